@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/access"
+	"github.com/spf13/cobra"
+)
+
+// readOnlyCommands are the commands users with the viewer role may run, by
+// path below the root command. A command not listed here may change something
+// and is refused. Where a flag makes the difference, the function reports
+// whether the command as invoked only reads.
+var readOnlyCommands = map[string]func(cmd *cobra.Command) bool{
+	"agent list":                 nil,
+	"alerts check":               nil,
+	"approval list":              nil,
+	"breakout routes":            nil,
+	"breakout show":              nil,
+	"ca show":                    nil,
+	"chaos status":               nil,
+	"cleanup":                    flagSet("dry-run"),
+	"client accounting":          nil,
+	"client accounting export":   nil,
+	"client invite list":         nil,
+	"client policy list":         nil,
+	"client sessions":            nil,
+	"completion":                 nil,
+	"config get":                 flagUnset("reveal"),
+	"config show":                nil,
+	"config validate":            nil,
+	"confirm status":             nil,
+	"crypto audit":               nil,
+	"crypto caps":                nil,
+	"crypto show":                nil,
+	"crypto test":                nil,
+	"discover":                   nil,
+	"discover dns":               func(cmd *cobra.Command) bool { return flagUnset("apply")(cmd) || flagSet("dry-run")(cmd) },
+	"events stream":              nil,
+	"fsck":                       flagUnset("repair"),
+	"gen-docs":                   nil,
+	"help":                       nil,
+	"history replay":             nil,
+	"history show":               nil,
+	"job show":                   nil,
+	"key list":                   nil,
+	"key show":                   nil,
+	"metrics generate-dashboard": nil,
+	"network app-route list":     nil,
+	"network multicast list":     nil,
+	"network schedule list":      nil,
+	"network schedule log":       nil,
+	"network show":               nil,
+	"path history":               nil,
+	"path show":                  nil,
+	"perf tune":                  flagUnset("apply"),
+	"peer-group show":            nil,
+	"report sla":                 nil,
+	"restconf openapi":           nil,
+	"restconf schema":            nil,
+	"security geoip":             nil,
+	"security show failures":     nil,
+	"selftest":                   nil,
+	"spiffe show":                nil,
+	"store status":               nil,
+	"tunnel apply":               anyFlagSet("dry-run", "render"),
+	"tunnel check-peer":          nil,
+	"tunnel debug show":          nil,
+	"tunnel export-peer":         nil,
+	"tunnel flows":               nil,
+	"tunnel keepalive":           nil,
+	"tunnel label":               argsAtMost(1),
+	"tunnel policy list":         nil,
+	"tunnel reauth":              nil,
+	"tunnel reconcile":           flagSet("dry-run"),
+	"tunnel sa-lifetime":         nil,
+	"tunnel shortcut list":       nil,
+	"tunnel shortcut scan":       flagUnset("offer"),
+	"tunnel show":                nil,
+	"tunnel sla":                 nil,
+	"tunnel stats":               nil,
+	"tunnel status":              nil,
+	"tunnel tune show":           nil,
+	"tunnel virtual-ip":          nil,
+	"uplinks show":               nil,
+	"vault status":               nil,
+	"version":                    nil,
+}
+
+// flagSet reports whether a boolean flag was given
+func flagSet(name string) func(cmd *cobra.Command) bool {
+	return func(cmd *cobra.Command) bool {
+		set, _ := cmd.Flags().GetBool(name)
+		return set
+	}
+}
+
+// anyFlagSet reports whether any of some boolean flags was given
+func anyFlagSet(names ...string) func(cmd *cobra.Command) bool {
+	return func(cmd *cobra.Command) bool {
+		for _, name := range names {
+			if flagSet(name)(cmd) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// flagUnset reports whether a boolean flag was left off
+func flagUnset(name string) func(cmd *cobra.Command) bool {
+	return func(cmd *cobra.Command) bool {
+		set, _ := cmd.Flags().GetBool(name)
+		return !set
+	}
+}
+
+// argsAtMost reports whether a command was given at most n arguments
+func argsAtMost(n int) func(cmd *cobra.Command) bool {
+	return func(cmd *cobra.Command) bool {
+		return cmd.Flags().NArg() <= n
+	}
+}
+
+// readOnly reports whether a command only reads
+func readOnly(cmd *cobra.Command) bool {
+	for c := cmd; c != nil; c = c.Parent() {
+		switch c.Name() {
+		case cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+			return true
+		}
+	}
+	path := strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+	check, ok := readOnlyCommands[path]
+	if !ok {
+		return false
+	}
+	return check == nil || check(cmd)
+}
+
+// authorize refuses commands that change something to users with the viewer role
+func authorize(cmd *cobra.Command) error {
+	if !access.Configured() || readOnly(cmd) {
+		return nil
+	}
+	u, err := access.CurrentUser()
+	if err != nil {
+		// The role cannot be told, so assume the lesser one
+		return access.Deny("an unknown user", "run '"+cmd.CommandPath()+"'")
+	}
+	if access.UserRole(u) == access.RoleViewer {
+		return access.Deny("user '"+u.Username+"'", "run '"+cmd.CommandPath()+"'; only show, status and diagnostic commands are allowed")
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/agent"
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/store"
+	"github.com/spf13/cobra"
+)
+
+// agentCmd represents the agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run a key agent that holds unlocked keys for this session",
+	Long: `Run a key agent in the foreground. The agent holds unlocked pre-shared keys
+and private keys in memory and answers derivation, decapsulation and signing
+requests over a Unix socket that only the current user can connect to. Keys
+sealed with a passphrase are unsealed once, by 'agent add', for the session.
+
+Point other commands at the agent with:
+  export ` + agent.SocketEnv + `=<socket>
+
+Tunnels with --psk-ref key://NAME then have their pre-shared key derived by the
+agent, and 'crypto decrypt-file --key-name' and 'key sign' use its keys. Set
+agent.socket for services, such as the RESTCONF server, to ask it too.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := agent.SocketPath()
+		a, err := agent.Listen(path)
+		if err != nil {
+			return fail("Error starting key agent: %v", err)
+		}
+
+		// Wipe keys on shutdown
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			a.Close()
+		}()
+
+		fmt.Printf("%s=%s; export %s\n", agent.SocketEnv, path, agent.SocketEnv)
+		err = a.Serve()
+		_ = os.Remove(path)
+		if err != nil {
+			return fail("Key agent failed: %v", err)
+		}
+		return nil
+	},
+}
+
+var agentAddCmd = &cobra.Command{
+	Use:   "add [name]...",
+	Short: "Unseal stored keys, or load a pre-shared key from Vault, into the agent",
+	Long: `Unseal stored keys into the agent. The passphrase of keys sealed with one is
+asked for once, for all the keys given, and only the agent keeps them unsealed.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		lifetime, _ := cmd.Flags().GetDuration("lifetime")
+		vaultRef, _ := cmd.Flags().GetString("vault")
+		passphraseFile, _ := cmd.Flags().GetString("passphrase-file")
+		if vaultRef != "" && len(args) > 1 {
+			return fail("Error: --vault loads a single key")
+		}
+
+		var passphrase []byte
+		if vaultRef == "" {
+			for _, name := range args {
+				if key, err := keys.Get(name); err == nil && key.SealedWith() == store.MethodPassphrase {
+					p, err := readPassphrase("Passphrase: ", passphraseFile)
+					if err != nil {
+						return fail("Error reading passphrase: %v", err)
+					}
+					passphrase = p
+					break
+				}
+			}
+			defer crypto.Zeroize(passphrase)
+		}
+
+		client, err := agent.Dial(agent.SocketPath())
+		if err != nil {
+			return fail("Error connecting to key agent: %v", err)
+		}
+		defer client.Close()
+
+		for _, name := range args {
+			if vaultRef != "" {
+				err = client.AddFromVault(name, vaultRef, lifetime)
+			} else {
+				err = client.Add(name, passphrase, lifetime)
+			}
+			if err != nil {
+				return fail("Error adding key '%s' to agent: %v", name, err)
+			}
+
+			logger.Info("Key '%s' added to agent", name)
+			fmt.Printf("Key '%s' added to agent\n", name)
+		}
+		return nil
+	},
+}
+
+var agentListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List keys held by the agent",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := agent.Dial(agent.SocketPath())
+		if err != nil {
+			return fail("Error connecting to key agent: %v", err)
+		}
+		defer client.Close()
+
+		held, err := client.List()
+		if err != nil {
+			return fail("Error listing agent keys: %v", err)
+		}
+
+		if len(held) == 0 {
+			fmt.Println("The agent has no keys")
+			return nil
+		}
+
+		fmt.Println("Agent keys:")
+		for _, k := range held {
+			expires := "never"
+			if !k.Expires.IsZero() {
+				expires = k.Expires.String()
+			}
+			source := ""
+			if k.Source != "" {
+				source = ", from " + k.Source
+			}
+			fmt.Printf("- %s: %s %s %s (expires %s%s)\n", k.Name, k.Type, k.Algorithm, k.Fingerprint, expires, source)
+		}
+		return nil
+	},
+}
+
+var agentRemoveCmd = &cobra.Command{
+	Use:   "remove [name]",
+	Short: "Wipe a key from the agent",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+
+		client, err := agent.Dial(agent.SocketPath())
+		if err != nil {
+			return fail("Error connecting to key agent: %v", err)
+		}
+		defer client.Close()
+
+		if err := client.Remove(name); err != nil {
+			return fail("Error removing key '%s' from agent: %v", name, err)
+		}
+
+		logger.Info("Key '%s' removed from agent", name)
+		fmt.Printf("Key '%s' removed from agent\n", name)
+		return nil
+	},
+}
+
+func init() {
+	// Add subcommands to agent command
+	agentCmd.AddCommand(agentAddCmd)
+	agentCmd.AddCommand(agentListCmd)
+	agentCmd.AddCommand(agentRemoveCmd)
+
+	// Flags for add command
+	agentAddCmd.Flags().String("vault", "", "Load a pre-shared key from Vault instead, given as <path>[#field] in vault.kv_mount")
+	agentAddCmd.Flags().Duration("lifetime", 0, "Remove the key from the agent after this long (default until the agent exits)")
+	agentAddCmd.Flags().String("passphrase-file", "", "Read the passphrase of keys sealed with one from a file instead of the terminal")
+}
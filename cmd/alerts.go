@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/alert"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// alertsCmd represents the alerts command
+var alertsCmd = &cobra.Command{
+	Use:   "alerts",
+	Short: "Alert on tunnel outages, probe loss and failures without Prometheus",
+	Long: `Check the rules in alerts.rules against every tunnel and notify the hooks, webhooks
+and email recipients in alerts.hooks, alerts.webhooks and alerts.email when an alert
+fires and when it is resolved. Rules are written as '<condition> > <value>':
+
+  down > 2m         The tunnel has been down or in error for over 2 minutes
+  loss > 5%         The last SLA probe operation lost over 5% of its probes
+  latency > 150ms   The last SLA probe operation's mean round-trip time is over 150ms
+  jitter > 30ms     The last SLA probe operation's jitter is over 30ms
+  failures > 3/h    The tunnel failed, e.g. to negotiate or rekey, over 3 times in an hour
+
+Tunnels stopped with 'ipsec-vpn tunnel stop' are not alerted on. SLA rules need
+'ipsec-vpn tunnel sla run' to be probing the tunnel.`,
+}
+
+var alertsRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Evaluate alert rules and send alerts in the foreground",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		interval := viper.GetInt("alerts.interval")
+		if cmd.Flags().Changed("interval") {
+			interval, _ = cmd.Flags().GetInt("interval")
+		}
+		if interval <= 0 {
+			return fail("Error: the interval must be a positive number of seconds")
+		}
+		rules, err := alert.Rules()
+		if err != nil {
+			return fail("Error reading alert rules: %v", err)
+		}
+		if len(rules) == 0 {
+			return fail("Error: no alert rules configured, set alerts.rules")
+		}
+		notifiers := alert.Notifiers()
+		if len(notifiers) == 0 {
+			logger.Info("No hooks, webhooks or email configured, alerts are only logged")
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+
+		// Alerts being sent are finished before exiting
+		var sending sync.WaitGroup
+		defer sending.Wait()
+
+		engine := alert.NewEngine(rules)
+		logger.Info("Evaluating %d alert rules every %d seconds", len(rules), interval)
+		for {
+			tunnels, err := tunnel.ListAll()
+			if err != nil {
+				logger.Error("Error listing tunnels: %v", err)
+			} else {
+				for _, a := range engine.Evaluate(tunnels, time.Now()) {
+					if a.State == alert.StateFiring {
+						logger.Error("Alert: %s", a.Subject())
+					} else {
+						logger.Info("Alert: %s", a.Subject())
+					}
+					sending.Add(1)
+					go func(a alert.Alert) {
+						defer sending.Done()
+						alert.Notify(notifiers, a)
+					}(a)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-sigs:
+				return nil
+			}
+		}
+	},
+}
+
+var alertsCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Show the alert rules each tunnel matches now, without sending alerts",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rules, err := alert.Rules()
+		if err != nil {
+			return fail("Error reading alert rules: %v", err)
+		}
+		tunnels, err := tunnel.ListAll()
+		if err != nil {
+			return fail("Error listing tunnels: %v", err)
+		}
+
+		engine := alert.NewEngine(rules)
+		engine.Evaluate(tunnels, time.Now())
+		firing := engine.Firing()
+		if len(firing) == 0 {
+			fmt.Printf("No alerts, %d rules checked against %d tunnels\n", len(rules), len(tunnels))
+			return nil
+		}
+		tbl := table.New(
+			table.Column{Header: "TUNNEL", MaxWidth: 24},
+			table.Column{Header: "RULE"},
+			table.Column{Header: "VALUE", MaxWidth: 60},
+		)
+		for _, a := range firing {
+			tbl.AddRow(a.Tunnel, a.Rule, a.Value)
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var alertsTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Send a test alert to each hook, webhook and email recipient",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		notifiers := alert.Notifiers()
+		if len(notifiers) == 0 {
+			return fail("Error: no hooks, webhooks or email configured, set alerts.hooks, alerts.webhooks or alerts.email")
+		}
+
+		host, _ := os.Hostname()
+		now := time.Now()
+		a := alert.Alert{Rule: "test", Tunnel: "-", State: alert.StateFiring, Value: "test alert from ipsec-vpn",
+			Host: host, Since: now, Time: now}
+		a.Text = a.Subject()
+		failed := alert.NotifyAll(notifiers, a)
+		for _, n := range notifiers {
+			if err, ok := failed[n]; ok {
+				fmt.Printf("%s: %v\n", n, err)
+			} else {
+				fmt.Printf("%s: ok\n", n)
+			}
+		}
+		if len(failed) > 0 {
+			return fail("Error: %d of %d notifiers failed", len(failed), len(notifiers))
+		}
+		return nil
+	},
+}
+
+func init() {
+	alertsCmd.AddCommand(alertsRunCmd)
+	alertsCmd.AddCommand(alertsCheckCmd)
+	alertsCmd.AddCommand(alertsTestCmd)
+
+	alertsRunCmd.Flags().Int("interval", 0, "Seconds between evaluations, overriding alerts.interval (default 30)")
+	alertsCheckCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+}
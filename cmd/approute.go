@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// networkAppRouteCmd represents the network app-route command
+var networkAppRouteCmd = &cobra.Command{
+	Use:   "app-route",
+	Short: "Send the traffic of certain applications through a tunnel",
+	Long: `Application routes send all traffic of some local processes through a tunnel,
+whatever its destination, while other traffic is routed as usual: for example,
+only the backup daemon's traffic goes through the tunnel. A route selects the
+processes of a user, as uid:backup or uid:1001, or those of a cgroup v2, as
+cgroup:system.slice/restic.service for a systemd service. Their packets are
+given a firewall mark by nft, and a policy routing rule sends marked packets
+through the tunnel interface. The routes are in place while the tunnel is up.`,
+}
+
+var networkAppRouteAddCmd = &cobra.Command{
+	Use:   "add [tunnel] [route...]",
+	Short: "Send the traffic of applications through a tunnel",
+	Long: `Send the traffic of applications through a tunnel. A cgroup must exist when the
+routes are installed, as the tunnel comes up; a service restarted in a new
+cgroup needs them installed again, with 'tunnel stop' and 'tunnel start'.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		tun, err := tunnel.Get(name)
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+
+		routes := tun.AppRoutes
+		var added []string
+		for _, arg := range args[1:] {
+			route, err := tunnel.ParseAppRoute(arg)
+			if err != nil {
+				return fail("Error: %v", err)
+			}
+			if !slices.Contains(routes, route) {
+				routes = append(routes, route)
+				added = append(added, route.String())
+			}
+		}
+		if err := setAppRoutes(name, routes); err != nil || len(added) == 0 {
+			return err
+		}
+		undo := append([]string{"network", "app-route", "remove", name}, added...)
+		return armConfirm(cmd, fmt.Sprintf("the application routes %s through tunnel '%s'", strings.Join(added, ", "), name), undo...)
+	},
+}
+
+var networkAppRouteRemoveCmd = &cobra.Command{
+	Use:   "remove [tunnel] [route...]",
+	Short: "Route the traffic of applications as usual again",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		tun, err := tunnel.Get(name)
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+
+		routes := slices.Clone(tun.AppRoutes)
+		for _, arg := range args[1:] {
+			route, err := tunnel.ParseAppRoute(arg)
+			if err != nil {
+				return fail("Error: %v", err)
+			}
+			i := slices.Index(routes, route)
+			if i < 0 {
+				return fail("Error: tunnel '%s' has no application route %s", name, route)
+			}
+			routes = slices.Delete(routes, i, i+1)
+		}
+		return setAppRoutes(name, routes)
+	},
+}
+
+var networkAppRouteClearCmd = &cobra.Command{
+	Use:   "clear [tunnel]",
+	Short: "Remove all application routes of a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setAppRoutes(args[0], nil)
+	},
+}
+
+var networkAppRouteListCmd = &cobra.Command{
+	Use:   "list [tunnel]",
+	Short: "List the application routes of a tunnel, or of every tunnel",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var tunnels []*tunnel.Tunnel
+		if len(args) == 1 {
+			tun, err := tunnel.Get(args[0])
+			if err != nil {
+				return fail("Error getting tunnel '%s': %v", args[0], err)
+			}
+			tunnels = append(tunnels, tun)
+		} else {
+			all, err := tunnel.ListAll()
+			if err != nil {
+				return fail("Error listing tunnels: %v", err)
+			}
+			for _, tun := range all {
+				if len(tun.AppRoutes) > 0 {
+					tunnels = append(tunnels, tun)
+				}
+			}
+		}
+
+		type appRoute struct {
+			Tunnel string `json:"tunnel"`
+			Route  string `json:"route"`
+			Active bool   `json:"active"`
+		}
+		var routes []appRoute
+		for _, tun := range tunnels {
+			for _, r := range tun.AppRoutes {
+				routes = append(routes, appRoute{tun.Name, r.String(), tun.Status == tunnel.StatusUp})
+			}
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, routes)
+		}
+		if len(routes) == 0 {
+			fmt.Println("No application routes")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "TUNNEL"},
+			table.Column{Header: "STATE", Status: true},
+			table.Column{Header: "ROUTE", MaxWidth: 60},
+		)
+		for _, r := range routes {
+			state := "INACTIVE"
+			if r.Active {
+				state = "ACTIVE"
+			}
+			tbl.AddRow(r.Tunnel, state, r.Route)
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+// setAppRoutes replaces the application routes of a tunnel
+func setAppRoutes(name string, routes []tunnel.AppRoute) error {
+	if err := tunnel.SetAppRoutes(name, routes); err != nil {
+		return fail("Error setting application routes of tunnel '%s': %v", name, err)
+	}
+
+	logger.Info("Application routes of tunnel '%s' set to %s", name, appRouteSummary(routes))
+	fmt.Printf("Application routes of tunnel '%s': %s\n", name, appRouteSummary(routes))
+	return nil
+}
+
+// appRouteSummary lists application routes on one line
+func appRouteSummary(routes []tunnel.AppRoute) string {
+	if len(routes) == 0 {
+		return "none"
+	}
+	parts := make([]string, len(routes))
+	for i, r := range routes {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func init() {
+	networkCmd.AddCommand(networkAppRouteCmd)
+	networkAppRouteCmd.AddCommand(networkAppRouteAddCmd)
+	networkAppRouteCmd.AddCommand(networkAppRouteRemoveCmd)
+	networkAppRouteCmd.AddCommand(networkAppRouteClearCmd)
+	networkAppRouteCmd.AddCommand(networkAppRouteListCmd)
+
+	addConfirmFlag(networkAppRouteAddCmd)
+	networkAppRouteListCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	networkAppRouteListCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+}
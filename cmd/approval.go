@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/access"
+	"github.com/dzakwan/ipsec-vpn/pkg/approval"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/spf13/cobra"
+)
+
+// approvalCmd represents the approval command
+var approvalCmd = &cobra.Command{
+	Use:   "approval",
+	Short: "Approve destructive operations under the two-person rule",
+	Long: `With approval.required set, destructive operations (deleting a tunnel or key,
+applying the breakout routes, and cleanup) are not carried out when first run.
+A request for the operation is recorded instead, which another operator
+approves with 'ipsec-vpn approval approve ID'; the operation is then run again
+with --approval ID. Each approval is used up by the operation it was given for,
+and requests expire after approval.expiry seconds.
+
+RESTCONF clients take part through the ipsec-vpn:approve operation and the
+Ipsec-Vpn-Approval header.`,
+}
+
+var approvalListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the requests awaiting approval or use",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		requests, err := approval.List()
+		if err != nil {
+			return fail("Error listing approval requests: %v", err)
+		}
+		if len(requests) == 0 {
+			fmt.Println("No approval requests")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "ID"},
+			table.Column{Header: "OPERATION", MaxWidth: 50},
+			table.Column{Header: "REQUESTED BY", MaxWidth: 24},
+			table.Column{Header: "APPROVED BY", MaxWidth: 24},
+			table.Column{Header: "EXPIRES"},
+		)
+		for _, r := range requests {
+			tbl.AddRow(r.ID, r.Operation, r.RequestedBy, orDash(r.ApprovedBy), r.Expires.Format(time.DateTime))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var approvalApproveCmd = &cobra.Command{
+	Use:   "approve [id]",
+	Short: "Approve a request made by another operator",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := approval.Approve(args[0], currentUserName())
+		if err != nil {
+			return fail("Error approving request %s: %v", args[0], err)
+		}
+		logger.Info("%s approved request %s by %s to %s", r.ApprovedBy, r.ID, r.RequestedBy, r.Operation)
+		fmt.Printf("Approved request %s by %s to %s\n", r.ID, r.RequestedBy, r.Operation)
+		fmt.Printf("It can be used with --approval %s until %s\n", r.ID, r.Expires.Format(time.DateTime))
+		return nil
+	},
+}
+
+var approvalRejectCmd = &cobra.Command{
+	Use:   "reject [id]",
+	Short: "Reject or withdraw a request",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := approval.Reject(args[0])
+		if err != nil {
+			return fail("Error rejecting request %s: %v", args[0], err)
+		}
+		logger.Info("%s rejected request %s by %s to %s", currentUserName(), r.ID, r.RequestedBy, r.Operation)
+		fmt.Printf("Rejected request %s to %s\n", r.ID, r.Operation)
+		return nil
+	},
+}
+
+// addApprovalFlag lets destructive commands be run with an approved request
+func addApprovalFlag(cmds ...*cobra.Command) {
+	for _, c := range cmds {
+		c.Flags().String("approval", "", "ID of the approved request for this operation, when approval.required is set")
+	}
+}
+
+// approved reports whether cmd may carry out a destructive operation under the
+// two-person rule. If no approved request was given, one is submitted and the
+// user is told how to get it approved.
+func approved(cmd *cobra.Command, operation string) error {
+	id, _ := cmd.Flags().GetString("approval")
+	err := approval.Check(id, operation, currentUserName())
+	var pending *approval.PendingError
+	if errors.As(err, &pending) {
+		logger.Info("%s requested approval to %s as %s", pending.Request.RequestedBy, operation, pending.Request.ID)
+		fmt.Printf("Approval is required to %s, requested as %s\n", operation, pending.Request.ID)
+		fmt.Printf("Ask another operator to run 'ipsec-vpn approval approve %s', then run this command again with --approval %s\n",
+			pending.Request.ID, pending.Request.ID)
+		return errFailed
+	}
+	if err != nil {
+		return fail("Error: %v", err)
+	}
+	if id != "" {
+		logger.Info("Running approved request %s to %s", id, operation)
+	}
+	return nil
+}
+
+// currentUserName names the user running a command in approval requests
+func currentUserName() string {
+	u, err := access.CurrentUser()
+	if err != nil {
+		return "uid " + strconv.Itoa(os.Getuid())
+	}
+	return u.Username
+}
+
+func init() {
+	approvalCmd.AddCommand(approvalListCmd)
+	approvalCmd.AddCommand(approvalApproveCmd)
+	approvalCmd.AddCommand(approvalRejectCmd)
+
+	// Flags for list command
+	approvalListCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+}
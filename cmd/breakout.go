@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/breakout"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// breakoutCmd represents the breakout command
+var breakoutCmd = &cobra.Command{
+	Use:   "breakout",
+	Short: "Send traffic to chosen destinations around the VPN",
+	Long: `Local breakout sends the traffic to the prefixes of the lists under
+breakout.lists straight out of breakout.interface, through breakout.gateway,
+even when a default route goes through a tunnel: the breakout routes are more
+specific, so they win. Lists hold static prefixes, a feed URL, or both. Feeds are
+plain text, one prefix per line, or the JSON of the Microsoft 365 endpoints web
+service, of which the Optimize category is used. Fetched feeds are cached, so a
+feed that cannot be reached keeps its last prefixes. Run "breakout apply" from
+cron to follow the feeds.`,
+}
+
+var breakoutShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the prefix lists, without fetching their feeds",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		lists, err := breakout.Lists()
+		if err != nil {
+			return fail("Error reading prefix lists: %v", err)
+		}
+		if len(lists) == 0 {
+			fmt.Println("No prefix lists configured")
+			return nil
+		}
+		printBreakoutResults(cmd, lists, nil)
+		return nil
+	},
+}
+
+var breakoutApplyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Fetch the feeds and install the breakout routes",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		offline, _ := cmd.Flags().GetBool("offline")
+		if err := approved(cmd, "apply the breakout routes"); err != nil {
+			return err
+		}
+		before, err := network.ListBreakoutRoutes()
+		if err != nil {
+			return fail("Error listing breakout routes: %v", err)
+		}
+		results, added, removed, err := breakout.Apply(offline)
+		if err != nil {
+			return fail("Error applying breakout routes: %v", err)
+		}
+		printBreakoutResults(cmd, nil, results)
+
+		logger.Info("Breakout routes through %s: %d added, %d removed", viper.GetString("breakout.interface"), added, removed)
+		fmt.Printf("Breakout routes through %s: %d added, %d removed\n", viper.GetString("breakout.interface"), added, removed)
+		if len(before) == 0 && added > 0 {
+			if err := armConfirm(cmd, "the breakout routes", "breakout", "clear"); err != nil {
+				return err
+			}
+		}
+		for _, r := range results {
+			if r.Err != nil {
+				return errFailed
+			}
+		}
+		return nil
+	},
+}
+
+var breakoutRoutesCmd = &cobra.Command{
+	Use:   "routes",
+	Short: "List the installed breakout routes",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		routes, err := network.ListBreakoutRoutes()
+		if err != nil {
+			return fail("Error listing breakout routes: %v", err)
+		}
+		if len(routes) == 0 {
+			fmt.Println("No breakout routes installed")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "DESTINATION", MaxWidth: 45},
+			table.Column{Header: "GATEWAY", MaxWidth: 40},
+			table.Column{Header: "INTERFACE"},
+		)
+		for _, r := range routes {
+			gateway := r.Gateway
+			if gateway == "" {
+				gateway = "-"
+			}
+			tbl.AddRow(r.Destination, gateway, r.Interface)
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var breakoutClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Remove every breakout route",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		n, err := breakout.Clear()
+		if err != nil {
+			return fail("Error removing breakout routes: %v", err)
+		}
+
+		logger.Info("Removed %d breakout routes", n)
+		fmt.Printf("Removed %d breakout routes\n", n)
+		return nil
+	},
+}
+
+// printBreakoutResults shows prefix lists as a table, resolving them from the
+// cache unless results are given
+func printBreakoutResults(cmd *cobra.Command, lists []breakout.List, results []breakout.Result) {
+	for _, l := range lists {
+		results = append(results, breakout.LoadCached(l))
+	}
+
+	tbl := table.New(
+		table.Column{Header: "NAME"},
+		table.Column{Header: "SOURCE"},
+		table.Column{Header: "PREFIXES"},
+		table.Column{Header: "UPDATED"},
+		table.Column{Header: "FEED", MaxWidth: 50, Wide: true},
+		table.Column{Header: "ERROR", MaxWidth: 50},
+	)
+	for _, r := range results {
+		updated := "-"
+		if !r.Updated.IsZero() {
+			updated = r.Updated.Format(time.DateTime)
+		}
+		source := r.Source
+		if r.Err != nil && len(r.Prefixes) == 0 {
+			source = "FAIL"
+		}
+		errText := ""
+		if r.Err != nil {
+			errText = r.Err.Error()
+		}
+		tbl.AddRow(r.List.Name, source, strconv.Itoa(len(r.Prefixes)), updated, r.List.URL, errText)
+	}
+	tbl.Render(os.Stdout, tableOptions(cmd))
+}
+
+func init() {
+	breakoutCmd.AddCommand(breakoutShowCmd)
+	breakoutCmd.AddCommand(breakoutApplyCmd)
+	breakoutCmd.AddCommand(breakoutRoutesCmd)
+	breakoutCmd.AddCommand(breakoutClearCmd)
+
+	// Flags for show command
+	breakoutShowCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+
+	// Flags for apply command
+	breakoutApplyCmd.Flags().Bool("offline", false, "Use the cached feeds instead of fetching them")
+	breakoutApplyCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	addConfirmFlag(breakoutApplyCmd)
+	addApprovalFlag(breakoutApplyCmd)
+
+	// Flags for routes command
+	breakoutRoutesCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+}
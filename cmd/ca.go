@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/ca"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/spf13/cobra"
+)
+
+// caTimeout bounds a one-off enrollment
+const caTimeout = 30 * time.Second
+
+// caCmd represents the ca command
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Issue short-lived certificates from a hub to its spokes",
+	Long: `Run a small certificate authority on a hub that issues certificates valid for
+ca.validity (24 hours by default) to its spokes over the RESTCONF management
+channel. Spokes renew them after two thirds of their lifetime, so a spoke that is
+decommissioned or compromised loses access within a day by no longer being
+allowed to renew, without CRLs or an OCSP responder.
+
+The hub runs 'ca init' once and 'restconf serve'. A spoke enrolls with
+'ca enroll', authenticated by a certificate from the hub's restconf.client_ca the
+first time and by the certificate it was last issued afterwards.`,
+}
+
+var caInitCmd = &cobra.Command{
+	Use:   "init [common-name]",
+	Short: "Create the certificate authority of a hub",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		commonName := "ipsec-vpn CA"
+		if len(args) > 0 {
+			commonName = args[0]
+		} else if host, err := os.Hostname(); err == nil {
+			commonName = host + " ipsec-vpn CA"
+		}
+		authority, err := ca.Init(commonName)
+		if err != nil {
+			return fail("Error creating certificate authority: %v", err)
+		}
+		dir, _ := ca.Dir()
+		logger.Info("Created certificate authority %s", commonName)
+		fmt.Printf("Created certificate authority '%s' in %s\n", commonName, dir)
+		printAuthority(authority)
+		return nil
+	},
+}
+
+var caShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the certificate authority of a hub",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		authority, err := ca.Load()
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		pem, _ := cmd.Flags().GetBool("pem")
+		if pem {
+			fmt.Print(authority.CertificatePEM)
+			return nil
+		}
+		printAuthority(authority)
+		return nil
+	},
+}
+
+var caIssueCmd = &cobra.Command{
+	Use:   "issue [common-name]",
+	Short: "Issue a certificate from the hub's certificate authority",
+	Long: `Issue a certificate for a common name with a newly generated key, valid for
+ca.validity, e.g. for the hub itself. Spokes are issued theirs by 'ca enroll'.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, _ := cmd.Flags().GetString("out")
+		authority, err := ca.Load()
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		cert, err := authority.IssueKey(args[0], ca.Validity())
+		if err != nil {
+			return fail("Error issuing certificate for %s: %v", args[0], err)
+		}
+		if out != "" {
+			if err := writeCertificate(out, cert.CertificatePEM, cert.PrivateKeyPEM, cert.CAPEM); err != nil {
+				return fail("Error writing certificate: %v", err)
+			}
+		}
+		logger.Info("Issued certificate %s for %s", cert.SerialNumber, args[0])
+		printCertificate(cert.Certificate, cert.SerialNumber, out)
+		return nil
+	},
+}
+
+var caEnrollCmd = &cobra.Command{
+	Use:   "enroll",
+	Short: "Have the hub issue this spoke a certificate",
+	Long: `Generate a key and have the hub at ca.hub issue a certificate for it through
+RESTCONF. The common name is the one the hub authenticated the spoke as. The
+certificate, private key and CA certificate are written to cert.pem, key.pem and
+ca.pem in --out. With --renew, the command keeps running and enrolls again after
+two thirds of each certificate's lifetime.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, _ := cmd.Flags().GetString("out")
+		renew, _ := cmd.Flags().GetBool("renew")
+
+		client, err := ca.ClientFromConfig(out)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+
+		if !renew {
+			ctx, cancel := context.WithTimeout(cmd.Context(), caTimeout)
+			defer cancel()
+			cert, err := client.Enroll(ctx)
+			if err != nil {
+				return fail("Error enrolling with the hub: %v", err)
+			}
+			if err := writeCertificate(out, cert.CertificatePEM, cert.PrivateKeyPEM, cert.CAPEM); err != nil {
+				return fail("Error writing certificate: %v", err)
+			}
+			printCertificate(cert.Certificate, cert.SerialNumber, out)
+			return nil
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		_ = client.WatchCertificate(ctx, func(cert *ca.Certificate) {
+			if err := writeCertificate(out, cert.CertificatePEM, cert.PrivateKeyPEM, cert.CAPEM); err != nil {
+				logger.Error("Failed to write certificate: %v", err)
+				return
+			}
+			printCertificate(cert.Certificate, cert.SerialNumber, out)
+		})
+		return nil
+	},
+}
+
+// printAuthority prints a summary of the certificate authority
+func printAuthority(authority *ca.CA) {
+	cert := authority.Certificate
+	fingerprint := fmt.Sprintf("% X", sha256.Sum256(cert.Raw))
+	fmt.Printf("Subject: %s\n", cert.Subject)
+	fmt.Printf("Valid: %s to %s\n", cert.NotBefore.Format(time.DateTime), cert.NotAfter.Format(time.DateTime))
+	fmt.Printf("SHA-256: %s\n", strings.ReplaceAll(fingerprint, " ", ":"))
+	fmt.Printf("Issues certificates valid for: %s\n", ca.Validity())
+}
+
+func init() {
+	caCmd.AddCommand(caInitCmd)
+	caCmd.AddCommand(caShowCmd)
+	caCmd.AddCommand(caIssueCmd)
+	caCmd.AddCommand(caEnrollCmd)
+
+	// Flags for show command
+	caShowCmd.Flags().Bool("pem", false, "Print the CA certificate in PEM, to distribute to peers")
+
+	// Flags for issue command
+	caIssueCmd.Flags().String("out", "", "Write cert.pem, key.pem and ca.pem to this directory")
+
+	// Flags for enroll command
+	caEnrollCmd.Flags().String("out", "", "Directory to write cert.pem, key.pem and ca.pem to")
+	caEnrollCmd.Flags().Bool("renew", false, "Keep running and renew the certificate before it expires")
+	caEnrollCmd.MarkFlagRequired("out")
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/fault"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/spf13/cobra"
+)
+
+// chaosCmd represents the chaos command
+var chaosCmd = &cobra.Command{
+	Use:   "chaos",
+	Short: "Inject faults for resilience testing in staging",
+	Long: `Inject faults, so that HA failover, retries and repairs can be seen to cope
+before a rollout to production: drop a share of the IKE packets, delay each
+netlink operation on tunnels or corrupt a share of the traffic counter reads.
+
+Faults only take effect on hosts whose system configuration file,
+/etc/ipsec-vpn/.ipsec-vpn.yaml, sets advanced.fault_injection, which production
+configurations must leave off, and end on their own after --for. Every ipsec-vpn process picks them up, including
+a RESTCONF server or agent that is already running. This command is hidden
+from help for that reason.`,
+	Hidden: true,
+}
+
+var chaosSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Start injecting faults, replacing those injected",
+	Example: `  # Drop 20% of IKE packets and add 500ms to netlink operations for 30 minutes
+  ipsec-vpn chaos set --drop-ike 20 --netlink-delay 500ms --for 30m`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		duration, _ := cmd.Flags().GetDuration("for")
+		if duration <= 0 {
+			return fail("Error: --for must be positive")
+		}
+		f := fault.Faults{Until: time.Now().Add(duration)}
+		f.DropIKE, _ = cmd.Flags().GetInt("drop-ike")
+		f.NetlinkDelay, _ = cmd.Flags().GetDuration("netlink-delay")
+		f.CorruptCounters, _ = cmd.Flags().GetInt("corrupt-counters")
+		if f.None() {
+			return fail("Error: set --drop-ike, --netlink-delay or --corrupt-counters")
+		}
+
+		prev, _ := fault.Load()
+		if err := fault.Set(f); err != nil {
+			return fail("Error injecting faults: %v", err)
+		}
+		if f.DropIKE > 0 || prev.DropIKE > 0 {
+			if err := network.DropIKE(f.DropIKE, duration); err != nil {
+				_, _ = fault.Clear()
+				return fail("Error injecting faults: %v", err)
+			}
+		}
+		logger.Info("Injecting faults until %s: %s", f.Until.Format(time.RFC3339), f)
+		fmt.Printf("Injecting faults until %s: %s\n", f.Until.Format(time.DateTime), f)
+		return nil
+	},
+}
+
+var chaosStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the faults injected",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := fault.Load()
+		if err != nil {
+			return fail("Error reading faults: %v", err)
+		}
+		active := fault.Active()
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, struct {
+				fault.Faults
+				Enabled bool `json:"enabled"`
+				Active  bool `json:"active"`
+			}{f, fault.Enabled(), !active.None()})
+		}
+		switch {
+		case f.None():
+			fmt.Println("No faults injected")
+		case !fault.Enabled():
+			fmt.Printf("Faults set but not injected, advanced.fault_injection is off: %s\n", f)
+		case active.None():
+			fmt.Printf("Faults ended at %s: %s\n", f.Until.Format(time.DateTime), f)
+		default:
+			fmt.Printf("Injecting faults for %s (until %s): %s\n",
+				time.Until(f.Until).Round(time.Second), f.Until.Format(time.DateTime), f)
+		}
+		return nil
+	},
+}
+
+var chaosClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Stop injecting faults",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		prev, _ := fault.Load()
+		cleared, err := fault.Clear()
+		if err != nil {
+			return fail("Error clearing faults: %v", err)
+		}
+		if prev.DropIKE > 0 {
+			if err := network.DropIKE(0, 0); err != nil {
+				return fail("Error clearing faults: %v", err)
+			}
+		}
+		if !cleared {
+			fmt.Println("No faults injected")
+			return nil
+		}
+		logger.Info("Stopped injecting faults: %s", prev)
+		fmt.Println("Stopped injecting faults")
+		return nil
+	},
+}
+
+func init() {
+	chaosCmd.AddCommand(chaosSetCmd)
+	chaosCmd.AddCommand(chaosStatusCmd)
+	chaosCmd.AddCommand(chaosClearCmd)
+
+	chaosSetCmd.Flags().Int("drop-ike", 0, "Percent of the IKE packets to drop, on UDP ports 500 and 4500")
+	chaosSetCmd.Flags().Duration("netlink-delay", 0, "Delay to add to each netlink operation on tunnels, e.g. 500ms")
+	chaosSetCmd.Flags().Int("corrupt-counters", 0, "Percent of the traffic counter reads to corrupt")
+	chaosSetCmd.Flags().Duration("for", time.Hour, "How long to inject the faults")
+	chaosStatusCmd.Flags().Bool("json", false, "Print machine-readable JSON")
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// cleanupCmd represents the cleanup command
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Remove kernel resources left behind by deleted tunnels",
+	Long: `Find the kernel resources ipsec-vpn created for tunnels that are no longer
+configured, and remove them:
+
+  interface     GRE (gre-<tunnel>) and WireGuard (wg-<tunnel>) interfaces, in
+                the default namespace or one a tunnel uses
+  namespace     Dedicated network namespaces (ipsec-<tunnel>); one that holds
+                interfaces ipsec-vpn did not create is left alone
+  xfrm-policy   Traffic-policy XFRM policies, recognised by their priorities,
+                that match no tunnel's allow-list
+  route         Kill-switch blackhole routes, recognised by their metric, to
+                subnets that are no tunnel's remote subnet
+
+Nothing is removed while a tunnel file cannot be loaded; run fsck first. With
+--dry-run, the resources are listed but left in place.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		leftovers, err := tunnel.Leftovers()
+		if err != nil {
+			return fail("Error finding leftover resources: %v", err)
+		}
+		if len(leftovers) == 0 {
+			fmt.Println("Nothing to clean up")
+			return nil
+		}
+
+		if !dryRun {
+			if err := approved(cmd, "remove leftover kernel resources"); err != nil {
+				return err
+			}
+		}
+
+		tbl := table.New(
+			table.Column{Header: "KIND"},
+			table.Column{Header: "RESOURCE", MaxWidth: 50},
+			table.Column{Header: "REASON", MaxWidth: 50},
+			table.Column{Header: "ACTION", MaxWidth: 40},
+		)
+		failed := 0
+		for _, l := range leftovers {
+			action := "would remove"
+			if !dryRun {
+				if err := l.Remove(); err != nil {
+					logger.Error("Failed to remove %s %s: %v", l.Kind, l.Name, err)
+					action = "FAILED: " + err.Error()
+					failed++
+				} else {
+					logger.Info("Removed %s %s: %s", l.Kind, l.Name, l.Reason)
+					action = "removed"
+				}
+			}
+			tbl.AddRow(l.Kind, l.Name, l.Reason, action)
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+
+		if failed > 0 {
+			return errFailed
+		}
+		return nil
+	},
+}
+
+func init() {
+	cleanupCmd.Flags().Bool("dry-run", false, "List the leftover resources without removing them")
+	cleanupCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	addApprovalFlag(cleanupCmd)
+}
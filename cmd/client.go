@@ -0,0 +1,603 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/invite"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/qr"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// clientCmd represents the client command
+var clientCmd = &cobra.Command{
+	Use:   "client",
+	Short: "Connect road warriors to a responder with native VPN clients",
+	Long: `Road warriors, laptops and phones of users away from the office, connect to a
+responder that accepts certificates of the hub's certificate authority (created
+with --remote-ip %any --peer-ca hub) and gives them a virtual IP, with the IKEv2
+client built into their operating system.`,
+}
+
+var clientProfileCmd = &cobra.Command{
+	Use:   "profile [user]",
+	Short: "Write a VPN profile that native clients import",
+	Long: `Issue a certificate to a user from the hub's certificate authority and write a
+ready-to-import VPN profile with it, the CA certificate, the server address and
+the proposals of the responder: an Apple configuration profile for iOS and macOS
+(mobileconfig), a PowerShell script for Windows that imports the certificate and
+adds the connection (powershell), or a profile for the strongSwan VPN Client on
+Android (strongswan-android). The user is the IKE identity of the client, such
+as alice@example.com, and must match the responder's peer ID pattern.
+
+Native clients cannot renew their certificate, which is valid for --validity:
+give the user a new profile before it expires. The profile carries the private
+key, so hand it over a trusted channel.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := profileOptions(cmd)
+		out, _ := cmd.Flags().GetString("out")
+
+		profile, err := tunnel.ClientProfile(args[0], opts)
+		if err != nil {
+			return fail("Error writing the profile of %s: %v", args[0], err)
+		}
+		logger.Info("Issued certificate %s for %s in a %s profile for responder %s", profile.Serial, args[0], opts.Format, profile.Responder)
+
+		if out == "" {
+			os.Stdout.Write(profile.Data)
+		} else if err := os.WriteFile(out, profile.Data, 0600); err != nil {
+			return fail("Error writing the profile: %v", err)
+		} else {
+			fmt.Printf("Wrote the %s profile of %s for responder '%s' to %s\n", opts.Format, args[0], profile.Responder, out)
+		}
+		fmt.Fprintf(os.Stderr, "Certificate %s valid until %s\n", profile.Serial, profile.NotAfter.Format(time.DateTime))
+		if profile.Password != "" {
+			fmt.Fprintf(os.Stderr, "Certificate password: %s\n", profile.Password)
+		}
+		for _, note := range profile.Notes {
+			fmt.Fprintf(os.Stderr, "Note: %s\n", note)
+		}
+		return nil
+	},
+}
+
+var clientInviteCmd = &cobra.Command{
+	Use:   "invite [user]",
+	Short: "Invite a user to fetch a VPN profile by scanning a QR code",
+	Long: `Create a one-time enrollment URL for a user and print it as a QR code. The
+user scans it with their phone, or opens it on their laptop, and downloads the
+same VPN profile 'client profile' writes, with a certificate issued at that
+moment. The URL works once and expires after --expiry; nothing is issued if it
+is never used.
+
+The URL points to the enrollment server ('client serve'), reached at client.url.
+For strongswan-android profiles a password is generated now and printed: give
+it to the user separately, the strongSwan VPN Client asks for it on import.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := profileOptions(cmd)
+		expiry, _ := cmd.Flags().GetDuration("expiry")
+		pngFile, _ := cmd.Flags().GetString("png")
+		invert, _ := cmd.Flags().GetBool("invert")
+		if opts.Format == tunnel.ProfileStrongSwanAndroid {
+			opts.Password = rand.Text()
+		}
+
+		inv, url, err := invite.Create(args[0], opts, expiry)
+		if err != nil {
+			return fail("Error inviting %s: %v", args[0], err)
+		}
+		logger.Info("Created invite %s for %s to a %s profile, expiring %s", inv.ID, inv.User, opts.Format, inv.Expires.Format(time.DateTime))
+		code, err := qr.Encode([]byte(url))
+		if err != nil {
+			return fail("Error encoding the enrollment URL: %v", err)
+		}
+
+		if pngFile != "" {
+			image, err := code.PNG(8)
+			if err != nil {
+				return fail("Error rendering the QR code: %v", err)
+			}
+			if err := os.WriteFile(pngFile, image, 0600); err != nil {
+				return fail("Error writing the QR code: %v", err)
+			}
+			fmt.Printf("Wrote the QR code to %s\n", pngFile)
+		} else {
+			fmt.Print(code.Terminal(invert))
+		}
+		fmt.Printf("Invite %s for %s, valid once until %s:\n%s\n", inv.ID, inv.User, inv.Expires.Format(time.DateTime), url)
+		if opts.Password != "" {
+			fmt.Fprintf(os.Stderr, "Certificate password: %s\n", opts.Password)
+		}
+		return nil
+	},
+}
+
+var clientInviteListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the invites awaiting use",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		invites, err := invite.List()
+		if err != nil {
+			return fail("Error listing invites: %v", err)
+		}
+		if len(invites) == 0 {
+			fmt.Println("No invites")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "ID"},
+			table.Column{Header: "USER", MaxWidth: 40},
+			table.Column{Header: "FORMAT"},
+			table.Column{Header: "RESPONDER", MaxWidth: 24},
+			table.Column{Header: "EXPIRES"},
+		)
+		for _, inv := range invites {
+			tbl.AddRow(inv.ID, inv.User, inv.Options.Format, orDash(inv.Options.Responder), inv.Expires.Format(time.DateTime))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var clientInviteRevokeCmd = &cobra.Command{
+	Use:   "revoke [id]",
+	Short: "Revoke an invite before it is used",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		inv, err := invite.Revoke(args[0])
+		if err != nil {
+			return fail("Error revoking invite %s: %v", args[0], err)
+		}
+		logger.Info("Revoked invite %s for %s", inv.ID, inv.User)
+		fmt.Printf("Revoked invite %s for %s\n", inv.ID, inv.User)
+		return nil
+	},
+}
+
+var clientServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run the enrollment server in the foreground",
+	Long: `Serve the enrollment URLs of invites over HTTPS on client.listen, with
+client.certificate, or the RESTCONF server's certificate if it is not set. Users
+are not asked for a client certificate: the secret in the URL authenticates them.
+The certificate must be one their devices trust, from a public CA.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().Changed("listen") {
+			listen, _ := cmd.Flags().GetString("listen")
+			viper.Set("client.listen", listen)
+		}
+		server, err := invite.FromConfig()
+		if err != nil {
+			return fail("Error starting enrollment server: %v", err)
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			server.Close()
+		}()
+
+		if err := server.ListenAndServe(); err != nil {
+			return fail("Enrollment server failed: %v", err)
+		}
+		return nil
+	},
+}
+
+var clientSessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "List the road warriors connected to responders",
+	Long: `List the sessions of the clients connected to responders, as the IKE daemon
+reports them with 'tunnel accept' and 'tunnel release': the client's identity,
+the virtual IP it was given, the public address it connects from, how long it
+has been connected and the traffic of its session.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		responder, _ := cmd.Flags().GetString("tunnel")
+		sessions, err := tunnel.Sessions(responder)
+		if err != nil {
+			return fail("Error listing sessions: %v", err)
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, sessions)
+		}
+		if len(sessions) == 0 {
+			fmt.Println("No clients connected")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "ID"},
+			table.Column{Header: "IDENTITY", MaxWidth: 40},
+			table.Column{Header: "VIRTUAL IP"},
+			table.Column{Header: "PUBLIC IP"},
+			table.Column{Header: "CONNECTED"},
+			table.Column{Header: "RX"},
+			table.Column{Header: "TX"},
+			table.Column{Header: "STATUS"},
+		)
+		for _, s := range sessions {
+			tbl.AddRow(s.ID, s.Identity, orDash(s.VirtualIP), s.Address, s.Duration().String(),
+				formatBytes(s.RxBytes), formatBytes(s.TxBytes), string(s.Status))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var clientDisconnectCmd = &cobra.Command{
+	Use:   "disconnect [id]",
+	Short: "Terminate the session of a connected road warrior",
+	Long: `Terminate a session listed by 'client sessions': release the client's
+instance, so that its traffic stops, and publish a tunnel.session.disconnected
+event for the IKE daemon to delete the client's IKE SA. The client may connect
+again; revoke its certificate or change the responder's peer ID to keep it out.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, err := tunnel.Disconnect(args[0])
+		if err != nil {
+			return fail("Error disconnecting session '%s': %v", args[0], err)
+		}
+		logger.Info("Disconnected session '%s' of %s from %s after %s", s.ID, s.Identity, s.Address, s.Duration())
+		fmt.Printf("Disconnected %s from responder '%s' after %s (%s received, %s sent)\n",
+			s.Identity, s.Responder, s.Duration(), formatBytes(s.RxBytes), formatBytes(s.TxBytes))
+		return nil
+	},
+}
+
+var clientPolicyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Limit when, from where and how often road warriors connect",
+	Long: `A login policy limits the identities matching a pattern, such as
+*@contractors.example.com: how many sessions each may have at once on all
+responders, the days and hours it may connect, in local time, and the countries
+and networks it may connect from. Countries are looked up in
+security.geoip_country_database. Policies are checked when the IKE daemon reports
+a client that authenticated with 'tunnel accept': a client a policy refuses is
+rejected with the reason, which is logged and published in a
+tunnel.session.rejected event. Every policy matching an identity applies.`,
+}
+
+var clientPolicySetCmd = &cobra.Command{
+	Use:   "set [name]",
+	Short: "Create a login policy or change its settings",
+	Long: `Create a login policy or change the settings given. It applies to the clients
+connecting from then on; those connected keep their sessions, see 'client
+disconnect'.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		p, err := tunnel.GetLoginPolicy(name)
+		if errors.Is(err, tunnel.ErrLoginPolicyNotFound) {
+			p, err = &tunnel.LoginPolicy{Name: name}, nil
+		}
+		if err != nil {
+			return fail("Error reading login policy %s: %v", name, err)
+		}
+
+		flags := cmd.Flags()
+		if flags.Changed("identity") {
+			p.Identity, _ = flags.GetString("identity")
+		}
+		if flags.Changed("max-sessions") {
+			p.MaxSessions, _ = flags.GetInt("max-sessions")
+		}
+		if flags.Changed("days") {
+			p.Days, _ = flags.GetStringSlice("days")
+		}
+		if flags.Changed("hours") {
+			hours, _ := flags.GetString("hours")
+			start, end, ok := strings.Cut(hours, "-")
+			if hours != "" && !ok {
+				return fail("Error: invalid hours %q, expected HH:MM-HH:MM", hours)
+			}
+			p.Start, p.End = start, end
+		}
+		if flags.Changed("countries") {
+			p.Countries, _ = flags.GetStringSlice("countries")
+		}
+		if flags.Changed("networks") {
+			p.Networks, _ = flags.GetStringSlice("networks")
+		}
+
+		if err := tunnel.SaveLoginPolicy(p); err != nil {
+			return fail("Error saving login policy %s: %v", name, err)
+		}
+		logger.Info("Login policy %s saved", name)
+		fmt.Printf("Login policy %s saved: %s may connect %s from %s\n", name, p.Identity, p.Hours(), p.Sources())
+		if p.MaxSessions > 0 {
+			fmt.Printf("At most %d sessions at once per identity\n", p.MaxSessions)
+		}
+		return nil
+	},
+}
+
+var clientPolicyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the login policies",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		policies, err := tunnel.LoginPolicies()
+		if err != nil {
+			return fail("Error listing login policies: %v", err)
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, policies)
+		}
+		if len(policies) == 0 {
+			fmt.Println("No login policies")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "NAME"},
+			table.Column{Header: "IDENTITY", MaxWidth: 40},
+			table.Column{Header: "MAX SESSIONS"},
+			table.Column{Header: "HOURS", MaxWidth: 40},
+			table.Column{Header: "SOURCES", MaxWidth: 50},
+		)
+		for _, p := range policies {
+			sessions := "-"
+			if p.MaxSessions > 0 {
+				sessions = fmt.Sprint(p.MaxSessions)
+			}
+			tbl.AddRow(p.Name, p.Identity, sessions, p.Hours(), p.Sources())
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var clientPolicyDeleteCmd = &cobra.Command{
+	Use:   "delete [name]",
+	Short: "Delete a login policy",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := tunnel.DeleteLoginPolicy(args[0]); err != nil {
+			return fail("Error deleting login policy %s: %v", args[0], err)
+		}
+		logger.Info("Login policy %s deleted", args[0])
+		fmt.Printf("Login policy %s deleted\n", args[0])
+		return nil
+	},
+}
+
+var clientAccountingCmd = &cobra.Command{
+	Use:   "accounting",
+	Short: "List the records of road warrior sessions",
+	Long: `List the records of the sessions of clients, kept for compliance and abuse
+investigations: the client's identity, the responder, the public address it
+connected from, the virtual IP it was given, when it connected and disconnected,
+why, and the traffic of the session. A session without an end is still
+connected, or its end was not seen, such as when the hub crashed.
+
+Records are kept in the state directory for client.accounting_retention days
+(365 by default). Use 'client accounting export' to hand them over.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		since, _ := cmd.Flags().GetDuration("since")
+		identity, _ := cmd.Flags().GetString("identity")
+		var from time.Time
+		if since > 0 {
+			from = time.Now().Add(-since)
+		}
+		records, err := tunnel.SessionHistory(from, time.Now(), identity)
+		if err != nil {
+			return fail("Error reading session records: %v", err)
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, records)
+		}
+		if len(records) == 0 {
+			fmt.Println("No sessions recorded")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "IDENTITY", MaxWidth: 40},
+			table.Column{Header: "RESPONDER"},
+			table.Column{Header: "PUBLIC IP"},
+			table.Column{Header: "VIRTUAL IP"},
+			table.Column{Header: "START"},
+			table.Column{Header: "DURATION"},
+			table.Column{Header: "RX"},
+			table.Column{Header: "TX"},
+			table.Column{Header: "END", MaxWidth: 20},
+		)
+		for _, r := range records {
+			end := r.Reason
+			if r.Stop.IsZero() {
+				end = "connected"
+			}
+			tbl.AddRow(r.Identity, r.Responder, r.Address, orDash(r.VirtualIP), r.Start.Local().Format(time.DateTime),
+				r.Duration().String(), formatBytes(r.RxBytes), formatBytes(r.TxBytes), end)
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var clientAccountingExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the records of road warrior sessions as CSV or JSON",
+	Long: `Export the records of the sessions connected at some point between two dates,
+inclusive, for compliance and abuse investigations. Times are in UTC and
+traffic in bytes. Without --from, the export starts with the oldest record kept;
+without --to, it ends now.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		identity, _ := cmd.Flags().GetString("identity")
+		format, _ := cmd.Flags().GetString("format")
+		out, _ := cmd.Flags().GetString("out")
+		if format != "csv" && format != "json" {
+			return fail("Error: unknown format '%s', expected csv, json", format)
+		}
+		from, to, err := accountingRange(cmd)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		records, err := tunnel.SessionHistory(from, to, identity)
+		if err != nil {
+			return fail("Error reading session records: %v", err)
+		}
+
+		w := os.Stdout
+		if out != "" {
+			if w, err = os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+				return fail("Error writing the export: %v", err)
+			}
+			defer w.Close()
+		}
+		if format == "json" {
+			err = writeJSON(w, records)
+		} else {
+			err = writeSessionRecordsCSV(w, records)
+		}
+		if err != nil {
+			return fail("Error writing the export: %v", err)
+		}
+		if out != "" {
+			logger.Info("Exported %d session records to %s", len(records), out)
+			fmt.Printf("Wrote %d session records to %s\n", len(records), out)
+		}
+		return nil
+	},
+}
+
+// accountingRange returns the times between the --from and --to dates of
+// 'client accounting export'
+func accountingRange(cmd *cobra.Command) (from, to time.Time, err error) {
+	start, _ := cmd.Flags().GetString("from")
+	end, _ := cmd.Flags().GetString("to")
+	to = time.Now()
+	if start != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, start, time.Local); err != nil {
+			return from, to, fmt.Errorf("invalid date '%s', expected YYYY-MM-DD", start)
+		}
+	}
+	if end != "" {
+		day, err := time.ParseInLocation(time.DateOnly, end, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid date '%s', expected YYYY-MM-DD", end)
+		}
+		to = day.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	if to.Before(from) {
+		return from, to, fmt.Errorf("--to %s is before --from %s", end, start)
+	}
+	return from, to, nil
+}
+
+// writeSessionRecordsCSV writes session records as CSV with a header row
+func writeSessionRecordsCSV(w io.Writer, records []tunnel.SessionRecord) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"session", "responder", "identity", "address", "virtual_ip", "start", "stop",
+		"duration_seconds", "rx_bytes", "tx_bytes", "reason"})
+	for _, r := range records {
+		stop := ""
+		if !r.Stop.IsZero() {
+			stop = r.Stop.UTC().Format(time.RFC3339)
+		}
+		c.Write([]string{r.Session, r.Responder, r.Identity, r.Address, r.VirtualIP, r.Start.UTC().Format(time.RFC3339), stop,
+			strconv.FormatInt(int64(r.Duration().Seconds()), 10), strconv.FormatUint(r.RxBytes, 10),
+			strconv.FormatUint(r.TxBytes, 10), r.Reason})
+	}
+	c.Flush()
+	return c.Error()
+}
+
+// addProfileFlags adds the flags of the profile a command writes
+func addProfileFlags(cmd *cobra.Command) {
+	cmd.Flags().String("format", tunnel.ProfileMobileconfig, "Client to write the profile for ("+strings.Join(tunnel.ProfileFormats, ", ")+")")
+	cmd.Flags().String("tunnel", "", "Responder to connect to (default the only one accepting certificates of the hub CA)")
+	cmd.Flags().String("server", "", "Address or name clients connect to (default the responder's local IP)")
+	cmd.Flags().String("server-id", "", "IKE identity of the hub, in its certificate (default the server address)")
+	cmd.Flags().Duration("validity", tunnel.DefaultProfileValidity, "Lifetime of the certificate issued to the user")
+}
+
+// profileOptions returns the profile options of the flags addProfileFlags adds
+func profileOptions(cmd *cobra.Command) tunnel.ProfileOptions {
+	flags := cmd.Flags()
+	opts := tunnel.ProfileOptions{}
+	opts.Format, _ = flags.GetString("format")
+	opts.Responder, _ = flags.GetString("tunnel")
+	opts.Server, _ = flags.GetString("server")
+	opts.ServerID, _ = flags.GetString("server-id")
+	opts.Validity, _ = flags.GetDuration("validity")
+	return opts
+}
+
+func init() {
+	clientCmd.AddCommand(clientProfileCmd)
+	clientCmd.AddCommand(clientInviteCmd)
+	clientCmd.AddCommand(clientServeCmd)
+	clientCmd.AddCommand(clientSessionsCmd)
+	clientCmd.AddCommand(clientDisconnectCmd)
+	clientCmd.AddCommand(clientPolicyCmd)
+	clientCmd.AddCommand(clientAccountingCmd)
+	clientAccountingCmd.AddCommand(clientAccountingExportCmd)
+	clientPolicyCmd.AddCommand(clientPolicySetCmd)
+	clientPolicyCmd.AddCommand(clientPolicyListCmd)
+	clientPolicyCmd.AddCommand(clientPolicyDeleteCmd)
+	clientInviteCmd.AddCommand(clientInviteListCmd)
+	clientInviteCmd.AddCommand(clientInviteRevokeCmd)
+
+	// Flags for profile command
+	addProfileFlags(clientProfileCmd)
+	clientProfileCmd.Flags().String("out", "", "File to write the profile to instead of standard output")
+
+	// Flags for invite command
+	addProfileFlags(clientInviteCmd)
+	clientInviteCmd.Flags().Duration("expiry", 0, "How long the invite may wait to be used (default client.invite_expiry)")
+	clientInviteCmd.Flags().String("png", "", "File to write the QR code to as a PNG image instead of printing it")
+	clientInviteCmd.Flags().Bool("invert", false, "Print the QR code for dark text on a light background")
+
+	// Flags for invite list command
+	clientInviteListCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+
+	// Flags for sessions command
+	clientSessionsCmd.Flags().String("tunnel", "", "Responder to list the sessions of (default all)")
+	clientSessionsCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	clientSessionsCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+
+	// Flags for policy commands
+	clientPolicySetCmd.Flags().String("identity", "", "Pattern of the identities the policy applies to, e.g. *@contractors.example.com")
+	clientPolicySetCmd.Flags().Int("max-sessions", 0, "Sessions an identity may have at once on all responders, 0 for any number")
+	clientPolicySetCmd.Flags().StringSlice("days", nil, "Days identities may connect on ("+strings.Join(tunnel.ScheduleDays, ", ")+"), every day by default")
+	clientPolicySetCmd.Flags().String("hours", "", "Hours identities may connect in local time, e.g. 08:00-18:00, any time by default")
+	clientPolicySetCmd.Flags().StringSlice("countries", nil, "ISO 3166-1 alpha-2 codes of the countries identities may connect from, e.g. DE,FR")
+	clientPolicySetCmd.Flags().StringSlice("networks", nil, "Networks identities may connect from, besides those countries")
+	clientAccountingCmd.Flags().Duration("since", 24*time.Hour, "Only list sessions connected within this long, 0 for all")
+	clientAccountingCmd.Flags().String("identity", "", "Only list the sessions of identities matching this pattern")
+	clientAccountingCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	clientAccountingCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+	clientAccountingExportCmd.Flags().String("from", "", "First day to export (YYYY-MM-DD), the oldest record kept by default")
+	clientAccountingExportCmd.Flags().String("to", "", "Last day to export (YYYY-MM-DD), today by default")
+	clientAccountingExportCmd.Flags().String("identity", "", "Only export the sessions of identities matching this pattern")
+	clientAccountingExportCmd.Flags().String("format", "csv", "Output format (csv, json)")
+	clientAccountingExportCmd.Flags().String("out", "", "File to write the export to instead of standard output")
+	clientPolicyListCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	clientPolicyListCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+
+	// Flags for serve command
+	clientServeCmd.Flags().String("listen", "", "Address to listen on, overriding client.listen (default :8444)")
+}
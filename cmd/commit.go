@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/commit"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// confirmCmd represents the confirm command
+var confirmCmd = &cobra.Command{
+	Use:   "confirm",
+	Short: "Keep the changes made with --confirm",
+	Long: `Changes that could cut off your SSH session, such as starting a tunnel or
+sending all traffic through one, take --confirm N to be reverted after N minutes
+unless "ipsec-vpn confirm" is run in the meantime, like commit confirmed in
+Junos. The reversal is run by a watcher process that survives the session
+going away. Changes made with --confirm while others are pending join them,
+and all are reverted together at the later deadline.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		p, err := commit.Confirm()
+		if err != nil {
+			return fail("Error confirming changes: %v", err)
+		}
+		if p == nil {
+			fmt.Println("No changes awaiting confirmation")
+			return nil
+		}
+
+		for _, c := range p.Changes {
+			logger.Info("Confirmed %s", c.Description)
+		}
+		fmt.Printf("Confirmed %d change(s)\n", len(p.Changes))
+		return nil
+	},
+}
+
+var confirmStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the changes awaiting confirmation",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		p, err := commit.Load()
+		if err != nil {
+			return fail("Error reading pending changes: %v", err)
+		}
+		if p == nil {
+			fmt.Println("No changes awaiting confirmation")
+			return nil
+		}
+
+		fmt.Printf("Reverting in %s (at %s) unless confirmed:\n",
+			max(time.Until(p.Deadline), 0).Round(time.Second), p.Deadline.Format(time.DateTime))
+		for _, c := range p.Changes {
+			fmt.Printf("  %s  %s (undo: ipsec-vpn %s)\n", c.At.Format(time.TimeOnly), c.Description, strings.Join(c.Undo, " "))
+		}
+		if !p.Watching() {
+			fmt.Println("Warning: the watcher is not running, run 'ipsec-vpn confirm rollback' to revert")
+		}
+		return nil
+	},
+}
+
+var confirmRollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Revert the changes awaiting confirmation now",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		changes, err := commit.Rollback(runUndo)
+		for _, c := range changes {
+			fmt.Printf("Reverted %s\n", c.Description)
+		}
+		if err != nil {
+			return fail("Error reverting changes: %v", err)
+		}
+		if len(changes) == 0 {
+			fmt.Println("No changes awaiting confirmation")
+		}
+		return nil
+	},
+}
+
+var confirmWatchCmd = &cobra.Command{
+	Use:    "watch",
+	Short:  "Revert the pending changes at their deadline",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		changes, err := commit.Watch(runUndo)
+		for _, c := range changes {
+			logger.Info("Reverted %s, it was not confirmed in time", c.Description)
+		}
+		if err != nil {
+			return fail("Error reverting unconfirmed changes: %v", err)
+		}
+		return nil
+	},
+}
+
+// addConfirmFlag lets the changes made by commands be reverted unless confirmed
+func addConfirmFlag(cmds ...*cobra.Command) {
+	for _, c := range cmds {
+		c.Flags().Int("confirm", 0, "Revert the change after this many minutes unless 'ipsec-vpn confirm' is run")
+	}
+}
+
+// armConfirm schedules the reversal of a change cmd made, if it was run with
+// --confirm. Should that fail, the change is reverted straight away rather than
+// left in place without the protection asked for.
+func armConfirm(cmd *cobra.Command, description string, undo ...string) error {
+	minutes, _ := cmd.Flags().GetInt("confirm")
+	if minutes <= 0 {
+		return nil
+	}
+
+	p, err := commit.Arm(description, undo, time.Duration(minutes)*time.Minute)
+	if err == nil && !p.Watching() {
+		err = startWatcher()
+	}
+	if err != nil {
+		logger.Error("Failed to schedule the reversal of %s, reverting it now: %v", description, err)
+		if undoErr := runUndo(undo); undoErr != nil {
+			return fail("Error scheduling the reversal of %s: %v; reverting it failed too: %v", description, err, undoErr)
+		}
+		return fail("Error scheduling the reversal of %s, it was reverted: %v", description, err)
+	}
+
+	fmt.Printf("Reverting %s at %s unless 'ipsec-vpn confirm' is run\n", description, p.Deadline.Format(time.TimeOnly))
+	return nil
+}
+
+// startWatcher starts the process reverting unconfirmed changes in a session of
+// its own, so that it outlives the operator's SSH session
+func startWatcher() error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	watcher := exec.Command(self, append(reexecArgs(), "confirm", "watch")...)
+	watcher.Dir = "/"
+	watcher.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := watcher.Start(); err != nil {
+		return fmt.Errorf("failed to start the watcher: %v", err)
+	}
+	pid := watcher.Process.Pid
+	_ = watcher.Process.Release()
+	return commit.SetWatcher(pid)
+}
+
+// runUndo runs ipsec-vpn with the arguments that undo a change
+func runUndo(args []string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command(self, append(reexecArgs(), args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ipsec-vpn %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// reexecArgs returns the global flags a child ipsec-vpn process needs to see
+// the same configuration
+func reexecArgs() []string {
+	var args []string
+	if path := viper.ConfigFileUsed(); path != "" {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		args = append(args, "--config", path)
+	}
+	for _, o := range overrides {
+		args = append(args, "--set", o)
+	}
+	return args
+}
+
+func init() {
+	confirmCmd.AddCommand(confirmStatusCmd)
+	confirmCmd.AddCommand(confirmRollbackCmd)
+	confirmCmd.AddCommand(confirmWatchCmd)
+}
@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/config"
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/invite"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/report"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// completeTunnelNames completes the names of configured tunnels
+func completeTunnelNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	tunnels, err := tunnel.ListAll()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	names := make([]string, 0, len(tunnels))
+	for _, t := range tunnels {
+		if !contains(args, t.Name) && strings.HasPrefix(t.Name, toComplete) {
+			names = append(names, t.Name+"\t"+string(t.Status))
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeSingleTunnelName completes one tunnel name as the only argument
+func completeSingleTunnelName(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return completeTunnelNames(cmd, args, toComplete)
+}
+
+// completePolicyRules completes a tunnel name followed by the rules of its traffic policy
+func completePolicyRules(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return completeTunnelNames(cmd, args, toComplete)
+	}
+
+	tun, err := tunnel.Get(args[0])
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var rules []string
+	for _, rule := range tun.Policy {
+		if !contains(args[1:], rule.String()) {
+			rules = append(rules, rule.String())
+		}
+	}
+	return rules, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completePeerGroupNames completes the names of peer groups
+func completePeerGroupNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	groups, err := tunnel.PeerGroups()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var names []string
+	for _, g := range groups {
+		if strings.HasPrefix(g.Name, toComplete) {
+			names = append(names, g.Name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completePeerGroupMembers completes a peer group name followed by tunnel names
+func completePeerGroupMembers(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return completePeerGroupNames(cmd, args, toComplete)
+	}
+	return completeTunnelNames(cmd, args[1:], toComplete)
+}
+
+// completeAppRoutes completes a tunnel name followed by its application routes
+func completeAppRoutes(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return completeTunnelNames(cmd, args, toComplete)
+	}
+
+	tun, err := tunnel.Get(args[0])
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var routes []string
+	for _, r := range tun.AppRoutes {
+		if !contains(args[1:], r.String()) {
+			routes = append(routes, r.String())
+		}
+	}
+	return routes, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeMulticastRoutes completes a tunnel name followed by its multicast routes
+func completeMulticastRoutes(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return completeTunnelNames(cmd, args, toComplete)
+	}
+
+	tun, err := tunnel.Get(args[0])
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var routes []string
+	for _, r := range tun.MulticastRoutes {
+		if !contains(args[1:], r.String()) {
+			routes = append(routes, r.String())
+		}
+	}
+	return routes, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completePathSetName completes the name of a path set as the only argument
+func completePathSetName(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	sets, err := tunnel.PathSets()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var names []string
+	for _, p := range sets {
+		if strings.HasPrefix(p.Name, toComplete) {
+			names = append(names, p.Name+"\t"+p.Prefix)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeScheduleName completes the name of a schedule as the only argument
+func completeScheduleName(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	schedules, err := tunnel.Schedules()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var names []string
+	for _, s := range schedules {
+		if strings.HasPrefix(s.Name, toComplete) {
+			names = append(names, s.Name+"\t"+s.Window())
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeLoginPolicyName completes the name of a login policy as the only argument
+func completeLoginPolicyName(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	policies, err := tunnel.LoginPolicies()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var names []string
+	for _, p := range policies {
+		if strings.HasPrefix(p.Name, toComplete) {
+			names = append(names, p.Name+"\t"+p.Identity)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeKeyNames completes the names of stored keys
+func completeKeyNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	stored, err := keys.ListAll()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	names := make([]string, 0, len(stored))
+	for _, k := range stored {
+		if strings.HasPrefix(k.Name, toComplete) {
+			names = append(names, k.Name+"\t"+k.Algorithm)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeInviteIDs completes the IDs of the invites awaiting use
+func completeInviteIDs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	invites, err := invite.List()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	ids := make([]string, 0, len(invites))
+	for _, inv := range invites {
+		if strings.HasPrefix(inv.ID, toComplete) {
+			ids = append(ids, inv.ID+"\t"+inv.User)
+		}
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeSessionIDs completes the IDs of the sessions of connected initiators
+func completeSessionIDs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	sessions, err := tunnel.Sessions("")
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	ids := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		if strings.HasPrefix(s.ID, toComplete) {
+			ids = append(ids, s.ID+"\t"+s.Identity)
+		}
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeAlgorithms completes the names of supported, non-deprecated algorithms
+func completeAlgorithms(classic, postQuantum, auto bool) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		var algos []crypto.Algorithm
+		if classic {
+			algos = append(algos, crypto.ListClassicAlgorithms()...)
+		}
+		if postQuantum {
+			algos = append(algos, crypto.ListPostQuantumAlgorithms()...)
+		}
+
+		var names []string
+		if auto {
+			names = append(names, crypto.AutoAlgorithm+"\tFastest cipher for this host")
+		}
+		for _, algo := range algos {
+			if !algo.Deprecated {
+				names = append(names, algo.Name+"\t"+algo.Description)
+			}
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// completeAlgorithmArg completes an algorithm as the only positional argument
+func completeAlgorithmArg(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return completeAlgorithms(true, true, false)(cmd, args, toComplete)
+}
+
+// completeSettingKeys completes configuration setting keys
+func completeSettingKeys(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return config.Keys(), cobra.ShellCompDirectiveNoFileComp
+}
+
+// machineOutput reports whether the command being run produces output meant for
+// other programs, such as completion scripts, or was asked to be quiet, so log
+// messages must stay off stdout
+func machineOutput() bool {
+	cmd, _, err := rootCmd.Find(os.Args[1:])
+	if err != nil {
+		return false
+	}
+
+	for c := cmd; c != nil; c = c.Parent() {
+		switch c.Name() {
+		case cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd, "completion", "gen-docs", "schema", "generate-dashboard":
+			return true
+		}
+	}
+
+	// Scripts running a command with --quiet only want its exit code, those
+	// asking for --json must be able to parse all of stdout, and those running
+	// it with --async read the job ID from it
+	quiet, _ := cmd.Flags().GetBool("quiet")
+	asJSON, _ := cmd.Flags().GetBool("json")
+	async, _ := cmd.Flags().GetBool("async")
+	return quiet || asJSON || async
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// registerCompletions attaches dynamic completions to commands and flags. It runs
+// from Execute since flags are only defined once every init function has run.
+func registerCompletions() {
+	// Positional arguments
+	for _, c := range []*cobra.Command{tunnelShowCmd, tunnelStatusCmd, tunnelStartCmd, tunnelStopCmd, tunnelDeleteCmd,
+		tunnelDebugEnableCmd, tunnelDebugDisableCmd, tunnelDebugShowCmd, tunnelExecCmd,
+		tunnelKillSwitchEnableCmd, tunnelKillSwitchDisableCmd, tunnelPolicyClearCmd, tunnelPolicyListCmd,
+		tunnelRateLimitSetCmd, tunnelRateLimitClearCmd, tunnelPinSetCmd, tunnelPinTOFUCmd, tunnelPinClearCmd, tunnelExportPeerCmd,
+		tunnelSLACmd, tunnelSLASetCmd, tunnelSLAClearCmd, tunnelAcceptCmd, tunnelReleaseCmd,
+		tunnelVirtualIPCmd, tunnelVirtualIPSetCmd, tunnelVirtualIPClearCmd, tunnelVirtualIPPoolCmd,
+		tunnelShortcutEnableCmd, tunnelShortcutDisableCmd, tunnelShortcutScanCmd, tunnelShortcutAddCmd, tunnelShortcutListCmd,
+		tunnelShortcutRemoveCmd, tunnelShortcutPruneCmd, tunnelTuneShowCmd, tunnelTuneSetCmd, tunnelTuneClearCmd,
+		tunnelStatsCmd, tunnelPacketAccountingEnableCmd, tunnelPacketAccountingDisableCmd,
+		tunnelReauthCmd, tunnelReauthSetCmd, tunnelReauthClearCmd, tunnelReauthReportCmd} {
+		c.ValidArgsFunction = completeSingleTunnelName
+	}
+	cryptoMigrateCmd.ValidArgsFunction = completeTunnelNames
+	peerGroupAddCmd.ValidArgsFunction = completePeerGroupMembers
+	peerGroupRemoveCmd.ValidArgsFunction = completeTunnelNames
+	for _, c := range []*cobra.Command{peerGroupShowCmd, peerGroupDeleteCmd} {
+		c.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) > 0 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			return completePeerGroupNames(cmd, args, toComplete)
+		}
+	}
+	for _, c := range []*cobra.Command{pathSetCmd, pathShowCmd, pathSelectCmd, pathHistoryCmd, pathDeleteCmd} {
+		c.ValidArgsFunction = completePathSetName
+	}
+	tunnelPolicyAddCmd.ValidArgsFunction = completeSingleTunnelName
+	for _, c := range []*cobra.Command{networkAppRouteAddCmd, networkAppRouteClearCmd, networkAppRouteListCmd} {
+		c.ValidArgsFunction = completeSingleTunnelName
+	}
+	networkAppRouteRemoveCmd.ValidArgsFunction = completeAppRoutes
+	for _, c := range []*cobra.Command{networkMulticastAddCmd, networkMulticastClearCmd, networkMulticastListCmd} {
+		c.ValidArgsFunction = completeSingleTunnelName
+	}
+	networkMulticastRemoveCmd.ValidArgsFunction = completeMulticastRoutes
+	for _, c := range []*cobra.Command{networkScheduleSetCmd, networkScheduleLogCmd, networkScheduleDeleteCmd} {
+		c.ValidArgsFunction = completeScheduleName
+	}
+	tunnelPolicyRemoveCmd.ValidArgsFunction = completePolicyRules
+	for _, c := range []*cobra.Command{keyShowCmd, keyDeleteCmd, agentAddCmd} {
+		c.ValidArgsFunction = completeKeyNames
+	}
+	cryptoTestCmd.ValidArgsFunction = completeAlgorithmArg
+	cryptoSetDefaultCmd.ValidArgsFunction = completeAlgorithmArg
+	configGetCmd.ValidArgsFunction = completeSettingKeys
+	configSetCmd.ValidArgsFunction = completeSettingKeys
+	clientInviteRevokeCmd.ValidArgsFunction = completeInviteIDs
+	clientDisconnectCmd.ValidArgsFunction = completeSessionIDs
+	for _, c := range []*cobra.Command{clientPolicySetCmd, clientPolicyDeleteCmd} {
+		c.ValidArgsFunction = completeLoginPolicyName
+	}
+
+	// Flag values
+	tunnelCreateCmd.RegisterFlagCompletionFunc("encryption", completeAlgorithms(true, true, true))
+	tunnelExportPeerCmd.RegisterFlagCompletionFunc("format", cobra.FixedCompletions(tunnel.ExportFormats, cobra.ShellCompDirectiveNoFileComp))
+	for _, c := range []*cobra.Command{clientProfileCmd, clientInviteCmd} {
+		c.RegisterFlagCompletionFunc("format", cobra.FixedCompletions(tunnel.ProfileFormats, cobra.ShellCompDirectiveNoFileComp))
+		c.RegisterFlagCompletionFunc("tunnel", completeTunnelNames)
+	}
+	clientSessionsCmd.RegisterFlagCompletionFunc("tunnel", completeTunnelNames)
+	tunnelReauthReportCmd.RegisterFlagCompletionFunc("result", cobra.FixedCompletions(tunnel.ReauthResults, cobra.ShellCompDirectiveNoFileComp))
+	clientAccountingExportCmd.RegisterFlagCompletionFunc("format", cobra.FixedCompletions([]string{"csv", "json"}, cobra.ShellCompDirectiveNoFileComp))
+	tunnelCreateCmd.RegisterFlagCompletionFunc("mode", cobra.FixedCompletions([]string{tunnel.ModeIPsec, tunnel.ModeWireGuard}, cobra.ShellCompDirectiveNoFileComp))
+	cryptoMigrateCmd.RegisterFlagCompletionFunc("to", completeAlgorithms(true, true, false))
+	cryptoKeygenCmd.RegisterFlagCompletionFunc("algorithm", completeAlgorithms(false, true, false))
+	keyGenerateCmd.RegisterFlagCompletionFunc("algorithm", completeAlgorithms(false, true, false))
+	keyGenerateCmd.RegisterFlagCompletionFunc("type", cobra.FixedCompletions([]string{"psk", "keypair"}, cobra.ShellCompDirectiveNoFileComp))
+	tunnelSLASetCmd.RegisterFlagCompletionFunc("type", cobra.FixedCompletions([]string{tunnel.ProbeICMP, tunnel.ProbeUDP}, cobra.ShellCompDirectiveNoFileComp))
+	reportSLACmd.RegisterFlagCompletionFunc("period", cobra.FixedCompletions(report.Periods, cobra.ShellCompDirectiveNoFileComp))
+	reportSLACmd.RegisterFlagCompletionFunc("format", cobra.FixedCompletions(report.Formats, cobra.ShellCompDirectiveNoFileComp))
+	networkAdvertiseCmd.RegisterFlagCompletionFunc("tunnel", completeTunnelNames)
+	networkWithdrawCmd.RegisterFlagCompletionFunc("tunnel", completeTunnelNames)
+	peerGroupSetCmd.RegisterFlagCompletionFunc("auth", cobra.FixedCompletions(tunnel.AuthMethods, cobra.ShellCompDirectiveNoFileComp))
+	tunnelCreateCmd.RegisterFlagCompletionFunc("peer-group", completePeerGroupNames)
+	pathSetCmd.RegisterFlagCompletionFunc("tunnels", completeTunnelNames)
+	networkScheduleSetCmd.RegisterFlagCompletionFunc("tunnel", completeTunnelNames)
+	networkScheduleSetCmd.RegisterFlagCompletionFunc("days", cobra.FixedCompletions(tunnel.ScheduleDays, cobra.ShellCompDirectiveNoFileComp))
+	clientPolicySetCmd.RegisterFlagCompletionFunc("days", cobra.FixedCompletions(tunnel.ScheduleDays, cobra.ShellCompDirectiveNoFileComp))
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/config"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// masked replaces the value of a secret when settings are shown
+const masked = "********"
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the global configuration",
+	Long:  `Inspect, validate, and change the global configuration.`,
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Validate a configuration file",
+	Long: `Check a configuration file against the schema. Unknown or misspelled keys
+are reported as warnings, invalid values as errors, each with its line number.
+If no file is given, the configuration file in use is validated.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := viper.ConfigFileUsed()
+		if len(args) == 1 {
+			path = args[0]
+		}
+		if path == "" {
+			return fail("Error: no configuration file found, pass one explicitly")
+		}
+
+		logger.Info("Validating configuration file %s", path)
+		_, problems, err := config.ValidateFile(path)
+		if err != nil {
+			return fail("Error reading configuration file %s: %v", path, err)
+		}
+
+		for _, p := range problems {
+			fmt.Printf("%s:%d: %s\n", path, p.Line, p)
+		}
+
+		if config.HasErrors(problems) {
+			logger.Error("Configuration file %s is invalid", path)
+			fmt.Printf("\n%s is invalid\n", path)
+			return errFailed
+		}
+
+		logger.Info("Configuration file %s is valid (%d warnings)", path, len(problems))
+		fmt.Printf("%s is valid\n", path)
+		return nil
+	},
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show configuration settings",
+	Long: `Show the settings from the configuration file. With --effective, show every
+setting after merging defaults, the configuration file, IPSEC_* environment
+variables and --set flags, together with where each value came from.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		effective, _ := cmd.Flags().GetBool("effective")
+		logger.Debug("Showing configuration settings (effective: %t)", effective)
+
+		if path := viper.ConfigFileUsed(); path != "" {
+			fmt.Printf("Configuration file: %s\n", path)
+		} else {
+			fmt.Println("Configuration file: none")
+		}
+
+		for _, s := range config.Effective() {
+			if !effective && s.Source != config.SourceFile {
+				continue
+			}
+			// Secrets are only shown by 'config get --reveal'
+			if config.Secret(s.Key) && s.Value != nil && s.Value != "" {
+				s.Value = masked
+			}
+			if effective {
+				fmt.Printf("%s = %v (%s, %s)\n", s.Key, s.Value, s.Source, s.Env)
+				continue
+			}
+			fmt.Printf("%s = %v\n", s.Key, s.Value)
+		}
+		return nil
+	},
+}
+
+var configGetCmd = &cobra.Command{
+	Use:   "get [key]",
+	Short: "Print the effective value of a setting",
+	Long: `Print the effective value of a setting. Secrets such as passwords are masked
+unless --reveal is given, which only operators may use.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key := args[0]
+		reveal, _ := cmd.Flags().GetBool("reveal")
+
+		for _, s := range config.Effective() {
+			if s.Key == key {
+				if config.Secret(s.Key) && !reveal && s.Value != nil && s.Value != "" {
+					s.Value = masked
+				}
+				logger.Debug("Setting %s = %v (from %s)", s.Key, s.Value, s.Source)
+				fmt.Println(s.Value)
+				return nil
+			}
+		}
+
+		return fail("Error: unknown setting '%s'", key)
+	},
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set [key] [value]",
+	Short: "Change a setting in the configuration file",
+	Long: `Change a setting in the configuration file. The value is validated before the
+file is written, and comments and formatting are kept. Lists such as
+advanced.esp_proposals take comma-separated values.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, value := args[0], args[1]
+
+		path := viper.ConfigFileUsed()
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return fail("Error: %v", err)
+			}
+			path = filepath.Join(home, ".ipsec-vpn.yaml")
+		}
+		if config.Protected(key) && path != config.SystemFile {
+			return fail("Error: %s is only read from %s, not from %s", key, config.SystemFile, path)
+		}
+
+		logger.Info("Setting %s to '%s' in %s", key, value, path)
+		if err := config.SetValue(path, key, value); err != nil {
+			return fail("Error setting %s: %v", key, err)
+		}
+
+		fmt.Printf("%s set to %s in %s\n", key, value, path)
+		if source := config.SourceOf(key); source == config.SourceEnv {
+			fmt.Printf("Note: %s is set and overrides the configuration file\n", config.EnvName(key))
+		}
+		return nil
+	},
+}
+
+func init() {
+	// Add subcommands to config command
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configShowCmd)
+	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configSetCmd)
+
+	// Flags for show command
+	configShowCmd.Flags().Bool("effective", false, "Show merged values from all sources and where each came from")
+
+	// Flags for get command
+	configGetCmd.Flags().Bool("reveal", false, "Print secrets such as passwords in clear")
+}
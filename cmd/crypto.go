@@ -2,9 +2,16 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/dzakwan/ipsec-vpn/pkg/agent"
 	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
 	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
 	"github.com/spf13/cobra"
 )
 
@@ -18,7 +25,7 @@ var cryptoCmd = &cobra.Command{
 var cryptoShowCmd = &cobra.Command{
 	Use:   "show",
 	Short: "Show available cryptographic algorithms",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		showPostQuantum, _ := cmd.Flags().GetBool("post-quantum")
 		showClassic, _ := cmd.Flags().GetBool("classic")
 
@@ -30,30 +37,63 @@ var cryptoShowCmd = &cobra.Command{
 			showClassic = true
 		}
 
+		opts := tableOptions(cmd)
+
 		if showClassic {
 			logger.Info("Displaying classic encryption algorithms")
 			fmt.Println("Classic encryption algorithms:")
-			for _, algo := range crypto.ListClassicAlgorithms() {
-				fmt.Printf("- %s: %s\n", algo.Name, algo.Description)
-			}
+			renderAlgorithms(crypto.ListClassicAlgorithms(), opts)
 			fmt.Println()
 		}
 
 		if showPostQuantum {
 			logger.Info("Displaying post-quantum encryption algorithms")
 			fmt.Println("Post-quantum encryption algorithms:")
-			for _, algo := range crypto.ListPostQuantumAlgorithms() {
-				fmt.Printf("- %s: %s\n", algo.Name, algo.Description)
-			}
+			renderAlgorithms(crypto.ListPostQuantumAlgorithms(), opts)
 		}
+		return nil
 	},
 }
 
+// renderAlgorithms prints algorithms as a table, marking deprecated ones with their replacement
+func renderAlgorithms(algos []crypto.Algorithm, opts table.Options) {
+	tbl := table.New(
+		table.Column{Header: "NAME"},
+		table.Column{Header: "STATUS", Status: true},
+		table.Column{Header: "REPLACED BY"},
+		table.Column{Header: "DESCRIPTION", MaxWidth: 60},
+	)
+	for _, algo := range algos {
+		status := "OK"
+		if algo.Deprecated {
+			status = "DEPRECATED"
+		}
+		tbl.AddRow(algo.Name, status, algo.ReplacedBy, algo.Description)
+	}
+	tbl.Render(os.Stdout, opts)
+}
+
 var cryptoTestCmd = &cobra.Command{
 	Use:   "test [algorithm]",
 	Short: "Test a cryptographic algorithm",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	Long: `Test a cryptographic algorithm with a random encrypt/decrypt round trip.
+With --kat, run the published known-answer test vectors instead; if no
+algorithm is given, the vectors for every supported algorithm are run.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kat, _ := cmd.Flags().GetBool("kat")
+		if kat {
+			algorithm := ""
+			if len(args) == 1 {
+				algorithm = args[0]
+			}
+			return runKnownAnswerTests(algorithm)
+		}
+
+		if len(args) != 1 {
+			return fail("Error: an algorithm is required unless --kat is given")
+		}
+
 		algorithm := args[0]
 		data, _ := cmd.Flags().GetString("data")
 		if data == "" {
@@ -65,9 +105,7 @@ var cryptoTestCmd = &cobra.Command{
 		// Test the algorithm
 		result, err := crypto.TestAlgorithm(algorithm, []byte(data))
 		if err != nil {
-			logger.Error("Error testing algorithm '%s': %v", algorithm, err)
-			fmt.Printf("Error testing algorithm '%s': %v\n", algorithm, err)
-			return
+			return fail("Error testing algorithm '%s': %v", algorithm, err)
 		}
 
 		logger.Info("Algorithm '%s' test completed successfully (decryption: %v)", algorithm, result.DecryptionSuccessful)
@@ -82,6 +120,10 @@ var cryptoTestCmd = &cobra.Command{
 		fmt.Printf("  Key generation: %v\n", result.KeyGenTime)
 		fmt.Printf("  Encryption: %v\n", result.EncryptTime)
 		fmt.Printf("  Decryption: %v\n", result.DecryptTime)
+		if !result.DecryptionSuccessful {
+			return errFailed
+		}
+		return nil
 	},
 }
 
@@ -89,7 +131,7 @@ var cryptoSetDefaultCmd = &cobra.Command{
 	Use:   "set-default [algorithm]",
 	Short: "Set the default encryption algorithm",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		algorithm := args[0]
 		postQuantum, _ := cmd.Flags().GetBool("post-quantum")
 
@@ -97,17 +139,332 @@ var cryptoSetDefaultCmd = &cobra.Command{
 
 		err := crypto.SetDefaultAlgorithm(algorithm, postQuantum)
 		if err != nil {
-			logger.Error("Error setting default algorithm: %v", err)
-			fmt.Printf("Error setting default algorithm: %v\n", err)
-			return
+			return fail("Error setting default algorithm: %v", err)
 		}
 
 		logger.Info("Default %s algorithm successfully set to '%s'", postQuantumLabel(postQuantum), algorithm)
 		fmt.Printf("Default %s algorithm set to: %s\n", 
 			postQuantumLabel(postQuantum), algorithm)
+		return nil
+	},
+}
+
+var cryptoAuditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Audit tunnels for weak or deprecated algorithms",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger.Info("Auditing tunnel encryption (post-quantum required: %t)", crypto.RequirePostQuantum())
+		results, err := tunnel.Audit()
+		if err != nil {
+			return fail("Error auditing tunnels: %v", err)
+		}
+
+		if len(results) == 0 {
+			fmt.Println("No tunnels configured")
+			return nil
+		}
+
+		flagged := 0
+		for _, result := range results {
+			if len(result.Findings) == 0 {
+				fmt.Printf("- %s (%s): OK\n", result.Tunnel, result.Encryption)
+				continue
+			}
+
+			flagged++
+			fmt.Printf("- %s (%s):\n", result.Tunnel, result.Encryption)
+			for _, finding := range result.Findings {
+				fmt.Printf("  [%s] %s (recommended: %s)\n", finding.Severity, finding.Message, finding.Recommended)
+			}
+		}
+
+		logger.Info("Audit completed: %d of %d tunnels flagged", flagged, len(results))
+		if flagged > 0 {
+			fmt.Printf("\n%d of %d tunnels flagged. Run 'ipsec-vpn crypto migrate --apply' to migrate them.\n",
+				flagged, len(results))
+		}
+		return nil
+	},
+}
+
+var cryptoMigrateCmd = &cobra.Command{
+	Use:   "migrate [tunnel...]",
+	Short: "Migrate tunnels to a new encryption algorithm",
+	Long: `Rewrite and rekey tunnels in bulk to use a new encryption algorithm.
+If no tunnels are named, every tunnel flagged by 'crypto audit' is migrated.
+Without --apply, the planned changes are only displayed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		to, _ := cmd.Flags().GetString("to")
+		apply, _ := cmd.Flags().GetBool("apply")
+
+		logger.Info("Migrating tunnels to '%s' (apply: %t)", to, apply)
+		migrations, err := tunnel.Migrate(args, to, apply)
+		for _, m := range migrations {
+			if !apply {
+				fmt.Printf("- %s: %s -> %s (dry run)\n", m.Tunnel, m.From, m.To)
+			} else if m.Rekeyed {
+				fmt.Printf("- %s: %s -> %s (rekeyed)\n", m.Tunnel, m.From, m.To)
+			} else {
+				fmt.Printf("- %s: %s -> %s\n", m.Tunnel, m.From, m.To)
+			}
+		}
+		if err != nil {
+			return fail("Error migrating tunnels: %v", err)
+		}
+
+		if len(migrations) == 0 {
+			fmt.Println("No tunnels need migration")
+			return nil
+		}
+
+		if !apply {
+			fmt.Println("\nRe-run with --apply to migrate these tunnels")
+			return nil
+		}
+
+		logger.Info("Migrated %d tunnels to '%s'", len(migrations), to)
+		fmt.Printf("Migrated %d tunnels to %s\n", len(migrations), to)
+		return nil
 	},
 }
 
+var cryptoKeygenCmd = &cobra.Command{
+	Use:   "keygen [name]",
+	Short: "Generate a key pair for file encryption",
+	Long: `Generate a recipient key pair for encrypt-file/decrypt-file.
+The public key is written to [name].pub and the private key to [name].key.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		algorithm, _ := cmd.Flags().GetString("algorithm")
+
+		logger.Info("Generating %s key pair '%s'", algorithm, name)
+		publicPEM, privatePEM, err := crypto.GenerateFileKeyPair(algorithm)
+		if err != nil {
+			return fail("Error generating key pair: %v", err)
+		}
+
+		defer crypto.Zeroize(privatePEM)
+
+		if err := os.WriteFile(name+".key", privatePEM, 0600); err != nil {
+			return fail("Error writing private key: %v", err)
+		}
+		if err := os.WriteFile(name+".pub", publicPEM, 0644); err != nil {
+			return fail("Error writing public key: %v", err)
+		}
+
+		fmt.Printf("Public key written to %s.pub\n", name)
+		fmt.Printf("Private key written to %s.key\n", name)
+		return nil
+	},
+}
+
+var cryptoEncryptFileCmd = &cobra.Command{
+	Use:   "encrypt-file [path]",
+	Short: "Encrypt a file or directory for a recipient",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		inPath := strings.TrimSuffix(args[0], "/")
+		recipient, _ := cmd.Flags().GetString("recipient")
+		recipientKey, _ := cmd.Flags().GetString("recipient-key")
+		outPath, _ := cmd.Flags().GetString("out")
+		armor, _ := cmd.Flags().GetBool("armor")
+		if (recipient == "") == (recipientKey == "") {
+			return fail("Error: either --recipient or --recipient-key is required")
+		}
+
+		if outPath == "" {
+			outPath = inPath + ".enc"
+			if armor {
+				outPath = inPath + ".asc"
+			}
+		}
+
+		var publicPEM []byte
+		if recipientKey != "" {
+			key, err := keys.Get(recipientKey)
+			if err != nil {
+				return fail("Error getting key '%s': %v", recipientKey, err)
+			}
+			public, err := key.PublicBytes()
+			if err != nil || key.Type != keys.TypeKeyPair {
+				return fail("Error: key '%s' is not a key pair", recipientKey)
+			}
+			publicPEM = crypto.PublicKeyPEM(key.Algorithm, public)
+		} else {
+			var err error
+			if publicPEM, err = os.ReadFile(recipient); err != nil {
+				return fail("Error reading recipient key: %v", err)
+			}
+		}
+
+		if err := crypto.EncryptFile(inPath, outPath, publicPEM, armor); err != nil {
+			return fail("Error encrypting '%s': %v", inPath, err)
+		}
+
+		fmt.Printf("Encrypted %s to %s\n", inPath, outPath)
+		return nil
+	},
+}
+
+var cryptoDecryptFileCmd = &cobra.Command{
+	Use:   "decrypt-file [path]",
+	Short: "Decrypt a file or directory encrypted with encrypt-file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		inPath := args[0]
+		keyFile, _ := cmd.Flags().GetString("key")
+		keyName, _ := cmd.Flags().GetString("key-name")
+		outPath, _ := cmd.Flags().GetString("out")
+		if (keyFile == "") == (keyName == "") {
+			return fail("Error: either --key or --key-name is required")
+		}
+
+		if outPath == "" {
+			outPath = strings.TrimSuffix(strings.TrimSuffix(inPath, ".enc"), ".asc")
+			if outPath == inPath {
+				outPath = inPath + ".dec"
+			}
+		}
+
+		if keyName != "" {
+			// The key agent decapsulates if it holds the key
+			key, err := keys.Get(keyName)
+			if err != nil {
+				return fail("Error getting key '%s': %v", keyName, err)
+			}
+			err = crypto.DecryptFileWith(inPath, outPath, key.Algorithm, func(ciphertext []byte) ([]byte, error) {
+				return agent.Decapsulate(keyName, ciphertext)
+			})
+			if err != nil {
+				return fail("Error decrypting '%s': %v", inPath, err)
+			}
+			fmt.Printf("Decrypted %s to %s\n", inPath, outPath)
+			return nil
+		}
+
+		privatePEM, err := os.ReadFile(keyFile)
+		if err != nil {
+			return fail("Error reading private key: %v", err)
+		}
+		defer crypto.Zeroize(privatePEM)
+
+		if err := crypto.DecryptFile(inPath, outPath, privatePEM); err != nil {
+			return fail("Error decrypting '%s': %v", inPath, err)
+		}
+
+		fmt.Printf("Decrypted %s to %s\n", inPath, outPath)
+		return nil
+	},
+}
+
+var cryptoSelftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Check the random number generator and run known-answer tests",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger.Info("Running cryptographic self-test")
+
+		report, err := crypto.CheckEntropy()
+		fmt.Println("Random number generator:")
+		fmt.Printf("  Source: %s\n", report.Source)
+		if report.EntropyAvail >= 0 {
+			fmt.Printf("  Kernel entropy estimate: %d bits\n", report.EntropyAvail)
+		}
+		fmt.Printf("  Pool initialized: %v\n", report.PoolReady)
+		fmt.Printf("  Longest repetition: %d in %d bytes\n", report.MaxRepetition, report.SampleSize)
+		fmt.Printf("  Most frequent byte: %d per window\n", report.MaxProportion)
+		if err != nil {
+			fmt.Printf("  Status: FAILED (%v)\n", err)
+			fmt.Println("\nKey generation is disabled until the random number generator passes its health checks")
+			return errFailed
+		}
+		fmt.Println("  Status: OK")
+		fmt.Println()
+
+		fmt.Println("Known-answer tests:")
+		return runKnownAnswerTests("")
+	},
+}
+
+var cryptoCapsCmd = &cobra.Command{
+	Use:   "caps",
+	Short: "Show hardware cryptographic capabilities",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		caps := crypto.DetectCapabilities()
+		logger.Info("Displaying CPU capabilities for %s", caps.Arch)
+
+		fmt.Printf("Architecture: %s\n", caps.Arch)
+		fmt.Printf("AES instructions: %v\n", caps.AES)
+		fmt.Printf("Carry-less multiply (GHASH): %v\n", caps.PCLMUL)
+		switch caps.Arch {
+		case "amd64", "386":
+			fmt.Printf("AVX2: %v\n", caps.AVX2)
+		case "arm", "arm64":
+			fmt.Printf("NEON: %v\n", caps.NEON)
+		}
+		fmt.Printf("Hardware AES-GCM: %v\n", caps.HardwareAESGCM())
+		fmt.Printf("Fastest cipher: %s\n", caps.PreferredCipher())
+		return nil
+	},
+}
+
+var cryptoBenchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Benchmark ciphers and cache the results for --encryption auto",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		duration, _ := cmd.Flags().GetDuration("duration")
+		logger.Info("Benchmarking ciphers for %v each", duration)
+
+		report, err := crypto.Benchmark(duration)
+		if err != nil {
+			return fail("Error running benchmark: %v", err)
+		}
+
+		fmt.Printf("Backend: %s\n", report.Backend)
+		fmt.Printf("Packet size: %d bytes\n", report.PacketSize)
+		for _, r := range report.Results {
+			fmt.Printf("- %s: %.1f MB/s (%d packets)\n", r.Algorithm, r.Throughput, r.Packets)
+		}
+		fmt.Printf("Fastest cipher: %s\n", report.Fastest())
+
+		if err := crypto.SaveBenchReport(report); err != nil {
+			return fail("Error saving benchmark results: %v", err)
+		}
+		logger.Info("Benchmark results cached, fastest cipher is %s", report.Fastest())
+		return nil
+	},
+}
+
+// runKnownAnswerTests runs and prints the known-answer tests for an algorithm,
+// returning errFailed if any test failed
+func runKnownAnswerTests(algorithm string) error {
+	logger.Info("Running known-answer tests for '%s'", algorithm)
+	results, err := crypto.RunKnownAnswerTests(algorithm)
+	if err != nil {
+		return fail("Error running known-answer tests: %v", err)
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Passed {
+			fmt.Printf("PASS %s: %s (%s)\n", r.Algorithm, r.Name, r.Source)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL %s: %s (%s): %s\n", r.Algorithm, r.Name, r.Source, r.Error)
+	}
+
+	if failed > 0 {
+		logger.Error("%d of %d known-answer tests failed", failed, len(results))
+		fmt.Printf("\n%d of %d known-answer tests failed\n", failed, len(results))
+		return errFailed
+	}
+
+	logger.Info("All %d known-answer tests passed", len(results))
+	fmt.Printf("\nAll %d known-answer tests passed\n", len(results))
+	return nil
+}
+
 // Helper function to get the label for post-quantum status
 func postQuantumLabel(isPostQuantum bool) string {
 	if isPostQuantum {
@@ -121,14 +478,45 @@ func init() {
 	cryptoCmd.AddCommand(cryptoShowCmd)
 	cryptoCmd.AddCommand(cryptoTestCmd)
 	cryptoCmd.AddCommand(cryptoSetDefaultCmd)
+	cryptoCmd.AddCommand(cryptoAuditCmd)
+	cryptoCmd.AddCommand(cryptoMigrateCmd)
+	cryptoCmd.AddCommand(cryptoKeygenCmd)
+	cryptoCmd.AddCommand(cryptoEncryptFileCmd)
+	cryptoCmd.AddCommand(cryptoDecryptFileCmd)
+	cryptoCmd.AddCommand(cryptoSelftestCmd)
+	cryptoCmd.AddCommand(cryptoCapsCmd)
+	cryptoCmd.AddCommand(cryptoBenchCmd)
 
 	// Flags for show command
 	cryptoShowCmd.Flags().Bool("post-quantum", false, "Show post-quantum algorithms only")
 	cryptoShowCmd.Flags().Bool("classic", false, "Show classic algorithms only")
+	cryptoShowCmd.Flags().Bool("wide", false, "Show all columns without truncation")
 
 	// Flags for test command
 	cryptoTestCmd.Flags().String("data", "", "Data to use for testing encryption")
+	cryptoTestCmd.Flags().Bool("kat", false, "Run published known-answer test vectors")
 
 	// Flags for set-default command
 	cryptoSetDefaultCmd.Flags().Bool("post-quantum", false, "Set as default post-quantum algorithm")
+
+	// Flags for migrate command
+	cryptoMigrateCmd.Flags().String("to", crypto.RecommendedAlgorithm, "Algorithm to migrate tunnels to")
+	cryptoMigrateCmd.Flags().Bool("apply", false, "Apply the migration instead of only showing it")
+
+	// Flags for bench command
+	cryptoBenchCmd.Flags().Duration("duration", time.Second, "How long to run each cipher")
+
+	// Flags for keygen command
+	cryptoKeygenCmd.Flags().String("algorithm", crypto.RecommendedAlgorithm, "Key encapsulation algorithm (mlkem768, hybrid-mlkem768-aes256gcm)")
+
+	// Flags for encrypt-file command
+	cryptoEncryptFileCmd.Flags().String("recipient", "", "Recipient public key file")
+	cryptoEncryptFileCmd.Flags().String("recipient-key", "", "Stored key pair to encrypt for")
+	cryptoEncryptFileCmd.Flags().String("out", "", "Output file (default is [path].enc, or [path].asc when armored)")
+	cryptoEncryptFileCmd.Flags().Bool("armor", false, "Write PEM armored output")
+
+	// Flags for decrypt-file command
+	cryptoDecryptFileCmd.Flags().String("key", "", "Private key file")
+	cryptoDecryptFileCmd.Flags().String("key-name", "", "Stored key pair to decrypt with, through the key agent if it holds it")
+	cryptoDecryptFileCmd.Flags().String("out", "", "Output file or directory (default strips .enc/.asc)")
 }
\ No newline at end of file
@@ -0,0 +1,411 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/discovery"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// discoverTimeout bounds a discovery, retries included
+const discoverTimeout = 30 * time.Second
+
+// pairLinger is how long 'discover pair' keeps announcing itself once paired,
+// so that a peer that has not found it yet does
+const pairLinger = 5 * time.Second
+
+// discoverCmd represents the discover command
+var discoverCmd = &cobra.Command{
+	Use:   "discover",
+	Short: "Find other instances on the local network, or the hubs to connect to",
+	Long: `Without a subcommand, announce this instance on the local network over mDNS, as
+_ipsecvpn._udp.local, and list the other instances heard during --timeout:
+candidate peers for a lab or a demo. Run 'discover pair' on two of them to
+create a WireGuard tunnel between them.
+
+'discover dns' finds the hubs a spoke connects to and the parameters of its
+tunnels to them, such as the subnet behind each hub, so that spokes are brought
+up without their hubs' addresses. With --apply, the tunnels to the hubs found
+are created like 'tunnel apply' creates those of a file: tunnels that exist are
+left alone.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		self, err := lanAnnouncement(cmd)
+		if err != nil {
+			return err
+		}
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+		defer cancel()
+		peers, err := browseLAN(ctx, cmd, self)
+		if err != nil {
+			return fail("Error discovering instances: %v", err)
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, peers)
+		}
+		if len(peers) == 0 {
+			fmt.Printf("No other instances found on the local network in %s\n", timeout)
+			return nil
+		}
+		tbl := table.New(
+			table.Column{Header: "NAME", MaxWidth: 24},
+			table.Column{Header: "ADDRESS"},
+			table.Column{Header: "PORT"},
+			table.Column{Header: "SUBNET"},
+			table.Column{Header: "PAIRING WITH", MaxWidth: 24},
+		)
+		for _, p := range peers {
+			tbl.AddRow(p.Name, p.Address, strconv.Itoa(p.Port), orDash(p.Params[discovery.ParamSubnet]),
+				orDash(p.Params[discovery.ParamPair]))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var discoverPairCmd = &cobra.Command{
+	Use:   "pair [peer]",
+	Short: "Create a WireGuard tunnel with another instance on the local network",
+	Long: `Pair with another instance on the local network: run 'discover pair' on both,
+each naming the other, e.g. 'discover pair laptop-b' on laptop-a and 'discover
+pair laptop-a' on laptop-b. Each announces the WireGuard public key of its
+tunnel to the other and its --local-subnet over mDNS, and waits up to --timeout
+for the other to do the same. Both then show a pairing code, a digest of both
+keys: check that they match before going ahead, so that neither pairs with an
+impostor. Each creates a WireGuard tunnel named after the other.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		peerName := args[0]
+		self, err := lanAnnouncement(cmd)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(peerName, self.Name) {
+			return fail("Error: cannot pair with this instance, %s", self.Name)
+		}
+		if !keys.ValidName(peerName) {
+			return fail("Error: invalid peer name %s, it names the tunnel", peerName)
+		}
+		local, err := discoverLocal(cmd)
+		if err != nil {
+			return err
+		}
+		if local.Subnet == "" {
+			return fail("Error: --local-subnet or discovery.local_subnet is needed to pair")
+		}
+		if _, err := tunnel.Get(peerName); !errors.Is(err, tunnel.ErrNotFound) {
+			return fail("Error: tunnel '%s' exists, delete it to pair again", peerName)
+		}
+		key, err := tunnel.PrepareWireGuardKey(peerName)
+		if err != nil {
+			return fail("Error generating the WireGuard key of tunnel '%s': %v", peerName, err)
+		}
+		self.Params[discovery.ParamSubnet] = local.Subnet
+		self.Params[discovery.ParamWGKey] = key
+		self.Params[discovery.ParamPair] = peerName
+
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+		lan, done, err := listenLAN(ctx, cmd, self)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		defer func() {
+			cancel()
+			<-done
+			lan.Close()
+		}()
+
+		fmt.Printf("Waiting for %s to pair with %s...\n", peerName, self.Name)
+		waitCtx, stop := context.WithTimeout(ctx, timeout)
+		defer stop()
+		var peer discovery.Hub
+		err = pollLAN(waitCtx, lan, func() bool {
+			var ok bool
+			peer, ok = lan.Peer(peerName)
+			return ok && strings.EqualFold(peer.Params[discovery.ParamPair], self.Name) && peer.Params[discovery.ParamWGKey] != ""
+		})
+		if err != nil {
+			return fail("Error: %s did not pair with %s within %s, run 'discover pair %s' on it", peerName, self.Name, timeout, self.Name)
+		}
+
+		if local.IP == "" {
+			if local.IP, err = localAddressTo(peer.Address); err != nil {
+				return fail("Error: %v", err)
+			}
+		}
+		spec, err := peer.Spec(local)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		spec.Mode = tunnel.ModeWireGuard
+		fmt.Printf("Pairing code: %s\n", discovery.PairingCode(key, peer.Params[discovery.ParamWGKey]))
+		if !confirm(cmd, "pair with "+peerName+" if it shows the same pairing code", []string{fmt.Sprintf(
+			"create WireGuard tunnel '%s' from %s to %s, carrying %s to %s", spec.Name, spec.LocalIP, spec.RemoteIP,
+			spec.LocalSubnet, spec.RemoteSubnet)}) {
+			return errFailed
+		}
+		action, details, err := applySpec(spec, false)
+		if err != nil {
+			return fail("Error creating tunnel '%s': %v", spec.Name, err)
+		}
+		logger.Info("Paired with %s at %s as tunnel '%s'", peerName, peer.Address, spec.Name)
+		fmt.Printf("Tunnel '%s' %s, %s\n", spec.Name, action, details)
+
+		// The peer may not have found this instance yet
+		select {
+		case <-time.After(pairLinger):
+		case <-cmd.Context().Done():
+		}
+		return nil
+	},
+}
+
+// lanAnnouncement returns what this instance announces on the local network
+func lanAnnouncement(cmd *cobra.Command) (discovery.Announcement, error) {
+	name, _ := cmd.Flags().GetString("name")
+	if name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return discovery.Announcement{}, fail("Error: %v, give --name", err)
+		}
+		name, _, _ = strings.Cut(strings.ToLower(host), ".")
+	}
+	if !keys.ValidName(name) {
+		return discovery.Announcement{}, fail("Error: invalid instance name %s, give --name", name)
+	}
+	port, _ := cmd.Flags().GetInt("listen-port")
+	local := discovery.DefaultLocal()
+	if ip, _ := cmd.Flags().GetString("local-ip"); ip != "" {
+		local.IP = ip
+	}
+	params := map[string]string{discovery.ParamName: name, discovery.ParamMode: tunnel.ModeWireGuard}
+	if subnet, _ := cmd.Flags().GetString("local-subnet"); subnet != "" {
+		params[discovery.ParamSubnet] = subnet
+	}
+	return discovery.Announcement{Name: name, Address: local.IP, Port: port, Params: params}, nil
+}
+
+// listenLAN joins the mDNS group to announce self until ctx is done, when done
+// is closed
+func listenLAN(ctx context.Context, cmd *cobra.Command, self discovery.Announcement) (*discovery.LAN, <-chan struct{}, error) {
+	iface, _ := cmd.Flags().GetString("interface")
+	lan, err := discovery.ListenLAN(iface, self)
+	if err != nil {
+		return nil, nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := lan.Run(ctx); err != nil {
+			logger.Error("mDNS discovery stopped: %v", err)
+		}
+	}()
+	return lan, done, nil
+}
+
+// pollLAN announces this instance and queries the others every second until
+// found reports true, or ctx is done
+func pollLAN(ctx context.Context, lan *discovery.LAN, found func() bool) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if err := lan.Announce(); err != nil {
+			return err
+		}
+		if err := lan.Query(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if found != nil && found() {
+			return nil
+		}
+	}
+}
+
+// browseLAN announces this instance until ctx is done and returns the others
+// heard
+func browseLAN(ctx context.Context, cmd *cobra.Command, self discovery.Announcement) ([]discovery.Hub, error) {
+	runCtx, cancel := context.WithCancel(context.Background())
+	lan, done, err := listenLAN(runCtx, cmd, self)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	err = pollLAN(ctx, lan, nil)
+	cancel()
+	<-done
+	peers := lan.Peers()
+	lan.Close()
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// localAddressTo returns the local address that reaches a peer, the one its
+// route leaves from; no packet is sent
+func localAddressTo(address string) (string, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(address, "9"))
+	if err != nil {
+		return "", fmt.Errorf("no route to %s: %v", address, err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+var discoverDNSCmd = &cobra.Command{
+	Use:   "dns [domain]",
+	Short: "Find hubs from the _ipsecvpn._udp SRV and TXT records of a domain",
+	Long: `Find hubs from the _ipsecvpn._udp SRV records of a domain, discovery.domain or
+else the domain of the host's name, preferred hubs (lowest priority, then
+heaviest weight) first. Their parameters come from TXT records starting with
+` + discovery.TXTVersion + `, those of _ipsecvpn._udp.<domain> shared by every hub and
+those of a hub's host name its own, e.g.
+
+  _ipsecvpn._udp.branches.example.com. SRV 10 50 500 hub1.example.com.
+  _ipsecvpn._udp.branches.example.com. TXT "` + discovery.TXTVersion + ` subnet=10.0.0.0/16 pq=true"
+  hub1.example.com.                    TXT "` + discovery.TXTVersion + ` name=hub-fra"
+
+Hubs are authenticated by IKE like any peer, not by the records, so DNS only
+tells spokes where to connect.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain := discovery.DefaultDomain()
+		if len(args) == 1 {
+			domain = args[0]
+		}
+		local, err := discoverLocal(cmd)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), discoverTimeout)
+		defer cancel()
+		hubs, err := discovery.LookupDNS(ctx, net.DefaultResolver, domain, local)
+		if err != nil {
+			return fail("Error discovering hubs: %v", err)
+		}
+		return discoveredHubs(cmd, hubs, local)
+	},
+}
+
+// discoverLocal returns the local end of the tunnels to the hubs, from the
+// flags or else the configuration
+func discoverLocal(cmd *cobra.Command) (discovery.Local, error) {
+	local := discovery.DefaultLocal()
+	if cmd.Flags().Changed("local-ip") {
+		local.IP, _ = cmd.Flags().GetString("local-ip")
+	}
+	if cmd.Flags().Changed("local-subnet") {
+		local.Subnet, _ = cmd.Flags().GetString("local-subnet")
+	}
+	if apply, _ := cmd.Flags().GetBool("apply"); apply && (local.IP == "" || local.Subnet == "") {
+		return local, fail("Error: --apply needs --local-ip and --local-subnet, or discovery.local_ip and discovery.local_subnet")
+	}
+	return local, nil
+}
+
+// discoveredHubs lists the hubs found or, with --apply, creates the tunnels to
+// them
+func discoveredHubs(cmd *cobra.Command, hubs []discovery.Hub, local discovery.Local) error {
+	if limit, _ := cmd.Flags().GetInt("max-hubs"); limit > 0 && len(hubs) > limit {
+		hubs = hubs[:limit]
+	}
+	if apply, _ := cmd.Flags().GetBool("apply"); apply {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		return applyHubs(cmd, hubs, local, dryRun)
+	}
+	if jsonOutput(cmd) {
+		return writeJSON(os.Stdout, hubs)
+	}
+
+	tbl := table.New(
+		table.Column{Header: "NAME", MaxWidth: 24},
+		table.Column{Header: "HUB", MaxWidth: 40},
+		table.Column{Header: "ADDRESS"},
+		table.Column{Header: "PRIORITY"},
+		table.Column{Header: "WEIGHT"},
+		table.Column{Header: "SUBNET"},
+		table.Column{Header: "MODE"},
+	)
+	for _, h := range hubs {
+		tbl.AddRow(h.Name, net.JoinHostPort(h.Target, strconv.Itoa(h.Port)), h.Address, strconv.Itoa(h.Priority),
+			strconv.Itoa(h.Weight), orDash(h.Params[discovery.ParamSubnet]), orDash(h.Params[discovery.ParamMode]))
+	}
+	tbl.Render(os.Stdout, tableOptions(cmd))
+	return nil
+}
+
+// applyHubs creates the tunnels to hubs that do not exist, unless in a dry run
+func applyHubs(cmd *cobra.Command, hubs []discovery.Hub, local discovery.Local, dryRun bool) error {
+	tbl := table.New(
+		table.Column{Header: "TUNNEL", MaxWidth: 24},
+		table.Column{Header: "ACTION", Status: true},
+		table.Column{Header: "DETAILS", MaxWidth: 60},
+	)
+	failed := 0
+	for _, h := range hubs {
+		action, details := "", ""
+		spec, err := h.Spec(local)
+		if err == nil {
+			action, details, err = applySpec(spec, dryRun)
+		}
+		if err != nil {
+			failed++
+			action, details = "FAILED", err.Error()
+			logger.Error("Failed to create tunnel to hub %s: %v", h.Target, err)
+		}
+		tbl.AddRow(h.Name, action, orDash(details))
+	}
+	tbl.Render(os.Stdout, tableOptions(cmd))
+	if failed > 0 {
+		return fail("Error: %d of %d hubs failed", failed, len(hubs))
+	}
+	return nil
+}
+
+func init() {
+	discoverCmd.AddCommand(discoverDNSCmd)
+	discoverCmd.AddCommand(discoverPairCmd)
+
+	for _, c := range []*cobra.Command{discoverCmd, discoverPairCmd} {
+		c.Flags().String("name", "", "Name this instance announces, which names the peer's tunnel to it; defaults to the host name")
+		c.Flags().String("interface", "", "Interface to announce and listen on; defaults to the one the system picks")
+		c.Flags().String("local-ip", "", "Local end of the tunnel; defaults to discovery.local_ip, or the address that reaches the peer")
+		c.Flags().String("local-subnet", "", "Subnet this instance carries through the tunnel; defaults to discovery.local_subnet")
+		c.Flags().Int("listen-port", tunnel.DefaultWireGuardPort, "UDP port of the WireGuard tunnel")
+	}
+	discoverCmd.Flags().Duration("timeout", 3*time.Second, "How long to listen for other instances")
+	discoverCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	discoverCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+	discoverPairCmd.Flags().Duration("timeout", 2*time.Minute, "How long to wait for the peer to pair")
+	addYesFlag(discoverPairCmd)
+
+	for _, c := range []*cobra.Command{discoverDNSCmd} {
+		c.Flags().Bool("apply", false, "Create the tunnels to the hubs found that do not exist")
+		c.Flags().Bool("dry-run", false, "With --apply, show what would be created without creating anything")
+		c.Flags().String("local-ip", "", "Local end of the tunnels to the hubs; defaults to discovery.local_ip")
+		c.Flags().String("local-subnet", "", "Local subnet of the tunnels to the hubs; defaults to discovery.local_subnet")
+		c.Flags().Int("max-hubs", 0, "Only the preferred hubs, at most this many; 0 for all")
+		c.Flags().Bool("wide", false, "Show all columns without truncation")
+		c.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+	}
+}
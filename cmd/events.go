@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// eventsCmd represents the events command
+var eventsCmd = &cobra.Command{
+	Use:   "events",
+	Short: "Publish tunnel events to MQTT, NATS, Kafka or email",
+	Long: `Tunnel lifecycle events are published to the brokers in events.publishers as
+tunnels are created, started, stopped, fail or are deleted. Each event is a JSON
+object with its type (tunnel.created, tunnel.up, tunnel.down, tunnel.error,
+tunnel.deleted or tunnel.stats), the tunnel, host, time, status and reason.
+Certificates that fail to renew before they expire publish certificate.expiring,
+and rejected peers publish auth.failure.
+
+MQTT events are published under <topic>/tunnel/<event> and NATS events under
+<topic>.tunnel.<event>. Kafka events go to the topic itself, keyed by tunnel.
+An unreachable broker is logged but never fails the tunnel operation.
+
+With events.email.enabled set, events of the types in events.email.types are
+also emailed through the SMTP server and to the recipients in alerts.email, at
+most events.email.rate_limit emails an hour.`,
+}
+
+var eventsStreamCmd = &cobra.Command{
+	Use:   "stream",
+	Short: "Publish the traffic counters of each tunnel periodically",
+	Long: `Run in the foreground, publishing a tunnel.stats event with the received and sent
+bytes of each tunnel that is up every events.stats_interval seconds.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		interval := viper.GetInt("events.stats_interval")
+		if cmd.Flags().Changed("interval") {
+			interval, _ = cmd.Flags().GetInt("interval")
+		}
+		if interval <= 0 {
+			return fail("Error: the interval must be a positive number of seconds")
+		}
+		publishers, err := events.Publishers()
+		if err != nil {
+			return fail("Error reading event publishers: %v", err)
+		}
+		if len(publishers) == 0 {
+			return fail("Error: no event publishers configured, set events.publishers")
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+
+		logger.Info("Publishing tunnel stats every %d seconds", interval)
+		for {
+			if err := tunnel.PublishStats(); err != nil {
+				logger.Error("Failed to publish tunnel stats: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-sigs:
+				return nil
+			}
+		}
+	},
+}
+
+var eventsTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Publish a test event to each configured broker and email recipient",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		publishers, err := events.Publishers()
+		if err != nil {
+			return fail("Error reading event publishers: %v", err)
+		}
+		if len(publishers) == 0 {
+			return fail("Error: no event publishers configured, set events.publishers or events.email.enabled")
+		}
+
+		failed := events.PublishTo(publishers, events.New(events.TypeTest, ""))
+		for _, p := range publishers {
+			if err, ok := failed[p]; ok {
+				fmt.Printf("%s: %v\n", p, err)
+			} else {
+				fmt.Printf("%s: ok\n", p)
+			}
+		}
+		if len(failed) > 0 {
+			return fail("Error: %d of %d publishers failed", len(failed), len(publishers))
+		}
+		return nil
+	},
+}
+
+func init() {
+	eventsCmd.AddCommand(eventsStreamCmd)
+	eventsCmd.AddCommand(eventsTestCmd)
+
+	eventsStreamCmd.Flags().Int("interval", 0, "Seconds between samples, overriding events.stats_interval (default 60)")
+}
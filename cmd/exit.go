@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+)
+
+// Exit codes returned by tunnel status
+const (
+	exitUp       = 0
+	exitDown     = 1
+	exitError    = 2
+	exitNotFound = 3
+)
+
+// ExitError is returned by a command that has already reported its failure. The
+// process exits with Code without printing anything further.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// errFailed is returned by commands that have already printed why they failed
+var errFailed = &ExitError{Code: 1}
+
+// lastFailure is the message of the last fail, recorded in the history
+var lastFailure string
+
+// fail logs and prints an error message and returns errFailed
+func fail(format string, args ...interface{}) error {
+	lastFailure = fmt.Sprintf(format, args...)
+	logger.Error(format, args...)
+	fmt.Printf(format+"\n", args...)
+	return errFailed
+}
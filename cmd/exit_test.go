@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/viper"
+)
+
+func TestStatusExitCode(t *testing.T) {
+	tests := []struct {
+		status tunnel.Status
+		want   int
+	}{
+		{tunnel.StatusUp, exitUp},
+		{tunnel.StatusDown, exitDown},
+		{tunnel.StatusError, exitError},
+		{tunnel.StatusUnknown, exitError},
+		{"", exitError},
+	}
+	for _, tt := range tests {
+		if got := statusExitCode(tt.status); got != tt.want {
+			t.Errorf("Expected status %q to exit with %d, got %d", tt.status, tt.want, got)
+		}
+	}
+}
+
+func TestTunnelStatusQuiet(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	defer viper.Set("config_dir", "")
+	if err := tunnelStatusCmd.Flags().Set("quiet", "true"); err != nil {
+		t.Fatal(err)
+	}
+	defer tunnelStatusCmd.Flags().Set("quiet", "false")
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		args  []string
+		want  int
+	}{
+		{"no tunnels", nil, nil, exitNotFound},
+		{"missing tunnel", nil, []string{"office"}, exitNotFound},
+		{"unreadable tunnel", map[string]string{"office.json": "{"}, []string{"office"}, exitError},
+		{"other tunnel", map[string]string{"branch.json": `{"name": "branch"}`}, []string{"office"}, exitNotFound},
+	}
+	for _, tt := range tests {
+		tunnelsDir := filepath.Join(dir, "tunnels")
+		if err := os.RemoveAll(tunnelsDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(tunnelsDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range tt.files {
+			if err := os.WriteFile(filepath.Join(tunnelsDir, name), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := tunnelStatusCmd.RunE(tunnelStatusCmd, tt.args)
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) || exitErr.Code != tt.want {
+			t.Errorf("%s: expected exit status %d, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestExitError(t *testing.T) {
+	err := fail("Error deleting key '%s': %v", "office", errors.New("not found"))
+	if err != errFailed || lastFailure != "Error deleting key 'office': not found" {
+		t.Errorf("Expected fail to record the message and return errFailed, got %v and %q", err, lastFailure)
+	}
+
+	// main finds the exit status through wrapping
+	var exitErr *ExitError
+	if !errors.As(fmt.Errorf("apply: %w", &ExitError{Code: exitNotFound}), &exitErr) || exitErr.Code != exitNotFound {
+		t.Errorf("Expected the exit status through a wrapped error, got %v", exitErr)
+	}
+	if got := (&ExitError{Code: 2}).Error(); got != "exit status 2" {
+		t.Errorf("Expected \"exit status 2\", got %q", got)
+	}
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// fsckCmd represents the fsck command
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Check the tunnel store for damaged records and orphans",
+	Long: `Check every stored tunnel against the schema and against the system:
+
+  invalid     Tunnel files that are not valid JSON, hold another tunnel, fail
+              validation or have an unknown status or unparsable policy rules
+  orphan      Tunnels whose interface is missing, GRE and WireGuard interfaces
+              named after tunnels that do not exist, and SLA histories and debug
+              transcripts of deleted tunnels
+  duplicate   Tunnels in the same namespace with the same subnets, whose XFRM
+              policies would match the same traffic
+  reused      WireGuard peer keys used by several tunnels, stored keys with the
+              same key material, and XFRM states sharing an SPI or key
+
+With --repair, the problems that can be fixed safely are: damaged files are
+moved aside, records are rewritten, missing interfaces are created and orphaned
+interfaces and files are deleted. The rest are left to be fixed by hand.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repair, _ := cmd.Flags().GetBool("repair")
+
+		problems, err := tunnel.Fsck()
+		if err != nil {
+			return fail("Error checking tunnels: %v", err)
+		}
+		if len(problems) == 0 {
+			fmt.Println("No problems found")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "KIND", Status: true},
+			table.Column{Header: "SUBJECT", MaxWidth: 40},
+			table.Column{Header: "PROBLEM", MaxWidth: 60},
+			table.Column{Header: "REPAIR", MaxWidth: 40},
+		)
+		remaining := 0
+		for _, p := range problems {
+			action := p.Repair
+			switch {
+			case p.Repair == "":
+				action = "manual"
+				remaining++
+			case repair:
+				if err := p.Fix(); err != nil {
+					logger.Error("Failed to repair %s: %v", p.Subject, err)
+					action = "FAILED: " + err.Error()
+					remaining++
+				} else {
+					logger.Info("Repaired %s: %s", p.Subject, p.Repair)
+					action = "done: " + p.Repair
+				}
+			default:
+				remaining++
+			}
+			tbl.AddRow(p.Kind, p.Subject, p.Message, action)
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+
+		if remaining > 0 {
+			if !repair {
+				fmt.Printf("\n%d problems found, run with --repair to fix those that can be\n", remaining)
+			}
+			return errFailed
+		}
+		return nil
+	},
+}
+
+func init() {
+	fsckCmd.Flags().Bool("repair", false, "Fix the problems that can be fixed safely")
+	fsckCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+}
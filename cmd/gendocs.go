@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// genDocsCmd represents the gen-docs command
+var genDocsCmd = &cobra.Command{
+	Use:   "gen-docs",
+	Short: "Generate man pages from the command tree",
+	Long: `Generate a man page for every command, e.g. ipsec-vpn-tunnel-create.1.
+Install them with: sudo cp man/*.1 /usr/local/share/man/man1/`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		man, _ := cmd.Flags().GetBool("man")
+		dir, _ := cmd.Flags().GetString("dir")
+
+		if !man {
+			return fail("Error: choose a documentation format, e.g. --man")
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fail("Error creating %s: %v", dir, err)
+		}
+
+		count, err := writeManPages(rootCmd, dir)
+		if err != nil {
+			return fail("Error generating man pages: %v", err)
+		}
+
+		logger.Info("Generated %d man pages in %s", count, dir)
+		fmt.Printf("Generated %d man pages in %s\n", count, dir)
+		return nil
+	},
+}
+
+// writeManPages writes a man page for cmd and each of its visible subcommands
+func writeManPages(cmd *cobra.Command, dir string) (int, error) {
+	count := 0
+	for _, sub := range cmd.Commands() {
+		if !sub.IsAvailableCommand() || sub.IsAdditionalHelpTopicCommand() {
+			continue
+		}
+		n, err := writeManPages(sub, dir)
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+
+	name := strings.ReplaceAll(cmd.CommandPath(), " ", "-") + ".1"
+	if err := os.WriteFile(filepath.Join(dir, name), manPage(cmd), 0644); err != nil {
+		return count, err
+	}
+	return count + 1, nil
+}
+
+// manPage renders a command as a roff man page
+func manPage(cmd *cobra.Command) []byte {
+	var buf bytes.Buffer
+	title := strings.ToUpper(strings.ReplaceAll(cmd.CommandPath(), " ", "-"))
+	date := time.Now().Format("Jan 2006")
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		var secs int64
+		if _, err := fmt.Sscan(epoch, &secs); err == nil {
+			date = time.Unix(secs, 0).UTC().Format("Jan 2006")
+		}
+	}
+
+	fmt.Fprintf(&buf, ".TH \"%s\" \"1\" \"%s\" \"ipsec-vpn %s\" \"IPsec VPN Manual\"\n", title, date, Version)
+
+	buf.WriteString(".SH NAME\n")
+	fmt.Fprintf(&buf, "%s \\- %s\n", roffEscape(strings.ReplaceAll(cmd.CommandPath(), " ", "-")), roffEscape(cmd.Short))
+
+	buf.WriteString(".SH SYNOPSIS\n")
+	fmt.Fprintf(&buf, ".B %s\n", roffEscape(cmd.UseLine()))
+
+	buf.WriteString(".SH DESCRIPTION\n")
+	description := cmd.Long
+	if description == "" {
+		description = cmd.Short
+	}
+	for _, para := range strings.Split(strings.TrimSpace(description), "\n\n") {
+		buf.WriteString(".PP\n")
+		buf.WriteString(roffEscape(para))
+		buf.WriteString("\n")
+	}
+
+	if cmd.HasAvailableLocalFlags() {
+		buf.WriteString(".SH OPTIONS\n")
+		writeManFlags(&buf, cmd.NonInheritedFlags())
+	}
+	if cmd.HasAvailableInheritedFlags() {
+		buf.WriteString(".SH OPTIONS INHERITED FROM PARENT COMMANDS\n")
+		writeManFlags(&buf, cmd.InheritedFlags())
+	}
+
+	var seeAlso []string
+	if cmd.HasParent() {
+		seeAlso = append(seeAlso, strings.ReplaceAll(cmd.Parent().CommandPath(), " ", "-"))
+	}
+	for _, sub := range cmd.Commands() {
+		if sub.IsAvailableCommand() && !sub.IsAdditionalHelpTopicCommand() {
+			seeAlso = append(seeAlso, strings.ReplaceAll(sub.CommandPath(), " ", "-"))
+		}
+	}
+	if len(seeAlso) > 0 {
+		buf.WriteString(".SH SEE ALSO\n")
+		for i, name := range seeAlso {
+			sep := ","
+			if i == len(seeAlso)-1 {
+				sep = ""
+			}
+			fmt.Fprintf(&buf, ".BR %s (1)%s\n", roffEscape(name), sep)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// writeManFlags renders a flag set as a roff tagged paragraph list
+func writeManFlags(buf *bytes.Buffer, flags *pflag.FlagSet) {
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Hidden {
+			return
+		}
+
+		buf.WriteString(".TP\n")
+		if f.Shorthand != "" {
+			fmt.Fprintf(buf, "\\fB\\-%s\\fP, \\fB\\-\\-%s\\fP", f.Shorthand, roffEscape(f.Name))
+		} else {
+			fmt.Fprintf(buf, "\\fB\\-\\-%s\\fP", roffEscape(f.Name))
+		}
+		if f.Value.Type() != "bool" && f.DefValue != "" && f.DefValue != "[]" {
+			fmt.Fprintf(buf, "=%s", roffEscape(f.DefValue))
+		}
+		buf.WriteString("\n")
+		buf.WriteString(roffEscape(f.Usage))
+		buf.WriteString("\n")
+	})
+}
+
+// roffEscape escapes text for use in a man page
+func roffEscape(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\e")
+	s = strings.ReplaceAll(s, "-", "\\-")
+
+	// Lines starting with a control character would be read as requests
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+			lines[i] = "\\&" + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func init() {
+	genDocsCmd.Flags().Bool("man", false, "Generate man pages")
+	genDocsCmd.Flags().String("dir", "man", "Directory to write the documentation to")
+}
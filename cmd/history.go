@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/config"
+	"github.com/dzakwan/ipsec-vpn/pkg/history"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show who changed what",
+	Long: `Every command that changes something is recorded in the configuration
+directory with its command line, the user who ran it (the one who invoked sudo,
+under sudo) and how it ended. Commands that only show something are not.
+The history is kept apart from the log, and holds the last
+history.max_entries commands.
+
+With history.record_operations on, the changes made through the command line
+and the RESTCONF API are also recorded, with what it takes to make them again,
+for 'ipsec-vpn history replay' to reproduce the state they left.`,
+}
+
+var historyShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the commands that changed something, newest last",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var filter history.Filter
+		filter.User, _ = cmd.Flags().GetString("user")
+		filter.Match, _ = cmd.Flags().GetString("match")
+		filter.Failed, _ = cmd.Flags().GetBool("failed")
+		if since, _ := cmd.Flags().GetDuration("since"); since > 0 {
+			filter.Since = time.Now().Add(-since)
+		}
+		limit, _ := cmd.Flags().GetInt("limit")
+
+		entries, err := history.Load(filter)
+		if err != nil {
+			return fail("Error reading the command history: %v", err)
+		}
+		if len(entries) == 0 {
+			fmt.Println("No commands recorded")
+			return nil
+		}
+		if limit > 0 && len(entries) > limit {
+			entries = entries[len(entries)-limit:]
+		}
+
+		tbl := table.New(
+			table.Column{Header: "TIME"},
+			table.Column{Header: "USER", MaxWidth: 16},
+			table.Column{Header: "COMMAND", MaxWidth: 60},
+			table.Column{Header: "STATUS", Status: true},
+			table.Column{Header: "ERROR", MaxWidth: 50},
+		)
+		for _, e := range entries {
+			if e.Failed() {
+				tbl.AddRow(e.Time.Format(time.DateTime), e.User, e.Command, "failed", e.Result)
+			} else {
+				tbl.AddRow(e.Time.Format(time.DateTime), e.User, e.Command, "ok", "-")
+			}
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+// recordHistory records a command that may have changed something
+func recordHistory(cmd *cobra.Command, err error) {
+	if cmd == nil || readOnly(cmd) {
+		return
+	}
+	args := redactArgs(cmd, os.Args[1:])
+	e := history.Entry{
+		Time:     started,
+		User:     currentUserName(),
+		Command:  history.CommandLine(append([]string{cmd.Root().Name()}, args...)),
+		Result:   history.ResultOK,
+		Duration: time.Since(started).Seconds(),
+	}
+	var exitErr *ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		e.ExitCode = exitErr.Code
+		e.Result = lastFailure
+		if e.Result == "" {
+			e.Result = "exit status " + strconv.Itoa(exitErr.Code)
+		}
+	default:
+		e.ExitCode = 1
+		e.Result = err.Error()
+	}
+	if err := history.Record(e); err != nil {
+		logger.Error("Failed to record the command in the history: %v", err)
+	}
+	op := history.Operation{Time: started, Source: history.SourceCLI, User: e.User, Args: args, Result: e.Result}
+	if err := history.RecordOperation(op); err != nil {
+		logger.Error("Failed to record the operation for replay: %v", err)
+	}
+}
+
+// secretAnnotation marks a flag whose value is a secret, which is masked in
+// the history
+const secretAnnotation = "secret"
+
+// redactArgs masks the secrets in the arguments a command was run with: the
+// values of flags marked with secretAnnotation, of --set for secret settings,
+// and of 'config set' for them
+func redactArgs(cmd *cobra.Command, args []string) []string {
+	redacted := slices.Clone(args)
+	var positional []int
+	for i := 0; i < len(redacted); i++ {
+		arg := redacted[i]
+		if arg == "--" {
+			for j := i + 1; j < len(redacted); j++ {
+				positional = append(positional, j)
+			}
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, i)
+			continue
+		}
+
+		var flag *pflag.Flag
+		name, value, inline := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "--") {
+			flag = lookupFlag(cmd, name)
+		} else {
+			// Shorthands may carry their value, as in -n5
+			flag = cmd.Flags().ShorthandLookup(arg[1:2])
+			if flag == nil {
+				flag = cmd.InheritedFlags().ShorthandLookup(arg[1:2])
+			}
+			value, inline = strings.TrimPrefix(arg[2:], "="), len(arg) > 2
+		}
+		if flag == nil || (flag.NoOptDefVal != "" && !inline) {
+			continue
+		}
+		// The value is either the end of this argument or the next one
+		prefix := arg[:len(arg)-len(value)]
+		if !inline {
+			if i+1 >= len(redacted) {
+				break
+			}
+			i++
+			prefix, value = "", redacted[i]
+		}
+
+		switch {
+		case len(flag.Annotations[secretAnnotation]) > 0:
+			value = masked
+		case flag.Name == "set":
+			if key, _, ok := strings.Cut(value, "="); ok && config.Secret(strings.TrimSpace(key)) {
+				value = key + "=" + masked
+			}
+		}
+		redacted[i] = prefix + value
+	}
+
+	// 'config set [key] [value]', after the names of the commands
+	words := len(strings.Fields(cmd.CommandPath())) - 1
+	if strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ") == "config set" && len(positional) >= words+2 {
+		if config.Secret(redacted[positional[words]]) {
+			redacted[positional[words+1]] = masked
+		}
+	}
+	return redacted
+}
+
+// lookupFlag finds a flag of a command by name, including those of its parents
+func lookupFlag(cmd *cobra.Command, name string) *pflag.Flag {
+	if flag := cmd.Flags().Lookup(name); flag != nil {
+		return flag
+	}
+	return cmd.InheritedFlags().Lookup(name)
+}
+
+func init() {
+	historyCmd.AddCommand(historyShowCmd)
+
+	// Flags for show command
+	historyShowCmd.Flags().String("user", "", "Only show commands run by this user")
+	historyShowCmd.Flags().String("match", "", "Only show command lines containing this text, e.g. 'tunnel delete'")
+	historyShowCmd.Flags().Duration("since", 0, "Only show commands run within this long, e.g. 24h")
+	historyShowCmd.Flags().Bool("failed", false, "Only show commands that failed")
+	historyShowCmd.Flags().IntP("limit", "n", 50, "Show at most this many of the latest commands, 0 for all")
+	historyShowCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+}
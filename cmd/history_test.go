@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestRedactArgs(t *testing.T) {
+	root := &cobra.Command{Use: "ipsec-vpn"}
+	root.PersistentFlags().StringArray("set", nil, "")
+	root.PersistentFlags().BoolP("verbose", "v", false, "")
+	parent := &cobra.Command{Use: "config"}
+	set := &cobra.Command{Use: "set", Run: func(*cobra.Command, []string) {}}
+	set.Flags().String("token", "", "")
+	set.Flags().SetAnnotation("token", secretAnnotation, []string{"true"})
+	root.AddCommand(parent)
+	parent.AddCommand(set)
+
+	tests := []struct {
+		args, want []string
+	}{
+		{
+			[]string{"config", "set", "alerts.email.password", "hunter2"},
+			[]string{"config", "set", "alerts.email.password", masked},
+		},
+		{
+			[]string{"-v", "config", "set", "--", "alerts.email.password", "hunter2"},
+			[]string{"-v", "config", "set", "--", "alerts.email.password", masked},
+		},
+		{
+			[]string{"config", "set", "alerts.email.smtp", "mail.example.com:587"},
+			[]string{"config", "set", "alerts.email.smtp", "mail.example.com:587"},
+		},
+		{
+			[]string{"--set", "alerts.email.password=hunter2", "--set=alerts.email.password=hunter2", "config", "set", "verbose", "true"},
+			[]string{"--set", "alerts.email.password=" + masked, "--set=alerts.email.password=" + masked, "config", "set", "verbose", "true"},
+		},
+		{
+			[]string{"config", "set", "--token", "s3cret", "--token=s3cret", "advanced.dpd_delay", "10"},
+			[]string{"config", "set", "--token", masked, "--token=" + masked, "advanced.dpd_delay", "10"},
+		},
+	}
+	for _, tt := range tests {
+		if got := redactArgs(set, tt.args); !slices.Equal(got, tt.want) {
+			t.Errorf("Expected %q to be redacted to %q, got %q", tt.args, tt.want, got)
+		}
+	}
+}
+
+func TestReplayArgs(t *testing.T) {
+	args := []string{"--config", "/etc/site.yaml", "--set", "config_dir=/var/lib/ipsec-vpn", "--set=log.directory=/var/log",
+		"--set", "history.record_operations=true", "--set", "verbose=true", "--config=/etc/other.yaml",
+		"tunnel", "exec", "office", "--", "ip", "--set", "config_dir=x"}
+	want := []string{"--set", "verbose=true", "tunnel", "exec", "office", "--", "ip", "--set", "config_dir=x"}
+	if got := replayArgs(args); !slices.Equal(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/job"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/spf13/cobra"
+)
+
+// jobCmd represents the job command
+var jobCmd = &cobra.Command{
+	Use:   "job",
+	Short: "Follow operations running in the background",
+	Long: `Commands run with --async, such as 'tunnel create --async', return a job ID
+straight away and carry on in the background. 'job show ID' reports the steps
+the job reached and its result; RESTCONF clients poll the job resource
+instead. Finished jobs are kept for a day.`,
+}
+
+var jobShowCmd = &cobra.Command{
+	Use:   "show [id]",
+	Short: "Show a job, or list the jobs",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if jsonOutput(cmd) {
+			return showJobsJSON(os.Stdout, args)
+		}
+		if watchInterval(cmd) > 0 {
+			watch(cmd, func(w io.Writer) { showJobs(w, args, tableOptions(cmd)) })
+			return nil
+		}
+		return showJobs(os.Stdout, args, tableOptions(cmd))
+	},
+}
+
+// showJobs writes a table of the jobs, or the details of one
+func showJobs(w io.Writer, args []string, opts table.Options) error {
+	if len(args) == 1 {
+		j, err := job.Load(args[0])
+		if err != nil {
+			return fail("Error reading job %s: %v", args[0], err)
+		}
+		fmt.Fprintf(w, "Job:        %s\n", j.ID)
+		fmt.Fprintf(w, "Operation:  %s\n", j.Operation)
+		fmt.Fprintf(w, "State:      %s\n", j.State)
+		fmt.Fprintf(w, "Started:    %s\n", j.Created.Format(time.DateTime))
+		if !j.Finished.IsZero() {
+			fmt.Fprintf(w, "Finished:   %s (took %s)\n", j.Finished.Format(time.DateTime), j.Finished.Sub(j.Created).Round(time.Millisecond))
+		}
+		if j.Error != "" {
+			fmt.Fprintf(w, "Error:      %s\n", j.Error)
+		}
+		if len(j.Steps) > 0 {
+			fmt.Fprintln(w, "Steps:")
+			for _, s := range j.Steps {
+				fmt.Fprintf(w, "  %s  %s\n", s.Time.Format(time.TimeOnly), s.Message)
+			}
+		}
+		return nil
+	}
+
+	jobs, err := job.List()
+	if err != nil {
+		return fail("Error listing jobs: %v", err)
+	}
+	if len(jobs) == 0 {
+		fmt.Fprintln(w, "No jobs")
+		return nil
+	}
+	tbl := table.New(
+		table.Column{Header: "ID"},
+		table.Column{Header: "OPERATION", MaxWidth: 40},
+		table.Column{Header: "STATE", Status: true},
+		table.Column{Header: "STARTED"},
+		table.Column{Header: "LAST STEP", MaxWidth: 40},
+	)
+	for _, j := range jobs {
+		last := j.Error
+		if last == "" && len(j.Steps) > 0 {
+			last = j.Steps[len(j.Steps)-1].Message
+		}
+		tbl.AddRow(j.ID, j.Operation, string(j.State), j.Created.Format(time.DateTime), orDash(last))
+	}
+	tbl.Render(w, opts)
+	return nil
+}
+
+// showJobsJSON writes the jobs, or one, as JSON
+func showJobsJSON(w io.Writer, args []string) error {
+	if len(args) == 1 {
+		j, err := job.Load(args[0])
+		if err != nil {
+			return fail("Error reading job %s: %v", args[0], err)
+		}
+		return writeJSON(w, j)
+	}
+	jobs, err := job.List()
+	if err != nil {
+		return fail("Error listing jobs: %v", err)
+	}
+	return writeJSON(w, jobs)
+}
+
+// addAsyncFlag lets a command carry on in the background as a job
+func addAsyncFlag(cmds ...*cobra.Command) {
+	for _, c := range cmds {
+		c.Flags().Bool("async", false, "Return a job ID straight away and carry on in the background, see 'ipsec-vpn job'")
+		c.Flags().String("job", "", "ID of the job this process runs")
+		c.Flags().MarkHidden("job")
+		c.MarkFlagsMutuallyExclusive("async", "job")
+	}
+}
+
+// startJob records a job for an operation and runs the command again in a
+// session of its own to carry it out, with --job instead of --async
+func startJob(operation string) error {
+	j, err := job.New(operation)
+	if err != nil {
+		return fail("Error starting job: %v", err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		j.Finish(err)
+		return fail("Error starting job: %v", err)
+	}
+	args := slices.DeleteFunc(slices.Clone(os.Args[1:]), func(arg string) bool {
+		return arg == "--async" || strings.HasPrefix(arg, "--async=")
+	})
+	child := exec.Command(self, append(args, "--job", j.ID)...)
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := child.Start(); err != nil {
+		j.Finish(err)
+		return fail("Error starting job: %v", err)
+	}
+	_ = child.Process.Release()
+
+	logger.Info("Started job %s to %s", j.ID, operation)
+	fmt.Println(j.ID)
+	fmt.Fprintf(os.Stderr, "Started job %s to %s, follow it with 'ipsec-vpn job show %s --watch'\n", j.ID, operation, j.ID)
+	return nil
+}
+
+// jobRun is the job a command carries out when run with --job
+type jobRun struct {
+	*job.Job
+}
+
+// attachJob returns the job a command was given with --job, or nil without one
+func attachJob(cmd *cobra.Command) (*jobRun, error) {
+	id, _ := cmd.Flags().GetString("job")
+	if id == "" {
+		return nil, nil
+	}
+	j, err := job.Attach(id)
+	if err != nil {
+		return nil, err
+	}
+	return &jobRun{j}, nil
+}
+
+// step records that the job reached a point, if the command runs one
+func (r *jobRun) step(format string, args ...any) {
+	if r == nil {
+		return
+	}
+	if err := r.Step(format, args...); err != nil {
+		logger.Error("Failed to record the progress of job %s: %v", r.ID, err)
+	}
+}
+
+// finish records the result of the job, if the command runs one. The message of
+// a failure already reported stands for it.
+func (r *jobRun) finish(err error) {
+	if r == nil {
+		return
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) && lastFailure != "" {
+		err = errors.New(lastFailure)
+	}
+	if err := r.Finish(err); err != nil {
+		logger.Error("Failed to record the result of job %s: %v", r.ID, err)
+	}
+}
+
+func init() {
+	jobCmd.AddCommand(jobShowCmd)
+
+	jobShowCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	addWatchFlag(jobShowCmd)
+	addJSONFlag(jobShowCmd)
+}
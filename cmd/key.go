@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/agent"
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/store"
+	"github.com/spf13/cobra"
+)
+
+// keyCmd represents the key command
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage stored keys",
+	Long: `Generate, inspect, and delete stored pre-shared keys and key pairs.
+
+The pre-shared key, or private key, of each stored key is sealed like the
+configuration store: with the host keyfile by default, or with a passphrase,
+another keyfile or the TPM. A tunnel uses a stored pre-shared key with
+--psk-ref key://NAME.`,
+}
+
+var keyGenerateCmd = &cobra.Command{
+	Use:   "generate [name]",
+	Short: "Generate a new pre-shared key or key pair",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		keyType, _ := cmd.Flags().GetString("type")
+		algorithm, _ := cmd.Flags().GetString("algorithm")
+		size, _ := cmd.Flags().GetInt("size")
+		expires, _ := cmd.Flags().GetDuration("expires")
+
+		switch keyType {
+		case "psk":
+			keyType = keys.TypePSK
+		case "keypair":
+			keyType = keys.TypeKeyPair
+		}
+
+		source, err := storeKeySource(cmd, true)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		if p, ok := source.(store.Passphrase); ok {
+			defer crypto.Zeroize(p.Passphrase)
+		}
+
+		key, err := keys.Generate(name, keyType, algorithm, size, expires, source)
+		if err != nil {
+			return fail("Error generating key '%s': %v", name, err)
+		}
+
+		logger.Info("Key '%s' generated successfully", key.Name)
+		fmt.Printf("Key '%s' generated successfully\n", key.Name)
+		fmt.Printf("Type: %s, Algorithm: %s\n", key.Type, key.Algorithm)
+		fmt.Printf("Fingerprint: %s\n", key.Fingerprint)
+		fmt.Printf("Sealed with: %s\n", key.SealedWith())
+		return nil
+	},
+}
+
+var keyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List stored keys",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger.Debug("Listing all stored keys")
+		list, err := keys.ListAll()
+		if err != nil {
+			return fail("Error listing keys: %v", err)
+		}
+
+		if len(list) == 0 {
+			logger.Info("No keys stored")
+			fmt.Println("No keys stored")
+			return nil
+		}
+
+		logger.Info("Found %d stored keys", len(list))
+		fmt.Println("Stored keys:")
+		for _, k := range list {
+			status := ""
+			if k.Expired() {
+				status = " (expired)"
+			}
+			fmt.Printf("- %s: %s %s %s%s\n", k.Name, k.Type, k.Algorithm, k.Fingerprint, status)
+		}
+		return nil
+	},
+}
+
+var keyShowCmd = &cobra.Command{
+	Use:   "show [name]",
+	Short: "Show key metadata",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		showPublic, _ := cmd.Flags().GetBool("public")
+
+		logger.Debug("Retrieving details for key '%s'", name)
+		key, err := keys.Get(name)
+		if err != nil {
+			return fail("Error getting key '%s': %v", name, err)
+		}
+
+		logger.Info("Displaying details for key '%s'", key.Name)
+		fmt.Printf("Key: %s\n", key.Name)
+		fmt.Printf("Type: %s\n", key.Type)
+		fmt.Printf("Algorithm: %s\n", key.Algorithm)
+		fmt.Printf("Fingerprint: %s\n", key.Fingerprint)
+		fmt.Printf("Sealed with: %s\n", key.SealedWith())
+		fmt.Printf("Created: %s\n", key.Created)
+		if key.Expiry != nil {
+			fmt.Printf("Expires: %s (expired: %v)\n", *key.Expiry, key.Expired())
+		} else {
+			fmt.Println("Expires: never")
+		}
+		if showPublic && key.Public != "" {
+			fmt.Printf("Public key: %s\n", key.Public)
+		}
+		return nil
+	},
+}
+
+var keySignCmd = &cobra.Command{
+	Use:   "sign [name] [file]",
+	Short: "Sign a file with a stored Ed25519 key pair",
+	Long: `Sign a file with a stored Ed25519 key pair and print the signature in base64.
+The key agent signs if it holds the key, so keys sealed with a passphrase are
+loaded into it with 'ipsec-vpn agent add NAME' first.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, path := args[0], args[1]
+		message, err := os.ReadFile(path)
+		if err != nil {
+			return fail("Error reading %s: %v", path, err)
+		}
+		signature, err := agent.Sign(name, message)
+		if err != nil {
+			return fail("Error signing %s with key '%s': %v", path, name, err)
+		}
+		logger.Info("Signed %s with key '%s'", path, name)
+		fmt.Println(base64.StdEncoding.EncodeToString(signature))
+		return nil
+	},
+}
+
+var keyVerifyCmd = &cobra.Command{
+	Use:   "verify [name] [file] [signature]",
+	Short: "Verify the signature of a file with a stored Ed25519 key pair",
+	Args:  cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, path := args[0], args[1]
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(args[2]))
+		if err != nil {
+			return fail("Error: the signature is not valid base64: %v", err)
+		}
+		message, err := os.ReadFile(path)
+		if err != nil {
+			return fail("Error reading %s: %v", path, err)
+		}
+		key, err := keys.Get(name)
+		if err != nil {
+			return fail("Error getting key '%s': %v", name, err)
+		}
+		ok, err := key.Verify(message, signature)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		if !ok {
+			return fail("Signature of %s is not valid for key '%s'", path, name)
+		}
+		fmt.Printf("Signature of %s is valid for key '%s'\n", path, name)
+		return nil
+	},
+}
+
+var keyDeleteCmd = &cobra.Command{
+	Use:   "delete [name]",
+	Short: "Delete a stored key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+
+		target := fmt.Sprintf("key '%s'", name)
+		if key, err := keys.Get(name); err == nil {
+			target = fmt.Sprintf("key '%s' (%s %s, %s)", name, key.Type, key.Algorithm, key.Fingerprint)
+		}
+		if !confirm(cmd, "permanently delete", []string{target}) {
+			return errFailed
+		}
+		if err := approved(cmd, fmt.Sprintf("delete key '%s'", name)); err != nil {
+			return err
+		}
+
+		if err := keys.Delete(name); err != nil {
+			return fail("Error deleting key '%s': %v", name, err)
+		}
+
+		logger.Info("Key '%s' deleted successfully", name)
+		fmt.Printf("Key '%s' deleted successfully\n", name)
+		return nil
+	},
+}
+
+func init() {
+	// Add subcommands to key command
+	keyCmd.AddCommand(keyGenerateCmd)
+	keyCmd.AddCommand(keyListCmd)
+	keyCmd.AddCommand(keyShowCmd)
+	keyCmd.AddCommand(keySignCmd)
+	keyCmd.AddCommand(keyVerifyCmd)
+	keyCmd.AddCommand(keyDeleteCmd)
+
+	// Flags for generate command
+	keyGenerateCmd.Flags().String("type", "psk", "Key type (psk, keypair)")
+	keyGenerateCmd.Flags().String("algorithm", "", "Key pair algorithm (mlkem768, hybrid-mlkem768-aes256gcm, x25519, ed25519 to sign)")
+	keyGenerateCmd.Flags().Int("size", keys.DefaultPSKSize, "Pre-shared key size in bytes")
+	keyGenerateCmd.Flags().Duration("expires", 0, "Key lifetime, e.g. 8760h (default never expires)")
+	keyGenerateCmd.Flags().Bool("passphrase", false, "Seal the key with a passphrase instead of the host keyfile; it is used through the key agent")
+	keyGenerateCmd.Flags().String("passphrase-file", "", "Seal the key with the passphrase in a file")
+	keyGenerateCmd.Flags().String("keyfile", "", "Seal the key with a keyfile instead of the host keyfile")
+	keyGenerateCmd.Flags().Bool("tpm", false, "Seal the key with key material sealed to the TPM")
+
+	// Flags for show command
+	keyShowCmd.Flags().Bool("public", false, "Print the public key of a key pair")
+
+	// Flags for delete command
+	addYesFlag(keyDeleteCmd)
+	addApprovalFlag(keyDeleteCmd)
+}
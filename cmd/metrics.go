@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/metrics"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// metricsCmd represents the metrics command
+var metricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "Export tunnel metrics to Prometheus and Grafana",
+	Long: `Serve tunnel health and throughput in the Prometheus text format, and generate a
+Grafana dashboard for them. Every tunnel metric is labelled with tunnel (its name),
+peer (its remote IP) and tenant (its network namespace, empty in the host namespace).`,
+}
+
+var metricsServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve tunnel metrics at /metrics in the foreground",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		listen := viper.GetString("metrics.listen")
+		if cmd.Flags().Changed("listen") {
+			listen, _ = cmd.Flags().GetString("listen")
+		}
+		server := &http.Server{Addr: listen, Handler: metrics.Handler(), ReadHeaderTimeout: 10 * time.Second}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			server.Close()
+		}()
+
+		logger.API.Info("Serving tunnel metrics on %s/metrics", listen)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fail("Metrics server failed: %v", err)
+		}
+		return nil
+	},
+}
+
+var metricsDashboardCmd = &cobra.Command{
+	Use:   "generate-dashboard",
+	Short: "Print a Grafana dashboard of tunnel health and throughput",
+	Long: `Print a Grafana dashboard as JSON, ready to import through Dashboards > New > Import
+or to provision from a file. It asks for a Prometheus data source scraping
+'ipsec-vpn metrics serve' and can be filtered by tenant and tunnel.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dashboard, err := metrics.Dashboard()
+		if err != nil {
+			return fail("Error generating dashboard: %v", err)
+		}
+		dashboard = append(dashboard, '\n')
+
+		out, _ := cmd.Flags().GetString("out")
+		if out == "" {
+			os.Stdout.Write(dashboard)
+			return nil
+		}
+		if err := os.WriteFile(out, dashboard, 0644); err != nil {
+			return fail("Error writing dashboard: %v", err)
+		}
+		logger.Info("Dashboard written to %s", out)
+		return nil
+	},
+}
+
+func init() {
+	metricsCmd.AddCommand(metricsServeCmd)
+	metricsCmd.AddCommand(metricsDashboardCmd)
+
+	metricsServeCmd.Flags().String("listen", "", "Address to listen on, overriding metrics.listen (default :9469)")
+	metricsDashboardCmd.Flags().String("out", "", "Write the dashboard to a file instead of stdout")
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// networkMulticastCmd represents the network multicast command
+var networkMulticastCmd = &cobra.Command{
+	Use:   "multicast",
+	Short: "Forward multicast groups across the GRE interface of a tunnel",
+	Long: `Multicast routes carry groups such as market data feeds or video streams across
+a tunnel, which IPsec alone cannot: the traffic goes over the GRE interface of
+the tunnel, and smcroute forwards it between that interface and a LAN one. An
+outbound route, out:eth1:239.1.1.1, sends a group received on eth1 through the
+tunnel; an inbound route, in:eth1:239.1.1.1, sends it from the tunnel out of
+eth1. Give a sender to forward its traffic to the group alone, as in
+in:eth1:10.1.0.5,239.1.1.1. The peer needs the opposite route, and senders a
+TTL above 1, for the group to reach the LAN behind it.
+
+smcrouted, version 2.5 or later, must be running. The routes are handed to it
+in /etc/smcroute.d while the tunnel is up.`,
+}
+
+var networkMulticastAddCmd = &cobra.Command{
+	Use:   "add [tunnel] [route...]",
+	Short: "Forward multicast groups across a tunnel",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		tun, err := tunnel.Get(name)
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+
+		routes := tun.MulticastRoutes
+		var added []string
+		for _, arg := range args[1:] {
+			route, err := tunnel.ParseMulticastRoute(arg)
+			if err != nil {
+				return fail("Error: %v", err)
+			}
+			if !slices.Contains(routes, route) {
+				routes = append(routes, route)
+				added = append(added, route.String())
+			}
+		}
+		if err := setMulticastRoutes(name, routes); err != nil || len(added) == 0 {
+			return err
+		}
+		undo := append([]string{"network", "multicast", "remove", name}, added...)
+		return armConfirm(cmd, fmt.Sprintf("the multicast routes %s of tunnel '%s'", strings.Join(added, ", "), name), undo...)
+	},
+}
+
+var networkMulticastRemoveCmd = &cobra.Command{
+	Use:   "remove [tunnel] [route...]",
+	Short: "Stop forwarding multicast groups across a tunnel",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		tun, err := tunnel.Get(name)
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+
+		routes := slices.Clone(tun.MulticastRoutes)
+		for _, arg := range args[1:] {
+			route, err := tunnel.ParseMulticastRoute(arg)
+			if err != nil {
+				return fail("Error: %v", err)
+			}
+			i := slices.Index(routes, route)
+			if i < 0 {
+				return fail("Error: tunnel '%s' has no multicast route %s", name, route)
+			}
+			routes = slices.Delete(routes, i, i+1)
+		}
+		return setMulticastRoutes(name, routes)
+	},
+}
+
+var networkMulticastClearCmd = &cobra.Command{
+	Use:   "clear [tunnel]",
+	Short: "Remove all multicast routes of a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setMulticastRoutes(args[0], nil)
+	},
+}
+
+var networkMulticastListCmd = &cobra.Command{
+	Use:   "list [tunnel]",
+	Short: "List the multicast routes of a tunnel, or of every tunnel",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var tunnels []*tunnel.Tunnel
+		if len(args) == 1 {
+			tun, err := tunnel.Get(args[0])
+			if err != nil {
+				return fail("Error getting tunnel '%s': %v", args[0], err)
+			}
+			tunnels = append(tunnels, tun)
+		} else {
+			all, err := tunnel.ListAll()
+			if err != nil {
+				return fail("Error listing tunnels: %v", err)
+			}
+			for _, tun := range all {
+				if len(tun.MulticastRoutes) > 0 {
+					tunnels = append(tunnels, tun)
+				}
+			}
+		}
+
+		type multicastRoute struct {
+			Tunnel    string `json:"tunnel"`
+			Direction string `json:"direction"`
+			Interface string `json:"interface"`
+			Source    string `json:"source,omitempty"`
+			Group     string `json:"group"`
+			Active    bool   `json:"active"`
+		}
+		var routes []multicastRoute
+		for _, tun := range tunnels {
+			for _, r := range tun.MulticastRoutes {
+				direction := "out"
+				if r.Inbound {
+					direction = "in"
+				}
+				routes = append(routes, multicastRoute{tun.Name, direction, r.Interface, r.Source, r.Group, tun.Status == tunnel.StatusUp})
+			}
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, routes)
+		}
+		if len(routes) == 0 {
+			fmt.Println("No multicast routes")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "TUNNEL"},
+			table.Column{Header: "STATE", Status: true},
+			table.Column{Header: "DIRECTION"},
+			table.Column{Header: "INTERFACE"},
+			table.Column{Header: "SOURCE"},
+			table.Column{Header: "GROUP"},
+		)
+		for _, r := range routes {
+			state := "INACTIVE"
+			if r.Active {
+				state = "ACTIVE"
+			}
+			tbl.AddRow(r.Tunnel, state, r.Direction, r.Interface, cmp.Or(r.Source, "any"), r.Group)
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+// setMulticastRoutes replaces the multicast routes of a tunnel
+func setMulticastRoutes(name string, routes []tunnel.MulticastRoute) error {
+	if err := tunnel.SetMulticastRoutes(name, routes); err != nil {
+		return fail("Error setting multicast routes of tunnel '%s': %v", name, err)
+	}
+
+	logger.Info("Multicast routes of tunnel '%s' set to %s", name, multicastRouteSummary(routes))
+	fmt.Printf("Multicast routes of tunnel '%s': %s\n", name, multicastRouteSummary(routes))
+	return nil
+}
+
+// multicastRouteSummary lists multicast routes on one line
+func multicastRouteSummary(routes []tunnel.MulticastRoute) string {
+	if len(routes) == 0 {
+		return "none"
+	}
+	parts := make([]string, len(routes))
+	for i, r := range routes {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func init() {
+	networkCmd.AddCommand(networkMulticastCmd)
+	networkMulticastCmd.AddCommand(networkMulticastAddCmd)
+	networkMulticastCmd.AddCommand(networkMulticastRemoveCmd)
+	networkMulticastCmd.AddCommand(networkMulticastClearCmd)
+	networkMulticastCmd.AddCommand(networkMulticastListCmd)
+
+	addConfirmFlag(networkMulticastAddCmd)
+	networkMulticastListCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	networkMulticastListCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+}
@@ -2,9 +2,14 @@ package cmd
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/dzakwan/ipsec-vpn/pkg/logger"
 	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
 	"github.com/spf13/cobra"
 )
 
@@ -18,11 +23,13 @@ var networkCmd = &cobra.Command{
 var networkShowCmd = &cobra.Command{
 	Use:   "show",
 	Short: "Show network configuration",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		interfaces, _ := cmd.Flags().GetBool("interfaces")
 		routes, _ := cmd.Flags().GetBool("routes")
 		advertised, _ := cmd.Flags().GetBool("advertised")
 
+		opts := tableOptions(cmd)
+
 		// If no flags specified, show everything
 		if !interfaces && !routes && !advertised {
 			interfaces = true
@@ -30,69 +37,129 @@ var networkShowCmd = &cobra.Command{
 			advertised = true
 		}
 
-		if interfaces {
-			logger.Debug("Displaying network interfaces")
-			fmt.Println("Network Interfaces:")
-			netIfaces, err := network.ListInterfaces()
-			if err != nil {
-				logger.Error("Error listing interfaces: %v", err)
-				fmt.Printf("Error listing interfaces: %v\n", err)
-			} else {
-				logger.Info("Found %d network interfaces", len(netIfaces))
-				for _, iface := range netIfaces {
-					fmt.Printf("- %s: %s\n", iface.Name, iface.Status)
-					fmt.Printf("  MAC: %s\n", iface.MAC)
-					fmt.Printf("  IP Addresses: %v\n", iface.IPAddresses)
-					fmt.Printf("  MTU: %d\n", iface.MTU)
-					fmt.Println()
-				}
+		if jsonOutput(cmd) {
+			return showNetworkJSON(os.Stdout, interfaces, routes, advertised)
+		}
+		if watchInterval(cmd) > 0 {
+			watch(cmd, func(w io.Writer) { showNetwork(w, interfaces, routes, advertised, opts) })
+			return nil
+		}
+		return showNetwork(os.Stdout, interfaces, routes, advertised, opts)
+	},
+}
+
+// showNetwork writes the selected interface, route and advertised network tables to w.
+// A table that cannot be listed is reported and the rest are still shown.
+func showNetwork(w io.Writer, interfaces, routes, advertised bool, opts table.Options) error {
+	var result error
+
+	if interfaces {
+		logger.Debug("Displaying network interfaces")
+		fmt.Fprintln(w, "Network Interfaces:")
+		netIfaces, err := network.ListInterfaces()
+		if err != nil {
+			logger.Error("Error listing interfaces: %v", err)
+			fmt.Fprintf(w, "Error listing interfaces: %v\n", err)
+			result = errFailed
+		} else {
+			logger.Info("Found %d network interfaces", len(netIfaces))
+			tbl := table.New(
+				table.Column{Header: "NAME", MaxWidth: 20},
+				table.Column{Header: "STATUS", Status: true},
+				table.Column{Header: "MTU"},
+				table.Column{Header: "ADDRESSES", MaxWidth: 40},
+				table.Column{Header: "MAC", Wide: true},
+			)
+			for _, iface := range netIfaces {
+				tbl.AddRow(iface.Name, iface.Status, strconv.Itoa(iface.MTU),
+					strings.Join(iface.IPAddresses, ", "), iface.MAC)
 			}
+			tbl.Render(w, opts)
 		}
+		fmt.Fprintln(w)
+	}
 
-		if routes {
-			logger.Debug("Displaying routing table")
-			fmt.Println("Routing Table:")
-			routes, err := network.ListRoutes()
-			if err != nil {
-				logger.Error("Error listing routes: %v", err)
-				fmt.Printf("Error listing routes: %v\n", err)
-			} else {
-				logger.Info("Found %d routes in routing table", len(routes))
-				for _, route := range routes {
-					fmt.Printf("- Destination: %s\n", route.Destination)
-					fmt.Printf("  Gateway: %s\n", route.Gateway)
-					fmt.Printf("  Interface: %s\n", route.Interface)
-					fmt.Printf("  Metric: %d\n", route.Metric)
-					fmt.Println()
-				}
+	if routes {
+		logger.Debug("Displaying routing table")
+		fmt.Fprintln(w, "Routing Table:")
+		routes, err := network.ListRoutes()
+		if err != nil {
+			logger.Error("Error listing routes: %v", err)
+			fmt.Fprintf(w, "Error listing routes: %v\n", err)
+			result = errFailed
+		} else {
+			logger.Info("Found %d routes in routing table", len(routes))
+			tbl := table.New(
+				table.Column{Header: "DESTINATION"},
+				table.Column{Header: "GATEWAY"},
+				table.Column{Header: "INTERFACE", MaxWidth: 20},
+				table.Column{Header: "METRIC"},
+			)
+			for _, route := range routes {
+				tbl.AddRow(route.Destination, route.Gateway, route.Interface, strconv.Itoa(route.Metric))
 			}
+			tbl.Render(w, opts)
 		}
+		fmt.Fprintln(w)
+	}
 
-		if advertised {
-			logger.Debug("Displaying advertised networks")
-			fmt.Println("Advertised Networks:")
-			advNetworks, err := network.ListAdvertisedNetworks()
-			if err != nil {
-				logger.Error("Error listing advertised networks: %v", err)
-				fmt.Printf("Error listing advertised networks: %v\n", err)
-			} else {
-				logger.Info("Found %d advertised networks", len(advNetworks))
-				for _, net := range advNetworks {
-					fmt.Printf("- Network: %s\n", net.CIDR)
-					fmt.Printf("  Advertised via: %s\n", net.AdvertisedVia)
-					fmt.Printf("  Status: %s\n", net.Status)
-					fmt.Println()
-				}
+	if advertised {
+		logger.Debug("Displaying advertised networks")
+		fmt.Fprintln(w, "Advertised Networks:")
+		advNetworks, err := network.ListAdvertisedNetworks()
+		if err != nil {
+			logger.Error("Error listing advertised networks: %v", err)
+			fmt.Fprintf(w, "Error listing advertised networks: %v\n", err)
+			result = errFailed
+		} else {
+			logger.Info("Found %d advertised networks", len(advNetworks))
+			tbl := table.New(
+				table.Column{Header: "NETWORK"},
+				table.Column{Header: "VIA", MaxWidth: 24},
+				table.Column{Header: "STATUS", Status: true},
+			)
+			for _, n := range advNetworks {
+				tbl.AddRow(n.CIDR, n.AdvertisedVia, n.Status)
 			}
+			tbl.Render(w, opts)
 		}
-	},
+	}
+
+	return result
+}
+
+// showNetworkJSON writes the selected interfaces, routes and advertised networks to w
+// as a single JSON object. Unlike the tables, any listing that fails is an error.
+func showNetworkJSON(w io.Writer, interfaces, routes, advertised bool) error {
+	var out struct {
+		Interfaces []network.Interface         `json:"interfaces,omitempty"`
+		Routes     []network.Route             `json:"routes,omitempty"`
+		Advertised []network.AdvertisedNetwork `json:"advertised,omitempty"`
+	}
+	var err error
+	if interfaces {
+		if out.Interfaces, err = network.ListInterfaces(); err != nil {
+			return fail("Error listing interfaces: %v", err)
+		}
+	}
+	if routes {
+		if out.Routes, err = network.ListRoutes(); err != nil {
+			return fail("Error listing routes: %v", err)
+		}
+	}
+	if advertised {
+		if out.Advertised, err = network.ListAdvertisedNetworks(); err != nil {
+			return fail("Error listing advertised networks: %v", err)
+		}
+	}
+	return writeJSON(w, out)
 }
 
 var networkAdvertiseCmd = &cobra.Command{
 	Use:   "advertise [network]",
 	Short: "Advertise a network",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		networkCIDR := args[0]
 		tunnelName, _ := cmd.Flags().GetString("tunnel")
 		metric, _ := cmd.Flags().GetInt("metric")
@@ -100,14 +167,13 @@ var networkAdvertiseCmd = &cobra.Command{
 		logger.Info("Advertising network %s via tunnel %s with metric %d", networkCIDR, tunnelName, metric)
 		err := network.AdvertiseNetwork(networkCIDR, tunnelName, metric)
 		if err != nil {
-			logger.Error("Error advertising network: %v", err)
-			fmt.Printf("Error advertising network: %v\n", err)
-			return
+			return fail("Error advertising network: %v", err)
 		}
 		logger.Info("Network %s advertised successfully", networkCIDR)
 
 		fmt.Printf("Network %s is now being advertised via tunnel %s\n", 
 			networkCIDR, tunnelName)
+		return nil
 	},
 }
 
@@ -115,18 +181,18 @@ var networkWithdrawCmd = &cobra.Command{
 	Use:   "withdraw [network]",
 	Short: "Withdraw a network advertisement",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		networkCIDR := args[0]
 		tunnelName, _ := cmd.Flags().GetString("tunnel")
 
 		err := network.WithdrawNetwork(networkCIDR, tunnelName)
 		if err != nil {
-			fmt.Printf("Error withdrawing network: %v\n", err)
-			return
+			return fail("Error withdrawing network: %v", err)
 		}
 
 		fmt.Printf("Network %s advertisement withdrawn from tunnel %s\n", 
 			networkCIDR, tunnelName)
+		return nil
 	},
 }
 
@@ -134,7 +200,7 @@ var networkRouteCmd = &cobra.Command{
 	Use:   "route [add|delete] [destination] [gateway]",
 	Short: "Manage routes",
 	Args:  cobra.ExactArgs(3),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		action := args[0]
 		destination := args[1]
 		gateway := args[2]
@@ -145,22 +211,21 @@ var networkRouteCmd = &cobra.Command{
 		case "add":
 			err := network.AddRoute(destination, gateway, iface, metric)
 			if err != nil {
-				fmt.Printf("Error adding route: %v\n", err)
-				return
+				return fail("Error adding route: %v", err)
 			}
 			fmt.Printf("Route to %s via %s added successfully\n", destination, gateway)
 
 		case "delete":
 			err := network.DeleteRoute(destination, gateway, iface)
 			if err != nil {
-				fmt.Printf("Error deleting route: %v\n", err)
-				return
+				return fail("Error deleting route: %v", err)
 			}
 			fmt.Printf("Route to %s via %s deleted successfully\n", destination, gateway)
 
 		default:
-			fmt.Printf("Unknown action: %s. Use 'add' or 'delete'\n", action)
+			return fail("Unknown action: %s. Use 'add' or 'delete'", action)
 		}
+		return nil
 	},
 }
 
@@ -175,6 +240,9 @@ func init() {
 	networkShowCmd.Flags().Bool("interfaces", false, "Show network interfaces")
 	networkShowCmd.Flags().Bool("routes", false, "Show routing table")
 	networkShowCmd.Flags().Bool("advertised", false, "Show advertised networks")
+	networkShowCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	addWatchFlag(networkShowCmd)
+	addJSONFlag(networkShowCmd)
 
 	// Flags for advertise command
 	networkAdvertiseCmd.Flags().String("tunnel", "", "Tunnel to advertise the network through")
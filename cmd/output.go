@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/spf13/cobra"
+)
+
+// tableOptions returns the table rendering options for a command with a --wide flag
+func tableOptions(cmd *cobra.Command) table.Options {
+	wide, _ := cmd.Flags().GetBool("wide")
+	return table.Options{
+		Wide:  wide,
+		Color: table.ColorEnabled(noColor),
+	}
+}
+
+// addJSONFlag adds --json to a show command, for scripts and configuration management
+func addJSONFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+	cmd.MarkFlagsMutuallyExclusive("json", "watch")
+}
+
+// jsonOutput reports whether --json was given
+func jsonOutput(cmd *cobra.Command) bool {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	return asJSON
+}
+
+// writeJSON writes v to w as indented JSON
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// yesNo formats a boolean for table output
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// orDash shows an empty table cell as a dash
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatBytes formats a byte count with a binary unit, e.g. 1.5 MiB
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// parseBytes parses a byte count with an optional binary unit, e.g. 4GiB or 512M
+func parseBytes(s string) (uint64, error) {
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "B"), "i")
+	shift := 0
+	if i := strings.IndexAny(number, "KMGTPE"); i >= 0 && i == len(number)-1 {
+		shift = 10 * (strings.IndexByte("KMGTPE", number[i]) + 1)
+		number = number[:i]
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid byte count %q, expected e.g. 4GiB or 512M", s)
+	}
+	return uint64(value * float64(uint64(1)<<shift)), nil
+}
@@ -0,0 +1,372 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// pathCmd represents the path command
+var pathCmd = &cobra.Command{
+	Use:   "path",
+	Short: "Route a prefix through the best of redundant tunnels",
+	Long: `A path set is a remote prefix reached through two or more tunnels, such as over
+two ISPs. Each round, the SLA probes of every tunnel are sent and the tunnel
+with the lowest latency, counting 10 ms per percent of loss, carries the
+prefix. The active tunnel is only left for one scoring better by the hysteresis
+for the hold rounds in a row, or at once when it stops answering. Each round
+and its scores are kept in the set's history.`,
+}
+
+var pathSetCmd = &cobra.Command{
+	Use:   "set [name]",
+	Short: "Create a path set or change its settings",
+	Long: `Create a path set or change its settings. Its tunnels must have SLA probes,
+set with "ipsec-vpn tunnel sla set", share a network namespace and each reach
+the whole prefix. Only the settings given are changed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		p, err := tunnel.GetPathSet(name)
+		if errors.Is(err, tunnel.ErrPathSetNotFound) {
+			p, err = &tunnel.PathSet{Name: name, Hysteresis: tunnel.DefaultPathHysteresis, Hold: tunnel.DefaultPathHold}, nil
+		}
+		if err != nil {
+			return fail("Error reading path set %s: %v", name, err)
+		}
+
+		flags := cmd.Flags()
+		if flags.Changed("prefix") {
+			p.Prefix, _ = flags.GetString("prefix")
+		}
+		if flags.Changed("tunnels") {
+			p.Tunnels, _ = flags.GetStringSlice("tunnels")
+		}
+		if flags.Changed("hysteresis") {
+			p.Hysteresis, _ = flags.GetFloat64("hysteresis")
+		}
+		if flags.Changed("hold") {
+			p.Hold, _ = flags.GetInt("hold")
+		}
+
+		if err := tunnel.SavePathSet(p); err != nil {
+			return fail("Error saving path set %s: %v", name, err)
+		}
+		logger.Info("Path set %s saved", name)
+		fmt.Printf("Path set %s saved\n", name)
+		return nil
+	},
+}
+
+var pathShowCmd = &cobra.Command{
+	Use:   "show [name]",
+	Short: "Show a path set and the last scores of its tunnels, or list the path sets",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 1 {
+			return showPathSet(cmd, args[0])
+		}
+
+		sets, err := tunnel.PathSets()
+		if err != nil {
+			return fail("Error listing path sets: %v", err)
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, sets)
+		}
+		if len(sets) == 0 {
+			fmt.Println("No path sets")
+			return nil
+		}
+		tbl := table.New(
+			table.Column{Header: "NAME"},
+			table.Column{Header: "PREFIX"},
+			table.Column{Header: "TUNNELS", MaxWidth: 40},
+			table.Column{Header: "ACTIVE"},
+			table.Column{Header: "HYSTERESIS"},
+			table.Column{Header: "HOLD"},
+		)
+		for _, p := range sets {
+			tbl.AddRow(p.Name, p.Prefix, strings.Join(p.Tunnels, ", "), orDash(p.Active),
+				fmt.Sprintf("%g%%", p.Hysteresis), fmt.Sprint(p.Hold))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+// showPathSet prints the settings of a path set and the scores of its tunnels
+// in the last round
+func showPathSet(cmd *cobra.Command, name string) error {
+	p, err := tunnel.GetPathSet(name)
+	if err != nil {
+		return fail("Error reading path set %s: %v", name, err)
+	}
+	history, err := tunnel.PathHistory(name)
+	if err != nil {
+		return fail("Error reading history of path set %s: %v", name, err)
+	}
+	var last *tunnel.PathDecision
+	if len(history) > 0 {
+		last = &history[len(history)-1]
+	}
+	if jsonOutput(cmd) {
+		return writeJSON(os.Stdout, struct {
+			*tunnel.PathSet
+			Last *tunnel.PathDecision `json:"last,omitempty"`
+		}{p, last})
+	}
+
+	fmt.Printf("Path Set:   %s\n", p.Name)
+	fmt.Printf("Prefix:     %s\n", p.Prefix)
+	fmt.Printf("Tunnels:    %s\n", strings.Join(p.Tunnels, ", "))
+	fmt.Printf("Active:     %s\n", orDash(p.Active))
+	fmt.Printf("Hysteresis: %g%%\n", p.Hysteresis)
+	fmt.Printf("Hold:       %d rounds\n", p.Hold)
+	if p.Challenger != "" {
+		fmt.Printf("Challenger: %s, %d of %d rounds\n", p.Challenger, p.Streak, p.Hold)
+	}
+	if last == nil {
+		fmt.Println("\nNo rounds yet, run 'ipsec-vpn path select' or 'ipsec-vpn path run'")
+		return nil
+	}
+	fmt.Printf("\nLast round at %s: %s\n", last.Time.Local().Format(time.DateTime), orDash(last.Reason))
+	printPathScores(cmd, last.Scores, p.Active)
+	return nil
+}
+
+// printPathScores prints the scores of the tunnels of a path set in a round
+func printPathScores(cmd *cobra.Command, scores []tunnel.PathScore, active string) {
+	tbl := table.New(
+		table.Column{Header: "TUNNEL"},
+		table.Column{Header: "STATE", Status: true},
+		table.Column{Header: "LATENCY"},
+		table.Column{Header: "LOSS"},
+		table.Column{Header: "SCORE"},
+		table.Column{Header: "ERROR", MaxWidth: 50},
+	)
+	for _, s := range scores {
+		state := "UP"
+		switch {
+		case !s.Usable:
+			state = "DOWN"
+		case s.Tunnel == active:
+			state = "ACTIVE"
+		}
+		latency, loss, score := "-", "-", "-"
+		if s.Usable {
+			latency = fmt.Sprintf("%.1f ms", s.Latency)
+			loss = fmt.Sprintf("%.1f%%", s.Loss)
+			score = fmt.Sprintf("%.1f", s.Score)
+		}
+		tbl.AddRow(s.Tunnel, state, latency, loss, score, orDash(s.Error))
+	}
+	tbl.Render(os.Stdout, tableOptions(cmd))
+}
+
+var pathSelectCmd = &cobra.Command{
+	Use:   "select [name]",
+	Short: "Run a round of a path set, or of every path set, once",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, err := pathSetNames(args)
+		if err != nil {
+			return fail("Error listing path sets: %v", err)
+		}
+		failed := 0
+		for _, name := range names {
+			d, err := tunnel.SelectPath(name)
+			if err != nil {
+				failed++
+				fmt.Fprintf(os.Stderr, "Error selecting the path of %s: %v\n", name, err)
+				continue
+			}
+			switch {
+			case d.Changed:
+				fmt.Printf("%s: moved from %s to %s, %s\n", name, orDash(d.From), d.To, d.Reason)
+			case d.To == "":
+				fmt.Printf("%s: no path, %s\n", name, d.Reason)
+			default:
+				fmt.Printf("%s: stays on %s%s\n", name, d.To, reasonSuffix(d.Reason))
+			}
+			printPathScores(cmd, d.Scores, d.To)
+		}
+		if failed > 0 {
+			return errFailed
+		}
+		return nil
+	},
+}
+
+// reasonSuffix returns a reason to append to a sentence, if there is one
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ", " + reason
+}
+
+var pathRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run rounds of every path set, in the foreground",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		interval, _ := cmd.Flags().GetInt("interval")
+		if interval <= 0 {
+			return fail("Error: the interval must be a positive number of seconds")
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+
+		logger.Info("Selecting paths every %d seconds", interval)
+		for {
+			names, err := pathSetNames(nil)
+			if err != nil {
+				logger.Error("Error listing path sets: %v", err)
+			}
+			for _, name := range names {
+				d, err := tunnel.SelectPath(name)
+				if err != nil {
+					logger.Error("Error selecting the path of %s: %v", name, err)
+					continue
+				}
+				if d.Changed {
+					logger.Info("Path set %s moved from %s to %s: %s", name, orDash(d.From), d.To, d.Reason)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-sigs:
+				return nil
+			}
+		}
+	},
+}
+
+// pathSetNames returns the path set named, or every path set
+func pathSetNames(args []string) ([]string, error) {
+	if len(args) > 0 {
+		return args, nil
+	}
+	sets, err := tunnel.PathSets()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(sets))
+	for i, p := range sets {
+		names[i] = p.Name
+	}
+	return names, nil
+}
+
+var pathHistoryCmd = &cobra.Command{
+	Use:   "history [name]",
+	Short: "Show the path changes of a path set",
+	Long: `Show the rounds of a path set that moved its prefix to another tunnel, with the
+reason and the scores of the tunnels, or every round with --all. The last 1440
+rounds are kept.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if _, err := tunnel.GetPathSet(name); err != nil {
+			return fail("Error reading path set %s: %v", name, err)
+		}
+		history, err := tunnel.PathHistory(name)
+		if err != nil {
+			return fail("Error reading history of path set %s: %v", name, err)
+		}
+		if all, _ := cmd.Flags().GetBool("all"); !all {
+			changes := history[:0]
+			for _, d := range history {
+				if d.Changed {
+					changes = append(changes, d)
+				}
+			}
+			history = changes
+		}
+		if limit, _ := cmd.Flags().GetInt("limit"); limit > 0 && len(history) > limit {
+			history = history[len(history)-limit:]
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, history)
+		}
+		if len(history) == 0 {
+			fmt.Printf("No path changes for %s\n", name)
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "TIME"},
+			table.Column{Header: "FROM"},
+			table.Column{Header: "TO"},
+			table.Column{Header: "SCORES", MaxWidth: 40},
+			table.Column{Header: "REASON", MaxWidth: 60},
+		)
+		for _, d := range history {
+			scores := make([]string, len(d.Scores))
+			for i, s := range d.Scores {
+				if s.Usable {
+					scores[i] = fmt.Sprintf("%s %.1f", s.Tunnel, s.Score)
+				} else {
+					scores[i] = s.Tunnel + " down"
+				}
+			}
+			tbl.AddRow(d.Time.Local().Format(time.DateTime), orDash(d.From), orDash(d.To),
+				strings.Join(scores, ", "), orDash(d.Reason))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var pathDeleteCmd = &cobra.Command{
+	Use:   "delete [name]",
+	Short: "Delete a path set, its history and the route of its prefix",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := tunnel.DeletePathSet(args[0]); err != nil {
+			return fail("Error deleting path set %s: %v", args[0], err)
+		}
+		logger.Info("Path set %s deleted", args[0])
+		fmt.Printf("Path set %s deleted\n", args[0])
+		return nil
+	},
+}
+
+func init() {
+	pathCmd.AddCommand(pathSetCmd)
+	pathCmd.AddCommand(pathShowCmd)
+	pathCmd.AddCommand(pathSelectCmd)
+	pathCmd.AddCommand(pathRunCmd)
+	pathCmd.AddCommand(pathHistoryCmd)
+	pathCmd.AddCommand(pathDeleteCmd)
+
+	pathSetCmd.Flags().String("prefix", "", "Remote prefix the tunnels reach, e.g. 10.50.0.0/16")
+	pathSetCmd.Flags().StringSlice("tunnels", nil, "Tunnels reaching the prefix, preferred in this order when they score alike")
+	pathSetCmd.Flags().Float64("hysteresis", tunnel.DefaultPathHysteresis, "Percent a tunnel must score better than the active one by to take over")
+	pathSetCmd.Flags().Int("hold", tunnel.DefaultPathHold, "Rounds in a row a tunnel must score better for to take over")
+
+	pathShowCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	pathShowCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+
+	pathSelectCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+
+	pathRunCmd.Flags().Int("interval", 60, "Seconds between rounds")
+
+	pathHistoryCmd.Flags().Bool("all", false, "Show every round, not only the changes")
+	pathHistoryCmd.Flags().Int("limit", 0, "Show only the last rounds")
+	pathHistoryCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	pathHistoryCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+}
@@ -0,0 +1,256 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// peerGroupCmd represents the peer-group command
+var peerGroupCmd = &cobra.Command{
+	Use:   "peer-group",
+	Short: "Share authentication, proposals, DPD and reauthentication settings between tunnels",
+	Long: `A peer group holds the authentication method, IKE and ESP proposals, dead peer
+detection and reauthentication settings of the tunnels that reference it, like
+a BGP peer group. Changing a setting of the group rekeys every member tunnel that is up,
+so that all of them negotiate with the new settings. Settings a group leaves
+unset are those of the configuration file.`,
+}
+
+var peerGroupSetCmd = &cobra.Command{
+	Use:   "set [name]",
+	Short: "Create a peer group or change its settings, rekeying its members",
+	Long: `Create a peer group or change its settings, then rekey the member tunnels that
+are up. Only the settings given are changed; give an empty value, such as
+--auth "", to fall back to the configuration file again.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		g, err := tunnel.GetPeerGroup(name)
+		if errors.Is(err, tunnel.ErrPeerGroupNotFound) {
+			g, err = &tunnel.PeerGroup{Name: name}, nil
+		}
+		if err != nil {
+			return fail("Error reading peer group %s: %v", name, err)
+		}
+
+		flags := cmd.Flags()
+		if flags.Changed("auth") {
+			g.AuthMethod, _ = flags.GetString("auth")
+		}
+		if flags.Changed("ike-proposals") {
+			g.IKEProposals, _ = flags.GetStringSlice("ike-proposals")
+		}
+		if flags.Changed("esp-proposals") {
+			g.ESPProposals, _ = flags.GetStringSlice("esp-proposals")
+		}
+		if flags.Changed("dpd-delay") {
+			g.DPDDelay, _ = flags.GetInt("dpd-delay")
+		}
+		if flags.Changed("dpd-timeout") {
+			g.DPDTimeout, _ = flags.GetInt("dpd-timeout")
+		}
+		if flags.Changed("reauth-interval") {
+			g.ReauthInterval, _ = flags.GetInt("reauth-interval")
+		}
+		if flags.Changed("reauth-grace") {
+			g.ReauthGrace, _ = flags.GetInt("reauth-grace")
+		}
+
+		rekeyed, err := tunnel.SavePeerGroup(g)
+		if len(rekeyed) > 0 {
+			fmt.Printf("Rekeyed %s\n", strings.Join(rekeyed, ", "))
+		}
+		if err != nil {
+			return fail("Error saving peer group %s: %v", name, err)
+		}
+		logger.Info("Peer group %s saved", name)
+		fmt.Printf("Peer group %s saved\n", name)
+		return nil
+	},
+}
+
+var peerGroupShowCmd = &cobra.Command{
+	Use:   "show [name]",
+	Short: "Show a peer group and its members, or list the peer groups",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 1 {
+			return showPeerGroup(cmd, args[0])
+		}
+
+		groups, err := tunnel.PeerGroups()
+		if err != nil {
+			return fail("Error listing peer groups: %v", err)
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, groups)
+		}
+		if len(groups) == 0 {
+			fmt.Println("No peer groups")
+			return nil
+		}
+		tbl := table.New(
+			table.Column{Header: "NAME"},
+			table.Column{Header: "AUTH"},
+			table.Column{Header: "IKE PROPOSALS", MaxWidth: 40},
+			table.Column{Header: "ESP PROPOSALS", MaxWidth: 40},
+			table.Column{Header: "DPD"},
+			table.Column{Header: "MEMBERS", MaxWidth: 40},
+		)
+		for _, g := range groups {
+			members, err := tunnel.PeerGroupMembers(g.Name)
+			if err != nil {
+				return fail("Error listing members of peer group %s: %v", g.Name, err)
+			}
+			tbl.AddRow(g.Name, orDash(g.AuthMethod), orDash(strings.Join(g.IKEProposals, ",")),
+				orDash(strings.Join(g.ESPProposals, ",")), formatDPD(g.DPDDelay, g.DPDTimeout), orDash(strings.Join(members, ", ")))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+// showPeerGroup prints the settings and members of a peer group, with the
+// settings that come from the configuration file
+func showPeerGroup(cmd *cobra.Command, name string) error {
+	g, err := tunnel.GetPeerGroup(name)
+	if err != nil {
+		return fail("Error reading peer group %s: %v", name, err)
+	}
+	members, err := tunnel.PeerGroupMembers(name)
+	if err != nil {
+		return fail("Error listing members of peer group %s: %v", name, err)
+	}
+	if jsonOutput(cmd) {
+		return writeJSON(os.Stdout, struct {
+			*tunnel.PeerGroup
+			Members []string `json:"members"`
+		}{g, members})
+	}
+
+	// The settings members negotiate with, whether from the group or the configuration file
+	s := tunnel.IKESettingsOf(&tunnel.Tunnel{PeerGroup: name})
+	inherited := func(set bool) string {
+		if set {
+			return ""
+		}
+		return " (from the configuration file)"
+	}
+	fmt.Printf("Peer Group:     %s\n", g.Name)
+	fmt.Printf("Authentication: %s%s\n", s.AuthMethod, inherited(g.AuthMethod != ""))
+	fmt.Printf("IKE Proposals:  %s%s\n", orDash(strings.Join(s.IKEProposals, ", ")), inherited(len(g.IKEProposals) > 0))
+	fmt.Printf("ESP Proposals:  %s%s\n", orDash(strings.Join(s.ESPProposals, ", ")), inherited(len(g.ESPProposals) > 0))
+	fmt.Printf("DPD:            %s%s\n", formatDPD(s.DPDDelay, s.DPDTimeout), inherited(g.DPDDelay > 0 || g.DPDTimeout > 0))
+	fmt.Printf("Reauth:         %s%s\n", formatReauth(s.ReauthInterval, s.ReauthGrace), inherited(g.ReauthInterval > 0 || g.ReauthGrace > 0))
+	fmt.Printf("Updated:        %s\n", g.UpdatedAt.Format(time.DateTime))
+	fmt.Printf("Members:        %s\n", orDash(strings.Join(members, ", ")))
+	return nil
+}
+
+// formatDPD formats dead peer detection settings in seconds
+func formatDPD(delay, timeout int) string {
+	if delay <= 0 {
+		return "-"
+	}
+	if timeout <= 0 {
+		return fmt.Sprintf("every %ds", delay)
+	}
+	return fmt.Sprintf("every %ds, timeout %ds", delay, timeout)
+}
+
+// formatReauth formats reauthentication settings in seconds
+func formatReauth(interval, grace int) string {
+	if interval <= 0 {
+		return "rekey only"
+	}
+	return fmt.Sprintf("every %ds, grace %ds", interval, grace)
+}
+
+var peerGroupAddCmd = &cobra.Command{
+	Use:   "add [group] [tunnel]...",
+	Short: "Put tunnels in a peer group, rekeying those that are up",
+	Long: `Put tunnels in a peer group, taking them out of any other, and rekey those that
+are up so that they negotiate with the group's settings.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setPeerGroup(args[0], args[1:])
+	},
+}
+
+var peerGroupRemoveCmd = &cobra.Command{
+	Use:   "remove [tunnel]...",
+	Short: "Take tunnels out of their peer group, rekeying those that are up",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setPeerGroup("", args)
+	},
+}
+
+// setPeerGroup puts tunnels in a peer group, or takes them out of theirs
+func setPeerGroup(group string, tunnels []string) error {
+	failed := 0
+	for _, name := range tunnels {
+		if err := tunnel.SetPeerGroup(name, group); err != nil {
+			failed++
+			logger.Error("Failed to set the peer group of tunnel '%s': %v", name, err)
+			fmt.Fprintf(os.Stderr, "Error setting the peer group of tunnel '%s': %v\n", name, err)
+			continue
+		}
+		if group == "" {
+			fmt.Printf("Tunnel '%s' is in no peer group\n", name)
+		} else {
+			fmt.Printf("Tunnel '%s' is in peer group %s\n", name, group)
+		}
+	}
+	if failed > 0 {
+		return fail("Error: %d of %d tunnels failed", failed, len(tunnels))
+	}
+	return nil
+}
+
+var peerGroupDeleteCmd = &cobra.Command{
+	Use:   "delete [name]",
+	Short: "Delete a peer group",
+	Long: `Delete a peer group. A group with member tunnels is only deleted with --force,
+which takes them out of it and rekeys those that are up with the settings of
+the configuration file.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		force, _ := cmd.Flags().GetBool("force")
+		if err := tunnel.DeletePeerGroup(args[0], force); err != nil {
+			return fail("Error deleting peer group %s: %v", args[0], err)
+		}
+		logger.Info("Peer group %s deleted", args[0])
+		fmt.Printf("Peer group %s deleted\n", args[0])
+		return nil
+	},
+}
+
+func init() {
+	peerGroupCmd.AddCommand(peerGroupSetCmd)
+	peerGroupCmd.AddCommand(peerGroupShowCmd)
+	peerGroupCmd.AddCommand(peerGroupAddCmd)
+	peerGroupCmd.AddCommand(peerGroupRemoveCmd)
+	peerGroupCmd.AddCommand(peerGroupDeleteCmd)
+
+	peerGroupSetCmd.Flags().String("auth", "", "Authentication method ("+strings.Join(tunnel.AuthMethods, ", ")+")")
+	peerGroupSetCmd.Flags().StringSlice("ike-proposals", nil, "IKE proposals, e.g. aes256gcm-sha384-ecp384")
+	peerGroupSetCmd.Flags().StringSlice("esp-proposals", nil, "ESP proposals, e.g. aes256gcm-ecp384")
+	peerGroupSetCmd.Flags().Int("dpd-delay", 0, "Seconds between dead peer detection checks")
+	peerGroupSetCmd.Flags().Int("dpd-timeout", 0, "Seconds without an answer before the peer is declared dead")
+	peerGroupSetCmd.Flags().Int("reauth-interval", 0, "Seconds between full reauthentications of the IKE SA")
+	peerGroupSetCmd.Flags().Int("reauth-grace", 0, "Seconds the SAs outlive a reauthentication that is due")
+
+	peerGroupShowCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	peerGroupShowCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+
+	peerGroupDeleteCmd.Flags().Bool("force", false, "Delete the group even if tunnels are in it, taking them out of it")
+}
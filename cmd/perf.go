@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/perf"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// perfCmd represents the perf command
+var perfCmd = &cobra.Command{
+	Use:   "perf",
+	Short: "Inspect and tune how the gateway uses its CPUs",
+}
+
+var perfTuneCmd = &cobra.Command{
+	Use:   "tune",
+	Short: "Spread the packet processing of the underlay NICs over all CPUs",
+	Long: `Report how the interrupts of the underlay NICs, the interfaces tunnels reach
+their peers through, are spread over the CPUs, with the receive packet steering
+(RPS) and transmit packet steering (XPS) of their queues and the receive
+softirqs each CPU has handled since boot. ESP is decrypted in those softirqs, on
+the CPU a packet arrives on: a NIC whose interrupts all land on one core caps
+the tunnels at what that core can decrypt.
+
+With --apply, the interrupts of each NIC are pinned to the CPUs in turn, RPS
+steers received packets to all CPUs when the NIC has fewer receive queues than
+CPUs, and XPS maps each CPU to a transmit queue, and the report shows the
+layout before and after. The settings last until the next reboot, and
+irqbalance, if it runs, moves the interrupts again.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		interfaces, _ := flags.GetStringSlice("interface")
+		if len(interfaces) == 0 {
+			var err error
+			if interfaces, err = tunnel.Underlays(); err != nil {
+				return fail("Error finding the underlay interfaces: %v", err)
+			}
+			if len(interfaces) == 0 {
+				return fail("Error: no tunnel has an underlay interface, give the NICs with --interface")
+			}
+		}
+		opts := perf.Options{}
+		if list, _ := flags.GetString("cpus"); list != "" {
+			cpus, err := perf.ParseCPUList(list)
+			if err != nil || len(cpus) == 0 {
+				return fail("Error: invalid CPU list %q, expected e.g. 0-3,6", list)
+			}
+			opts.CPUs = cpus
+		}
+		opts.IRQs, _ = flags.GetBool("irqs")
+		opts.RPS, _ = flags.GetBool("rps")
+		opts.XPS, _ = flags.GetBool("xps")
+
+		before, err := perf.Inspect(interfaces)
+		if err != nil {
+			return fail("Error inspecting the NICs: %v", err)
+		}
+		var after *perf.Report
+		if apply, _ := flags.GetBool("apply"); apply {
+			if err := perf.Tune(interfaces, opts); err != nil {
+				return fail("Error tuning the NICs: %v", err)
+			}
+			logger.Info("Tuned the packet processing of %s", strings.Join(interfaces, ", "))
+			if after, err = perf.Inspect(interfaces); err != nil {
+				return fail("Error inspecting the NICs: %v", err)
+			}
+		}
+
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, struct {
+				Before *perf.Report `json:"before"`
+				After  *perf.Report `json:"after,omitempty"`
+			}{before, after})
+		}
+		printPerfReport(cmd, before, after)
+		return nil
+	},
+}
+
+// printPerfReport prints the layout of each NIC, before and after tuning if it
+// was tuned, the share of the receive softirqs of the busiest CPUs and hints
+func printPerfReport(cmd *cobra.Command, before, after *perf.Report) {
+	for i, layout := range before.Layouts {
+		fmt.Printf("%s: %d interrupts, %d receive and %d transmit queues\n",
+			layout.Interface, len(layout.IRQs), len(layout.RxQueues), len(layout.TxQueues))
+
+		columns := []table.Column{{Header: "KIND"}, {Header: "NAME", MaxWidth: 30}, {Header: "CPUS"}}
+		if after != nil {
+			columns = []table.Column{{Header: "KIND"}, {Header: "NAME", MaxWidth: 30}, {Header: "BEFORE"}, {Header: "AFTER"}}
+		}
+		columns = append(columns, table.Column{Header: "INTERRUPTS"})
+		tbl := table.New(columns...)
+		// Queues and interrupts are found in the same order after tuning
+		var next perf.Layout
+		if after != nil {
+			next = *after.Layouts[i]
+		}
+		row := func(kind, name string, cpus []int, changed []int, count string) {
+			cells := []string{kind, name, perf.FormatCPUList(cpus)}
+			if after != nil {
+				cells = append(cells, perf.FormatCPUList(changed))
+			}
+			tbl.AddRow(append(cells, count)...)
+		}
+		for j, irq := range layout.IRQs {
+			row("irq", fmt.Sprintf("%d %s", irq.Number, irq.Name), irq.CPUs, cpusAt(next.IRQs, j, func(irq perf.IRQ) []int { return irq.CPUs }), fmt.Sprint(irq.Count))
+		}
+		for j, q := range layout.RxQueues {
+			row("rps", q.Name, q.CPUs, cpusAt(next.RxQueues, j, func(q perf.Queue) []int { return q.CPUs }), "-")
+		}
+		for j, q := range layout.TxQueues {
+			row("xps", q.Name, q.CPUs, cpusAt(next.TxQueues, j, func(q perf.Queue) []int { return q.CPUs }), "-")
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		fmt.Println()
+	}
+
+	fmt.Printf("Receive softirqs by CPU since boot, where ESP is decrypted: %s\n", netRxSummary(before.NetRx))
+	if before.IRQBalance {
+		fmt.Println("irqbalance is running: it moves interrupts on its own and undoes pinning unless they are banned from it")
+	}
+	if after == nil {
+		for _, layout := range before.Layouts {
+			if len(layout.RxQueues) == 1 && len(before.CPUs) > 1 && len(layout.RxQueues[0].CPUs) == 0 {
+				fmt.Printf("%s has a single receive queue without RPS, so one CPU receives all its packets; --apply steers them to all\n", layout.Interface)
+			}
+		}
+	}
+}
+
+// cpusAt returns the CPUs of the j-th of items, or none if there are fewer
+func cpusAt[T any](items []T, j int, cpus func(T) []int) []int {
+	if j >= len(items) {
+		return nil
+	}
+	return cpus(items[j])
+}
+
+// netRxSummary formats the shares of the receive softirqs of the busiest CPUs
+func netRxSummary(counts []uint64) string {
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 {
+		return "none"
+	}
+	cpus := make([]int, len(counts))
+	for i := range cpus {
+		cpus[i] = i
+	}
+	slices.SortStableFunc(cpus, func(a, b int) int {
+		switch {
+		case counts[a] > counts[b]:
+			return -1
+		case counts[a] < counts[b]:
+			return 1
+		}
+		return 0
+	})
+	var parts []string
+	for _, cpu := range cpus[:min(len(cpus), 4)] {
+		parts = append(parts, fmt.Sprintf("cpu%d %.0f%%", cpu, float64(counts[cpu])*100/float64(total)))
+	}
+	if len(cpus) > 4 {
+		parts = append(parts, "...")
+	}
+	return strings.Join(parts, ", ")
+}
+
+func init() {
+	perfCmd.AddCommand(perfTuneCmd)
+
+	perfTuneCmd.Flags().StringSlice("interface", nil, "NICs to inspect or tune, the underlay interfaces of the tunnels by default")
+	perfTuneCmd.Flags().String("cpus", "", "CPUs to spread the processing over, such as 2-7, all online CPUs by default")
+	perfTuneCmd.Flags().Bool("apply", false, "Pin the interrupts and set RPS and XPS, reporting the layout before and after")
+	perfTuneCmd.Flags().Bool("irqs", true, "Pin the interrupts of the NICs with --apply")
+	perfTuneCmd.Flags().Bool("rps", true, "Set receive packet steering with --apply")
+	perfTuneCmd.Flags().Bool("xps", true, "Set transmit packet steering with --apply")
+	perfTuneCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	perfTuneCmd.Flags().Bool("json", false, "Print machine-readable JSON")
+}
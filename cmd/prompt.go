@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// addYesFlag adds --yes/-y to a destructive command
+func addYesFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolP("yes", "y", false, "Do not prompt for confirmation")
+}
+
+// confirm lists what an action will destroy and asks the user to go ahead. It only
+// prompts when stdin is a terminal and --yes was not given; otherwise it proceeds.
+func confirm(cmd *cobra.Command, action string, targets []string) bool {
+	yes, _ := cmd.Flags().GetBool("yes")
+	if yes || !table.IsTerminal(os.Stdin) {
+		return true
+	}
+
+	fmt.Printf("This will %s:\n", action)
+	for _, t := range targets {
+		fmt.Printf("  - %s\n", t)
+	}
+	fmt.Print("Continue? [y/N] ")
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		fmt.Println("Aborted")
+		return false
+	}
+}
+
+// readPassphrase reads a passphrase from a file, or else from stdin, prompting
+// without echo if stdin is a terminal. A single trailing newline is dropped.
+func readPassphrase(prompt, file string) ([]byte, error) {
+	var line string
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		line = string(data)
+	case table.IsTerminal(os.Stdin):
+		fd := int(os.Stdin.Fd())
+		state, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		if err != nil {
+			return nil, err
+		}
+		noEcho := *state
+		noEcho.Lflag &^= unix.ECHO
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+			return nil, err
+		}
+		fmt.Fprint(os.Stderr, prompt)
+		line, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		_ = unix.IoctlSetTermios(fd, unix.TCSETS, state)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		var err error
+		line, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, err
+		}
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if line == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return []byte(line), nil
+}
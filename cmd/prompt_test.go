@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// terminal replaces stdin with a pseudo-terminal, returning its other end to
+// type into
+func terminal(t *testing.T) *os.File {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("No pseudo-terminals: %v", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		t.Skipf("Cannot unlock the pseudo-terminal: %v", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Skipf("Cannot find the pseudo-terminal: %v", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("Cannot open the pseudo-terminal: %v", err)
+	}
+	t.Cleanup(func() { slave.Close() })
+
+	stdin := os.Stdin
+	os.Stdin = slave
+	t.Cleanup(func() { os.Stdin = stdin })
+	return master
+}
+
+// pipe replaces stdin with a pipe that reads input
+func pipe(t *testing.T, input string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	if _, err := w.WriteString(input); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() { os.Stdin = stdin })
+}
+
+func TestConfirm(t *testing.T) {
+	tests := []struct {
+		answer string
+		yes    bool
+		want   bool
+	}{
+		{"y\n", false, true},
+		{"YES\n", false, true},
+		{" yes \n", false, true},
+		{"n\n", false, false},
+		{"\n", false, false},
+		{"yep\n", false, false},
+		{"", true, true},
+	}
+	for _, tt := range tests {
+		master := terminal(t)
+		cmd := &cobra.Command{Use: "delete"}
+		addYesFlag(cmd)
+		if tt.yes {
+			cmd.Flags().Set("yes", "true")
+		} else if _, err := master.WriteString(tt.answer); err != nil {
+			t.Fatal(err)
+		}
+		if got := confirm(cmd, "delete", []string{"tunnel 'office'"}); got != tt.want {
+			t.Errorf("Expected %q with --yes=%v to confirm: %v, got %v", tt.answer, tt.yes, tt.want, got)
+		}
+	}
+
+	// Without a terminal nobody is asked
+	pipe(t, "n\n")
+	cmd := &cobra.Command{Use: "delete"}
+	addYesFlag(cmd)
+	if !confirm(cmd, "delete", []string{"tunnel 'office'"}) {
+		t.Error("Expected no prompt when stdin is not a terminal")
+	}
+}
+
+func TestReadPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		stdin   string
+		want    string
+		wantErr bool
+	}{
+		{"file", write("file", "correct horse\n"), "", "correct horse", false},
+		{"file without newline", write("bare", "correct horse"), "", "correct horse", false},
+		{"file with CRLF", write("crlf", "correct horse\r\n"), "", "correct horse", false},
+		{"only the last newline", write("lines", "correct\nhorse\n"), "", "correct\nhorse", false},
+		{"empty file", write("empty", "\n"), "", "", true},
+		{"missing file", filepath.Join(dir, "missing"), "", "", true},
+		{"stdin", "", "correct horse\nbattery\n", "correct horse", false},
+		{"stdin without newline", "", "correct horse", "correct horse", false},
+		{"empty stdin", "", "", "", true},
+	}
+	for _, tt := range tests {
+		pipe(t, tt.stdin)
+		got, err := readPassphrase("Passphrase: ", tt.file)
+		if (err != nil) != tt.wantErr || string(got) != tt.want {
+			t.Errorf("%s: expected %q (error %v), got %q: %v", tt.name, tt.want, tt.wantErr, got, err)
+		}
+	}
+}
+
+func TestReadPassphraseTerminal(t *testing.T) {
+	master := terminal(t)
+	if _, err := master.WriteString("correct horse\n"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readPassphrase("Passphrase: ", "")
+	if err != nil || string(got) != "correct horse" {
+		t.Errorf("Expected the passphrase typed, got %q: %v", got, err)
+	}
+	state, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Lflag&unix.ECHO == 0 {
+		t.Error("Expected echo to be turned back on")
+	}
+}
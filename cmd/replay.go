@@ -0,0 +1,314 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/history"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/dzakwan/ipsec-vpn/pkg/restconf"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/spf13/cobra"
+)
+
+// replayResult is how a recorded operation ended when it was replayed
+type replayResult struct {
+	history.Operation
+	Replayed string `json:"replayed"` // history.ResultOK, or why it failed
+}
+
+// Differs reports whether the operation succeeded when it was recorded and
+// failed when it was replayed, or the other way around
+func (r replayResult) Differs() bool {
+	return (r.Result == history.ResultOK) != (r.Replayed == history.ResultOK)
+}
+
+var historyReplayCmd = &cobra.Command{
+	Use:   "replay [file]",
+	Short: "Replay recorded operations against a simulation backend",
+	Long: `Replay the operations recorded with history.record_operations, from
+operations.jsonl in the configuration directory or a file a user attached to a
+bug report, to reproduce the state they left, such as a corrupted tunnel.
+
+The operations are made again in order, in a scratch configuration directory,
+--dir or a new temporary one, that starts empty or as a copy of --base. Tunnels
+run against a simulation backend that changes nothing and hook scripts are not
+run. Each command runs in a network namespace of its own, so anything else it
+changes in the kernel, and any event it publishes, stays there. Secrets were
+masked when the operations were recorded and are replayed masked, and approvals
+are not replayed, so operations that need one fail where approval.required is
+set.
+
+Commands are replayed as fast as they run unless --speed keeps the recorded
+pace, 1 for the time they took then. The operations that ended differently than
+when recorded are pointed out, and the directory is kept for inspection, e.g.
+with 'ipsec-vpn --set config_dir=DIR tunnel show NAME'.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := history.OperationsPath()
+		if len(args) > 0 {
+			path, err = filepath.Abs(args[0])
+		}
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		ops, err := history.LoadOperations(path)
+		if err != nil {
+			return fail("Error reading the recorded operations: %v", err)
+		}
+		if until, _ := cmd.Flags().GetString("until"); until != "" {
+			t, err := time.Parse(time.RFC3339, until)
+			if err != nil {
+				return fail("Error: --until must be an RFC 3339 time, e.g. 2026-10-16T09:30:00Z")
+			}
+			for i, op := range ops {
+				if op.Time.After(t) {
+					ops = ops[:i]
+					break
+				}
+			}
+		}
+		if len(ops) == 0 {
+			fmt.Println("No operations to replay")
+			return nil
+		}
+
+		if sandboxed, _ := cmd.Flags().GetBool("sandboxed"); sandboxed && simulate {
+			return replayOperations(cmd, ops)
+		}
+		return replayInSandbox(cmd, path)
+	},
+}
+
+// replayInSandbox prepares the scratch configuration directory and replays a
+// recording in a copy of the command, in a network namespace of its own
+func replayInSandbox(cmd *cobra.Command, path string) error {
+	dir, _ := cmd.Flags().GetString("dir")
+	var err error
+	if dir == "" {
+		dir, err = os.MkdirTemp("", "ipsec-vpn-replay-")
+	} else {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		return fail("Error creating the replay directory: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		return fail("Error: replay directory %s is not empty", dir)
+	}
+	if base, _ := cmd.Flags().GetString("base"); base != "" {
+		if err := os.CopyFS(dir, os.DirFS(base)); err != nil {
+			return fail("Error copying %s into the replay directory: %v", base, err)
+		}
+	}
+
+	args := append(replayFlags(dir), "history", "replay", path, "--sandboxed")
+	for _, name := range []string{"until", "speed", "timeout", "wide", "json"} {
+		if f := cmd.Flags().Lookup(name); f.Changed {
+			args = append(args, "--"+name+"="+f.Value.String())
+		}
+	}
+	replay, err := sandboxCommand(context.Background(), args)
+	if err != nil {
+		return fail("Error replaying operations: %v", err)
+	}
+	replay.Stdout, replay.Stderr = os.Stdout, os.Stderr
+	logger.Info("Replaying the operations of %s in %s", path, dir)
+	if err := replay.Run(); err != nil {
+		return fail("Error replaying operations in a network namespace of their own: %v", err)
+	}
+	if !jsonOutput(cmd) {
+		fmt.Printf("Replayed into %s, inspect it with 'ipsec-vpn --set config_dir=%s ...'\n", dir, dir)
+	}
+	return nil
+}
+
+// replayOperations makes recorded operations again, in the sandbox set up by
+// replayInSandbox, and shows how each ended then and now
+func replayOperations(cmd *cobra.Command, ops []history.Operation) error {
+	dir, err := paths.ConfigDir()
+	if err != nil {
+		return fail("Error: %v", err)
+	}
+	speed, _ := cmd.Flags().GetFloat64("speed")
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	api := restconf.New("", nil).Handler()
+
+	results := make([]replayResult, len(ops))
+	for i, op := range ops {
+		if i > 0 && speed > 0 {
+			time.Sleep(time.Duration(float64(op.Time.Sub(ops[i-1].Time)) / speed))
+		}
+		results[i] = replayResult{Operation: op}
+		if op.Source == history.SourceRESTCONF {
+			results[i].Replayed = replayRequest(api, op)
+		} else {
+			results[i].Replayed = replayCommand(dir, op, timeout)
+		}
+	}
+
+	if jsonOutput(cmd) {
+		return writeJSON(os.Stdout, results)
+	}
+	tbl := table.New(
+		table.Column{Header: "TIME"},
+		table.Column{Header: "SOURCE"},
+		table.Column{Header: "OPERATION", MaxWidth: 50},
+		table.Column{Header: "RECORDED", Status: true},
+		table.Column{Header: "REPLAYED", Status: true},
+		table.Column{Header: "ERROR", MaxWidth: 50},
+	)
+	differ := 0
+	for _, r := range results {
+		recorded, replayed, reason := "ok", "ok", "-"
+		if r.Result != history.ResultOK {
+			recorded = "failed"
+		}
+		if r.Replayed != history.ResultOK {
+			replayed, reason = "failed", r.Replayed
+		}
+		if r.Differs() {
+			differ++
+		}
+		operation := r.String()
+		if r.Source == history.SourceCLI {
+			operation = history.CommandLine(replayArgs(r.Args))
+		}
+		tbl.AddRow(r.Time.Format(time.DateTime), r.Source, operation, recorded, replayed, reason)
+	}
+	tbl.Render(os.Stdout, tableOptions(cmd))
+	fmt.Printf("Replayed %d operation(s), %d ended differently than recorded\n", len(results), differ)
+	return nil
+}
+
+// replayCommand runs a recorded command in the scratch directory, returning
+// history.ResultOK or the last line it printed when it failed
+func replayCommand(dir string, op history.Operation, timeout time.Duration) string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	self, err := os.Executable()
+	if err != nil {
+		return err.Error()
+	}
+	var out bytes.Buffer
+	c := exec.CommandContext(ctx, self, append(replayFlags(dir), replayArgs(op.Args)...)...)
+	c.Stdout = &out
+	if err := c.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Sprintf("still running after %s", timeout)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if last := lines[len(lines)-1]; last != "" {
+			return last
+		}
+		return err.Error()
+	}
+	return history.ResultOK
+}
+
+// replayRequest sends a recorded RESTCONF request to the API, returning
+// history.ResultOK or the status it failed with, as recorded
+func replayRequest(api http.Handler, op history.Operation) string {
+	r, err := http.NewRequest(op.Method, "https://localhost"+op.Path, strings.NewReader(op.Body))
+	if err != nil {
+		return err.Error()
+	}
+	if op.ContentType != "" {
+		r.Header.Set("Content-Type", op.ContentType)
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code >= http.StatusBadRequest {
+		return fmt.Sprintf("%d %s", w.Code, http.StatusText(w.Code))
+	}
+	return history.ResultOK
+}
+
+// replayFlags are the global flags of the commands replaying operations into
+// a scratch configuration directory: against the simulation backend, with the
+// configuration file of the replay, logging to the directory and not recording
+// the operations again
+func replayFlags(dir string) []string {
+	flags := []string{"--simulate", "--set", "config_dir=" + dir, "--set", "log.directory=" + filepath.Join(dir, "log"),
+		"--set", "history.record_operations=false"}
+	if cfgFile != "" {
+		flags = append(flags, "--config", cfgFile)
+	}
+	return flags
+}
+
+// replayArgs drops the arguments of a recorded command that would take it out
+// of the scratch directory, its configuration file and configuration directory,
+// or record it again
+func replayArgs(args []string) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(kept, args[i:]...)
+		}
+		switch {
+		case arg == "--config":
+			i++
+		case strings.HasPrefix(arg, "--config="):
+		case arg == "--set" && i+1 < len(args) && replayProtected(args[i+1]):
+			i++
+		case strings.HasPrefix(arg, "--set=") && replayProtected(strings.TrimPrefix(arg, "--set=")):
+		default:
+			kept = append(kept, arg)
+		}
+	}
+	return kept
+}
+
+// replayProtected reports whether an override sets where a replayed command
+// keeps its state or logs, or whether it is recorded
+func replayProtected(override string) bool {
+	key, _, _ := strings.Cut(override, "=")
+	switch strings.TrimSpace(key) {
+	case "config_dir", "log.directory", "history.record_operations":
+		return true
+	}
+	return false
+}
+
+// sandboxCommand returns a copy of the running command with args, in a new
+// network namespace, and a new user namespace for users other than root
+func sandboxCommand(ctx context.Context, args []string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	c := exec.CommandContext(ctx, self, args...)
+	c.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if os.Geteuid() != 0 {
+		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		c.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		c.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	}
+	return c, nil
+}
+
+func init() {
+	historyCmd.AddCommand(historyReplayCmd)
+
+	historyReplayCmd.Flags().String("dir", "", "Scratch configuration directory to replay into, empty or new; defaults to a temporary one")
+	historyReplayCmd.Flags().String("base", "", "Configuration directory to start from a copy of, such as the one the recording began with")
+	historyReplayCmd.Flags().String("until", "", "Only replay the operations made until this RFC 3339 time")
+	historyReplayCmd.Flags().Float64("speed", 0, "Keep the recorded pace, sped up this many times; 0 to replay as fast as possible")
+	historyReplayCmd.Flags().Duration("timeout", time.Minute, "Stop a replayed command still running after this long, such as a server")
+	historyReplayCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	historyReplayCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+	historyReplayCmd.Flags().Bool("sandboxed", false, "Replay in this process, set up by a replay outside the sandbox")
+	_ = historyReplayCmd.Flags().MarkHidden("sandboxed")
+}
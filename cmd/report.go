@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/report"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// reportCmd represents the report command
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Report on the tunnels over a period",
+	Long: `Reports are computed from the journal of the tunnels' lifecycle events: when each
+was created, went up, down or into error and was deleted. The journal is kept in
+the state directory for 13 months.`,
+}
+
+var reportSLACmd = &cobra.Command{
+	Use:   "sla",
+	Short: "Report the availability of each tunnel over a day, week or month",
+	Long: `Report the availability of each tunnel over a period as the percentage of the time
+it was meant to be up that it was, with the mean time to restore it (MTTR) and the
+list of its outages. A tunnel is meant to be up from when it is started until it
+is stopped or deleted; it is out from when it goes into error, or down for a
+reason other than being stopped, until it is up again.
+
+Without --start, the report covers the last complete period, such as last month.
+Reports are written as text, JSON or a standalone HTML page to hand to customers.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		period, _ := cmd.Flags().GetString("period")
+		start, _ := cmd.Flags().GetString("start")
+		format, _ := cmd.Flags().GetString("format")
+
+		from, to, err := reportPeriod(period, start)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		journal, err := tunnel.Journal(to)
+		if err != nil {
+			return fail("Error reading the journal: %v", err)
+		}
+		sla := report.ComputeSLA(journal, period, from, to)
+
+		switch format {
+		case report.FormatText:
+			sla.WriteText(os.Stdout, tableOptions(cmd))
+		case report.FormatJSON:
+			return writeJSON(os.Stdout, sla)
+		case report.FormatHTML:
+			if err := sla.WriteHTML(os.Stdout); err != nil {
+				return fail("Error writing report: %v", err)
+			}
+		default:
+			return fail("Error: unknown format '%s', expected %s", format, strings.Join(report.Formats, ", "))
+		}
+		return nil
+	},
+}
+
+// reportPeriod returns the bounds of the period containing a date, or of the
+// last complete period without one
+func reportPeriod(period, start string) (from, to time.Time, err error) {
+	if start != "" {
+		at, err := time.ParseInLocation(time.DateOnly, start, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid start date '%s', expected YYYY-MM-DD", start)
+		}
+		return report.Period(period, at)
+	}
+	current, _, err := report.Period(period, time.Now())
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return report.Period(period, current.Add(-time.Nanosecond))
+}
+
+func init() {
+	reportCmd.AddCommand(reportSLACmd)
+
+	reportSLACmd.Flags().String("period", report.PeriodMonth, "Period to report on ("+strings.Join(report.Periods, ", ")+")")
+	reportSLACmd.Flags().String("start", "", "Report on the period containing this date (YYYY-MM-DD) instead of the last complete one")
+	reportSLACmd.Flags().String("format", report.FormatText, "Output format ("+strings.Join(report.Formats, ", ")+")")
+	reportSLACmd.Flags().Bool("wide", false, "Show all columns without truncation")
+}
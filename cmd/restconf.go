@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/restconf"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// restconfCmd represents the restconf command
+var restconfCmd = &cobra.Command{
+	Use:   "restconf",
+	Short: "Manage tunnels and advertised networks over RESTCONF",
+	Long: `Serve the ipsec-vpn YANG module over RESTCONF (RFC 8040), so orchestration systems
+that manage devices through YANG models can create, change and delete tunnels and
+advertised networks. Data is encoded as JSON (RFC 7951). Clients authenticate with
+TLS client certificates issued by restconf.client_ca.`,
+}
+
+var restconfServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run the RESTCONF server in the foreground",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().Changed("listen") {
+			listen, _ := cmd.Flags().GetString("listen")
+			viper.Set("restconf.listen", listen)
+		}
+		server, err := restconf.FromConfig()
+		if err != nil {
+			return fail("Error starting RESTCONF server: %v", err)
+		}
+		// Report a failed self-test now rather than on the first change
+		if err := tunnel.RequireSelfTest(); err != nil {
+			logger.Error("Tunnels cannot be changed through RESTCONF: %v", err)
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			server.Close()
+		}()
+		defer watchLinks()()
+
+		if err := server.ListenAndServe(); err != nil {
+			return fail("RESTCONF server failed: %v", err)
+		}
+		return nil
+	},
+}
+
+var restconfSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the ipsec-vpn YANG module",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Stdout.Write(restconf.Schema)
+	},
+}
+
+var restconfOpenAPICmd = &cobra.Command{
+	Use:   "openapi",
+	Short: "Print the OpenAPI document of the RESTCONF API",
+	Long: `Print an OpenAPI 3 document describing the RESTCONF resources and operations, for
+generating clients in other languages. Go programs can use pkg/client instead. The
+server also serves the document at /restconf/openapi.json.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		server, _ := cmd.Flags().GetString("server")
+		doc, err := restconf.OpenAPI(server)
+		if err != nil {
+			return fail("Error generating OpenAPI document: %v", err)
+		}
+		os.Stdout.Write(append(doc, '\n'))
+		return nil
+	},
+}
+
+func init() {
+	restconfCmd.AddCommand(restconfServeCmd)
+	restconfCmd.AddCommand(restconfSchemaCmd)
+	restconfCmd.AddCommand(restconfOpenAPICmd)
+
+	restconfServeCmd.Flags().String("listen", "", "Address to listen on, overriding restconf.listen (default :8443)")
+	restconfOpenAPICmd.Flags().String("server", "", "URL of the server to list in the document, e.g. https://gw.example.com:8443")
+}
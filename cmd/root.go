@@ -4,17 +4,36 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/dzakwan/ipsec-vpn/pkg/config"
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
 	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/store"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
-	cfgFile string
-	verbose bool
+	cfgFile   string
+	verbose   bool
+	noColor   bool
+	overrides []string
+	// simulate runs tunnels against the simulation backend, for 'history replay'
+	simulate bool
+	// storeErr is why the configuration store cannot be used, if it is locked
+	storeErr error
+	// started is when the command began to run, once its arguments were accepted
+	started time.Time
 )
 
+// eventsFlushTimeout bounds how long a command waits on exit for the events it
+// published to be sent
+const eventsFlushTimeout = 10 * time.Second
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "ipsec-vpn",
@@ -29,12 +48,41 @@ Features:
 - Network advertisement capabilities
 - Cisco-like CLI configuration interface
 - Comprehensive logging and monitoring`,
+
+	// Commands report their own failures and return an ExitError; other errors,
+	// such as bad arguments, are printed by main
+	SilenceErrors: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// Arguments were valid, so a failure from here on is not a usage error
+		cmd.SilenceUsage = true
+		started = time.Now()
+		if storeErr != nil && !worksLocked(cmd) {
+			return fail("Error: %v", storeErr)
+		}
+		if err := authorize(cmd); err != nil {
+			return fail("Error: %v", err)
+		}
+		return nil
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() error {
-	return rootCmd.Execute()
+	registerCompletions()
+	cmd, err := rootCmd.ExecuteC()
+	if started.IsZero() {
+		return err
+	}
+	recordHistory(cmd, err)
+	if !events.Flush(eventsFlushTimeout) {
+		logger.Error("Events still waiting to be published were dropped on exit")
+	}
+	// Changes to an unlocked configuration store are written back to the sealed file
+	if _, err := store.Sync(); err != nil {
+		logger.Error("Failed to write changes to the sealed configuration store: %v", err)
+	}
+	return err
 }
 
 func init() {
@@ -43,12 +91,46 @@ func init() {
 	// Global flags
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.ipsec-vpn.yaml)")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose output")
+	rootCmd.PersistentFlags().BoolVar(&noColor, "no-color", false, "disable colored output (also honors NO_COLOR)")
+	rootCmd.PersistentFlags().StringArrayVar(&overrides, "set", nil, "override a setting, e.g. --set advanced.dpd_delay=10 (repeatable)")
+	rootCmd.PersistentFlags().BoolVar(&simulate, "simulate", false, "change nothing on the system, as when replaying operations")
+	_ = rootCmd.PersistentFlags().MarkHidden("simulate")
 
 	// Add commands
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(tunnelCmd)
 	rootCmd.AddCommand(cryptoCmd)
 	rootCmd.AddCommand(networkCmd)
+	rootCmd.AddCommand(keyCmd)
+	rootCmd.AddCommand(agentCmd)
+	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(securityCmd)
+	rootCmd.AddCommand(spiffeCmd)
+	rootCmd.AddCommand(vaultCmd)
+	rootCmd.AddCommand(caCmd)
+	rootCmd.AddCommand(storeCmd)
+	rootCmd.AddCommand(restconfCmd)
+	rootCmd.AddCommand(eventsCmd)
+	rootCmd.AddCommand(metricsCmd)
+	rootCmd.AddCommand(alertsCmd)
+	rootCmd.AddCommand(selftestCmd)
+	rootCmd.AddCommand(fsckCmd)
+	rootCmd.AddCommand(cleanupCmd)
+	rootCmd.AddCommand(flowsCmd)
+	rootCmd.AddCommand(uplinksCmd)
+	rootCmd.AddCommand(pathCmd)
+	rootCmd.AddCommand(perfCmd)
+	rootCmd.AddCommand(breakoutCmd)
+	rootCmd.AddCommand(discoverCmd)
+	rootCmd.AddCommand(confirmCmd)
+	rootCmd.AddCommand(chaosCmd)
+	rootCmd.AddCommand(approvalCmd)
+	rootCmd.AddCommand(jobCmd)
+	rootCmd.AddCommand(historyCmd)
+	rootCmd.AddCommand(reportCmd)
+	rootCmd.AddCommand(peerGroupCmd)
+	rootCmd.AddCommand(clientCmd)
+	rootCmd.AddCommand(genDocsCmd)
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -77,15 +159,61 @@ func initConfig() {
 	// Environment variables can override config file settings
 	viper.AutomaticEnv() // read in environment variables that match
 	viper.SetEnvPrefix("IPSEC") // will be uppercased automatically
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	config.Bind()
+
+	// Command line overrides take precedence over everything else
+	cobra.CheckErr(config.ApplyOverrides(overrides))
+	verbose = verbose || viper.GetBool("verbose")
+	if simulate {
+		tunnel.Simulate()
+	}
+
+	// Who may change what is up to root alone, whatever the user passed above
+	if err := config.ApplyPolicy(config.SystemFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring the access and approval settings: %v\n", err)
+	}
+
+	// A sealed configuration store is used from its runtime directory
+	storeErr = store.Apply()
 
 	// Initialize logger
 	if err := logger.Init(verbose); err != nil {
 		fmt.Fprintf(os.Stderr, "Error initializing logger: %v\n", err)
 	}
+	if machineOutput() {
+		logger.SetQuiet()
+	}
 
 	// Log startup information
 	logger.Info("IPsec VPN starting up")
 	if verbose {
 		logger.Debug("Verbose logging enabled")
 	}
+
+	// Viper silently ignores unknown keys, so point out typos in the config file
+	if path := viper.ConfigFileUsed(); path != "" {
+		if _, problems, err := config.ValidateFile(path); err != nil {
+			logger.Error("Failed to parse config file %s: %v", path, err)
+		} else {
+			for _, p := range problems {
+				if !p.Warning || strings.HasPrefix(p.Message, "unknown key") {
+					fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, p.Line, p)
+				}
+			}
+		}
+		if path != config.SystemFile {
+			for _, key := range config.Keys() {
+				if config.Protected(key) && viper.InConfig(key) {
+					fmt.Fprintf(os.Stderr, "%s: %s is ignored, it is only read from %s\n", path, key, config.SystemFile)
+				}
+			}
+		}
+	}
+
+	// Check the random number generator before any keys are generated.
+	// A failure disables key generation for the rest of the process.
+	if _, err := crypto.CheckEntropy(); err != nil {
+		logger.Error("Entropy health check failed, key generation disabled: %v", err)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// networkScheduleCmd represents the network schedule command
+var networkScheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Route or advertise prefixes through tunnels at certain times of day",
+	Long: `A schedule routes a prefix through a tunnel during a window of the day, such as
+replicating traffic over an expensive LTE tunnel only at night, and withdraws
+the route outside it. With --advertise, the route is advertised like those of
+'network advertise' while the window is open. Windows are in local time; one
+ending at or before its start runs past midnight. 'network schedule run' opens
+and closes the windows, logging every activation, and 'network schedule log'
+shows them.`,
+}
+
+var networkScheduleSetCmd = &cobra.Command{
+	Use:   "set [name]",
+	Short: "Create a schedule or change its settings",
+	Long: `Create a schedule or change the settings given. The prefix must lie within the
+remote subnet of the tunnel. The route of a schedule that is active is
+withdrawn and put in place again as changed if its window is open.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		s, err := tunnel.GetSchedule(name)
+		if errors.Is(err, tunnel.ErrScheduleNotFound) {
+			s, err = &tunnel.Schedule{Name: name}, nil
+		}
+		if err != nil {
+			return fail("Error reading schedule %s: %v", name, err)
+		}
+
+		flags := cmd.Flags()
+		if flags.Changed("tunnel") {
+			s.Tunnel, _ = flags.GetString("tunnel")
+		}
+		if flags.Changed("prefix") {
+			s.Prefix, _ = flags.GetString("prefix")
+		}
+		if flags.Changed("metric") {
+			s.Metric, _ = flags.GetInt("metric")
+		}
+		if flags.Changed("advertise") {
+			s.Advertise, _ = flags.GetBool("advertise")
+		}
+		if flags.Changed("days") {
+			s.Days, _ = flags.GetStringSlice("days")
+		}
+		if flags.Changed("window") {
+			window, _ := flags.GetString("window")
+			start, end, ok := strings.Cut(window, "-")
+			if !ok {
+				return fail("Error: invalid window %q, expected HH:MM-HH:MM", window)
+			}
+			s.Start, s.End = start, end
+		}
+
+		if err := tunnel.SaveSchedule(s); err != nil {
+			return fail("Error saving schedule %s: %v", name, err)
+		}
+		logger.Info("Schedule %s saved", name)
+		fmt.Printf("Schedule %s saved: %s through %s, %s\n", name, s.Prefix, s.Tunnel, s.Window())
+		a, err := tunnel.RunSchedule(name, time.Now())
+		if err != nil {
+			return fail("Error running schedule %s: %v", name, err)
+		}
+		if a != nil {
+			fmt.Println(formatActivation(*a))
+		}
+		return nil
+	},
+}
+
+var networkScheduleListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the schedules and whether their routes are in place",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		schedules, err := tunnel.Schedules()
+		if err != nil {
+			return fail("Error listing schedules: %v", err)
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, schedules)
+		}
+		if len(schedules) == 0 {
+			fmt.Println("No schedules")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "NAME"},
+			table.Column{Header: "TUNNEL"},
+			table.Column{Header: "PREFIX"},
+			table.Column{Header: "WINDOW", MaxWidth: 40},
+			table.Column{Header: "METRIC", Wide: true},
+			table.Column{Header: "STATE", Status: true},
+			table.Column{Header: "SINCE"},
+			table.Column{Header: "ERROR", MaxWidth: 50},
+		)
+		for _, s := range schedules {
+			state := "INACTIVE"
+			if s.Active {
+				state = "ACTIVE"
+			}
+			if s.Advertise {
+				state += " (ADVERTISED)"
+			}
+			since := "-"
+			if !s.ChangedAt.IsZero() {
+				since = s.ChangedAt.Local().Format(time.DateTime)
+			}
+			tbl.AddRow(s.Name, s.Tunnel, s.Prefix, s.Window(), fmt.Sprint(s.Metric), state, since, orDash(s.Error))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var networkScheduleApplyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Open and close the windows of the schedules, once",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		activations, err := tunnel.RunSchedules(time.Now())
+		printActivations(activations)
+		if err != nil {
+			return fail("Error running schedules: %v", err)
+		}
+		if len(activations) == 0 {
+			fmt.Println("All schedules are as their windows say")
+		}
+		for _, a := range activations {
+			if a.Error != "" {
+				return errFailed
+			}
+		}
+		return nil
+	},
+}
+
+var networkScheduleRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Open and close the windows of the schedules, in the foreground",
+	Long: `Open and close the windows of the schedules every interval until interrupted.
+Routes of open windows are put in place again each round, as they go away with
+a tunnel that is restarted.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		interval, _ := cmd.Flags().GetInt("interval")
+		if interval <= 0 {
+			return fail("Error: the interval must be a positive number of seconds")
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+
+		logger.Info("Running schedules every %d seconds", interval)
+		for {
+			activations, err := tunnel.RunSchedules(time.Now())
+			if err != nil {
+				logger.Error("Error running schedules: %v", err)
+			}
+			printActivations(activations)
+
+			select {
+			case <-ticker.C:
+			case <-sigs:
+				return nil
+			}
+		}
+	},
+}
+
+// printActivations prints the activations of a round of the schedules
+func printActivations(activations []tunnel.ScheduleActivation) {
+	for _, a := range activations {
+		fmt.Println(formatActivation(a))
+	}
+}
+
+// formatActivation formats an activation of a schedule on one line
+func formatActivation(a tunnel.ScheduleActivation) string {
+	line := fmt.Sprintf("%s  %-11s  %s  %s", a.Time.Local().Format(time.DateTime), strings.ToUpper(a.Action), a.Schedule, a.Reason)
+	if a.Error != "" {
+		line += ": " + a.Error
+	}
+	return line
+}
+
+var networkScheduleLogCmd = &cobra.Command{
+	Use:   "log [name]",
+	Short: "Show the activation log of a schedule",
+	Long: `Show when a schedule put its route in place, withdrew it or failed to, and why.
+The last 1000 activations are kept.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if _, err := tunnel.GetSchedule(name); err != nil {
+			return fail("Error reading schedule %s: %v", name, err)
+		}
+		log, err := tunnel.ScheduleLog(name)
+		if err != nil {
+			return fail("Error reading activation log of schedule %s: %v", name, err)
+		}
+		if limit, _ := cmd.Flags().GetInt("limit"); limit > 0 && len(log) > limit {
+			log = log[len(log)-limit:]
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, log)
+		}
+		if len(log) == 0 {
+			fmt.Printf("Schedule %s has not been activated yet\n", name)
+			return nil
+		}
+		for _, a := range log {
+			fmt.Println(formatActivation(a))
+		}
+		return nil
+	},
+}
+
+var networkScheduleDeleteCmd = &cobra.Command{
+	Use:   "delete [name]",
+	Short: "Delete a schedule and its log, withdrawing its route",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := tunnel.DeleteSchedule(args[0]); err != nil {
+			return fail("Error deleting schedule %s: %v", args[0], err)
+		}
+		logger.Info("Schedule %s deleted", args[0])
+		fmt.Printf("Schedule %s deleted\n", args[0])
+		return nil
+	},
+}
+
+func init() {
+	networkCmd.AddCommand(networkScheduleCmd)
+	networkScheduleCmd.AddCommand(networkScheduleSetCmd)
+	networkScheduleCmd.AddCommand(networkScheduleListCmd)
+	networkScheduleCmd.AddCommand(networkScheduleApplyCmd)
+	networkScheduleCmd.AddCommand(networkScheduleRunCmd)
+	networkScheduleCmd.AddCommand(networkScheduleLogCmd)
+	networkScheduleCmd.AddCommand(networkScheduleDeleteCmd)
+
+	networkScheduleSetCmd.Flags().String("tunnel", "", "Tunnel to route the prefix through")
+	networkScheduleSetCmd.Flags().String("prefix", "", "Prefix to route, within the remote subnet of the tunnel")
+	networkScheduleSetCmd.Flags().Int("metric", tunnel.DefaultScheduleMetric, "Metric of the route")
+	networkScheduleSetCmd.Flags().Bool("advertise", false, "Advertise the route while the window is open")
+	networkScheduleSetCmd.Flags().StringSlice("days", nil, "Days the window opens on ("+strings.Join(tunnel.ScheduleDays, ", ")+"), every day by default")
+	networkScheduleSetCmd.Flags().String("window", "", "Hours of the window in local time, e.g. 22:00-06:00")
+
+	networkScheduleListCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	networkScheduleListCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+
+	networkScheduleRunCmd.Flags().Int("interval", 60, "Seconds between rounds")
+
+	networkScheduleLogCmd.Flags().Int("limit", 0, "Show only the last activations")
+	networkScheduleLogCmd.Flags().Bool("json", false, "Print machine-readable JSON")
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/geoip"
+	"github.com/dzakwan/ipsec-vpn/pkg/guard"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/spf13/cobra"
+)
+
+// securityCmd represents the security command
+var securityCmd = &cobra.Command{
+	Use:   "security",
+	Short: "Inspect security events and settings",
+	Long:  `Inspect authentication failures recorded by the IKE responder and check peer restrictions.`,
+}
+
+var securityShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show security events",
+}
+
+var securityShowFailuresCmd = &cobra.Command{
+	Use:   "failures",
+	Short: "Show peers that failed authentication",
+	Long: `Show authentication failures from the auth failure log, which is also meant to be
+read by fail2ban or CrowdSec. The log is security.auth_failure_log, or
+auth-failures.log in the log directory.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		since, _ := cmd.Flags().GetDuration("since")
+		source, _ := cmd.Flags().GetString("source")
+		summary, _ := cmd.Flags().GetBool("summary")
+
+		var from time.Time
+		if since > 0 {
+			from = time.Now().Add(-since)
+		}
+		var sourceIP net.IP
+		if source != "" {
+			if sourceIP = net.ParseIP(source); sourceIP == nil {
+				return fail("Error: invalid source address %q", source)
+			}
+		}
+
+		failures, err := guard.ReadAuthFailures(from)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Println("No authentication failures recorded")
+			return nil
+		}
+		if err != nil {
+			return fail("Error reading %s: %v", guard.AuthFailureLogPath(), err)
+		}
+		if sourceIP != nil {
+			matching := failures[:0]
+			for _, f := range failures {
+				if f.Source.Equal(sourceIP) {
+					matching = append(matching, f)
+				}
+			}
+			failures = matching
+		}
+
+		if len(failures) == 0 {
+			fmt.Println("No authentication failures found")
+			return nil
+		}
+		if summary {
+			failuresBySource(failures).Render(os.Stdout, tableOptions(cmd))
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "TIME"},
+			table.Column{Header: "SOURCE"},
+			table.Column{Header: "TUNNEL"},
+			table.Column{Header: "IDENTITY", MaxWidth: 30},
+			table.Column{Header: "REASON", MaxWidth: 40},
+		)
+		for _, f := range failures {
+			tbl.AddRow(f.Time.Local().Format(time.DateTime), f.Source.String(), orDash(f.Tunnel), orDash(f.Identity), f.Reason)
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var securityGeoIPCmd = &cobra.Command{
+	Use:   "geoip [address]",
+	Short: "Check whether peers from an address would be accepted",
+	Long: `Look an address up in the GeoIP databases (security.geoip_country_database and
+security.geoip_asn_database) and check it against security.geoip_allow_countries
+and security.geoip_allow_asns, as the IKE responder does for new negotiations.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ip := net.ParseIP(args[0])
+		if ip == nil {
+			return fail("Error: invalid address %q", args[0])
+		}
+
+		locator, err := geoip.LocatorFromConfig()
+		if err != nil {
+			return fail("Error opening GeoIP database: %v", err)
+		}
+		if locator == nil {
+			return fail("Error: no GeoIP database configured, set security.geoip_country_database or security.geoip_asn_database")
+		}
+		loc, err := locator.Locate(ip)
+		if err != nil {
+			return fail("Error looking up %s: %v", ip, err)
+		}
+
+		fmt.Printf("Address: %s\n", ip)
+		fmt.Printf("Country: %s\n", orDash(loc.Country))
+		if loc.ASN != 0 {
+			fmt.Printf("AS: %d (%s)\n", loc.ASN, loc.Organization)
+		} else {
+			fmt.Println("AS: -")
+		}
+
+		g := guard.New(guard.LimitsFromConfig())
+		g.UseGeoIP(locator)
+		if _, err := g.Admit(ip, nil, nil, nil); errors.Is(err, guard.ErrGeoBlocked) {
+			fmt.Println("Accepted: no, not on the allow-list")
+			return errFailed
+		}
+		fmt.Println("Accepted: yes")
+		return nil
+	},
+}
+
+// failuresBySource tabulates failures per source, most failures first
+func failuresBySource(failures []guard.AuthFailure) *table.Table {
+	type sourceFailures struct {
+		source string
+		count  int
+		last   guard.AuthFailure
+	}
+	bySource := make(map[string]*sourceFailures)
+	for _, f := range failures {
+		s, ok := bySource[f.Source.String()]
+		if !ok {
+			s = &sourceFailures{source: f.Source.String()}
+			bySource[s.source] = s
+		}
+		s.count++
+		s.last = f
+	}
+
+	sources := make([]*sourceFailures, 0, len(bySource))
+	for _, s := range bySource {
+		sources = append(sources, s)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].count != sources[j].count {
+			return sources[i].count > sources[j].count
+		}
+		return sources[i].source < sources[j].source
+	})
+
+	tbl := table.New(
+		table.Column{Header: "SOURCE"},
+		table.Column{Header: "FAILURES"},
+		table.Column{Header: "LAST"},
+		table.Column{Header: "LAST REASON", MaxWidth: 40},
+	)
+	for _, s := range sources {
+		tbl.AddRow(s.source, strconv.Itoa(s.count), s.last.Time.Local().Format(time.DateTime), s.last.Reason)
+	}
+	return tbl
+}
+
+func init() {
+	securityCmd.AddCommand(securityShowCmd)
+	securityShowCmd.AddCommand(securityShowFailuresCmd)
+	securityCmd.AddCommand(securityGeoIPCmd)
+
+	securityShowFailuresCmd.Flags().Duration("since", 24*time.Hour, "Only show failures this recent, 0 for all")
+	securityShowFailuresCmd.Flags().String("source", "", "Only show failures from this address")
+	securityShowFailuresCmd.Flags().Bool("summary", false, "Count failures per source instead of listing them")
+	securityShowFailuresCmd.Flags().Bool("wide", false, "Do not truncate long identities and reasons")
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// selftestCmd represents the selftest command
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Run the checks made before tunnels are managed",
+	Long: `Run the self-test made the first time a command or server manages a tunnel:
+
+  crypto    The random number generator passes its health checks and the ciphers
+            and key exchanges pass their known-answer tests
+  netlink   Links and XFRM policies can be listed, so the kernel can be configured
+  store     Every tunnel and key file can be read, is stored under its own name,
+            and every key matches its fingerprint and is readable only by its owner
+
+With self_test.fail_closed set, tunnels are not created, started, stopped,
+deleted or changed by a process whose self-test failed.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		results := tunnel.SelfTest()
+		tbl := table.New(
+			table.Column{Header: "CHECK"},
+			table.Column{Header: "STATUS", Status: true},
+			table.Column{Header: "DETAIL", MaxWidth: 80},
+		)
+		for _, r := range results {
+			if r.Err != nil {
+				tbl.AddRow(r.Check, "FAIL", r.Err.Error())
+			} else {
+				tbl.AddRow(r.Check, "PASS", "")
+			}
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+
+		if err := tunnel.SelfTestError(results); err != nil {
+			logger.Error("Self-test failed: %v", err)
+			return errFailed
+		}
+		return nil
+	},
+}
+
+func init() {
+	selftestCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+}
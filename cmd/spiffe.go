@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/spiffe"
+	"github.com/spf13/cobra"
+)
+
+// spiffeFetchTimeout bounds how long spiffe show waits for the agent
+const spiffeFetchTimeout = 10 * time.Second
+
+// spiffeCmd represents the spiffe command
+var spiffeCmd = &cobra.Command{
+	Use:   "spiffe",
+	Short: "Inspect the SPIFFE identity fetched from the Workload API",
+	Long: `Inspect the X.509-SVID that tunnels using security.authentication_method: spiffe
+present to their peers. SVIDs and trust bundles are fetched from the SPIFFE
+Workload API of a local agent such as SPIRE, at spiffe.socket or ` + spiffe.SocketEnv + `,
+and rotated whenever the agent issues new ones.`,
+}
+
+var spiffeShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the current SVID and trust bundles",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := spiffe.NewClient(spiffe.SocketAddress())
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), spiffeFetchTimeout)
+		defer cancel()
+		x509Context, err := client.FetchX509Context(ctx)
+		if err != nil {
+			return fail("Error fetching SVID from %s: %v", spiffe.SocketAddress(), err)
+		}
+		printX509Context(x509Context)
+		return nil
+	},
+}
+
+var spiffeWatchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Print the SVID each time the agent rotates it",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := spiffe.NewClient(spiffe.SocketAddress())
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		defer client.Close()
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		_ = client.WatchX509Context(ctx, func(x509Context *spiffe.X509Context) {
+			svid := x509Context.DefaultSVID()
+			logger.Info("Received SVID %s, valid until %s", svid.ID, svid.ExpiresAt().Format(time.RFC3339))
+			fmt.Printf("--- %s\n", time.Now().Format(time.DateTime))
+			printX509Context(x509Context)
+		})
+		return nil
+	},
+}
+
+// printX509Context prints the SVIDs and trust bundles of a Workload API update
+func printX509Context(x509Context *spiffe.X509Context) {
+	for i, svid := range x509Context.SVIDs {
+		if i > 0 {
+			fmt.Println()
+		}
+		leaf := svid.Certificates[0]
+		fmt.Printf("SPIFFE ID: %s\n", svid.ID)
+		if svid.Hint != "" {
+			fmt.Printf("Hint: %s\n", svid.Hint)
+		}
+		fmt.Printf("Serial: %x\n", leaf.SerialNumber)
+		fmt.Printf("Valid: %s to %s (%s left)\n", leaf.NotBefore.Format(time.DateTime), leaf.NotAfter.Format(time.DateTime),
+			time.Until(leaf.NotAfter).Round(time.Second))
+		fmt.Printf("Issuer: %s\n", leaf.Issuer)
+	}
+
+	trustDomains := make([]string, 0, len(x509Context.Bundles))
+	for trustDomain, cas := range x509Context.Bundles {
+		plural := "s"
+		if len(cas) == 1 {
+			plural = ""
+		}
+		trustDomains = append(trustDomains, fmt.Sprintf("%s (%d CA%s)", trustDomain, len(cas), plural))
+	}
+	sort.Strings(trustDomains)
+	fmt.Printf("Trust Bundles: %s\n", strings.Join(trustDomains, ", "))
+}
+
+func init() {
+	spiffeCmd.AddCommand(spiffeShowCmd)
+	spiffeCmd.AddCommand(spiffeWatchCmd)
+}
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/store"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/spf13/cobra"
+)
+
+// storeCmd represents the store command
+var storeCmd = &cobra.Command{
+	Use:   "store",
+	Short: "Keep the configuration directory encrypted at rest",
+	Long: `Seal the configuration directory (~/.ipsec-vpn, or config_dir) into a single
+encrypted file next to it, so a stolen disk or backup image exposes neither the
+tunnel topology nor the keys. The store is unlocked at startup with a passphrase,
+a keyfile, a systemd credential or the TPM, into a runtime directory on tmpfs
+that every command then uses. Changes are written back to the sealed file after
+each command, and 'store lock' removes the unlocked copy.
+
+While the store is locked, only the store, config, version and completion
+commands run.`,
+}
+
+var storeStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show whether the configuration store is sealed and unlocked",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		state, err := store.State()
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		dir, err := store.Dir()
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		fmt.Printf("State: %s\n", state)
+		if state == store.StatePlain {
+			fmt.Printf("Directory: %s\n", dir)
+			return nil
+		}
+		path, _ := store.SealedPath()
+		method, err := store.Describe()
+		if err != nil {
+			return fail("Error reading sealed store: %v", err)
+		}
+		fmt.Printf("Sealed: %s\n", path)
+		fmt.Printf("Unlocked with: %s\n", method)
+		if state == store.StateUnlocked {
+			fmt.Printf("Runtime directory: %s\n", store.RuntimeDir())
+		}
+		return nil
+	},
+}
+
+var storeSealCmd = &cobra.Command{
+	Use:   "seal",
+	Short: "Encrypt the configuration directory",
+	Long: `Encrypt the configuration directory into <directory>.sealed and remove it. Give
+exactly one way of unlocking it:
+
+  --passphrase        Ask for a passphrase, stretched with scrypt
+  --keyfile FILE      Derive the key from a file of at least 16 bytes
+  --credential NAME   Generate key material and store it as the encrypted systemd
+                      credential /etc/credstore.encrypted/NAME, for units with
+                      LoadCredentialEncrypted=NAME
+  --tpm               Generate key material and seal it to this host's TPM2 with
+                      systemd-creds
+
+Blocks the removed files occupied may still be readable on the disk, so seal a
+fresh installation or wipe free space afterwards.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		source, err := storeKeySource(cmd, true)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		if source == nil {
+			return fail("Error: give one of --passphrase, --keyfile, --credential or --tpm")
+		}
+		if err := store.Seal(source); err != nil {
+			return fail("Error sealing configuration store: %v", err)
+		}
+		path, _ := store.SealedPath()
+		logger.Info("Sealed configuration store with %s", source.Method())
+		fmt.Printf("Configuration store sealed into %s\n", path)
+		fmt.Println("Run 'ipsec-vpn store unlock' to use it")
+		return nil
+	},
+}
+
+var storeUnlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Decrypt the configuration store for use",
+	Long: `Decrypt the sealed configuration store into the runtime directory. A store
+sealed with a keyfile, systemd credential or the TPM is unlocked without further
+input, e.g. from ExecStartPre= of a systemd unit; one sealed with a passphrase
+asks for it, or reads it from --passphrase-file.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		method, err := store.Describe()
+		if err != nil {
+			state, _ := store.State()
+			if state == store.StatePlain {
+				return fail("Error: %v", store.ErrNotSealed)
+			}
+			return fail("Error reading sealed store: %v", err)
+		}
+		source, err := storeKeySource(cmd, false)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		if source == nil && strings.HasPrefix(method, store.MethodPassphrase) {
+			file, _ := cmd.Flags().GetString("passphrase-file")
+			passphrase, err := readPassphrase("Passphrase: ", file)
+			if err != nil {
+				return fail("Error reading passphrase: %v", err)
+			}
+			defer crypto.Zeroize(passphrase)
+			source = store.Passphrase{Passphrase: passphrase}
+		}
+		if err := store.Unlock(source); err != nil {
+			return fail("Error unlocking configuration store: %v", err)
+		}
+		fmt.Printf("Configuration store unlocked into %s\n", store.RuntimeDir())
+		return nil
+	},
+}
+
+var storeLockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Write back changes and remove the unlocked configuration store",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := store.Lock(); err != nil {
+			return fail("Error locking configuration store: %v", err)
+		}
+		fmt.Println("Configuration store locked")
+		return nil
+	},
+}
+
+var storeUnsealCmd = &cobra.Command{
+	Use:   "unseal",
+	Short: "Turn encryption off and restore the configuration directory",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir, err := store.Dir()
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		if !confirm(cmd, "store the configuration unencrypted", []string{dir}) {
+			return nil
+		}
+		if err := store.Unseal(); err != nil {
+			return fail("Error unsealing configuration store: %v", err)
+		}
+		fmt.Printf("Configuration store restored to %s unencrypted\n", dir)
+		return nil
+	},
+}
+
+// storeKeySource returns the key source given on the command line, or nil if
+// none was. When sealing, a passphrase is asked for twice.
+func storeKeySource(cmd *cobra.Command, sealing bool) (store.KeySource, error) {
+	usePassphrase, _ := cmd.Flags().GetBool("passphrase")
+	passphraseFile, _ := cmd.Flags().GetString("passphrase-file")
+	keyfile, _ := cmd.Flags().GetString("keyfile")
+	credential, _ := cmd.Flags().GetString("credential")
+	tpm, _ := cmd.Flags().GetBool("tpm")
+
+	var sources []store.KeySource
+	if usePassphrase || (sealing && passphraseFile != "") {
+		passphrase, err := readPassphrase("Passphrase: ", passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %v", err)
+		}
+		if sealing && passphraseFile == "" && table.IsTerminal(os.Stdin) {
+			again, err := readPassphrase("Repeat passphrase: ", "")
+			if err != nil {
+				return nil, fmt.Errorf("failed to read passphrase: %v", err)
+			}
+			if !bytes.Equal(passphrase, again) {
+				return nil, errors.New("passphrases do not match")
+			}
+		}
+		sources = append(sources, store.Passphrase{Passphrase: passphrase})
+	}
+	if keyfile != "" {
+		sources = append(sources, store.Keyfile{Path: keyfile})
+	}
+	if credential != "" {
+		sources = append(sources, store.Credential{Name: credential})
+	}
+	if tpm {
+		sources = append(sources, store.TPM{})
+	}
+	if len(sources) > 1 {
+		return nil, errors.New("give only one of --passphrase, --keyfile, --credential and --tpm")
+	}
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	return sources[0], nil
+}
+
+// worksLocked reports whether a command may run while the store is locked
+func worksLocked(cmd *cobra.Command) bool {
+	for c := cmd; c != nil; c = c.Parent() {
+		switch c.Name() {
+		case "store", "config", "version", "help", "completion", "gen-docs", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	storeCmd.AddCommand(storeStatusCmd)
+	storeCmd.AddCommand(storeSealCmd)
+	storeCmd.AddCommand(storeUnlockCmd)
+	storeCmd.AddCommand(storeLockCmd)
+	storeCmd.AddCommand(storeUnsealCmd)
+
+	// Flags for seal and unlock commands
+	for _, c := range []*cobra.Command{storeSealCmd, storeUnlockCmd} {
+		c.Flags().String("passphrase-file", "", "Read the passphrase from a file instead of the terminal")
+		c.Flags().String("keyfile", "", "Unlock with a keyfile")
+	}
+	storeSealCmd.Flags().Bool("passphrase", false, "Unlock with a passphrase")
+	storeSealCmd.Flags().String("credential", "", "Unlock with an encrypted systemd credential of this name")
+	storeSealCmd.Flags().Bool("tpm", false, "Unlock with key material sealed to the TPM")
+
+	// Flags for unseal command
+	addYesFlag(storeUnsealCmd)
+}
@@ -1,11 +1,32 @@
 package cmd
 
 import (
+	"cmp"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
 	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
 	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // tunnelCmd represents the tunnel command
@@ -18,8 +39,11 @@ var tunnelCmd = &cobra.Command{
 var tunnelCreateCmd = &cobra.Command{
 	Use:   "create [name]",
 	Short: "Create a new IPsec tunnel",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	Long: `Create a new IPsec tunnel and start it. Negotiating with the peer can take
+seconds; with --async the command prints a job ID straight away and creates
+the tunnel in the background, see 'ipsec-vpn job show'.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		name := args[0]
 		localIP, _ := cmd.Flags().GetString("local-ip")
 		remoteIP, _ := cmd.Flags().GetString("remote-ip")
@@ -27,6 +51,61 @@ var tunnelCreateCmd = &cobra.Command{
 		remoteSubnet, _ := cmd.Flags().GetString("remote-subnet")
 		encryption, _ := cmd.Flags().GetString("encryption")
 		pqEnabled, _ := cmd.Flags().GetBool("post-quantum")
+		namespace, _ := cmd.Flags().GetString("netns")
+		killSwitch, _ := cmd.Flags().GetBool("kill-switch")
+		rateLimit, _ := cmd.Flags().GetString("rate-limit")
+		pin, _ := cmd.Flags().GetString("pin")
+		tofu, _ := cmd.Flags().GetBool("tofu")
+		peerSpiffeID, _ := cmd.Flags().GetString("peer-spiffe-id")
+		pskRef, _ := cmd.Flags().GetString("psk-ref")
+		peerGroup, _ := cmd.Flags().GetString("peer-group")
+		peerID, _ := cmd.Flags().GetString("peer-id")
+		peerCA, _ := cmd.Flags().GetString("peer-ca")
+		virtualIPPool, _ := cmd.Flags().GetString("virtual-ip-pool")
+		virtualIPEntries, _ := cmd.Flags().GetStringArray("virtual-ip")
+		shortcuts, _ := cmd.Flags().GetBool("shortcuts")
+		mode, _ := cmd.Flags().GetString("mode")
+		wireGuardPeerKey, _ := cmd.Flags().GetString("wireguard-peer-key")
+		listenPort, _ := cmd.Flags().GetInt("listen-port")
+		checkPeer, _ := cmd.Flags().GetString("check-peer")
+
+		// Fall back to the configured tunnel defaults for options not given on the command line.
+		// They do not apply to WireGuard, which has a fixed cipher.
+		if !cmd.Flags().Changed("encryption") {
+			encryption = viper.GetString("tunnel_defaults.encryption")
+			if mode == tunnel.ModeWireGuard {
+				encryption = ""
+			}
+		}
+		if !cmd.Flags().Changed("post-quantum") {
+			pqEnabled = viper.GetBool("tunnel_defaults.post_quantum") && mode != tunnel.ModeWireGuard
+		}
+		if !cmd.Flags().Changed("check-peer") {
+			checkPeer = cmp.Or(viper.GetString("tunnel_defaults.check_peer"), tunnel.CheckPeerOff)
+		}
+		if !slices.Contains(tunnel.CheckPeerModes, checkPeer) {
+			return fail("Error: --check-peer must be one of %s", strings.Join(tunnel.CheckPeerModes, ", "))
+		}
+
+		var rate uint64
+		if rateLimit != "" {
+			var err error
+			if rate, err = network.ParseRate(rateLimit); err != nil {
+				return fail("Error: %v", err)
+			}
+		}
+
+		if pin != "" {
+			var err error
+			if pin, err = peerFingerprint(pin); err != nil {
+				return fail("Error: %v", err)
+			}
+		}
+
+		virtualIPs, err := tunnel.ParseVirtualIPs(virtualIPEntries)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
 
 		// Create tunnel configuration
 		config := tunnel.Config{
@@ -37,158 +116,3195 @@ var tunnelCreateCmd = &cobra.Command{
 			RemoteSubnet:  remoteSubnet,
 			Encryption:    encryption,
 			PostQuantum:   pqEnabled,
+			Namespace:     namespace,
+			KillSwitch:    killSwitch,
+			RateLimit:     rate,
+			PeerPin:       pin,
+			PinTOFU:       tofu,
+			PeerSpiffeID:  peerSpiffeID,
+			Mode:          mode,
+			WireGuardPeerKey: wireGuardPeerKey,
+			ListenPort:    listenPort,
+			PSKRef:        pskRef,
+			PeerGroup:     peerGroup,
+			PeerID:        peerID,
+			PeerCA:        peerCA,
+			VirtualIPPool: virtualIPPool,
+			VirtualIPs:    virtualIPs,
+			Shortcuts:     shortcuts,
+		}
+
+		if async, _ := cmd.Flags().GetBool("async"); async {
+			return startJob(fmt.Sprintf("create tunnel '%s'", name))
+		}
+		j, err := attachJob(cmd)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		defer func() { j.finish(err) }()
+
+		// Make sure the peer can be reached before creating anything
+		if checkPeer != tunnel.CheckPeerOff && remoteIP != tunnel.AnyPeer {
+			j.step("Checking peer %s", remoteIP)
+			check, err := tunnel.CheckPeer(remoteIP, mode, listenPort)
+			if err != nil {
+				return fail("Error checking peer: %v", err)
+			}
+			printPeerCheck(os.Stdout, check)
+			if err := check.Err(); err != nil {
+				if checkPeer == tunnel.CheckPeerAbort {
+					return fail("Error: not creating tunnel '%s': %v", name, err)
+				}
+				logger.Error("Peer %s of tunnel '%s' looks unreachable: %v", remoteIP, name, err)
+				fmt.Printf("Warning: %v; the tunnel may go into ERROR\n", err)
+			}
 		}
 
 		// Create and start the tunnel
 		logger.Info("Creating tunnel '%s' with local IP %s and remote IP %s", name, localIP, remoteIP)
+		j.step("Creating and starting tunnel '%s'", name)
 		tun, err := tunnel.Create(config)
 		if err != nil {
-			logger.Error("Error creating tunnel: %v", err)
-			fmt.Printf("Error creating tunnel: %v\n", err)
-			return
+			return fail("Error creating tunnel: %v", err)
 		}
+		j.step("Tunnel '%s' created, status %s", tun.Name, tun.Status)
 
 		logger.Info("Tunnel '%s' created successfully", tun.Name)
 		fmt.Printf("Tunnel '%s' created successfully\n", tun.Name)
 		fmt.Printf("Local IP: %s, Remote IP: %s\n", tun.LocalIP, tun.RemoteIP)
 		fmt.Printf("Local Subnet: %s, Remote Subnet: %s\n", tun.LocalSubnet, tun.RemoteSubnet)
 		fmt.Printf("Encryption: %s, Post-Quantum: %v\n", tun.Encryption, tun.PostQuantum)
+		if tun.Mode == tunnel.ModeWireGuard {
+			if public, err := tunnel.WireGuardPublicKey(tun.Name); err == nil {
+				fmt.Printf("WireGuard Public Key: %s (configure this on the peer, port %d)\n", public, tun.ListenPort)
+			}
+		}
+		if tun.Namespace != "" {
+			fmt.Printf("Network Namespace: %s (run commands in it with 'ipsec-vpn tunnel exec %s -- <command>')\n",
+				tun.Namespace, tun.Name)
+		}
+
+		if algo, ok := crypto.LookupAlgorithm(tun.Encryption); ok && algo.Deprecated {
+			logger.Info("Tunnel '%s' uses deprecated algorithm %s", tun.Name, algo.Name)
+			fmt.Printf("Warning: %s is deprecated, consider 'ipsec-vpn crypto migrate %s --to %s'\n",
+				algo.Name, tun.Name, algo.ReplacedBy)
+		}
+		return nil
+	},
+}
+
+var tunnelApplyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Create the tunnels declared in a file, a template for many sites",
+	Long: `Create the tunnels declared under 'tunnels:' in a YAML file, with the options of
+'tunnel create' and labels, and set the labels of those that exist. Tunnels that
+exist with other options are reported and left alone: delete them and apply again
+to change them.
+
+The file is a Go template. Placeholders such as {{ .SiteID }} and {{ .Region }}
+are resolved from the environment, then a values file and --set, so one template
+generates the tunnels of every branch site. With several --values files, the
+template is rendered once for each, e.g. --values 'sites/*.yaml'. A placeholder
+without a value is an error.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, _ := cmd.Flags().GetString("file")
+		valueFiles, _ := cmd.Flags().GetStringSlice("values")
+		sets, _ := cmd.Flags().GetStringArray("set")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		render, _ := cmd.Flags().GetBool("render")
+
+		text, err := os.ReadFile(file)
+		if err != nil {
+			return fail("Error reading %s: %v", file, err)
+		}
+		set := make(tunnel.Values)
+		for _, s := range sets {
+			key, value, ok := strings.Cut(s, "=")
+			if !ok || key == "" {
+				return fail("Error: invalid value '%s', expected key=value", s)
+			}
+			set[key] = value
+		}
+		var paths []string
+		for _, pattern := range valueFiles {
+			matches, err := filepath.Glob(pattern)
+			if err != nil || len(matches) == 0 {
+				return fail("Error: no values file matches '%s'", pattern)
+			}
+			paths = append(paths, matches...)
+		}
+
+		// Render the template once for each values file, or once without any
+		env := tunnel.EnvValues()
+		renders := []tunnel.Values{env.Merge(set)}
+		if len(paths) > 0 {
+			renders = nil
+			for _, path := range paths {
+				values, err := tunnel.LoadValues(path)
+				if err != nil {
+					return fail("Error reading values: %v", err)
+				}
+				renders = append(renders, env.Merge(values, set))
+			}
+		}
+		var specs []tunnel.Spec
+		declared := make(map[string]bool)
+		for i, values := range renders {
+			data, err := tunnel.Render(filepath.Base(file), text, values)
+			if err != nil {
+				return fail("Error rendering %s%s: %v", file, valuesSuffix(paths, i), err)
+			}
+			if render {
+				if i > 0 {
+					fmt.Println("---")
+				}
+				os.Stdout.Write(data)
+				continue
+			}
+			rendered, err := tunnel.ParseSpecs(data)
+			if err != nil {
+				return fail("Error parsing %s%s: %v", file, valuesSuffix(paths, i), err)
+			}
+			for _, spec := range rendered {
+				if declared[spec.Name] {
+					return fail("Error: tunnel '%s' is declared more than once%s", spec.Name, valuesSuffix(paths, i))
+				}
+				declared[spec.Name] = true
+			}
+			specs = append(specs, rendered...)
+		}
+		if render {
+			return nil
+		}
+		if len(specs) == 0 {
+			fmt.Println("No tunnels declared")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "TUNNEL", MaxWidth: 24},
+			table.Column{Header: "ACTION", Status: true},
+			table.Column{Header: "DETAILS", MaxWidth: 60},
+		)
+		failed := 0
+		for _, spec := range specs {
+			action, details, err := applySpec(spec, dryRun)
+			if err != nil {
+				failed++
+				action, details = "FAILED", err.Error()
+				logger.Error("Failed to apply tunnel '%s': %v", spec.Name, err)
+			}
+			tbl.AddRow(spec.Name, action, orDash(details))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		if failed > 0 {
+			return fail("Error: %d of %d tunnels failed to apply", failed, len(specs))
+		}
+		return nil
+	},
+}
+
+// applySpec creates the tunnel of a spec or updates its labels, unless in a
+// dry run, and returns what it did
+func applySpec(spec tunnel.Spec, dryRun bool) (action, details string, err error) {
+	config, err := spec.Config()
+	if err != nil {
+		return "", "", err
+	}
+	existing, err := tunnel.Get(spec.Name)
+	if errors.Is(err, tunnel.ErrNotFound) {
+		if dryRun {
+			return "create", fmt.Sprintf("%s -> %s", config.LocalIP, config.RemoteIP), nil
+		}
+		logger.Info("Creating tunnel '%s' with local IP %s and remote IP %s", spec.Name, config.LocalIP, config.RemoteIP)
+		tun, err := tunnel.Create(config)
+		if err != nil {
+			return "", "", err
+		}
+		if len(spec.Labels) > 0 {
+			if err := tunnel.SetLabels(tun.Name, spec.Labels); err != nil {
+				return "", "", err
+			}
+		}
+		return "created", fmt.Sprintf("status %s", tun.Status), nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	diffs, err := spec.Differences(existing)
+	if err != nil {
+		return "", "", err
+	}
+	if len(diffs) > 0 {
+		return "differs", strings.Join(diffs, ", ") + "; delete the tunnel and apply again to change it", nil
+	}
+	if spec.Labels == nil || maps.Equal(spec.Labels, existing.Labels) {
+		return "unchanged", "", nil
+	}
+	labels := tunnel.FormatLabels(spec.Labels)
+	if dryRun {
+		return "relabel", labels, nil
+	}
+	if err := tunnel.SetLabels(spec.Name, spec.Labels); err != nil {
+		return "", "", err
+	}
+	logger.Info("Tunnel '%s' labels: %s", spec.Name, labels)
+	return "relabeled", labels, nil
+}
+
+// valuesSuffix names the values file of render i, if any, for errors
+func valuesSuffix(paths []string, i int) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	return " with " + paths[i]
+}
+
+var tunnelCheckPeerCmd = &cobra.Command{
+	Use:   "check-peer [address]",
+	Short: "Check that a peer can be reached before creating a tunnel to it",
+	Long: `Look up the route to a peer, measure the round-trip time of a few ICMP echoes
+and probe its IKE port, UDP 500, or with --mode wireguard its listen port, to
+tell a closed port from one that may be open. Exits with 1 if the peer looks
+unreachable. This is the check 'tunnel create --check-peer' runs.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		mode, _ := cmd.Flags().GetString("mode")
+		listenPort, _ := cmd.Flags().GetInt("listen-port")
+
+		check, err := tunnel.CheckPeer(args[0], mode, listenPort)
+		if err != nil {
+			return fail("Error checking peer: %v", err)
+		}
+		printPeerCheck(os.Stdout, check)
+		if err := check.Err(); err != nil {
+			return fail("Error: %v", err)
+		}
+		return nil
 	},
 }
 
+// printPeerCheck prints the outcome of probing a peer and its warnings
+func printPeerCheck(w io.Writer, check *tunnel.PeerCheck) {
+	if check.RouteErr != nil {
+		fmt.Fprintf(w, "Route: %v\n", check.RouteErr)
+		return
+	}
+	if check.Gateway != "" {
+		fmt.Fprintf(w, "Route: %s via %s\n", check.Interface, check.Gateway)
+	} else {
+		fmt.Fprintf(w, "Route: %s (on link)\n", check.Interface)
+	}
+	switch {
+	case check.ICMPErr != nil:
+		fmt.Fprintf(w, "ICMP: not sent\n")
+	case check.Received > 0:
+		fmt.Fprintf(w, "ICMP: %d/%d replies, %.1fms round-trip\n", check.Received, check.Sent, check.Latency)
+	default:
+		fmt.Fprintf(w, "ICMP: %d/%d replies\n", check.Received, check.Sent)
+	}
+	fmt.Fprintf(w, "UDP %d: %s\n", check.Port, check.PortState)
+	for _, warning := range check.Warnings() {
+		fmt.Fprintf(w, "Warning: %s\n", warning)
+	}
+}
+
 var tunnelShowCmd = &cobra.Command{
 	Use:   "show [name]",
 	Short: "Show tunnel details",
 	Args:  cobra.MaximumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) == 0 {
-			// List all tunnels
-			logger.Debug("Listing all configured tunnels")
-			tunnels, err := tunnel.ListAll()
-			if err != nil {
-				logger.Error("Error listing tunnels: %v", err)
-				fmt.Printf("Error listing tunnels: %v\n", err)
-				return
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := tableOptions(cmd)
+		s, _ := cmd.Flags().GetString("selector")
+		selector, err := tunnel.ParseSelector(s)
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		if jsonOutput(cmd) {
+			return showTunnelsJSON(os.Stdout, args, selector)
+		}
+		if watchInterval(cmd) > 0 {
+			watch(cmd, func(w io.Writer) { showTunnels(w, args, selector, opts) })
+			return nil
+		}
+		return showTunnels(os.Stdout, args, selector, opts)
+	},
+}
+
+// showTunnels writes a table of the tunnels matching selector, or the details of
+// the named tunnel, to w
+func showTunnels(w io.Writer, args []string, selector tunnel.Selector, opts table.Options) error {
+	if len(args) == 0 {
+		// List all tunnels
+		logger.Debug("Listing all configured tunnels")
+		tunnels, err := tunnel.ListAll()
+		if err != nil {
+			logger.Error("Error listing tunnels: %v", err)
+			fmt.Fprintf(w, "Error listing tunnels: %v\n", err)
+			return errFailed
+		}
+		if len(tunnels) == 0 {
+			logger.Info("No tunnels configured")
+			fmt.Fprintln(w, "No tunnels configured")
+			return nil
+		}
+		tunnels = slices.DeleteFunc(tunnels, func(t *tunnel.Tunnel) bool { return !selector.Matches(t.Labels) })
+		if len(tunnels) == 0 {
+			fmt.Fprintln(w, "No tunnels match the selector")
+			return nil
+		}
+
+		logger.Info("Found %d configured tunnels", len(tunnels))
+		tbl := table.New(
+			table.Column{Header: "NAME", MaxWidth: 24},
+			table.Column{Header: "STATUS", Status: true},
+			table.Column{Header: "LOCAL IP"},
+			table.Column{Header: "REMOTE IP"},
+			table.Column{Header: "ENCRYPTION", MaxWidth: 20},
+			table.Column{Header: "PQ"},
+			table.Column{Header: "SYNC", Status: true},
+			table.Column{Header: "REASON", MaxWidth: 40},
+			table.Column{Header: "MODE", Wide: true},
+			table.Column{Header: "LOCAL SUBNET", Wide: true},
+			table.Column{Header: "REMOTE SUBNET", Wide: true},
+			table.Column{Header: "PEER", Wide: true},
+			table.Column{Header: "SINCE", Wide: true},
+			table.Column{Header: "UPDATED", Wide: true},
+			table.Column{Header: "LABELS", Wide: true},
+		)
+		for _, t := range tunnels {
+			peer := ""
+			if t.Peer != nil {
+				peer = t.Peer.Name()
 			}
+			sync := "-"
+			if state, err := tunnel.Sync(t.Name); err == nil && state != nil {
+				sync = yesNo(state.InSync)
+			}
+			tbl.AddRow(t.Name, string(t.Status), t.LocalIP, t.RemoteIP, t.Encryption,
+				yesNo(t.PostQuantum), sync, t.Reason, t.Mode, t.LocalSubnet, t.RemoteSubnet, peer,
+				t.LastTransition.Format(time.DateTime), t.UpdatedAt.Format(time.DateTime), tunnel.FormatLabels(t.Labels))
+		}
+		tbl.Render(w, opts)
+		return nil
+	}
 
-			if len(tunnels) == 0 {
-				logger.Info("No tunnels configured")
-				fmt.Println("No tunnels configured")
-				return
+	// Show specific tunnel
+	name := args[0]
+	logger.Debug("Retrieving details for tunnel '%s'", name)
+	tun, err := tunnel.Get(name)
+	if err != nil {
+		logger.Error("Error getting tunnel '%s': %v", name, err)
+		fmt.Fprintf(w, "Error getting tunnel '%s': %v\n", name, err)
+		return errFailed
+	}
+
+	logger.Info("Displaying details for tunnel '%s'", tun.Name)
+	fmt.Fprintf(w, "Tunnel: %s\n", tun.Name)
+	fmt.Fprintf(w, "Status: %s\n", tun.Status)
+	if tun.Reason != "" {
+		fmt.Fprintf(w, "Reason: %s\n", tun.Reason)
+	}
+	fmt.Fprintf(w, "Last Transition: %s\n", tun.LastTransition)
+	if state, err := tunnel.Sync(tun.Name); err == nil && state != nil {
+		if state.InSync {
+			fmt.Fprintf(w, "Sync: in sync, checked %s\n", state.Checked.Format(time.DateTime))
+		} else {
+			fmt.Fprintf(w, "Sync: drifted, checked %s: %s\n", state.Checked.Format(time.DateTime), strings.Join(state.Drift, "; "))
+		}
+		if state.BackingOff(time.Now()) {
+			fmt.Fprintf(w, "Next Retry: %s, backing off after %d repairs in a row\n", state.NextRetry.Format(time.DateTime), state.Repairs)
+		}
+	}
+	fmt.Fprintf(w, "Mode: %s\n", tun.Mode)
+	fmt.Fprintf(w, "Local IP: %s\n", tun.LocalIP)
+	fmt.Fprintf(w, "Remote IP: %s\n", tun.RemoteIP)
+	fmt.Fprintf(w, "Local Subnet: %s\n", tun.LocalSubnet)
+	fmt.Fprintf(w, "Remote Subnet: %s\n", tun.RemoteSubnet)
+	fmt.Fprintf(w, "Encryption: %s\n", tun.Encryption)
+	fmt.Fprintf(w, "Post-Quantum: %v\n", tun.PostQuantum)
+	if tun.Mode == tunnel.ModeWireGuard {
+		if public, err := tunnel.WireGuardPublicKey(tun.Name); err == nil {
+			fmt.Fprintf(w, "WireGuard Public Key: %s\n", public)
+		}
+		fmt.Fprintf(w, "WireGuard Peer Key: %s\n", tun.WireGuardPeerKey)
+		fmt.Fprintf(w, "Listen Port: %d\n", tun.ListenPort)
+	}
+	if stats, err := tunnel.GetStats(tun.Name); err == nil {
+		fmt.Fprintf(w, "Traffic: %s received, %s sent\n", formatBytes(stats.RxBytes), formatBytes(stats.TxBytes))
+		if !stats.LastHandshake.IsZero() {
+			fmt.Fprintf(w, "Last Handshake: %s\n", stats.LastHandshake.Format(time.DateTime))
+		}
+	}
+	if tun.Namespace != "" {
+		fmt.Fprintf(w, "Network Namespace: %s\n", tun.Namespace)
+	}
+	if tun.KillSwitchEnabled() {
+		fmt.Fprintf(w, "Kill-Switch: on, %s is blocked while the tunnel is down\n", tun.RemoteSubnet)
+	}
+	switch {
+	case tun.PeerPin != "" && tun.PinTOFU:
+		fmt.Fprintf(w, "Peer Pin: %s (trusted on first use, %s)\n", tun.PeerPin, tun.PinnedAt.Format(time.DateTime))
+	case tun.PeerPin != "":
+		fmt.Fprintf(w, "Peer Pin: %s\n", tun.PeerPin)
+	case tun.PinTOFU:
+		fmt.Fprintln(w, "Peer Pin: none yet, the first peer key will be trusted")
+	}
+	if tun.PeerSpiffeID != "" {
+		fmt.Fprintf(w, "Peer SPIFFE ID: %s\n", tun.PeerSpiffeID)
+	}
+	if tun.PSKRef != "" {
+		fmt.Fprintf(w, "Pre-Shared Key: %s\n", tun.PSKRef)
+	}
+	if tun.PeerGroup != "" {
+		fmt.Fprintf(w, "Peer Group: %s\n", tun.PeerGroup)
+	}
+	if tun.Responder() {
+		fmt.Fprintf(w, "Accepts: %s\n", tun.Accepts())
+		if instances, err := tunnel.Instances(tun.Name); err == nil {
+			names := make([]string, 0, len(instances))
+			for _, instance := range instances {
+				names = append(names, fmt.Sprintf("%s (%s from %s)", instance.Name, instance.PeerIdentity, instance.RemoteIP))
+			}
+			fmt.Fprintf(w, "Instances: %s\n", orDash(strings.Join(names, ", ")))
+		}
+		if tun.VirtualIPPool != "" || len(tun.VirtualIPs) > 0 {
+			fmt.Fprintf(w, "Virtual IP Pool: %s, %d static\n", orDash(tun.VirtualIPPool), len(tun.VirtualIPs))
+		}
+		if tun.Shortcuts {
+			fmt.Fprintln(w, "Shortcuts: brokered between instances")
+		}
+	}
+	if tun.Via != "" {
+		fmt.Fprintf(w, "Shortcut Via: %s, peer %s\n", tun.Via, tun.PeerIdentity)
+	}
+	if tun.Template != "" {
+		fmt.Fprintf(w, "Instance Of: %s, peer %s\n", tun.Template, tun.PeerIdentity)
+	}
+	if tun.VirtualIP != "" {
+		fmt.Fprintf(w, "Virtual IP: %s\n", tun.VirtualIP)
+	}
+	if tun.RateLimit > 0 {
+		fmt.Fprintf(w, "Rate Limit: %s each way\n", network.FormatRate(tun.RateLimit))
+	}
+	if tun.PacketAccounting {
+		fmt.Fprintln(w, "Packet Accounting: on")
+	}
+	if len(tun.Policy) > 0 {
+		fmt.Fprintf(w, "Traffic Policy: %s\n", policySummary(tun.Policy))
+	}
+	if len(tun.AppRoutes) > 0 {
+		fmt.Fprintf(w, "App Routes: %s\n", appRouteSummary(tun.AppRoutes))
+	}
+	if len(tun.MulticastRoutes) > 0 {
+		fmt.Fprintf(w, "Multicast Routes: %s\n", multicastRouteSummary(tun.MulticastRoutes))
+	}
+	if tun.Tuning != nil {
+		fmt.Fprintf(w, "Tuning: %s\n", tun.Tuning)
+	}
+	if tun.Inspection != nil {
+		fmt.Fprintf(w, "Inspection: %s\n", tun.Inspection)
+	}
+	if tun.Uplink != "" {
+		fmt.Fprintf(w, "Uplink: %s\n", tun.Uplink)
+	}
+	if len(tun.Labels) > 0 {
+		fmt.Fprintf(w, "Labels: %s\n", tunnel.FormatLabels(tun.Labels))
+	}
+	if tun.Keepalive > 0 {
+		if stats, err := tunnel.KeepaliveCounters(tun.Name); err == nil {
+			fmt.Fprintf(w, "Keepalive: every %s, %d sent, %d failed\n", tun.Keepalive, stats.Sent, stats.Failed)
+		}
+	}
+	if counts, err := tunnel.Rekeys(tun.Name); err == nil && !counts.Last.IsZero() {
+		fmt.Fprintf(w, "SA Rekeys: %d by time, %d by bytes, %d by packets, %d hard expiries\n",
+			counts.Time, counts.Bytes, counts.Packets, counts.HardExpiries)
+	}
+	if p, _ := tunnel.EffectiveReauth(tun); p.Interval > 0 && tun.Mode != tunnel.ModeWireGuard {
+		fmt.Fprintf(w, "Reauthentication: %s\n", p)
+	}
+	if tun.DefaultRoute && len(tun.DNS) > 0 {
+		fmt.Fprintf(w, "Default Route: all traffic, DNS %s\n", strings.Join(tun.DNS, ", "))
+	} else if tun.DefaultRoute {
+		fmt.Fprintln(w, "Default Route: all traffic")
+	}
+	if h := tun.Hooks; h != nil {
+		for _, hook := range []struct{ point, command string }{
+			{tunnel.HookPreUp, h.PreUp}, {tunnel.HookPostUp, h.PostUp},
+			{tunnel.HookPreDown, h.PreDown}, {tunnel.HookPostDown, h.PostDown},
+		} {
+			if hook.command != "" {
+				fmt.Fprintf(w, "Hook %s: %s\n", hook.point, hook.command)
 			}
+		}
+	}
+	if tun.Debug {
+		fmt.Fprintln(w, "Debug Transcript: enabled")
+	}
+	if tun.Peer != nil {
+		fmt.Fprintf(w, "Peer: %s\n", tun.Peer.Name())
+		if len(tun.Peer.Features) > 0 {
+			fmt.Fprintf(w, "Peer Features: %s\n", strings.Join(tun.Peer.Features, ", "))
+		}
+		for _, warning := range tun.InteropWarnings() {
+			fmt.Fprintf(w, "Interop Warning: %s\n", warning)
+		}
+	}
+	fmt.Fprintf(w, "Created: %s\n", tun.CreatedAt)
+	fmt.Fprintf(w, "Last Modified: %s\n", tun.UpdatedAt)
+	return nil
+}
 
-			logger.Info("Found %d configured tunnels", len(tunnels))
-			fmt.Println("Configured tunnels:")
-			for _, t := range tunnels {
-				fmt.Printf("- %s: %s <-> %s (%s)\n", t.Name, t.LocalIP, t.RemoteIP, t.Status)
+// showTunnelsJSON writes the tunnels matching selector as a JSON array, or the
+// named tunnel as a JSON object, to w
+func showTunnelsJSON(w io.Writer, args []string, selector tunnel.Selector) error {
+	if len(args) == 0 {
+		tunnels, err := tunnel.ListAll()
+		if err != nil {
+			return fail("Error listing tunnels: %v", err)
+		}
+		tunnels = slices.DeleteFunc(tunnels, func(t *tunnel.Tunnel) bool { return !selector.Matches(t.Labels) })
+		if tunnels == nil {
+			tunnels = []*tunnel.Tunnel{}
+		}
+		return writeJSON(w, tunnels)
+	}
+
+	tun, err := tunnel.Get(args[0])
+	if err != nil {
+		return fail("Error getting tunnel '%s': %v", args[0], err)
+	}
+	return writeJSON(w, tun)
+}
+
+var tunnelStatusCmd = &cobra.Command{
+	Use:   "status [name]",
+	Short: "Print tunnel status and exit with a status code",
+	Long: `Print the status of a tunnel, or of every tunnel, and exit with:
+  0 if the tunnel is up
+  1 if it is down
+  2 if it is in error or its status cannot be determined
+  3 if it is not found
+
+Without a name the worst status of all tunnels is used, and 3 means no tunnels
+are configured. Use --quiet in scripts to only set the exit code.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		quiet, _ := cmd.Flags().GetBool("quiet")
+
+		var tunnels []*tunnel.Tunnel
+		if len(args) == 1 {
+			tun, err := tunnel.Get(args[0])
+			if errors.Is(err, tunnel.ErrNotFound) {
+				logger.Debug("Tunnel '%s' not found", args[0])
+				if !quiet {
+					fmt.Printf("Tunnel '%s' not found\n", args[0])
+				}
+				return &ExitError{Code: exitNotFound}
+			}
+			if err != nil {
+				logger.Error("Error getting tunnel '%s': %v", args[0], err)
+				if !quiet {
+					fmt.Printf("Error getting tunnel '%s': %v\n", args[0], err)
+				}
+				return &ExitError{Code: exitError}
 			}
+			tunnels = append(tunnels, tun)
 		} else {
-			// Show specific tunnel
-			name := args[0]
-			logger.Debug("Retrieving details for tunnel '%s'", name)
-			tun, err := tunnel.Get(name)
+			var err error
+			tunnels, err = tunnel.ListAll()
 			if err != nil {
-				logger.Error("Error getting tunnel '%s': %v", name, err)
-				fmt.Printf("Error getting tunnel '%s': %v\n", name, err)
-				return
+				logger.Error("Error listing tunnels: %v", err)
+				if !quiet {
+					fmt.Printf("Error listing tunnels: %v\n", err)
+				}
+				return &ExitError{Code: exitError}
 			}
+			if len(tunnels) == 0 {
+				if !quiet {
+					fmt.Println("No tunnels configured")
+				}
+				return &ExitError{Code: exitNotFound}
+			}
+		}
 
-			logger.Info("Displaying details for tunnel '%s'", tun.Name)
-			fmt.Printf("Tunnel: %s\n", tun.Name)
-			fmt.Printf("Status: %s\n", tun.Status)
-			fmt.Printf("Local IP: %s\n", tun.LocalIP)
-			fmt.Printf("Remote IP: %s\n", tun.RemoteIP)
-			fmt.Printf("Local Subnet: %s\n", tun.LocalSubnet)
-			fmt.Printf("Remote Subnet: %s\n", tun.RemoteSubnet)
-			fmt.Printf("Encryption: %s\n", tun.Encryption)
-			fmt.Printf("Post-Quantum: %v\n", tun.PostQuantum)
-			fmt.Printf("Created: %s\n", tun.CreatedAt)
-			fmt.Printf("Last Modified: %s\n", tun.UpdatedAt)
+		code := exitUp
+		for _, t := range tunnels {
+			if !quiet {
+				line := fmt.Sprintf("%s: %s", t.Name, t.Status)
+				if t.Reason != "" {
+					line += fmt.Sprintf(" (%s)", t.Reason)
+				}
+				if state, err := tunnel.Sync(t.Name); err == nil && state.BackingOff(time.Now()) {
+					line += fmt.Sprintf(", next retry at %s", state.NextRetry.Format(time.DateTime))
+				}
+				fmt.Println(line)
+			}
+			if c := statusExitCode(t.Status); c > code {
+				code = c
+			}
+		}
+		if code != exitUp {
+			return &ExitError{Code: code}
 		}
+		return nil
 	},
 }
 
+// statusExitCode maps a tunnel status to the exit code of tunnel status
+func statusExitCode(status tunnel.Status) int {
+	switch status {
+	case tunnel.StatusUp:
+		return exitUp
+	case tunnel.StatusDown:
+		return exitDown
+	default:
+		return exitError
+	}
+}
+
 var tunnelDeleteCmd = &cobra.Command{
 	Use:   "delete [name]",
 	Short: "Delete an IPsec tunnel",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		name := args[0]
 		force, _ := cmd.Flags().GetBool("force")
 
+		if !confirm(cmd, "delete", tunnelResources(name)) {
+			return errFailed
+		}
+		if err := approved(cmd, fmt.Sprintf("delete tunnel '%s'", name)); err != nil {
+			return err
+		}
+
 		logger.Info("Deleting tunnel '%s' (force: %t)", name, force)
 		err := tunnel.Delete(name, force)
 		if err != nil {
-			logger.Error("Error deleting tunnel '%s': %v", name, err)
-			fmt.Printf("Error deleting tunnel '%s': %v\n", name, err)
-			return
+			return fail("Error deleting tunnel '%s': %v", name, err)
 		}
 
 		logger.Info("Tunnel '%s' deleted successfully", name)
 		fmt.Printf("Tunnel '%s' deleted successfully\n", name)
+		return nil
 	},
 }
 
-var tunnelStartCmd = &cobra.Command{
-	Use:   "start [name]",
-	Short: "Start an IPsec tunnel",
+// tunnelResources describes a tunnel and the interface, routes and advertised
+// networks that go away with it
+func tunnelResources(name string) []string {
+	resources := []string{fmt.Sprintf("tunnel '%s'", name)}
+	if tun, err := tunnel.Get(name); err == nil {
+		resources[0] = fmt.Sprintf("tunnel '%s' (%s, %s -> %s)", name, tun.Status, tun.LocalIP, tun.RemoteIP)
+		if tun.KillSwitchEnabled() {
+			resources = append(resources, fmt.Sprintf("kill-switch block route for %s", tun.RemoteSubnet))
+		}
+		if len(tun.Policy) > 0 {
+			resources = append(resources, fmt.Sprintf("traffic policy XFRM rules (%s)", policySummary(tun.Policy)))
+		}
+		if tun.Inspection != nil {
+			resources = append(resources, fmt.Sprintf("inspection of its traffic %s", tun.Inspection))
+		}
+		if len(tun.AppRoutes) > 0 {
+			resources = append(resources, fmt.Sprintf("routes of the traffic of %s through it", appRouteSummary(tun.AppRoutes)))
+		}
+		if len(tun.MulticastRoutes) > 0 {
+			resources = append(resources, fmt.Sprintf("smcroute forwarding of the multicast groups %s", multicastRouteSummary(tun.MulticastRoutes)))
+		}
+		if tun.PacketAccounting {
+			resources = append(resources, "eBPF packet accounting and its counters")
+		}
+		if tun.DefaultRoute {
+			resources = append(resources, "routes sending all traffic through it")
+		}
+		if tun.OwnsNamespace() {
+			resources = append(resources, fmt.Sprintf("network namespace %s and everything in it", tun.Namespace))
+		}
+	}
+
+	iface := tunnel.InterfaceName(name)
+	if tun, err := tunnel.Get(name); err == nil {
+		iface = tun.Interface()
+	}
+	if ifaces, err := network.ListInterfaces(); err == nil {
+		for _, i := range ifaces {
+			if i.Name == iface {
+				resources = append(resources, fmt.Sprintf("interface %s", iface))
+			}
+		}
+	}
+	if routes, err := network.ListRoutes(); err == nil {
+		for _, r := range routes {
+			if r.Interface == iface {
+				resources = append(resources, fmt.Sprintf("route to %s via %s", r.Destination, iface))
+			}
+		}
+	}
+	if advertised, err := network.ListAdvertisedNetworks(); err == nil {
+		for _, n := range advertised {
+			if n.AdvertisedVia == name {
+				resources = append(resources, fmt.Sprintf("advertisement of %s", n.CIDR))
+			}
+		}
+	}
+	return resources
+}
+
+var tunnelExportPeerCmd = &cobra.Command{
+	Use:   "export-peer [name]",
+	Short: "Print the configuration a firewall needs to be the peer of a tunnel",
+	Long: `Print the configuration an OPNsense, pfSense, MikroTik RouterOS or Cisco IOS/ASA device
+needs to terminate the other end of a tunnel: phase 1 and phase 2 entries as XML for the
+<ipsec> section of an OPNsense or pfSense config.xml, the /ip ipsec profile, peer, proposal,
+identity and policy commands for RouterOS, or a crypto map entry with its ACL, proposals and
+keyring or tunnel-group for Cisco. Local and remote are swapped, and the proposals, lifetimes
+and DPD settings are taken from the configuration file. Pre-shared keys are not exported.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		ikeID, _ := cmd.Flags().GetInt("ikeid")
+
+		data, err := tunnel.ExportPeer(args[0], format, ikeID)
+		if err != nil {
+			return fail("Error exporting tunnel '%s': %v", args[0], err)
+		}
+		os.Stdout.Write(data)
+		return nil
+	},
+}
+
+var tunnelKillSwitchCmd = &cobra.Command{
+	Use:   "kill-switch",
+	Short: "Drop traffic to a tunnel's remote subnet while it is down",
+	Long: `With the kill-switch on, traffic to the remote subnet of a tunnel is dropped whenever
+the tunnel is down instead of leaking out through the default route. It can also be
+turned on for every tunnel with security.kill_switch in the configuration file.`,
+}
+
+var tunnelKillSwitchEnableCmd = &cobra.Command{
+	Use:   "enable [name]",
+	Short: "Turn on the kill-switch of a tunnel",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		name := args[0]
-		logger.Info("Starting tunnel '%s'", name)
-		err := tunnel.Start(name)
+		tun, err := tunnel.Get(name)
 		if err != nil {
-			logger.Error("Error starting tunnel '%s': %v", name, err)
-			fmt.Printf("Error starting tunnel '%s': %v\n", name, err)
-			return
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+		if err := setTunnelKillSwitch(name, true); err != nil || tun.KillSwitch {
+			return err
 		}
+		return armConfirm(cmd, fmt.Sprintf("the kill-switch of tunnel '%s'", name), "tunnel", "kill-switch", "disable", name)
+	},
+}
 
-		logger.Info("Tunnel '%s' started successfully", name)
-		fmt.Printf("Tunnel '%s' started successfully\n", name)
+var tunnelKillSwitchDisableCmd = &cobra.Command{
+	Use:   "disable [name]",
+	Short: "Turn off the kill-switch of a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setTunnelKillSwitch(args[0], false)
 	},
 }
 
-var tunnelStopCmd = &cobra.Command{
-	Use:   "stop [name]",
-	Short: "Stop an IPsec tunnel",
+// setTunnelKillSwitch turns the kill-switch of a tunnel on or off
+func setTunnelKillSwitch(name string, enabled bool) error {
+	if err := tunnel.SetKillSwitch(name, enabled); err != nil {
+		return fail("Error setting kill-switch for tunnel '%s': %v", name, err)
+	}
+
+	state := "off"
+	if enabled {
+		state = "on"
+	}
+	logger.Info("Kill-switch %s for tunnel '%s'", state, name)
+	fmt.Printf("Kill-switch %s for tunnel '%s'\n", state, name)
+	return nil
+}
+
+var tunnelDefaultRouteCmd = &cobra.Command{
+	Use:   "default-route",
+	Short: "Send all traffic through a tunnel",
+	Long: `With the default route on, all traffic goes through the tunnel while it is up:
+0.0.0.0/1 and 128.0.0.0/1 (::/1 and 8000::/1 for IPv6 subnets) are routed through
+the tunnel interface, the route to the peer is pinned to the path it had before,
+and with --dns name resolution goes to the given servers, through systemd-resolved
+or by rewriting /etc/resolv.conf. The existing default route is left alone, so
+removing the two halves hands traffic straight back to it.
+
+Everything is rolled back when the tunnel is stopped or its status leaves UP.
+Run "ipsec-vpn tunnel default-route guard" under a service manager to also roll
+back as soon as the tunnel interface goes down, and whenever the guard exits.
+Only one tunnel at a time can carry all traffic.`,
+}
+
+var tunnelDefaultRouteEnableCmd = &cobra.Command{
+	Use:   "enable [name]",
+	Short: "Send all traffic through a tunnel while it is up",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		name := args[0]
-		logger.Info("Stopping tunnel '%s'", name)
-		err := tunnel.Stop(name)
+		dns, _ := cmd.Flags().GetStringSlice("dns")
+		tun, err := tunnel.Get(name)
 		if err != nil {
-			logger.Error("Error stopping tunnel '%s': %v", name, err)
-			fmt.Printf("Error stopping tunnel '%s': %v\n", name, err)
-			return
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+		if err := tunnel.SetDefaultRoute(name, true, dns); err != nil {
+			return fail("Error setting default route through tunnel '%s': %v", name, err)
 		}
 
-		logger.Info("Tunnel '%s' stopped successfully", name)
-		fmt.Printf("Tunnel '%s' stopped successfully\n", name)
+		logger.Info("All traffic goes through tunnel '%s' while it is up", name)
+		fmt.Printf("All traffic goes through tunnel '%s' while it is up\n", name)
+		if tun.DefaultRoute {
+			return nil
+		}
+		return armConfirm(cmd, fmt.Sprintf("the default route through tunnel '%s'", name), "tunnel", "default-route", "disable", name)
 	},
 }
 
-func init() {
-	// Add subcommands to tunnel command
-	tunnelCmd.AddCommand(tunnelCreateCmd)
-	tunnelCmd.AddCommand(tunnelShowCmd)
-	tunnelCmd.AddCommand(tunnelDeleteCmd)
-	tunnelCmd.AddCommand(tunnelStartCmd)
-	tunnelCmd.AddCommand(tunnelStopCmd)
+var tunnelDefaultRouteDisableCmd = &cobra.Command{
+	Use:   "disable [name]",
+	Short: "Stop sending all traffic through a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if err := tunnel.SetDefaultRoute(name, false, nil); err != nil {
+			return fail("Error removing default route through tunnel '%s': %v", name, err)
+		}
 
-	// Flags for create command
-	tunnelCreateCmd.Flags().String("local-ip", "", "Local IP address for the tunnel")
-	tunnelCreateCmd.Flags().String("remote-ip", "", "Remote IP address for the tunnel")
-	tunnelCreateCmd.Flags().String("local-subnet", "", "Local subnet to be tunneled (CIDR notation)")
-	tunnelCreateCmd.Flags().String("remote-subnet", "", "Remote subnet to be tunneled (CIDR notation)")
-	tunnelCreateCmd.Flags().String("encryption", "aes256gcm", "Encryption algorithm (aes256gcm, chacha20poly1305)")
-	tunnelCreateCmd.Flags().Bool("post-quantum", false, "Enable post-quantum cryptography")
+		logger.Info("Tunnel '%s' only carries traffic to its remote subnet", name)
+		fmt.Printf("Tunnel '%s' only carries traffic to its remote subnet\n", name)
+		return nil
+	},
+}
 
-	// Mark required flags
-	tunnelCreateCmd.MarkFlagRequired("local-ip")
-	tunnelCreateCmd.MarkFlagRequired("remote-ip")
-	tunnelCreateCmd.MarkFlagRequired("local-subnet")
-	tunnelCreateCmd.MarkFlagRequired("remote-subnet")
+var tunnelDefaultRouteGuardCmd = &cobra.Command{
+	Use:   "guard [name]",
+	Short: "Roll back the default route as soon as a tunnel drops, in the foreground",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		interval, _ := cmd.Flags().GetInt("interval")
+		if interval <= 0 {
+			return fail("Error: the interval must be a positive number of seconds")
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		stop := make(chan struct{})
+		go func() {
+			<-sigs
+			close(stop)
+		}()
+
+		logger.Info("Guarding the default route through tunnel '%s' every %d seconds", name, interval)
+		if err := tunnel.GuardDefaultRoute(name, time.Duration(interval)*time.Second, stop); err != nil {
+			return fail("Error guarding default route through tunnel '%s': %v", name, err)
+		}
+		return nil
+	},
+}
+
+var tunnelPinCmd = &cobra.Command{
+	Use:   "pin",
+	Short: "Pin the key a tunnel's peer must present",
+	Long: `Pin the public key a tunnel's peer must authenticate with, by its SHA-256
+fingerprint. A peer presenting any other key is refused and the tunnel goes into
+the ERROR state. With trust-on-first-use, the key of the first peer to
+authenticate is pinned.`,
+}
+
+var tunnelPinSetCmd = &cobra.Command{
+	Use:   "set [name] [fingerprint|certificate]",
+	Short: "Pin a key fingerprint, or the key of a certificate file",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		fingerprint, err := peerFingerprint(args[1])
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		if err := tunnel.PinPeer(name, fingerprint); err != nil {
+			return fail("Error pinning peer key for tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' peer key pinned to %s", name, fingerprint)
+		fmt.Printf("Tunnel '%s' peer key pinned to %s\n", name, fingerprint)
+		return nil
+	},
+}
+
+var tunnelPinTOFUCmd = &cobra.Command{
+	Use:   "tofu [name]",
+	Short: "Pin the key of the first peer to authenticate",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		disable, _ := cmd.Flags().GetBool("disable")
+		if err := tunnel.SetTOFU(name, !disable); err != nil {
+			return fail("Error setting trust-on-first-use for tunnel '%s': %v", name, err)
+		}
+
+		state := "on"
+		if disable {
+			state = "off"
+		}
+		logger.Info("Trust-on-first-use %s for tunnel '%s'", state, name)
+		fmt.Printf("Trust-on-first-use %s for tunnel '%s'\n", state, name)
+		return nil
+	},
+}
+
+var tunnelPinClearCmd = &cobra.Command{
+	Use:   "clear [name]",
+	Short: "Remove the pin, e.g. after the peer's key was replaced",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if err := tunnel.ClearPin(name); err != nil {
+			return fail("Error clearing peer pin for tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Peer pin of tunnel '%s' cleared", name)
+		fmt.Printf("Peer pin of tunnel '%s' cleared\n", name)
+		return nil
+	},
+}
+
+// peerFingerprint reads a key fingerprint, or fingerprints the key in a certificate file
+func peerFingerprint(arg string) (string, error) {
+	data, err := os.ReadFile(arg)
+	if err != nil {
+		return tunnel.ParseFingerprint(arg)
+	}
+	fingerprint, err := tunnel.CertificateFingerprint(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to read certificate %s: %v", arg, err)
+	}
+	return fingerprint, nil
+}
+
+var tunnelAcceptCmd = &cobra.Command{
+	Use:   "accept [responder]",
+	Short: "Bring up the instance of an initiator that authenticated to a responder",
+	Long: `Accept an initiator that authenticated to a responder, a tunnel created with
+--remote-ip %any, and bring up its instance: a tunnel named after the responder
+with the initiator's address and subnet. The initiator's identity must match the
+responder's --peer-id, its certificate be issued by its --peer-ca, and the
+login policies of its identity allow it ('client policy'). This is run by the
+IKE daemon, e.g. from its updown script, when an initiator connects.
+
+A responder with a virtual IP pool or static map assigns the initiator its
+virtual IP, the same one each time it connects, and routes it through the
+instance. Without --subnet, the virtual IP is the initiator's subnet.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		peer := tunnel.Initiator{}
+		peer.ID, _ = cmd.Flags().GetString("id")
+		peer.Address, _ = cmd.Flags().GetString("address")
+		peer.Subnet, _ = cmd.Flags().GetString("subnet")
+		if file, _ := cmd.Flags().GetString("cert"); file != "" {
+			chain, err := readCertificates(file)
+			if err != nil {
+				return fail("Error: %v", err)
+			}
+			peer.Chain = chain
+		}
+
+		tun, err := tunnel.AcceptPeer(args[0], peer)
+		if err != nil {
+			return fail("Error accepting peer of responder '%s': %v", args[0], err)
+		}
+		logger.Info("Responder '%s' accepted %s from %s as tunnel '%s'", args[0], tun.PeerIdentity, tun.RemoteIP, tun.Name)
+		fmt.Printf("Tunnel '%s' is up for %s from %s\n", tun.Name, tun.PeerIdentity, tun.RemoteIP)
+		if tun.VirtualIP != "" {
+			fmt.Printf("Virtual IP: %s\n", tun.VirtualIP)
+		}
+		return nil
+	},
+}
+
+var tunnelReleaseCmd = &cobra.Command{
+	Use:   "release [name]",
+	Short: "Delete the instance of an initiator that disconnected",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := tunnel.ReleasePeer(args[0]); err != nil {
+			return fail("Error releasing tunnel '%s': %v", args[0], err)
+		}
+		logger.Info("Tunnel '%s' released", args[0])
+		fmt.Printf("Tunnel '%s' released\n", args[0])
+		return nil
+	},
+}
+
+var tunnelVirtualIPCmd = &cobra.Command{
+	Use:   "virtual-ip [responder]",
+	Short: "Show the virtual IPs a responder assigns its initiators",
+	Long: `A responder assigns each initiator it accepts a virtual IP, or subnet, mapped
+to its identity statically or else leased from the responder's pool, and routes
+it through the initiator's instance. A lease is kept when the initiator
+disconnects, so it gets the same virtual IP each time it connects.
+
+Shows the virtual IPs mapped and leased, and the instances of the initiators
+connected.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ips, err := tunnel.VirtualIPs(args[0])
+		if err != nil {
+			return fail("Error listing virtual IPs of responder '%s': %v", args[0], err)
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, ips)
+		}
+		if len(ips) == 0 {
+			fmt.Printf("Responder '%s' has assigned no virtual IPs\n", args[0])
+			return nil
+		}
+		tbl := table.New(
+			table.Column{Header: "IDENTITY", MaxWidth: 40},
+			table.Column{Header: "VIRTUAL IP"},
+			table.Column{Header: "ASSIGNED"},
+			table.Column{Header: "INSTANCE"},
+		)
+		for _, ip := range ips {
+			assigned := "leased"
+			if ip.Static {
+				assigned = "static"
+			}
+			tbl.AddRow(ip.Identity, ip.Address, assigned, orDash(ip.Instance))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var tunnelVirtualIPSetCmd = &cobra.Command{
+	Use:   "set [responder] [identity] [address]",
+	Short: "Map an initiator's identity to a virtual IP or subnet",
+	Long: `Map an initiator's identity to a virtual IP, or subnet, which it is assigned
+rather than one from the pool. An initiator that is connected gets it when it
+next connects.`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := tunnel.SetVirtualIP(args[0], args[1], args[2]); err != nil {
+			return fail("Error mapping virtual IP of %s: %v", args[1], err)
+		}
+		logger.Info("Responder '%s' maps %s to %s", args[0], args[1], args[2])
+		fmt.Printf("Responder '%s' assigns %s to %s\n", args[0], args[2], args[1])
+		return nil
+	},
+}
+
+var tunnelVirtualIPClearCmd = &cobra.Command{
+	Use:   "clear [responder] [identity]",
+	Short: "Remove the virtual IP mapped or leased to an initiator's identity",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := tunnel.ClearVirtualIP(args[0], args[1]); err != nil {
+			return fail("Error clearing virtual IP of %s: %v", args[1], err)
+		}
+		logger.Info("Responder '%s' cleared the virtual IP of %s", args[0], args[1])
+		fmt.Printf("Virtual IP of %s cleared\n", args[1])
+		return nil
+	},
+}
+
+var tunnelVirtualIPPoolCmd = &cobra.Command{
+	Use:   "pool [responder] [subnet]",
+	Short: "Set the pool a responder leases virtual IPs from",
+	Long: `Set the subnet a responder leases virtual IPs from, or without a subnet stop
+leasing them. Initiators whose lease falls outside a new pool are leased
+another when they next connect.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pool := ""
+		if len(args) == 2 {
+			pool = args[1]
+		}
+		if err := tunnel.SetVirtualIPPool(args[0], pool); err != nil {
+			return fail("Error setting virtual IP pool of responder '%s': %v", args[0], err)
+		}
+		logger.Info("Responder '%s' virtual IP pool set to %s", args[0], orDash(pool))
+		if pool == "" {
+			fmt.Printf("Responder '%s' leases no virtual IPs\n", args[0])
+		} else {
+			fmt.Printf("Responder '%s' leases virtual IPs from %s\n", args[0], pool)
+		}
+		return nil
+	},
+}
+
+var tunnelShortcutCmd = &cobra.Command{
+	Use:   "shortcut",
+	Short: "Broker and take direct tunnels between the spokes of a hub",
+	Long: `Spokes of a hub that exchange traffic through it can be offered a shortcut, a
+direct tunnel between them, in the manner of DMVPN and ADVPN, so that the hub
+leaves the data path between them. The hub, a responder with --shortcuts, finds
+the spokes exchanging traffic with 'shortcut scan --offer' and publishes an
+offer to each in a tunnel.shortcut.offered event, which the IKE daemon delivers
+to the spoke. The spoke takes it with 'shortcut add' and lets it go with
+'shortcut prune' once idle; traffic to the other spoke then goes through the
+hub again.`,
+}
+
+var tunnelShortcutEnableCmd = &cobra.Command{
+	Use:   "enable [responder]",
+	Short: "Broker shortcuts between the spokes of a responder",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := tunnel.SetShortcuts(args[0], true); err != nil {
+			return fail("Error enabling shortcuts of responder '%s': %v", args[0], err)
+		}
+		logger.Info("Responder '%s' brokers shortcuts", args[0])
+		fmt.Printf("Responder '%s' brokers shortcuts between its spokes\n", args[0])
+		return nil
+	},
+}
+
+var tunnelShortcutDisableCmd = &cobra.Command{
+	Use:   "disable [responder]",
+	Short: "Stop brokering shortcuts between the spokes of a responder",
+	Long: `Stop brokering shortcuts between the spokes of a responder. Shortcuts spokes
+have taken stay up until they prune them.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := tunnel.SetShortcuts(args[0], false); err != nil {
+			return fail("Error disabling shortcuts of responder '%s': %v", args[0], err)
+		}
+		logger.Info("Responder '%s' brokers no shortcuts", args[0])
+		fmt.Printf("Responder '%s' brokers no shortcuts\n", args[0])
+		return nil
+	},
+}
+
+var tunnelShortcutScanCmd = &cobra.Command{
+	Use:   "scan [responder]",
+	Short: "Find the spokes of a responder exchanging traffic through it",
+	Long: `Find the pairs of spokes of a responder that have exchanged at least
+--min-bytes through it, in the flows conntrack tracks, busiest first. With
+--offer, offer each spoke of a pair a shortcut to the other; run it from cron
+or a timer to keep offering shortcuts as traffic starts.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		minBytes, _ := cmd.Flags().GetUint64("min-bytes")
+		offer, _ := cmd.Flags().GetBool("offer")
+		shortcuts, err := tunnel.FindShortcuts(args[0], minBytes, offer)
+		if err != nil {
+			return fail("Error scanning responder '%s' for shortcuts: %v", args[0], err)
+		}
+		if offer && len(shortcuts) > 0 {
+			logger.Info("Responder '%s' offered %d shortcuts", args[0], len(shortcuts))
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, shortcuts)
+		}
+		if len(shortcuts) == 0 {
+			fmt.Printf("No spokes of responder '%s' exchange %d bytes through it\n", args[0], minBytes)
+			return nil
+		}
+		tbl := table.New(
+			table.Column{Header: "SPOKE", MaxWidth: 40},
+			table.Column{Header: "SUBNET"},
+			table.Column{Header: "PEER", MaxWidth: 40},
+			table.Column{Header: "PEER SUBNET"},
+			table.Column{Header: "FLOWS"},
+			table.Column{Header: "BYTES"},
+		)
+		for _, s := range shortcuts {
+			tbl.AddRow(s.Peers[0].ID, s.Peers[0].Subnet, s.Peers[1].ID, s.Peers[1].Subnet, fmt.Sprint(s.Flows), formatBytes(s.Bytes))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var tunnelShortcutAddCmd = &cobra.Command{
+	Use:   "add [via]",
+	Short: "Take a shortcut a hub offered to another of its spokes",
+	Long: `Connect directly to another spoke of the hub reached through a tunnel, via, as
+the hub offered in a tunnel.shortcut.offered event. The shortcut is a tunnel
+named after via with the other spoke's address and subnet and via's other
+options. The subnet must lie within via's remote subnet, and be narrower, so
+that traffic to the other spoke takes the shortcut and the rest still goes
+through the hub. This is run by the IKE daemon when the hub's offer arrives.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		peer := tunnel.ShortcutPeer{}
+		peer.ID, _ = cmd.Flags().GetString("id")
+		peer.Address, _ = cmd.Flags().GetString("address")
+		peer.Subnet, _ = cmd.Flags().GetString("subnet")
+		tun, err := tunnel.AddShortcut(args[0], peer)
+		if err != nil {
+			return fail("Error taking shortcut via '%s': %v", args[0], err)
+		}
+		logger.Info("Took shortcut via '%s' to %s at %s as tunnel '%s'", args[0], peer.ID, peer.Address, tun.Name)
+		fmt.Printf("Tunnel '%s' is up to %s at %s, carrying %s\n", tun.Name, tun.PeerIdentity, tun.RemoteIP, tun.RemoteSubnet)
+		return nil
+	},
+}
+
+var tunnelShortcutListCmd = &cobra.Command{
+	Use:   "list [via]",
+	Short: "List the shortcuts taken that bypass a tunnel's hub",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		shortcuts, err := tunnel.ShortcutsVia(args[0])
+		if err != nil {
+			return fail("Error listing shortcuts via '%s': %v", args[0], err)
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, shortcuts)
+		}
+		if len(shortcuts) == 0 {
+			fmt.Printf("No shortcuts bypass tunnel '%s'\n", args[0])
+			return nil
+		}
+		tbl := table.New(
+			table.Column{Header: "NAME"},
+			table.Column{Header: "PEER", MaxWidth: 40},
+			table.Column{Header: "ADDRESS"},
+			table.Column{Header: "SUBNET"},
+			table.Column{Header: "STATUS", Status: true},
+		)
+		for _, s := range shortcuts {
+			tbl.AddRow(s.Name, s.PeerIdentity, s.RemoteIP, s.RemoteSubnet, string(s.Status))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var tunnelShortcutRemoveCmd = &cobra.Command{
+	Use:   "remove [name]",
+	Short: "Delete a shortcut, sending traffic through the hub again",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := tunnel.RemoveShortcut(args[0]); err != nil {
+			return fail("Error removing shortcut '%s': %v", args[0], err)
+		}
+		logger.Info("Shortcut '%s' removed", args[0])
+		fmt.Printf("Shortcut '%s' removed\n", args[0])
+		return nil
+	},
+}
+
+var tunnelShortcutPruneCmd = &cobra.Command{
+	Use:   "prune [via]",
+	Short: "Delete the shortcuts bypassing a tunnel's hub that carry no traffic",
+	Long: `Delete the shortcuts bypassing a tunnel's hub that carry no flows conntrack
+still tracks, so that idle ones do not linger; run it from cron or a timer.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pruned, err := tunnel.PruneShortcuts(args[0])
+		for _, name := range pruned {
+			logger.Info("Shortcut '%s' pruned", name)
+			fmt.Printf("Shortcut '%s' removed\n", name)
+		}
+		if err != nil {
+			return fail("Error pruning shortcuts via '%s': %v", args[0], err)
+		}
+		if len(pruned) == 0 {
+			fmt.Printf("No idle shortcuts bypass tunnel '%s'\n", args[0])
+		}
+		return nil
+	},
+}
+
+// readCertificates reads a PEM certificate chain, leaf first
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var chain []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in %s: %v", file, err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return chain, nil
+}
+
+var tunnelRateLimitCmd = &cobra.Command{
+	Use:   "rate-limit",
+	Short: "Limit the bandwidth of a tunnel's peer",
+	Long: `Limit the bandwidth of a tunnel's peer with a token bucket on the tunnel interface.
+The rate applies in each direction: egress is shaped and ingress beyond the rate is
+dropped. Rates use tc notation, e.g. 10mbit, 512kbit or 2mbps (bytes per second).`,
+}
+
+var tunnelRateLimitSetCmd = &cobra.Command{
+	Use:   "set [name] [rate]",
+	Short: "Set the bandwidth limit of a tunnel",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		rate, err := network.ParseRate(args[1])
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+		if err := tunnel.SetRateLimit(name, rate); err != nil {
+			return fail("Error setting rate limit for tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' limited to %s", name, network.FormatRate(rate))
+		fmt.Printf("Tunnel '%s' limited to %s each way\n", name, network.FormatRate(rate))
+		return nil
+	},
+}
+
+var tunnelRateLimitClearCmd = &cobra.Command{
+	Use:   "clear [name]",
+	Short: "Remove the bandwidth limit of a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if err := tunnel.SetRateLimit(name, 0); err != nil {
+			return fail("Error removing rate limit for tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Rate limit of tunnel '%s' removed", name)
+		fmt.Printf("Rate limit of tunnel '%s' removed\n", name)
+		return nil
+	},
+}
+
+var tunnelTuneCmd = &cobra.Command{
+	Use:   "tune",
+	Short: "Tune the MTU and offloads of a tunnel for throughput",
+	Long: `The default settings leave much of the throughput of fast links unused. A tuning
+sets offload features, such as GSO, GRO and TSO, of the tunnel interface and of
+the underlay interface carrying its traffic to the peer, and their MTUs. On an
+underlay with jumbo frames, an MTU of 'auto' sizes tunnel packets to fill them
+without fragmenting. A tuning is applied whenever the tunnel starts.`,
+}
+
+var tunnelTuneShowCmd = &cobra.Command{
+	Use:   "show [name]",
+	Short: "Show the MTUs and offloads of a tunnel and its underlay, and its tuning",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		tun, err := tunnel.Get(name)
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+		state, err := tunnel.GetTuningState(name)
+		if err != nil {
+			return fail("Error reading the interfaces of tunnel '%s': %v", name, err)
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, struct {
+				*tunnel.TuningState
+				Tuning *tunnel.Tuning `json:"tuning,omitempty"`
+			}{state, tun.Tuning})
+		}
+
+		features := slices.Sorted(maps.Keys(network.OffloadFeatures))
+		columns := []table.Column{{Header: "INTERFACE"}, {Header: "ROLE"}, {Header: "MTU"}}
+		for _, f := range features {
+			columns = append(columns, table.Column{Header: strings.ToUpper(f)})
+		}
+		tbl := table.New(columns...)
+		for _, row := range []struct {
+			iface, role string
+			mtu         int
+			offloads    map[string]network.Offload
+		}{
+			{state.Interface, "tunnel", state.MTU, state.Offloads},
+			{state.Underlay, "underlay", state.UnderlayMTU, state.UnderlayOffloads},
+		} {
+			cells := []string{row.iface, row.role, fmt.Sprint(row.mtu)}
+			for _, f := range features {
+				cells = append(cells, formatOffloadState(row.offloads, f))
+			}
+			tbl.AddRow(cells...)
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+
+		fmt.Printf("\nMTU fitting the underlay: %d (%d bytes of overhead)\n", state.FitMTU, state.UnderlayMTU-state.FitMTU)
+		if tun.Tuning != nil {
+			fmt.Printf("Tuning: %s\n", tun.Tuning)
+		} else {
+			fmt.Println("Tuning: none")
+		}
+		return nil
+	},
+}
+
+// formatOffloadState formats the state of an offload feature of an interface
+func formatOffloadState(offloads map[string]network.Offload, feature string) string {
+	o, ok := offloads[feature]
+	switch {
+	case !ok:
+		return "-"
+	case o.On && o.Fixed:
+		return "on [fixed]"
+	case o.On:
+		return "on"
+	case o.Fixed:
+		return "off [fixed]"
+	default:
+		return "off"
+	}
+}
+
+var tunnelTuneSetCmd = &cobra.Command{
+	Use:   "set [name]",
+	Short: "Change the tuning of a tunnel",
+	Long: `Change the settings given of the tuning of a tunnel, keeping the others. A tunnel
+that is up is tuned straight away. Offloads are given as name=on or name=off,
+such as --offload gso=on,gro=on.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		tun, err := tunnel.Get(name)
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+		tuning := &tunnel.Tuning{}
+		if tun.Tuning != nil {
+			tuning = tun.Tuning
+		}
+
+		flags := cmd.Flags()
+		if flags.Changed("mtu") {
+			mtu, _ := flags.GetString("mtu")
+			if mtu == "auto" {
+				tuning.MTU = tunnel.AutoMTU
+			} else if tuning.MTU, err = strconv.Atoi(mtu); err != nil {
+				return fail("Error: invalid MTU %q, expected a number of bytes or auto", mtu)
+			}
+		}
+		if flags.Changed("underlay-mtu") {
+			tuning.UnderlayMTU, _ = flags.GetInt("underlay-mtu")
+		}
+		offloads, _ := flags.GetStringSlice("offload")
+		if tuning.Offloads, err = mergeOffloads(tuning.Offloads, offloads); err != nil {
+			return fail("Error: %v", err)
+		}
+		offloads, _ = flags.GetStringSlice("underlay-offload")
+		if tuning.UnderlayOffloads, err = mergeOffloads(tuning.UnderlayOffloads, offloads); err != nil {
+			return fail("Error: %v", err)
+		}
+
+		if err := tunnel.SetTuning(name, tuning); err != nil {
+			return fail("Error tuning tunnel '%s': %v", name, err)
+		}
+		logger.Info("Tunnel '%s' tuned: %s", name, tuning)
+		fmt.Printf("Tunnel '%s' tuned: %s\n", name, tuning)
+		return nil
+	},
+}
+
+// mergeOffloads adds offload settings such as gro=on to those of a tuning
+func mergeOffloads(offloads map[string]bool, settings []string) (map[string]bool, error) {
+	for _, s := range settings {
+		feature, on, err := tunnel.ParseOffload(s)
+		if err != nil {
+			return nil, err
+		}
+		if offloads == nil {
+			offloads = make(map[string]bool)
+		}
+		offloads[feature] = on
+	}
+	return offloads, nil
+}
+
+var tunnelTuneClearCmd = &cobra.Command{
+	Use:   "clear [name]",
+	Short: "Remove the tuning of a tunnel",
+	Long: `Remove the tuning of a tunnel. Its interfaces keep the MTUs and offloads the
+tuning set until they are changed or the tunnel interface is created again.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if err := tunnel.SetTuning(name, nil); err != nil {
+			return fail("Error removing the tuning of tunnel '%s': %v", name, err)
+		}
+		logger.Info("Tuning of tunnel '%s' removed", name)
+		fmt.Printf("Tuning of tunnel '%s' removed\n", name)
+		return nil
+	},
+}
+
+var tunnelHooksCmd = &cobra.Command{
+	Use:   "hooks",
+	Short: "Run scripts as a tunnel comes up and goes down",
+	Long: `Hooks are shell commands run at four points, like strongSwan's updown script:
+
+  pre-up      before the tunnel is started; if it fails, the tunnel is not started
+  post-up     after the tunnel is up
+  pre-down    before the tunnel is stopped; if it fails, the tunnel is not stopped
+  post-down   after the tunnel is down
+
+The tunnel is described to the script by the environment variables
+IPSEC_VPN_VERB (the point), IPSEC_VPN_TUNNEL, IPSEC_VPN_MODE,
+IPSEC_VPN_INTERFACE, IPSEC_VPN_NAMESPACE, IPSEC_VPN_LOCAL_IP,
+IPSEC_VPN_REMOTE_IP, IPSEC_VPN_LOCAL_SUBNET and IPSEC_VPN_REMOTE_SUBNET.
+Hooks run in the default network namespace and are killed after 30 seconds.`,
+}
+
+var tunnelHooksSetCmd = &cobra.Command{
+	Use:   "set [name]",
+	Short: "Set the hook scripts of a tunnel, replacing any set before",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		hooks := &tunnel.Hooks{}
+		hooks.PreUp, _ = cmd.Flags().GetString(tunnel.HookPreUp)
+		hooks.PostUp, _ = cmd.Flags().GetString(tunnel.HookPostUp)
+		hooks.PreDown, _ = cmd.Flags().GetString(tunnel.HookPreDown)
+		hooks.PostDown, _ = cmd.Flags().GetString(tunnel.HookPostDown)
+		if err := tunnel.SetHooks(name, hooks); err != nil {
+			return fail("Error setting hooks of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Hooks of tunnel '%s' set", name)
+		fmt.Printf("Hooks of tunnel '%s' set\n", name)
+		return nil
+	},
+}
+
+var tunnelHooksClearCmd = &cobra.Command{
+	Use:   "clear [name]",
+	Short: "Remove the hook scripts of a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if err := tunnel.SetHooks(name, nil); err != nil {
+			return fail("Error removing hooks of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Hooks of tunnel '%s' removed", name)
+		fmt.Printf("Hooks of tunnel '%s' removed\n", name)
+		return nil
+	},
+}
+
+var tunnelInspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Pass a tunnel's decrypted traffic through an IDS or IPS",
+	Long: `Divert the traffic a tunnel carries to its local subnet through an inspection
+device or program, such as Suricata, before it is delivered:
+
+  --interface   Route the traffic out of an interface the device sits behind,
+                with a policy routing rule matching the tunnel interface
+  --queue       Hand the traffic to a program listening on an NFQUEUE, with an
+                nftables rule in the table inet ipsec_vpn
+
+Inspection is set up whenever the tunnel starts.`,
+}
+
+var tunnelInspectSetCmd = &cobra.Command{
+	Use:   "set [name]",
+	Short: "Inspect the traffic of a tunnel through an interface or NFQUEUE",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		inspection := &tunnel.Inspection{Type: tunnel.InspectInterface}
+		if cmd.Flags().Changed("queue") {
+			inspection.Type = tunnel.InspectQueue
+		}
+		inspection.Interface, _ = cmd.Flags().GetString("interface")
+		inspection.Gateway, _ = cmd.Flags().GetString("gateway")
+		inspection.Queue, _ = cmd.Flags().GetUint16("queue")
+		inspection.Bypass, _ = cmd.Flags().GetBool("bypass")
+		tun, err := tunnel.Get(name)
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+		if err := tunnel.SetInspection(name, inspection); err != nil {
+			return fail("Error setting inspection of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Traffic of tunnel '%s' is inspected %s", name, inspection)
+		fmt.Printf("Traffic of tunnel '%s' is inspected %s\n", name, inspection)
+		if tun.Inspection != nil {
+			return nil
+		}
+		return armConfirm(cmd, fmt.Sprintf("the inspection of tunnel '%s'", name), "tunnel", "inspect", "clear", name)
+	},
+}
+
+var tunnelInspectClearCmd = &cobra.Command{
+	Use:   "clear [name]",
+	Short: "Deliver the traffic of a tunnel without inspection",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if err := tunnel.SetInspection(name, nil); err != nil {
+			return fail("Error removing inspection of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Traffic of tunnel '%s' is no longer inspected", name)
+		fmt.Printf("Traffic of tunnel '%s' is no longer inspected\n", name)
+		return nil
+	},
+}
+
+var tunnelUplinkCmd = &cobra.Command{
+	Use:   "uplink",
+	Short: "Choose the WAN uplink that carries a tunnel",
+	Long: `Bind a tunnel to one of the uplinks in the configuration, or let ipsec-vpn place
+it with "auto". A bound tunnel fails over to another uplink while its own is
+down and comes back once it is up again; an auto tunnel moves only when its
+uplink goes down, to the uplink with the most capacity left. Moving a tunnel
+changes its local address to the new uplink's and routes its peer through it.
+Run "ipsec-vpn uplinks run" to follow uplinks going up and down.`,
+}
+
+var tunnelUplinkSetCmd = &cobra.Command{
+	Use:   "set [name] [uplink|auto]",
+	Short: "Carry a tunnel over an uplink",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, uplink := args[0], args[1]
+		if err := tunnel.SetUplink(name, uplink); err != nil {
+			return fail("Error setting uplink of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' is carried over uplink %s", name, uplink)
+		fmt.Printf("Tunnel '%s' is carried over uplink %s\n", name, uplink)
+		return nil
+	},
+}
+
+var tunnelUplinkClearCmd = &cobra.Command{
+	Use:   "clear [name]",
+	Short: "Stop moving a tunnel between uplinks",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if err := tunnel.SetUplink(name, ""); err != nil {
+			return fail("Error removing uplink of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' is no longer moved between uplinks", name)
+		fmt.Printf("Tunnel '%s' is no longer moved between uplinks\n", name)
+		return nil
+	},
+}
+
+var tunnelLabelCmd = &cobra.Command{
+	Use:   "label [name] [key=value | key-]...",
+	Short: "Set or remove labels of a tunnel",
+	Long: `Labels group tunnels, e.g. by site or customer, for 'tunnel show --selector' and
+the label-selector query parameter of RESTCONF. key=value sets a label and key-
+removes it. Without labels, the tunnel's labels are printed.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		tun, err := tunnel.Get(name)
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+		if len(args) == 1 {
+			if len(tun.Labels) == 0 {
+				fmt.Printf("Tunnel '%s' has no labels\n", name)
+				return nil
+			}
+			for _, key := range slices.Sorted(maps.Keys(tun.Labels)) {
+				fmt.Printf("%s=%s\n", key, tun.Labels[key])
+			}
+			return nil
+		}
+
+		labels := maps.Clone(tun.Labels)
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		for _, arg := range args[1:] {
+			if key, value, ok := strings.Cut(arg, "="); ok {
+				labels[key] = value
+			} else if key, ok := strings.CutSuffix(arg, "-"); ok {
+				delete(labels, key)
+			} else {
+				return fail("Error: invalid label '%s', use key=value to set it or key- to remove it", arg)
+			}
+		}
+		if err := tunnel.SetLabels(name, labels); err != nil {
+			return fail("Error setting labels of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' labels: %s", name, orDash(tunnel.FormatLabels(labels)))
+		fmt.Printf("Tunnel '%s' labels: %s\n", name, orDash(tunnel.FormatLabels(labels)))
+		return nil
+	},
+}
+
+var tunnelPolicyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Limit the traffic a tunnel carries to certain protocols and ports",
+	Long: `A traffic policy is an allow-list of rules such as tcp/443, udp/53, tcp/8000-8010 or
+icmp. Once a tunnel has rules, only matching traffic between its subnets is let
+through, in either direction; everything else between the subnets is dropped.
+A tunnel without rules carries all traffic between its subnets.`,
+}
+
+var tunnelPolicyAddCmd = &cobra.Command{
+	Use:   "add [name] [rule...]",
+	Short: "Allow protocols and ports through a tunnel",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		tun, err := tunnel.Get(name)
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+
+		rules := tun.Policy
+		var added []string
+		for _, arg := range args[1:] {
+			rule, err := tunnel.ParseTrafficRule(arg)
+			if err != nil {
+				return fail("Error: %v", err)
+			}
+			if !slices.Contains(rules, rule) {
+				rules = append(rules, rule)
+				added = append(added, rule.String())
+			}
+		}
+		if err := setTunnelPolicy(name, rules); err != nil || len(added) == 0 {
+			return err
+		}
+
+		// The first rules turn the policy into an allow-list
+		undo := []string{"tunnel", "policy", "clear", name}
+		if len(tun.Policy) > 0 {
+			undo = append([]string{"tunnel", "policy", "remove", name}, added...)
+		}
+		return armConfirm(cmd, fmt.Sprintf("the traffic policy rules %s of tunnel '%s'", strings.Join(added, ", "), name), undo...)
+	},
+}
+
+var tunnelPolicyRemoveCmd = &cobra.Command{
+	Use:   "remove [name] [rule...]",
+	Short: "Stop allowing protocols and ports through a tunnel",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		tun, err := tunnel.Get(name)
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+
+		rules := slices.Clone(tun.Policy)
+		for _, arg := range args[1:] {
+			rule, err := tunnel.ParseTrafficRule(arg)
+			if err != nil {
+				return fail("Error: %v", err)
+			}
+			i := slices.Index(rules, rule)
+			if i < 0 {
+				return fail("Error: tunnel '%s' has no rule %s", name, rule)
+			}
+			rules = slices.Delete(rules, i, i+1)
+		}
+		if len(rules) == 0 {
+			fmt.Printf("Removing the last rule lets all traffic between the subnets of tunnel '%s' through\n", name)
+		}
+		return setTunnelPolicy(name, rules)
+	},
+}
+
+var tunnelPolicyClearCmd = &cobra.Command{
+	Use:   "clear [name]",
+	Short: "Remove all rules, letting all traffic through a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setTunnelPolicy(args[0], nil)
+	},
+}
+
+var tunnelPolicyListCmd = &cobra.Command{
+	Use:   "list [name]",
+	Short: "List the traffic policy of a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		tun, err := tunnel.Get(name)
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", name, err)
+		}
+
+		if len(tun.Policy) == 0 {
+			fmt.Printf("Tunnel '%s' carries all traffic between %s and %s\n", name, tun.LocalSubnet, tun.RemoteSubnet)
+			return nil
+		}
+		for _, rule := range tun.Policy {
+			fmt.Println(rule)
+		}
+		return nil
+	},
+}
+
+// setTunnelPolicy replaces the traffic policy of a tunnel
+func setTunnelPolicy(name string, rules []tunnel.TrafficRule) error {
+	if err := tunnel.SetTrafficPolicy(name, rules); err != nil {
+		return fail("Error setting traffic policy for tunnel '%s': %v", name, err)
+	}
+
+	logger.Info("Traffic policy of tunnel '%s' set to %s", name, policySummary(rules))
+	fmt.Printf("Traffic policy of tunnel '%s': %s\n", name, policySummary(rules))
+	return nil
+}
+
+// policySummary lists the rules of a traffic policy on one line
+func policySummary(rules []tunnel.TrafficRule) string {
+	if len(rules) == 0 {
+		return "all traffic"
+	}
+	parts := make([]string, len(rules))
+	for i, rule := range rules {
+		parts[i] = rule.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+var tunnelExecCmd = &cobra.Command{
+	Use:   "exec [name] -- [command] [args...]",
+	Short: "Run a command inside the network namespace of a tunnel",
+	Long: `Run a command inside the network namespace of a tunnel created with --netns, e.g.
+  ipsec-vpn tunnel exec office -- ip route
+The command's exit status is passed through.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		logger.Debug("Running %v in the network namespace of tunnel '%s'", args[1:], name)
+
+		err := tunnel.Exec(name, args[1:], os.Stdin, os.Stdout, os.Stderr)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return &ExitError{Code: exitErr.ExitCode()}
+		}
+		if err != nil {
+			return fail("Error running command in tunnel '%s': %v", name, err)
+		}
+		return nil
+	},
+}
+
+var tunnelStartCmd = &cobra.Command{
+	Use:   "start [name]",
+	Short: "Start an IPsec tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		wasUp := false
+		if tun, err := tunnel.Get(name); err == nil {
+			wasUp = tun.Status == tunnel.StatusUp
+		}
+
+		logger.Info("Starting tunnel '%s'", name)
+		err := tunnel.Start(name)
+		if err != nil {
+			return fail("Error starting tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' started successfully", name)
+		fmt.Printf("Tunnel '%s' started successfully\n", name)
+		if wasUp {
+			return nil
+		}
+		return armConfirm(cmd, fmt.Sprintf("the start of tunnel '%s'", name), "tunnel", "stop", name)
+	},
+}
+
+var tunnelStopCmd = &cobra.Command{
+	Use:   "stop [name]",
+	Short: "Stop an IPsec tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		logger.Info("Stopping tunnel '%s'", name)
+		err := tunnel.Stop(name)
+		if err != nil {
+			return fail("Error stopping tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' stopped successfully", name)
+		fmt.Printf("Tunnel '%s' stopped successfully\n", name)
+		return nil
+	},
+}
+
+var tunnelDrainCmd = &cobra.Command{
+	Use:   "drain [name]",
+	Short: "Move traffic off an IPsec tunnel, then stop it",
+	Long: `Take a tunnel out of service without cutting off traffic in flight. The
+networks advertised through the tunnel are withdrawn so that traffic moves to
+other paths, then the tunnel's traffic counters are watched until they stop
+moving, or --timeout passes, and only then is the tunnel stopped.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		logger.Info("Draining tunnel '%s'", name)
+		err := tunnel.Drain(name, timeout)
+		if err != nil {
+			return fail("Error draining tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' drained and stopped successfully", name)
+		fmt.Printf("Tunnel '%s' drained and stopped successfully\n", name)
+		return nil
+	},
+}
+
+var tunnelFlowsCmd = &cobra.Command{
+	Use:   "flows [name]",
+	Short: "List the connections a tunnel is carrying",
+	Long: `List the connections between the subnets of a tunnel that conntrack is
+tracking, busiest first. SENT counts the bytes from the side that opened the
+connection, RECEIVED those from the other side; both are only counted with
+conntrack accounting on (sysctl net.netfilter.nf_conntrack_acct=1).`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		flows, err := tunnel.Flows(name)
+		if err != nil {
+			return fail("Error listing flows of tunnel '%s': %v", name, err)
+		}
+		if len(flows) == 0 {
+			fmt.Printf("No flows through tunnel '%s'\n", name)
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "PROTO"},
+			table.Column{Header: "SOURCE", MaxWidth: 46},
+			table.Column{Header: "DESTINATION", MaxWidth: 46},
+			table.Column{Header: "DIRECTION"},
+			table.Column{Header: "SENT"},
+			table.Column{Header: "RECEIVED"},
+			table.Column{Header: "PACKETS", Wide: true},
+			table.Column{Header: "TIMEOUT", Wide: true},
+		)
+		for _, f := range flows {
+			direction := "inbound"
+			if f.Outbound {
+				direction = "outbound"
+			}
+			tbl.AddRow(f.Protocol(), f.Source(), f.Destination(), direction, formatBytes(f.SentBytes),
+				formatBytes(f.RecvBytes), fmt.Sprint(f.Packets()), f.Timeout.String())
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var tunnelStatsCmd = &cobra.Command{
+	Use:   "stats [name]",
+	Short: "Show the traffic a tunnel has carried",
+	Long: `Show the bytes a tunnel has received and sent since its interface was created.
+With --detailed, the packets and bytes are broken down by protocol and direction,
+if its packet accounting is on, and the packets it dropped are listed by
+reason: on its interface, by its rate limit and, for IPsec, in the kernel's
+processing of the SAs of all tunnels.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		stats, err := tunnel.GetStats(name)
+		if err != nil {
+			return fail("Error getting the traffic of tunnel '%s': %v", name, err)
+		}
+		var detailed *tunnel.DetailedStats
+		if d, _ := cmd.Flags().GetBool("detailed"); d {
+			if detailed, err = tunnel.GetDetailedStats(name); err != nil {
+				return fail("Error getting the detailed traffic of tunnel '%s': %v", name, err)
+			}
+		}
+		if jsonOutput(cmd) {
+			return writeJSON(os.Stdout, struct {
+				*tunnel.Stats
+				*tunnel.DetailedStats
+			}{stats, detailed})
+		}
+
+		fmt.Printf("Traffic: %s received, %s sent\n", formatBytes(stats.RxBytes), formatBytes(stats.TxBytes))
+		if !stats.LastHandshake.IsZero() {
+			fmt.Printf("Last Handshake: %s\n", stats.LastHandshake.Format(time.DateTime))
+		}
+		if detailed == nil {
+			return nil
+		}
+
+		fmt.Println()
+		if c := detailed.Counters; c != nil {
+			tbl := table.New(
+				table.Column{Header: "PROTOCOL"},
+				table.Column{Header: "RX PACKETS"},
+				table.Column{Header: "RX BYTES"},
+				table.Column{Header: "TX PACKETS"},
+				table.Column{Header: "TX BYTES"},
+			)
+			for _, protocol := range network.AccountingProtocols {
+				rx, tx := c.Received[protocol], c.Sent[protocol]
+				tbl.AddRow(protocol, fmt.Sprint(rx.Packets), formatBytes(rx.Bytes), fmt.Sprint(tx.Packets), formatBytes(tx.Bytes))
+			}
+			tbl.Render(os.Stdout, tableOptions(cmd))
+		} else {
+			fmt.Printf("Packet accounting is off, turn it on with: ipsec-vpn tunnel packet-accounting enable %s\n", name)
+		}
+
+		fmt.Println()
+		if len(detailed.Drops) == 0 && len(detailed.Xfrm) == 0 {
+			fmt.Println("No packets dropped")
+			return nil
+		}
+		tbl := table.New(table.Column{Header: "SCOPE"}, table.Column{Header: "REASON"}, table.Column{Header: "PACKETS"})
+		for _, d := range detailed.Drops {
+			tbl.AddRow("tunnel", d.Reason, fmt.Sprint(d.Packets))
+		}
+		for _, d := range detailed.Xfrm {
+			tbl.AddRow("all SAs", d.Reason, fmt.Sprint(d.Packets))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var tunnelPacketAccountingCmd = &cobra.Command{
+	Use:   "packet-accounting",
+	Short: "Count the packets of a tunnel by protocol and direction",
+	Long: `Packet accounting attaches small eBPF programs to both directions of the
+interface of a tunnel that count its packets and bytes by protocol: TCP, UDP,
+ICMP, ESP and the rest. The counters are per CPU, so they cost next to nothing
+on busy tunnels, and they are kept on the BPF filesystem under
+/sys/fs/bpf/ipsec-vpn while the tunnel exists. See them with
+"ipsec-vpn tunnel stats --detailed".
+
+The kernel must be 4.18 or later and allow eBPF programs, and /sys/fs/bpf must be
+mounted.`,
+}
+
+var tunnelPacketAccountingEnableCmd = &cobra.Command{
+	Use:   "enable [name]",
+	Short: "Turn on the packet accounting of a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setTunnelPacketAccounting(args[0], true)
+	},
+}
+
+var tunnelPacketAccountingDisableCmd = &cobra.Command{
+	Use:   "disable [name]",
+	Short: "Turn off the packet accounting of a tunnel, discarding its counters",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setTunnelPacketAccounting(args[0], false)
+	},
+}
+
+// setTunnelPacketAccounting turns the packet accounting of a tunnel on or off
+func setTunnelPacketAccounting(name string, enabled bool) error {
+	if err := tunnel.SetPacketAccounting(name, enabled); err != nil {
+		return fail("Error setting packet accounting for tunnel '%s': %v", name, err)
+	}
+
+	state := "off"
+	if enabled {
+		state = "on"
+	}
+	logger.Info("Packet accounting %s for tunnel '%s'", state, name)
+	fmt.Printf("Packet accounting %s for tunnel '%s'\n", state, name)
+	return nil
+}
+
+var tunnelDebugCmd = &cobra.Command{
+	Use:   "debug",
+	Short: "Record IKE negotiation transcripts for interop debugging",
+	Long: `Record a transcript of each IKE negotiation of a tunnel: message types, payload
+types and lengths, notify messages, the selected proposal and timing. Payload
+contents such as nonces, key exchange data, identities and AUTH are never recorded.
+Changes take effect at the next negotiation, without restarting the tunnel.`,
+}
+
+var tunnelDebugEnableCmd = &cobra.Command{
+	Use:   "enable [name]",
+	Short: "Start recording negotiation transcripts for a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setTunnelDebug(args[0], true)
+	},
+}
+
+var tunnelDebugDisableCmd = &cobra.Command{
+	Use:   "disable [name]",
+	Short: "Stop recording negotiation transcripts for a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setTunnelDebug(args[0], false)
+	},
+}
+
+// setTunnelDebug turns transcripts on or off and reports where they are written
+func setTunnelDebug(name string, enabled bool) error {
+	if err := tunnel.SetDebug(name, enabled); err != nil {
+		return fail("Error setting debug for tunnel '%s': %v", name, err)
+	}
+
+	if !enabled {
+		logger.Info("Negotiation transcripts disabled for tunnel '%s'", name)
+		fmt.Printf("Negotiation transcripts disabled for tunnel '%s'\n", name)
+		return nil
+	}
+
+	path, _ := tunnel.TranscriptPath(name)
+	logger.Info("Negotiation transcripts enabled for tunnel '%s'", name)
+	fmt.Printf("Negotiation transcripts enabled for tunnel '%s', writing to %s\n", name, path)
+	return nil
+}
+
+var tunnelDebugShowCmd = &cobra.Command{
+	Use:   "show [name]",
+	Short: "Print the recorded negotiation transcript of a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		events, err := tunnel.ReadTranscript(name)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("No transcript recorded for tunnel '%s'\n", name)
+			return nil
+		}
+		if err != nil {
+			return fail("Error reading transcript for tunnel '%s': %v", name, err)
+		}
+
+		for _, e := range events {
+			payloads := make([]string, 0, len(e.Payloads))
+			for _, p := range e.Payloads {
+				payloads = append(payloads, fmt.Sprintf("%s(%d)", p.Type, p.Length))
+			}
+			for _, n := range e.Notify {
+				payloads = append(payloads, "N("+n+")")
+			}
+
+			fmt.Printf("%s %+9.1fms %-3s %s #%d [%s]", e.Time.Format(time.TimeOnly), e.Elapsed,
+				e.Direction, e.Exchange, e.MessageID, strings.Join(payloads, " "))
+			if e.Proposal != "" {
+				fmt.Printf(" proposal %s", e.Proposal)
+			}
+			fmt.Println()
+		}
+		return nil
+	},
+}
+
+var tunnelSLACmd = &cobra.Command{
+	Use:   "sla [name]",
+	Short: "Show SLA probe results of tunnels",
+	Long: `Measure latency, jitter and loss through tunnels with probes, like IP SLA operations.
+Every interval, 'tunnel sla run' sends a burst of ICMP echoes or UDP echo probes to a
+target in the remote subnet and checks the results against the tunnel's thresholds.
+
+Without a name, lists the last result of each tunnel with probes and how many of the
+recorded results met the SLA. With a name, shows the tunnel's probe settings and its
+recent results.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return showSLAs(os.Stdout, tableOptions(cmd))
+		}
+		count, _ := cmd.Flags().GetInt("history")
+		return showSLA(os.Stdout, args[0], count, tableOptions(cmd))
+	},
+}
+
+// showSLAs writes a table of the last SLA result of each tunnel with probes
+func showSLAs(w io.Writer, opts table.Options) error {
+	tunnels, err := tunnel.ListAll()
+	if err != nil {
+		return fail("Error listing tunnels: %v", err)
+	}
+
+	tbl := table.New(
+		table.Column{Header: "NAME", MaxWidth: 24},
+		table.Column{Header: "SLA", Status: true},
+		table.Column{Header: "TARGET"},
+		table.Column{Header: "LATENCY"},
+		table.Column{Header: "JITTER"},
+		table.Column{Header: "LOSS"},
+		table.Column{Header: "COMPLIANCE"},
+		table.Column{Header: "VIOLATIONS", MaxWidth: 40},
+		table.Column{Header: "LAST PROBE", Wide: true},
+	)
+	for _, t := range tunnels {
+		if t.SLA == nil {
+			continue
+		}
+		history, err := tunnel.SLAHistory(t.Name)
+		if err != nil {
+			return fail("Error reading SLA results of tunnel '%s': %v", t.Name, err)
+		}
+		if len(history) == 0 {
+			tbl.AddRow(t.Name, "PENDING", t.SLA.Target, "-", "-", "-", "-", "", "-")
+			continue
+		}
+		last := history[len(history)-1]
+		latency, jitter := slaTimes(last)
+		tbl.AddRow(t.Name, slaState(last), t.SLA.Target, latency, jitter,
+			fmt.Sprintf("%.0f%%", last.Loss), fmt.Sprintf("%.1f%%", tunnel.Compliance(history)),
+			strings.Join(last.Violations, ", "), last.Time.Format(time.DateTime))
+	}
+	if tbl.Len() == 0 {
+		fmt.Fprintln(w, "No tunnels have SLA probes, add them with 'ipsec-vpn tunnel sla set'")
+		return nil
+	}
+	tbl.Render(w, opts)
+	return nil
+}
+
+// showSLA writes the SLA settings of a tunnel and its last results
+func showSLA(w io.Writer, name string, count int, opts table.Options) error {
+	t, err := tunnel.Get(name)
+	if err != nil {
+		return fail("Error getting tunnel '%s': %v", name, err)
+	}
+	if t.SLA == nil {
+		fmt.Fprintf(w, "Tunnel '%s' has no SLA probes\n", name)
+		return nil
+	}
+	history, err := tunnel.SLAHistory(name)
+	if err != nil {
+		return fail("Error reading SLA results of tunnel '%s': %v", name, err)
+	}
+
+	threshold := func(d time.Duration) string {
+		if d == 0 {
+			return "-"
+		}
+		return d.String()
+	}
+	fmt.Fprintf(w, "Tunnel: %s\n", t.Name)
+	fmt.Fprintf(w, "Probe: %s to %s, %d every %s\n", t.SLA.Type, t.SLA.Target, t.SLA.Count, t.SLA.Interval)
+	fmt.Fprintf(w, "Max Latency: %s\n", threshold(t.SLA.MaxLatency))
+	fmt.Fprintf(w, "Max Jitter: %s\n", threshold(t.SLA.MaxJitter))
+	if t.SLA.MaxLoss > 0 {
+		fmt.Fprintf(w, "Max Loss: %g%%\n", t.SLA.MaxLoss)
+	} else {
+		fmt.Fprintln(w, "Max Loss: -")
+	}
+	if len(history) == 0 {
+		fmt.Fprintln(w, "No results yet, probes are sent by 'ipsec-vpn tunnel sla run'")
+		return nil
+	}
+	fmt.Fprintf(w, "Compliance: %.1f%% of %d results since %s\n", tunnel.Compliance(history), len(history),
+		history[0].Time.Format(time.DateTime))
+
+	tbl := table.New(
+		table.Column{Header: "TIME"},
+		table.Column{Header: "SLA", Status: true},
+		table.Column{Header: "LATENCY"},
+		table.Column{Header: "JITTER"},
+		table.Column{Header: "LOSS"},
+		table.Column{Header: "VIOLATIONS"},
+	)
+	for _, r := range history[max(0, len(history)-count):] {
+		latency, jitter := slaTimes(r)
+		tbl.AddRow(r.Time.Format(time.DateTime), slaState(r), latency, jitter,
+			fmt.Sprintf("%.0f%% (%d/%d)", r.Loss, r.Sent-r.Received, r.Sent), strings.Join(r.Violations, ", "))
+	}
+	fmt.Fprintln(w)
+	tbl.Render(w, opts)
+	return nil
+}
+
+// slaState formats whether a result met the SLA
+func slaState(r tunnel.SLAResult) string {
+	if r.Met {
+		return "OK"
+	}
+	return "FAIL"
+}
+
+// slaTimes formats the latency and jitter of a result, which are unknown without replies
+func slaTimes(r tunnel.SLAResult) (string, string) {
+	if r.Received == 0 {
+		return "-", "-"
+	}
+	return fmt.Sprintf("%.1fms", r.Latency), fmt.Sprintf("%.1fms", r.Jitter)
+}
+
+var tunnelSLASetCmd = &cobra.Command{
+	Use:   "set [name]",
+	Short: "Set the SLA probes and thresholds of a tunnel",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		sla := &tunnel.SLA{}
+		sla.Type, _ = cmd.Flags().GetString("type")
+		sla.Target, _ = cmd.Flags().GetString("target")
+		sla.Interval, _ = cmd.Flags().GetDuration("interval")
+		sla.Count, _ = cmd.Flags().GetInt("count")
+		sla.MaxLatency, _ = cmd.Flags().GetDuration("max-latency")
+		sla.MaxJitter, _ = cmd.Flags().GetDuration("max-jitter")
+		sla.MaxLoss, _ = cmd.Flags().GetFloat64("max-loss")
+		if err := tunnel.SetSLA(name, sla); err != nil {
+			return fail("Error setting SLA probes for tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' probes %s every %s", name, sla.Target, sla.Interval)
+		fmt.Printf("Tunnel '%s' probes %s (%s) every %s\n", name, sla.Target, sla.Type, sla.Interval)
+		return nil
+	},
+}
+
+var tunnelSLAClearCmd = &cobra.Command{
+	Use:   "clear [name]",
+	Short: "Remove the SLA probes of a tunnel and their results",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if err := tunnel.SetSLA(name, nil); err != nil {
+			return fail("Error removing SLA probes of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("SLA probes of tunnel '%s' removed", name)
+		fmt.Printf("SLA probes of tunnel '%s' removed\n", name)
+		return nil
+	},
+}
+
+var tunnelSLARunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Send the SLA probes of all tunnels in the foreground",
+	Long: `Send the SLA probes of each tunnel at its interval and record the results until
+interrupted. Tunnels with probes added or changed while running are picked up.
+ICMP probes need a raw socket, so run this as root.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		logger.Info("Running SLA probes")
+		due := make(map[string]time.Time)
+		running := make(map[string]bool)
+		finished := make(chan string)
+		for {
+			tunnels, err := tunnel.ListAll()
+			if err != nil {
+				logger.Error("Error listing tunnels: %v", err)
+			}
+			now := time.Now()
+			for _, t := range tunnels {
+				if t.SLA == nil || running[t.Name] || now.Before(due[t.Name]) {
+					continue
+				}
+				due[t.Name] = now.Add(t.SLA.Interval)
+				running[t.Name] = true
+				go func(name string) {
+					if result, err := tunnel.ProbeSLA(name); err != nil {
+						logger.Error("SLA probe of tunnel '%s' failed: %v", name, err)
+					} else {
+						logger.Debug("SLA probe of tunnel '%s': latency %.1fms, jitter %.1fms, loss %.0f%%",
+							name, result.Latency, result.Jitter, result.Loss)
+					}
+					finished <- name
+				}(t.Name)
+			}
+
+			select {
+			case <-ticker.C:
+			case name := <-finished:
+				delete(running, name)
+			case <-sigs:
+				return nil
+			}
+		}
+	},
+}
+
+var tunnelSLAResponderCmd = &cobra.Command{
+	Use:   "responder",
+	Short: "Echo UDP SLA probes from the other end of tunnels",
+	Long: `Run a UDP echo responder in the foreground, for udp probes sent by the gateway at
+the other end of a tunnel. Listen on an address in the local subnet the tunnel carries.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		listen, _ := cmd.Flags().GetString("listen")
+		conn, err := net.ListenPacket("udp", listen)
+		if err != nil {
+			return fail("Error starting SLA responder: %v", err)
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			conn.Close()
+		}()
+
+		logger.Info("Echoing SLA probes on %s", conn.LocalAddr())
+		if err := tunnel.ServeSLAResponder(conn); err != nil {
+			return fail("SLA responder failed: %v", err)
+		}
+		return nil
+	},
+}
+
+var tunnelSALifetimeCmd = &cobra.Command{
+	Use:   "sa-lifetime [name]",
+	Short: "Show when the SAs of a tunnel are rekeyed and expire",
+	Long: `SAs are rekeyed when they reach a soft lifetime limit and deleted when they reach a
+hard one, after a time or after carrying a volume of bytes or packets. Without limits of
+its own a tunnel uses tunnel_defaults.sa_lifetime, whose hard time limit defaults to
+tunnel_defaults.key_rotation_interval and soft time limit to 90% of that.
+
+Shows a tunnel's limits and how often its SAs reached them, by cause, as counted by
+'tunnel sa-lifetime watch'.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		t, err := tunnel.Get(args[0])
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", args[0], err)
+		}
+		if t.Mode == tunnel.ModeWireGuard {
+			fmt.Println("WireGuard rekeys every 2 minutes on its own, its lifetime cannot be set")
+			return nil
+		}
+		counts, err := tunnel.Rekeys(t.Name)
+		if err != nil {
+			return fail("Error reading rekey counts of tunnel '%s': %v", t.Name, err)
+		}
+
+		l := t.EffectiveSALifetime()
+		source := "default"
+		if t.SALifetime != nil {
+			source = "tunnel"
+		}
+		fmt.Printf("Tunnel: %s\n", t.Name)
+		fmt.Printf("Lifetime: %s\n", source)
+		fmt.Printf("Time: rekey after %s, expire after %s\n", orNoLimit(uint64(l.SoftTime), l.SoftTime.String()), orNoLimit(uint64(l.HardTime), l.HardTime.String()))
+		fmt.Printf("Bytes: rekey after %s, expire after %s\n", orNoLimit(l.SoftBytes, formatBytes(l.SoftBytes)), orNoLimit(l.HardBytes, formatBytes(l.HardBytes)))
+		fmt.Printf("Packets: rekey after %s, expire after %s\n", orNoLimit(l.SoftPackets, fmt.Sprint(l.SoftPackets)), orNoLimit(l.HardPackets, fmt.Sprint(l.HardPackets)))
+		fmt.Printf("Rekeys: %d by time, %d by bytes, %d by packets\n", counts.Time, counts.Bytes, counts.Packets)
+		fmt.Printf("Hard Expiries: %d\n", counts.HardExpiries)
+		if !counts.Last.IsZero() {
+			fmt.Printf("Last: %s (%s)\n", counts.Last.Format(time.DateTime), counts.LastCause)
+		}
+		return nil
+	},
+}
+
+// orNoLimit returns formatted, or "no limit" for a zero limit
+func orNoLimit(limit uint64, formatted string) string {
+	if limit == 0 {
+		return "no limit"
+	}
+	return formatted
+}
+
+var tunnelSALifetimeSetCmd = &cobra.Command{
+	Use:   "set [name]",
+	Short: "Set the soft and hard SA lifetime limits of a tunnel",
+	Long: `Set when the SAs of a tunnel are rekeyed (soft) and deleted (hard). Each soft limit
+must be below its hard limit. Limits not given are not applied, except that the time
+limits default to those of tunnel_defaults.sa_lifetime. SAs the tunnel has now get the
+new limits straight away.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		defaults := tunnel.DefaultSALifetime()
+		l := &tunnel.SALifetime{SoftTime: defaults.SoftTime, HardTime: defaults.HardTime}
+		if cmd.Flags().Changed("soft-time") || cmd.Flags().Changed("hard-time") {
+			l.SoftTime, _ = cmd.Flags().GetDuration("soft-time")
+			l.HardTime, _ = cmd.Flags().GetDuration("hard-time")
+		}
+		for _, f := range []struct {
+			flag  string
+			value *uint64
+		}{{"soft-bytes", &l.SoftBytes}, {"hard-bytes", &l.HardBytes}} {
+			if s, _ := cmd.Flags().GetString(f.flag); s != "" {
+				var err error
+				if *f.value, err = parseBytes(s); err != nil {
+					return fail("Error: --%s: %v", f.flag, err)
+				}
+			}
+		}
+		l.SoftPackets, _ = cmd.Flags().GetUint64("soft-packets")
+		l.HardPackets, _ = cmd.Flags().GetUint64("hard-packets")
+
+		if err := tunnel.SetSALifetime(name, l); err != nil {
+			return fail("Error setting SA lifetime of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("SA lifetime of tunnel '%s' set", name)
+		fmt.Printf("SAs of tunnel '%s' are rekeyed after %s", name, l.SoftTime)
+		if l.SoftBytes > 0 {
+			fmt.Printf(" or %s", formatBytes(l.SoftBytes))
+		}
+		if l.SoftPackets > 0 {
+			fmt.Printf(" or %d packets", l.SoftPackets)
+		}
+		fmt.Println()
+		return nil
+	},
+}
+
+var tunnelSALifetimeClearCmd = &cobra.Command{
+	Use:   "clear [name]",
+	Short: "Make the SAs of a tunnel use the default lifetime again",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if err := tunnel.SetSALifetime(name, nil); err != nil {
+			return fail("Error clearing SA lifetime of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("SAs of tunnel '%s' use the default lifetime", name)
+		fmt.Printf("SAs of tunnel '%s' use the default lifetime\n", name)
+		return nil
+	},
+}
+
+var tunnelSALifetimeWatchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Report SAs reaching their lifetime limits in the foreground",
+	Long: `Follow the kernel's SA expiry notifications until interrupted. Each SA of a tunnel
+reaching a soft limit, which starts a rekey, or a hard limit, which deletes it, is
+printed with the cause (time, bytes or packets), counted, and published as a
+tunnel.sa.rekey or tunnel.sa.expired event.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		stop := make(chan struct{})
+		go func() {
+			<-sigs
+			close(stop)
+		}()
+
+		logger.Info("Watching SA lifetimes")
+		err := tunnel.WatchSAExpiry(stop, func(e tunnel.SAExpiry) {
+			limit := "REKEY"
+			if e.Hard {
+				limit = "EXPIRED"
+			}
+			fmt.Printf("%s  %-7s  %s  %s\n", time.Now().Format(time.DateTime), limit, e.Tunnel, e)
+		})
+		if err != nil {
+			return fail("Error watching SA lifetimes: %v", err)
+		}
+		return nil
+	},
+}
+
+var tunnelReauthCmd = &cobra.Command{
+	Use:   "reauth [name]",
+	Short: "Show how often the IKE SA of a tunnel is reauthenticated",
+	Long: `A rekey derives new keys for an SA, while a reauthentication negotiates the IKE
+SA again from scratch, checking the peer's credentials as when the tunnel came up,
+as some security policies require every so many hours. The SAs outlive a
+reauthentication that is due by a grace, so that the new ones are up before the
+old ones go; a tunnel whose reauthentication has not succeeded by then is
+overdue. Without a policy of its own a tunnel uses its peer group's, or else
+advanced.reauth_interval and advanced.reauth_grace, which only rekey by default.
+
+Shows a tunnel's policy, when it is next due and how many reauthentications the
+IKE daemon reported with 'tunnel reauth report'.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		t, err := tunnel.Get(args[0])
+		if err != nil {
+			return fail("Error getting tunnel '%s': %v", args[0], err)
+		}
+		if t.Mode == tunnel.ModeWireGuard {
+			fmt.Println("WireGuard has no IKE SA, it authenticates every handshake")
+			return nil
+		}
+		counts, err := tunnel.Reauths(t.Name)
+		if err != nil {
+			return fail("Error reading reauthentication counts of tunnel '%s': %v", t.Name, err)
+		}
+
+		p, source := tunnel.EffectiveReauth(t)
+		l := t.EffectiveSALifetime()
+		fmt.Printf("Tunnel: %s\n", t.Name)
+		fmt.Printf("Reauthentication: %s (%s)\n", p, source)
+		fmt.Printf("Rekey: after %s\n", orNoLimit(uint64(l.SoftTime), l.SoftTime.String()))
+		if p.Interval > 0 && l.SoftTime > 0 && p.Interval <= l.SoftTime {
+			fmt.Println("Note: SAs are reauthenticated before they are due to be rekeyed, so they are never rekeyed")
+		}
+		if due := tunnel.ReauthDue(t, p, counts); !due.IsZero() {
+			if tunnel.ReauthOverdue(t, p, counts, time.Now()) {
+				fmt.Printf("Next: overdue since %s\n", due.Add(p.Grace).Format(time.DateTime))
+			} else {
+				fmt.Printf("Next: due %s, SAs kept until %s\n", due.Format(time.DateTime), due.Add(p.Grace).Format(time.DateTime))
+			}
+		}
+		fmt.Printf("Reauthentications: %d succeeded, %d failed\n", counts.Successes, counts.Failures)
+		if !counts.LastAttempt.IsZero() {
+			fmt.Printf("Last: %s (%s)", counts.LastAttempt.Format(time.DateTime), counts.LastResult)
+			if counts.LastReason != "" {
+				fmt.Printf(": %s", counts.LastReason)
+			}
+			fmt.Println()
+		}
+		return nil
+	},
+}
+
+var tunnelReauthSetCmd = &cobra.Command{
+	Use:   "set [name]",
+	Short: "Set how often the IKE SA of a tunnel is reauthenticated",
+	Long: `Set the reauthentication policy of a tunnel, overriding its peer group's and the
+configuration file's. An --interval of 0 makes the tunnel only rekey. The IKE
+daemon applies the policy from the next IKE SA it negotiates.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		p := &tunnel.ReauthPolicy{}
+		p.Interval, _ = cmd.Flags().GetDuration("interval")
+		p.Grace, _ = cmd.Flags().GetDuration("grace")
+		if !cmd.Flags().Changed("grace") && p.Interval > 0 {
+			p.Grace = min(time.Duration(viper.GetInt("advanced.reauth_grace"))*time.Second, p.Interval/2)
+		}
+		if err := tunnel.SetReauth(name, p); err != nil {
+			return fail("Error setting reauthentication of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Reauthentication of tunnel '%s' set to %s", name, p)
+		fmt.Printf("Tunnel '%s' reauthenticates its IKE SA: %s\n", name, p)
+		return nil
+	},
+}
+
+var tunnelReauthClearCmd = &cobra.Command{
+	Use:   "clear [name]",
+	Short: "Make a tunnel use the reauthentication of its peer group or the configuration file again",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if err := tunnel.SetReauth(name, nil); err != nil {
+			return fail("Error clearing reauthentication of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' uses the default reauthentication", name)
+		fmt.Printf("Tunnel '%s' uses the default reauthentication\n", name)
+		return nil
+	},
+}
+
+var tunnelReauthReportCmd = &cobra.Command{
+	Use:   "report [name]",
+	Short: "Report the outcome of a reauthentication of the IKE SA of a tunnel",
+	Long: `Count a reauthentication of the IKE SA of a tunnel and publish it as a
+tunnel.reauth.succeeded or tunnel.reauth.failed event. This is run by the IKE
+daemon, e.g. from its updown script, when a reauthentication completes or fails.
+The counts are exported as metrics with those of the other tunnels.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		result, _ := cmd.Flags().GetString("result")
+		reason, _ := cmd.Flags().GetString("reason")
+		counts, err := tunnel.RecordReauth(args[0], result, reason)
+		if err != nil {
+			return fail("Error reporting reauthentication of tunnel '%s': %v", args[0], err)
+		}
+		logger.Info("Reauthentication of tunnel '%s': %s", args[0], result)
+		fmt.Printf("Tunnel '%s': %d reauthentications succeeded, %d failed\n", args[0], counts.Successes, counts.Failures)
+		return nil
+	},
+}
+
+var tunnelKeepaliveCmd = &cobra.Command{
+	Use:   "keepalive",
+	Short: "Show the keepalive counters of tunnels",
+	Long: `Keep NAT devices and stateful firewalls on the path to a peer from expiring the
+tunnel's flow by sending a small packet through it every interval, independent of
+DPD. Keepalives go to the discard port of the first address in the remote subnet and
+are encrypted like any other traffic; 'tunnel keepalive run' sends them.
+
+Lists the tunnels with keepalives, how many were sent and failed, and the last one.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tunnels, err := tunnel.ListAll()
+		if err != nil {
+			return fail("Error listing tunnels: %v", err)
+		}
+
+		tbl := table.New(
+			table.Column{Header: "NAME", MaxWidth: 24},
+			table.Column{Header: "STATUS", Status: true},
+			table.Column{Header: "INTERVAL"},
+			table.Column{Header: "SENT"},
+			table.Column{Header: "FAILED"},
+			table.Column{Header: "LAST SENT"},
+			table.Column{Header: "LAST ERROR", MaxWidth: 40, Wide: true},
+		)
+		for _, t := range tunnels {
+			if t.Keepalive == 0 {
+				continue
+			}
+			stats, err := tunnel.KeepaliveCounters(t.Name)
+			if err != nil {
+				return fail("Error reading keepalive counters of tunnel '%s': %v", t.Name, err)
+			}
+			last := "-"
+			if !stats.LastSent.IsZero() {
+				last = stats.LastSent.Format(time.DateTime)
+			}
+			tbl.AddRow(t.Name, string(t.Status), t.Keepalive.String(), fmt.Sprint(stats.Sent),
+				fmt.Sprint(stats.Failed), last, stats.LastError)
+		}
+		if tbl.Len() == 0 {
+			fmt.Println("No tunnels send keepalives, turn them on with 'ipsec-vpn tunnel keepalive set'")
+			return nil
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var tunnelKeepaliveSetCmd = &cobra.Command{
+	Use:   "set [name] [interval]",
+	Short: "Send a keepalive through a tunnel every interval, e.g. 20s",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		interval, err := time.ParseDuration(args[1])
+		if err != nil || interval <= 0 {
+			return fail("Error: invalid interval '%s', use e.g. 20s", args[1])
+		}
+		if err := tunnel.SetKeepalive(name, interval); err != nil {
+			return fail("Error setting keepalive of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' sends a keepalive every %s", name, interval)
+		fmt.Printf("Tunnel '%s' sends a keepalive every %s\n", name, interval)
+		return nil
+	},
+}
+
+var tunnelKeepaliveClearCmd = &cobra.Command{
+	Use:   "clear [name]",
+	Short: "Stop sending keepalives through a tunnel and drop its counters",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if err := tunnel.SetKeepalive(name, 0); err != nil {
+			return fail("Error removing keepalive of tunnel '%s': %v", name, err)
+		}
+
+		logger.Info("Tunnel '%s' no longer sends keepalives", name)
+		fmt.Printf("Tunnel '%s' no longer sends keepalives\n", name)
+		return nil
+	},
+}
+
+var tunnelKeepaliveRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Send the keepalives of all tunnels in the foreground",
+	Long: `Send a keepalive through each tunnel that is up at its interval until interrupted.
+Tunnels with keepalives turned on or changed while running are picked up.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		logger.Info("Sending keepalives")
+		due := make(map[string]time.Time)
+		for {
+			tunnels, err := tunnel.ListAll()
+			if err != nil {
+				logger.Error("Error listing tunnels: %v", err)
+			}
+			now := time.Now()
+			for _, t := range tunnels {
+				if t.Keepalive == 0 || t.Status != tunnel.StatusUp || now.Before(due[t.Name]) {
+					continue
+				}
+				due[t.Name] = now.Add(t.Keepalive)
+				if stats, err := tunnel.SendKeepalive(t.Name); err != nil {
+					logger.Error("Keepalive through tunnel '%s' failed: %v", t.Name, err)
+				} else {
+					logger.Debug("Keepalive %d sent through tunnel '%s'", stats.Sent, t.Name)
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-sigs:
+				return nil
+			}
+		}
+	},
+}
+
+var tunnelReconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Compare the tunnels with the kernel and repair drift",
+	Long: `Compare the configuration of each tunnel with the kernel once and repair what
+drifted: a missing interface is recreated, the interface of a tunnel that is up
+is brought up again, and a missing kill-switch block route or traffic policy is
+reinstalled. Whether each tunnel is in sync is recorded and shown in the SYNC
+column of 'tunnel show'. 'tunnel reconcile run' keeps doing this.
+
+A tunnel that needed repairs on consecutive passes, such as one whose peer
+flaps, is repaired again only after a delay that doubles each time, from
+reconcile.backoff_initial up to reconcile.backoff_max seconds; 'tunnel status'
+shows when. --force repairs it now.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		force, _ := cmd.Flags().GetBool("force")
+		drift, err := tunnel.Reconcile(dryRun, force)
+		if err != nil {
+			return fail("Error reconciling tunnels: %v", err)
+		}
+		if len(drift) == 0 {
+			logger.Info("All tunnels are in sync")
+			fmt.Println("All tunnels are in sync")
+			return nil
+		}
+
+		tbl := table.New(
+			table.Column{Header: "TUNNEL", MaxWidth: 24},
+			table.Column{Header: "DRIFT", MaxWidth: 60},
+			table.Column{Header: "ACTION", Status: true},
+			table.Column{Header: "ERROR", MaxWidth: 50},
+		)
+		failed := false
+		for _, d := range drift {
+			switch {
+			case d.Repaired:
+				tbl.AddRow(d.Tunnel, d.Problem, "repaired", "-")
+			case errors.Is(d.Err, tunnel.ErrBackingOff):
+				tbl.AddRow(d.Tunnel, d.Problem, "deferred", d.Err.Error())
+			case d.Err != nil:
+				failed = true
+				tbl.AddRow(d.Tunnel, d.Problem, "failed", d.Err.Error())
+			default:
+				tbl.AddRow(d.Tunnel, d.Problem, "none", "-")
+			}
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		if failed {
+			return errFailed
+		}
+		return nil
+	},
+}
+
+var tunnelReconcileRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Keep the tunnels in sync with the kernel in the foreground",
+	Long: `Compare the tunnels with the kernel and repair drift every interval until
+interrupted, reconcile.interval seconds unless --interval is given.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		interval := tunnel.ReconcileInterval()
+		if cmd.Flags().Changed("interval") {
+			seconds, _ := cmd.Flags().GetInt("interval")
+			if seconds <= 0 {
+				return fail("Error: --interval must be positive")
+			}
+			interval = time.Duration(seconds) * time.Second
+		}
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer watchLinks()()
+
+		logger.Info("Reconciling tunnels every %s", interval)
+		for {
+			drift, err := tunnel.Reconcile(false, false)
+			if err != nil {
+				logger.Error("Error reconciling tunnels: %v", err)
+			}
+			for _, d := range drift {
+				if errors.Is(d.Err, tunnel.ErrBackingOff) {
+					continue
+				}
+				if d.Repaired {
+					fmt.Printf("%s  REPAIRED  %s  %s\n", time.Now().Format(time.DateTime), d.Tunnel, d.Problem)
+				} else {
+					fmt.Printf("%s  DRIFTED   %s  %s: %v\n", time.Now().Format(time.DateTime), d.Tunnel, d.Problem, d.Err)
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-sigs:
+				return nil
+			}
+		}
+	},
+}
+
+// watchLinks caches the interfaces for commands that run until interrupted,
+// returning a function that stops it
+func watchLinks() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		if err := tunnel.WatchLinks(ctx); err != nil {
+			logger.Error("Looking up interfaces without a cache: %v", err)
+		}
+	}()
+	return cancel
+}
+
+func init() {
+	// Add subcommands to tunnel command
+	tunnelCmd.AddCommand(tunnelCreateCmd)
+	tunnelCmd.AddCommand(tunnelApplyCmd)
+	tunnelCmd.AddCommand(tunnelCheckPeerCmd)
+	tunnelCmd.AddCommand(tunnelShowCmd)
+	tunnelCmd.AddCommand(tunnelStatusCmd)
+	tunnelCmd.AddCommand(tunnelDeleteCmd)
+	tunnelCmd.AddCommand(tunnelStartCmd)
+	tunnelCmd.AddCommand(tunnelStopCmd)
+	tunnelCmd.AddCommand(tunnelDrainCmd)
+	tunnelCmd.AddCommand(tunnelFlowsCmd)
+	tunnelCmd.AddCommand(tunnelStatsCmd)
+	tunnelCmd.AddCommand(tunnelPacketAccountingCmd)
+	tunnelPacketAccountingCmd.AddCommand(tunnelPacketAccountingEnableCmd)
+	tunnelPacketAccountingCmd.AddCommand(tunnelPacketAccountingDisableCmd)
+	tunnelCmd.AddCommand(tunnelExecCmd)
+	tunnelCmd.AddCommand(tunnelExportPeerCmd)
+	tunnelCmd.AddCommand(tunnelKillSwitchCmd)
+	tunnelKillSwitchCmd.AddCommand(tunnelKillSwitchEnableCmd)
+	tunnelKillSwitchCmd.AddCommand(tunnelKillSwitchDisableCmd)
+	tunnelCmd.AddCommand(tunnelDefaultRouteCmd)
+	tunnelDefaultRouteCmd.AddCommand(tunnelDefaultRouteEnableCmd)
+	tunnelDefaultRouteCmd.AddCommand(tunnelDefaultRouteDisableCmd)
+	tunnelDefaultRouteCmd.AddCommand(tunnelDefaultRouteGuardCmd)
+	tunnelCmd.AddCommand(tunnelPinCmd)
+	tunnelPinCmd.AddCommand(tunnelPinSetCmd)
+	tunnelPinCmd.AddCommand(tunnelPinTOFUCmd)
+	tunnelPinCmd.AddCommand(tunnelPinClearCmd)
+	tunnelCmd.AddCommand(tunnelAcceptCmd)
+	tunnelCmd.AddCommand(tunnelReleaseCmd)
+	tunnelCmd.AddCommand(tunnelVirtualIPCmd)
+	tunnelVirtualIPCmd.AddCommand(tunnelVirtualIPSetCmd)
+	tunnelVirtualIPCmd.AddCommand(tunnelVirtualIPClearCmd)
+	tunnelVirtualIPCmd.AddCommand(tunnelVirtualIPPoolCmd)
+	tunnelCmd.AddCommand(tunnelShortcutCmd)
+	tunnelShortcutCmd.AddCommand(tunnelShortcutEnableCmd)
+	tunnelShortcutCmd.AddCommand(tunnelShortcutDisableCmd)
+	tunnelShortcutCmd.AddCommand(tunnelShortcutScanCmd)
+	tunnelShortcutCmd.AddCommand(tunnelShortcutAddCmd)
+	tunnelShortcutCmd.AddCommand(tunnelShortcutListCmd)
+	tunnelShortcutCmd.AddCommand(tunnelShortcutRemoveCmd)
+	tunnelShortcutCmd.AddCommand(tunnelShortcutPruneCmd)
+	tunnelCmd.AddCommand(tunnelRateLimitCmd)
+	tunnelRateLimitCmd.AddCommand(tunnelRateLimitSetCmd)
+	tunnelRateLimitCmd.AddCommand(tunnelRateLimitClearCmd)
+	tunnelCmd.AddCommand(tunnelTuneCmd)
+	tunnelTuneCmd.AddCommand(tunnelTuneShowCmd)
+	tunnelTuneCmd.AddCommand(tunnelTuneSetCmd)
+	tunnelTuneCmd.AddCommand(tunnelTuneClearCmd)
+	tunnelCmd.AddCommand(tunnelHooksCmd)
+	tunnelHooksCmd.AddCommand(tunnelHooksSetCmd)
+	tunnelHooksCmd.AddCommand(tunnelHooksClearCmd)
+	tunnelCmd.AddCommand(tunnelInspectCmd)
+	tunnelInspectCmd.AddCommand(tunnelInspectSetCmd)
+	tunnelInspectCmd.AddCommand(tunnelInspectClearCmd)
+	tunnelCmd.AddCommand(tunnelUplinkCmd)
+	tunnelUplinkCmd.AddCommand(tunnelUplinkSetCmd)
+	tunnelUplinkCmd.AddCommand(tunnelUplinkClearCmd)
+	tunnelCmd.AddCommand(tunnelLabelCmd)
+	tunnelCmd.AddCommand(tunnelPolicyCmd)
+	tunnelPolicyCmd.AddCommand(tunnelPolicyAddCmd)
+	tunnelPolicyCmd.AddCommand(tunnelPolicyRemoveCmd)
+	tunnelPolicyCmd.AddCommand(tunnelPolicyClearCmd)
+	tunnelPolicyCmd.AddCommand(tunnelPolicyListCmd)
+	tunnelCmd.AddCommand(tunnelDebugCmd)
+	tunnelDebugCmd.AddCommand(tunnelDebugEnableCmd)
+	tunnelDebugCmd.AddCommand(tunnelDebugDisableCmd)
+	tunnelDebugCmd.AddCommand(tunnelDebugShowCmd)
+	tunnelCmd.AddCommand(tunnelSLACmd)
+	tunnelSLACmd.AddCommand(tunnelSLASetCmd)
+	tunnelSLACmd.AddCommand(tunnelSLAClearCmd)
+	tunnelSLACmd.AddCommand(tunnelSLARunCmd)
+	tunnelSLACmd.AddCommand(tunnelSLAResponderCmd)
+	tunnelCmd.AddCommand(tunnelKeepaliveCmd)
+	tunnelKeepaliveCmd.AddCommand(tunnelKeepaliveSetCmd)
+	tunnelKeepaliveCmd.AddCommand(tunnelKeepaliveClearCmd)
+	tunnelKeepaliveCmd.AddCommand(tunnelKeepaliveRunCmd)
+	tunnelCmd.AddCommand(tunnelSALifetimeCmd)
+	tunnelSALifetimeCmd.AddCommand(tunnelSALifetimeSetCmd)
+	tunnelSALifetimeCmd.AddCommand(tunnelSALifetimeClearCmd)
+	tunnelSALifetimeCmd.AddCommand(tunnelSALifetimeWatchCmd)
+	tunnelCmd.AddCommand(tunnelReauthCmd)
+	tunnelReauthCmd.AddCommand(tunnelReauthSetCmd)
+	tunnelReauthCmd.AddCommand(tunnelReauthClearCmd)
+	tunnelReauthCmd.AddCommand(tunnelReauthReportCmd)
+	tunnelCmd.AddCommand(tunnelReconcileCmd)
+	tunnelReconcileCmd.AddCommand(tunnelReconcileRunCmd)
+
+	// Flags for create command
+	tunnelCreateCmd.Flags().String("local-ip", "", "Local IP address for the tunnel")
+	tunnelCreateCmd.Flags().String("remote-ip", "", "Remote IP address for the tunnel, or %any to accept initiators from any address, see --peer-id and --peer-ca")
+	tunnelCreateCmd.Flags().String("local-subnet", "", "Local subnet to be tunneled (CIDR notation)")
+	tunnelCreateCmd.Flags().String("remote-subnet", "", "Remote subnet to be tunneled (CIDR notation)")
+	tunnelCreateCmd.Flags().String("encryption", "aes256gcm", "Encryption algorithm (aes256gcm, chacha20poly1305, or auto to pick the fastest for this host); defaults to tunnel_defaults.encryption")
+	tunnelCreateCmd.Flags().Bool("post-quantum", false, "Enable post-quantum cryptography; defaults to tunnel_defaults.post_quantum")
+	tunnelCreateCmd.Flags().Bool("kill-switch", false, "Drop traffic to the remote subnet while the tunnel is down; see also security.kill_switch")
+	tunnelCreateCmd.Flags().String("rate-limit", "", "Limit the peer's bandwidth in each direction, e.g. 10mbit")
+	tunnelTuneShowCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	tunnelTuneShowCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+	tunnelTuneSetCmd.Flags().String("mtu", "", "MTU of the tunnel interface, or auto to fit the underlay")
+	tunnelTuneSetCmd.Flags().Int("underlay-mtu", 0, "MTU of the underlay interface, such as 9000 for jumbo frames")
+	tunnelTuneSetCmd.Flags().StringSlice("offload", nil, "Offloads of the tunnel interface, such as gso=on,gro=on")
+	tunnelTuneSetCmd.Flags().StringSlice("underlay-offload", nil, "Offloads of the underlay interface, such as gro=on,lro=off")
+	tunnelPinTOFUCmd.Flags().Bool("disable", false, "Turn trust-on-first-use off again")
+	tunnelAcceptCmd.Flags().String("id", "", "IKE identity of the initiator; defaults to the common name of its certificate")
+	tunnelAcceptCmd.Flags().String("address", "", "Address the initiator connected from")
+	tunnelAcceptCmd.Flags().String("subnet", "", "Subnet behind the initiator, within the responder's remote subnet; defaults to its virtual IP")
+	tunnelAcceptCmd.Flags().String("cert", "", "PEM file with the certificate chain the initiator authenticated with, leaf first")
+	tunnelAcceptCmd.MarkFlagRequired("address")
+	tunnelVirtualIPCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	tunnelVirtualIPCmd.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+	tunnelShortcutScanCmd.Flags().Uint64("min-bytes", tunnel.DefaultShortcutMinBytes, "Traffic between two spokes through the hub past which they are offered a shortcut")
+	tunnelShortcutScanCmd.Flags().Bool("offer", false, "Offer the spokes found shortcuts to each other")
+	tunnelShortcutAddCmd.Flags().String("id", "", "IKE identity of the other spoke")
+	tunnelShortcutAddCmd.Flags().String("address", "", "Address of the other spoke")
+	tunnelShortcutAddCmd.Flags().String("subnet", "", "Subnet behind the other spoke, within the remote subnet of via")
+	tunnelShortcutAddCmd.MarkFlagRequired("id")
+	tunnelShortcutAddCmd.MarkFlagRequired("address")
+	tunnelShortcutAddCmd.MarkFlagRequired("subnet")
+	for _, c := range []*cobra.Command{tunnelShortcutScanCmd, tunnelShortcutListCmd} {
+		c.Flags().Bool("wide", false, "Show all columns without truncation")
+		c.Flags().Bool("json", false, "Print machine-readable JSON instead of a table")
+	}
+	tunnelCreateCmd.Flags().String("pin", "", "Only accept a peer presenting this key fingerprint, or the key of this certificate file")
+	tunnelCreateCmd.Flags().Bool("tofu", false, "Pin the key of the first peer to authenticate")
+	tunnelCreateCmd.Flags().String("peer-id", "", "With --remote-ip %any, accept initiators whose identity matches this pattern, e.g. '*.branches.example.com'")
+	tunnelCreateCmd.Flags().String("peer-ca", "", "With --remote-ip %any, accept initiators with a certificate issued by this CA certificate file, or 'hub' for this hub's CA")
+	tunnelCreateCmd.Flags().String("virtual-ip-pool", "", "With --remote-ip %any, lease each initiator a virtual IP from this subnet, kept across reconnects")
+	tunnelCreateCmd.Flags().Bool("shortcuts", false, "With --remote-ip %any, broker direct tunnels between initiators exchanging traffic through this hub")
+	tunnelCreateCmd.Flags().StringArray("virtual-ip", nil, "With --remote-ip %any, assign an initiator this virtual IP or subnet, as identity=address; can be repeated")
+	tunnelCreateCmd.Flags().String("peer-group", "", "Share the authentication method, proposals and DPD settings of this peer group, see 'ipsec-vpn peer-group'")
+	tunnelCreateCmd.Flags().String("psk-ref", "", "Where the pre-shared key is kept: vault://path[#field], env://NAME, file:///path or key://NAME, resolved each time the tunnel starts")
+	tunnelCreateCmd.Flags().String("peer-spiffe-id", "", "Authenticate the peer by its X.509-SVID, accepting this SPIFFE ID or every workload of this trust domain")
+	tunnelExportPeerCmd.Flags().String("format", tunnel.FormatOPNsense, "Firewall to export for ("+strings.Join(tunnel.ExportFormats, ", ")+")")
+	tunnelExportPeerCmd.Flags().Int("ikeid", 1, "Phase 1 ID on OPNsense or pfSense, or crypto map sequence number on Cisco, which must not be taken")
+	tunnelCreateCmd.Flags().String("mode", tunnel.ModeIPsec, "Tunnel mode (ipsec, wireguard)")
+	tunnelCreateCmd.Flags().String("wireguard-peer-key", "", "Public key of the peer in wireguard mode, as printed by 'wg pubkey'")
+	tunnelCreateCmd.Flags().Int("listen-port", tunnel.DefaultWireGuardPort, "UDP port both ends listen on in wireguard mode")
+	tunnelCreateCmd.Flags().String("check-peer", tunnel.CheckPeerOff, "Probe the peer before creating anything and, if it looks unreachable, warn or abort; defaults to tunnel_defaults.check_peer")
+	tunnelCreateCmd.Flags().Lookup("check-peer").NoOptDefVal = tunnel.CheckPeerAbort
+	tunnelCreateCmd.Flags().String("netns", "", "Move the tunnel interface into this network namespace, created if needed; 'dedicated' creates one just for this tunnel")
+	addAsyncFlag(tunnelCreateCmd)
+
+	// Mark required flags
+	tunnelCreateCmd.MarkFlagRequired("local-ip")
+	tunnelCreateCmd.MarkFlagRequired("remote-ip")
+	tunnelCreateCmd.MarkFlagRequired("local-subnet")
+	tunnelCreateCmd.MarkFlagRequired("remote-subnet")
+
+	// Flags for apply command
+	tunnelApplyCmd.Flags().StringP("file", "f", "", "YAML file, or template, declaring the tunnels")
+	tunnelApplyCmd.Flags().StringSlice("values", nil, "YAML values file, or glob, to render the file with; repeat to render it once for each")
+	tunnelApplyCmd.Flags().StringArray("set", nil, "Set a value, key=value, over those of the environment and values files")
+	tunnelApplyCmd.Flags().Bool("dry-run", false, "Show what would be created and relabeled without changing anything")
+	tunnelApplyCmd.Flags().Bool("render", false, "Print the file as rendered and exit")
+	tunnelApplyCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	tunnelApplyCmd.MarkFlagRequired("file")
+	tunnelApplyCmd.MarkFlagsMutuallyExclusive("dry-run", "render")
+
+	// Flags for check-peer command
+	tunnelCheckPeerCmd.Flags().String("mode", tunnel.ModeIPsec, "Tunnel mode (ipsec, wireguard), which decides the port probed")
+	tunnelCheckPeerCmd.Flags().Int("listen-port", tunnel.DefaultWireGuardPort, "UDP port the peer listens on in wireguard mode")
+
+	// Flags for show command
+	tunnelShowCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	tunnelShowCmd.Flags().StringP("selector", "l", "", "Only list tunnels with these labels, e.g. site=fra,env!=lab")
+	addWatchFlag(tunnelShowCmd)
+	addJSONFlag(tunnelShowCmd)
+
+	// Flags for status command
+	tunnelStatusCmd.Flags().BoolP("quiet", "q", false, "Print nothing, only set the exit code")
+
+	// Commands that can cut off the operator can be reverted unless confirmed
+	addConfirmFlag(tunnelStartCmd, tunnelDefaultRouteEnableCmd, tunnelKillSwitchEnableCmd, tunnelPolicyAddCmd, tunnelInspectSetCmd)
+
+	// Flags for default-route commands
+	tunnelDefaultRouteEnableCmd.Flags().StringSlice("dns", nil, "DNS servers to resolve through while all traffic goes through the tunnel")
+	tunnelDefaultRouteGuardCmd.Flags().Int("interval", 2, "Seconds between checks of the tunnel")
+
+	// Flags for SLA commands
+	tunnelSLACmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	tunnelSLACmd.Flags().Int("history", 10, "Number of recent results to show for a tunnel")
+	tunnelSLASetCmd.Flags().String("target", "", "Address in the remote subnet to probe, with a port for udp probes (default 7)")
+	tunnelSLASetCmd.Flags().String("type", tunnel.ProbeICMP, "Probe type (icmp, udp)")
+	tunnelSLASetCmd.Flags().Duration("interval", tunnel.DefaultSLAInterval, "Time between probe operations")
+	tunnelSLASetCmd.Flags().Int("count", tunnel.DefaultSLACount, "Probes sent per operation, 20ms apart")
+	tunnelSLASetCmd.Flags().Duration("max-latency", 0, "Highest acceptable mean round-trip time, e.g. 150ms")
+	tunnelSLASetCmd.Flags().Duration("max-jitter", 0, "Highest acceptable jitter, e.g. 30ms")
+	tunnelSLASetCmd.Flags().Float64("max-loss", 0, "Highest acceptable loss in percent, e.g. 1")
+	tunnelSLASetCmd.MarkFlagRequired("target")
+	tunnelSLAResponderCmd.Flags().String("listen", ":7", "UDP address to echo probes on")
+
+	// Flags for keepalive commands
+	tunnelKeepaliveCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+
+	// Flags for SA lifetime commands
+	tunnelSALifetimeSetCmd.Flags().Duration("soft-time", 0, "Rekey SAs after this long, e.g. 50m (default from tunnel_defaults.sa_lifetime)")
+	tunnelSALifetimeSetCmd.Flags().Duration("hard-time", 0, "Delete SAs after this long, e.g. 1h")
+	tunnelSALifetimeSetCmd.Flags().String("soft-bytes", "", "Rekey SAs after they carried this many bytes, e.g. 3.5GiB")
+	tunnelSALifetimeSetCmd.Flags().String("hard-bytes", "", "Delete SAs after they carried this many bytes, e.g. 4GiB")
+	tunnelSALifetimeSetCmd.Flags().Uint64("soft-packets", 0, "Rekey SAs after they carried this many packets")
+	tunnelSALifetimeSetCmd.Flags().Uint64("hard-packets", 0, "Delete SAs after they carried this many packets")
+	tunnelReauthSetCmd.Flags().Duration("interval", 0, "Reauthenticate the IKE SA this often, e.g. 8h, 0 to only rekey")
+	tunnelReauthSetCmd.Flags().Duration("grace", 0, "How long the SAs outlive a reauthentication that is due (default advanced.reauth_grace, at most half the interval)")
+	tunnelReauthSetCmd.MarkFlagRequired("interval")
+	tunnelReauthReportCmd.Flags().String("result", "", "Outcome of the reauthentication ("+strings.Join(tunnel.ReauthResults, ", ")+")")
+	tunnelReauthReportCmd.Flags().String("reason", "", "Why the reauthentication failed")
+	tunnelReauthReportCmd.MarkFlagRequired("result")
+
+	// Flags for reconcile commands
+	tunnelReconcileCmd.Flags().Bool("dry-run", false, "Only report drift, repair nothing")
+	tunnelReconcileCmd.Flags().Bool("force", false, "Repair tunnels the reconciler is backing off from too")
+	tunnelReconcileCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	tunnelReconcileRunCmd.Flags().Int("interval", 0, "Seconds between passes (default from reconcile.interval)")
+
+	// Flags for hooks commands
+	tunnelHooksSetCmd.Flags().String(tunnel.HookPreUp, "", "Command to run before the tunnel is started")
+	tunnelHooksSetCmd.Flags().String(tunnel.HookPostUp, "", "Command to run after the tunnel is up")
+	tunnelHooksSetCmd.Flags().String(tunnel.HookPreDown, "", "Command to run before the tunnel is stopped")
+	tunnelHooksSetCmd.Flags().String(tunnel.HookPostDown, "", "Command to run after the tunnel is down")
+
+	// Flags for inspect commands
+	tunnelInspectSetCmd.Flags().String("interface", "", "Route the traffic through this interface")
+	tunnelInspectSetCmd.Flags().String("gateway", "", "Next hop on the inspection interface, if the device is not on the link")
+	tunnelInspectSetCmd.Flags().Uint16("queue", 0, "Hand the traffic to the program listening on this NFQUEUE")
+	tunnelInspectSetCmd.Flags().Bool("bypass", false, "Let traffic through while nothing listens on the queue, rather than dropping it")
+	tunnelInspectSetCmd.MarkFlagsOneRequired("interface", "queue")
+	tunnelInspectSetCmd.MarkFlagsMutuallyExclusive("interface", "queue")
+
+	// Flags for flows command
+	tunnelFlowsCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+
+	// Flags for stats command
+	tunnelStatsCmd.Flags().Bool("detailed", false, "Break the traffic down by protocol and direction, and list the drops by reason")
+	tunnelStatsCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+	tunnelStatsCmd.Flags().Bool("json", false, "Print machine-readable JSON")
+
+	// Flags for drain command
+	tunnelDrainCmd.Flags().Duration("timeout", tunnel.DefaultDrainTimeout, "Longest time to wait for traffic to stop before stopping the tunnel anyway")
 
 	// Flags for delete command
 	tunnelDeleteCmd.Flags().Bool("force", false, "Force deletion even if tunnel is active")
+	addYesFlag(tunnelDeleteCmd)
+	addApprovalFlag(tunnelDeleteCmd)
 }
\ No newline at end of file
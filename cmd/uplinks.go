@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// uplinksCmd represents the uplinks command
+var uplinksCmd = &cobra.Command{
+	Use:   "uplinks",
+	Short: "Spread tunnels over several WAN uplinks",
+	Long: `Uplinks are the WAN interfaces listed under uplinks in the configuration, each
+with an optional gateway and capacity. Tunnels bound to an uplink, or to "auto",
+with "ipsec-vpn tunnel uplink set" are moved to another uplink when theirs goes
+down: their local address becomes the new uplink's address and the route to
+their peer goes out of the new uplink. Auto tunnels go to the uplink with the
+most capacity left after the rate limits of the tunnels already on it.`,
+}
+
+var uplinksShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the uplinks and the tunnels they carry",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		uplinks, err := tunnel.Uplinks()
+		if err != nil {
+			return fail("Error reading uplinks: %v", err)
+		}
+		if len(uplinks) == 0 {
+			fmt.Println("No uplinks configured")
+			return nil
+		}
+		tunnels, err := tunnel.ListAll()
+		if err != nil {
+			return fail("Error listing tunnels: %v", err)
+		}
+
+		tbl := table.New(
+			table.Column{Header: "NAME"},
+			table.Column{Header: "INTERFACE"},
+			table.Column{Header: "STATE", Status: true},
+			table.Column{Header: "ADDRESS", MaxWidth: 40},
+			table.Column{Header: "CAPACITY"},
+			table.Column{Header: "BOOKED"},
+			table.Column{Header: "TUNNELS", MaxWidth: 40},
+		)
+		for _, u := range uplinks {
+			state := "DOWN"
+			if u.Up {
+				state = "UP"
+			}
+			addresses := make([]string, len(u.Addresses))
+			for i, a := range u.Addresses {
+				addresses[i] = a.String()
+			}
+			capacity := "-"
+			if u.Capacity > 0 {
+				capacity = network.FormatRate(u.Capacity)
+			}
+			var booked uint64
+			var carried []string
+			for _, t := range tunnels {
+				if tunnel.UplinkOf(t, uplinks) == u {
+					booked += t.RateLimit
+					carried = append(carried, t.Name)
+				}
+			}
+			tbl.AddRow(u.Name, u.Interface, state, strings.Join(addresses, ", "), capacity,
+				network.FormatRate(booked), cmp.Or(strings.Join(carried, ", "), "-"))
+		}
+		tbl.Render(os.Stdout, tableOptions(cmd))
+		return nil
+	},
+}
+
+var uplinksRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Move tunnels between uplinks as they go up and down, in the foreground",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		interval, _ := cmd.Flags().GetInt("interval")
+		if interval <= 0 {
+			return fail("Error: the interval must be a positive number of seconds")
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+
+		logger.Info("Checking uplinks every %d seconds", interval)
+		for {
+			moves, err := tunnel.RebalanceUplinks()
+			if err != nil {
+				logger.Error("Error rebalancing uplinks: %v", err)
+			}
+			for _, m := range moves {
+				if m.Err != nil {
+					logger.Error("Failed to move tunnel '%s' to uplink '%s': %v", m.Tunnel, m.To, m.Err)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-sigs:
+				return nil
+			}
+		}
+	},
+}
+
+var uplinksRebalanceCmd = &cobra.Command{
+	Use:   "rebalance",
+	Short: "Move tunnels off uplinks that are down, once",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		moves, err := tunnel.RebalanceUplinks()
+		if err != nil {
+			return fail("Error rebalancing uplinks: %v", err)
+		}
+		if len(moves) == 0 {
+			fmt.Println("All tunnels are on the right uplink")
+			return nil
+		}
+
+		failed := 0
+		for _, m := range moves {
+			if m.Err != nil {
+				fmt.Printf("Failed to move tunnel '%s' to uplink '%s': %v\n", m.Tunnel, m.To, m.Err)
+				failed++
+				continue
+			}
+			if m.From == "" {
+				fmt.Printf("Moved tunnel '%s' onto uplink '%s'\n", m.Tunnel, m.To)
+			} else {
+				fmt.Printf("Moved tunnel '%s' from uplink '%s' to '%s'\n", m.Tunnel, m.From, m.To)
+			}
+		}
+		if failed > 0 {
+			return errFailed
+		}
+		return nil
+	},
+}
+
+func init() {
+	uplinksCmd.AddCommand(uplinksShowCmd)
+	uplinksCmd.AddCommand(uplinksRunCmd)
+	uplinksCmd.AddCommand(uplinksRebalanceCmd)
+
+	// Flags for show command
+	uplinksShowCmd.Flags().Bool("wide", false, "Show all columns without truncation")
+
+	// Flags for run command
+	uplinksRunCmd.Flags().Int("interval", 5, "Seconds between checks of the uplinks")
+}
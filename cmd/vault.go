@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/vault"
+	"github.com/spf13/cobra"
+)
+
+// vaultTimeout bounds one-off Vault commands
+const vaultTimeout = 30 * time.Second
+
+// vaultCmd represents the vault command
+var vaultCmd = &cobra.Command{
+	Use:   "vault",
+	Short: "Fetch secrets and certificates from HashiCorp Vault",
+	Long: `Use HashiCorp Vault as the secrets backend instead of long-lived credentials on
+disk. Pre-shared keys are read from the KV secrets engine into the key agent with
+'ipsec-vpn agent add --vault', and short-lived certificates are issued by the PKI
+secrets engine and renewed before they expire.
+
+The server is vault.address or ` + vault.AddressEnv + `, authenticated with ` + vault.TokenEnv + `,
+vault.token_file, or the token the vault CLI stored on login.`,
+}
+
+var vaultStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Check the connection to Vault and the token in use",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := vault.FromConfig()
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), vaultTimeout)
+		defer cancel()
+		info, err := client.LookupToken(ctx)
+		if err != nil {
+			return fail("Error looking up Vault token: %v", err)
+		}
+
+		ttl := "never expires"
+		if info.TTL > 0 {
+			ttl = info.TTL.String()
+			if info.Renewable {
+				ttl += ", renewable"
+			}
+		}
+		fmt.Printf("Address: %s\n", vault.Address())
+		fmt.Printf("Token: %s\n", orDash(info.DisplayName))
+		fmt.Printf("Policies: %s\n", strings.Join(info.Policies, ", "))
+		fmt.Printf("TTL: %s\n", ttl)
+		return nil
+	},
+}
+
+var vaultIssueCmd = &cobra.Command{
+	Use:   "issue [common-name]",
+	Short: "Issue a short-lived certificate from the PKI secrets engine",
+	Long: `Issue a certificate for a common name from vault.pki_role, valid for
+vault.certificate_ttl. With --out, the certificate chain, private key and CA chain
+are written to cert.pem, key.pem and ca.pem in a directory. With --renew, the
+command keeps running and replaces them after two thirds of each certificate's
+lifetime.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		commonName := args[0]
+		out, _ := cmd.Flags().GetString("out")
+		renew, _ := cmd.Flags().GetBool("renew")
+		if renew && out == "" {
+			return fail("Error: --renew requires --out")
+		}
+
+		client, err := vault.FromConfig()
+		if err != nil {
+			return fail("Error: %v", err)
+		}
+
+		if !renew {
+			ctx, cancel := context.WithTimeout(cmd.Context(), vaultTimeout)
+			defer cancel()
+			cert, err := client.IssueCertificate(ctx, commonName)
+			if err != nil {
+				return fail("Error issuing certificate for %s: %v", commonName, err)
+			}
+			if out != "" {
+				if err := writeCertificate(out, cert.CertificatePEM, cert.PrivateKeyPEM, cert.CAChainPEM); err != nil {
+					return fail("Error writing certificate: %v", err)
+				}
+			}
+			printCertificate(cert.Certificate, cert.SerialNumber, out)
+			return nil
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		_ = client.WatchCertificate(ctx, commonName, func(cert *vault.Certificate) {
+			if err := writeCertificate(out, cert.CertificatePEM, cert.PrivateKeyPEM, cert.CAChainPEM); err != nil {
+				logger.Error("Failed to write certificate: %v", err)
+				return
+			}
+			printCertificate(cert.Certificate, cert.SerialNumber, out)
+		})
+		return nil
+	},
+}
+
+// printCertificate prints a summary of an issued certificate
+func printCertificate(cert *x509.Certificate, serial, out string) {
+	fmt.Printf("Serial: %s\n", serial)
+	fmt.Printf("Subject: %s\n", cert.Subject)
+	fmt.Printf("Valid: %s to %s\n", cert.NotBefore.Format(time.DateTime), cert.NotAfter.Format(time.DateTime))
+	if out != "" {
+		fmt.Printf("Written to: %s\n", out)
+	}
+}
+
+// writeCertificate writes an issued certificate, its private key and CA to
+// cert.pem, key.pem and ca.pem, replacing each file atomically so readers never
+// see a half-written one
+func writeCertificate(dir, certPEM, keyPEM, caPEM string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, file := range []struct {
+		name string
+		data string
+		mode os.FileMode
+	}{
+		{"key.pem", keyPEM, 0600},
+		{"cert.pem", certPEM, 0644},
+		{"ca.pem", caPEM, 0644},
+	} {
+		path := filepath.Join(dir, file.name)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(strings.TrimSpace(file.data)+"\n"), file.mode); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	vaultCmd.AddCommand(vaultStatusCmd)
+	vaultCmd.AddCommand(vaultIssueCmd)
+
+	vaultIssueCmd.Flags().String("out", "", "Write cert.pem, key.pem and ca.pem to this directory")
+	vaultIssueCmd.Flags().Bool("renew", false, "Keep running and renew the certificate before it expires")
+}
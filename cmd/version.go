@@ -19,8 +19,9 @@ var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Print the version number",
 	Long:  `Display the version, commit, and build date information for the IPsec VPN application.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		logger.Info("Displaying version information: v%s (commit: %s, built: %s)", Version, Commit, BuildDate)
 		fmt.Printf("IPsec VPN v%s (commit: %s, built: %s)\n", Version, Commit, BuildDate)
+		return nil
 	},
 }
\ No newline at end of file
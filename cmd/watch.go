@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+	"github.com/spf13/cobra"
+)
+
+// defaultWatchInterval is the refresh interval used when --watch is given without a value
+const defaultWatchInterval = "2"
+
+// clearScreen moves the cursor home and clears the terminal
+const clearScreen = "\033[H\033[2J"
+
+// addWatchFlag adds --watch/-w to a show command
+func addWatchFlag(cmd *cobra.Command) {
+	cmd.Flags().IntP("watch", "w", 0, "Refresh the output every N seconds (default "+defaultWatchInterval+" when given without a value), highlighting changes")
+	cmd.Flags().Lookup("watch").NoOptDefVal = defaultWatchInterval
+}
+
+// watchInterval returns the refresh interval requested with --watch, or 0 when not watching
+func watchInterval(cmd *cobra.Command) time.Duration {
+	seconds, _ := cmd.Flags().GetInt("watch")
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// watch repeatedly renders output until interrupted. On a terminal the screen is
+// redrawn in place and, when color is enabled, lines that changed since the
+// previous refresh are highlighted.
+func watch(cmd *cobra.Command, render func(w io.Writer)) {
+	interval := watchInterval(cmd)
+	tty := table.IsTerminal(os.Stdout)
+	highlight := table.ColorEnabled(noColor)
+
+	// Per-refresh log messages would scroll the display away
+	logger.SetQuiet()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	title := fmt.Sprintf("Every %s: %s", interval, strings.Join(os.Args, " "))
+	var previous string
+	for {
+		var buf bytes.Buffer
+		render(&buf)
+		frame := buf.String()
+
+		output := frame
+		if highlight && previous != "" {
+			output = table.Highlight(previous, frame)
+		}
+		previous = frame
+
+		if tty {
+			fmt.Print(clearScreen)
+		}
+		fmt.Printf("%s    %s\n\n%s", title, time.Now().Format(time.DateTime), output)
+		if !tty {
+			fmt.Println()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,86 @@
+# -*- coding: utf-8 -*-
+# Copyright (c) 2023 Dzakwan
+# MIT License (see LICENSE in the repository root)
+
+"""Shared helpers for the ipsecvpn modules, which drive the ipsec-vpn CLI and
+read its state from the JSON printed by the show commands."""
+
+from __future__ import absolute_import, division, print_function
+__metaclass__ = type
+
+import json
+
+# Options every module accepts
+COMMON_ARGS = dict(
+    binary=dict(type='str', default='ipsec-vpn'),
+    config=dict(type='path'),
+)
+
+# tc rate units in bits per second, as accepted by 'tunnel rate-limit set'
+RATE_UNITS = (
+    ('gbit', 1000 ** 3),
+    ('mbit', 1000 ** 2),
+    ('kbit', 1000),
+    ('gbps', 8 * 1000 ** 3),
+    ('mbps', 8 * 1000 ** 2),
+    ('kbps', 8 * 1000),
+    ('bit', 1),
+    ('bps', 8),
+)
+
+
+def parse_rate(rate):
+    """Convert a rate in tc notation such as 10mbit to bits per second, the way
+    ipsec-vpn stores it, or return None if it cannot be parsed."""
+    lower = rate.strip().lower()
+    for suffix, bits in RATE_UNITS:
+        if lower.endswith(suffix):
+            try:
+                return int(float(lower[:-len(suffix)]) * bits)
+            except ValueError:
+                return None
+    return None
+
+
+class IpsecVpn(object):
+    """Runs ipsec-vpn commands on behalf of a module"""
+
+    def __init__(self, module):
+        self.module = module
+        self.binary = module.get_bin_path(module.params['binary'], required=True)
+
+    def command(self, *args):
+        cmd = [self.binary]
+        if self.module.params.get('config'):
+            cmd += ['--config', self.module.params['config']]
+        return cmd + list(args)
+
+    def run(self, *args):
+        """Run a command, failing the module if it exits non-zero"""
+        cmd = self.command(*args)
+        rc, out, err = self.module.run_command(cmd)
+        if rc != 0:
+            # Commands print their error last, after any log messages
+            lines = (out.strip() or err.strip()).splitlines() or ['exit status %d' % rc]
+            self.module.fail_json(msg='ipsec-vpn %s failed: %s' % (' '.join(args[:2]), lines[-1]),
+                                  cmd=cmd, rc=rc, stdout=out, stderr=err)
+        return out
+
+    def show(self, *args):
+        """Run a show command with --json and return the decoded output"""
+        out = self.run(*(args + ('--json',)))
+        try:
+            return json.loads(out)
+        except ValueError as e:
+            self.module.fail_json(msg='cannot parse the output of ipsec-vpn %s: %s' % (' '.join(args), e),
+                                  stdout=out)
+
+    def tunnel(self, name):
+        """Return the tunnel with this name, or None if it does not exist"""
+        for tunnel in self.show('tunnel', 'show'):
+            if tunnel['name'] == name:
+                return tunnel
+        return None
+
+    def routes(self):
+        return self.show('network', 'show', '--routes').get('routes') or []
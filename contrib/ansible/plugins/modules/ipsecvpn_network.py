@@ -0,0 +1,116 @@
+#!/usr/bin/python
+# -*- coding: utf-8 -*-
+# Copyright (c) 2023 Dzakwan
+# MIT License (see LICENSE in the repository root)
+
+from __future__ import absolute_import, division, print_function
+__metaclass__ = type
+
+DOCUMENTATION = r'''
+---
+module: ipsecvpn_network
+short_description: Advertise networks through ipsec-vpn tunnels
+description:
+  - Advertise or withdraw a network through a tunnel with C(ipsec-vpn network advertise)
+    and C(ipsec-vpn network withdraw).
+  - A network counts as advertised when C(ipsec-vpn network show --routes --json) lists a
+    route to it through the tunnel's interface, so nothing is run when it already is.
+options:
+  network:
+    description: Network in CIDR notation. Host bits are ignored.
+    type: str
+    required: true
+  tunnel:
+    description: Tunnel interface to advertise the network through, as given to C(--tunnel).
+    type: str
+    required: true
+  metric:
+    description: Metric of the advertised route. A different metric advertises the network again.
+    type: int
+    default: 100
+  state:
+    description: Whether the network should be advertised.
+    type: str
+    choices: [present, absent]
+    default: present
+  binary:
+    description: Name or path of the ipsec-vpn binary.
+    type: str
+    default: ipsec-vpn
+  config:
+    description: Configuration file passed to ipsec-vpn with C(--config).
+    type: path
+notes:
+  - Supports check mode.
+'''
+
+EXAMPLES = r'''
+- name: Advertise the office LAN through the branch tunnel
+  dzakwan.ipsecvpn.ipsecvpn_network:
+    network: 172.16.0.0/24
+    tunnel: gre-branch
+    metric: 50
+'''
+
+RETURN = r'''
+route:
+  description: The route carrying the advertisement before any change, or null if there was none.
+  returned: always
+  type: dict
+commands:
+  description: The ipsec-vpn commands that were run, or would be run in check mode.
+  returned: always
+  type: list
+  elements: list
+'''
+
+import ipaddress
+
+from ansible.module_utils.basic import AnsibleModule
+from ansible.module_utils.common.text.converters import to_text
+from ansible_collections.dzakwan.ipsecvpn.plugins.module_utils.ipsecvpn import COMMON_ARGS, IpsecVpn
+
+
+def main():
+    argument_spec = dict(
+        network=dict(type='str', required=True),
+        tunnel=dict(type='str', required=True),
+        metric=dict(type='int', default=100),
+        state=dict(type='str', default='present', choices=['present', 'absent']),
+    )
+    argument_spec.update(COMMON_ARGS)
+    module = AnsibleModule(argument_spec=argument_spec, supports_check_mode=True)
+    params = module.params
+
+    try:
+        network = str(ipaddress.ip_network(to_text(params['network']), strict=False))
+    except ValueError as e:
+        module.fail_json(msg='invalid network: %s' % e)
+
+    cli = IpsecVpn(module)
+    route = None
+    for r in cli.routes():
+        if r['destination'] == network and r['interface'] == params['tunnel']:
+            route = r
+            break
+
+    withdraw = ['network', 'withdraw', network, '--tunnel', params['tunnel']]
+    advertise = ['network', 'advertise', network, '--tunnel', params['tunnel'], '--metric', str(params['metric'])]
+    commands = []
+    if params['state'] == 'absent':
+        if route is not None:
+            commands.append(withdraw)
+    elif route is None:
+        commands.append(advertise)
+    elif route['metric'] != params['metric']:
+        commands += [withdraw, advertise]
+
+    if commands and not module.check_mode:
+        for c in commands:
+            cli.run(*c)
+
+    module.exit_json(changed=bool(commands), commands=[cli.command(*c) for c in commands], route=route)
+
+
+if __name__ == '__main__':
+    main()
@@ -0,0 +1,259 @@
+#!/usr/bin/python
+# -*- coding: utf-8 -*-
+# Copyright (c) 2023 Dzakwan
+# MIT License (see LICENSE in the repository root)
+
+from __future__ import absolute_import, division, print_function
+__metaclass__ = type
+
+DOCUMENTATION = r'''
+---
+module: ipsecvpn_tunnel
+short_description: Manage ipsec-vpn tunnels
+description:
+  - Create, delete, start and stop tunnels with the ipsec-vpn CLI.
+  - The current state is read from C(ipsec-vpn tunnel show --json), so nothing is
+    run when the tunnel already matches.
+  - The addresses, subnets, cipher, mode and namespace of a tunnel cannot be changed
+    in place. When they differ the module fails, unless I(recreate=true).
+options:
+  name:
+    description: Name of the tunnel.
+    type: str
+    required: true
+  state:
+    description:
+      - C(present) makes sure the tunnel exists without starting or stopping it.
+      - C(started) and C(stopped) also bring it up or down.
+    type: str
+    choices: [present, absent, started, stopped]
+    default: present
+  local_ip:
+    description: Local IP address. Required to create the tunnel.
+    type: str
+  remote_ip:
+    description: Remote IP address. Required to create the tunnel.
+    type: str
+  local_subnet:
+    description: Local subnet in CIDR notation. Required to create the tunnel.
+    type: str
+  remote_subnet:
+    description: Remote subnet in CIDR notation. Required to create the tunnel.
+    type: str
+  encryption:
+    description:
+      - Cipher, or C(auto) to pick the fastest for the host. Defaults to
+        C(tunnel_defaults.encryption). C(auto) is never reported as a change.
+    type: str
+  post_quantum:
+    description: Use post-quantum key exchange. Defaults to C(tunnel_defaults.post_quantum).
+    type: bool
+  mode:
+    description: Tunnel mode.
+    type: str
+    choices: [ipsec, wireguard]
+  wireguard_peer_key:
+    description: Public key of the peer in wireguard mode.
+    type: str
+  listen_port:
+    description: UDP port in wireguard mode.
+    type: int
+  netns:
+    description:
+      - Network namespace to move the tunnel interface into, or C(dedicated) for one
+        of its own. C(dedicated) is never reported as a change.
+    type: str
+  kill_switch:
+    description: Drop traffic to the remote subnet while the tunnel is down. Changed in place.
+    type: bool
+  rate_limit:
+    description:
+      - Bandwidth limit in each direction in tc notation, e.g. C(10mbit). An empty
+        string removes the limit. Changed in place.
+    type: str
+  recreate:
+    description: Delete and create the tunnel again when a setting that cannot be changed in place differs.
+    type: bool
+    default: false
+  binary:
+    description: Name or path of the ipsec-vpn binary.
+    type: str
+    default: ipsec-vpn
+  config:
+    description: Configuration file passed to ipsec-vpn with C(--config).
+    type: path
+notes:
+  - Supports check mode and diff mode.
+'''
+
+EXAMPLES = r'''
+- name: Bring up the tunnel to the branch office
+  dzakwan.ipsecvpn.ipsecvpn_tunnel:
+    name: branch
+    state: started
+    local_ip: 192.0.2.1
+    remote_ip: 198.51.100.1
+    local_subnet: 10.0.0.0/16
+    remote_subnet: 10.1.0.0/16
+    encryption: aes256gcm
+    kill_switch: true
+    rate_limit: 50mbit
+
+- name: Remove it again
+  dzakwan.ipsecvpn.ipsecvpn_tunnel:
+    name: branch
+    state: absent
+'''
+
+RETURN = r'''
+tunnel:
+  description: The tunnel as printed by C(ipsec-vpn tunnel show --json), or null when absent. Not updated in check mode.
+  returned: always
+  type: dict
+commands:
+  description: The ipsec-vpn commands that were run, or would be run in check mode.
+  returned: always
+  type: list
+  elements: list
+'''
+
+from ansible.module_utils.basic import AnsibleModule
+from ansible_collections.dzakwan.ipsecvpn.plugins.module_utils.ipsecvpn import (
+    COMMON_ARGS, IpsecVpn, parse_rate,
+)
+
+# Options that cannot be changed without recreating the tunnel, and their
+# field in the JSON output
+IMMUTABLE = (
+    ('local_ip', 'local_ip'),
+    ('remote_ip', 'remote_ip'),
+    ('local_subnet', 'local_subnet'),
+    ('remote_subnet', 'remote_subnet'),
+    ('encryption', 'encryption'),
+    ('post_quantum', 'post_quantum'),
+    ('mode', 'mode'),
+    ('wireguard_peer_key', 'wireguard_peer_key'),
+    ('listen_port', 'listen_port'),
+    ('netns', 'namespace'),
+)
+
+# Values that are resolved by ipsec-vpn and cannot be compared
+RESOLVED = {'encryption': 'auto', 'netns': 'dedicated'}
+
+
+def immutable_changes(params, tunnel):
+    changes = []
+    for option, field in IMMUTABLE:
+        want = params[option]
+        if want is None or want == RESOLVED.get(option):
+            continue
+        if want != tunnel.get(field, type(want)()):
+            changes.append(option)
+    return changes
+
+
+def create_command(params):
+    missing = [o for o in ('local_ip', 'remote_ip', 'local_subnet', 'remote_subnet') if not params[o]]
+    if missing:
+        return None, missing
+
+    args = ['tunnel', 'create', params['name']]
+    for option in ('local_ip', 'remote_ip', 'local_subnet', 'remote_subnet', 'encryption', 'mode',
+                   'wireguard_peer_key', 'netns', 'rate_limit'):
+        if params[option]:
+            args += ['--' + option.replace('_', '-'), params[option]]
+    if params['listen_port'] is not None:
+        args += ['--listen-port', str(params['listen_port'])]
+    for option in ('post_quantum', 'kill_switch'):
+        if params[option] is not None:
+            args.append('--%s=%s' % (option.replace('_', '-'), str(params[option]).lower()))
+    return args, None
+
+
+def update_commands(params, tunnel):
+    name = params['name']
+    commands = []
+    if params['kill_switch'] is not None and params['kill_switch'] != tunnel.get('kill_switch', False):
+        commands.append(['tunnel', 'kill-switch', 'enable' if params['kill_switch'] else 'disable', name])
+    if params['rate_limit'] is not None:
+        current = tunnel.get('rate_limit', 0)
+        if params['rate_limit'] == '':
+            if current:
+                commands.append(['tunnel', 'rate-limit', 'clear', name])
+        elif parse_rate(params['rate_limit']) != current:
+            commands.append(['tunnel', 'rate-limit', 'set', name, params['rate_limit']])
+    return commands
+
+
+def main():
+    argument_spec = dict(
+        name=dict(type='str', required=True),
+        state=dict(type='str', default='present', choices=['present', 'absent', 'started', 'stopped']),
+        local_ip=dict(type='str'),
+        remote_ip=dict(type='str'),
+        local_subnet=dict(type='str'),
+        remote_subnet=dict(type='str'),
+        encryption=dict(type='str'),
+        post_quantum=dict(type='bool'),
+        mode=dict(type='str', choices=['ipsec', 'wireguard']),
+        wireguard_peer_key=dict(type='str', no_log=False),
+        listen_port=dict(type='int'),
+        netns=dict(type='str'),
+        kill_switch=dict(type='bool'),
+        rate_limit=dict(type='str'),
+        recreate=dict(type='bool', default=False),
+    )
+    argument_spec.update(COMMON_ARGS)
+    module = AnsibleModule(argument_spec=argument_spec, supports_check_mode=True)
+    params = module.params
+    name = params['name']
+    state = params['state']
+
+    cli = IpsecVpn(module)
+    tunnel = cli.tunnel(name)
+    up = tunnel is not None and tunnel['status'] == 'UP'
+
+    commands = []
+    if state == 'absent':
+        if tunnel is not None:
+            commands.append(['tunnel', 'delete', name, '--force', '--yes'])
+    else:
+        recreate = False
+        if tunnel is not None:
+            changes = immutable_changes(params, tunnel)
+            if changes and not params['recreate']:
+                module.fail_json(msg="tunnel '%s' differs in %s, which cannot be changed in place; set recreate=true to "
+                                     "delete and create it again" % (name, ', '.join(changes)), tunnel=tunnel)
+            recreate = bool(changes)
+
+        if tunnel is None or recreate:
+            create, missing = create_command(params)
+            if missing:
+                module.fail_json(msg="creating tunnel '%s' requires %s" % (name, ', '.join(missing)))
+            if recreate:
+                commands.append(['tunnel', 'delete', name, '--force', '--yes'])
+            commands.append(create)
+            if state == 'started' or (state == 'present' and up):
+                commands.append(['tunnel', 'start', name])
+        else:
+            commands += update_commands(params, tunnel)
+            if state == 'started' and not up:
+                commands.append(['tunnel', 'start', name])
+            elif state == 'stopped' and up:
+                commands.append(['tunnel', 'stop', name])
+
+    result = dict(changed=bool(commands), commands=[cli.command(*c) for c in commands], tunnel=tunnel)
+    if module._diff:
+        result['diff'] = dict(before=tunnel or {}, after={} if state == 'absent' else dict(
+            (k, v) for k, v in params.items() if v is not None and k not in COMMON_ARGS and k != 'recreate'))
+
+    if commands and not module.check_mode:
+        for c in commands:
+            cli.run(*c)
+        result['tunnel'] = cli.tunnel(name)
+
+    module.exit_json(**result)
+
+
+if __name__ == '__main__':
+    main()
@@ -0,0 +1,104 @@
+// Package access assigns roles to the users of the command line, the key agent
+// and the RESTCONF API. Users and clients listed under access in the
+// configuration get the read-only viewer role; everyone else who can reach
+// ipsec-vpn at all is an operator.
+package access
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+
+	"github.com/spf13/viper"
+)
+
+// Role is what a user is allowed to do
+type Role string
+
+// Roles
+const (
+	RoleOperator Role = "operator" // May change anything
+	RoleViewer   Role = "viewer"   // May only run show, status and diagnostic commands
+)
+
+// DeniedError is returned when a viewer attempts to change something
+type DeniedError struct {
+	Who    string
+	Action string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("permission denied: %s has the read-only viewer role and may not %s", e.Who, e.Action)
+}
+
+// Deny returns the error for a viewer attempting an action
+func Deny(who, action string) error {
+	return &DeniedError{Who: who, Action: action}
+}
+
+// Configured reports whether any users, groups or clients have the viewer role
+func Configured() bool {
+	return len(viper.GetStringSlice("access.viewer_users")) > 0 ||
+		len(viper.GetStringSlice("access.viewer_groups")) > 0 ||
+		len(viper.GetStringSlice("access.viewer_clients")) > 0
+}
+
+// CurrentUser returns the user running a command. When root runs it through
+// sudo, that is the user who invoked sudo, so a viewer allowed to run
+// ipsec-vpn with sudo keeps the viewer role.
+func CurrentUser() (*user.User, error) {
+	if os.Getuid() == 0 {
+		if name := os.Getenv("SUDO_USER"); name != "" {
+			return user.Lookup(name)
+		}
+	}
+	return user.LookupId(strconv.Itoa(os.Getuid()))
+}
+
+// UserRole returns the role of an OS user, by name or by membership in one of
+// access.viewer_groups
+func UserRole(u *user.User) Role {
+	if slices.Contains(viper.GetStringSlice("access.viewer_users"), u.Username) {
+		return RoleViewer
+	}
+	groups := viper.GetStringSlice("access.viewer_groups")
+	if len(groups) == 0 {
+		return RoleOperator
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		// Without the groups the role cannot be told, so assume the lesser one
+		return RoleViewer
+	}
+	for _, id := range ids {
+		group, err := user.LookupGroupId(id)
+		if err != nil {
+			continue
+		}
+		if slices.Contains(groups, group.Name) {
+			return RoleViewer
+		}
+	}
+	return RoleOperator
+}
+
+// UIDRole returns the role of the user with the given uid, as seen on the peer
+// of a Unix socket
+func UIDRole(uid int) (Role, error) {
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return "", err
+	}
+	return UserRole(u), nil
+}
+
+// ClientRole returns the role of a RESTCONF client, by the common name of its
+// certificate
+func ClientRole(commonName string) Role {
+	if slices.Contains(viper.GetStringSlice("access.viewer_clients"), commonName) {
+		return RoleViewer
+	}
+	return RoleOperator
+}
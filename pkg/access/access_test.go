@@ -0,0 +1,46 @@
+package access
+
+import (
+	"os/user"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestRoles(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer viper.Set("access.viewer_users", nil)
+	defer viper.Set("access.viewer_groups", nil)
+	defer viper.Set("access.viewer_clients", nil)
+
+	if Configured() || UserRole(current) != RoleOperator || ClientRole("noc") != RoleOperator {
+		t.Fatal("Expected everyone to be an operator without viewers")
+	}
+
+	viper.Set("access.viewer_users", []string{current.Username})
+	if UserRole(current) != RoleViewer {
+		t.Errorf("Expected %s to be a viewer by name", current.Username)
+	}
+	viper.Set("access.viewer_users", nil)
+
+	group, err := user.LookupGroupId(current.Gid)
+	if err != nil {
+		t.Skip(err)
+	}
+	viper.Set("access.viewer_groups", []string{group.Name})
+	if UserRole(current) != RoleViewer {
+		t.Errorf("Expected members of %s to be viewers", group.Name)
+	}
+	viper.Set("access.viewer_groups", []string{"no-such-group"})
+	if UserRole(current) != RoleOperator {
+		t.Error("Expected users outside the viewer groups to be operators")
+	}
+
+	viper.Set("access.viewer_clients", []string{"noc"})
+	if ClientRole("noc") != RoleViewer || ClientRole("orchestrator") != RoleOperator {
+		t.Error("Expected only listed clients to be viewers")
+	}
+}
@@ -0,0 +1,472 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/access"
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/store"
+	"github.com/dzakwan/ipsec-vpn/pkg/vault"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/sys/unix"
+)
+
+// SocketEnv is the environment variable that overrides the agent socket path
+const SocketEnv = "IPSEC_VPN_AGENT_SOCK"
+
+// vaultTimeout bounds reading a key from Vault
+const vaultTimeout = 30 * time.Second
+
+// maxDeriveLength caps the amount of key material a single derive request may return
+const maxDeriveLength = 255 * sha256.Size
+
+// Request operations
+const (
+	OpList        = "list"
+	OpAdd         = "add"
+	OpRemove      = "remove"
+	OpDerive      = "derive"
+	OpDecapsulate = "decapsulate"
+	OpSign        = "sign"
+)
+
+// Request is a single newline-delimited JSON request sent to the agent
+type Request struct {
+	Op         string `json:"op"`
+	Name       string `json:"name,omitempty"`
+	Lifetime   string `json:"lifetime,omitempty"`
+	Vault      string `json:"vault,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	Info       []byte `json:"info,omitempty"`
+	Length     int    `json:"length,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+	Message    []byte `json:"message,omitempty"`
+	Passphrase []byte `json:"passphrase,omitempty"` // Unseals a stored key sealed with a passphrase
+}
+
+// Response is the agent's reply to a Request
+type Response struct {
+	Error     string    `json:"error,omitempty"`
+	Keys      []KeyInfo `json:"keys,omitempty"`
+	Secret    []byte    `json:"secret,omitempty"`
+	Signature []byte    `json:"signature,omitempty"`
+}
+
+// KeyInfo describes a key held by the agent without revealing its material
+type KeyInfo struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Algorithm   string    `json:"algorithm"`
+	Fingerprint string    `json:"fingerprint"`
+	Expires     time.Time `json:"expires,omitempty"`
+	Source      string    `json:"source,omitempty"` // Where the key was loaded from, if not the key store
+}
+
+// heldKey is an unlocked key kept in agent memory
+type heldKey struct {
+	info     KeyInfo
+	material []byte // Pre-shared key or private key, allocated with crypto.NewSecret
+}
+
+// Agent holds unlocked keys in memory and answers requests over a Unix socket
+type Agent struct {
+	mu       sync.Mutex
+	keys     map[string]*heldKey
+	listener net.Listener
+	uid      int
+}
+
+// SocketPath returns the path of the agent socket
+func SocketPath() string {
+	if path := os.Getenv(SocketEnv); path != "" {
+		return path
+	}
+	if path := viper.GetString("agent.socket"); path != "" {
+		return path
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "ipsec-vpn-agent.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("ipsec-vpn-agent-%d.sock", os.Getuid()))
+}
+
+// Listen creates the agent socket. Only the current user may connect to it, and
+// users with the viewer role to list keys.
+func Listen(path string) (*Agent, error) {
+	// Remove a stale socket left behind by an agent that did not shut down cleanly
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("an agent is already listening on %s", path)
+	}
+	_ = os.Remove(path)
+
+	oldMask := unix.Umask(0077)
+	listener, err := net.Listen("unix", path)
+	unix.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	if access.Configured() {
+		// checkPeer tells viewers from other users
+		if err := os.Chmod(path, 0666); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	logger.Info("Key agent listening on %s", path)
+	return &Agent{
+		keys:     make(map[string]*heldKey),
+		listener: listener,
+		uid:      os.Getuid(),
+	}, nil
+}
+
+// Serve accepts connections until the agent is closed
+func (a *Agent) Serve() error {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go a.handle(conn)
+	}
+}
+
+// Close stops the agent and wipes all held keys
+func (a *Agent) Close() error {
+	a.mu.Lock()
+	for name, key := range a.keys {
+		crypto.ReleaseSecret(key.material)
+		delete(a.keys, name)
+	}
+	a.mu.Unlock()
+
+	logger.Info("Key agent stopped, all keys wiped")
+	return a.listener.Close()
+}
+
+// handle answers requests on a single connection
+func (a *Agent) handle(conn net.Conn) {
+	defer conn.Close()
+
+	role, err := a.checkPeer(conn)
+	if err != nil {
+		logger.Error("Rejected agent connection: %v", err)
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF {
+				logger.Debug("Agent connection closed: %v", err)
+			}
+			return
+		}
+
+		var req Request
+		var resp *Response
+		if err := json.Unmarshal(line, &req); err != nil {
+			resp = &Response{Error: fmt.Sprintf("invalid request: %v", err)}
+		} else if role == access.RoleViewer && req.Op != OpList {
+			logger.Error("Refused agent %s request from a viewer", req.Op)
+			resp = &Response{Error: access.Deny("this user", req.Op+" keys in the agent").Error()}
+		} else {
+			resp = a.dispatch(&req)
+		}
+		crypto.Zeroize(req.Passphrase)
+
+		err = encoder.Encode(resp)
+		crypto.Zeroize(resp.Secret)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// checkPeer only allows connections from the user running the agent, or root,
+// as operators, and from users with the viewer role
+func (a *Agent) checkPeer(conn net.Conn) (access.Role, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return "", errors.New("not a unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return "", err
+	}
+	if credErr != nil {
+		return "", credErr
+	}
+
+	if int(cred.Uid) == a.uid || cred.Uid == 0 {
+		return access.RoleOperator, nil
+	}
+	if role, err := access.UIDRole(int(cred.Uid)); err == nil && role == access.RoleViewer {
+		return role, nil
+	}
+	return "", fmt.Errorf("peer uid %d does not match agent uid %d", cred.Uid, a.uid)
+}
+
+// dispatch runs a single request
+func (a *Agent) dispatch(req *Request) *Response {
+	var err error
+	resp := &Response{}
+
+	switch req.Op {
+	case OpList:
+		resp.Keys = a.list()
+	case OpAdd:
+		if req.Vault != "" {
+			err = a.addFromVault(req.Name, req.Vault, req.Lifetime)
+		} else {
+			err = a.add(req.Name, req.Lifetime, req.Passphrase)
+		}
+	case OpRemove:
+		err = a.remove(req.Name)
+	case OpDerive:
+		resp.Secret, err = a.derive(req.Name, req.Salt, req.Info, req.Length)
+	case OpDecapsulate:
+		resp.Secret, err = a.decapsulate(req.Name, req.Ciphertext)
+	case OpSign:
+		resp.Signature, err = a.sign(req.Name, req.Message)
+	default:
+		err = fmt.Errorf("unknown operation: %s", req.Op)
+	}
+
+	if err != nil {
+		logger.Debug("Agent %s request for '%s' failed: %v", req.Op, req.Name, err)
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// list returns the keys currently held, dropping any whose lifetime has ended
+func (a *Agent) list() []KeyInfo {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	infos := make([]KeyInfo, 0, len(a.keys))
+	for name, key := range a.keys {
+		if a.expiredLocked(name, key) {
+			continue
+		}
+		infos = append(infos, key.info)
+	}
+	return infos
+}
+
+// add unseals a key from the key store into memory, with the passphrase if it
+// is sealed with one, so that keys sealed otherwise can be added along with it
+func (a *Agent) add(name, lifetime string, passphrase []byte) error {
+	key, err := keys.Get(name)
+	if err != nil {
+		return err
+	}
+	if key.Expired() {
+		return fmt.Errorf("key '%s' has expired", name)
+	}
+
+	var source store.KeySource
+	if len(passphrase) > 0 && key.SealedWith() == store.MethodPassphrase {
+		source = store.Passphrase{Passphrase: passphrase}
+	}
+	material, err := key.Material(source)
+	if err != nil {
+		return err
+	}
+	defer crypto.Zeroize(material)
+
+	info := KeyInfo{
+		Name:        key.Name,
+		Type:        key.Type,
+		Algorithm:   key.Algorithm,
+		Fingerprint: key.Fingerprint,
+	}
+	if key.Expiry != nil {
+		info.Expires = *key.Expiry
+	}
+	return a.hold(info, material, lifetime)
+}
+
+// addFromVault loads a pre-shared key from the Vault KV secrets engine into
+// memory, so it is never written to the gateway's disk
+func (a *Agent) addFromVault(name, ref, lifetime string) error {
+	if !keys.ValidName(name) {
+		return fmt.Errorf("invalid key name: %s", name)
+	}
+	client, err := vault.FromConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+	material, err := client.ReadPSK(ctx, ref)
+	if err != nil {
+		return err
+	}
+	defer crypto.Zeroize(material)
+
+	info := KeyInfo{
+		Name:        name,
+		Type:        keys.TypePSK,
+		Algorithm:   fmt.Sprintf("psk%d", len(material)*8),
+		Fingerprint: keys.Fingerprint(material),
+		Source:      "vault:" + ref,
+	}
+	return a.hold(info, material, lifetime)
+}
+
+// hold copies key material into locked memory, replacing a key of the same name
+func (a *Agent) hold(info KeyInfo, material []byte, lifetime string) error {
+	held := &heldKey{
+		info:     info,
+		material: crypto.NewSecret(len(material)),
+	}
+	copy(held.material, material)
+
+	if lifetime != "" {
+		d, err := time.ParseDuration(lifetime)
+		if err != nil {
+			crypto.ReleaseSecret(held.material)
+			return fmt.Errorf("invalid lifetime: %v", err)
+		}
+		if expires := time.Now().Add(d); held.info.Expires.IsZero() || expires.Before(held.info.Expires) {
+			held.info.Expires = expires
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if old, ok := a.keys[info.Name]; ok {
+		crypto.ReleaseSecret(old.material)
+	}
+	a.keys[info.Name] = held
+
+	logger.Info("Key agent loaded key '%s' (%s)", info.Name, info.Fingerprint)
+	return nil
+}
+
+// remove wipes a key from memory
+func (a *Agent) remove(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, ok := a.keys[name]
+	if !ok {
+		return fmt.Errorf("key '%s' is not loaded", name)
+	}
+	crypto.ReleaseSecret(key.material)
+	delete(a.keys, name)
+
+	logger.Info("Key agent removed key '%s'", name)
+	return nil
+}
+
+// derive expands a pre-shared key with HKDF-SHA256
+func (a *Agent) derive(name string, salt, info []byte, length int) ([]byte, error) {
+	if length <= 0 || length > maxDeriveLength {
+		return nil, fmt.Errorf("invalid derive length: %d", length)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, err := a.getLocked(name, keys.TypePSK)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key.material, salt, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// decapsulate recovers a shared secret with a held private key
+func (a *Agent) decapsulate(name string, ciphertext []byte) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, err := a.getLocked(name, keys.TypeKeyPair)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.DecapsulateKEM(key.info.Algorithm, key.material, ciphertext)
+}
+
+// sign signs a message with a held Ed25519 key pair
+func (a *Agent) sign(name string, message []byte) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, err := a.getLocked(name, keys.TypeKeyPair)
+	if err != nil {
+		return nil, err
+	}
+	return signEd25519(key.info.Algorithm, key.material, message)
+}
+
+// signEd25519 signs a message with the seed of an Ed25519 private key
+func signEd25519(algorithm string, seed, message []byte) ([]byte, error) {
+	if algorithm != crypto.AlgorithmEd25519 || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s keys cannot sign, only %s keys", algorithm, crypto.AlgorithmEd25519)
+	}
+	private := ed25519.NewKeyFromSeed(seed)
+	defer crypto.Zeroize(private)
+	return ed25519.Sign(private, message), nil
+}
+
+// getLocked returns a held, unexpired key of the given type. The caller must hold a.mu.
+func (a *Agent) getLocked(name, keyType string) (*heldKey, error) {
+	key, ok := a.keys[name]
+	if !ok || a.expiredLocked(name, key) {
+		return nil, fmt.Errorf("key '%s' is not loaded", name)
+	}
+	if key.info.Type != keyType {
+		return nil, fmt.Errorf("key '%s' is of type %s, not %s", name, key.info.Type, keyType)
+	}
+	return key, nil
+}
+
+// expiredLocked wipes and drops a key whose lifetime has ended. The caller must hold a.mu.
+func (a *Agent) expiredLocked(name string, key *heldKey) bool {
+	if key.info.Expires.IsZero() || time.Now().Before(key.info.Expires) {
+		return false
+	}
+	crypto.ReleaseSecret(key.material)
+	delete(a.keys, name)
+	logger.Info("Key agent dropped expired key '%s'", name)
+	return true
+}
@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/store"
+	"github.com/spf13/viper"
+)
+
+var passphrase = store.Passphrase{Passphrase: []byte("correct horse")}
+
+// start points the key store at a temporary directory and serves an agent on
+// a socket in it
+func start(t *testing.T) (*Agent, string) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "agent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	viper.Set("config_dir", filepath.Join(dir, "config"))
+	t.Cleanup(func() { viper.Set("config_dir", "") })
+
+	path := filepath.Join(dir, "agent.sock")
+	a, err := Listen(path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go a.Serve()
+	t.Cleanup(func() { a.Close() })
+	return a, path
+}
+
+// dial connects to the agent
+func dial(t *testing.T, path string) *Client {
+	t.Helper()
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestProtocol(t *testing.T) {
+	_, path := start(t)
+	if _, err := keys.Generate("office", keys.TypePSK, "", 0, 0, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := keys.Generate("release", keys.TypeKeyPair, crypto.AlgorithmEd25519, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, path)
+
+	if err := c.Add("office", nil, 0); err == nil || !strings.Contains(err.Error(), keys.ErrPassphrase.Error()) {
+		t.Errorf("Expected a key sealed with a passphrase to need it, got %v", err)
+	}
+	if err := c.Add("office", []byte("wrong"), 0); err == nil {
+		t.Error("Expected a wrong passphrase to fail")
+	}
+	if err := c.Add("office", passphrase.Passphrase, 0); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := c.Add("release", passphrase.Passphrase, 0); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := c.Add("missing", nil, 0); err == nil {
+		t.Error("Expected a missing key to be an error")
+	}
+
+	held, err := c.List()
+	if err != nil || len(held) != 2 {
+		t.Fatalf("Expected 2 keys held, got %v: %v", held, err)
+	}
+
+	// The agent derives the same tunnel key as the key store
+	key, _ := keys.Get("office")
+	material, err := key.Material(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := keys.DeriveTunnelPSK(material)
+	psk, err := c.Derive("office", nil, keys.TunnelPSKInfo, keys.TunnelPSKSize)
+	if err != nil || !bytes.Equal(psk, want) {
+		t.Errorf("Expected the derived key to match keys.DeriveTunnelPSK: %v", err)
+	}
+	if _, err := c.Derive("office", nil, nil, maxDeriveLength+1); err == nil {
+		t.Error("Expected an oversized derivation to be refused")
+	}
+	if _, err := c.Derive("release", nil, nil, 32); err == nil {
+		t.Error("Expected a key pair not to derive")
+	}
+
+	message := []byte("ipsec-vpn 1.0.0")
+	signature, err := c.Sign("release", message)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	public, _ := signer.PublicBytes()
+	if !ed25519.Verify(public, message, signature) {
+		t.Error("Expected the signature to verify with the public key")
+	}
+	if ok, err := signer.Verify(message, signature); !ok || err != nil {
+		t.Errorf("Expected the stored key to verify the signature: %v", err)
+	}
+	if _, err := c.Sign("office", message); err == nil {
+		t.Error("Expected a pre-shared key not to sign")
+	}
+
+	if err := c.Remove("office"); err != nil {
+		t.Errorf("Remove failed: %v", err)
+	}
+	if _, err := c.Derive("office", nil, keys.TunnelPSKInfo, keys.TunnelPSKSize); err == nil {
+		t.Error("Expected a removed key not to derive")
+	}
+}
+
+func TestDecapsulate(t *testing.T) {
+	_, path := start(t)
+	pair, err := keys.Generate("backup", keys.TypeKeyPair, crypto.RecommendedAlgorithm, 0, 0, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _ := pair.PublicBytes()
+	dir := t.TempDir()
+	plain, encrypted, decrypted := filepath.Join(dir, "plain"), filepath.Join(dir, "plain.enc"), filepath.Join(dir, "plain.dec")
+	if err := os.WriteFile(plain, []byte("backup"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := crypto.EncryptFile(plain, encrypted, crypto.PublicKeyPEM(pair.Algorithm, public), false); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(SocketEnv, path)
+	decapsulate := func(ciphertext []byte) ([]byte, error) { return Decapsulate("backup", ciphertext) }
+
+	// Without the passphrase, only the agent can decrypt
+	if err := crypto.DecryptFileWith(encrypted, decrypted, pair.Algorithm, decapsulate); !errors.Is(err, keys.ErrPassphrase) {
+		t.Errorf("Expected the passphrase to be needed, got %v", err)
+	}
+	if err := dial(t, path).Add("backup", passphrase.Passphrase, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := crypto.DecryptFileWith(encrypted, decrypted, pair.Algorithm, decapsulate); err != nil {
+		t.Fatalf("DecryptFileWith failed: %v", err)
+	}
+	if data, _ := os.ReadFile(decrypted); string(data) != "backup" {
+		t.Errorf("Expected the file decrypted, got %q", data)
+	}
+}
+
+func TestTunnelPSK(t *testing.T) {
+	_, path := start(t)
+	if _, err := keys.Generate("office", keys.TypePSK, "", 0, 0, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Generate("branch", keys.TypePSK, "", 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without an agent, keys are unsealed in the process if they can be
+	t.Setenv(SocketEnv, "")
+	if _, err := TunnelPSK("office"); !errors.Is(err, keys.ErrPassphrase) {
+		t.Errorf("Expected the passphrase to be needed, got %v", err)
+	}
+	local, err := TunnelPSK("branch")
+	if err != nil {
+		t.Fatalf("TunnelPSK failed: %v", err)
+	}
+
+	t.Setenv(SocketEnv, path)
+	if !Enabled() {
+		t.Fatal("Expected the agent to be enabled")
+	}
+	if err := dial(t, path).Add("office", passphrase.Passphrase, 0); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := keys.Get("office")
+	material, _ := key.Material(passphrase)
+	want, _ := keys.DeriveTunnelPSK(material)
+	if psk, err := TunnelPSK("office"); err != nil || !bytes.Equal(psk, want) {
+		t.Errorf("Expected the agent to derive the tunnel key: %v", err)
+	}
+	// Keys the agent does not hold are still unsealed in the process
+	if psk, err := TunnelPSK("branch"); err != nil || !bytes.Equal(psk, local) {
+		t.Errorf("Expected a key the agent does not hold to be unsealed locally: %v", err)
+	}
+}
+
+func TestLifetime(t *testing.T) {
+	_, path := start(t)
+	if _, err := keys.Generate("office", keys.TypePSK, "", 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, path)
+	if err := c.Add("office", nil, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Derive("office", nil, keys.TunnelPSKInfo, keys.TunnelPSKSize); err != nil {
+		t.Fatalf("Expected the key to be held for its lifetime: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.Derive("office", nil, keys.TunnelPSKInfo, keys.TunnelPSKSize); err == nil {
+		t.Error("Expected the key to be dropped after its lifetime")
+	}
+	if held, err := c.List(); err != nil || len(held) != 0 {
+		t.Errorf("Expected no keys held, got %v: %v", held, err)
+	}
+	if err := c.Add("office", nil, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if held, _ := c.List(); len(held) != 1 {
+		t.Errorf("Expected a key added without a positive lifetime to be held, got %v", held)
+	}
+}
+
+func TestCloseWipesKeys(t *testing.T) {
+	a, path := start(t)
+	if _, err := keys.Generate("office", keys.TypePSK, "", 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := dial(t, path).Add("office", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	a.mu.Lock()
+	material := a.keys["office"].material
+	a.mu.Unlock()
+	if bytes.Equal(material, make([]byte, len(material))) {
+		t.Fatal("Expected the agent to hold the key")
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(material, make([]byte, len(material))) {
+		t.Error("Expected the key to be wiped when the agent closes")
+	}
+	if len(a.keys) != 0 {
+		t.Error("Expected no keys held after the agent closes")
+	}
+	if _, err := Dial(path); err == nil {
+		t.Error("Expected the agent to stop listening")
+	}
+}
+
+func TestPeerRejected(t *testing.T) {
+	a, path := start(t)
+	if os.Getuid() != 0 {
+		// Act as an agent run by another user
+		a.uid = os.Getuid() + 1
+	} else {
+		// Connect as nobody, which root lets reach the socket
+		if err := os.Chmod(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Setresuid(-1, 65534, -1); err != nil {
+			t.Skipf("Cannot connect as another user: %v", err)
+		}
+	}
+	c, err := Dial(path)
+	if os.Getuid() == 0 {
+		if err := syscall.Setresuid(-1, 0, -1); err != nil {
+			t.Fatalf("Cannot restore the effective user: %v", err)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.List(); err == nil {
+		t.Error("Expected a connection from another user to be rejected")
+	}
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Client talks to a running key agent
+type Client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Dial connects to the agent listening on the given socket
+func Dial(path string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("no key agent running on %s: %v", path, err)
+	}
+	return &Client{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// Close closes the connection to the agent
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// List returns the keys held by the agent
+func (c *Client) List() ([]KeyInfo, error) {
+	resp, err := c.call(&Request{Op: OpList})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+// Add asks the agent to unseal a key from the key store, with the passphrase
+// if it is sealed with one, optionally for a limited lifetime
+func (c *Client) Add(name string, passphrase []byte, lifetime time.Duration) error {
+	req := &Request{Op: OpAdd, Name: name, Passphrase: passphrase}
+	if lifetime > 0 {
+		req.Lifetime = lifetime.String()
+	}
+	_, err := c.call(req)
+	return err
+}
+
+// AddFromVault asks the agent to load a pre-shared key from the Vault KV secrets
+// engine under a name, optionally for a limited lifetime
+func (c *Client) AddFromVault(name, ref string, lifetime time.Duration) error {
+	req := &Request{Op: OpAdd, Name: name, Vault: ref}
+	if lifetime > 0 {
+		req.Lifetime = lifetime.String()
+	}
+	_, err := c.call(req)
+	return err
+}
+
+// Remove asks the agent to wipe a key from memory
+func (c *Client) Remove(name string) error {
+	_, err := c.call(&Request{Op: OpRemove, Name: name})
+	return err
+}
+
+// Derive returns length bytes derived from a held pre-shared key with HKDF-SHA256
+func (c *Client) Derive(name string, salt, info []byte, length int) ([]byte, error) {
+	resp, err := c.call(&Request{Op: OpDerive, Name: name, Salt: salt, Info: info, Length: length})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Secret, nil
+}
+
+// Decapsulate returns the shared secret for a ciphertext encapsulated to a held key pair
+func (c *Client) Decapsulate(name string, ciphertext []byte) ([]byte, error) {
+	resp, err := c.call(&Request{Op: OpDecapsulate, Name: name, Ciphertext: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Secret, nil
+}
+
+// Sign returns the Ed25519 signature of a message by a held key pair
+func (c *Client) Sign(name string, message []byte) ([]byte, error) {
+	resp, err := c.call(&Request{Op: OpSign, Name: name, Message: message})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+// call sends a request and waits for the response
+func (c *Client) call(req *Request) (*Response, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent response: %v", err)
+	}
+
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("invalid agent response: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
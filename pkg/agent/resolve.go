@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/spf13/viper"
+)
+
+// errNoAgent is returned when no key agent is to be asked
+var errNoAgent = errors.New("no key agent configured")
+
+// Enabled reports whether stored keys are asked of a key agent before they are
+// unsealed in the process: with $IPSEC_VPN_AGENT_SOCK set, as by the agent's
+// session, or agent.socket, for services such as the RESTCONF server
+func Enabled() bool {
+	return os.Getenv(SocketEnv) != "" || viper.GetString("agent.socket") != ""
+}
+
+// TunnelPSK returns the pre-shared key of a tunnel referring to a stored key:
+// derived by the key agent if it holds the key, and otherwise from the key
+// unsealed in this process, as keys.TunnelPSK does
+func TunnelPSK(name string) ([]byte, error) {
+	psk, err := ask(name, func(c *Client) ([]byte, error) {
+		return c.Derive(name, nil, keys.TunnelPSKInfo, keys.TunnelPSKSize)
+	})
+	if err == nil {
+		return psk, nil
+	}
+	return local(name, func() ([]byte, error) { return keys.TunnelPSK(name) })
+}
+
+// Decapsulate recovers the shared secret of a ciphertext encapsulated to a
+// stored key pair: by the key agent if it holds the key, and otherwise with
+// the key unsealed in this process
+func Decapsulate(name string, ciphertext []byte) ([]byte, error) {
+	secret, err := ask(name, func(c *Client) ([]byte, error) {
+		return c.Decapsulate(name, ciphertext)
+	})
+	if err == nil {
+		return secret, nil
+	}
+	return local(name, func() ([]byte, error) {
+		return withKeyPair(name, func(key *keys.Key, private []byte) ([]byte, error) {
+			return crypto.DecapsulateKEM(key.Algorithm, private, ciphertext)
+		})
+	})
+}
+
+// Sign signs a message with a stored Ed25519 key pair: by the key agent if it
+// holds the key, and otherwise with the key unsealed in this process
+func Sign(name string, message []byte) ([]byte, error) {
+	signature, err := ask(name, func(c *Client) ([]byte, error) {
+		return c.Sign(name, message)
+	})
+	if err == nil {
+		return signature, nil
+	}
+	return local(name, func() ([]byte, error) {
+		return withKeyPair(name, func(key *keys.Key, private []byte) ([]byte, error) {
+			return signEd25519(key.Algorithm, private, message)
+		})
+	})
+}
+
+// ask runs a request for a key on the key agent, if one is enabled
+func ask(name string, request func(*Client) ([]byte, error)) ([]byte, error) {
+	if !Enabled() {
+		return nil, errNoAgent
+	}
+	client, err := Dial(SocketPath())
+	if err != nil {
+		logger.Debug("Unsealing key '%s' without the key agent: %v", name, err)
+		return nil, err
+	}
+	defer client.Close()
+	out, err := request(client)
+	if err != nil {
+		logger.Debug("Unsealing key '%s' without the key agent: %v", name, err)
+	}
+	return out, err
+}
+
+// local does what the key agent did not with the key unsealed in this process,
+// pointing at the key agent for keys that need a passphrase
+func local(name string, use func() ([]byte, error)) ([]byte, error) {
+	out, err := use()
+	if errors.Is(err, keys.ErrPassphrase) {
+		return nil, fmt.Errorf("%w: load it into the key agent with 'ipsec-vpn agent add %s'", err, name)
+	}
+	return out, err
+}
+
+// withKeyPair unseals the private key of a stored key pair in this process
+func withKeyPair(name string, use func(key *keys.Key, private []byte) ([]byte, error)) ([]byte, error) {
+	key, err := keys.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if key.Type != keys.TypeKeyPair {
+		return nil, fmt.Errorf("key '%s' is a pre-shared key, not a key pair", name)
+	}
+	if key.Expired() {
+		return nil, fmt.Errorf("key '%s' has expired", name)
+	}
+	private, err := key.Material(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Zeroize(private)
+	return use(key, private)
+}
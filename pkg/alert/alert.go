@@ -0,0 +1,263 @@
+// Package alert evaluates local alert rules against tunnel state and notifies
+// hooks, webhooks and email recipients when they fire and resolve, for
+// deployments without a Prometheus and Alertmanager stack.
+package alert
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/viper"
+)
+
+// Rule conditions
+const (
+	CondDown     = "down"     // The tunnel has not been up for longer than the duration
+	CondLoss     = "loss"     // The last SLA probe operation lost more than the percentage
+	CondLatency  = "latency"  // The last SLA probe operation's latency is over the duration
+	CondJitter   = "jitter"   // The last SLA probe operation's jitter is over the duration
+	CondFailures = "failures" // More failures than the count were reported within the window
+)
+
+// Alert states
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// maxWindow is the longest failures window, as tunnels keep a day of failures
+const maxWindow = 24 * time.Hour
+
+// Rule is a condition checked against every tunnel, written as
+// "<condition> > <value>": "down > 2m", "loss > 5%", "latency > 150ms",
+// "jitter > 30ms" or "failures > 3/h"
+type Rule struct {
+	Text      string
+	Condition string
+	Duration  time.Duration // How long for down, the threshold for latency and jitter, the window for failures
+	Threshold float64       // Percent for loss, a count for failures
+}
+
+// ParseRule parses an alert rule
+func ParseRule(text string) (Rule, error) {
+	r := Rule{Text: text}
+	fields := strings.Fields(text)
+	if len(fields) != 3 || fields[1] != ">" {
+		return r, fmt.Errorf("invalid rule %q, expected '<condition> > <value>' such as 'down > 2m'", text)
+	}
+	r.Condition = fields[0]
+	value := fields[2]
+
+	var err error
+	switch r.Condition {
+	case CondDown, CondLatency, CondJitter:
+		if r.Duration, err = time.ParseDuration(value); err != nil || r.Duration <= 0 {
+			return r, fmt.Errorf("invalid rule %q, %s needs a positive duration such as 2m or 150ms", text, r.Condition)
+		}
+	case CondLoss:
+		r.Threshold, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || r.Threshold < 0 || r.Threshold >= 100 {
+			return r, fmt.Errorf("invalid rule %q, loss needs a percentage from 0 to 100 such as 5%%", text)
+		}
+	case CondFailures:
+		count, window, ok := strings.Cut(value, "/")
+		n, err := strconv.Atoi(count)
+		if !ok || err != nil || n < 0 {
+			return r, fmt.Errorf("invalid rule %q, failures needs a count per window such as 3/h or 10/30m", text)
+		}
+		r.Threshold = float64(n)
+		if r.Duration, err = parseWindow(window); err != nil {
+			return r, fmt.Errorf("invalid rule %q: %v", text, err)
+		}
+	default:
+		return r, fmt.Errorf("invalid rule %q, unknown condition '%s' (use %s, %s, %s, %s or %s)",
+			text, r.Condition, CondDown, CondLoss, CondLatency, CondJitter, CondFailures)
+	}
+	return r, nil
+}
+
+// parseWindow parses the window of a failures rule: a duration, or a unit
+// alone for one of it, such as h for an hour
+func parseWindow(s string) (time.Duration, error) {
+	switch s {
+	case "d":
+		return maxWindow, nil
+	case "s", "m", "h":
+		s = "1" + s
+	}
+	window, err := time.ParseDuration(s)
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("invalid window '%s', use a duration such as h or 30m", s)
+	}
+	if window > maxWindow {
+		return 0, fmt.Errorf("window %s is longer than the %s of failures kept", window, maxWindow)
+	}
+	return window, nil
+}
+
+// check reports whether a tunnel matches the rule, describing the value that
+// matched. SLA rules never match tunnels without SLA results.
+func (r Rule) check(t *tunnel.Tunnel, now time.Time) (bool, string, error) {
+	switch r.Condition {
+	case CondDown:
+		// A tunnel stopped on purpose is down without a reason
+		if t.Status == tunnel.StatusUp || (t.Status == tunnel.StatusDown && t.Reason == "") {
+			return false, "", nil
+		}
+		down := now.Sub(t.LastTransition)
+		value := fmt.Sprintf("%s for %s", t.Status, down.Round(time.Second))
+		if t.Reason != "" {
+			value += ": " + t.Reason
+		}
+		return down > r.Duration, value, nil
+	case CondFailures:
+		n := t.FailuresSince(now.Add(-r.Duration))
+		return float64(n) > r.Threshold, fmt.Sprintf("%d failures in the last %s", n, shortDuration(r.Duration)), nil
+	}
+
+	if t.SLA == nil {
+		return false, "", nil
+	}
+	history, err := tunnel.SLAHistory(t.Name)
+	if err != nil || len(history) == 0 {
+		return false, "", err
+	}
+	last := history[len(history)-1]
+	switch r.Condition {
+	case CondLoss:
+		return last.Loss > r.Threshold, fmt.Sprintf("loss %.0f%%", last.Loss), nil
+	case CondLatency:
+		return last.Received > 0 && last.Latency > ms(r.Duration), fmt.Sprintf("latency %.1fms", last.Latency), nil
+	default:
+		return last.Received > 0 && last.Jitter > ms(r.Duration), fmt.Sprintf("jitter %.1fms", last.Jitter), nil
+	}
+}
+
+// shortDuration formats a duration without zero minutes and seconds, e.g. 1h
+// rather than 1h0m0s
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// ms converts a duration to milliseconds
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Alert is a rule that started or stopped matching a tunnel
+type Alert struct {
+	Rule   string    `json:"rule"`
+	Tunnel string    `json:"tunnel"`
+	State  string    `json:"state"`
+	Value  string    `json:"value"`
+	Host   string    `json:"host"`
+	Since  time.Time `json:"since"` // When the rule started matching
+	Time   time.Time `json:"time"`
+	Text   string    `json:"text"` // A summary, shown by chat webhooks such as Slack and Mattermost
+}
+
+// Subject returns a one-line summary of the alert
+func (a Alert) Subject() string {
+	return fmt.Sprintf("[%s] %s: %s (%s)", strings.ToUpper(a.State), a.Tunnel, a.Rule, a.Value)
+}
+
+// Engine evaluates rules and keeps track of the alerts that are firing
+type Engine struct {
+	rules  []Rule
+	host   string
+	firing map[string]*Alert
+}
+
+// NewEngine creates an engine for the given rules
+func NewEngine(rules []Rule) *Engine {
+	host, _ := os.Hostname()
+	return &Engine{rules: rules, host: host, firing: make(map[string]*Alert)}
+}
+
+// Rules returns the rules configured in alerts.rules
+func Rules() ([]Rule, error) {
+	var rules []Rule
+	for _, text := range viper.GetStringSlice("alerts.rules") {
+		r, err := ParseRule(text)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Evaluate checks every rule against the tunnels and returns the alerts that
+// started firing or were resolved since the last evaluation. Alerts of tunnels
+// that no longer exist are resolved.
+func (e *Engine) Evaluate(tunnels []*tunnel.Tunnel, now time.Time) []Alert {
+	var changed []Alert
+	seen := make(map[string]bool)
+	for _, t := range tunnels {
+		for _, r := range e.rules {
+			key := t.Name + "\x00" + r.Text
+			matched, value, err := r.check(t, now)
+			if err != nil {
+				// Keep the current state until the rule can be checked again
+				seen[key] = e.firing[key] != nil
+				continue
+			}
+			if !matched {
+				continue
+			}
+			seen[key] = true
+			if a := e.firing[key]; a != nil {
+				a.Value = value
+				a.Text = a.Subject()
+				continue
+			}
+			a := &Alert{Rule: r.Text, Tunnel: t.Name, State: StateFiring, Value: value, Host: e.host, Since: now, Time: now}
+			a.Text = a.Subject()
+			e.firing[key] = a
+			changed = append(changed, *a)
+		}
+	}
+
+	for key, a := range e.firing {
+		if seen[key] {
+			continue
+		}
+		delete(e.firing, key)
+		resolved := *a
+		resolved.State = StateResolved
+		resolved.Time = now
+		resolved.Text = resolved.Subject()
+		changed = append(changed, resolved)
+	}
+	sort.SliceStable(changed, func(i, j int) bool {
+		return changed[i].Tunnel < changed[j].Tunnel
+	})
+	return changed
+}
+
+// Firing returns the alerts that are firing, by tunnel and rule
+func (e *Engine) Firing() []Alert {
+	alerts := make([]Alert, 0, len(e.firing))
+	for _, a := range e.firing {
+		alerts = append(alerts, *a)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Tunnel != alerts[j].Tunnel {
+			return alerts[i].Tunnel < alerts[j].Tunnel
+		}
+		return alerts[i].Rule < alerts[j].Rule
+	})
+	return alerts
+}
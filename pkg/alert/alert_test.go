@@ -0,0 +1,181 @@
+package alert
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/mail"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+)
+
+func TestParseRule(t *testing.T) {
+	for text, want := range map[string]Rule{
+		"down > 2m":         {Condition: CondDown, Duration: 2 * time.Minute},
+		"loss > 5%":         {Condition: CondLoss, Threshold: 5},
+		"latency > 150ms":   {Condition: CondLatency, Duration: 150 * time.Millisecond},
+		"failures > 3/h":    {Condition: CondFailures, Threshold: 3, Duration: time.Hour},
+		"failures > 10/30m": {Condition: CondFailures, Threshold: 10, Duration: 30 * time.Minute},
+	} {
+		got, err := ParseRule(text)
+		want.Text = text
+		if err != nil || got != want {
+			t.Errorf("ParseRule(%q) = %+v, %v, expected %+v", text, got, err, want)
+		}
+	}
+
+	for _, text := range []string{"down 2m", "down > 2", "loss > 120%", "failures > 3", "failures > 3/2d", "cpu > 90%"} {
+		if _, err := ParseRule(text); err == nil {
+			t.Errorf("Expected ParseRule(%q) to fail", text)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Now()
+	down, _ := ParseRule("down > 2m")
+	failures, _ := ParseRule("failures > 2/h")
+	engine := NewEngine([]Rule{down, failures})
+
+	office := &tunnel.Tunnel{Name: "office", Status: tunnel.StatusError, Reason: "peer unreachable",
+		LastTransition: now.Add(-time.Minute)}
+	stopped := &tunnel.Tunnel{Name: "lab", Status: tunnel.StatusDown, LastTransition: now.Add(-time.Hour)}
+	tunnels := []*tunnel.Tunnel{office, stopped}
+	if changed := engine.Evaluate(tunnels, now); len(changed) != 0 {
+		t.Fatalf("Expected no alerts within 2 minutes or for a stopped tunnel, got %v", changed)
+	}
+
+	now = now.Add(2 * time.Minute)
+	office.Failures = []time.Time{now.Add(-2 * time.Hour), now.Add(-30 * time.Minute), now.Add(-20 * time.Minute), now}
+	changed := engine.Evaluate(tunnels, now)
+	if len(changed) != 2 || changed[0].State != StateFiring || changed[1].State != StateFiring {
+		t.Fatalf("Expected down and failures alerts to fire, got %v", changed)
+	}
+	if changed[0].Value != "ERROR for 3m0s: peer unreachable" || changed[1].Value != "3 failures in the last 1h" {
+		t.Errorf("Unexpected alert values %q and %q", changed[0].Value, changed[1].Value)
+	}
+	// Firing alerts are not sent again
+	if changed := engine.Evaluate(tunnels, now.Add(time.Second)); len(changed) != 0 {
+		t.Errorf("Expected no changes while firing, got %v", changed)
+	}
+
+	office.Status = tunnel.StatusUp
+	office.Failures = nil
+	changed = engine.Evaluate(tunnels, now.Add(time.Minute))
+	if len(changed) != 2 || changed[0].State != StateResolved || changed[1].State != StateResolved {
+		t.Fatalf("Expected both alerts to be resolved, got %v", changed)
+	}
+	if !changed[0].Since.Equal(now) || len(engine.Firing()) != 0 {
+		t.Errorf("Expected resolved alerts to keep when they fired, got %v", changed[0].Since)
+	}
+}
+
+func TestHookAndWebhook(t *testing.T) {
+	a := Alert{Rule: "down > 2m", Tunnel: "office", State: StateFiring, Value: "ERROR for 3m0s", Time: time.Now()}
+	a.Text = a.Subject()
+
+	out := filepath.Join(t.TempDir(), "alert.json")
+	hook := &Hook{Command: `cat > ` + out + ` && test "$IPSEC_VPN_ALERT_TUNNEL" = office`}
+	if err := hook.Notify(a); err != nil {
+		t.Fatalf("Hook failed: %v", err)
+	}
+	var got Alert
+	if data, err := os.ReadFile(out); err != nil || json.Unmarshal(data, &got) != nil || got.Rule != a.Rule {
+		t.Errorf("Expected the hook to be given the alert, got %+v: %v", got, err)
+	}
+	if err := (&Hook{Command: "echo no route >&2; exit 1"}).Notify(a); err == nil || !strings.Contains(err.Error(), "no route") {
+		t.Errorf("Expected a failing hook to report its output, got %v", err)
+	}
+
+	var posted map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&posted)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	if err := (&Webhook{URL: server.URL + "/hooks/T0KEN"}).Notify(a); err != nil {
+		t.Fatalf("Webhook failed: %v", err)
+	}
+	if posted["text"] != a.Text || posted["tunnel"] != "office" {
+		t.Errorf("Expected the alert to be posted, got %v", posted)
+	}
+	if err := (&Webhook{URL: server.URL + "/fail"}).Notify(a); err == nil {
+		t.Error("Expected a webhook error status to be reported")
+	}
+	if s := (&Webhook{URL: server.URL + "/hooks/T0KEN"}).String(); strings.Contains(s, "T0KEN") {
+		t.Errorf("Expected the webhook token to be hidden, got %s", s)
+	}
+}
+
+func TestEmail(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		io.WriteString(conn, "220 mail.example.com ESMTP\r\n")
+		var transcript strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"):
+				io.WriteString(conn, "250 mail.example.com\r\n")
+			case cmd == "DATA":
+				io.WriteString(conn, "354 go ahead\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					transcript.WriteString(line)
+				}
+				io.WriteString(conn, "250 queued\r\n")
+			case cmd == "QUIT":
+				io.WriteString(conn, "221 bye\r\n")
+				received <- transcript.String()
+				return
+			default:
+				io.WriteString(conn, "250 ok\r\n")
+			}
+		}
+	}()
+
+	email := &Email{&mail.Mailer{Server: mail.Server{Address: ln.Addr().String()}, From: "vpn@example.com", To: []string{"noc@example.com", "oncall@example.com"}}}
+	a := Alert{Rule: "loss > 5%", Tunnel: "office", State: StateResolved, Value: "loss 0%", Time: time.Now()}
+	if err := email.Notify(a); err != nil {
+		t.Fatalf("Email failed: %v", err)
+	}
+	transcript := <-received
+	for _, want := range []string{
+		"MAIL FROM:<vpn@example.com>",
+		"RCPT TO:<oncall@example.com>",
+		"Subject: ipsec-vpn [RESOLVED] office: loss > 5% (loss 0%)",
+	} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("Expected %q in the SMTP transcript:\n%s", want, transcript)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/mail"
+	"github.com/spf13/viper"
+)
+
+// notifyTimeout bounds each notification, so a hung receiver cannot hold up the others
+const notifyTimeout = 30 * time.Second
+
+// Notifier delivers alerts
+type Notifier interface {
+	Notify(a Alert) error
+	String() string
+}
+
+// JSON encodes the alert without escaping the > of its rule
+func (a Alert) JSON() []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(a)
+	return b.Bytes()
+}
+
+// Hook runs a command through the shell for each alert, with the alert as JSON
+// on stdin and in IPSEC_VPN_ALERT_* environment variables
+type Hook struct {
+	Command string
+}
+
+func (h *Hook) String() string {
+	return "hook " + h.Command
+}
+
+// Notify runs the hook
+func (h *Hook) Notify(a Alert) error {
+	payload := a.JSON()
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.Command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"IPSEC_VPN_ALERT_RULE="+a.Rule,
+		"IPSEC_VPN_ALERT_TUNNEL="+a.Tunnel,
+		"IPSEC_VPN_ALERT_STATE="+a.State,
+		"IPSEC_VPN_ALERT_VALUE="+a.Value,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Webhook posts each alert as JSON to a URL. The text field makes it readable
+// by Slack and Mattermost incoming webhooks.
+type Webhook struct {
+	URL string
+}
+
+func (w *Webhook) String() string {
+	// Webhook URLs often embed a secret token in the path
+	if u, err := url.Parse(w.URL); err == nil {
+		return "webhook " + u.Scheme + "://" + u.Host
+	}
+	return "webhook"
+}
+
+// Notify posts the alert
+func (w *Webhook) Notify(a Alert) error {
+	payload := a.JSON()
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		// The error includes the URL, which may hold a token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Email sends each alert to recipients through an SMTP server
+type Email struct {
+	*mail.Mailer
+}
+
+func (e *Email) String() string {
+	return "email to " + strings.Join(e.To, ", ")
+}
+
+// Notify sends the alert
+func (e *Email) Notify(a Alert) error {
+	body := fmt.Sprintf("Tunnel: %s\nHost: %s\nRule: %s\nState: %s\nValue: %s\nSince: %s\n",
+		a.Tunnel, a.Host, a.Rule, a.State, a.Value, a.Since.Format(time.RFC3339))
+	return e.Send("ipsec-vpn "+a.Subject(), body, a.Time)
+}
+
+// Notifiers returns the notifiers configured in alerts.hooks, alerts.webhooks
+// and alerts.email
+func Notifiers() []Notifier {
+	var notifiers []Notifier
+	for _, command := range viper.GetStringSlice("alerts.hooks") {
+		notifiers = append(notifiers, &Hook{Command: command})
+	}
+	for _, u := range viper.GetStringSlice("alerts.webhooks") {
+		notifiers = append(notifiers, &Webhook{URL: u})
+	}
+	if mailer := mail.FromConfig(); mailer != nil {
+		notifiers = append(notifiers, &Email{Mailer: mailer})
+	}
+	return notifiers
+}
+
+// NotifyAll sends an alert to each notifier in parallel, returning the error of
+// each that failed
+func NotifyAll(notifiers []Notifier, a Alert) map[Notifier]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := make(map[Notifier]error)
+	for _, n := range notifiers {
+		wg.Add(1)
+		go func(n Notifier) {
+			defer wg.Done()
+			if err := n.Notify(a); err != nil {
+				mu.Lock()
+				failed[n] = err
+				mu.Unlock()
+			}
+		}(n)
+	}
+	wg.Wait()
+	return failed
+}
+
+// Notify sends an alert to each notifier, logging those that failed
+func Notify(notifiers []Notifier, a Alert) {
+	for n, err := range NotifyAll(notifiers, a) {
+		logger.Error("Failed to send alert to %s: %v", n, err)
+	}
+}
@@ -0,0 +1,258 @@
+// Package approval implements the two-person rule for destructive operations.
+// With approval.required set, an operation such as deleting a tunnel is not
+// carried out when first asked for; a request for it is recorded instead, and
+// it only goes ahead once another operator has approved the request and the
+// operation is asked for again with the request's ID. An approval is used up by
+// the operation it was given for.
+package approval
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/spf13/viper"
+)
+
+// DefaultExpiry is how long a request may wait for approval and be used, unless
+// approval.expiry says otherwise
+const DefaultExpiry = time.Hour
+
+// idSize is the number of random bytes in a request ID
+const idSize = 8
+
+var (
+	// ErrNotFound is returned for an unknown or expired request
+	ErrNotFound = errors.New("no such approval request, or it has expired")
+	// ErrSelfApproval is returned when the requester tries to approve their own request
+	ErrSelfApproval = errors.New("a request must be approved by someone other than the requester")
+	// ErrNotApproved is returned when a request that was not approved yet is used
+	ErrNotApproved = errors.New("the request has not been approved yet")
+)
+
+// Request is a destructive operation awaiting, or given, a second person's approval
+type Request struct {
+	ID          string     `json:"id"`
+	Operation   string     `json:"operation"`
+	RequestedBy string     `json:"requested_by"`
+	Requested   time.Time  `json:"requested"`
+	ApprovedBy  string     `json:"approved_by,omitempty"`
+	Approved    *time.Time `json:"approved,omitempty"`
+	Expires     time.Time  `json:"expires"`
+}
+
+// PendingError is returned for an operation that needs approval, once a
+// request for it has been submitted
+type PendingError struct {
+	Request *Request
+}
+
+func (e *PendingError) Error() string {
+	return fmt.Sprintf("%s requires the approval of a second operator, requested as %s", e.Request.Operation, e.Request.ID)
+}
+
+// Required reports whether destructive operations need approval
+func Required() bool {
+	return viper.GetBool("approval.required")
+}
+
+// Expiry returns how long a request may wait for approval and be used
+func Expiry() time.Duration {
+	if seconds := viper.GetInt("approval.expiry"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return DefaultExpiry
+}
+
+// Check lets an operation go ahead if approval is not required, or if id names
+// an approved request for it, which is then used up. Without an id, a request
+// for the operation is submitted and returned in a *PendingError.
+func Check(id, operation, by string) error {
+	if !Required() {
+		return nil
+	}
+	if id == "" {
+		r, err := Submit(operation, by)
+		if err != nil {
+			return err
+		}
+		return &PendingError{Request: r}
+	}
+	_, err := Consume(id, operation)
+	return err
+}
+
+// Submit records a request for an operation
+func Submit(operation, by string) (*Request, error) {
+	raw := make([]byte, idSize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	r := &Request{
+		ID:          hex.EncodeToString(raw),
+		Operation:   operation,
+		RequestedBy: by,
+		Requested:   now,
+		Expires:     now.Add(Expiry()),
+	}
+	return r, save(r)
+}
+
+// Get returns a request that has not expired
+func Get(id string) (*Request, error) {
+	path, err := requestPath(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var r Request
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid approval request in %s: %v", path, err)
+	}
+	if !time.Now().Before(r.Expires) {
+		_ = os.Remove(path)
+		return nil, ErrNotFound
+	}
+	return &r, nil
+}
+
+// List returns the requests that have not expired, oldest first
+func List() ([]*Request, error) {
+	dir, err := requestsDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var requests []*Request
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		r, err := Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		requests = append(requests, r)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Requested.Before(requests[j].Requested) })
+	return requests, nil
+}
+
+// Approve approves a request on behalf of someone other than the requester
+func Approve(id, by string) (*Request, error) {
+	r, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if by == r.RequestedBy {
+		return nil, ErrSelfApproval
+	}
+	if r.Approved != nil {
+		return nil, fmt.Errorf("the request was already approved by %s", r.ApprovedBy)
+	}
+	now := time.Now()
+	r.ApprovedBy = by
+	r.Approved = &now
+	return r, save(r)
+}
+
+// Reject drops a request, approved or not
+func Reject(id string) (*Request, error) {
+	r, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	path, err := requestPath(id)
+	if err != nil {
+		return nil, err
+	}
+	return r, os.Remove(path)
+}
+
+// Consume uses up an approved request for an operation. Only the first of two
+// concurrent attempts succeeds, as the request is removed before returning.
+func Consume(id, operation string) (*Request, error) {
+	r, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if r.Operation != operation {
+		return nil, fmt.Errorf("request %s is for %s, not %s", id, r.Operation, operation)
+	}
+	if r.Approved == nil {
+		return nil, ErrNotApproved
+	}
+	path, err := requestPath(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// save records a request
+func save(r *Request) error {
+	path, err := requestPath(r.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// requestPath returns the file a request is kept in
+func requestPath(id string) (string, error) {
+	if raw, err := hex.DecodeString(id); err != nil || len(raw) != idSize {
+		return "", ErrNotFound
+	}
+	dir, err := requestsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, id+".json"), nil
+}
+
+// requestsDir returns the directory requests are kept in
+func requestsDir() (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "approvals"), nil
+}
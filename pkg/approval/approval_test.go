@@ -0,0 +1,103 @@
+package approval
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/config"
+	"github.com/spf13/viper"
+)
+
+func TestTwoPersonRule(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	if err := Check("", "delete tunnel 'office'", "alice"); err != nil {
+		t.Fatalf("Expected operations to go ahead unless approval is required, got %v", err)
+	}
+	viper.Set("approval.required", true)
+	defer viper.Set("approval.required", false)
+
+	var pending *PendingError
+	if err := Check("", "delete tunnel 'office'", "alice"); !errors.As(err, &pending) {
+		t.Fatalf("Expected a request to be submitted, got %v", err)
+	}
+	id := pending.Request.ID
+	if err := Check(id, "delete tunnel 'office'", "alice"); !errors.Is(err, ErrNotApproved) {
+		t.Errorf("Expected an unapproved request to be refused, got %v", err)
+	}
+	if _, err := Approve(id, "alice"); !errors.Is(err, ErrSelfApproval) {
+		t.Errorf("Expected the requester not to approve their own request, got %v", err)
+	}
+	if _, err := Approve(id, "bob"); err != nil {
+		t.Fatalf("Approve failed: %v", err)
+	}
+	if err := Check(id, "delete tunnel 'branch'", "alice"); err == nil {
+		t.Error("Expected the approval not to cover another operation")
+	}
+	if err := Check(id, "delete tunnel 'office'", "alice"); err != nil {
+		t.Fatalf("Expected the approved operation to go ahead, got %v", err)
+	}
+	if err := Check(id, "delete tunnel 'office'", "alice"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the approval to be used up, got %v", err)
+	}
+
+	// Requests expire
+	r, err := Submit("apply the breakout routes", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Expires = time.Now().Add(-time.Second)
+	if err := save(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Approve(r.ID, "bob"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an expired request to be gone, got %v", err)
+	}
+	if requests, err := List(); err != nil || len(requests) != 0 {
+		t.Errorf("Expected no requests, got %v: %v", requests, err)
+	}
+
+	if _, err := Get("../../etc/passwd"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an invalid ID to be refused, got %v", err)
+	}
+}
+
+func TestRequiredNotOverridable(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the system configuration file must be owned by root")
+	}
+	viper.Set("config_dir", t.TempDir())
+	t.Cleanup(viper.Reset)
+
+	system := filepath.Join(t.TempDir(), ".ipsec-vpn.yaml")
+	if err := os.WriteFile(system, []byte("approval:\n  required: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The operator controls the environment, --set and --config
+	t.Setenv("IPSEC_APPROVAL_REQUIRED", "false")
+	viper.SetEnvPrefix("IPSEC")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	config.Bind()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader("approval:\n  required: false\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ApplyOverrides([]string{"approval.required=false"}); err == nil {
+		t.Error("Expected an override of approval.required to be rejected")
+	}
+	if err := config.ApplyPolicy(system); err != nil {
+		t.Fatal(err)
+	}
+
+	var pending *PendingError
+	if err := Check("", "delete key 'nokey'", "alice"); !errors.As(err, &pending) {
+		t.Errorf("Expected approval to stay required, got %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+// Package breakout sends the traffic to chosen destinations, such as SaaS
+// services, straight out of a local interface instead of through the VPN. The
+// destinations come from prefix lists: static lists in the configuration, or
+// feeds such as Microsoft's 365 endpoints or Zoom's IP ranges, fetched over HTTP
+// and cached so that they still apply while the feed cannot be reached.
+package breakout
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/spf13/viper"
+)
+
+// Feed formats
+const (
+	FormatPlain = "plain" // One prefix or address per line, # starts a comment
+	FormatM365  = "m365"  // Microsoft 365 endpoints web service JSON, Optimize category
+)
+
+// Formats lists the feed formats
+var Formats = []string{FormatPlain, FormatM365}
+
+// Where the prefixes of a list came from
+const (
+	SourceStatic = "static"
+	SourceFeed   = "feed"
+	SourceCache  = "cache"
+)
+
+// fetchTimeout bounds the download of a feed
+const fetchTimeout = 30 * time.Second
+
+// Shortest prefixes accepted. Anything broader would take over the default route
+// through the VPN rather than carve destinations out of it.
+const (
+	minPrefixIPv4 = 8
+	minPrefixIPv6 = 16
+)
+
+// List is a prefix list from the breakout configuration. It has static prefixes,
+// a feed URL, or both.
+type List struct {
+	Name     string
+	URL      string
+	Format   string
+	Prefixes []string
+}
+
+// Result is the prefixes a list resolved to. Updated is when the feed was
+// fetched, and Err why it could not be, if it was not.
+type Result struct {
+	List     List
+	Prefixes []*net.IPNet
+	Source   string
+	Updated  time.Time
+	Err      error
+}
+
+// Lists returns the configured prefix lists
+func Lists() ([]List, error) {
+	var lists []List
+	if err := viper.UnmarshalKey("breakout.lists", &lists); err != nil {
+		return nil, fmt.Errorf("invalid breakout configuration: %v", err)
+	}
+	for i := range lists {
+		if lists[i].Format == "" {
+			lists[i].Format = FormatPlain
+		}
+	}
+	return lists, nil
+}
+
+// LoadCached resolves a list using the cached copy of its feed, without fetching it
+func LoadCached(l List) Result {
+	return load(l, false)
+}
+
+// load resolves a list to its prefixes, fetching its feed if fetch is set and
+// falling back to the cached copy of the last successful fetch
+func load(l List, fetch bool) Result {
+	r := Result{List: l, Source: SourceStatic}
+	static, err := Parse([]byte(strings.Join(l.Prefixes, "\n")), FormatPlain)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	r.Prefixes = static
+	if l.URL == "" {
+		return r
+	}
+
+	var feed []*net.IPNet
+	if fetch {
+		feed, err = fetchFeed(l)
+		if err == nil {
+			r.Source, r.Updated = SourceFeed, time.Now()
+		} else {
+			r.Err = err
+			logger.Network.Error("Failed to fetch prefix list '%s', using the cached copy: %v", l.Name, err)
+		}
+	}
+	if feed == nil {
+		var cacheErr error
+		if feed, r.Updated, cacheErr = readCache(l.Name); cacheErr == nil {
+			r.Source = SourceCache
+		} else if r.Err == nil {
+			r.Err = cacheErr
+		}
+	}
+	r.Prefixes = append(r.Prefixes, feed...)
+	return r
+}
+
+// fetchFeed downloads and parses the feed of a list, caching it on success
+func fetchFeed(l List) ([]*net.IPNet, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(l.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", l.URL, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", l.URL, err)
+	}
+
+	prefixes, err := Parse(data, l.Format)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("%s lists no prefixes", l.URL)
+	}
+	if err := writeCache(l.Name, prefixes); err != nil {
+		logger.Network.Error("Failed to cache prefix list '%s': %v", l.Name, err)
+	}
+	return prefixes, nil
+}
+
+// Parse reads the prefixes of a feed in format. Bare addresses become host
+// prefixes, and duplicates are dropped.
+func Parse(data []byte, format string) ([]*net.IPNet, error) {
+	var entries []string
+	switch format {
+	case FormatPlain:
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				entries = append(entries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	case FormatM365:
+		var endpoints []struct {
+			Category string   `json:"category"`
+			IPs      []string `json:"ips"`
+		}
+		if err := json.Unmarshal(data, &endpoints); err != nil {
+			return nil, fmt.Errorf("invalid Microsoft 365 endpoints: %v", err)
+		}
+		for _, e := range endpoints {
+			if e.Category == "Optimize" {
+				entries = append(entries, e.IPs...)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown format '%s', expected %s or %s", format, FormatPlain, FormatM365)
+	}
+
+	var prefixes []*net.IPNet
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[prefix.String()] {
+			seen[prefix.String()] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// parsePrefix parses a prefix or address, refusing prefixes too broad to break out
+func parsePrefix(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix '%s'", s)
+	}
+	ones, bits := prefix.Mask.Size()
+	if (bits == 32 && ones < minPrefixIPv4) || (bits == 128 && ones < minPrefixIPv6) {
+		return nil, fmt.Errorf("prefix %s is too broad to break out, the shortest allowed are /%d and /%d", s, minPrefixIPv4, minPrefixIPv6)
+	}
+	return prefix, nil
+}
+
+// Apply resolves every list and routes its prefixes out of breakout.interface,
+// through breakout.gateway, removing the routes of prefixes no longer listed.
+// With a gateway, only prefixes of its address family are routed. Feeds are
+// fetched unless offline is set. It returns the lists and how many routes were
+// added and removed.
+func Apply(offline bool) ([]Result, int, int, error) {
+	iface := viper.GetString("breakout.interface")
+	if iface == "" {
+		return nil, 0, 0, errors.New("no breakout interface configured, set breakout.interface")
+	}
+	gateway := viper.GetString("breakout.gateway")
+	lists, err := Lists()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	results := make([]Result, 0, len(lists))
+	var prefixes []*net.IPNet
+	for _, l := range lists {
+		r := load(l, !offline)
+		results = append(results, r)
+		prefixes = append(prefixes, r.Prefixes...)
+	}
+	prefixes = routable(prefixes, gateway)
+
+	added, removed, err := network.SetBreakoutRoutes(prefixes, iface, gateway)
+	if err != nil {
+		return results, added, removed, err
+	}
+	logger.Network.Debug("Breaking out %d prefixes through %s: %d routes added, %d removed", len(prefixes), iface, added, removed)
+	return results, added, removed, nil
+}
+
+// routable drops duplicate prefixes, and those a gateway of the other address
+// family cannot reach
+func routable(prefixes []*net.IPNet, gateway string) []*net.IPNet {
+	gw := net.ParseIP(gateway)
+	seen := make(map[string]bool)
+	return slices.DeleteFunc(prefixes, func(p *net.IPNet) bool {
+		if (gw != nil && (p.IP.To4() == nil) != (gw.To4() == nil)) || seen[p.String()] {
+			return true
+		}
+		seen[p.String()] = true
+		return false
+	})
+}
+
+// Clear removes every breakout route and returns how many there were
+func Clear() (int, error) {
+	return network.ClearBreakoutRoutes()
+}
+
+// cachePath returns the file the last fetched feed of a list is kept in
+func cachePath(name string) (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "breakout", name+".txt"), nil
+}
+
+// writeCache saves the prefixes of a feed in the plain format
+func writeCache(name string, prefixes []*net.IPNet) error {
+	path, err := cachePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, p := range prefixes {
+		fmt.Fprintln(&b, p)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// readCache returns the cached prefixes of a feed and when they were fetched
+func readCache(name string) ([]*net.IPNet, time.Time, error) {
+	path, err := cachePath(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("prefix list '%s' has not been fetched yet", name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	prefixes, err := Parse(data, FormatPlain)
+	return prefixes, info.ModTime(), err
+}
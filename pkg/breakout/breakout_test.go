@@ -0,0 +1,80 @@
+package breakout
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParse(t *testing.T) {
+	plain := []byte(`# Zoom meetings
+3.7.35.0/25
+3.21.137.128/25  # US
+3.7.35.0/25
+2620:123:2000::/40
+170.114.10.10
+`)
+	prefixes, err := Parse(plain, FormatPlain)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	var got []string
+	for _, p := range prefixes {
+		got = append(got, p.String())
+	}
+	if want := "3.7.35.0/25 3.21.137.128/25 2620:123:2000::/40 170.114.10.10/32"; strings.Join(got, " ") != want {
+		t.Errorf("Expected %s, got %v", want, got)
+	}
+
+	m365 := []byte(`[
+  {"id": 1, "serviceArea": "Exchange", "category": "Optimize", "ips": ["13.107.6.152/31", "2603:1006::/40"]},
+  {"id": 46, "serviceArea": "Common", "category": "Allow", "ips": ["52.108.0.0/14"]},
+  {"id": 56, "serviceArea": "Common", "category": "Default", "urls": ["*.msocdn.com"]}
+]`)
+	prefixes, err = Parse(m365, FormatM365)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(prefixes) != 2 || prefixes[0].String() != "13.107.6.152/31" {
+		t.Errorf("Expected only the Optimize prefixes, got %v", prefixes)
+	}
+
+	for _, bad := range []string{"10.0.0.0/4", "::/0", "not-a-prefix"} {
+		if _, err := Parse([]byte(bad), FormatPlain); err == nil {
+			t.Errorf("Expected %s to be refused", bad)
+		}
+	}
+}
+
+func TestLoadCache(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	up := true
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("198.51.100.0/24\n203.0.113.0/24\n"))
+	}))
+	defer feed.Close()
+
+	l := List{Name: "saas", URL: feed.URL, Format: FormatPlain, Prefixes: []string{"192.0.2.0/24"}}
+	if r := LoadCached(l); r.Err == nil || len(r.Prefixes) != 1 {
+		t.Errorf("Expected only the static prefix before the first fetch, got %+v", r)
+	}
+	if r := load(l, true); r.Err != nil || r.Source != SourceFeed || len(r.Prefixes) != 3 {
+		t.Fatalf("Expected the feed and static prefixes, got %+v", r)
+	}
+
+	// An unreachable feed keeps its last prefixes
+	up = false
+	r := load(l, true)
+	if r.Err == nil || r.Source != SourceCache || len(r.Prefixes) != 3 || r.Updated.IsZero() {
+		t.Errorf("Expected the cached feed with the fetch error, got %+v", r)
+	}
+}
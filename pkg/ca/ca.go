@@ -0,0 +1,267 @@
+// Package ca is a small certificate authority a hub runs for its spokes. It
+// issues short-lived certificates over the RESTCONF management channel, which
+// spokes renew well before they expire, so a compromised spoke is cut off by no
+// longer renewing its certificate instead of by a CRL or OCSP responder.
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/spf13/viper"
+)
+
+// DefaultValidity is the lifetime of issued certificates unless ca.validity is set
+const DefaultValidity = 24 * time.Hour
+
+// caLifetime is the lifetime of the CA certificate itself
+const caLifetime = 10 * 365 * 24 * time.Hour
+
+// backdate is how far NotBefore is set in the past, for peers whose clocks lag
+const backdate = 5 * time.Minute
+
+// Files of the CA in its directory
+const (
+	certificateFile = "ca.crt"
+	privateKeyFile  = "ca.key"
+)
+
+// hostname matches common names that are also DNS names
+var hostname = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9_-]*[A-Za-z0-9])?)*$`)
+
+// ErrNotInitialized is returned when the CA has not been created
+var ErrNotInitialized = errors.New("no certificate authority, run 'ipsec-vpn ca init' first")
+
+// CA is the certificate authority of a hub
+type CA struct {
+	Certificate    *x509.Certificate
+	CertificatePEM string
+	key            crypto.Signer
+}
+
+// Dir returns the directory the CA certificate and private key are kept in
+func Dir() (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "ca"), nil
+}
+
+// Validity returns the lifetime of issued certificates, ca.validity seconds
+func Validity() time.Duration {
+	if seconds := viper.GetInt("ca.validity"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return DefaultValidity
+}
+
+// Init creates the CA with a new P-256 key and a self-signed certificate. It
+// refuses to replace an existing CA, which would strand every spoke.
+func Init(commonName string) (*CA, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, certificateFile)); err == nil {
+		return nil, fmt.Errorf("a certificate authority already exists in %s", dir)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, privateKeyFile), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, certificateFile), certPEM, 0644); err != nil {
+		return nil, err
+	}
+	return Load()
+}
+
+// Load reads the CA, returning ErrNotInitialized if it has not been created
+func Load() (*CA, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := os.ReadFile(filepath.Join(dir, certificateFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNotInitialized
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA certificate: %v", err)
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, privateKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no private key in %s", filepath.Join(dir, privateKeyFile))
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA private key: %v", err)
+	}
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("invalid CA private key: cannot sign")
+	}
+	return &CA{Certificate: cert, CertificatePEM: string(certPEM), key: key}, nil
+}
+
+// Issue signs a certificate request for a common name, valid for the given
+// duration. The subject of the request is ignored: the common name is the
+// identity the caller authenticated, so a spoke cannot ask for another's.
+func (c *CA) Issue(csrPEM []byte, commonName string, validity time.Duration) (*Certificate, error) {
+	if commonName == "" {
+		return nil, errors.New("no common name to issue a certificate for")
+	}
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no PEM encoded certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate request: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %v", err)
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(c.Certificate.NotAfter) {
+		notAfter = c.Certificate.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-backdate),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	// TLS and IKE peers, and the native clients of road warriors identified by
+	// email, match names against the subject alternative names
+	if ip := net.ParseIP(commonName); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else if hostname.MatchString(commonName) {
+		template.DNSNames = []string{commonName}
+	} else if addr, err := mail.ParseAddress(commonName); err == nil && addr.Address == commonName {
+		template.EmailAddresses = []string{commonName}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.Certificate, csr.PublicKey, c.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{
+		Certificate:    cert,
+		CertificatePEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		CAPEM:          c.CertificatePEM,
+		SerialNumber:   Serial(cert),
+	}, nil
+}
+
+// IssueKey generates a key and issues a certificate for it, for the hub itself
+// or for spokes that are handed their first certificate out of band
+func (c *CA) IssueKey(commonName string, validity time.Duration) (*Certificate, error) {
+	key, csr, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := c.Issue(csr, commonName, validity)
+	if err != nil {
+		return nil, err
+	}
+	if cert.PrivateKeyPEM, err = encodeKey(key); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Serial formats the serial number of a certificate as colon-separated hex
+func Serial(cert *x509.Certificate) string {
+	hex := fmt.Sprintf("%x", cert.SerialNumber)
+	if len(hex)%2 != 0 {
+		hex = "0" + hex
+	}
+	parts := make([]string, 0, len(hex)/2)
+	for i := 0; i < len(hex); i += 2 {
+		parts = append(parts, hex[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+// newSerial returns a random 128-bit serial number
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// parseCertificate parses the first certificate of a PEM bundle
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
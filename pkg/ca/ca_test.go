@@ -0,0 +1,122 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/pkcs12"
+)
+
+func TestIssue(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	if _, err := Load(); err != ErrNotInitialized {
+		t.Fatalf("Expected ErrNotInitialized before init, got %v", err)
+	}
+	authority, err := Init("hub CA")
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if _, err := Init("hub CA"); err == nil {
+		t.Error("Expected an existing CA not to be replaced")
+	}
+
+	key, csr, err := newRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := authority.Issue(csr, "spoke-1", DefaultValidity)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if cert.Certificate.Subject.CommonName != "spoke-1" || !key.PublicKey.Equal(cert.Certificate.PublicKey) {
+		t.Errorf("Unexpected certificate for %s", cert.Certificate.Subject)
+	}
+	if len(cert.Certificate.DNSNames) != 1 || cert.Certificate.DNSNames[0] != "spoke-1" {
+		t.Errorf("Expected the common name as DNS name, got %q", cert.Certificate.DNSNames)
+	}
+	if lifetime := cert.Certificate.NotAfter.Sub(cert.Certificate.NotBefore); lifetime != DefaultValidity+backdate {
+		t.Errorf("Expected a lifetime of %v, got %v", DefaultValidity+backdate, lifetime)
+	}
+
+	loaded, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(loaded.Certificate)
+	if _, err := cert.Certificate.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("Issued certificate does not verify: %v", err)
+	}
+
+	if _, err := authority.Issue([]byte("not a request"), "spoke-1", DefaultValidity); err == nil {
+		t.Error("Expected an invalid request to be rejected")
+	}
+	if _, err := authority.Issue(csr, "", DefaultValidity); err == nil {
+		t.Error("Expected a certificate without a common name to be refused")
+	}
+}
+
+func TestRenewAt(t *testing.T) {
+	start := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	cert := &Certificate{Certificate: &x509.Certificate{NotBefore: start, NotAfter: start.Add(24 * time.Hour)}}
+	if got := cert.renewAt(); !got.Equal(start.Add(16 * time.Hour)) {
+		t.Errorf("Expected renewal after 16h, got %v", got)
+	}
+}
+
+func TestPKCS12(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	authority, err := Init("hub CA")
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	cert, err := authority.IssueKey("alice@example.com", DefaultValidity)
+	if err != nil {
+		t.Fatalf("IssueKey failed: %v", err)
+	}
+	if len(cert.Certificate.EmailAddresses) != 1 || cert.Certificate.EmailAddresses[0] != "alice@example.com" {
+		t.Errorf("Expected the common name as email address, got %q", cert.Certificate.EmailAddresses)
+	}
+
+	data, err := cert.PKCS12("alice", "correct horse")
+	if err != nil {
+		t.Fatalf("PKCS12 failed: %v", err)
+	}
+	if _, err := pkcs12.ToPEM(data, "wrong horse"); err == nil {
+		t.Error("Expected the wrong password to be refused")
+	}
+	blocks, err := pkcs12.ToPEM(data, "correct horse")
+	if err != nil {
+		t.Fatalf("PKCS12 file does not decode: %v", err)
+	}
+	var certs []*x509.Certificate
+	var key any
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			c, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certs = append(certs, c)
+		case "PRIVATE KEY":
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(certs) != 2 || !certs[0].Equal(cert.Certificate) || !certs[1].Equal(authority.Certificate) {
+		t.Errorf("Expected the certificate and the CA, got %d certificates", len(certs))
+	}
+	if signer, ok := key.(crypto.Signer); !ok || !signer.Public().(*ecdsa.PublicKey).Equal(cert.Certificate.PublicKey) {
+		t.Error("Expected the private key of the certificate")
+	}
+}
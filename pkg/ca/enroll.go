@@ -0,0 +1,284 @@
+package ca
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/spf13/viper"
+)
+
+// Operation is the RESTCONF operation the hub issues certificates through
+const Operation = "ipsec-vpn:issue-certificate"
+
+// requestTimeout bounds a single request to the hub
+const requestTimeout = 30 * time.Second
+
+// Retry intervals for failed renewals
+const (
+	minRetry = 5 * time.Second
+	maxRetry = 5 * time.Minute
+)
+
+// ErrNotConfigured is returned when no hub is set
+var ErrNotConfigured = errors.New("no hub configured, set ca.hub")
+
+// Certificate is a certificate issued by the CA of a hub, with the private key
+// it was requested for
+type Certificate struct {
+	Certificate    *x509.Certificate
+	CertificatePEM string
+	PrivateKeyPEM  string
+	CAPEM          string
+	SerialNumber   string
+}
+
+// renewAt returns when a certificate should be replaced: after two thirds of its
+// lifetime, leaving the rest to retry if the hub is unreachable
+func (c *Certificate) renewAt() time.Time {
+	notBefore, notAfter := c.Certificate.NotBefore, c.Certificate.NotAfter
+	return notBefore.Add(notAfter.Sub(notBefore) * 2 / 3)
+}
+
+// IssueRequest is the input of the issue-certificate operation
+type IssueRequest struct {
+	CSR string `json:"csr"`
+}
+
+// IssueResponse is the output of the issue-certificate operation
+type IssueResponse struct {
+	Certificate   string `json:"certificate"`
+	CACertificate string `json:"ca-certificate"`
+}
+
+// Client enrolls with the CA of a hub. It authenticates with the certificate
+// it was last issued while that is valid, and otherwise with the bootstrap
+// certificate in ca.certificate, issued by the hub's restconf.client_ca.
+type Client struct {
+	url  string
+	http *http.Client
+
+	mu        sync.Mutex
+	current   *tls.Certificate
+	bootstrap *tls.Certificate
+}
+
+// ClientFromConfig creates a client from the ca settings. Certificates issued
+// before are read from cert.pem and key.pem in dir, if given.
+func ClientFromConfig(dir string) (*Client, error) {
+	hub := viper.GetString("ca.hub")
+	if hub == "" {
+		return nil, ErrNotConfigured
+	}
+	u, err := url.Parse(hub)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid hub address %q, expected an https URL", hub)
+	}
+
+	c := &Client{url: strings.TrimRight(hub, "/") + "/restconf/operations/" + Operation}
+	if cert, key := viper.GetString("ca.certificate"), viper.GetString("ca.private_key"); cert != "" && key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load bootstrap certificate: %v", err)
+		}
+		c.bootstrap = &pair
+	}
+	if dir != "" {
+		if pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+			c.current = &pair
+		}
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, GetClientCertificate: c.clientCertificate}
+	if path := viper.GetString("ca.hub_ca"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read hub CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", path)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	// Connections are not reused, so each request presents the latest certificate
+	transport.DisableKeepAlives = true
+	c.http = &http.Client{Transport: transport, Timeout: requestTimeout}
+	return c, nil
+}
+
+// clientCertificate picks the certificate to authenticate with
+func (c *Client) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != nil && c.current.Leaf != nil && time.Now().Before(c.current.Leaf.NotAfter) {
+		return c.current, nil
+	}
+	if c.bootstrap != nil {
+		return c.bootstrap, nil
+	}
+	return nil, errors.New("no valid certificate to authenticate with, set ca.certificate and ca.private_key")
+}
+
+// Enroll generates a new key and has the hub issue a certificate for it. The
+// common name is whatever the hub authenticated this client as.
+func (c *Client) Enroll(ctx context.Context) (*Certificate, error) {
+	key, csr, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	input := map[string]IssueRequest{"ipsec-vpn:input": {CSR: string(csr)}}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/yang-data+json")
+	req.Header.Set("Accept", "application/yang-data+json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp.StatusCode, data)
+	}
+
+	var output struct {
+		Output IssueResponse `json:"ipsec-vpn:output"`
+	}
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, fmt.Errorf("invalid response from hub: %v", err)
+	}
+	cert, err := parseCertificate([]byte(output.Output.Certificate))
+	if err != nil {
+		return nil, fmt.Errorf("hub returned an invalid certificate: %v", err)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, errors.New("hub returned a certificate for another key")
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	issued := &Certificate{
+		Certificate:    cert,
+		CertificatePEM: output.Output.Certificate,
+		PrivateKeyPEM:  keyPEM,
+		CAPEM:          output.Output.CACertificate,
+		SerialNumber:   Serial(cert),
+	}
+	c.mu.Lock()
+	c.current = &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+	c.mu.Unlock()
+	return issued, nil
+}
+
+// newRequest generates a P-256 key and a certificate request for it. The
+// request has no subject, as the CA fills in the name it authenticated.
+func newRequest() (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}), nil
+}
+
+// encodeKey PEM encodes a private key in PKCS #8
+func encodeKey(key *ecdsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// responseError returns the error message of a RESTCONF error response
+func responseError(status int, data []byte) error {
+	var resp struct {
+		Errors struct {
+			Error []struct {
+				Message string `json:"error-message"`
+			} `json:"error"`
+		} `json:"ietf-restconf:errors"`
+	}
+	if err := json.Unmarshal(data, &resp); err == nil && len(resp.Errors.Error) > 0 {
+		return fmt.Errorf("hub returned %d: %s", status, resp.Errors.Error[0].Message)
+	}
+	return fmt.Errorf("hub returned %d", status)
+}
+
+// WatchCertificate enrolls and passes the certificate to update, then enrolls
+// again each time two thirds of the current one's lifetime have passed, until
+// the context is cancelled. Failures are retried with backoff, and the first
+// failure to renew a certificate publishes a certificate.expiring event.
+func (c *Client) WatchCertificate(ctx context.Context, update func(*Certificate)) error {
+	retry := minRetry
+	next := time.Now()
+	var current *Certificate
+	warned := false
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(next)):
+		}
+
+		cert, err := c.Enroll(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			logger.Error("Failed to renew certificate from the hub, retrying in %v: %v", retry, err)
+			if current != nil && !warned {
+				warned = true
+				e := events.New(events.TypeCertificateExpiring, "")
+				e.Expires = &current.Certificate.NotAfter
+				e.Reason = fmt.Sprintf("renewing the certificate for %s from the hub failed: %v", current.Certificate.Subject.CommonName, err)
+				events.Publish(e)
+			}
+			next = time.Now().Add(retry)
+			retry = min(2*retry, maxRetry)
+			continue
+		}
+
+		retry = minRetry
+		current, warned = cert, false
+		next = cert.renewAt()
+		logger.Info("Hub issued certificate %s for %s, valid until %s", cert.SerialNumber, cert.Certificate.Subject.CommonName, cert.Certificate.NotAfter.Format(time.RFC3339))
+		update(cert)
+	}
+}
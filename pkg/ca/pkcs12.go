@@ -0,0 +1,266 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"unicode/utf16"
+)
+
+// pkcs12Iterations is the iteration count of the key derivation of PKCS #12 files
+const pkcs12Iterations = 2048
+
+// Object identifiers of PKCS #12 and the PKCS #7 content it is made of
+var (
+	oidData              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidShroudedKeyBag    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBEWithSHAAnd3DES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1              = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+type (
+	pfx struct {
+		Version  int
+		AuthSafe contentInfo
+		MacData  macData
+	}
+	contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue // Explicitly tagged [0]
+	}
+	macData struct {
+		Mac        digestInfo
+		MacSalt    []byte
+		Iterations int
+	}
+	digestInfo struct {
+		Algorithm algorithmIdentifier
+		Digest    []byte
+	}
+	algorithmIdentifier struct {
+		Algorithm  asn1.ObjectIdentifier
+		Parameters asn1.RawValue `asn1:"optional"`
+	}
+	pbeParams struct {
+		Salt       []byte
+		Iterations int
+	}
+	safeBag struct {
+		ID         asn1.ObjectIdentifier
+		Value      asn1.RawValue     // Explicitly tagged [0]
+		Attributes []pkcs12Attribute `asn1:"set,optional"`
+	}
+	pkcs12Attribute struct {
+		ID    asn1.ObjectIdentifier
+		Value asn1.RawValue `asn1:"set"`
+	}
+	certBag struct {
+		ID   asn1.ObjectIdentifier
+		Data []byte `asn1:"tag:0,explicit"`
+	}
+	encryptedPrivateKeyInfo struct {
+		Algorithm     algorithmIdentifier
+		EncryptedData []byte
+	}
+)
+
+// PKCS12 encodes the certificate, its private key and the CA certificate in a
+// PKCS #12 file protected by password, as operating systems import client
+// identities. It uses 3DES and a SHA-1 MAC, the one scheme that the certificate
+// stores of iOS, macOS, Windows and Android all take, so the password is what
+// protects the key: it should be long and random.
+func (c *Certificate) PKCS12(name, password string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(c.PrivateKeyPEM))
+	if block == nil {
+		return nil, errors.New("no private key to encode")
+	}
+	keyID := sha1.Sum(c.Certificate.Raw)
+	attributes, err := bagAttributes(name, keyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []safeBag{}
+	chain := [][]byte{c.Certificate.Raw}
+	if ca, err := parseCertificate([]byte(c.CAPEM)); err == nil {
+		chain = append(chain, ca.Raw)
+	}
+	for i, der := range chain {
+		bag, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: der})
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, safeBag{ID: oidCertBag, Value: explicit(bag)})
+		if i == 0 {
+			certs[0].Attributes = attributes
+		}
+	}
+
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	encrypted, err := pbeEncrypt(block.Bytes, salt, bmpPassword(password))
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return nil, err
+	}
+	shrouded, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     algorithmIdentifier{Algorithm: oidPBEWithSHAAnd3DES, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := []safeBag{{ID: oidShroudedKeyBag, Value: explicit(shrouded), Attributes: attributes}}
+
+	var safe []contentInfo
+	for _, bags := range [][]safeBag{certs, keys} {
+		info, err := dataContent(bags)
+		if err != nil {
+			return nil, err
+		}
+		safe = append(safe, info)
+	}
+	authSafe, err := asn1.Marshal(safe)
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt := make([]byte, 8)
+	if _, err := rand.Read(macSalt); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, pkcs12KDF(macSalt, bmpPassword(password), 3, 20))
+	mac.Write(authSafe)
+	content, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pfx{
+		Version:  3,
+		AuthSafe: contentInfo{ContentType: oidData, Content: explicit(content)},
+		MacData: macData{
+			Mac:        digestInfo{Algorithm: algorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue}, Digest: mac.Sum(nil)},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// bagAttributes returns the friendly name of the identity and the ID pairing
+// its certificate with its key
+func bagAttributes(name string, keyID []byte) ([]pkcs12Attribute, error) {
+	var bmp []byte
+	for _, r := range utf16.Encode([]rune(name)) {
+		bmp = append(bmp, byte(r>>8), byte(r))
+	}
+	friendlyName, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmp})
+	if err != nil {
+		return nil, err
+	}
+	localKeyID, err := asn1.Marshal(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return []pkcs12Attribute{
+		{ID: oidFriendlyName, Value: asn1.RawValue{FullBytes: setOf(friendlyName)}},
+		{ID: oidLocalKeyID, Value: asn1.RawValue{FullBytes: setOf(localKeyID)}},
+	}, nil
+}
+
+// setOf wraps a DER encoded value in a SET
+func setOf(der []byte) []byte {
+	set, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der})
+	return set
+}
+
+// dataContent wraps safe bags in unencrypted content
+func dataContent(bags []safeBag) (contentInfo, error) {
+	contents, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	octets, err := asn1.Marshal(contents)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{ContentType: oidData, Content: explicit(octets)}, nil
+}
+
+// explicit tags a DER encoded value [0], which encoding/asn1 leaves to raw values
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// bmpPassword encodes a password the way PKCS #12 derives keys from it: in
+// UTF-16 big endian with a terminating zero
+func bmpPassword(password string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(password)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return append(b, 0, 0)
+}
+
+// pbeEncrypt encrypts data with pbeWithSHAAnd3-KeyTripleDES-CBC
+func pbeEncrypt(data, salt, password []byte) ([]byte, error) {
+	block, err := des.NewTripleDESCipher(pkcs12KDF(salt, password, 1, 24))
+	if err != nil {
+		return nil, err
+	}
+	padding := block.BlockSize() - len(data)%block.BlockSize()
+	padded := append(bytes.Clone(data), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, pkcs12KDF(salt, password, 2, 8)).CryptBlocks(padded, padded)
+	return padded, nil
+}
+
+// pkcs12KDF derives size bytes of key material from a password with SHA-1, as
+// in RFC 7292 appendix B.2: id 1 for keys, 2 for IVs and 3 for MAC keys
+func pkcs12KDF(salt, password []byte, id byte, size int) []byte {
+	const u, v = sha1.Size, 64
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		n := (len(b) + v - 1) / v * v
+		return bytes.Repeat(b, (n+len(b)-1)/len(b))[:n]
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+
+	var out []byte
+	for len(out) < size {
+		h := sha1.Sum(append(d, i...))
+		a := h[:]
+		for range pkcs12Iterations - 1 {
+			h = sha1.Sum(a)
+			a = h[:]
+		}
+		out = append(out, a...)
+
+		// I_j = (I_j + B + 1) mod 2^(v*8) for each v byte block of I
+		b := fill(a)
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(i[j+k]) + int(b[k]) + carry
+				i[j+k], carry = byte(sum), sum>>8
+			}
+		}
+	}
+	return out[:size]
+}
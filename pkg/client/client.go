@@ -0,0 +1,531 @@
+// Package client manages the tunnels and advertised networks of an ipsec-vpn
+// gateway through its RESTCONF API, as described by the OpenAPI document the
+// gateway serves at /restconf/openapi.json
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the module, its operations and the headers of the API
+const (
+	Module           = "ipsec-vpn"
+	ApproveOperation = Module + ":approve"
+	IssueOperation   = Module + ":issue-certificate"
+	ApprovalHeader   = "Ipsec-Vpn-Approval"
+	TotalCountHeader = "Ipsec-Vpn-Total-Count"
+)
+
+// mediaType is the RESTCONF media type for JSON encoded YANG data
+const mediaType = "application/yang-data+json"
+
+// maxResponseSize bounds the size of a response body
+const maxResponseSize = 16 << 20
+
+// requestTimeout bounds a single request of a client created by NewTLS
+const requestTimeout = 30 * time.Second
+
+// ErrNotFound matches errors for resources that do not exist
+var ErrNotFound = errors.New("not found")
+
+// Status is the operational state of a tunnel
+type Status string
+
+// States of a tunnel
+const (
+	StatusUp      Status = "UP"
+	StatusDown    Status = "DOWN"
+	StatusError   Status = "ERROR"
+	StatusUnknown Status = "UNKNOWN"
+)
+
+// Tunnel is an entry of the tunnel list. Leaves that are empty are left to
+// the gateway's defaults when the tunnel is created.
+type Tunnel struct {
+	Name             string       `json:"name"`
+	Mode             string       `json:"mode,omitempty"`
+	LocalIP          string       `json:"local-ip,omitempty"`
+	RemoteIP         string       `json:"remote-ip,omitempty"`
+	LocalSubnet      string       `json:"local-subnet,omitempty"`
+	RemoteSubnet     string       `json:"remote-subnet,omitempty"`
+	Encryption       string       `json:"encryption,omitempty"`
+	PostQuantum      *bool        `json:"post-quantum,omitempty"`
+	Namespace        string       `json:"namespace,omitempty"`
+	WireGuardPeerKey string       `json:"wireguard-peer-key,omitempty"`
+	ListenPort       int          `json:"listen-port,omitempty"`
+	PSKRef           string       `json:"psk-ref,omitempty"`
+	PeerGroup        string       `json:"peer-group,omitempty"`
+	PeerID           string       `json:"peer-id,omitempty"`
+	PeerCA           string       `json:"peer-ca,omitempty"`
+	VirtualIPPool    string       `json:"virtual-ip-pool,omitempty"`
+	Shortcuts        bool         `json:"shortcuts,omitempty"`
+	KillSwitch       bool         `json:"kill-switch"`
+	RateLimit        uint64       `json:"rate-limit,omitempty,string"`
+	Enabled          bool         `json:"enabled"`
+	Labels           []Label      `json:"label,omitempty"`
+	State            *TunnelState `json:"state,omitempty"`
+}
+
+// Label is an entry of the label list of a tunnel
+type Label struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// TunnelState is the operational state of a tunnel, returned but never sent
+type TunnelState struct {
+	Status         Status `json:"status"`
+	Reason         string `json:"reason,omitempty"`
+	LastTransition string `json:"last-transition,omitempty"`
+	Peer           string `json:"peer,omitempty"`
+	NextRetry      string `json:"next-retry,omitempty"`    // While repairs of a tunnel that keeps failing are held back
+	Template       string `json:"template,omitempty"`      // Responder the tunnel is an instance of
+	PeerIdentity   string `json:"peer-identity,omitempty"` // Identity its initiator was accepted as
+	VirtualIP      string `json:"virtual-ip,omitempty"`    // Virtual IP the responder assigned its initiator
+	Via            string `json:"via,omitempty"`           // Tunnel to the hub a shortcut bypasses
+}
+
+// Network is an entry of the list of advertised networks
+type Network struct {
+	Prefix string `json:"prefix"`
+	Tunnel string `json:"tunnel"`
+	Metric int    `json:"metric"`
+}
+
+// ListOptions filters and pages through the tunnel list. Zero values are not sent.
+type ListOptions struct {
+	Fields        string   // Nodes to return, e.g. "name,status"
+	Limit         int      // At most this many tunnels
+	Offset        int      // Skip this many tunnels, in order of name
+	Status        []Status // Only tunnels in these states
+	LabelSelector string   // Only tunnels whose labels match, e.g. "site=fra,env!=lab"
+}
+
+// TunnelList is a page of the tunnel list
+type TunnelList struct {
+	Tunnels []Tunnel
+	Total   int // Tunnels matching the filters, before limit and offset
+}
+
+// JobState is where a job is in its life
+type JobState string
+
+// States of a job
+const (
+	JobRunning   JobState = "RUNNING"
+	JobSucceeded JobState = "SUCCEEDED"
+	JobFailed    JobState = "FAILED"
+)
+
+// Job is an operation the gateway runs in the background
+type Job struct {
+	ID        string    `json:"id"`
+	Operation string    `json:"operation"`
+	State     JobState  `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	Created   string    `json:"created"`
+	Finished  string    `json:"finished,omitempty"`
+	Steps     []JobStep `json:"step,omitempty"`
+}
+
+// JobStep is a point a job reached
+type JobStep struct {
+	Time    string `json:"time"`
+	Message string `json:"message"`
+}
+
+// Done reports whether a job has finished
+func (j *Job) Done() bool {
+	return j.State == JobSucceeded || j.State == JobFailed
+}
+
+// Approval is an approved request for a destructive operation
+type Approval struct {
+	Operation string `json:"operation"`
+	Expires   string `json:"expires"`
+}
+
+// Certificate is a certificate issued by the gateway's CA, in PEM
+type Certificate struct {
+	Certificate   string `json:"certificate"`
+	CACertificate string `json:"ca-certificate"`
+}
+
+// Error is an error response of the API (RFC 8040 section 7.1)
+type Error struct {
+	StatusCode int
+	Tag        string // error-tag, e.g. access-denied
+	Message    string
+	// ApprovalID is the request submitted for approval when a destructive
+	// operation needs a second operator
+	ApprovalID string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("gateway returned %d", e.StatusCode)
+	}
+	return fmt.Sprintf("gateway returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Is reports whether the error is ErrNotFound
+func (e *Error) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// Client talks to the RESTCONF API of a gateway
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+// New creates a client for the gateway at baseURL, e.g. https://gw:8443,
+// sending requests with httpClient, or http.DefaultClient if nil
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{url: strings.TrimRight(baseURL, "/"), http: httpClient}
+}
+
+// NewTLS creates a client authenticating with the certificate and key in
+// certFile and keyFile, trusting the server certificates issued by the CAs in
+// caFile, or the system roots if empty
+func NewTLS(baseURL, certFile, keyFile, caFile string) (*Client, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return New(baseURL, &http.Client{Transport: transport, Timeout: requestTimeout}), nil
+}
+
+// ListTunnels returns a page of the tunnels matching the options
+func (c *Client) ListTunnels(ctx context.Context, opts ListOptions) (*TunnelList, error) {
+	query := url.Values{}
+	if opts.Fields != "" {
+		query.Set("fields", opts.Fields)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		query.Set("offset", strconv.Itoa(opts.Offset))
+	}
+	if len(opts.Status) > 0 {
+		states := make([]string, len(opts.Status))
+		for i, s := range opts.Status {
+			states[i] = string(s)
+		}
+		query.Set("status", strings.Join(states, ","))
+	}
+	if opts.LabelSelector != "" {
+		query.Set("label-selector", opts.LabelSelector)
+	}
+	path := tunnelsPath
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var out struct {
+		Tunnels struct {
+			Tunnel []Tunnel `json:"tunnel"`
+		} `json:"ipsec-vpn:tunnels"`
+	}
+	resp, err := c.do(ctx, http.MethodGet, path, nil, nil, &out)
+	if err != nil {
+		return nil, err
+	}
+	list := &TunnelList{Tunnels: out.Tunnels.Tunnel, Total: len(out.Tunnels.Tunnel)}
+	if total, err := strconv.Atoi(resp.Header.Get(TotalCountHeader)); err == nil {
+		list.Total = total
+	}
+	return list, nil
+}
+
+// GetTunnel returns a tunnel
+func (c *Client) GetTunnel(ctx context.Context, name string) (*Tunnel, error) {
+	var out struct {
+		Tunnel []Tunnel `json:"ipsec-vpn:tunnel"`
+	}
+	if _, err := c.do(ctx, http.MethodGet, tunnelPath(name), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	if len(out.Tunnel) != 1 {
+		return nil, errors.New("invalid response from gateway: expected a single tunnel")
+	}
+	return &out.Tunnel[0], nil
+}
+
+// CreateTunnel creates a tunnel, and starts it if enabled
+func (c *Client) CreateTunnel(ctx context.Context, t Tunnel) error {
+	t.State = nil
+	_, err := c.do(ctx, http.MethodPost, tunnelsPath, entry("tunnel", t), nil, nil)
+	return err
+}
+
+// CreateTunnelAsync has the gateway create a tunnel in the background, and
+// start it if enabled, and returns the ID of the job to follow with GetJob
+func (c *Client) CreateTunnelAsync(ctx context.Context, t Tunnel) (string, error) {
+	t.State = nil
+	header := http.Header{"Prefer": {"respond-async"}}
+	resp, err := c.do(ctx, http.MethodPost, tunnelsPath, entry("tunnel", t), header, nil)
+	if err != nil {
+		return "", err
+	}
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusAccepted || !strings.HasPrefix(location, jobsPath+"/job=") {
+		return "", errors.New("invalid response from gateway: expected a job")
+	}
+	id, err := url.PathUnescape(strings.TrimPrefix(location, jobsPath+"/job="))
+	if err != nil {
+		return "", fmt.Errorf("invalid response from gateway: %v", err)
+	}
+	return id, nil
+}
+
+// ReplaceTunnel creates a tunnel, or replaces its changeable leaves, and
+// reports whether it was created
+func (c *Client) ReplaceTunnel(ctx context.Context, t Tunnel) (bool, error) {
+	t.State = nil
+	resp, err := c.do(ctx, http.MethodPut, tunnelPath(t.Name), entry("tunnel", t), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	return resp.StatusCode == http.StatusCreated, nil
+}
+
+// UpdateTunnel merges leaves into a tunnel, keyed by their YANG names such as
+// "kill-switch" or "enabled". Labels given as "label" are merged by name.
+func (c *Client) UpdateTunnel(ctx context.Context, name string, leaves map[string]any) error {
+	merged := map[string]any{"name": name}
+	for leaf, value := range leaves {
+		merged[leaf] = value
+	}
+	_, err := c.do(ctx, http.MethodPatch, tunnelPath(name), entry("tunnel", merged), nil, nil)
+	return err
+}
+
+// DeleteTunnel deletes a tunnel. When the gateway requires a second operator's
+// approval, the returned *Error carries the ID of the request submitted for
+// it; once approved, pass that ID as approvalID to go ahead.
+func (c *Client) DeleteTunnel(ctx context.Context, name, approvalID string) error {
+	var header http.Header
+	if approvalID != "" {
+		header = http.Header{ApprovalHeader: {approvalID}}
+	}
+	_, err := c.do(ctx, http.MethodDelete, tunnelPath(name), nil, header, nil)
+	return err
+}
+
+// ListNetworks returns the advertised networks
+func (c *Client) ListNetworks(ctx context.Context) ([]Network, error) {
+	var out struct {
+		Networks struct {
+			Network []Network `json:"network"`
+		} `json:"ipsec-vpn:networks"`
+	}
+	if _, err := c.do(ctx, http.MethodGet, networksPath, nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Networks.Network, nil
+}
+
+// GetNetwork returns a network advertised through a tunnel
+func (c *Client) GetNetwork(ctx context.Context, prefix, tunnel string) (*Network, error) {
+	var out struct {
+		Network []Network `json:"ipsec-vpn:network"`
+	}
+	if _, err := c.do(ctx, http.MethodGet, networkPath(prefix, tunnel), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	if len(out.Network) != 1 {
+		return nil, errors.New("invalid response from gateway: expected a single network")
+	}
+	return &out.Network[0], nil
+}
+
+// AdvertiseNetwork advertises a network through a tunnel
+func (c *Client) AdvertiseNetwork(ctx context.Context, n Network) error {
+	_, err := c.do(ctx, http.MethodPost, networksPath, entry("network", n), nil, nil)
+	return err
+}
+
+// ReplaceNetwork advertises a network, or changes its metric, and reports
+// whether it was advertised
+func (c *Client) ReplaceNetwork(ctx context.Context, n Network) (bool, error) {
+	resp, err := c.do(ctx, http.MethodPut, networkPath(n.Prefix, n.Tunnel), entry("network", n), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	return resp.StatusCode == http.StatusCreated, nil
+}
+
+// WithdrawNetwork withdraws a network advertised through a tunnel
+func (c *Client) WithdrawNetwork(ctx context.Context, prefix, tunnel string) error {
+	_, err := c.do(ctx, http.MethodDelete, networkPath(prefix, tunnel), nil, nil, nil)
+	return err
+}
+
+// GetJob returns a job the gateway runs in the background
+func (c *Client) GetJob(ctx context.Context, id string) (*Job, error) {
+	var out struct {
+		Job []Job `json:"ipsec-vpn:job"`
+	}
+	if _, err := c.do(ctx, http.MethodGet, jobsPath+"/job="+escapeKey(id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	if len(out.Job) != 1 {
+		return nil, errors.New("invalid response from gateway: expected a single job")
+	}
+	return &out.Job[0], nil
+}
+
+// Approve approves a request for a destructive operation made by another client
+func (c *Client) Approve(ctx context.Context, id string) (*Approval, error) {
+	var out struct {
+		Output Approval `json:"ipsec-vpn:output"`
+	}
+	input := map[string]any{Module + ":input": map[string]string{"id": id}}
+	if _, err := c.do(ctx, http.MethodPost, "/restconf/operations/"+ApproveOperation, input, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Output, nil
+}
+
+// IssueCertificate has the gateway's CA sign a PEM certificate request for the
+// name the client authenticated as
+func (c *Client) IssueCertificate(ctx context.Context, csrPEM []byte) (*Certificate, error) {
+	var out struct {
+		Output Certificate `json:"ipsec-vpn:output"`
+	}
+	input := map[string]any{Module + ":input": map[string]string{"csr": string(csrPEM)}}
+	if _, err := c.do(ctx, http.MethodPost, "/restconf/operations/"+IssueOperation, input, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Output, nil
+}
+
+// OpenAPI returns the OpenAPI document describing the gateway's API
+func (c *Client) OpenAPI(ctx context.Context) ([]byte, error) {
+	var doc json.RawMessage
+	if _, err := c.do(ctx, http.MethodGet, "/restconf/openapi.json", nil, nil, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+const (
+	tunnelsPath  = "/restconf/data/" + Module + ":tunnels"
+	networksPath = "/restconf/data/" + Module + ":networks"
+	jobsPath     = "/restconf/data/" + Module + ":jobs"
+)
+
+// tunnelPath is the path of a tunnel's list entry
+func tunnelPath(name string) string {
+	return tunnelsPath + "/tunnel=" + escapeKey(name)
+}
+
+// networkPath is the path of an advertised network's list entry
+func networkPath(prefix, tunnel string) string {
+	return networksPath + "/network=" + escapeKey(prefix) + "," + escapeKey(tunnel)
+}
+
+// escapeKey percent-encodes a key value, including the commas and slashes
+// that would otherwise split it (RFC 8040 section 3.5.3)
+func escapeKey(value string) string {
+	return strings.NewReplacer(",", "%2C", "/", "%2F").Replace(url.PathEscape(value))
+}
+
+// entry wraps a single list entry in an array under the qualified list name,
+// as RFC 7951 describes
+func entry(list string, v any) any {
+	return map[string][]any{Module + ":" + list: {v}}
+}
+
+// do sends a request and decodes the response body into out, if given. Error
+// responses are returned as *Error.
+func (c *Client) do(ctx context.Context, method, path string, body any, header http.Header, out any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", mediaType)
+	if body != nil {
+		req.Header.Set("Content-Type", mediaType)
+	}
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, responseError(resp, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("invalid response from gateway: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+// responseError decodes an error response
+func responseError(resp *http.Response, data []byte) error {
+	e := &Error{StatusCode: resp.StatusCode, ApprovalID: resp.Header.Get(ApprovalHeader)}
+	var body struct {
+		Errors struct {
+			Error []struct {
+				Tag     string `json:"error-tag"`
+				Message string `json:"error-message"`
+			} `json:"error"`
+		} `json:"ietf-restconf:errors"`
+	}
+	if err := json.Unmarshal(data, &body); err == nil && len(body.Errors.Error) > 0 {
+		e.Tag = body.Errors.Error[0].Tag
+		e.Message = body.Errors.Error[0].Message
+	}
+	return e
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/restconf"
+	"github.com/spf13/viper"
+)
+
+// operations maps the operations of the OpenAPI document to the methods implementing them
+var operations = map[string]string{
+	"listTunnels":      "ListTunnels",
+	"createTunnel":     "CreateTunnel",
+	"getTunnel":        "GetTunnel",
+	"replaceTunnel":    "ReplaceTunnel",
+	"updateTunnel":     "UpdateTunnel",
+	"deleteTunnel":     "DeleteTunnel",
+	"listNetworks":     "ListNetworks",
+	"advertiseNetwork": "AdvertiseNetwork",
+	"getNetwork":       "GetNetwork",
+	"replaceNetwork":   "ReplaceNetwork",
+	"withdrawNetwork":  "WithdrawNetwork",
+	"approve":          "Approve",
+	"issueCertificate": "IssueCertificate",
+	"getJob":           "GetJob",
+}
+
+// server serves the RESTCONF API over a store of tunnels in a temporary directory
+func server(t *testing.T, tunnels map[string]string) *Client {
+	t.Helper()
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	t.Cleanup(func() { viper.Set("config_dir", "") })
+	if err := os.MkdirAll(filepath.Join(dir, "tunnels"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, stored := range tunnels {
+		if err := os.WriteFile(filepath.Join(dir, "tunnels", name+".json"), []byte(stored), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(restconf.New("", nil).Handler())
+	t.Cleanup(ts.Close)
+	return New(ts.URL, ts.Client())
+}
+
+func TestOperationsCovered(t *testing.T) {
+	c := server(t, nil)
+	doc, err := c.OpenAPI(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		Paths map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(doc, &spec); err != nil {
+		t.Fatal(err)
+	}
+	client := reflect.TypeFor[*Client]()
+	for path, methods := range spec.Paths {
+		for method, op := range methods {
+			name, ok := operations[op.OperationID]
+			if !ok {
+				t.Errorf("No method for %s %s (%s)", method, path, op.OperationID)
+				continue
+			}
+			if _, ok := client.MethodByName(name); !ok {
+				t.Errorf("Client has no method %s for %s", name, op.OperationID)
+			}
+		}
+	}
+}
+
+func TestTunnels(t *testing.T) {
+	ctx := context.Background()
+	c := server(t, map[string]string{
+		"office": `{"name":"office","local_ip":"192.0.2.1","remote_ip":"198.51.100.1","local_subnet":"10.0.0.0/16",
+			"remote_subnet":"10.1.0.0/16","mode":"ipsec","status":"ERROR","rate_limit":10000000,"labels":["site=fra"]}`,
+		"lab": `{"name":"lab","local_ip":"192.0.2.1","remote_ip":"198.51.100.2","local_subnet":"10.0.0.0/16",
+			"remote_subnet":"10.2.0.0/16","mode":"ipsec","status":"DOWN"}`,
+	})
+
+	list, err := c.ListTunnels(ctx, ListOptions{Status: []Status{StatusError, StatusDown}, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 2 || len(list.Tunnels) != 1 || list.Tunnels[0].Name != "lab" {
+		t.Errorf("Expected the first of two tunnels, got %+v", list)
+	}
+	list, err = c.ListTunnels(ctx, ListOptions{LabelSelector: "site=fra", Fields: "name,status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Tunnels) != 1 || list.Tunnels[0].State == nil || list.Tunnels[0].State.Status != StatusError || list.Tunnels[0].LocalIP != "" {
+		t.Errorf("Expected only the name and status of office, got %+v", list.Tunnels)
+	}
+
+	office, err := c.GetTunnel(ctx, "office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if office.RateLimit != 10000000 || len(office.Labels) != 1 || office.Labels[0] != (Label{"site", "fra"}) {
+		t.Errorf("Unexpected tunnel %+v", office)
+	}
+	if err := c.UpdateTunnel(ctx, "office", map[string]any{"label": []Label{{"env", "prod"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if office, err = c.GetTunnel(ctx, "office"); err != nil || len(office.Labels) != 2 {
+		t.Errorf("Expected the labels to be merged, got %+v: %v", office, err)
+	}
+
+	_, err = c.GetTunnel(ctx, "missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	err = c.CreateTunnel(ctx, Tunnel{Name: "office"})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict || apiErr.Tag != "data-exists" {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+
+	if err := c.DeleteTunnel(ctx, "lab", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetTunnel(ctx, "lab"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the tunnel to be deleted, got %v", err)
+	}
+}
+
+func TestCreateTunnelAsync(t *testing.T) {
+	ctx := context.Background()
+	c := server(t, nil)
+	id, err := c.CreateTunnelAsync(ctx, Tunnel{Name: "new", LocalIP: "192.0.2.1", RemoteIP: "198.51.100.2",
+		LocalSubnet: "10.0.0.0/16", RemoteSubnet: "10.2.0.0/16", Encryption: "bogus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j *Job
+	for range 100 {
+		if j, err = c.GetJob(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		if j.Done() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if j.ID != id || j.State != JobFailed || j.Error == "" {
+		t.Errorf("Expected job %s to fail, got %+v", id, j)
+	}
+	if _, err := c.GetJob(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestApproval(t *testing.T) {
+	viper.Set("approval.required", true)
+	defer viper.Set("approval.required", false)
+	c := server(t, map[string]string{"office": `{"name":"office"}`})
+
+	// Without client certificates, requests are made by their remote address
+	err := c.DeleteTunnel(context.Background(), "office", "")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden || apiErr.ApprovalID == "" {
+		t.Fatalf("Expected the delete to need approval, got %v", err)
+	}
+	if _, err := c.Approve(context.Background(), "bogus"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an unknown request not to be found, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+// Package commit reverts changes that could cut off the operator, such as new
+// routes or firewall rules, unless they are confirmed in time, like commit
+// confirmed in Junos. Each change is recorded with the ipsec-vpn arguments that
+// undo it, and a watcher process outside the operator's session runs them once
+// the deadline passes.
+package commit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+)
+
+// checkInterval is how often the watcher looks at the pending changes
+const checkInterval = time.Second
+
+// Change is a change awaiting confirmation
+type Change struct {
+	Description string    `json:"description"`
+	Undo        []string  `json:"undo"` // ipsec-vpn arguments that revert the change
+	At          time.Time `json:"at"`
+}
+
+// Pending is the changes awaiting confirmation, reverted at Deadline by the
+// watcher process Watcher
+type Pending struct {
+	Changes  []Change  `json:"changes"`
+	Deadline time.Time `json:"deadline"`
+	Watcher  int       `json:"watcher,omitempty"`
+}
+
+// Watching reports whether the watcher process is still running
+func (p *Pending) Watching() bool {
+	return p.Watcher > 0 && syscall.Kill(p.Watcher, 0) == nil
+}
+
+// Load returns the changes awaiting confirmation, or nil if there are none
+func Load() (*Pending, error) {
+	path, err := pendingPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var p Pending
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid pending changes in %s: %v", path, err)
+	}
+	return &p, nil
+}
+
+// save records the changes awaiting confirmation
+func save(p *Pending) error {
+	path, err := pendingPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// remove drops the changes awaiting confirmation, reporting whether there were any
+func remove() (bool, error) {
+	path, err := pendingPath()
+	if err != nil {
+		return false, err
+	}
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Arm records a change to revert unless confirmed within timeout. Changes armed
+// while others are pending join them, and all are reverted together at the
+// later of their deadlines.
+func Arm(description string, undo []string, timeout time.Duration) (*Pending, error) {
+	if timeout <= 0 {
+		return nil, errors.New("the confirmation timeout must be positive")
+	}
+	p, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		p = &Pending{}
+	}
+
+	now := time.Now()
+	p.Changes = append(p.Changes, Change{Description: description, Undo: undo, At: now})
+	if deadline := now.Add(timeout); deadline.After(p.Deadline) {
+		p.Deadline = deadline
+	}
+	return p, save(p)
+}
+
+// SetWatcher records the process that reverts the pending changes
+func SetWatcher(pid int) error {
+	p, err := Load()
+	if err != nil || p == nil {
+		return err
+	}
+	p.Watcher = pid
+	return save(p)
+}
+
+// Confirm keeps the pending changes, returning them, or nil if there were none
+func Confirm() (*Pending, error) {
+	p, err := Load()
+	if err != nil || p == nil {
+		return nil, err
+	}
+	if _, err := remove(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Rollback reverts the pending changes, newest first, calling run with the
+// arguments that undo each. The changes are dropped before any is reverted, so
+// that a watcher does not revert them a second time. It returns the reverted
+// changes and the errors of those that failed.
+func Rollback(run func(args []string) error) ([]Change, error) {
+	p, err := Load()
+	if err != nil || p == nil {
+		return nil, err
+	}
+	if ok, err := remove(); err != nil || !ok {
+		return nil, err
+	}
+
+	var errs []error
+	changes := slices.Clone(p.Changes)
+	slices.Reverse(changes)
+	for _, c := range changes {
+		if err := run(c.Undo); err != nil {
+			errs = append(errs, fmt.Errorf("failed to revert %s: %v", c.Description, err))
+		}
+	}
+	return changes, errors.Join(errs...)
+}
+
+// Watch waits until the pending changes are confirmed, reverting them with run
+// if their deadline passes first
+func Watch(run func(args []string) error) ([]Change, error) {
+	for {
+		p, err := Load()
+		if err != nil || p == nil {
+			return nil, err
+		}
+		if !time.Now().Before(p.Deadline) {
+			return Rollback(run)
+		}
+		time.Sleep(min(checkInterval, time.Until(p.Deadline)))
+	}
+}
+
+// pendingPath returns the file the changes awaiting confirmation are kept in
+func pendingPath() (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "commit", "pending.json"), nil
+}
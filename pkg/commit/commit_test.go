@@ -0,0 +1,71 @@
+package commit
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestArmAndRollback(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	if _, err := Arm("the start of tunnel 'office'", []string{"tunnel", "stop", "office"}, time.Hour); err != nil {
+		t.Fatalf("Arm failed: %v", err)
+	}
+	p, err := Arm("the kill-switch of tunnel 'office'", []string{"tunnel", "kill-switch", "disable", "office"}, time.Minute)
+	if err != nil {
+		t.Fatalf("Arm failed: %v", err)
+	}
+	if len(p.Changes) != 2 || time.Until(p.Deadline) < 59*time.Minute {
+		t.Errorf("Expected both changes reverted at the later deadline, got %+v", p)
+	}
+
+	// Newest first, carrying on past failures
+	var ran []string
+	changes, err := Rollback(func(args []string) error {
+		ran = append(ran, strings.Join(args, " "))
+		if args[1] == "kill-switch" {
+			return errors.New("exit status 1")
+		}
+		return nil
+	})
+	if want := []string{"tunnel kill-switch disable office", "tunnel stop office"}; !slices.Equal(ran, want) {
+		t.Errorf("Expected %v to run, got %v", want, ran)
+	}
+	if len(changes) != 2 || err == nil || !strings.Contains(err.Error(), "kill-switch") {
+		t.Errorf("Expected the failed reversal to be reported, got %v", err)
+	}
+	if p, _ := Load(); p != nil {
+		t.Errorf("Expected no pending changes after a rollback, got %+v", p)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	run := func(args []string) error { return nil }
+	if _, err := Arm("the breakout routes", []string{"breakout", "clear"}, 50*time.Millisecond); err != nil {
+		t.Fatalf("Arm failed: %v", err)
+	}
+	changes, err := Watch(run)
+	if err != nil || len(changes) != 1 {
+		t.Errorf("Expected the unconfirmed change to be reverted, got %v, %v", changes, err)
+	}
+
+	// A confirmed change is kept
+	if _, err := Arm("the breakout routes", []string{"breakout", "clear"}, time.Hour); err != nil {
+		t.Fatalf("Arm failed: %v", err)
+	}
+	if p, err := Confirm(); err != nil || p == nil {
+		t.Fatalf("Confirm failed: %v", err)
+	}
+	if changes, err := Watch(run); err != nil || len(changes) != 0 {
+		t.Errorf("Expected nothing to revert after confirmation, got %v, %v", changes, err)
+	}
+}
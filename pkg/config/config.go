@@ -0,0 +1,353 @@
+package config
+
+// Config is the schema of the global configuration file
+type Config struct {
+	Verbose              bool                    `yaml:"verbose"`
+	ConfigDir            string                  `yaml:"config_dir"`
+	Crypto               CryptoConfig            `yaml:"crypto"`
+	Agent                AgentConfig             `yaml:"agent"`
+	Spiffe               SpiffeConfig            `yaml:"spiffe"`
+	Vault                VaultConfig             `yaml:"vault"`
+	Restconf             RestconfConfig          `yaml:"restconf"`
+	CA                   CAConfig                `yaml:"ca"`
+	Client               ClientConfig            `yaml:"client"`
+	Store                StoreConfig             `yaml:"store"`
+	Keys                 KeysConfig              `yaml:"keys"`
+	Access               AccessConfig            `yaml:"access"`
+	Approval             ApprovalConfig          `yaml:"approval"`
+	History              HistoryConfig           `yaml:"history"`
+	Reconcile            ReconcileConfig         `yaml:"reconcile"`
+	Retry                RetryConfig             `yaml:"retry"`
+	Events               EventsConfig            `yaml:"events"`
+	Metrics              MetricsConfig           `yaml:"metrics"`
+	Alerts               AlertsConfig            `yaml:"alerts"`
+	Flows                FlowsConfig             `yaml:"flows"`
+	Uplinks              []UplinkConfig          `yaml:"uplinks"`
+	Breakout             BreakoutConfig          `yaml:"breakout"`
+	Discovery            DiscoveryConfig         `yaml:"discovery"`
+	TunnelDefaults       TunnelDefaults          `yaml:"tunnel_defaults"`
+	Tunnels              map[string]TunnelConfig `yaml:"tunnels"`
+	NetworkAdvertisement NetworkAdvertisement    `yaml:"network_advertisement"`
+	Log                  LogConfig               `yaml:"log"`
+	Logging              LoggingConfig           `yaml:"logging"`
+	Security             SecurityConfig          `yaml:"security"`
+	Advanced             AdvancedConfig          `yaml:"advanced"`
+	SelfTest             SelfTestConfig          `yaml:"self_test"`
+}
+
+// CryptoConfig holds the crypto settings
+type CryptoConfig struct {
+	DefaultClassic     string `yaml:"default_classic"`
+	DefaultPostQuantum string `yaml:"default_post_quantum"`
+	RequirePostQuantum bool   `yaml:"require_post_quantum"`
+	MlockKeys          bool   `yaml:"mlock_keys"`
+	RNGNonblocking     bool   `yaml:"rng_nonblocking"`
+	Backend            string `yaml:"backend"`
+}
+
+// AgentConfig holds the key agent settings
+type AgentConfig struct {
+	Socket string `yaml:"socket"`
+}
+
+// SpiffeConfig holds the SPIFFE Workload API settings
+type SpiffeConfig struct {
+	Socket string `yaml:"socket"`
+}
+
+// VaultConfig holds the HashiCorp Vault settings
+type VaultConfig struct {
+	Address        string `yaml:"address"`
+	TokenFile      string `yaml:"token_file"`
+	Namespace      string `yaml:"namespace"`
+	CACert         string `yaml:"ca_cert"`
+	KVMount        string `yaml:"kv_mount"`
+	KVVersion      int    `yaml:"kv_version"`
+	PKIMount       string `yaml:"pki_mount"`
+	PKIRole        string `yaml:"pki_role"`
+	CertificateTTL int    `yaml:"certificate_ttl"`
+}
+
+// RestconfConfig holds the RESTCONF server settings
+type RestconfConfig struct {
+	Listen      string `yaml:"listen"`
+	Certificate string `yaml:"certificate"`
+	PrivateKey  string `yaml:"private_key"`
+	ClientCA    string `yaml:"client_ca"`
+}
+
+// ClientConfig holds the settings of the enrollment server road warriors
+// fetch their profiles from
+type ClientConfig struct {
+	Listen              string `yaml:"listen"`
+	URL                 string `yaml:"url"`
+	Certificate         string `yaml:"certificate"`
+	PrivateKey          string `yaml:"private_key"`
+	InviteExpiry        int    `yaml:"invite_expiry"`
+	AccountingRetention int    `yaml:"accounting_retention"` // Days the records of sessions are kept
+}
+
+// CAConfig holds the settings of the hub's certificate authority and of spokes
+// enrolling with it
+type CAConfig struct {
+	Validity    int    `yaml:"validity"`
+	Hub         string `yaml:"hub"`
+	HubCA       string `yaml:"hub_ca"`
+	Certificate string `yaml:"certificate"`
+	PrivateKey  string `yaml:"private_key"`
+}
+
+// StoreConfig holds the settings of the encrypted configuration store
+type StoreConfig struct {
+	RuntimeDir string `yaml:"runtime_dir"`
+}
+
+// KeysConfig holds the key store settings
+type KeysConfig struct {
+	Keyfile string `yaml:"keyfile"`
+}
+
+// AccessConfig lists the OS users and groups, and the RESTCONF clients by the
+// common name of their certificate, that only get the read-only viewer role
+type AccessConfig struct {
+	ViewerUsers   []string `yaml:"viewer_users"`
+	ViewerGroups  []string `yaml:"viewer_groups"`
+	ViewerClients []string `yaml:"viewer_clients"`
+}
+
+// ApprovalConfig holds the settings of the two-person rule for destructive
+// operations
+type ApprovalConfig struct {
+	Required bool `yaml:"required"`
+	Expiry   int  `yaml:"expiry"`
+}
+
+// HistoryConfig holds the settings of the record of commands that changed state
+type HistoryConfig struct {
+	MaxEntries       int  `yaml:"max_entries"`
+	RecordOperations bool `yaml:"record_operations"` // Record CLI and RESTCONF changes for 'history replay'
+}
+
+// ReconcileConfig holds the settings of the loop keeping the tunnels in sync
+// with the kernel
+type ReconcileConfig struct {
+	Interval       int `yaml:"interval"`
+	BackoffInitial int `yaml:"backoff_initial"`
+	BackoffMax     int `yaml:"backoff_max"`
+}
+
+// RetryConfig holds how failures that may pass are retried, by operation
+type RetryConfig struct {
+	IKE     RetryPolicy `yaml:"ike"`
+	Netlink RetryPolicy `yaml:"netlink"`
+	DNS     RetryPolicy `yaml:"dns"`
+	Jitter  float64     `yaml:"jitter"`
+}
+
+// RetryPolicy holds the attempts at an operation and the delays, in
+// milliseconds, between them, which double up to max_delay
+type RetryPolicy struct {
+	Attempts     int `yaml:"attempts"`
+	InitialDelay int `yaml:"initial_delay"`
+	MaxDelay     int `yaml:"max_delay"`
+}
+
+// EventsConfig holds the message brokers tunnel events are published to
+type EventsConfig struct {
+	Publishers    []string          `yaml:"publishers"`
+	Topic         string            `yaml:"topic"`
+	StatsInterval int               `yaml:"stats_interval"`
+	Email         EventsEmailConfig `yaml:"email"`
+}
+
+// EventsEmailConfig holds which events are emailed and how. They are sent
+// through the SMTP server and to the recipients in alerts.email.
+type EventsEmailConfig struct {
+	Enabled   bool     `yaml:"enabled"`
+	Types     []string `yaml:"types"`
+	Subject   string   `yaml:"subject"`
+	Body      string   `yaml:"body"`
+	RateLimit int      `yaml:"rate_limit"`
+}
+
+// MetricsConfig holds the Prometheus metrics endpoint settings
+type MetricsConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+// AlertsConfig holds the local alert rules and where their alerts are sent
+type AlertsConfig struct {
+	Interval int         `yaml:"interval"`
+	Rules    []string    `yaml:"rules"`
+	Hooks    []string    `yaml:"hooks"`
+	Webhooks []string    `yaml:"webhooks"`
+	Email    EmailConfig `yaml:"email"`
+}
+
+// FlowsConfig holds the NetFlow v9 or IPFIX collector tunnel flows are exported to
+type FlowsConfig struct {
+	Collector string `yaml:"collector"`
+	Protocol  string `yaml:"protocol"`
+	Interval  int    `yaml:"interval"`
+	DomainID  int    `yaml:"domain_id"`
+}
+
+// UplinkConfig is a WAN interface tunnels can be carried over
+type UplinkConfig struct {
+	Name      string `yaml:"name"`
+	Interface string `yaml:"interface"`
+	Gateway   string `yaml:"gateway"`
+	Capacity  string `yaml:"capacity"`
+}
+
+// BreakoutConfig holds the prefix lists routed around the VPN and where to
+type BreakoutConfig struct {
+	Interface string             `yaml:"interface"`
+	Gateway   string             `yaml:"gateway"`
+	Lists     []PrefixListConfig `yaml:"lists"`
+}
+
+// PrefixListConfig is a list of static prefixes, a prefix feed, or both
+type PrefixListConfig struct {
+	Name     string   `yaml:"name"`
+	URL      string   `yaml:"url"`
+	Format   string   `yaml:"format"`
+	Prefixes []string `yaml:"prefixes"`
+}
+
+// DiscoveryConfig holds the domain a spoke discovers its hubs in, and the
+// local end of the tunnels it creates to them
+type DiscoveryConfig struct {
+	Domain      string `yaml:"domain"`
+	LocalIP     string `yaml:"local_ip"`
+	LocalSubnet string `yaml:"local_subnet"`
+}
+
+// EmailConfig holds the SMTP server and recipients of alert and event emails
+type EmailConfig struct {
+	SMTP     string   `yaml:"smtp"`
+	TLS      string   `yaml:"tls"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+}
+
+// TunnelDefaults holds the defaults applied to new tunnels
+type TunnelDefaults struct {
+	Encryption          string           `yaml:"encryption"`
+	PostQuantum         bool             `yaml:"post_quantum"`
+	MTU                 int              `yaml:"mtu"`
+	KeyRotationInterval int              `yaml:"key_rotation_interval"`
+	CheckPeer           string           `yaml:"check_peer"` // off, warn or abort
+	SALifetime          SALifetimeConfig `yaml:"sa_lifetime"`
+}
+
+// SALifetimeConfig holds the limits after which SAs are rekeyed (soft) and
+// deleted (hard). Zero is no limit; the hard time limit defaults to
+// key_rotation_interval and the soft one to 90% of it.
+type SALifetimeConfig struct {
+	SoftTime    int    `yaml:"soft_time"` // Seconds
+	HardTime    int    `yaml:"hard_time"`
+	SoftBytes   uint64 `yaml:"soft_bytes"`
+	HardBytes   uint64 `yaml:"hard_bytes"`
+	SoftPackets uint64 `yaml:"soft_packets"`
+	HardPackets uint64 `yaml:"hard_packets"`
+}
+
+// TunnelConfig is a pre-configured tunnel
+type TunnelConfig struct {
+	LocalIP          string `yaml:"local_ip"`
+	RemoteIP         string `yaml:"remote_ip"`
+	LocalSubnet      string `yaml:"local_subnet"`
+	RemoteSubnet     string `yaml:"remote_subnet"`
+	Encryption       string `yaml:"encryption"`
+	PostQuantum      bool   `yaml:"post_quantum"`
+	Namespace        string `yaml:"namespace"`
+	RateLimit        string `yaml:"rate_limit"`
+	PeerSpiffeID     string `yaml:"peer_spiffe_id"`
+	Mode             string `yaml:"mode"`
+	WireGuardPeerKey string `yaml:"wireguard_peer_key"`
+	ListenPort       int    `yaml:"listen_port"`
+	Description      string `yaml:"description"`
+}
+
+// NetworkAdvertisement holds the network advertisement settings
+type NetworkAdvertisement struct {
+	Enabled            bool                `yaml:"enabled"`
+	AdvertisedNetworks []AdvertisedNetwork `yaml:"advertised_networks"`
+}
+
+// AdvertisedNetwork is a network advertised through a tunnel
+type AdvertisedNetwork struct {
+	CIDR   string `yaml:"cidr"`
+	Tunnel string `yaml:"tunnel"`
+	Metric int    `yaml:"metric"`
+}
+
+// LogConfig holds the log file rotation settings
+type LogConfig struct {
+	Directory  string          `yaml:"directory"`
+	MaxSize    int             `yaml:"max_size"`
+	MaxBackups int             `yaml:"max_backups"`
+	MaxAge     int             `yaml:"max_age"`
+	Compress   bool            `yaml:"compress"`
+	Rotation   string          `yaml:"rotation"`
+	Levels     LogLevelsConfig `yaml:"levels"`
+}
+
+// LogLevelsConfig holds the log level of each module, overriding the default
+// of writing every message to the log file
+type LogLevelsConfig struct {
+	IKE     string `yaml:"ike"`
+	XFRM    string `yaml:"xfrm"`
+	Tunnel  string `yaml:"tunnel"`
+	Network string `yaml:"network"`
+	API     string `yaml:"api"`
+}
+
+// LoggingConfig holds the logging level settings
+type LoggingConfig struct {
+	Level      string `yaml:"level"`
+	File       string `yaml:"file"`
+	MaxSize    int    `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+	MaxAge     int    `yaml:"max_age"`
+}
+
+// SecurityConfig holds the security settings
+type SecurityConfig struct {
+	PerfectForwardSecrecy bool     `yaml:"perfect_forward_secrecy"`
+	KeyRotationEnabled    bool     `yaml:"key_rotation_enabled"`
+	ReplayProtection      bool     `yaml:"replay_protection"`
+	AuthenticationMethod  string   `yaml:"authentication_method"`
+	PSKFile               string   `yaml:"psk_file"`
+	KillSwitch            bool     `yaml:"kill_switch"`
+	CookieThreshold       int      `yaml:"cookie_threshold"`
+	MaxHalfOpenPerSource  int      `yaml:"max_half_open_per_source"`
+	BlacklistFailures     int      `yaml:"blacklist_failures"`
+	BlacklistDuration     int      `yaml:"blacklist_duration"`
+	AuthFailureLog        string   `yaml:"auth_failure_log"`
+	GeoIPCountryDatabase  string   `yaml:"geoip_country_database"`
+	GeoIPASNDatabase      string   `yaml:"geoip_asn_database"`
+	GeoIPAllowCountries   []string `yaml:"geoip_allow_countries"`
+	GeoIPAllowASNs        []int    `yaml:"geoip_allow_asns"`
+}
+
+// SelfTestConfig holds the settings of the self-test made before tunnels are managed
+type SelfTestConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	FailClosed bool `yaml:"fail_closed"`
+}
+
+// AdvancedConfig holds the IKE and ESP settings
+type AdvancedConfig struct {
+	IKEVersion     int      `yaml:"ike_version"`
+	ESPProposals   []string `yaml:"esp_proposals"`
+	IKEProposals   []string `yaml:"ike_proposals"`
+	DPDDelay       int      `yaml:"dpd_delay"`
+	DPDTimeout     int      `yaml:"dpd_timeout"`
+	ReauthInterval int      `yaml:"reauth_interval"` // Seconds between full reauthentications of IKE SAs, 0 to only rekey
+	ReauthGrace    int      `yaml:"reauth_grace"`    // Seconds the SAs outlive a reauthentication that is due
+	FaultInjection bool     `yaml:"fault_injection"` // Lets 'ipsec-vpn chaos' inject faults, for staging only
+}
@@ -0,0 +1,293 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	data := []byte(`verbos: true
+crypto:
+  default_classic: aes256gcm
+log:
+  max_size: 0
+  max_age: abc
+tunnels:
+  office:
+    local_ip: 192.168.1.300
+    remote_ip: 10.0.0.1
+    local_subnet: 192.168.0.0/24
+    remote_subnet: 10.0.0.0/24
+    encryption: aes256gcm
+`)
+
+	cfg, problems, err := Validate(data)
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if cfg.Crypto.DefaultClassic != "aes256gcm" {
+		t.Errorf("Expected default_classic to be decoded, got %q", cfg.Crypto.DefaultClassic)
+	}
+
+	expected := map[int]string{
+		1: `unknown key, did you mean "verbose"?`,
+		5: "must be greater than 0",
+		6: "cannot unmarshal",
+		9: "invalid IP address",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for _, p := range problems {
+		want, ok := expected[p.Line]
+		if !ok || !strings.Contains(p.Message, want) {
+			t.Errorf("Unexpected problem on line %d: %s", p.Line, p)
+		}
+	}
+
+	if !HasErrors(problems) {
+		t.Error("Expected problems to include errors")
+	}
+}
+
+func TestValidateClean(t *testing.T) {
+	data := []byte(`crypto:
+  default_classic: chacha20poly1305
+  default_post_quantum: mlkem768
+logging:
+  level: info
+`)
+
+	_, problems, err := Validate(data)
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+}
+
+func TestValidateEventsEmail(t *testing.T) {
+	data := []byte(`events:
+  email:
+    enabled: true
+    types: [tunnel.down, tunnel.flapping]
+    subject: "{{.Tunel}} is down"
+    rate_limit: -1
+alerts:
+  email:
+    tls: ssl
+`)
+
+	_, problems, err := Validate(data)
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	expected := map[int]string{
+		3: "needs alerts.email.smtp",
+		4: `unknown event type "tunnel.flapping"`,
+		5: "invalid email template",
+		6: "must not be negative",
+		9: "must be one of",
+	}
+	for _, p := range problems {
+		want, ok := expected[p.Line]
+		if !ok || !strings.Contains(p.Message, want) {
+			t.Errorf("Unexpected problem on line %d: %s", p.Line, p)
+		}
+		delete(expected, p.Line)
+	}
+	if len(expected) != 0 {
+		t.Errorf("Expected problems on lines %v", expected)
+	}
+}
+
+func TestValidateUplinks(t *testing.T) {
+	data := []byte(`uplinks:
+  - name: fiber
+    interface: eth0
+    gateway: 203.0.113.1
+    capacity: 1gbit
+  - name: fiber
+    interface: eth1
+    gateway: 198.51.100.300
+  - name: lte
+    capacity: fast
+`)
+
+	_, problems, err := Validate(data)
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	expected := map[int]string{
+		6:  `uplink "fiber" is defined more than once`,
+		8:  "invalid IP address",
+		9:  `missing required key "interface"`,
+		10: "invalid rate",
+	}
+	for _, p := range problems {
+		want, ok := expected[p.Line]
+		if !ok || !strings.Contains(p.Message, want) {
+			t.Errorf("Unexpected problem on line %d: %s", p.Line, p)
+		}
+		delete(expected, p.Line)
+	}
+	if len(expected) != 0 {
+		t.Errorf("Expected problems on lines %v", expected)
+	}
+}
+
+func TestValidateBreakout(t *testing.T) {
+	data := []byte(`breakout:
+  gateway: 192.168.1.254
+  lists:
+    - name: m365
+      url: https://endpoints.office.com/endpoints/worldwide
+      format: json
+    - name: static
+      prefixes: [52.112.0.0/14, 0.0.0.0/0]
+    - name: empty
+`)
+
+	_, problems, err := Validate(data)
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	expected := map[int]string{
+		3: "needs breakout.interface",
+		6: "must be one of",
+		8: "too broad to break out",
+		9: "needs a url, prefixes or both",
+	}
+	for _, p := range problems {
+		want, ok := expected[p.Line]
+		if !ok || !strings.Contains(p.Message, want) {
+			t.Errorf("Unexpected problem on line %d: %s", p.Line, p)
+		}
+		delete(expected, p.Line)
+	}
+	if len(expected) != 0 {
+		t.Errorf("Expected problems on lines %v", expected)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	Bind()
+	t.Setenv(EnvName("advanced.dpd_timeout"), "90")
+
+	if err := ApplyOverrides([]string{"advanced.dpd_delay=10"}); err != nil {
+		t.Fatalf("ApplyOverrides failed: %v", err)
+	}
+	if err := ApplyOverrides([]string{"advanced.dpd_dealy=10"}); err == nil {
+		t.Error("Expected an error for an unknown setting")
+	}
+
+	sources := make(map[string]Setting)
+	for _, s := range Effective() {
+		sources[s.Key] = s
+	}
+
+	for key, want := range map[string]struct {
+		value  interface{}
+		source Source
+	}{
+		"advanced.dpd_delay":   {10, SourceFlag},
+		"advanced.dpd_timeout": {"90", SourceEnv},
+		"log.max_size":         {10, SourceDefault},
+	} {
+		got := sources[key]
+		if got.Value != want.value || got.Source != want.source {
+			t.Errorf("%s: expected %v from %s, got %v from %s", key, want.value, want.source, got.Value, got.Source)
+		}
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	original := "logging:\n  level: info  # debug, info, warn, error\n\nadvanced:\n  dpd_delay: 30\n"
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetValue(path, "logging.level", "debug"); err != nil {
+		t.Fatalf("SetValue failed: %v", err)
+	}
+	if err := SetValue(path, "advanced.dpd_delay", "0"); err == nil {
+		t.Error("Expected an invalid value to be rejected")
+	}
+	if err := SetValue(path, "logging.levle", "debug"); err == nil {
+		t.Error("Expected an unknown setting to be rejected")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Replace(original, "level: info", "level: debug", 1)
+	if string(data) != expected {
+		t.Errorf("Expected only the value to change, got:\n%s", data)
+	}
+
+	// New keys are added to the file
+	if err := SetValue(path, "crypto.mlock_keys", "true"); err != nil {
+		t.Fatalf("SetValue failed: %v", err)
+	}
+	cfg, _, err := ValidateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Crypto.MlockKeys || cfg.Logging.Level != "debug" {
+		t.Errorf("Unexpected configuration after edits: %+v", cfg)
+	}
+}
+
+func TestValidateSALifetime(t *testing.T) {
+	data := []byte(`tunnel_defaults:
+  check_peer: sometimes
+  key_rotation_interval: 3600
+  sa_lifetime:
+    soft_time: 3600
+    soft_bytes: 4000000000
+    hard_bytes: 3000000000
+    hard_packets: 1000000
+`)
+
+	_, problems, err := Validate(data)
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	expected := map[int]string{
+		2: "must be one of off, warn, abort",
+		5: "must be below the hard limit (3600)",
+		6: "must be below the hard limit (3000000000)",
+		8: "needs soft_packets",
+	}
+	for _, p := range problems {
+		want, ok := expected[p.Line]
+		if !ok || !strings.Contains(p.Message, want) {
+			t.Errorf("Unexpected problem on line %d: %s", p.Line, p)
+		}
+		delete(expected, p.Line)
+	}
+	if len(expected) != 0 {
+		t.Errorf("Expected problems on lines %v", expected)
+	}
+}
+
+// FuzzValidate checks that any configuration file, however malformed, is
+// validated without panicking
+func FuzzValidate(f *testing.F) {
+	f.Add([]byte("crypto:\n  default_classic: aes256gcm\nlog:\n  max_age: abc\ntunnels:\n  office:\n    local_ip: 192.168.1.300\n"))
+	f.Add([]byte("network:\n  uplinks:\n    - name: wan1\n      interface: eth0\n      priority: -1\n"))
+	f.Add([]byte("advanced:\n  reauth_interval: 60\n  reauth_grace: 300\n"))
+	f.Add([]byte("a: &a [*a]\n"))
+	f.Add([]byte(""))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cfg, problems, err := Validate(data)
+		if err == nil && cfg == nil {
+			t.Errorf("Expected a configuration or an error, got %d problems", len(problems))
+		}
+	})
+}
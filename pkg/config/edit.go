@@ -0,0 +1,169 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SetValue sets a key in a configuration file, keeping its comments and layout.
+// The file is only written if the new value passes validation.
+func SetValue(path, key, value string) error {
+	known := false
+	for _, k := range Keys() {
+		if k == key {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown setting %q", key)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	if len(root.Content) == 0 {
+		root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+
+	node := root.Content[0]
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		node = mappingValue(node, part, yaml.MappingNode)
+	}
+	target := mappingValue(node, parts[len(parts)-1], yaml.ScalarNode)
+
+	// Existing scalar values are edited in place so the rest of the file is untouched
+	out, ok := editInPlace(data, target, key, value)
+	if !ok {
+		setNode(target, key, value)
+
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(&root); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		out = buf.Bytes()
+	}
+
+	// Reject the change if it makes the setting invalid
+	_, problems, err := Validate(out)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		if !p.Warning && p.Key == key {
+			return fmt.Errorf("invalid value for %s: %s", key, p.Message)
+		}
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	return os.WriteFile(path, out, mode)
+}
+
+// mappingValue returns the value node for a key in a mapping, adding it if missing
+func mappingValue(node *yaml.Node, key string, kind yaml.Kind) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		// Replace a scalar or empty value with a mapping
+		*node = yaml.Node{Kind: yaml.MappingNode, Line: node.Line}
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	value := &yaml.Node{Kind: kind}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+	return value
+}
+
+// editInPlace rewrites the value of an existing single-line scalar, keeping any
+// trailing comment and the spacing before it
+func editInPlace(data []byte, node *yaml.Node, key, value string) ([]byte, bool) {
+	if node.Kind != yaml.ScalarNode || node.Line == 0 || isList(key) {
+		return nil, false
+	}
+
+	lines := strings.Split(string(data), "\n")
+	if node.Line > len(lines) {
+		return nil, false
+	}
+	line := lines[node.Line-1]
+	start := node.Column - 1
+	if start < 0 || start > len(line) {
+		return nil, false
+	}
+
+	end := len(line)
+	if node.LineComment != "" {
+		i := strings.LastIndex(line, node.LineComment)
+		if i < start {
+			return nil, false
+		}
+		end = start + len(strings.TrimRight(line[start:i], " \t"))
+	}
+
+	lines[node.Line-1] = line[:start] + formatScalar(value) + line[end:]
+	return []byte(strings.Join(lines, "\n")), true
+}
+
+// setNode replaces a node with a value typed to match the schema
+func setNode(node *yaml.Node, key, value string) {
+	comment := node.LineComment
+
+	if isList(key) {
+		*node = yaml.Node{Kind: yaml.SequenceNode, LineComment: comment}
+		for _, item := range strings.Split(value, ",") {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: strings.TrimSpace(item)})
+		}
+		return
+	}
+
+	*node = yaml.Node{Kind: yaml.ScalarNode, Tag: scalarTag(value), Value: value, LineComment: comment}
+}
+
+// formatScalar renders a value as YAML, quoting strings that would otherwise change type
+func formatScalar(value string) string {
+	node := &yaml.Node{Kind: yaml.ScalarNode, Tag: scalarTag(value), Value: value}
+	out, err := yaml.Marshal(node)
+	if err != nil {
+		return strconv.Quote(value)
+	}
+	return strings.TrimSuffix(string(out), "\n")
+}
+
+// scalarTag returns the YAML tag for a command line value
+func scalarTag(value string) string {
+	if _, err := strconv.Atoi(value); err == nil {
+		return "!!int"
+	}
+	if value == "true" || value == "false" {
+		return "!!bool"
+	}
+	return "!!str"
+}
+
+// isList reports whether a setting holds a list of values
+func isList(key string) bool {
+	return strings.HasSuffix(key, "_proposals")
+}
@@ -0,0 +1,240 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/flowexport"
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix is the prefix of environment variables that override settings
+const EnvPrefix = "IPSEC"
+
+// Source identifies where the effective value of a setting came from
+type Source string
+
+const (
+	SourceFlag    Source = "flag"
+	SourceEnv     Source = "env"
+	SourceFile    Source = "file"
+	SourceDefault Source = "default"
+)
+
+// Setting is the effective value of a configuration key
+type Setting struct {
+	Key    string
+	Value  interface{}
+	Source Source
+	Env    string
+}
+
+// Defaults holds the built-in value of every setting that has one
+var Defaults = map[string]interface{}{
+	"verbose":                               false,
+	"crypto.default_classic":                "aes256gcm",
+	"crypto.default_post_quantum":           "mlkem768",
+	"crypto.require_post_quantum":           false,
+	"crypto.mlock_keys":                     false,
+	"crypto.rng_nonblocking":                false,
+	"crypto.backend":                        "go",
+	"vault.kv_mount":                        "secret",
+	"vault.kv_version":                      2,
+	"vault.pki_mount":                       "pki",
+	"vault.certificate_ttl":                 86400,
+	"restconf.listen":                       ":8443",
+	"ca.validity":                           86400,
+	"client.listen":                         ":8444",
+	"client.invite_expiry":                  86400,
+	"client.accounting_retention":           365,
+	"approval.required":                     false,
+	"approval.expiry":                       3600,
+	"history.max_entries":                   10000,
+	"history.record_operations":             false,
+	"reconcile.interval":                    30,
+	"reconcile.backoff_initial":             30,
+	"reconcile.backoff_max":                 900,
+	"retry.ike.attempts":                    5,
+	"retry.ike.initial_delay":               1000,
+	"retry.ike.max_delay":                   30000,
+	"retry.netlink.attempts":                5,
+	"retry.netlink.initial_delay":           10,
+	"retry.netlink.max_delay":               1000,
+	"retry.dns.attempts":                    3,
+	"retry.dns.initial_delay":               500,
+	"retry.dns.max_delay":                   5000,
+	"retry.jitter":                          0.2,
+	"events.topic":                          "ipsec-vpn",
+	"events.stats_interval":                 60,
+	"events.email.types":                    events.DefaultEmailTypes,
+	"events.email.rate_limit":               events.DefaultEmailRateLimit,
+	"metrics.listen":                        ":9469",
+	"alerts.interval":                       30,
+	"alerts.email.tls":                      "auto",
+	"flows.protocol":                        flowexport.ProtocolIPFIX,
+	"flows.interval":                        60,
+	"flows.domain_id":                       0,
+	"tunnel_defaults.encryption":            "aes256gcm",
+	"tunnel_defaults.post_quantum":          false,
+	"tunnel_defaults.mtu":                   1400,
+	"tunnel_defaults.key_rotation_interval": 86400,
+	"tunnel_defaults.check_peer":            "off",
+	"network_advertisement.enabled":         false,
+	"log.directory":                         "/var/log/ipsec-vpn",
+	"log.max_size":                          10,
+	"log.max_backups":                       5,
+	"log.max_age":                           30,
+	"log.compress":                          true,
+	"log.rotation":                          "internal",
+	"self_test.enabled":                     true,
+	"self_test.fail_closed":                 false,
+	"logging.level":                         "info",
+	"security.perfect_forward_secrecy":      true,
+	"security.key_rotation_enabled":         true,
+	"security.replay_protection":            true,
+	"security.authentication_method":        "psk",
+	"security.kill_switch":                  false,
+	"security.cookie_threshold":             50,
+	"security.max_half_open_per_source":     5,
+	"security.blacklist_failures":           5,
+	"security.blacklist_duration":           600,
+	"advanced.ike_version":                  2,
+	"advanced.dpd_delay":                    30,
+	"advanced.dpd_timeout":                  120,
+	"advanced.reauth_interval":              0,
+	"advanced.reauth_grace":                 300,
+	"advanced.fault_injection":              false,
+}
+
+// flagOverrides records the keys set with --set on the command line
+var flagOverrides = make(map[string]bool)
+
+// Keys returns every scalar or list setting in the schema. Per-tunnel and
+// per-network entries are not included since they have no fixed key.
+func Keys() []string {
+	var keys []string
+	collectKeys(reflect.TypeOf(Config{}), "", &keys)
+	sort.Strings(keys)
+	return keys
+}
+
+func collectKeys(t reflect.Type, path string, keys *[]string) {
+	for name, field := range structFields(t) {
+		key := joinPath(path, name)
+		switch field.Kind() {
+		case reflect.Struct:
+			collectKeys(field, key, keys)
+		case reflect.Map:
+			// Named entries such as tunnels.<name> are not overridable
+		case reflect.Slice:
+			if field.Elem().Kind() != reflect.Struct {
+				*keys = append(*keys, key)
+			}
+		default:
+			*keys = append(*keys, key)
+		}
+	}
+}
+
+// EnvName returns the environment variable that overrides a key, e.g.
+// IPSEC_ADVANCED_DPD_DELAY for advanced.dpd_delay
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Bind registers defaults and environment overrides for every setting but the
+// protected ones
+func Bind() {
+	for key, value := range Defaults {
+		viper.SetDefault(key, value)
+	}
+	for _, key := range Keys() {
+		if !Protected(key) {
+			_ = viper.BindEnv(key, EnvName(key))
+		}
+	}
+}
+
+// ApplyOverrides applies key=value overrides given on the command line
+func ApplyOverrides(overrides []string) error {
+	known := make(map[string]bool)
+	for _, key := range Keys() {
+		known[key] = true
+	}
+
+	for _, override := range overrides {
+		key, value, ok := strings.Cut(override, "=")
+		if !ok {
+			return fmt.Errorf("invalid override %q, expected key=value", override)
+		}
+		key = strings.TrimSpace(key)
+		if !known[key] {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if Protected(key) {
+			return fmt.Errorf("%s cannot be overridden, it is only read from %s", key, SystemFile)
+		}
+		viper.Set(key, parseValue(value))
+		flagOverrides[key] = true
+	}
+	return nil
+}
+
+// parseValue converts a command line value to a bool or int where it looks like one
+func parseValue(value string) interface{} {
+	if b, err := strconv.ParseBool(value); err == nil {
+		return b
+	}
+	if i, err := strconv.Atoi(value); err == nil {
+		return i
+	}
+	if strings.Contains(value, ",") {
+		return strings.Split(value, ",")
+	}
+	return value
+}
+
+// Secret reports whether a key holds a secret, which is masked when shown
+func Secret(key string) bool {
+	return strings.HasSuffix(key, ".password")
+}
+
+// Effective returns the merged value and source of every setting
+func Effective() []Setting {
+	keys := Keys()
+	settings := make([]Setting, 0, len(keys))
+	for _, key := range keys {
+		settings = append(settings, Setting{
+			Key:    key,
+			Value:  viper.Get(key),
+			Source: SourceOf(key),
+			Env:    EnvName(key),
+		})
+	}
+	return settings
+}
+
+// SourceOf reports where the effective value of a key comes from
+func SourceOf(key string) Source {
+	if Protected(key) {
+		if policyKeys[key] {
+			return SourceFile
+		}
+		return SourceDefault
+	}
+	if flagOverrides[key] {
+		return SourceFlag
+	}
+	if _, ok := os.LookupEnv(EnvName(key)); ok {
+		return SourceEnv
+	}
+	if viper.InConfig(key) {
+		return SourceFile
+	}
+	return SourceDefault
+}
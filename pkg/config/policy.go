@@ -0,0 +1,94 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+// SystemFile is the configuration file owned by root that the protected
+// sections are read from
+const SystemFile = "/etc/ipsec-vpn/.ipsec-vpn.yaml"
+
+// protectedSections restrict what the user running a command may do, through
+// the viewer role and the two-person rule, or let faults be injected on the
+// host, so that user must not be able to change them. They are only read from
+// SystemFile, never from --set, the environment or another configuration file.
+var protectedSections = []string{"access", "approval", "advanced.fault_injection"}
+
+// policyKeys records the protected keys set in SystemFile
+var policyKeys = make(map[string]bool)
+
+// Protected reports whether a key may only be set in SystemFile
+func Protected(key string) bool {
+	for _, section := range protectedSections {
+		if key == section || strings.HasPrefix(key, section+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyPolicy sets every protected key to its value in the system
+// configuration file at path, or to its default, replacing whatever the
+// configuration file in use, the environment or --set gave it. The file is
+// ignored unless it is owned by root and writable by nobody else.
+func ApplyPolicy(path string) error {
+	policy := viper.New()
+	err := trusted(path)
+	if err == nil {
+		policy.SetConfigFile(path)
+		err = policy.ReadInConfig()
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+
+	for key := range policyKeys {
+		delete(policyKeys, key)
+	}
+	for _, key := range Keys() {
+		if !Protected(key) {
+			continue
+		}
+		value, ok := Defaults[key]
+		if !ok {
+			// A nil value would let viper fall back to the environment and file
+			value = reflect.Zero(keyType(key)).Interface()
+		}
+		if err == nil && policy.IsSet(key) {
+			value = policy.Get(key)
+			policyKeys[key] = true
+		}
+		viper.Set(key, value)
+	}
+	return err
+}
+
+// trusted checks that only root can have written a file
+func trusted(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Uid != 0 || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s must be owned by root and writable only by root", path)
+	}
+	return nil
+}
+
+// keyType returns the type of the value of a key in the schema
+func keyType(key string) reflect.Type {
+	t := reflect.TypeOf(Config{})
+	for _, name := range strings.Split(key, ".") {
+		t = structFields(t)[name]
+	}
+	return t
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/access"
+	"github.com/dzakwan/ipsec-vpn/pkg/fault"
+	"github.com/spf13/viper"
+)
+
+func TestPolicyNotOverridable(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	if os.Getuid() != 0 {
+		t.Skip("the system configuration file must be owned by root")
+	}
+	t.Cleanup(viper.Reset)
+
+	system := filepath.Join(t.TempDir(), ".ipsec-vpn.yaml")
+	if err := os.WriteFile(system, []byte("access:\n  viewer_users: ["+current.Username+"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user controls the environment, --set and --config
+	t.Setenv("IPSEC_ACCESS_VIEWER_USERS", "somebodyelse")
+	viper.SetEnvPrefix("IPSEC")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	Bind()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader("access:\n  viewer_users: [somebodyelse]\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyOverrides([]string{"access.viewer_users=somebodyelse"}); err == nil {
+		t.Error("Expected an override of access.viewer_users to be rejected")
+	}
+
+	if err := ApplyPolicy(system); err != nil {
+		t.Fatal(err)
+	}
+	if access.UserRole(current) != access.RoleViewer {
+		t.Errorf("Expected %s to stay a viewer", current.Username)
+	}
+	if SourceOf("access.viewer_users") != SourceFile {
+		t.Errorf("Expected access.viewer_users to come from the system file, got %s", SourceOf("access.viewer_users"))
+	}
+
+	// Nor is the environment or --config used without a system file
+	if err := ApplyPolicy(filepath.Join(t.TempDir(), "missing.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if access.Configured() {
+		t.Error("Expected no viewers without a system file")
+	}
+
+	// A file others could have written is no policy either
+	if err := os.Chmod(system, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyPolicy(system); err == nil || access.Configured() {
+		t.Error("Expected a world-writable system file to be ignored")
+	}
+}
+
+func TestFaultInjectionProtected(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	// A user's configuration file, the environment or --set cannot enable it
+	t.Setenv("IPSEC_ADVANCED_FAULT_INJECTION", "true")
+	viper.SetEnvPrefix("IPSEC")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	Bind()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader("advanced:\n  fault_injection: true\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyOverrides([]string{"advanced.fault_injection=true"}); err == nil {
+		t.Error("Expected an override of advanced.fault_injection to be rejected")
+	}
+	if err := ApplyPolicy(filepath.Join(t.TempDir(), "missing.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if fault.Enabled() {
+		t.Error("Expected a user configuration not to enable fault injection")
+	}
+	if SourceOf("advanced.fault_injection") != SourceDefault {
+		t.Errorf("Expected advanced.fault_injection to keep its default, got %s", SourceOf("advanced.fault_injection"))
+	}
+
+	// Nor can a system file others could have written
+	system := filepath.Join(t.TempDir(), ".ipsec-vpn.yaml")
+	if err := os.WriteFile(system, []byte("advanced:\n  fault_injection: true\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(system, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyPolicy(system); err == nil || fault.Enabled() {
+		t.Error("Expected a world-writable system file not to enable fault injection")
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("the system configuration file must be owned by root")
+	}
+	if err := os.Chmod(system, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyPolicy(system); err != nil {
+		t.Fatal(err)
+	}
+	if !fault.Enabled() {
+		t.Error("Expected the system file to enable fault injection")
+	}
+}
@@ -0,0 +1,706 @@
+package config
+
+import (
+	"cmp"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/alert"
+	"github.com/dzakwan/ipsec-vpn/pkg/breakout"
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/flowexport"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/mail"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/dzakwan/ipsec-vpn/pkg/spiffe"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is an issue found in a configuration file
+type Problem struct {
+	Line    int
+	Key     string
+	Message string
+	Warning bool
+}
+
+// String formats the problem for display, without its line number
+func (p Problem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	if p.Key == "" {
+		return fmt.Sprintf("%s: %s", level, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", level, p.Key, p.Message)
+}
+
+// HasErrors reports whether any of the problems is an error rather than a warning
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if !p.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// validator collects problems while checking a configuration file
+type validator struct {
+	lines    map[string]int // Line of each key path present in the file
+	problems []Problem
+}
+
+// ValidateFile checks a configuration file against the schema
+func ValidateFile(path string) (*Config, []Problem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return Validate(data)
+}
+
+// Validate checks configuration data against the schema. Unknown keys are
+// reported as warnings; type mismatches and invalid values as errors.
+func Validate(data []byte) (*Config, []Problem, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, err
+	}
+
+	v := &validator{lines: make(map[string]int)}
+	cfg := &Config{}
+	if len(root.Content) == 0 {
+		return cfg, nil, nil
+	}
+
+	doc := root.Content[0]
+	v.walk(doc, reflect.TypeOf(Config{}), "")
+
+	// Decode with the tolerant decoder so that type errors are reported per key
+	if err := doc.Decode(cfg); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, nil, err
+		}
+		for _, msg := range typeErr.Errors {
+			v.problems = append(v.problems, v.typeProblem(msg))
+		}
+	}
+
+	v.check(cfg)
+
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		return v.problems[i].Line < v.problems[j].Line
+	})
+	return cfg, v.problems, nil
+}
+
+// walk records the line of every key and reports keys the schema does not know
+func (v *validator) walk(node *yaml.Node, t reflect.Type, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := structFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := joinPath(path, key.Value)
+			v.lines[keyPath] = key.Line
+
+			field, ok := fields[key.Value]
+			if !ok {
+				msg := "unknown key, it will be ignored"
+				if s := suggest(key.Value, fields); s != "" {
+					msg = fmt.Sprintf("unknown key, did you mean %q?", s)
+				}
+				v.problems = append(v.problems, Problem{Line: key.Line, Key: keyPath, Message: msg, Warning: true})
+				continue
+			}
+			v.walk(value, field, keyPath)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := joinPath(path, key.Value)
+			v.lines[keyPath] = key.Line
+			v.walk(value, t.Elem(), keyPath)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			v.lines[itemPath] = item.Line
+			v.walk(item, t.Elem(), itemPath)
+		}
+	}
+}
+
+// check validates the values of the keys present in the file
+func (v *validator) check(cfg *Config) {
+	for _, key := range []struct {
+		path  string
+		value int
+	}{
+		{"log.max_size", cfg.Log.MaxSize},
+		{"logging.max_size", cfg.Logging.MaxSize},
+		{"tunnel_defaults.key_rotation_interval", cfg.TunnelDefaults.KeyRotationInterval},
+		{"advanced.dpd_delay", cfg.Advanced.DPDDelay},
+		{"advanced.dpd_timeout", cfg.Advanced.DPDTimeout},
+		{"vault.certificate_ttl", cfg.Vault.CertificateTTL},
+		{"ca.validity", cfg.CA.Validity},
+		{"client.invite_expiry", cfg.Client.InviteExpiry},
+		{"client.accounting_retention", cfg.Client.AccountingRetention},
+		{"approval.expiry", cfg.Approval.Expiry},
+		{"history.max_entries", cfg.History.MaxEntries},
+		{"reconcile.interval", cfg.Reconcile.Interval},
+		{"reconcile.backoff_initial", cfg.Reconcile.BackoffInitial},
+		{"reconcile.backoff_max", cfg.Reconcile.BackoffMax},
+		{"retry.ike.attempts", cfg.Retry.IKE.Attempts},
+		{"retry.ike.initial_delay", cfg.Retry.IKE.InitialDelay},
+		{"retry.ike.max_delay", cfg.Retry.IKE.MaxDelay},
+		{"retry.netlink.attempts", cfg.Retry.Netlink.Attempts},
+		{"retry.netlink.initial_delay", cfg.Retry.Netlink.InitialDelay},
+		{"retry.netlink.max_delay", cfg.Retry.Netlink.MaxDelay},
+		{"retry.dns.attempts", cfg.Retry.DNS.Attempts},
+		{"retry.dns.initial_delay", cfg.Retry.DNS.InitialDelay},
+		{"retry.dns.max_delay", cfg.Retry.DNS.MaxDelay},
+	} {
+		if key.value <= 0 {
+			v.errorf(key.path, "must be greater than 0, got %d", key.value)
+		}
+	}
+
+	for _, key := range []struct {
+		path  string
+		value int
+	}{
+		{"log.max_backups", cfg.Log.MaxBackups},
+		{"log.max_age", cfg.Log.MaxAge},
+		{"logging.max_backups", cfg.Logging.MaxBackups},
+		{"logging.max_age", cfg.Logging.MaxAge},
+		{"security.cookie_threshold", cfg.Security.CookieThreshold},
+		{"security.max_half_open_per_source", cfg.Security.MaxHalfOpenPerSource},
+		{"security.blacklist_failures", cfg.Security.BlacklistFailures},
+		{"advanced.reauth_interval", cfg.Advanced.ReauthInterval},
+		{"advanced.reauth_grace", cfg.Advanced.ReauthGrace},
+	} {
+		if key.value < 0 {
+			v.errorf(key.path, "must not be negative, got %d", key.value)
+		}
+	}
+
+	for _, policy := range []struct {
+		path string
+		p    RetryPolicy
+	}{{"retry.ike", cfg.Retry.IKE}, {"retry.netlink", cfg.Retry.Netlink}, {"retry.dns", cfg.Retry.DNS}} {
+		if policy.p.MaxDelay > 0 && policy.p.MaxDelay < policy.p.InitialDelay {
+			v.errorf(policy.path+".max_delay", "must not be less than initial_delay (%d), got %d", policy.p.InitialDelay, policy.p.MaxDelay)
+		}
+	}
+	if cfg.Reconcile.BackoffMax > 0 && cfg.Reconcile.BackoffMax < cfg.Reconcile.BackoffInitial {
+		v.errorf("reconcile.backoff_max", "must not be less than backoff_initial (%d), got %d", cfg.Reconcile.BackoffInitial, cfg.Reconcile.BackoffMax)
+	}
+	if cfg.Retry.Jitter < 0 || cfg.Retry.Jitter > 1 {
+		v.errorf("retry.jitter", "must be between 0 and 1, got %v", cfg.Retry.Jitter)
+	}
+
+	if cfg.Security.BlacklistFailures > 0 && cfg.Security.BlacklistDuration <= 0 {
+		v.errorf("security.blacklist_duration", "must be greater than 0 when blacklist_failures is set, got %d", cfg.Security.BlacklistDuration)
+	}
+
+	if len(cfg.Security.GeoIPAllowCountries) > 0 && cfg.Security.GeoIPCountryDatabase == "" {
+		v.errorf("security.geoip_allow_countries", "requires security.geoip_country_database")
+	}
+	for i, country := range cfg.Security.GeoIPAllowCountries {
+		if len(country) != 2 || strings.ToUpper(country) != country {
+			v.errorf(fmt.Sprintf("security.geoip_allow_countries[%d]", i), "must be a two-letter ISO 3166 code such as DE, got %q", country)
+		}
+	}
+	if len(cfg.Security.GeoIPAllowASNs) > 0 && cfg.Security.GeoIPASNDatabase == "" {
+		v.errorf("security.geoip_allow_asns", "requires security.geoip_asn_database")
+	}
+	for i, asn := range cfg.Security.GeoIPAllowASNs {
+		if asn <= 0 {
+			v.errorf(fmt.Sprintf("security.geoip_allow_asns[%d]", i), "must be a positive AS number, got %d", asn)
+		}
+	}
+
+	v.oneOf("crypto.backend", cfg.Crypto.Backend, crypto.BackendGo, crypto.BackendKernel)
+	v.oneOf("logging.level", cfg.Logging.Level, "debug", "info", "warn", "error")
+	v.oneOf("log.rotation", cfg.Log.Rotation, logger.RotationInternal, logger.RotationExternal)
+	for _, key := range []struct {
+		path  string
+		value string
+	}{
+		{"log.levels.ike", cfg.Log.Levels.IKE},
+		{"log.levels.xfrm", cfg.Log.Levels.XFRM},
+		{"log.levels.tunnel", cfg.Log.Levels.Tunnel},
+		{"log.levels.network", cfg.Log.Levels.Network},
+		{"log.levels.api", cfg.Log.Levels.API},
+	} {
+		v.oneOf(key.path, key.value, "debug", "info", "error")
+	}
+	v.oneOf("security.authentication_method", cfg.Security.AuthenticationMethod, "psk", "pubkey", "spiffe")
+	if cfg.Vault.Address != "" {
+		if u, err := url.Parse(cfg.Vault.Address); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			v.errorf("vault.address", "must be an http or https URL such as https://vault.example.com:8200, got %q", cfg.Vault.Address)
+		} else if u.Scheme == "http" {
+			v.warnf("vault.address", "secrets are fetched without TLS")
+		}
+	}
+	if cfg.Vault.KVVersion != 1 && cfg.Vault.KVVersion != 2 {
+		v.errorf("vault.kv_version", "must be 1 or 2, got %d", cfg.Vault.KVVersion)
+	}
+	if _, _, err := net.SplitHostPort(cfg.Restconf.Listen); err != nil {
+		v.errorf("restconf.listen", "must be an address such as :8443 or 192.0.2.1:8443, got %q", cfg.Restconf.Listen)
+	}
+	if cfg.CA.Hub != "" {
+		if u, err := url.Parse(cfg.CA.Hub); err != nil || u.Scheme != "https" || u.Host == "" {
+			v.errorf("ca.hub", "must be the https URL of the hub's RESTCONF server such as https://hub.example.com:8443, got %q", cfg.CA.Hub)
+		}
+	}
+	if _, _, err := net.SplitHostPort(cfg.Client.Listen); err != nil {
+		v.errorf("client.listen", "must be an address such as :8444 or 192.0.2.1:8444, got %q", cfg.Client.Listen)
+	}
+	if cfg.Client.URL != "" {
+		if u, err := url.Parse(cfg.Client.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+			v.errorf("client.url", "must be the https URL users reach the enrollment server at such as https://vpn.example.com:8444, got %q", cfg.Client.URL)
+		}
+	}
+	if cfg.Store.RuntimeDir != "" && !filepath.IsAbs(cfg.Store.RuntimeDir) {
+		v.errorf("store.runtime_dir", "must be an absolute path, got %q", cfg.Store.RuntimeDir)
+	}
+	if cfg.Keys.Keyfile != "" && !filepath.IsAbs(cfg.Keys.Keyfile) {
+		v.errorf("keys.keyfile", "must be an absolute path, got %q", cfg.Keys.Keyfile)
+	}
+	for i, name := range cfg.Access.ViewerUsers {
+		if _, err := user.Lookup(name); err != nil {
+			v.warnf(fmt.Sprintf("access.viewer_users[%d]", i), "no user %q on this host", name)
+		}
+	}
+	for i, name := range cfg.Access.ViewerGroups {
+		if _, err := user.LookupGroup(name); err != nil {
+			v.warnf(fmt.Sprintf("access.viewer_groups[%d]", i), "no group %q on this host", name)
+		}
+	}
+	if (cfg.CA.Certificate == "") != (cfg.CA.PrivateKey == "") {
+		v.errorf("ca.certificate", "and ca.private_key must be set together")
+		v.errorf("ca.private_key", "and ca.certificate must be set together")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Metrics.Listen); err != nil {
+		v.errorf("metrics.listen", "must be an address such as :9469 or 127.0.0.1:9469, got %q", cfg.Metrics.Listen)
+	}
+	for i, broker := range cfg.Events.Publishers {
+		key := fmt.Sprintf("events.publishers[%d]", i)
+		if _, err := events.Open(broker, cfg.Events.Topic); err != nil {
+			v.errorf(key, "%v", err)
+		} else if u, _ := url.Parse(broker); u.User != nil && (u.Scheme == "mqtt" || u.Scheme == "nats") {
+			v.warnf(key, "credentials are sent without TLS")
+		}
+	}
+	if cfg.Events.Topic == "" {
+		v.errorf("events.topic", "must not be empty")
+	}
+	if cfg.Events.StatsInterval <= 0 {
+		v.errorf("events.stats_interval", "must be a positive number of seconds, got %d", cfg.Events.StatsInterval)
+	}
+	sink := cfg.Events.Email
+	if sink.Enabled && cfg.Alerts.Email.SMTP == "" {
+		v.errorf("events.email.enabled", "needs alerts.email.smtp, which events are emailed through")
+	}
+	for i, typ := range sink.Types {
+		if !slices.Contains(events.Types, typ) {
+			v.warnf(fmt.Sprintf("events.email.types[%d]", i), "unknown event type %q, events are %s", typ, strings.Join(events.Types, ", "))
+		}
+	}
+	for key, text := range map[string]string{"events.email.subject": sink.Subject, "events.email.body": sink.Body} {
+		if text == "" {
+			continue
+		}
+		if err := events.CheckEmailTemplate(text); err != nil {
+			v.errorf(key, "%v", err)
+		}
+	}
+	if sink.RateLimit < 0 {
+		v.errorf("events.email.rate_limit", "must not be negative, got %d", sink.RateLimit)
+	}
+	if cfg.Alerts.Interval <= 0 {
+		v.errorf("alerts.interval", "must be a positive number of seconds, got %d", cfg.Alerts.Interval)
+	}
+	for i, rule := range cfg.Alerts.Rules {
+		if _, err := alert.ParseRule(rule); err != nil {
+			v.errorf(fmt.Sprintf("alerts.rules[%d]", i), "%v", err)
+		}
+	}
+	for i, webhook := range cfg.Alerts.Webhooks {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf(fmt.Sprintf("alerts.webhooks[%d]", i), "must be an http or https URL")
+		}
+	}
+	email := cfg.Alerts.Email
+	v.email("alerts.email", email.SMTP, email.TLS, email.From, email.To)
+	if len(cfg.Alerts.Rules) > 0 && len(cfg.Alerts.Hooks)+len(cfg.Alerts.Webhooks) == 0 && cfg.Alerts.Email.SMTP == "" {
+		v.warnf("alerts.rules", "alerts are only logged, as no hooks, webhooks or email are configured")
+	}
+	if cfg.Flows.Collector != "" {
+		if _, _, err := net.SplitHostPort(cfg.Flows.Collector); err != nil {
+			v.errorf("flows.collector", "must be a host and port such as collector:4739, got %q", cfg.Flows.Collector)
+		}
+	}
+	v.oneOf("flows.protocol", cfg.Flows.Protocol, flowexport.Protocols...)
+	if cfg.Flows.Interval <= 0 {
+		v.errorf("flows.interval", "must be a positive number of seconds, got %d", cfg.Flows.Interval)
+	}
+	if cfg.Flows.DomainID < 0 || cfg.Flows.DomainID > math.MaxUint32 {
+		v.errorf("flows.domain_id", "must be between 0 and %d, got %d", uint32(math.MaxUint32), cfg.Flows.DomainID)
+	}
+	uplinks := make(map[string]bool)
+	for i, u := range cfg.Uplinks {
+		prefix := fmt.Sprintf("uplinks[%d]", i)
+		switch {
+		case u.Name == "":
+			v.errorf(prefix, "missing required key \"name\"")
+		case u.Name == "auto":
+			v.errorf(prefix+".name", "\"auto\" is reserved for tunnels placed automatically")
+		case uplinks[u.Name]:
+			v.errorf(prefix+".name", "uplink %q is defined more than once", u.Name)
+		}
+		uplinks[u.Name] = true
+		if u.Interface == "" {
+			v.errorf(prefix, "missing required key \"interface\"")
+		}
+		if u.Gateway != "" {
+			v.ip(prefix+".gateway", u.Gateway)
+		}
+		if u.Capacity != "" {
+			if _, err := network.ParseRate(u.Capacity); err != nil {
+				v.errorf(prefix+".capacity", "%v", err)
+			}
+		}
+	}
+	if len(cfg.Breakout.Lists) > 0 && cfg.Breakout.Interface == "" {
+		v.errorf("breakout.lists", "needs breakout.interface to route the prefixes out of")
+	}
+	if cfg.Breakout.Gateway != "" {
+		v.ip("breakout.gateway", cfg.Breakout.Gateway)
+	}
+	lists := make(map[string]bool)
+	for i, l := range cfg.Breakout.Lists {
+		prefix := fmt.Sprintf("breakout.lists[%d]", i)
+		switch {
+		case l.Name == "":
+			v.errorf(prefix, "missing required key \"name\"")
+		case lists[l.Name]:
+			v.errorf(prefix+".name", "prefix list %q is defined more than once", l.Name)
+		}
+		lists[l.Name] = true
+		if l.URL == "" && len(l.Prefixes) == 0 {
+			v.errorf(prefix, "needs a url, prefixes or both")
+		}
+		if l.URL != "" {
+			if u, err := url.Parse(l.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				v.errorf(prefix+".url", "must be an http or https URL, got %q", l.URL)
+			}
+		}
+		if l.Format != "" {
+			v.oneOf(prefix+".format", l.Format, breakout.Formats...)
+		}
+		for j, p := range l.Prefixes {
+			if _, err := breakout.Parse([]byte(p), breakout.FormatPlain); err != nil {
+				v.errorf(fmt.Sprintf("%s.prefixes[%d]", prefix, j), "%v", err)
+			}
+		}
+	}
+	if cfg.Discovery.LocalIP != "" {
+		v.ip("discovery.local_ip", cfg.Discovery.LocalIP)
+	}
+	if cfg.Discovery.LocalSubnet != "" {
+		v.cidr("discovery.local_subnet", cfg.Discovery.LocalSubnet)
+	}
+	if cfg.Spiffe.Socket != "" {
+		if _, _, err := spiffe.ParseAddress(cfg.Spiffe.Socket); err != nil {
+			v.errorf("spiffe.socket", "%v", err)
+		}
+	}
+
+	if cfg.TunnelDefaults.MTU < 576 || cfg.TunnelDefaults.MTU > 9000 {
+		v.errorf("tunnel_defaults.mtu", "must be between 576 and 9000, got %d", cfg.TunnelDefaults.MTU)
+	}
+	if cfg.Advanced.IKEVersion != 1 && cfg.Advanced.IKEVersion != 2 {
+		v.errorf("advanced.ike_version", "must be 1 or 2, got %d", cfg.Advanced.IKEVersion)
+	}
+	if cfg.Advanced.DPDDelay > 0 && cfg.Advanced.DPDTimeout > 0 && cfg.Advanced.DPDTimeout < cfg.Advanced.DPDDelay {
+		v.errorf("advanced.dpd_timeout", "must not be shorter than dpd_delay (%d)", cfg.Advanced.DPDDelay)
+	}
+	if cfg.Advanced.ReauthInterval > 0 && cfg.Advanced.ReauthInterval < 60 {
+		v.errorf("advanced.reauth_interval", "must be 0 or at least 60, got %d", cfg.Advanced.ReauthInterval)
+	}
+	if cfg.Advanced.ReauthInterval > 0 && cfg.Advanced.ReauthGrace >= cfg.Advanced.ReauthInterval {
+		v.errorf("advanced.reauth_grace", "must be shorter than reauth_interval (%d)", cfg.Advanced.ReauthInterval)
+	}
+
+	v.algorithm("crypto.default_classic", cfg.Crypto.DefaultClassic, false)
+	v.algorithm("crypto.default_post_quantum", cfg.Crypto.DefaultPostQuantum, true)
+	v.algorithm("tunnel_defaults.encryption", cfg.TunnelDefaults.Encryption, false)
+	// The hard time limit defaults to key_rotation_interval, so a soft one alone is fine
+	l := cfg.TunnelDefaults.SALifetime
+	if l.SoftTime < 0 || l.HardTime < 0 {
+		v.errorf("tunnel_defaults.sa_lifetime", "time limits must not be negative")
+	}
+	for _, pair := range []struct {
+		name       string
+		soft, hard uint64
+	}{
+		{"time", uint64(max(l.SoftTime, 0)), uint64(max(cmp.Or(l.HardTime, cfg.TunnelDefaults.KeyRotationInterval), 0))},
+		{"bytes", l.SoftBytes, l.HardBytes},
+		{"packets", l.SoftPackets, l.HardPackets},
+	} {
+		soft, hard := "tunnel_defaults.sa_lifetime.soft_"+pair.name, "tunnel_defaults.sa_lifetime.hard_"+pair.name
+		switch {
+		case pair.soft > 0 && pair.hard > 0 && pair.soft >= pair.hard:
+			v.errorf(soft, "must be below the hard limit (%d) so SAs are rekeyed before they expire", pair.hard)
+		case pair.soft > 0 && pair.hard == 0:
+			v.errorf(soft, "needs hard_%s", pair.name)
+		case pair.soft == 0 && pair.hard > 0 && pair.name != "time":
+			v.errorf(hard, "needs soft_%s, or SAs expire without being rekeyed", pair.name)
+		}
+	}
+	if cfg.TunnelDefaults.CheckPeer != "" {
+		v.oneOf("tunnel_defaults.check_peer", cfg.TunnelDefaults.CheckPeer, "off", "warn", "abort")
+	}
+
+	names := make([]string, 0, len(cfg.Tunnels))
+	for name := range cfg.Tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := cfg.Tunnels[name]
+		prefix := "tunnels." + name + "."
+		for _, required := range []string{"local_ip", "remote_ip", "local_subnet", "remote_subnet"} {
+			if _, ok := v.present(prefix + required); !ok {
+				v.errorf("tunnels."+name, "missing required key %q", required)
+			}
+		}
+		v.ip(prefix+"local_ip", t.LocalIP)
+		v.ip(prefix+"remote_ip", t.RemoteIP)
+		v.cidr(prefix+"local_subnet", t.LocalSubnet)
+		v.cidr(prefix+"remote_subnet", t.RemoteSubnet)
+		v.algorithm(prefix+"encryption", t.Encryption, t.PostQuantum)
+		if t.RateLimit != "" {
+			if _, err := network.ParseRate(t.RateLimit); err != nil {
+				v.errorf(prefix+"rate_limit", "%v", err)
+			}
+		}
+		if t.PeerSpiffeID != "" {
+			if _, err := spiffe.ParseID(t.PeerSpiffeID); err != nil {
+				v.errorf(prefix+"peer_spiffe_id", "%v", err)
+			}
+		} else if cfg.Security.AuthenticationMethod == "spiffe" {
+			v.errorf("tunnels."+name, "missing key \"peer_spiffe_id\", required with security.authentication_method spiffe")
+		}
+		v.oneOf(prefix+"mode", t.Mode, "ipsec", "wireguard")
+		if t.Mode == "wireguard" {
+			if key, err := base64.StdEncoding.DecodeString(t.WireGuardPeerKey); t.WireGuardPeerKey == "" {
+				v.errorf("tunnels."+name, "missing key \"wireguard_peer_key\", required in wireguard mode")
+			} else if err != nil || len(key) != 32 {
+				v.errorf(prefix+"wireguard_peer_key", "must be a base64 WireGuard public key")
+			}
+			if t.Encryption != "" && t.Encryption != "chacha20poly1305" {
+				v.errorf(prefix+"encryption", "wireguard mode always uses chacha20poly1305, got %q", t.Encryption)
+			}
+			if t.PostQuantum {
+				v.errorf(prefix+"post_quantum", "not supported in wireguard mode")
+			}
+		} else if t.WireGuardPeerKey != "" {
+			v.warnf(prefix+"wireguard_peer_key", "ignored unless mode is wireguard")
+		}
+		if t.ListenPort < 1 || t.ListenPort > 65535 {
+			v.errorf(prefix+"listen_port", "must be between 1 and 65535, got %d", t.ListenPort)
+		}
+	}
+
+	for i, n := range cfg.NetworkAdvertisement.AdvertisedNetworks {
+		prefix := fmt.Sprintf("network_advertisement.advertised_networks[%d].", i)
+		v.cidr(prefix+"cidr", n.CIDR)
+		if n.Metric < 0 {
+			v.errorf(prefix+"metric", "must not be negative, got %d", n.Metric)
+		}
+		if _, ok := cfg.Tunnels[n.Tunnel]; !ok && n.Tunnel != "" {
+			v.warnf(prefix+"tunnel", "tunnel %q is not defined in this file", n.Tunnel)
+		}
+	}
+}
+
+// present reports whether a key path appears in the file, and returns its line
+func (v *validator) present(path string) (int, bool) {
+	line, ok := v.lines[path]
+	return line, ok
+}
+
+// email checks the SMTP settings of an email section. The sender and recipients
+// are reported on the smtp key, since they are needed once it is set.
+func (v *validator) email(section, smtp, tls, from string, to []string) {
+	v.oneOf(section+".tls", tls, mail.TLSAuto, mail.TLSStartTLS, mail.TLSImplicit, mail.TLSNone)
+	if smtp == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(smtp); err != nil {
+		v.errorf(section+".smtp", "must be an address such as smtp.example.com:587, got %q", smtp)
+	}
+	if from == "" || len(to) == 0 {
+		v.errorf(section+".smtp", "needs %s.from and at least one recipient in %s.to", section, section)
+	}
+}
+
+func (v *validator) errorf(path, format string, args ...interface{}) {
+	if line, ok := v.present(path); ok {
+		v.problems = append(v.problems, Problem{Line: line, Key: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (v *validator) warnf(path, format string, args ...interface{}) {
+	if line, ok := v.present(path); ok {
+		v.problems = append(v.problems, Problem{Line: line, Key: path, Message: fmt.Sprintf(format, args...), Warning: true})
+	}
+}
+
+func (v *validator) oneOf(path, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.errorf(path, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+}
+
+func (v *validator) ip(path, value string) {
+	if net.ParseIP(value) == nil {
+		v.errorf(path, "invalid IP address %q", value)
+	}
+}
+
+func (v *validator) cidr(path, value string) {
+	if _, _, err := net.ParseCIDR(value); err != nil {
+		v.errorf(path, "invalid CIDR %q", value)
+	}
+}
+
+func (v *validator) algorithm(path, value string, postQuantum bool) {
+	if value == crypto.AutoAlgorithm && !postQuantum {
+		return
+	}
+	algo, ok := crypto.LookupAlgorithm(value)
+	if !ok {
+		v.errorf(path, "unknown algorithm %q", value)
+		return
+	}
+	if algo.PostQuantum != postQuantum {
+		v.errorf(path, "%q is not a %s algorithm", value, postQuantumLabel(postQuantum))
+		return
+	}
+	if algo.Deprecated {
+		v.warnf(path, "%q is deprecated, use %q", value, algo.ReplacedBy)
+	}
+}
+
+func postQuantumLabel(postQuantum bool) string {
+	if postQuantum {
+		return "post-quantum"
+	}
+	return "classic"
+}
+
+// typeProblem converts a yaml.v3 type error message such as
+// "line 12: cannot unmarshal !!str `abc` into int" into a Problem
+func (v *validator) typeProblem(msg string) Problem {
+	p := Problem{Message: msg}
+	var line int
+	if n, _ := fmt.Sscanf(msg, "line %d:", &line); n == 1 {
+		p.Line = line
+		p.Message = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+		for path, l := range v.lines {
+			if l == line && len(path) > len(p.Key) {
+				p.Key = path
+			}
+		}
+	}
+	return p
+}
+
+// structFields maps the yaml keys of a struct to their field types
+func structFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// suggest returns the known key closest to an unknown one, if any is close enough
+func suggest(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	for name := range fields {
+		if d := levenshtein(key, name); d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
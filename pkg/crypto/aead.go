@@ -0,0 +1,54 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher backends for the AEAD operations done in userspace, such as file
+// encryption. ESP traffic is always encrypted by the kernel.
+const (
+	BackendGo     = "go"     // Go's crypto/aes and x/crypto/chacha20poly1305
+	BackendKernel = "kernel" // The Linux kernel crypto API, through AF_ALG sockets
+)
+
+// Backend returns the configured cipher backend
+func Backend() string {
+	if backend := viper.GetString("crypto.backend"); backend != "" {
+		return backend
+	}
+	return BackendGo
+}
+
+// NewAEAD returns an AEAD cipher for a classic algorithm with a 32 byte key,
+// implemented by the configured backend. The key is not retained by the kernel
+// backend, which copies it into the kernel.
+func NewAEAD(algorithm string, key []byte) (cipher.AEAD, error) {
+	switch Backend() {
+	case BackendGo:
+		return newGoAEAD(algorithm, key)
+	case BackendKernel:
+		return newKernelAEAD(algorithm, key)
+	default:
+		return nil, fmt.Errorf("unknown crypto backend %q, expected %s or %s", Backend(), BackendGo, BackendKernel)
+	}
+}
+
+func newGoAEAD(algorithm string, key []byte) (cipher.AEAD, error) {
+	switch algorithm {
+	case "aes256gcm":
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case "chacha20poly1305":
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("no AEAD cipher for algorithm %s", algorithm)
+	}
+}
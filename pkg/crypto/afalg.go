@@ -0,0 +1,198 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// kernelAlgorithms maps algorithms to their names in the kernel crypto API
+var kernelAlgorithms = map[string]string{
+	"aes256gcm":        "gcm(aes)",
+	"chacha20poly1305": "rfc7539(chacha20,poly1305)",
+}
+
+// Sizes shared by both kernel AEADs
+const (
+	kernelNonceSize = 12
+	kernelTagSize   = 16
+)
+
+// errKernelOpen is returned when the kernel rejects a ciphertext's tag
+var errKernelOpen = errors.New("cipher: message authentication failed")
+
+// kernelAEAD performs AEAD operations through an AF_ALG socket. Each operation
+// sends the additional data and input with the nonce in control messages, and
+// reads back the additional data followed by the output.
+type kernelAEAD struct {
+	name string
+	mu   sync.Mutex // One operation at a time on the socket
+	fds  *kernelSockets
+}
+
+// kernelSockets are the transform socket holding the key and the operation
+// socket accepted from it
+type kernelSockets struct {
+	tfm, op int
+}
+
+func (s *kernelSockets) close() {
+	unix.Close(s.op)
+	unix.Close(s.tfm)
+}
+
+func newKernelAEAD(algorithm string, key []byte) (cipher.AEAD, error) {
+	name, ok := kernelAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("no kernel AEAD cipher for algorithm %s", algorithm)
+	}
+
+	tfm, err := unix.Socket(unix.AF_ALG, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("kernel crypto API unavailable (CONFIG_CRYPTO_USER_API_AEAD): %v", err)
+	}
+	if err := unix.Bind(tfm, &unix.SockaddrALG{Type: "aead", Name: name}); err != nil {
+		unix.Close(tfm)
+		return nil, fmt.Errorf("kernel has no %s: %v", name, err)
+	}
+	if err := unix.SetsockoptString(tfm, unix.SOL_ALG, unix.ALG_SET_KEY, string(key)); err != nil {
+		unix.Close(tfm)
+		return nil, fmt.Errorf("kernel rejected %s key: %v", name, err)
+	}
+
+	// accept(2) on an AF_ALG socket returns no address, which unix.Accept cannot handle
+	op, _, errno := unix.Syscall6(unix.SYS_ACCEPT4, uintptr(tfm), 0, 0, unix.SOCK_CLOEXEC, 0, 0)
+	if errno != 0 {
+		unix.Close(tfm)
+		return nil, fmt.Errorf("failed to open %s operation socket: %v", name, errno)
+	}
+
+	aead := &kernelAEAD{name: name, fds: &kernelSockets{tfm: tfm, op: int(op)}}
+	runtime.AddCleanup(aead, (*kernelSockets).close, aead.fds)
+	return aead, nil
+}
+
+func (k *kernelAEAD) NonceSize() int { return kernelNonceSize }
+
+func (k *kernelAEAD) Overhead() int { return kernelTagSize }
+
+func (k *kernelAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != kernelNonceSize {
+		panic("crypto: incorrect nonce length given to kernel AEAD")
+	}
+	out, err := k.do(unix.ALG_OP_ENCRYPT, nonce, plaintext, additionalData, len(plaintext)+kernelTagSize)
+	if err != nil {
+		// cipher.AEAD has no way to report errors from Seal
+		panic(fmt.Sprintf("crypto: kernel %s encryption failed: %v", k.name, err))
+	}
+	return append(dst, out...)
+}
+
+func (k *kernelAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != kernelNonceSize {
+		panic("crypto: incorrect nonce length given to kernel AEAD")
+	}
+	if len(ciphertext) < kernelTagSize {
+		return nil, errKernelOpen
+	}
+	out, err := k.do(unix.ALG_OP_DECRYPT, nonce, ciphertext, additionalData, len(ciphertext)-kernelTagSize)
+	if errors.Is(err, unix.EBADMSG) {
+		return nil, errKernelOpen
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kernel %s decryption failed: %v", k.name, err)
+	}
+	return append(dst, out...), nil
+}
+
+// do runs one operation and returns its output of outLen bytes
+func (k *kernelAEAD) do(op uint32, nonce, input, additionalData []byte, outLen int) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	defer runtime.KeepAlive(k)
+
+	message := make([]byte, 0, len(additionalData)+len(input))
+	message = append(message, additionalData...)
+	message = append(message, input...)
+	defer Zeroize(message)
+	if err := k.reserve(len(message)); err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, 4+len(nonce)) // struct af_alg_iv
+	binary.NativeEndian.PutUint32(iv, uint32(len(nonce)))
+	copy(iv[4:], nonce)
+	var control []byte
+	control = appendControl(control, unix.ALG_SET_OP, binary.NativeEndian.AppendUint32(nil, op))
+	control = appendControl(control, unix.ALG_SET_IV, iv)
+	control = appendControl(control, unix.ALG_SET_AEAD_ASSOCLEN, binary.NativeEndian.AppendUint32(nil, uint32(len(additionalData))))
+
+	// The whole message must be queued before the kernel computes anything, so a
+	// message that does not fit fails rather than blocking forever
+	n, err := unix.SendmsgN(k.fds.op, message, control, nil, unix.MSG_DONTWAIT)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(message) {
+		return nil, fmt.Errorf("kernel accepted %d of %d bytes", n, len(message))
+	}
+
+	out := make([]byte, len(additionalData)+outLen)
+	n, err = unix.Read(k.fds.op, out)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(out) {
+		return nil, fmt.Errorf("kernel returned %d of %d bytes", n, len(out))
+	}
+	return out[len(additionalData):], nil
+}
+
+// reserve grows the operation socket's buffers to hold a message and its output:
+// the kernel queues the whole input in the send buffer and maps the output
+// against the receive buffer. Raising them past net.core.wmem_max and rmem_max
+// needs CAP_NET_ADMIN.
+func (k *kernelAEAD) reserve(size int) error {
+	pageSize := os.Getpagesize()
+	for _, buffer := range []struct{ option, force int }{
+		{unix.SO_SNDBUF, unix.SO_SNDBUFFORCE},
+		{unix.SO_RCVBUF, unix.SO_RCVBUFFORCE},
+	} {
+		fits := func() bool {
+			current, err := unix.GetsockoptInt(k.fds.op, unix.SOL_SOCKET, buffer.option)
+			return err == nil && current&^(pageSize-1) >= size+pageSize
+		}
+		if fits() {
+			continue
+		}
+
+		// The kernel doubles the requested size for bookkeeping
+		want := (size + 2*pageSize) / 2
+		if unix.SetsockoptInt(k.fds.op, unix.SOL_SOCKET, buffer.force, want) != nil {
+			_ = unix.SetsockoptInt(k.fds.op, unix.SOL_SOCKET, buffer.option, want)
+		}
+		if !fits() {
+			return fmt.Errorf("message of %d bytes exceeds the socket buffers, raise net.core.wmem_max and rmem_max or run as root", size)
+		}
+	}
+	return nil
+}
+
+// appendControl appends a SOL_ALG control message
+func appendControl(b []byte, kind int, data []byte) []byte {
+	start := len(b)
+	b = append(b, make([]byte, unix.CmsgSpace(len(data)))...)
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&b[start]))
+	header.Level = unix.SOL_ALG
+	header.Type = int32(kind)
+	header.SetLen(unix.CmsgLen(len(data)))
+	copy(b[start+unix.CmsgLen(0):], data)
+	return b
+}
@@ -0,0 +1,69 @@
+package crypto
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// Severity indicates how urgently an audit finding should be addressed
+type Severity string
+
+const (
+	SeverityWarning  Severity = "WARNING"
+	SeverityCritical Severity = "CRITICAL"
+)
+
+// Finding describes a weak or deprecated cryptographic choice
+type Finding struct {
+	Severity    Severity
+	Algorithm   string
+	Message     string
+	Recommended string
+}
+
+// RequirePostQuantum reports whether the configured policy requires post-quantum algorithms
+func RequirePostQuantum() bool {
+	return viper.GetBool("crypto.require_post_quantum")
+}
+
+// AuditAlgorithm checks an algorithm choice against the current crypto policy
+func AuditAlgorithm(algorithm string) []Finding {
+	cryptoLog.Debug("Auditing algorithm", "algorithm", algorithm)
+
+	algo, ok := LookupAlgorithm(algorithm)
+	if !ok {
+		return []Finding{{
+			Severity:    SeverityCritical,
+			Algorithm:   algorithm,
+			Message:     fmt.Sprintf("unknown algorithm: %s", algorithm),
+			Recommended: RecommendedAlgorithm,
+		}}
+	}
+
+	findings := make([]Finding, 0)
+
+	if algo.Deprecated {
+		findings = append(findings, Finding{
+			Severity:    SeverityWarning,
+			Algorithm:   algo.Name,
+			Message:     fmt.Sprintf("%s is deprecated, use %s instead", algo.Name, algo.ReplacedBy),
+			Recommended: algo.ReplacedBy,
+		})
+	}
+
+	if !algo.PostQuantum {
+		severity := SeverityWarning
+		if RequirePostQuantum() {
+			severity = SeverityCritical
+		}
+		findings = append(findings, Finding{
+			Severity:    severity,
+			Algorithm:   algo.Name,
+			Message:     "not protected against harvest-now-decrypt-later attacks",
+			Recommended: RecommendedAlgorithm,
+		})
+	}
+
+	return findings
+}
@@ -0,0 +1,180 @@
+package crypto
+
+import (
+	"cmp"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+)
+
+// benchPacketSize approximates a full-size ESP payload on a 1500 byte MTU link
+const benchPacketSize = 1400
+
+// quickBenchDuration is how long each cipher runs when "auto" has no cached results
+const quickBenchDuration = 50 * time.Millisecond
+
+// BenchResult holds the measured throughput of a single cipher
+type BenchResult struct {
+	Algorithm  string  `json:"algorithm"`
+	Packets    int     `json:"packets"`
+	Throughput float64 `json:"throughput_mbps"`
+}
+
+// BenchReport holds the results of a cipher benchmark on this host
+type BenchReport struct {
+	Capabilities Capabilities  `json:"capabilities"`
+	Backend      string        `json:"backend,omitempty"`
+	PacketSize   int           `json:"packet_size"`
+	Results      []BenchResult `json:"results"`
+	CreatedAt    time.Time     `json:"created_at"`
+}
+
+// Fastest returns the algorithm with the highest measured throughput
+func (r *BenchReport) Fastest() string {
+	best := ""
+	bestThroughput := 0.0
+	for _, result := range r.Results {
+		if result.Throughput > bestThroughput {
+			best = result.Algorithm
+			bestThroughput = result.Throughput
+		}
+	}
+	return best
+}
+
+// Benchmark measures the throughput of every approved classic cipher, running each for the given duration
+func Benchmark(duration time.Duration) (*BenchReport, error) {
+	report := &BenchReport{
+		Capabilities: DetectCapabilities(),
+		Backend:      Backend(),
+		PacketSize:   benchPacketSize,
+		CreatedAt:    time.Now(),
+	}
+
+	for _, algo := range ListClassicAlgorithms() {
+		if algo.Deprecated {
+			continue
+		}
+
+		cryptoLog.Debug("Benchmarking", "algorithm", algo.Name, "duration", duration)
+		result, err := benchCipher(algo.Name, duration)
+		if err != nil {
+			return nil, err
+		}
+		report.Results = append(report.Results, *result)
+	}
+
+	return report, nil
+}
+
+// benchCipher seals packet-sized buffers with a cipher until the duration has elapsed
+func benchCipher(algorithm string, duration time.Duration) (*BenchResult, error) {
+	aead, err := benchAEAD(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	packet := make([]byte, benchPacketSize)
+	nonce := make([]byte, aead.NonceSize())
+	out := make([]byte, 0, benchPacketSize+aead.Overhead())
+
+	packets := 0
+	start := time.Now()
+	for time.Since(start) < duration {
+		// The nonce only has to be unique; the key is discarded afterwards
+		binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(packets))
+		out = aead.Seal(out[:0], nonce, packet, nil)
+		packets++
+	}
+	elapsed := time.Since(start)
+
+	return &BenchResult{
+		Algorithm:  algorithm,
+		Packets:    packets,
+		Throughput: float64(packets*benchPacketSize) / elapsed.Seconds() / 1e6,
+	}, nil
+}
+
+// benchAEAD creates a cipher with a throwaway random key
+func benchAEAD(algorithm string) (cipher.AEAD, error) {
+	key := NewSecret(32)
+	defer ReleaseSecret(key)
+	if err := readRandom(key); err != nil {
+		return nil, err
+	}
+
+	aead, err := NewAEAD(algorithm, key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot benchmark algorithm %s: %v", algorithm, err)
+	}
+	return aead, nil
+}
+
+// SaveBenchReport caches benchmark results for use by the "auto" encryption setting
+func SaveBenchReport(report *BenchReport) error {
+	path, err := benchCachePath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// LoadBenchReport loads cached benchmark results. Results recorded on a host
+// with different CPU capabilities are ignored.
+func LoadBenchReport() (*BenchReport, error) {
+	path, err := benchCachePath()
+	if err != nil {
+		return nil, err
+	}
+	return LoadBenchReportFrom(path)
+}
+
+// LoadBenchReportFrom loads benchmark results cached at path, as LoadBenchReport
+func LoadBenchReportFrom(path string) (*BenchReport, error) {
+	if path == "" {
+		return nil, errors.New("no benchmark cache")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var report BenchReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+
+	if report.Capabilities != DetectCapabilities() {
+		return nil, errors.New("cached benchmark was recorded on different hardware")
+	}
+	// Reports from before the backend was recorded used Go's ciphers
+	if cmp.Or(report.Backend, BackendGo) != Backend() {
+		return nil, errors.New("cached benchmark was recorded with another crypto backend")
+	}
+	return &report, nil
+}
+
+// benchCachePath returns the location of the cached benchmark results
+func benchCachePath() (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "bench.json"), nil
+}
@@ -0,0 +1,92 @@
+package crypto
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/cpu"
+)
+
+// AutoAlgorithm is the encryption setting that selects the fastest cipher for this host
+const AutoAlgorithm = "auto"
+
+// Capabilities describes the CPU features relevant to cipher performance
+type Capabilities struct {
+	Arch   string
+	AES    bool // AES instructions (AES-NI on x86, ARMv8 crypto extensions)
+	PCLMUL bool // Carry-less multiplication for GHASH (PCLMULQDQ on x86, PMULL on ARM)
+	AVX2   bool // 256-bit vector instructions used by ChaCha20 on x86
+	NEON   bool // Advanced SIMD used by ChaCha20 on ARM
+}
+
+// DetectCapabilities reports the cryptographic CPU features of this host
+func DetectCapabilities() Capabilities {
+	caps := Capabilities{Arch: runtime.GOARCH}
+
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		caps.AES = cpu.X86.HasAES
+		caps.PCLMUL = cpu.X86.HasPCLMULQDQ
+		caps.AVX2 = cpu.X86.HasAVX2
+	case "arm64":
+		caps.AES = cpu.ARM64.HasAES
+		caps.PCLMUL = cpu.ARM64.HasPMULL
+		caps.NEON = cpu.ARM64.HasASIMD
+	case "arm":
+		caps.AES = cpu.ARM.HasAES
+		caps.PCLMUL = cpu.ARM.HasPMULL
+		caps.NEON = cpu.ARM.HasNEON
+	}
+
+	cryptoLog.Debug("Detected CPU capabilities", "capabilities", fmt.Sprintf("%+v", caps))
+	return caps
+}
+
+// HardwareAESGCM reports whether AES-GCM is fully hardware accelerated
+func (c Capabilities) HardwareAESGCM() bool {
+	return c.AES && c.PCLMUL
+}
+
+// PreferredCipher returns the classic cipher expected to be fastest on this host.
+// Without hardware AES-GCM support, ChaCha20-Poly1305 is faster and constant time.
+func (c Capabilities) PreferredCipher() string {
+	if c.HardwareAESGCM() {
+		return "aes256gcm"
+	}
+	return "chacha20poly1305"
+}
+
+// ResolveAlgorithm replaces the "auto" encryption setting with a concrete algorithm.
+// Cached results from `crypto bench` are preferred; without them a quick benchmark
+// is run, falling back to detected CPU capabilities if that fails.
+func ResolveAlgorithm(algorithm string) string {
+	path, err := benchCachePath()
+	if err != nil {
+		cryptoLog.Debug("No cached benchmark", "err", err)
+	}
+	return ResolveAlgorithmFrom(path, algorithm)
+}
+
+// ResolveAlgorithmFrom is ResolveAlgorithm with the benchmark results cached at
+// path rather than in the configuration directory
+func ResolveAlgorithmFrom(path, algorithm string) string {
+	if algorithm != AutoAlgorithm {
+		return algorithm
+	}
+
+	if report, err := LoadBenchReportFrom(path); err == nil && report.Fastest() != "" {
+		cryptoLog.Info("Encryption 'auto' resolved from cached benchmark", "algorithm", report.Fastest())
+		return report.Fastest()
+	}
+
+	report, err := Benchmark(quickBenchDuration)
+	if err == nil && report.Fastest() != "" {
+		cryptoLog.Info("Encryption 'auto' resolved from quick benchmark", "algorithm", report.Fastest())
+		return report.Fastest()
+	}
+	cryptoLog.Debug("Quick benchmark failed, using CPU capabilities", "err", err)
+
+	resolved := DetectCapabilities().PreferredCipher()
+	cryptoLog.Info("Encryption 'auto' resolved from CPU capabilities", "algorithm", resolved)
+	return resolved
+}
@@ -1,27 +1,47 @@
 package crypto
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"errors"
 	"fmt"
-	"io"
 	"time"
 
 	"github.com/cloudflare/circl/kem"
 	"github.com/cloudflare/circl/kem/kyber/kyber768"
 	"github.com/cloudflare/circl/kem/kyber/kyber1024"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
 	"github.com/dzakwan/ipsec-vpn/pkg/logger"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// RecommendedAlgorithm is the algorithm new and migrated tunnels should use
+const RecommendedAlgorithm = "hybrid-mlkem768-aes256gcm"
+
+// Logger receives the messages of the package: constant messages with
+// key-value pairs, as in log/slog. *slog.Logger and logger.Structured satisfy it.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// cryptoLog is where the package logs to, the ipsec-vpn log unless SetLogger
+// was called
+var cryptoLog Logger = logger.Structured{}
+
+// SetLogger sends the messages of the package to a logger of the program
+// embedding it. It is not safe to call while the package is in use.
+func SetLogger(l Logger) {
+	cryptoLog = l
+}
+
 // Algorithm represents a cryptographic algorithm
 type Algorithm struct {
 	Name        string
 	Description string
 	PostQuantum bool
+	Deprecated  bool
+	ReplacedBy  string
 }
 
 // TestResult represents the result of testing an algorithm
@@ -36,7 +56,7 @@ type TestResult struct {
 
 // ListClassicAlgorithms returns a list of available classic encryption algorithms
 func ListClassicAlgorithms() []Algorithm {
-	logger.Debug("Listing available classic encryption algorithms")
+	cryptoLog.Debug("Listing available classic encryption algorithms")
 	return []Algorithm{
 		{
 			Name:        "aes256gcm",
@@ -53,29 +73,60 @@ func ListClassicAlgorithms() []Algorithm {
 
 // ListPostQuantumAlgorithms returns a list of available post-quantum encryption algorithms
 func ListPostQuantumAlgorithms() []Algorithm {
-	logger.Debug("Listing available post-quantum encryption algorithms")
+	cryptoLog.Debug("Listing available post-quantum encryption algorithms")
 	return []Algorithm{
+		{
+			Name:        "mlkem768",
+			Description: "ML-KEM-768 - NIST FIPS 203 post-quantum key encapsulation mechanism",
+			PostQuantum: true,
+		},
+		{
+			Name:        "hybrid-mlkem768-aes256gcm",
+			Description: "Hybrid ML-KEM-768 + AES-256-GCM - Post-quantum security with classical fallback",
+			PostQuantum: true,
+		},
 		{
 			Name:        "kyber768",
-			Description: "Kyber-768 - NIST selected post-quantum key encapsulation mechanism",
+			Description: "Kyber-768 - Pre-standard post-quantum key encapsulation mechanism",
 			PostQuantum: true,
+			Deprecated:  true,
+			ReplacedBy:  "mlkem768",
 		},
 		{
 			Name:        "kyber1024",
-			Description: "Kyber-1024 - Higher security level post-quantum key encapsulation mechanism",
+			Description: "Kyber-1024 - Higher security level pre-standard post-quantum key encapsulation mechanism",
 			PostQuantum: true,
+			Deprecated:  true,
+			ReplacedBy:  "mlkem768",
 		},
 		{
 			Name:        "hybrid-kyber768-aes256gcm",
-			Description: "Hybrid Kyber-768 + AES-256-GCM - Post-quantum security with classical fallback",
+			Description: "Hybrid Kyber-768 + AES-256-GCM - Pre-standard post-quantum security with classical fallback",
 			PostQuantum: true,
+			Deprecated:  true,
+			ReplacedBy:  "hybrid-mlkem768-aes256gcm",
 		},
 	}
 }
 
+// LookupAlgorithm returns the classic or post-quantum algorithm with the given name
+func LookupAlgorithm(name string) (Algorithm, bool) {
+	for _, algo := range ListClassicAlgorithms() {
+		if algo.Name == name {
+			return algo, true
+		}
+	}
+	for _, algo := range ListPostQuantumAlgorithms() {
+		if algo.Name == name {
+			return algo, true
+		}
+	}
+	return Algorithm{}, false
+}
+
 // TestAlgorithm tests an encryption algorithm with the given data
 func TestAlgorithm(algorithm string, data []byte) (*TestResult, error) {
-	logger.Info("Testing encryption algorithm: %s", algorithm)
+	cryptoLog.Info("Testing encryption algorithm", "algorithm", algorithm)
 	result := &TestResult{
 		Algorithm: algorithm,
 	}
@@ -83,29 +134,35 @@ func TestAlgorithm(algorithm string, data []byte) (*TestResult, error) {
 	// Test the algorithm based on its type
 	switch algorithm {
 	case "aes256gcm":
-		logger.Debug("Testing AES-256-GCM algorithm")
+		cryptoLog.Debug("Testing AES-256-GCM algorithm")
 		return testAES256GCM(data, result)
 	case "chacha20poly1305":
-		logger.Debug("Testing ChaCha20-Poly1305 algorithm")
+		cryptoLog.Debug("Testing ChaCha20-Poly1305 algorithm")
 		return testChaCha20Poly1305(data, result)
 	case "kyber768":
-		logger.Debug("Testing Kyber-768 algorithm")
+		cryptoLog.Debug("Testing Kyber-768 algorithm")
 		return testKyber(kyber768.Scheme(), data, result)
 	case "kyber1024":
-		logger.Debug("Testing Kyber-1024 algorithm")
+		cryptoLog.Debug("Testing Kyber-1024 algorithm")
 		return testKyber(kyber1024.Scheme(), data, result)
 	case "hybrid-kyber768-aes256gcm":
-		logger.Debug("Testing Hybrid Kyber-768 + AES-256-GCM algorithm")
+		cryptoLog.Debug("Testing Hybrid Kyber-768 + AES-256-GCM algorithm")
 		return testHybridKyberAES(kyber768.Scheme(), data, result)
+	case "mlkem768":
+		cryptoLog.Debug("Testing ML-KEM-768 algorithm")
+		return testKyber(mlkem768.Scheme(), data, result)
+	case "hybrid-mlkem768-aes256gcm":
+		cryptoLog.Debug("Testing Hybrid ML-KEM-768 + AES-256-GCM algorithm")
+		return testHybridKyberAES(mlkem768.Scheme(), data, result)
 	default:
-		logger.Error("Unsupported algorithm: %s", algorithm)
+		cryptoLog.Error("Unsupported algorithm", "algorithm", algorithm)
 		return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
 	}
 }
 
 // SetDefaultAlgorithm sets the default encryption algorithm
 func SetDefaultAlgorithm(algorithm string, postQuantum bool) error {
-	logger.Info("Setting default encryption algorithm to %s (post-quantum: %t)", algorithm, postQuantum)
+	cryptoLog.Info("Setting default encryption algorithm", "algorithm", algorithm, "post_quantum", postQuantum)
 	// Validate algorithm
 	valid := false
 	if postQuantum {
@@ -144,7 +201,7 @@ func GetDefaultAlgorithm(postQuantum bool) string {
 	if postQuantum {
 		defaultAlgo := viper.GetString("crypto.default_post_quantum")
 		if defaultAlgo == "" {
-			return "kyber768" // Default post-quantum algorithm
+			return "mlkem768" // Default post-quantum algorithm
 		}
 		return defaultAlgo
 	} else {
@@ -162,26 +219,22 @@ func GetDefaultAlgorithm(postQuantum bool) string {
 func testAES256GCM(data []byte, result *TestResult) (*TestResult, error) {
 	// Generate key
 	startKeyGen := time.Now()
-	key := make([]byte, 32) // AES-256 uses a 32-byte key
-	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+	key := NewSecret(32) // AES-256 uses a 32-byte key
+	defer ReleaseSecret(key)
+	if err := readRandom(key); err != nil {
 		return nil, err
 	}
 	result.KeyGenTime = time.Since(startKeyGen)
 
 	// Create cipher
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	aead, err := cipher.NewGCM(block)
+	aead, err := NewAEAD("aes256gcm", key)
 	if err != nil {
 		return nil, err
 	}
 
 	// Generate nonce
 	nonce := make([]byte, aead.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	if err := readRandom(nonce); err != nil {
 		return nil, err
 	}
 
@@ -207,7 +260,7 @@ func testAES256GCM(data []byte, result *TestResult) (*TestResult, error) {
 		return result, nil
 	}
 
-	result.DecryptionSuccessful = string(plaintext) == string(data)
+	result.DecryptionSuccessful = ConstantTimeEqual(plaintext, data)
 	return result, nil
 }
 
@@ -215,21 +268,22 @@ func testAES256GCM(data []byte, result *TestResult) (*TestResult, error) {
 func testChaCha20Poly1305(data []byte, result *TestResult) (*TestResult, error) {
 	// Generate key
 	startKeyGen := time.Now()
-	key := make([]byte, chacha20poly1305.KeySize)
-	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+	key := NewSecret(chacha20poly1305.KeySize)
+	defer ReleaseSecret(key)
+	if err := readRandom(key); err != nil {
 		return nil, err
 	}
 	result.KeyGenTime = time.Since(startKeyGen)
 
 	// Create cipher
-	aead, err := chacha20poly1305.New(key)
+	aead, err := NewAEAD("chacha20poly1305", key)
 	if err != nil {
 		return nil, err
 	}
 
 	// Generate nonce
 	nonce := make([]byte, aead.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	if err := readRandom(nonce); err != nil {
 		return nil, err
 	}
 
@@ -255,7 +309,7 @@ func testChaCha20Poly1305(data []byte, result *TestResult) (*TestResult, error)
 		return result, nil
 	}
 
-	result.DecryptionSuccessful = string(plaintext) == string(data)
+	result.DecryptionSuccessful = ConstantTimeEqual(plaintext, data)
 	return result, nil
 }
 
@@ -263,6 +317,9 @@ func testChaCha20Poly1305(data []byte, result *TestResult) (*TestResult, error)
 func testKyber(scheme kem.Scheme, data []byte, result *TestResult) (*TestResult, error) {
 	// Generate key pair
 	startKeyGen := time.Now()
+	if err := rngStatus(); err != nil {
+		return nil, err
+	}
 	public, private, err := scheme.GenerateKeyPair()
 	if err != nil {
 		return nil, err
@@ -275,21 +332,17 @@ func testKyber(scheme kem.Scheme, data []byte, result *TestResult) (*TestResult,
 	if err != nil {
 		return nil, err
 	}
+	defer Zeroize(sharedSecret)
 	result.EncryptTime = time.Since(startEncrypt)
 
 	// Use shared secret to encrypt data with AES-GCM
-	block, err := aes.NewCipher(sharedSecret)
-	if err != nil {
-		return nil, err
-	}
-
-	aead, err := cipher.NewGCM(block)
+	aead, err := NewAEAD("aes256gcm", sharedSecret)
 	if err != nil {
 		return nil, err
 	}
 
 	nonce := make([]byte, aead.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	if err := readRandom(nonce); err != nil {
 		return nil, err
 	}
 
@@ -315,14 +368,10 @@ func testKyber(scheme kem.Scheme, data []byte, result *TestResult) (*TestResult,
 		result.DecryptionSuccessful = false
 		return result, nil
 	}
+	defer Zeroize(decapsulatedSecret)
 
 	// Use shared secret to decrypt data
-	block, err = aes.NewCipher(decapsulatedSecret)
-	if err != nil {
-		return nil, err
-	}
-
-	aead, err = cipher.NewGCM(block)
+	aead, err = NewAEAD("aes256gcm", decapsulatedSecret)
 	if err != nil {
 		return nil, err
 	}
@@ -341,7 +390,7 @@ func testKyber(scheme kem.Scheme, data []byte, result *TestResult) (*TestResult,
 		return result, nil
 	}
 
-	result.DecryptionSuccessful = string(plaintext) == string(data)
+	result.DecryptionSuccessful = ConstantTimeEqual(plaintext, data)
 	return result, nil
 }
 
@@ -349,14 +398,18 @@ func testKyber(scheme kem.Scheme, data []byte, result *TestResult) (*TestResult,
 func testHybridKyberAES(scheme kem.Scheme, data []byte, result *TestResult) (*TestResult, error) {
 	// Generate key pair for Kyber
 	startKeyGen := time.Now()
+	if err := rngStatus(); err != nil {
+		return nil, err
+	}
 	public, private, err := scheme.GenerateKeyPair()
 	if err != nil {
 		return nil, err
 	}
 
 	// Generate AES key
-	aesKey := make([]byte, 32) // AES-256
-	if _, err := io.ReadFull(rand.Reader, aesKey); err != nil {
+	aesKey := NewSecret(32) // AES-256
+	defer ReleaseSecret(aesKey)
+	if err := readRandom(aesKey); err != nil {
 		return nil, err
 	}
 	result.KeyGenTime = time.Since(startKeyGen)
@@ -367,25 +420,22 @@ func testHybridKyberAES(scheme kem.Scheme, data []byte, result *TestResult) (*Te
 	if err != nil {
 		return nil, err
 	}
+	defer Zeroize(sharedSecret)
 
 	// Combine Kyber shared secret with AES key
-	hybridKey := make([]byte, len(sharedSecret)+len(aesKey))
+	hybridKey := NewSecret(len(sharedSecret) + len(aesKey))
+	defer ReleaseSecret(hybridKey)
 	copy(hybridKey, sharedSecret)
 	copy(hybridKey[len(sharedSecret):], aesKey)
 
 	// Use hybrid key to encrypt data with AES-GCM
-	block, err := aes.NewCipher(hybridKey[:32]) // Use first 32 bytes for AES-256
-	if err != nil {
-		return nil, err
-	}
-
-	aead, err := cipher.NewGCM(block)
+	aead, err := NewAEAD("aes256gcm", hybridKey[:32]) // Use first 32 bytes for AES-256
 	if err != nil {
 		return nil, err
 	}
 
 	nonce := make([]byte, aead.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	if err := readRandom(nonce); err != nil {
 		return nil, err
 	}
 
@@ -394,18 +444,13 @@ func testHybridKyberAES(scheme kem.Scheme, data []byte, result *TestResult) (*Te
 
 	// Combine ciphertext, AES key (encrypted with Kyber shared secret), nonce, and encrypted data
 	// Encrypt AES key with Kyber shared secret
-	aesKeyBlock, err := aes.NewCipher(sharedSecret)
-	if err != nil {
-		return nil, err
-	}
-
-	aesKeyAead, err := cipher.NewGCM(aesKeyBlock)
+	aesKeyAead, err := NewAEAD("aes256gcm", sharedSecret)
 	if err != nil {
 		return nil, err
 	}
 
 	aesKeyNonce := make([]byte, aesKeyAead.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, aesKeyNonce); err != nil {
+	if err := readRandom(aesKeyNonce); err != nil {
 		return nil, err
 	}
 
@@ -431,14 +476,10 @@ func testHybridKyberAES(scheme kem.Scheme, data []byte, result *TestResult) (*Te
 		result.DecryptionSuccessful = false
 		return result, nil
 	}
+	defer Zeroize(decapsulatedSecret)
 
 	// Extract AES key nonce and encrypted AES key
-	aesKeyBlock, err = aes.NewCipher(decapsulatedSecret)
-	if err != nil {
-		return nil, err
-	}
-
-	aesKeyAead, err = cipher.NewGCM(aesKeyBlock)
+	aesKeyAead, err = NewAEAD("aes256gcm", decapsulatedSecret)
 	if err != nil {
 		return nil, err
 	}
@@ -464,19 +505,16 @@ func testHybridKyberAES(scheme kem.Scheme, data []byte, result *TestResult) (*Te
 		result.DecryptionSuccessful = false
 		return result, nil
 	}
+	defer Zeroize(decryptedAesKey)
 
 	// Combine Kyber shared secret with decrypted AES key
-	hybridKeyDecrypt := make([]byte, len(decapsulatedSecret)+len(decryptedAesKey))
+	hybridKeyDecrypt := NewSecret(len(decapsulatedSecret) + len(decryptedAesKey))
+	defer ReleaseSecret(hybridKeyDecrypt)
 	copy(hybridKeyDecrypt, decapsulatedSecret)
 	copy(hybridKeyDecrypt[len(decapsulatedSecret):], decryptedAesKey)
 
 	// Use hybrid key to decrypt data
-	blockDecrypt, err := aes.NewCipher(hybridKeyDecrypt[:32]) // Use first 32 bytes for AES-256
-	if err != nil {
-		return nil, err
-	}
-
-	aeadDecrypt, err := cipher.NewGCM(blockDecrypt)
+	aeadDecrypt, err := NewAEAD("aes256gcm", hybridKeyDecrypt[:32]) // Use first 32 bytes for AES-256
 	if err != nil {
 		return nil, err
 	}
@@ -495,6 +533,6 @@ func testHybridKyberAES(scheme kem.Scheme, data []byte, result *TestResult) (*Te
 		return result, nil
 	}
 
-	result.DecryptionSuccessful = string(plaintext) == string(data)
+	result.DecryptionSuccessful = ConstantTimeEqual(plaintext, data)
 	return result, nil
 }
\ No newline at end of file
@@ -1,7 +1,15 @@
 package crypto
 
 import (
+	"bytes"
+	"log/slog"
+	"os"
+	"strings"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/spf13/viper"
 )
 
 func TestListClassicAlgorithms(t *testing.T) {
@@ -153,4 +161,249 @@ func TestUnsupportedAlgorithm(t *testing.T) {
 	if err == nil {
 		t.Error("Expected error for unsupported algorithm, got nil")
 	}
-}
\ No newline at end of file
+}
+func TestMLKEM768(t *testing.T) {
+	// Test data
+	data := []byte("This is a test message for ML-KEM-768 post-quantum encryption")
+
+	// Test the algorithm
+	result, err := TestAlgorithm("mlkem768", data)
+	if err != nil {
+		t.Fatalf("Error testing ML-KEM-768: %v", err)
+	}
+
+	// Check the result
+	if !result.DecryptionSuccessful {
+		t.Error("Decryption was not successful")
+	}
+}
+
+func TestAuditAlgorithm(t *testing.T) {
+	// Recommended algorithm should produce no findings
+	if findings := AuditAlgorithm(RecommendedAlgorithm); len(findings) != 0 {
+		t.Errorf("Expected no findings for %s, got %v", RecommendedAlgorithm, findings)
+	}
+
+	// Deprecated algorithm should recommend its replacement
+	findings := AuditAlgorithm("kyber768")
+	if len(findings) != 1 || findings[0].Recommended != "mlkem768" {
+		t.Errorf("Expected deprecation finding for kyber768, got %v", findings)
+	}
+
+	// Classic algorithm should be flagged as not post-quantum
+	findings = AuditAlgorithm("aes256gcm")
+	if len(findings) != 1 || findings[0].Severity != SeverityWarning {
+		t.Errorf("Expected warning for aes256gcm, got %v", findings)
+	}
+
+	// Unknown algorithm should be critical
+	findings = AuditAlgorithm("rot13")
+	if len(findings) != 1 || findings[0].Severity != SeverityCritical {
+		t.Errorf("Expected critical finding for unknown algorithm, got %v", findings)
+	}
+}
+
+func TestEncryptDecryptFile(t *testing.T) {
+	dir := t.TempDir()
+	publicPEM, privatePEM, err := GenerateFileKeyPair(RecommendedAlgorithm)
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v", err)
+	}
+
+	// Encrypt and decrypt a single armored file
+	plain := filepath.Join(dir, "backup.yaml")
+	if err := os.WriteFile(plain, []byte("tunnels: {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptFile(plain, plain+".asc", publicPEM, true); err != nil {
+		t.Fatalf("Error encrypting file: %v", err)
+	}
+	if err := DecryptFile(plain+".asc", plain+".out", privatePEM); err != nil {
+		t.Fatalf("Error decrypting file: %v", err)
+	}
+	data, _ := os.ReadFile(plain + ".out")
+	if string(data) != "tunnels: {}\n" {
+		t.Errorf("Decrypted content mismatch: %q", data)
+	}
+
+	// Encrypt and decrypt a directory
+	src := filepath.Join(dir, "keys")
+	os.MkdirAll(filepath.Join(src, "sub"), 0700)
+	os.WriteFile(filepath.Join(src, "sub", "psk.key"), []byte("secret"), 0600)
+	if err := EncryptFile(src, src+".enc", publicPEM, false); err != nil {
+		t.Fatalf("Error encrypting directory: %v", err)
+	}
+	if err := DecryptFile(src+".enc", filepath.Join(dir, "restored"), privatePEM); err != nil {
+		t.Fatalf("Error decrypting directory: %v", err)
+	}
+	data, _ = os.ReadFile(filepath.Join(dir, "restored", "sub", "psk.key"))
+	if string(data) != "secret" {
+		t.Errorf("Restored content mismatch: %q", data)
+	}
+
+	// A different key must not decrypt the file
+	_, otherPEM, _ := GenerateFileKeyPair(RecommendedAlgorithm)
+	if err := DecryptFile(plain+".asc", plain+".bad", otherPEM); err == nil {
+		t.Error("Expected error decrypting with the wrong key")
+	}
+}
+
+func TestKnownAnswerTests(t *testing.T) {
+	results, err := RunKnownAnswerTests("")
+	if err != nil {
+		t.Fatalf("Error running known-answer tests: %v", err)
+	}
+
+	if len(results) == 0 {
+		t.Fatal("Expected known-answer test results, got none")
+	}
+
+	for _, r := range results {
+		if !r.Passed {
+			t.Errorf("%s %s (%s) failed: %s", r.Algorithm, r.Name, r.Source, r.Error)
+		}
+	}
+
+	if err := SelfTest(); err != nil {
+		t.Errorf("Self-test failed: %v", err)
+	}
+
+	if _, err := RunKnownAnswerTests("kyber768"); err == nil {
+		t.Error("Expected error for algorithm without vectors, got nil")
+	}
+}
+
+func TestSecretHandling(t *testing.T) {
+	secret := NewSecret(32)
+	copy(secret, "0123456789abcdef0123456789abcdef")
+
+	if !ConstantTimeEqual(secret, []byte("0123456789abcdef0123456789abcdef")) {
+		t.Error("Expected equal secrets to compare equal")
+	}
+	if ConstantTimeEqual(secret, []byte("0123456789abcdef")) {
+		t.Error("Expected secrets of different length to compare unequal")
+	}
+
+	ReleaseSecret(secret)
+	for i, b := range secret {
+		if b != 0 {
+			t.Fatalf("Expected secret to be zeroized, byte %d is %#x", i, b)
+		}
+	}
+}
+
+func TestCheckEntropy(t *testing.T) {
+	report, err := CheckEntropy()
+	if err != nil {
+		t.Fatalf("Entropy health check failed: %v", err)
+	}
+
+	if !report.PoolReady {
+		t.Error("Expected entropy pool to be ready")
+	}
+
+	if report.MaxRepetition >= repetitionCountCutoff || report.MaxProportion >= adaptiveProportionLimit {
+		t.Errorf("Unexpected health test results: %+v", report)
+	}
+}
+
+func TestResolveAlgorithm(t *testing.T) {
+	if got := ResolveAlgorithm("chacha20poly1305"); got != "chacha20poly1305" {
+		t.Errorf("Expected explicit algorithm to be unchanged, got %s", got)
+	}
+
+	resolved := ResolveAlgorithm(AutoAlgorithm)
+	if resolved != "aes256gcm" && resolved != "chacha20poly1305" {
+		t.Fatalf("Expected auto to resolve to a classic cipher, got %s", resolved)
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	report, err := Benchmark(5 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("Benchmark failed: %v", err)
+	}
+	if len(report.Results) != 2 {
+		t.Fatalf("Expected 2 benchmark results, got %d", len(report.Results))
+	}
+
+	// Cached results decide the auto setting
+	report.Results = []BenchResult{
+		{Algorithm: "aes256gcm", Throughput: 100},
+		{Algorithm: "chacha20poly1305", Throughput: 200},
+	}
+	if err := SaveBenchReport(report); err != nil {
+		t.Fatalf("Failed to save benchmark: %v", err)
+	}
+	if got := ResolveAlgorithm(AutoAlgorithm); got != "chacha20poly1305" {
+		t.Errorf("Expected auto to use the cached fastest cipher, got %s", got)
+	}
+}
+
+func TestKernelAEAD(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	nonce := make([]byte, 12)
+	additionalData := []byte("header")
+
+	for _, algorithm := range []string{"aes256gcm", "chacha20poly1305"} {
+		kernel, err := newKernelAEAD(algorithm, key)
+		if err != nil {
+			t.Skipf("Kernel crypto API not available: %v", err)
+		}
+		reference, _ := newGoAEAD(algorithm, key)
+
+		for _, size := range []int{0, 1400, 300 << 10} {
+			plaintext := make([]byte, size)
+			for i := range plaintext {
+				plaintext[i] = byte(i * 7)
+			}
+			sealed := kernel.Seal(nil, nonce, plaintext, additionalData)
+			if want := reference.Seal(nil, nonce, plaintext, additionalData); !ConstantTimeEqual(sealed, want) {
+				t.Fatalf("%s: kernel ciphertext of %d bytes differs from Go's", algorithm, size)
+			}
+			opened, err := kernel.Open(nil, nonce, sealed, additionalData)
+			if err != nil || !ConstantTimeEqual(opened, plaintext) {
+				t.Fatalf("%s: kernel failed to open %d bytes: %v", algorithm, size, err)
+			}
+		}
+
+		sealed := kernel.Seal(nil, nonce, []byte("payload"), additionalData)
+		sealed[0] ^= 1
+		if _, err := kernel.Open(nil, nonce, sealed, additionalData); err == nil {
+			t.Errorf("%s: expected a tampered ciphertext to be rejected", algorithm)
+		}
+	}
+}
+
+func TestNewAEADBackend(t *testing.T) {
+	defer viper.Set("crypto.backend", nil)
+
+	viper.Set("crypto.backend", "openssl")
+	if _, err := NewAEAD("aes256gcm", make([]byte, 32)); err == nil {
+		t.Error("Expected an unknown backend to be rejected")
+	}
+
+	viper.Set("crypto.backend", BackendGo)
+	if _, err := NewAEAD("mlkem768", make([]byte, 32)); err == nil {
+		t.Error("Expected a non-AEAD algorithm to be rejected")
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	defer SetLogger(cryptoLog)
+	var log bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&log, nil)))
+
+	if _, err := TestAlgorithm("aes256gcm", []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), `msg="Testing encryption algorithm" algorithm=aes256gcm`) {
+		t.Errorf("Expected the messages to go to the logger, got %q", log.String())
+	}
+}
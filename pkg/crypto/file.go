@@ -0,0 +1,439 @@
+package crypto
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudflare/circl/kem"
+	"github.com/cloudflare/circl/kem/hybrid"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+	"golang.org/x/crypto/hkdf"
+)
+
+// PEM block types used for armored keys and files
+const (
+	PublicKeyBlock     = "IPSEC-VPN PUBLIC KEY"
+	PrivateKeyBlock    = "IPSEC-VPN PRIVATE KEY"
+	EncryptedFileBlock = "IPSEC-VPN ENCRYPTED FILE"
+)
+
+// fileMagic identifies the binary encrypted file format
+const fileMagic = "IPSECVPN1"
+
+// fileFlagArchive marks an encrypted payload as a gzipped tar archive of a directory
+const fileFlagArchive byte = 1 << 0
+
+// fileKeyInfo is the HKDF info string used to derive file encryption keys
+var fileKeyInfo = []byte("ipsec-vpn file encryption")
+
+// fileScheme returns the KEM used to protect files for the given algorithm
+func fileScheme(algorithm string) (kem.Scheme, error) {
+	switch algorithm {
+	case "mlkem768":
+		return mlkem768.Scheme(), nil
+	case "hybrid-mlkem768-aes256gcm":
+		return hybrid.X25519MLKEM768(), nil
+	default:
+		return nil, fmt.Errorf("algorithm %s cannot be used for file encryption", algorithm)
+	}
+}
+
+// GenerateKEMKeyPair generates a raw key encapsulation key pair for the given algorithm
+func GenerateKEMKeyPair(algorithm string) (publicKey, privateKey []byte, err error) {
+	scheme, err := fileScheme(algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cryptoLog.Debug("Generating key pair", "algorithm", algorithm)
+	if err := rngStatus(); err != nil {
+		return nil, nil, err
+	}
+	public, private, err := scheme.GenerateKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publicKey, err = public.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	privateKey, err = private.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	return publicKey, privateKey, nil
+}
+
+// AlgorithmX25519 names Curve25519 key pairs, as used by WireGuard tunnels
+const AlgorithmX25519 = "x25519"
+
+// GenerateX25519KeyPair generates a raw Curve25519 key pair
+func GenerateX25519KeyPair() (publicKey, privateKey []byte, err error) {
+	cryptoLog.Debug("Generating key pair", "algorithm", AlgorithmX25519)
+	privateKey, err = GenerateSecret(32)
+	if err != nil {
+		return nil, nil, err
+	}
+	private, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private.PublicKey().Bytes(), privateKey, nil
+}
+
+// AlgorithmEd25519 names Ed25519 key pairs, which sign through the key agent
+const AlgorithmEd25519 = "ed25519"
+
+// GenerateEd25519KeyPair generates an Ed25519 key pair, the private key as its
+// seed
+func GenerateEd25519KeyPair() (publicKey, privateKey []byte, err error) {
+	cryptoLog.Debug("Generating key pair", "algorithm", AlgorithmEd25519)
+	seed, err := GenerateSecret(ed25519.SeedSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	private := ed25519.NewKeyFromSeed(seed)
+	defer Zeroize(private)
+	return append([]byte(nil), private.Public().(ed25519.PublicKey)...), seed, nil
+}
+
+// DecapsulateKEM recovers the shared secret from a key encapsulation ciphertext
+func DecapsulateKEM(algorithm string, privateKey, ciphertext []byte) ([]byte, error) {
+	scheme, err := fileScheme(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	private, err := scheme.UnmarshalBinaryPrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	if len(ciphertext) != scheme.CiphertextSize() {
+		return nil, fmt.Errorf("invalid ciphertext size: %d", len(ciphertext))
+	}
+	return scheme.Decapsulate(private, ciphertext)
+}
+
+// GenerateFileKeyPair generates a PEM-armored recipient key pair for file encryption
+func GenerateFileKeyPair(algorithm string) (publicPEM, privatePEM []byte, err error) {
+	publicBytes, privateBytes, err := GenerateKEMKeyPair(algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer Zeroize(privateBytes)
+
+	headers := map[string]string{"Algorithm": algorithm}
+	privatePEM = pem.EncodeToMemory(&pem.Block{Type: PrivateKeyBlock, Headers: headers, Bytes: privateBytes})
+	return PublicKeyPEM(algorithm, publicBytes), privatePEM, nil
+}
+
+// PublicKeyPEM encodes the public key of a key pair of the algorithm as a
+// recipient key for EncryptFile, such as that of a stored key pair
+func PublicKeyPEM(algorithm string, publicKey []byte) []byte {
+	headers := map[string]string{"Algorithm": algorithm}
+	return pem.EncodeToMemory(&pem.Block{Type: PublicKeyBlock, Headers: headers, Bytes: publicKey})
+}
+
+// EncryptFile encrypts a file or directory for the holder of the given public key.
+// Directories are archived before encryption. If armor is set, the output is PEM encoded.
+func EncryptFile(inPath, outPath string, publicPEM []byte, armor bool) error {
+	algorithm, keyBytes, err := decodeKey(publicPEM, PublicKeyBlock)
+	if err != nil {
+		return err
+	}
+	scheme, err := fileScheme(algorithm)
+	if err != nil {
+		return err
+	}
+	public, err := scheme.UnmarshalBinaryPublicKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+
+	info, err := os.Stat(inPath)
+	if err != nil {
+		return err
+	}
+
+	var flags byte
+	var plaintext []byte
+	if info.IsDir() {
+		cryptoLog.Debug("Archiving directory for encryption", "path", inPath)
+		flags |= fileFlagArchive
+		plaintext, err = ArchiveDir(inPath)
+	} else {
+		plaintext, err = os.ReadFile(inPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Encapsulate a fresh shared secret for the recipient
+	if err := rngStatus(); err != nil {
+		return err
+	}
+	kemCiphertext, sharedSecret, err := scheme.Encapsulate(public)
+	if err != nil {
+		return err
+	}
+	defer Zeroize(sharedSecret)
+
+	aead, err := fileAEAD(sharedSecret)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if err := readRandom(nonce); err != nil {
+		return err
+	}
+
+	// The header is authenticated as additional data
+	header := make([]byte, 0, len(fileMagic)+2+len(algorithm)+len(kemCiphertext))
+	header = append(header, fileMagic...)
+	header = append(header, flags, byte(len(algorithm)))
+	header = append(header, algorithm...)
+	header = append(header, kemCiphertext...)
+
+	out := append(header, nonce...)
+	out = aead.Seal(out, nonce, plaintext, header)
+
+	if armor {
+		out = pem.EncodeToMemory(&pem.Block{Type: EncryptedFileBlock, Bytes: out})
+	}
+
+	cryptoLog.Info("Encrypting", "path", inPath, "out", outPath, "algorithm", algorithm)
+	return os.WriteFile(outPath, out, 0600)
+}
+
+// DecryptFile decrypts a file produced by EncryptFile using the given private key.
+// Encrypted directories are extracted into outPath.
+func DecryptFile(inPath, outPath string, privatePEM []byte) error {
+	algorithm, keyBytes, err := decodeKey(privatePEM, PrivateKeyBlock)
+	if err != nil {
+		return err
+	}
+	defer Zeroize(keyBytes)
+	scheme, err := fileScheme(algorithm)
+	if err != nil {
+		return err
+	}
+	private, err := scheme.UnmarshalBinaryPrivateKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %v", err)
+	}
+	return DecryptFileWith(inPath, outPath, algorithm, func(ciphertext []byte) ([]byte, error) {
+		return scheme.Decapsulate(private, ciphertext)
+	})
+}
+
+// DecryptFileWith decrypts a file produced by EncryptFile for a key pair of
+// the algorithm, whose private key decapsulate uses, such as through the key
+// agent
+func DecryptFileWith(inPath, outPath, algorithm string, decapsulate func(ciphertext []byte) ([]byte, error)) error {
+	scheme, err := fileScheme(algorithm)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(inPath)
+	if err != nil {
+		return err
+	}
+
+	// Accept both armored and binary input
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != EncryptedFileBlock {
+			return fmt.Errorf("unexpected PEM block type: %s", block.Type)
+		}
+		data = block.Bytes
+	}
+
+	if len(data) < len(fileMagic)+2 || string(data[:len(fileMagic)]) != fileMagic {
+		return errors.New("not an ipsec-vpn encrypted file")
+	}
+	flags := data[len(fileMagic)]
+	nameLen := int(data[len(fileMagic)+1])
+	offset := len(fileMagic) + 2
+
+	if len(data) < offset+nameLen {
+		return errors.New("encrypted file too short")
+	}
+	fileAlgorithm := string(data[offset : offset+nameLen])
+	offset += nameLen
+	if fileAlgorithm != algorithm {
+		return fmt.Errorf("file was encrypted with %s but the key is for %s", fileAlgorithm, algorithm)
+	}
+
+	if len(data) < offset+scheme.CiphertextSize() {
+		return errors.New("encrypted file too short")
+	}
+	kemCiphertext := data[offset : offset+scheme.CiphertextSize()]
+	offset += scheme.CiphertextSize()
+	header := data[:offset]
+
+	sharedSecret, err := decapsulate(kemCiphertext)
+	if err != nil {
+		return err
+	}
+	defer Zeroize(sharedSecret)
+
+	aead, err := fileAEAD(sharedSecret)
+	if err != nil {
+		return err
+	}
+
+	if len(data) < offset+aead.NonceSize() {
+		return errors.New("encrypted file too short")
+	}
+	nonce := data[offset : offset+aead.NonceSize()]
+	offset += aead.NonceSize()
+
+	plaintext, err := aead.Open(nil, nonce, data[offset:], header)
+	if err != nil {
+		return errors.New("decryption failed: wrong key or corrupted file")
+	}
+
+	cryptoLog.Info("Decrypting", "path", inPath, "out", outPath)
+	if flags&fileFlagArchive != 0 {
+		return ExtractDir(plaintext, outPath)
+	}
+	return os.WriteFile(outPath, plaintext, 0600)
+}
+
+// decodeKey decodes a PEM-armored key of the expected type and returns its algorithm
+func decodeKey(data []byte, blockType string) (string, []byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return "", nil, fmt.Errorf("expected a PEM encoded %s", strings.ToLower(blockType))
+	}
+
+	algorithm := block.Headers["Algorithm"]
+	if algorithm == "" {
+		return "", nil, errors.New("key is missing the Algorithm header")
+	}
+
+	return algorithm, block.Bytes, nil
+}
+
+// fileAEAD derives an AES-256-GCM cipher from a KEM shared secret
+func fileAEAD(sharedSecret []byte) (cipher.AEAD, error) {
+	key := NewSecret(32)
+	defer ReleaseSecret(key)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, nil, fileKeyInfo), key); err != nil {
+		return nil, err
+	}
+
+	return NewAEAD("aes256gcm", key)
+}
+
+// ArchiveDir packs a directory into a gzipped tar archive
+func ArchiveDir(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ExtractDir unpacks a gzipped tar archive created by ArchiveDir into dir
+func ExtractDir(data []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Refuse entries that would escape the target directory
+		target := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid archive entry: %s", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		default:
+			cryptoLog.Debug("Skipping archive entry of unsupported type", "entry", hdr.Name)
+		}
+	}
+}
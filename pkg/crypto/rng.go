@@ -0,0 +1,188 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+)
+
+// ErrRNGFailure is returned by key generation once the random number generator has failed a health check
+var ErrRNGFailure = errors.New("random number generator failed health check, refusing to generate keys")
+
+// Health test parameters, loosely following NIST SP 800-90B section 4.4 for
+// 8 bits of entropy per byte with a false positive rate below 2^-30
+const (
+	entropySampleSize       = 1024
+	repetitionCountCutoff   = 6
+	adaptiveWindowSize      = 512
+	adaptiveProportionLimit = 20
+)
+
+var (
+	rngMu     sync.Mutex
+	rngFailed error
+	rngLast   [sha256.Size]byte
+)
+
+// EntropyReport holds the results of an entropy health check
+type EntropyReport struct {
+	Source        string
+	PoolReady     bool
+	EntropyAvail  int
+	SampleSize    int
+	MaxRepetition int
+	MaxProportion int
+	Error         string
+}
+
+// CheckEntropy runs health tests on the system random number generator. A failing
+// check latches the generator as failed so that subsequent key generation is refused.
+func CheckEntropy() (*EntropyReport, error) {
+	report := &EntropyReport{
+		Source:       "getrandom(2)",
+		EntropyAvail: -1,
+		SampleSize:   entropySampleSize,
+	}
+
+	// Informational only; modern kernels always report 256 once the pool is initialized
+	if data, err := os.ReadFile("/proc/sys/kernel/random/entropy_avail"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			report.EntropyAvail = n
+		}
+	}
+
+	err := checkEntropy(report)
+	if err != nil {
+		report.Error = err.Error()
+		latchRNGFailure(err)
+		return report, err
+	}
+
+	cryptoLog.Debug("Entropy health check passed", "max_repetition", report.MaxRepetition,
+		"max_proportion", fmt.Sprintf("%d/%d", report.MaxProportion, adaptiveWindowSize))
+	return report, nil
+}
+
+// checkEntropy fills in the report and returns an error if any health test fails
+func checkEntropy(report *EntropyReport) error {
+	sample := make([]byte, entropySampleSize)
+
+	if viper.GetBool("crypto.rng_nonblocking") {
+		// Fail instead of waiting if the kernel pool has not been initialized yet
+		n, err := unix.Getrandom(sample, unix.GRND_NONBLOCK)
+		if err == unix.EAGAIN {
+			return errors.New("kernel entropy pool is not initialized yet")
+		}
+		if err != nil {
+			return fmt.Errorf("getrandom failed: %v", err)
+		}
+		if n != len(sample) {
+			return fmt.Errorf("getrandom returned %d of %d bytes", n, len(sample))
+		}
+	} else if _, err := io.ReadFull(rand.Reader, sample); err != nil {
+		return fmt.Errorf("failed to read from random number generator: %v", err)
+	}
+	report.PoolReady = true
+
+	// Repetition count test: no byte may repeat too many times in a row
+	run := 1
+	report.MaxRepetition = 1
+	for i := 1; i < len(sample); i++ {
+		if sample[i] == sample[i-1] {
+			run++
+			if run > report.MaxRepetition {
+				report.MaxRepetition = run
+			}
+		} else {
+			run = 1
+		}
+	}
+	if report.MaxRepetition >= repetitionCountCutoff {
+		return fmt.Errorf("repetition count test failed: byte repeated %d times", report.MaxRepetition)
+	}
+
+	// Adaptive proportion test: no byte value may dominate a window
+	for start := 0; start+adaptiveWindowSize <= len(sample); start += adaptiveWindowSize {
+		var counts [256]int
+		for _, b := range sample[start : start+adaptiveWindowSize] {
+			counts[b]++
+			if counts[b] > report.MaxProportion {
+				report.MaxProportion = counts[b]
+			}
+		}
+	}
+	if report.MaxProportion >= adaptiveProportionLimit {
+		return fmt.Errorf("adaptive proportion test failed: byte value seen %d times in %d bytes",
+			report.MaxProportion, adaptiveWindowSize)
+	}
+
+	return nil
+}
+
+// latchRNGFailure marks the random number generator as failed for the rest of the process
+func latchRNGFailure(err error) {
+	rngMu.Lock()
+	defer rngMu.Unlock()
+	if rngFailed == nil {
+		cryptoLog.Error("Random number generator failed health check", "err", err)
+		rngFailed = err
+	}
+}
+
+// rngStatus returns ErrRNGFailure if the random number generator has failed a health check
+func rngStatus() error {
+	rngMu.Lock()
+	defer rngMu.Unlock()
+	if rngFailed != nil {
+		return fmt.Errorf("%w: %v", ErrRNGFailure, rngFailed)
+	}
+	return nil
+}
+
+// RNGStatus returns the failed health check of the random number generator, if any
+func RNGStatus() error {
+	return rngStatus()
+}
+
+// readRandom fills b from the system random number generator, applying a continuous
+// test that rejects output identical to the previous block. Only a digest of the
+// previous block is retained so that no copy of key material is kept.
+func readRandom(b []byte) error {
+	if err := rngStatus(); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		latchRNGFailure(err)
+		return fmt.Errorf("%w: %v", ErrRNGFailure, err)
+	}
+
+	// Blocks shorter than 8 bytes repeat by chance too often to be tested
+	if len(b) < 8 {
+		return nil
+	}
+
+	digest := sha256.Sum256(b)
+	rngMu.Lock()
+	repeated := digest == rngLast
+	rngLast = digest
+	rngMu.Unlock()
+
+	if repeated || bytes.Count(b, b[:1]) == len(b) {
+		err := errors.New("continuous test failed: generator produced repeated output")
+		latchRNGFailure(err)
+		return fmt.Errorf("%w: %v", ErrRNGFailure, err)
+	}
+
+	return nil
+}
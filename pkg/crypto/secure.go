@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"runtime"
+
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+)
+
+// Zeroize overwrites a secret with zeros once it is no longer needed
+func Zeroize(b []byte) {
+	clear(b)
+	runtime.KeepAlive(b)
+}
+
+// ConstantTimeEqual reports whether two byte slices are equal without leaking timing information
+func ConstantTimeEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// NewSecret allocates a buffer for key material. If crypto.mlock_keys is set, the
+// buffer is locked into memory so that it is never written to swap.
+func NewSecret(size int) []byte {
+	b := make([]byte, size)
+	if size > 0 && viper.GetBool("crypto.mlock_keys") {
+		if err := unix.Mlock(b); err != nil {
+			// Locking is best effort; it fails without CAP_IPC_LOCK or when RLIMIT_MEMLOCK is exhausted
+			cryptoLog.Debug("Failed to lock key buffer into memory", "err", err)
+		}
+	}
+	return b
+}
+
+// GenerateSecret returns a new random secret, such as a pre-shared key, of the given size
+func GenerateSecret(size int) ([]byte, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid secret size: %d", size)
+	}
+
+	secret := make([]byte, size)
+	if err := readRandom(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// ReleaseSecret zeroizes a buffer allocated by NewSecret and unlocks it
+func ReleaseSecret(b []byte) {
+	Zeroize(b)
+	if len(b) > 0 && viper.GetBool("crypto.mlock_keys") {
+		_ = unix.Munlock(b)
+	}
+}
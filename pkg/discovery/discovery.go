@@ -0,0 +1,189 @@
+// Package discovery finds the hubs spokes connect to, and the parameters of
+// their tunnels, so that a fleet of spokes is brought up without hardcoding
+// the hubs' addresses: from the _ipsecvpn._udp SRV and TXT records of the
+// spokes' domain. In a lab, instances also find each other on the local
+// network over mDNS, and pair by exchanging WireGuard keys.
+package discovery
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/viper"
+)
+
+// Service and Proto name the SRV records of hubs, _ipsecvpn._udp.<domain>
+const (
+	Service = "ipsecvpn"
+	Proto   = "udp"
+)
+
+// TXTVersion starts the TXT records holding the parameters of hubs, so that
+// other TXT records of the same names are told apart
+const TXTVersion = "v=ipsecvpn1"
+
+// Parameters hubs announce in their TXT records, as key=value
+const (
+	ParamName       = "name"       // Name of the tunnel to the hub, the first label of its host name by default
+	ParamSubnet     = "subnet"     // Subnet behind the hub, the remote subnet of the tunnel
+	ParamMode       = "mode"       // ipsec or wireguard
+	ParamEncryption = "encryption" // Cipher, tunnel_defaults.encryption by default
+	ParamPQ         = "pq"         // Post-quantum key exchange, true or false
+	ParamWGKey      = "wg-key"     // The hub's WireGuard public key
+	ParamPeerGroup  = "peer-group" // Peer group the tunnel joins
+	ParamPSKRef     = "psk-ref"    // Where the pre-shared key is kept, never the key itself
+	ParamPair       = "pair"       // Instance an instance on the local network is pairing with
+)
+
+// Params lists the parameters hubs announce
+var Params = []string{ParamName, ParamSubnet, ParamMode, ParamEncryption, ParamPQ, ParamWGKey, ParamPeerGroup, ParamPSKRef, ParamPair}
+
+// Sources hubs are discovered from
+const (
+	SourceDNS  = "dns"
+	SourceMDNS = "mdns" // Instances announced on the local network
+)
+
+// ErrNoHubs is returned when a domain announces no hubs
+var ErrNoHubs = errors.New("no hubs found")
+
+// Hub is a hub discovered, with the parameters spokes create their tunnel to
+// it with
+type Hub struct {
+	Name     string            `json:"name"`
+	Target   string            `json:"target"` // Host name of the hub
+	Address  string            `json:"address"`
+	Port     int               `json:"port"`
+	Priority int               `json:"priority"` // Lower is preferred
+	Weight   int               `json:"weight"`   // Share among hubs of the same priority
+	Params   map[string]string `json:"params,omitempty"`
+	Source   string            `json:"source"`
+}
+
+// Local is the end of the spokes' tunnels to the hubs
+type Local struct {
+	IP     string
+	Subnet string
+}
+
+// DefaultDomain returns the domain hubs are looked up in: discovery.domain,
+// or else the domain of the host's name
+func DefaultDomain() string {
+	if domain := viper.GetString("discovery.domain"); domain != "" {
+		return domain
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	_, domain, _ := strings.Cut(host, ".")
+	return domain
+}
+
+// DefaultLocal returns the end of the spokes' tunnels set in
+// discovery.local_ip and discovery.local_subnet
+func DefaultLocal() Local {
+	return Local{IP: viper.GetString("discovery.local_ip"), Subnet: viper.GetString("discovery.local_subnet")}
+}
+
+// parseTXT reads the parameters of the TXT records that start with
+// TXTVersion, in order, a later one overriding an earlier one. Fields are
+// separated by spaces; fields without '=' and unknown keys are left out, so
+// that hubs may announce parameters newer spokes understand.
+func parseTXT(records []string) map[string]string {
+	var params map[string]string
+	for _, record := range records {
+		fields := strings.Fields(record)
+		if len(fields) == 0 || fields[0] != TXTVersion {
+			continue
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		for _, field := range fields[1:] {
+			if key, value, ok := strings.Cut(field, "="); ok && slices.Contains(Params, key) {
+				params[key] = value
+			}
+		}
+	}
+	return params
+}
+
+// hubName returns the name of the tunnel to a hub: its name parameter, or
+// else the first label of its host name
+func hubName(target string, params map[string]string) string {
+	if name := params[ParamName]; name != "" {
+		return name
+	}
+	label, _, _ := strings.Cut(strings.TrimSuffix(target, "."), ".")
+	return strings.ToLower(label)
+}
+
+// preferAddress picks the address of a hub of the same family as the local
+// end, or an IPv4 one if the local end is not known
+func preferAddress(addrs []net.IP, local string) net.IP {
+	v4 := true
+	if ip := net.ParseIP(local); ip != nil {
+		v4 = ip.To4() != nil
+	}
+	for _, ip := range addrs {
+		if (ip.To4() != nil) == v4 {
+			return ip
+		}
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// sortHubs orders hubs by priority, then by weight, heaviest first, then by
+// name, so that the preferred hubs come first
+func sortHubs(hubs []Hub) {
+	slices.SortStableFunc(hubs, func(a, b Hub) int {
+		return cmp.Or(cmp.Compare(a.Priority, b.Priority), cmp.Compare(b.Weight, a.Weight), cmp.Compare(a.Name, b.Name))
+	})
+}
+
+// Spec returns the tunnel a spoke creates to a hub, from the hub's parameters
+// and the local end. The tunnel's other options, such as its cipher, fall back
+// to tunnel_defaults like those of 'tunnel apply'.
+func (h Hub) Spec(local Local) (tunnel.Spec, error) {
+	if local.IP == "" || local.Subnet == "" {
+		return tunnel.Spec{}, errors.New("local IP and subnet are needed to create tunnels to hubs")
+	}
+	subnet := h.Params[ParamSubnet]
+	if subnet == "" {
+		return tunnel.Spec{}, fmt.Errorf("hub %s announces no subnet", h.Target)
+	}
+	spec := tunnel.Spec{
+		Name:             h.Name,
+		Mode:             h.Params[ParamMode],
+		LocalIP:          local.IP,
+		RemoteIP:         h.Address,
+		LocalSubnet:      local.Subnet,
+		RemoteSubnet:     subnet,
+		Encryption:       h.Params[ParamEncryption],
+		WireGuardPeerKey: h.Params[ParamWGKey],
+		PeerGroup:        h.Params[ParamPeerGroup],
+		PSKRef:           h.Params[ParamPSKRef],
+	}
+	if pq, ok := h.Params[ParamPQ]; ok {
+		enabled, err := strconv.ParseBool(pq)
+		if err != nil {
+			return tunnel.Spec{}, fmt.Errorf("hub %s announces invalid %s %q", h.Target, ParamPQ, pq)
+		}
+		spec.PostQuantum = &enabled
+	}
+	if spec.Mode == tunnel.ModeWireGuard {
+		spec.ListenPort = h.Port
+	}
+	return spec, nil
+}
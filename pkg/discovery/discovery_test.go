@@ -0,0 +1,138 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/viper"
+)
+
+// fakeResolver answers lookups from records, and with not found for names it
+// has none of
+type fakeResolver struct {
+	srv map[string][]*net.SRV
+	txt map[string][]string
+	ip  map[string][]net.IP
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	cname := "_" + service + "._" + proto + "." + name
+	records, ok := r.srv[cname]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	return cname, records, nil
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r.txt[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func (r *fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	addrs, ok := r.ip[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestLookupDNS(t *testing.T) {
+	viper.Set("retry.dns.attempts", 1)
+	t.Cleanup(viper.Reset)
+
+	r := &fakeResolver{
+		srv: map[string][]*net.SRV{"_ipsecvpn._udp.branches.example.com": {
+			{Target: "hub2.example.com.", Port: 500, Priority: 20, Weight: 10},
+			{Target: "hub1.example.com.", Port: 500, Priority: 10, Weight: 10},
+			{Target: "hub3.example.com.", Port: 500, Priority: 10, Weight: 90},
+			{Target: "gone.example.com.", Port: 500, Priority: 0, Weight: 0},
+		}},
+		txt: map[string][]string{
+			"_ipsecvpn._udp.branches.example.com": {"v=spf1 -all", TXTVersion + " subnet=10.0.0.0/16 pq=true color=blue"},
+			"hub3.example.com":                    {TXTVersion + " name=hub-fra subnet=10.1.0.0/16"},
+		},
+		ip: map[string][]net.IP{
+			"hub1.example.com": {net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")},
+			"hub2.example.com": {net.ParseIP("192.0.2.2")},
+			"hub3.example.com": {net.ParseIP("192.0.2.3")},
+		},
+	}
+	hubs, err := LookupDNS(context.Background(), r, "branches.example.com.", Local{})
+	if err != nil {
+		t.Fatalf("LookupDNS failed: %v", err)
+	}
+
+	// Preferred first, without the hub that does not resolve
+	want := []struct{ name, address, subnet string }{
+		{"hub-fra", "192.0.2.3", "10.1.0.0/16"},
+		{"hub1", "192.0.2.1", "10.0.0.0/16"},
+		{"hub2", "192.0.2.2", "10.0.0.0/16"},
+	}
+	if len(hubs) != len(want) {
+		t.Fatalf("Expected %d hubs, got %+v", len(want), hubs)
+	}
+	for i, w := range want {
+		h := hubs[i]
+		if h.Name != w.name || h.Address != w.address || h.Params[ParamSubnet] != w.subnet || h.Params[ParamPQ] != "true" {
+			t.Errorf("Expected hub %d to be %s at %s with subnet %s, got %+v", i, w.name, w.address, w.subnet, h)
+		}
+		if _, ok := h.Params["color"]; ok {
+			t.Errorf("Expected unknown parameters to be left out, got %v", h.Params)
+		}
+	}
+
+	// An IPv6 local end prefers the hub's IPv6 address
+	if hubs, err := LookupDNS(context.Background(), r, "branches.example.com", Local{IP: "2001:db8:1::7"}); err != nil || hubs[1].Address != "2001:db8::1" {
+		t.Errorf("Expected hub1 at 2001:db8::1, got %v: %v", hubs, err)
+	}
+
+	for _, tt := range []struct {
+		desc   string
+		domain string
+		srv    []*net.SRV
+	}{
+		{"no SRV records", "example.org", nil},
+		{"the service decidedly not available", "example.net", []*net.SRV{{Target: "."}}},
+	} {
+		if tt.srv != nil {
+			r.srv["_ipsecvpn._udp."+tt.domain] = tt.srv
+		}
+		if _, err := LookupDNS(context.Background(), r, tt.domain, Local{}); !errors.Is(err, ErrNoHubs) {
+			t.Errorf("Expected no hubs with %s, got %v", tt.desc, err)
+		}
+	}
+}
+
+func TestHubSpec(t *testing.T) {
+	local := Local{IP: "198.51.100.7", Subnet: "10.130.7.0/24"}
+	hub := Hub{Name: "hub1", Target: "hub1.example.com", Address: "192.0.2.1", Port: 51820,
+		Params: map[string]string{ParamSubnet: "10.0.0.0/16", ParamMode: tunnel.ModeWireGuard, ParamWGKey: "key", ParamPQ: "false"}}
+	spec, err := hub.Spec(local)
+	if err != nil {
+		t.Fatalf("Spec failed: %v", err)
+	}
+	if spec.Name != "hub1" || spec.LocalIP != local.IP || spec.RemoteIP != "192.0.2.1" || spec.LocalSubnet != local.Subnet ||
+		spec.RemoteSubnet != "10.0.0.0/16" || spec.WireGuardPeerKey != "key" || spec.ListenPort != 51820 ||
+		spec.PostQuantum == nil || *spec.PostQuantum {
+		t.Errorf("Expected a wireguard tunnel to hub1 on port 51820, got %+v", spec)
+	}
+
+	if _, err := hub.Spec(Local{}); err == nil {
+		t.Error("Expected a spec without a local end to fail")
+	}
+	hub.Params[ParamPQ] = "maybe"
+	if _, err := hub.Spec(local); err == nil {
+		t.Error("Expected an invalid pq parameter to fail")
+	}
+	delete(hub.Params, ParamSubnet)
+	if _, err := hub.Spec(local); err == nil {
+		t.Error("Expected a hub announcing no subnet to fail")
+	}
+}
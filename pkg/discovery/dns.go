@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/retry"
+)
+
+// Resolver looks up the records hubs are discovered from; net.DefaultResolver
+// is one
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// LookupDNS discovers the hubs of a domain from its _ipsecvpn._udp SRV records,
+// preferred hubs first. Their parameters come from the TXT records of
+// _ipsecvpn._udp.<domain>, shared by every hub, overridden by those of each
+// hub's host name. A DNS server that fails to answer is asked again under
+// retry.dns; a hub whose name does not resolve is left out.
+func LookupDNS(ctx context.Context, r Resolver, domain string, local Local) ([]Hub, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return nil, errors.New("no domain to discover hubs in, set discovery.domain")
+	}
+	name := fmt.Sprintf("_%s._%s.%s", Service, Proto, domain)
+
+	var records []*net.SRV
+	err := retry.Do(ctx, retry.DNS, retry.Temporary, func() error {
+		var err error
+		_, records, err = r.LookupSRV(ctx, Service, Proto, domain)
+		return err
+	})
+	if notFound(err) || (len(records) == 1 && records[0].Target == ".") {
+		// A single target of "." means the service is decidedly not available
+		return nil, fmt.Errorf("%w: %s has no SRV records", ErrNoHubs, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %w", name, err)
+	}
+	shared, err := lookupParams(ctx, r, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var hubs []Hub
+	for _, srv := range records {
+		target := strings.TrimSuffix(srv.Target, ".")
+		params, err := lookupParams(ctx, r, target)
+		if err != nil {
+			return nil, err
+		}
+		merged := maps.Clone(shared)
+		if merged == nil {
+			merged = make(map[string]string)
+		}
+		maps.Copy(merged, params)
+
+		var addrs []net.IP
+		err = retry.Do(ctx, retry.DNS, retry.Temporary, func() error {
+			var err error
+			addrs, err = r.LookupIP(ctx, "ip", target)
+			return err
+		})
+		address := preferAddress(addrs, local.IP)
+		if err != nil || address == nil {
+			logger.Network.Info("Leaving out hub %s of %s, its address does not resolve: %v", target, domain, err)
+			continue
+		}
+		hubs = append(hubs, Hub{
+			Name:     hubName(target, merged),
+			Target:   target,
+			Address:  address.String(),
+			Port:     int(srv.Port),
+			Priority: int(srv.Priority),
+			Weight:   int(srv.Weight),
+			Params:   merged,
+			Source:   SourceDNS,
+		})
+	}
+	if len(hubs) == 0 {
+		return nil, fmt.Errorf("%w: none of the hubs of %s resolves", ErrNoHubs, name)
+	}
+	sortHubs(hubs)
+	logger.Network.Debug("Discovered %d hubs in %s", len(hubs), domain)
+	return hubs, nil
+}
+
+// lookupParams reads the parameters in the TXT records of a name, none if it
+// has none
+func lookupParams(ctx context.Context, r Resolver, name string) (map[string]string, error) {
+	var records []string
+	err := retry.Do(ctx, retry.DNS, retry.Temporary, func() error {
+		var err error
+		records, err = r.LookupTXT(ctx, name)
+		return err
+	})
+	if notFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up TXT records of %s: %w", name, err)
+	}
+	return parseTXT(records), nil
+}
+
+// notFound reports whether a lookup failed because the name has no records
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
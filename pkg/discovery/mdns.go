@@ -0,0 +1,488 @@
+package discovery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+)
+
+// mDNS, as RFC 6762 and DNS-SD, RFC 6763, describe them. Instances of
+// ipsec-vpn on a local network announce themselves as <name>._ipsecvpn._udp.local
+// with the same TXT parameters as hubs in DNS, so that avahi-browse and
+// dns-sd list them too.
+const (
+	mdnsPort = 5353
+	mdnsTTL  = 120 // Seconds, as RFC 6762 recommends for records with host names
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN     = 1
+	dnsCacheFlush  = 1 << 15 // In the class of a unique record
+	dnsUnicastResp = 1 << 15 // In the class of a question, the QU bit
+
+	dnsFlagResponse      = 1 << 15
+	dnsFlagAuthoritative = 1 << 10
+)
+
+// mdnsGroup is the IPv4 mDNS group
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// serviceName is the DNS-SD service instances of ipsec-vpn announce on the
+// local network
+var serviceName = fmt.Sprintf("_%s._%s.local", Service, Proto)
+
+// Announcement is what an instance announces of itself on the local network:
+// its name, the port its tunnels listen on and its parameters
+type Announcement struct {
+	Name    string
+	Address string // IPv4 address of the instance, left out if empty
+	Port    int
+	Params  map[string]string
+}
+
+// instanceName returns the DNS-SD instance name of an announcement
+func (a Announcement) instanceName() string {
+	return a.Name + "." + serviceName
+}
+
+// hostName returns the host name in the SRV record of an announcement
+func (a Announcement) hostName() string {
+	return a.Name + ".local"
+}
+
+// LAN announces an instance on the local network over mDNS, answering the
+// queries of others, and records the instances others announce
+type LAN struct {
+	conn *net.UDPConn
+	self Announcement
+
+	mu    sync.Mutex
+	peers map[string]Hub // By lower-case name
+}
+
+// ListenLAN joins the mDNS group on an interface, or the one the system picks
+// if iface is empty, to announce self. Its name must be a single DNS label.
+func ListenLAN(iface string, self Announcement) (*LAN, error) {
+	if self.Name == "" || strings.ContainsAny(self.Name, ". ") || len(self.Name) > 63 {
+		return nil, fmt.Errorf("invalid instance name %q", self.Name)
+	}
+	var ifi *net.Interface
+	if iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(iface); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, mdnsGroup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join the mDNS group: %w", err)
+	}
+	return &LAN{conn: conn, self: self, peers: make(map[string]Hub)}, nil
+}
+
+// Close leaves the mDNS group, telling others this instance is gone
+func (l *LAN) Close() error {
+	if msg, err := l.response(0, nil, 0); err == nil {
+		_, _ = l.conn.WriteToUDP(msg, mdnsGroup)
+	}
+	return l.conn.Close()
+}
+
+// Announce sends this instance's records unsolicited, so that others browsing
+// learn of it at once
+func (l *LAN) Announce() error {
+	msg, err := l.response(0, nil, mdnsTTL)
+	if err != nil {
+		return err
+	}
+	_, err = l.conn.WriteToUDP(msg, mdnsGroup)
+	return err
+}
+
+// Query asks the instances on the local network to announce themselves
+func (l *LAN) Query() error {
+	msg := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(msg[4:], 1) // One question
+	msg = appendName(msg, serviceName)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypePTR)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	_, err := l.conn.WriteToUDP(msg, mdnsGroup)
+	return err
+}
+
+// Peers returns the instances announced on the local network but this one,
+// sorted by name
+func (l *LAN) Peers() []Hub {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	peers := make([]Hub, 0, len(l.peers))
+	for _, h := range l.peers {
+		peers = append(peers, h)
+	}
+	slices.SortFunc(peers, func(a, b Hub) int { return strings.Compare(a.Name, b.Name) })
+	return peers
+}
+
+// Peer returns an instance announced on the local network by name
+func (l *LAN) Peer(name string) (Hub, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.peers[strings.ToLower(name)]
+	return h, ok
+}
+
+// Run answers queries and records the announcements of others until ctx is
+// done or the connection is closed
+func (l *LAN) Run(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { _ = l.conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := l.conn.ReadFromUDP(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := l.handle(buf[:n], src); err != nil {
+			logger.Network.Debug("Ignoring mDNS message from %s: %v", src, err)
+		}
+	}
+}
+
+// handle answers a query for the service, or records the instances of a
+// response
+func (l *LAN) handle(msg []byte, src *net.UDPAddr) error {
+	m, err := parseMessage(msg)
+	if err != nil {
+		return err
+	}
+	if m.flags&dnsFlagResponse != 0 {
+		l.record(m, src)
+		return nil
+	}
+
+	var asked []question
+	unicast := src.Port != mdnsPort
+	for _, q := range m.questions {
+		service := strings.EqualFold(q.name, serviceName) && (q.qtype == dnsTypePTR || q.qtype == dnsTypeANY)
+		if service || strings.EqualFold(q.name, l.self.instanceName()) {
+			asked = append(asked, q)
+			unicast = unicast || q.class&dnsUnicastResp != 0
+		}
+	}
+	if len(asked) == 0 {
+		return nil
+	}
+	if !unicast {
+		return l.Announce()
+	}
+	// A legacy resolver, not on port 5353, expects its ID and questions back
+	id := uint16(0)
+	if src.Port != mdnsPort {
+		id = m.id
+	} else {
+		asked = nil
+	}
+	resp, err := l.response(id, asked, mdnsTTL)
+	if err != nil {
+		return err
+	}
+	_, err = l.conn.WriteToUDP(resp, src)
+	return err
+}
+
+// record keeps the instances a response announces, and forgets those it says
+// are gone
+func (l *LAN) record(m *message, src *net.UDPAddr) {
+	srv := make(map[string]resource)
+	txt := make(map[string][]string)
+	addrs := make(map[string]net.IP)
+	var instances []resource
+	for _, r := range m.records {
+		name := strings.ToLower(r.name)
+		switch r.rtype {
+		case dnsTypePTR:
+			if strings.EqualFold(r.name, serviceName) {
+				instances = append(instances, r)
+			}
+		case dnsTypeSRV:
+			srv[name] = r
+		case dnsTypeTXT:
+			txt[name] = r.txt
+		case dnsTypeA:
+			addrs[name] = r.ip
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, ptr := range instances {
+		label, _, _ := strings.Cut(ptr.target, ".")
+		key := strings.ToLower(label)
+		if strings.EqualFold(label, l.self.Name) {
+			continue
+		}
+		if ptr.ttl == 0 {
+			delete(l.peers, key)
+			continue
+		}
+		s, ok := srv[strings.ToLower(ptr.target)]
+		if !ok {
+			continue
+		}
+		params := parseTXT(txt[strings.ToLower(ptr.target)])
+		if params == nil {
+			params = make(map[string]string)
+		}
+		// The address the response came from reaches the instance, unless it
+		// announces its own
+		address := src.IP
+		if ip, ok := addrs[strings.ToLower(s.target)]; ok {
+			address = ip
+		}
+		l.peers[key] = Hub{
+			Name:    label,
+			Target:  strings.TrimSuffix(s.target, "."),
+			Address: address.String(),
+			Port:    int(s.port),
+			Params:  params,
+			Source:  SourceMDNS,
+		}
+	}
+}
+
+// response builds the records of this instance: PTR, SRV, TXT and, if its
+// address is known, A. A TTL of 0 says it is gone.
+func (l *LAN) response(id uint16, questions []question, ttl uint32) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], dnsFlagResponse|dnsFlagAuthoritative)
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(questions)))
+	for _, q := range questions {
+		msg = appendName(msg, q.name)
+		msg = binary.BigEndian.AppendUint16(msg, q.qtype)
+		msg = binary.BigEndian.AppendUint16(msg, q.class&^dnsUnicastResp)
+	}
+
+	instance, host := l.self.instanceName(), l.self.hostName()
+	answers := 0
+	msg = appendRecord(msg, serviceName, dnsTypePTR, dnsClassIN, ttl, appendName(nil, instance))
+	answers++
+
+	srv := binary.BigEndian.AppendUint16(nil, 0) // Priority
+	srv = binary.BigEndian.AppendUint16(srv, 0)  // Weight
+	srv = binary.BigEndian.AppendUint16(srv, uint16(l.self.Port))
+	msg = appendRecord(msg, instance, dnsTypeSRV, dnsClassIN|dnsCacheFlush, ttl, appendName(srv, host))
+	answers++
+
+	txt, err := appendTXT(nil, l.self.Params)
+	if err != nil {
+		return nil, err
+	}
+	msg = appendRecord(msg, instance, dnsTypeTXT, dnsClassIN|dnsCacheFlush, ttl, txt)
+	answers++
+
+	if ip := net.ParseIP(l.self.Address).To4(); ip != nil {
+		msg = appendRecord(msg, host, dnsTypeA, dnsClassIN|dnsCacheFlush, ttl, ip)
+		answers++
+	}
+	binary.BigEndian.PutUint16(msg[6:], uint16(answers))
+	return msg, nil
+}
+
+// appendTXT appends the TXT record data of parameters: TXTVersion and then
+// key=value, sorted by key, each a string of its own as DNS-SD has it
+func appendTXT(b []byte, params map[string]string) ([]byte, error) {
+	entries := []string{TXTVersion}
+	for _, key := range Params {
+		if value, ok := params[key]; ok {
+			entries = append(entries, key+"="+value)
+		}
+	}
+	for _, entry := range entries {
+		if len(entry) > 255 {
+			return nil, fmt.Errorf("TXT entry %q is too long", entry)
+		}
+		b = append(b, byte(len(entry)))
+		b = append(b, entry...)
+	}
+	return b, nil
+}
+
+// appendName appends a domain name, uncompressed
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// appendRecord appends a resource record
+func appendRecord(b []byte, name string, rtype, class uint16, ttl uint32, data []byte) []byte {
+	b = appendName(b, name)
+	b = binary.BigEndian.AppendUint16(b, rtype)
+	b = binary.BigEndian.AppendUint16(b, class)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// message is a DNS message as far as mDNS discovery reads it
+type message struct {
+	id        uint16
+	flags     uint16
+	questions []question
+	records   []resource // Answers, authority and additional records
+}
+
+// question is a question of a DNS message
+type question struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+// resource is a resource record, with the data of the types discovery reads
+type resource struct {
+	name   string
+	rtype  uint16
+	ttl    uint32
+	target string   // PTR and SRV
+	port   uint16   // SRV
+	txt    []string // TXT
+	ip     net.IP   // A
+}
+
+var errTruncated = errors.New("truncated DNS message")
+
+// parseMessage reads a DNS message
+func parseMessage(msg []byte) (*message, error) {
+	if len(msg) < 12 {
+		return nil, errTruncated
+	}
+	m := &message{id: binary.BigEndian.Uint16(msg[0:]), flags: binary.BigEndian.Uint16(msg[2:])}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for range qdcount {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(msg) {
+			return nil, errTruncated
+		}
+		m.questions = append(m.questions, question{name: name, qtype: binary.BigEndian.Uint16(msg[next:]), class: binary.BigEndian.Uint16(msg[next+2:])})
+		off = next + 4
+	}
+	for range rrcount {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, errTruncated
+		}
+		r := resource{name: name, rtype: binary.BigEndian.Uint16(msg[next:]), ttl: binary.BigEndian.Uint32(msg[next+4:])}
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		if start+length > len(msg) {
+			return nil, errTruncated
+		}
+		data := msg[start : start+length]
+		switch r.rtype {
+		case dnsTypePTR:
+			if r.target, _, err = readName(msg, start); err != nil {
+				return nil, err
+			}
+		case dnsTypeSRV:
+			if length < 7 {
+				return nil, errTruncated
+			}
+			r.port = binary.BigEndian.Uint16(data[4:])
+			if r.target, _, err = readName(msg, start+6); err != nil {
+				return nil, err
+			}
+		case dnsTypeTXT:
+			for i := 0; i < len(data); i += 1 + int(data[i]) {
+				if i+1+int(data[i]) > len(data) {
+					return nil, errTruncated
+				}
+				r.txt = append(r.txt, string(data[i+1:i+1+int(data[i])]))
+			}
+			// DNS-SD has one key=value per string, parseTXT one record of fields
+			r.txt = []string{strings.Join(r.txt, " ")}
+		case dnsTypeA:
+			if length == net.IPv4len {
+				r.ip = net.IP(slices.Clone(data))
+			}
+		}
+		m.records = append(m.records, r)
+		off = start + length
+	}
+	return m, nil
+}
+
+// readName reads a domain name, following compression pointers, and returns
+// the offset after it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errTruncated
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errTruncated
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errors.New("DNS name compression loop")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errTruncated
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// PairingCode returns the code two instances pairing show, to be compared by
+// their users so that neither pairs with an impostor: a digest of both their
+// WireGuard public keys, the same whichever side computes it
+func PairingCode(key, peerKey string) string {
+	keys := []string{key, peerKey}
+	slices.Sort(keys)
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\n")))
+	code := binary.BigEndian.Uint32(sum[:]) % 1000000
+	return fmt.Sprintf("%03d %03d", code/1000, code%1000)
+}
@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMDNSResponse(t *testing.T) {
+	self := &LAN{self: Announcement{Name: "laptop-a", Address: "192.168.1.10", Port: 51820,
+		Params: map[string]string{ParamSubnet: "10.10.0.0/24", ParamWGKey: "keyA", ParamPair: "laptop-b"}}}
+	msg, err := self.response(0, nil, mdnsTTL)
+	if err != nil {
+		t.Fatalf("response failed: %v", err)
+	}
+	m, err := parseMessage(msg)
+	if err != nil {
+		t.Fatalf("parseMessage failed: %v", err)
+	}
+
+	// Another instance records it, with the address it announces
+	other := &LAN{self: Announcement{Name: "laptop-b"}, peers: make(map[string]Hub)}
+	other.record(m, &net.UDPAddr{IP: net.ParseIP("192.168.1.99"), Port: mdnsPort})
+	peer, ok := other.Peer("Laptop-A")
+	if !ok {
+		t.Fatalf("Expected laptop-a to be recorded, got %+v", other.Peers())
+	}
+	if peer.Address != "192.168.1.10" || peer.Port != 51820 || peer.Source != SourceMDNS ||
+		peer.Params[ParamSubnet] != "10.10.0.0/24" || peer.Params[ParamWGKey] != "keyA" || peer.Params[ParamPair] != "laptop-b" {
+		t.Errorf("Expected laptop-a at 192.168.1.10:51820 pairing with laptop-b, got %+v", peer)
+	}
+
+	// Its own announcements are not recorded
+	self.peers = make(map[string]Hub)
+	self.record(m, &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: mdnsPort})
+	if len(self.Peers()) != 0 {
+		t.Errorf("Expected an instance to leave itself out, got %+v", self.Peers())
+	}
+
+	// Without an A record, the source of the response reaches it; a TTL of 0
+	// says it is gone
+	self.self.Address = ""
+	msg, _ = self.response(0, nil, mdnsTTL)
+	m, _ = parseMessage(msg)
+	other.record(m, &net.UDPAddr{IP: net.ParseIP("192.168.1.99"), Port: mdnsPort})
+	if peer, _ := other.Peer("laptop-a"); peer.Address != "192.168.1.99" {
+		t.Errorf("Expected laptop-a at the source address 192.168.1.99, got %+v", peer)
+	}
+	msg, _ = self.response(0, nil, 0)
+	m, _ = parseMessage(msg)
+	other.record(m, &net.UDPAddr{IP: net.ParseIP("192.168.1.99"), Port: mdnsPort})
+	if _, ok := other.Peer("laptop-a"); ok {
+		t.Error("Expected laptop-a to be forgotten after its goodbye")
+	}
+}
+
+func TestReadName(t *testing.T) {
+	// "local" at 12, "_ipsecvpn._udp" then a pointer to it at 18
+	msg := make([]byte, 12)
+	msg = append(msg, 5, 'l', 'o', 'c', 'a', 'l', 0)
+	msg = append(msg, 9, '_', 'i', 'p', 's', 'e', 'c', 'v', 'p', 'n', 4, '_', 'u', 'd', 'p', 0xc0, 12)
+	name, next, err := readName(msg, 19)
+	if err != nil || name != "_ipsecvpn._udp.local" || next != len(msg) {
+		t.Errorf("Expected _ipsecvpn._udp.local ending at %d, got %q at %d: %v", len(msg), name, next, err)
+	}
+
+	for _, tt := range []struct {
+		desc string
+		msg  []byte
+	}{
+		{"a pointer to itself", append(make([]byte, 12), 0xc0, 12)},
+		{"a label past the end", append(make([]byte, 12), 9, 'a')},
+		{"no terminating label", append(make([]byte, 12), 1, 'a')},
+	} {
+		if _, _, err := readName(tt.msg, 12); err == nil {
+			t.Errorf("Expected %s to fail", tt.desc)
+		}
+	}
+	if _, err := parseMessage([]byte{0, 1, 2}); err == nil {
+		t.Error("Expected a message shorter than its header to fail")
+	}
+}
+
+func TestPairingCode(t *testing.T) {
+	code := PairingCode("keyA", "keyB")
+	if len(code) != 7 || code[3] != ' ' {
+		t.Errorf("Expected a code of two groups of 3 digits, got %q", code)
+	}
+	if other := PairingCode("keyB", "keyA"); other != code {
+		t.Errorf("Expected both sides to show %s, got %s", code, other)
+	}
+	if other := PairingCode("keyA", "keyC"); other == code {
+		t.Errorf("Expected another key to change the code, got %s for both", code)
+	}
+}
@@ -0,0 +1,231 @@
+package events
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/mail"
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/spf13/viper"
+)
+
+// Default email settings
+const (
+	DefaultEmailSubject = `[ipsec-vpn] {{.Type}}{{with .Tunnel}} {{.}}{{end}} on {{.Host}}`
+	DefaultEmailBody    = `{{.Type}} on {{.Host}} at {{.Time.Format "2006-01-02 15:04:05 MST"}}
+{{with .Tunnel}}
+Tunnel: {{.}}{{end}}{{with .Status}}
+Status: {{.}}{{end}}{{with .Source}}
+Source: {{.}}{{end}}{{with .Expires}}
+Expires: {{.Format "2006-01-02 15:04:05 MST"}}{{end}}{{with .Reason}}
+Reason: {{.}}{{end}}
+{{if .Suppressed}}
+{{.Suppressed}} earlier notifications were not sent because of the rate limit.
+{{end}}`
+	DefaultEmailRateLimit = 20 // Emails per hour
+)
+
+// DefaultEmailTypes are the events emailed unless events.email.types is set
+var DefaultEmailTypes = []string{TypeDown, TypeError, TypeCertificateExpiring, TypeAuthFailure}
+
+// emailTimeout bounds sending one email, which is longer than publishing to a
+// broker as SMTP takes several round trips
+const emailTimeout = 10 * time.Second
+
+// EmailConfig configures the email publisher
+type EmailConfig struct {
+	Mailer    *mail.Mailer
+	Types     []string // Event types to email; test events are always sent
+	Subject   string   // text/template of the subject, DefaultEmailSubject if empty
+	Body      string   // text/template of the body, DefaultEmailBody if empty
+	RateLimit int      // Emails per hour, 0 for no limit
+}
+
+// emailPublisher emails events of the configured types to an ops alias
+type emailPublisher struct {
+	config  EmailConfig
+	subject *template.Template
+	body    *template.Template
+	send    func(subject, body string, date time.Time) error
+}
+
+// emailData is what email templates are executed with
+type emailData struct {
+	Event
+	Suppressed int // Emails not sent since the last one because of the rate limit
+}
+
+// NewEmail returns a publisher that emails events, checking its templates
+func NewEmail(config EmailConfig) (Publisher, error) {
+	if config.Mailer == nil || config.Mailer.From == "" || len(config.Mailer.To) == 0 {
+		return nil, fmt.Errorf("email needs a sender and at least one recipient")
+	}
+	subject, err := parseEmailTemplate("email subject", cmp.Or(config.Subject, DefaultEmailSubject))
+	if err != nil {
+		return nil, err
+	}
+	body, err := parseEmailTemplate("email body", cmp.Or(config.Body, DefaultEmailBody))
+	if err != nil {
+		return nil, err
+	}
+	mailer := *config.Mailer
+	if mailer.Server.Timeout == 0 {
+		mailer.Server.Timeout = emailTimeout
+	}
+	config.Mailer = &mailer
+	return &emailPublisher{config: config, subject: subject, body: body, send: mailer.Send}, nil
+}
+
+// parseEmailTemplate parses an email template and tries it on a sample event,
+// so that references to fields events do not have are caught early
+func parseEmailTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %v", name, err)
+	}
+	sample := emailData{Event: New(TypeError, "office"), Suppressed: 1}
+	if err := t.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("invalid %s template: %v", name, err)
+	}
+	return t, nil
+}
+
+// CheckEmailTemplate reports whether text is a valid email subject or body template
+func CheckEmailTemplate(text string) error {
+	_, err := parseEmailTemplate("email", text)
+	return err
+}
+
+// emailFromConfig returns the publisher configured in events.email, sending
+// through the SMTP server and to the recipients of alerts.email, or nil if
+// events.email.enabled is not set
+func emailFromConfig() (Publisher, error) {
+	if !viper.GetBool("events.email.enabled") {
+		return nil, nil
+	}
+	mailer := mail.FromConfig()
+	if mailer == nil {
+		return nil, fmt.Errorf("events.email.enabled needs the SMTP server in alerts.email.smtp")
+	}
+	return NewEmail(EmailConfig{
+		Mailer:    mailer,
+		Types:     viper.GetStringSlice("events.email.types"),
+		Subject:   viper.GetString("events.email.subject"),
+		Body:      viper.GetString("events.email.body"),
+		RateLimit: viper.GetInt("events.email.rate_limit"),
+	})
+}
+
+func (p *emailPublisher) String() string {
+	return "smtp://" + p.config.Mailer.Server.Address + " (" + strings.Join(p.config.Mailer.To, ", ") + ")"
+}
+
+// Publish emails the event if it is of a configured type and the rate limit
+// allows it. Events dropped by the rate limit are counted in the next email.
+func (p *emailPublisher) Publish(e Event, payload []byte) error {
+	if e.Type != TypeTest && !slices.Contains(p.config.Types, e.Type) {
+		return nil
+	}
+
+	state, err := loadEmailState()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	state.Sent = slices.DeleteFunc(state.Sent, func(t time.Time) bool {
+		return now.Sub(t) > time.Hour
+	})
+	if p.config.RateLimit > 0 && len(state.Sent) >= p.config.RateLimit && e.Type != TypeTest {
+		state.Suppressed++
+		logger.Debug("Not emailing %s event, %d emails were sent in the last hour", e.Type, len(state.Sent))
+		return saveEmailState(state)
+	}
+
+	data := emailData{Event: e, Suppressed: state.Suppressed}
+	var subject, body strings.Builder
+	if err := p.subject.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := p.body.Execute(&body, data); err != nil {
+		return err
+	}
+	if err := p.send(subject.String(), body.String(), e.Time); err != nil {
+		return err
+	}
+
+	state.Sent = append(state.Sent, now)
+	state.Suppressed = 0
+	return saveEmailState(state)
+}
+
+// emailState is the rate limiting state shared by every process publishing events
+type emailState struct {
+	Sent       []time.Time `json:"sent"`
+	Suppressed int         `json:"suppressed"`
+}
+
+// emailStatePath returns the file the email rate limiting state is kept in
+func emailStatePath() (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "events", "email.json"), nil
+}
+
+// loadEmailState reads the email rate limiting state
+func loadEmailState() (*emailState, error) {
+	path, err := emailStatePath()
+	if err != nil {
+		return nil, err
+	}
+	state := &emailState{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A damaged state file only resets the rate limit
+	_ = json.Unmarshal(data, state)
+	return state, nil
+}
+
+// saveEmailState replaces the email rate limiting state
+func saveEmailState(state *emailState) error {
+	path, err := emailStatePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Several processes publish events, so each writes its own temporary file
+	tmp, err := os.CreateTemp(filepath.Dir(path), "email-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,218 @@
+package events
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Event types
+const (
+	TypeCreated = "tunnel.created"
+	TypeUp      = "tunnel.up"
+	TypeDown    = "tunnel.down"
+	TypeError   = "tunnel.error"
+	TypeDeleted = "tunnel.deleted"
+	TypeStats   = "tunnel.stats"
+
+	TypeSLAViolated = "tunnel.sla.violated"
+	TypeSLARestored = "tunnel.sla.restored"
+
+	TypeSARekey   = "tunnel.sa.rekey"   // An SA reached a soft lifetime limit and is rekeyed
+	TypeSAExpired = "tunnel.sa.expired" // An SA reached a hard lifetime limit and was deleted
+
+	TypeReauthSucceeded = "tunnel.reauth.succeeded" // The IKE SA was reauthenticated from scratch
+	TypeReauthFailed    = "tunnel.reauth.failed"    // Reauthenticating the IKE SA failed, its SAs last until the grace ends
+
+	TypeShortcutOffered     = "tunnel.shortcut.offered"     // A hub offers a spoke a direct tunnel to another spoke
+	TypePathChanged         = "tunnel.path.changed"         // A path set routes its prefix through another tunnel
+	TypeSessionDisconnected = "tunnel.session.disconnected" // An initiator was disconnected, its IKE SA is to be deleted
+	TypeSessionRejected     = "tunnel.session.rejected"     // A login policy refused an initiator that authenticated
+
+	TypeScheduleActivated   = "tunnel.schedule.activated"   // A schedule routes its prefix through its tunnel
+	TypeScheduleDeactivated = "tunnel.schedule.deactivated" // A schedule withdraws the route
+
+	TypeAuthFailure         = "auth.failure"
+	TypeCertificateExpiring = "certificate.expiring"
+
+	TypeTest = "test"
+)
+
+// Types lists the event types tunnels and the IKE responder publish
+var Types = []string{TypeCreated, TypeUp, TypeDown, TypeError, TypeDeleted, TypeStats,
+	TypeSLAViolated, TypeSLARestored, TypeSARekey, TypeSAExpired, TypeReauthSucceeded, TypeReauthFailed, TypeShortcutOffered, TypePathChanged,
+	TypeSessionDisconnected, TypeSessionRejected, TypeScheduleActivated, TypeScheduleDeactivated, TypeAuthFailure, TypeCertificateExpiring}
+
+// publishTimeout bounds connecting to a broker and publishing one event
+const publishTimeout = 5 * time.Second
+
+// Event is a tunnel lifecycle change, a sample of its traffic counters, a peer
+// that failed to authenticate, a certificate about to expire or a shortcut a
+// hub offers
+type Event struct {
+	Type          string     `json:"type"`
+	Tunnel        string     `json:"tunnel,omitempty"`
+	Host          string     `json:"host"`
+	Time          time.Time  `json:"time"`
+	Status        string     `json:"status,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+	Source        string     `json:"source,omitempty"`  // Address of the peer that failed to authenticate
+	Expires       *time.Time `json:"expires,omitempty"` // When the certificate expires
+	RxBytes       *uint64    `json:"rx_bytes,omitempty"`
+	TxBytes       *uint64    `json:"tx_bytes,omitempty"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	PeerID        string     `json:"peer_id,omitempty"`      // Spoke a shortcut is offered to
+	PeerAddress   string     `json:"peer_address,omitempty"` // Its address
+	PeerSubnet    string     `json:"peer_subnet,omitempty"`  // Its subnet
+}
+
+// New returns an event of the given type for a tunnel, stamped with the host and time
+func New(typ, tunnel string) Event {
+	host, _ := os.Hostname()
+	return Event{Type: typ, Tunnel: tunnel, Host: host, Time: time.Now().UTC()}
+}
+
+// Subject returns the name the event is published under, below a topic prefix,
+// with the parts of its type joined by sep
+func (e Event) Subject(prefix, sep string) string {
+	return prefix + sep + strings.ReplaceAll(e.Type, ".", sep)
+}
+
+// Publisher sends events to a message broker
+type Publisher interface {
+	// Publish sends an encoded event, returning once the broker accepted it
+	Publish(e Event, payload []byte) error
+	// String returns the broker URL without credentials
+	String() string
+}
+
+// Open returns the publisher for a broker URL: mqtt:// or mqtts:// for an MQTT
+// broker, nats:// or tls:// for NATS and kafka:// or kafka+tls:// for a list of
+// comma separated Kafka bootstrap brokers
+func Open(rawURL, topic string) (Publisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("broker URL %q has no host", rawURL)
+	}
+	var tlsConfig *tls.Config
+	switch u.Scheme {
+	case "mqtts", "tls", "kafka+tls":
+		tlsConfig = &tls.Config{}
+	}
+
+	switch u.Scheme {
+	case "mqtt", "mqtts":
+		return &mqttPublisher{url: u, addr: withPort(u.Host, defaultPort(u.Scheme)), tls: tlsConfig, topic: topic}, nil
+	case "nats", "tls":
+		return &natsPublisher{url: u, addr: withPort(u.Host, "4222"), tls: tlsConfig, topic: topic}, nil
+	case "kafka", "kafka+tls":
+		if u.User != nil {
+			return nil, errors.New("Kafka SASL authentication is not supported")
+		}
+		var brokers []string
+		for _, host := range strings.Split(u.Host, ",") {
+			brokers = append(brokers, withPort(host, "9092"))
+		}
+		return &kafkaPublisher{url: u, brokers: brokers, tls: tlsConfig, topic: topic}, nil
+	}
+	return nil, fmt.Errorf("unsupported broker URL scheme %q, use mqtt, mqtts, nats, tls, kafka or kafka+tls", u.Scheme)
+}
+
+// defaultPort returns the well-known port of an MQTT URL scheme
+func defaultPort(scheme string) string {
+	if scheme == "mqtts" {
+		return "8883"
+	}
+	return "1883"
+}
+
+// withPort adds a port to a host that has none
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// dial connects to a broker, over TLS if configured, with a deadline for the
+// whole exchange
+func dial(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: publishTimeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		config := tlsConfig.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(publishTimeout))
+	return conn, nil
+}
+
+// Publishers returns the publishers configured in events.publishers, and the
+// email publisher if events.email.smtp is set
+func Publishers() ([]Publisher, error) {
+	topic := viper.GetString("events.topic")
+	var publishers []Publisher
+	for _, rawURL := range viper.GetStringSlice("events.publishers") {
+		p, err := Open(rawURL, topic)
+		if err != nil {
+			return nil, err
+		}
+		publishers = append(publishers, p)
+	}
+	email, err := emailFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	if email != nil {
+		publishers = append(publishers, email)
+	}
+	return publishers, nil
+}
+
+// PublishTo sends an event to each publisher in parallel, returning the error
+// of each that failed
+func PublishTo(publishers []Publisher, e Event) map[Publisher]error {
+	payload, _ := json.Marshal(e)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := make(map[Publisher]error)
+	for _, p := range publishers {
+		wg.Add(1)
+		go func(p Publisher) {
+			defer wg.Done()
+			if err := p.Publish(e, payload); err != nil {
+				mu.Lock()
+				failed[p] = err
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	return failed
+}
+
+// Publish queues an event for the configured publishers. Failures are logged
+// rather than returned, and the event is sent in the background, so an
+// unreachable broker never fails or holds up a tunnel operation.
+func Publish(e Event) {
+	Default().Publish(e)
+}
@@ -0,0 +1,302 @@
+package events
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// Kafka API keys and the versions used, the oldest still supported by Kafka 4
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 4
+)
+
+// kafkaAcks waits for all in-sync replicas to have the event
+const kafkaAcks = -1
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaPublisher produces events to a Kafka topic, keyed by tunnel so that the
+// events of a tunnel stay in order on one partition. It asks a bootstrap broker
+// for the partition leaders and connects to the leader for each event.
+type kafkaPublisher struct {
+	url     *url.URL
+	brokers []string
+	tls     *tls.Config
+	topic   string
+}
+
+func (p *kafkaPublisher) String() string {
+	return p.url.Redacted()
+}
+
+func (p *kafkaPublisher) Publish(e Event, payload []byte) error {
+	var leaders map[int32]string
+	var err error
+	for _, broker := range p.brokers {
+		if leaders, err = p.metadata(broker); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Hash the tunnel name over the partitions that have a leader
+	partitions := make([]int32, 0, len(leaders))
+	for partition := range leaders {
+		partitions = append(partitions, partition)
+	}
+	slices.Sort(partitions)
+	key := fnv.New32a()
+	key.Write([]byte(e.Tunnel))
+	partition := partitions[key.Sum32()%uint32(len(partitions))]
+	return p.produce(leaders[partition], partition, []byte(e.Tunnel), payload, e.Time.UnixMilli())
+}
+
+// metadata returns the address of the leader of each partition of the topic
+func (p *kafkaPublisher) metadata(broker string) (map[int32]string, error) {
+	req := new(kafkaEncoder)
+	req.int32(1)
+	req.string(p.topic)
+	req.int8(1) // Allow auto topic creation
+	resp, err := p.roundTrip(broker, kafkaMetadata, kafkaMetadataVersion, req.b)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &kafkaDecoder{b: resp}
+	d.int32() // Throttle time
+	nodes := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.string() // Rack
+		nodes[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // Cluster ID
+	d.int32()  // Controller ID
+	if d.int32() != 1 {
+		return nil, d.fail(errors.New("expected metadata for one topic"))
+	}
+	if code := d.int16(); code != 0 {
+		return nil, d.fail(fmt.Errorf("topic %s: %s", p.topic, kafkaError(code)))
+	}
+	d.string() // Name
+	d.int8()   // Internal
+	leaders := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code, partition, leader := d.int16(), d.int32(), d.int32()
+		d.skipInt32s() // Replicas
+		d.skipInt32s() // In-sync replicas
+		if addr, ok := nodes[leader]; ok && code == 0 {
+			leaders[partition] = addr
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(leaders) == 0 {
+		return nil, fmt.Errorf("topic %s has no partition with a leader", p.topic)
+	}
+	return leaders, nil
+}
+
+// produce appends a record to a partition through its leader
+func (p *kafkaPublisher) produce(leader string, partition int32, key, value []byte, timestamp int64) error {
+	req := new(kafkaEncoder)
+	req.int16(-1) // No transactional ID
+	req.int16(kafkaAcks)
+	req.int32(int32(publishTimeout.Milliseconds()))
+	req.int32(1)
+	req.string(p.topic)
+	req.int32(1)
+	req.int32(partition)
+	batch := recordBatch(key, value, timestamp)
+	req.int32(int32(len(batch)))
+	req.b = append(req.b, batch...)
+
+	resp, err := p.roundTrip(leader, kafkaProduce, kafkaProduceVersion, req.b)
+	if err != nil {
+		return err
+	}
+	d := &kafkaDecoder{b: resp}
+	if d.int32() != 1 {
+		return d.fail(errors.New("expected a response for one topic"))
+	}
+	d.string()
+	if d.int32() != 1 {
+		return d.fail(errors.New("expected a response for one partition"))
+	}
+	d.int32()
+	if code := d.int16(); code != 0 {
+		return d.fail(fmt.Errorf("partition %d: %s", partition, kafkaError(code)))
+	}
+	return d.err
+}
+
+// roundTrip sends a request to a broker and returns the response body
+func (p *kafkaPublisher) roundTrip(broker string, apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	conn, err := dial(broker, p.tls)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	const correlationID = 1
+	req := new(kafkaEncoder)
+	req.int32(0) // Size, set below
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(correlationID)
+	req.string("ipsec-vpn")
+	req.b = append(req.b, body...)
+	binary.BigEndian.PutUint32(req.b, uint32(len(req.b)-4))
+	if _, err := conn.Write(req.b); err != nil {
+		return nil, err
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 4 || size > 1<<20 {
+		return nil, fmt.Errorf("invalid response size %d", size)
+	}
+	if id := binary.BigEndian.Uint32(header[4:]); id != correlationID {
+		return nil, fmt.Errorf("unexpected correlation ID %d", id)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// recordBatch encodes a v2 record batch holding a single record
+func recordBatch(key, value []byte, timestamp int64) []byte {
+	var record []byte
+	record = append(record, 0)              // Attributes
+	record = binary.AppendVarint(record, 0) // Timestamp delta
+	record = binary.AppendVarint(record, 0) // Offset delta
+	record = binary.AppendVarint(record, int64(len(key)))
+	record = append(record, key...)
+	record = binary.AppendVarint(record, int64(len(value)))
+	record = append(record, value...)
+	record = binary.AppendVarint(record, 0) // Headers
+
+	// The CRC covers everything from the attributes on
+	covered := new(kafkaEncoder)
+	covered.int16(0) // Attributes: no compression, create time
+	covered.int32(0) // Last offset delta
+	covered.int64(timestamp)
+	covered.int64(timestamp)
+	covered.int64(-1) // Producer ID
+	covered.int16(-1) // Producer epoch
+	covered.int32(-1) // Base sequence
+	covered.int32(1)
+	covered.b = binary.AppendVarint(covered.b, int64(len(record)))
+	covered.b = append(covered.b, record...)
+
+	batch := new(kafkaEncoder)
+	batch.int64(0) // Base offset
+	batch.int32(int32(4 + 1 + 4 + len(covered.b)))
+	batch.int32(-1) // Partition leader epoch
+	batch.int8(2)   // Magic
+	batch.int32(int32(crc32.Checksum(covered.b, castagnoli)))
+	batch.b = append(batch.b, covered.b...)
+	return batch.b
+}
+
+// kafkaError describes a Kafka error code
+func kafkaError(code int16) string {
+	switch code {
+	case 3:
+		return "unknown topic or partition"
+	case 5:
+		return "leader not available"
+	case 6:
+		return "not leader for partition"
+	case 7:
+		return "request timed out"
+	case 19:
+		return "not enough replicas"
+	case 29:
+		return "topic authorization failed"
+	case 31:
+		return "cluster authorization failed"
+	}
+	return fmt.Sprintf("error code %d", code)
+}
+
+// kafkaEncoder appends big-endian protocol fields
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.b = append(e.b, byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32) { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// kafkaDecoder reads big-endian protocol fields, remembering the first error
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if len(d.b) < n {
+		d.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int8() int8   { return int8(d.next(1)[0]) }
+func (d *kafkaDecoder) int16() int16 { return int16(binary.BigEndian.Uint16(d.next(2))) }
+func (d *kafkaDecoder) int32() int32 { return int32(binary.BigEndian.Uint32(d.next(4))) }
+
+// string reads a string, returning "" for a null one
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) skipInt32s() {
+	if n := d.int32(); n > 0 {
+		d.next(4 * int(n))
+	}
+}
+
+// fail returns the decoding error if there was one, as err is then meaningless
+func (d *kafkaDecoder) fail(err error) error {
+	if d.err != nil {
+		return d.err
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package events
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+)
+
+// MQTT 3.1.1 control packet types, shifted into the fixed header
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPuback     = 4 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// mqttPublisher publishes events at QoS 1 to an MQTT 3.1.1 broker, under
+// <topic>/tunnel/<event>, connecting for each event
+type mqttPublisher struct {
+	url   *url.URL
+	addr  string
+	tls   *tls.Config
+	topic string
+}
+
+func (p *mqttPublisher) String() string {
+	return p.url.Redacted()
+}
+
+func (p *mqttPublisher) Publish(e Event, payload []byte) error {
+	conn, err := dial(p.addr, p.tls)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if _, err := conn.Write(p.connectPacket()); err != nil {
+		return err
+	}
+	typ, body, err := readMQTTPacket(r)
+	if err != nil {
+		return err
+	}
+	if typ != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("expected CONNACK, got packet type %d", typ>>4)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("connection refused: %s", mqttConnackReason(body[1]))
+	}
+
+	// QoS 1 so the event is acknowledged before the connection is closed
+	const packetID = 1
+	var packet []byte
+	packet = appendMQTTString(packet, e.Subject(p.topic, "/"))
+	packet = binary.BigEndian.AppendUint16(packet, packetID)
+	packet = append(packet, payload...)
+	if _, err := conn.Write(mqttPacket(mqttPublish|0x02, packet)); err != nil {
+		return err
+	}
+	typ, body, err = readMQTTPacket(r)
+	if err != nil {
+		return err
+	}
+	if typ != mqttPuback || len(body) != 2 || binary.BigEndian.Uint16(body) != packetID {
+		return fmt.Errorf("expected PUBACK, got packet type %d", typ>>4)
+	}
+
+	_, err = conn.Write(mqttPacket(mqttDisconnect, nil))
+	return err
+}
+
+// connectPacket returns a CONNECT packet for a clean session, with the
+// credentials of the broker URL
+func (p *mqttPublisher) connectPacket() []byte {
+	host, _ := os.Hostname()
+	flags := byte(0x02) // Clean session
+	var payload []byte
+	payload = appendMQTTString(payload, fmt.Sprintf("ipsec-vpn-%s-%d", host, os.Getpid()))
+	if user := p.url.User; user != nil {
+		flags |= 0x80
+		payload = appendMQTTString(payload, user.Username())
+		if password, ok := user.Password(); ok {
+			flags |= 0x40
+			payload = appendMQTTString(payload, password)
+		}
+	}
+
+	var packet []byte
+	packet = appendMQTTString(packet, "MQTT")
+	packet = append(packet, 4, flags) // Protocol level 4 is MQTT 3.1.1
+	packet = binary.BigEndian.AppendUint16(packet, 60)
+	packet = append(packet, payload...)
+	return mqttPacket(mqttConnect, packet)
+}
+
+// mqttPacket prefixes a packet body with its fixed header
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// appendMQTTString appends a length-prefixed UTF-8 string
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readMQTTPacket reads a packet, returning the type from its fixed header and its body
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header & 0xf0, body, nil
+}
+
+// mqttConnackReason describes a CONNACK return code
+func mqttConnackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	}
+	return fmt.Sprintf("return code %d", code)
+}
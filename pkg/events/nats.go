@@ -0,0 +1,107 @@
+package events
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// natsPublisher publishes events to a NATS server under <topic>.tunnel.<event>,
+// connecting for each event
+type natsPublisher struct {
+	url   *url.URL
+	addr  string
+	tls   *tls.Config
+	topic string
+}
+
+func (p *natsPublisher) String() string {
+	return p.url.Redacted()
+}
+
+func (p *natsPublisher) Publish(e Event, payload []byte) error {
+	conn, err := dial(p.addr, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { conn.Close() }()
+	r := bufio.NewReader(conn)
+
+	// The server speaks first, and TLS is negotiated after its INFO
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("expected INFO, got %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		return fmt.Errorf("invalid INFO: %v", err)
+	}
+	if info.TLSRequired && p.tls == nil {
+		return errors.New("server requires TLS, use a tls:// URL")
+	}
+	if p.tls != nil {
+		config := p.tls.Clone()
+		config.ServerName = p.url.Hostname()
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	connect, _ := json.Marshal(p.connectOptions())
+	// PING after PUB so the PONG confirms the server processed it, or an
+	// -ERR arrives first
+	msg := fmt.Sprintf("CONNECT %s\r\nPUB %s %d\r\n%s\r\nPING\r\n", connect, e.Subject(p.topic, "."), len(payload), payload)
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.Trim(strings.TrimSpace(line[len("-ERR"):]), "'"))
+		case line == "PING":
+			if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// connectOptions returns the CONNECT options, with the credentials of the URL:
+// a user name alone is sent as a token
+func (p *natsPublisher) connectOptions() map[string]any {
+	options := map[string]any{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "ipsec-vpn",
+		"lang":     "go",
+		"protocol": 1,
+	}
+	if user := p.url.User; user != nil {
+		if password, ok := user.Password(); ok {
+			options["user"] = user.Username()
+			options["pass"] = password
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	return options
+}
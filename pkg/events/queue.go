@@ -0,0 +1,111 @@
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+)
+
+// QueueSize is how many events may wait to be published before more are
+// dropped
+const QueueSize = 256
+
+// Queue publishes events in the background, one at a time to all its
+// publishers in parallel, so that a slow or unreachable broker never holds up
+// the tunnel operation that published the event. Events published while the
+// queue is full are dropped.
+type Queue struct {
+	publishers []Publisher
+	events     chan Event
+	pending    sync.WaitGroup
+	dropped    atomic.Int64
+}
+
+// NewQueue starts publishing events to the publishers, with room for size
+// events waiting
+func NewQueue(publishers []Publisher, size int) *Queue {
+	q := &Queue{publishers: publishers, events: make(chan Event, size)}
+	if len(publishers) > 0 {
+		go q.run()
+	}
+	return q
+}
+
+// Publish queues an event, or drops it if the queue is full
+func (q *Queue) Publish(e Event) {
+	if q == nil || len(q.publishers) == 0 {
+		return
+	}
+	q.pending.Add(1)
+	select {
+	case q.events <- e:
+	default:
+		q.pending.Done()
+		if q.dropped.Add(1) == 1 {
+			logger.Error("Event queue full, dropping %s and further events until the brokers catch up", e.Type)
+		}
+	}
+}
+
+// Flush waits up to timeout for the queued events to be published, reporting
+// whether they were, such as before a command exits
+func (q *Queue) Flush(timeout time.Duration) bool {
+	if q == nil {
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		q.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// run publishes the queued events
+func (q *Queue) run() {
+	for e := range q.events {
+		for p, err := range PublishTo(q.publishers, e) {
+			logger.Error("Failed to publish %s event to %s: %v", e.Type, p, err)
+		}
+		if n := q.dropped.Swap(0); n > 0 {
+			logger.Error("Dropped %d event(s) while the event queue was full", n)
+		}
+		q.pending.Done()
+	}
+}
+
+var (
+	defaultMu    sync.Mutex
+	defaultQueue *Queue
+)
+
+// Default returns the queue of the publishers configured in events.publishers
+// and events.email, built the first time it is used
+func Default() *Queue {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultQueue == nil {
+		publishers, err := Publishers()
+		if err != nil {
+			logger.Error("Events will not be published: %v", err)
+		}
+		defaultQueue = NewQueue(publishers, QueueSize)
+	}
+	return defaultQueue
+}
+
+// Flush waits up to timeout for the events published through Default to be
+// sent, if any were
+func Flush(timeout time.Duration) bool {
+	defaultMu.Lock()
+	q := defaultQueue
+	defaultMu.Unlock()
+	return q.Flush(timeout)
+}
@@ -0,0 +1,190 @@
+// Package fault injects faults for resilience testing, so that HA failover and
+// retries can be seen to work in staging before a rollout: it drops a share of
+// the IKE packets, delays netlink operations and corrupts traffic counters.
+// Faults only take effect where advanced.fault_injection is on, which only
+// the root-owned system configuration file can do and production
+// configurations leave off, and end on their own at a deadline so
+// that a forgotten test does not linger.
+package fault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/spf13/viper"
+)
+
+// MaxNetlinkDelay is the longest delay that may be added to netlink operations
+const MaxNetlinkDelay = time.Minute
+
+// Faults are the faults injected until a deadline
+type Faults struct {
+	DropIKE         int           `json:"drop_ike,omitempty"`         // Percent of the IKE packets dropped
+	NetlinkDelay    time.Duration `json:"netlink_delay,omitempty"`    // Added to each netlink operation of the tunnels
+	CorruptCounters int           `json:"corrupt_counters,omitempty"` // Percent of the traffic counter reads corrupted
+	Until           time.Time     `json:"until"`
+}
+
+// Validate checks that the percentages are between 0 and 100 and the delay
+// between 0 and MaxNetlinkDelay
+func (f Faults) Validate() error {
+	if f.DropIKE < 0 || f.DropIKE > 100 {
+		return fmt.Errorf("IKE packets dropped must be 0 to 100%%, got %d", f.DropIKE)
+	}
+	if f.CorruptCounters < 0 || f.CorruptCounters > 100 {
+		return fmt.Errorf("counters corrupted must be 0 to 100%%, got %d", f.CorruptCounters)
+	}
+	if f.NetlinkDelay < 0 || f.NetlinkDelay > MaxNetlinkDelay {
+		return fmt.Errorf("netlink delay must be 0 to %s, got %s", MaxNetlinkDelay, f.NetlinkDelay)
+	}
+	return nil
+}
+
+// None reports whether no fault is injected
+func (f Faults) None() bool {
+	return f.DropIKE == 0 && f.NetlinkDelay == 0 && f.CorruptCounters == 0
+}
+
+// String describes the faults
+func (f Faults) String() string {
+	var faults []string
+	if f.DropIKE > 0 {
+		faults = append(faults, fmt.Sprintf("%d%% of IKE packets dropped", f.DropIKE))
+	}
+	if f.NetlinkDelay > 0 {
+		faults = append(faults, fmt.Sprintf("netlink delayed %s", f.NetlinkDelay))
+	}
+	if f.CorruptCounters > 0 {
+		faults = append(faults, fmt.Sprintf("%d%% of counter reads corrupted", f.CorruptCounters))
+	}
+	if len(faults) == 0 {
+		return "none"
+	}
+	return strings.Join(faults, ", ")
+}
+
+// Enabled reports whether faults may be injected, with advanced.fault_injection
+func Enabled() bool {
+	return viper.GetBool("advanced.fault_injection")
+}
+
+// Load returns the faults set, whether or not they are in effect, or zero
+// faults if none are
+func Load() (Faults, error) {
+	var f Faults
+	path, err := faultsPath()
+	if err != nil {
+		return f, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("invalid faults in %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// Set injects faults until their deadline, in every ipsec-vpn process that
+// reads them from then on
+func Set(f Faults) error {
+	if !Enabled() {
+		return errors.New("fault injection is off, set advanced.fault_injection in a staging configuration")
+	}
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	if !f.Until.After(time.Now()) {
+		return errors.New("the faults must end in the future")
+	}
+	path, err := faultsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// Clear stops injecting faults, reporting whether any were set
+func Clear() (bool, error) {
+	path, err := faultsPath()
+	if err != nil {
+		return false, err
+	}
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Active returns the faults in effect: none unless fault injection is on and
+// the faults set have not ended. Faults that cannot be read are none.
+func Active() Faults {
+	if !Enabled() {
+		return Faults{}
+	}
+	f, err := Load()
+	if err != nil || !time.Now().Before(f.Until) {
+		return Faults{}
+	}
+	return f
+}
+
+// DelayNetlink waits for the netlink delay in effect
+func DelayNetlink() {
+	if d := Active().NetlinkDelay; d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// CorruptCounter returns a traffic counter as read, or, for the share of reads
+// corrupted, as it might come back wrong: reset to 0, gone backwards or with a
+// high bit flipped
+func CorruptCounter(v uint64) uint64 {
+	return corrupt(v, Active().CorruptCounters)
+}
+
+// corrupt corrupts a percentage of counter values
+func corrupt(v uint64, percent int) uint64 {
+	if percent == 0 || rand.IntN(100) >= percent {
+		return v
+	}
+	switch rand.IntN(3) {
+	case 0:
+		return 0
+	case 1:
+		if v > 0 {
+			return rand.Uint64N(v)
+		}
+		return 0
+	default:
+		return v ^ 1<<(32+rand.IntN(32))
+	}
+}
+
+// faultsPath returns the file the faults are kept in
+func faultsPath() (string, error) {
+	dir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "faults.json"), nil
+}
@@ -0,0 +1,76 @@
+package fault
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestFaults(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	f := Faults{DropIKE: 20, NetlinkDelay: time.Millisecond, Until: time.Now().Add(time.Hour)}
+	if err := Set(f); err == nil {
+		t.Fatal("Expected faults to be refused with fault injection off")
+	}
+	viper.Set("advanced.fault_injection", true)
+	defer viper.Set("advanced.fault_injection", nil)
+
+	for _, bad := range []Faults{
+		{DropIKE: 101, Until: f.Until},
+		{CorruptCounters: -1, Until: f.Until},
+		{NetlinkDelay: 2 * MaxNetlinkDelay, Until: f.Until},
+		{DropIKE: 1, Until: time.Now().Add(-time.Second)},
+	} {
+		if err := Set(bad); err == nil {
+			t.Errorf("Expected %+v to be refused", bad)
+		}
+	}
+
+	if err := Set(f); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if got := Active(); got.DropIKE != 20 || got.NetlinkDelay != time.Millisecond {
+		t.Errorf("Expected the faults set to be active, got %+v", got)
+	}
+	viper.Set("advanced.fault_injection", false)
+	if got := Active(); !got.None() {
+		t.Errorf("Expected no faults with fault injection off, got %+v", got)
+	}
+	viper.Set("advanced.fault_injection", true)
+
+	// Faults end on their own
+	f.Until = time.Now().Add(50 * time.Millisecond)
+	if err := Set(f); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := Active(); !got.None() {
+		t.Errorf("Expected the faults to have ended, got %+v", got)
+	}
+	if got, _ := Load(); got.DropIKE != 20 {
+		t.Errorf("Expected ended faults to still be shown, got %+v", got)
+	}
+
+	if cleared, err := Clear(); !cleared || err != nil {
+		t.Errorf("Expected the faults to be cleared, got %v, %v", cleared, err)
+	}
+	if cleared, _ := Clear(); cleared {
+		t.Error("Expected nothing left to clear")
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	for _, v := range []uint64{0, 1, 1 << 40, ^uint64(0)} {
+		if got := corrupt(v, 0); got != v {
+			t.Errorf("Expected %d untouched, got %d", v, got)
+		}
+		for range 100 {
+			if got := corrupt(v, 100); v > 0 && got == v {
+				t.Errorf("Expected %d to be corrupted", v)
+			}
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Package flowexport exports the connections carried by tunnels to a NetFlow v9
+// or IPFIX collector. The connections are sampled from conntrack, so the records
+// describe the decrypted traffic: the inner addresses, ports and protocol, the
+// bytes and packets since the previous sample, and the tunnel as the ingress
+// interface.
+package flowexport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+)
+
+// Export protocols
+const (
+	ProtocolIPFIX    = "ipfix"
+	ProtocolNetFlow9 = "netflow9"
+)
+
+// Protocols lists the export protocols
+var Protocols = []string{ProtocolIPFIX, ProtocolNetFlow9}
+
+// Record is the traffic in one direction of a connection through a tunnel
+// between two samples
+type Record struct {
+	Proto    uint8
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	Octets   uint64
+	Packets  uint64
+	TunnelID uint32 // Index of the tunnel interface
+	Egress   bool   // Towards the remote subnet
+	Start    time.Time
+	End      time.Time
+}
+
+// flowKey identifies a connection through a tunnel across samples
+type flowKey struct {
+	tunnel   string
+	proto    uint8
+	src, dst string
+	sport    uint16
+	dport    uint16
+}
+
+// Meter turns the running counters of conntrack into the traffic between samples
+type Meter struct {
+	last     map[flowKey]tunnel.Flow
+	lastTime time.Time
+}
+
+// NewMeter returns a meter that has not sampled anything yet
+func NewMeter() *Meter {
+	return &Meter{last: make(map[flowKey]tunnel.Flow)}
+}
+
+// Sample returns the traffic of the connections through the tunnels that are up
+// since the previous sample. A connection seen for the first time counts all
+// its traffic so far. Tunnels whose connections cannot be read are skipped.
+func (m *Meter) Sample(tunnels []*tunnel.Tunnel, now time.Time) []Record {
+	start := m.lastTime
+	if start.IsZero() {
+		start = now
+	}
+
+	seen := make(map[flowKey]tunnel.Flow)
+	var records []Record
+	for _, t := range tunnels {
+		if t.Status != tunnel.StatusUp {
+			continue
+		}
+		index, err := t.InterfaceIndex()
+		if err != nil {
+			continue
+		}
+		flows, err := tunnel.Flows(t.Name)
+		if err != nil {
+			continue
+		}
+		records = append(records, m.sample(t.Name, uint32(index), flows, seen, start, now)...)
+	}
+
+	// Connections conntrack has forgotten are not carried over
+	m.last = seen
+	m.lastTime = now
+	return records
+}
+
+// sample returns the records of the connections of one tunnel, adding them to seen
+func (m *Meter) sample(name string, id uint32, flows []tunnel.Flow, seen map[flowKey]tunnel.Flow, start, end time.Time) []Record {
+	var records []Record
+	for _, f := range flows {
+		key := flowKey{name, f.Proto, f.SrcIP.String(), f.DstIP.String(), f.SrcPort, f.DstPort}
+		seen[key] = f
+		last, ok := m.last[key]
+		if !ok || f.SentBytes < last.SentBytes || f.RecvBytes < last.RecvBytes {
+			last = tunnel.Flow{} // A new connection reusing the tuple
+		}
+
+		sent := Record{Proto: f.Proto, SrcIP: f.SrcIP, DstIP: f.DstIP, SrcPort: f.SrcPort, DstPort: f.DstPort,
+			Octets: f.SentBytes - last.SentBytes, Packets: f.SentPackets - last.SentPackets,
+			TunnelID: id, Egress: f.Outbound, Start: start, End: end}
+		recv := Record{Proto: f.Proto, SrcIP: f.DstIP, DstIP: f.SrcIP, SrcPort: f.DstPort, DstPort: f.SrcPort,
+			Octets: f.RecvBytes - last.RecvBytes, Packets: f.RecvPackets - last.RecvPackets,
+			TunnelID: id, Egress: !f.Outbound, Start: start, End: end}
+		for _, r := range []Record{sent, recv} {
+			if r.Octets > 0 {
+				records = append(records, r)
+			}
+		}
+	}
+	return records
+}
+
+// Template IDs of the IPv4 and IPv6 records
+const (
+	templateIPv4 = 256
+	templateIPv6 = 257
+)
+
+// recordsPerMessage keeps an export message of IPv6 records within a 1500 byte MTU
+const recordsPerMessage = 16
+
+// field is an information element of a template, with its length
+type field struct {
+	id, length uint16
+}
+
+// Exporter sends records to a collector over UDP
+type Exporter struct {
+	conn     net.Conn
+	protocol string
+	domain   uint32
+	sequence uint32
+	started  time.Time
+}
+
+// NewExporter returns an exporter sending to collector, a host and port, in
+// protocol. The observation domain, or source ID in NetFlow v9, is domain.
+func NewExporter(collector, protocol string, domain uint32) (*Exporter, error) {
+	if protocol != ProtocolIPFIX && protocol != ProtocolNetFlow9 {
+		return nil, fmt.Errorf("unknown protocol '%s', expected %s or %s", protocol, ProtocolIPFIX, ProtocolNetFlow9)
+	}
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to collector %s: %v", collector, err)
+	}
+	return &Exporter{conn: conn, protocol: protocol, domain: domain, started: time.Now()}, nil
+}
+
+// Close closes the connection to the collector
+func (e *Exporter) Close() error {
+	return e.conn.Close()
+}
+
+// Export sends records to the collector, with the templates in every message so
+// that a collector started later can decode them straight away
+func (e *Exporter) Export(records []Record, now time.Time) error {
+	for len(records) > 0 {
+		n := min(len(records), recordsPerMessage)
+		if _, err := e.conn.Write(e.encode(records[:n], now)); err != nil {
+			return fmt.Errorf("failed to send to collector: %v", err)
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// templates returns the fields of the IPv4 and IPv6 templates
+func (e *Exporter) templates() map[uint16][]field {
+	// IPFIX has absolute timestamps, NetFlow v9 times relative to the exporter's uptime
+	times := []field{{152, 8}, {153, 8}} // flowStartMilliseconds, flowEndMilliseconds
+	if e.protocol == ProtocolNetFlow9 {
+		times = []field{{22, 4}, {21, 4}} // FIRST_SWITCHED, LAST_SWITCHED
+	}
+	common := append([]field{
+		{7, 2},  // sourceTransportPort
+		{11, 2}, // destinationTransportPort
+		{4, 1},  // protocolIdentifier
+		{1, 8},  // octetDeltaCount
+		{2, 8},  // packetDeltaCount
+		{10, 4}, // ingressInterface
+		{61, 1}, // flowDirection
+	}, times...)
+	return map[uint16][]field{
+		templateIPv4: append([]field{{8, 4}, {12, 4}}, common...),    // sourceIPv4Address, destinationIPv4Address
+		templateIPv6: append([]field{{27, 16}, {28, 16}}, common...), // sourceIPv6Address, destinationIPv6Address
+	}
+}
+
+// encode builds one export message holding the templates and records
+func (e *Exporter) encode(records []Record, now time.Time) []byte {
+	templates := e.templates()
+	netflow := e.protocol == ProtocolNetFlow9
+
+	// Template set: ID 2 in IPFIX, 0 in NetFlow v9
+	set := []byte{}
+	for _, id := range []uint16{templateIPv4, templateIPv6} {
+		set = binary.BigEndian.AppendUint16(set, id)
+		set = binary.BigEndian.AppendUint16(set, uint16(len(templates[id])))
+		for _, f := range templates[id] {
+			set = binary.BigEndian.AppendUint16(set, f.id)
+			set = binary.BigEndian.AppendUint16(set, f.length)
+		}
+	}
+	setID := uint16(2)
+	if netflow {
+		setID = 0
+	}
+	body := appendSet(nil, setID, set, netflow)
+
+	// One data set per template
+	for _, id := range []uint16{templateIPv4, templateIPv6} {
+		var data []byte
+		for _, r := range records {
+			if (r.SrcIP.To4() != nil) == (id == templateIPv4) {
+				data = e.appendRecord(data, r)
+			}
+		}
+		if len(data) > 0 {
+			body = appendSet(body, id, data, netflow)
+		}
+	}
+
+	var msg []byte
+	if netflow {
+		msg = binary.BigEndian.AppendUint16(msg, 9)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(2+len(records))) // Template and data records
+		msg = binary.BigEndian.AppendUint32(msg, e.uptime(now))
+		msg = binary.BigEndian.AppendUint32(msg, uint32(now.Unix()))
+		msg = binary.BigEndian.AppendUint32(msg, e.sequence)
+		msg = binary.BigEndian.AppendUint32(msg, e.domain)
+		e.sequence++ // Counts messages
+	} else {
+		msg = binary.BigEndian.AppendUint16(msg, 10)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(16+len(body)))
+		msg = binary.BigEndian.AppendUint32(msg, uint32(now.Unix()))
+		msg = binary.BigEndian.AppendUint32(msg, e.sequence)
+		msg = binary.BigEndian.AppendUint32(msg, e.domain)
+		e.sequence += uint32(len(records)) // Counts data records
+	}
+	return append(msg, body...)
+}
+
+// appendRecord encodes a record in the field order of the templates
+func (e *Exporter) appendRecord(b []byte, r Record) []byte {
+	if ip := r.SrcIP.To4(); ip != nil {
+		b = append(b, ip...)
+		b = append(b, r.DstIP.To4()...)
+	} else {
+		b = append(b, r.SrcIP.To16()...)
+		b = append(b, r.DstIP.To16()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, r.SrcPort)
+	b = binary.BigEndian.AppendUint16(b, r.DstPort)
+	b = append(b, r.Proto)
+	b = binary.BigEndian.AppendUint64(b, r.Octets)
+	b = binary.BigEndian.AppendUint64(b, r.Packets)
+	b = binary.BigEndian.AppendUint32(b, r.TunnelID)
+	if r.Egress {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	if e.protocol == ProtocolNetFlow9 {
+		b = binary.BigEndian.AppendUint32(b, e.uptime(r.Start))
+		return binary.BigEndian.AppendUint32(b, e.uptime(r.End))
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Start.UnixMilli()))
+	return binary.BigEndian.AppendUint64(b, uint64(r.End.UnixMilli()))
+}
+
+// uptime returns the milliseconds from the start of the exporter to t
+func (e *Exporter) uptime(t time.Time) uint32 {
+	return uint32(max(t.Sub(e.started), 0).Milliseconds())
+}
+
+// appendSet appends a set, or flowset in NetFlow v9, padding it to 32 bits as
+// NetFlow v9 requires
+func appendSet(b []byte, id uint16, content []byte, pad bool) []byte {
+	padding := 0
+	if pad {
+		padding = (4 - len(content)%4) % 4
+	}
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(content)+padding))
+	b = append(b, content...)
+	return append(b, make([]byte, padding)...)
+}
@@ -0,0 +1,118 @@
+package flowexport
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+)
+
+func TestMeterSample(t *testing.T) {
+	m := NewMeter()
+	flow := tunnel.Flow{Proto: 6, SrcIP: net.ParseIP("10.1.0.5"), DstIP: net.ParseIP("10.2.0.9"), SrcPort: 40000, DstPort: 443,
+		Outbound: true, SentBytes: 1000, RecvBytes: 5000, SentPackets: 10, RecvPackets: 8}
+	start := time.Unix(1700000000, 0)
+
+	seen := make(map[flowKey]tunnel.Flow)
+	records := m.sample("office", 7, []tunnel.Flow{flow}, seen, start, start.Add(time.Minute))
+	if len(records) != 2 {
+		t.Fatalf("Expected a record for each direction, got %+v", records)
+	}
+	if r := records[0]; r.Octets != 1000 || r.Packets != 10 || !r.Egress || r.TunnelID != 7 || r.DstPort != 443 {
+		t.Errorf("Unexpected record of the sent traffic %+v", r)
+	}
+	if r := records[1]; r.Octets != 5000 || r.Egress || r.SrcPort != 443 || !r.SrcIP.Equal(flow.DstIP) {
+		t.Errorf("Unexpected record of the received traffic %+v", r)
+	}
+
+	// Only the traffic since the last sample counts, and idle directions are left out
+	m.last = seen
+	flow.SentBytes, flow.SentPackets = 1500, 14
+	records = m.sample("office", 7, []tunnel.Flow{flow}, make(map[flowKey]tunnel.Flow), start, start.Add(time.Minute))
+	if len(records) != 1 || records[0].Octets != 500 || records[0].Packets != 4 {
+		t.Errorf("Expected 500 bytes in 4 packets sent since the last sample, got %+v", records)
+	}
+}
+
+func TestExport(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer collector.Close()
+
+	records := []Record{
+		{Proto: 17, SrcIP: net.ParseIP("10.1.0.5"), DstIP: net.ParseIP("10.2.0.9"), SrcPort: 5353, DstPort: 53, Octets: 60, Packets: 1},
+		{Proto: 6, SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd01::1"), SrcPort: 40000, DstPort: 443, Octets: 900, Packets: 3},
+	}
+	now := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		protocol string
+		version  uint16
+		sequence uint32 // Of the second message
+	}{
+		{ProtocolIPFIX, 10, 2},
+		{ProtocolNetFlow9, 9, 1},
+	} {
+		exporter, err := NewExporter(collector.LocalAddr().String(), tc.protocol, 42)
+		if err != nil {
+			t.Fatalf("NewExporter failed: %v", err)
+		}
+		for range 2 {
+			if err := exporter.Export(records, now); err != nil {
+				t.Fatalf("Export failed: %v", err)
+			}
+		}
+		exporter.Close()
+
+		buf := make([]byte, 1500)
+		collector.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := collector.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("No %s message received: %v", tc.protocol, err)
+		}
+		if version := binary.BigEndian.Uint16(buf); version != tc.version {
+			t.Errorf("Expected version %d, got %d", tc.version, version)
+		}
+		if tc.protocol == ProtocolIPFIX && int(binary.BigEndian.Uint16(buf[2:])) != n {
+			t.Errorf("Expected the IPFIX length to be %d, got %d", n, binary.BigEndian.Uint16(buf[2:]))
+		}
+		if tc.protocol == ProtocolNetFlow9 && binary.BigEndian.Uint16(buf[2:]) != 4 {
+			t.Errorf("Expected 2 template and 2 data records, got %d", binary.BigEndian.Uint16(buf[2:]))
+		}
+
+		n, _, err = collector.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("No second %s message received: %v", tc.protocol, err)
+		}
+		header := 16
+		if tc.protocol == ProtocolNetFlow9 {
+			header = 20
+		}
+		if sequence := binary.BigEndian.Uint32(buf[header-8:]); sequence != tc.sequence {
+			t.Errorf("Expected %s sequence %d, got %d", tc.protocol, tc.sequence, sequence)
+		}
+		if domain := binary.BigEndian.Uint32(buf[header-4:]); domain != 42 {
+			t.Errorf("Expected domain 42, got %d", domain)
+		}
+
+		// Template set, then a data set per address family, each a whole number of bytes
+		sets := 0
+		for offset := header; offset < n; sets++ {
+			length := int(binary.BigEndian.Uint16(buf[offset+2:]))
+			if length < 4 {
+				t.Fatalf("Invalid set length %d", length)
+			}
+			offset += length
+		}
+		if sets != 3 {
+			t.Errorf("Expected 3 sets in a %s message, got %d", tc.protocol, sets)
+		}
+	}
+
+	if _, err := NewExporter(collector.LocalAddr().String(), "sflow", 0); err == nil {
+		t.Error("Expected an unknown protocol to be refused")
+	}
+}
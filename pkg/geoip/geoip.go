@@ -0,0 +1,78 @@
+// Package geoip maps peer addresses to countries and autonomous systems using
+// MaxMind DB files such as GeoLite2-Country and GeoLite2-ASN.
+package geoip
+
+import (
+	"net"
+
+	"github.com/spf13/viper"
+)
+
+// Location is what the databases know about an address. Fields are empty when
+// the address is not in a database.
+type Location struct {
+	Country      string // ISO 3166-1 alpha-2 code, e.g. DE
+	ASN          uint
+	Organization string
+}
+
+// Locator looks up addresses in a country database, an ASN database or both
+type Locator struct {
+	country *Database
+	asn     *Database
+}
+
+// NewLocator opens the databases at the given paths. Either may be empty.
+func NewLocator(countryPath, asnPath string) (*Locator, error) {
+	l := &Locator{}
+	var err error
+	if countryPath != "" {
+		if l.country, err = Open(countryPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if l.asn, err = Open(asnPath); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// LocatorFromConfig opens the databases set in security.geoip_country_database
+// and security.geoip_asn_database. It returns nil if neither is set.
+func LocatorFromConfig() (*Locator, error) {
+	countryPath := viper.GetString("security.geoip_country_database")
+	asnPath := viper.GetString("security.geoip_asn_database")
+	if countryPath == "" && asnPath == "" {
+		return nil, nil
+	}
+	return NewLocator(countryPath, asnPath)
+}
+
+// Locate looks an address up in the databases
+func (l *Locator) Locate(ip net.IP) (Location, error) {
+	var loc Location
+	if l.country != nil {
+		record, err := l.country.Lookup(ip)
+		if err != nil {
+			return loc, err
+		}
+		// Fall back to where the network is registered for addresses without a country
+		for _, key := range []string{"country", "registered_country"} {
+			if country, ok := record[key].(map[string]any); ok && loc.Country == "" {
+				loc.Country, _ = country["iso_code"].(string)
+			}
+		}
+	}
+	if l.asn != nil {
+		record, err := l.asn.Lookup(ip)
+		if err != nil {
+			return loc, err
+		}
+		asn, _ := record["autonomous_system_number"].(uint64)
+		loc.ASN = uint(asn)
+		loc.Organization, _ = record["autonomous_system_organization"].(string)
+	}
+	return loc, nil
+}
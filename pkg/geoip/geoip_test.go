@@ -0,0 +1,156 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// encode encodes a value in the MaxMind DB data format. Only what the tests
+// need is supported.
+func encode(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		if len(v) >= 29 {
+			return append([]byte{2<<5 | 29, byte(len(v) - 29)}, v...)
+		}
+		return append([]byte{2<<5 | byte(len(v))}, v...)
+	case uint16:
+		return []byte{5<<5 | 2, byte(v >> 8), byte(v)}
+	case uint32:
+		return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := []byte{7<<5 | byte(len(v))}
+		for _, k := range keys {
+			out = append(out, encode(k)...)
+			out = append(out, encode(v[k])...)
+		}
+		return out
+	}
+	panic("unsupported type")
+}
+
+// writeDatabase writes a database with 24-bit records mapping networks to records
+func writeDatabase(t *testing.T, ipVersion uint16, networks map[string]map[string]any) string {
+	t.Helper()
+
+	type node struct{ records [2]int } // Node index, or -1 for empty, or -2-data for a record
+	nodes := []node{{[2]int{-1, -1}}}
+	var data []byte
+	var offsets []int
+
+	for cidr, record := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := network.IP.To4()
+		ones, _ := network.Mask.Size()
+		if ipVersion == 6 {
+			// IPv4 addresses live under ::/96 in an IPv6 tree
+			addr = append(make([]byte, 12), addr...)
+			ones += 96
+		}
+
+		offsets = append(offsets, len(data))
+		data = append(data, encode(record)...)
+
+		current := 0
+		for i := 0; i < ones; i++ {
+			bit := addr[i/8] >> (7 - i%8) & 1
+			if i == ones-1 {
+				nodes[current].records[bit] = -2 - (len(offsets) - 1)
+				break
+			}
+			if nodes[current].records[bit] < 0 {
+				nodes = append(nodes, node{[2]int{-1, -1}})
+				nodes[current].records[bit] = len(nodes) - 1
+			}
+			current = nodes[current].records[bit]
+		}
+	}
+
+	count := len(nodes)
+	var buf []byte
+	for _, n := range nodes {
+		for _, r := range n.records {
+			value := r
+			switch {
+			case r == -1:
+				value = count
+			case r <= -2:
+				value = count + dataSectionSeparator + offsets[-2-r]
+			}
+			buf = append(buf, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	buf = append(buf, make([]byte, dataSectionSeparator)...)
+	buf = append(buf, data...)
+	buf = append(buf, metadataMarker...)
+	buf = append(buf, encode(map[string]any{
+		"node_count":    uint32(count),
+		"record_size":   uint16(24),
+		"ip_version":    ipVersion,
+		"database_type": "Test",
+	})...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLocate(t *testing.T) {
+	country := writeDatabase(t, 6, map[string]map[string]any{
+		"192.0.2.0/24":    {"country": map[string]any{"iso_code": "DE"}},
+		"198.51.100.0/25": {"registered_country": map[string]any{"iso_code": "NL"}},
+	})
+	asn := writeDatabase(t, 4, map[string]map[string]any{
+		"192.0.2.128/25": {"autonomous_system_number": uint32(64500), "autonomous_system_organization": "Example Net"},
+	})
+
+	locator, err := NewLocator(country, asn)
+	if err != nil {
+		t.Fatalf("NewLocator failed: %v", err)
+	}
+	if locator.country.Type != "Test" {
+		t.Errorf("Expected database type Test, got %q", locator.country.Type)
+	}
+
+	for _, tc := range []struct {
+		ip   string
+		want Location
+	}{
+		{"192.0.2.1", Location{Country: "DE"}},
+		{"192.0.2.200", Location{Country: "DE", ASN: 64500, Organization: "Example Net"}},
+		{"198.51.100.7", Location{Country: "NL"}},
+		{"198.51.100.200", Location{}},
+		{"203.0.113.1", Location{}},
+		{"2001:db8::1", Location{}},
+	} {
+		got, err := locator.Locate(net.ParseIP(tc.ip))
+		if err != nil {
+			t.Errorf("Locate(%s) failed: %v", tc.ip, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Locate(%s) = %+v, expected %+v", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.mmdb")
+	os.WriteFile(path, []byte("not a database"), 0644)
+	if _, err := Open(path); err == nil {
+		t.Error("Expected opening a file without metadata to fail")
+	}
+}
@@ -0,0 +1,141 @@
+package guard
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/spf13/viper"
+)
+
+// failureTag marks authentication failure lines, so filters can match them
+const failureTag = "ipsec-vpn auth-failure"
+
+// AuthFailure is a peer that failed IKE authentication
+type AuthFailure struct {
+	Time     time.Time
+	Source   net.IP
+	Tunnel   string // Empty if the peer matched no tunnel
+	Identity string // The IKE identity the peer presented
+	Reason   string
+}
+
+// String formats the failure as one line of the auth failure log:
+//
+//	2026-01-02T15:04:05Z ipsec-vpn auth-failure src=198.51.100.7 tunnel=office identity="vpn@example.com" reason="no matching PSK"
+//
+// This format is relied on by fail2ban and CrowdSec filters and must not change.
+// Identity and reason are quoted, so a peer cannot forge other fields.
+func (f AuthFailure) String() string {
+	tunnel := f.Tunnel
+	if tunnel == "" {
+		tunnel = "-"
+	}
+	return fmt.Sprintf("%s %s src=%s tunnel=%s identity=%s reason=%s", f.Time.UTC().Format(time.RFC3339),
+		failureTag, f.Source, tunnel, strconv.Quote(f.Identity), strconv.Quote(f.Reason))
+}
+
+// ParseAuthFailure parses a line of the auth failure log
+func ParseAuthFailure(line string) (AuthFailure, error) {
+	var f AuthFailure
+	timestamp, rest, _ := strings.Cut(line, " ")
+	rest, ok := strings.CutPrefix(rest, failureTag+" ")
+	if !ok {
+		return f, fmt.Errorf("not an auth failure line")
+	}
+	var err error
+	if f.Time, err = time.Parse(time.RFC3339, timestamp); err != nil {
+		return f, err
+	}
+
+	for rest != "" {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return f, fmt.Errorf("malformed field %q", rest)
+		}
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return f, fmt.Errorf("malformed %s: %v", key, err)
+			}
+			rest = strings.TrimPrefix(value[len(quoted):], " ")
+			value, _ = strconv.Unquote(quoted)
+		} else {
+			value, rest, _ = strings.Cut(value, " ")
+		}
+
+		switch key {
+		case "src":
+			f.Source = net.ParseIP(value)
+		case "tunnel":
+			if value != "-" {
+				f.Tunnel = value
+			}
+		case "identity":
+			f.Identity = value
+		case "reason":
+			f.Reason = value
+		}
+	}
+	if f.Source == nil {
+		return f, fmt.Errorf("missing source address")
+	}
+	return f, nil
+}
+
+// AuthFailureLogPath returns the file authentication failures are written to,
+// security.auth_failure_log or auth-failures.log in the log directory
+func AuthFailureLogPath() string {
+	if path := viper.GetString("security.auth_failure_log"); path != "" {
+		return path
+	}
+	return filepath.Join(logger.Directory(), "auth-failures.log")
+}
+
+// LogAuthFailure appends an authentication failure to the auth failure log
+func LogAuthFailure(f AuthFailure) error {
+	if f.Time.IsZero() {
+		f.Time = time.Now()
+	}
+
+	path := AuthFailureLogPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintln(file, f)
+	return err
+}
+
+// ReadAuthFailures returns the authentication failures logged since a time
+func ReadAuthFailures(since time.Time) ([]AuthFailure, error) {
+	file, err := os.Open(AuthFailureLogPath())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var failures []AuthFailure
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f, err := ParseAuthFailure(scanner.Text())
+		if err != nil {
+			continue // Skip lines cut short by a crash
+		}
+		if !f.Time.Before(since) {
+			failures = append(failures, f)
+		}
+	}
+	return failures, scanner.Err()
+}
@@ -0,0 +1,382 @@
+// Package guard protects the IKE responder against denial of service: it asks
+// for IKEv2 cookies once too many negotiations are half-open, limits half-open
+// negotiations per source, temporarily blacklists sources that keep failing
+// authentication and can restrict peers to allowed countries or networks.
+package guard
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/geoip"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/spf13/viper"
+)
+
+// secretLifetime is how long a cookie secret is used before it is replaced. Cookies
+// made with the previous secret are still accepted, per RFC 7296 section 2.6.
+const secretLifetime = 5 * time.Minute
+
+var (
+	ErrBlacklisted    = errors.New("source is blacklisted")
+	ErrRateLimited    = errors.New("too many half-open negotiations from source")
+	ErrCookieRequired = errors.New("cookie required")
+	ErrGeoBlocked     = errors.New("source is outside the allowed countries and networks")
+)
+
+// Limits configures the protections. A zero value turns the protection off.
+type Limits struct {
+	CookieThreshold      int           // Half-open negotiations before cookies are required
+	MaxHalfOpenPerSource int           // Half-open negotiations allowed from one source
+	BlacklistFailures    int           // Authentication failures before a source is blacklisted
+	BlacklistDuration    time.Duration // How long a source stays blacklisted, and the window failures are counted in
+	AllowCountries       []string      // Countries peers may connect from, if any are set
+	AllowASNs            []uint        // Autonomous systems peers may connect from, if any are set
+}
+
+// LimitsFromConfig reads the limits from the security settings
+func LimitsFromConfig() Limits {
+	var asns []uint
+	for _, asn := range viper.GetIntSlice("security.geoip_allow_asns") {
+		asns = append(asns, uint(asn))
+	}
+	return Limits{
+		CookieThreshold:      viper.GetInt("security.cookie_threshold"),
+		MaxHalfOpenPerSource: viper.GetInt("security.max_half_open_per_source"),
+		BlacklistFailures:    viper.GetInt("security.blacklist_failures"),
+		BlacklistDuration:    time.Duration(viper.GetInt("security.blacklist_duration")) * time.Second,
+		AllowCountries:       viper.GetStringSlice("security.geoip_allow_countries"),
+		AllowASNs:            asns,
+	}
+}
+
+// Stats counts what the guard has done since it started
+type Stats struct {
+	CookiesSent     uint64 // Cookie challenges sent
+	CookiesRejected uint64 // Requests with a wrong or stale cookie
+	RateLimited     uint64 // Requests refused for too many half-open negotiations
+	AuthFailures    uint64 // Authentication failures reported
+	Blacklisted     uint64 // Sources blacklisted
+	Blocked         uint64 // Requests refused from blacklisted sources
+	GeoBlocked      uint64 // Requests refused from outside the allowed countries and networks
+	Malformed       uint64 // Datagrams that were not a well-formed IKE_SA_INIT request
+	HalfOpen        int    // Negotiations currently half-open
+	BlacklistSize   int    // Sources currently blacklisted
+}
+
+// Ban is a blacklisted source
+type Ban struct {
+	Source   string
+	Failures int
+	Until    time.Time
+}
+
+// Guard tracks negotiations for the IKE responder. It is safe for concurrent use.
+type Guard struct {
+	mu       sync.Mutex
+	limits   Limits
+	now      func() time.Time
+	secrets  [2][]byte // Current and previous cookie secret
+	version  byte      // Version of the current secret, sent with each cookie
+	rotated  time.Time
+	halfOpen map[string]int
+	total    int
+	failures map[string][]time.Time
+	banned   map[string]*Ban
+	locator  *geoip.Locator
+	stats    Stats
+}
+
+// New returns a guard enforcing the given limits
+func New(limits Limits) *Guard {
+	g := &Guard{
+		limits:   limits,
+		now:      time.Now,
+		halfOpen: make(map[string]int),
+		failures: make(map[string][]time.Time),
+		banned:   make(map[string]*Ban),
+	}
+	g.rotateLocked()
+	return g
+}
+
+// UseGeoIP restricts peers to the allowed countries and autonomous systems,
+// looking sources up with a locator
+func (g *Guard) UseGeoIP(locator *geoip.Locator) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.locator = locator
+}
+
+// Admit decides whether to answer an IKE_SA_INIT request from a source. The SPI
+// and nonce are the initiator's. When a cookie is required and the request did
+// not carry a valid one, Admit returns ErrCookieRequired along with the cookie to
+// send back in a COOKIE notify. An admitted negotiation stays half-open until
+// Release is called.
+func (g *Guard) Admit(source net.IP, spi, nonce, cookie []byte) ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := source.String()
+	if g.bannedLocked(key) {
+		g.stats.Blocked++
+		return nil, ErrBlacklisted
+	}
+	if !g.geoAllowedLocked(source) {
+		g.stats.GeoBlocked++
+		return nil, ErrGeoBlocked
+	}
+	if g.limits.MaxHalfOpenPerSource > 0 && g.halfOpen[key] >= g.limits.MaxHalfOpenPerSource {
+		g.stats.RateLimited++
+		return nil, ErrRateLimited
+	}
+
+	if g.limits.CookieThreshold > 0 && g.total >= g.limits.CookieThreshold {
+		if g.now().Sub(g.rotated) >= secretLifetime {
+			g.rotateLocked()
+		}
+		if !g.validCookieLocked(source, spi, nonce, cookie) {
+			if len(cookie) > 0 {
+				g.stats.CookiesRejected++
+			}
+			g.stats.CookiesSent++
+			return g.cookieLocked(0, source, spi, nonce), ErrCookieRequired
+		}
+	}
+
+	g.halfOpen[key]++
+	g.total++
+	return nil, nil
+}
+
+// Release ends a half-open negotiation admitted from a source, whether it was
+// established, failed or timed out
+func (g *Guard) Release(source net.IP) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := source.String()
+	if g.halfOpen[key] == 0 {
+		return
+	}
+	g.halfOpen[key]--
+	g.total--
+	if g.halfOpen[key] == 0 {
+		delete(g.halfOpen, key)
+	}
+}
+
+// AuthFailed records an authentication failure, writing it to the auth failure
+// log, and reports whether its source is now blacklisted
+func (g *Guard) AuthFailed(f AuthFailure) bool {
+	if f.Time.IsZero() {
+		f.Time = g.now()
+	}
+	if err := LogAuthFailure(f); err != nil {
+		logger.IKE.Error("Failed to log authentication failure from %s: %v", f.Source, err)
+	}
+	e := events.New(events.TypeAuthFailure, f.Tunnel)
+	e.Time = f.Time.UTC()
+	e.Source = f.Source.String()
+	e.Reason = f.Reason
+	events.Publish(e)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.stats.AuthFailures++
+	if g.limits.BlacklistFailures <= 0 {
+		return false
+	}
+
+	key := f.Source.String()
+	now := f.Time
+	recent := g.failures[key][:0]
+	for _, t := range g.failures[key] {
+		if now.Sub(t) < g.limits.BlacklistDuration {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	g.failures[key] = recent
+
+	if len(recent) < g.limits.BlacklistFailures {
+		return false
+	}
+	delete(g.failures, key)
+	g.banned[key] = &Ban{Source: key, Failures: len(recent), Until: now.Add(g.limits.BlacklistDuration)}
+	g.stats.Blacklisted++
+	logger.IKE.Info("Blacklisted %s for %s after %d authentication failures", key, g.limits.BlacklistDuration, len(recent))
+	return true
+}
+
+// Unban removes a source from the blacklist
+func (g *Guard) Unban(source net.IP) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := source.String()
+	_, ok := g.banned[key]
+	delete(g.banned, key)
+	return ok
+}
+
+// Blacklist returns the sources currently blacklisted
+func (g *Guard) Blacklist() []Ban {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var bans []Ban
+	for key, ban := range g.banned {
+		if g.bannedLocked(key) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Source < bans[j].Source })
+	return bans
+}
+
+// Stats returns the guard's counters
+func (g *Guard) Stats() Stats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for key := range g.banned {
+		g.bannedLocked(key)
+	}
+	stats := g.stats
+	stats.HalfOpen = g.total
+	stats.BlacklistSize = len(g.banned)
+	return stats
+}
+
+// WriteMetrics writes the guard's counters in the Prometheus text format
+func (g *Guard) WriteMetrics(w io.Writer) error {
+	stats := g.Stats()
+	for _, m := range []struct {
+		name, kind, help string
+		value            uint64
+	}{
+		{"ipsec_vpn_ike_cookies_sent_total", "counter", "IKEv2 cookie challenges sent.", stats.CookiesSent},
+		{"ipsec_vpn_ike_cookies_rejected_total", "counter", "IKE_SA_INIT requests with an invalid cookie.", stats.CookiesRejected},
+		{"ipsec_vpn_ike_rate_limited_total", "counter", "IKE_SA_INIT requests refused for too many half-open negotiations.", stats.RateLimited},
+		{"ipsec_vpn_ike_auth_failures_total", "counter", "IKE authentication failures.", stats.AuthFailures},
+		{"ipsec_vpn_ike_blacklisted_total", "counter", "Sources blacklisted after repeated authentication failures.", stats.Blacklisted},
+		{"ipsec_vpn_ike_blocked_total", "counter", "IKE requests refused from blacklisted sources.", stats.Blocked},
+		{"ipsec_vpn_ike_geo_blocked_total", "counter", "IKE requests refused from outside the allowed countries and networks.", stats.GeoBlocked},
+		{"ipsec_vpn_ike_malformed_total", "counter", "Datagrams refused as malformed IKE_SA_INIT requests.", stats.Malformed},
+		{"ipsec_vpn_ike_half_open", "gauge", "IKE negotiations currently half-open.", uint64(stats.HalfOpen)},
+		{"ipsec_vpn_ike_blacklist_size", "gauge", "Sources currently blacklisted.", uint64(stats.BlacklistSize)},
+	} {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GeoAllowed reports whether a location is on the allow-list. Without an
+// allow-list every location is allowed; with one, a source must be in an allowed
+// country or an allowed autonomous system.
+func (l Limits) GeoAllowed(loc geoip.Location) bool {
+	if len(l.AllowCountries) == 0 && len(l.AllowASNs) == 0 {
+		return true
+	}
+	for _, country := range l.AllowCountries {
+		if strings.EqualFold(country, loc.Country) {
+			return true
+		}
+	}
+	return loc.ASN != 0 && slices.Contains(l.AllowASNs, loc.ASN)
+}
+
+// geoAllowedLocked checks a source against the allow-list. Private and other
+// non-global addresses are not in GeoIP databases and are always allowed.
+func (g *Guard) geoAllowedLocked(source net.IP) bool {
+	if g.locator == nil || (len(g.limits.AllowCountries) == 0 && len(g.limits.AllowASNs) == 0) {
+		return true
+	}
+	if !source.IsGlobalUnicast() || source.IsPrivate() {
+		return true
+	}
+
+	loc, err := g.locator.Locate(source)
+	if err != nil {
+		logger.IKE.Error("GeoIP lookup of %s failed: %v", source, err)
+		return false
+	}
+	if g.limits.GeoAllowed(loc) {
+		return true
+	}
+	logger.IKE.Info("Rejected IKE negotiation from %s (country %s, AS%d)", source, orUnknown(loc.Country), loc.ASN)
+	return false
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// bannedLocked reports whether a source is blacklisted, dropping expired bans
+func (g *Guard) bannedLocked(key string) bool {
+	ban, ok := g.banned[key]
+	if !ok {
+		return false
+	}
+	if !g.now().Before(ban.Until) {
+		delete(g.banned, key)
+		return false
+	}
+	return true
+}
+
+// rotateLocked replaces the cookie secret, keeping the previous one
+func (g *Guard) rotateLocked() {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("failed to generate cookie secret: %v", err))
+	}
+	g.secrets[1] = g.secrets[0]
+	g.secrets[0] = secret
+	g.version++
+	g.rotated = g.now()
+}
+
+// cookieLocked computes <version> | HMAC(secret, Ni | IPi | SPIi) with the
+// current (0) or previous (1) secret
+func (g *Guard) cookieLocked(secret int, source net.IP, spi, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, g.secrets[secret])
+	mac.Write(nonce)
+	if ip4 := source.To4(); ip4 != nil {
+		source = ip4
+	}
+	mac.Write(source)
+	mac.Write(spi)
+	return append([]byte{g.version - byte(secret)}, mac.Sum(nil)...)
+}
+
+func (g *Guard) validCookieLocked(source net.IP, spi, nonce, cookie []byte) bool {
+	if len(cookie) == 0 {
+		return false
+	}
+	for secret := range g.secrets {
+		if g.secrets[secret] != nil && cookie[0] == g.version-byte(secret) &&
+			hmac.Equal(cookie, g.cookieLocked(secret, source, spi, nonce)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package guard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/geoip"
+	"github.com/spf13/viper"
+)
+
+func TestCookieChallenge(t *testing.T) {
+	g := New(Limits{CookieThreshold: 1})
+	spi, nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte("nonce")
+
+	first := net.ParseIP("192.0.2.1")
+	if _, err := g.Admit(first, spi, nonce, nil); err != nil {
+		t.Fatalf("Expected the first negotiation to be admitted, got %v", err)
+	}
+
+	// Under load the request must be repeated with the cookie it was sent
+	source := net.ParseIP("192.0.2.2")
+	cookie, err := g.Admit(source, spi, nonce, nil)
+	if !errors.Is(err, ErrCookieRequired) || len(cookie) == 0 {
+		t.Fatalf("Expected a cookie challenge, got %x, %v", cookie, err)
+	}
+	if _, err := g.Admit(net.ParseIP("192.0.2.3"), spi, nonce, cookie); !errors.Is(err, ErrCookieRequired) {
+		t.Errorf("Expected a cookie for another source to be rejected, got %v", err)
+	}
+	if _, err := g.Admit(source, spi, nonce, cookie); err != nil {
+		t.Errorf("Expected the returned cookie to be accepted, got %v", err)
+	}
+
+	// Cookies from the previous secret remain valid after a rotation
+	cookie, _ = g.Admit(source, spi, nonce, nil)
+	g.now = func() time.Time { return time.Now().Add(secretLifetime) }
+	if _, err := g.Admit(source, spi, nonce, cookie); err != nil {
+		t.Errorf("Expected a cookie from the previous secret to be accepted, got %v", err)
+	}
+
+	stats := g.Stats()
+	if stats.CookiesSent != 3 || stats.CookiesRejected != 1 || stats.HalfOpen != 3 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestHalfOpenLimit(t *testing.T) {
+	g := New(Limits{MaxHalfOpenPerSource: 2})
+	source := net.ParseIP("2001:db8::1")
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.Admit(source, nil, nil, nil); err != nil {
+			t.Fatalf("Expected negotiation %d to be admitted, got %v", i+1, err)
+		}
+	}
+	if _, err := g.Admit(source, nil, nil, nil); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected the third half-open negotiation to be refused, got %v", err)
+	}
+	if _, err := g.Admit(net.ParseIP("2001:db8::2"), nil, nil, nil); err != nil {
+		t.Errorf("Expected other sources to be unaffected, got %v", err)
+	}
+
+	g.Release(source)
+	if _, err := g.Admit(source, nil, nil, nil); err != nil {
+		t.Errorf("Expected a released slot to be reusable, got %v", err)
+	}
+}
+
+func TestBlacklist(t *testing.T) {
+	viper.Set("security.auth_failure_log", filepath.Join(t.TempDir(), "auth-failures.log"))
+	defer viper.Set("security.auth_failure_log", "")
+
+	g := New(Limits{BlacklistFailures: 3, BlacklistDuration: time.Minute})
+	source := net.ParseIP("198.51.100.7")
+	failure := AuthFailure{Source: source, Tunnel: "office", Reason: "no matching PSK"}
+	now := time.Now()
+	g.now = func() time.Time { return now }
+
+	// Failures outside the window are forgotten
+	g.AuthFailed(failure)
+	now = now.Add(2 * time.Minute)
+	if g.AuthFailed(failure) || g.AuthFailed(failure) {
+		t.Fatal("Expected no blacklisting before three failures within the window")
+	}
+	if !g.AuthFailed(failure) {
+		t.Fatal("Expected the third failure within the window to blacklist the source")
+	}
+	if _, err := g.Admit(source, nil, nil, nil); !errors.Is(err, ErrBlacklisted) {
+		t.Errorf("Expected a blacklisted source to be refused, got %v", err)
+	}
+	if bans := g.Blacklist(); len(bans) != 1 || bans[0].Source != "198.51.100.7" {
+		t.Errorf("Unexpected blacklist: %+v", bans)
+	}
+
+	var metrics bytes.Buffer
+	g.WriteMetrics(&metrics)
+	for _, want := range []string{"ipsec_vpn_ike_auth_failures_total 4", "ipsec_vpn_ike_blocked_total 1", "ipsec_vpn_ike_blacklist_size 1"} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, metrics.String())
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := g.Admit(source, nil, nil, nil); err != nil {
+		t.Errorf("Expected the ban to expire, got %v", err)
+	}
+
+	// Every failure is logged for fail2ban
+	failures, err := ReadAuthFailures(time.Time{})
+	if err != nil {
+		t.Fatalf("ReadAuthFailures failed: %v", err)
+	}
+	if len(failures) != 4 || !failures[3].Source.Equal(source) || failures[3].Tunnel != "office" {
+		t.Errorf("Unexpected logged failures: %+v", failures)
+	}
+}
+
+func TestAuthFailureFormat(t *testing.T) {
+	f := AuthFailure{
+		Time:     time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC),
+		Source:   net.ParseIP("2001:db8::7"),
+		Identity: `evil" src=192.0.2.1`,
+		Reason:   "no matching PSK",
+	}
+	line := f.String()
+	want := `2026-01-02T15:04:05Z ipsec-vpn auth-failure src=2001:db8::7 tunnel=- identity="evil\" src=192.0.2.1" reason="no matching PSK"`
+	if line != want {
+		t.Errorf("Expected %s, got %s", want, line)
+	}
+
+	got, err := ParseAuthFailure(line)
+	if err != nil {
+		t.Fatalf("ParseAuthFailure failed: %v", err)
+	}
+	if !got.Source.Equal(f.Source) || got.Identity != f.Identity || got.Reason != f.Reason || !got.Time.Equal(f.Time) {
+		t.Errorf("Expected %+v, got %+v", f, got)
+	}
+}
+
+func TestGeoAllowed(t *testing.T) {
+	if !(Limits{}).GeoAllowed(geoip.Location{}) {
+		t.Error("Expected every location to be allowed without an allow-list")
+	}
+
+	limits := Limits{AllowCountries: []string{"DE", "NL"}, AllowASNs: []uint{64500}}
+	for _, tc := range []struct {
+		loc  geoip.Location
+		want bool
+	}{
+		{geoip.Location{Country: "DE"}, true},
+		{geoip.Location{Country: "US", ASN: 64500}, true},
+		{geoip.Location{Country: "US", ASN: 64501}, false},
+		{geoip.Location{}, false},
+	} {
+		if got := limits.GeoAllowed(tc.loc); got != tc.want {
+			t.Errorf("GeoAllowed(%+v) = %v, expected %v", tc.loc, got, tc.want)
+		}
+	}
+}
+
+// saInit builds an IKE_SA_INIT request with a nonce and, if given, a COOKIE notify
+func saInit(spi, nonce, cookie []byte) []byte {
+	msg := make([]byte, headerLength)
+	copy(msg, spi)
+	msg[17], msg[18], msg[19] = 0x20, ExchangeSAInit, flagInitiator
+	last := 16
+	add := func(typ uint8, body []byte) {
+		msg[last] = typ
+		last = len(msg)
+		msg = append(msg, 0, 0)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(payloadHeaderLength+len(body)))
+		msg = append(msg, body...)
+	}
+	if cookie != nil {
+		add(PayloadNotify, append([]byte{0, 0, 0x40, 0x06}, cookie...))
+	}
+	add(PayloadNonce, nonce)
+	binary.BigEndian.PutUint32(msg[24:], uint32(len(msg)))
+	return msg
+}
+
+func TestAdmitMessage(t *testing.T) {
+	g := New(Limits{CookieThreshold: 1})
+	spi, nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}, bytes.Repeat([]byte{0xaa}, 32)
+
+	m, err := ParseMessage(saInit(spi, nonce, []byte("cookie")))
+	if err != nil {
+		t.Fatalf("ParseMessage failed: %v", err)
+	}
+	if !bytes.Equal(m.InitiatorSPI, spi) || !bytes.Equal(m.Payload(PayloadNonce), nonce) || string(m.Notify(NotifyCookie)) != "cookie" {
+		t.Errorf("Expected the SPI, nonce and cookie back, got %+v", m)
+	}
+
+	if _, err := g.AdmitMessage(net.ParseIP("192.0.2.1"), saInit(spi, nonce, nil)); err != nil {
+		t.Fatalf("Expected the first negotiation to be admitted, got %v", err)
+	}
+	source := net.ParseIP("192.0.2.2")
+	cookie, err := g.AdmitMessage(source, saInit(spi, nonce, nil))
+	if !errors.Is(err, ErrCookieRequired) {
+		t.Fatalf("Expected a cookie challenge, got %v", err)
+	}
+	if _, err := g.AdmitMessage(source, saInit(spi, nonce, cookie)); err != nil {
+		t.Errorf("Expected the request repeated with the cookie to be admitted, got %v", err)
+	}
+
+	ikev1 := saInit(spi, nonce, nil)
+	ikev1[17] = 0x10
+	for name, msg := range map[string][]byte{
+		"truncated":    saInit(spi, nonce, nil)[:40],
+		"short nonce":  saInit(spi, nonce[:8], nil),
+		"no SPI":       saInit(make([]byte, 8), nonce, nil),
+		"IKEv1":        ikev1,
+		"wrong length": append(saInit(spi, nonce, nil), 0),
+	} {
+		if _, err := g.AdmitMessage(source, msg); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: expected ErrMalformed, got %v", name, err)
+		}
+	}
+	if stats := g.Stats(); stats.Malformed != 5 {
+		t.Errorf("Expected 5 malformed requests, got %d", stats.Malformed)
+	}
+}
+
+// FuzzParseMessage feeds the parser what a peer on the internet might send:
+// it must never panic, and what it accepts must fit in the datagram
+func FuzzParseMessage(f *testing.F) {
+	spi, nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}, bytes.Repeat([]byte{0xaa}, 32)
+	f.Add(saInit(spi, nonce, nil))
+	f.Add(saInit(spi, nonce, []byte("cookie")))
+	f.Add(saInit(spi, nonce, nil)[:30])
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := ParseMessage(data)
+		if err != nil {
+			return
+		}
+		size := headerLength
+		for _, p := range m.Payloads {
+			size += payloadHeaderLength + len(p.Body)
+		}
+		if size != len(data) {
+			t.Errorf("Payloads of %d bytes in a message of %d", size, len(data))
+		}
+		m.Notify(NotifyCookie)
+
+		g := New(Limits{CookieThreshold: 1, MaxHalfOpenPerSource: 1})
+		if _, err := g.AdmitMessage(net.ParseIP("192.0.2.1"), data); err == nil && g.Stats().HalfOpen != 1 {
+			t.Errorf("Expected an admitted request to be half-open")
+		}
+	})
+}
+
+// FuzzParseAuthFailure checks that any line of the auth failure log, which
+// holds identities peers chose, parses without panicking and that failures
+// read back as written
+func FuzzParseAuthFailure(f *testing.F) {
+	f.Add(`2026-01-02T15:04:05Z ipsec-vpn auth-failure src=198.51.100.7 tunnel=office identity="vpn@example.com" reason="no matching PSK"`, "vpn@example.com")
+	f.Add(`2026-01-02T15:04:05Z ipsec-vpn auth-failure src=2001:db8::7 tunnel=- identity="evil\" src=192.0.2.1" reason="x"`, `"`)
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, line, identity string) {
+		ParseAuthFailure(line)
+
+		want := AuthFailure{Time: time.Unix(1767366245, 0).UTC(), Source: net.ParseIP("192.0.2.1"), Identity: identity, Reason: line}
+		got, err := ParseAuthFailure(want.String())
+		if err != nil {
+			t.Fatalf("ParseAuthFailure(%q) failed: %v", want.String(), err)
+		}
+		if got.Identity != identity || got.Reason != line {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package guard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// IKEv2 exchange, payload and notify message types the guard looks at, RFC 7296
+// section 3
+const (
+	ExchangeSAInit = 34
+	PayloadNonce   = 40
+	PayloadNotify  = 41
+	PayloadSK      = 46
+	NotifyCookie   = 16390
+)
+
+const (
+	headerLength        = 28
+	payloadHeaderLength = 4
+	flagInitiator       = 0x08
+	flagResponse        = 0x20
+	minNonceLength      = 16
+	maxNonceLength      = 256
+)
+
+// ErrMalformed is returned for datagrams that are not a well-formed IKEv2 message
+var ErrMalformed = errors.New("malformed IKE message")
+
+// Payload is a payload of an IKE message. Its body is a slice of the message.
+type Payload struct {
+	Type     uint8
+	Critical bool
+	Body     []byte
+}
+
+// Message is an IKEv2 message as received from a peer. Only the header and the
+// payload chain are parsed: the payloads of an encrypted (SK) payload are left
+// to the IKE daemon, which holds the keys.
+type Message struct {
+	InitiatorSPI []byte
+	ResponderSPI []byte
+	Version      uint8 // Major version in the high nibble, minor in the low
+	Exchange     uint8
+	Flags        uint8
+	MessageID    uint32
+	Payloads     []Payload
+}
+
+// ParseMessage parses an IKEv2 message, with the non-ESP marker of port 4500
+// already stripped. It never reads past the data, whatever a peer sends: a
+// length that does not match, a payload chain that runs over or leaves bytes
+// behind and a major version other than 2 are errors.
+func ParseMessage(data []byte) (*Message, error) {
+	if len(data) < headerLength {
+		return nil, fmt.Errorf("%w: %d bytes is shorter than the header", ErrMalformed, len(data))
+	}
+	m := &Message{
+		InitiatorSPI: data[0:8],
+		ResponderSPI: data[8:16],
+		Version:      data[17],
+		Exchange:     data[18],
+		Flags:        data[19],
+		MessageID:    binary.BigEndian.Uint32(data[20:24]),
+	}
+	if m.Version>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d.%d", ErrMalformed, m.Version>>4, m.Version&0x0f)
+	}
+	if length := binary.BigEndian.Uint32(data[24:28]); length != uint32(len(data)) {
+		return nil, fmt.Errorf("%w: length %d in the header, %d received", ErrMalformed, length, len(data))
+	}
+
+	next, offset := data[16], headerLength
+	for next != 0 {
+		if len(data)-offset < payloadHeaderLength {
+			return nil, fmt.Errorf("%w: payload %d cut short", ErrMalformed, next)
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if length < payloadHeaderLength || length > len(data)-offset {
+			return nil, fmt.Errorf("%w: payload %d has length %d", ErrMalformed, next, length)
+		}
+		m.Payloads = append(m.Payloads, Payload{
+			Type:     next,
+			Critical: data[offset+1]&0x80 != 0,
+			Body:     data[offset+payloadHeaderLength : offset+length],
+		})
+		// The next payload of an SK payload is the first one it encrypts
+		if next == PayloadSK {
+			offset += length
+			break
+		}
+		next, offset = data[offset], offset+length
+	}
+	if offset != len(data) {
+		return nil, fmt.Errorf("%w: %d bytes after the last payload", ErrMalformed, len(data)-offset)
+	}
+	return m, nil
+}
+
+// Response reports whether the message is a response rather than a request
+func (m *Message) Response() bool {
+	return m.Flags&flagResponse != 0
+}
+
+// Payload returns the body of the first payload of a type, nil if there is none
+func (m *Message) Payload(typ uint8) []byte {
+	for _, p := range m.Payloads {
+		if p.Type == typ {
+			return p.Body
+		}
+	}
+	return nil
+}
+
+// Notify returns the notification data of the first notify payload of a type,
+// nil if there is none
+func (m *Message) Notify(typ uint16) []byte {
+	for _, p := range m.Payloads {
+		if p.Type != PayloadNotify || len(p.Body) < 4 {
+			continue
+		}
+		spiSize := int(p.Body[1])
+		if binary.BigEndian.Uint16(p.Body[2:4]) == typ && len(p.Body) >= 4+spiSize {
+			return p.Body[4+spiSize:]
+		}
+	}
+	return nil
+}
+
+// AdmitMessage parses an IKE_SA_INIT request received from a source and
+// decides whether to answer it, as Admit does with the initiator's SPI, its
+// nonce and the COOKIE notify it carried. Anything but an IKE_SA_INIT request
+// is refused with ErrMalformed and counted.
+func (g *Guard) AdmitMessage(source net.IP, data []byte) ([]byte, error) {
+	m, err := ParseMessage(data)
+	if err == nil {
+		err = m.validSAInit()
+	}
+	if err != nil {
+		g.mu.Lock()
+		g.stats.Malformed++
+		g.mu.Unlock()
+		return nil, err
+	}
+	return g.Admit(source, m.InitiatorSPI, m.Payload(PayloadNonce), m.Notify(NotifyCookie))
+}
+
+// validSAInit checks that a message is the first of an IKE_SA_INIT exchange
+func (m *Message) validSAInit() error {
+	switch {
+	case m.Exchange != ExchangeSAInit:
+		return fmt.Errorf("%w: exchange %d is not IKE_SA_INIT", ErrMalformed, m.Exchange)
+	case m.Response() || m.Flags&flagInitiator == 0:
+		return fmt.Errorf("%w: IKE_SA_INIT is not a request from the initiator", ErrMalformed)
+	case m.MessageID != 0:
+		return fmt.Errorf("%w: IKE_SA_INIT has message ID %d", ErrMalformed, m.MessageID)
+	case binary.BigEndian.Uint64(m.InitiatorSPI) == 0 || binary.BigEndian.Uint64(m.ResponderSPI) != 0:
+		return fmt.Errorf("%w: IKE_SA_INIT needs an initiator SPI and no responder SPI", ErrMalformed)
+	}
+	if nonce := m.Payload(PayloadNonce); len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return fmt.Errorf("%w: IKE_SA_INIT nonce of %d bytes", ErrMalformed, len(nonce))
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Package history records the command lines that changed state, who ran them
+// and how they ended, so a change such as a deleted tunnel can be traced back
+// to its author. It is kept in the configuration directory, next to what the
+// commands changed, and is separate from the log.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultMaxEntries is how many entries are kept unless history.max_entries
+// says otherwise
+const DefaultMaxEntries = 10000
+
+// ResultOK is the result of a command that succeeded
+const ResultOK = "ok"
+
+// Entry is a command that was run
+type Entry struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	Command  string    `json:"command"`
+	Result   string    `json:"result"` // ResultOK, or why the command failed
+	ExitCode int       `json:"exit_code"`
+	Duration float64   `json:"duration"` // Seconds
+}
+
+// Failed reports whether the command failed
+func (e Entry) Failed() bool {
+	return e.Result != ResultOK
+}
+
+// Filter selects entries to show
+type Filter struct {
+	User   string
+	Match  string // Substring of the command line
+	Since  time.Time
+	Failed bool // Only failed commands
+}
+
+// Matches reports whether an entry is selected by the filter
+func (f Filter) Matches(e Entry) bool {
+	return (f.User == "" || e.User == f.User) &&
+		(f.Match == "" || strings.Contains(e.Command, f.Match)) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(!f.Failed || e.Failed())
+}
+
+// MaxEntries returns how many entries are kept
+func MaxEntries() int {
+	if n := viper.GetInt("history.max_entries"); n > 0 {
+		return n
+	}
+	return DefaultMaxEntries
+}
+
+// Record appends an entry, dropping the oldest beyond MaxEntries. Nothing is
+// recorded while the configuration directory does not exist, such as after
+// the configuration store was sealed or locked.
+func Record(e Entry) error {
+	path, err := Path()
+	if err != nil {
+		return err
+	}
+	return appendLine(path, e)
+}
+
+// appendLine appends v as a line of JSON to a file of the configuration
+// directory, dropping the oldest lines beyond MaxEntries. Nothing is written
+// while the directory does not exist.
+func appendLine(path string, v any) error {
+	if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Commands finishing at the same time take turns
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if drop := len(lines) + 1 - MaxEntries(); drop > 0 {
+		kept := append(bytes.Join(lines[drop:], nil), line...)
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		_, err = f.WriteAt(kept, 0)
+		return err
+	}
+	_, err = f.Write(line)
+	return err
+}
+
+// Load returns the entries selected by filter, oldest first
+func Load(filter Filter) ([]Entry, error) {
+	path, err := Path()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("invalid entry on line %d of %s: %v", n, path, err)
+		}
+		if filter.Matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Path returns the file the history is kept in
+func Path() (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "history.jsonl"), nil
+}
+
+// CommandLine formats arguments as a command line, quoting those a shell would
+// split or expand
+func CommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`*?[]{}()<>|&;#~!") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,102 @@
+package history
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestRecord(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	viper.Set("history.max_entries", 3)
+	defer viper.Set("config_dir", "")
+	defer viper.Set("history.max_entries", 0)
+
+	start := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	for i, e := range []Entry{
+		{User: "alice", Command: "ipsec-vpn tunnel create office", Result: ResultOK},
+		{User: "bob", Command: "ipsec-vpn tunnel start office", Result: ResultOK},
+		{User: "bob", Command: "ipsec-vpn tunnel delete office", Result: ResultOK},
+		{User: "alice", Command: "ipsec-vpn tunnel delete branch", Result: "tunnel 'branch' not found", ExitCode: 1},
+	} {
+		e.Time = start.Add(time.Duration(i) * time.Minute)
+		if err := Record(e); err != nil {
+			t.Fatalf("Record failed: %v", err)
+		}
+	}
+
+	entries, err := Load(Filter{})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(entries) != 3 || entries[0].Command != "ipsec-vpn tunnel start office" {
+		t.Fatalf("Expected the oldest entry to be dropped, got %+v", entries)
+	}
+	if entries, _ := Load(Filter{User: "bob", Match: "tunnel delete"}); len(entries) != 1 || entries[0].Command != "ipsec-vpn tunnel delete office" {
+		t.Errorf("Expected bob's delete, got %+v", entries)
+	}
+	if entries, _ := Load(Filter{Failed: true}); len(entries) != 1 || entries[0].User != "alice" {
+		t.Errorf("Expected the failed delete, got %+v", entries)
+	}
+	if entries, _ := Load(Filter{Since: start.Add(3 * time.Minute)}); len(entries) != 1 {
+		t.Errorf("Expected one entry since 09:03, got %+v", entries)
+	}
+
+	// Nothing is recorded without a configuration directory
+	viper.Set("config_dir", t.TempDir()+"/missing")
+	if err := Record(Entry{Command: "ipsec-vpn store lock"}); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := Load(Filter{}); len(entries) != 0 {
+		t.Error("Expected nothing to be recorded")
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	got := CommandLine([]string{"ipsec-vpn", "tunnel", "delete", "it's", "", "-y"})
+	if want := `ipsec-vpn tunnel delete 'it'\''s' '' -y`; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestRecordOperation(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	defer viper.Set("config_dir", "")
+
+	op := Operation{Source: SourceCLI, Args: []string{"tunnel", "start", "office"}, Result: ResultOK}
+	if err := RecordOperation(op); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := OperationsPath()
+	if _, err := LoadOperations(path); err == nil {
+		t.Fatal("Expected nothing to be recorded unless history.record_operations is on")
+	}
+
+	viper.Set("history.record_operations", true)
+	defer viper.Set("history.record_operations", false)
+	for _, op := range []Operation{
+		op,
+		{Source: SourceRESTCONF, Method: "DELETE", Path: "/restconf/data/ipsec-vpn:tunnels/tunnel=office", Result: "404 Not Found"},
+	} {
+		if err := RecordOperation(op); err != nil {
+			t.Fatalf("RecordOperation failed: %v", err)
+		}
+	}
+	ops, err := LoadOperations(path)
+	if err != nil {
+		t.Fatalf("LoadOperations failed: %v", err)
+	}
+	if len(ops) != 2 || ops[0].String() != "tunnel start office" || ops[1].String() != "DELETE /restconf/data/ipsec-vpn:tunnels/tunnel=office" {
+		t.Fatalf("Unexpected operations %+v", ops)
+	}
+
+	if err := appendLine(path, Operation{Source: "ssh", Result: ResultOK}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOperations(path); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("Expected the unknown source on line 3 to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/spf13/viper"
+)
+
+// Where operations were made
+const (
+	SourceCLI      = "cli"
+	SourceRESTCONF = "restconf"
+)
+
+// Operation is a change made through the command line or the RESTCONF API,
+// recorded with what it takes to make it again: the arguments of a command, or
+// the method, path and body of a request. Secrets are masked as in the
+// history, so a recording can be attached to a bug report.
+type Operation struct {
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+	User        string    `json:"user,omitempty"`
+	Args        []string  `json:"args,omitempty"` // Without the name of the program
+	Method      string    `json:"method,omitempty"`
+	Path        string    `json:"path,omitempty"` // With the query
+	ContentType string    `json:"content_type,omitempty"`
+	Body        string    `json:"body,omitempty"`
+	Result      string    `json:"result"` // ResultOK, or why the operation failed
+}
+
+// String describes an operation as it was made
+func (op Operation) String() string {
+	if op.Source == SourceRESTCONF {
+		return op.Method + " " + op.Path
+	}
+	return CommandLine(op.Args)
+}
+
+// RecordingOperations reports whether operations are recorded, with
+// history.record_operations
+func RecordingOperations() bool {
+	return viper.GetBool("history.record_operations")
+}
+
+// RecordOperation appends an operation to the recording if operations are
+// recorded, dropping the oldest beyond MaxEntries
+func RecordOperation(op Operation) error {
+	if !RecordingOperations() {
+		return nil
+	}
+	path, err := OperationsPath()
+	if err != nil {
+		return err
+	}
+	return appendLine(path, op)
+}
+
+// LoadOperations reads a recording of operations, oldest first
+func LoadOperations(path string) ([]Operation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ops []Operation
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var op Operation
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			return nil, fmt.Errorf("invalid operation on line %d of %s: %v", n, path, err)
+		}
+		switch op.Source {
+		case SourceCLI:
+			if len(op.Args) == 0 {
+				return nil, fmt.Errorf("operation on line %d of %s has no arguments", n, path)
+			}
+		case SourceRESTCONF:
+			if op.Method == "" || op.Path == "" {
+				return nil, fmt.Errorf("operation on line %d of %s has no method or path", n, path)
+			}
+		default:
+			return nil, fmt.Errorf("operation on line %d of %s has unknown source %q", n, path, op.Source)
+		}
+		ops = append(ops, op)
+	}
+	return ops, scanner.Err()
+}
+
+// OperationsPath returns the file operations are recorded in
+func OperationsPath() (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "operations.jsonl"), nil
+}
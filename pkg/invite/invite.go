@@ -0,0 +1,275 @@
+// Package invite onboards road warriors by having them scan a QR code instead
+// of typing keys. An invite is a one-time URL of the enrollment server: the
+// user's phone or laptop opens it and is handed a VPN profile with a
+// certificate issued for the user there and then. An invite is used up by the
+// first profile it hands out, and lapses after client.invite_expiry.
+package invite
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/viper"
+)
+
+// DefaultExpiry is how long an invite may wait to be used, unless
+// client.invite_expiry says otherwise
+const DefaultExpiry = 24 * time.Hour
+
+// Sizes of the random ID and secret of an invite, in bytes
+const (
+	idSize     = 8
+	secretSize = 16
+)
+
+// enrollPath is the path of the enrollment URLs, followed by the token
+const enrollPath = "/enroll/"
+
+var (
+	// ErrNotFound is returned for an unknown, expired or used invite, or a
+	// token whose secret is wrong
+	ErrNotFound = errors.New("no such invite, or it has expired or been used")
+	// ErrNoURL is returned when the enrollment server's address is not set
+	ErrNoURL = errors.New("client.url must be set to the https URL users reach the enrollment server at")
+)
+
+// Invite is the promise of a VPN profile to a user, to whoever opens its URL
+// first. Only a hash of the secret in the URL is kept.
+type Invite struct {
+	ID      string                `json:"id"`
+	User    string                `json:"user"`
+	Options tunnel.ProfileOptions `json:"options"`
+	Secret  string                `json:"secret"` // SHA-256 of the secret, hex
+	Created time.Time             `json:"created"`
+	Expires time.Time             `json:"expires"`
+}
+
+// Expiry returns how long an invite may wait to be used
+func Expiry() time.Duration {
+	if seconds := viper.GetInt("client.invite_expiry"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return DefaultExpiry
+}
+
+// BaseURL returns the URL users reach the enrollment server at
+func BaseURL() (string, error) {
+	base := viper.GetString("client.url")
+	if base == "" {
+		return "", ErrNoURL
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("invalid client.url %q, expected an https URL such as https://vpn.example.com:8444", base)
+	}
+	return strings.TrimSuffix(base, "/"), nil
+}
+
+// Create records an invite for a user to the profile of opts, valid for
+// expiry, and returns it with its URL. The profile is checked now, so that a
+// user is not handed an invite that cannot be used.
+func Create(user string, opts tunnel.ProfileOptions, expiry time.Duration) (*Invite, string, error) {
+	base, err := BaseURL()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := tunnel.CheckProfile(user, opts); err != nil {
+		return nil, "", err
+	}
+	if expiry <= 0 {
+		expiry = Expiry()
+	}
+
+	id := make([]byte, idSize)
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(secret)
+	now := time.Now()
+	inv := &Invite{
+		ID:      hex.EncodeToString(id),
+		User:    user,
+		Options: opts,
+		Secret:  hex.EncodeToString(sum[:]),
+		Created: now,
+		Expires: now.Add(expiry),
+	}
+	if err := save(inv); err != nil {
+		return nil, "", err
+	}
+	token := inv.ID + "." + base64.RawURLEncoding.EncodeToString(secret)
+	return inv, base + enrollPath + token, nil
+}
+
+// Get returns an invite that has not expired or been used
+func Get(id string) (*Invite, error) {
+	path, err := invitePath(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var inv Invite
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return nil, fmt.Errorf("invalid invite in %s: %v", path, err)
+	}
+	if !time.Now().Before(inv.Expires) {
+		_ = os.Remove(path)
+		return nil, ErrNotFound
+	}
+	return &inv, nil
+}
+
+// List returns the invites that have not expired or been used, oldest first
+func List() ([]*Invite, error) {
+	dir, err := invitesDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var invites []*Invite
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		inv, err := Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		invites = append(invites, inv)
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].Created.Before(invites[j].Created) })
+	return invites, nil
+}
+
+// Revoke drops an invite before it is used
+func Revoke(id string) (*Invite, error) {
+	inv, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	path, err := invitePath(id)
+	if err != nil {
+		return nil, err
+	}
+	return inv, os.Remove(path)
+}
+
+// Lookup returns the invite of a token from its URL, without using it up
+func Lookup(token string) (*Invite, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrNotFound
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	inv, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(inv.Secret)) != 1 {
+		return nil, ErrNotFound
+	}
+	return inv, nil
+}
+
+// Redeem uses up the invite of a token and returns the profile it promised.
+// Only the first of two concurrent attempts gets it, as the invite is removed
+// before the certificate is issued; it is put back if that fails.
+func Redeem(token string) (*Invite, *tunnel.Profile, error) {
+	inv, err := Lookup(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	path, err := invitePath(inv.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return nil, nil, ErrNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	profile, err := tunnel.ClientProfile(inv.User, inv.Options)
+	if err != nil {
+		if err := save(inv); err != nil {
+			return nil, nil, fmt.Errorf("failed to put back invite %s: %v", inv.ID, err)
+		}
+		return nil, nil, err
+	}
+	return inv, profile, nil
+}
+
+// save records an invite
+func save(inv *Invite) error {
+	path, err := invitePath(inv.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// invitePath returns the file an invite is kept in
+func invitePath(id string) (string, error) {
+	if raw, err := hex.DecodeString(id); err != nil || len(raw) != idSize {
+		return "", ErrNotFound
+	}
+	dir, err := invitesDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, id+".json"), nil
+}
+
+// invitesDir returns the directory invites are kept in
+func invitesDir() (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "invites"), nil
+}
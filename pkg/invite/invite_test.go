@@ -0,0 +1,160 @@
+package invite
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/ca"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/viper"
+)
+
+// setup configures a hub accepting road warriors of example.com
+func setup(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	t.Cleanup(func() { viper.Set("config_dir", "") })
+	viper.Set("client.url", "https://vpn.example.com:8444/")
+	t.Cleanup(func() { viper.Set("client.url", nil) })
+
+	if _, err := ca.Init("hub CA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "tunnels"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stored := `{"name":"hub","local_ip":"192.0.2.1","remote_ip":"%any","local_subnet":"10.0.0.0/16",
+		"remote_subnet":"10.128.0.0/9","encryption":"aes256gcm","mode":"ipsec",
+		"peer_id":"*@example.com","peer_ca":"hub","virtual_ip_pool":"10.200.0.0/24"}`
+	if err := os.WriteFile(filepath.Join(dir, "tunnels", "hub.json"), []byte(stored), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// token returns the token at the end of an invite URL
+func token(t *testing.T, url string) string {
+	t.Helper()
+	token, ok := strings.CutPrefix(url, "https://vpn.example.com:8444"+enrollPath)
+	if !ok {
+		t.Fatalf("Expected an enrollment URL of client.url, got %s", url)
+	}
+	return token
+}
+
+func TestInvite(t *testing.T) {
+	setup(t)
+
+	if _, _, err := Create("bob@example.org", tunnel.ProfileOptions{Format: tunnel.ProfileMobileconfig}, 0); err == nil {
+		t.Error("Expected an invite the hub would not accept to be refused")
+	}
+	opts := tunnel.ProfileOptions{Format: tunnel.ProfileStrongSwanAndroid, Password: "correct horse"}
+	inv, url, err := Create("alice@example.com", opts, 0)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if d := inv.Expires.Sub(inv.Created); d != DefaultExpiry {
+		t.Errorf("Expected the invite to expire after %s, got %s", DefaultExpiry, d)
+	}
+	tok := token(t, url)
+	if strings.Contains(inv.Secret, tok[len(inv.ID)+1:]) {
+		t.Error("Expected only a hash of the secret to be kept")
+	}
+
+	if invites, err := List(); err != nil || len(invites) != 1 || invites[0].ID != inv.ID {
+		t.Errorf("Expected the invite listed, got %v, %v", invites, err)
+	}
+	if _, err := Lookup(inv.ID + ".AAAAAAAAAAAAAAAAAAAAAA"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a wrong secret to be refused, got %v", err)
+	}
+	if _, err := Lookup(tok); err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+
+	redeemed, profile, err := Redeem(tok)
+	if err != nil {
+		t.Fatalf("Redeem failed: %v", err)
+	}
+	if redeemed.User != "alice@example.com" || profile.Password != "correct horse" || len(profile.Data) == 0 {
+		t.Errorf("Expected the profile with the password of the invite, got %+v", profile)
+	}
+	if _, _, err := Redeem(tok); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an invite to be used once, got %v", err)
+	}
+
+	inv, url, err = Create("carol@example.com", tunnel.ProfileOptions{Format: tunnel.ProfileMobileconfig}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Revoke(inv.ID); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if _, err := Lookup(token(t, url)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a revoked invite to be refused, got %v", err)
+	}
+
+	inv, _, err = Create("dave@example.com", tunnel.ProfileOptions{Format: tunnel.ProfileMobileconfig}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.Expires = time.Now().Add(-time.Second)
+	if err := save(inv); err != nil {
+		t.Fatal(err)
+	}
+	if invites, err := List(); err != nil || len(invites) != 0 {
+		t.Errorf("Expected an expired invite to be dropped, got %v, %v", invites, err)
+	}
+
+	viper.Set("client.url", "http://vpn.example.com")
+	if _, _, err := Create("alice@example.com", opts, 0); err == nil {
+		t.Error("Expected an enrollment URL without TLS to be refused")
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	setup(t)
+	_, url, err := Create("alice@example.com", tunnel.ProfileOptions{Format: tunnel.ProfileMobileconfig}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := enrollPath + token(t, url)
+	s := New("", nil)
+
+	// Fetching the page, as link previews do, leaves the invite alone
+	for range 2 {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<form method="post">`) {
+			t.Fatalf("Expected the confirmation page, got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the profile, got %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-apple-aspen-config" {
+		t.Errorf("Expected an Apple configuration profile, got %s", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="alice_example.com.mobileconfig"` {
+		t.Errorf("Unexpected Content-Disposition %s", cd)
+	}
+	if !strings.Contains(w.Body.String(), "<plist") {
+		t.Errorf("Expected a property list, got %s", w.Body)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected %s of a used invite to be refused, got %d", method, w.Code)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package invite
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/viper"
+)
+
+// ErrNotConfigured is returned when the enrollment server has no certificate
+var ErrNotConfigured = errors.New("client.certificate and client.private_key, or restconf.certificate and restconf.private_key, must be set")
+
+// profileFiles holds the media type and file extension of each profile format
+var profileFiles = map[string]struct{ mediaType, extension string }{
+	tunnel.ProfileMobileconfig:      {"application/x-apple-aspen-config", ".mobileconfig"},
+	tunnel.ProfilePowerShell:        {"application/octet-stream", ".ps1"},
+	tunnel.ProfileStrongSwanAndroid: {"application/vnd.strongswan.profile", ".sswan"},
+}
+
+// page asks the user to confirm before the invite is used, so that link
+// previews of chat apps and mail scanners fetching the URL do not use it up
+var page = template.Must(template.New("enroll").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>VPN profile for {{.User}}</title>
+</head>
+<body>
+<h1>VPN profile for {{.User}}</h1>
+{{if eq .Format "mobileconfig"}}<p>Download the profile, then install it in Settings, under Profile Downloaded.</p>
+{{else if eq .Format "powershell"}}<p>Download the script, then run it in PowerShell as your own user.</p>
+{{else}}<p>Download the profile and open it with the strongSwan VPN Client. It asks for the password your administrator gave you.</p>
+{{end}}<p>The link works once and expires {{.Expires.Format "2006-01-02 15:04 MST"}}.</p>
+<form method="post">
+<button type="submit">Download</button>
+</form>
+</body>
+</html>
+`))
+
+// Server hands out the profiles of invites over HTTPS. Users are not asked
+// for a client certificate, the secret in the URL is what authenticates them.
+type Server struct {
+	http *http.Server
+}
+
+// New creates a server listening on addr with the given TLS configuration
+func New(addr string, tlsConfig *tls.Config) *Server {
+	s := &Server{}
+	s.http = &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// FromConfig creates a server from the client settings, with the RESTCONF
+// server's certificate unless it has its own
+func FromConfig() (*Server, error) {
+	cert := viper.GetString("client.certificate")
+	key := viper.GetString("client.private_key")
+	if cert == "" && key == "" {
+		cert = viper.GetString("restconf.certificate")
+		key = viper.GetString("restconf.private_key")
+	}
+	if cert == "" || key == "" {
+		return nil, ErrNotConfigured
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %v", err)
+	}
+	return New(viper.GetString("client.listen"), &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
+
+// Serve accepts connections on the listener until the server is closed
+func (s *Server) Serve(listener net.Listener) error {
+	logger.API.Info("Enrollment server listening on %s", listener.Addr())
+	err := s.http.ServeTLS(listener, "", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// ListenAndServe listens on the configured address and serves until the server is closed
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.http.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	return s.http.Close()
+}
+
+// Handler returns the HTTP handler of the enrollment URLs
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+enrollPath+"{token}", s.confirm)
+	mux.HandleFunc("POST "+enrollPath+"{token}", s.enroll)
+	return mux
+}
+
+// confirm shows the page of an invite
+func (s *Server) confirm(w http.ResponseWriter, r *http.Request) {
+	inv, err := Lookup(r.PathValue("token"))
+	if err != nil {
+		s.notFound(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := page.Execute(w, map[string]any{
+		"User":    inv.User,
+		"Format":  inv.Options.Format,
+		"Expires": inv.Expires,
+	}); err != nil {
+		logger.API.Error("Failed to write the page of invite %s: %v", inv.ID, err)
+	}
+}
+
+// enroll uses up an invite and sends its profile
+func (s *Server) enroll(w http.ResponseWriter, r *http.Request) {
+	inv, profile, err := Redeem(r.PathValue("token"))
+	if errors.Is(err, ErrNotFound) {
+		s.notFound(w, r, err)
+		return
+	} else if err != nil {
+		logger.API.Error("Failed to issue the profile of an invite: %v", err)
+		http.Error(w, "the profile could not be issued, try again later", http.StatusInternalServerError)
+		return
+	}
+	logger.API.Info("Invite %s used by %s: issued %s profile with certificate %s to %s",
+		inv.ID, r.RemoteAddr, inv.Options.Format, profile.Serial, inv.User)
+
+	file := profileFiles[inv.Options.Format]
+	name := strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' {
+			return r
+		}
+		return '_'
+	}, inv.User)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", file.mediaType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+file.extension+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(profile.Data)))
+	_, _ = w.Write(profile.Data)
+}
+
+// notFound answers for an invite that cannot be used, the same whatever the reason
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request, err error) {
+	logger.API.Info("Refused enrollment from %s: %v", r.RemoteAddr, err)
+	http.Error(w, "this link is invalid, expired or already used, ask your administrator for a new one", http.StatusNotFound)
+}
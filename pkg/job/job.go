@@ -0,0 +1,230 @@
+// Package job tracks operations that run in the background, such as creating
+// a tunnel with 'tunnel create --async', so that their progress and result can
+// be looked up by ID from another command or over RESTCONF
+package job
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+)
+
+// idSize is the number of random bytes in a job ID
+const idSize = 8
+
+// Retention is how long finished jobs are kept
+const Retention = 24 * time.Hour
+
+// startTimeout is how long a job may wait for a process to run it
+const startTimeout = time.Minute
+
+// State is where a job is in its life
+type State string
+
+// Job states
+const (
+	StateRunning   State = "RUNNING"
+	StateSucceeded State = "SUCCEEDED"
+	StateFailed    State = "FAILED"
+)
+
+// ErrNotFound is returned for a job that does not exist, or no longer does
+var ErrNotFound = errors.New("job not found")
+
+// Step is a point a job reached
+type Step struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Job is an operation running in the background. It is saved after every
+// change, so that it can be read while it runs.
+type Job struct {
+	ID        string    `json:"id"`
+	Operation string    `json:"operation"` // e.g. create tunnel 'office'
+	State     State     `json:"state"`
+	Steps     []Step    `json:"steps,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	PID       int       `json:"pid,omitempty"` // Process running it, once started
+	Created   time.Time `json:"created"`
+	Finished  time.Time `json:"finished,omitzero"`
+}
+
+// New records a job for an operation. The process that runs it, the calling
+// process or one it starts, calls Attach.
+func New(operation string) (*Job, error) {
+	raw := make([]byte, idSize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	if err := prune(); err != nil {
+		return nil, err
+	}
+	j := &Job{
+		ID:        hex.EncodeToString(raw),
+		Operation: operation,
+		State:     StateRunning,
+		Created:   time.Now(),
+	}
+	return j, j.save()
+}
+
+// Attach records the calling process as the one running a job
+func Attach(id string) (*Job, error) {
+	j, err := Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if j.Done() {
+		return nil, fmt.Errorf("job %s has already finished", id)
+	}
+	j.PID = os.Getpid()
+	return j, j.save()
+}
+
+// Load returns a job. A running job whose process has exited without
+// finishing it, or that no process attached to in time, is reported as failed.
+func Load(id string) (*Job, error) {
+	path, err := jobPath(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var j Job
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("invalid job in %s: %v", path, err)
+	}
+	switch {
+	case j.Done():
+	case j.PID > 0 && syscall.Kill(j.PID, 0) == syscall.ESRCH:
+		j.State = StateFailed
+		j.Error = "the process running the job exited before it finished"
+	case j.PID == 0 && time.Since(j.Created) > startTimeout:
+		j.State = StateFailed
+		j.Error = "no process started running the job"
+	}
+	return &j, nil
+}
+
+// List returns the jobs, oldest first
+func List() ([]*Job, error) {
+	dir, err := jobsDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	for _, file := range files {
+		j, err := Load(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	slices.SortFunc(jobs, func(a, b *Job) int { return a.Created.Compare(b.Created) })
+	return jobs, nil
+}
+
+// Done reports whether a job has finished
+func (j *Job) Done() bool {
+	return j.State == StateSucceeded || j.State == StateFailed
+}
+
+// Step records that a job reached a point
+func (j *Job) Step(format string, args ...any) error {
+	j.Steps = append(j.Steps, Step{Time: time.Now(), Message: fmt.Sprintf(format, args...)})
+	return j.save()
+}
+
+// Finish records the result of a job
+func (j *Job) Finish(err error) error {
+	j.State = StateSucceeded
+	if err != nil {
+		j.State = StateFailed
+		j.Error = err.Error()
+	}
+	j.Finished = time.Now()
+	return j.save()
+}
+
+// save writes a job to a new file that replaces the old one, so that it is
+// never read half-written
+func (j *Job) save() error {
+	path, err := jobPath(j.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// prune removes the jobs that finished more than Retention ago
+func prune() error {
+	jobs, err := List()
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		// Jobs abandoned by their process have no time they finished
+		if j.Done() && time.Since(cmp.Or(j.Finished, j.Created)) > Retention {
+			path, err := jobPath(j.ID)
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jobsDir returns the directory jobs are kept in
+func jobsDir() (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "jobs"), nil
+}
+
+// jobPath returns the file a job is kept in
+func jobPath(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return "", ErrNotFound
+	}
+	dir, err := jobsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, id+".json"), nil
+}
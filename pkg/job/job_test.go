@@ -0,0 +1,77 @@
+package job
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestJob(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	j, err := New("create tunnel 'office'")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if j, err = Attach(j.ID); err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+	if err := j.Step("Creating tunnel"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process sees the job running, with the process running it
+	loaded, err := Load(j.ID)
+	if err != nil || loaded.State != StateRunning || loaded.PID != os.Getpid() || len(loaded.Steps) != 1 {
+		t.Errorf("Expected the running job, got %+v: %v", loaded, err)
+	}
+
+	if err := j.Finish(errors.New("peer unreachable")); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ := Load(j.ID); loaded.State != StateFailed || loaded.Error != "peer unreachable" || loaded.Finished.IsZero() {
+		t.Errorf("Expected the job to have failed, got %+v", loaded)
+	}
+	if _, err := Attach(j.ID); err == nil {
+		t.Error("Expected a finished job not to be attached to")
+	}
+	if _, err := Load("../tunnels/office"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an ID outside the jobs to be not found, got %v", err)
+	}
+}
+
+func TestAbandonedJobs(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	// The process running a job exited without finishing it
+	exited := &Job{ID: "exited", State: StateRunning, PID: 1 << 22, Created: time.Now()}
+	// No process started running a job
+	orphan := &Job{ID: "orphan", State: StateRunning, Created: time.Now().Add(-2 * startTimeout)}
+	// A job that finished long ago
+	old := &Job{ID: "old", State: StateSucceeded, Created: time.Now().Add(-2 * Retention), Finished: time.Now().Add(-2 * Retention)}
+	for _, j := range []*Job{exited, orphan, old} {
+		if err := j.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range []string{"exited", "orphan"} {
+		if j, err := Load(id); err != nil || j.State != StateFailed || j.Error == "" {
+			t.Errorf("Expected job %s to have failed, got %+v: %v", id, j, err)
+		}
+	}
+	if _, err := New("delete tunnel 'office'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load("old"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a job finished long ago to be removed, got %v", err)
+	}
+	if jobs, _ := List(); len(jobs) != 3 || jobs[0].ID != "orphan" {
+		t.Errorf("Expected three jobs, oldest first, got %+v", jobs)
+	}
+}
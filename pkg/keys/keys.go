@@ -0,0 +1,476 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/dzakwan/ipsec-vpn/pkg/store"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Key types, as the JOSE "kty" of a JSON Web Key, with the algorithm in "alg"
+const (
+	TypePSK     = "oct" // Symmetric pre-shared key
+	TypeKeyPair = "OKP" // Key pair, for key encapsulation or WireGuard
+)
+
+// legacyTypeKeyPair is the type key pairs were stored with before they
+// followed JOSE
+const legacyTypeKeyPair = "KEM"
+
+// DefaultPSKSize is the size in bytes of generated pre-shared keys
+const DefaultPSKSize = 32
+
+// TunnelPSKSize is the size of the pre-shared keys tunnels derive from stored
+// keys, as WireGuard requires
+const TunnelPSKSize = 32
+
+// TunnelPSKInfo is the HKDF info string tunnel pre-shared keys are derived with
+var TunnelPSKInfo = []byte("ipsec-vpn tunnel psk")
+
+// hostKeyfileSize is the size of the host keyfile keys are sealed with by default
+const hostKeyfileSize = 32
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ValidName reports whether a name can be used for a key
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// ErrPassphrase is returned for keys sealed with a passphrase that is not given
+var ErrPassphrase = errors.New("the key is sealed with a passphrase, which must be given")
+
+// Key is a stored pre-shared key or key pair together with its metadata. The
+// pre-shared or private key is sealed with a key source of the configuration
+// store, bound to the name of the key; the public key is unpadded base64url,
+// as in a JSON Web Key.
+type Key struct {
+	Name        string        `json:"kid"`
+	Type        string        `json:"kty"`
+	Algorithm   string        `json:"alg"`
+	Created     time.Time     `json:"created"`
+	Expiry      *time.Time    `json:"expiry,omitempty"`
+	Fingerprint string        `json:"fingerprint"`
+	Public      string        `json:"pub,omitempty"`
+	Sealed      *store.Sealed `json:"sealed,omitempty"`
+	// Key files written before keys were sealed hold the key in the clear;
+	// they are still read
+	Secret  string `json:"k,omitempty"`
+	Private string `json:"priv,omitempty"`
+}
+
+// Expired reports whether the key is past its expiry time
+func (k *Key) Expired() bool {
+	return k.Expiry != nil && time.Now().After(*k.Expiry)
+}
+
+// SealedWith returns the method the key is unsealed with, or "none" for a key
+// file written in the clear
+func (k *Key) SealedWith() string {
+	if k.Sealed == nil {
+		return "none"
+	}
+	return k.Sealed.Method()
+}
+
+// Material returns the pre-shared key, or the private key of a key pair,
+// unsealed with the key source, or without one unless it is sealed with a
+// passphrase. The caller zeroizes it.
+func (k *Key) Material(source store.KeySource) ([]byte, error) {
+	if k.Sealed == nil {
+		if k.Type == TypePSK {
+			return base64.RawURLEncoding.DecodeString(k.Secret)
+		}
+		return base64.RawURLEncoding.DecodeString(k.Private)
+	}
+	if source == nil && k.Sealed.Method() == store.MethodPassphrase {
+		return nil, fmt.Errorf("key '%s': %w", k.Name, ErrPassphrase)
+	}
+	material, err := k.Sealed.Open(source, []byte(k.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unseal key '%s': %v", k.Name, err)
+	}
+	return material, nil
+}
+
+// PublicBytes returns the decoded public key
+func (k *Key) PublicBytes() ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(k.Public)
+}
+
+// Verify reports whether a signature of the message was made with the private
+// key of an Ed25519 key pair
+func (k *Key) Verify(message, signature []byte) (bool, error) {
+	if k.Type != TypeKeyPair || k.Algorithm != crypto.AlgorithmEd25519 {
+		return false, fmt.Errorf("key '%s' is not an %s key pair", k.Name, crypto.AlgorithmEd25519)
+	}
+	public, err := k.PublicBytes()
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return false, fmt.Errorf("key '%s' has no valid public key", k.Name)
+	}
+	return ed25519.Verify(public, message, signature), nil
+}
+
+// DeriveTunnelPSK derives the pre-shared key of a tunnel from a stored
+// pre-shared key with HKDF-SHA256, the way the key agent does, so that it
+// matches on every gateway holding the key
+func DeriveTunnelPSK(material []byte) ([]byte, error) {
+	psk := make([]byte, TunnelPSKSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, material, nil, TunnelPSKInfo), psk); err != nil {
+		return nil, err
+	}
+	return psk, nil
+}
+
+// TunnelPSK returns the pre-shared key a tunnel referring to a stored key
+// uses, unsealing the key without asking for anything
+func TunnelPSK(name string) ([]byte, error) {
+	key, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if key.Type != TypePSK {
+		return nil, fmt.Errorf("key '%s' is a key pair, not a pre-shared key", name)
+	}
+	if key.Expired() {
+		return nil, fmt.Errorf("key '%s' has expired", name)
+	}
+	material, err := key.Material(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Zeroize(material)
+	return DeriveTunnelPSK(material)
+}
+
+// HostKeyfile returns the keyfile keys are sealed with unless another key
+// source is given: keys.keyfile, or a file next to the configuration directory,
+// so that copies and backups of the directory do not carry it
+func HostKeyfile() (string, error) {
+	if path := viper.GetString("keys.keyfile"); path != "" {
+		return path, nil
+	}
+	dir, err := store.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Clean(dir) + ".keyfile", nil
+}
+
+// DefaultSource returns the host keyfile as a key source, creating it with
+// random content the first time
+func DefaultSource() (store.KeySource, error) {
+	path, err := HostKeyfile()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		material, err := crypto.GenerateSecret(hostKeyfileSize)
+		if err != nil {
+			return nil, err
+		}
+		defer crypto.Zeroize(material)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			_, err = f.Write(material)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return nil, err
+			}
+			logger.Info("Created host keyfile %s to seal keys with", path)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return store.Keyfile{Path: path}, nil
+}
+
+// Generate creates and stores a new key, sealed with the key source, or the
+// host keyfile if it is nil. For pre-shared keys, size is the key length in
+// bytes; for key pairs, algorithm selects the key encapsulation mechanism,
+// x25519 for a WireGuard key pair or ed25519 for signing. A zero validity means
+// the key never expires.
+func Generate(name, keyType, algorithm string, size int, validity time.Duration, source store.KeySource) (*Key, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid key name: %s", name)
+	}
+	if _, err := Get(name); err == nil {
+		return nil, fmt.Errorf("key with name '%s' already exists", name)
+	}
+
+	if source == nil {
+		var err error
+		if source, err = DefaultSource(); err != nil {
+			return nil, fmt.Errorf("failed to create the host keyfile: %v", err)
+		}
+	}
+
+	key := &Key{
+		Name:    name,
+		Type:    keyType,
+		Created: time.Now().UTC(),
+	}
+	if validity > 0 {
+		expiry := key.Created.Add(validity)
+		key.Expiry = &expiry
+	}
+
+	var material []byte
+
+	switch keyType {
+	case TypePSK:
+		if size == 0 {
+			size = DefaultPSKSize
+		}
+		if size < 16 {
+			return nil, fmt.Errorf("pre-shared keys must be at least 16 bytes, got %d", size)
+		}
+
+		logger.Info("Generating %d byte pre-shared key '%s'", size, name)
+		secret, err := crypto.GenerateSecret(size)
+		if err != nil {
+			return nil, err
+		}
+		defer crypto.Zeroize(secret)
+
+		key.Algorithm = fmt.Sprintf("psk%d", size*8)
+		key.Fingerprint = Fingerprint(secret)
+		material = secret
+	case TypeKeyPair:
+		if algorithm == "" {
+			algorithm = crypto.RecommendedAlgorithm
+		}
+
+		logger.Info("Generating %s key pair '%s'", algorithm, name)
+		generate := crypto.GenerateKEMKeyPair
+		switch algorithm {
+		case crypto.AlgorithmX25519:
+			generate = func(string) ([]byte, []byte, error) { return crypto.GenerateX25519KeyPair() }
+		case crypto.AlgorithmEd25519:
+			generate = func(string) ([]byte, []byte, error) { return crypto.GenerateEd25519KeyPair() }
+		}
+		public, private, err := generate(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		defer crypto.Zeroize(private)
+
+		key.Algorithm = algorithm
+		key.Public = base64.RawURLEncoding.EncodeToString(public)
+		key.Fingerprint = Fingerprint(public)
+		material = private
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", keyType)
+	}
+
+	var err error
+	if key.Sealed, err = store.SealSecret(source, material, []byte(name)); err != nil {
+		return nil, fmt.Errorf("failed to seal key '%s': %v", name, err)
+	}
+
+	if err := saveKey(key); err != nil {
+		logger.Error("Failed to save key '%s': %v", name, err)
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Get loads a stored key by name
+func Get(name string) (*Key, error) {
+	path, err := keyPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("key '%s' not found", name)
+		}
+		return nil, err
+	}
+
+	var key Key
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %v", path, err)
+	}
+	if key.Type == legacyTypeKeyPair {
+		key.Type = TypeKeyPair
+	}
+	return &key, nil
+}
+
+// ListAll returns all stored keys
+func ListAll() ([]*Key, error) {
+	keysDir, err := getKeysDir()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(keysDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*Key, 0, len(files))
+	for _, file := range files {
+		name := filepath.Base(file)
+		name = name[:len(name)-5] // Remove .json extension
+
+		key, err := Get(name)
+		if err != nil {
+			// Skip unreadable key files
+			logger.Debug("Skipping key file %s: %v", file, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// CheckStore verifies every stored key: that it can be read, is stored under its
+// own name, is readable only by its owner and matches its fingerprint
+func CheckStore() error {
+	keysDir, err := getKeysDir()
+	if err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(keysDir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := filepath.Base(file)
+		name = name[:len(name)-5] // Remove .json extension
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			return fmt.Errorf("key file %s is accessible to other users (mode %04o)", file, info.Mode().Perm())
+		}
+		key, err := Get(name)
+		if err != nil {
+			return err
+		}
+		if key.Name != name {
+			return fmt.Errorf("key file %s holds key '%s'", file, key.Name)
+		}
+
+		// A sealed pre-shared key is not unsealed to check it, which may
+		// need a passphrase or the TPM
+		if key.Type == TypePSK && key.Sealed != nil {
+			continue
+		}
+		material, err := key.PublicBytes()
+		if key.Type == TypePSK {
+			material, err = key.Material(nil)
+		}
+		if err != nil {
+			return fmt.Errorf("key '%s' is not valid base64url: %v", name, err)
+		}
+		if Fingerprint(material) != key.Fingerprint {
+			return fmt.Errorf("key '%s' does not match its fingerprint %s", name, key.Fingerprint)
+		}
+	}
+	return nil
+}
+
+// Delete removes a stored key, overwriting the file before unlinking it
+func Delete(name string) error {
+	path, err := keyPath(name)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("key '%s' not found", name)
+		}
+		return err
+	}
+
+	// Best effort; journaling filesystems may keep older copies of the data
+	if err := os.WriteFile(path, make([]byte, info.Size()), 0600); err != nil {
+		logger.Debug("Failed to overwrite key file %s: %v", path, err)
+	}
+
+	logger.Info("Deleting key '%s'", name)
+	return os.Remove(path)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of public key material, or of a pre-shared key
+func Fingerprint(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+// saveKey writes a key file readable only by its owner
+func saveKey(key *Key) error {
+	path, err := keyPath(key.Name)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(key, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// keyPath returns the file a named key is stored in
+func keyPath(name string) (string, error) {
+	if !validName.MatchString(name) {
+		return "", errors.New("invalid key name: " + name)
+	}
+
+	keysDir, err := getKeysDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(keysDir, name+".json"), nil
+}
+
+// getKeysDir returns the key store directory, creating it if needed
+func getKeysDir() (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	keysDir := filepath.Join(configDir, "keys")
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		return "", err
+	}
+	return keysDir, nil
+}
@@ -0,0 +1,253 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/store"
+	"github.com/spf13/viper"
+)
+
+// setup points the key store and the host keyfile at a temporary directory
+func setup(t *testing.T) (dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	viper.Set("config_dir", filepath.Join(dir, "config"))
+	t.Cleanup(func() { viper.Set("config_dir", "") })
+	return dir
+}
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"office", true},
+		{"wg-branch_2.paris", true},
+		{"9lives", true},
+		{"", false},
+		{"-office", false},
+		{".hidden", false},
+		{"../etc/passwd", false},
+		{"a/b", false},
+		{"office psk", false},
+	}
+	for _, tt := range tests {
+		if got := ValidName(tt.name); got != tt.valid {
+			t.Errorf("Expected ValidName(%q) to be %v", tt.name, tt.valid)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	// SHA-256 of the empty string
+	if got, want := Fingerprint(nil), "SHA256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if Fingerprint([]byte("a")) == Fingerprint([]byte("b")) {
+		t.Error("Expected different keys to have different fingerprints")
+	}
+}
+
+func TestGenerateRoundTrip(t *testing.T) {
+	dir := setup(t)
+
+	psk, err := Generate("office", TypePSK, "", 0, 0, nil)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	if psk.Algorithm != "psk256" || psk.SealedWith() != store.MethodKeyfile {
+		t.Errorf("Unexpected key %+v", psk)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "config.keyfile")); err != nil {
+		t.Errorf("Expected the host keyfile next to the configuration directory: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config", "keys", "office.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), `"k"`) || !strings.Contains(string(data), `"sealed"`) {
+		t.Errorf("Expected the key to be sealed: %s", data)
+	}
+
+	got, err := Get("office")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	material, err := got.Material(nil)
+	if err != nil {
+		t.Fatalf("Material failed: %v", err)
+	}
+	if len(material) != DefaultPSKSize || Fingerprint(material) != psk.Fingerprint {
+		t.Errorf("Expected the key to match its fingerprint %s", psk.Fingerprint)
+	}
+	if err := CheckStore(); err != nil {
+		t.Errorf("CheckStore failed: %v", err)
+	}
+
+	pair, err := Generate("wg-office", TypeKeyPair, "x25519", 0, 0, nil)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	if pair.Type != "OKP" || pair.Algorithm != "x25519" {
+		t.Errorf("Expected an OKP x25519 key pair, got %s %s", pair.Type, pair.Algorithm)
+	}
+	if private, err := pair.Material(nil); err != nil || len(private) != 32 {
+		t.Errorf("Expected the private key, got %d bytes: %v", len(private), err)
+	}
+
+	if _, err := Generate("office", TypePSK, "", 0, 0, nil); err == nil {
+		t.Error("Expected an existing key not to be replaced")
+	}
+	if _, err := Generate("short", TypePSK, "", 8, 0, nil); err == nil {
+		t.Error("Expected a short key to be refused")
+	}
+	if _, err := Generate("../escape", TypePSK, "", 0, 0, nil); err == nil {
+		t.Error("Expected an invalid name to be refused")
+	}
+}
+
+func TestSealedBinding(t *testing.T) {
+	dir := setup(t)
+	if _, err := Generate("office", TypePSK, "", 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Generate("branch", TypePSK, "", 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A sealed key moved to another name does not unseal
+	keysDir := filepath.Join(dir, "config", "keys")
+	data, err := os.ReadFile(filepath.Join(keysDir, "office.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := strings.Replace(string(data), `"kid": "office"`, `"kid": "branch"`, 1)
+	if err := os.WriteFile(filepath.Join(keysDir, "branch.json"), []byte(moved), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := Get("branch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.Material(nil); err == nil {
+		t.Error("Expected a key moved to another name not to unseal")
+	}
+
+	// Nor does one without its keyfile
+	if err := os.Remove(filepath.Join(dir, "config.keyfile")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TunnelPSK("office"); err == nil {
+		t.Error("Expected the key not to unseal without the host keyfile")
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	setup(t)
+	source := store.Passphrase{Passphrase: []byte("correct horse")}
+	if _, err := Generate("office", TypePSK, "", 0, 0, source); err != nil {
+		t.Fatal(err)
+	}
+	key, err := Get("office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.Material(nil); !errors.Is(err, ErrPassphrase) {
+		t.Errorf("Expected the passphrase to be needed, got %v", err)
+	}
+	if _, err := key.Material(store.Passphrase{Passphrase: []byte("wrong")}); err == nil {
+		t.Error("Expected a wrong passphrase to fail")
+	}
+	if material, err := key.Material(source); err != nil || Fingerprint(material) != key.Fingerprint {
+		t.Errorf("Expected the key with its passphrase: %v", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	setup(t)
+	key, err := Generate("office", TypePSK, "", 0, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Expiry == nil || key.Expired() {
+		t.Fatalf("Expected the key to expire in an hour, got %v", key.Expiry)
+	}
+	past := time.Now().Add(-time.Minute)
+	key.Expiry = &past
+	if !key.Expired() {
+		t.Error("Expected the key to have expired")
+	}
+	if err := saveKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TunnelPSK("office"); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected an expired key not to be used, got %v", err)
+	}
+}
+
+func TestTunnelPSK(t *testing.T) {
+	setup(t)
+	key, err := Generate("office", TypePSK, "", 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	material, err := key.Material(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, err := TunnelPSK("office")
+	if err != nil {
+		t.Fatalf("TunnelPSK failed: %v", err)
+	}
+	if len(psk) != TunnelPSKSize || bytes.Equal(psk, material) {
+		t.Errorf("Expected a %d byte key derived from the stored one", TunnelPSKSize)
+	}
+	if again, _ := DeriveTunnelPSK(material); !bytes.Equal(again, psk) {
+		t.Error("Expected the derivation to be the same everywhere")
+	}
+
+	if _, err := Generate("pair", TypeKeyPair, "x25519", 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TunnelPSK("pair"); err == nil {
+		t.Error("Expected a key pair not to be used as a pre-shared key")
+	}
+	if _, err := TunnelPSK("missing"); err == nil {
+		t.Error("Expected a missing key to be an error")
+	}
+}
+
+func TestLegacyKeyFile(t *testing.T) {
+	dir := setup(t)
+	keysDir := filepath.Join(dir, "config", "keys")
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	secret := bytes.Repeat([]byte{7}, 32)
+	legacy := `{"kid":"old","kty":"oct","alg":"psk256","fingerprint":"` + Fingerprint(secret) +
+		`","k":"` + base64.RawURLEncoding.EncodeToString(secret) + `"}`
+	if err := os.WriteFile(filepath.Join(keysDir, "old.json"), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(keysDir, "pair.json"), []byte(`{"kid":"pair","kty":"KEM","alg":"x25519"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := Get("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if material, err := key.Material(nil); err != nil || !bytes.Equal(material, secret) || key.SealedWith() != "none" {
+		t.Errorf("Expected the key written in the clear to be read: %v", err)
+	}
+	if pair, err := Get("pair"); err != nil || pair.Type != TypeKeyPair {
+		t.Errorf("Expected the KEM type to be read as %s, got %+v: %v", TypeKeyPair, pair, err)
+	}
+}
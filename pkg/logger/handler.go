@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// traceKey marks the context of a debug message of a module at debug level,
+// which the console writes whatever its level
+type traceKey struct{}
+
+// multiHandler sends every record to each of its handlers that is enabled for it
+type multiHandler []slog.Handler
+
+func (h multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, handler := range h {
+		if handler.Enabled(ctx, r.Level) {
+			errs = append(errs, handler.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (h multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return handlers
+}
+
+// consoleHandler writes errors to stderr, and other records from its level,
+// or traced debug messages unless it is quiet, to stdout
+type consoleHandler struct {
+	stdout slog.Handler
+	stderr slog.Handler
+	level  *slog.LevelVar
+}
+
+func (h *consoleHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= ErrorLevel || level >= h.level.Level() {
+		return true
+	}
+	traced, _ := ctx.Value(traceKey{}).(bool)
+	return traced && h.level.Level() <= InfoLevel
+}
+
+func (h *consoleHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= ErrorLevel {
+		return h.stderr.Handle(ctx, r)
+	}
+	return h.stdout.Handle(ctx, r)
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &consoleHandler{stdout: h.stdout.WithAttrs(attrs), stderr: h.stderr.WithAttrs(attrs), level: h.level}
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	return &consoleHandler{stdout: h.stdout.WithGroup(name), stderr: h.stderr.WithGroup(name), level: h.level}
+}
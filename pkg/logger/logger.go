@@ -1,11 +1,16 @@
 package logger
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/spf13/viper"
@@ -13,40 +18,130 @@ import (
 )
 
 // LogLevel represents the severity of a log message
-type LogLevel int
+type LogLevel = slog.Level
 
 // Log levels
 const (
-	DebugLevel LogLevel = iota
-	InfoLevel
-	ErrorLevel
+	DebugLevel LogLevel = slog.LevelDebug
+	InfoLevel  LogLevel = slog.LevelInfo
+	ErrorLevel LogLevel = slog.LevelError
 )
 
-// String returns the string representation of the log level
-func (l LogLevel) String() string {
-	switch l {
-	case DebugLevel:
-		return "DEBUG"
-	case InfoLevel:
-		return "INFO"
-	case ErrorLevel:
-		return "ERROR"
-	default:
-		return "UNKNOWN"
-	}
-}
+// Module is a part of ipsec-vpn whose log level can be set on its own in
+// log.levels, e.g. log.levels.ike: debug to debug an IKE interop issue
+// without debug messages from everything else
+type Module string
+
+// Modules
+const (
+	IKE     Module = "ike"     // IKE negotiation and peer authentication
+	XFRM    Module = "xfrm"    // Kernel XFRM policies and states
+	Tunnel  Module = "tunnel"  // Tunnel lifecycle
+	Network Module = "network" // Interfaces, routes and advertised networks
+	API     Module = "api"     // RESTCONF and metrics servers
+)
+
+// Modules lists every module
+var Modules = []Module{IKE, XFRM, Tunnel, Network, API}
+
+// Log rotation modes, set by log.rotation
+const (
+	RotationInternal = "internal" // Rotate by size and age with lumberjack
+	RotationExternal = "external" // Leave rotation to logrotate or journald
+)
 
-// Logger represents a logger instance
+// Logger writes every message to the log file as JSON, and to the console as
+// text: debug messages with --verbose, info messages unless quiet, and errors
+// always, on stderr
 type Logger struct {
-	debugLogger *log.Logger
-	infoLogger  *log.Logger
-	errorLogger *log.Logger
-	verbose     bool
+	slog    *slog.Logger
+	console *slog.LevelVar // Lowest level written to stdout
+	reopen  func() error
 }
 
 // defaultLogger is the package-level logger instance
 var defaultLogger *Logger
 
+// directory is where the default logger writes, once Init has picked it
+var directory string
+
+// handleSignal makes sure SIGUSR1 is only watched once, however often Init runs
+var handleSignal sync.Once
+
+// appendFile is a log file that is opened for appending and can be reopened
+// after logrotate has moved it away
+type appendFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func openAppendFile(path string) (*appendFile, error) {
+	f := &appendFile{path: path}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *appendFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Write(p)
+}
+
+// Reopen closes the file and opens the file now at its path
+func (f *appendFile) Reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	return nil
+}
+
+// openLogFile opens the log file for the rotation mode in log.rotation,
+// returning it and a function that reopens it
+func openLogFile(logFile string) (io.Writer, func() error, error) {
+	switch rotation := viper.GetString("log.rotation"); rotation {
+	case "", RotationInternal:
+	case RotationExternal:
+		f, err := openAppendFile(logFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		return f, f.Reopen, nil
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown log rotation %q, rotating internally\n", rotation)
+	}
+
+	rotatingLogger := &lumberjack.Logger{
+		Filename:   logFile,
+		MaxSize:    viper.GetInt("log.max_size"),     // megabytes
+		MaxBackups: viper.GetInt("log.max_backups"),  // number of backups
+		MaxAge:     viper.GetInt("log.max_age"),      // days
+		Compress:   viper.GetBool("log.compress"),    // compress rotated files
+	}
+
+	// Set defaults if not specified in config
+	if rotatingLogger.MaxSize == 0 {
+		rotatingLogger.MaxSize = 10 // 10 MB
+	}
+	if rotatingLogger.MaxBackups == 0 {
+		rotatingLogger.MaxBackups = 5
+	}
+	if rotatingLogger.MaxAge == 0 {
+		rotatingLogger.MaxAge = 30 // 30 days
+	}
+	// lumberjack opens the file again on the next write after Close
+	return rotatingLogger, rotatingLogger.Close, nil
+}
+
 // checkDirWritable checks if a directory exists and is writable
 func checkDirWritable(dir string) error {
 	// Check if directory exists
@@ -113,51 +208,31 @@ func Init(verbose bool) error {
 	}
 
 	// Configure log rotation
+	directory = logDir
 	logFile := filepath.Join(logDir, "ipsec-vpn.log")
-	rotatingLogger := &lumberjack.Logger{
-		Filename:   logFile,
-		MaxSize:    viper.GetInt("log.max_size"),     // megabytes
-		MaxBackups: viper.GetInt("log.max_backups"),  // number of backups
-		MaxAge:     viper.GetInt("log.max_age"),      // days
-		Compress:   viper.GetBool("log.compress"),    // compress rotated files
-	}
-
-	// Set defaults if not specified in config
-	if rotatingLogger.MaxSize == 0 {
-		rotatingLogger.MaxSize = 10 // 10 MB
-	}
-	if rotatingLogger.MaxBackups == 0 {
-		rotatingLogger.MaxBackups = 5
-	}
-	if rotatingLogger.MaxAge == 0 {
-		rotatingLogger.MaxAge = 30 // 30 days
+	fileWriter, reopen, err := openLogFile(logFile)
+	if err != nil {
+		return err
 	}
 
-	// Create multi-writer for console and file
-	var debugWriter, infoWriter, errorWriter io.Writer
-
-	// If verbose, write debug logs to both stdout and file
 	if verbose {
-		debugWriter = io.MultiWriter(os.Stdout, rotatingLogger)
-		infoWriter = io.MultiWriter(os.Stdout, rotatingLogger)
 		// Print log file location in verbose mode
 		fmt.Printf("Logging to file: %s\n", logFile)
-	} else {
-		// In non-verbose mode, debug logs go only to file
-		debugWriter = rotatingLogger
-		infoWriter = io.MultiWriter(os.Stdout, rotatingLogger)
-	}
-
-	// Error logs always go to stderr and file
-	errorWriter = io.MultiWriter(os.Stderr, rotatingLogger)
-
-	// Create the logger
-	defaultLogger = &Logger{
-		debugLogger: log.New(debugWriter, "DEBUG: ", log.Ldate|log.Ltime),
-		infoLogger:  log.New(infoWriter, "INFO: ", log.Ldate|log.Ltime),
-		errorLogger: log.New(errorWriter, "ERROR: ", log.Ldate|log.Ltime),
-		verbose:     verbose,
 	}
+	defaultLogger = newLogger(fileWriter, reopen, verbose)
+
+	// logrotate's postrotate, or a manual kill -USR1, reopens the log file
+	handleSignal.Do(func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGUSR1)
+		go func() {
+			for range sigs {
+				if err := Reopen(); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to reopen log file: %v\n", err)
+				}
+			}
+		}()
+	})
 
 	return nil
 }
@@ -185,106 +260,197 @@ func New(verbose bool) (*Logger, error) {
 
 	// Configure log rotation
 	logFile := filepath.Join(logDir, "ipsec-vpn.log")
-	rotatingLogger := &lumberjack.Logger{
-		Filename:   logFile,
-		MaxSize:    viper.GetInt("log.max_size"),     // megabytes
-		MaxBackups: viper.GetInt("log.max_backups"),  // number of backups
-		MaxAge:     viper.GetInt("log.max_age"),      // days
-		Compress:   viper.GetBool("log.compress"),    // compress rotated files
+	fileWriter, reopen, err := openLogFile(logFile)
+	if err != nil {
+		return nil, err
 	}
 
-	// Set defaults if not specified in config
-	if rotatingLogger.MaxSize == 0 {
-		rotatingLogger.MaxSize = 10 // 10 MB
-	}
-	if rotatingLogger.MaxBackups == 0 {
-		rotatingLogger.MaxBackups = 5
+	return newLogger(fileWriter, reopen, verbose), nil
+}
+
+// newLogger returns a Logger writing to a log file and the console
+func newLogger(file io.Writer, reopen func() error, verbose bool) *Logger {
+	console := new(slog.LevelVar)
+	if !verbose {
+		console.Set(InfoLevel)
 	}
-	if rotatingLogger.MaxAge == 0 {
-		rotatingLogger.MaxAge = 30 // 30 days
+	return &Logger{
+		slog: slog.New(multiHandler{
+			slog.NewJSONHandler(file, &slog.HandlerOptions{Level: DebugLevel}),
+			&consoleHandler{
+				stdout: slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: DebugLevel}),
+				stderr: slog.NewTextHandler(os.Stderr, nil),
+				level:  console,
+			},
+		}),
+		console: console,
+		reopen:  reopen,
 	}
+}
 
-	// Create multi-writer for console and file
-	var debugWriter, infoWriter, errorWriter io.Writer
-
-	// If verbose, write debug logs to both stdout and file
-	if verbose {
-		debugWriter = io.MultiWriter(os.Stdout, rotatingLogger)
-		infoWriter = io.MultiWriter(os.Stdout, rotatingLogger)
-	} else {
-		// In non-verbose mode, debug logs go only to file
-		debugWriter = rotatingLogger
-		infoWriter = io.MultiWriter(os.Stdout, rotatingLogger)
+// Reopen closes and reopens the log file, so that writes go to a new file once
+// an external tool such as logrotate has moved the old one away
+func (l *Logger) Reopen() error {
+	if l.reopen == nil {
+		return nil
 	}
-
-	// Error logs always go to stderr and file
-	errorWriter = io.MultiWriter(os.Stderr, rotatingLogger)
-
-	// Create the logger
-	return &Logger{
-		debugLogger: log.New(debugWriter, "DEBUG: ", log.Ldate|log.Ltime),
-		infoLogger:  log.New(infoWriter, "INFO: ", log.Ldate|log.Ltime),
-		errorLogger: log.New(errorWriter, "ERROR: ", log.Ldate|log.Ltime),
-		verbose:     verbose,
-	}, nil
+	return l.reopen()
 }
 
 // Debug logs a debug message
 func (l *Logger) Debug(format string, v ...interface{}) {
-	l.debugLogger.Printf(format, v...)
+	l.slog.Debug(fmt.Sprintf(format, v...))
 }
 
 // Info logs an info message
 func (l *Logger) Info(format string, v ...interface{}) {
-	l.infoLogger.Printf(format, v...)
+	l.slog.Info(fmt.Sprintf(format, v...))
 }
 
 // Error logs an error message
 func (l *Logger) Error(format string, v ...interface{}) {
-	l.errorLogger.Printf(format, v...)
+	l.slog.Error(fmt.Sprintf(format, v...))
 }
 
-// Debug logs a debug message using the default logger
-func Debug(format string, v ...interface{}) {
+// Slog returns the *slog.Logger behind a Logger, for messages with attributes
+func (l *Logger) Slog() *slog.Logger {
+	return l.slog
+}
+
+// get returns the default logger, initializing it with default settings if
+// Init has not been called
+func get() *Logger {
 	if defaultLogger == nil {
-		// Initialize with default settings if not initialized
 		if err := Init(false); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
-			return
+			return nil
 		}
 	}
-	defaultLogger.Debug(format, v...)
+	return defaultLogger
+}
+
+// Debug logs a debug message using the default logger
+func Debug(format string, v ...interface{}) {
+	if l := get(); l != nil {
+		l.Debug(format, v...)
+	}
 }
 
 // Info logs an info message using the default logger
 func Info(format string, v ...interface{}) {
-	if defaultLogger == nil {
-		// Initialize with default settings if not initialized
-		if err := Init(false); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
-			return
-		}
+	if l := get(); l != nil {
+		l.Info(format, v...)
 	}
-	defaultLogger.Info(format, v...)
 }
 
 // Error logs an error message using the default logger
 func Error(format string, v ...interface{}) {
-	if defaultLogger == nil {
-		// Initialize with default settings if not initialized
-		if err := Init(false); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
+	if l := get(); l != nil {
+		l.Error(format, v...)
+	}
+}
+
+// Slog returns the default logger as a *slog.Logger, for messages with
+// attributes
+func Slog() *slog.Logger {
+	if l := get(); l != nil {
+		return l.slog
+	}
+	return slog.New(multiHandler{})
+}
+
+// ParseLevel returns the level named by a log.levels setting
+func ParseLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return DebugLevel, fmt.Errorf("unknown log level %q, expected debug, info or error", name)
+}
+
+// level returns the level set for the module in log.levels. Modules without
+// one log like the package-level functions do.
+func (m Module) level() (LogLevel, bool) {
+	level, err := ParseLevel(viper.GetString("log.levels." + string(m)))
+	return level, err == nil
+}
+
+// log logs a message of the module, or of the rest of ipsec-vpn without one,
+// with the module as an attribute. Debug messages of a module at debug level
+// are written to the console as well as the log file, as with --verbose.
+func (m Module) log(level LogLevel, msg string, args ...any) {
+	ctx := context.Background()
+	if m != "" {
+		min, set := m.level()
+		if level < min {
 			return
 		}
+		if set && level < InfoLevel {
+			ctx = context.WithValue(ctx, traceKey{}, true)
+		}
+		args = append([]any{slog.String("module", string(m))}, args...)
 	}
-	defaultLogger.Error(format, v...)
+	if l := get(); l != nil {
+		l.slog.Log(ctx, level, msg, args...)
+	}
+}
+
+// Debug logs a debug message of the module
+func (m Module) Debug(format string, v ...interface{}) {
+	m.log(DebugLevel, fmt.Sprintf(format, v...))
+}
+
+// Info logs an info message of the module, unless its level is error
+func (m Module) Info(format string, v ...interface{}) {
+	m.log(InfoLevel, fmt.Sprintf(format, v...))
+}
+
+// Error logs an error message of the module
+func (m Module) Error(format string, v ...interface{}) {
+	m.log(ErrorLevel, fmt.Sprintf(format, v...))
 }
 
 // SetVerbose sets the verbose mode for the default logger
 func SetVerbose(verbose bool) {
+	if defaultLogger == nil {
+		return
+	}
+	if verbose {
+		defaultLogger.console.Set(DebugLevel)
+	} else {
+		defaultLogger.console.Set(InfoLevel)
+	}
+}
+
+// SetQuiet stops debug and info messages from the default logger being written
+// to stdout, for commands whose output is consumed by other programs
+func SetQuiet() {
 	if defaultLogger != nil {
-		defaultLogger.verbose = verbose
+		defaultLogger.console.Set(ErrorLevel)
+	}
+}
+
+// Reopen reopens the log file of the default logger. It is called on SIGUSR1.
+func Reopen() error {
+	if defaultLogger == nil {
+		return nil
+	}
+	return defaultLogger.Reopen()
+}
+
+// Directory returns the directory log files are written to
+func Directory() string {
+	if directory != "" {
+		return directory
+	}
+	if dir := viper.GetString("log.directory"); dir != "" {
+		return dir
 	}
+	return "/var/log/ipsec-vpn"
 }
 
 // GetTimestamp returns a formatted timestamp for logging
@@ -0,0 +1,159 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestExternalRotation(t *testing.T) {
+	viper.Set("log.rotation", RotationExternal)
+	defer viper.Set("log.rotation", "")
+
+	path := filepath.Join(t.TempDir(), "ipsec-vpn.log")
+	w, reopen, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("openLogFile failed: %v", err)
+	}
+	w.Write([]byte("before\n"))
+
+	// logrotate moves the file away, then signals the process to reopen it
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopen(); err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	w.Write([]byte("after\n"))
+
+	for file, want := range map[string]string{path + ".1": "before\n", path: "after\n"} {
+		data, err := os.ReadFile(file)
+		if err != nil || string(data) != want {
+			t.Errorf("Expected %s to hold %q, got %q: %v", filepath.Base(file), want, data, err)
+		}
+	}
+}
+
+func TestInternalRotationReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipsec-vpn.log")
+	w, reopen, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("openLogFile failed: %v", err)
+	}
+	w.Write([]byte("before\n"))
+	os.Rename(path, path+".1")
+	reopen()
+	w.Write([]byte("after\n"))
+
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "after") || strings.Contains(string(data), "before") {
+		t.Errorf("Expected writes after reopening to go to a new file, got %q", data)
+	}
+}
+
+// capture makes the default logger write to a log file in memory, and to a
+// console in memory at info level, returning both
+func capture(t *testing.T) (file, stdout *strings.Builder) {
+	file, stdout = new(strings.Builder), new(strings.Builder)
+	console := new(slog.LevelVar)
+	defaultLogger = &Logger{
+		slog: slog.New(multiHandler{
+			slog.NewJSONHandler(file, &slog.HandlerOptions{Level: DebugLevel}),
+			&consoleHandler{
+				stdout: slog.NewTextHandler(stdout, &slog.HandlerOptions{Level: DebugLevel, ReplaceAttr: noTime}),
+				stderr: slog.NewTextHandler(stdout, &slog.HandlerOptions{ReplaceAttr: noTime}),
+				level:  console,
+			},
+		}),
+		console: console,
+	}
+	console.Set(InfoLevel)
+	t.Cleanup(func() { defaultLogger = nil })
+	return file, stdout
+}
+
+func noTime(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	return a
+}
+
+// records decodes the JSON records of a log file, without their time
+func records(t *testing.T, file string) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(file), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected a JSON record, got %q: %v", line, err)
+		}
+		delete(record, "time")
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestModuleLevels(t *testing.T) {
+	file, stdout := capture(t)
+
+	viper.Set("log.levels.ike", "debug")
+	viper.Set("log.levels.api", "error")
+	defer viper.Set("log.levels.ike", "")
+	defer viper.Set("log.levels.api", "")
+
+	IKE.Debug("proposal %d", 1)
+	API.Info("client connected")
+	API.Error("listen failed")
+	Network.Debug("found interfaces")
+
+	want := []map[string]any{
+		{"level": "DEBUG", "msg": "proposal 1", "module": "ike"},
+		{"level": "ERROR", "msg": "listen failed", "module": "api"},
+		{"level": "DEBUG", "msg": "found interfaces", "module": "network"},
+	}
+	if got := records(t, file.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected module levels to filter messages, got:\n%s", file.String())
+	}
+
+	// Only the debug message of the module at debug level reaches the console
+	wantConsole := "level=DEBUG msg=\"proposal 1\" module=ike\nlevel=ERROR msg=\"listen failed\" module=api\n"
+	if stdout.String() != wantConsole {
+		t.Errorf("Expected %q on the console, got %q", wantConsole, stdout.String())
+	}
+
+	stdout.Reset()
+	SetQuiet()
+	IKE.Debug("proposal %d", 2)
+	Info("tunnel up")
+	if stdout.Len() != 0 {
+		t.Errorf("Expected nothing on the console when quiet, got %q", stdout.String())
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Expected an unknown level to be rejected")
+	}
+}
+
+func TestStructured(t *testing.T) {
+	file, _ := capture(t)
+
+	Structured{Module: Tunnel}.Info("Stopping tunnel", "tunnel", "office")
+	Structured{}.Error("Failed to stop tunnel", "tunnel", "office", "err", errors.New("link busy"), slog.Int("tries", 3), "dangling")
+	Slog().With("peer", "198.51.100.1").Debug("Sent DPD")
+
+	want := []map[string]any{
+		{"level": "INFO", "msg": "Stopping tunnel", "module": "tunnel", "tunnel": "office"},
+		{"level": "ERROR", "msg": "Failed to stop tunnel", "tunnel": "office", "err": "link busy", "tries": 3.0, "!BADKEY": "dangling"},
+		{"level": "DEBUG", "msg": "Sent DPD", "peer": "198.51.100.1"},
+	}
+	if got := records(t, file.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected key-value pairs as attributes, got:\n%s", file.String())
+	}
+}
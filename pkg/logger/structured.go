@@ -0,0 +1,25 @@
+package logger
+
+// Structured writes messages in the style of log/slog to the log of a module,
+// or to the general log without one: a constant message followed by key-value
+// pairs or slog.Attr values, which become attributes of the record. Packages
+// that can be embedded in other programs, such as tunnel and crypto, log
+// through an interface that both Structured and *slog.Logger satisfy.
+type Structured struct {
+	Module Module
+}
+
+// Debug logs a debug message with key-value pairs
+func (s Structured) Debug(msg string, args ...any) {
+	s.Module.log(DebugLevel, msg, args...)
+}
+
+// Info logs an info message with key-value pairs
+func (s Structured) Info(msg string, args ...any) {
+	s.Module.log(InfoLevel, msg, args...)
+}
+
+// Error logs an error message with key-value pairs
+func (s Structured) Error(msg string, args ...any) {
+	s.Module.log(ErrorLevel, msg, args...)
+}
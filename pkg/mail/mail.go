@@ -0,0 +1,161 @@
+// Package mail sends plain text email through an SMTP server
+package mail
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TLS modes
+const (
+	TLSAuto     = "auto"     // STARTTLS when the server offers it, TLS on port 465
+	TLSStartTLS = "starttls" // Require STARTTLS
+	TLSImplicit = "tls"      // Connect over TLS, as on port 465
+	TLSNone     = "none"     // Never use TLS
+)
+
+// DefaultTimeout bounds connecting to the server and sending one message
+const DefaultTimeout = 30 * time.Second
+
+// Server is an SMTP server and the credentials to authenticate with, if any
+type Server struct {
+	Address  string // host:port
+	TLS      string // One of the TLS modes, TLSAuto if empty
+	Username string
+	Password string
+	Timeout  time.Duration // DefaultTimeout if 0
+}
+
+// Mailer sends messages from a sender to a fixed list of recipients
+type Mailer struct {
+	Server Server
+	From   string
+	To     []string
+}
+
+// FromConfig returns the mailer configured in alerts.email, which both alerts
+// and events are emailed through, or nil if alerts.email.smtp is not set
+func FromConfig() *Mailer {
+	server := viper.GetString("alerts.email.smtp")
+	if server == "" {
+		return nil
+	}
+	return &Mailer{
+		Server: Server{
+			Address:  server,
+			TLS:      viper.GetString("alerts.email.tls"),
+			Username: viper.GetString("alerts.email.username"),
+			Password: viper.GetString("alerts.email.password"),
+		},
+		From: viper.GetString("alerts.email.from"),
+		To:   viper.GetStringSlice("alerts.email.to"),
+	}
+}
+
+// Send sends a plain text message to the recipients
+func (m *Mailer) Send(subject, body string, date time.Time) error {
+	return m.Server.Send(m.From, m.To, Message(m.From, m.To, subject, body, date))
+}
+
+// ValidTLS reports whether mode is a TLS mode
+func ValidTLS(mode string) bool {
+	switch mode {
+	case "", TLSAuto, TLSStartTLS, TLSImplicit, TLSNone:
+		return true
+	}
+	return false
+}
+
+// Send sends a message to the recipients
+func (s Server) Send(from string, to []string, msg []byte) error {
+	host, port, err := net.SplitHostPort(s.Address)
+	if err != nil {
+		return err
+	}
+	if !ValidTLS(s.TLS) {
+		return fmt.Errorf("unknown TLS mode '%s'", s.TLS)
+	}
+	implicit := s.TLS == TLSImplicit || (s.TLS != TLSNone && s.TLS != TLSStartTLS && port == "465")
+
+	timeout := cmp.Or(s.Timeout, DefaultTimeout)
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if implicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.Address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", s.Address)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if !implicit && s.TLS != TLSNone {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		} else if s.TLS == TLSStartTLS {
+			return errors.New("server does not offer STARTTLS")
+		}
+	}
+	if s.Username != "" {
+		// PlainAuth refuses to send the password without TLS, except to localhost
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Message formats a plain text message. The subject is encoded if it is not
+// ASCII, and line endings in the body are converted to CRLF.
+func Message(from string, to []string, subject, body string, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject), " ")))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	if !strings.HasSuffix(body, "\n") {
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DashboardUID identifies the generated dashboard, so importing it again
+// replaces the previous version
+const DashboardUID = "ipsec-vpn-tunnels"
+
+// selector restricts a query to the tunnels chosen in the dashboard variables
+var selector = fmt.Sprintf(`{%s=~"$tenant",%s=~"$tunnel"}`, LabelTenant, LabelTunnel)
+
+// datasource refers to the Prometheus data source chosen in the dashboard
+var datasource = map[string]any{"type": "prometheus", "uid": "${datasource}"}
+
+// target is a Prometheus query of a panel
+type target struct {
+	expr, legend string
+	instant      bool
+}
+
+// panel returns a panel of the given type at a grid position
+func panel(id int, typ, title string, x, y, w, h int, unit string, targets ...target) map[string]any {
+	queries := make([]map[string]any, len(targets))
+	for i, t := range targets {
+		q := map[string]any{
+			"datasource":   datasource,
+			"expr":         t.expr,
+			"legendFormat": t.legend,
+			"refId":        string(rune('A' + i)),
+		}
+		if t.instant {
+			q["instant"] = true
+			q["format"] = "table"
+		}
+		queries[i] = q
+	}
+	return map[string]any{
+		"id":          id,
+		"type":        typ,
+		"title":       title,
+		"datasource":  datasource,
+		"gridPos":     map[string]int{"x": x, "y": y, "w": w, "h": h},
+		"targets":     queries,
+		"fieldConfig": map[string]any{"defaults": map[string]any{"unit": unit}, "overrides": []any{}},
+		"options":     map[string]any{},
+	}
+}
+
+// variable returns a dashboard variable listing the values of a label
+func variable(name, label, query string) map[string]any {
+	return map[string]any{
+		"name":       name,
+		"label":      label,
+		"type":       "query",
+		"datasource": datasource,
+		"query":      map[string]any{"query": query, "refId": name},
+		"definition": query,
+		"refresh":    2, // On time range change
+		"includeAll": true,
+		"multi":      true,
+		"allValue":   ".*",
+		"current":    map[string]any{"text": "All", "value": "$__all"},
+		"sort":       1,
+	}
+}
+
+// Dashboard returns a Grafana dashboard of tunnel health and throughput, built
+// on the tunnel metrics and labels. It asks for a Prometheus data source when
+// imported.
+func Dashboard() ([]byte, error) {
+	rate := func(metric string) string {
+		return fmt.Sprintf("rate(%s%s[$__rate_interval]) * 8", metric, selector)
+	}
+
+	up := panel(1, "stat", "Tunnels up", 0, 0, 6, 4, "none",
+		target{expr: fmt.Sprintf("sum(%s%s)", TunnelUp, selector)})
+	down := panel(2, "stat", "Tunnels down", 6, 0, 6, 4, "none",
+		target{expr: fmt.Sprintf("count(%s%s == 0) or vector(0)", TunnelUp, selector)})
+	down["fieldConfig"] = map[string]any{
+		"defaults": map[string]any{
+			"unit":  "none",
+			"color": map[string]any{"mode": "thresholds"},
+			"thresholds": map[string]any{"mode": "absolute", "steps": []map[string]any{
+				{"color": "green", "value": nil},
+				{"color": "red", "value": 1},
+			}},
+		},
+		"overrides": []any{},
+	}
+	received := panel(3, "stat", "Received", 12, 0, 6, 4, "bps",
+		target{expr: fmt.Sprintf("sum(%s)", rate(TunnelReceiveBytes))})
+	sent := panel(4, "stat", "Sent", 18, 0, 6, 4, "bps",
+		target{expr: fmt.Sprintf("sum(%s)", rate(TunnelTransmitBytes))})
+
+	status := panel(5, "state-timeline", "Tunnel status", 0, 4, 24, 8, "none",
+		target{expr: TunnelUp + selector, legend: "{{" + LabelTunnel + "}}"})
+	status["fieldConfig"] = map[string]any{
+		"defaults": map[string]any{
+			"color": map[string]any{"mode": "thresholds"},
+			"thresholds": map[string]any{"mode": "absolute", "steps": []map[string]any{
+				{"color": "red", "value": nil},
+				{"color": "green", "value": 1},
+			}},
+			"mappings": []map[string]any{{
+				"type": "value",
+				"options": map[string]any{
+					"0": map[string]any{"text": "Down", "color": "red"},
+					"1": map[string]any{"text": "Up", "color": "green"},
+				},
+			}},
+		},
+		"overrides": []any{},
+	}
+
+	rxByTunnel := panel(6, "timeseries", "Received by tunnel", 0, 12, 12, 8, "bps",
+		target{expr: rate(TunnelReceiveBytes), legend: "{{" + LabelTunnel + "}}"})
+	txByTunnel := panel(7, "timeseries", "Sent by tunnel", 12, 12, 12, 8, "bps",
+		target{expr: rate(TunnelTransmitBytes), legend: "{{" + LabelTunnel + "}}"})
+	handshake := panel(8, "timeseries", "Time since last handshake (WireGuard)", 0, 20, 12, 8, "s",
+		target{expr: fmt.Sprintf("time() - %s%s", TunnelLastHandshake, selector), legend: "{{" + LabelTunnel + "}}"})
+
+	tunnels := panel(9, "table", "Tunnels", 12, 20, 12, 8, "none",
+		target{expr: TunnelInfo + selector, instant: true})
+	tunnels["transformations"] = []map[string]any{{
+		"id": "organize",
+		"options": map[string]any{
+			"excludeByName": map[string]bool{"Time": true, "Value": true, "__name__": true, "instance": true, "job": true},
+			"indexByName":   map[string]int{LabelTunnel: 0, LabelPeer: 1, LabelTenant: 2, "mode": 3, "encryption": 4},
+		},
+	}}
+
+	slaLatency := panel(10, "timeseries", "SLA latency and jitter", 0, 28, 12, 8, "s",
+		target{expr: TunnelSLALatency + selector, legend: "{{" + LabelTunnel + "}} latency"},
+		target{expr: TunnelSLAJitter + selector, legend: "{{" + LabelTunnel + "}} jitter"})
+	slaLoss := panel(11, "timeseries", "SLA probe loss", 12, 28, 12, 8, "percentunit",
+		target{expr: TunnelSLALoss + selector, legend: "{{" + LabelTunnel + "}}"})
+
+	dashboard := map[string]any{
+		"uid":           DashboardUID,
+		"title":         "ipsec-vpn tunnels",
+		"description":   "Health and throughput of ipsec-vpn tunnels, from 'ipsec-vpn metrics serve'.",
+		"tags":          []string{"ipsec-vpn"},
+		"timezone":      "browser",
+		"schemaVersion": 39,
+		"version":       1,
+		"editable":      true,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]any{"list": []map[string]any{
+			{
+				"name":  "datasource",
+				"label": "Data source",
+				"type":  "datasource",
+				"query": "prometheus",
+			},
+			variable(LabelTenant, "Tenant", fmt.Sprintf("label_values(%s, %s)", TunnelInfo, LabelTenant)),
+			variable(LabelTunnel, "Tunnel", fmt.Sprintf(`label_values(%s{%s=~"$tenant"}, %s)`, TunnelInfo, LabelTenant, LabelTunnel)),
+		}},
+		"panels": []map[string]any{up, down, received, sent, status, rxByTunnel, txByTunnel, handshake, tunnels, slaLatency, slaLoss},
+	}
+	return json.MarshalIndent(dashboard, "", "  ")
+}
@@ -0,0 +1,207 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+)
+
+// Labels identifying a tunnel on every tunnel metric. The names are stable, so
+// dashboards and alerts can rely on them.
+const (
+	LabelTunnel = "tunnel" // Tunnel name
+	LabelPeer   = "peer"   // Remote IP of the tunnel
+	LabelTenant = "tenant" // Network namespace of the tunnel, empty in the host namespace
+)
+
+// Tunnel metric names
+const (
+	TunnelInfo           = "ipsec_vpn_tunnel_info"
+	TunnelUp             = "ipsec_vpn_tunnel_up"
+	TunnelLastTransition = "ipsec_vpn_tunnel_last_transition_timestamp_seconds"
+	TunnelReceiveBytes   = "ipsec_vpn_tunnel_receive_bytes_total"
+	TunnelTransmitBytes  = "ipsec_vpn_tunnel_transmit_bytes_total"
+	TunnelLastHandshake  = "ipsec_vpn_tunnel_last_handshake_timestamp_seconds"
+	TunnelRateLimit      = "ipsec_vpn_tunnel_rate_limit_bits_per_second"
+	TunnelSLALatency     = "ipsec_vpn_tunnel_sla_latency_seconds"
+	TunnelSLAJitter      = "ipsec_vpn_tunnel_sla_jitter_seconds"
+	TunnelSLALoss        = "ipsec_vpn_tunnel_sla_loss_ratio"
+	TunnelSLAMet         = "ipsec_vpn_tunnel_sla_met"
+	TunnelSLALastProbe   = "ipsec_vpn_tunnel_sla_last_probe_timestamp_seconds"
+	TunnelReauthInterval = "ipsec_vpn_tunnel_reauth_interval_seconds"
+	TunnelReauths        = "ipsec_vpn_tunnel_reauthentications_total"
+	TunnelLastReauth     = "ipsec_vpn_tunnel_last_reauth_timestamp_seconds"
+	TunnelReauthOverdue  = "ipsec_vpn_tunnel_reauth_overdue"
+)
+
+// ContentType is the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// family describes a metric
+type family struct {
+	name, kind, help string
+}
+
+// sample is a value of a metric with its labels
+type sample struct {
+	labels [][2]string
+	value  float64
+}
+
+// families lists the tunnel metrics in the order they are written
+var families = []family{
+	{name: TunnelInfo, kind: "gauge", help: "Tunnel settings as labels, always 1."},
+	{name: TunnelUp, kind: "gauge", help: "Whether the tunnel is up."},
+	{name: TunnelLastTransition, kind: "gauge", help: "Time of the tunnel's last status change."},
+	{name: TunnelReceiveBytes, kind: "counter", help: "Bytes received through the tunnel."},
+	{name: TunnelTransmitBytes, kind: "counter", help: "Bytes sent through the tunnel."},
+	{name: TunnelLastHandshake, kind: "gauge", help: "Time of the last WireGuard handshake."},
+	{name: TunnelRateLimit, kind: "gauge", help: "Bandwidth limit of the peer in each direction."},
+	{name: TunnelSLALatency, kind: "gauge", help: "Mean round-trip time of the last SLA probe operation."},
+	{name: TunnelSLAJitter, kind: "gauge", help: "Jitter of the last SLA probe operation."},
+	{name: TunnelSLALoss, kind: "gauge", help: "Share of probes lost in the last SLA probe operation."},
+	{name: TunnelSLAMet, kind: "gauge", help: "Whether the last SLA probe operation met the thresholds."},
+	{name: TunnelSLALastProbe, kind: "gauge", help: "Time of the last SLA probe operation."},
+	{name: TunnelReauthInterval, kind: "gauge", help: "Time between full reauthentications of the IKE SA."},
+	{name: TunnelReauths, kind: "counter", help: "Reauthentications of the IKE SA the IKE daemon reported, by result."},
+	{name: TunnelLastReauth, kind: "gauge", help: "Time of the last successful reauthentication of the IKE SA."},
+	{name: TunnelReauthOverdue, kind: "gauge", help: "Whether the grace of a due reauthentication ran out without one succeeding."},
+}
+
+// labels returns the identifying labels of a tunnel, followed by any extra ones
+func labels(t *tunnel.Tunnel, extra ...[2]string) [][2]string {
+	return append([][2]string{{LabelTunnel, t.Name}, {LabelPeer, t.RemoteIP}, {LabelTenant, t.Namespace}}, extra...)
+}
+
+// WriteTunnels writes the metrics of all tunnels in the Prometheus text format.
+// Traffic counters are left out for tunnels whose interface does not exist.
+func WriteTunnels(w io.Writer) error {
+	tunnels, err := tunnel.ListAll()
+	if err != nil {
+		return err
+	}
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
+
+	samples := make(map[string][]sample)
+	add := func(name string, labels [][2]string, value float64) {
+		samples[name] = append(samples[name], sample{labels, value})
+	}
+	for _, t := range tunnels {
+		id := labels(t)
+		add(TunnelInfo, labels(t, [2]string{"mode", t.Mode}, [2]string{"encryption", t.Encryption}), 1)
+		up := 0.0
+		if t.Status == tunnel.StatusUp {
+			up = 1
+		}
+		add(TunnelUp, id, up)
+		if !t.LastTransition.IsZero() {
+			add(TunnelLastTransition, id, seconds(t.LastTransition))
+		}
+		if t.RateLimit > 0 {
+			add(TunnelRateLimit, id, float64(t.RateLimit))
+		}
+		if history, err := tunnel.SLAHistory(t.Name); err == nil && t.SLA != nil && len(history) > 0 {
+			last := history[len(history)-1]
+			add(TunnelSLALatency, id, last.Latency/1000)
+			add(TunnelSLAJitter, id, last.Jitter/1000)
+			add(TunnelSLALoss, id, last.Loss/100)
+			met := 0.0
+			if last.Met {
+				met = 1
+			}
+			add(TunnelSLAMet, id, met)
+			add(TunnelSLALastProbe, id, seconds(last.Time))
+		}
+		if t.Mode != tunnel.ModeWireGuard {
+			addReauth(add, t, id)
+		}
+		stats, err := tunnel.GetStats(t.Name)
+		if err != nil {
+			continue
+		}
+		add(TunnelReceiveBytes, id, float64(stats.RxBytes))
+		add(TunnelTransmitBytes, id, float64(stats.TxBytes))
+		if !stats.LastHandshake.IsZero() {
+			add(TunnelLastHandshake, id, seconds(stats.LastHandshake))
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, f := range families {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range samples[f.name] {
+			fmt.Fprintf(&buf, "%s{%s} %s\n", f.name, formatLabels(s.labels), formatValue(s.value))
+		}
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// addReauth adds the reauthentication metrics of a tunnel: the interval and
+// whether it is overdue for those that reauthenticate, and the outcomes the IKE
+// daemon reported
+func addReauth(add func(string, [][2]string, float64), t *tunnel.Tunnel, id [][2]string) {
+	p, _ := tunnel.EffectiveReauth(t)
+	counts, err := tunnel.Reauths(t.Name)
+	if err != nil {
+		counts = &tunnel.ReauthCounts{}
+	}
+	if p.Interval > 0 {
+		add(TunnelReauthInterval, id, p.Interval.Seconds())
+		overdue := 0.0
+		if tunnel.ReauthOverdue(t, p, counts, time.Now()) {
+			overdue = 1
+		}
+		add(TunnelReauthOverdue, id, overdue)
+	}
+	if counts.LastAttempt.IsZero() {
+		return
+	}
+	add(TunnelReauths, labels(t, [2]string{"result", tunnel.ReauthSuccess}), float64(counts.Successes))
+	add(TunnelReauths, labels(t, [2]string{"result", tunnel.ReauthFailure}), float64(counts.Failures))
+	if !counts.LastSuccess.IsZero() {
+		add(TunnelLastReauth, id, seconds(counts.LastSuccess))
+	}
+}
+
+// seconds returns a time as seconds since the epoch
+func seconds(t time.Time) float64 {
+	return float64(t.UnixMilli()) / 1000
+}
+
+// formatLabels formats label pairs, escaping their values
+func formatLabels(labels [][2]string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, l[0], escaper.Replace(l[1]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// formatValue formats a sample value without an exponent
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Handler serves the tunnel metrics at /metrics
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := WriteTunnels(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		w.Write(buf.Bytes())
+	})
+	return mux
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestWriteTunnels(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	defer viper.Set("config_dir", "")
+	if err := os.MkdirAll(filepath.Join(dir, "tunnels"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stored := `{"name":"office","local_ip":"192.0.2.1","remote_ip":"198.51.100.1","local_subnet":"10.0.0.0/16",
+		"remote_subnet":"10.1.0.0/16","encryption":"aes256gcm","mode":"ipsec","namespace":"acme\"corp",
+		"rate_limit":10000000,"status":"UP","last_transition":"2026-10-16T09:00:00.5Z",
+		"reauth_interval":"8h","reauth_grace":"10m"}`
+	if err := os.WriteFile(filepath.Join(dir, "tunnels", "office.json"), []byte(stored), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "reauth"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	reauths := `{"successes":3,"failures":1,"last_attempt":"2026-10-16T17:00:00Z","last_success":"2026-10-16T17:00:00Z"}`
+	if err := os.WriteFile(filepath.Join(dir, "reauth", "office.json"), []byte(reauths), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ContentType {
+		t.Fatalf("Expected metrics, got %d: %s", w.Code, w.Body)
+	}
+	id := `tunnel="office",peer="198.51.100.1",tenant="acme\"corp"`
+	for _, want := range []string{
+		"# TYPE " + TunnelReceiveBytes + " counter",
+		TunnelInfo + "{" + id + `,mode="ipsec",encryption="aes256gcm"} 1`,
+		TunnelLastTransition + "{" + id + "} 1792141200.5",
+		TunnelRateLimit + "{" + id + "} 10000000",
+		TunnelReauthInterval + "{" + id + "} 28800",
+		TunnelReauths + "{" + id + `,result="success"} 3`,
+		TunnelReauths + "{" + id + `,result="failure"} 1`,
+		TunnelLastReauth + "{" + id + "} 1792170000",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, w.Body)
+		}
+	}
+	// The interface does not exist, so there are no traffic counters
+	if strings.Contains(w.Body.String(), TunnelReceiveBytes+"{") {
+		t.Errorf("Expected no traffic counters without an interface:\n%s", w.Body)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	data, err := Dashboard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dashboard struct {
+		UID    string `json:"uid"`
+		Panels []struct {
+			Title   string `json:"title"`
+			Targets []struct {
+				Expr string `json:"expr"`
+			} `json:"targets"`
+		} `json:"panels"`
+	}
+	if err := json.Unmarshal(data, &dashboard); err != nil {
+		t.Fatalf("Invalid dashboard JSON: %v", err)
+	}
+	if dashboard.UID != DashboardUID || len(dashboard.Panels) == 0 {
+		t.Fatalf("Unexpected dashboard %s", data)
+	}
+
+	known := make(map[string]bool)
+	for _, f := range families {
+		known[f.name] = true
+	}
+	metric := regexp.MustCompile(`ipsec_vpn_\w+`)
+	for _, p := range dashboard.Panels {
+		for _, target := range p.Targets {
+			for _, name := range metric.FindAllString(target.Expr, -1) {
+				if !known[name] {
+					t.Errorf("Panel %q queries unknown metric %s", p.Title, name)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/perf"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// AccountingProtocols are the protocols packet accounting counts by, with
+// icmp counting ICMPv6 too and other everything else
+var AccountingProtocols = []string{"tcp", "udp", "icmp", "esp", "other"}
+
+// accountingNumbers maps the IP protocol numbers packet accounting tells apart
+// to their protocol
+var accountingNumbers = []struct {
+	number   int32
+	protocol string
+}{
+	{unix.IPPROTO_TCP, "tcp"},
+	{unix.IPPROTO_UDP, "udp"},
+	{unix.IPPROTO_ICMP, "icmp"},
+	{unix.IPPROTO_ICMPV6, "icmp"},
+	{unix.IPPROTO_ESP, "esp"},
+}
+
+// bpfDir is where the counters of packet accounting are pinned, on the BPF
+// filesystem
+var bpfDir = "/sys/fs/bpf/ipsec-vpn"
+
+// xfrmStatPath is where the kernel reports the errors of its IPsec processing
+var xfrmStatPath = "/proc/net/xfrm_stat"
+
+// Offsets in the struct __sk_buff a tc program is handed
+const (
+	skbLen      = 0
+	skbProtocol = 16
+)
+
+// Priorities of the tc filters on the clsact qdisc of an interface: packet
+// accounting runs first so that it counts what the rate limit drops
+const (
+	accountingPriority = 1
+	policePriority     = 2
+)
+
+// Counter counts packets and their bytes
+type Counter struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// PacketCounters are the packets an interface received and sent, by protocol
+type PacketCounters struct {
+	Received map[string]Counter `json:"received"`
+	Sent     map[string]Counter `json:"sent"`
+}
+
+// Drop counts the packets dropped for one reason
+type Drop struct {
+	Reason  string `json:"reason"`
+	Packets uint64 `json:"packets"`
+}
+
+// htons returns a 16-bit value in network byte order as the native one reads it
+func htons(v uint16) int32 {
+	return int32(binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v)))
+}
+
+// accountingProgram returns the program counting the packets of one direction
+// into the map: it reads the protocol of IPv4 and IPv6 packets and adds the
+// packet and its length to the slot of that protocol, leaving the packet to the
+// filters after it
+func accountingProgram(mapFd int, direction int) ([]bpfInsn, error) {
+	slot := func(protocol string) int32 {
+		return int32(direction*len(AccountingProtocols) + slices.Index(AccountingProtocols, protocol))
+	}
+
+	a := newBPFAsm()
+	a.emit(bpfMovX, 6, 1, 0, 0) // r6 = skb
+	a.emit(bpfMovK, 7, 0, 0, slot("other"))
+	a.emit(bpfLdxW, 2, 6, skbProtocol, 0)
+	a.emit(bpfMovK, 3, 0, 0, 9) // Offset of the protocol in an IPv4 header
+	a.jump(bpfJeqK, 2, htons(unix.ETH_P_IP), "load")
+	a.emit(bpfMovK, 3, 0, 0, 6) // and of the next header in an IPv6 one
+	a.jump(bpfJeqK, 2, htons(unix.ETH_P_IPV6), "load")
+	a.jump(bpfJa, 0, 0, "count")
+
+	// bpf_skb_load_bytes_relative(skb, offset, fp-8, 1, BPF_HDR_START_NET)
+	a.label("load")
+	a.emit(bpfMovX, 1, 6, 0, 0)
+	a.emit(bpfMovX, 2, 3, 0, 0)
+	a.emit(bpfMovX, 3, 10, 0, 0)
+	a.emit(bpfAddK, 3, 0, 0, -8)
+	a.emit(bpfMovK, 4, 0, 0, 1)
+	a.emit(bpfMovK, 5, 0, 0, unix.BPF_HDR_START_NET)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncSkbLoadBytesRelative)
+	a.jump(bpfJneK, 0, 0, "count")
+	a.emit(bpfLdxB, 1, 10, -8, 0)
+	for _, n := range accountingNumbers {
+		a.emit(bpfMovK, 7, 0, 0, slot(n.protocol))
+		a.jump(bpfJeqK, 1, n.number, "count")
+	}
+	a.emit(bpfMovK, 7, 0, 0, slot("other"))
+
+	// The counters are per CPU, so they are added to without atomics
+	a.label("count")
+	a.emit(bpfStxW, 10, 7, -4, 0)
+	a.loadMap(1, mapFd)
+	a.emit(bpfMovX, 2, 10, 0, 0)
+	a.emit(bpfAddK, 2, 0, 0, -4)
+	a.emit(bpfCall, 0, 0, 0, bpfFuncMapLookupElem)
+	a.jump(bpfJeqK, 0, 0, "exit")
+	a.emit(bpfLdxDW, 1, 0, 0, 0)
+	a.emit(bpfAddK, 1, 0, 0, 1)
+	a.emit(bpfStxDW, 0, 1, 0, 0)
+	a.emit(bpfLdxW, 1, 6, skbLen, 0)
+	a.emit(bpfLdxDW, 2, 0, 8, 0)
+	a.emit(bpfAddX, 2, 1, 0, 0)
+	a.emit(bpfStxDW, 0, 2, 8, 0)
+
+	a.label("exit")
+	a.emit(bpfMovK, 0, 0, 0, -1) // TC_ACT_UNSPEC
+	a.emit(bpfExit, 0, 0, 0, 0)
+	return a.assemble()
+}
+
+// accountingPin returns where the counters of packet accounting by name are pinned
+func accountingPin(name string) string {
+	return filepath.Join(bpfDir, name)
+}
+
+// accountingFilters returns the filters running the packet accounting programs
+// of an interface, on ingress then egress
+func accountingFilters(index int) []*netlink.BpfFilter {
+	var filters []*netlink.BpfFilter
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		filters = append(filters, &netlink.BpfFilter{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: index,
+				Parent:    parent,
+				Handle:    1,
+				Priority:  accountingPriority,
+				Protocol:  unix.ETH_P_ALL,
+			},
+			Fd:           -1,
+			Name:         "ipsec-vpn-accounting",
+			DirectAction: true,
+		})
+	}
+	return filters
+}
+
+// InstallPacketAccounting attaches eBPF programs to both directions of an
+// interface that count its packets by protocol, into counters pinned under
+// name. Counters pinned already are kept counting, so that they survive the
+// interface being recreated.
+func InstallPacketAccounting(handle *netlink.Handle, iface, name string) error {
+	link, err := handle.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %v", iface, err)
+	}
+
+	pin := accountingPin(name)
+	mapFd, err := bpfGetPinned(pin)
+	if errors.Is(err, unix.ENOENT) {
+		size := uint32(2 * len(AccountingProtocols))
+		if mapFd, err = bpfCreateMap(unix.BPF_MAP_TYPE_PERCPU_ARRAY, 4, 16, size, "ipsec_vpn_acct"); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(bpfDir, 0700); err != nil {
+			unix.Close(mapFd)
+			return fmt.Errorf("failed to create %s, is the BPF filesystem mounted on /sys/fs/bpf? %v", bpfDir, err)
+		}
+		if err := bpfPin(mapFd, pin); err != nil {
+			unix.Close(mapFd)
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	defer unix.Close(mapFd)
+
+	if err := ensureClsact(handle, link); err != nil {
+		return err
+	}
+	logger.Network.Debug("Installing packet accounting on %s", iface)
+	for direction, filter := range accountingFilters(link.Attrs().Index) {
+		insns, err := accountingProgram(mapFd, direction)
+		if err != nil {
+			return err
+		}
+		progFd, err := bpfLoadProgram(unix.BPF_PROG_TYPE_SCHED_CLS, insns, "ipsec_vpn_acct")
+		if err != nil {
+			return err
+		}
+		// The filter holds on to the program once attached
+		filter.Fd = progFd
+		err = handle.FilterReplace(filter)
+		unix.Close(progFd)
+		if err != nil {
+			_ = RemovePacketAccounting(handle, iface, name)
+			return fmt.Errorf("failed to attach packet accounting to %s: %v", iface, err)
+		}
+	}
+	return nil
+}
+
+// RemovePacketAccounting detaches the packet accounting programs from an
+// interface, if it still exists, and unpins their counters
+func RemovePacketAccounting(handle *netlink.Handle, iface, name string) error {
+	var errs []error
+	if link, err := handle.LinkByName(iface); err == nil {
+		for _, filter := range accountingFilters(link.Attrs().Index) {
+			// A filter without a handle takes all of its priority with it
+			filter.Handle = 0
+			if err := handle.FilterDel(filter); err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EINVAL) {
+				errs = append(errs, err)
+			}
+		}
+		if err := releaseClsact(handle, link); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := os.Remove(accountingPin(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove packet accounting from %s: %v", iface, errors.Join(errs...))
+	}
+	return nil
+}
+
+// ReadPacketCounters returns the counters of packet accounting pinned under name,
+// summed over the CPUs
+func ReadPacketCounters(name string) (*PacketCounters, error) {
+	fd, err := bpfGetPinned(accountingPin(name))
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	// Per-CPU values come one per possible CPU, online or not
+	possible, err := os.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := perf.ParseCPUList(strings.TrimSpace(string(possible)))
+	if err != nil {
+		return nil, err
+	}
+
+	counters := &PacketCounters{Received: make(map[string]Counter), Sent: make(map[string]Counter)}
+	value := make([]byte, 16*(slices.Max(cpus)+1))
+	for direction, counts := range []map[string]Counter{counters.Received, counters.Sent} {
+		for i, protocol := range AccountingProtocols {
+			if err := bpfLookup(fd, uint32(direction*len(AccountingProtocols)+i), value); err != nil {
+				return nil, err
+			}
+			var c Counter
+			for cpu := 0; cpu < len(value); cpu += 16 {
+				c.Packets += binary.NativeEndian.Uint64(value[cpu:])
+				c.Bytes += binary.NativeEndian.Uint64(value[cpu+8:])
+			}
+			counts[protocol] = c
+		}
+	}
+	return counters, nil
+}
+
+// Drops returns the packets an interface dropped, by reason: those its link
+// counters report, and those its rate limit dropped. Reasons without drops are
+// left out.
+func Drops(handle *netlink.Handle, iface string) ([]Drop, error) {
+	link, err := handle.LinkByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %v", iface, err)
+	}
+
+	var drops []Drop
+	add := func(reason string, packets uint64) {
+		if packets > 0 {
+			drops = append(drops, Drop{reason, packets})
+		}
+	}
+	if s := link.Attrs().Statistics; s != nil {
+		add("dropped on receive", s.RxDropped)
+		add("receive errors", s.RxErrors)
+		add("bad checksum or sequence", s.RxCrcErrors+s.RxFifoErrors)
+		add("dropped on send", s.TxDropped)
+		add("send errors", s.TxErrors)
+		add("no route to peer", s.TxCarrierErrors)
+	}
+
+	if filters, err := handle.FilterList(link, netlink.HANDLE_MIN_INGRESS); err == nil {
+		for _, filter := range filters {
+			if u32, ok := filter.(*netlink.U32); ok && u32.Priority == policePriority {
+				for _, action := range u32.Actions {
+					if s := action.Attrs().Statistics; s != nil && s.Queue != nil {
+						add("rate limit on receive", uint64(s.Queue.Drops))
+					}
+				}
+			}
+		}
+	}
+	if qdiscs, err := handle.QdiscList(link); err == nil {
+		for _, qdisc := range qdiscs {
+			if _, ok := qdisc.(*netlink.Tbf); !ok {
+				continue
+			}
+			if s := qdisc.Attrs().Statistics; s != nil && s.Queue != nil {
+				add("rate limit on send", uint64(s.Queue.Drops))
+			}
+		}
+	}
+	return drops, nil
+}
+
+// XfrmErrors returns the errors of the kernel's IPsec processing that have
+// happened, by name, such as XfrmInNoStates. They are counted for all SAs.
+func XfrmErrors() ([]Drop, error) {
+	f, err := os.Open(xfrmStatPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var drops []Drop
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Such as "XfrmInNoStates          	3"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[1], 10, 64); err == nil && n > 0 {
+			drops = append(drops, Drop{fields[0], n})
+		}
+	}
+	return drops, scanner.Err()
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// appRulePriority is the priority of the policy routing rules sending
+	// marked traffic to the routing table of its tunnel, after the inspection
+	// rules and ahead of the main table
+	appRulePriority = 1010
+
+	// appMarkBase and appTableBase are added to the index of a tunnel interface
+	// to give the firewall mark of the traffic classified to it and the routing
+	// table of its route
+	appMarkBase  = 0x7a000000
+	appTableBase = 0x20000
+
+	// appChain holds the rules marking the traffic of applications, commented
+	// with the interface it is routed through
+	appChain = "app_route"
+)
+
+// AppMatch selects the traffic sent by local processes: those running as a
+// user, or those in a cgroup
+type AppMatch struct {
+	UID    int    // With Cgroup empty
+	Cgroup string // Path below the cgroup v2 mount, such as system.slice/restic.service
+}
+
+// expression returns the nft expression matching the traffic
+func (a AppMatch) expression() string {
+	if a.Cgroup != "" {
+		return fmt.Sprintf("socket cgroupv2 level %d %q", len(strings.Split(a.Cgroup, "/")), a.Cgroup)
+	}
+	return fmt.Sprintf("meta skuid %d", a.UID)
+}
+
+// SetAppRoutes sends the traffic of the processes each of matches selects
+// through iface, whatever its destination, in the address family given: the
+// traffic is marked by nft in the output path, and a policy routing rule looks
+// marked traffic up in a routing table of the interface's own holding a default
+// route through it. Earlier matches of iface are replaced. It runs nft in the
+// calling thread's network namespace, which handle must be of.
+func SetAppRoutes(handle *netlink.Handle, iface string, ipv6 bool, matches []AppMatch) error {
+	if err := ClearAppRoutes(handle, iface); err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	link, err := handle.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %v", iface, err)
+	}
+	index := link.Attrs().Index
+	mark, table := uint32(appMarkBase+index), appTableBase+index
+
+	family, dst := netlink.FAMILY_V4, &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	if ipv6 {
+		family, dst = netlink.FAMILY_V6, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	route := netlink.Route{Dst: dst, LinkIndex: index, Table: table, Family: family}
+	if err := handle.RouteReplace(&route); err != nil {
+		return fmt.Errorf("failed to add application route: %v", err)
+	}
+
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Mark = mark
+	rule.Table = table
+	rule.Priority = appRulePriority
+	if err := handle.RuleAdd(rule); err != nil && !errors.Is(err, unix.EEXIST) {
+		_ = ClearAppRoutes(handle, iface)
+		return fmt.Errorf("failed to add application rule: %v", err)
+	}
+
+	// A route chain looks the route up again once the mark is set
+	var script strings.Builder
+	fmt.Fprintf(&script, "add table inet %s\n", inspectTable)
+	fmt.Fprintf(&script, "add chain inet %s %s { type route hook output priority mangle; }\n", inspectTable, appChain)
+	for _, m := range matches {
+		fmt.Fprintf(&script, "add rule inet %s %s %s meta mark set 0x%x comment %q\n", inspectTable, appChain, m.expression(), mark, iface)
+	}
+	if err := nft(script.String()); err != nil {
+		_ = ClearAppRoutes(handle, iface)
+		return fmt.Errorf("failed to mark application traffic: %v", err)
+	}
+
+	logger.Network.Debug("Routing the traffic of %d applications through %s with mark 0x%x", len(matches), iface, mark)
+	return nil
+}
+
+// ClearAppRoutes removes the marking rules, policy routing rules and routes
+// added by SetAppRoutes for iface. An interface that no longer exists took its
+// routes with it, but its rules are still removed.
+func ClearAppRoutes(handle *netlink.Handle, iface string) error {
+	var errs []error
+	if err := deleteCommentedRules(appChain, iface); err != nil {
+		errs = append(errs, err)
+	}
+
+	if link, err := handle.LinkByName(iface); err == nil {
+		mark := uint32(appMarkBase + link.Attrs().Index)
+		rules, err := handle.RuleList(netlink.FAMILY_ALL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list rules: %v", err))
+		}
+		for _, rule := range rules {
+			if rule.Mark != mark || rule.Priority != appRulePriority {
+				continue
+			}
+			if err := handle.RuleDel(&rule); err != nil && !errors.Is(err, unix.ENOENT) {
+				errs = append(errs, err)
+			}
+			routes, err := handle.RouteListFiltered(rule.Family, &netlink.Route{Table: rule.Table}, netlink.RT_FILTER_TABLE)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			for _, route := range routes {
+				if err := handle.RouteDel(&route); err != nil && !errors.Is(err, unix.ESRCH) {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove application routes: %v", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/retry"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// batchWorkers is how many netlink sockets a Batch keeps requests in flight on
+const batchWorkers = 8
+
+var (
+	sharedOnce   sync.Once
+	sharedHandle *netlink.Handle
+)
+
+// Handle returns the netlink handle shared by the route and XFRM changes in
+// the current network namespace, which keeps one socket open per netlink
+// family instead of opening one for every request. Without it, as when the
+// sockets cannot be opened, requests fall back to a socket each.
+func Handle() *netlink.Handle {
+	sharedOnce.Do(func() {
+		h, err := netlink.NewHandle(unix.NETLINK_ROUTE, unix.NETLINK_XFRM)
+		if err != nil {
+			logger.Network.Debug("Failed to open a shared netlink handle: %v", err)
+			return
+		}
+		sharedHandle = h
+	})
+	if sharedHandle == nil {
+		return &netlink.Handle{}
+	}
+	return sharedHandle
+}
+
+// Busy makes a netlink request, trying again under retry.netlink while the
+// kernel answers EBUSY
+func Busy(request func() error) error {
+	return retry.Do(context.Background(), retry.Netlink, retry.Busy, request)
+}
+
+// Batch collects route and XFRM changes to make together. Run pipelines them
+// over a few netlink sockets, so that bulk changes such as the XFRM policies
+// of a port range, or reconciling every tunnel, do not wait for the kernel to
+// answer each request before sending the next.
+type Batch struct {
+	ops []func(*netlink.Handle) error
+}
+
+// Len returns the number of changes in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// RouteReplace adds or replaces a route
+func (b *Batch) RouteReplace(route netlink.Route) {
+	b.ops = append(b.ops, func(h *netlink.Handle) error { return h.RouteReplace(&route) })
+}
+
+// RouteDel deletes a route, if it exists
+func (b *Batch) RouteDel(route netlink.Route) {
+	b.ops = append(b.ops, func(h *netlink.Handle) error { return absent(h.RouteDel(&route), unix.ESRCH) })
+}
+
+// XfrmPolicyUpdate adds or updates an XFRM policy
+func (b *Batch) XfrmPolicyUpdate(policy netlink.XfrmPolicy) {
+	b.ops = append(b.ops, func(h *netlink.Handle) error { return h.XfrmPolicyUpdate(&policy) })
+}
+
+// XfrmPolicyDel deletes an XFRM policy, if it exists
+func (b *Batch) XfrmPolicyDel(policy netlink.XfrmPolicy) {
+	b.ops = append(b.ops, func(h *netlink.Handle) error { return absent(h.XfrmPolicyDel(&policy), unix.ENOENT) })
+}
+
+// absent returns the error of a deletion, unless it is gone, the error the
+// kernel answers for what does not exist
+func absent(err error, gone unix.Errno) error {
+	if errors.Is(err, gone) {
+		return nil
+	}
+	return err
+}
+
+// Run makes every change in the batch, carrying on past errors, and returns
+// them joined. Small batches go through the shared handle.
+func (b *Batch) Run() error {
+	if len(b.ops) <= batchWorkers {
+		var errs []error
+		for _, op := range b.ops {
+			errs = append(errs, Busy(func() error { return op(Handle()) }))
+		}
+		return errors.Join(errs...)
+	}
+
+	ops := make(chan func(*netlink.Handle) error)
+	errs := make([]error, batchWorkers)
+	var wg sync.WaitGroup
+	for i := range batchWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h, err := netlink.NewHandle(unix.NETLINK_ROUTE, unix.NETLINK_XFRM)
+			if err != nil {
+				h = Handle()
+			} else {
+				defer h.Close()
+			}
+			for op := range ops {
+				errs[i] = errors.Join(errs[i], Busy(func() error { return op(h) }))
+			}
+		}()
+	}
+	for _, op := range b.ops {
+		ops <- op
+	}
+	close(ops)
+	wg.Wait()
+
+	logger.Network.Debug("Made %d netlink changes in a batch", len(b.ops))
+	return errors.Join(errs...)
+}
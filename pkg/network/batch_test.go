@@ -0,0 +1,109 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestBatchRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		ops    int
+		failed []int // Changes the kernel refuses
+		busy   []int // Changes the kernel is busy for once
+	}{
+		{"empty", 0, nil, nil},
+		{"shared handle", batchWorkers, nil, nil},
+		{"shared handle with errors", 3, []int{0, 2}, []int{1}},
+		{"pipelined", 100, nil, nil},
+		{"pipelined with errors", 100, []int{7, 42, 99}, []int{3, 50}},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		calls := make([]int, tt.ops)
+		var b Batch
+		for i := range tt.ops {
+			b.ops = append(b.ops, func(h *netlink.Handle) error {
+				if h == nil {
+					return errors.New("no handle")
+				}
+				mu.Lock()
+				calls[i]++
+				n := calls[i]
+				mu.Unlock()
+				switch {
+				case slices.Contains(tt.failed, i):
+					return fmt.Errorf("change %d: %w", i, unix.EINVAL)
+				case slices.Contains(tt.busy, i) && n == 1:
+					return unix.EBUSY
+				}
+				return nil
+			})
+		}
+		if b.Len() != tt.ops {
+			t.Errorf("%s: expected %d changes, got %d", tt.name, tt.ops, b.Len())
+		}
+
+		err := b.Run()
+		for i, n := range calls {
+			want := 1
+			if slices.Contains(tt.busy, i) {
+				want = 2
+			}
+			if n != want {
+				t.Errorf("%s: expected change %d to be made %d time(s), got %d", tt.name, i, want, n)
+			}
+		}
+		if len(tt.failed) == 0 {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %v", tt.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, unix.EINVAL) {
+			t.Errorf("%s: expected the errors of the refused changes, got %v", tt.name, err)
+			continue
+		}
+		for _, i := range tt.failed {
+			if !strings.Contains(err.Error(), fmt.Sprintf("change %d:", i)) {
+				t.Errorf("%s: expected the error of change %d in %v", tt.name, i, err)
+			}
+		}
+	}
+}
+
+func TestAbsent(t *testing.T) {
+	tests := []struct {
+		err  error
+		gone unix.Errno
+		want error
+	}{
+		{nil, unix.ENOENT, nil},
+		{unix.ENOENT, unix.ENOENT, nil},
+		{fmt.Errorf("delete policy: %w", unix.ESRCH), unix.ESRCH, nil},
+		{unix.ESRCH, unix.ENOENT, unix.ESRCH},
+		{unix.EPERM, unix.ESRCH, unix.EPERM},
+	}
+	for _, tt := range tests {
+		if got := absent(tt.err, tt.gone); !errors.Is(got, tt.want) || (got == nil) != (tt.want == nil) {
+			t.Errorf("Expected absent(%v, %v) to be %v, got %v", tt.err, tt.gone, tt.want, got)
+		}
+	}
+}
+
+func TestHandleShared(t *testing.T) {
+	h := Handle()
+	if h == nil {
+		t.Fatal("Expected a handle")
+	}
+	if sharedHandle != nil && Handle() != h {
+		t.Error("Expected the same handle each time")
+	}
+}
@@ -0,0 +1,226 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// eBPF opcodes the packet accounting program is written with. Arithmetic and
+// moves are 64-bit.
+const (
+	bpfLdxW    = 0x61 // dst = *(u32 *)(src + off)
+	bpfLdxB    = 0x71 // dst = *(u8 *)(src + off)
+	bpfLdxDW   = 0x79 // dst = *(u64 *)(src + off)
+	bpfStxW    = 0x63 // *(u32 *)(dst + off) = src
+	bpfStxDW   = 0x7b // *(u64 *)(dst + off) = src
+	bpfMovK    = 0xb7 // dst = imm
+	bpfMovX    = 0xbf // dst = src
+	bpfAddK    = 0x07 // dst += imm
+	bpfAddX    = 0x0f // dst += src
+	bpfLdImm64 = 0x18 // dst = imm64, over two instructions
+	bpfJa      = 0x05 // goto off
+	bpfJeqK    = 0x15 // if dst == imm goto off
+	bpfJneK    = 0x55 // if dst != imm goto off
+	bpfCall    = 0x85 // r0 = helper imm(r1, ..., r5)
+	bpfExit    = 0x95 // return r0
+)
+
+// eBPF helpers the packet accounting program calls
+const (
+	bpfFuncMapLookupElem        = 1
+	bpfFuncSkbLoadBytesRelative = 68
+)
+
+// bpfInsn is an eBPF instruction as the kernel takes it
+type bpfInsn struct {
+	Op   uint8
+	Regs uint8 // Source register in the high nibble, destination in the low one
+	Off  int16
+	Imm  int32
+}
+
+// bpfAsm assembles an eBPF program, resolving jumps to labels
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string // Label each jump goes to, by its index
+}
+
+func newBPFAsm() *bpfAsm {
+	return &bpfAsm{labels: make(map[string]int), jumps: make(map[int]string)}
+}
+
+// emit appends an instruction
+func (a *bpfAsm) emit(op, dst, src uint8, off int16, imm int32) {
+	a.insns = append(a.insns, bpfInsn{Op: op, Regs: src<<4 | dst&0xf, Off: off, Imm: imm})
+}
+
+// jump appends a jump to a label, comparing dst with imm unless it is bpfJa
+func (a *bpfAsm) jump(op, dst uint8, imm int32, label string) {
+	a.jumps[len(a.insns)] = label
+	a.emit(op, dst, 0, 0, imm)
+}
+
+// loadMap appends the two instructions loading a map into dst
+func (a *bpfAsm) loadMap(dst uint8, fd int) {
+	a.emit(bpfLdImm64, dst, unix.BPF_PSEUDO_MAP_FD, 0, int32(fd))
+	a.emit(0, 0, 0, 0, 0)
+}
+
+// label marks where the next instruction is
+func (a *bpfAsm) label(name string) {
+	a.labels[name] = len(a.insns)
+}
+
+// assemble returns the instructions with the offsets of their jumps
+func (a *bpfAsm) assemble() ([]bpfInsn, error) {
+	insns := make([]bpfInsn, len(a.insns))
+	copy(insns, a.insns)
+	for i, name := range a.jumps {
+		target, ok := a.labels[name]
+		if !ok {
+			return nil, fmt.Errorf("undefined label %s", name)
+		}
+		// Offsets are from the instruction after the jump, and eBPF has no loops
+		if target <= i {
+			return nil, fmt.Errorf("jump back to label %s", name)
+		}
+		insns[i].Off = int16(target - i - 1)
+	}
+	return insns, nil
+}
+
+// The attributes of the bpf(2) commands used here, laid out for 64-bit
+// pointers as the amd64 and arm64 builds have. Pointers are kept as such so
+// that what they point to stays put until the call returns.
+type (
+	bpfMapCreateAttr struct {
+		MapType    uint32
+		KeySize    uint32
+		ValueSize  uint32
+		MaxEntries uint32
+		MapFlags   uint32
+		InnerMapFd uint32
+		NumaNode   uint32
+		MapName    [unix.BPF_OBJ_NAME_LEN]byte
+	}
+	bpfProgLoadAttr struct {
+		ProgType    uint32
+		InsnCnt     uint32
+		Insns       unsafe.Pointer
+		License     unsafe.Pointer
+		LogLevel    uint32
+		LogSize     uint32
+		LogBuf      unsafe.Pointer
+		KernVersion uint32
+		ProgFlags   uint32
+		ProgName    [unix.BPF_OBJ_NAME_LEN]byte
+	}
+	bpfObjAttr struct {
+		Pathname  unsafe.Pointer
+		BpfFd     uint32
+		FileFlags uint32
+	}
+	bpfMapElemAttr struct {
+		MapFd uint32
+		_     uint32
+		Key   unsafe.Pointer
+		Value unsafe.Pointer
+		Flags uint64
+	}
+)
+
+// bpfSyscall runs a bpf(2) command and returns the file descriptor or value it
+// returns
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	runtime.KeepAlive(attr)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// bpfName returns an object name as the kernel takes it, cut to fit
+func bpfName(name string) [unix.BPF_OBJ_NAME_LEN]byte {
+	var b [unix.BPF_OBJ_NAME_LEN]byte
+	copy(b[:len(b)-1], name)
+	return b
+}
+
+// bpfCreateMap creates a map and returns its file descriptor
+func bpfCreateMap(mapType, keySize, valueSize, entries uint32, name string) (int, error) {
+	attr := bpfMapCreateAttr{MapType: mapType, KeySize: keySize, ValueSize: valueSize, MaxEntries: entries, MapName: bpfName(name)}
+	fd, err := bpfSyscall(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("failed to create eBPF map: %v", err)
+	}
+	return fd, nil
+}
+
+// bpfLoadProgram loads a program and returns its file descriptor. A program
+// the verifier rejects is loaded again with its log on, to say why.
+func bpfLoadProgram(progType uint32, insns []bpfInsn, name string) (int, error) {
+	license := []byte("Dual MIT/GPL\x00")
+	attr := bpfProgLoadAttr{
+		ProgType: progType,
+		InsnCnt:  uint32(len(insns)),
+		Insns:    unsafe.Pointer(&insns[0]),
+		License:  unsafe.Pointer(&license[0]),
+		ProgName: bpfName(name),
+	}
+	fd, err := bpfSyscall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		return fd, nil
+	}
+	if !errors.Is(err, unix.EACCES) && !errors.Is(err, unix.EINVAL) {
+		return -1, fmt.Errorf("failed to load eBPF program: %v", err)
+	}
+
+	log := make([]byte, 64*1024)
+	attr.LogLevel, attr.LogSize, attr.LogBuf = 1, uint32(len(log)), unsafe.Pointer(&log[0])
+	if fd, err := bpfSyscall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err == nil {
+		return fd, nil
+	}
+	return -1, fmt.Errorf("failed to load eBPF program: %v: %s", err, unix.ByteSliceToString(log))
+}
+
+// bpfPin pins a map or program to a path on the BPF filesystem
+func bpfPin(fd int, path string) error {
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attr := bpfObjAttr{Pathname: unsafe.Pointer(p), BpfFd: uint32(fd)}
+	if _, err := bpfSyscall(unix.BPF_OBJ_PIN, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return fmt.Errorf("failed to pin eBPF object to %s: %v", path, err)
+	}
+	return nil
+}
+
+// bpfGetPinned opens a map or program pinned to a path
+func bpfGetPinned(path string) (int, error) {
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	attr := bpfObjAttr{Pathname: unsafe.Pointer(p)}
+	fd, err := bpfSyscall(unix.BPF_OBJ_GET, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("failed to open eBPF object %s: %w", path, err)
+	}
+	return fd, nil
+}
+
+// bpfLookup reads the value of a map element into value
+func bpfLookup(fd int, key uint32, value []byte) error {
+	attr := bpfMapElemAttr{MapFd: uint32(fd), Key: unsafe.Pointer(&key), Value: unsafe.Pointer(&value[0])}
+	if _, err := bpfSyscall(unix.BPF_MAP_LOOKUP_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return fmt.Errorf("failed to read eBPF map element %d: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/vishvananda/netlink"
+)
+
+// breakoutProtocol marks the routes added by SetBreakoutRoutes
+const breakoutProtocol = 32
+
+// ListBreakoutRoutes returns the routes installed by SetBreakoutRoutes
+func ListBreakoutRoutes() ([]Route, error) {
+	filter := &netlink.Route{Protocol: breakoutProtocol}
+	netlinkRoutes, err := Handle().RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	routes := make([]Route, 0, len(netlinkRoutes))
+	for _, nlRoute := range netlinkRoutes {
+		if nlRoute.Dst == nil {
+			continue
+		}
+		route := Route{Destination: nlRoute.Dst.String(), Metric: nlRoute.Priority}
+		if nlRoute.Gw != nil {
+			route.Gateway = nlRoute.Gw.String()
+		}
+		if link, err := Handle().LinkByIndex(nlRoute.LinkIndex); err == nil {
+			route.Interface = link.Attrs().Name
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// SetBreakoutRoutes routes destinations out of iface, through gateway if not
+// empty, instead of through any tunnel: being more specific, the routes win over
+// a default route through a VPN. Routes to destinations no longer listed are
+// removed. It returns how many routes were added and removed.
+func SetBreakoutRoutes(destinations []*net.IPNet, iface, gateway string) (int, int, error) {
+	link, err := Handle().LinkByName(iface)
+	if err != nil {
+		return 0, 0, fmt.Errorf("interface %s not found: %v", iface, err)
+	}
+	var gw net.IP
+	if gateway != "" {
+		if gw = net.ParseIP(gateway); gw == nil {
+			return 0, 0, fmt.Errorf("invalid gateway '%s'", gateway)
+		}
+	}
+
+	filter := &netlink.Route{Protocol: breakoutProtocol}
+	existing, err := Handle().RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list routes: %v", err)
+	}
+	installed := make(map[string]netlink.Route, len(existing))
+	for _, r := range existing {
+		if r.Dst != nil {
+			installed[r.Dst.String()] = r
+		}
+	}
+
+	// Breakout lists such as the ranges of a SaaS provider run into thousands
+	var batch Batch
+	added := 0
+	wanted := make(map[string]bool, len(destinations))
+	for _, dst := range destinations {
+		wanted[dst.String()] = true
+		route := netlink.Route{
+			Dst:       dst,
+			LinkIndex: link.Attrs().Index,
+			Gw:        gw,
+			Protocol:  breakoutProtocol,
+		}
+		if r, ok := installed[dst.String()]; ok && r.LinkIndex == route.LinkIndex && r.Gw.Equal(gw) {
+			continue
+		}
+		batch.RouteReplace(route)
+		added++
+	}
+
+	removed := 0
+	for dst, r := range installed {
+		if wanted[dst] {
+			continue
+		}
+		batch.RouteDel(r)
+		removed++
+	}
+	if err := batch.Run(); err != nil {
+		return 0, 0, fmt.Errorf("failed to update breakout routes: %v", err)
+	}
+
+	logger.Network.Debug("Breakout routes through %s: %d added, %d removed", iface, added, removed)
+	return added, removed, nil
+}
+
+// ClearBreakoutRoutes removes every route installed by SetBreakoutRoutes and
+// returns how many there were
+func ClearBreakoutRoutes() (int, error) {
+	filter := &netlink.Route{Protocol: breakoutProtocol}
+	existing, err := Handle().RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list routes: %v", err)
+	}
+	var batch Batch
+	for _, r := range existing {
+		batch.RouteDel(r)
+	}
+	if err := batch.Run(); err != nil {
+		return 0, fmt.Errorf("failed to delete breakout routes: %v", err)
+	}
+	return len(existing), nil
+}
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// splitDefaultProtocol marks the routes added by SetSplitDefault
+const splitDefaultProtocol = 33
+
+// The halves of the address space routed through a tunnel to send it all traffic.
+// Together they are more specific than any default route, which stays in place
+// and takes over again once they are removed.
+var (
+	splitDefaultIPv4 = []string{"0.0.0.0/1", "128.0.0.0/1"}
+	splitDefaultIPv6 = []string{"::/1", "8000::/1"}
+)
+
+// SetSplitDefault routes all traffic of an address family through iface
+func SetSplitDefault(iface string, ipv6 bool) error {
+	link, err := Handle().LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("interface %s not found: %v", iface, err)
+	}
+
+	halves := splitDefaultIPv4
+	if ipv6 {
+		halves = splitDefaultIPv6
+	}
+	for _, half := range halves {
+		_, dst, _ := net.ParseCIDR(half)
+		route := netlink.Route{
+			Dst:       dst,
+			LinkIndex: link.Attrs().Index,
+			Protocol:  splitDefaultProtocol,
+		}
+		if err := Handle().RouteReplace(&route); err != nil {
+			return fmt.Errorf("failed to route %s through %s: %v", half, iface, err)
+		}
+	}
+
+	logger.Network.Debug("Routed all traffic through %s", iface)
+	return nil
+}
+
+// ClearSplitDefault removes the routes SetSplitDefault added through iface. An
+// interface that no longer exists took its routes with it.
+func ClearSplitDefault(iface string) error {
+	routes, err := splitDefaultRoutes(iface)
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		if err := Handle().RouteDel(&r); err != nil && !errors.Is(err, unix.ESRCH) {
+			return fmt.Errorf("failed to delete route to %s: %v", r.Dst, err)
+		}
+	}
+
+	logger.Network.Debug("Removed the routes of all traffic through %s", iface)
+	return nil
+}
+
+// HasSplitDefault reports whether SetSplitDefault routes traffic through iface
+func HasSplitDefault(iface string) (bool, error) {
+	routes, err := splitDefaultRoutes(iface)
+	return len(routes) > 0, err
+}
+
+// splitDefaultRoutes returns the routes SetSplitDefault added through iface
+func splitDefaultRoutes(iface string) ([]netlink.Route, error) {
+	link, err := Handle().LinkByName(iface)
+	if err != nil {
+		return nil, nil
+	}
+	filter := &netlink.Route{Protocol: splitDefaultProtocol, LinkIndex: link.Attrs().Index}
+	routes, err := Handle().RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_OIF)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+	return routes, nil
+}
+
+// PeerPath returns the gateway, empty if the peer is on the link, and interface
+// the kernel routes traffic to a peer through
+func PeerPath(peer string) (string, string, error) {
+	ip := net.ParseIP(peer)
+	if ip == nil {
+		return "", "", fmt.Errorf("invalid peer address '%s'", peer)
+	}
+	routes, err := Handle().RouteGet(ip)
+	if err != nil || len(routes) == 0 {
+		return "", "", fmt.Errorf("no route to peer %s: %v", peer, err)
+	}
+	link, err := Handle().LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return "", "", fmt.Errorf("no interface for the route to peer %s: %v", peer, err)
+	}
+
+	gateway := ""
+	if routes[0].Gw != nil {
+		gateway = routes[0].Gw.String()
+	}
+	return gateway, link.Attrs().Name, nil
+}
+
+// DeletePeerRoute removes the route to a peer added by SetPeerRoute
+func DeletePeerRoute(peer string) error {
+	ip := net.ParseIP(peer)
+	if ip == nil {
+		return fmt.Errorf("invalid peer address '%s'", peer)
+	}
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	route := netlink.Route{
+		Dst:      &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)},
+		Protocol: peerProtocol,
+	}
+	if err := Handle().RouteDel(&route); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("failed to delete route to peer %s: %v", peer, err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+)
+
+// resolvConf is the resolver configuration rewritten when systemd-resolved is not running
+var resolvConf = "/etc/resolv.conf"
+
+// resolvedRunning reports whether name resolution goes through systemd-resolved
+func resolvedRunning() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+	_, err := os.Stat("/run/systemd/resolve")
+	return err == nil
+}
+
+// SetDNS sends name resolution to servers while a tunnel carries all traffic.
+// With systemd-resolved, the servers are set on iface, which then takes every DNS
+// domain; otherwise the resolver configuration is saved to backup, unless a saved
+// copy is already there, and rewritten.
+func SetDNS(iface string, servers []string, backup string) error {
+	if resolvedRunning() {
+		steps := [][]string{
+			append([]string{"dns", iface}, servers...),
+			{"domain", iface, "~."},
+			{"default-route", iface, "true"},
+		}
+		for _, args := range steps {
+			if out, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+				return fmt.Errorf("resolvectl %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+			}
+		}
+		logger.Network.Debug("Set DNS servers %s on %s through systemd-resolved", strings.Join(servers, ", "), iface)
+		return nil
+	}
+
+	if _, err := os.Stat(backup); os.IsNotExist(err) {
+		original, err := os.ReadFile(resolvConf)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read %s: %v", resolvConf, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(backup, original, 0644); err != nil {
+			return fmt.Errorf("failed to save %s: %v", resolvConf, err)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written by ipsec-vpn while all traffic goes through %s\n", iface)
+	for _, s := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if err := os.WriteFile(resolvConf, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", resolvConf, err)
+	}
+	logger.Network.Debug("Set DNS servers %s in %s", strings.Join(servers, ", "), resolvConf)
+	return nil
+}
+
+// RestoreDNS undoes SetDNS
+func RestoreDNS(iface, backup string) error {
+	if resolvedRunning() {
+		// The interface may be gone already, taking its settings with it
+		_ = exec.Command("resolvectl", "revert", iface).Run()
+	}
+
+	original, err := os.ReadFile(backup)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read the saved %s: %v", resolvConf, err)
+	}
+	if err := os.WriteFile(resolvConf, original, 0644); err != nil {
+		return fmt.Errorf("failed to restore %s: %v", resolvConf, err)
+	}
+	logger.Network.Debug("Restored %s", resolvConf)
+	return os.Remove(backup)
+}
@@ -0,0 +1,43 @@
+package network
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+)
+
+// faultPorts is the nft set of the IKE ports whose packets are dropped for
+// fault injection, each until it times out, and faultChains the chains of the
+// ipsec_vpn table dropping them on the way in and out
+const faultPorts = "fault_ike_ports"
+
+var faultChains = map[string]string{"fault_in": "input", "fault_out": "output"}
+
+// DropIKE drops a percentage of the IKE packets to and from UDP ports 500 and
+// 4500, for fault injection, for a while. The ports time out of an nft set in
+// the kernel, so packets stop being dropped then even if nothing clears it. A
+// percentage of 0 stops dropping packets at once. It runs nft in the calling
+// thread's network namespace.
+func DropIKE(percent int, timeout time.Duration) error {
+	script := fmt.Sprintf("add table inet %s\n", inspectTable) +
+		fmt.Sprintf("add set inet %s %s { type inet_service; flags timeout; }\n", inspectTable, faultPorts) +
+		fmt.Sprintf("flush set inet %s %s\n", inspectTable, faultPorts)
+	for chain, hook := range faultChains {
+		script += fmt.Sprintf("add chain inet %s %s { type filter hook %s priority -10; }\n", inspectTable, chain, hook) +
+			fmt.Sprintf("flush chain inet %s %s\n", inspectTable, chain)
+	}
+	if percent > 0 {
+		seconds := max(int(timeout.Seconds()), 1)
+		script += fmt.Sprintf("add element inet %s %s { 500 timeout %ds, 4500 timeout %ds }\n", inspectTable, faultPorts, seconds, seconds)
+		for chain := range faultChains {
+			script += fmt.Sprintf("add rule inet %s %s udp dport @%s numgen random mod 100 < %d drop\n", inspectTable, chain, faultPorts, percent)
+		}
+	}
+	if err := nft(script); err != nil {
+		return fmt.Errorf("failed to set IKE packet drop: %v", err)
+	}
+
+	logger.Network.Debug("Dropping %d%% of IKE packets for %s", percent, timeout)
+	return nil
+}
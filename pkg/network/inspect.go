@@ -0,0 +1,182 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// inspectRulePriority is the priority of the policy routing rules sending
+	// traffic from a tunnel to its inspection interface, ahead of the main table
+	inspectRulePriority = 1000
+
+	// inspectTableBase is added to the index of a tunnel interface to give the
+	// routing table of its inspection route
+	inspectTableBase = 0x10000
+
+	// inspectTable holds the nft rules of ipsec-vpn, and inspectChain the
+	// NFQUEUE rules, one per tunnel interface, commented with the interface name
+	inspectTable = "ipsec_vpn"
+	inspectChain = "inspect"
+)
+
+// SetInspectRoute sends traffic arriving on iface for destination through the
+// inspection interface via, to gateway if it is not on the link, using a policy
+// routing rule and a routing table of the tunnel interface's own
+func SetInspectRoute(handle *netlink.Handle, iface, destination, via, gateway string) error {
+	_, dst, err := net.ParseCIDR(destination)
+	if err != nil {
+		return fmt.Errorf("invalid destination: %v", err)
+	}
+	link, err := handle.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %v", iface, err)
+	}
+	viaLink, err := handle.LinkByName(via)
+	if err != nil {
+		return fmt.Errorf("failed to find inspection interface %s: %v", via, err)
+	}
+	table := inspectTableBase + link.Attrs().Index
+
+	route := netlink.Route{Dst: dst, LinkIndex: viaLink.Attrs().Index, Table: table}
+	if gateway != "" {
+		route.Gw = net.ParseIP(gateway)
+	}
+	if err := handle.RouteReplace(&route); err != nil {
+		return fmt.Errorf("failed to add inspection route: %v", err)
+	}
+
+	rule := netlink.NewRule()
+	rule.IifName = iface
+	rule.Dst = dst
+	rule.Table = table
+	rule.Priority = inspectRulePriority
+	if err := handle.RuleAdd(rule); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("failed to add inspection rule: %v", err)
+	}
+
+	logger.Network.Debug("Sending traffic from %s to %s through %s", iface, destination, via)
+	return nil
+}
+
+// ClearInspectRoute removes the rules and routes added by SetInspectRoute
+func ClearInspectRoute(handle *netlink.Handle, iface string) error {
+	rules, err := handle.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+
+	var errs []error
+	for _, rule := range rules {
+		if rule.IifName != iface || rule.Priority != inspectRulePriority {
+			continue
+		}
+		if err := handle.RuleDel(&rule); err != nil && !errors.Is(err, unix.ENOENT) {
+			errs = append(errs, err)
+		}
+		routes, err := handle.RouteListFiltered(rule.Family, &netlink.Route{Table: rule.Table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, route := range routes {
+			if err := handle.RouteDel(&route); err != nil && !errors.Is(err, unix.ESRCH) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove inspection route: %v", errors.Join(errs...))
+	}
+	return nil
+}
+
+// SetInspectQueue hands traffic arriving on iface for destination to NFQUEUE
+// queue, where an IDS or IPS such as Suricata picks it up. With bypass, traffic
+// is let through while no program listens on the queue; otherwise it is dropped.
+// It runs nft in the calling thread's network namespace.
+func SetInspectQueue(iface, destination string, queue uint16, bypass bool) error {
+	_, dst, err := net.ParseCIDR(destination)
+	if err != nil {
+		return fmt.Errorf("invalid destination: %v", err)
+	}
+	if err := ClearInspectQueue(iface); err != nil {
+		return err
+	}
+
+	family := "ip"
+	if dst.IP.To4() == nil {
+		family = "ip6"
+	}
+	rule := fmt.Sprintf("iifname %q %s daddr %s queue num %d", iface, family, dst, queue)
+	if bypass {
+		rule += " bypass"
+	}
+	script := fmt.Sprintf("add table inet %s\n", inspectTable) +
+		fmt.Sprintf("add chain inet %s %s { type filter hook forward priority 0; }\n", inspectTable, inspectChain) +
+		fmt.Sprintf("add rule inet %s %s %s comment %q\n", inspectTable, inspectChain, rule, iface)
+	if err := nft(script); err != nil {
+		return fmt.Errorf("failed to add inspection queue: %v", err)
+	}
+
+	logger.Network.Debug("Queueing traffic from %s to %s on NFQUEUE %d", iface, destination, queue)
+	return nil
+}
+
+// ClearInspectQueue removes the rule added by SetInspectQueue
+func ClearInspectQueue(iface string) error {
+	if err := deleteCommentedRules(inspectChain, iface); err != nil {
+		return fmt.Errorf("failed to remove inspection queue: %v", err)
+	}
+	return nil
+}
+
+// deleteCommentedRules deletes the rules of a chain of the ipsec_vpn table
+// commented with comment
+func deleteCommentedRules(chain, comment string) error {
+	out, err := exec.Command("nft", "-a", "list", "chain", "inet", inspectTable, chain).Output()
+	if err != nil {
+		return nil // No chain, so no rule
+	}
+
+	var script strings.Builder
+	for _, handle := range ruleHandles(string(out), comment) {
+		fmt.Fprintf(&script, "delete rule inet %s %s handle %s\n", inspectTable, chain, handle)
+	}
+	if script.Len() == 0 {
+		return nil
+	}
+	return nft(script.String())
+}
+
+// ruleHandleRe matches the comment and handle of a rule in 'nft -a list' output
+var ruleHandleRe = regexp.MustCompile(`comment "([^"]*)" # handle (\d+)`)
+
+// ruleHandles returns the handles of the rules commented with comment
+func ruleHandles(listing, comment string) []string {
+	var handles []string
+	for _, m := range ruleHandleRe.FindAllStringSubmatch(listing, -1) {
+		if m[1] == comment {
+			handles = append(handles, m[2])
+		}
+	}
+	return handles
+}
+
+// nft runs an nft script
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
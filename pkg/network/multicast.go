@@ -0,0 +1,120 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/vishvananda/netlink"
+)
+
+// smcrouteDir holds the configuration files smcrouted reads besides its own
+var smcrouteDir = "/etc/smcroute.d"
+
+// MulticastRoute forwards the traffic of a multicast group received on one
+// interface out of others
+type MulticastRoute struct {
+	From   string   // Interface the group is received on
+	Source string   // Sender, or empty for any
+	Group  string   // Group address
+	To     []string // Interfaces the group is sent out of
+}
+
+// smcrouteConfig returns the path of the smcroute configuration of name
+func smcrouteConfig(name string) string {
+	return filepath.Join(smcrouteDir, "ipsec-vpn-"+name+".conf")
+}
+
+// SetMulticastRoutes turns on multicast on iface and has smcroute forward the
+// groups of routes, from a configuration file of its own for name. Routes of a
+// group from the same interface and sender are merged, as smcroute keeps one
+// route for each.
+func SetMulticastRoutes(handle *netlink.Handle, name, iface string, routes []MulticastRoute) error {
+	if _, err := exec.LookPath("smcroutectl"); err != nil {
+		return fmt.Errorf("smcroute is not installed, it forwards multicast traffic")
+	}
+	link, err := handle.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %v", iface, err)
+	}
+	// Point-to-point GRE interfaces come up without it, and smcroute skips them
+	if err := handle.LinkSetMulticastOn(link); err != nil {
+		return fmt.Errorf("failed to enable multicast on %s: %v", iface, err)
+	}
+
+	var merged []MulticastRoute
+	for _, r := range routes {
+		i := slices.IndexFunc(merged, func(m MulticastRoute) bool {
+			return m.From == r.From && m.Source == r.Source && m.Group == r.Group
+		})
+		if i < 0 {
+			merged = append(merged, MulticastRoute{From: r.From, Source: r.Source, Group: r.Group})
+			i = len(merged) - 1
+		}
+		for _, to := range r.To {
+			if !slices.Contains(merged[i].To, to) {
+				merged[i].To = append(merged[i].To, to)
+			}
+		}
+	}
+
+	interfaces := []string{iface}
+	for _, r := range merged {
+		for _, i := range append([]string{r.From}, r.To...) {
+			if !slices.Contains(interfaces, i) {
+				interfaces = append(interfaces, i)
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written by ipsec-vpn for the multicast routes of %s\n", name)
+	for _, i := range interfaces {
+		fmt.Fprintf(&b, "phyint %s enable\n", i)
+	}
+	for _, r := range merged {
+		from := "from " + r.From
+		if r.Source != "" {
+			from += " source " + r.Source
+		}
+		// Joining the group has IGMP snooping switches and upstream routers send it
+		fmt.Fprintf(&b, "mgroup %s group %s\n", from, r.Group)
+		fmt.Fprintf(&b, "mroute %s group %s to %s\n", from, r.Group, strings.Join(r.To, " "))
+	}
+
+	if err := os.MkdirAll(smcrouteDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(smcrouteConfig(name), []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write smcroute configuration: %v", err)
+	}
+	if err := reloadSmcroute(); err != nil {
+		return err
+	}
+	logger.Network.Debug("Forwarding %d multicast groups for %s through smcroute", len(merged), name)
+	return nil
+}
+
+// ClearMulticastRoutes removes the smcroute configuration SetMulticastRoutes
+// wrote for name, so that smcroute stops forwarding its groups
+func ClearMulticastRoutes(name string) error {
+	err := os.Remove(smcrouteConfig(name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to remove smcroute configuration: %v", err)
+	}
+	return reloadSmcroute()
+}
+
+// reloadSmcroute has smcrouted read its configuration again
+func reloadSmcroute() error {
+	if out, err := exec.Command("smcroutectl", "reload").CombinedOutput(); err != nil {
+		return fmt.Errorf("smcroutectl reload failed, is smcrouted running? %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
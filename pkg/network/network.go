@@ -9,44 +9,48 @@ import (
 
 	"github.com/dzakwan/ipsec-vpn/pkg/logger"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
+// advertiseProtocol marks the routes added by AdvertiseNetwork
+const advertiseProtocol = 30
+
 // Interface represents a network interface
 type Interface struct {
-	Name        string
-	MAC         string
-	IPAddresses []string
-	MTU         int
-	Status      string
+	Name        string   `json:"name"`
+	MAC         string   `json:"mac"`
+	IPAddresses []string `json:"addresses"`
+	MTU         int      `json:"mtu"`
+	Status      string   `json:"status"`
 }
 
 // Route represents a routing table entry
 type Route struct {
-	Destination string
-	Gateway     string
-	Interface   string
-	Metric      int
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway"`
+	Interface   string `json:"interface"`
+	Metric      int    `json:"metric"`
 }
 
 // AdvertisedNetwork represents a network that is being advertised
 type AdvertisedNetwork struct {
-	CIDR          string
-	AdvertisedVia string
-	Status        string
+	CIDR          string `json:"cidr"`
+	AdvertisedVia string `json:"via"`
+	Status        string `json:"status"`
 }
 
 // ListInterfaces returns a list of network interfaces
 func ListInterfaces() ([]Interface, error) {
-	logger.Debug("Listing network interfaces")
+	logger.Network.Debug("Listing network interfaces")
 	
 	// Get all network interfaces
-	links, err := netlink.LinkList()
+	links, err := Handle().LinkList()
 	if err != nil {
-		logger.Error("Failed to list interfaces: %v", err)
+		logger.Network.Error("Failed to list interfaces: %v", err)
 		return nil, fmt.Errorf("failed to list interfaces: %v", err)
 	}
 
-	logger.Debug("Found %d network interfaces", len(links))
+	logger.Network.Debug("Found %d network interfaces", len(links))
 	
 	// Convert to Interface objects
 	interfaces := make([]Interface, 0, len(links))
@@ -54,7 +58,7 @@ func ListInterfaces() ([]Interface, error) {
 		attrs := link.Attrs()
 
 		// Get IP addresses
-		addrs, err := netlink.AddrList(link, 0) // 0 means all families (AF_UNSPEC)
+		addrs, err := Handle().AddrList(link, 0) // 0 means all families (AF_UNSPEC)
 		if err != nil {
 			continue
 		}
@@ -88,7 +92,7 @@ func ListInterfaces() ([]Interface, error) {
 // ListRoutes returns the routing table
 func ListRoutes() ([]Route, error) {
 	// Get all routes
-	netlinkRoutes, err := netlink.RouteList(nil, 0) // 0 means all families (AF_UNSPEC)
+	netlinkRoutes, err := Handle().RouteList(nil, 0) // 0 means all families (AF_UNSPEC)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list routes: %v", err)
 	}
@@ -102,7 +106,7 @@ func ListRoutes() ([]Route, error) {
 		}
 
 		// Get interface name
-		link, err := netlink.LinkByIndex(nlRoute.LinkIndex)
+		link, err := Handle().LinkByIndex(nlRoute.LinkIndex)
 		if err != nil {
 			continue
 		}
@@ -158,6 +162,30 @@ func ListAdvertisedNetworks() ([]AdvertisedNetwork, error) {
 	return advertisedNetworks, nil
 }
 
+// ListAdvertisedRoutes returns the routes added by AdvertiseNetwork, one for each
+// network advertised through a tunnel
+func ListAdvertisedRoutes() ([]Route, error) {
+	filter := &netlink.Route{Protocol: advertiseProtocol}
+	netlinkRoutes, err := Handle().RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	routes := make([]Route, 0, len(netlinkRoutes))
+	for _, nlRoute := range netlinkRoutes {
+		link, err := Handle().LinkByIndex(nlRoute.LinkIndex)
+		if err != nil || nlRoute.Dst == nil {
+			continue
+		}
+		routes = append(routes, Route{
+			Destination: nlRoute.Dst.String(),
+			Interface:   link.Attrs().Name,
+			Metric:      nlRoute.Priority,
+		})
+	}
+	return routes, nil
+}
+
 // AdvertiseNetwork advertises a network through a tunnel
 func AdvertiseNetwork(networkCIDR, tunnelName string, metric int) error {
 	// Validate network CIDR
@@ -167,7 +195,7 @@ func AdvertiseNetwork(networkCIDR, tunnelName string, metric int) error {
 	}
 
 	// Check if tunnel exists
-	link, err := netlink.LinkByName(tunnelName)
+	link, err := Handle().LinkByName(tunnelName)
 	if err != nil {
 		return fmt.Errorf("tunnel not found: %v", err)
 	}
@@ -184,11 +212,11 @@ func AdvertiseNetwork(networkCIDR, tunnelName string, metric int) error {
 	route := netlink.Route{
 		Dst:       dst,
 		LinkIndex: link.Attrs().Index,
-		Protocol:  30, // Protocol BIRD (for example)
+		Protocol:  advertiseProtocol,
 		Priority:  metric,
 	}
 
-	if err := netlink.RouteAdd(&route); err != nil {
+	if err := Handle().RouteAdd(&route); err != nil {
 		return fmt.Errorf("failed to add route: %v", err)
 	}
 
@@ -204,7 +232,7 @@ func WithdrawNetwork(networkCIDR, tunnelName string) error {
 	}
 
 	// Check if tunnel exists
-	link, err := netlink.LinkByName(tunnelName)
+	link, err := Handle().LinkByName(tunnelName)
 	if err != nil {
 		return fmt.Errorf("tunnel not found: %v", err)
 	}
@@ -223,7 +251,7 @@ func WithdrawNetwork(networkCIDR, tunnelName string) error {
 		LinkIndex: link.Attrs().Index,
 	}
 
-	if err := netlink.RouteDel(&route); err != nil {
+	if err := Handle().RouteDel(&route); err != nil {
 		return fmt.Errorf("failed to delete route: %v", err)
 	}
 
@@ -247,18 +275,18 @@ func AddRoute(destination, gateway, iface string, metric int) error {
 	// Get interface
 	var link netlink.Link
 	if iface != "" {
-		link, err = netlink.LinkByName(iface)
+		link, err = Handle().LinkByName(iface)
 		if err != nil {
 			return fmt.Errorf("interface not found: %v", err)
 		}
 	} else {
 		// If no interface is specified, find the interface with a route to the gateway
-		routes, err := netlink.RouteGet(gw)
+		routes, err := Handle().RouteGet(gw)
 		if err != nil || len(routes) == 0 {
 			return fmt.Errorf("failed to find route to gateway: %v", err)
 		}
 
-		link, err = netlink.LinkByIndex(routes[0].LinkIndex)
+		link, err = Handle().LinkByIndex(routes[0].LinkIndex)
 		if err != nil {
 			return fmt.Errorf("failed to find interface for gateway: %v", err)
 		}
@@ -273,7 +301,7 @@ func AddRoute(destination, gateway, iface string, metric int) error {
 	}
 
 	// Add route
-	if err := netlink.RouteAdd(&route); err != nil {
+	if err := Handle().RouteAdd(&route); err != nil {
 		return fmt.Errorf("failed to add route: %v", err)
 	}
 
@@ -297,18 +325,18 @@ func DeleteRoute(destination, gateway, iface string) error {
 	// Get interface
 	var link netlink.Link
 	if iface != "" {
-		link, err = netlink.LinkByName(iface)
+		link, err = Handle().LinkByName(iface)
 		if err != nil {
 			return fmt.Errorf("interface not found: %v", err)
 		}
 	} else {
 		// If no interface is specified, find the interface with a route to the gateway
-		routes, err := netlink.RouteGet(gw)
+		routes, err := Handle().RouteGet(gw)
 		if err != nil || len(routes) == 0 {
 			return fmt.Errorf("failed to find route to gateway: %v", err)
 		}
 
-		link, err = netlink.LinkByIndex(routes[0].LinkIndex)
+		link, err = Handle().LinkByIndex(routes[0].LinkIndex)
 		if err != nil {
 			return fmt.Errorf("failed to find interface for gateway: %v", err)
 		}
@@ -322,9 +350,74 @@ func DeleteRoute(destination, gateway, iface string) error {
 	}
 
 	// Delete route
-	if err := netlink.RouteDel(&route); err != nil {
+	if err := Handle().RouteDel(&route); err != nil {
 		return fmt.Errorf("failed to delete route: %v", err)
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// BlockMetric is the metric of block routes. It is higher than that of any route a
+// tunnel installs, so the tunnel's routes win while it is up.
+const BlockMetric = 4096
+
+// AddBlockRoute installs a blackhole route so that traffic to destination is
+// dropped rather than following the default route when nothing better exists
+func AddBlockRoute(destination string) error {
+	_, dst, err := net.ParseCIDR(destination)
+	if err != nil {
+		return fmt.Errorf("invalid destination: %v", err)
+	}
+
+	route := netlink.Route{
+		Dst:      dst,
+		Type:     unix.RTN_BLACKHOLE,
+		Priority: BlockMetric,
+	}
+	if err := Handle().RouteReplace(&route); err != nil {
+		return fmt.Errorf("failed to add block route: %v", err)
+	}
+
+	logger.Network.Debug("Installed block route for %s", destination)
+	return nil
+}
+
+// HasBlockRoute reports whether the route installed by AddBlockRoute for
+// destination is in place
+func HasBlockRoute(destination string) (bool, error) {
+	_, dst, err := net.ParseCIDR(destination)
+	if err != nil {
+		return false, fmt.Errorf("invalid destination: %v", err)
+	}
+
+	routes, err := Handle().RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		return false, fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, r := range routes {
+		if r.Type == unix.RTN_BLACKHOLE && r.Priority == BlockMetric {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteBlockRoute removes a route installed by AddBlockRoute
+func DeleteBlockRoute(destination string) error {
+	_, dst, err := net.ParseCIDR(destination)
+	if err != nil {
+		return fmt.Errorf("invalid destination: %v", err)
+	}
+
+	route := netlink.Route{
+		Dst:      dst,
+		Type:     unix.RTN_BLACKHOLE,
+		Priority: BlockMetric,
+	}
+	if err := Handle().RouteDel(&route); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("failed to delete block route: %v", err)
+	}
+
+	logger.Network.Debug("Removed block route for %s", destination)
+	return nil
+}
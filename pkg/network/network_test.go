@@ -0,0 +1,77 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestAccountingProgram(t *testing.T) {
+	for direction := range 2 {
+		insns, err := accountingProgram(42, direction)
+		if err != nil {
+			t.Fatalf("accountingProgram failed: %v", err)
+		}
+		if last := insns[len(insns)-1]; last.Op != bpfExit {
+			t.Errorf("Expected the program to end with exit, got opcode %#x", last.Op)
+		}
+
+		var slots []int32
+		for i, insn := range insns {
+			switch insn.Op {
+			case bpfJa, bpfJeqK, bpfJneK:
+				// Every jump lands forward, inside the program
+				if target := i + 1 + int(insn.Off); insn.Off < 0 || target >= len(insns) {
+					t.Errorf("Jump %d goes to %d, outside the program", i, target)
+				}
+			case bpfLdImm64:
+				if insn.Regs>>4 != unix.BPF_PSEUDO_MAP_FD || insn.Imm != 42 {
+					t.Errorf("Expected the map to be loaded by its file descriptor, got %+v", insn)
+				}
+			case bpfMovK:
+				if insn.Regs&0xf == 7 {
+					slots = append(slots, insn.Imm)
+				}
+			}
+		}
+		// Slots of tcp, udp, icmp twice, esp and other, after other by default
+		base := int32(direction * len(AccountingProtocols))
+		want := []int32{base + 4, base, base + 1, base + 2, base + 2, base + 3, base + 4}
+		if !reflect.DeepEqual(slots, want) {
+			t.Errorf("Expected direction %d to count into slots %v, got %v", direction, want, slots)
+		}
+	}
+
+	a := newBPFAsm()
+	a.label("start")
+	a.jump(bpfJa, 0, 0, "start")
+	if _, err := a.assemble(); err == nil {
+		t.Error("Expected a jump back to be refused")
+	}
+	a = newBPFAsm()
+	a.jump(bpfJa, 0, 0, "nowhere")
+	if _, err := a.assemble(); err == nil {
+		t.Error("Expected a jump to an undefined label to be refused")
+	}
+}
+
+func TestXfrmErrors(t *testing.T) {
+	xfrmStatPath = filepath.Join(t.TempDir(), "xfrm_stat")
+	defer func() { xfrmStatPath = "/proc/net/xfrm_stat" }()
+
+	stat := "XfrmInError                     0\nXfrmInNoStates                  12\nXfrmInStateSeqError             3\nXfrmOutNoStates                 0\n"
+	if err := os.WriteFile(xfrmStatPath, []byte(stat), 0600); err != nil {
+		t.Fatal(err)
+	}
+	drops, err := XfrmErrors()
+	if err != nil {
+		t.Fatalf("XfrmErrors failed: %v", err)
+	}
+	want := []Drop{{"XfrmInNoStates", 12}, {"XfrmInStateSeqError", 3}}
+	if !reflect.DeepEqual(drops, want) {
+		t.Errorf("Expected %v, got %v", want, drops)
+	}
+}
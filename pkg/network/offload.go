@@ -0,0 +1,95 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/vishvananda/netlink"
+)
+
+// OffloadFeatures maps the offloads that can be tuned, by the short names
+// ethtool -K takes, to the names ethtool -k reports them by
+var OffloadFeatures = map[string]string{
+	"gso":                   "generic-segmentation-offload",
+	"gro":                   "generic-receive-offload",
+	"tso":                   "tcp-segmentation-offload",
+	"lro":                   "large-receive-offload",
+	"rx-udp-gro-forwarding": "rx-udp-gro-forwarding",
+}
+
+// Offload is the state of an offload feature of an interface. Fixed features
+// cannot be changed on that interface.
+type Offload struct {
+	On    bool `json:"on"`
+	Fixed bool `json:"fixed,omitempty"`
+}
+
+// Offloads returns the state of the features of OffloadFeatures on an
+// interface, by their short names. The interface driver may not have them all.
+func Offloads(iface string) (map[string]Offload, error) {
+	out, err := exec.Command("ethtool", "-k", iface).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ethtool -k %s failed: %v: %s", iface, err, strings.TrimSpace(string(out)))
+	}
+
+	long := make(map[string]string, len(OffloadFeatures))
+	for short, name := range OffloadFeatures {
+		long[name] = short
+	}
+	offloads := make(map[string]Offload)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// Such as "generic-receive-offload: on" or "large-receive-offload: off [fixed]"
+		name, state, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ": ")
+		if short, known := long[name]; ok && known {
+			offloads[short] = Offload{On: strings.HasPrefix(state, "on"), Fixed: strings.Contains(state, "[fixed]")}
+		}
+	}
+	return offloads, nil
+}
+
+// SetOffloads turns the offload features given by short name on or off on an
+// interface
+func SetOffloads(iface string, features map[string]bool) error {
+	if len(features) == 0 {
+		return nil
+	}
+	args := []string{"-K", iface}
+	for _, name := range slices.Sorted(maps.Keys(features)) {
+		if _, ok := OffloadFeatures[name]; !ok {
+			return fmt.Errorf("unknown offload %s", name)
+		}
+		state := "off"
+		if features[name] {
+			state = "on"
+		}
+		args = append(args, name, state)
+	}
+	if out, err := exec.Command("ethtool", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ethtool %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	logger.Network.Debug("Set offloads of %s: %s", iface, strings.Join(args[2:], " "))
+	return nil
+}
+
+// SetMTU sets the MTU of an interface unless it has it already
+func SetMTU(handle *netlink.Handle, iface string, mtu int) error {
+	link, err := handle.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %v", iface, err)
+	}
+	if link.Attrs().MTU == mtu {
+		return nil
+	}
+	if err := handle.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("failed to set the MTU of %s to %d: %v", iface, mtu, err)
+	}
+	logger.Network.Debug("Set the MTU of %s to %d", iface, mtu)
+	return nil
+}
@@ -0,0 +1,51 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/vishvananda/netlink"
+)
+
+// pathProtocol marks the routes added by SetPathRoute
+const pathProtocol = 35
+
+// SetPathRoute routes a prefix reached through several tunnels through the
+// interface of the one selected, replacing the route through another
+func SetPathRoute(handle *netlink.Handle, iface, prefix string) error {
+	_, dst, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid prefix: %v", err)
+	}
+	link, err := handle.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %v", iface, err)
+	}
+	route := netlink.Route{Dst: dst, LinkIndex: link.Attrs().Index, Protocol: pathProtocol}
+	if err := handle.RouteReplace(&route); err != nil {
+		return fmt.Errorf("failed to route %s through %s: %v", prefix, iface, err)
+	}
+
+	logger.Network.Debug("Routed %s through %s", prefix, iface)
+	return nil
+}
+
+// DeletePathRoute removes the route SetPathRoute added for a prefix, if any
+func DeletePathRoute(handle *netlink.Handle, prefix string) error {
+	_, dst, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid prefix: %v", err)
+	}
+	filter := &netlink.Route{Dst: dst, Protocol: pathProtocol}
+	routes, err := handle.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_DST|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, route := range routes {
+		if err := handle.RouteDel(&route); err != nil {
+			return fmt.Errorf("failed to delete route to %s: %v", prefix, err)
+		}
+	}
+	return nil
+}
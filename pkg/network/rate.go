@@ -0,0 +1,201 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// rateUnits are the tc rate units, in bits per second
+var rateUnits = []struct {
+	suffix string
+	bits   uint64
+}{
+	{"gbit", 1000 * 1000 * 1000},
+	{"mbit", 1000 * 1000},
+	{"kbit", 1000},
+	{"gbps", 8 * 1000 * 1000 * 1000},
+	{"mbps", 8 * 1000 * 1000},
+	{"kbps", 8 * 1000},
+	{"bit", 1},
+	{"bps", 8},
+}
+
+// maxPoliceRate is the highest rate the tc police action can enforce, in bits per second
+const maxPoliceRate = 8 * math.MaxUint32
+
+// ParseRate parses a rate in tc notation, such as 10mbit, 512kbit or 2mbps
+// (bytes), and returns it in bits per second
+func ParseRate(s string) (uint64, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	for _, unit := range rateUnits {
+		if number, ok := strings.CutSuffix(lower, unit.suffix); ok {
+			value, err := strconv.ParseFloat(number, 64)
+			if err != nil || value <= 0 {
+				break
+			}
+			bits := uint64(value * float64(unit.bits))
+			if bits < 8000 {
+				return 0, fmt.Errorf("rate %q is below 8kbit", s)
+			}
+			if bits > maxPoliceRate {
+				return 0, fmt.Errorf("rate %q is too high", s)
+			}
+			return bits, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid rate %q, expected e.g. 10mbit or 512kbit", s)
+}
+
+// FormatRate formats a rate in bits per second in tc notation
+func FormatRate(bits uint64) string {
+	for _, unit := range rateUnits[:3] {
+		if bits >= unit.bits && bits%unit.bits == 0 {
+			return fmt.Sprintf("%d%s", bits/unit.bits, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dbit", bits)
+}
+
+// rateBurst returns the bucket size for a rate: 20ms of traffic, and at least a
+// few full-size packets so the interface MTU never exceeds it
+func rateBurst(bytesPerSecond uint64) uint32 {
+	return uint32(max(bytesPerSecond/50, 16*1024))
+}
+
+// SetRateLimit limits traffic through an interface in both directions with a
+// token bucket: a tbf qdisc shapes egress, and a police action on the ingress
+// hook of the clsact qdisc drops what arrives faster than the rate
+func SetRateLimit(handle *netlink.Handle, iface string, bitsPerSecond uint64) error {
+	link, err := handle.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %v", iface, err)
+	}
+	index := link.Attrs().Index
+	rate := bitsPerSecond / 8
+	burst := rateBurst(rate)
+
+	logger.Network.Debug("Limiting %s to %s", iface, FormatRate(bitsPerSecond))
+	tbf := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rate,
+		Buffer: netlink.Xmittime(rate, burst),
+		Limit:  burst + uint32(rate/20), // Queue up to 50ms before dropping
+	}
+	if err := handle.QdiscReplace(tbf); err != nil {
+		return fmt.Errorf("failed to shape egress on %s: %v", iface, err)
+	}
+
+	if err := ensureClsact(handle, link); err != nil {
+		return err
+	}
+
+	police := netlink.NewPoliceAction()
+	police.Rate = uint32(rate)
+	police.Burst = burst
+	police.ExceedAction = netlink.TC_POLICE_SHOT
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Priority:  policePriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Actions: []netlink.Action{police}, // Without a selector, u32 matches every packet
+	}
+	if err := handle.FilterReplace(filter); err != nil {
+		_ = ClearRateLimit(handle, iface)
+		return fmt.Errorf("failed to police ingress on %s: %v", iface, err)
+	}
+	return nil
+}
+
+// ClearRateLimit removes the rate limit of an interface
+func ClearRateLimit(handle *netlink.Handle, iface string) error {
+	link, err := handle.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %v", iface, err)
+	}
+	index := link.Attrs().Index
+
+	var errs []error
+	police := &netlink.U32{FilterAttrs: netlink.FilterAttrs{LinkIndex: index, Parent: netlink.HANDLE_MIN_INGRESS, Priority: policePriority, Protocol: unix.ETH_P_ALL}}
+	if err := handle.FilterDel(police); err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EINVAL) {
+		errs = append(errs, err)
+	}
+	for _, qdisc := range []netlink.Qdisc{
+		&netlink.Tbf{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: index, Handle: netlink.MakeHandle(1, 0), Parent: netlink.HANDLE_ROOT}},
+		legacyIngress(index),
+	} {
+		// Removing the ingress qdisc of older releases removes its filters too
+		if err := handle.QdiscDel(qdisc); err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EINVAL) {
+			errs = append(errs, err)
+		}
+	}
+	if err := releaseClsact(handle, link); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove rate limit on %s: %v", iface, errors.Join(errs...))
+	}
+	return nil
+}
+
+// legacyIngress returns the ingress qdisc older releases policed ingress on,
+// which takes the place of the clsact qdisc
+func legacyIngress(index int) *netlink.Ingress {
+	return &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: index, Handle: netlink.MakeHandle(0xffff, 0), Parent: netlink.HANDLE_INGRESS}}
+}
+
+// clsact returns the clsact qdisc that the rate limit and packet accounting of
+// an interface hook their filters on
+func clsact(index int) *netlink.Clsact {
+	return &netlink.Clsact{QdiscAttrs: netlink.QdiscAttrs{LinkIndex: index, Handle: netlink.MakeHandle(0xffff, 0), Parent: netlink.HANDLE_CLSACT}}
+}
+
+// ensureClsact adds the clsact qdisc to an interface, replacing the ingress
+// qdisc of an older release, whose rate limit must be set again
+func ensureClsact(handle *netlink.Handle, link netlink.Link) error {
+	qdiscs, err := handle.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %s: %v", link.Attrs().Name, err)
+	}
+	for _, qdisc := range qdiscs {
+		switch qdisc.(type) {
+		case *netlink.Clsact:
+			return nil
+		case *netlink.Ingress:
+			if err := handle.QdiscDel(qdisc); err != nil {
+				return fmt.Errorf("failed to remove ingress qdisc of %s: %v", link.Attrs().Name, err)
+			}
+		}
+	}
+	if err := handle.QdiscAdd(clsact(link.Attrs().Index)); err != nil {
+		return fmt.Errorf("failed to add clsact qdisc on %s: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// releaseClsact removes the clsact qdisc of an interface once no filter is left on it
+func releaseClsact(handle *netlink.Handle, link netlink.Link) error {
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		filters, err := handle.FilterList(link, parent)
+		if err != nil || len(filters) > 0 {
+			return nil
+		}
+	}
+	if err := handle.QdiscDel(clsact(link.Attrs().Index)); err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("failed to remove clsact qdisc of %s: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/retry"
+)
+
+// Resolve returns the address of a host given by name or address. A DNS
+// server that fails to answer is asked again under retry.dns.
+func Resolve(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	var addrs []net.IP
+	err := retry.Do(ctx, retry.DNS, retry.Temporary, func() error {
+		var err error
+		addrs, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	// Prefer IPv4, as tunnels are most often set up over it
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return addrs[0], nil
+}
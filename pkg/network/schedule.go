@@ -0,0 +1,64 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// scheduleProtocol marks the routes added by SetScheduledRoute
+const scheduleProtocol = 36
+
+// scheduledRoute returns the route of a prefix through iface a schedule adds.
+// An advertised route is marked the way AdvertiseNetwork marks routes, so that
+// it is listed and advertised with them.
+func scheduledRoute(handle *netlink.Handle, iface, prefix string, metric int, advertise bool) (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix: %v", err)
+	}
+	link, err := handle.LinkByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %v", iface, err)
+	}
+	protocol := scheduleProtocol
+	if advertise {
+		protocol = advertiseProtocol
+	}
+	return &netlink.Route{Dst: dst, LinkIndex: link.Attrs().Index, Priority: metric, Protocol: netlink.RouteProtocol(protocol)}, nil
+}
+
+// SetScheduledRoute routes a prefix through iface with a metric, for as long
+// as a schedule is active
+func SetScheduledRoute(handle *netlink.Handle, iface, prefix string, metric int, advertise bool) error {
+	route, err := scheduledRoute(handle, iface, prefix, metric, advertise)
+	if err != nil {
+		return err
+	}
+	if err := handle.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to route %s through %s: %v", prefix, iface, err)
+	}
+
+	logger.Network.Debug("Routed %s through %s with metric %d", prefix, iface, metric)
+	return nil
+}
+
+// DeleteScheduledRoute removes the route SetScheduledRoute added. An interface
+// that no longer exists took the route with it.
+func DeleteScheduledRoute(handle *netlink.Handle, iface, prefix string, metric int, advertise bool) error {
+	if _, err := handle.LinkByName(iface); err != nil {
+		return nil
+	}
+	route, err := scheduledRoute(handle, iface, prefix, metric, advertise)
+	if err != nil {
+		return err
+	}
+	if err := handle.RouteDel(route); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("failed to delete route to %s through %s: %v", prefix, iface, err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/vishvananda/netlink"
+)
+
+// spokeProtocol marks the routes added by SetSpokeRoute
+const spokeProtocol = 34
+
+// SetSpokeRoute routes a destination behind a spoke, such as its virtual IP,
+// through the tunnel interface of the spoke's instance. The route goes with
+// the interface.
+func SetSpokeRoute(handle *netlink.Handle, iface, destination string) error {
+	_, dst, err := net.ParseCIDR(destination)
+	if err != nil {
+		return fmt.Errorf("invalid destination: %v", err)
+	}
+	link, err := handle.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %v", iface, err)
+	}
+	route := netlink.Route{Dst: dst, LinkIndex: link.Attrs().Index, Protocol: spokeProtocol}
+	if err := handle.RouteReplace(&route); err != nil {
+		return fmt.Errorf("failed to route %s through %s: %v", destination, iface, err)
+	}
+
+	logger.Network.Debug("Routed %s through %s", destination, iface)
+	return nil
+}
@@ -0,0 +1,73 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// peerProtocol marks the routes added by SetPeerRoute
+const peerProtocol = 31
+
+// UplinkAddresses reports whether a WAN interface is up and returns its global
+// unicast addresses, which tunnels carried over it can use as their local address
+func UplinkAddresses(iface string) (bool, []net.IP, error) {
+	link, err := Handle().LinkByName(iface)
+	if err != nil {
+		return false, nil, fmt.Errorf("interface %s not found: %v", iface, err)
+	}
+	attrs := link.Attrs()
+	up := attrs.Flags&net.FlagUp != 0 &&
+		(attrs.OperState == netlink.OperUp || attrs.OperState == netlink.OperUnknown)
+
+	addrs, err := Handle().AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to list addresses of %s: %v", iface, err)
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if a.IP.IsGlobalUnicast() && a.Flags&unix.IFA_F_TENTATIVE == 0 {
+			ips = append(ips, a.IP)
+		}
+	}
+	return up, ips, nil
+}
+
+// SetPeerRoute routes the traffic to a tunnel peer out of a WAN interface, through
+// gateway if not empty, with source as its source address, replacing any route to
+// the peer SetPeerRoute added before
+func SetPeerRoute(peer, iface, gateway, source string) error {
+	dst := net.ParseIP(peer)
+	if dst == nil {
+		return fmt.Errorf("invalid peer address '%s'", peer)
+	}
+	link, err := Handle().LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("interface %s not found: %v", iface, err)
+	}
+
+	bits := 32
+	if dst.To4() == nil {
+		bits = 128
+	}
+	route := netlink.Route{
+		Dst:       &net.IPNet{IP: dst, Mask: net.CIDRMask(bits, bits)},
+		LinkIndex: link.Attrs().Index,
+		Src:       net.ParseIP(source),
+		Protocol:  peerProtocol,
+	}
+	if gateway != "" {
+		if route.Gw = net.ParseIP(gateway); route.Gw == nil {
+			return fmt.Errorf("invalid gateway '%s'", gateway)
+		}
+	}
+	if err := Handle().RouteReplace(&route); err != nil {
+		return fmt.Errorf("failed to route peer %s through %s: %v", peer, iface, err)
+	}
+
+	logger.Network.Debug("Routed peer %s through %s from %s", peer, iface, source)
+	return nil
+}
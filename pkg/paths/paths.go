@@ -0,0 +1,37 @@
+// Package paths locates the configuration directory that tunnels, keys and the
+// state of every other package are kept in
+package paths
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+)
+
+// ConfigDir returns the configuration directory: config_dir if set, and
+// otherwise ~/.ipsec-vpn of the user who ran sudo, or of the current user, so
+// state is kept in one place whether or not a command runs under sudo
+func ConfigDir() (string, error) {
+	if dir := viper.GetString("config_dir"); dir != "" {
+		return dir, nil
+	}
+	home, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ipsec-vpn"), nil
+}
+
+// homeDir returns the home directory of the user who ran sudo, or of the current user
+func homeDir() (string, error) {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		u, err := user.Lookup(sudoUser)
+		if err != nil {
+			return "", err
+		}
+		return u.HomeDir, nil
+	}
+	return os.UserHomeDir()
+}
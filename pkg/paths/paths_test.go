@@ -0,0 +1,33 @@
+package paths
+
+import (
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfigDir(t *testing.T) {
+	viper.Set("config_dir", "/srv/ipsec-vpn")
+	defer viper.Set("config_dir", "")
+	if dir, err := ConfigDir(); err != nil || dir != "/srv/ipsec-vpn" {
+		t.Errorf("Expected config_dir, got %q: %v", dir, err)
+	}
+
+	viper.Set("config_dir", "")
+	t.Setenv("HOME", t.TempDir())
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	// Under sudo the invoking user's directory is used, not the target user's
+	t.Setenv("SUDO_USER", current.Username)
+	if dir, err := ConfigDir(); err != nil || dir != filepath.Join(current.HomeDir, ".ipsec-vpn") {
+		t.Errorf("Expected the directory of the sudo user, got %q: %v", dir, err)
+	}
+	t.Setenv("SUDO_USER", "no-such-user-ipsec-vpn")
+	if _, err := ConfigDir(); err == nil {
+		t.Error("Expected an unknown sudo user to be an error")
+	}
+}
@@ -0,0 +1,389 @@
+// Package perf inspects and tunes how a gateway spreads packet processing over
+// its CPUs. The kernel decrypts ESP in the receive softirq of the CPU a packet
+// arrives on, so a NIC whose interrupts all land on one core caps the
+// throughput of every tunnel at what that core can decrypt, however many cores
+// sit idle. Spreading the interrupts of the queues of the underlay NICs
+// (RSS), steering received packets to more CPUs in software (RPS) and mapping
+// each CPU to a transmit queue (XPS) put all cores to work.
+package perf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+)
+
+// root is where procfs and sysfs are found below, replaced by tests
+var root = "/"
+
+// IRQ is an interrupt of a NIC, with the CPUs it may be handled on and the
+// number handled so far
+type IRQ struct {
+	Number int    `json:"number"`
+	Name   string `json:"name"`
+	CPUs   []int  `json:"cpus"`
+	Count  uint64 `json:"count"`
+}
+
+// Queue is a receive or transmit queue of a NIC, with the CPUs RPS steers its
+// packets to, or the CPUs XPS maps to it. No CPUs means steering is off.
+type Queue struct {
+	Name string `json:"name"`
+	CPUs []int  `json:"cpus"`
+}
+
+// Layout is how the processing of the packets of a NIC is spread over CPUs
+type Layout struct {
+	Interface string  `json:"interface"`
+	IRQs      []IRQ   `json:"irqs"`
+	RxQueues  []Queue `json:"rx_queues"`
+	TxQueues  []Queue `json:"tx_queues"`
+}
+
+// Report is the layout of NICs, with the online CPUs and the receive softirqs
+// each has handled, where ESP is decrypted
+type Report struct {
+	CPUs       []int     `json:"cpus"`
+	NetRx      []uint64  `json:"net_rx"` // By CPU
+	Layouts    []*Layout `json:"layouts"`
+	IRQBalance bool      `json:"irqbalance"` // irqbalance runs, and moves interrupts on its own
+}
+
+// Options select what Tune changes
+type Options struct {
+	CPUs []int // CPUs to spread the processing over, all online ones if empty
+	IRQs bool  // Pin the interrupts of the NIC queues to CPUs in turn
+	RPS  bool  // Steer received packets to the CPUs when there are fewer queues than CPUs
+	XPS  bool  // Map each CPU to a transmit queue
+}
+
+// Inspect reports how the processing of the packets of NICs is spread over CPUs
+func Inspect(interfaces []string) (*Report, error) {
+	cpus, err := OnlineCPUs()
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{CPUs: cpus, IRQBalance: irqbalanceRunning()}
+	if report.NetRx, err = netRxSoftirqs(); err != nil {
+		return nil, err
+	}
+	counts, names, err := interrupts()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, iface := range interfaces {
+		if _, err := os.Stat(filepath.Join(root, "sys/class/net", iface)); err != nil {
+			return nil, fmt.Errorf("no interface %s", iface)
+		}
+		layout := &Layout{Interface: iface}
+		for _, n := range nicIRQs(iface, names) {
+			irq := IRQ{Number: n, Name: names[n], Count: counts[n]}
+			if data, err := os.ReadFile(filepath.Join(root, "proc/irq", strconv.Itoa(n), "smp_affinity_list")); err == nil {
+				irq.CPUs, _ = ParseCPUList(strings.TrimSpace(string(data)))
+			}
+			layout.IRQs = append(layout.IRQs, irq)
+		}
+		if layout.RxQueues, err = queues(iface, "rx-", "rps_cpus"); err != nil {
+			return nil, err
+		}
+		if layout.TxQueues, err = queues(iface, "tx-", "xps_cpus"); err != nil {
+			return nil, err
+		}
+		report.Layouts = append(report.Layouts, layout)
+	}
+	return report, nil
+}
+
+// Tune spreads the processing of the packets of NICs over CPUs as opts say:
+// the interrupts of the NIC are pinned to the CPUs in turn, RPS steers each
+// receive queue to all of them if the NIC has fewer queues than CPUs, and off
+// otherwise, and XPS maps each CPU to a transmit queue in turn
+func Tune(interfaces []string, opts Options) error {
+	cpus := opts.CPUs
+	if len(cpus) == 0 {
+		var err error
+		if cpus, err = OnlineCPUs(); err != nil {
+			return err
+		}
+	}
+	report, err := Inspect(interfaces)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, layout := range report.Layouts {
+		for _, c := range Plan(layout, cpus, opts) {
+			if err := os.WriteFile(filepath.Join(root, c.Path), []byte(c.Value), 0644); err != nil {
+				errs = append(errs, fmt.Errorf("failed to write %s to %s: %v", c.Value, c.Path, err))
+				continue
+			}
+			logger.Network.Debug("Set %s to %s", c.Path, c.Value)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Change is a value written to a file under procfs or sysfs
+type Change struct {
+	Path  string
+	Value string
+}
+
+// Plan returns the changes Tune makes to the layout of a NIC to spread its
+// processing over cpus
+func Plan(layout *Layout, cpus []int, opts Options) []Change {
+	var changes []Change
+	if opts.IRQs {
+		for i, irq := range layout.IRQs {
+			changes = append(changes, Change{
+				Path:  filepath.Join("proc/irq", strconv.Itoa(irq.Number), "smp_affinity_list"),
+				Value: strconv.Itoa(cpus[i%len(cpus)]),
+			})
+		}
+	}
+	queueDir := filepath.Join("sys/class/net", layout.Interface, "queues")
+	if opts.RPS {
+		steer := []int(nil)
+		if len(layout.RxQueues) < len(cpus) {
+			steer = cpus
+		}
+		for _, q := range layout.RxQueues {
+			changes = append(changes, Change{Path: filepath.Join(queueDir, q.Name, "rps_cpus"), Value: FormatCPUMask(steer)})
+		}
+	}
+	if opts.XPS && len(layout.TxQueues) > 0 {
+		for i, q := range layout.TxQueues {
+			var mapped []int
+			for j, cpu := range cpus {
+				if j%len(layout.TxQueues) == i {
+					mapped = append(mapped, cpu)
+				}
+			}
+			changes = append(changes, Change{Path: filepath.Join(queueDir, q.Name, "xps_cpus"), Value: FormatCPUMask(mapped)})
+		}
+	}
+	return changes
+}
+
+// OnlineCPUs returns the CPUs that are online
+func OnlineCPUs() ([]int, error) {
+	data, err := os.ReadFile(filepath.Join(root, "sys/devices/system/cpu/online"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the online CPUs: %v", err)
+	}
+	return ParseCPUList(strings.TrimSpace(string(data)))
+}
+
+// ParseCPUList parses a list of CPUs such as 0-3,6
+func ParseCPUList(s string) ([]int, error) {
+	var cpus []int
+	if s == "" {
+		return nil, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(first)
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(last)
+		}
+		if err != nil || from < 0 || to < from {
+			return nil, fmt.Errorf("invalid CPU list %q", s)
+		}
+		for cpu := from; cpu <= to; cpu++ {
+			if !slices.Contains(cpus, cpu) {
+				cpus = append(cpus, cpu)
+			}
+		}
+	}
+	slices.Sort(cpus)
+	return cpus, nil
+}
+
+// FormatCPUList formats CPUs as a list such as 0-3,6, or - for none
+func FormatCPUList(cpus []int) string {
+	if len(cpus) == 0 {
+		return "-"
+	}
+	sorted := slices.Sorted(slices.Values(cpus))
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		} else {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// FormatCPUMask formats CPUs as the hexadecimal mask sysfs takes, in comma
+// separated groups of 32 CPUs, such as 00000001,000000ff
+func FormatCPUMask(cpus []int) string {
+	groups := []uint32{0}
+	for _, cpu := range cpus {
+		for cpu/32 >= len(groups) {
+			groups = append(groups, 0)
+		}
+		groups[cpu/32] |= 1 << (cpu % 32)
+	}
+	parts := make([]string, len(groups))
+	for i, g := range groups {
+		parts[len(groups)-1-i] = fmt.Sprintf("%08x", g)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseCPUMask parses a hexadecimal mask of CPUs as FormatCPUMask formats it
+func ParseCPUMask(s string) ([]int, error) {
+	groups := strings.Split(strings.TrimSpace(s), ",")
+	var cpus []int
+	for i := len(groups) - 1; i >= 0; i-- {
+		g, err := strconv.ParseUint(groups[i], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU mask %q", s)
+		}
+		for bit := range 32 {
+			if g&(1<<bit) != 0 {
+				cpus = append(cpus, (len(groups)-1-i)*32+bit)
+			}
+		}
+	}
+	return cpus, nil
+}
+
+// interrupts returns the number of each interrupt handled and its name, from
+// /proc/interrupts. Lines there look like
+//
+//	24:     1200      36   PCI-MSI 524288-edge      eth0-TxRx-0
+func interrupts() (map[int]uint64, map[int]string, error) {
+	data, err := os.ReadFile(filepath.Join(root, "proc/interrupts"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read interrupts: %v", err)
+	}
+	counts, names := make(map[int]uint64), make(map[int]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() {
+		return counts, names, nil
+	}
+	columns := len(strings.Fields(scanner.Text()))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil {
+			continue // NMI, LOC and other per-CPU interrupts
+		}
+		var count uint64
+		for _, f := range fields[1:min(len(fields), columns+1)] {
+			c, _ := strconv.ParseUint(f, 10, 64)
+			count += c
+		}
+		counts[n] = count
+		names[n] = fields[len(fields)-1]
+	}
+	return counts, names, nil
+}
+
+// nicIRQs returns the interrupts of a NIC: the MSI interrupts of its device,
+// or else those named after it
+func nicIRQs(iface string, names map[int]string) []int {
+	var irqs []int
+	entries, err := os.ReadDir(filepath.Join(root, "sys/class/net", iface, "device/msi_irqs"))
+	if err == nil {
+		for _, e := range entries {
+			if n, err := strconv.Atoi(e.Name()); err == nil {
+				irqs = append(irqs, n)
+			}
+		}
+	} else {
+		for n, name := range names {
+			if name == iface || strings.HasPrefix(name, iface+"-") || strings.Contains(name, "-"+iface+"-") {
+				irqs = append(irqs, n)
+			}
+		}
+	}
+	slices.Sort(irqs)
+	return irqs
+}
+
+// queues returns the queues of a NIC whose names start with prefix, with the
+// CPUs of their steering file
+func queues(iface, prefix, file string) ([]Queue, error) {
+	entries, err := os.ReadDir(filepath.Join(root, "sys/class/net", iface, "queues"))
+	if err != nil {
+		return nil, nil
+	}
+	var queues []Queue
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		q := Queue{Name: e.Name()}
+		// Missing without RPS or XPS support, and unreadable on single-queue devices
+		if data, err := os.ReadFile(filepath.Join(root, "sys/class/net", iface, "queues", e.Name(), file)); err == nil {
+			if q.CPUs, err = ParseCPUMask(string(data)); err != nil {
+				return nil, err
+			}
+		}
+		queues = append(queues, q)
+	}
+	slices.SortFunc(queues, func(a, b Queue) int { return queueIndex(a.Name) - queueIndex(b.Name) })
+	return queues, nil
+}
+
+// queueIndex returns the number of a queue such as rx-10
+func queueIndex(name string) int {
+	_, n, _ := strings.Cut(name, "-")
+	i, _ := strconv.Atoi(n)
+	return i
+}
+
+// netRxSoftirqs returns the receive softirqs each CPU has handled, from the
+// NET_RX line of /proc/softirqs
+func netRxSoftirqs() ([]uint64, error) {
+	data, err := os.ReadFile(filepath.Join(root, "proc/softirqs"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read softirqs: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "NET_RX:" {
+			continue
+		}
+		counts := make([]uint64, len(fields)-1)
+		for i, f := range fields[1:] {
+			counts[i], _ = strconv.ParseUint(f, 10, 64)
+		}
+		return counts, nil
+	}
+	return nil, nil
+}
+
+// irqbalanceRunning reports whether irqbalance is running
+func irqbalanceRunning() bool {
+	comms, _ := filepath.Glob(filepath.Join(root, "proc/[0-9]*/comm"))
+	for _, path := range comms {
+		if data, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(data)) == "irqbalance" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package perf
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeRoot builds the procfs and sysfs files of a 4 CPU host with eth0, a NIC
+// of 2 queues whose interrupts all land on CPU 0, and returns its path
+func fakeRoot(t *testing.T) string {
+	dir := t.TempDir()
+	files := map[string]string{
+		"sys/devices/system/cpu/online": "0-3\n",
+		"proc/interrupts": `           CPU0       CPU1       CPU2       CPU3
+  0:         30          0          0          0   IO-APIC   2-edge      timer
+ 24:       9000          0          0          0   PCI-MSI 524288-edge      eth0-TxRx-0
+ 25:       7000          0          0          0   PCI-MSI 524289-edge      eth0-TxRx-1
+ 26:         12          0          0          0   PCI-MSI 524290-edge      eth0
+ 30:          5          5          0          0   PCI-MSI 100-edge      nvme0q1
+NMI:          0          0          0          0   Non-maskable interrupts
+`,
+		"proc/softirqs": `                    CPU0       CPU1       CPU2       CPU3
+          HI:          0          0          0          0
+      NET_RX:        900         50         30         20
+`,
+		"proc/irq/24/smp_affinity_list":            "0-3\n",
+		"proc/irq/25/smp_affinity_list":            "0-3\n",
+		"proc/irq/26/smp_affinity_list":            "0-3\n",
+		"proc/1/comm":                              "systemd\n",
+		"sys/class/net/eth0/queues/rx-0/rps_cpus":  "0\n",
+		"sys/class/net/eth0/queues/rx-1/rps_cpus":  "0\n",
+		"sys/class/net/eth0/queues/tx-0/xps_cpus":  "00000000\n",
+		"sys/class/net/eth0/queues/tx-1/xps_cpus":  "00000000\n",
+		"sys/class/net/eth0/queues/tx-10/xps_cpus": "00000000\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCPUListsAndMasks(t *testing.T) {
+	cpus, err := ParseCPUList("0-3,6,2")
+	if err != nil || !slices.Equal(cpus, []int{0, 1, 2, 3, 6}) {
+		t.Fatalf("Expected CPUs 0-3 and 6, got %v: %v", cpus, err)
+	}
+	if s := FormatCPUList(cpus); s != "0-3,6" {
+		t.Errorf("Expected 0-3,6, got %s", s)
+	}
+	for _, s := range []string{"a", "3-1", "-1", "1,"} {
+		if _, err := ParseCPUList(s); err == nil {
+			t.Errorf("Expected ParseCPUList(%q) to fail", s)
+		}
+	}
+
+	if mask := FormatCPUMask([]int{0, 1, 2, 3, 6}); mask != "0000004f" {
+		t.Errorf("Expected 0000004f, got %s", mask)
+	}
+	if mask := FormatCPUMask([]int{1, 33}); mask != "00000002,00000002" {
+		t.Errorf("Expected a group for each 32 CPUs, got %s", mask)
+	}
+	if cpus, err := ParseCPUMask("00000002,00000002\n"); err != nil || !slices.Equal(cpus, []int{1, 33}) {
+		t.Errorf("Expected CPUs 1 and 33, got %v: %v", cpus, err)
+	}
+	if cpus, _ := ParseCPUMask("0"); len(cpus) != 0 {
+		t.Errorf("Expected no CPUs, got %v", cpus)
+	}
+}
+
+func TestInspectAndTune(t *testing.T) {
+	root = fakeRoot(t)
+	defer func() { root = "/" }()
+
+	report, err := Inspect([]string{"eth0"})
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if !slices.Equal(report.CPUs, []int{0, 1, 2, 3}) || !slices.Equal(report.NetRx, []uint64{900, 50, 30, 20}) || report.IRQBalance {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	layout := report.Layouts[0]
+	var irqs []string
+	for _, irq := range layout.IRQs {
+		irqs = append(irqs, irq.Name)
+	}
+	if strings.Join(irqs, " ") != "eth0-TxRx-0 eth0-TxRx-1 eth0" || layout.IRQs[0].Count != 9000 || FormatCPUList(layout.IRQs[0].CPUs) != "0-3" {
+		t.Errorf("Expected the interrupts of eth0 alone, got %+v", layout.IRQs)
+	}
+	if len(layout.RxQueues) != 2 || len(layout.TxQueues) != 3 || layout.TxQueues[2].Name != "tx-10" {
+		t.Errorf("Expected 2 receive and 3 transmit queues in order, got %+v %+v", layout.RxQueues, layout.TxQueues)
+	}
+	if _, err := Inspect([]string{"eth9"}); err == nil {
+		t.Error("Expected a missing interface to be refused")
+	}
+
+	// 2 receive queues for 4 CPUs: RPS spreads them, and each CPU maps to one of 3 transmit queues
+	if err := Tune([]string{"eth0"}, Options{IRQs: true, RPS: true, XPS: true}); err != nil {
+		t.Fatalf("Tune failed: %v", err)
+	}
+	report, _ = Inspect([]string{"eth0"})
+	layout = report.Layouts[0]
+	for i, want := range []string{"0", "1", "2"} {
+		if got := FormatCPUList(layout.IRQs[i].CPUs); got != want {
+			t.Errorf("Expected interrupt %d pinned to CPU %s, got %s", layout.IRQs[i].Number, want, got)
+		}
+	}
+	if got := FormatCPUList(layout.RxQueues[0].CPUs); got != "0-3" {
+		t.Errorf("Expected RPS to steer to all CPUs, got %s", got)
+	}
+	for i, want := range []string{"0,3", "1", "2"} {
+		if got := FormatCPUList(layout.TxQueues[i].CPUs); got != want {
+			t.Errorf("Expected %s mapped from CPUs %s, got %s", layout.TxQueues[i].Name, want, got)
+		}
+	}
+
+	// As many queues as CPUs need no RPS
+	changes := Plan(&Layout{Interface: "eth1", RxQueues: []Queue{{Name: "rx-0"}, {Name: "rx-1"}}}, []int{4, 5}, Options{RPS: true})
+	if len(changes) != 2 || changes[0].Value != "00000000" || changes[0].Path != "sys/class/net/eth1/queues/rx-0/rps_cpus" {
+		t.Errorf("Expected RPS turned off, got %+v", changes)
+	}
+}
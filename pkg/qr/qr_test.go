@@ -0,0 +1,125 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// HELLO WORLD at 1-M, from the worked example of the standard
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("Expected error correction %v, got %v", want, got)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	for _, tt := range []struct {
+		size, version int
+	}{
+		{1, 1}, {14, 1}, {15, 2}, {75, 5}, {180, 9}, {213, 10},
+	} {
+		c, err := Encode([]byte(strings.Repeat("a", tt.size)))
+		if err != nil {
+			t.Fatalf("Encode of %d bytes failed: %v", tt.size, err)
+		}
+		if want := 4*tt.version + 17; c.Size != want {
+			t.Errorf("Expected %d bytes in version %d, %d modules wide, got %d", tt.size, tt.version, want, c.Size)
+		}
+
+		// Finder patterns in three corners, and the dark module
+		for _, corner := range [][2]int{{0, 0}, {c.Size - 7, 0}, {0, c.Size - 7}} {
+			for y := range 7 {
+				for x := range 7 {
+					d := max(abs(x-3), abs(y-3))
+					if c.Dark(corner[0]+x, corner[1]+y) != (d != 2) {
+						t.Fatalf("Finder pattern at %v is broken at %d,%d", corner, x, y)
+					}
+				}
+			}
+		}
+		if !c.Dark(8, c.Size-8) {
+			t.Error("Expected the dark module")
+		}
+
+		// The format information of level M and the mask chosen, twice
+		if first, second := formatInformation(c); first != second || (first^0x5412)>>13 != 0 {
+			t.Errorf("Expected both copies of the format information of level M, got %015b and %015b", first, second)
+		}
+	}
+
+	if _, err := Encode(make([]byte, 214)); !errors.Is(err, ErrTooLong) {
+		t.Errorf("Expected ErrTooLong, got %v", err)
+	}
+}
+
+func TestFormatInformation(t *testing.T) {
+	c, _ := Encode([]byte("x"))
+	c.drawFormat(0)
+	if first, second := formatInformation(c); first != 0b101010000010010 || second != first {
+		t.Errorf("Expected the format information of level M and mask 0, got %015b and %015b", first, second)
+	}
+}
+
+// formatInformation reads both copies of the format information of a code,
+// most significant bit first
+func formatInformation(c *Code) (first, second int) {
+	for _, p := range [][2]int{{0, 8}, {1, 8}, {2, 8}, {3, 8}, {4, 8}, {5, 8}, {7, 8}, {8, 8}, {8, 7}, {8, 5}, {8, 4}, {8, 3}, {8, 2}, {8, 1}, {8, 0}} {
+		first <<= 1
+		if c.Dark(p[0], p[1]) {
+			first |= 1
+		}
+	}
+	for i := range 15 {
+		x, y := 8, c.Size-1-i
+		if i >= 7 {
+			x, y = c.Size-15+i, 8
+		}
+		second <<= 1
+		if c.Dark(x, y) {
+			second |= 1
+		}
+	}
+	return first, second
+}
+
+func TestRender(t *testing.T) {
+	c, err := Encode([]byte("https://vpn.example.com:8444/enroll/token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	side := c.Size + 2*QuietZone
+
+	lines := strings.Split(strings.TrimSuffix(c.Terminal(false), "\n"), "\n")
+	if len(lines) != (side+1)/2 {
+		t.Errorf("Expected %d lines, got %d", (side+1)/2, len(lines))
+	}
+	for _, line := range lines {
+		if n := len([]rune(line)); n != side {
+			t.Fatalf("Expected lines of %d characters, got %d", side, n)
+		}
+	}
+	// The quiet zone is drawn on a dark terminal and left blank on a light one
+	if !strings.HasPrefix(lines[0], "████") || !strings.HasPrefix(c.Terminal(true), "    ") {
+		t.Error("Expected the quiet zone in ink only without invert")
+	}
+
+	data, err := c.PNG(3)
+	if err != nil {
+		t.Fatalf("PNG failed: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("PNG does not decode: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != side*3 || b.Dy() != side*3 {
+		t.Errorf("Expected a %dx%d image, got %v", side*3, side*3, b)
+	}
+	if r, _, _, _ := img.At(QuietZone*3, QuietZone*3).RGBA(); r != 0 {
+		t.Error("Expected the corner of the finder pattern to be dark")
+	}
+}
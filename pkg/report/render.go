@@ -0,0 +1,146 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+)
+
+// Report formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	FormatHTML = "html"
+)
+
+// Formats lists the report formats
+var Formats = []string{FormatText, FormatJSON, FormatHTML}
+
+// Title returns the title of a report, e.g. "SLA report for October 2026"
+func (r *SLA) Title() string {
+	switch r.Period {
+	case PeriodDay:
+		return "SLA report for " + r.From.Format("Monday 2 January 2006")
+	case PeriodWeek:
+		return "SLA report for the week of " + r.From.Format("2 January 2006")
+	case PeriodMonth:
+		return "SLA report for " + r.From.Format("January 2006")
+	}
+	return fmt.Sprintf("SLA report from %s to %s", r.From.Format(time.DateTime), r.To.Format(time.DateTime))
+}
+
+// WriteText writes a report as a table of the tunnels followed by their outages
+func (r *SLA) WriteText(w io.Writer, opts table.Options) {
+	fmt.Fprintln(w, r.Title())
+	fmt.Fprintf(w, "From %s to %s", r.From.Format(time.DateTime), r.To.Format(time.DateTime))
+	if r.Host != "" {
+		fmt.Fprintf(w, " on %s", r.Host)
+	}
+	fmt.Fprint(w, "\n\n")
+	if len(r.Tunnels) == 0 {
+		fmt.Fprintln(w, "No tunnel was meant to be up in the period")
+		return
+	}
+
+	tbl := table.New(
+		table.Column{Header: "TUNNEL", MaxWidth: 24},
+		table.Column{Header: "AVAILABILITY"},
+		table.Column{Header: "MONITORED"},
+		table.Column{Header: "DOWNTIME"},
+		table.Column{Header: "OUTAGES"},
+		table.Column{Header: "MTTR"},
+	)
+	for _, a := range r.Tunnels {
+		tbl.AddRow(a.Tunnel, Percent(a.Percent), Duration(a.Monitored), Duration(a.Downtime),
+			fmt.Sprint(len(a.Outages)), Duration(a.MTTR))
+	}
+	tbl.Render(w, opts)
+
+	for _, a := range r.Tunnels {
+		if len(a.Outages) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nOutages of %s:\n", a.Tunnel)
+		outages := table.New(
+			table.Column{Header: "START"},
+			table.Column{Header: "END"},
+			table.Column{Header: "DURATION"},
+			table.Column{Header: "STATUS", Status: true},
+			table.Column{Header: "REASON", MaxWidth: 50},
+		)
+		for _, o := range a.Outages {
+			end := o.End.Format(time.DateTime)
+			if o.Ongoing {
+				end = "ongoing"
+			}
+			outages.AddRow(o.Start.Format(time.DateTime), end, Duration(o.Duration()), o.Status, o.Reason)
+		}
+		outages.Render(w, opts)
+	}
+}
+
+// WriteHTML writes a report as a standalone HTML page, to hand to customers
+func (r *SLA) WriteHTML(w io.Writer) error {
+	return htmlReport.Execute(w, r)
+}
+
+// Percent formats an availability, with as many decimals as an SLA of
+// "three nines" needs
+func Percent(p float64) string {
+	return fmt.Sprintf("%.3f%%", p)
+}
+
+// Duration formats a duration in whole seconds, "-" if zero
+func Duration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Truncate(time.Second).String()
+}
+
+var htmlReport = template.Must(template.New("sla").Funcs(template.FuncMap{
+	"percent":  Percent,
+	"duration": Duration,
+	"time":     func(t time.Time) string { return t.Format(time.DateTime) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+th { background: #f0f0f0; }
+td.number { text-align: right; }
+p.meta { color: #666; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">From {{time .From}} to {{time .To}}{{with .Host}} on {{.}}{{end}}, generated {{time .Generated}}</p>
+{{- if .Tunnels}}
+<table>
+<tr><th>Tunnel</th><th>Availability</th><th>Monitored</th><th>Downtime</th><th>Outages</th><th>MTTR</th></tr>
+{{- range .Tunnels}}
+<tr><td>{{.Tunnel}}</td><td class="number">{{percent .Percent}}</td><td class="number">{{duration .Monitored}}</td><td class="number">{{duration .Downtime}}</td><td class="number">{{len .Outages}}</td><td class="number">{{duration .MTTR}}</td></tr>
+{{- end}}
+</table>
+{{- range .Tunnels}}{{if .Outages}}
+<h2>Outages of {{.Tunnel}}</h2>
+<table>
+<tr><th>Start</th><th>End</th><th>Duration</th><th>Status</th><th>Reason</th></tr>
+{{- range .Outages}}
+<tr><td>{{time .Start}}</td><td>{{if .Ongoing}}ongoing{{else}}{{time .End}}{{end}}</td><td class="number">{{duration .Duration}}</td><td>{{.Status}}</td><td>{{.Reason}}</td></tr>
+{{- end}}
+</table>
+{{- end}}{{end}}
+{{- else}}
+<p>No tunnel was meant to be up in the period.</p>
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,108 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/table"
+)
+
+func TestPeriod(t *testing.T) {
+	at := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC) // A Friday
+	tests := []struct {
+		period   string
+		from, to time.Time
+	}{
+		{PeriodDay, time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)},
+		{PeriodWeek, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{PeriodMonth, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		from, to, err := Period(tt.period, at)
+		if err != nil || !from.Equal(tt.from) || !to.Equal(tt.to) {
+			t.Errorf("Expected the %s to run from %v to %v, got %v to %v: %v", tt.period, tt.from, tt.to, from, to, err)
+		}
+	}
+
+	// A Sunday is the last day of its week
+	if from, _, _ := Period(PeriodWeek, time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC)); from.Day() != 12 {
+		t.Errorf("Expected the week to start on Monday 12, got %v", from)
+	}
+	if _, _, err := Period("year", at); err == nil {
+		t.Error("Expected an unknown period to be rejected")
+	}
+}
+
+func TestComputeSLA(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	event := func(typ, tunnel string, at time.Time, reason string) events.Event {
+		return events.Event{Type: typ, Tunnel: tunnel, Host: "gw1", Time: at, Reason: reason}
+	}
+	journal := []events.Event{
+		// Up since before the period, out for an hour twice, once through two failures
+		event(events.TypeUp, "office", from.AddDate(0, 0, -3), ""),
+		event(events.TypeError, "office", from.Add(24*time.Hour), "peer unreachable"),
+		event(events.TypeUp, "office", from.Add(25*time.Hour), ""),
+		event(events.TypeDown, "office", from.Add(48*time.Hour), "dead peer detected"),
+		event(events.TypeError, "office", from.Add(48*time.Hour+30*time.Minute), "IKE timeout"),
+		event(events.TypeUp, "office", from.Add(49*time.Hour), ""),
+		// Stopped for a day, which is not an outage
+		event(events.TypeDown, "office", from.Add(72*time.Hour), ""),
+		event(events.TypeUp, "office", from.Add(96*time.Hour), ""),
+		// Failing when the period ends
+		event(events.TypeUp, "branch", from.Add(-time.Hour), ""),
+		event(events.TypeError, "branch", to.Add(-time.Hour), "peer unreachable"),
+		// Deleted before the period
+		event(events.TypeUp, "old", from.AddDate(0, 0, -10), ""),
+		event(events.TypeDeleted, "old", from.AddDate(0, 0, -9), ""),
+		// Not a lifecycle event
+		event(events.TypeStats, "office", from.Add(24*time.Hour+time.Minute), ""),
+		// After the period
+		event(events.TypeError, "office", to.Add(time.Hour), "peer unreachable"),
+	}
+	report := ComputeSLA(journal, PeriodMonth, from, to)
+	if report.Host != "gw1" || len(report.Tunnels) != 2 {
+		t.Fatalf("Expected branch and office on gw1, got %+v", report)
+	}
+
+	branch, office := report.Tunnels[0], report.Tunnels[1]
+	month := 30 * 24 * time.Hour
+	if office.Tunnel != "office" || office.Monitored != month-24*time.Hour || office.Downtime != 2*time.Hour {
+		t.Errorf("Expected office to be monitored for 29 days with 2h down, got %+v", office)
+	}
+	if len(office.Outages) != 2 || office.Outages[1].Reason != "dead peer detected" || office.MTTR != time.Hour {
+		t.Errorf("Expected two outages of an hour, got %+v", office.Outages)
+	}
+	if want := 100 * float64(month-26*time.Hour) / float64(month-24*time.Hour); office.Percent != want {
+		t.Errorf("Expected %v%% availability, got %v", want, office.Percent)
+	}
+
+	if branch.Monitored != month || branch.Downtime != time.Hour || branch.MTTR != 0 {
+		t.Errorf("Expected branch to be monitored for the month with an hour down, got %+v", branch)
+	}
+	if len(branch.Outages) != 1 || !branch.Outages[0].Ongoing || !branch.Outages[0].End.Equal(to) {
+		t.Errorf("Expected the outage of branch to be ongoing at the end of the period, got %+v", branch.Outages)
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if !strings.Contains(string(data), `"downtime_seconds":3600`) {
+		t.Errorf("Expected durations in seconds, got %s", data)
+	}
+
+	var text, html bytes.Buffer
+	report.WriteText(&text, table.Options{})
+	if !strings.Contains(text.String(), "Outages of office:") || !strings.Contains(text.String(), "ongoing") {
+		t.Errorf("Expected the outages in the text report, got:\n%s", text.String())
+	}
+	if err := report.WriteHTML(&html); err != nil || !strings.Contains(html.String(), "<h1>SLA report for September 2026</h1>") {
+		t.Errorf("Expected an HTML report, got %v:\n%s", err, html.String())
+	}
+}
@@ -0,0 +1,214 @@
+// Package report computes reports on the tunnels from the journal of their
+// lifecycle events, such as the availability of each over a month for
+// customer-facing SLA reporting
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+)
+
+// Report periods
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+// Periods lists the report periods
+var Periods = []string{PeriodDay, PeriodWeek, PeriodMonth}
+
+// Period returns the bounds of the day, week (from Monday) or month that
+// contains a time, in its location
+func Period(period string, at time.Time) (from, to time.Time, err error) {
+	y, m, d := at.Date()
+	switch period {
+	case PeriodDay:
+		from = time.Date(y, m, d, 0, 0, 0, 0, at.Location())
+		return from, from.AddDate(0, 0, 1), nil
+	case PeriodWeek:
+		from = time.Date(y, m, d-(int(at.Weekday())+6)%7, 0, 0, 0, 0, at.Location())
+		return from, from.AddDate(0, 0, 7), nil
+	case PeriodMonth:
+		from = time.Date(y, m, 1, 0, 0, 0, 0, at.Location())
+		return from, from.AddDate(0, 1, 0), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("unknown period '%s', expected day, week or month", period)
+}
+
+// Outage is a time a tunnel meant to be up was not: from when it went into
+// error, or down for a reason other than being stopped, until it was up
+// again, stopped or deleted
+type Outage struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"` // The end of the period, if Ongoing
+	Status  string    `json:"status"`
+	Reason  string    `json:"reason,omitempty"`
+	Ongoing bool      `json:"ongoing,omitempty"`
+}
+
+// Duration returns how long the outage lasted within the period
+func (o Outage) Duration() time.Duration {
+	return o.End.Sub(o.Start)
+}
+
+// Availability is how well a tunnel met its SLA over a period
+type Availability struct {
+	Tunnel string
+	// Monitored is the time the tunnel was meant to be up: not before it was
+	// first started, nor while stopped or after it was deleted
+	Monitored time.Duration
+	Downtime  time.Duration
+	Percent   float64       // Of the monitored time the tunnel was up
+	MTTR      time.Duration // Mean time to restore the tunnel after the outages that ended
+	Outages   []Outage
+}
+
+// MarshalJSON encodes the durations of an availability in seconds
+func (a Availability) MarshalJSON() ([]byte, error) {
+	type outage struct {
+		Outage
+		Seconds float64 `json:"duration_seconds"`
+	}
+	outages := make([]outage, len(a.Outages))
+	for i, o := range a.Outages {
+		outages[i] = outage{o, o.Duration().Seconds()}
+	}
+	return json.Marshal(struct {
+		Tunnel    string   `json:"tunnel"`
+		Percent   float64  `json:"availability_percent"`
+		Monitored float64  `json:"monitored_seconds"`
+		Downtime  float64  `json:"downtime_seconds"`
+		MTTR      float64  `json:"mttr_seconds"`
+		Outages   []outage `json:"outages"`
+	}{a.Tunnel, a.Percent, a.Monitored.Seconds(), a.Downtime.Seconds(), a.MTTR.Seconds(), outages})
+}
+
+// SLA is the availability of each tunnel over a period
+type SLA struct {
+	Period    string         `json:"period"`
+	From      time.Time      `json:"from"`
+	To        time.Time      `json:"to"`
+	Generated time.Time      `json:"generated"`
+	Host      string         `json:"host,omitempty"`
+	Tunnels   []Availability `json:"tunnels"`
+}
+
+// state is what a tunnel was doing as far as the report is concerned
+type state int
+
+const (
+	unmonitored state = iota // Not created, not started yet, stopped or deleted
+	up
+	out
+)
+
+// stateOf returns what a lifecycle event leaves a tunnel doing
+func stateOf(e events.Event) state {
+	switch e.Type {
+	case events.TypeUp:
+		return up
+	case events.TypeError:
+		return out
+	case events.TypeDown:
+		// Stopping a tunnel records no reason; a failure detected while it runs does
+		if e.Reason != "" {
+			return out
+		}
+	}
+	return unmonitored
+}
+
+// ComputeSLA computes the availability of each tunnel between from and to, or
+// now for a period that has not ended, from the journal of lifecycle events,
+// oldest first. Events before from give the state each tunnel started the
+// period in. Durations are counted in whole seconds.
+func ComputeSLA(journal []events.Event, period string, from, to time.Time) *SLA {
+	report := &SLA{Period: period, From: from, To: to, Generated: time.Now()}
+	end := to
+	if report.Generated.Before(end) {
+		end = report.Generated
+	}
+	type tracked struct {
+		state  state
+		since  time.Time
+		reason string
+		status string
+		a      *Availability
+	}
+	tunnels := make(map[string]*tracked)
+	var order []string
+
+	// account counts the time a tunnel spent in its state until a time
+	account := func(t *tracked, until time.Time, ongoing bool) {
+		start := t.since
+		if start.Before(from) {
+			start = from
+		}
+		if t.state == unmonitored || !until.After(start) {
+			return
+		}
+		spent := until.Sub(start).Truncate(time.Second)
+		t.a.Monitored += spent
+		if t.state == out {
+			t.a.Downtime += spent
+			t.a.Outages = append(t.a.Outages, Outage{Start: start, End: until, Status: t.status, Reason: t.reason, Ongoing: ongoing})
+		}
+	}
+
+	for _, e := range journal {
+		if e.Tunnel == "" || e.Time.After(end) || !slices.Contains(lifecycleTypes, e.Type) {
+			continue
+		}
+		if report.Host == "" {
+			report.Host = e.Host
+		}
+		t, ok := tunnels[e.Tunnel]
+		if !ok {
+			t = &tracked{a: &Availability{Tunnel: e.Tunnel}}
+			tunnels[e.Tunnel] = t
+			order = append(order, e.Tunnel)
+		}
+		next := stateOf(e)
+		// An outage goes on through further failures until the tunnel is up
+		if next == out && t.state == out {
+			continue
+		}
+		account(t, e.Time, false)
+		t.state, t.since, t.reason, t.status = next, e.Time, e.Reason, e.Status
+	}
+
+	slices.Sort(order)
+	for _, name := range order {
+		t := tunnels[name]
+		account(t, end, true)
+		a := t.a
+		if a.Monitored == 0 {
+			// Neither up nor failing in the period, such as deleted before it
+			continue
+		}
+		a.Percent = 100 * float64(a.Monitored-a.Downtime) / float64(a.Monitored)
+		var restored []time.Duration
+		for _, o := range a.Outages {
+			if !o.Ongoing {
+				restored = append(restored, o.Duration())
+			}
+		}
+		if len(restored) > 0 {
+			var total time.Duration
+			for _, d := range restored {
+				total += d
+			}
+			a.MTTR = (total / time.Duration(len(restored))).Truncate(time.Second)
+		}
+		report.Tunnels = append(report.Tunnels, *a)
+	}
+	return report
+}
+
+// lifecycleTypes are the events that change what a tunnel is doing
+var lifecycleTypes = []string{events.TypeCreated, events.TypeUp, events.TypeDown, events.TypeError, events.TypeDeleted}
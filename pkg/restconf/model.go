@@ -0,0 +1,246 @@
+package restconf
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/job"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/viper"
+)
+
+// tunnelData is an entry of the tunnel list, encoded as RFC 7951 describes
+type tunnelData struct {
+	Name             string       `json:"name"`
+	Mode             string       `json:"mode,omitempty"`
+	LocalIP          string       `json:"local-ip,omitempty"`
+	RemoteIP         string       `json:"remote-ip,omitempty"`
+	LocalSubnet      string       `json:"local-subnet,omitempty"`
+	RemoteSubnet     string       `json:"remote-subnet,omitempty"`
+	Encryption       string       `json:"encryption,omitempty"`
+	PostQuantum      *bool        `json:"post-quantum,omitempty"`
+	Namespace        string       `json:"namespace,omitempty"`
+	WireGuardPeerKey string       `json:"wireguard-peer-key,omitempty"`
+	ListenPort       int          `json:"listen-port,omitempty"`
+	PSKRef           string       `json:"psk-ref,omitempty"`
+	PeerGroup        string       `json:"peer-group,omitempty"`
+	PeerID           string       `json:"peer-id,omitempty"`
+	PeerCA           string       `json:"peer-ca,omitempty"`
+	VirtualIPPool    string       `json:"virtual-ip-pool,omitempty"`
+	Shortcuts        bool         `json:"shortcuts,omitempty"`
+	KillSwitch       bool         `json:"kill-switch"`
+	RateLimit        uint64       `json:"rate-limit,omitempty,string"` // 64-bit integers are strings in RFC 7951
+	Enabled          bool         `json:"enabled"`
+	Labels           []labelData  `json:"label,omitempty"`
+	State            *tunnelState `json:"state,omitempty"`
+}
+
+// labelData is an entry of the label list of a tunnel
+type labelData struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// tunnelState is the config false part of a tunnel
+type tunnelState struct {
+	Status         tunnel.Status `json:"status"`
+	Reason         string        `json:"reason,omitempty"`
+	LastTransition string        `json:"last-transition,omitempty"`
+	Peer           string        `json:"peer,omitempty"`
+	NextRetry      string        `json:"next-retry,omitempty"`
+	Template       string        `json:"template,omitempty"`
+	PeerIdentity   string        `json:"peer-identity,omitempty"`
+	VirtualIP      string        `json:"virtual-ip,omitempty"`
+	Via            string        `json:"via,omitempty"`
+}
+
+// networkData is an entry of the network list
+type networkData struct {
+	Prefix string `json:"prefix"`
+	Tunnel string `json:"tunnel"`
+	Metric int    `json:"metric"`
+}
+
+// jobData is an entry of the job list, which is state only
+type jobData struct {
+	ID        string     `json:"id"`
+	Operation string     `json:"operation"`
+	State     job.State  `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	Created   string     `json:"created"`
+	Finished  string     `json:"finished,omitempty"`
+	Steps     []stepData `json:"step,omitempty"`
+}
+
+// stepData is an entry of the step list of a job
+type stepData struct {
+	Time    string `json:"time"`
+	Message string `json:"message"`
+}
+
+// fromTunnel converts a tunnel to its list entry, including its state
+func fromTunnel(t *tunnel.Tunnel) tunnelData {
+	data := tunnelData{
+		Name:             t.Name,
+		Mode:             t.Mode,
+		LocalIP:          t.LocalIP,
+		RemoteIP:         t.RemoteIP,
+		LocalSubnet:      t.LocalSubnet,
+		RemoteSubnet:     t.RemoteSubnet,
+		Encryption:       t.Encryption,
+		PostQuantum:      &t.PostQuantum,
+		Namespace:        t.Namespace,
+		WireGuardPeerKey: t.WireGuardPeerKey,
+		ListenPort:       t.ListenPort,
+		PSKRef:           t.PSKRef,
+		PeerGroup:        t.PeerGroup,
+		PeerID:           t.PeerID,
+		PeerCA:           t.PeerCA,
+		VirtualIPPool:    t.VirtualIPPool,
+		Shortcuts:        t.Shortcuts,
+		KillSwitch:       t.KillSwitch,
+		RateLimit:        t.RateLimit,
+		Enabled:          t.Status == tunnel.StatusUp,
+		State: &tunnelState{Status: t.Status, Reason: t.Reason, Template: t.Template, PeerIdentity: t.PeerIdentity,
+			VirtualIP: t.VirtualIP, Via: t.Via},
+	}
+	if !t.LastTransition.IsZero() {
+		data.State.LastTransition = t.LastTransition.Format(time.RFC3339)
+	}
+	if t.Peer != nil {
+		data.State.Peer = t.Peer.Name()
+	}
+	if sync, err := tunnel.Sync(t.Name); err == nil && sync.BackingOff(time.Now()) {
+		data.State.NextRetry = sync.NextRetry.Format(time.RFC3339)
+	}
+	data.Labels = labelList(t.Labels)
+	return data
+}
+
+// labelList converts labels to the entries of the label list, sorted by name
+func labelList(labels map[string]string) []labelData {
+	var list []labelData
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		list = append(list, labelData{Name: name, Value: labels[name]})
+	}
+	return list
+}
+
+// labels returns the label list of an entry as a map
+func (d tunnelData) labels() map[string]string {
+	labels := make(map[string]string, len(d.Labels))
+	for _, l := range d.Labels {
+		labels[l.Name] = l.Value
+	}
+	return labels
+}
+
+// config converts a list entry to the configuration of a new tunnel, falling
+// back to the tunnel defaults like 'tunnel create' does
+func (d tunnelData) config() tunnel.Config {
+	encryption := d.Encryption
+	if encryption == "" && d.Mode != tunnel.ModeWireGuard {
+		encryption = viper.GetString("tunnel_defaults.encryption")
+	}
+	postQuantum := viper.GetBool("tunnel_defaults.post_quantum") && d.Mode != tunnel.ModeWireGuard
+	if d.PostQuantum != nil {
+		postQuantum = *d.PostQuantum
+	}
+	return tunnel.Config{
+		Name:             d.Name,
+		LocalIP:          d.LocalIP,
+		RemoteIP:         d.RemoteIP,
+		LocalSubnet:      d.LocalSubnet,
+		RemoteSubnet:     d.RemoteSubnet,
+		Encryption:       encryption,
+		PostQuantum:      postQuantum,
+		Namespace:        d.Namespace,
+		KillSwitch:       d.KillSwitch,
+		RateLimit:        d.RateLimit,
+		Mode:             d.Mode,
+		WireGuardPeerKey: d.WireGuardPeerKey,
+		ListenPort:       d.ListenPort,
+		PSKRef:           d.PSKRef,
+		PeerGroup:        d.PeerGroup,
+		PeerID:           d.PeerID,
+		PeerCA:           d.PeerCA,
+		VirtualIPPool:    d.VirtualIPPool,
+		Shortcuts:        d.Shortcuts,
+	}
+}
+
+// checkTypes checks the address and prefix leaves against their YANG types
+func (d tunnelData) checkTypes() error {
+	for _, leaf := range []struct{ name, value string }{{"local-ip", d.LocalIP}, {"remote-ip", d.RemoteIP}} {
+		if net.ParseIP(leaf.value) == nil && !(leaf.name == "remote-ip" && leaf.value == tunnel.AnyPeer) {
+			return fmt.Errorf("%s %q is not an IP address", leaf.name, leaf.value)
+		}
+	}
+	for _, leaf := range []struct{ name, value string }{{"local-subnet", d.LocalSubnet}, {"remote-subnet", d.RemoteSubnet}} {
+		if _, _, err := net.ParseCIDR(leaf.value); err != nil {
+			return fmt.Errorf("%s %q is not an IP prefix", leaf.name, leaf.value)
+		}
+	}
+	if _, _, err := net.ParseCIDR(d.VirtualIPPool); d.VirtualIPPool != "" && err != nil {
+		return fmt.Errorf("virtual-ip-pool %q is not an IP prefix", d.VirtualIPPool)
+	}
+	return tunnel.ValidateLabels(d.labels())
+}
+
+// fixedLeaves returns the leaves of d that differ from an existing tunnel but
+// can only be set when a tunnel is created. Leaves that are absent, or whose
+// value is resolved at creation such as encryption auto, are not compared.
+func (d tunnelData) fixedLeaves(t *tunnel.Tunnel) []string {
+	var leaves []string
+	for _, leaf := range []struct {
+		name      string
+		want, got any
+		set       bool
+	}{
+		{"mode", d.Mode, t.Mode, d.Mode != ""},
+		{"local-ip", d.LocalIP, t.LocalIP, d.LocalIP != ""},
+		{"remote-ip", d.RemoteIP, t.RemoteIP, d.RemoteIP != ""},
+		{"local-subnet", d.LocalSubnet, t.LocalSubnet, d.LocalSubnet != ""},
+		{"remote-subnet", d.RemoteSubnet, t.RemoteSubnet, d.RemoteSubnet != ""},
+		{"encryption", d.Encryption, t.Encryption, d.Encryption != "" && d.Encryption != "auto"},
+		{"post-quantum", d.PostQuantum != nil && *d.PostQuantum, t.PostQuantum, d.PostQuantum != nil},
+		{"namespace", d.Namespace, t.Namespace, d.Namespace != "" && d.Namespace != "dedicated"},
+		{"wireguard-peer-key", d.WireGuardPeerKey, t.WireGuardPeerKey, d.WireGuardPeerKey != ""},
+		{"listen-port", d.ListenPort, t.ListenPort, d.ListenPort != 0},
+		{"psk-ref", d.PSKRef, t.PSKRef, d.PSKRef != ""},
+		{"peer-id", d.PeerID, t.PeerID, d.PeerID != ""},
+		{"peer-ca", d.PeerCA, t.PeerCA, d.PeerCA != ""},
+	} {
+		if leaf.set && leaf.want != leaf.got {
+			leaves = append(leaves, leaf.name)
+		}
+	}
+	return leaves
+}
+
+// fromRoute converts an advertised route to its list entry
+func fromRoute(r network.Route) networkData {
+	return networkData{Prefix: r.Destination, Tunnel: r.Interface, Metric: r.Metric}
+}
+
+// fromJob converts a job to its list entry
+func fromJob(j *job.Job) jobData {
+	data := jobData{
+		ID:        j.ID,
+		Operation: j.Operation,
+		State:     j.State,
+		Error:     j.Error,
+		Created:   j.Created.Format(time.RFC3339),
+	}
+	if !j.Finished.IsZero() {
+		data.Finished = j.Finished.Format(time.RFC3339)
+	}
+	for _, s := range j.Steps {
+		data.Steps = append(data.Steps, stepData{Time: s.Time.Format(time.RFC3339), Message: s.Message})
+	}
+	return data
+}
@@ -0,0 +1,318 @@
+package restconf
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/ca"
+	"github.com/dzakwan/ipsec-vpn/pkg/job"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification the document follows
+const OpenAPIVersion = "3.1.0"
+
+// approveInput and approveOutput are the input and output of the approve operation
+type approveInput struct {
+	ID string `json:"id"`
+}
+
+type approveOutput struct {
+	Operation string `json:"operation"`
+	Expires   string `json:"expires"`
+}
+
+// schemaNames names the component schemas of the types exchanged with clients
+var schemaNames = map[reflect.Type]string{
+	reflect.TypeFor[tunnelData]():       "tunnel",
+	reflect.TypeFor[tunnelState]():      "tunnel-state",
+	reflect.TypeFor[labelData]():        "label",
+	reflect.TypeFor[networkData]():      "network",
+	reflect.TypeFor[jobData]():          "job",
+	reflect.TypeFor[stepData]():         "job-step",
+	reflect.TypeFor[approveInput]():     "approve-input",
+	reflect.TypeFor[approveOutput]():    "approve-output",
+	reflect.TypeFor[ca.IssueRequest]():  "issue-certificate-input",
+	reflect.TypeFor[ca.IssueResponse](): "issue-certificate-output",
+}
+
+// endpoint is a method on a resource of the API
+type endpoint struct {
+	path, method string
+	id, summary  string
+	params       []string // Names of components/parameters
+	request      any      // Request body schema, or nil
+	responses    map[int]any
+}
+
+// endpoints are the resources and methods the handler serves, other than the
+// API root, the YANG library and the schema
+var endpoints = []endpoint{
+	{"/restconf/data/" + Module + ":tunnels", http.MethodGet, "listTunnels",
+		"List the tunnels matching the filters, one page at a time",
+		[]string{paramFields, paramLimit, paramOffset, paramStatus, paramLabelSelector}, nil,
+		map[int]any{http.StatusOK: container(Module+":tunnels", "tunnel", "tunnel")}},
+	{"/restconf/data/" + Module + ":tunnels", http.MethodPost, "createTunnel",
+		"Create a tunnel, and start it if enabled; with Prefer: respond-async, in the background as a job",
+		[]string{"prefer"}, entry(Module+":tunnel", "tunnel"),
+		map[int]any{http.StatusCreated: nil, http.StatusAccepted: nil, http.StatusConflict: errorsRef}},
+	{"/restconf/data/" + Module + ":tunnels/tunnel={name}", http.MethodGet, "getTunnel",
+		"Read a tunnel", []string{"name", paramFields}, nil,
+		map[int]any{http.StatusOK: entry(Module+":tunnel", "tunnel"), http.StatusNotFound: errorsRef}},
+	{"/restconf/data/" + Module + ":tunnels/tunnel={name}", http.MethodPut, "replaceTunnel",
+		"Create a tunnel, or replace its changeable leaves", []string{"name"}, entry(Module+":tunnel", "tunnel"),
+		map[int]any{http.StatusCreated: nil, http.StatusNoContent: nil}},
+	{"/restconf/data/" + Module + ":tunnels/tunnel={name}", http.MethodPatch, "updateTunnel",
+		"Merge leaves into a tunnel; labels are merged by name", []string{"name"}, entry(Module+":tunnel", "tunnel"),
+		map[int]any{http.StatusNoContent: nil, http.StatusNotFound: errorsRef}},
+	{"/restconf/data/" + Module + ":tunnels/tunnel={name}", http.MethodDelete, "deleteTunnel",
+		"Delete a tunnel, with an approved request if approval.required is set", []string{"name", "approval"}, nil,
+		map[int]any{http.StatusNoContent: nil, http.StatusForbidden: errorsRef, http.StatusNotFound: errorsRef}},
+	{"/restconf/data/" + Module + ":jobs/job={id}", http.MethodGet, "getJob",
+		"Read a job, to poll for the progress and result of an operation run in the background", []string{"id"}, nil,
+		map[int]any{http.StatusOK: entry(Module+":job", "job"), http.StatusNotFound: errorsRef}},
+	{"/restconf/data/" + Module + ":networks", http.MethodGet, "listNetworks",
+		"List the advertised networks", nil, nil,
+		map[int]any{http.StatusOK: container(Module+":networks", "network", "network")}},
+	{"/restconf/data/" + Module + ":networks", http.MethodPost, "advertiseNetwork",
+		"Advertise a network through a tunnel", nil, entry(Module+":network", "network"),
+		map[int]any{http.StatusCreated: nil, http.StatusConflict: errorsRef}},
+	{"/restconf/data/" + Module + ":networks/network={prefix},{tunnel}", http.MethodGet, "getNetwork",
+		"Read an advertised network", []string{"prefix", "tunnel"}, nil,
+		map[int]any{http.StatusOK: entry(Module+":network", "network"), http.StatusNotFound: errorsRef}},
+	{"/restconf/data/" + Module + ":networks/network={prefix},{tunnel}", http.MethodPut, "replaceNetwork",
+		"Advertise a network, or change its metric", []string{"prefix", "tunnel"}, entry(Module+":network", "network"),
+		map[int]any{http.StatusCreated: nil, http.StatusNoContent: nil}},
+	{"/restconf/data/" + Module + ":networks/network={prefix},{tunnel}", http.MethodDelete, "withdrawNetwork",
+		"Withdraw an advertised network", []string{"prefix", "tunnel"}, nil,
+		map[int]any{http.StatusNoContent: nil, http.StatusNotFound: errorsRef}},
+	{"/restconf/operations/" + ApproveOperation, http.MethodPost, "approve",
+		"Approve a request for a destructive operation made by another client", nil, wrapped(Module+":input", "approve-input"),
+		map[int]any{http.StatusOK: wrapped(Module+":output", "approve-output"), http.StatusForbidden: errorsRef, http.StatusNotFound: errorsRef}},
+	{"/restconf/operations/" + ca.Operation, http.MethodPost, "issueCertificate",
+		"Have the hub's CA issue a certificate for the client's name", nil, wrapped(Module+":input", "issue-certificate-input"),
+		map[int]any{http.StatusOK: wrapped(Module+":output", "issue-certificate-output"), http.StatusNotImplemented: errorsRef}},
+}
+
+// parameters describes the parameters endpoints refer to by name
+var parameters = map[string]any{
+	"name":   pathParam("name", "Name of the tunnel"),
+	"prefix": pathParam("prefix", "Advertised network, with its '/' percent-encoded"),
+	"tunnel": pathParam("tunnel", "Interface of the tunnel the network is advertised through"),
+	"id":     pathParam("id", "ID of the job"),
+	"prefer": map[string]any{
+		"name": "Prefer", "in": "header", "schema": map[string]any{"type": "string", "enum": []string{"respond-async"}},
+		"description": "respond-async to answer with 202 Accepted straight away, with the job in the Location header",
+	},
+	"approval": map[string]any{
+		"name": ApprovalHeader, "in": "header", "schema": map[string]any{"type": "string"},
+		"description": "ID of the approved request for this operation, when approval.required is set",
+	},
+	paramFields: queryParam(paramFields, "string",
+		"Nodes of each tunnel to return (RFC 8040 section 4.8.3), e.g. local-ip;state(status) or name,status"),
+	paramLimit:  queryParam(paramLimit, "integer", "Return at most this many tunnels"),
+	paramOffset: queryParam(paramOffset, "integer", "Skip this many tunnels, in order of name"),
+	paramStatus: queryParam(paramStatus, "string", "Only tunnels in these states, e.g. ERROR or UP,DOWN"),
+	paramLabelSelector: queryParam(paramLabelSelector, "string",
+		"Only tunnels whose labels match, e.g. site=fra,env!=lab"),
+}
+
+// errorsRef is the error response of RFC 8040 section 7.1
+var errorsRef = ref("errors")
+
+// OpenAPI returns an OpenAPI document describing the API served at serverURL,
+// or relative to wherever the document is found if serverURL is empty
+func OpenAPI(serverURL string) ([]byte, error) {
+	schemas := map[string]any{"errors": errorsSchema()}
+	for t, name := range schemaNames {
+		schemas[name] = typeSchema(t, false)
+	}
+
+	paths := map[string]map[string]any{}
+	for _, e := range endpoints {
+		if paths[e.path] == nil {
+			paths[e.path] = map[string]any{}
+		}
+		op := map[string]any{"operationId": e.id, "summary": e.summary}
+		var params []any
+		for _, p := range e.params {
+			params = append(params, ref(p, "parameters"))
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if e.request != nil {
+			op["requestBody"] = map[string]any{"required": true, "content": content(e.request)}
+		}
+		responses := map[string]any{
+			"400":     response(http.StatusBadRequest, errorsRef),
+			"default": response(0, errorsRef),
+		}
+		for status, body := range e.responses {
+			responses[strconv.Itoa(status)] = response(status, body)
+		}
+		if e.id == "listTunnels" {
+			responses["200"].(map[string]any)["headers"] = map[string]any{TotalCountHeader: map[string]any{
+				"description": "Number of tunnels matching the filters, before limit and offset",
+				"schema":      map[string]any{"type": "integer"},
+			}}
+		}
+		if e.id == "createTunnel" {
+			responses["202"].(map[string]any)["headers"] = map[string]any{"Location": map[string]any{
+				"description": "The job creating the tunnel, to poll with getJob",
+				"schema":      map[string]any{"type": "string"},
+			}}
+		}
+		if e.id == "deleteTunnel" {
+			responses["403"].(map[string]any)["headers"] = map[string]any{ApprovalHeader: map[string]any{
+				"description": "ID of the request submitted for approval, when approval is required",
+				"schema":      map[string]any{"type": "string"},
+			}}
+		}
+		op["responses"] = responses
+		paths[e.path][strings.ToLower(e.method)] = op
+	}
+
+	doc := map[string]any{
+		"openapi": OpenAPIVersion,
+		"info": map[string]any{
+			"title":   "ipsec-vpn RESTCONF API",
+			"version": Revision,
+			"description": "Tunnels and advertised networks of an ipsec-vpn gateway, served as RESTCONF (RFC 8040) " +
+				"resources of the " + Module + " YANG module. Clients authenticate with a certificate issued by " +
+				"restconf.client_ca.",
+		},
+		"paths":      paths,
+		"security":   []any{map[string]any{"mutualTLS": []any{}}},
+		"components": map[string]any{"schemas": schemas, "parameters": parameters, "securitySchemes": map[string]any{"mutualTLS": map[string]any{"type": "mutualTLS"}}},
+	}
+	if serverURL != "" {
+		doc["servers"] = []any{map[string]any{"url": strings.TrimRight(serverURL, "/")}}
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// jsonSchema returns the JSON Schema of a type as encoding/json encodes it.
+// Named types are referred to by name, and 64-bit integers with the string
+// option are strings, as RFC 7951 encodes them.
+func jsonSchema(t reflect.Type, quoted bool) any {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if name, ok := schemaNames[t]; ok && !quoted {
+		return ref(name)
+	}
+	return typeSchema(t, quoted)
+}
+
+// typeSchema returns the JSON Schema of a type, not referring to it by name
+func typeSchema(t reflect.Type, quoted bool) map[string]any {
+	if t == reflect.TypeFor[tunnel.Status]() {
+		return map[string]any{"type": "string", "enum": []tunnel.Status{tunnel.StatusUp, tunnel.StatusDown, tunnel.StatusError, tunnel.StatusUnknown}}
+	}
+	if t == reflect.TypeFor[job.State]() {
+		return map[string]any{"type": "string", "enum": []job.State{job.StateRunning, job.StateSucceeded, job.StateFailed}}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), quoted)
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem(), false)}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Int64, reflect.Uint64:
+		if quoted {
+			return map[string]any{"type": "string", "pattern": "^[0-9]+$"}
+		}
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int32, reflect.Uint32, reflect.Uint16:
+		return map[string]any{"type": "integer"}
+	case reflect.Struct:
+		properties := map[string]any{}
+		for i := range t.NumField() {
+			field := t.Field(i)
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			properties[name] = jsonSchema(field.Type, strings.Contains(opts, "string"))
+		}
+		return map[string]any{"type": "object", "properties": properties}
+	}
+	return map[string]any{}
+}
+
+// errorsSchema is the schema of an error response
+func errorsSchema() any {
+	return map[string]any{"type": "object", "properties": map[string]any{
+		"ietf-restconf:errors": map[string]any{"type": "object", "properties": map[string]any{
+			"error": map[string]any{"type": "array", "items": map[string]any{"type": "object", "properties": map[string]any{
+				"error-type":    map[string]any{"type": "string"},
+				"error-tag":     map[string]any{"type": "string"},
+				"error-message": map[string]any{"type": "string"},
+			}}},
+		}},
+	}}
+}
+
+// ref refers to a component, a schema unless kind says otherwise
+func ref(name string, kind ...string) map[string]any {
+	section := "schemas"
+	if len(kind) > 0 {
+		section = kind[0]
+	}
+	return map[string]any{"$ref": "#/components/" + section + "/" + name}
+}
+
+// entry is the schema of a body holding a single list entry, wrapped in an
+// array under the qualified list name as RFC 7951 describes
+func entry(member, schema string) any {
+	return map[string]any{"type": "object", "properties": map[string]any{
+		member: map[string]any{"type": "array", "items": ref(schema), "minItems": 1, "maxItems": 1},
+	}}
+}
+
+// container is the schema of a container holding a list
+func container(member, list, schema string) any {
+	return map[string]any{"type": "object", "properties": map[string]any{
+		member: map[string]any{"type": "object", "properties": map[string]any{
+			list: map[string]any{"type": "array", "items": ref(schema)},
+		}},
+	}}
+}
+
+// wrapped is the schema of operation input or output
+func wrapped(member, schema string) any {
+	return map[string]any{"type": "object", "properties": map[string]any{member: ref(schema)}}
+}
+
+// content is the content of a request or response body
+func content(schema any) map[string]any {
+	return map[string]any{mediaType: map[string]any{"schema": schema}}
+}
+
+// response describes a response with an optional body
+func response(status int, body any) map[string]any {
+	description := http.StatusText(status)
+	if status == 0 {
+		description = "Error"
+	}
+	r := map[string]any{"description": description}
+	if body != nil {
+		r["content"] = content(body)
+	}
+	return r
+}
+
+func pathParam(name, description string) map[string]any {
+	return map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}, "description": description}
+}
+
+func queryParam(name, typ, description string) map[string]any {
+	return map[string]any{"name": name, "in": "query", "schema": map[string]any{"type": typ}, "description": description}
+}
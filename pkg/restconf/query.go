@@ -0,0 +1,315 @@
+package restconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+)
+
+// TotalCountHeader carries the number of tunnels matching the filters of a list
+// request, before limit and offset are applied
+const TotalCountHeader = "Ipsec-Vpn-Total-Count"
+
+// Query parameters of tunnel resources. Only fields applies to a single tunnel.
+const (
+	paramFields        = "fields"
+	paramLimit         = "limit"
+	paramOffset        = "offset"
+	paramStatus        = "status"
+	paramLabelSelector = "label-selector"
+)
+
+// tunnelQuery selects, filters and pages through tunnels
+type tunnelQuery struct {
+	fields   fieldSet // nil for all fields
+	limit    int      // 0 for no limit
+	offset   int
+	status   []tunnel.Status
+	selector tunnel.Selector
+}
+
+// parseTunnelQuery parses the query of a request for the tunnel list, or for a
+// single tunnel if list is false. Each parameter may be given once.
+func parseTunnelQuery(rawQuery string, list bool) (*tunnelQuery, error) {
+	values, err := parseQuery(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	q := &tunnelQuery{}
+	for param, v := range values {
+		if len(v) != 1 {
+			return nil, fmt.Errorf("query parameter %q is given more than once", param)
+		}
+		value := v[0]
+		if !list && param != paramFields {
+			return nil, fmt.Errorf("query parameter %q only applies to the tunnel list", param)
+		}
+		switch param {
+		case paramFields:
+			if q.fields, err = parseFields(value); err != nil {
+				return nil, err
+			}
+		case paramLimit:
+			if q.limit, err = strconv.Atoi(value); err != nil || q.limit < 1 {
+				return nil, fmt.Errorf("limit must be a positive integer, got %q", value)
+			}
+		case paramOffset:
+			if q.offset, err = strconv.Atoi(value); err != nil || q.offset < 0 {
+				return nil, fmt.Errorf("offset must be a non-negative integer, got %q", value)
+			}
+		case paramStatus:
+			for _, s := range strings.Split(value, ",") {
+				status := tunnel.Status(strings.ToUpper(strings.TrimSpace(s)))
+				switch status {
+				case tunnel.StatusUp, tunnel.StatusDown, tunnel.StatusError, tunnel.StatusUnknown:
+					q.status = append(q.status, status)
+				default:
+					return nil, fmt.Errorf("unknown status %q", s)
+				}
+			}
+		case paramLabelSelector:
+			if q.selector, err = tunnel.ParseSelector(value); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("query parameter %q is not supported", param)
+		}
+	}
+	return q, nil
+}
+
+// parseQuery splits a query into its parameters. Unlike url.ParseQuery, it
+// leaves semicolons alone, which RFC 8040 fields expressions use unencoded.
+func parseQuery(rawQuery string) (url.Values, error) {
+	values := url.Values{}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		rawName, rawValue, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query parameter %q: %v", rawName, err)
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of query parameter %q: %v", name, err)
+		}
+		values.Add(name, value)
+	}
+	return values, nil
+}
+
+// matches reports whether a tunnel passes the label and status filters. The
+// status of a tunnel with the labels is looked up only to filter by it.
+func (q *tunnelQuery) matches(t *tunnel.Tunnel) bool {
+	if !q.selector.Matches(t.Labels) {
+		return false
+	}
+	if len(q.status) == 0 {
+		return true
+	}
+	t.RefreshStatus()
+	return slices.Contains(q.status, t.Status)
+}
+
+// page returns the tunnels within offset and limit
+func (q *tunnelQuery) page(tunnels []*tunnel.Tunnel) []*tunnel.Tunnel {
+	tunnels = tunnels[min(q.offset, len(tunnels)):]
+	if q.limit > 0 && len(tunnels) > q.limit {
+		tunnels = tunnels[:q.limit]
+	}
+	return tunnels
+}
+
+// entry converts a tunnel to its list entry, with only the selected fields
+func (q *tunnelQuery) entry(t *tunnel.Tunnel) (any, error) {
+	data := fromTunnel(t)
+	if q.fields == nil {
+		return data, nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var entry map[string]any
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, err
+	}
+	return q.fields.apply(entry), nil
+}
+
+// fieldSet is a selection of child nodes as the fields query parameter of RFC
+// 8040 section 4.8.3 describes. A child mapped to nil is selected as a whole.
+type fieldSet map[string]fieldSet
+
+// parseFields parses a fields expression against the tunnel list entry, such as
+// "name;state(status;reason)" or "name,state/status". Commas may separate
+// fields like semicolons, and leaves of state may be named on their own.
+func parseFields(expr string) (fieldSet, error) {
+	p := &fieldsParser{expr: expr}
+	fields, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.expr) {
+		return nil, fmt.Errorf("invalid fields %q: unexpected %q at %d", expr, p.expr[p.pos], p.pos)
+	}
+	if err := fields.resolve(tunnelSchema); err != nil {
+		return nil, fmt.Errorf("invalid fields %q: %v", expr, err)
+	}
+	return fields, nil
+}
+
+// fieldsParser is a recursive descent parser of fields expressions
+type fieldsParser struct {
+	expr string
+	pos  int
+}
+
+// parse parses fields separated by ';' or ',' up to a ')' or the end
+func (p *fieldsParser) parse() (fieldSet, error) {
+	fields := fieldSet{}
+	for {
+		start := p.pos
+		for p.pos < len(p.expr) && !strings.ContainsRune(";,()", rune(p.expr[p.pos])) {
+			p.pos++
+		}
+		var path []string
+		for _, node := range strings.Split(p.expr[start:p.pos], "/") {
+			// Nodes may carry the module name, as in ipsec-vpn:name
+			node = strings.TrimPrefix(node, Module+":")
+			if node == "" {
+				return nil, fmt.Errorf("invalid fields %q: empty node at %d", p.expr, start)
+			}
+			path = append(path, node)
+		}
+
+		var sub fieldSet
+		if p.pos < len(p.expr) && p.expr[p.pos] == '(' {
+			p.pos++
+			var err error
+			if sub, err = p.parse(); err != nil {
+				return nil, err
+			}
+			if p.pos >= len(p.expr) || p.expr[p.pos] != ')' {
+				return nil, fmt.Errorf("invalid fields %q: missing ')'", p.expr)
+			}
+			p.pos++
+		}
+		fields.add(path, sub)
+
+		if p.pos >= len(p.expr) || (p.expr[p.pos] != ';' && p.expr[p.pos] != ',') {
+			return fields, nil
+		}
+		p.pos++
+	}
+}
+
+// add selects the node at path, or only the sub nodes of it if sub is not nil
+func (f fieldSet) add(path []string, sub fieldSet) {
+	name := path[0]
+	child, ok := f[name]
+	if ok && child == nil {
+		return // Already selected as a whole
+	}
+	if len(path) == 1 && sub == nil {
+		f[name] = nil
+		return
+	}
+	if !ok {
+		child = fieldSet{}
+		f[name] = child
+	}
+	if len(path) > 1 {
+		child.add(path[1:], sub)
+		return
+	}
+	for node, nodeSub := range sub {
+		child.add([]string{node}, nodeSub)
+	}
+}
+
+// resolve checks the selection against schema, moving leaves of state named on
+// their own into state
+func (f fieldSet) resolve(schema fieldSet) error {
+	for name, sub := range f {
+		node, ok := schema[name]
+		if !ok {
+			if _, isState := schema["state"][name]; isState {
+				if sub != nil {
+					return fmt.Errorf("%q has no child nodes", name)
+				}
+				delete(f, name)
+				f.add([]string{"state", name}, sub)
+				continue
+			}
+			return fmt.Errorf("no node %q", name)
+		}
+		if sub != nil {
+			if node == nil {
+				return fmt.Errorf("%q has no child nodes", name)
+			}
+			if err := sub.resolve(node); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// apply returns the selected nodes of a JSON value. The name of list entries,
+// their key, is kept.
+func (f fieldSet) apply(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		selected := make(map[string]any)
+		for name, value := range v {
+			if sub, ok := f[name]; ok {
+				if sub == nil {
+					selected[name] = value
+				} else {
+					selected[name] = sub.apply(value)
+				}
+			} else if name == "name" {
+				selected[name] = value
+			}
+		}
+		return selected
+	case []any:
+		entries := make([]any, len(v))
+		for i, entry := range v {
+			entries[i] = f.apply(entry)
+		}
+		return entries
+	}
+	return v
+}
+
+// tunnelSchema is the tree of nodes of a tunnel list entry
+var tunnelSchema = schemaOf(reflect.TypeFor[tunnelData]())
+
+// schemaOf returns the tree of JSON members of a struct type, leaves mapped to nil
+func schemaOf(t reflect.Type) fieldSet {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	schema := fieldSet{}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			schema[name] = schemaOf(field.Type)
+		}
+	}
+	return schema
+}
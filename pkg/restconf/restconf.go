@@ -0,0 +1,1092 @@
+// Package restconf is a RESTCONF (RFC 8040) server for the tunnels and
+// advertised networks of the ipsec-vpn YANG module, for orchestration systems
+// that manage network devices through YANG models
+package restconf
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/access"
+	"github.com/dzakwan/ipsec-vpn/pkg/approval"
+	"github.com/dzakwan/ipsec-vpn/pkg/ca"
+	"github.com/dzakwan/ipsec-vpn/pkg/history"
+	"github.com/dzakwan/ipsec-vpn/pkg/job"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/dzakwan/ipsec-vpn/pkg/tunnel"
+	"github.com/spf13/viper"
+)
+
+// Module identifies the YANG module served
+const (
+	Module    = "ipsec-vpn"
+	Revision  = "2026-10-16"
+	Namespace = "urn:dzakwan:params:xml:ns:yang:ipsec-vpn"
+)
+
+// ApproveOperation approves a request under the two-person rule
+const ApproveOperation = Module + ":approve"
+
+// ApprovalHeader carries the ID of an approved request with a destructive
+// operation when approval.required is set
+const ApprovalHeader = "Ipsec-Vpn-Approval"
+
+// mediaType is the RESTCONF media type for JSON encoded YANG data
+const mediaType = "application/yang-data+json"
+
+// maxBodySize bounds the size of a request body
+const maxBodySize = 1 << 20
+
+// Schema is the ipsec-vpn YANG module
+//
+//go:embed ipsec-vpn.yang
+var Schema []byte
+
+// ErrNotConfigured is returned when TLS is not fully configured
+var ErrNotConfigured = errors.New("restconf.certificate, restconf.private_key and restconf.client_ca must be set")
+
+// Server answers RESTCONF requests. Clients authenticate with a certificate
+// issued by the configured client CA, or by the hub's CA to renew it.
+type Server struct {
+	mu     sync.Mutex // Serializes changes
+	http   *http.Server
+	miniCA *x509.Certificate // Clients it issued may only call issue-certificate
+}
+
+// New creates a server listening on addr with the given TLS configuration
+func New(addr string, tlsConfig *tls.Config) *Server {
+	s := &Server{}
+	s.http = &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// FromConfig creates a server from the restconf settings
+func FromConfig() (*Server, error) {
+	cert := viper.GetString("restconf.certificate")
+	key := viper.GetString("restconf.private_key")
+	clientCA := viper.GetString("restconf.client_ca")
+	if cert == "" || key == "" || clientCA == "" {
+		return nil, ErrNotConfigured
+	}
+	tlsConfig, err := TLSConfig(cert, key, clientCA)
+	if err != nil {
+		return nil, err
+	}
+	// Spokes renew with the certificate the hub's CA last issued them
+	authority, err := ca.Load()
+	if err != nil && !errors.Is(err, ca.ErrNotInitialized) {
+		return nil, err
+	}
+	s := New(viper.GetString("restconf.listen"), tlsConfig)
+	if authority != nil {
+		tlsConfig.ClientCAs.AddCert(authority.Certificate)
+		s.miniCA = authority.Certificate
+	}
+	return s, nil
+}
+
+// TLSConfig loads the server certificate and requires clients to present a
+// certificate issued by one of the CAs in clientCAFile
+func TLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %v", err)
+	}
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", clientCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Serve accepts connections on the listener until the server is closed
+func (s *Server) Serve(listener net.Listener) error {
+	logger.API.Info("RESTCONF server listening on %s", listener.Addr())
+	err := s.http.ServeTLS(listener, "", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// ListenAndServe listens on the configured address and serves until the server is closed
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.http.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	return s.http.Close()
+}
+
+// Handler returns the HTTP handler of the RESTCONF resources
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/host-meta", hostMeta)
+	mux.HandleFunc("/restconf", root)
+	mux.HandleFunc("/restconf/", root)
+	mux.HandleFunc("/restconf/operations", operations)
+	mux.HandleFunc("/restconf/operations/", s.operation)
+	mux.HandleFunc("/restconf/data", s.data)
+	mux.HandleFunc("/restconf/data/", s.data)
+	mux.HandleFunc("/restconf/yang/", schema)
+	mux.HandleFunc("/restconf/openapi.json", openAPI)
+	return s.authorize(record(mux))
+}
+
+// authorize refuses anything but reads to clients with the viewer role
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if commonName := client(r); r.TLS != nil && access.ClientRole(commonName) == access.RoleViewer {
+				logger.API.Error("Refused %s %s from RESTCONF client %s with the viewer role", r.Method, r.URL.Path, commonName)
+				writeError(w, http.StatusForbidden, "access-denied", "%v", access.Deny("client "+commonName, "change the configuration"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// record records the changes made through the API, with what it takes to make
+// them again in 'ipsec-vpn history replay', when history.record_operations is on
+func record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !history.RecordingOperations() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Bodies past the limit are refused by the handlers anyway
+		body, _ := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		op := history.Operation{
+			Time:        time.Now(),
+			Source:      history.SourceRESTCONF,
+			User:        client(r),
+			Method:      r.Method,
+			Path:        r.URL.RequestURI(),
+			ContentType: r.Header.Get("Content-Type"),
+			Body:        string(body),
+			Result:      history.ResultOK,
+		}
+		status := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(status, r)
+		if status.status >= http.StatusBadRequest {
+			op.Result = fmt.Sprintf("%d %s", status.status, http.StatusText(status.status))
+		}
+		if err := history.RecordOperation(op); err != nil {
+			logger.API.Error("Failed to record %s %s: %v", r.Method, r.URL.Path, err)
+		}
+	})
+}
+
+// statusWriter remembers the status of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// hostMeta points clients at the RESTCONF root (RFC 8040 section 3.1)
+func hostMeta(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/xrd+xml")
+	fmt.Fprintln(w, `<XRD xmlns="http://docs.oasis-open.org/ns/xri/xrd-1.0"><Link rel="restconf" href="/restconf"/></XRD>`)
+}
+
+// root returns the API root resource
+func root(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/restconf" && r.URL.Path != "/restconf/" {
+		writeError(w, http.StatusNotFound, "invalid-value", "no resource at %s", r.URL.Path)
+		return
+	}
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	writeData(w, http.StatusOK, map[string]any{
+		"ietf-restconf:restconf": map[string]any{
+			"data":                 map[string]any{},
+			"operations":           map[string]any{},
+			"yang-library-version": "2016-06-21",
+		},
+	})
+}
+
+// operations lists the RPCs (RFC 8040 section 3.3.2)
+func operations(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	writeData(w, http.StatusOK, map[string]any{"ietf-restconf:operations": map[string]any{
+		ca.Operation:     []any{nil},
+		ApproveOperation: []any{nil},
+	}})
+}
+
+// operation dispatches invocations of the RPCs
+func (s *Server) operation(w http.ResponseWriter, r *http.Request) {
+	var handle func(w http.ResponseWriter, r *http.Request)
+	switch strings.TrimPrefix(r.URL.Path, "/restconf/operations/") {
+	case ca.Operation:
+		handle = s.issueCertificate
+	case ApproveOperation:
+		handle = s.approve
+	default:
+		writeError(w, http.StatusNotFound, "invalid-value", "no operation at %s", r.URL.Path)
+		return
+	}
+	if allow(w, r, http.MethodPost) {
+		handle(w, r)
+	}
+}
+
+// approve approves a request for a destructive operation made by someone else
+func (s *Server) approve(w http.ResponseWriter, r *http.Request) {
+	if s.spoke(r) {
+		writeError(w, http.StatusForbidden, "access-denied", "certificates issued by the hub's CA may only renew themselves")
+		return
+	}
+	var input approveInput
+	if !readInput(w, r, &input) {
+		return
+	}
+	request, err := approval.Approve(input.ID, client(r))
+	switch {
+	case errors.Is(err, approval.ErrNotFound):
+		writeError(w, http.StatusNotFound, "invalid-value", "%v", err)
+		return
+	case errors.Is(err, approval.ErrSelfApproval):
+		writeError(w, http.StatusForbidden, "access-denied", "%v", err)
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, "operation-failed", "%v", err)
+		return
+	}
+	logger.API.Info("RESTCONF client %s approved request %s by %s to %s", request.ApprovedBy, request.ID, request.RequestedBy, request.Operation)
+	writeData(w, http.StatusOK, map[string]any{Module + ":output": approveOutput{
+		Operation: request.Operation,
+		Expires:   request.Expires.Format(time.RFC3339),
+	}})
+}
+
+// approved reports whether a destructive operation may go ahead under the
+// two-person rule, writing the error response if not. Without the
+// Ipsec-Vpn-Approval header, a request for the operation is submitted and its
+// ID returned in the header of the response.
+func approved(w http.ResponseWriter, r *http.Request, operation string) bool {
+	id := r.Header.Get(ApprovalHeader)
+	err := approval.Check(id, operation, client(r))
+	var pending *approval.PendingError
+	switch {
+	case err == nil:
+		if id != "" {
+			logger.API.Info("RESTCONF client %s used approved request %s to %s", client(r), id, operation)
+		}
+		return true
+	case errors.As(err, &pending):
+		logger.API.Info("RESTCONF client %s requested approval to %s as %s", client(r), operation, pending.Request.ID)
+		w.Header().Set(ApprovalHeader, pending.Request.ID)
+		writeError(w, http.StatusForbidden, "access-denied", "%v; have another operator approve it, then repeat the request with the %s header", err, ApprovalHeader)
+	default:
+		writeError(w, http.StatusForbidden, "access-denied", "%v", err)
+	}
+	return false
+}
+
+// issueCertificate signs a spoke's certificate request with the hub's CA. The
+// common name is taken from the client certificate, not the request, so a
+// spoke only ever gets certificates for the identity it authenticated as.
+func (s *Server) issueCertificate(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		writeError(w, http.StatusForbidden, "access-denied", "a client certificate is required")
+		return
+	}
+	var input ca.IssueRequest
+	if !readInput(w, r, &input) {
+		return
+	}
+	authority, err := ca.Load()
+	if errors.Is(err, ca.ErrNotInitialized) {
+		writeError(w, http.StatusNotImplemented, "operation-not-supported", "%v", err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+		return
+	}
+	commonName := client(r)
+	cert, err := authority.Issue([]byte(input.CSR), commonName, ca.Validity())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-value", "%v", err)
+		return
+	}
+	logger.API.Info("RESTCONF client %s was issued certificate %s, valid until %s", commonName, cert.SerialNumber, cert.Certificate.NotAfter.Format(time.RFC3339))
+	writeData(w, http.StatusOK, map[string]any{Module + ":output": ca.IssueResponse{
+		Certificate:   cert.CertificatePEM,
+		CACertificate: cert.CAPEM,
+	}})
+}
+
+// spoke reports whether a request was authenticated by a certificate of the
+// hub's CA rather than restconf.client_ca
+func (s *Server) spoke(r *http.Request) bool {
+	if s.miniCA == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	for _, chain := range r.TLS.VerifiedChains {
+		if !chain[len(chain)-1].Equal(s.miniCA) {
+			return false
+		}
+	}
+	return true
+}
+
+// schema returns the YANG module named in the YANG library
+func schema(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/restconf/yang/")
+	if name != Module && name != Module+"@"+Revision {
+		writeError(w, http.StatusNotFound, "invalid-value", "unknown module %s", name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yang")
+	w.Write(Schema)
+}
+
+// openAPI returns the OpenAPI document of the API, with paths relative to the server
+func openAPI(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	doc, err := OpenAPI("")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
+
+// modulesState is the YANG library (RFC 7895) listing the module
+func modulesState(r *http.Request) any {
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return map[string]any{
+		"ietf-yang-library:modules-state": map[string]any{
+			"module-set-id": Revision,
+			"module": []map[string]any{{
+				"name":             Module,
+				"revision":         Revision,
+				"schema":           fmt.Sprintf("%s://%s/restconf/yang/%s@%s", scheme, r.Host, Module, Revision),
+				"namespace":        Namespace,
+				"conformance-type": "implement",
+			}},
+		},
+	}
+}
+
+// segment is a path segment of a data resource, with the keys of a list entry
+type segment struct {
+	name string
+	keys []string
+}
+
+// parsePath splits the path of a data resource into its segments. Key values
+// are percent-decoded after splitting, since commas inside them are encoded.
+func parsePath(escaped string) ([]segment, error) {
+	escaped = strings.Trim(strings.TrimPrefix(escaped, "/restconf/data"), "/")
+	if escaped == "" {
+		return nil, nil
+	}
+	var segments []segment
+	for _, raw := range strings.Split(escaped, "/") {
+		name, keys, hasKeys := strings.Cut(raw, "=")
+		name, err := url.PathUnescape(name)
+		if err != nil {
+			return nil, err
+		}
+		seg := segment{name: name}
+		if hasKeys {
+			for _, key := range strings.Split(keys, ",") {
+				value, err := url.PathUnescape(key)
+				if err != nil {
+					return nil, err
+				}
+				seg.keys = append(seg.keys, value)
+			}
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// data dispatches requests for the datastore resource and its descendants
+func (s *Server) data(w http.ResponseWriter, r *http.Request) {
+	if s.spoke(r) {
+		writeError(w, http.StatusForbidden, "access-denied", "certificates issued by the hub's CA may only renew themselves")
+		return
+	}
+	path, err := parsePath(r.URL.EscapedPath())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-value", "invalid path: %v", err)
+		return
+	}
+	// Query parameters only select, filter and page through tunnels
+	if r.URL.RawQuery != "" && (r.Method != http.MethodGet || len(path) == 0 || path[0].name != Module+":tunnels") {
+		writeError(w, http.StatusBadRequest, "invalid-value", "query parameters are only supported when reading tunnels")
+		return
+	}
+
+	switch {
+	case len(path) == 0:
+		if allow(w, r, http.MethodGet) {
+			s.getDatastore(w)
+		}
+	case len(path) == 1 && path[0].name == "ietf-yang-library:modules-state":
+		if allow(w, r, http.MethodGet) {
+			writeData(w, http.StatusOK, modulesState(r))
+		}
+	case len(path) == 1 && path[0].name == Module+":tunnels" && path[0].keys == nil:
+		if allow(w, r, http.MethodGet, http.MethodPost) {
+			s.tunnels(w, r)
+		}
+	case len(path) == 2 && path[0].name == Module+":tunnels" && path[1].name == "tunnel" && len(path[1].keys) == 1:
+		if allow(w, r, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete) {
+			s.tunnel(w, r, path[1].keys[0])
+		}
+	case len(path) == 2 && path[0].name == Module+":jobs" && path[1].name == "job" && len(path[1].keys) == 1:
+		if allow(w, r, http.MethodGet) {
+			getJob(w, path[1].keys[0])
+		}
+	case len(path) == 1 && path[0].name == Module+":networks" && path[0].keys == nil:
+		if allow(w, r, http.MethodGet, http.MethodPost) {
+			s.networks(w, r)
+		}
+	case len(path) == 2 && path[0].name == Module+":networks" && path[1].name == "network" && len(path[1].keys) == 2:
+		if allow(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+			s.network(w, r, networkData{Prefix: path[1].keys[0], Tunnel: path[1].keys[1]})
+		}
+	default:
+		writeError(w, http.StatusNotFound, "invalid-value", "no resource at %s", r.URL.Path)
+	}
+}
+
+// getDatastore returns the whole datastore
+func (s *Server) getDatastore(w http.ResponseWriter) {
+	tunnels, err := listTunnels()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+		return
+	}
+	networks, err := listNetworks()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+		return
+	}
+	writeData(w, http.StatusOK, map[string]any{
+		"ietf-restconf:data": map[string]any{
+			Module + ":tunnels":  map[string]any{"tunnel": tunnels},
+			Module + ":networks": map[string]any{"network": networks},
+		},
+	})
+}
+
+// listTunnels returns every tunnel as a list entry
+func listTunnels() ([]tunnelData, error) {
+	all, err := tunnel.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	tunnels := make([]tunnelData, 0, len(all))
+	for _, t := range all {
+		tunnels = append(tunnels, fromTunnel(t))
+	}
+	return tunnels, nil
+}
+
+// listNetworks returns every advertised network as a list entry
+func listNetworks() ([]networkData, error) {
+	routes, err := network.ListAdvertisedRoutes()
+	if err != nil {
+		return nil, err
+	}
+	networks := make([]networkData, 0, len(routes))
+	for _, route := range routes {
+		networks = append(networks, fromRoute(route))
+	}
+	return networks, nil
+}
+
+// tunnels lists the tunnels, or creates one from the entry in a POST. The list
+// can be filtered by status and labels, paged through with limit and offset, and
+// cut down to the fields selected.
+func (s *Server) tunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		q, err := parseTunnelQuery(r.URL.RawQuery, true)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid-value", "%v", err)
+			return
+		}
+		// Looking up the status of a tunnel is costly, so it is only done for
+		// the page returned, unless the tunnels are filtered by it
+		all, err := tunnel.ListConfigured()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+			return
+		}
+		var matched []*tunnel.Tunnel
+		for _, t := range all {
+			if q.matches(t) {
+				matched = append(matched, t)
+			}
+		}
+		tunnels := []any{}
+		for _, t := range q.page(matched) {
+			if len(q.status) == 0 {
+				t.RefreshStatus()
+			}
+			entry, err := q.entry(t)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+				return
+			}
+			tunnels = append(tunnels, entry)
+		}
+		w.Header().Set(TotalCountHeader, strconv.Itoa(len(matched)))
+		writeData(w, http.StatusOK, map[string]any{Module + ":tunnels": map[string]any{"tunnel": tunnels}})
+		return
+	}
+
+	var entry tunnelData
+	if !readEntry(w, r, Module+":tunnel", &entry) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := tunnel.Get(entry.Name); err == nil {
+		writeError(w, http.StatusConflict, "data-exists", "tunnel '%s' already exists", entry.Name)
+		return
+	}
+	if respondAsync(r) {
+		s.createTunnelAsync(w, r, entry)
+		return
+	}
+	if createTunnel(w, r, entry) {
+		w.Header().Set("Location", "/restconf/data/"+Module+":tunnels/tunnel="+url.PathEscape(entry.Name))
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// tunnel reads, replaces, merges into or deletes a tunnel
+func (s *Server) tunnel(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	existing, err := tunnel.Get(name)
+	if err != nil && !errors.Is(err, tunnel.ErrNotFound) {
+		writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+		return
+	}
+	if existing == nil && r.Method != http.MethodPut {
+		writeError(w, http.StatusNotFound, "invalid-value", "tunnel '%s' does not exist", name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		q, err := parseTunnelQuery(r.URL.RawQuery, false)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid-value", "%v", err)
+			return
+		}
+		entry, err := q.entry(existing)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+			return
+		}
+		writeData(w, http.StatusOK, map[string]any{Module + ":tunnel": []any{entry}})
+
+	case http.MethodDelete:
+		if !approved(w, r, fmt.Sprintf("delete tunnel '%s'", name)) {
+			return
+		}
+		if err := tunnel.Delete(name, true); err != nil {
+			writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+			return
+		}
+		logger.API.Info("RESTCONF client %s deleted tunnel '%s'", client(r), name)
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodPut, http.MethodPatch:
+		// A merge starts from the current values, a replacement from nothing
+		var entry tunnelData
+		if r.Method == http.MethodPatch {
+			entry = fromTunnel(existing)
+			entry.State = nil
+		}
+		if !readEntry(w, r, Module+":tunnel", &entry) {
+			return
+		}
+		if r.Method == http.MethodPatch {
+			// Label entries are merged by their key, not replaced as a whole
+			labels := maps.Clone(existing.Labels)
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			maps.Copy(labels, entry.labels())
+			entry.Labels = labelList(labels)
+		}
+		if entry.Name != name {
+			writeError(w, http.StatusBadRequest, "invalid-value", "name %q does not match the key %q", entry.Name, name)
+			return
+		}
+		if existing == nil {
+			if createTunnel(w, r, entry) {
+				w.WriteHeader(http.StatusCreated)
+			}
+			return
+		}
+		if updateTunnel(w, r, existing, entry) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// createTunnel creates a tunnel and starts it if enabled, writing an error response on failure
+func createTunnel(w http.ResponseWriter, r *http.Request, entry tunnelData) bool {
+	if !validNewTunnel(w, entry) {
+		return false
+	}
+	if err := buildTunnel(entry, nil); err != nil {
+		if errors.Is(err, tunnel.ErrInvalidConfig) {
+			writeError(w, http.StatusBadRequest, "invalid-value", "%v", err)
+		} else {
+			writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+		}
+		return false
+	}
+	logger.API.Info("RESTCONF client %s created tunnel '%s'", client(r), entry.Name)
+	return true
+}
+
+// validNewTunnel checks the leaves of a tunnel to create, writing an error
+// response if they are incomplete or invalid
+func validNewTunnel(w http.ResponseWriter, entry tunnelData) bool {
+	if entry.LocalIP == "" || entry.RemoteIP == "" || entry.LocalSubnet == "" || entry.RemoteSubnet == "" {
+		writeError(w, http.StatusBadRequest, "missing-element", "local-ip, remote-ip, local-subnet and remote-subnet are mandatory")
+		return false
+	}
+	if err := entry.checkTypes(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-value", "%v", err)
+		return false
+	}
+	return true
+}
+
+// buildTunnel creates a tunnel, sets its labels and starts it if enabled,
+// recording each step in j unless nil
+func buildTunnel(entry tunnelData, j *job.Job) error {
+	step := func(format string, args ...any) {
+		if j != nil {
+			if err := j.Step(format, args...); err != nil {
+				logger.API.Error("Failed to record the progress of job %s: %v", j.ID, err)
+			}
+		}
+	}
+
+	step("Creating tunnel '%s'", entry.Name)
+	if _, err := tunnel.Create(entry.config()); err != nil {
+		return err
+	}
+	if len(entry.Labels) > 0 {
+		if err := tunnel.SetLabels(entry.Name, entry.labels()); err != nil {
+			return fmt.Errorf("tunnel '%s' was created but its labels were not set: %v", entry.Name, err)
+		}
+	}
+	if entry.Enabled {
+		step("Starting tunnel '%s'", entry.Name)
+		if err := tunnel.Start(entry.Name); err != nil {
+			return fmt.Errorf("tunnel '%s' was created but failed to start: %v", entry.Name, err)
+		}
+	}
+	return nil
+}
+
+// respondAsync reports whether a client asked for a long-running request to
+// be answered before it completes (RFC 7240)
+func respondAsync(r *http.Request) bool {
+	for _, prefer := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(prefer, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// createTunnelAsync creates a tunnel in the background as a job, answering
+// with 202 Accepted and the location of the job straight away
+func (s *Server) createTunnelAsync(w http.ResponseWriter, r *http.Request, entry tunnelData) {
+	if !validNewTunnel(w, entry) {
+		return
+	}
+	j, err := job.New(fmt.Sprintf("create tunnel '%s'", entry.Name))
+	if err == nil {
+		j, err = job.Attach(j.ID)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+		return
+	}
+	by := client(r)
+	go func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		err := buildTunnel(entry, j)
+		if err == nil {
+			logger.API.Info("RESTCONF client %s created tunnel '%s' in job %s", by, entry.Name, j.ID)
+		}
+		if err := j.Finish(err); err != nil {
+			logger.API.Error("Failed to record the result of job %s: %v", j.ID, err)
+		}
+	}()
+
+	w.Header().Set("Location", "/restconf/data/"+Module+":jobs/job="+j.ID)
+	w.Header().Set("Preference-Applied", "respond-async")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// getJob reads a job
+func getJob(w http.ResponseWriter, id string) {
+	j, err := job.Load(id)
+	if errors.Is(err, job.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "invalid-value", "job '%s' does not exist", id)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+		return
+	}
+	writeData(w, http.StatusOK, map[string]any{Module + ":job": []any{fromJob(j)}})
+}
+
+// updateTunnel applies the kill-switch, rate limit, peer group, label and enabled leaves to an
+// existing tunnel, writing an error response on failure. Other leaves must not change.
+func updateTunnel(w http.ResponseWriter, r *http.Request, existing *tunnel.Tunnel, entry tunnelData) bool {
+	if leaves := entry.fixedLeaves(existing); len(leaves) > 0 {
+		writeError(w, http.StatusBadRequest, "invalid-value",
+			"%s of tunnel '%s' cannot be changed, delete the tunnel and create it again", strings.Join(leaves, ", "), existing.Name)
+		return false
+	}
+	labels := entry.labels()
+	if err := tunnel.ValidateLabels(labels); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-value", "%v", err)
+		return false
+	}
+
+	name := existing.Name
+	var err error
+	if !maps.Equal(labels, existing.Labels) {
+		err = tunnel.SetLabels(name, labels)
+	}
+	if err == nil && entry.KillSwitch != existing.KillSwitch {
+		err = tunnel.SetKillSwitch(name, entry.KillSwitch)
+	}
+	if err == nil && entry.RateLimit != existing.RateLimit {
+		err = tunnel.SetRateLimit(name, entry.RateLimit)
+	}
+	if err == nil && entry.PeerGroup != existing.PeerGroup {
+		err = tunnel.SetPeerGroup(name, entry.PeerGroup)
+	}
+	if err == nil && entry.VirtualIPPool != existing.VirtualIPPool {
+		err = tunnel.SetVirtualIPPool(name, entry.VirtualIPPool)
+	}
+	if err == nil && entry.Shortcuts != existing.Shortcuts {
+		err = tunnel.SetShortcuts(name, entry.Shortcuts)
+	}
+	if up := existing.Status == tunnel.StatusUp; err == nil && entry.Enabled != up {
+		if entry.Enabled {
+			err = tunnel.Start(name)
+		} else {
+			err = tunnel.Stop(name)
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+		return false
+	}
+	logger.API.Info("RESTCONF client %s updated tunnel '%s'", client(r), name)
+	return true
+}
+
+// networks lists the advertised networks, or advertises the one in a POST
+func (s *Server) networks(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		networks, err := listNetworks()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+			return
+		}
+		writeData(w, http.StatusOK, map[string]any{Module + ":networks": map[string]any{"network": networks}})
+		return
+	}
+
+	entry := networkData{Metric: 100}
+	if !readEntry(w, r, Module+":network", &entry) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, err := findNetwork(entry); err != nil {
+		writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+		return
+	} else if existing != nil {
+		writeError(w, http.StatusConflict, "data-exists", "%s is already advertised through %s", entry.Prefix, entry.Tunnel)
+		return
+	}
+	if advertise(w, r, entry) {
+		w.Header().Set("Location", "/restconf/data/"+Module+":networks/network="+
+			url.PathEscape(entry.Prefix)+","+url.PathEscape(entry.Tunnel))
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// network reads, replaces or withdraws an advertised network
+func (s *Server) network(w http.ResponseWriter, r *http.Request, key networkData) {
+	if r.Method != http.MethodGet {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	existing, err := findNetwork(key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+		return
+	}
+	if existing == nil && r.Method != http.MethodPut {
+		writeError(w, http.StatusNotFound, "invalid-value", "%s is not advertised through %s", key.Prefix, key.Tunnel)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeData(w, http.StatusOK, map[string]any{Module + ":network": []networkData{*existing}})
+
+	case http.MethodDelete:
+		if err := network.WithdrawNetwork(existing.Prefix, existing.Tunnel); err != nil {
+			writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+			return
+		}
+		logger.API.Info("RESTCONF client %s withdrew %s from %s", client(r), existing.Prefix, existing.Tunnel)
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodPut:
+		entry := networkData{Metric: 100}
+		if !readEntry(w, r, Module+":network", &entry) {
+			return
+		}
+		if entry.Prefix != key.Prefix || entry.Tunnel != key.Tunnel {
+			writeError(w, http.StatusBadRequest, "invalid-value", "prefix and tunnel do not match the keys %s,%s", key.Prefix, key.Tunnel)
+			return
+		}
+		status := http.StatusCreated
+		if existing != nil {
+			status = http.StatusNoContent
+			if existing.Metric == entry.Metric {
+				w.WriteHeader(status)
+				return
+			}
+			if err := network.WithdrawNetwork(existing.Prefix, existing.Tunnel); err != nil {
+				writeError(w, http.StatusInternalServerError, "operation-failed", "%v", err)
+				return
+			}
+		}
+		if advertise(w, r, entry) {
+			w.WriteHeader(status)
+		}
+	}
+}
+
+// findNetwork returns the advertised network with the keys of entry, or nil
+func findNetwork(entry networkData) (*networkData, error) {
+	_, prefix, err := net.ParseCIDR(entry.Prefix)
+	if err != nil {
+		return nil, nil
+	}
+	networks, err := listNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range networks {
+		if n.Prefix == prefix.String() && n.Tunnel == entry.Tunnel {
+			return &n, nil
+		}
+	}
+	return nil, nil
+}
+
+// advertise advertises a network, writing an error response on failure
+func advertise(w http.ResponseWriter, r *http.Request, entry networkData) bool {
+	if err := network.AdvertiseNetwork(entry.Prefix, entry.Tunnel, entry.Metric); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-value", "%v", err)
+		return false
+	}
+	logger.API.Info("RESTCONF client %s advertised %s through %s", client(r), entry.Prefix, entry.Tunnel)
+	return true
+}
+
+// readEntry decodes a request body holding a single list entry into v. Per
+// RFC 7951 the entry is wrapped in an array under the qualified list name.
+func readEntry(w http.ResponseWriter, r *http.Request, name string, v any) bool {
+	if media, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); media != mediaType && media != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, "invalid-value", "expected %s", mediaType)
+		return false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "malformed-message", "%v", err)
+		return false
+	}
+	var doc map[string][]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed-message", "%v", err)
+		return false
+	}
+	entries, ok := doc[name]
+	if len(doc) != 1 || !ok || len(entries) != 1 {
+		writeError(w, http.StatusBadRequest, "malformed-message", "expected a single %s entry", name)
+		return false
+	}
+	if err := json.Unmarshal(entries[0], v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-value", "%v", err)
+		return false
+	}
+	return true
+}
+
+// readInput decodes the input of an operation into v. Per RFC 8040 section 3.6.1
+// it is wrapped in an object under the qualified name "input".
+func readInput(w http.ResponseWriter, r *http.Request, v any) bool {
+	if media, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); media != mediaType && media != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, "invalid-value", "expected %s", mediaType)
+		return false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "malformed-message", "%v", err)
+		return false
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed-message", "%v", err)
+		return false
+	}
+	input, ok := doc[Module+":input"]
+	if len(doc) != 1 || !ok {
+		writeError(w, http.StatusBadRequest, "malformed-message", "expected %s:input", Module)
+		return false
+	}
+	if err := json.Unmarshal(input, v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-value", "%v", err)
+		return false
+	}
+	return true
+}
+
+// allow writes a 405 response unless the request uses one of the methods
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "operation-not-supported", "%s is not supported on %s", r.Method, r.URL.Path)
+	return false
+}
+
+// writeData writes a response body of YANG data
+func writeData(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeError writes an error response as RFC 8040 section 7.1 describes
+func writeError(w http.ResponseWriter, status int, tag, format string, args ...any) {
+	errorType := "application"
+	if tag == "malformed-message" {
+		errorType = "rpc"
+	}
+	writeData(w, status, map[string]any{
+		"ietf-restconf:errors": map[string]any{
+			"error": []map[string]string{{
+				"error-type":    errorType,
+				"error-tag":     tag,
+				"error-message": fmt.Sprintf(format, args...),
+			}},
+		},
+	})
+}
+
+// client names the client of a request by its certificate
+func client(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,544 @@
+package restconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/ca"
+	"github.com/dzakwan/ipsec-vpn/pkg/history"
+	"github.com/dzakwan/ipsec-vpn/pkg/job"
+	"github.com/spf13/viper"
+)
+
+// request sends a request to a server's handler and returns the response
+func request(t *testing.T, s *Server, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", mediaType)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+// errorTag returns the error-tag of an RFC 8040 error response
+func errorTag(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp struct {
+		Errors struct {
+			Error []struct {
+				Tag string `json:"error-tag"`
+			} `json:"error"`
+		} `json:"ietf-restconf:errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Errors.Error) != 1 {
+		t.Fatalf("Expected an error response, got %d: %s", w.Code, w.Body)
+	}
+	return resp.Errors.Error[0].Tag
+}
+
+func TestParsePath(t *testing.T) {
+	path, err := parsePath("/restconf/data/ipsec-vpn:networks/network=172.16.0.0%2F24,gre-a%2Cb")
+	if err != nil {
+		t.Fatalf("parsePath failed: %v", err)
+	}
+	if len(path) != 2 || path[0].name != "ipsec-vpn:networks" || path[1].name != "network" {
+		t.Fatalf("Unexpected segments %+v", path)
+	}
+	if keys := path[1].keys; len(keys) != 2 || keys[0] != "172.16.0.0/24" || keys[1] != "gre-a,b" {
+		t.Errorf("Expected the keys decoded after splitting, got %q", keys)
+	}
+}
+
+func TestTunnelResources(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	defer viper.Set("config_dir", "")
+	if err := os.MkdirAll(filepath.Join(dir, "tunnels"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stored := `{"name":"office","local_ip":"192.0.2.1","remote_ip":"198.51.100.1","local_subnet":"10.0.0.0/16",
+		"remote_subnet":"10.1.0.0/16","encryption":"aes256gcm","mode":"ipsec","rate_limit":10000000}`
+	if err := os.WriteFile(filepath.Join(dir, "tunnels", "office.json"), []byte(stored), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := New("", nil)
+
+	w := request(t, s, http.MethodGet, "/restconf/data/ipsec-vpn:tunnels/tunnel=office", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != mediaType {
+		t.Fatalf("Expected the tunnel, got %d: %s", w.Code, w.Body)
+	}
+	var got struct {
+		Tunnel []tunnelData `json:"ipsec-vpn:tunnel"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got.Tunnel) != 1 {
+		t.Fatalf("Unexpected response %s: %v", w.Body, err)
+	}
+	if tun := got.Tunnel[0]; tun.LocalSubnet != "10.0.0.0/16" || tun.RateLimit != 10000000 || tun.State == nil {
+		t.Errorf("Unexpected tunnel %+v", tun)
+	}
+	if !strings.Contains(w.Body.String(), `"rate-limit": "10000000"`) {
+		t.Errorf("Expected the 64-bit rate limit encoded as a string: %s", w.Body)
+	}
+
+	// Fixed leaves cannot be changed in place
+	w = request(t, s, http.MethodPatch, "/restconf/data/ipsec-vpn:tunnels/tunnel=office",
+		`{"ipsec-vpn:tunnel":[{"name":"office","local-ip":"192.0.2.9"}]}`)
+	if w.Code != http.StatusBadRequest || errorTag(t, w) != "invalid-value" || !strings.Contains(w.Body.String(), "local-ip") {
+		t.Errorf("Expected changing local-ip to be rejected, got %d: %s", w.Code, w.Body)
+	}
+	w = request(t, s, http.MethodPut, "/restconf/data/ipsec-vpn:tunnels/tunnel=office",
+		`{"ipsec-vpn:tunnel":[{"name":"branch"}]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a name not matching the key to be rejected, got %d", w.Code)
+	}
+	w = request(t, s, http.MethodPost, "/restconf/data/ipsec-vpn:tunnels", `{"ipsec-vpn:tunnel":[{"name":"office"}]}`)
+	if w.Code != http.StatusConflict || errorTag(t, w) != "data-exists" {
+		t.Errorf("Expected creating an existing tunnel to conflict, got %d: %s", w.Code, w.Body)
+	}
+	w = request(t, s, http.MethodPost, "/restconf/data/ipsec-vpn:tunnels",
+		`{"ipsec-vpn:tunnel":[{"name":"new","local-ip":"192.0.2.1","remote-ip":"198.51.100.2","local-subnet":"10.0.0.0/16","remote-subnet":"bad"}]}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "remote-subnet") {
+		t.Errorf("Expected an invalid prefix to be rejected, got %d: %s", w.Code, w.Body)
+	}
+
+	w = request(t, s, http.MethodGet, "/restconf/data/ipsec-vpn:tunnels/tunnel=missing", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing tunnel, got %d", w.Code)
+	}
+	w = request(t, s, http.MethodPatch, "/restconf/data/ipsec-vpn:tunnels", "")
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") == "" {
+		t.Errorf("Expected 405 with Allow, got %d", w.Code)
+	}
+	w = request(t, s, http.MethodGet, "/restconf/data?depth=1", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected unsupported query parameters to be rejected, got %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/restconf/data/ipsec-vpn:tunnels", strings.NewReader("<tunnel/>"))
+	r.Header.Set("Content-Type", "application/yang-data+xml")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, r)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected XML to be refused, got %d", rec.Code)
+	}
+}
+
+func TestAsyncCreate(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+	s := New("", nil)
+
+	r := httptest.NewRequest(http.MethodPost, "/restconf/data/ipsec-vpn:tunnels", strings.NewReader(
+		`{"ipsec-vpn:tunnel":[{"name":"new","local-ip":"192.0.2.1","remote-ip":"198.51.100.2","local-subnet":"10.0.0.0/16","remote-subnet":"10.2.0.0/16","encryption":"bogus"}]}`))
+	r.Header.Set("Content-Type", mediaType)
+	r.Header.Set("Prefer", "return=minimal, respond-async")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusAccepted || !strings.HasPrefix(location, "/restconf/data/ipsec-vpn:jobs/job=") ||
+		w.Header().Get("Preference-Applied") != "respond-async" {
+		t.Fatalf("Expected 202 with the location of a job, got %d %q: %s", w.Code, location, w.Body)
+	}
+
+	// The invalid cipher is only found by the job
+	var resp struct {
+		Job []jobData `json:"ipsec-vpn:job"`
+	}
+	for range 100 {
+		w = request(t, s, http.MethodGet, location, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the job, got %d: %s", w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Job) != 1 {
+			t.Fatalf("Expected a single job, got %s", w.Body)
+		}
+		if resp.Job[0].State != job.StateRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	j := resp.Job[0]
+	if j.State != job.StateFailed || !strings.Contains(j.Error, "bogus") || j.Operation != "create tunnel 'new'" || len(j.Steps) == 0 {
+		t.Errorf("Expected the job to fail on the cipher, got %+v", j)
+	}
+
+	if w := request(t, s, http.MethodGet, "/restconf/data/ipsec-vpn:jobs/job=missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing job, got %d", w.Code)
+	}
+}
+
+func TestTunnelQuery(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	defer viper.Set("config_dir", "")
+	if err := os.MkdirAll(filepath.Join(dir, "tunnels"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tun := range []struct{ name, status, labels string }{
+		{"a", "UP", `["site=fra","env=prod"]`},
+		{"b", "ERROR", `["site=fra"]`},
+		{"c", "ERROR", `["site=ams","env=prod"]`},
+		{"d", "DOWN", `[]`},
+	} {
+		stored := `{"name":"` + tun.name + `","local_ip":"192.0.2.1","remote_ip":"198.51.100.1","local_subnet":"10.0.0.0/16",
+			"remote_subnet":"10.1.0.0/16","mode":"ipsec","status":"` + tun.status + `","reason":"test","labels":` + tun.labels + `}`
+		if err := os.WriteFile(filepath.Join(dir, "tunnels", tun.name+".json"), []byte(stored), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := New("", nil)
+
+	list := func(query string) ([]map[string]any, string) {
+		t.Helper()
+		w := request(t, s, http.MethodGet, "/restconf/data/ipsec-vpn:tunnels?"+query, "")
+		var got struct {
+			Tunnels struct {
+				Tunnel []map[string]any `json:"tunnel"`
+			} `json:"ipsec-vpn:tunnels"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("Expected the tunnels for %q, got %d: %s", query, w.Code, w.Body)
+		}
+		var names []string
+		for _, tun := range got.Tunnels.Tunnel {
+			names = append(names, tun["name"].(string))
+		}
+		if total := w.Header().Get(TotalCountHeader); total == "" {
+			t.Errorf("Expected the total count for %q", query)
+		}
+		return got.Tunnels.Tunnel, strings.Join(names, ",")
+	}
+
+	for query, want := range map[string]string{
+		"":                                      "a,b,c,d",
+		"status=ERROR":                          "b,c",
+		"status=up,down":                        "a,d",
+		"label-selector=site%3Dfra":             "a,b",
+		"label-selector=env%3Dprod,site!%3Dfra": "c",
+		"label-selector=!site":                  "d",
+		"status=ERROR&label-selector=env":       "c",
+		"limit=2":                               "a,b",
+		"limit=2&offset=3":                      "d",
+		"offset=9":                              "",
+	} {
+		if _, got := list(query); got != want {
+			t.Errorf("Expected tunnels %q for %q, got %q", want, query, got)
+		}
+	}
+
+	tunnels, _ := list("fields=name,status&limit=1")
+	if state, ok := tunnels[0]["state"].(map[string]any); len(tunnels[0]) != 2 || !ok || len(state) != 1 || state["status"] != "UP" {
+		t.Errorf("Expected only the name and status, got %v", tunnels[0])
+	}
+	tunnels, _ = list("fields=local-ip;state(status;reason);label/value&limit=1")
+	if state := tunnels[0]["state"].(map[string]any); len(tunnels[0]) != 4 || len(state) != 2 {
+		t.Errorf("Expected the name, local-ip, label values and two state leaves, got %v", tunnels[0])
+	}
+	if labels := tunnels[0]["label"].([]any); len(labels) != 2 || labels[0].(map[string]any)["value"] != "prod" {
+		t.Errorf("Expected the labels with their name and value, got %v", tunnels[0]["label"])
+	}
+
+	w := request(t, s, http.MethodGet, "/restconf/data/ipsec-vpn:tunnels/tunnel=b?fields=enabled", "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "local-ip") || !strings.Contains(w.Body.String(), `"enabled"`) {
+		t.Errorf("Expected only the selected fields of the tunnel, got %d: %s", w.Code, w.Body)
+	}
+	for _, path := range []string{
+		"ipsec-vpn:tunnels?limit=0",
+		"ipsec-vpn:tunnels?offset=-1",
+		"ipsec-vpn:tunnels?status=BROKEN",
+		"ipsec-vpn:tunnels?fields=name(status)",
+		"ipsec-vpn:tunnels?fields=bogus",
+		"ipsec-vpn:tunnels?fields=state(status",
+		"ipsec-vpn:tunnels?label-selector=a%20b",
+		"ipsec-vpn:tunnels?limit=1&limit=2",
+		"ipsec-vpn:tunnels/tunnel=b?limit=1",
+		"ipsec-vpn:networks?limit=1",
+	} {
+		if w := request(t, s, http.MethodGet, "/restconf/data/"+path, ""); w.Code != http.StatusBadRequest || errorTag(t, w) != "invalid-value" {
+			t.Errorf("Expected %s to be rejected, got %d: %s", path, w.Code, w.Body)
+		}
+	}
+
+	// Labels are merged by a PATCH and replaced by a PUT
+	w = request(t, s, http.MethodPatch, "/restconf/data/ipsec-vpn:tunnels/tunnel=a",
+		`{"ipsec-vpn:tunnel":[{"name":"a","label":[{"name":"site","value":"ams"},{"name":"rack","value":"r1"}]}]}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the labels to be merged, got %d: %s", w.Code, w.Body)
+	}
+	if _, got := list("label-selector=site%3Dams,env%3Dprod"); got != "a,c" {
+		t.Errorf("Expected the merged labels to select a and c, got %q", got)
+	}
+	w = request(t, s, http.MethodPatch, "/restconf/data/ipsec-vpn:tunnels/tunnel=a",
+		`{"ipsec-vpn:tunnel":[{"name":"a","label":[{"name":"bad key","value":"x"}]}]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid label key to be rejected, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestYangLibrary(t *testing.T) {
+	s := New("", nil)
+	w := request(t, s, http.MethodGet, "/restconf/data/ietf-yang-library:modules-state", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/restconf/yang/ipsec-vpn@"+Revision) {
+		t.Fatalf("Expected the module with its schema location, got %d: %s", w.Code, w.Body)
+	}
+	w = request(t, s, http.MethodGet, "/restconf/yang/ipsec-vpn@"+Revision, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "revision "+Revision) {
+		t.Errorf("Expected the YANG module of this revision, got %d", w.Code)
+	}
+}
+
+func TestIssueCertificate(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+	s := New("", nil)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "hub"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, _ := json.Marshal(map[string]any{"ipsec-vpn:input": ca.IssueRequest{
+		CSR: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+	}})
+	issue := func(chains [][]*x509.Certificate) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/restconf/operations/"+ca.Operation, strings.NewReader(string(input)))
+		r.Header.Set("Content-Type", mediaType)
+		r.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "spoke-1"}}},
+			VerifiedChains:   chains,
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	if w := issue(nil); w.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected no CA to be reported, got %d: %s", w.Code, w.Body)
+	}
+	authority, err := ca.Init("hub CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := issue(nil)
+	var output struct {
+		Output ca.IssueResponse `json:"ipsec-vpn:output"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &output); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Expected a certificate, got %d: %s", w.Code, w.Body)
+	}
+	block, _ := pem.Decode([]byte(output.Output.Certificate))
+	if block == nil {
+		t.Fatalf("No certificate in %s", w.Body)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || cert.Subject.CommonName != "spoke-1" {
+		t.Errorf("Expected a certificate for the client's name, not the request's, got %v: %v", cert.Subject, err)
+	}
+	if output.Output.CACertificate != authority.CertificatePEM {
+		t.Error("Expected the CA certificate in the output")
+	}
+
+	// A spoke authenticated by the CA may renew but not touch the datastore
+	s.miniCA = authority.Certificate
+	chains := [][]*x509.Certificate{{cert, authority.Certificate}}
+	if w := issue(chains); w.Code != http.StatusOK {
+		t.Errorf("Expected a spoke to renew its certificate, got %d: %s", w.Code, w.Body)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/restconf/data", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: chains}
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || errorTag(t, w) != "access-denied" {
+		t.Errorf("Expected a spoke to be denied the datastore, got %d", w.Code)
+	}
+}
+
+func TestViewerClient(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	viper.Set("access.viewer_clients", []string{"noc"})
+	defer viper.Set("config_dir", "")
+	defer viper.Set("access.viewer_clients", nil)
+	if err := os.MkdirAll(filepath.Join(dir, "tunnels"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tunnels", "office.json"), []byte(`{"name":"office"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := New("", nil)
+	send := func(commonName, method string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/restconf/data/ipsec-vpn:tunnels/tunnel=office", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: commonName}}}}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	if w := send("noc", http.MethodGet); w.Code != http.StatusOK {
+		t.Errorf("Expected a viewer to read the tunnel, got %d: %s", w.Code, w.Body)
+	}
+	w := send("noc", http.MethodDelete)
+	if w.Code != http.StatusForbidden || errorTag(t, w) != "access-denied" {
+		t.Errorf("Expected a viewer to be denied deleting the tunnel, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tunnels", "office.json")); err != nil {
+		t.Error("Expected the tunnel to be kept")
+	}
+	if w := send("admin", http.MethodDelete); w.Code != http.StatusNoContent {
+		t.Errorf("Expected an operator to delete the tunnel, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestApproval(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	viper.Set("approval.required", true)
+	defer viper.Set("config_dir", "")
+	defer viper.Set("approval.required", false)
+	if err := os.MkdirAll(filepath.Join(dir, "tunnels"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tunnels", "office.json"), []byte(`{"name":"office"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := New("", nil)
+	send := func(commonName, method, path, id, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: commonName}}}}
+		if id != "" {
+			r.Header.Set(ApprovalHeader, id)
+		}
+		if body != "" {
+			r.Header.Set("Content-Type", mediaType)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+	const office = "/restconf/data/ipsec-vpn:tunnels/tunnel=office"
+
+	w := send("alice", http.MethodDelete, office, "", "")
+	id := w.Header().Get(ApprovalHeader)
+	if w.Code != http.StatusForbidden || errorTag(t, w) != "access-denied" || id == "" {
+		t.Fatalf("Expected deleting to need approval, got %d: %s", w.Code, w.Body)
+	}
+	approve := `{"ipsec-vpn:input":{"id":"` + id + `"}}`
+	if w := send("alice", http.MethodPost, "/restconf/operations/"+ApproveOperation, "", approve); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the requester not to approve their own request, got %d: %s", w.Code, w.Body)
+	}
+	if w := send("bob", http.MethodPost, "/restconf/operations/"+ApproveOperation, "", approve); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "delete tunnel 'office'") {
+		t.Fatalf("Expected bob to approve the request, got %d: %s", w.Code, w.Body)
+	}
+	if w := send("alice", http.MethodDelete, office, id, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the approved delete to go ahead, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tunnels", "office.json")); !os.IsNotExist(err) {
+		t.Error("Expected the tunnel to be deleted")
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	doc, err := OpenAPI("https://gw.example.com:8443/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec map[string]any
+	if err := json.Unmarshal(doc, &spec); err != nil {
+		t.Fatalf("Invalid document: %v", err)
+	}
+	if spec["openapi"] != OpenAPIVersion || !strings.Contains(string(doc), `"url": "https://gw.example.com:8443"`) {
+		t.Errorf("Expected the version and server in the document")
+	}
+
+	// Every reference resolves to a component
+	components := spec["components"].(map[string]any)
+	var check func(v any)
+	check = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if target, ok := v["$ref"].(string); ok {
+				section, name, _ := strings.Cut(strings.TrimPrefix(target, "#/components/"), "/")
+				if _, ok := components[section].(map[string]any)[name]; !ok {
+					t.Errorf("Unresolved reference %s", target)
+				}
+			}
+			for _, child := range v {
+				check(child)
+			}
+		case []any:
+			for _, child := range v {
+				check(child)
+			}
+		}
+	}
+	check(spec)
+
+	// Path parameters are declared by the endpoints using them
+	for _, e := range endpoints {
+		for _, part := range strings.Split(e.path, "{")[1:] {
+			name, _, _ := strings.Cut(part, "}")
+			if !slices.Contains(e.params, name) {
+				t.Errorf("%s does not declare path parameter %s", e.id, name)
+			}
+		}
+	}
+
+	tunnel := components["schemas"].(map[string]any)["tunnel"].(map[string]any)["properties"].(map[string]any)
+	if rate := tunnel["rate-limit"].(map[string]any); rate["type"] != "string" {
+		t.Errorf("Expected the 64-bit rate limit to be a string, got %v", rate)
+	}
+	if state := tunnel["state"].(map[string]any); state["$ref"] != "#/components/schemas/tunnel-state" {
+		t.Errorf("Expected the state to refer to its schema, got %v", state)
+	}
+
+	s := New("", nil)
+	w := request(t, s, http.MethodGet, "/restconf/openapi.json", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"operationId": "listTunnels"`) || strings.Contains(w.Body.String(), `"servers"`) {
+		t.Errorf("Expected the document without a server, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestRecordOperations(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	viper.Set("history.record_operations", true)
+	defer viper.Set("config_dir", "")
+	defer viper.Set("history.record_operations", false)
+	s := New("", nil)
+
+	request(t, s, http.MethodGet, "/restconf/data/ipsec-vpn:tunnels", "")
+	body := `{"ipsec-vpn:tunnel":[{"name":"new","remote-subnet":"bad"}]}`
+	if w := request(t, s, http.MethodPost, "/restconf/data/ipsec-vpn:tunnels", body); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected the tunnel to be rejected, got %d: %s", w.Code, w.Body)
+	}
+
+	ops, err := history.LoadOperations(filepath.Join(dir, "operations.jsonl"))
+	if err != nil {
+		t.Fatalf("LoadOperations failed: %v", err)
+	}
+	if len(ops) != 1 {
+		t.Fatalf("Expected only the POST to be recorded, got %+v", ops)
+	}
+	if op := ops[0]; op.Source != history.SourceRESTCONF || op.Body != body || op.ContentType != mediaType || op.Result != "400 Bad Request" {
+		t.Errorf("Unexpected operation %+v", op)
+	}
+}
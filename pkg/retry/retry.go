@@ -0,0 +1,166 @@
+// Package retry retries operations that fail for reasons that pass, such as
+// an IKE initiation timing out, netlink answering EBUSY or a DNS server not
+// answering, waiting exponentially longer between attempts, with jitter so
+// that many tunnels retrying at once spread out
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/spf13/viper"
+)
+
+// Operations retried with a policy of their own, configured under
+// retry.<operation>
+const (
+	IKE     = "ike"     // Initiating a tunnel's IKE or WireGuard handshake
+	Netlink = "netlink" // Netlink requests the kernel answers with EBUSY
+	DNS     = "dns"     // Resolving a peer's host name
+)
+
+// DefaultJitter is the fraction of each delay that is randomized
+const DefaultJitter = 0.2
+
+// Policy is how an operation is retried
+type Policy struct {
+	Operation string
+	Attempts  int           // Attempts in all, including the first; 1 fails fast
+	Initial   time.Duration // Delay before the first retry
+	Max       time.Duration // Cap on the delay, which doubles after each retry
+	Jitter    float64       // Fraction of each delay randomized, e.g. 0.2 for ±20%
+}
+
+// defaults are the policies without configuration
+var defaults = map[string]Policy{
+	IKE:     {Operation: IKE, Attempts: 5, Initial: time.Second, Max: 30 * time.Second, Jitter: DefaultJitter},
+	Netlink: {Operation: Netlink, Attempts: 5, Initial: 10 * time.Millisecond, Max: time.Second, Jitter: DefaultJitter},
+	DNS:     {Operation: DNS, Attempts: 3, Initial: 500 * time.Millisecond, Max: 5 * time.Second, Jitter: DefaultJitter},
+}
+
+// For returns the policy of an operation: the default, with the attempts and
+// delays in milliseconds set in retry.<operation>.attempts, initial_delay and
+// max_delay, and the jitter in retry.jitter
+func For(operation string) Policy {
+	p, ok := defaults[operation]
+	if !ok {
+		p = Policy{Operation: operation, Attempts: 1}
+	}
+	if n := viper.GetInt("retry." + operation + ".attempts"); n > 0 {
+		p.Attempts = n
+	}
+	if ms := viper.GetInt("retry." + operation + ".initial_delay"); ms > 0 {
+		p.Initial = time.Duration(ms) * time.Millisecond
+	}
+	if ms := viper.GetInt("retry." + operation + ".max_delay"); ms > 0 {
+		p.Max = time.Duration(ms) * time.Millisecond
+	}
+	p.Jitter = jitter()
+	return p
+}
+
+// jitter returns the fraction of each delay randomized, from retry.jitter
+func jitter() float64 {
+	if viper.IsSet("retry.jitter") {
+		return viper.GetFloat64("retry.jitter")
+	}
+	return DefaultJitter
+}
+
+// Backoff returns a policy spacing out attempts that are not bounded in
+// number, such as repairs of a tunnel that keeps failing, with the jitter in
+// retry.jitter
+func Backoff(initial, max time.Duration) Policy {
+	return Policy{Operation: "backoff", Attempts: 1, Initial: initial, Max: max, Jitter: jitter()}
+}
+
+// Do calls fn under the policy of an operation, see Policy.Do
+func Do(ctx context.Context, operation string, retryable func(error) bool, fn func() error) error {
+	return For(operation).Do(ctx, retryable, fn)
+}
+
+// Do calls fn until it succeeds, fails with an error retryable does not
+// accept, the attempts run out or ctx is done, and returns its last error
+func (p Policy) Do(ctx context.Context, retryable func(error) bool, fn func() error) error {
+	attempts := max(p.Attempts, 1)
+	for n := 0; ; n++ {
+		err := fn()
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if n+1 >= attempts {
+			if attempts > 1 {
+				return fmt.Errorf("%w (gave up after %d attempts)", err, attempts)
+			}
+			return err
+		}
+		delay := p.Backoff(n)
+		logger.Debug("Retrying %s in %v after attempt %d of %d failed: %v", p.Operation, delay.Round(time.Millisecond), n+1, attempts, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// Delay returns the delay before retry n, counting from 0, without jitter:
+// the initial delay doubled n times, up to the cap
+func (p Policy) Delay(n int) time.Duration {
+	delay := p.Initial
+	for range n {
+		if p.Max > 0 && delay >= p.Max {
+			break
+		}
+		delay *= 2
+	}
+	if p.Max > 0 {
+		return min(delay, p.Max)
+	}
+	return delay
+}
+
+// Backoff returns the delay before retry n, counting from 0, with jitter
+func (p Policy) Backoff(n int) time.Duration {
+	return p.jittered(p.Delay(n))
+}
+
+// jittered moves a delay by up to the policy's jitter either way
+func (p Policy) jittered(delay time.Duration) time.Duration {
+	if p.Jitter <= 0 || delay <= 0 {
+		return delay
+	}
+	spread := float64(delay) * min(p.Jitter, 1)
+	return time.Duration(float64(delay) - spread + rand.Float64()*2*spread)
+}
+
+// Busy reports whether a netlink request failed because the kernel was busy
+func Busy(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EAGAIN)
+}
+
+// Temporary reports whether an error is one that may pass: a timeout, a
+// peer or network that cannot be reached for now, a busy kernel or a DNS
+// server that failed to answer
+func Temporary(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() ||
+		errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		Busy(err)
+}
@@ -0,0 +1,105 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestDelay(t *testing.T) {
+	p := Policy{Initial: 100 * time.Millisecond, Max: time.Second}
+	for n, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if got := p.Delay(n); got != want {
+			t.Errorf("Expected delay %v before retry %d, got %v", want, n, got)
+		}
+	}
+
+	p.Jitter = 0.5
+	for range 100 {
+		if d := p.jittered(time.Second); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("Expected a jittered delay within 50%% of 1s, got %v", d)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	p := Policy{Operation: "test", Attempts: 4, Initial: time.Millisecond, Max: 2 * time.Millisecond}
+
+	calls := 0
+	err := p.Do(context.Background(), Busy, func() error {
+		if calls++; calls < 3 {
+			return syscall.EBUSY
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected success on the third attempt, got %v after %d", err, calls)
+	}
+
+	calls = 0
+	err = p.Do(context.Background(), Busy, func() error {
+		calls++
+		return syscall.EBUSY
+	})
+	if !errors.Is(err, syscall.EBUSY) || calls != 4 || !strings.Contains(err.Error(), "4 attempts") {
+		t.Errorf("Expected to give up after 4 attempts, got %v after %d", err, calls)
+	}
+
+	calls = 0
+	err = p.Do(context.Background(), Busy, func() error {
+		calls++
+		return syscall.EPERM
+	})
+	if !errors.Is(err, syscall.EPERM) || calls != 1 {
+		t.Errorf("Expected a permanent error to fail fast, got %v after %d", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	p.Initial, p.Max = time.Hour, time.Hour
+	if err := p.Do(ctx, Busy, func() error { calls++; return syscall.EBUSY }); calls != 1 || !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("Expected a cancelled context to stop retrying, got %v after %d", err, calls)
+	}
+}
+
+func TestFor(t *testing.T) {
+	if p := For(Netlink); p.Attempts != 5 || p.Initial != 10*time.Millisecond || p.Max != time.Second {
+		t.Errorf("Unexpected default policy %+v", p)
+	}
+	viper.Set("retry.dns.attempts", 1)
+	viper.Set("retry.dns.max_delay", 250)
+	viper.Set("retry.jitter", 0)
+	defer func() {
+		viper.Set("retry.dns.attempts", nil)
+		viper.Set("retry.dns.max_delay", nil)
+		viper.Set("retry.jitter", nil)
+	}()
+	if p := For(DNS); p.Attempts != 1 || p.Initial != 500*time.Millisecond || p.Max != 250*time.Millisecond || p.Jitter != 0 {
+		t.Errorf("Expected the configured policy, got %+v", p)
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{&net.DNSError{Err: "server misbehaving", IsTemporary: true}, true},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{syscall.ECONNREFUSED, true},
+		{syscall.EBUSY, true},
+		{syscall.EPERM, false},
+		{errors.New("invalid"), false},
+	} {
+		if got := Temporary(c.err); got != c.want {
+			t.Errorf("Expected Temporary(%v) to be %v, got %v", c.err, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Package secret resolves references to secrets, such as the pre-shared key
+// of a tunnel, so that tunnel configurations and apply files name where a
+// secret is kept instead of holding it and can be committed to git
+package secret
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/agent"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/vault"
+)
+
+// Reference schemes
+const (
+	SchemeVault = "vault" // vault://path[#field], a field of a secret in vault.kv_mount
+	SchemeEnv   = "env"   // env://NAME, an environment variable
+	SchemeFile  = "file"  // file:///path, a file
+	SchemeKey   = "key"   // key://NAME, a stored pre-shared key the key of a tunnel is derived from
+)
+
+// resolveTimeout bounds resolving a reference, such as reading it from Vault
+const resolveTimeout = 30 * time.Second
+
+// Parse splits a reference into its scheme and the location of the secret
+func Parse(ref string) (scheme, location string, err error) {
+	scheme, location, ok := strings.Cut(ref, "://")
+	if !ok {
+		return "", "", fmt.Errorf("invalid secret reference %q, expected vault://path, env://NAME, file:///path or key://NAME", ref)
+	}
+	switch scheme {
+	case SchemeVault, SchemeEnv:
+		if location == "" {
+			return "", "", fmt.Errorf("secret reference %q names no secret", ref)
+		}
+	case SchemeFile:
+		if !strings.HasPrefix(location, "/") {
+			return "", "", fmt.Errorf("secret reference %q must give an absolute path, as in file:///run/secrets/psk", ref)
+		}
+	case SchemeKey:
+		if !keys.ValidName(location) {
+			return "", "", fmt.Errorf("secret reference %q does not name a stored key", ref)
+		}
+	default:
+		return "", "", fmt.Errorf("unknown scheme of secret reference %q, expected vault, env, file or key", ref)
+	}
+	return scheme, location, nil
+}
+
+// ResolvePSK returns the pre-shared key a reference points to. Environment
+// variables and files hold the key in base64, like the field of a Vault
+// secret, which defaults to psk. A stored key is not used as it is: the key is
+// derived from it, by the key agent if one holds it.
+func ResolvePSK(ctx context.Context, ref string) ([]byte, error) {
+	scheme, location, err := Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	var encoded string
+	switch scheme {
+	case SchemeVault:
+		client, err := vault.FromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return client.ReadPSK(ctx, location)
+	case SchemeKey:
+		return agent.TunnelPSK(location)
+	case SchemeEnv:
+		value, ok := os.LookupEnv(location)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", location)
+		}
+		encoded = value
+	case SchemeFile:
+		data, err := os.ReadFile(location)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+
+	psk, err := vault.DecodeKey(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ref, err)
+	}
+	if len(psk) < vault.MinPSKSize {
+		return nil, fmt.Errorf("pre-shared key in %s is %d bytes, expected at least %d", ref, len(psk), vault.MinPSKSize)
+	}
+	return psk, nil
+}
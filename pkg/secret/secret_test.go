@@ -0,0 +1,83 @@
+package secret
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/spf13/viper"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		ref, scheme, location string
+	}{
+		{"vault://branches/paris", SchemeVault, "branches/paris"},
+		{"vault://branches/paris#key", SchemeVault, "branches/paris#key"},
+		{"env://BRANCH_PSK", SchemeEnv, "BRANCH_PSK"},
+		{"file:///run/secrets/psk", SchemeFile, "/run/secrets/psk"},
+	}
+	for _, tt := range tests {
+		scheme, location, err := Parse(tt.ref)
+		if err != nil || scheme != tt.scheme || location != tt.location {
+			t.Errorf("Expected %s to be %s %s, got %s %s: %v", tt.ref, tt.scheme, tt.location, scheme, location, err)
+		}
+	}
+	for _, ref := range []string{"s3cr3t", "env://", "file://run/secrets/psk", "https://example.com/psk"} {
+		if _, _, err := Parse(ref); err == nil {
+			t.Errorf("Expected %q to be rejected", ref)
+		}
+	}
+}
+
+func TestResolvePSK(t *testing.T) {
+	psk := bytes.Repeat([]byte{7}, 32)
+	encoded := base64.StdEncoding.EncodeToString(psk)
+
+	t.Setenv("BRANCH_PSK", encoded)
+	if got, err := ResolvePSK(context.Background(), "env://BRANCH_PSK"); err != nil || !bytes.Equal(got, psk) {
+		t.Errorf("Expected the key from the environment, got %x: %v", got, err)
+	}
+	if _, err := ResolvePSK(context.Background(), "env://MISSING_PSK"); err == nil {
+		t.Error("Expected an unset variable to be an error")
+	}
+
+	path := filepath.Join(t.TempDir(), "psk")
+	if err := os.WriteFile(path, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ResolvePSK(context.Background(), "file://"+path); err != nil || !bytes.Equal(got, psk) {
+		t.Errorf("Expected the key from the file, got %x: %v", got, err)
+	}
+
+	t.Setenv("SHORT_PSK", base64.StdEncoding.EncodeToString([]byte("short")))
+	if _, err := ResolvePSK(context.Background(), "env://SHORT_PSK"); err == nil {
+		t.Error("Expected a short key to be rejected")
+	}
+}
+
+func TestResolveStoredKey(t *testing.T) {
+	viper.Set("config_dir", filepath.Join(t.TempDir(), "config"))
+	defer viper.Set("config_dir", "")
+	if _, err := keys.Generate("office", keys.TypePSK, "", 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := keys.TunnelPSK("office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ResolvePSK(context.Background(), "key://office"); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("Expected the key derived from the stored one, got %x: %v", got, err)
+	}
+	if _, err := ResolvePSK(context.Background(), "key://missing"); err == nil {
+		t.Error("Expected a missing key to be an error")
+	}
+	if _, _, err := Parse("key://../office"); err == nil {
+		t.Error("Expected an invalid key name to be rejected")
+	}
+}
@@ -0,0 +1,67 @@
+package spiffe
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	validTrustDomain = regexp.MustCompile(`^[a-z0-9._-]+$`)
+	validPathSegment = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// ID is a SPIFFE ID, spiffe://<trust domain>/<path>
+type ID struct {
+	TrustDomain string
+	Path        string // Empty, or starting with a slash
+}
+
+// ParseID parses a SPIFFE ID. A bare trust domain such as spiffe://example.org
+// is accepted; it identifies the trust domain itself.
+func ParseID(s string) (ID, error) {
+	rest, ok := strings.CutPrefix(s, "spiffe://")
+	if !ok {
+		return ID{}, fmt.Errorf("invalid SPIFFE ID %q: must start with spiffe://", s)
+	}
+	trustDomain, path, _ := strings.Cut(rest, "/")
+	if !validTrustDomain.MatchString(trustDomain) {
+		return ID{}, fmt.Errorf("invalid SPIFFE ID %q: trust domain must be lowercase letters, digits, dots, dashes and underscores", s)
+	}
+	if path == "" {
+		if strings.HasSuffix(rest, "/") {
+			return ID{}, fmt.Errorf("invalid SPIFFE ID %q: trailing slash", s)
+		}
+		return ID{TrustDomain: trustDomain}, nil
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if !validPathSegment.MatchString(segment) || segment == "." || segment == ".." {
+			return ID{}, fmt.Errorf("invalid SPIFFE ID %q: bad path segment %q", s, segment)
+		}
+	}
+	return ID{TrustDomain: trustDomain, Path: "/" + path}, nil
+}
+
+// idFromURI returns the SPIFFE ID in a certificate URI SAN
+func idFromURI(u *url.URL) (ID, error) {
+	return ParseID(u.String())
+}
+
+func (id ID) String() string {
+	return "spiffe://" + id.TrustDomain + id.Path
+}
+
+// IsZero reports whether the ID is unset
+func (id ID) IsZero() bool {
+	return id.TrustDomain == ""
+}
+
+// Matches reports whether the ID is allowed by a pattern: either the same ID, or
+// a bare trust domain, which allows every workload in it
+func (id ID) Matches(pattern ID) bool {
+	if pattern.Path == "" {
+		return id.TrustDomain == pattern.TrustDomain
+	}
+	return id == pattern
+}
@@ -0,0 +1,202 @@
+package spiffe
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for SPIFFE IDs
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns the DER certificate and PKCS#8 key of an SVID
+func (ca *testCA) issue(t *testing.T, id string, serial int64) ([]byte, []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	uri, _ := url.Parse(id)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	return der, pkcs8
+}
+
+// field encodes a length-delimited protobuf field
+func field(num int, value []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(num)<<3|2)
+	out = binary.AppendUvarint(out, uint64(len(value)))
+	return append(out, value...)
+}
+
+func x509Response(id string, certificate, key, bundle []byte) []byte {
+	var svid []byte
+	svid = append(svid, field(1, []byte(id))...)
+	svid = append(svid, field(2, certificate)...)
+	svid = append(svid, field(3, key)...)
+	svid = append(svid, field(4, bundle)...)
+	return field(1, svid)
+}
+
+// serveWorkloadAPI runs a fake Workload API that streams the given responses
+func serveWorkloadAPI(t *testing.T, responses ...[]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "api.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{
+		Protocols: &protocols,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/SpiffeWorkloadAPI/FetchX509SVID" || r.Header.Get("workload.spiffe.io") != "true" {
+				w.Header().Set("grpc-status", "3")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.Header().Set("Content-Type", "application/grpc")
+			for _, response := range responses {
+				prefix := make([]byte, 5)
+				binary.BigEndian.PutUint32(prefix[1:], uint32(len(response)))
+				w.Write(append(prefix, response...))
+				w.(http.Flusher).Flush()
+			}
+			w.Header().Set(http.TrailerPrefix+"grpc-status", "0")
+		}),
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return "unix://" + path
+}
+
+func TestParseID(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want ID
+		ok   bool
+	}{
+		{"spiffe://example.org/ns/prod/sa/gateway", ID{"example.org", "/ns/prod/sa/gateway"}, true},
+		{"spiffe://example.org", ID{"example.org", ""}, true},
+		{"spiffe://Example.org/a", ID{}, false},
+		{"spiffe://example.org/", ID{}, false},
+		{"spiffe://example.org/a//b", ID{}, false},
+		{"spiffe://example.org/a/../b", ID{}, false},
+		{"https://example.org/a", ID{}, false},
+	} {
+		got, err := ParseID(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("ParseID(%q) = %+v, %v", tc.in, got, err)
+		}
+	}
+}
+
+func TestFetchX509Context(t *testing.T) {
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "spiffe://example.org/gateway", 2)
+	rotated, rotatedKey := ca.issue(t, "spiffe://example.org/gateway", 3)
+	addr := serveWorkloadAPI(t,
+		x509Response("spiffe://example.org/gateway", cert, key, ca.cert.Raw),
+		x509Response("spiffe://example.org/gateway", rotated, rotatedKey, ca.cert.Raw))
+
+	client, err := NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	x509Context, err := client.FetchX509Context(ctx)
+	if err != nil {
+		t.Fatalf("FetchX509Context failed: %v", err)
+	}
+	svid := x509Context.DefaultSVID()
+	if svid.ID.String() != "spiffe://example.org/gateway" || svid.Certificates[0].SerialNumber.Int64() != 2 {
+		t.Errorf("Unexpected SVID %s with serial %v", svid.ID, svid.Certificates[0].SerialNumber)
+	}
+	if len(x509Context.Bundles["example.org"]) != 1 {
+		t.Errorf("Expected the example.org bundle, got %v", x509Context.Bundles)
+	}
+
+	// Rotations arrive as further messages on the same stream
+	var serials []int64
+	err = client.WatchX509Context(ctx, func(x509Context *X509Context) {
+		serials = append(serials, x509Context.DefaultSVID().Certificates[0].SerialNumber.Int64())
+		if len(serials) == 2 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) || len(serials) != 2 || serials[1] != 3 {
+		t.Errorf("Expected the rotated SVID, got serials %v and %v", serials, err)
+	}
+}
+
+func TestVerifyPeer(t *testing.T) {
+	ca := newTestCA(t)
+	der, _ := ca.issue(t, "spiffe://example.org/branch/berlin", 2)
+	leaf, _ := x509.ParseCertificate(der)
+	bundles := map[string][]*x509.Certificate{"example.org": {ca.cert}}
+	chain := []*x509.Certificate{leaf}
+
+	for _, allowed := range []string{"spiffe://example.org/branch/berlin", "spiffe://example.org"} {
+		pattern, _ := ParseID(allowed)
+		if _, err := VerifyPeer(chain, bundles, pattern); err != nil {
+			t.Errorf("Expected %s to be allowed, got %v", allowed, err)
+		}
+	}
+
+	other, _ := ParseID("spiffe://example.org/branch/paris")
+	if _, err := VerifyPeer(chain, bundles, other); !errors.Is(err, ErrPeerNotAllowed) {
+		t.Errorf("Expected ErrPeerNotAllowed, got %v", err)
+	}
+
+	untrusted := map[string][]*x509.Certificate{"example.org": {newTestCA(t).cert}}
+	if _, err := VerifyPeer(chain, untrusted, other); err == nil || errors.Is(err, ErrPeerNotAllowed) {
+		t.Errorf("Expected a verification error, got %v", err)
+	}
+}
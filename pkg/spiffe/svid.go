@@ -0,0 +1,131 @@
+package spiffe
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPeerNotAllowed is returned when a peer's SVID is valid but carries an ID the
+// tunnel does not accept
+var ErrPeerNotAllowed = errors.New("peer SPIFFE ID not allowed")
+
+// SVID is an X.509 SPIFFE Verifiable Identity Document: a certificate chain whose
+// leaf carries the workload's SPIFFE ID, and the matching private key
+type SVID struct {
+	ID           ID
+	Certificates []*x509.Certificate // Leaf first
+	PrivateKey   crypto.Signer
+	Hint         string // Set by the agent to tell SVIDs of one workload apart
+}
+
+// ExpiresAt returns when the leaf certificate expires
+func (s *SVID) ExpiresAt() time.Time {
+	return s.Certificates[0].NotAfter
+}
+
+// X509Context is everything the Workload API returns in one update: the
+// workload's SVIDs, the first being the default, and the CA certificates of its
+// own and federated trust domains, by trust domain
+type X509Context struct {
+	SVIDs   []*SVID
+	Bundles map[string][]*x509.Certificate
+}
+
+// DefaultSVID returns the SVID the workload should present
+func (c *X509Context) DefaultSVID() *SVID {
+	return c.SVIDs[0]
+}
+
+// parseSVID builds an SVID from the DER certificates and PKCS#8 key the Workload
+// API sends
+func parseSVID(id string, certificates, key []byte, hint string) (*SVID, error) {
+	parsedID, err := ParseID(id)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := x509.ParseCertificates(certificates)
+	if err != nil {
+		return nil, fmt.Errorf("SVID %s: %v", id, err)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("SVID %s has no certificates", id)
+	}
+	leafID, err := LeafID(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("SVID %s: %v", id, err)
+	}
+	if leafID != parsedID {
+		return nil, fmt.Errorf("SVID %s: certificate is for %s", id, leafID)
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("SVID %s: private key: %v", id, err)
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("SVID %s: unsupported private key type %T", id, privateKey)
+	}
+	return &SVID{ID: parsedID, Certificates: chain, PrivateKey: signer, Hint: hint}, nil
+}
+
+// LeafID returns the SPIFFE ID of an X.509-SVID leaf certificate, which must be
+// its only URI SAN
+func LeafID(leaf *x509.Certificate) (ID, error) {
+	if leaf.IsCA {
+		return ID{}, errors.New("leaf certificate is a CA")
+	}
+	if len(leaf.URIs) != 1 {
+		return ID{}, fmt.Errorf("certificate has %d URI SANs, an SVID has exactly one", len(leaf.URIs))
+	}
+	id, err := idFromURI(leaf.URIs[0])
+	if err != nil {
+		return ID{}, err
+	}
+	if id.Path == "" {
+		return ID{}, fmt.Errorf("certificate identifies trust domain %s rather than a workload", id)
+	}
+	return id, nil
+}
+
+// VerifyPeer verifies the X.509-SVID chain a peer presented, leaf first, against
+// the CA bundle of the peer's trust domain, and checks its SPIFFE ID against the
+// allowed ID or trust domain
+func VerifyPeer(chain []*x509.Certificate, bundles map[string][]*x509.Certificate, allowed ID) (ID, error) {
+	if len(chain) == 0 {
+		return ID{}, errors.New("peer presented no certificate")
+	}
+	id, err := LeafID(chain[0])
+	if err != nil {
+		return ID{}, err
+	}
+	bundle, ok := bundles[id.TrustDomain]
+	if !ok {
+		return id, fmt.Errorf("no trust bundle for trust domain %s", id.TrustDomain)
+	}
+
+	roots := x509.NewCertPool()
+	for _, cert := range bundle {
+		roots.AddCert(cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	// SVIDs carry no DNS names or key usages the verifier would check
+	if _, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return id, fmt.Errorf("peer SVID %s: %v", id, err)
+	}
+
+	if !id.Matches(allowed) {
+		return id, fmt.Errorf("%w: %s, expected %s", ErrPeerNotAllowed, id, allowed)
+	}
+	return id, nil
+}
@@ -0,0 +1,381 @@
+package spiffe
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/spf13/viper"
+)
+
+// SocketEnv is the standard environment variable holding the Workload API address
+const SocketEnv = "SPIFFE_ENDPOINT_SOCKET"
+
+// DefaultSocket is the Workload API address of a SPIRE agent with default settings
+const DefaultSocket = "unix:///tmp/spire-agent/public/api.sock"
+
+// maxMessageSize caps a single Workload API response
+const maxMessageSize = 4 << 20
+
+// Retry intervals for reconnecting to the Workload API
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// gRPC status code the Workload API returns while the workload has no identity yet
+const codePermissionDenied = 7
+
+// SocketAddress returns the Workload API address
+func SocketAddress() string {
+	if addr := os.Getenv(SocketEnv); addr != "" {
+		return addr
+	}
+	if addr := viper.GetString("spiffe.socket"); addr != "" {
+		return addr
+	}
+	return DefaultSocket
+}
+
+// ParseAddress splits a Workload API address, unix:///path or tcp://ip:port, into
+// a network and address for net.Dial. A plain path is taken as a Unix socket.
+func ParseAddress(addr string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return "unix", strings.TrimPrefix(addr, "unix://"), nil
+	case strings.HasPrefix(addr, "unix:"):
+		return "unix", strings.TrimPrefix(addr, "unix:"), nil
+	case strings.HasPrefix(addr, "tcp://"):
+		hostPort := strings.TrimPrefix(addr, "tcp://")
+		host, _, err := net.SplitHostPort(hostPort)
+		if err != nil || net.ParseIP(host) == nil {
+			return "", "", fmt.Errorf("invalid Workload API address %q: tcp addresses must be tcp://<ip>:<port>", addr)
+		}
+		return "tcp", hostPort, nil
+	case strings.HasPrefix(addr, "/"):
+		return "unix", addr, nil
+	}
+	return "", "", fmt.Errorf("invalid Workload API address %q, expected unix:///path or tcp://ip:port", addr)
+}
+
+// StatusError is a gRPC error status returned by the Workload API
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("workload API error %d: %s", e.Code, e.Message)
+}
+
+// Client talks to the SPIFFE Workload API of a local agent such as SPIRE. The API
+// is gRPC, which is HTTP/2 with length-prefixed protobuf messages; only the X.509
+// SVID stream is implemented.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient creates a client for a Workload API address
+func NewClient(addr string) (*Client, error) {
+	network, address, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The API is served over cleartext HTTP/2 on the socket
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{
+		Protocols: &protocols,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport}}, nil
+}
+
+// Close closes idle connections to the agent
+func (c *Client) Close() {
+	c.http.CloseIdleConnections()
+}
+
+// FetchX509Context returns the workload's current SVIDs and trust bundles
+func (c *Client) FetchX509Context(ctx context.Context) (*X509Context, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var result *X509Context
+	err := c.streamX509(ctx, func(x509Context *X509Context) bool {
+		result = x509Context
+		return false
+	})
+	if result != nil {
+		return result, nil
+	}
+	if err == nil {
+		err = errors.New("workload API closed the stream without an SVID")
+	}
+	return nil, err
+}
+
+// WatchX509Context calls update with the workload's SVIDs and bundles, and again
+// each time the agent rotates them, until the context is cancelled. Lost
+// connections are retried with backoff.
+func (c *Client) WatchX509Context(ctx context.Context, update func(*X509Context)) error {
+	backoff := minBackoff
+	for {
+		err := c.streamX509(ctx, func(x509Context *X509Context) bool {
+			backoff = minBackoff
+			update(x509Context)
+			return true
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var status *StatusError
+		if errors.As(err, &status) && status.Code == codePermissionDenied {
+			logger.Debug("Workload API has no identity for this workload yet, retrying in %v", backoff)
+		} else {
+			logger.Error("Lost connection to the workload API, retrying in %v: %v", backoff, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// streamX509 calls FetchX509SVID and passes each response to handle until it
+// returns false or the stream ends
+func (c *Client) streamX509(ctx context.Context, handle func(*X509Context) bool) error {
+	// An X509SVIDRequest has no fields, so the request is an empty message
+	frame := make([]byte, 5)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/SpiffeWorkloadAPI/FetchX509SVID", bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("workload.spiffe.io", "true") // Required by the API to tell workloads from browsers
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		// The URL is a placeholder, so leave it out of the error
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("workload API returned HTTP %s", resp.Status)
+	}
+	// Errors without any messages come in the headers
+	if err := grpcStatus(resp.Header); err != nil {
+		return err
+	}
+
+	for {
+		message, err := readMessage(resp.Body)
+		if err == io.EOF {
+			if err := grpcStatus(resp.Trailer); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		x509Context, err := parseX509Response(message)
+		if err != nil {
+			return err
+		}
+		if !handle(x509Context) {
+			return nil
+		}
+	}
+}
+
+// grpcStatus returns the error in a grpc-status header, if any
+func grpcStatus(header http.Header) error {
+	code := header.Get("grpc-status")
+	if code == "" || code == "0" {
+		return nil
+	}
+	var n int
+	if _, err := fmt.Sscan(code, &n); err != nil {
+		return fmt.Errorf("invalid grpc-status %q", code)
+	}
+	return &StatusError{Code: n, Message: header.Get("grpc-message")}
+}
+
+// readMessage reads one length-prefixed gRPC message
+func readMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated workload API message")
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed workload API messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("workload API message of %d bytes exceeds %d", size, maxMessageSize)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, errors.New("truncated workload API message")
+	}
+	return message, nil
+}
+
+// parseX509Response decodes an X509SVIDResponse:
+//
+//	message X509SVIDResponse {
+//	    repeated X509SVID svids = 1;
+//	    repeated bytes crl = 2;
+//	    map<string, bytes> federated_bundles = 3;
+//	}
+//	message X509SVID {
+//	    string spiffe_id = 1;
+//	    bytes x509_svid = 2;     // DER certificates, leaf first
+//	    bytes x509_svid_key = 3; // PKCS#8 DER
+//	    bytes bundle = 4;        // DER CA certificates of the SVID's trust domain
+//	    string hint = 5;
+//	}
+func parseX509Response(message []byte) (*X509Context, error) {
+	x509Context := &X509Context{Bundles: make(map[string][]*x509.Certificate)}
+	err := eachField(message, func(num int, value []byte) error {
+		switch num {
+		case 1:
+			var id, hint string
+			var certificates, key, bundle []byte
+			if err := eachField(value, func(num int, value []byte) error {
+				switch num {
+				case 1:
+					id = string(value)
+				case 2:
+					certificates = value
+				case 3:
+					key = value
+				case 4:
+					bundle = value
+				case 5:
+					hint = string(value)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			svid, err := parseSVID(id, certificates, key, hint)
+			if err != nil {
+				return err
+			}
+			cas, err := x509.ParseCertificates(bundle)
+			if err != nil {
+				return fmt.Errorf("bundle of %s: %v", svid.ID.TrustDomain, err)
+			}
+			x509Context.SVIDs = append(x509Context.SVIDs, svid)
+			x509Context.Bundles[svid.ID.TrustDomain] = cas
+		case 3:
+			var trustDomain string
+			var bundle []byte
+			if err := eachField(value, func(num int, value []byte) error {
+				switch num {
+				case 1:
+					trustDomain = string(value)
+				case 2:
+					bundle = value
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			// Keys are trust domain IDs such as spiffe://example.org
+			id, err := ParseID(trustDomain)
+			if err != nil {
+				return fmt.Errorf("federated bundle: %v", err)
+			}
+			cas, err := x509.ParseCertificates(bundle)
+			if err != nil {
+				return fmt.Errorf("federated bundle of %s: %v", id.TrustDomain, err)
+			}
+			if _, ok := x509Context.Bundles[id.TrustDomain]; !ok {
+				x509Context.Bundles[id.TrustDomain] = cas
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid workload API response: %v", err)
+	}
+	if len(x509Context.SVIDs) == 0 {
+		return nil, errors.New("workload API response has no SVID")
+	}
+	return x509Context, nil
+}
+
+// eachField calls fn with the number and value of each length-delimited field of
+// a protobuf message, which is every field type the Workload API messages use.
+// Fields of other wire types are skipped.
+func eachField(message []byte, fn func(num int, value []byte) error) error {
+	for len(message) > 0 {
+		tag, n := binary.Uvarint(message)
+		if n <= 0 {
+			return errors.New("invalid field tag")
+		}
+		message = message[n:]
+
+		num := int(tag >> 3)
+		switch tag & 7 {
+		case 0: // Varint
+			if _, n = binary.Uvarint(message); n <= 0 {
+				return errors.New("invalid varint")
+			}
+			message = message[n:]
+		case 1: // 64-bit
+			if len(message) < 8 {
+				return errors.New("truncated field")
+			}
+			message = message[8:]
+		case 2: // Length-delimited
+			size, n := binary.Uvarint(message)
+			if n <= 0 || size > uint64(len(message)-n) {
+				return errors.New("truncated field")
+			}
+			value := message[n : n+int(size)]
+			message = message[n+int(size):]
+			if err := fn(num, value); err != nil {
+				return err
+			}
+		case 5: // 32-bit
+			if len(message) < 4 {
+				return errors.New("truncated field")
+			}
+			message = message[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", tag&7)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Methods of unlocking a sealed store
+const (
+	MethodPassphrase = "passphrase"
+	MethodKeyfile    = "keyfile"
+	MethodCredential = "credential" // An encrypted systemd credential
+	MethodTPM        = "tpm"        // Key material sealed by the TPM through systemd-creds
+)
+
+// Methods lists the methods of unlocking a sealed store
+var Methods = []string{MethodPassphrase, MethodKeyfile, MethodCredential, MethodTPM}
+
+// scrypt parameters for passphrases, as recommended for interactive logins
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// minKeyfileSize is the least key material accepted from a keyfile
+const minKeyfileSize = 16
+
+// CredentialStore is where systemd looks up the encrypted credentials named in
+// LoadCredentialEncrypted=
+const CredentialStore = "/etc/credstore.encrypted"
+
+// tpmCredential names the key material sealed by the TPM, which systemd-creds
+// binds it to
+const tpmCredential = "ipsec-vpn-store"
+
+// keyInfo is the HKDF info string key encryption keys are derived with
+var keyInfo = []byte("ipsec-vpn store key")
+
+// KeySource provides the key encryption key of a sealed store
+type KeySource interface {
+	Method() string
+	// seal creates the key encryption key of a new store, recording in the
+	// header what unseal needs to obtain it again
+	seal(h *header) ([]byte, error)
+	unseal(h *header) ([]byte, error)
+}
+
+// sourceFor returns the key source a store was sealed with, if it can be used
+// without asking for anything
+func sourceFor(h *header) (KeySource, error) {
+	switch h.Method {
+	case MethodKeyfile:
+		return Keyfile{Path: h.Keyfile}, nil
+	case MethodCredential:
+		return Credential{Name: h.Credential}, nil
+	case MethodTPM:
+		return TPM{}, nil
+	case MethodPassphrase:
+		return nil, errors.New("the store is sealed with a passphrase, which must be given")
+	}
+	return nil, fmt.Errorf("unknown unlock method %q", h.Method)
+}
+
+// Passphrase derives the key from a passphrase with scrypt
+type Passphrase struct {
+	Passphrase []byte
+}
+
+func (Passphrase) Method() string { return MethodPassphrase }
+
+func (p Passphrase) seal(h *header) ([]byte, error) {
+	return p.unseal(h)
+}
+
+func (p Passphrase) unseal(h *header) ([]byte, error) {
+	if len(p.Passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return scrypt.Key(p.Passphrase, h.Salt, scryptN, scryptR, scryptP, keySize)
+}
+
+// Keyfile derives the key from the contents of a file
+type Keyfile struct {
+	Path string
+}
+
+func (Keyfile) Method() string { return MethodKeyfile }
+
+func (k Keyfile) seal(h *header) ([]byte, error) {
+	path, err := filepath.Abs(k.Path)
+	if err != nil {
+		return nil, err
+	}
+	h.Keyfile = path
+	return k.unseal(h)
+}
+
+func (k Keyfile) unseal(h *header) ([]byte, error) {
+	material, err := os.ReadFile(k.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %v", err)
+	}
+	defer crypto.Zeroize(material)
+	return deriveKey(material, h.Salt)
+}
+
+// Credential derives the key from random key material kept as an encrypted
+// systemd credential in CredentialStore. A unit with
+// LoadCredentialEncrypted=<name> is handed it decrypted in
+// $CREDENTIALS_DIRECTORY; elsewhere systemd-creds decrypts it, which needs root.
+type Credential struct {
+	Name string
+}
+
+func (Credential) Method() string { return MethodCredential }
+
+func (c Credential) seal(h *header) ([]byte, error) {
+	material, err := crypto.GenerateSecret(keySize)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.ReleaseSecret(material)
+	if err := os.MkdirAll(CredentialStore, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(CredentialStore, c.Name)
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("credential %s already exists", path)
+	}
+	if _, err := systemdCreds(material, "encrypt", "--name="+c.Name, "-", path); err != nil {
+		return nil, err
+	}
+	h.Credential = c.Name
+	return deriveKey(material, h.Salt)
+}
+
+func (c Credential) unseal(h *header) ([]byte, error) {
+	var material []byte
+	var err error
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		material, err = os.ReadFile(filepath.Join(dir, c.Name))
+	} else {
+		material, err = systemdCreds(nil, "decrypt", "--name="+c.Name, filepath.Join(CredentialStore, c.Name), "-")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential %s: %v", c.Name, err)
+	}
+	defer crypto.Zeroize(material)
+	return deriveKey(material, h.Salt)
+}
+
+// TPM derives the key from random key material sealed to the TPM by
+// systemd-creds and kept in the header, so the store only unlocks on this host
+type TPM struct{}
+
+func (TPM) Method() string { return MethodTPM }
+
+func (TPM) seal(h *header) ([]byte, error) {
+	material, err := crypto.GenerateSecret(keySize)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.ReleaseSecret(material)
+	if h.Sealed, err = systemdCreds(material, "encrypt", "--with-key=tpm2", "--name="+tpmCredential, "-", "-"); err != nil {
+		return nil, err
+	}
+	return deriveKey(material, h.Salt)
+}
+
+func (TPM) unseal(h *header) ([]byte, error) {
+	material, err := systemdCreds(h.Sealed, "decrypt", "--name="+tpmCredential, "-", "-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to unseal the key with the TPM: %v", err)
+	}
+	defer crypto.Zeroize(material)
+	return deriveKey(material, h.Salt)
+}
+
+// deriveKey derives a key encryption key from key material
+func deriveKey(material, salt []byte) ([]byte, error) {
+	if len(material) < minKeyfileSize {
+		return nil, fmt.Errorf("key material must be at least %d bytes, got %d", minKeyfileSize, len(material))
+	}
+	key := crypto.NewSecret(keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, material, salt, keyInfo), key); err != nil {
+		crypto.ReleaseSecret(key)
+		return nil, err
+	}
+	return key, nil
+}
+
+// systemdCreds runs systemd-creds with input on stdin and returns its output.
+// It is a variable so tests can do without systemd and a TPM.
+var systemdCreds = func(input []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("systemd-creds", args...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("systemd-creds %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("systemd-creds %s: %v", args[0], err)
+	}
+	return out, nil
+}
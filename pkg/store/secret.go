@@ -0,0 +1,83 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+)
+
+// Sealed is a single secret, such as a stored pre-shared or private key,
+// encrypted with a data key protected by a key source as a sealed store is. It
+// is bound to a context, such as the name of the key, so that it cannot be
+// moved to another one.
+type Sealed struct {
+	header
+	Ciphertext []byte `json:"ciphertext"` // Nonce followed by the encrypted secret
+}
+
+// SealSecret encrypts a secret bound to a context with a new data key
+// protected by the key source. Systemd credentials are kept one per store and
+// cannot seal secrets.
+func SealSecret(source KeySource, secret, context []byte) (*Sealed, error) {
+	if source.Method() == MethodCredential {
+		return nil, errors.New("secrets are sealed with a passphrase, keyfile or the TPM, not a systemd credential")
+	}
+	key, err := crypto.GenerateSecret(keySize)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.ReleaseSecret(key)
+
+	s := &Sealed{header: header{Method: source.Method()}}
+	if s.Salt, err = crypto.GenerateSecret(keySize); err != nil {
+		return nil, err
+	}
+	kek, err := source.seal(&s.header)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.ReleaseSecret(kek)
+	if s.WrappedKey, err = encrypt(kek, key, []byte(magic)); err != nil {
+		return nil, err
+	}
+	if s.Ciphertext, err = encrypt(key, secret, context); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Method returns the method the secret is unsealed with
+func (s *Sealed) Method() string {
+	return s.header.Method
+}
+
+// Open decrypts the secret with the key source it was sealed with, or without
+// one if it can be unsealed without asking for anything. The caller zeroizes
+// the secret.
+func (s *Sealed) Open(source KeySource, context []byte) ([]byte, error) {
+	var err error
+	if source == nil {
+		if source, err = sourceFor(&s.header); err != nil {
+			return nil, err
+		}
+	}
+	if source.Method() != s.header.Method {
+		return nil, fmt.Errorf("the secret was sealed with %s, not %s", s.header.Method, source.Method())
+	}
+	kek, err := source.unseal(&s.header)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.ReleaseSecret(kek)
+	key, err := decrypt(kek, s.WrappedKey, []byte(magic))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or key")
+	}
+	defer crypto.ReleaseSecret(key)
+	secret, err := decrypt(key, s.Ciphertext, context)
+	if err != nil {
+		return nil, errors.New("the sealed secret is corrupted or belongs to something else")
+	}
+	return secret, nil
+}
@@ -0,0 +1,508 @@
+// Package store keeps the configuration directory encrypted at rest. A sealed
+// store is a single file next to the directory, an AES-256-GCM encrypted
+// archive of it. Unlocking extracts it to a runtime directory, normally on
+// tmpfs, which is used as the configuration directory until the store is
+// locked again, so a stolen disk image exposes neither topology nor keys.
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/spf13/viper"
+)
+
+// magic identifies a sealed store
+const magic = "IPSECVPNSTORE1"
+
+// keySize is the size of the data and key encryption keys
+const keySize = 32
+
+// States of the store
+const (
+	StatePlain    = "plain"    // Not encrypted
+	StateLocked   = "locked"   // Sealed, and not unlocked
+	StateUnlocked = "unlocked" // Sealed, and extracted to the runtime directory
+)
+
+// configured is the configuration directory before Apply redirected it
+var configured string
+
+var (
+	// ErrLocked is returned when the store is sealed and has not been unlocked
+	ErrLocked = errors.New("the configuration store is locked, run 'ipsec-vpn store unlock'")
+	// ErrNotSealed is returned for operations on a store that is not encrypted
+	ErrNotSealed = errors.New("the configuration store is not sealed")
+)
+
+// header is the unencrypted part of a sealed store. It tells how to obtain the
+// key encryption key, and holds the data key wrapped with it.
+type header struct {
+	Method     string `json:"method"`
+	Salt       []byte `json:"salt"`
+	Keyfile    string `json:"keyfile,omitempty"`    // MethodKeyfile
+	Credential string `json:"credential,omitempty"` // MethodCredential
+	Sealed     []byte `json:"sealed,omitempty"`     // MethodTPM: the key material sealed by the TPM
+	WrappedKey []byte `json:"wrapped_key"`          // Nonce followed by the encrypted data key
+}
+
+// session is what an unlocked store keeps next to its runtime directory: the
+// data key, so changes can be written back without unlocking again, and the
+// state of the directory when it was last written
+type session struct {
+	Key    []byte `json:"key"`
+	Digest string `json:"digest"`
+}
+
+// Dir returns the configuration directory as configured, before it is
+// redirected to the runtime directory
+func Dir() (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	return paths.ConfigDir()
+}
+
+// SealedPath returns the file a sealed store is kept in
+func SealedPath() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Clean(dir) + ".sealed", nil
+}
+
+// RuntimeDir returns the directory an unlocked store is extracted to:
+// store.runtime_dir, or a directory under /run or $XDG_RUNTIME_DIR, which are
+// tmpfs and so never written to disk
+func RuntimeDir() string {
+	if dir := viper.GetString("store.runtime_dir"); dir != "" {
+		return dir
+	}
+	if xdg := os.Getenv("XDG_RUNTIME_DIR"); xdg != "" && os.Geteuid() != 0 {
+		return filepath.Join(xdg, "ipsec-vpn", "store")
+	}
+	return filepath.Join("/run", "ipsec-vpn", "store")
+}
+
+// sessionPath returns the file the session of an unlocked store is kept in
+func sessionPath() string {
+	return filepath.Clean(RuntimeDir()) + ".key"
+}
+
+// State returns whether the store is sealed and unlocked
+func State() (string, error) {
+	path, err := SealedPath()
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return StatePlain, nil
+	} else if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(sessionPath()); err == nil {
+		return StateUnlocked, nil
+	}
+	return StateLocked, nil
+}
+
+// Apply points config_dir at the runtime directory if the store is sealed, so
+// every package reads and writes the unlocked copy. A locked store is pointed
+// at too, so nothing is written to an unencrypted directory by mistake, and
+// ErrLocked is returned.
+func Apply() error {
+	state, err := State()
+	if err != nil || state == StatePlain {
+		return err
+	}
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	configured = dir
+	viper.Set("config_dir", RuntimeDir())
+	if state == StateLocked {
+		return ErrLocked
+	}
+	return nil
+}
+
+// Seal encrypts the configuration directory with a new data key protected by
+// the key source, and removes the unencrypted directory
+func Seal(source KeySource) error {
+	state, err := State()
+	if err != nil {
+		return err
+	}
+	if state != StatePlain {
+		return errors.New("the configuration store is already sealed")
+	}
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	key, err := crypto.GenerateSecret(keySize)
+	if err != nil {
+		return err
+	}
+	defer crypto.ReleaseSecret(key)
+	h := &header{Method: source.Method()}
+	if h.Salt, err = crypto.GenerateSecret(keySize); err != nil {
+		return err
+	}
+	kek, err := source.seal(h)
+	if err != nil {
+		return err
+	}
+	defer crypto.ReleaseSecret(kek)
+	if h.WrappedKey, err = encrypt(kek, key, []byte(magic)); err != nil {
+		return err
+	}
+
+	path, err := SealedPath()
+	if err != nil {
+		return err
+	}
+	if _, err := write(path, h, key, dir); err != nil {
+		return err
+	}
+	logger.Info("Sealed configuration store %s into %s with %s", dir, path, h.Method)
+	return os.RemoveAll(dir)
+}
+
+// Unlock decrypts a sealed store into the runtime directory
+func Unlock(source KeySource) error {
+	state, err := State()
+	if err != nil {
+		return err
+	}
+	switch state {
+	case StatePlain:
+		return ErrNotSealed
+	case StateUnlocked:
+		return nil
+	}
+
+	path, err := SealedPath()
+	if err != nil {
+		return err
+	}
+	h, prefix, ciphertext, err := readSealed(path)
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		if source, err = sourceFor(h); err != nil {
+			return err
+		}
+	}
+	if source.Method() != h.Method {
+		return fmt.Errorf("the store was sealed with %s, not %s", h.Method, source.Method())
+	}
+	kek, err := source.unseal(h)
+	if err != nil {
+		return err
+	}
+	defer crypto.ReleaseSecret(kek)
+	key, err := decrypt(kek, h.WrappedKey, []byte(magic))
+	if err != nil {
+		return errors.New("wrong passphrase or key")
+	}
+	defer crypto.ReleaseSecret(key)
+	archive, err := decrypt(key, ciphertext, prefix)
+	if err != nil {
+		return errors.New("the sealed store is corrupted")
+	}
+
+	runtimeDir := RuntimeDir()
+	if err := os.MkdirAll(filepath.Dir(runtimeDir), 0700); err != nil {
+		return err
+	}
+	_ = os.RemoveAll(runtimeDir)
+	if err := crypto.ExtractDir(archive, runtimeDir); err != nil {
+		_ = os.RemoveAll(runtimeDir)
+		return err
+	}
+	if err := os.Chmod(runtimeDir, 0700); err != nil {
+		return err
+	}
+	digest, err := dirDigest(runtimeDir)
+	if err != nil {
+		return err
+	}
+	if err := saveSession(&session{Key: key, Digest: digest}); err != nil {
+		_ = os.RemoveAll(runtimeDir)
+		return err
+	}
+	logger.Info("Unlocked configuration store %s into %s", path, runtimeDir)
+	return nil
+}
+
+// Sync writes the changes made to an unlocked store back to the sealed file. It
+// reports whether there were any.
+func Sync() (bool, error) {
+	state, err := State()
+	if err != nil || state != StateUnlocked {
+		return false, err
+	}
+	s, err := loadSession()
+	if err != nil {
+		return false, err
+	}
+	defer crypto.ReleaseSecret(s.Key)
+	runtimeDir := RuntimeDir()
+	digest, err := dirDigest(runtimeDir)
+	if err != nil {
+		return false, err
+	}
+	if digest == s.Digest {
+		return false, nil
+	}
+
+	path, err := SealedPath()
+	if err != nil {
+		return false, err
+	}
+	h, _, _, err := readSealed(path)
+	if err != nil {
+		return false, err
+	}
+	if s.Digest, err = write(path, h, s.Key, runtimeDir); err != nil {
+		return false, err
+	}
+	logger.Debug("Wrote configuration store changes to %s", path)
+	return true, saveSession(s)
+}
+
+// Lock writes back any changes and removes the runtime directory and data key
+func Lock() error {
+	state, err := State()
+	if err != nil {
+		return err
+	}
+	switch state {
+	case StatePlain:
+		return ErrNotSealed
+	case StateLocked:
+		return nil
+	}
+	if _, err := Sync(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(RuntimeDir()); err != nil {
+		return err
+	}
+	logger.Info("Locked configuration store")
+	return os.Remove(sessionPath())
+}
+
+// Unseal turns encryption off: an unlocked store is moved back to the
+// configuration directory and the sealed file removed
+func Unseal() error {
+	state, err := State()
+	if err != nil {
+		return err
+	}
+	switch state {
+	case StatePlain:
+		return ErrNotSealed
+	case StateLocked:
+		return ErrLocked
+	}
+	if _, err := Sync(); err != nil {
+		return err
+	}
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	archive, err := crypto.ArchiveDir(RuntimeDir())
+	if err != nil {
+		return err
+	}
+	if err := crypto.ExtractDir(archive, dir); err != nil {
+		return err
+	}
+	path, err := SealedPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	_ = os.RemoveAll(RuntimeDir())
+	logger.Info("Unsealed configuration store into %s", dir)
+	return os.Remove(sessionPath())
+}
+
+// write encrypts the archive of dir with the data key into the sealed file,
+// replacing it atomically, and returns the digest of the directory written
+func write(path string, h *header, key []byte, dir string) (string, error) {
+	digest, err := dirDigest(dir)
+	if err != nil {
+		return "", err
+	}
+	archive, err := crypto.ArchiveDir(dir)
+	if err != nil {
+		return "", err
+	}
+	defer crypto.Zeroize(archive)
+
+	headerJSON, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	prefix := append([]byte(magic), binary.BigEndian.AppendUint32(nil, uint32(len(headerJSON)))...)
+	prefix = append(prefix, headerJSON...)
+	// The header is authenticated along with the archive
+	ciphertext, err := encrypt(key, archive, prefix)
+	if err != nil {
+		return "", err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(prefix, ciphertext...), 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return digest, nil
+}
+
+// readSealed splits a sealed file into its header, the authenticated prefix
+// and the encrypted archive
+func readSealed(path string) (*header, []byte, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(data) < len(magic)+4 || string(data[:len(magic)]) != magic {
+		return nil, nil, nil, fmt.Errorf("%s is not a sealed configuration store", path)
+	}
+	size := int(binary.BigEndian.Uint32(data[len(magic):]))
+	end := len(magic) + 4 + size
+	if size > len(data) || end > len(data) {
+		return nil, nil, nil, fmt.Errorf("%s is truncated", path)
+	}
+	h := &header{}
+	if err := json.Unmarshal(data[len(magic)+4:end], h); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid header in %s: %v", path, err)
+	}
+	return h, data[:end], data[end:], nil
+}
+
+// encrypt seals plaintext with AES-256-GCM, prefixing the random nonce
+func encrypt(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := crypto.NewAEAD("aes256gcm", key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := crypto.GenerateSecret(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// decrypt opens a ciphertext produced by encrypt
+func decrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := crypto.NewAEAD("aes256gcm", key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], additionalData)
+}
+
+// dirDigest summarizes the names, sizes, modes and modification times of the
+// files in a directory, to tell cheaply whether anything changed
+func dirDigest(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		fmt.Fprintf(h, "%s\x00%d\x00%o\x00%d\n", rel, info.Size(), info.Mode(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadSession reads the session of an unlocked store
+func loadSession() (*session, error) {
+	data, err := os.ReadFile(sessionPath())
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Zeroize(data)
+	s := &session{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid store session: %v", err)
+	}
+	if len(s.Key) != keySize {
+		return nil, errors.New("invalid store session: bad key size")
+	}
+	return s, nil
+}
+
+// saveSession replaces the session of an unlocked store
+func saveSession(s *session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	defer crypto.Zeroize(data)
+	path := sessionPath()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Describe names how a sealed store is unlocked, e.g. "keyfile /etc/ipsec-vpn/store.key"
+func Describe() (string, error) {
+	path, err := SealedPath()
+	if err != nil {
+		return "", err
+	}
+	h, _, _, err := readSealed(path)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case h.Keyfile != "":
+		return h.Method + " " + h.Keyfile, nil
+	case h.Credential != "":
+		return h.Method + " " + h.Credential, nil
+	}
+	return h.Method, nil
+}
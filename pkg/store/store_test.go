@@ -0,0 +1,244 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/ca"
+	"github.com/dzakwan/ipsec-vpn/pkg/history"
+	"github.com/spf13/viper"
+)
+
+// setup creates a configuration directory holding a tunnel and points the store
+// at it, with the runtime directory elsewhere in a temporary directory
+func setup(t *testing.T) (dir string) {
+	t.Helper()
+	root := t.TempDir()
+	dir = filepath.Join(root, "config")
+	if err := os.MkdirAll(filepath.Join(dir, "tunnels"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tunnels", "office.json"), []byte(`{"name":"office"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("config_dir", dir)
+	viper.Set("store.runtime_dir", filepath.Join(root, "run", "store"))
+	t.Cleanup(func() {
+		viper.Set("config_dir", "")
+		viper.Set("store.runtime_dir", "")
+		configured = ""
+	})
+	return dir
+}
+
+func TestSealAndUnlock(t *testing.T) {
+	dir := setup(t)
+	if err := Seal(Passphrase{Passphrase: []byte("correct horse")}); err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("Expected the unencrypted directory to be removed")
+	}
+	sealed, err := os.ReadFile(dir + ".sealed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("office")) {
+		t.Error("Expected the sealed store not to contain the tunnel in the clear")
+	}
+
+	if err := Apply(); err != ErrLocked {
+		t.Fatalf("Expected a locked store, got %v", err)
+	}
+	if viper.GetString("config_dir") != RuntimeDir() {
+		t.Errorf("Expected config_dir to point at the runtime directory even while locked")
+	}
+	if err := Unlock(Passphrase{Passphrase: []byte("wrong horse")}); err == nil {
+		t.Fatal("Expected a wrong passphrase to be refused")
+	}
+	if err := Unlock(nil); err == nil {
+		t.Fatal("Expected a passphrase to be required")
+	}
+	if err := Unlock(Passphrase{Passphrase: []byte("correct horse")}); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if state, _ := State(); state != StateUnlocked {
+		t.Fatalf("Expected an unlocked store, got %s", state)
+	}
+	data, err := os.ReadFile(filepath.Join(RuntimeDir(), "tunnels", "office.json"))
+	if err != nil || string(data) != `{"name":"office"}` {
+		t.Fatalf("Expected the tunnel in the runtime directory, got %q: %v", data, err)
+	}
+
+	// Nothing changed, so nothing is written
+	if changed, err := Sync(); err != nil || changed {
+		t.Errorf("Expected no changes to write, got %v: %v", changed, err)
+	}
+	if err := os.WriteFile(filepath.Join(RuntimeDir(), "tunnels", "branch.json"), []byte(`{"name":"branch"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := Sync(); err != nil || !changed {
+		t.Fatalf("Expected the new tunnel to be written, got %v: %v", changed, err)
+	}
+
+	if err := Lock(); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if _, err := os.Stat(RuntimeDir()); !os.IsNotExist(err) {
+		t.Error("Expected the runtime directory to be removed")
+	}
+	if _, err := os.Stat(sessionPath()); !os.IsNotExist(err) {
+		t.Error("Expected the data key to be removed")
+	}
+	if err := Unlock(Passphrase{Passphrase: []byte("correct horse")}); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(RuntimeDir(), "tunnels", "branch.json")); err != nil {
+		t.Errorf("Expected the change to survive locking: %v", err)
+	}
+
+	if err := Unseal(); err != nil {
+		t.Fatalf("Unseal failed: %v", err)
+	}
+	if state, _ := State(); state != StatePlain {
+		t.Errorf("Expected a plain store, got %s", state)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tunnels", "branch.json")); err != nil {
+		t.Errorf("Expected the tunnels back in the configuration directory: %v", err)
+	}
+}
+
+func TestKeyfileAndTPM(t *testing.T) {
+	dir := setup(t)
+	keyfile := filepath.Join(t.TempDir(), "store.key")
+	if err := os.WriteFile(keyfile, []byte("0123456789abcdef0123456789abcdef"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Seal(Keyfile{Path: keyfile}); err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if err := Unlock(nil); err != nil {
+		t.Fatalf("Expected the keyfile recorded at sealing to unlock the store: %v", err)
+	}
+	if err := Unseal(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The TPM is stood in for by reversing the key material
+	orig := systemdCreds
+	defer func() { systemdCreds = orig }()
+	systemdCreds = func(input []byte, args ...string) ([]byte, error) {
+		out := slices.Clone(input)
+		slices.Reverse(out)
+		return out, nil
+	}
+	if err := Seal(TPM{}); err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if method, _ := Describe(); method != MethodTPM {
+		t.Errorf("Expected the store to be sealed with the TPM, got %s", method)
+	}
+	if err := Unlock(nil); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(RuntimeDir(), "tunnels", "office.json")); err != nil {
+		t.Errorf("Expected the tunnel in the runtime directory: %v", err)
+	}
+	if err := Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tampering is detected
+	data, err := os.ReadFile(dir + ".sealed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := os.WriteFile(dir+".sealed", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unlock(nil); err == nil {
+		t.Error("Expected a corrupted store to be refused")
+	}
+}
+
+func TestSealCoversAllState(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	viper.Set("store.runtime_dir", filepath.Join(t.TempDir(), "store"))
+	t.Cleanup(func() {
+		viper.Set("config_dir", "")
+		viper.Set("store.runtime_dir", "")
+		configured = ""
+	})
+
+	// Under sudo, the CA and history are kept in the invoking user's directory
+	// with the tunnels, not in the target user's
+	if current, err := user.Current(); err == nil {
+		t.Setenv("SUDO_USER", current.Username)
+		dir, _ := Dir()
+		caDir, _ := ca.Dir()
+		historyPath, _ := history.Path()
+		if dir != filepath.Join(current.HomeDir, ".ipsec-vpn") || filepath.Dir(caDir) != dir || filepath.Dir(historyPath) != dir {
+			t.Errorf("Expected the CA %s and history %s in %s", caDir, historyPath, dir)
+		}
+		os.Unsetenv("SUDO_USER")
+	}
+
+	if _, err := ca.Init("hub CA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := history.Record(history.Entry{User: "alice", Command: "tunnel delete office"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Seal(Passphrase{Passphrase: []byte("correct horse")}); err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	err := filepath.WalkDir(home, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(data, []byte("PRIVATE KEY")) || bytes.Contains(data, []byte("tunnel delete")) {
+			t.Errorf("Expected %s to be sealed, found it in the clear", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealSecret(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	source := Passphrase{Passphrase: []byte("correct horse")}
+	sealed, err := SealSecret(source, secret, []byte("office"))
+	if err != nil {
+		t.Fatalf("SealSecret failed: %v", err)
+	}
+	if bytes.Contains(sealed.Ciphertext, secret) || sealed.Method() != MethodPassphrase {
+		t.Fatalf("Unexpected sealed secret %+v", sealed)
+	}
+	if got, err := sealed.Open(source, []byte("office")); err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("Expected the secret back, got %q: %v", got, err)
+	}
+	if _, err := sealed.Open(nil, []byte("office")); err == nil {
+		t.Error("Expected a passphrase to be needed")
+	}
+	if _, err := sealed.Open(Passphrase{Passphrase: []byte("wrong")}, []byte("office")); err == nil {
+		t.Error("Expected a wrong passphrase to fail")
+	}
+	if _, err := sealed.Open(source, []byte("branch")); err == nil {
+		t.Error("Expected a secret sealed for another context not to open")
+	}
+	if _, err := SealSecret(Credential{Name: "ipsec-vpn-key"}, secret, nil); err == nil {
+		t.Error("Expected systemd credentials to be refused")
+	}
+}
@@ -0,0 +1,166 @@
+package table
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+// ANSI color codes
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorInvert = "\033[7m"
+)
+
+// Column describes a table column
+type Column struct {
+	Header   string
+	MaxWidth int  // Cells longer than this are truncated unless the table is wide; 0 means no limit
+	Wide     bool // Only shown in wide output
+	Status   bool // Cells are colored by status
+}
+
+// Options control how a table is rendered
+type Options struct {
+	Wide  bool
+	Color bool
+}
+
+// Table is a column-aligned table of text
+type Table struct {
+	columns []Column
+	rows    [][]string
+}
+
+// New creates a table with the given columns
+func New(columns ...Column) *Table {
+	return &Table{columns: columns}
+}
+
+// AddRow appends a row. Missing cells are left empty.
+func (t *Table) AddRow(cells ...string) {
+	row := make([]string, len(t.columns))
+	copy(row, cells)
+	t.rows = append(t.rows, row)
+}
+
+// Len returns the number of rows
+func (t *Table) Len() int {
+	return len(t.rows)
+}
+
+// Render writes the table to w
+func (t *Table) Render(w io.Writer, opts Options) {
+	var visible []int
+	for i, c := range t.columns {
+		if !c.Wide || opts.Wide {
+			visible = append(visible, i)
+		}
+	}
+
+	// Truncate cells, then size each column to its widest cell
+	cells := make([][]string, len(t.rows))
+	widths := make([]int, len(t.columns))
+	for _, i := range visible {
+		widths[i] = utf8.RuneCountInString(t.columns[i].Header)
+	}
+	for r, row := range t.rows {
+		cells[r] = make([]string, len(row))
+		for _, i := range visible {
+			cell := row[i]
+			if !opts.Wide {
+				cell = truncate(cell, t.columns[i].MaxWidth)
+			}
+			cells[r][i] = cell
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	header := make([]string, len(t.columns))
+	for _, i := range visible {
+		header[i] = t.columns[i].Header
+	}
+	t.writeRow(w, header, visible, widths, false)
+	for _, row := range cells {
+		t.writeRow(w, row, visible, widths, opts.Color)
+	}
+}
+
+// writeRow writes one aligned row, coloring status cells if requested
+func (t *Table) writeRow(w io.Writer, row []string, visible, widths []int, color bool) {
+	var b strings.Builder
+	for n, i := range visible {
+		cell := row[i]
+		pad := widths[i] - utf8.RuneCountInString(cell)
+		if color && t.columns[i].Status {
+			cell = Colorize(cell)
+		}
+
+		b.WriteString(cell)
+		if n < len(visible)-1 {
+			b.WriteString(strings.Repeat(" ", pad+2))
+		}
+	}
+	fmt.Fprintln(w, strings.TrimRight(b.String(), " "))
+}
+
+// Colorize colors a status value: green when healthy, red when down or failed, yellow otherwise
+func Colorize(status string) string {
+	switch strings.ToUpper(status) {
+	case "UP", "ACTIVE", "OK", "PASS", "YES", "SUCCEEDED":
+		return colorGreen + status + colorReset
+	case "DOWN", "ERROR", "FAILED", "FAIL", "INACTIVE", "NO":
+		return colorRed + status + colorReset
+	case "":
+		return status
+	default:
+		return colorYellow + status + colorReset
+	}
+}
+
+// ColorEnabled reports whether colored output should be used. Color is disabled by
+// --no-color, by the NO_COLOR environment variable, or when stdout is not a terminal.
+func ColorEnabled(noColor bool) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return IsTerminal(os.Stdout)
+}
+
+// IsTerminal reports whether f is a terminal
+func IsTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// Highlight returns cur with every line that differs from the same line of prev
+// shown in reverse video. Colors within a changed line keep the highlight.
+func Highlight(prev, cur string) string {
+	prevLines := strings.Split(prev, "\n")
+	lines := strings.Split(cur, "\n")
+	for i, line := range lines {
+		if line == "" || (i < len(prevLines) && prevLines[i] == line) {
+			continue
+		}
+		lines[i] = colorInvert + strings.ReplaceAll(line, colorReset, colorReset+colorInvert) + colorReset
+	}
+	return strings.Join(lines, "\n")
+}
+
+// truncate shortens s to at most width runes, marking the cut with an ellipsis
+func truncate(s string, width int) string {
+	if width <= 0 || utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width-1]) + "…"
+}
@@ -0,0 +1,62 @@
+package table
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tbl := New(
+		Column{Header: "NAME"},
+		Column{Header: "STATUS", Status: true},
+		Column{Header: "DESCRIPTION", MaxWidth: 10},
+		Column{Header: "SUBNET", Wide: true},
+	)
+	tbl.AddRow("office", "UP", "Office VPN connection", "10.0.0.0/24")
+	tbl.AddRow("dc", "DOWN", "Datacenter", "172.16.0.0/16")
+
+	var buf bytes.Buffer
+	tbl.Render(&buf, Options{})
+	expected := "NAME    STATUS  DESCRIPTION\n" +
+		"office  UP      Office VP…\n" +
+		"dc      DOWN    Datacenter\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected table:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	tbl.Render(&buf, Options{Wide: true})
+	if !strings.Contains(buf.String(), "Office VPN connection  10.0.0.0/24") {
+		t.Errorf("Expected wide output to include full cells and wide columns, got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	tbl.Render(&buf, Options{Color: true})
+	lines := strings.Split(buf.String(), "\n")
+	if !strings.Contains(lines[1], colorGreen+"UP"+colorReset+"      ") {
+		t.Errorf("Expected colored status to stay aligned, got %q", lines[1])
+	}
+	if strings.Contains(lines[0], "\033") {
+		t.Errorf("Expected header not to be colored, got %q", lines[0])
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	prev := "NAME    STATUS\noffice  DOWN\n"
+	cur := "NAME    STATUS\noffice  " + Colorize("UP") + "\ndc      DOWN\n"
+
+	lines := strings.Split(Highlight(prev, cur), "\n")
+	if lines[0] != "NAME    STATUS" {
+		t.Errorf("Expected unchanged line to be left alone, got %q", lines[0])
+	}
+	if lines[1] != colorInvert+"office  "+colorGreen+"UP"+colorReset+colorInvert+colorReset {
+		t.Errorf("Expected changed line to be highlighted throughout, got %q", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], colorInvert) {
+		t.Errorf("Expected new line to be highlighted, got %q", lines[2])
+	}
+	if lines[3] != "" {
+		t.Errorf("Expected trailing empty line to stay empty, got %q", lines[3])
+	}
+}
@@ -0,0 +1,117 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// DetailedStats breaks down the traffic of a tunnel by protocol and direction,
+// with the packets it dropped and why
+type DetailedStats struct {
+	Counters *network.PacketCounters `json:"counters,omitempty"` // Nil unless packet accounting is on
+	Drops    []network.Drop          `json:"drops"`
+	Xfrm     []network.Drop          `json:"xfrm,omitempty"` // Errors of all IPsec SAs on the host
+}
+
+// SetPacketAccounting turns the packet accounting of a tunnel on or off: eBPF
+// programs on its interface counting the packets it carries by protocol. A
+// tunnel that is up is switched over straight away; otherwise it is when it
+// starts. Turning it off discards the counters.
+func SetPacketAccounting(name string, enabled bool) error {
+	if err := RequireSelfTest(); err != nil {
+		return err
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+	if enabled && tunnel.Responder() {
+		return errors.New("a responder has no interface of its own, count the packets of the tunnels to its initiators")
+	}
+
+	if enabled {
+		tunnel.PacketAccounting = true
+		if tunnel.Status == StatusUp {
+			if err := installPacketAccounting(tunnel); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := removePacketAccounting(tunnel); err != nil {
+			return err
+		}
+		tunnel.PacketAccounting = false
+	}
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// installPacketAccounting attaches the packet accounting programs of a tunnel
+// to its interface, and sets its rate limit again on top of them
+func installPacketAccounting(tunnel *Tunnel) error {
+	if !tunnel.PacketAccounting {
+		return nil
+	}
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	tunnelLog.Debug("Installing packet accounting of tunnel", "tunnel", tunnel.Name)
+	if err := network.InstallPacketAccounting(handle, tunnel.Interface(), tunnel.Name); err != nil {
+		return err
+	}
+	// Releases before packet accounting policed ingress on a qdisc it replaces
+	return applyRateLimit(tunnel, 0)
+}
+
+// removePacketAccounting detaches the packet accounting programs of a tunnel
+// and discards its counters
+func removePacketAccounting(tunnel *Tunnel) error {
+	if !tunnel.PacketAccounting {
+		return nil
+	}
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	return network.RemovePacketAccounting(handle, tunnel.Interface(), tunnel.Name)
+}
+
+// GetDetailedStats returns the traffic of a tunnel by protocol and direction,
+// if its packet accounting is on, and the packets its interface dropped
+func GetDetailedStats(name string) (*DetailedStats, error) {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return nil, err
+	}
+	if tunnel.Responder() {
+		return nil, errors.New("a responder has no interface of its own, see the tunnels to its initiators")
+	}
+
+	stats := &DetailedStats{}
+	if tunnel.PacketAccounting {
+		if stats.Counters, err = network.ReadPacketCounters(tunnel.Name); err != nil {
+			return nil, fmt.Errorf("failed to read the packet counters, is the tunnel up? %v", err)
+		}
+	}
+
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	if stats.Drops, err = network.Drops(handle, tunnel.Interface()); err != nil {
+		return nil, err
+	}
+	// SAs are not per tunnel in the kernel's counters, and WireGuard has none
+	if tunnel.Mode != ModeWireGuard {
+		stats.Xfrm, _ = network.XfrmErrors()
+	}
+	return stats, nil
+}
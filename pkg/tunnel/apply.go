@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// Spec is a tunnel as declared in an apply file, with the options of
+// 'tunnel create' and its labels
+type Spec struct {
+	Name             string            `yaml:"name"`
+	Mode             string            `yaml:"mode,omitempty"`
+	LocalIP          string            `yaml:"local_ip"`
+	RemoteIP         string            `yaml:"remote_ip"`
+	LocalSubnet      string            `yaml:"local_subnet"`
+	RemoteSubnet     string            `yaml:"remote_subnet"`
+	Encryption       string            `yaml:"encryption,omitempty"`   // tunnel_defaults.encryption if empty
+	PostQuantum      *bool             `yaml:"post_quantum,omitempty"` // tunnel_defaults.post_quantum if unset
+	Namespace        string            `yaml:"netns,omitempty"`
+	KillSwitch       bool              `yaml:"kill_switch,omitempty"`
+	RateLimit        string            `yaml:"rate_limit,omitempty"` // Such as 10mbit
+	PeerSpiffeID     string            `yaml:"peer_spiffe_id,omitempty"`
+	WireGuardPeerKey string            `yaml:"wireguard_peer_key,omitempty"`
+	ListenPort       int               `yaml:"listen_port,omitempty"`
+	PSKRef           string            `yaml:"psk_ref,omitempty"` // Such as vault://branches/paris, never the key itself
+	PeerGroup        string            `yaml:"peer_group,omitempty"`
+	PeerID           string            `yaml:"peer_id,omitempty"`         // With remote_ip %any
+	PeerCA           string            `yaml:"peer_ca,omitempty"`         // With remote_ip %any
+	VirtualIPPool    string            `yaml:"virtual_ip_pool,omitempty"` // With remote_ip %any
+	VirtualIPs       map[string]string `yaml:"virtual_ips,omitempty"`     // Identity to address or subnet, with remote_ip %any
+	Shortcuts        bool              `yaml:"shortcuts,omitempty"`       // With remote_ip %any
+	Labels           map[string]string `yaml:"labels,omitempty"`
+}
+
+// applyFile is the layout of an apply file once rendered
+type applyFile struct {
+	Tunnels []Spec `yaml:"tunnels"`
+}
+
+// Values are what the placeholders of an apply file, such as {{ .SiteID }},
+// are resolved from
+type Values map[string]any
+
+// EnvValues returns the environment as values, so that {{ .REGION }} is the
+// variable REGION
+func EnvValues() Values {
+	values := make(Values)
+	for _, kv := range os.Environ() {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// LoadValues reads a YAML values file
+func LoadValues(path string) (Values, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(Values)
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return values, nil
+}
+
+// Merge returns the values with others set over them
+func (v Values) Merge(others ...Values) Values {
+	merged := maps.Clone(v)
+	if merged == nil {
+		merged = make(Values)
+	}
+	for _, other := range others {
+		maps.Copy(merged, other)
+	}
+	return merged
+}
+
+// templateFuncs are the functions apply files may call besides the builtins
+var templateFuncs = template.FuncMap{
+	"env": os.Getenv,
+	"default": func(def, value any) any {
+		if value == nil || value == "" {
+			return def
+		}
+		return value
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// Render resolves the placeholders of an apply file, a Go template, from
+// values. A placeholder without a value is an error rather than an empty
+// string, which would make for a tunnel half configured.
+func Render(name string, text []byte, values Values) ([]byte, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, map[string]any(values)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// ParseSpecs reads the tunnels of a rendered apply file. Unknown keys are
+// errors, so that a misspelt option is not silently left out.
+func ParseSpecs(data []byte) ([]Spec, error) {
+	var file applyFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for i, s := range file.Tunnels {
+		if s.Name == "" {
+			return nil, fmt.Errorf("tunnel %d has no name", i+1)
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("tunnel '%s' is declared twice", s.Name)
+		}
+		seen[s.Name] = true
+	}
+	return file.Tunnels, nil
+}
+
+// Config returns the configuration to create the tunnel of a spec with,
+// falling back to tunnel_defaults like 'tunnel create'
+func (s Spec) Config() (Config, error) {
+	mode := cmp.Or(s.Mode, ModeIPsec)
+	config := Config{
+		Name:             s.Name,
+		LocalIP:          s.LocalIP,
+		RemoteIP:         s.RemoteIP,
+		LocalSubnet:      s.LocalSubnet,
+		RemoteSubnet:     s.RemoteSubnet,
+		Encryption:       s.Encryption,
+		Namespace:        s.Namespace,
+		KillSwitch:       s.KillSwitch,
+		PeerSpiffeID:     s.PeerSpiffeID,
+		Mode:             mode,
+		WireGuardPeerKey: s.WireGuardPeerKey,
+		ListenPort:       s.ListenPort,
+		PSKRef:           s.PSKRef,
+		PeerGroup:        s.PeerGroup,
+		PeerID:           s.PeerID,
+		PeerCA:           s.PeerCA,
+		VirtualIPPool:    s.VirtualIPPool,
+		Shortcuts:        s.Shortcuts,
+	}
+	if mode != ModeWireGuard {
+		config.Encryption = cmp.Or(config.Encryption, viper.GetString("tunnel_defaults.encryption"))
+		config.PostQuantum = viper.GetBool("tunnel_defaults.post_quantum")
+		if s.PostQuantum != nil {
+			config.PostQuantum = *s.PostQuantum
+		}
+	}
+	if s.RateLimit != "" {
+		rate, err := network.ParseRate(s.RateLimit)
+		if err != nil {
+			return Config{}, fmt.Errorf("tunnel '%s': %v", s.Name, err)
+		}
+		config.RateLimit = rate
+	}
+	if len(s.VirtualIPs) > 0 {
+		ips, err := ParseVirtualIPs(formatVirtualIPs(s.VirtualIPs))
+		if err != nil {
+			return Config{}, fmt.Errorf("tunnel '%s': %v", s.Name, err)
+		}
+		config.VirtualIPs = ips
+	}
+	if err := ValidateLabels(s.Labels); err != nil {
+		return Config{}, fmt.Errorf("tunnel '%s': %v", s.Name, err)
+	}
+	return config, nil
+}
+
+// Differences lists how an existing tunnel differs from its spec, other than
+// its labels, as "option: have -> want"
+func (s Spec) Differences(t *Tunnel) ([]string, error) {
+	config, err := s.Config()
+	if err != nil {
+		return nil, err
+	}
+	var diffs []string
+	differ := func(option string, have, want any) {
+		if have != want {
+			diffs = append(diffs, fmt.Sprintf("%s: %v -> %v", option, have, want))
+		}
+	}
+	differ("mode", t.Mode, config.Mode)
+	differ("local_ip", t.LocalIP, config.LocalIP)
+	differ("remote_ip", t.RemoteIP, config.RemoteIP)
+	differ("local_subnet", t.LocalSubnet, config.LocalSubnet)
+	differ("remote_subnet", t.RemoteSubnet, config.RemoteSubnet)
+	// A cipher picked for this host, such as auto, may resolve differently from
+	// when the tunnel was created
+	if config.Encryption != "" && config.Encryption != crypto.AutoAlgorithm {
+		differ("encryption", t.Encryption, config.Encryption)
+	}
+	if config.Mode != ModeWireGuard {
+		differ("post_quantum", t.PostQuantum, config.PostQuantum)
+	}
+	differ("kill_switch", t.KillSwitch, config.KillSwitch)
+	differ("rate_limit", t.RateLimit, config.RateLimit)
+	differ("peer_spiffe_id", t.PeerSpiffeID, config.PeerSpiffeID)
+	differ("wireguard_peer_key", t.WireGuardPeerKey, config.WireGuardPeerKey)
+	differ("psk_ref", t.PSKRef, config.PSKRef)
+	differ("peer_group", t.PeerGroup, config.PeerGroup)
+	differ("peer_id", t.PeerID, config.PeerID)
+	differ("peer_ca", t.PeerCA, config.PeerCA)
+	differ("virtual_ip_pool", t.VirtualIPPool, config.VirtualIPPool)
+	differ("virtual_ips", strings.Join(formatVirtualIPs(t.VirtualIPs), ","), strings.Join(formatVirtualIPs(config.VirtualIPs), ","))
+	differ("shortcuts", t.Shortcuts, config.Shortcuts)
+	return diffs, nil
+}
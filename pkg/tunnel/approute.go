@@ -0,0 +1,127 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// AppRoute sends all traffic of some local processes through a tunnel, whatever
+// its destination: that of the processes running as a user, or of those in a
+// cgroup, such as the one systemd runs a service in. Other traffic is routed
+// as usual.
+type AppRoute struct {
+	UID    int    // With Cgroup empty
+	Cgroup string // Path below /sys/fs/cgroup
+}
+
+// ParseAppRoute parses a route such as uid:1001, uid:backup or
+// cgroup:system.slice/restic.service. User names are looked up, so the route
+// holds the UID.
+func ParseAppRoute(s string) (AppRoute, error) {
+	kind, value, _ := strings.Cut(s, ":")
+	switch kind {
+	case "uid":
+		if uid, err := strconv.Atoi(value); err == nil && uid >= 0 {
+			return AppRoute{UID: uid}, nil
+		}
+		u, err := user.Lookup(value)
+		if err != nil {
+			return AppRoute{}, fmt.Errorf("invalid application route %q: no user %s", s, value)
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		return AppRoute{UID: uid}, nil
+	case "cgroup":
+		cgroup := strings.Trim(strings.TrimPrefix(value, "/sys/fs/cgroup"), "/")
+		if cgroup == "" || path.Clean(cgroup) != cgroup || strings.HasPrefix(cgroup, "..") || strings.ContainsAny(cgroup, "\"\n") {
+			return AppRoute{}, fmt.Errorf("invalid application route %q: invalid cgroup path", s)
+		}
+		return AppRoute{Cgroup: cgroup}, nil
+	default:
+		return AppRoute{}, fmt.Errorf("invalid application route %q: expected uid:<user> or cgroup:<path>", s)
+	}
+}
+
+// String formats a route the way ParseAppRoute reads it
+func (r AppRoute) String() string {
+	if r.Cgroup != "" {
+		return "cgroup:" + r.Cgroup
+	}
+	return fmt.Sprintf("uid:%d", r.UID)
+}
+
+// SetAppRoutes replaces the application routes of a tunnel. A tunnel that is up
+// is switched over straight away; otherwise they are installed when it starts.
+func SetAppRoutes(name string, routes []AppRoute) error {
+	if err := RequireSelfTest(); err != nil {
+		return err
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+	if tunnel.Responder() && len(routes) > 0 {
+		return errors.New("a responder has no interface of its own, route applications through a tunnel to a single peer")
+	}
+
+	if tunnel.Status == StatusUp {
+		if err := removeAppRoutes(tunnel); err != nil {
+			return err
+		}
+		tunnel.AppRoutes = routes
+		if err := installAppRoutes(tunnel); err != nil {
+			return err
+		}
+	}
+
+	tunnel.AppRoutes = routes
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// installAppRoutes marks the traffic of the applications routed through a
+// tunnel and routes it through the tunnel interface, in the address family of
+// the tunnel's subnets. The interface must be up.
+func installAppRoutes(tunnel *Tunnel) error {
+	if len(tunnel.AppRoutes) == 0 {
+		return nil
+	}
+	_, remote, err := net.ParseCIDR(tunnel.RemoteSubnet)
+	if err != nil {
+		return fmt.Errorf("invalid remote subnet: %v", err)
+	}
+	matches := make([]network.AppMatch, len(tunnel.AppRoutes))
+	for i, r := range tunnel.AppRoutes {
+		matches[i] = network.AppMatch{UID: r.UID, Cgroup: r.Cgroup}
+	}
+
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	tunnelLog.Debug("Routing application traffic through tunnel", "tunnel", tunnel.Name, "routes", len(matches))
+	return inNamespace(tunnel, func() error {
+		return network.SetAppRoutes(handle, tunnel.Interface(), remote.IP.To4() == nil, matches)
+	})
+}
+
+// removeAppRoutes routes the traffic of the applications of a tunnel as usual again
+func removeAppRoutes(tunnel *Tunnel) error {
+	if len(tunnel.AppRoutes) == 0 {
+		return nil
+	}
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	return inNamespace(tunnel, func() error { return network.ClearAppRoutes(handle, tunnel.Interface()) })
+}
@@ -0,0 +1,201 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ciscoMaxLifetime is the longest IKE and IPsec SA lifetime IOS and ASA accept
+const ciscoMaxLifetime = 86400
+
+// ciscoGroups are the DH groups both IOS and ASA support for IKE and PFS
+var ciscoGroups = map[int]bool{14: true, 15: true, 16: true, 19: true, 20: true, 21: true}
+
+// ciscoSettings adapts the peer settings of a tunnel to what IOS and ASA support,
+// adding notes for anything that had to change
+func ciscoSettings(tunnel *Tunnel, s *peerSettings, platform string) (group, pfs, lifetime int, notes []string, err error) {
+	if s.Local.IP.To4() == nil || net.ParseIP(tunnel.LocalIP).To4() == nil {
+		return 0, 0, 0, nil, fmt.Errorf("%s export supports IPv4 tunnels only", platform)
+	}
+	notes = s.Notes
+
+	if s.IKE.Cipher == "chacha20poly1305" || s.ESP.Cipher == "chacha20poly1305" {
+		notes = append(notes, fmt.Sprintf("%s has no ChaCha20-Poly1305, AES-256-GCM is used instead and must be allowed on this gateway", platform))
+	}
+	group = s.IKE.Group
+	if !ciscoGroups[group] {
+		notes = append(notes, fmt.Sprintf("%s does not support DH group %d, group 20 is used instead", platform, group))
+		group = 20
+	}
+	pfs = s.PFSGroup
+	if pfs != 0 && !ciscoGroups[pfs] {
+		pfs = group
+	}
+	lifetime = s.Lifetime
+	if lifetime > ciscoMaxLifetime {
+		notes = append(notes, fmt.Sprintf("%s lifetimes are at most %d seconds, shorter than this gateway's %d", platform, ciscoMaxLifetime, lifetime))
+		lifetime = ciscoMaxLifetime
+	}
+	return group, pfs, lifetime, notes, nil
+}
+
+// ciscoName is the name of the objects created for a tunnel
+func ciscoName(tunnel *Tunnel) string {
+	return "IPSEC-VPN-" + strings.ToUpper(tunnel.Name)
+}
+
+// ciscoHash returns the hash of a proposal, which IKEv1 and the IKEv2 PRF need
+func ciscoHash(p proposal) string {
+	if p.Hash == "" {
+		return "sha256"
+	}
+	return p.Hash
+}
+
+// mask formats a subnet mask in dotted decimal, inverted for wildcard masks
+func mask(network *net.IPNet, wildcard bool) string {
+	m := make(net.IP, len(network.Mask))
+	for i, b := range network.Mask {
+		if wildcard {
+			b = ^b
+		}
+		m[i] = b
+	}
+	return m.To4().String()
+}
+
+// exportCiscoIOS writes the IOS or IOS XE configuration that makes a router the
+// peer of a tunnel using a crypto map with the given sequence number
+func exportCiscoIOS(tunnel *Tunnel, s *peerSettings, seq int) ([]byte, error) {
+	group, pfs, lifetime, notes, err := ciscoSettings(tunnel, s, "Cisco IOS")
+	if err != nil {
+		return nil, err
+	}
+	name := ciscoName(tunnel)
+	peer := tunnel.LocalIP
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "! ipsec-vpn tunnel '%s' for Cisco IOS: paste in global configuration mode\n", tunnel.Name)
+	for _, note := range notes {
+		fmt.Fprintf(&buf, "! %s\n", note)
+	}
+	fmt.Fprintln(&buf, "! then apply the crypto map to the outside interface with: crypto map IPSEC-VPN")
+
+	if s.IKEv1 {
+		fmt.Fprintf(&buf, "crypto isakmp policy %d\n encryption aes 256\n hash %s\n group %d\n lifetime %d\n", seq, ciscoHash(s.IKE), group, lifetime)
+		if s.Certificates {
+			fmt.Fprintln(&buf, " authentication rsa-sig")
+		} else {
+			fmt.Fprintf(&buf, " authentication pre-share\ncrypto isakmp key <pre-shared-key> address %s\n", peer)
+		}
+		if s.DPDDelay > 0 {
+			fmt.Fprintf(&buf, "crypto isakmp keepalive %d %d periodic\n", s.DPDDelay, min(max(s.DPDDelay, 2), 60))
+		}
+	} else {
+		fmt.Fprintf(&buf, "crypto ikev2 proposal %s\n encryption aes-gcm-256\n prf %s\n group %d\n!\n", name, ciscoHash(s.IKE), group)
+		fmt.Fprintf(&buf, "crypto ikev2 policy %s\n proposal %s\n!\n", name, name)
+		auth := "rsa-sig"
+		if !s.Certificates {
+			auth = "pre-share"
+			fmt.Fprintf(&buf, "crypto ikev2 keyring %s\n peer %s\n  address %s\n  pre-shared-key <pre-shared-key>\n!\n", name, strings.ToLower(name), peer)
+		}
+		fmt.Fprintf(&buf, "crypto ikev2 profile %s\n match identity remote address %s 255.255.255.255\n", name, peer)
+		fmt.Fprintf(&buf, " authentication remote %s\n authentication local %s\n", auth, auth)
+		if s.Certificates {
+			fmt.Fprintln(&buf, " pki trustpoint <trustpoint>")
+		} else {
+			fmt.Fprintf(&buf, " keyring local %s\n", name)
+		}
+		fmt.Fprintf(&buf, " lifetime %d\n", lifetime)
+		if s.DPDDelay > 0 {
+			fmt.Fprintf(&buf, " dpd %d %d periodic\n", s.DPDDelay, min(max(s.DPDDelay, 2), 255))
+		}
+		fmt.Fprintln(&buf, "!")
+	}
+
+	fmt.Fprintf(&buf, "crypto ipsec transform-set %s esp-gcm 256\n mode tunnel\n!\n", name)
+	fmt.Fprintf(&buf, "ip access-list extended %s\n permit ip %s %s %s %s\n!\n", name,
+		s.Local.IP, mask(s.Local, true), s.Remote.IP, mask(s.Remote, true))
+	fmt.Fprintf(&buf, "crypto map IPSEC-VPN %d ipsec-isakmp\n set peer %s\n set transform-set %s\n", seq, peer, name)
+	if pfs != 0 {
+		fmt.Fprintf(&buf, " set pfs group%d\n", pfs)
+	}
+	if !s.IKEv1 {
+		fmt.Fprintf(&buf, " set ikev2-profile %s\n", name)
+	}
+	fmt.Fprintf(&buf, " set security-association lifetime seconds %d\n match address %s\n", lifetime, name)
+	return buf.Bytes(), nil
+}
+
+// exportCiscoASA writes the ASA configuration that makes a firewall the peer of a
+// tunnel: a crypto map entry with the given sequence number and a tunnel-group
+func exportCiscoASA(tunnel *Tunnel, s *peerSettings, seq int) ([]byte, error) {
+	group, pfs, lifetime, notes, err := ciscoSettings(tunnel, s, "Cisco ASA")
+	if err != nil {
+		return nil, err
+	}
+	name := ciscoName(tunnel)
+	peer := tunnel.LocalIP
+	if s.IKEv1 {
+		notes = append(notes, "ASA IKEv1 has no AES-GCM, ESP uses esp-aes-256 with esp-sha-hmac")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "! ipsec-vpn tunnel '%s' for Cisco ASA: paste in global configuration mode\n", tunnel.Name)
+	for _, note := range notes {
+		fmt.Fprintf(&buf, "! %s\n", note)
+	}
+	fmt.Fprintln(&buf, "! the outside interface is assumed to be named outside")
+
+	fmt.Fprintf(&buf, "object-group network %s-LOCAL\n network-object %s %s\n", name, s.Local.IP, mask(s.Local, false))
+	fmt.Fprintf(&buf, "object-group network %s-REMOTE\n network-object %s %s\n", name, s.Remote.IP, mask(s.Remote, false))
+	fmt.Fprintf(&buf, "access-list %s extended permit ip object-group %s-LOCAL object-group %s-REMOTE\n", name, name, name)
+
+	version := "ikev2"
+	if s.IKEv1 {
+		version = "ikev1"
+		auth := "pre-share"
+		if s.Certificates {
+			auth = "rsa-sig"
+		}
+		fmt.Fprintf(&buf, "crypto ikev1 policy %d\n authentication %s\n encryption aes-256\n hash sha\n group %d\n lifetime %d\n",
+			seq, auth, group, lifetime)
+		fmt.Fprintf(&buf, "crypto ipsec ikev1 transform-set %s esp-aes-256 esp-sha-hmac\n", name)
+	} else {
+		fmt.Fprintf(&buf, "crypto ikev2 policy %d\n encryption aes-gcm-256\n integrity null\n group %d\n prf %s\n lifetime seconds %d\n",
+			seq, group, ciscoHash(s.IKE), lifetime)
+		fmt.Fprintf(&buf, "crypto ipsec ikev2 ipsec-proposal %s\n protocol esp encryption aes-gcm-256\n protocol esp integrity null\n", name)
+	}
+	fmt.Fprintf(&buf, "crypto %s enable outside\n", version)
+
+	fmt.Fprintf(&buf, "crypto map outside_map %d match address %s\n", seq, name)
+	fmt.Fprintf(&buf, "crypto map outside_map %d set peer %s\n", seq, peer)
+	if s.IKEv1 {
+		fmt.Fprintf(&buf, "crypto map outside_map %d set ikev1 transform-set %s\n", seq, name)
+	} else {
+		fmt.Fprintf(&buf, "crypto map outside_map %d set ikev2 ipsec-proposal %s\n", seq, name)
+	}
+	if pfs != 0 {
+		fmt.Fprintf(&buf, "crypto map outside_map %d set pfs group%d\n", seq, pfs)
+	}
+	fmt.Fprintf(&buf, "crypto map outside_map %d set security-association lifetime seconds %d\n", seq, lifetime)
+	fmt.Fprintln(&buf, "crypto map outside_map interface outside")
+
+	fmt.Fprintf(&buf, "tunnel-group %s type ipsec-l2l\ntunnel-group %s ipsec-attributes\n", peer, peer)
+	switch {
+	case s.Certificates && s.IKEv1:
+		fmt.Fprintln(&buf, " ikev1 trust-point <trustpoint>")
+	case s.Certificates:
+		fmt.Fprintln(&buf, " ikev2 remote-authentication certificate\n ikev2 local-authentication certificate <trustpoint>")
+	case s.IKEv1:
+		fmt.Fprintln(&buf, " ikev1 pre-shared-key <pre-shared-key>")
+	default:
+		fmt.Fprintln(&buf, " ikev2 remote-authentication pre-shared-key <pre-shared-key>\n ikev2 local-authentication pre-shared-key <pre-shared-key>")
+	}
+	if s.DPDDelay > 0 {
+		fmt.Fprintf(&buf, " isakmp keepalive threshold %d retry %d\n", max(s.DPDDelay, 10), min(max(s.DPDDelay, 2), 10))
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,262 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// Kinds of kernel resource found by Leftovers
+const (
+	LeftoverInterface = "interface"
+	LeftoverNamespace = "namespace"
+	LeftoverPolicy    = "xfrm-policy"
+	LeftoverRoute     = "route"
+)
+
+// namespaceDir is where named network namespaces are bind-mounted
+const namespaceDir = "/run/netns"
+
+// Leftover is a kernel resource created by ipsec-vpn for a tunnel that is no
+// longer configured
+type Leftover struct {
+	Kind   string
+	Name   string
+	Reason string
+	remove func() error
+}
+
+// Remove deletes the resource from the kernel
+func (l *Leftover) Remove() error {
+	return l.remove()
+}
+
+// Leftovers finds the GRE and WireGuard interfaces, dedicated network namespaces,
+// traffic-policy XFRM policies and kill-switch block routes that ipsec-vpn
+// created and that belong to no configured tunnel. Resources are recognised by
+// their names, the priorities of the XFRM policies and the metric of the block
+// routes. It only reads; the leftovers it returns are deleted with Remove.
+func Leftovers() ([]*Leftover, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(configDir, "tunnels", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	// A tunnel that cannot be loaded may own any of the resources, so refuse to
+	// guess rather than remove something still in use
+	var tunnels []*Tunnel
+	names := make(map[string]bool)
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		tunnel, err := loadTunnel(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tunnel '%s', run fsck first: %v", name, err)
+		}
+		tunnels = append(tunnels, tunnel)
+		names[name] = true
+	}
+
+	leftovers := leftoverLinks(tunnels, names)
+	leftovers = append(leftovers, leftoverNamespaces(tunnels, names)...)
+
+	policies, err := network.Handle().XfrmPolicyList(netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list XFRM policies: %v", err)
+	}
+	leftovers = append(leftovers, leftoverPolicies(tunnels, policies)...)
+
+	routes, err := network.Handle().RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Type: unix.RTN_BLACKHOLE}, netlink.RT_FILTER_TYPE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+	leftovers = append(leftovers, leftoverRoutes(tunnels, routes)...)
+	return leftovers, nil
+}
+
+// leftoverLinks returns the tunnel interfaces, in the default namespace or one a
+// tunnel uses, that have no tunnel
+func leftoverLinks(tunnels []*Tunnel, names map[string]bool) []*Leftover {
+	namespaces := []string{""}
+	for _, t := range tunnels {
+		if t.Namespace != "" && !slices.Contains(namespaces, t.Namespace) {
+			namespaces = append(namespaces, t.Namespace)
+		}
+	}
+
+	var leftovers []*Leftover
+	for _, ns := range namespaces {
+		handle, err := linkHandle(&Tunnel{Namespace: ns})
+		if err != nil {
+			continue // Reported for the tunnel using the namespace
+		}
+		links, err := handle.LinkList()
+		handle.Close()
+		if err != nil {
+			continue
+		}
+		for _, link := range links {
+			tunnel, ok := tunnelLink(link)
+			if !ok || names[tunnel] {
+				continue
+			}
+			name, where := link.Attrs().Name, ""
+			if ns != "" {
+				where = " in network namespace '" + ns + "'"
+			}
+			leftovers = append(leftovers, &Leftover{
+				Kind:   LeftoverInterface,
+				Name:   name,
+				Reason: fmt.Sprintf("%s interface%s has no tunnel '%s'", link.Type(), where, tunnel),
+				remove: func() error {
+					handle, err := linkHandle(&Tunnel{Namespace: ns})
+					if err != nil {
+						return err
+					}
+					defer handle.Close()
+					link, err := handle.LinkByName(name)
+					if err != nil {
+						return nil // Already gone
+					}
+					return handle.LinkDel(link)
+				},
+			})
+		}
+	}
+	return leftovers
+}
+
+// leftoverNamespaces returns the dedicated network namespaces of deleted tunnels.
+// A namespace holding interfaces ipsec-vpn did not create is left alone.
+func leftoverNamespaces(tunnels []*Tunnel, names map[string]bool) []*Leftover {
+	entries, err := os.ReadDir(namespaceDir)
+	if err != nil {
+		return nil
+	}
+
+	var leftovers []*Leftover
+	for _, entry := range entries {
+		ns := entry.Name()
+		tunnel, ok := strings.CutPrefix(ns, dedicatedNamespaceName(""))
+		if !ok || names[tunnel] || slices.ContainsFunc(tunnels, func(t *Tunnel) bool { return t.Namespace == ns }) {
+			continue
+		}
+		if !onlyTunnelLinks(ns) {
+			tunnelLog.Info("Keeping network namespace holding interfaces ipsec-vpn did not create", "namespace", ns)
+			continue
+		}
+		leftovers = append(leftovers, &Leftover{
+			Kind:   LeftoverNamespace,
+			Name:   ns,
+			Reason: fmt.Sprintf("dedicated network namespace has no tunnel '%s'", tunnel),
+			remove: func() error { return netns.DeleteNamed(ns) },
+		})
+	}
+	return leftovers
+}
+
+// onlyTunnelLinks reports whether a namespace holds nothing but its loopback and
+// tunnel interfaces
+func onlyTunnelLinks(ns string) bool {
+	handle, err := linkHandle(&Tunnel{Namespace: ns})
+	if err != nil {
+		return false
+	}
+	defer handle.Close()
+	links, err := handle.LinkList()
+	if err != nil {
+		return false
+	}
+	for _, link := range links {
+		if _, ok := tunnelLink(link); !ok && link.Type() != "device" {
+			return false
+		}
+	}
+	return true
+}
+
+// leftoverPolicies returns the traffic-policy XFRM policies that match none of
+// the tunnels' allow-lists
+func leftoverPolicies(tunnels []*Tunnel, policies []netlink.XfrmPolicy) []*Leftover {
+	owned := make(map[string]bool)
+	for _, t := range tunnels {
+		selectors, err := trafficSelectors(t)
+		if err != nil {
+			continue
+		}
+		for _, p := range selectors {
+			owned[policyKey(p)] = true
+		}
+	}
+
+	var leftovers []*Leftover
+	for _, p := range policies {
+		ours := (p.Priority == allowPriority && p.Action == netlink.XFRM_POLICY_ALLOW) ||
+			(p.Priority == blockPriority && p.Action == netlink.XFRM_POLICY_BLOCK)
+		if !ours || p.Src == nil || p.Dst == nil || owned[policyKey(p)] {
+			continue
+		}
+		leftovers = append(leftovers, &Leftover{
+			Kind:   LeftoverPolicy,
+			Name:   policyKey(p),
+			Reason: "traffic policy of no tunnel",
+			remove: func() error { return network.Handle().XfrmPolicyDel(&p) },
+		})
+	}
+	return leftovers
+}
+
+// policyKey identifies an XFRM policy by its selector and action
+func policyKey(p netlink.XfrmPolicy) string {
+	key := fmt.Sprintf("%s %s -> %s", p.Dir, p.Src, p.Dst)
+	if p.Proto != 0 {
+		key += fmt.Sprintf(" proto %d", p.Proto)
+	}
+	if p.SrcPort != 0 {
+		key += fmt.Sprintf(" sport %d", p.SrcPort)
+	}
+	if p.DstPort != 0 {
+		key += fmt.Sprintf(" dport %d", p.DstPort)
+	}
+	if p.Action == netlink.XFRM_POLICY_BLOCK {
+		key += " block"
+	}
+	return key
+}
+
+// leftoverRoutes returns the kill-switch block routes to subnets that are no
+// tunnel's remote subnet
+func leftoverRoutes(tunnels []*Tunnel, routes []netlink.Route) []*Leftover {
+	owned := make(map[string]bool)
+	for _, t := range tunnels {
+		if _, remote, err := net.ParseCIDR(t.RemoteSubnet); err == nil {
+			owned[remote.String()] = true
+		}
+	}
+
+	var leftovers []*Leftover
+	for _, r := range routes {
+		if r.Type != unix.RTN_BLACKHOLE || r.Priority != network.BlockMetric || r.Dst == nil || owned[r.Dst.String()] {
+			continue
+		}
+		destination := r.Dst.String()
+		leftovers = append(leftovers, &Leftover{
+			Kind:   LeftoverRoute,
+			Name:   "blackhole " + destination,
+			Reason: "kill-switch block route of no tunnel",
+			remove: func() error { return network.DeleteBlockRoute(destination) },
+		})
+	}
+	return leftovers
+}
@@ -0,0 +1,201 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/vishvananda/netlink"
+)
+
+// SetDefaultRoute turns on or off sending all traffic through a tunnel, with
+// name resolution through dns if given. A tunnel that is up is switched over
+// straight away. Only one tunnel at a time can carry all traffic.
+func SetDefaultRoute(name string, enabled bool, dns []string) error {
+	if err := RequireSelfTest(); err != nil {
+		return err
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		if tunnel.Namespace != "" {
+			return fmt.Errorf("tunnel '%s' is in network namespace %s and can only carry its traffic", name, tunnel.Namespace)
+		}
+		for _, s := range dns {
+			if net.ParseIP(s) == nil {
+				return fmt.Errorf("invalid DNS server '%s'", s)
+			}
+		}
+		tunnels, err := ListAll()
+		if err != nil {
+			return err
+		}
+		for _, t := range tunnels {
+			if t.DefaultRoute && t.Name != name {
+				return fmt.Errorf("tunnel '%s' already carries all traffic", t.Name)
+			}
+		}
+	} else {
+		dns = nil
+	}
+
+	if tunnel.Status == StatusUp {
+		if err := removeDefaultRoute(tunnel); err != nil {
+			return err
+		}
+		tunnel.DefaultRoute, tunnel.DNS = enabled, dns
+		if err := installDefaultRoute(tunnel); err != nil {
+			return err
+		}
+	}
+
+	tunnel.DefaultRoute, tunnel.DNS = enabled, dns
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// installDefaultRoute sends all traffic of the address family of a tunnel's
+// subnets through it. The route to the peer is pinned to the path it has now
+// first, so that the tunnel's own packets do not loop back into it. Whatever
+// was installed is rolled back if a step fails.
+func installDefaultRoute(tunnel *Tunnel) error {
+	if !tunnel.DefaultRoute {
+		return nil
+	}
+
+	// An uplink already pins the route to the peer
+	if tunnel.Uplink == "" {
+		gateway, iface, err := network.PeerPath(tunnel.RemoteIP)
+		if err != nil {
+			return err
+		}
+		if iface == tunnel.Interface() {
+			return fmt.Errorf("peer %s is routed through the tunnel itself", tunnel.RemoteIP)
+		}
+		if err := network.SetPeerRoute(tunnel.RemoteIP, iface, gateway, ""); err != nil {
+			return err
+		}
+	}
+
+	_, remote, err := net.ParseCIDR(tunnel.RemoteSubnet)
+	if err != nil {
+		_ = removeDefaultRoute(tunnel)
+		return fmt.Errorf("invalid remote subnet: %v", err)
+	}
+	if err := network.SetSplitDefault(tunnel.Interface(), remote.IP.To4() == nil); err != nil {
+		_ = removeDefaultRoute(tunnel)
+		return err
+	}
+
+	if len(tunnel.DNS) > 0 {
+		backup, err := dnsBackupPath()
+		if err == nil {
+			err = network.SetDNS(tunnel.Interface(), tunnel.DNS, backup)
+		}
+		if err != nil {
+			_ = removeDefaultRoute(tunnel)
+			return err
+		}
+	}
+
+	tunnelLog.Info("All traffic goes through tunnel", "tunnel", tunnel.Name)
+	return nil
+}
+
+// removeDefaultRoute rolls back installDefaultRoute. It carries on past failures
+// so that as much as possible is undone, and returns them together.
+func removeDefaultRoute(tunnel *Tunnel) error {
+	if !tunnel.DefaultRoute {
+		return nil
+	}
+
+	active, _ := network.HasSplitDefault(tunnel.Interface())
+	errs := []error{network.ClearSplitDefault(tunnel.Interface())}
+	if backup, err := dnsBackupPath(); err == nil {
+		errs = append(errs, network.RestoreDNS(tunnel.Interface(), backup))
+	}
+	if tunnel.Uplink == "" {
+		errs = append(errs, network.DeletePeerRoute(tunnel.RemoteIP))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if active {
+		tunnelLog.Info("Traffic no longer goes through tunnel by default", "tunnel", tunnel.Name)
+	}
+	return nil
+}
+
+// dnsBackupPath returns where the resolver configuration is saved while a tunnel
+// carries all traffic
+func dnsBackupPath() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "dns", "resolv.conf"), nil
+}
+
+// GuardDefaultRoute keeps the default route through a tunnel in step with the
+// tunnel until stop is closed, then rolls it back. The routes and DNS settings
+// are removed as soon as the tunnel is not up or its interface is down, and
+// installed again once it recovers, so a dead tunnel cannot cut the host off.
+func GuardDefaultRoute(name string, interval time.Duration, stop <-chan struct{}) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var tunnel *Tunnel
+	for {
+		var err error
+		if tunnel, err = Get(name); err != nil {
+			return err
+		}
+		if !tunnel.DefaultRoute {
+			return fmt.Errorf("tunnel '%s' does not carry all traffic", name)
+		}
+
+		active, err := network.HasSplitDefault(tunnel.Interface())
+		if err != nil {
+			return err
+		}
+		switch healthy := tunnel.Status == StatusUp && linkUp(tunnel); {
+		case healthy && !active:
+			if err := installDefaultRoute(tunnel); err != nil {
+				tunnelLog.Error("Failed to send all traffic through tunnel", "tunnel", name, "err", err)
+			}
+		case !healthy && active:
+			tunnelLog.Error("Tunnel dropped, rolling back its default route", "tunnel", name)
+			if err := removeDefaultRoute(tunnel); err != nil {
+				tunnelLog.Error("Failed to roll back the default route of tunnel", "tunnel", name, "err", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return removeDefaultRoute(tunnel)
+		}
+	}
+}
+
+// linkUp reports whether the interface of a tunnel exists and is up
+func linkUp(tunnel *Tunnel) bool {
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return false
+	}
+	defer handle.Close()
+	link, err := handle.LinkByName(tunnel.Interface())
+	if err != nil {
+		return false
+	}
+	attrs := link.Attrs()
+	return attrs.Flags&net.FlagUp != 0 && attrs.OperState != netlink.OperDown && attrs.OperState != netlink.OperLowerLayerDown
+}
@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// DefaultDrainTimeout is how long Drain waits for traffic to stop by default
+const DefaultDrainTimeout = 60 * time.Second
+
+// drainInterval is how often the traffic counters are sampled while draining
+const drainInterval = time.Second
+
+// Drain takes a tunnel out of service without cutting off traffic in flight: it
+// withdraws the networks advertised through the tunnel so that traffic moves to
+// other paths, waits until the tunnel's traffic counters stop moving or timeout
+// passes, and only then stops it.
+func Drain(name string, timeout time.Duration) error {
+	if err := RequireSelfTest(); err != nil {
+		return err
+	}
+	tunnel, err := Get(name)
+	if err != nil {
+		return err
+	}
+
+	routes, err := network.ListAdvertisedRoutes()
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		if r.Interface != tunnel.Interface() {
+			continue
+		}
+		if err := network.WithdrawNetwork(r.Destination, r.Interface); err != nil {
+			return err
+		}
+		tunnelLog.Info("Withdrew advertisement from tunnel", "tunnel", name, "network", r.Destination)
+	}
+
+	if tunnel.Status == StatusUp {
+		tunnelLog.Info("Waiting for traffic through tunnel to stop", "tunnel", name, "timeout", timeout)
+		sample := func() (*Stats, error) { return GetStats(name) }
+		if !waitQuiet(sample, drainInterval, timeout) {
+			tunnelLog.Info("Traffic through tunnel did not stop in time, stopping it anyway", "tunnel", name, "timeout", timeout)
+		}
+	}
+	return Stop(name)
+}
+
+// waitQuiet samples traffic counters every interval until two samples in a row
+// are the same, reporting false if that does not happen within timeout. Counters
+// that cannot be read count as quiet, as there is nothing left to wait for.
+func waitQuiet(sample func() (*Stats, error), interval, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	last, err := sample()
+	if err != nil {
+		return true
+	}
+	for time.Now().Before(deadline) {
+		time.Sleep(min(interval, time.Until(deadline)))
+		stats, err := sample()
+		if err != nil {
+			return true
+		}
+		if stats.RxBytes == last.RxBytes && stats.TxBytes == last.TxBytes {
+			return true
+		}
+		last = stats
+	}
+	return false
+}
@@ -0,0 +1,403 @@
+package tunnel
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/spf13/viper"
+)
+
+// Peer configuration formats
+const (
+	FormatOPNsense = "opnsense"
+	FormatPfSense  = "pfsense"
+	FormatRouterOS = "routeros"
+	FormatCiscoIOS = "cisco-ios"
+	FormatCiscoASA = "cisco-asa"
+)
+
+// ExportFormats lists the formats ExportPeer can write
+var ExportFormats = []string{FormatOPNsense, FormatPfSense, FormatRouterOS, FormatCiscoIOS, FormatCiscoASA}
+
+// defaultIKEProposal is used when advanced.ike_proposals is not configured
+const defaultIKEProposal = "aes256gcm-sha384-ecp384"
+
+// dhGroups maps strongSwan key exchange names to IKE Diffie-Hellman group numbers
+var dhGroups = map[string]int{
+	"modp2048":   14,
+	"modp3072":   15,
+	"modp4096":   16,
+	"ecp256":     19,
+	"ecp384":     20,
+	"ecp521":     21,
+	"curve25519": 31,
+	"x25519":     31,
+	"curve448":   32,
+	"x448":       32,
+}
+
+// proposal is a parsed IKE or ESP proposal such as aes256gcm-sha384-ecp384
+type proposal struct {
+	Cipher string
+	Hash   string
+	Group  int
+}
+
+// parseProposal splits a proposal into its cipher, integrity or PRF hash and DH group
+func parseProposal(s string) (proposal, error) {
+	parts := strings.Split(strings.ToLower(s), "-")
+	p := proposal{Cipher: parts[0]}
+	for _, part := range parts[1:] {
+		if group, ok := dhGroups[part]; ok {
+			p.Group = group
+		} else if strings.HasPrefix(part, "sha") {
+			p.Hash = part
+		} else {
+			return proposal{}, fmt.Errorf("unsupported proposal %q: unknown algorithm %s", s, part)
+		}
+	}
+	if _, ok := crypto.LookupAlgorithm(p.Cipher); !ok {
+		return proposal{}, fmt.Errorf("unsupported proposal %q: unknown cipher %s", s, p.Cipher)
+	}
+	return p, nil
+}
+
+// cipherFor returns the symmetric cipher a firewall can negotiate for a tunnel.
+// Firewalls without post-quantum key exchange fall back to AES-256-GCM.
+func cipherFor(tunnel *Tunnel) string {
+	if tunnel.Encryption == "chacha20poly1305" {
+		return tunnel.Encryption
+	}
+	return "aes256gcm"
+}
+
+// selectProposal picks the first configured proposal using the tunnel's cipher,
+// or else the first one, filling in what it leaves out
+func selectProposal(configured []string, cipher string, fallback proposal) (proposal, error) {
+	var chosen *proposal
+	for _, s := range configured {
+		p, err := parseProposal(s)
+		if err != nil {
+			return proposal{}, err
+		}
+		if p.Cipher == cipher {
+			chosen = &p
+			break
+		}
+		if chosen == nil {
+			chosen = &p
+		}
+	}
+	if chosen == nil {
+		return fallback, nil
+	}
+	if chosen.Hash == "" {
+		chosen.Hash = fallback.Hash
+	}
+	return *chosen, nil
+}
+
+// xmlAlgorithm is an encryption algorithm element of the firewall configuration
+type xmlAlgorithm struct {
+	Name   string `xml:"name"`
+	KeyLen int    `xml:"keylen,omitempty"`
+}
+
+// pfSenseEncryption lists the phase 1 proposals in pfSense 2.5 and later
+type pfSenseEncryption struct {
+	Items []pfSenseEncryptionItem `xml:"item"`
+}
+
+// pfSenseEncryptionItem is a phase 1 proposal of pfSense
+type pfSenseEncryptionItem struct {
+	EncryptionAlgorithm xmlAlgorithm `xml:"encryption-algorithm"`
+	HashAlgorithm       string       `xml:"hash-algorithm"`
+	PRFAlgorithm        string       `xml:"prf-algorithm"`
+	DHGroup             int          `xml:"dhgroup"`
+}
+
+// phase1 is the IKE SA of a tunnel in the <ipsec> section of config.xml. pfSense
+// lists proposals under encryption, OPNsense has a single algorithm, hash and group.
+type phase1 struct {
+	XMLName              xml.Name           `xml:"phase1"`
+	IKEID                int                `xml:"ikeid"`
+	IKEType              string             `xml:"iketype"`
+	Interface            string             `xml:"interface"`
+	RemoteGateway        string             `xml:"remote-gateway"`
+	Protocol             string             `xml:"protocol"`
+	MyIDType             string             `xml:"myid_type"`
+	MyIDData             string             `xml:"myid_data"`
+	PeerIDType           string             `xml:"peerid_type"`
+	PeerIDData           string             `xml:"peerid_data"`
+	Encryption           *pfSenseEncryption `xml:"encryption,omitempty"`
+	EncryptionAlgorithm  *xmlAlgorithm      `xml:"encryption-algorithm,omitempty"`
+	HashAlgorithm        string             `xml:"hash-algorithm,omitempty"`
+	DHGroup              int                `xml:"dhgroup,omitempty"`
+	Lifetime             int                `xml:"lifetime"`
+	AuthenticationMethod string             `xml:"authentication_method"`
+	PreSharedKey         *string            `xml:"pre-shared-key"`
+	NATTraversal         string             `xml:"nat_traversal"`
+	Mobike               string             `xml:"mobike"`
+	DPDDelay             int                `xml:"dpd_delay,omitempty"`
+	DPDMaxFail           int                `xml:"dpd_maxfail,omitempty"`
+	Descr                string             `xml:"descr"`
+}
+
+// phase2ID is a traffic selector of a phase 2 entry
+type phase2ID struct {
+	Type    string `xml:"type"`
+	Address string `xml:"address"`
+	Netbits int    `xml:"netbits"`
+}
+
+// phase2 is the child SA of a tunnel
+type phase2 struct {
+	XMLName    xml.Name       `xml:"phase2"`
+	IKEID      int            `xml:"ikeid"`
+	UniqID     string         `xml:"uniqid"`
+	Mode       string         `xml:"mode"`
+	ReqID      int            `xml:"reqid"`
+	LocalID    phase2ID       `xml:"localid"`
+	RemoteID   phase2ID       `xml:"remoteid"`
+	Protocol   string         `xml:"protocol"`
+	Algorithms []xmlAlgorithm `xml:"encryption-algorithm-option"`
+	PFSGroup   int            `xml:"pfsgroup"`
+	Lifetime   int            `xml:"lifetime"`
+	Descr      string         `xml:"descr"`
+}
+
+// ExportPeer writes the configuration a firewall or router needs to be the other
+// end of a tunnel, seen from the peer's side: phase 1 and phase 2 entries for the
+// <ipsec> section of an OPNsense or pfSense config.xml, RouterOS commands, or Cisco
+// IOS or ASA configuration. ikeID is the phase 1 ID on OPNsense or pfSense and the
+// crypto map sequence number on Cisco, and must not be in use. Pre-shared keys are
+// never exported and are left for the peer's administrator.
+func ExportPeer(name, format string, ikeID int) ([]byte, error) {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return nil, err
+	}
+	if tunnel.Mode == ModeWireGuard {
+		return nil, fmt.Errorf("tunnel '%s' is in wireguard mode, not IPsec", name)
+	}
+	if !slices.Contains(ExportFormats, format) {
+		return nil, fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(ExportFormats, ", "))
+	}
+	if ikeID < 1 {
+		return nil, fmt.Errorf("invalid IKE ID: %d", ikeID)
+	}
+
+	settings, err := peerSettingsFor(tunnel, format, cipherFor(tunnel))
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatRouterOS:
+		return exportRouterOS(tunnel, settings), nil
+	case FormatCiscoIOS:
+		return exportCiscoIOS(tunnel, settings, ikeID)
+	case FormatCiscoASA:
+		return exportCiscoASA(tunnel, settings, ikeID)
+	}
+
+	p1, p2 := peerPhases(tunnel, settings, format, ikeID)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<!-- ipsec-vpn tunnel '%s' for %s: merge into the <ipsec> section of config.xml -->\n", tunnel.Name, format)
+	for _, note := range settings.Notes {
+		fmt.Fprintf(&buf, "<!-- %s -->\n", note)
+	}
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(struct {
+		XMLName xml.Name `xml:"ipsec"`
+		Phase1  phase1
+		Phase2  phase2
+	}{Phase1: p1, Phase2: p2}); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// peerSettings is a tunnel as its peer sees it, independent of the peer's format
+type peerSettings struct {
+	Local, Remote *net.IPNet // The peer's subnets, so the tunnel's remote and local subnet
+	IKE, ESP      proposal
+	PFSGroup      int // 0 without perfect forward secrecy
+	Lifetime      int // Seconds
+	DPDDelay      int // Seconds, 0 to turn DPD off
+	DPDMaxFail    int
+	IKEv1         bool
+	Certificates  bool     // Authenticate with certificates rather than a pre-shared key
+	Notes         []string // What the administrator has to check or complete
+}
+
+// peerSettingsFor works out the proposals, lifetimes and authentication the peer
+// of a tunnel must use from its peer group and the configuration file,
+// preferring the proposals with cipher
+func peerSettingsFor(tunnel *Tunnel, format, cipher string) (*peerSettings, error) {
+	s := &peerSettings{}
+
+	var err error
+	if _, s.Local, err = net.ParseCIDR(tunnel.RemoteSubnet); err != nil {
+		return nil, fmt.Errorf("invalid remote subnet: %v", err)
+	}
+	if _, s.Remote, err = net.ParseCIDR(tunnel.LocalSubnet); err != nil {
+		return nil, fmt.Errorf("invalid local subnet: %v", err)
+	}
+
+	if tunnel.PostQuantum || cipher != tunnel.Encryption {
+		s.Notes = append(s.Notes, fmt.Sprintf("%s has no post-quantum key exchange, the tunnel falls back to %s with classical key exchange", format, cipher))
+	}
+	settings := IKESettingsOf(tunnel)
+	if s.IKE, err = selectProposal(settings.IKEProposals, cipher, mustProposal(defaultIKEProposal)); err != nil {
+		return nil, err
+	}
+	if s.ESP, err = selectProposal(settings.ESPProposals, cipher, s.IKE); err != nil {
+		return nil, err
+	}
+	if s.IKE.Group == 0 {
+		s.IKE.Group = mustProposal(defaultIKEProposal).Group
+	}
+	if viper.GetBool("security.perfect_forward_secrecy") {
+		s.PFSGroup = cmp.Or(s.ESP.Group, s.IKE.Group)
+	}
+
+	s.Lifetime = viper.GetInt("tunnel_defaults.key_rotation_interval")
+	if s.Lifetime <= 0 {
+		s.Lifetime = 86400
+	}
+	if delay := settings.DPDDelay; delay > 0 {
+		s.DPDDelay = delay
+		s.DPDMaxFail = max(1, (settings.DPDTimeout+delay-1)/delay)
+	}
+	s.IKEv1 = viper.GetInt("advanced.ike_version") == 1
+	if reauth, _ := EffectiveReauth(tunnel); reauth.Interval > 0 {
+		s.Notes = append(s.Notes, fmt.Sprintf("reauthenticate the IKE SA every %s rather than only rekeying it, as this gateway does", reauth.Interval))
+	}
+
+	switch settings.AuthMethod {
+	case "pubkey", "spiffe":
+		s.Certificates = true
+		s.Notes = append(s.Notes, "select the peer's certificate and the CA that signs this gateway's certificate")
+	default:
+		s.Notes = append(s.Notes, "set the pre-shared key to the tunnel's key, it is not exported")
+	}
+	return s, nil
+}
+
+// peerPhases builds the OPNsense or pfSense phase 1 and phase 2 entries of a tunnel
+func peerPhases(tunnel *Tunnel, s *peerSettings, format string, ikeID int) (phase1, phase2) {
+	protocol := "inet"
+	if ip := net.ParseIP(tunnel.LocalIP); ip != nil && ip.To4() == nil {
+		protocol = "inet6"
+	}
+	iketype := "ikev2"
+	if s.IKEv1 {
+		iketype = "ikev1"
+	}
+
+	p1 := phase1{
+		IKEID:         ikeID,
+		IKEType:       iketype,
+		Interface:     "wan",
+		RemoteGateway: tunnel.LocalIP,
+		Protocol:      protocol,
+		MyIDType:      "myaddress",
+		PeerIDType:    "peeraddress",
+		Lifetime:      s.Lifetime,
+		NATTraversal:  "on",
+		Mobike:        "off",
+		DPDDelay:      s.DPDDelay,
+		DPDMaxFail:    s.DPDMaxFail,
+		Descr:         "ipsec-vpn " + tunnel.Name,
+	}
+	switch {
+	case s.Certificates && format == FormatPfSense:
+		p1.AuthenticationMethod = "cert"
+	case s.Certificates:
+		p1.AuthenticationMethod = "rsasig"
+	default:
+		empty := ""
+		p1.AuthenticationMethod = "pre_shared_key"
+		p1.PreSharedKey = &empty
+	}
+
+	p2 := phase2{
+		IKEID:    ikeID,
+		UniqID:   uniqID(tunnel.Name),
+		Mode:     "tunnel",
+		ReqID:    ikeID,
+		LocalID:  selectorFor(s.Local),
+		RemoteID: selectorFor(s.Remote),
+		Protocol: "esp",
+		PFSGroup: s.PFSGroup,
+		Lifetime: s.Lifetime,
+		Descr:    "ipsec-vpn " + tunnel.Name,
+	}
+
+	switch format {
+	case FormatPfSense:
+		p1.Encryption = &pfSenseEncryption{Items: []pfSenseEncryptionItem{{
+			EncryptionAlgorithm: pfSenseAlgorithm(s.IKE.Cipher),
+			HashAlgorithm:       s.IKE.Hash,
+			PRFAlgorithm:        s.IKE.Hash,
+			DHGroup:             s.IKE.Group,
+		}}}
+		p2.Algorithms = []xmlAlgorithm{pfSenseAlgorithm(s.ESP.Cipher)}
+	default:
+		p1.EncryptionAlgorithm = &xmlAlgorithm{Name: strongSwanCipher(s.IKE.Cipher)}
+		p1.HashAlgorithm = s.IKE.Hash
+		p1.DHGroup = s.IKE.Group
+		p2.Algorithms = []xmlAlgorithm{{Name: strongSwanCipher(s.ESP.Cipher)}}
+	}
+
+	return p1, p2
+}
+
+// pfSenseAlgorithm names a cipher the way pfSense does: AES-GCM by its ICV length,
+// with the key length separate
+func pfSenseAlgorithm(cipher string) xmlAlgorithm {
+	if cipher == "chacha20poly1305" {
+		return xmlAlgorithm{Name: cipher}
+	}
+	return xmlAlgorithm{Name: "aes128gcm", KeyLen: 256}
+}
+
+// strongSwanCipher names a cipher the way strongSwan, and so OPNsense, does
+func strongSwanCipher(cipher string) string {
+	if cipher == "chacha20poly1305" {
+		return cipher
+	}
+	return "aes256gcm16"
+}
+
+// selectorFor converts a subnet to a phase 2 network selector
+func selectorFor(network *net.IPNet) phase2ID {
+	bits, _ := network.Mask.Size()
+	return phase2ID{Type: "network", Address: network.IP.String(), Netbits: bits}
+}
+
+// uniqID derives a stable phase 2 identifier from the tunnel name, in the 13 hex
+// digit form the firewalls generate themselves
+func uniqID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])[:13]
+}
+
+func mustProposal(s string) proposal {
+	p, err := parseProposal(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
@@ -0,0 +1,52 @@
+package tunnel
+
+import "github.com/dzakwan/ipsec-vpn/pkg/fault"
+
+// faultyBackend delays each operation of a backend by the netlink delay
+// injected with 'ipsec-vpn chaos', so that staging shows how retries, repairs
+// and HA failover cope with a slow kernel
+type faultyBackend struct {
+	Backend
+}
+
+// Create creates the interface of a tunnel once the delay has passed
+func (b faultyBackend) Create(t *Tunnel) error {
+	fault.DelayNetlink()
+	return b.Backend.Create(t)
+}
+
+// Guard installs the kill-switch of a tunnel once the delay has passed
+func (b faultyBackend) Guard(t *Tunnel) error {
+	fault.DelayNetlink()
+	return b.Backend.Guard(t)
+}
+
+// Start brings a tunnel up once the delay has passed
+func (b faultyBackend) Start(t *Tunnel) error {
+	fault.DelayNetlink()
+	return b.Backend.Start(t)
+}
+
+// Stop takes a tunnel down once the delay has passed
+func (b faultyBackend) Stop(t *Tunnel) error {
+	fault.DelayNetlink()
+	return b.Backend.Stop(t)
+}
+
+// Route installs or removes the default route of a tunnel once the delay has passed
+func (b faultyBackend) Route(t *Tunnel, up bool) error {
+	fault.DelayNetlink()
+	return b.Backend.Route(t, up)
+}
+
+// Status returns the status of a tunnel once the delay has passed
+func (b faultyBackend) Status(t *Tunnel) (Status, error) {
+	fault.DelayNetlink()
+	return b.Backend.Status(t)
+}
+
+// Delete removes everything set up for a tunnel once the delay has passed
+func (b faultyBackend) Delete(t *Tunnel, force bool) error {
+	fault.DelayNetlink()
+	return b.Backend.Delete(t, force)
+}
@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Flow is a connection carried by a tunnel, as tracked by conntrack. The source
+// is the side that opened it, and sent counts the traffic from the source. The
+// byte and packet counters are only kept when conntrack accounting
+// (net.netfilter.nf_conntrack_acct) is on.
+type Flow struct {
+	Proto       uint8
+	SrcIP       net.IP
+	DstIP       net.IP
+	SrcPort     uint16
+	DstPort     uint16
+	Outbound    bool // Opened from the local subnet
+	SentBytes   uint64
+	RecvBytes   uint64
+	SentPackets uint64
+	RecvPackets uint64
+	Timeout     time.Duration // Until conntrack forgets an idle flow
+}
+
+// Bytes returns the traffic of the flow in both directions
+func (f Flow) Bytes() uint64 {
+	return f.SentBytes + f.RecvBytes
+}
+
+// Packets returns the packets of the flow in both directions
+func (f Flow) Packets() uint64 {
+	return f.SentPackets + f.RecvPackets
+}
+
+// Protocol names the protocol of the flow
+func (f Flow) Protocol() string {
+	return protocolName(f.Proto)
+}
+
+// Source formats the address, and port for TCP and UDP, that opened the flow
+func (f Flow) Source() string {
+	return endpoint(f.SrcIP, f.SrcPort, f.Proto)
+}
+
+// Destination formats the address, and port for TCP and UDP, the flow was opened to
+func (f Flow) Destination() string {
+	return endpoint(f.DstIP, f.DstPort, f.Proto)
+}
+
+// Flows returns the connections between the subnets of a tunnel that conntrack
+// is tracking in the tunnel's network namespace, busiest first
+func Flows(name string) ([]Flow, error) {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return nil, err
+	}
+	_, local, err := net.ParseCIDR(tunnel.LocalSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local subnet: %v", err)
+	}
+
+	family := netlink.InetFamily(unix.AF_INET)
+	if local.IP.To4() == nil {
+		family = unix.AF_INET6
+	}
+
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	conntrack, err := handle.ConntrackTableList(netlink.ConntrackTable, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conntrack flows: %v", err)
+	}
+	return tunnelFlows(tunnel, conntrack), nil
+}
+
+// tunnelFlows picks the flows between the subnets of a tunnel, in either direction
+func tunnelFlows(tunnel *Tunnel, conntrack []*netlink.ConntrackFlow) []Flow {
+	_, local, err1 := net.ParseCIDR(tunnel.LocalSubnet)
+	_, remote, err2 := net.ParseCIDR(tunnel.RemoteSubnet)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+
+	var flows []Flow
+	for _, c := range conntrack {
+		orig := c.Forward
+		outbound := local.Contains(orig.SrcIP) && remote.Contains(orig.DstIP)
+		if !outbound && !(remote.Contains(orig.SrcIP) && local.Contains(orig.DstIP)) {
+			continue
+		}
+		flows = append(flows, Flow{
+			Proto:       orig.Protocol,
+			SrcIP:       orig.SrcIP,
+			DstIP:       orig.DstIP,
+			SrcPort:     orig.SrcPort,
+			DstPort:     orig.DstPort,
+			Outbound:    outbound,
+			SentBytes:   orig.Bytes,
+			RecvBytes:   c.Reverse.Bytes,
+			SentPackets: orig.Packets,
+			RecvPackets: c.Reverse.Packets,
+			Timeout:     time.Duration(c.TimeOut) * time.Second,
+		})
+	}
+	slices.SortStableFunc(flows, func(a, b Flow) int { return cmp.Compare(b.Bytes(), a.Bytes()) })
+	return flows
+}
+
+// protocolName names the protocols a tunnel's traffic policy knows
+func protocolName(proto uint8) string {
+	switch proto {
+	case unix.IPPROTO_TCP:
+		return "tcp"
+	case unix.IPPROTO_UDP:
+		return "udp"
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		return "icmp"
+	}
+	return strconv.Itoa(int(proto))
+}
+
+// endpoint formats an address, with the port for TCP and UDP
+func endpoint(ip net.IP, port uint16, proto uint8) string {
+	if proto != unix.IPPROTO_TCP && proto != unix.IPPROTO_UDP {
+		return ip.String()
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// InterfaceIndex returns the index of the tunnel interface in its network namespace
+func (t *Tunnel) InterfaceIndex() (int, error) {
+	handle, err := linkHandle(t)
+	if err != nil {
+		return 0, err
+	}
+	defer handle.Close()
+	link, err := handle.LinkByName(t.Interface())
+	if err != nil {
+		return 0, fmt.Errorf("interface %s not found: %v", t.Interface(), err)
+	}
+	return link.Attrs().Index, nil
+}
@@ -0,0 +1,400 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/vishvananda/netlink"
+)
+
+// Kinds of problem found by Fsck
+const (
+	FsckInvalid   = "invalid"   // A tunnel file that cannot be read or breaks the schema
+	FsckOrphan    = "orphan"    // A tunnel without its interface, or an interface or file without its tunnel
+	FsckDuplicate = "duplicate" // Tunnels with the same traffic selectors
+	FsckReused    = "reused"    // Key material or an SPI used more than once
+)
+
+// FsckProblem is an inconsistency between the tunnel store and itself or the kernel
+type FsckProblem struct {
+	Kind    string
+	Subject string // The tunnel, interface, file, key or SPI concerned
+	Message string
+	Repair  string // What Fix does, empty if the problem must be fixed by hand
+	fix     func() error
+}
+
+// Fix repairs the problem, if it can be repaired safely
+func (p *FsckProblem) Fix() error {
+	if p.fix == nil {
+		return fmt.Errorf("%s must be fixed by hand", p.Subject)
+	}
+	return p.fix()
+}
+
+// Fsck checks every tunnel file against the schema, and the tunnels against
+// their interfaces, SLA histories and debug transcripts, each other's traffic
+// selectors, the key store and the kernel's XFRM states. It only reads; the
+// problems it returns are repaired with Fix.
+func Fsck() ([]*FsckProblem, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(configDir, "tunnels", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []*FsckProblem
+	var tunnels []*Tunnel
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		tunnel, found := checkTunnelFile(file, name)
+		problems = append(problems, found...)
+		if tunnel != nil {
+			tunnels = append(tunnels, tunnel)
+		}
+	}
+	// Files that failed to load still count as tunnels for finding orphans
+	names := make(map[string]bool)
+	for _, file := range files {
+		names[strings.TrimSuffix(filepath.Base(file), ".json")] = true
+	}
+
+	for _, tunnel := range tunnels {
+		if tunnel.Responder() {
+			continue // Only its instances have interfaces
+		}
+		if p := checkInterface(tunnel); p != nil {
+			problems = append(problems, p)
+		}
+	}
+	problems = append(problems, orphanInterfaces(tunnels, names)...)
+	problems = append(problems, orphanFiles(configDir, names)...)
+	problems = append(problems, duplicateSelectors(tunnels)...)
+	problems = append(problems, reusedKeys(tunnels)...)
+	return problems, nil
+}
+
+// checkTunnelFile checks one tunnel file, returning the tunnel if it could be loaded
+func checkTunnelFile(file, name string) (*Tunnel, []*FsckProblem) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, []*FsckProblem{{Kind: FsckInvalid, Subject: file, Message: err.Error()}}
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, []*FsckProblem{{
+			Kind:    FsckInvalid,
+			Subject: file,
+			Message: fmt.Sprintf("not valid JSON: %v", err),
+			Repair:  "move it aside to " + filepath.Base(file) + ".corrupt",
+			fix:     func() error { return os.Rename(file, file+".corrupt") },
+		}}
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return nil, []*FsckProblem{{Kind: FsckInvalid, Subject: file, Message: err.Error()}}
+	}
+
+	var problems []*FsckProblem
+	if tunnel.Name != name {
+		stored := tunnel.Name
+		problems = append(problems, &FsckProblem{
+			Kind:    FsckInvalid,
+			Subject: name,
+			Message: fmt.Sprintf("the file holds tunnel '%s'", stored),
+			Repair:  "rename the tunnel to '" + name + "'",
+			fix: func() error {
+				t, err := loadTunnel(name)
+				if err != nil {
+					return err
+				}
+				t.Name = name
+				return saveTunnel(t)
+			},
+		})
+		tunnel.Name = name
+	}
+
+	if err := validateConfig(configOf(tunnel)); err != nil {
+		problems = append(problems, &FsckProblem{Kind: FsckInvalid, Subject: name, Message: err.Error()})
+	}
+	for _, field := range []struct{ key, value string }{
+		{"local_ip", tunnel.LocalIP},
+		{"remote_ip", tunnel.RemoteIP},
+		{"local_subnet", tunnel.LocalSubnet},
+		{"remote_subnet", tunnel.RemoteSubnet},
+	} {
+		if field.value == "" {
+			continue // Reported by validateConfig
+		}
+		if strings.HasSuffix(field.key, "_ip") && net.ParseIP(field.value) == nil && !(field.key == "remote_ip" && tunnel.Responder()) {
+			problems = append(problems, &FsckProblem{Kind: FsckInvalid, Subject: name,
+				Message: fmt.Sprintf("%s %q is not an IP address", field.key, field.value)})
+		}
+		if _, _, err := net.ParseCIDR(field.value); strings.HasSuffix(field.key, "_subnet") && err != nil {
+			problems = append(problems, &FsckProblem{Kind: FsckInvalid, Subject: name,
+				Message: fmt.Sprintf("%s %q is not a subnet", field.key, field.value)})
+		}
+	}
+	switch tunnel.Status {
+	case StatusUp, StatusDown, StatusError, StatusUnknown:
+	default:
+		problems = append(problems, &FsckProblem{
+			Kind:    FsckInvalid,
+			Subject: name,
+			Message: fmt.Sprintf("unknown status %q", tunnel.Status),
+			Repair:  "set the status to " + string(StatusUnknown),
+			fix:     func() error { return SetStatus(name, StatusUnknown, "repaired by fsck") },
+		})
+	}
+
+	// loadTunnel skips rules it cannot parse, so saving the tunnel drops them
+	rules, _ := raw["policy"].([]any)
+	for _, r := range rules {
+		s, _ := r.(string)
+		if _, err := ParseTrafficRule(s); err != nil {
+			problems = append(problems, &FsckProblem{
+				Kind:    FsckInvalid,
+				Subject: name,
+				Message: fmt.Sprintf("traffic policy rule %q: %v", s, err),
+				Repair:  "remove the rule",
+				fix: func() error {
+					t, err := loadTunnel(name)
+					if err != nil {
+						return err
+					}
+					return saveTunnel(t)
+				},
+			})
+		}
+	}
+	return tunnel, problems
+}
+
+// configOf returns the configuration a tunnel would have been created with
+func configOf(t *Tunnel) Config {
+	return Config{
+		Name:             t.Name,
+		LocalIP:          t.LocalIP,
+		RemoteIP:         t.RemoteIP,
+		LocalSubnet:      t.LocalSubnet,
+		RemoteSubnet:     t.RemoteSubnet,
+		Encryption:       t.Encryption,
+		PostQuantum:      t.PostQuantum,
+		Namespace:        t.Namespace,
+		KillSwitch:       t.KillSwitch,
+		RateLimit:        t.RateLimit,
+		PeerPin:          t.PeerPin,
+		PinTOFU:          t.PinTOFU,
+		PeerSpiffeID:     t.PeerSpiffeID,
+		Mode:             t.Mode,
+		WireGuardPeerKey: t.WireGuardPeerKey,
+		ListenPort:       t.ListenPort,
+		PSKRef:           t.PSKRef,
+		PeerGroup:        t.PeerGroup,
+		PeerID:           t.PeerID,
+		PeerCA:           t.PeerCA,
+		VirtualIPPool:    t.VirtualIPPool,
+		VirtualIPs:       t.VirtualIPs,
+		Shortcuts:        t.Shortcuts,
+	}
+}
+
+// checkInterface reports a tunnel whose interface is missing
+func checkInterface(tunnel *Tunnel) *FsckProblem {
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return &FsckProblem{Kind: FsckOrphan, Subject: tunnel.Name, Message: err.Error()}
+	}
+	defer handle.Close()
+	if _, err := handle.LinkByName(tunnel.Interface()); err == nil {
+		return nil
+	}
+
+	where := ""
+	if tunnel.Namespace != "" {
+		where = " in network namespace '" + tunnel.Namespace + "'"
+	}
+	return &FsckProblem{
+		Kind:    FsckOrphan,
+		Subject: tunnel.Name,
+		Message: fmt.Sprintf("interface %s%s is missing", tunnel.Interface(), where),
+		Repair:  "create the interface",
+		fix: func() error {
+			if err := createLink(tunnel); err != nil {
+				return err
+			}
+			if tunnel.Namespace != "" {
+				return moveToNamespace(tunnel)
+			}
+			return nil
+		},
+	}
+}
+
+// tunnelLink returns the tunnel a GRE or WireGuard interface was created for,
+// if its name and type say it was created by ipsec-vpn
+func tunnelLink(link netlink.Link) (string, bool) {
+	name := link.Attrs().Name
+	if tunnel, ok := strings.CutPrefix(name, "gre-"); ok && link.Type() == "gretun" {
+		return tunnel, true
+	}
+	if tunnel, ok := strings.CutPrefix(name, "wg-"); ok && link.Type() == "wireguard" {
+		return tunnel, true
+	}
+	return "", false
+}
+
+// orphanInterfaces reports tunnel interfaces, in the default namespace or one a
+// tunnel uses, that have no tunnel
+func orphanInterfaces(tunnels []*Tunnel, names map[string]bool) []*FsckProblem {
+	var problems []*FsckProblem
+	for _, l := range leftoverLinks(tunnels, names) {
+		problems = append(problems, &FsckProblem{
+			Kind:    FsckOrphan,
+			Subject: l.Name,
+			Message: l.Reason,
+			Repair:  "delete the interface",
+			fix:     l.Remove,
+		})
+	}
+	return problems
+}
+
+// orphanFiles reports SLA histories, keepalive and rekey counters, sync states, virtual
+// IP leases and debug transcripts of deleted tunnels
+func orphanFiles(configDir string, names map[string]bool) []*FsckProblem {
+	var problems []*FsckProblem
+	for _, pattern := range []string{filepath.Join("sla", "*.json"), filepath.Join("keepalive", "*.json"),
+		filepath.Join("rekeys", "*.json"), filepath.Join("sync", "*.json"), filepath.Join("leases", "*.json"), filepath.Join("debug", "*.log")} {
+		files, _ := filepath.Glob(filepath.Join(configDir, pattern))
+		for _, file := range files {
+			name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+			if names[name] {
+				continue
+			}
+			problems = append(problems, &FsckProblem{
+				Kind:    FsckOrphan,
+				Subject: file,
+				Message: fmt.Sprintf("there is no tunnel '%s'", name),
+				Repair:  "delete the file",
+				fix:     func() error { return os.Remove(file) },
+			})
+		}
+	}
+	return problems
+}
+
+// duplicateSelectors reports tunnels in the same namespace whose subnets are the
+// same, so their XFRM policies would match the same traffic
+func duplicateSelectors(tunnels []*Tunnel) []*FsckProblem {
+	var selectors []string
+	groups := make(map[string][]string)
+	for _, t := range tunnels {
+		_, local, err1 := net.ParseCIDR(t.LocalSubnet)
+		_, remote, err2 := net.ParseCIDR(t.RemoteSubnet)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		selector := local.String() + " -> " + remote.String()
+		if t.Namespace != "" {
+			selector += " in network namespace '" + t.Namespace + "'"
+		}
+		if _, ok := groups[selector]; !ok {
+			selectors = append(selectors, selector)
+		}
+		groups[selector] = append(groups[selector], t.Name)
+	}
+
+	var problems []*FsckProblem
+	for _, selector := range selectors {
+		if names := groups[selector]; len(names) > 1 {
+			problems = append(problems, &FsckProblem{
+				Kind:    FsckDuplicate,
+				Subject: strings.Join(names, ", "),
+				Message: "same traffic selectors " + selector,
+			})
+		}
+	}
+	return problems
+}
+
+// reusedKeys reports WireGuard peer keys shared by tunnels, stored keys with the
+// same key material, and XFRM states sharing an SPI or a key
+func reusedKeys(tunnels []*Tunnel) []*FsckProblem {
+	var problems []*FsckProblem
+	reused := func(subject string, users map[string][]string, order []string, format string) {
+		for _, k := range order {
+			if len(users[k]) > 1 {
+				problems = append(problems, &FsckProblem{Kind: FsckReused, Subject: subject,
+					Message: fmt.Sprintf(format, k, strings.Join(users[k], ", "))})
+			}
+		}
+	}
+	group := func(users map[string][]string, order *[]string, key, user string) {
+		if _, ok := users[key]; !ok {
+			*order = append(*order, key)
+		}
+		users[key] = append(users[key], user)
+	}
+
+	peerKeys, order := make(map[string][]string), []string(nil)
+	for _, t := range tunnels {
+		if t.WireGuardPeerKey != "" {
+			group(peerKeys, &order, t.WireGuardPeerKey, t.Name)
+		}
+	}
+	reused("wireguard_peer_key", peerKeys, order, "peer key %s is used by tunnels %s")
+
+	if stored, err := keys.ListAll(); err == nil {
+		fingerprints, order := make(map[string][]string), []string(nil)
+		for _, k := range stored {
+			group(fingerprints, &order, k.Fingerprint, k.Name)
+		}
+		reused("key store", fingerprints, order, "key material %s is stored as keys %s")
+	}
+
+	// Without CAP_NET_ADMIN the states cannot be listed, which the self-test reports
+	states, err := network.Handle().XfrmStateList(netlink.FAMILY_ALL)
+	if err != nil {
+		return problems
+	}
+	spis, spiOrder := make(map[string][]string), []string(nil)
+	material, keyOrder := make(map[string][]string), []string(nil)
+	for _, s := range states {
+		state := fmt.Sprintf("%s->%s", s.Src, s.Dst)
+		group(spis, &spiOrder, fmt.Sprintf("%s 0x%08x", s.Proto, uint32(s.Spi)), state)
+		for _, k := range [][]byte{aeadKey(s), cryptKey(s)} {
+			if len(k) > 0 {
+				group(material, &keyOrder, fmt.Sprintf("SHA256:%x", sha256.Sum256(k))[:23], state)
+			}
+		}
+	}
+	reused("XFRM SPI", spis, spiOrder, "SPI %s is used by states %s")
+	reused("XFRM key", material, keyOrder, "key %s is used by states %s")
+	return problems
+}
+
+func aeadKey(s netlink.XfrmState) []byte {
+	if s.Aead == nil {
+		return nil
+	}
+	return s.Aead.Key
+}
+
+func cryptKey(s netlink.XfrmState) []byte {
+	if s.Crypt == nil {
+		return nil
+	}
+	return s.Crypt.Key
+}
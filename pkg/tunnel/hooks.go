@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Points in the life of a tunnel at which hook scripts run
+const (
+	HookPreUp    = "pre-up"
+	HookPostUp   = "post-up"
+	HookPreDown  = "pre-down"
+	HookPostDown = "post-down"
+)
+
+// hookTimeout is how long a hook script may run before it is killed
+const hookTimeout = 30 * time.Second
+
+// Hooks are shell commands run as a tunnel comes up and goes down, in the manner
+// of strongSwan's updown script. A failing pre-up or pre-down hook stops the
+// tunnel from being started or stopped; post-up and post-down hooks are only
+// logged when they fail.
+type Hooks struct {
+	PreUp    string `json:"pre_up,omitempty"`
+	PostUp   string `json:"post_up,omitempty"`
+	PreDown  string `json:"pre_down,omitempty"`
+	PostDown string `json:"post_down,omitempty"`
+}
+
+// command returns the hook to run at a point, empty if there is none
+func (h *Hooks) command(point string) string {
+	if h == nil {
+		return ""
+	}
+	switch point {
+	case HookPreUp:
+		return h.PreUp
+	case HookPostUp:
+		return h.PostUp
+	case HookPreDown:
+		return h.PreDown
+	case HookPostDown:
+		return h.PostDown
+	}
+	return ""
+}
+
+// SetHooks sets the hook scripts of a tunnel, or removes them if hooks is nil
+func SetHooks(name string, hooks *Hooks) error {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+
+	if hooks != nil && *hooks == (Hooks{}) {
+		return errors.New("no hooks given")
+	}
+	tunnel.Hooks = hooks
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// runHook runs the hook of a tunnel for a point through the shell, with the
+// tunnel described in IPSEC_VPN_* environment variables
+func runHook(tunnel *Tunnel, point string) error {
+	command := tunnel.Hooks.command(point)
+	if command == "" || simulating {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), hookEnv(tunnel, point)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s hook failed: %v: %s", point, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// hookEnv describes a tunnel to a hook script
+func hookEnv(tunnel *Tunnel, point string) []string {
+	return []string{
+		"IPSEC_VPN_VERB=" + point,
+		"IPSEC_VPN_TUNNEL=" + tunnel.Name,
+		"IPSEC_VPN_MODE=" + tunnel.Mode,
+		"IPSEC_VPN_INTERFACE=" + tunnel.Interface(),
+		"IPSEC_VPN_NAMESPACE=" + tunnel.Namespace,
+		"IPSEC_VPN_LOCAL_IP=" + tunnel.LocalIP,
+		"IPSEC_VPN_REMOTE_IP=" + tunnel.RemoteIP,
+		"IPSEC_VPN_LOCAL_SUBNET=" + tunnel.LocalSubnet,
+		"IPSEC_VPN_REMOTE_SUBNET=" + tunnel.RemoteSubnet,
+	}
+}
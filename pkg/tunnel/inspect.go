@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// Ways of passing a tunnel's decrypted traffic through an IDS or IPS
+const (
+	InspectInterface = "interface" // Route it through an interface the inspection device sits behind
+	InspectQueue     = "nfqueue"   // Hand it to a program, such as Suricata, on an NFQUEUE
+)
+
+// Inspection sends the decrypted traffic of a tunnel through an IDS or IPS
+// before it reaches the local subnet
+type Inspection struct {
+	Type      string `json:"type"`
+	Interface string `json:"interface,omitempty"` // Interface to route through, with InspectInterface
+	Gateway   string `json:"gateway,omitempty"`   // Next hop on Interface, if the device is not on the link
+	Queue     uint16 `json:"queue"`               // Queue number, with InspectQueue
+	Bypass    bool   `json:"bypass"`              // Let traffic through while nothing listens on the queue
+}
+
+// validate checks an inspection setting
+func (i *Inspection) validate() error {
+	switch i.Type {
+	case InspectInterface:
+		if i.Interface == "" {
+			return errors.New("an inspection interface is required")
+		}
+		if i.Gateway != "" && net.ParseIP(i.Gateway) == nil {
+			return fmt.Errorf("invalid gateway '%s'", i.Gateway)
+		}
+		if i.Bypass {
+			return errors.New("bypass only applies to nfqueue inspection")
+		}
+	case InspectQueue:
+		if i.Interface != "" || i.Gateway != "" {
+			return errors.New("nfqueue inspection takes no interface or gateway")
+		}
+	default:
+		return fmt.Errorf("unknown inspection type '%s', expected %s or %s", i.Type, InspectInterface, InspectQueue)
+	}
+	return nil
+}
+
+func (i *Inspection) String() string {
+	switch {
+	case i.Type == InspectQueue && i.Bypass:
+		return fmt.Sprintf("NFQUEUE %d (bypassed while nothing listens)", i.Queue)
+	case i.Type == InspectQueue:
+		return fmt.Sprintf("NFQUEUE %d", i.Queue)
+	case i.Gateway != "":
+		return fmt.Sprintf("via %s on %s", i.Gateway, i.Interface)
+	default:
+		return "through " + i.Interface
+	}
+}
+
+// SetInspection sends the decrypted traffic of a tunnel through an IDS or IPS,
+// or stops doing so if inspection is nil. A tunnel that is up is switched over
+// straight away.
+func SetInspection(name string, inspection *Inspection) error {
+	if err := RequireSelfTest(); err != nil {
+		return err
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+	if inspection != nil {
+		if err := inspection.validate(); err != nil {
+			return err
+		}
+	}
+
+	if tunnel.Status == StatusUp {
+		if err := removeInspection(tunnel); err != nil {
+			return err
+		}
+		tunnel.Inspection = inspection
+		if err := installInspection(tunnel); err != nil {
+			return err
+		}
+	}
+
+	tunnel.Inspection = inspection
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// installInspection diverts the traffic a tunnel carries to its local subnet
+// through the tunnel's inspection interface or queue
+func installInspection(tunnel *Tunnel) error {
+	i := tunnel.Inspection
+	if i == nil {
+		return nil
+	}
+
+	tunnelLog.Debug("Inspecting traffic of tunnel", "tunnel", tunnel.Name, "inspection", i)
+	if i.Type == InspectQueue {
+		return inNamespace(tunnel, func() error {
+			return network.SetInspectQueue(tunnel.Interface(), tunnel.LocalSubnet, i.Queue, i.Bypass)
+		})
+	}
+
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	return network.SetInspectRoute(handle, tunnel.Interface(), tunnel.LocalSubnet, i.Interface, i.Gateway)
+}
+
+// removeInspection lets the traffic of a tunnel reach its local subnet directly again
+func removeInspection(tunnel *Tunnel) error {
+	i := tunnel.Inspection
+	if i == nil {
+		return nil
+	}
+
+	if i.Type == InspectQueue {
+		return inNamespace(tunnel, func() error { return network.ClearInspectQueue(tunnel.Interface()) })
+	}
+
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	return network.ClearInspectRoute(handle, tunnel.Interface())
+}
@@ -0,0 +1,147 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+)
+
+// journalRetention is how many months of lifecycle events the journal keeps,
+// enough for a report on the same month a year before
+const journalRetention = 13
+
+// journalMonth is the layout of the name of each month's journal file
+const journalMonth = "2006-01"
+
+// publish sends a lifecycle event carrying the tunnel's status, and records it
+// in the journal of the state directory
+func (m *Manager) publish(t *Tunnel, typ string) {
+	e := events.New(typ, t.Name)
+	e.Status = string(t.Status)
+	e.Reason = t.Reason
+	if err := m.record(e); err != nil {
+		m.logger().Error("Failed to record event in the journal", "tunnel", t.Name, "type", typ, "err", err)
+	}
+	m.send(e)
+}
+
+// send publishes an event where the Manager publishes events
+func (m *Manager) send(e events.Event) {
+	if m.sink != nil {
+		m.sink(e)
+	}
+}
+
+// record appends an event to the journal of the month it happened in,
+// <state dir>/journal/2026-10.jsonl, and removes the months past retention
+// when it starts a new one
+func (m *Manager) record(e events.Event) error {
+	dir, err := m.journalDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, e.Time.Format(journalMonth)+".jsonl")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		pruneJournal(dir, e.Time)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pruneJournal removes the months of the journal past retention at a time
+func pruneJournal(dir string, now time.Time) {
+	oldest := time.Date(now.Year(), now.Month()-journalRetention+1, 1, 0, 0, 0, 0, time.UTC).Format(journalMonth)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	for _, file := range files {
+		if month := strings.TrimSuffix(filepath.Base(file), ".jsonl"); month < oldest {
+			_ = os.Remove(file)
+		}
+	}
+}
+
+// Journal returns the lifecycle events of the tunnels up to a time, oldest
+// first: when each was created, went up, down or into error and was deleted
+func Journal(to time.Time) ([]events.Event, error) {
+	return std.Journal(to)
+}
+
+// Journal returns the lifecycle events of the tunnels up to a time, oldest first
+func (m *Manager) Journal(to time.Time) ([]events.Event, error) {
+	dir, err := m.journalDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	last := to.UTC().Format(journalMonth)
+	var journal []events.Event
+	for _, file := range files {
+		if strings.TrimSuffix(filepath.Base(file), ".jsonl") > last {
+			continue
+		}
+		month, err := readJournal(file, to)
+		if err != nil {
+			return nil, err
+		}
+		journal = append(journal, month...)
+	}
+	slices.SortStableFunc(journal, func(a, b events.Event) int { return a.Time.Compare(b.Time) })
+	return journal, nil
+}
+
+// readJournal reads the events of a journal file up to a time. A line cut
+// short, as by a crash while it was written, is skipped.
+func readJournal(path string, to time.Time) ([]events.Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var journal []events.Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e events.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if !e.Time.After(to) {
+			journal = append(journal, e)
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, bufio.ErrTooLong) {
+		return nil, err
+	}
+	return journal, nil
+}
+
+// journalDir returns the directory of the journal
+func (m *Manager) journalDir() (string, error) {
+	dir, err := m.dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "journal"), nil
+}
@@ -0,0 +1,170 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// keepalivePort is the port keepalives are sent to, the discard service (RFC 863)
+const keepalivePort = 9
+
+// keepalivePayload is the content of a keepalive, small enough to cost nothing
+var keepalivePayload = []byte("ipsec-vpn keepalive")
+
+// KeepaliveStats counts the keepalives sent through a tunnel
+type KeepaliveStats struct {
+	Sent      uint64    `json:"sent"`
+	Failed    uint64    `json:"failed"`
+	LastSent  time.Time `json:"last_sent,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// SetKeepalive makes a tunnel carry a keepalive every interval, or stops it and
+// drops its counters if interval is 0
+func SetKeepalive(name string, interval time.Duration) error {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+	if interval != 0 && interval < time.Second {
+		return fmt.Errorf("interval must be at least 1s, got %s", interval)
+	}
+	if interval == 0 {
+		if path, err := keepaliveStatsPath(name); err == nil {
+			_ = os.Remove(path)
+		}
+	}
+
+	tunnel.Keepalive = interval
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// keepaliveTarget returns where the keepalives of a tunnel go: the discard port
+// of the first address in its remote subnet, which is routed through the tunnel
+// whether or not a host answers there
+func keepaliveTarget(tunnel *Tunnel) (string, error) {
+	_, remote, err := net.ParseCIDR(tunnel.RemoteSubnet)
+	if err != nil {
+		return "", fmt.Errorf("invalid remote subnet: %v", err)
+	}
+	ip := remote.IP.To4()
+	if ip == nil {
+		ip = remote.IP.To16()
+	}
+	target := make(net.IP, len(ip))
+	copy(target, ip)
+	if ones, bits := remote.Mask.Size(); ones < bits {
+		target[len(target)-1]++
+	}
+	return net.JoinHostPort(target.String(), fmt.Sprint(keepalivePort)), nil
+}
+
+// SendKeepalive sends one keepalive through a tunnel and counts it. The packet is
+// bound to the tunnel interface, so it is encapsulated and encrypted like any
+// other traffic and refreshes the state of NAT devices and firewalls on the path
+// to the peer, whatever DPD does.
+func SendKeepalive(name string) (*KeepaliveStats, error) {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return nil, err
+	}
+	if tunnel.Keepalive == 0 {
+		return nil, fmt.Errorf("tunnel '%s' has no keepalive configured", name)
+	}
+	target, sendErr := keepaliveTarget(tunnel)
+	if sendErr == nil {
+		sendErr = inNamespace(tunnel, func() error {
+			dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+				var err error
+				if ctrlErr := c.Control(func(fd uintptr) {
+					err = unix.BindToDevice(int(fd), tunnel.Interface())
+				}); ctrlErr != nil {
+					return ctrlErr
+				}
+				return err
+			}}
+			conn, err := dialer.Dial("udp", target)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			_, err = conn.Write(keepalivePayload)
+			return err
+		})
+	}
+
+	stats, err := KeepaliveCounters(name)
+	if err != nil {
+		return nil, err
+	}
+	if sendErr != nil {
+		stats.Failed++
+		stats.LastError = sendErr.Error()
+	} else {
+		stats.Sent++
+		stats.LastSent = time.Now()
+		stats.LastError = ""
+	}
+	if err := saveKeepaliveStats(name, stats); err != nil {
+		return nil, err
+	}
+	return stats, sendErr
+}
+
+// keepaliveStatsPath returns the file the keepalive counters of a tunnel are kept in
+func keepaliveStatsPath(name string) (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "keepalive", name+".json"), nil
+}
+
+// KeepaliveCounters returns the keepalive counters of a tunnel, zero if it has
+// not sent any
+func KeepaliveCounters(name string) (*KeepaliveStats, error) {
+	path, err := keepaliveStatsPath(name)
+	if err != nil {
+		return nil, err
+	}
+	stats := &KeepaliveStats{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, stats); err != nil {
+		return nil, fmt.Errorf("failed to read keepalive counters of tunnel '%s': %v", name, err)
+	}
+	return stats, nil
+}
+
+// saveKeepaliveStats replaces the keepalive counters of a tunnel
+func saveKeepaliveStats(name string, stats *KeepaliveStats) error {
+	path, err := keepaliveStatsPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
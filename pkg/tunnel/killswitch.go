@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// KillSwitchEnabled reports whether traffic to the remote subnet must be dropped
+// while the tunnel is down, either for this tunnel or for all tunnels of its
+// Manager, with security.kill_switch
+func (t *Tunnel) KillSwitchEnabled() bool {
+	return t.KillSwitch || t.config().KillSwitch
+}
+
+// SetKillSwitch turns the kill-switch of a tunnel on or off, installing or
+// removing its block route straight away
+func SetKillSwitch(name string, enabled bool) error {
+	if err := RequireSelfTest(); err != nil {
+		return err
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+
+	tunnel.KillSwitch = enabled
+	if tunnel.KillSwitchEnabled() {
+		if !enabled {
+			return errors.New("the kill-switch is on for all tunnels, turn off security.kill_switch first")
+		}
+		if err := installKillSwitch(tunnel); err != nil {
+			return err
+		}
+	} else if tunnel.RemoteSubnet != "" {
+		if err := network.DeleteBlockRoute(tunnel.RemoteSubnet); err != nil {
+			return err
+		}
+	}
+
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// installKillSwitch installs the block route of a tunnel with the kill-switch on.
+// The route stays in place while the tunnel is up, where the tunnel's own routes
+// take precedence, so there is no window in which traffic can leak while the
+// tunnel goes down.
+func installKillSwitch(tunnel *Tunnel) error {
+	if !tunnel.KillSwitchEnabled() || tunnel.RemoteSubnet == "" {
+		return nil
+	}
+
+	tunnelLog.Debug("Kill-switch on, blocking the remote subnet outside the tunnel", "tunnel", tunnel.Name, "subnet", tunnel.RemoteSubnet)
+	return network.AddBlockRoute(tunnel.RemoteSubnet)
+}
+
+// removeKillSwitch removes the block route of a tunnel with the kill-switch on
+func removeKillSwitch(tunnel *Tunnel) error {
+	if !tunnel.KillSwitchEnabled() || tunnel.RemoteSubnet == "" {
+		return nil
+	}
+	return network.DeleteBlockRoute(tunnel.RemoteSubnet)
+}
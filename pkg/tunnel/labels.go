@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxLabelLength bounds the length of label keys and values
+const maxLabelLength = 63
+
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+	labelValuePattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?)?$`)
+)
+
+// ValidateLabels checks that label keys and values can be told apart in a
+// selector: keys and values are alphanumeric with '.', '_' and '-' inside, keys
+// may also contain '/', and neither is longer than 63 characters
+func ValidateLabels(labels map[string]string) error {
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		if len(key) > maxLabelLength || !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if value := labels[key]; len(value) > maxLabelLength || !labelValuePattern.MatchString(value) {
+			return fmt.Errorf("invalid value %q of label %q", value, key)
+		}
+	}
+	return nil
+}
+
+// SetLabels replaces the labels of a tunnel, which group tunnels for selectors
+// such as 'tunnel show --selector site=fra'
+func SetLabels(name string, labels map[string]string) error {
+	if err := ValidateLabels(labels); err != nil {
+		return err
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+
+	tunnel.Labels = nil
+	if len(labels) > 0 {
+		tunnel.Labels = maps.Clone(labels)
+	}
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// FormatLabels formats labels as key=value pairs sorted by key
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// labelRequirement is one comma-separated term of a selector
+type labelRequirement struct {
+	key   string
+	value string
+	op    string // "=", "!=", "exists" or "!exists"
+}
+
+// Selector selects tunnels by their labels. Terms are separated by commas and
+// must all hold: key=value (or key==value), key!=value, key for a label that is
+// set and !key for one that is not.
+type Selector []labelRequirement
+
+// ParseSelector parses a label selector such as "site=fra,env!=lab"
+func ParseSelector(s string) (Selector, error) {
+	var selector Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		var r labelRequirement
+		switch {
+		case term == "":
+			continue
+		case strings.Contains(term, "!="):
+			r.key, r.value, _ = strings.Cut(term, "!=")
+			r.op = "!="
+		case strings.Contains(term, "="):
+			r.key, r.value, _ = strings.Cut(term, "=")
+			r.value = strings.TrimPrefix(r.value, "=")
+			r.op = "="
+		case strings.HasPrefix(term, "!"):
+			r.key, r.op = strings.TrimPrefix(term, "!"), "!exists"
+		default:
+			r.key, r.op = term, "exists"
+		}
+		r.key, r.value = strings.TrimSpace(r.key), strings.TrimSpace(r.value)
+		if err := ValidateLabels(map[string]string{r.key: r.value}); err != nil {
+			return nil, fmt.Errorf("invalid selector term %q: %v", term, err)
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+// Matches reports whether labels satisfy every term of the selector
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		value, ok := labels[r.key]
+		switch r.op {
+		case "=":
+			if !ok || value != r.value {
+				return false
+			}
+		case "!=":
+			if ok && value == r.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
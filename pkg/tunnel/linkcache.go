@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// links caches the interfaces of the root namespace while WatchLinks runs
+var links = &linkCache{}
+
+// linkCache holds whether each interface is up, by name
+type linkCache struct {
+	mu       sync.RWMutex
+	watching bool
+	up       map[string]bool
+	names    map[int]string // By index, to follow renames
+}
+
+// WatchLinks keeps a cache of the interfaces in the root namespace, updated
+// from netlink link events, until ctx is done. While it runs, the status of a
+// tunnel and the drift of its interface are looked up in the cache rather than
+// with a netlink request per tunnel, so listing hundreds of tunnels stays fast.
+// Long-running commands such as 'restconf serve' run it.
+func WatchLinks(ctx context.Context) error {
+	updates := make(chan netlink.LinkUpdate, 64)
+	done := make(chan struct{})
+	defer close(done)
+	errs := make(chan error, 1)
+	err := netlink.LinkSubscribeWithOptions(updates, done, netlink.LinkSubscribeOptions{
+		ErrorCallback: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to link events: %v", err)
+	}
+
+	// Events queued while listing are newer than the list, so apply them after it
+	existing, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+	links.reset(existing)
+	defer links.reset(nil)
+	tunnelLog.Debug("Watching link events", "links", len(existing))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return fmt.Errorf("failed to receive link events: %v", err)
+		case u, ok := <-updates:
+			if !ok {
+				return errors.New("link events stopped")
+			}
+			links.update(u.Header.Type == unix.RTM_DELLINK, u.Link)
+		}
+	}
+}
+
+// reset fills the cache with a list of links, or empties it and stops its
+// use without one
+func (c *linkCache) reset(list []netlink.Link) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watching = list != nil
+	c.up = make(map[string]bool, len(list))
+	c.names = make(map[int]string, len(list))
+	for _, link := range list {
+		c.set(link)
+	}
+}
+
+// update applies a link event
+func (c *linkCache) update(deleted bool, link netlink.Link) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !deleted {
+		c.set(link)
+		return
+	}
+	attrs := link.Attrs()
+	delete(c.up, attrs.Name)
+	delete(c.names, attrs.Index)
+}
+
+func (c *linkCache) set(link netlink.Link) {
+	attrs := link.Attrs()
+	if old, ok := c.names[attrs.Index]; ok && old != attrs.Name {
+		delete(c.up, old)
+	}
+	c.names[attrs.Index] = attrs.Name
+	c.up[attrs.Name] = attrs.Flags&unix.IFF_UP != 0
+}
+
+// lookup returns whether an interface exists and is up, and whether the cache
+// knows, which it only does while WatchLinks runs
+func (c *linkCache) lookup(name string) (exists, up, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.watching {
+		return false, false, false
+	}
+	up, exists = c.up[name]
+	return exists, up, true
+}
@@ -0,0 +1,355 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/geoip"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+)
+
+// ErrLoginPolicyNotFound is returned for login policies that do not exist
+var ErrLoginPolicyNotFound = errors.New("login policy not found")
+
+// LoginPolicy limits when, from where and how many times at once the
+// identities matching a pattern may connect to responders. It is checked when
+// the IKE daemon reports an initiator that authenticated, with 'tunnel
+// accept', and an initiator it refuses is rejected with the reason. Every
+// policy matching an identity applies.
+type LoginPolicy struct {
+	Name        string    `json:"name"`
+	Identity    string    `json:"identity"`               // Pattern of the identities it applies to, as a responder's peer ID
+	MaxSessions int       `json:"max_sessions,omitempty"` // Sessions an identity may have at once on all responders
+	Days        []string  `json:"days,omitempty"`         // Days it may connect on, every day without any
+	Start       string    `json:"start,omitempty"`        // HH:MM in local time it may connect from, any time if empty
+	End         string    `json:"end,omitempty"`
+	Countries   []string  `json:"countries,omitempty"` // ISO 3166-1 alpha-2 codes of the countries it may connect from
+	Networks    []string  `json:"networks,omitempty"`  // Networks it may connect from, besides those countries
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// locateSource looks up where the address of an initiator is, for the
+// countries of login policies
+var locateSource = func(ip net.IP) (geoip.Location, error) {
+	locator, err := geoip.LocatorFromConfig()
+	if err != nil {
+		return geoip.Location{}, err
+	}
+	if locator == nil {
+		return geoip.Location{}, errors.New("no GeoIP database, set security.geoip_country_database")
+	}
+	return locator.Locate(ip)
+}
+
+// Validate checks the settings of a login policy, normalizing its days,
+// countries and networks
+func (p *LoginPolicy) Validate() error {
+	if !keys.ValidName(p.Name) {
+		return fmt.Errorf("invalid login policy name: %s", p.Name)
+	}
+	if p.Identity == "" {
+		return errors.New("an identity pattern is required")
+	}
+	if _, err := path.Match(p.Identity, ""); err != nil {
+		return fmt.Errorf("invalid identity pattern %q: %v", p.Identity, err)
+	}
+	if p.MaxSessions < 0 {
+		return fmt.Errorf("invalid maximum of sessions %d", p.MaxSessions)
+	}
+	for i, day := range p.Days {
+		p.Days[i] = strings.ToLower(day)
+		if !slices.Contains(ScheduleDays, p.Days[i]) {
+			return fmt.Errorf("invalid day %q, expected one of %s", day, strings.Join(ScheduleDays, ", "))
+		}
+	}
+	if (p.Start == "") != (p.End == "") {
+		return errors.New("hours need both a start and an end")
+	}
+	for _, clock := range []string{p.Start, p.End} {
+		if _, err := parseClock(clock); clock != "" && err != nil {
+			return err
+		}
+	}
+	for i, country := range p.Countries {
+		p.Countries[i] = strings.ToUpper(country)
+		if len(country) != 2 || strings.Trim(p.Countries[i], "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return fmt.Errorf("invalid country %q, expected an ISO 3166-1 alpha-2 code such as DE", country)
+		}
+	}
+	for i, network := range p.Networks {
+		_, subnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return fmt.Errorf("invalid network %q", network)
+		}
+		p.Networks[i] = subnet.String()
+	}
+	if p.MaxSessions == 0 && len(p.Days) == 0 && p.Start == "" && len(p.Countries) == 0 && len(p.Networks) == 0 {
+		return errors.New("a login policy needs a maximum of sessions, days, hours, countries or networks")
+	}
+	return nil
+}
+
+// Applies reports whether a login policy applies to an identity
+func (p *LoginPolicy) Applies(id string) bool {
+	ok, _ := path.Match(p.Identity, id)
+	return ok
+}
+
+// Hours formats the days and hours a login policy allows
+func (p *LoginPolicy) Hours() string {
+	if len(p.Days) == 0 && p.Start == "" {
+		return "any time"
+	}
+	days := "daily"
+	if len(p.Days) > 0 {
+		days = strings.Join(p.Days, ",")
+	}
+	if p.Start == "" {
+		return days
+	}
+	return fmt.Sprintf("%s-%s %s", p.Start, p.End, days)
+}
+
+// Sources formats the countries and networks a login policy allows
+func (p *LoginPolicy) Sources() string {
+	sources := slices.Concat(p.Countries, p.Networks)
+	if len(sources) == 0 {
+		return "anywhere"
+	}
+	return strings.Join(sources, ",")
+}
+
+// OpenAt reports whether a login policy allows connecting at a time
+func (p *LoginPolicy) OpenAt(now time.Time) bool {
+	start, end := p.Start, p.End
+	if start == "" {
+		start, end = "00:00", "00:00"
+	}
+	return windowOpen(p.Days, start, end, now)
+}
+
+// refusal returns why a login policy refuses an identity connecting from an
+// address at a time while it has sessions on other responders, or "" if it
+// does not
+func (p *LoginPolicy) refusal(address string, now time.Time, sessions int) string {
+	if !p.OpenAt(now) {
+		return fmt.Sprintf("login policy %s allows connecting %s only", p.Name, p.Hours())
+	}
+	if len(p.Countries) > 0 || len(p.Networks) > 0 {
+		if reason := p.sourceRefusal(net.ParseIP(address)); reason != "" {
+			return reason
+		}
+	}
+	if p.MaxSessions > 0 && sessions >= p.MaxSessions {
+		return fmt.Sprintf("login policy %s allows %d connected at once and the identity has %d", p.Name, p.MaxSessions, sessions)
+	}
+	return ""
+}
+
+// sourceRefusal returns why a login policy refuses an address, or "" if it is
+// in one of its networks or countries. Private and other non-global addresses
+// are not in GeoIP databases and pass the countries, as with the guard of the
+// IKE responder.
+func (p *LoginPolicy) sourceRefusal(ip net.IP) string {
+	for _, network := range p.Networks {
+		if _, subnet, _ := net.ParseCIDR(network); subnet != nil && subnet.Contains(ip) {
+			return ""
+		}
+	}
+	if len(p.Countries) == 0 {
+		return fmt.Sprintf("login policy %s allows connecting from %s only", p.Name, p.Sources())
+	}
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return ""
+	}
+	loc, err := locateSource(ip)
+	if err != nil {
+		return fmt.Sprintf("login policy %s cannot locate %s: %v", p.Name, ip, err)
+	}
+	if slices.Contains(p.Countries, loc.Country) {
+		return ""
+	}
+	country := loc.Country
+	if country == "" {
+		country = "unknown"
+	}
+	return fmt.Sprintf("login policy %s allows connecting from %s only, not %s (country %s)", p.Name, p.Sources(), ip, country)
+}
+
+// checkLogin applies the login policies to an initiator a responder accepts,
+// and rejects it with the reason, logged and published in a
+// tunnel.session.rejected event, if one refuses it
+func (m *Manager) checkLogin(responder *Tunnel, id, address string, now time.Time) error {
+	policies, err := m.LoginPolicies()
+	if err != nil {
+		return err
+	}
+	policies = slices.DeleteFunc(policies, func(p *LoginPolicy) bool { return !p.Applies(id) })
+	if len(policies) == 0 {
+		return nil
+	}
+
+	// The initiator's session on this responder is replaced, not added to
+	sessions := 0
+	tunnels, err := m.ListConfigured()
+	if err != nil {
+		return err
+	}
+	for _, t := range tunnels {
+		if t.Template != "" && t.Template != responder.Name && t.PeerIdentity == id {
+			sessions++
+		}
+	}
+
+	for _, p := range policies {
+		reason := p.refusal(address, now, sessions)
+		if reason == "" {
+			continue
+		}
+		m.logger().Error("Rejected initiator", "tunnel", responder.Name, "id", id, "address", address, "policy", p.Name, "reason", reason)
+		e := events.New(events.TypeSessionRejected, responder.Name)
+		e.Reason = reason
+		e.Source = address
+		e.PeerID = id
+		if err := m.record(e); err != nil {
+			m.logger().Error("Failed to record event in the journal", "tunnel", responder.Name, "type", e.Type, "err", err)
+		}
+		m.send(e)
+		return fmt.Errorf("%w: %s: %s", ErrPeerRejected, id, reason)
+	}
+	return nil
+}
+
+// GetLoginPolicy returns a login policy
+func GetLoginPolicy(name string) (*LoginPolicy, error) {
+	return std.LoginPolicy(name)
+}
+
+// LoginPolicy returns a login policy
+func (m *Manager) LoginPolicy(name string) (*LoginPolicy, error) {
+	path, err := m.loginPolicyPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrLoginPolicyNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p LoginPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid login policy %s: %v", name, err)
+	}
+	return &p, nil
+}
+
+// LoginPolicies returns the login policies sorted by name
+func LoginPolicies() ([]*LoginPolicy, error) {
+	return std.LoginPolicies()
+}
+
+// LoginPolicies returns the login policies sorted by name
+func (m *Manager) LoginPolicies() ([]*LoginPolicy, error) {
+	dir, err := m.loginPoliciesDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var policies []*LoginPolicy
+	for _, file := range files {
+		p, err := m.LoginPolicy(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// SaveLoginPolicy creates or changes a login policy. It applies to the
+// initiators accepted from then on; those connected keep their sessions.
+func SaveLoginPolicy(p *LoginPolicy) error {
+	return std.SaveLoginPolicy(p)
+}
+
+// SaveLoginPolicy creates or changes a login policy
+func (m *Manager) SaveLoginPolicy(p *LoginPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	dir, err := m.loginPoliciesDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	p.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, p.Name+".json"), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	m.logger().Info("Saved login policy", "policy", p.Name, "identity", p.Identity, "max_sessions", p.MaxSessions,
+		"hours", p.Hours(), "sources", p.Sources())
+	return nil
+}
+
+// DeleteLoginPolicy deletes a login policy
+func DeleteLoginPolicy(name string) error {
+	return std.DeleteLoginPolicy(name)
+}
+
+// DeleteLoginPolicy deletes a login policy
+func (m *Manager) DeleteLoginPolicy(name string) error {
+	path, err := m.loginPolicyPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrLoginPolicyNotFound, name)
+	} else if err != nil {
+		return err
+	}
+	m.logger().Info("Deleted login policy", "policy", name)
+	return nil
+}
+
+// loginPoliciesDir returns the directory of the login policies
+func (m *Manager) loginPoliciesDir() (string, error) {
+	dir, err := m.dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "login-policies"), nil
+}
+
+// loginPolicyPath returns the file of a login policy
+func (m *Manager) loginPolicyPath(name string) (string, error) {
+	if !keys.ValidName(name) {
+		return "", fmt.Errorf("invalid login policy name: %s", name)
+	}
+	dir, err := m.loginPoliciesDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
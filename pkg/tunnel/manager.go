@@ -0,0 +1,326 @@
+package tunnel
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/retry"
+	"github.com/vishvananda/netns"
+)
+
+// Logger receives the messages of the package: constant messages with
+// key-value pairs, as in log/slog. *slog.Logger and logger.Structured satisfy it.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Where the package logs to, by module of the ipsec-vpn log
+var (
+	tunnelLog  Logger = logger.Structured{Module: logger.Tunnel}
+	xfrmLog    Logger = logger.Structured{Module: logger.XFRM}
+	ikeLog     Logger = logger.Structured{Module: logger.IKE}
+	networkLog Logger = logger.Structured{Module: logger.Network}
+)
+
+// SetLogger sends the messages of the package, such as those of
+// NetlinkBackend, to a logger of the program embedding it. It is not safe to
+// call while tunnels are managed.
+func SetLogger(l Logger) {
+	tunnelLog, xfrmLog, ikeLog, networkLog = l, l, l, l
+}
+
+// Backend makes the changes to the system that the tunnels of a Manager need.
+// NetlinkBackend configures the kernel; another backend lets a service manage
+// the interfaces itself, or tests run without root.
+type Backend interface {
+	// Create sets up the interface of a new tunnel, undoing its changes if one fails
+	Create(t *Tunnel) error
+	// Guard makes sure traffic to the remote subnet of a tunnel with its
+	// kill-switch on is dropped while the tunnel is not up
+	Guard(t *Tunnel) error
+	// Start brings a tunnel up
+	Start(t *Tunnel) error
+	// Stop takes a tunnel down
+	Stop(t *Tunnel) error
+	// Route installs or removes the default route of a tunnel carrying all traffic
+	Route(t *Tunnel, up bool) error
+	// Status returns the current status of a tunnel
+	Status(t *Tunnel) (Status, error)
+	// Delete removes everything set up for a tunnel. With force, it carries on
+	// past errors and returns the first.
+	Delete(t *Tunnel, force bool) error
+}
+
+// Options configure a Manager. The zero value of each field selects what the
+// ipsec-vpn command uses.
+type Options struct {
+	// StateDir holds the tunnels, under "tunnels", and their state. It
+	// defaults to the configuration directory.
+	StateDir string
+	// Backend defaults to NetlinkBackend, slowed down by the netlink
+	// delay of fault injection
+	Backend Backend
+	// Logger receives the messages of the Manager, and defaults to the
+	// logger of the package
+	Logger Logger
+	// Publish receives the lifecycle events of the tunnels, such as
+	// events.Publish to send them to the configured brokers. They are only
+	// recorded in the journal by default.
+	Publish func(events.Event)
+	// Settings are applied to the tunnels instead of the ipsec-vpn
+	// configuration
+	Settings Settings
+}
+
+// Manager creates, starts, stops and deletes the tunnels stored in a state
+// directory. The package-level functions such as Create use a Manager with
+// the default options, which reads its settings from the ipsec-vpn
+// configuration and publishes events to the configured brokers.
+type Manager struct {
+	stateDir string
+	backend  Backend
+	log      Logger
+	sink     func(events.Event) // Where events are published, nil to only journal them
+	settings *Settings          // nil to read the configuration
+
+	selfTestOnce sync.Once
+	selfTestErr  error
+}
+
+// std is the Manager behind the package-level functions
+var std = &Manager{backend: faultyBackend{NetlinkBackend{}}, sink: events.Publish}
+
+// NewManager returns a Manager for embedding tunnel management in another Go
+// program, which does not read the ipsec-vpn configuration for its state
+// directory, backend, logger or settings
+func NewManager(opts Options) *Manager {
+	settings := opts.Settings
+	m := &Manager{stateDir: opts.StateDir, backend: opts.Backend, log: opts.Logger, sink: opts.Publish, settings: &settings}
+	if m.backend == nil {
+		m.backend = faultyBackend{NetlinkBackend{}}
+	}
+	return m
+}
+
+// config returns the settings of the Manager
+func (m *Manager) config() Settings {
+	if m.settings == nil {
+		return ConfiguredSettings()
+	}
+	return *m.settings
+}
+
+// config returns the settings of the Manager of a tunnel
+func (t *Tunnel) config() Settings {
+	if t.settings == nil {
+		return ConfiguredSettings()
+	}
+	return *t.settings
+}
+
+// logger returns the logger of the Manager
+func (m *Manager) logger() Logger {
+	if m.log != nil {
+		return m.log
+	}
+	return tunnelLog
+}
+
+// dir returns the state directory
+func (m *Manager) dir() (string, error) {
+	if m.stateDir != "" {
+		return m.stateDir, nil
+	}
+	return getConfigDir()
+}
+
+// resolveAlgorithm replaces the "auto" encryption setting with the fastest
+// cipher benchmarked on this host, keeping the benchmark results of a Manager
+// from NewManager in its state directory
+func (m *Manager) resolveAlgorithm(algorithm string) string {
+	if m.stateDir == "" {
+		return crypto.ResolveAlgorithm(algorithm)
+	}
+	return crypto.ResolveAlgorithmFrom(filepath.Join(m.stateDir, "bench.json"), algorithm)
+}
+
+// tunnelsDir returns the directory of the tunnels, creating it if needed
+func (m *Manager) tunnelsDir() (string, error) {
+	dir, err := m.dir()
+	if err != nil {
+		return "", err
+	}
+	tunnelsDir := filepath.Join(dir, "tunnels")
+	if err := os.MkdirAll(tunnelsDir, 0755); err != nil {
+		return "", err
+	}
+	return tunnelsDir, nil
+}
+
+// requireSelfTest runs the self-test before the first change, if it is
+// enabled, and refuses changes if it failed with SelfTestFailClosed
+func (m *Manager) requireSelfTest() error {
+	if m.settings == nil {
+		return RequireSelfTest()
+	}
+	if !m.settings.SelfTest {
+		return nil
+	}
+	m.selfTestOnce.Do(func() {
+		m.selfTestErr = runSelfTest(m.logger(), m.selfTest(), m.settings.SelfTestFailClosed)
+	})
+	return m.selfTestErr
+}
+
+// NetlinkBackend configures tunnels in the kernel over netlink: GRE or
+// WireGuard interfaces, XFRM policies, network namespaces, kill-switch block
+// routes, rate limits and default routes. It needs root.
+type NetlinkBackend struct{}
+
+// Create creates the interface of a tunnel in its namespace, with its
+// kill-switch and rate limit
+func (NetlinkBackend) Create(t *Tunnel) error {
+	// Block the remote subnet before anything can be routed to it
+	if err := installKillSwitch(t); err != nil {
+		return fmt.Errorf("failed to install kill-switch: %w", err)
+	}
+
+	// Create the GRE or WireGuard tunnel interface
+	if err := createLink(t); err != nil {
+		_ = removeKillSwitch(t)
+		return err
+	}
+
+	// Isolate the tunnel in its network namespace
+	if t.Namespace != "" {
+		tunnelLog.Debug("Moving tunnel into network namespace", "tunnel", t.Name, "namespace", t.Namespace)
+		if err := moveToNamespace(t); err != nil {
+			_ = deleteLink(t)
+			_ = removeKillSwitch(t)
+			return fmt.Errorf("failed to move tunnel into network namespace: %w", err)
+		}
+	}
+
+	// Limit the peer's bandwidth
+	if err := applyRateLimit(t, 0); err != nil {
+		_ = deleteLink(t)
+		_ = removeKillSwitch(t)
+		return fmt.Errorf("failed to set rate limit: %w", err)
+	}
+
+	// Reach the initiator of a responder's instance at its virtual IP and subnet
+	if err := installSpokeRoutes(t); err != nil {
+		_ = deleteLink(t)
+		_ = removeKillSwitch(t)
+		return fmt.Errorf("failed to route initiator: %w", err)
+	}
+	return nil
+}
+
+// Guard installs the kill-switch block route of a tunnel
+func (NetlinkBackend) Guard(t *Tunnel) error {
+	return installKillSwitch(t)
+}
+
+// Start installs the XFRM policies and diversion through an IDS or IPS of a
+// tunnel, which do not survive a reboot, brings it up, routes the traffic of
+// its applications through it and forwards its multicast groups
+func (NetlinkBackend) Start(t *Tunnel) error {
+	if err := installTrafficPolicy(t); err != nil {
+		return err
+	}
+	if err := installInspection(t); err != nil {
+		return err
+	}
+	if err := installSpokeRoutes(t); err != nil {
+		return err
+	}
+	// A peer that does not answer yet is tried again under retry.ike
+	if err := retry.Do(context.Background(), retry.IKE, retry.Temporary, func() error { return startTunnel(t) }); err != nil {
+		return err
+	}
+	// Routes through the interface need it up
+	if err := installAppRoutes(t); err != nil {
+		return err
+	}
+	if err := installMulticastRoutes(t); err != nil {
+		return err
+	}
+	// A tunnel runs slower untuned, but it runs
+	if err := applyTuning(t); err != nil {
+		tunnelLog.Error("Failed to tune tunnel", "tunnel", t.Name, "err", err)
+	}
+	// and without its packets counted by protocol
+	if err := installPacketAccounting(t); err != nil {
+		tunnelLog.Error("Failed to install packet accounting of tunnel", "tunnel", t.Name, "err", err)
+	}
+
+	// Rekey its SAs by volume as well as by time
+	if t.Mode != ModeWireGuard {
+		if err := applySALifetime(t); err != nil {
+			xfrmLog.Error("Failed to set the SA lifetime of tunnel", "tunnel", t.Name, "err", err)
+		}
+	}
+	return nil
+}
+
+// Stop routes the traffic of the applications sent through a tunnel as usual
+// again, rather than let it fall through to other routes unmarked, stops
+// forwarding its multicast groups and takes the tunnel down
+func (NetlinkBackend) Stop(t *Tunnel) error {
+	if err := removeAppRoutes(t); err != nil {
+		return err
+	}
+	if err := removeMulticastRoutes(t); err != nil {
+		return err
+	}
+	return stopTunnel(t)
+}
+
+// Route installs or removes the default route of a tunnel
+func (NetlinkBackend) Route(t *Tunnel, up bool) error {
+	if up {
+		return installDefaultRoute(t)
+	}
+	return removeDefaultRoute(t)
+}
+
+// Status returns the current status of a tunnel
+func (NetlinkBackend) Status(t *Tunnel) (Status, error) {
+	return getTunnelStatus(t)
+}
+
+// Delete deletes the application and multicast routes of a tunnel, its packet
+// counters, interface, kill-switch, XFRM policies, diversion and a namespace
+// created for it alone
+func (NetlinkBackend) Delete(t *Tunnel, force bool) error {
+	var first error
+	for _, remove := range []func(*Tunnel) error{removeAppRoutes, removeMulticastRoutes, removePacketAccounting, deleteLink, removeKillSwitch, removeTrafficPolicy, removeInspection} {
+		if err := remove(t); err != nil {
+			if !force {
+				return err
+			}
+			first = cmp.Or(first, err)
+		}
+	}
+
+	if t.OwnsNamespace() {
+		if err := netns.DeleteNamed(t.Namespace); err != nil {
+			err = fmt.Errorf("failed to delete network namespace '%s': %v", t.Namespace, err)
+			if !force {
+				return err
+			}
+			first = cmp.Or(first, err)
+		}
+	}
+	return first
+}
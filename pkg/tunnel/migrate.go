@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+)
+
+// AuditResult holds the audit findings for a single tunnel
+type AuditResult struct {
+	Tunnel     string
+	Encryption string
+	Findings   []crypto.Finding
+}
+
+// Migration describes an algorithm change for a single tunnel
+type Migration struct {
+	Tunnel  string
+	From    string
+	To      string
+	Rekeyed bool
+}
+
+// Audit checks the encryption of all configured tunnels against the crypto policy
+func Audit() ([]AuditResult, error) {
+	tunnelLog.Debug("Auditing encryption of all configured tunnels")
+	tunnels, err := ListAll()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]AuditResult, 0, len(tunnels))
+	for _, t := range tunnels {
+		results = append(results, AuditResult{
+			Tunnel:     t.Name,
+			Encryption: t.Encryption,
+			Findings:   crypto.AuditAlgorithm(t.Encryption),
+		})
+	}
+
+	return results, nil
+}
+
+// Migrate moves the named tunnels to the given algorithm. If no names are given,
+// every tunnel with audit findings is migrated. Nothing is changed unless apply is set;
+// active tunnels are restarted so that they rekey with the new algorithm.
+func Migrate(names []string, to string, apply bool) ([]Migration, error) {
+	algo, ok := crypto.LookupAlgorithm(to)
+	if !ok {
+		return nil, fmt.Errorf("invalid encryption algorithm: %s", to)
+	}
+	if algo.Deprecated {
+		return nil, fmt.Errorf("cannot migrate to deprecated algorithm %s, use %s instead", to, algo.ReplacedBy)
+	}
+
+	var tunnels []*Tunnel
+	if len(names) == 0 {
+		results, err := Audit()
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			if len(result.Findings) == 0 {
+				continue
+			}
+			t, err := Get(result.Tunnel)
+			if err != nil {
+				return nil, err
+			}
+			tunnels = append(tunnels, t)
+		}
+	} else {
+		for _, name := range names {
+			t, err := Get(name)
+			if err != nil {
+				return nil, err
+			}
+			if t.Mode == ModeWireGuard {
+				return nil, fmt.Errorf("tunnel '%s' is in wireguard mode, which always uses %s", name, WireGuardEncryption)
+			}
+			tunnels = append(tunnels, t)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(tunnels))
+	for _, t := range tunnels {
+		if t.Encryption == algo.Name {
+			continue
+		}
+
+		migration := Migration{Tunnel: t.Name, From: t.Encryption, To: algo.Name}
+		if apply {
+			tunnelLog.Info("Migrating tunnel", "tunnel", t.Name, "from", t.Encryption, "to", algo.Name)
+			if err := migrateTunnel(t, algo); err != nil {
+				tunnelLog.Error("Failed to migrate tunnel", "tunnel", t.Name, "err", err)
+				return migrations, fmt.Errorf("failed to migrate tunnel '%s': %v", t.Name, err)
+			}
+			migration.Rekeyed = t.Status == StatusUp
+		}
+
+		migrations = append(migrations, migration)
+	}
+
+	return migrations, nil
+}
+
+// migrateTunnel rewrites the tunnel's algorithm and rekeys it if it is active
+func migrateTunnel(tunnel *Tunnel, algo crypto.Algorithm) error {
+	tunnel.Encryption = algo.Name
+	tunnel.PostQuantum = algo.PostQuantum
+	tunnel.UpdatedAt = time.Now()
+	if err := saveTunnel(tunnel); err != nil {
+		return err
+	}
+
+	if tunnel.Status != StatusUp {
+		return nil
+	}
+
+	tunnelLog.Debug("Rekeying tunnel", "tunnel", tunnel.Name)
+	if err := stopTunnel(tunnel); err != nil {
+		return err
+	}
+	return startTunnel(tunnel)
+}
@@ -0,0 +1,143 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// MulticastRoute forwards a multicast group across the GRE interface of a
+// tunnel: the group is received on a LAN interface and sent through the
+// tunnel, outbound, or received from the tunnel and sent out of the LAN
+// interface, inbound. The peer needs the opposite route for the group to
+// reach its own LAN.
+type MulticastRoute struct {
+	Inbound   bool   // From the tunnel to Interface
+	Interface string // LAN interface
+	Source    string // Sender, or empty for any
+	Group     string
+}
+
+// ParseMulticastRoute parses a route such as out:eth1:239.1.1.1, or
+// in:eth1:10.1.0.5,239.1.1.1 for the group sent by 10.1.0.5 alone
+func ParseMulticastRoute(s string) (MulticastRoute, error) {
+	direction, rest, _ := strings.Cut(s, ":")
+	iface, addresses, ok := strings.Cut(rest, ":")
+	if !ok || (direction != "in" && direction != "out") {
+		return MulticastRoute{}, fmt.Errorf("invalid multicast route %q: expected in|out:<interface>:[<source>,]<group>", s)
+	}
+	if iface == "" || len(iface) > 15 || strings.ContainsAny(iface, "/ \t\n") {
+		return MulticastRoute{}, fmt.Errorf("invalid multicast route %q: invalid interface name", s)
+	}
+	r := MulticastRoute{Inbound: direction == "in", Interface: iface, Group: addresses}
+	if source, group, ok := strings.Cut(addresses, ","); ok {
+		r.Source, r.Group = source, group
+	}
+
+	group := net.ParseIP(r.Group)
+	if group == nil || !group.IsMulticast() {
+		return MulticastRoute{}, fmt.Errorf("invalid multicast route %q: %s is not a multicast group", s, r.Group)
+	}
+	if r.Source != "" {
+		source := net.ParseIP(r.Source)
+		if source == nil || source.IsMulticast() || source.IsUnspecified() {
+			return MulticastRoute{}, fmt.Errorf("invalid multicast route %q: invalid source %s", s, r.Source)
+		}
+		if (source.To4() == nil) != (group.To4() == nil) {
+			return MulticastRoute{}, fmt.Errorf("invalid multicast route %q: source and group are of different address families", s)
+		}
+	}
+	return r, nil
+}
+
+// String formats a route the way ParseMulticastRoute reads it
+func (r MulticastRoute) String() string {
+	direction := "out"
+	if r.Inbound {
+		direction = "in"
+	}
+	if r.Source != "" {
+		return fmt.Sprintf("%s:%s:%s,%s", direction, r.Interface, r.Source, r.Group)
+	}
+	return fmt.Sprintf("%s:%s:%s", direction, r.Interface, r.Group)
+}
+
+// SetMulticastRoutes replaces the multicast routes of a tunnel. A tunnel that
+// is up forwards the groups straight away; otherwise they are forwarded once
+// it starts.
+func SetMulticastRoutes(name string, routes []MulticastRoute) error {
+	if err := RequireSelfTest(); err != nil {
+		return err
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+	if len(routes) > 0 {
+		switch {
+		case tunnel.Mode == ModeWireGuard:
+			return errors.New("multicast is forwarded over the GRE interface of an IPsec tunnel, a WireGuard interface carries none")
+		case tunnel.Responder():
+			return errors.New("a responder has no interface of its own, forward multicast through a tunnel to a single peer")
+		case tunnel.Namespace != "":
+			return errors.New("smcroute forwards multicast in the host namespace, not in that of the tunnel")
+		}
+		for _, r := range routes {
+			if r.Interface == tunnel.Interface() {
+				return fmt.Errorf("multicast route %s: the LAN interface cannot be the tunnel interface", r)
+			}
+		}
+	}
+
+	if tunnel.Status == StatusUp {
+		tunnel.MulticastRoutes = routes
+		if len(routes) > 0 {
+			err = installMulticastRoutes(tunnel)
+		} else {
+			err = network.ClearMulticastRoutes(tunnel.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	tunnel.MulticastRoutes = routes
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// installMulticastRoutes has smcroute forward the multicast groups of a tunnel
+// between its LAN interfaces and the tunnel interface, which must be up
+func installMulticastRoutes(tunnel *Tunnel) error {
+	if len(tunnel.MulticastRoutes) == 0 {
+		return nil
+	}
+	iface := tunnel.Interface()
+	routes := make([]network.MulticastRoute, len(tunnel.MulticastRoutes))
+	for i, r := range tunnel.MulticastRoutes {
+		routes[i] = network.MulticastRoute{From: r.Interface, Source: r.Source, Group: r.Group, To: []string{iface}}
+		if r.Inbound {
+			routes[i].From, routes[i].To = iface, []string{r.Interface}
+		}
+	}
+
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	tunnelLog.Debug("Forwarding multicast through tunnel", "tunnel", tunnel.Name, "routes", len(routes))
+	return network.SetMulticastRoutes(handle, tunnel.Name, iface, routes)
+}
+
+// removeMulticastRoutes stops forwarding the multicast groups of a tunnel
+func removeMulticastRoutes(tunnel *Tunnel) error {
+	if len(tunnel.MulticastRoutes) == 0 {
+		return nil
+	}
+	return network.ClearMulticastRoutes(tunnel.Name)
+}
@@ -0,0 +1,162 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// DedicatedNamespace requests a network namespace of the tunnel's own, named
+// ipsec-<tunnel>, that is removed again when the tunnel is deleted
+const DedicatedNamespace = "dedicated"
+
+// namespaceFor resolves the namespace option of a tunnel configuration to a name
+func namespaceFor(tunnel, namespace string) string {
+	if namespace == DedicatedNamespace {
+		return dedicatedNamespaceName(tunnel)
+	}
+	return namespace
+}
+
+func dedicatedNamespaceName(tunnel string) string {
+	return "ipsec-" + tunnel
+}
+
+// OwnsNamespace reports whether the tunnel's namespace was created for it alone
+func (t *Tunnel) OwnsNamespace() bool {
+	return t.Namespace != "" && t.Namespace == dedicatedNamespaceName(t.Name)
+}
+
+// openNamespace returns a handle to a named network namespace, creating it if needed
+func openNamespace(name string) (netns.NsHandle, error) {
+	if ns, err := netns.GetFromName(name); err == nil {
+		return ns, nil
+	}
+
+	// Creating a namespace switches the calling thread into it, so switch back
+	// before the thread can be used for anything else
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return netns.None(), err
+	}
+	defer origin.Close()
+
+	tunnelLog.Info("Creating network namespace", "namespace", name)
+	ns, err := netns.NewNamed(name)
+	if restoreErr := netns.Set(origin); restoreErr != nil {
+		// Leave the thread locked so it is discarded rather than reused
+		ns.Close()
+		return netns.None(), fmt.Errorf("failed to restore network namespace: %v", restoreErr)
+	}
+	runtime.UnlockOSThread()
+	return ns, err
+}
+
+// moveToNamespace moves the tunnel interface into the tunnel's network namespace.
+// The GRE or WireGuard underlay stays in the namespace the interface was created in.
+func moveToNamespace(tunnel *Tunnel) error {
+	ns, err := openNamespace(tunnel.Namespace)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace '%s': %v", tunnel.Namespace, err)
+	}
+	defer ns.Close()
+
+	link, err := netlink.LinkByName(tunnel.Interface())
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetNsFd(link, int(ns)); err != nil {
+		return fmt.Errorf("failed to move %s into network namespace '%s': %v", link.Attrs().Name, tunnel.Namespace, err)
+	}
+
+	// Moving an interface takes it down
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if link, err = handle.LinkByName(tunnel.Interface()); err != nil {
+		return err
+	}
+	return handle.LinkSetUp(link)
+}
+
+// linkHandle returns a netlink handle for the namespace holding the tunnel interface
+func linkHandle(tunnel *Tunnel) (*netlink.Handle, error) {
+	if tunnel.Namespace == "" {
+		return netlink.NewHandle()
+	}
+
+	ns, err := netns.GetFromName(tunnel.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace '%s': %v", tunnel.Namespace, err)
+	}
+	defer ns.Close()
+	return netlink.NewHandleAt(ns)
+}
+
+// Exec runs a command inside the network namespace of a tunnel
+func Exec(name string, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+	if tunnel.Namespace == "" {
+		return fmt.Errorf("tunnel '%s' is not in a network namespace", name)
+	}
+
+	// The command inherits the namespace of the thread that starts it
+	var cmd *exec.Cmd
+	err = inNamespace(tunnel, func() error {
+		cmd = exec.Command(args[0], args[1:]...)
+		cmd.Stdin = stdin
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		return cmd.Start()
+	})
+	if err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// inNamespace calls fn on a thread in the network namespace of a tunnel, so that
+// any netlink socket it opens talks to that namespace
+func inNamespace(tunnel *Tunnel, fn func() error) error {
+	if tunnel.Namespace == "" {
+		return fn()
+	}
+
+	ns, err := netns.GetFromName(tunnel.Namespace)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace '%s': %v", tunnel.Namespace, err)
+	}
+	defer ns.Close()
+
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	if err := netns.Set(ns); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace '%s': %v", tunnel.Namespace, err)
+	}
+
+	fnErr := fn()
+
+	if err := netns.Set(origin); err != nil {
+		// Leave the thread locked so it is discarded rather than reused
+		return fmt.Errorf("failed to restore network namespace: %v", err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
@@ -0,0 +1,469 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// Path selection defaults
+const (
+	DefaultPathHysteresis = 20 // Percent
+	DefaultPathHold       = 3  // Rounds
+)
+
+// pathLossWeight is the latency, in milliseconds, a percent of loss scores as
+const pathLossWeight = 10
+
+// pathHistorySize is the number of decisions kept per path set, a day of
+// rounds a minute apart
+const pathHistorySize = 1440
+
+// ErrPathSetNotFound is returned for path sets that do not exist
+var ErrPathSetNotFound = errors.New("path set not found")
+
+// PathSet is a prefix reached through redundant tunnels, such as over two ISPs,
+// routed through the one measuring best. Each round, the SLA probes of every
+// tunnel are sent and each scores its latency plus pathLossWeight ms per
+// percent of loss. The active tunnel is left for another only once the other
+// scores Hysteresis percent better for Hold rounds in a row, so that routes do
+// not flap between paths that measure alike, or at once when the active
+// tunnel stops answering.
+type PathSet struct {
+	Name       string    `json:"name"`
+	Prefix     string    `json:"prefix"`
+	Tunnels    []string  `json:"tunnels"`    // In order of preference between paths scoring alike
+	Hysteresis float64   `json:"hysteresis"` // Percent
+	Hold       int       `json:"hold"`       // Rounds
+	Active     string    `json:"active,omitempty"`
+	Challenger string    `json:"challenger,omitempty"` // Tunnel scoring better than the active one
+	Streak     int       `json:"streak,omitempty"`     // Rounds in a row it has
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// PathScore is how a tunnel of a path set measured in a round
+type PathScore struct {
+	Tunnel  string  `json:"tunnel"`
+	Latency float64 `json:"latency_ms,omitempty"`
+	Loss    float64 `json:"loss,omitempty"` // Percent
+	Score   float64 `json:"score,omitempty"`
+	Usable  bool    `json:"usable"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// PathDecision is the outcome of a round of a path set: the tunnel its prefix
+// was routed through before and after, and why
+type PathDecision struct {
+	Time    time.Time   `json:"time"`
+	From    string      `json:"from,omitempty"`
+	To      string      `json:"to,omitempty"`
+	Changed bool        `json:"changed"`
+	Reason  string      `json:"reason,omitempty"`
+	Scores  []PathScore `json:"scores"`
+}
+
+// Validate checks the settings of a path set, filling in defaults
+func (p *PathSet) Validate() error {
+	if !keys.ValidName(p.Name) {
+		return fmt.Errorf("invalid path set name: %s", p.Name)
+	}
+	_, prefix, err := net.ParseCIDR(p.Prefix)
+	if err != nil {
+		return fmt.Errorf("invalid prefix %q", p.Prefix)
+	}
+	p.Prefix = prefix.String()
+	if len(p.Tunnels) < 2 {
+		return errors.New("a path set needs at least two tunnels")
+	}
+	for i, name := range p.Tunnels {
+		if slices.Contains(p.Tunnels[:i], name) {
+			return fmt.Errorf("tunnel '%s' is listed twice", name)
+		}
+	}
+	if p.Hysteresis < 0 || p.Hysteresis >= 100 {
+		return fmt.Errorf("hysteresis must be at least 0 and below 100%%, got %g", p.Hysteresis)
+	}
+	if p.Hold == 0 {
+		p.Hold = DefaultPathHold
+	}
+	if p.Hold < 1 {
+		return fmt.Errorf("hold must be at least 1 round, got %d", p.Hold)
+	}
+	return nil
+}
+
+// GetPathSet returns a path set
+func GetPathSet(name string) (*PathSet, error) {
+	return std.PathSet(name)
+}
+
+// PathSet returns a path set
+func (m *Manager) PathSet(name string) (*PathSet, error) {
+	path, err := m.pathSetPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrPathSetNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p PathSet
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid path set %s: %v", name, err)
+	}
+	return &p, nil
+}
+
+// PathSets returns the path sets sorted by name
+func PathSets() ([]*PathSet, error) {
+	return std.PathSets()
+}
+
+// PathSets returns the path sets sorted by name
+func (m *Manager) PathSets() ([]*PathSet, error) {
+	dir, err := m.pathSetsDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var sets []*PathSet
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		if strings.HasSuffix(name, ".history") {
+			continue
+		}
+		p, err := m.PathSet(name)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, p)
+	}
+	return sets, nil
+}
+
+// SavePathSet creates or changes a path set. Its tunnels must exist, have SLA
+// probes to measure them by, share a network namespace and each reach the
+// whole prefix. A tunnel taken out of the set while active leaves the prefix
+// to be routed again at the next round.
+func SavePathSet(p *PathSet) error {
+	return std.SavePathSet(p)
+}
+
+// SavePathSet creates or changes a path set
+func (m *Manager) SavePathSet(p *PathSet) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	namespace := ""
+	for i, name := range p.Tunnels {
+		t, err := m.load(name)
+		if err != nil {
+			return err
+		}
+		if t.SLA == nil {
+			return fmt.Errorf("tunnel '%s' has no SLA probes to measure it by, add them with 'tunnel sla set'", name)
+		}
+		if err := withinSubnet(p.Prefix, t.RemoteSubnet); err != nil {
+			return fmt.Errorf("tunnel '%s' does not reach all of %s: %v", name, p.Prefix, err)
+		}
+		if i > 0 && t.Namespace != namespace {
+			return fmt.Errorf("tunnel '%s' is not in the network namespace of '%s'", name, p.Tunnels[0])
+		}
+		namespace = t.Namespace
+	}
+	if !slices.Contains(p.Tunnels, p.Active) {
+		p.Active = ""
+	}
+	if !slices.Contains(p.Tunnels, p.Challenger) {
+		p.Challenger, p.Streak = "", 0
+	}
+	if err := m.writePathSet(p); err != nil {
+		return err
+	}
+	m.logger().Info("Saved path set", "set", p.Name, "prefix", p.Prefix, "tunnels", strings.Join(p.Tunnels, ","))
+	return nil
+}
+
+// DeletePathSet deletes a path set, its decision history and the route of its
+// prefix through the active tunnel
+func DeletePathSet(name string) error {
+	return std.DeletePathSet(name)
+}
+
+// DeletePathSet deletes a path set
+func (m *Manager) DeletePathSet(name string) error {
+	p, err := m.PathSet(name)
+	if err != nil {
+		return err
+	}
+	if p.Active != "" {
+		if t, err := m.load(p.Active); err == nil {
+			if err := removePathRoute(t, p.Prefix); err != nil {
+				m.logger().Error("Failed to remove route of path set", "set", name, "prefix", p.Prefix, "err", err)
+			}
+		}
+	}
+	path, _ := m.pathSetPath(name)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if history, err := m.pathHistoryPath(name); err == nil {
+		_ = os.Remove(history)
+	}
+	m.logger().Info("Deleted path set", "set", name)
+	return nil
+}
+
+// SelectPath runs a round of a path set: it probes each of its tunnels, picks
+// the one to route the prefix through and routes it, then records the decision
+// in the set's history. A change publishes a tunnel.path.changed event.
+func SelectPath(name string) (*PathDecision, error) {
+	return std.SelectPath(name, ProbeSLA)
+}
+
+// SelectPath runs a round of a path set, measuring its tunnels with probe
+func (m *Manager) SelectPath(name string, probe func(tunnel string) (*SLAResult, error)) (*PathDecision, error) {
+	p, err := m.PathSet(name)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]*SLAResult)
+	errs := make(map[string]error)
+	for _, member := range p.Tunnels {
+		t, err := m.Get(member)
+		if err == nil && t.Status != StatusUp {
+			err = fmt.Errorf("tunnel is %s", t.Status)
+		}
+		if err == nil {
+			results[member], err = probe(member)
+		}
+		if err != nil {
+			errs[member] = err
+		}
+	}
+
+	d := choosePath(p, results, errs)
+	if d.To != "" {
+		t, err := m.load(d.To)
+		if err == nil {
+			err = routePath(t, p.Prefix)
+		}
+		if err != nil {
+			// Try again next round, from where the route was
+			return nil, fmt.Errorf("failed to route %s through '%s': %w", p.Prefix, d.To, err)
+		}
+	}
+	if err := m.writePathSet(p); err != nil {
+		return nil, err
+	}
+	if err := m.recordPathDecision(name, d); err != nil {
+		return nil, err
+	}
+	if d.Changed {
+		m.logger().Info("Path changed", "set", name, "prefix", p.Prefix, "from", d.From, "to", d.To, "reason", d.Reason)
+		e := events.New(events.TypePathChanged, d.To)
+		e.Reason = fmt.Sprintf("%s: %s", name, d.Reason)
+		if err := m.record(e); err != nil {
+			m.logger().Error("Failed to record event in the journal", "tunnel", d.To, "type", e.Type, "err", err)
+		}
+		m.send(e)
+	}
+	return d, nil
+}
+
+// choosePath scores the tunnels of a path set from the results of their probes,
+// or the errors that kept them from being probed, and picks the one to route
+// the prefix through, updating the set's active tunnel and challenger
+func choosePath(p *PathSet, results map[string]*SLAResult, errs map[string]error) *PathDecision {
+	d := &PathDecision{Time: time.Now(), From: p.Active}
+	var best, active *PathScore
+	for _, name := range p.Tunnels {
+		s := PathScore{Tunnel: name}
+		if r := results[name]; r != nil && r.Received > 0 {
+			s.Latency, s.Loss, s.Usable = r.Latency, r.Loss, true
+			s.Score = r.Latency + pathLossWeight*r.Loss
+		} else if err := errs[name]; err != nil {
+			s.Error = err.Error()
+		} else {
+			s.Error = "no replies"
+		}
+		d.Scores = append(d.Scores, s)
+	}
+	for i := range d.Scores {
+		s := &d.Scores[i]
+		if s.Usable && (best == nil || s.Score < best.Score) {
+			best = s
+		}
+		if s.Tunnel == p.Active {
+			active = s
+		}
+	}
+
+	switchTo := func(s *PathScore, reason string) {
+		p.Active, p.Challenger, p.Streak = s.Tunnel, "", 0
+		d.Changed = d.From != s.Tunnel
+		d.Reason = reason
+	}
+	d.To = p.Active
+	switch {
+	case best == nil:
+		p.Challenger, p.Streak = "", 0
+		d.Reason = "no tunnel answers its probes"
+	case active == nil:
+		switchTo(best, fmt.Sprintf("%s scores best, %.1f", best.Tunnel, best.Score))
+	case !active.Usable:
+		switchTo(best, fmt.Sprintf("%s fails: %s", active.Tunnel, active.Error))
+	case best != active && best.Score < active.Score*(1-p.Hysteresis/100):
+		if p.Challenger == best.Tunnel {
+			p.Streak++
+		} else {
+			p.Challenger, p.Streak = best.Tunnel, 1
+		}
+		reason := fmt.Sprintf("%s scores %.1f against %.1f of %s", best.Tunnel, best.Score, active.Score, active.Tunnel)
+		if p.Streak >= p.Hold {
+			switchTo(best, fmt.Sprintf("%s for %d rounds", reason, p.Hold))
+		} else {
+			d.Reason = fmt.Sprintf("%s, round %d of %d", reason, p.Streak, p.Hold)
+		}
+	default:
+		p.Challenger, p.Streak = "", 0
+	}
+	d.To = p.Active
+	return d
+}
+
+// routePath routes the prefix of a path set through a tunnel
+func routePath(t *Tunnel, prefix string) error {
+	handle, err := linkHandle(t)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	return network.SetPathRoute(handle, t.Interface(), prefix)
+}
+
+// removePathRoute removes the route of the prefix of a path set
+func removePathRoute(t *Tunnel, prefix string) error {
+	handle, err := linkHandle(t)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	return network.DeletePathRoute(handle, prefix)
+}
+
+// PathHistory returns the decisions recorded for a path set, oldest first
+func PathHistory(name string) ([]PathDecision, error) {
+	return std.PathHistory(name)
+}
+
+// PathHistory returns the decisions recorded for a path set
+func (m *Manager) PathHistory(name string) ([]PathDecision, error) {
+	path, err := m.pathHistoryPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var history []PathDecision
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("failed to read path history of %s: %v", name, err)
+	}
+	return history, nil
+}
+
+// recordPathDecision appends a decision to the history of a path set, keeping
+// the last pathHistorySize
+func (m *Manager) recordPathDecision(name string, d *PathDecision) error {
+	history, err := m.PathHistory(name)
+	if err != nil {
+		return err
+	}
+	history = append(history, *d)
+	if len(history) > pathHistorySize {
+		history = history[len(history)-pathHistorySize:]
+	}
+	path, err := m.pathHistoryPath(name)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writePathSet stores a path set
+func (m *Manager) writePathSet(p *PathSet) error {
+	dir, err := m.pathSetsDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	p.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, p.Name+".json"), append(data, '\n'), 0644)
+}
+
+// pathSetsDir returns the directory of the path sets
+func (m *Manager) pathSetsDir() (string, error) {
+	dir, err := m.dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "paths"), nil
+}
+
+// pathSetPath returns the file of a path set
+func (m *Manager) pathSetPath(name string) (string, error) {
+	if !keys.ValidName(name) {
+		return "", fmt.Errorf("invalid path set name: %s", name)
+	}
+	dir, err := m.pathSetsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// pathHistoryPath returns the file the decisions of a path set are kept in
+func (m *Manager) pathHistoryPath(name string) (string, error) {
+	path, err := m.pathSetPath(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(path, ".json") + ".history.json", nil
+}
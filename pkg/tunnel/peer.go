@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Peer describes the IKE implementation at the remote end of a tunnel, as learned
+// from the vendor IDs it sent and what it agreed to during negotiation
+type Peer struct {
+	Software    string   `json:"software,omitempty"`
+	VendorIDs   []string `json:"vendor_ids,omitempty"` // Hex encoded, as received
+	Features    []string `json:"features,omitempty"`
+	PostQuantum bool     `json:"post_quantum"` // Whether a post-quantum key exchange was negotiated
+}
+
+// vendorID maps a known vendor ID prefix to the software or feature it announces.
+// Many vendor IDs end in version or flag bytes, so only the prefix is matched.
+type vendorID struct {
+	prefix   string
+	software string
+	feature  string
+}
+
+var knownVendorIDs = []vendorID{
+	{prefix: "882fe56d6fd20dbc2251613b2ebe5beb", software: "strongSwan"},
+	{prefix: "1e2b516905991c7d7c96fcbfb587e461", software: "Microsoft Windows"},
+	{prefix: "12f5f28c457168a9702d9fe274cc", feature: "Cisco Unity"},
+	{prefix: "09002689dfd6b712", feature: "XAUTH"},
+	{prefix: "afcad71368a1f1c96b8696fc7757", feature: "DPD"},
+	{prefix: "4a131c81070358455c5728f20e95452f", feature: "NAT-T"},
+	{prefix: "90cb80913ebb696e086381b5ec427b1f", feature: "NAT-T (draft 02)"},
+	{prefix: "4048b7d56ebce88525e7de7f00d6c2d3", feature: "IKE fragmentation"},
+}
+
+// IdentifyPeer fingerprints a peer from the vendor IDs it sent
+func IdentifyPeer(vendorIDs [][]byte, postQuantum bool) *Peer {
+	peer := &Peer{PostQuantum: postQuantum}
+	for _, vid := range vendorIDs {
+		encoded := hex.EncodeToString(vid)
+		peer.VendorIDs = append(peer.VendorIDs, encoded)
+
+		for _, known := range knownVendorIDs {
+			if !strings.HasPrefix(encoded, known.prefix) {
+				continue
+			}
+			if known.software != "" && peer.Software == "" {
+				peer.Software = known.software
+			}
+			if known.feature != "" {
+				peer.Features = append(peer.Features, known.feature)
+			}
+		}
+	}
+	return peer
+}
+
+// Name returns the peer software, or a placeholder when it could not be identified
+func (p *Peer) Name() string {
+	if p.Software == "" {
+		return "unknown"
+	}
+	return p.Software
+}
+
+// RecordPeer stores what was learned about the peer of a tunnel during IKE
+func RecordPeer(name string, vendorIDs [][]byte, postQuantum bool) (*Peer, error) {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel.Peer = IdentifyPeer(vendorIDs, postQuantum)
+	tunnel.UpdatedAt = time.Now()
+	for _, w := range tunnel.InteropWarnings() {
+		ikeLog.Info("Interop warning", "tunnel", name, "warning", w)
+	}
+	return tunnel.Peer, saveTunnel(tunnel)
+}
+
+// InteropWarnings explains where the peer falls short of the tunnel configuration
+func (t *Tunnel) InteropWarnings() []string {
+	if t.Peer == nil {
+		return nil
+	}
+
+	var warnings []string
+	if t.PostQuantum && !t.Peer.PostQuantum {
+		warnings = append(warnings, "peer does not support a post-quantum KEM, fell back to classical key exchange")
+	}
+	if t.Peer.Software == "Microsoft Windows" && t.Encryption == "chacha20poly1305" {
+		warnings = append(warnings, fmt.Sprintf("%s does not support ChaCha20-Poly1305, use aes256gcm", t.Peer.Software))
+	}
+	return warnings
+}
@@ -0,0 +1,186 @@
+package tunnel
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// Peer check modes of 'tunnel create --check-peer'
+const (
+	CheckPeerOff   = "off"
+	CheckPeerWarn  = "warn"  // Create the tunnel anyway, warning about what failed
+	CheckPeerAbort = "abort" // Refuse to create a tunnel to an unreachable peer
+)
+
+// CheckPeerModes lists the peer check modes
+var CheckPeerModes = []string{CheckPeerOff, CheckPeerWarn, CheckPeerAbort}
+
+// Outcomes of probing the peer's IKE or WireGuard port
+const (
+	PortAnswered = "answered"  // The peer replied
+	PortClosed   = "closed"    // An ICMP port unreachable came back
+	PortSilent   = "no answer" // Nothing came back, which is all WireGuard ever sends to a stranger
+)
+
+// peerCheckCount is the number of ICMP echoes sent to a peer, and
+// peerCheckLatency the round-trip time above which it is reported as slow
+const (
+	peerCheckCount   = 3
+	peerCheckLatency = 300 * time.Millisecond
+)
+
+// ikePort is the UDP port IKE listens on
+const ikePort = 500
+
+// PeerCheck is the outcome of probing a peer before a tunnel to it is created
+type PeerCheck struct {
+	Peer      string
+	Interface string // Interface the peer is routed through
+	Gateway   string // Empty if the peer is on the link
+	RouteErr  error  // Set if there is no route to the peer
+	Sent      int    // ICMP echoes sent
+	Received  int
+	Latency   float64 // Mean round-trip time in milliseconds
+	ICMPErr   error   // Set if no echo could be sent, e.g. without CAP_NET_RAW
+	Port      int     // IKE port, or the WireGuard listen port
+	PortState string
+
+	wireGuard bool
+}
+
+// CheckPeer probes the peer of a tunnel about to be created, given by address
+// or host name, in the given mode and, for WireGuard, with its listen port: it
+// looks up the route to the peer, measures the round-trip time of a few ICMP
+// echoes and sends an IKE_SA_INIT header to UDP 500, or an empty datagram to
+// the WireGuard port, to tell a port that is closed from one that is not.
+func CheckPeer(peer, mode string, listenPort int) (*PeerCheck, error) {
+	ip, err := network.Resolve(context.Background(), peer)
+	if err != nil {
+		return nil, err
+	}
+	check := &PeerCheck{Peer: peer, Port: ikePort, wireGuard: mode == ModeWireGuard}
+	if check.wireGuard {
+		check.Port = cmp.Or(listenPort, DefaultWireGuardPort)
+	}
+
+	check.Gateway, check.Interface, check.RouteErr = network.PeerPath(ip.String())
+	if check.RouteErr != nil {
+		return check, nil
+	}
+
+	var rtts []time.Duration
+	if rtts, check.ICMPErr = probeICMP(ip, peerCheckCount); check.ICMPErr == nil {
+		var total time.Duration
+		check.Sent = len(rtts)
+		for _, rtt := range rtts {
+			if rtt >= 0 {
+				check.Received++
+				total += rtt
+			}
+		}
+		if check.Received > 0 {
+			check.Latency = ms(total / time.Duration(check.Received))
+		}
+	}
+
+	check.PortState = probePort(ip, check.Port, check.wireGuard)
+	return check, nil
+}
+
+// probePort sends one datagram to a peer's UDP port and waits for a reply or an
+// ICMP port unreachable. IKE responders answer a bare IKE_SA_INIT header with
+// an INVALID_SYNTAX notification, or at least do not refuse it.
+func probePort(ip net.IP, port int, wireGuard bool) string {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), slaTimeout)
+	if err != nil {
+		return PortSilent
+	}
+	defer conn.Close()
+
+	msg := []byte{}
+	if !wireGuard {
+		msg = ikeSAInitHeader()
+	}
+	// A port unreachable may only be reported on a later write or read, so try twice
+	for range 2 {
+		if _, err := conn.Write(msg); errors.Is(err, syscall.ECONNREFUSED) {
+			return PortClosed
+		}
+		conn.SetReadDeadline(time.Now().Add(slaTimeout / 2))
+		_, err := conn.Read(make([]byte, 1500))
+		switch {
+		case err == nil:
+			return PortAnswered
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return PortClosed
+		}
+	}
+	return PortSilent
+}
+
+// ikeSAInitHeader returns an IKEv2 IKE_SA_INIT request header (RFC 7296 section
+// 3.1) with a random initiator SPI and no payloads
+func ikeSAInitHeader() []byte {
+	header := make([]byte, 28)
+	_, _ = rand.Read(header[:8])
+	header[17] = 0x20 // Version 2.0
+	header[18] = 34   // IKE_SA_INIT
+	header[19] = 0x08 // Initiator
+	binary.BigEndian.PutUint32(header[24:], uint32(len(header)))
+	return header
+}
+
+// Err returns why the peer is unreachable, or nil if it may be reached: there is
+// no route to it, its port is closed, or neither the echoes nor the port got an
+// answer
+func (c *PeerCheck) Err() error {
+	switch {
+	case c.RouteErr != nil:
+		return c.RouteErr
+	case c.PortState == PortClosed:
+		return fmt.Errorf("peer %s refused UDP port %d, nothing listens on it", c.Peer, c.Port)
+	case c.Received == 0 && c.ICMPErr == nil && c.PortState != PortAnswered:
+		return fmt.Errorf("peer %s answered neither ICMP echoes nor UDP port %d through %s", c.Peer, c.Port, c.path())
+	}
+	return nil
+}
+
+// Warnings returns what may still keep a tunnel to a reachable peer from coming
+// up, or be worth knowing about it
+func (c *PeerCheck) Warnings() []string {
+	if c.Err() != nil {
+		return nil
+	}
+	var warnings []string
+	if c.ICMPErr != nil {
+		warnings = append(warnings, fmt.Sprintf("could not send ICMP echoes: %v", c.ICMPErr))
+	} else if c.Received < c.Sent {
+		warnings = append(warnings, fmt.Sprintf("%d of %d ICMP echoes to %s lost", c.Sent-c.Received, c.Sent, c.Peer))
+	}
+	if c.Received > 0 && c.Latency > ms(peerCheckLatency) {
+		warnings = append(warnings, fmt.Sprintf("round-trip time to %s is %.0fms", c.Peer, c.Latency))
+	}
+	// WireGuard only ever answers peers it knows, so silence means nothing
+	if c.PortState == PortSilent && !c.wireGuard {
+		warnings = append(warnings, fmt.Sprintf("no answer from UDP port %d, a firewall may drop IKE", c.Port))
+	}
+	return warnings
+}
+
+// path describes the route to the peer
+func (c *PeerCheck) path() string {
+	if c.Gateway == "" {
+		return c.Interface
+	}
+	return fmt.Sprintf("%s via %s", c.Interface, c.Gateway)
+}
@@ -0,0 +1,365 @@
+package tunnel
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+)
+
+// AuthMethods lists the ways tunnels authenticate their peers
+var AuthMethods = []string{"psk", "pubkey", "spiffe"}
+
+// ErrPeerGroupNotFound is returned for peer groups that do not exist
+var ErrPeerGroupNotFound = errors.New("peer group not found")
+
+// PeerGroup holds the settings the tunnels that reference it share, like a BGP
+// peer group: how they authenticate, their IKE and ESP proposals, dead peer
+// detection and reauthentication. Settings left empty fall back to the
+// configuration file.
+type PeerGroup struct {
+	Name           string    `json:"name"`
+	AuthMethod     string    `json:"authentication_method,omitempty"`
+	IKEProposals   []string  `json:"ike_proposals,omitempty"`
+	ESPProposals   []string  `json:"esp_proposals,omitempty"`
+	DPDDelay       int       `json:"dpd_delay,omitempty"`       // Seconds
+	DPDTimeout     int       `json:"dpd_timeout,omitempty"`     // Seconds
+	ReauthInterval int       `json:"reauth_interval,omitempty"` // Seconds
+	ReauthGrace    int       `json:"reauth_grace,omitempty"`    // Seconds
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Validate checks the settings of a peer group, with the reauthentication
+// grace of the configuration file if the group has none
+func (g *PeerGroup) Validate() error {
+	return g.validate(ConfiguredSettings().IKE.ReauthGrace)
+}
+
+// validate checks the settings of a peer group, with defaultGrace as the
+// reauthentication grace if the group has none
+func (g *PeerGroup) validate(defaultGrace int) error {
+	if !keys.ValidName(g.Name) {
+		return fmt.Errorf("invalid peer group name: %s", g.Name)
+	}
+	if g.AuthMethod != "" && !slices.Contains(AuthMethods, g.AuthMethod) {
+		return fmt.Errorf("invalid authentication method %q, expected %s", g.AuthMethod, strings.Join(AuthMethods, ", "))
+	}
+	for _, p := range slices.Concat(g.IKEProposals, g.ESPProposals) {
+		if _, err := parseProposal(p); err != nil {
+			return err
+		}
+	}
+	if g.DPDDelay < 0 || g.DPDTimeout < 0 {
+		return errors.New("DPD delay and timeout must not be negative")
+	}
+	if g.DPDDelay > 0 && g.DPDTimeout > 0 && g.DPDTimeout < g.DPDDelay {
+		return fmt.Errorf("DPD timeout (%ds) must not be shorter than the delay (%ds)", g.DPDTimeout, g.DPDDelay)
+	}
+	if g.ReauthInterval < 0 || g.ReauthGrace < 0 {
+		return errors.New("reauthentication interval and grace must not be negative")
+	}
+	if g.ReauthInterval > 0 && g.ReauthInterval < 60 {
+		return fmt.Errorf("reauthentication interval must be at least 60s, got %ds", g.ReauthInterval)
+	}
+	if grace := cmp.Or(g.ReauthGrace, defaultGrace); g.ReauthInterval > 0 && grace >= g.ReauthInterval {
+		return fmt.Errorf("reauthentication grace (%ds) must be shorter than the interval (%ds)", grace, g.ReauthInterval)
+	}
+	return nil
+}
+
+// IKESettings are the settings a tunnel negotiates its peer with, from its
+// peer group or else the settings of its Manager
+type IKESettings struct {
+	Group        string // The tunnel's peer group, if any
+	AuthMethod   string
+	IKEProposals []string
+	ESPProposals []string
+	DPDDelay     int // Seconds, 0 to turn DPD off
+	DPDTimeout   int // Seconds
+	// Seconds between full reauthentications of the IKE SA, 0 to only rekey
+	// it, and how long its SAs outlive a reauthentication that is due
+	ReauthInterval int
+	ReauthGrace    int
+}
+
+// IKESettingsOf returns the settings a tunnel negotiates its peer with. The
+// settings of a peer group that has gone are those of the configuration file.
+func IKESettingsOf(t *Tunnel) IKESettings {
+	return std.IKESettingsOf(t)
+}
+
+// IKESettingsOf returns the settings a tunnel negotiates its peer with. The
+// settings of a peer group that has gone are those of Settings.IKE.
+func (m *Manager) IKESettingsOf(t *Tunnel) IKESettings {
+	s := m.config().IKE
+	s.Group = ""
+	if t.PeerGroup == "" {
+		return s
+	}
+	s.Group = t.PeerGroup
+	g, err := m.PeerGroup(t.PeerGroup)
+	if err != nil {
+		m.logger().Error("Failed to read peer group of tunnel", "tunnel", t.Name, "group", t.PeerGroup, "err", err)
+		return s
+	}
+	if g.AuthMethod != "" {
+		s.AuthMethod = g.AuthMethod
+	}
+	if len(g.IKEProposals) > 0 {
+		s.IKEProposals = g.IKEProposals
+	}
+	if len(g.ESPProposals) > 0 {
+		s.ESPProposals = g.ESPProposals
+	}
+	if g.DPDDelay > 0 {
+		s.DPDDelay = g.DPDDelay
+	}
+	if g.DPDTimeout > 0 {
+		s.DPDTimeout = g.DPDTimeout
+	}
+	if g.ReauthInterval > 0 {
+		s.ReauthInterval = g.ReauthInterval
+	}
+	if g.ReauthGrace > 0 {
+		s.ReauthGrace = g.ReauthGrace
+	}
+	return s
+}
+
+// GetPeerGroup returns a peer group
+func GetPeerGroup(name string) (*PeerGroup, error) {
+	return std.PeerGroup(name)
+}
+
+// PeerGroup returns a peer group
+func (m *Manager) PeerGroup(name string) (*PeerGroup, error) {
+	path, err := m.peerGroupPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrPeerGroupNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var g PeerGroup
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, fmt.Errorf("invalid peer group %s: %v", name, err)
+	}
+	return &g, nil
+}
+
+// PeerGroups returns the peer groups sorted by name
+func PeerGroups() ([]*PeerGroup, error) {
+	return std.PeerGroups()
+}
+
+// PeerGroups returns the peer groups sorted by name
+func (m *Manager) PeerGroups() ([]*PeerGroup, error) {
+	dir, err := m.peerGroupsDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var groups []*PeerGroup
+	for _, file := range files {
+		g, err := m.PeerGroup(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// PeerGroupMembers returns the names of the tunnels in a peer group
+func (m *Manager) PeerGroupMembers(group string) ([]string, error) {
+	tunnels, err := m.ListConfigured()
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	for _, t := range tunnels {
+		if t.PeerGroup == group {
+			members = append(members, t.Name)
+		}
+	}
+	slices.Sort(members)
+	return members, nil
+}
+
+// PeerGroupMembers returns the names of the tunnels in a peer group
+func PeerGroupMembers(group string) ([]string, error) {
+	return std.PeerGroupMembers(group)
+}
+
+// SavePeerGroup creates or updates a peer group, and rekeys the member tunnels
+// that are up so that they negotiate with the new settings. It returns the
+// tunnels rekeyed; a member that fails to rekey does not stop the others.
+func SavePeerGroup(g *PeerGroup) ([]string, error) {
+	return std.SavePeerGroup(g)
+}
+
+// SavePeerGroup creates or updates a peer group and rekeys its members
+func (m *Manager) SavePeerGroup(g *PeerGroup) ([]string, error) {
+	if err := g.validate(m.config().IKE.ReauthGrace); err != nil {
+		return nil, err
+	}
+	dir, err := m.peerGroupsDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	g.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, g.Name+".json"), append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	m.logger().Info("Saved peer group", "group", g.Name)
+
+	members, err := m.PeerGroupMembers(g.Name)
+	if err != nil {
+		return nil, err
+	}
+	var rekeyed []string
+	var errs []error
+	for _, name := range members {
+		done, err := m.rekey(name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tunnel '%s': %w", name, err))
+		}
+		if done {
+			rekeyed = append(rekeyed, name)
+		}
+	}
+	return rekeyed, errors.Join(errs...)
+}
+
+// DeletePeerGroup deletes a peer group. A group with members is only deleted
+// with force, which takes its members out of it and rekeys those that are up.
+func DeletePeerGroup(name string, force bool) error {
+	return std.DeletePeerGroup(name, force)
+}
+
+// DeletePeerGroup deletes a peer group
+func (m *Manager) DeletePeerGroup(name string, force bool) error {
+	path, err := m.peerGroupPath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrPeerGroupNotFound, name)
+	}
+	members, err := m.PeerGroupMembers(name)
+	if err != nil {
+		return err
+	}
+	if len(members) > 0 && !force {
+		return fmt.Errorf("peer group %s has %d member tunnels (%s), use force to take them out of it", name, len(members), strings.Join(members, ", "))
+	}
+	var errs []error
+	for _, member := range members {
+		if err := m.SetPeerGroup(member, ""); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel '%s': %w", member, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	m.logger().Info("Deleted peer group", "group", name)
+	return nil
+}
+
+// SetPeerGroup puts a tunnel in a peer group, or takes it out of its group if
+// group is empty, and rekeys it if it is up
+func SetPeerGroup(tunnel, group string) error {
+	return std.SetPeerGroup(tunnel, group)
+}
+
+// SetPeerGroup puts a tunnel in a peer group and rekeys it
+func (m *Manager) SetPeerGroup(name, group string) error {
+	if group != "" {
+		if _, err := m.PeerGroup(group); err != nil {
+			return err
+		}
+	}
+	tunnel, err := m.load(name)
+	if err != nil {
+		return err
+	}
+	if tunnel.PeerGroup == group {
+		return nil
+	}
+	tunnel.PeerGroup = group
+	tunnel.UpdatedAt = time.Now()
+	if err := m.save(tunnel); err != nil {
+		return err
+	}
+	m.logger().Info("Set peer group of tunnel", "tunnel", name, "group", group)
+	_, err = m.rekey(name)
+	return err
+}
+
+// rekey restarts a tunnel that is up so that it negotiates new SAs with its
+// current settings, and reports whether it did
+func (m *Manager) rekey(name string) (bool, error) {
+	tunnel, err := m.Get(name)
+	if err != nil {
+		return false, err
+	}
+	// A responder's instances negotiate, restarting it would only release them
+	if tunnel.Status != StatusUp || tunnel.Responder() {
+		return false, nil
+	}
+	m.logger().Info("Rekeying tunnel", "tunnel", name)
+	if err := m.Stop(name); err != nil {
+		return false, err
+	}
+	if err := m.Start(name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// peerGroupsDir returns the directory of the peer groups
+func (m *Manager) peerGroupsDir() (string, error) {
+	dir, err := m.dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "peer-groups"), nil
+}
+
+// peerGroupPath returns the file of a peer group
+func (m *Manager) peerGroupPath(name string) (string, error) {
+	if !keys.ValidName(name) {
+		return "", fmt.Errorf("invalid peer group name: %s", name)
+	}
+	dir, err := m.peerGroupsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
@@ -0,0 +1,117 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrPinMismatch is returned when a peer presents a key other than the pinned one
+var ErrPinMismatch = errors.New("peer key does not match the pinned fingerprint")
+
+// KeyFingerprint returns the fingerprint of a public key, in the format used for
+// stored keys
+func KeyFingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+// CertificateFingerprint returns the fingerprint of the public key in a DER or PEM
+// encoded certificate. The key is pinned rather than the certificate, so renewing
+// a certificate for the same key keeps the pin valid.
+func CertificateFingerprint(data []byte) (string, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return "", err
+	}
+	return KeyFingerprint(cert.RawSubjectPublicKeyInfo), nil
+}
+
+// ParseFingerprint normalizes a fingerprint given as SHA256:<hex> or bare hex,
+// optionally with colons between bytes
+func ParseFingerprint(s string) (string, error) {
+	digest := strings.ToLower(strings.ReplaceAll(s, ":", ""))
+	digest = strings.TrimPrefix(digest, "sha256")
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid fingerprint %q, expected SHA256: followed by 64 hex digits", s)
+	}
+	return "SHA256:" + digest, nil
+}
+
+// PinPeer pins the key a tunnel's peer must present
+func PinPeer(name, fingerprint string) error {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+
+	tunnel.PeerPin = fingerprint
+	tunnel.PinnedAt = time.Now()
+	tunnel.UpdatedAt = tunnel.PinnedAt
+	return saveTunnel(tunnel)
+}
+
+// SetTOFU turns trust-on-first-use on or off for a tunnel. With it on and no pin
+// yet, the key of the first peer to authenticate is pinned.
+func SetTOFU(name string, enabled bool) error {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+
+	tunnel.PinTOFU = enabled
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// ClearPin removes the pin of a tunnel. With trust-on-first-use on, the next
+// peer key is pinned again, e.g. after the peer's key was legitimately replaced.
+func ClearPin(name string) error {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+
+	tunnel.PeerPin = ""
+	tunnel.PinnedAt = time.Time{}
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// VerifyPeerKey checks the key fingerprint a peer authenticated with against the
+// tunnel's pin, pinning it first if trust-on-first-use is on. A changed key puts
+// the tunnel in the ERROR state with the reason, so it shows up in tunnel status.
+func VerifyPeerKey(name, fingerprint string) error {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case tunnel.PeerPin == "" && tunnel.PinTOFU:
+		tunnelLog.Info("Pinned peer key on first use", "tunnel", name, "fingerprint", fingerprint)
+		tunnel.PeerPin = fingerprint
+		tunnel.PinnedAt = time.Now()
+		tunnel.UpdatedAt = tunnel.PinnedAt
+		return saveTunnel(tunnel)
+	case tunnel.PeerPin == "" || tunnel.PeerPin == fingerprint:
+		return nil
+	}
+
+	reason := fmt.Sprintf("peer key changed: pinned %s, got %s", tunnel.PeerPin, fingerprint)
+	tunnelLog.Error("SECURITY ALERT: peer key changed. If it was replaced, run 'ipsec-vpn tunnel pin clear'",
+		"tunnel", name, "pinned", tunnel.PeerPin, "got", fingerprint)
+	tunnel.setStatus(StatusError, reason)
+	if err := saveTunnel(tunnel); err != nil {
+		return err
+	}
+	return ErrPinMismatch
+}
@@ -0,0 +1,225 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// maxPortRange limits port ranges, since each port needs XFRM selectors of its own
+const maxPortRange = 64
+
+// XFRM policy priorities: allowed traffic is matched before the subnet-wide block
+const (
+	allowPriority = 100
+	blockPriority = 200
+)
+
+// TrafficRule allows one protocol, optionally limited to a port range, through a
+// tunnel. A tunnel with no rules carries all traffic between its subnets.
+type TrafficRule struct {
+	Protocol  string // tcp, udp or icmp
+	FirstPort int    // 0 for any port
+	LastPort  int
+}
+
+// ParseTrafficRule parses a rule such as tcp/443, udp/5000-5010 or icmp
+func ParseTrafficRule(s string) (TrafficRule, error) {
+	protocol, ports, hasPorts := strings.Cut(strings.ToLower(s), "/")
+	rule := TrafficRule{Protocol: protocol}
+
+	switch protocol {
+	case "tcp", "udp":
+	case "icmp":
+		if hasPorts {
+			return rule, fmt.Errorf("invalid rule %q: icmp has no ports", s)
+		}
+	default:
+		return rule, fmt.Errorf("invalid rule %q: protocol must be tcp, udp or icmp", s)
+	}
+	if !hasPorts {
+		return rule, nil
+	}
+
+	first, last, isRange := strings.Cut(ports, "-")
+	var err error
+	if rule.FirstPort, err = parsePort(first); err != nil {
+		return rule, fmt.Errorf("invalid rule %q: %v", s, err)
+	}
+	rule.LastPort = rule.FirstPort
+	if isRange {
+		if rule.LastPort, err = parsePort(last); err != nil {
+			return rule, fmt.Errorf("invalid rule %q: %v", s, err)
+		}
+	}
+	if rule.LastPort < rule.FirstPort {
+		return rule, fmt.Errorf("invalid rule %q: port range is reversed", s)
+	}
+	if rule.LastPort-rule.FirstPort >= maxPortRange {
+		return rule, fmt.Errorf("invalid rule %q: port ranges are limited to %d ports", s, maxPortRange)
+	}
+	return rule, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// String formats a rule the way ParseTrafficRule reads it
+func (r TrafficRule) String() string {
+	switch {
+	case r.FirstPort == 0:
+		return r.Protocol
+	case r.FirstPort == r.LastPort:
+		return fmt.Sprintf("%s/%d", r.Protocol, r.FirstPort)
+	default:
+		return fmt.Sprintf("%s/%d-%d", r.Protocol, r.FirstPort, r.LastPort)
+	}
+}
+
+func (r TrafficRule) proto(ipv6 bool) netlink.Proto {
+	switch {
+	case r.Protocol == "tcp":
+		return netlink.Proto(unix.IPPROTO_TCP)
+	case r.Protocol == "udp":
+		return netlink.Proto(unix.IPPROTO_UDP)
+	case ipv6:
+		return netlink.Proto(unix.IPPROTO_ICMPV6)
+	default:
+		return netlink.Proto(unix.IPPROTO_ICMP)
+	}
+}
+
+// SetTrafficPolicy replaces the traffic allow-list of a tunnel and installs it
+func SetTrafficPolicy(name string, rules []TrafficRule) error {
+	if err := RequireSelfTest(); err != nil {
+		return err
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+	if tunnel.Mode == ModeWireGuard && len(rules) > 0 {
+		return errors.New("traffic policies are enforced by IPsec and not available in wireguard mode")
+	}
+
+	if err := removeTrafficPolicy(tunnel); err != nil {
+		return err
+	}
+	tunnel.Policy = rules
+	if err := installTrafficPolicy(tunnel); err != nil {
+		return err
+	}
+
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// trafficSelectors returns the XFRM policies enforcing the allow-list of a tunnel:
+// for every allowed port, traffic in both directions and whichever side opened the
+// connection, followed by a block on everything else between the subnets
+func trafficSelectors(tunnel *Tunnel) ([]netlink.XfrmPolicy, error) {
+	if len(tunnel.Policy) == 0 {
+		return nil, nil
+	}
+
+	_, local, err := net.ParseCIDR(tunnel.LocalSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local subnet: %v", err)
+	}
+	_, remote, err := net.ParseCIDR(tunnel.RemoteSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote subnet: %v", err)
+	}
+
+	ipv6 := local.IP.To4() == nil
+
+	var policies []netlink.XfrmPolicy
+	directions := []struct {
+		dir      netlink.Dir
+		src, dst *net.IPNet
+	}{
+		{netlink.XFRM_DIR_OUT, local, remote},
+		{netlink.XFRM_DIR_IN, remote, local},
+		{netlink.XFRM_DIR_FWD, remote, local},
+	}
+	for _, d := range directions {
+		for _, rule := range tunnel.Policy {
+			base := netlink.XfrmPolicy{
+				Src:      d.src,
+				Dst:      d.dst,
+				Proto:    rule.proto(ipv6),
+				Dir:      d.dir,
+				Priority: allowPriority,
+				Action:   netlink.XFRM_POLICY_ALLOW,
+			}
+			if rule.FirstPort == 0 {
+				policies = append(policies, base)
+				continue
+			}
+			for port := rule.FirstPort; port <= rule.LastPort; port++ {
+				toPort, fromPort := base, base
+				toPort.DstPort = port
+				fromPort.SrcPort = port
+				policies = append(policies, toPort, fromPort)
+			}
+		}
+
+		policies = append(policies, netlink.XfrmPolicy{
+			Src:      d.src,
+			Dst:      d.dst,
+			Dir:      d.dir,
+			Priority: blockPriority,
+			Action:   netlink.XFRM_POLICY_BLOCK,
+		})
+	}
+	return policies, nil
+}
+
+// installTrafficPolicy installs the XFRM policies of a tunnel's allow-list
+func installTrafficPolicy(tunnel *Tunnel) error {
+	policies, err := trafficSelectors(tunnel)
+	if err != nil {
+		return err
+	}
+
+	var batch network.Batch
+	for _, p := range policies {
+		batch.XfrmPolicyUpdate(p)
+	}
+	if err := batch.Run(); err != nil {
+		return fmt.Errorf("failed to install traffic policy: %v", err)
+	}
+	if len(policies) > 0 {
+		xfrmLog.Debug("Installed XFRM policies for the traffic policy of tunnel", "tunnel", tunnel.Name, "policies", len(policies))
+	}
+	return nil
+}
+
+// removeTrafficPolicy removes the XFRM policies of a tunnel's allow-list
+func removeTrafficPolicy(tunnel *Tunnel) error {
+	policies, err := trafficSelectors(tunnel)
+	if err != nil {
+		return err
+	}
+
+	var batch network.Batch
+	for _, p := range policies {
+		batch.XfrmPolicyDel(p)
+	}
+	if err := batch.Run(); err != nil {
+		return fmt.Errorf("failed to remove traffic policy: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,554 @@
+package tunnel
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/ca"
+)
+
+// Client profile formats
+const (
+	ProfileMobileconfig      = "mobileconfig"
+	ProfilePowerShell        = "powershell"
+	ProfileStrongSwanAndroid = "strongswan-android"
+)
+
+// ProfileFormats lists the formats ClientProfile can write
+var ProfileFormats = []string{ProfileMobileconfig, ProfilePowerShell, ProfileStrongSwanAndroid}
+
+// DefaultProfileValidity is the lifetime of the certificate in a client
+// profile. Native clients cannot renew it, so it lasts longer than those of
+// spokes: the user is given a new profile before it expires.
+const DefaultProfileValidity = 90 * 24 * time.Hour
+
+// ProfileOptions are the options of a client profile
+type ProfileOptions struct {
+	Format    string        `json:"format"`
+	Responder string        `json:"responder,omitempty"` // Responder the client connects to, the only one accepting the hub CA if empty
+	Server    string        `json:"server,omitempty"`    // Address the client connects to, the responder's local IP if empty
+	ServerID  string        `json:"server_id,omitempty"` // IKE identity of the hub, the server address if empty
+	Validity  time.Duration `json:"validity,omitempty"`  // Of the client certificate, DefaultProfileValidity if 0
+	Password  string        `json:"password,omitempty"`  // Of the certificate and key, random if empty
+}
+
+// Profile is the VPN profile of a road warrior for the native IKEv2 client of
+// its operating system, with a certificate issued to it by the hub CA
+type Profile struct {
+	Data      []byte
+	Responder string
+	Serial    string // Of the certificate issued to the user
+	NotAfter  time.Time
+	Password  string   // Of the certificate and key, when the user is asked for it on import
+	Notes     []string // What the administrator has to check or complete
+}
+
+// ClientProfile issues a certificate to a road warrior from the hub CA and
+// writes the profile that configures the native IKEv2 client of an operating
+// system to connect to a responder with it: an Apple configuration profile
+// for iOS and macOS, a PowerShell script for Windows, or a profile for the
+// strongSwan VPN Client on Android. The responder must accept certificates of
+// the hub CA, the user's identity and give it a virtual IP.
+func ClientProfile(user string, opts ProfileOptions) (*Profile, error) {
+	c, err := prepareProfile(user, opts)
+	if err != nil {
+		return nil, err
+	}
+	validity := opts.Validity
+	if validity <= 0 {
+		validity = DefaultProfileValidity
+	}
+	cert, err := c.Authority.IssueKey(user, validity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue a certificate for %s: %v", user, err)
+	}
+	c.Password = cmp.Or(opts.Password, rand.Text())
+	if c.Identity, err = cert.PKCS12(user, c.Password); err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{Responder: c.Tunnel.Name, Serial: cert.SerialNumber, NotAfter: cert.Certificate.NotAfter}
+	if profile.Data, err = c.write(opts.Format); err != nil {
+		return nil, err
+	}
+	switch opts.Format {
+	case ProfileMobileconfig:
+		profile.Notes = append(profile.Notes, "the profile carries the private key and its password, hand it to the user over a trusted channel")
+	case ProfilePowerShell:
+		profile.Notes = append(profile.Notes,
+			"the script carries the private key and its password, hand it to the user over a trusted channel",
+			fmt.Sprintf("Windows checks that the hub's certificate names %s in its subject alternative names", c.Server))
+	case ProfileStrongSwanAndroid:
+		profile.Password = c.Password
+		profile.Notes = append(profile.Notes, "the strongSwan VPN Client asks for the password of the certificate on import, give it to the user separately")
+	}
+	if c.Tunnel.PostQuantum {
+		profile.Notes = append(profile.Notes, fmt.Sprintf("%s has no post-quantum key exchange, the client connects with %s and classical key exchange", opts.Format, c.Settings.IKE.Cipher))
+	} else if c.Settings.IKE.Cipher != c.Tunnel.Encryption {
+		profile.Notes = append(profile.Notes, fmt.Sprintf("the client connects with %s rather than %s", c.Settings.IKE.Cipher, c.Tunnel.Encryption))
+	}
+	profile.Notes = append(profile.Notes, fmt.Sprintf("the hub must authenticate as %s with a certificate of its CA, see 'ipsec-vpn ca issue %s'", c.ServerID, c.ServerID))
+	return profile, nil
+}
+
+// CheckProfile checks that ClientProfile can write a profile for a user,
+// without issuing a certificate
+func CheckProfile(user string, opts ProfileOptions) error {
+	c, err := prepareProfile(user, opts)
+	if err != nil {
+		return err
+	}
+	_, err = c.write(opts.Format)
+	return err
+}
+
+// prepareProfile checks that a responder takes a user with a native client,
+// and works out what its profile is written from but the user's identity
+func prepareProfile(user string, opts ProfileOptions) (*clientProfile, error) {
+	if !slices.Contains(ProfileFormats, opts.Format) {
+		return nil, fmt.Errorf("unknown format %q, expected one of %s", opts.Format, strings.Join(ProfileFormats, ", "))
+	}
+	if user == "" {
+		return nil, errors.New("no user to write a profile for")
+	}
+	tunnel, err := profileResponder(opts.Responder)
+	if err != nil {
+		return nil, err
+	}
+	if tunnel.PeerID != "" {
+		if ok, _ := path.Match(tunnel.PeerID, user); !ok {
+			return nil, fmt.Errorf("identity %q does not match the peer ID pattern %q of responder '%s'", user, tunnel.PeerID, tunnel.Name)
+		}
+	}
+	if tunnel.VirtualIPPool == "" && tunnel.VirtualIPs[user] == "" {
+		return nil, fmt.Errorf("responder '%s' has no virtual IP for %s, which native clients need: set a pool or map one to the identity", tunnel.Name, user)
+	}
+
+	server := opts.Server
+	if server == "" {
+		if ip := net.ParseIP(tunnel.LocalIP); ip == nil || ip.IsUnspecified() {
+			return nil, fmt.Errorf("responder '%s' listens on %s, give the address clients connect to", tunnel.Name, tunnel.LocalIP)
+		}
+		server = tunnel.LocalIP
+	}
+
+	// Windows has no ChaCha20-Poly1305 and takes an AES-GCM proposal if there is one
+	cipher := cipherFor(tunnel)
+	if opts.Format == ProfilePowerShell {
+		cipher = "aes256gcm"
+	}
+	settings, err := peerSettingsFor(tunnel, opts.Format, cipher)
+	if err != nil {
+		return nil, err
+	}
+	if settings.IKEv1 {
+		return nil, errors.New("native clients connect with IKEv2, and advanced.ike_version is 1")
+	}
+
+	authority, err := ca.Load()
+	if err != nil {
+		return nil, err
+	}
+	return &clientProfile{
+		Tunnel:    tunnel,
+		User:      user,
+		Server:    server,
+		ServerID:  cmp.Or(opts.ServerID, server),
+		Settings:  settings,
+		Authority: authority,
+	}, nil
+}
+
+// profileResponder returns the responder a client profile is for: the one
+// named, or the only responder accepting certificates of the hub CA
+func profileResponder(name string) (*Tunnel, error) {
+	if name != "" {
+		tunnel, err := loadTunnel(name)
+		if err != nil {
+			return nil, err
+		}
+		if !tunnel.Responder() {
+			return nil, fmt.Errorf("tunnel '%s' is not a responder, with remote IP %s", name, AnyPeer)
+		}
+		if tunnel.PeerCA != HubCA {
+			return nil, fmt.Errorf("responder '%s' does not accept certificates of the hub CA, with --peer-ca %s", name, HubCA)
+		}
+		return tunnel, nil
+	}
+
+	tunnels, err := ListConfigured()
+	if err != nil {
+		return nil, err
+	}
+	var responders []*Tunnel
+	for _, tunnel := range tunnels {
+		if tunnel.Responder() && tunnel.PeerCA == HubCA {
+			responders = append(responders, tunnel)
+		}
+	}
+	switch len(responders) {
+	case 0:
+		return nil, fmt.Errorf("no responder accepts certificates of the hub CA, create one with --remote-ip %s --peer-ca %s", AnyPeer, HubCA)
+	case 1:
+		return responders[0], nil
+	default:
+		return nil, errors.New("several responders accept certificates of the hub CA, pick one")
+	}
+}
+
+// clientProfile is what the profiles of every format are written from
+type clientProfile struct {
+	Tunnel    *Tunnel
+	User      string
+	Server    string
+	ServerID  string
+	Settings  *peerSettings
+	Authority *ca.CA
+	Identity  []byte // PKCS #12 file with the user's certificate and key
+	Password  string // Of Identity
+}
+
+// write writes the profile in a format
+func (c *clientProfile) write(format string) ([]byte, error) {
+	switch format {
+	case ProfileMobileconfig:
+		return c.mobileconfig()
+	case ProfilePowerShell:
+		return c.powerShell()
+	default:
+		return c.strongSwanAndroid()
+	}
+}
+
+// displayName is the name of the VPN connection on the client
+func (c *clientProfile) displayName() string {
+	return "ipsec-vpn " + c.Tunnel.Name
+}
+
+// plistDict is a property list dictionary, its keys in order
+type plistDict []plistEntry
+
+// plistEntry is a key of a property list dictionary and its value: a string,
+// int, bool, []byte, plistDict or []plistDict
+type plistEntry struct {
+	Key   string
+	Value any
+}
+
+// writePlist writes a property list value in the XML format
+func writePlist(buf *bytes.Buffer, v any, indent string) {
+	switch v := v.(type) {
+	case string:
+		buf.WriteString(indent + "<string>")
+		xml.EscapeText(buf, []byte(v))
+		buf.WriteString("</string>\n")
+	case int:
+		fmt.Fprintf(buf, "%s<integer>%d</integer>\n", indent, v)
+	case bool:
+		fmt.Fprintf(buf, "%s<%t/>\n", indent, v)
+	case []byte:
+		fmt.Fprintf(buf, "%s<data>%s</data>\n", indent, base64.StdEncoding.EncodeToString(v))
+	case plistDict:
+		buf.WriteString(indent + "<dict>\n")
+		for _, e := range v {
+			buf.WriteString(indent + "\t<key>")
+			xml.EscapeText(buf, []byte(e.Key))
+			buf.WriteString("</key>\n")
+			writePlist(buf, e.Value, indent+"\t")
+		}
+		buf.WriteString(indent + "</dict>\n")
+	case []plistDict:
+		buf.WriteString(indent + "<array>\n")
+		for _, d := range v {
+			writePlist(buf, d, indent+"\t")
+		}
+		buf.WriteString(indent + "</array>\n")
+	default:
+		panic(fmt.Sprintf("unsupported property list value %T", v))
+	}
+}
+
+// newUUID returns a random UUID, as payloads and profiles are identified by
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// appleCipher names a cipher the way Apple's IKEv2 client does
+func appleCipher(cipher string) (string, error) {
+	switch cipher {
+	case "aes256gcm":
+		return "AES-256-GCM", nil
+	case "chacha20poly1305":
+		return "ChaCha20Poly1305", nil
+	}
+	return "", fmt.Errorf("Apple's IKEv2 client has no cipher %s", cipher)
+}
+
+// appleIntegrity names a hash the way Apple's IKEv2 client does
+func appleIntegrity(hash string) (string, error) {
+	switch hash {
+	case "sha256", "sha384", "sha512":
+		return "SHA2-" + strings.TrimPrefix(hash, "sha"), nil
+	}
+	return "", fmt.Errorf("Apple's IKEv2 client has no integrity algorithm %s", hash)
+}
+
+// appleSA returns the parameters of an IKE or child SA of an Apple profile
+func appleSA(p proposal, group, lifetime int) (plistDict, error) {
+	cipher, err := appleCipher(p.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	integrity, err := appleIntegrity(p.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if group == 32 {
+		return nil, errors.New("Apple's IKEv2 client has no Curve448 key exchange")
+	}
+	return plistDict{
+		{"EncryptionAlgorithm", cipher},
+		{"IntegrityAlgorithm", integrity},
+		{"DiffieHellmanGroup", group},
+		{"LifeTimeInMinutes", min(max(lifetime/60, 10), 1440)},
+	}, nil
+}
+
+// mobileconfig writes an Apple configuration profile for iOS and macOS with
+// the hub CA, the user's identity and the VPN connection
+func (c *clientProfile) mobileconfig() ([]byte, error) {
+	s := c.Settings
+	ike, err := appleSA(s.IKE, s.IKE.Group, s.Lifetime)
+	if err != nil {
+		return nil, err
+	}
+	child, err := appleSA(s.ESP, cmp.Or(s.PFSGroup, s.IKE.Group), s.Lifetime)
+	if err != nil {
+		return nil, err
+	}
+	// Apple's client sends DPD every minute at High, 10 at Medium and 30 at Low
+	dpd := "None"
+	switch {
+	case s.DPDDelay == 0:
+	case s.DPDDelay <= 60:
+		dpd = "High"
+	case s.DPDDelay <= 600:
+		dpd = "Medium"
+	default:
+		dpd = "Low"
+	}
+	pfs := 0
+	if s.PFSGroup != 0 {
+		pfs = 1
+	}
+
+	identifier := fmt.Sprintf("ipsec-vpn.%s.%s", c.Tunnel.Name, c.User)
+	identityUUID := newUUID()
+	profile := plistDict{
+		{"PayloadContent", []plistDict{
+			{
+				{"PayloadType", "com.apple.security.root"},
+				{"PayloadVersion", 1},
+				{"PayloadIdentifier", identifier + ".ca"},
+				{"PayloadUUID", newUUID()},
+				{"PayloadDisplayName", c.Authority.Certificate.Subject.CommonName},
+				{"PayloadCertificateFileName", "ca.cer"},
+				{"PayloadContent", c.Authority.Certificate.Raw},
+			},
+			{
+				{"PayloadType", "com.apple.security.pkcs12"},
+				{"PayloadVersion", 1},
+				{"PayloadIdentifier", identifier + ".identity"},
+				{"PayloadUUID", identityUUID},
+				{"PayloadDisplayName", c.User},
+				{"PayloadCertificateFileName", c.User + ".p12"},
+				{"PayloadContent", c.Identity},
+				{"Password", c.Password},
+			},
+			{
+				{"PayloadType", "com.apple.vpn.managed"},
+				{"PayloadVersion", 1},
+				{"PayloadIdentifier", identifier + ".vpn"},
+				{"PayloadUUID", newUUID()},
+				{"PayloadDisplayName", c.displayName()},
+				{"UserDefinedName", c.displayName()},
+				{"VPNType", "IKEv2"},
+				{"IKEv2", plistDict{
+					{"RemoteAddress", c.Server},
+					{"RemoteIdentifier", c.ServerID},
+					{"LocalIdentifier", c.User},
+					{"AuthenticationMethod", "Certificate"},
+					{"CertificateType", "ECDSA256"},
+					{"PayloadCertificateUUID", identityUUID},
+					{"ServerCertificateIssuerCommonName", c.Authority.Certificate.Subject.CommonName},
+					{"ExtendedAuthEnabled", 0},
+					{"DeadPeerDetectionRate", dpd},
+					{"EnablePFS", pfs},
+					{"IKESecurityAssociationParameters", ike},
+					{"ChildSecurityAssociationParameters", child},
+				}},
+			},
+		}},
+		{"PayloadDisplayName", c.displayName()},
+		{"PayloadDescription", fmt.Sprintf("VPN connection of %s to %s", c.User, c.Server)},
+		{"PayloadIdentifier", identifier},
+		{"PayloadType", "Configuration"},
+		{"PayloadUUID", newUUID()},
+		{"PayloadVersion", 1},
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	buf.WriteString(`<plist version="1.0">` + "\n")
+	writePlist(&buf, profile, "")
+	buf.WriteString("</plist>\n")
+	return buf.Bytes(), nil
+}
+
+// windowsGroups names DH groups the way Set-VpnConnectionIPsecConfiguration
+// does, for IKE and for PFS
+var windowsGroups = map[int][2]string{
+	14: {"Group14", "PFS2048"},
+	19: {"ECP256", "ECP256"},
+	20: {"ECP384", "ECP384"},
+}
+
+// powerShellQuote quotes a string for PowerShell
+func powerShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// powerShell writes a PowerShell script that imports the hub CA and the
+// user's identity into the machine store and adds the VPN connection
+func (c *clientProfile) powerShell() ([]byte, error) {
+	s := c.Settings
+	if s.IKE.Cipher != "aes256gcm" || s.ESP.Cipher != "aes256gcm" {
+		return nil, errors.New("Windows has no ChaCha20-Poly1305, add an aes256gcm proposal to advanced.ike_proposals")
+	}
+	integrity := strings.ToUpper(s.IKE.Hash)
+	if integrity != "SHA256" && integrity != "SHA384" {
+		return nil, fmt.Errorf("Windows has no integrity algorithm %s", s.IKE.Hash)
+	}
+	group, ok := windowsGroups[s.IKE.Group]
+	if !ok {
+		return nil, fmt.Errorf("Windows has no DH group %d, add a proposal with ecp384, ecp256 or modp2048", s.IKE.Group)
+	}
+	pfs := "None"
+	if s.PFSGroup != 0 {
+		g, ok := windowsGroups[s.PFSGroup]
+		if !ok {
+			return nil, fmt.Errorf("Windows has no PFS group %d, add a proposal with ecp384, ecp256 or modp2048", s.PFSGroup)
+		}
+		pfs = g[1]
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# ipsec-vpn profile of %s for responder '%s' at %s\n", c.User, c.Tunnel.Name, c.Server)
+	buf.WriteString("# Run in an elevated PowerShell: it imports the certificate into the machine store\n")
+	buf.WriteString("#Requires -RunAsAdministrator\n")
+	buf.WriteString("$ErrorActionPreference = 'Stop'\n\n")
+	fmt.Fprintf(&buf, "$Name = %s\n", powerShellQuote(c.displayName()))
+	fmt.Fprintf(&buf, "$CA = [Convert]::FromBase64String('%s')\n", base64.StdEncoding.EncodeToString(c.Authority.Certificate.Raw))
+	fmt.Fprintf(&buf, "$Identity = [Convert]::FromBase64String('%s')\n", base64.StdEncoding.EncodeToString(c.Identity))
+	fmt.Fprintf(&buf, "$Password = ConvertTo-SecureString -String %s -AsPlainText -Force\n\n", powerShellQuote(c.Password))
+
+	buf.WriteString("$Dir = New-Item -ItemType Directory -Path (Join-Path $env:TEMP ([guid]::NewGuid()))\n")
+	buf.WriteString("try {\n")
+	buf.WriteString("    [IO.File]::WriteAllBytes(\"$Dir\\ca.cer\", $CA)\n")
+	buf.WriteString("    [IO.File]::WriteAllBytes(\"$Dir\\identity.p12\", $Identity)\n")
+	buf.WriteString("    Import-Certificate -FilePath \"$Dir\\ca.cer\" -CertStoreLocation Cert:\\LocalMachine\\Root | Out-Null\n")
+	buf.WriteString("    Import-PfxCertificate -FilePath \"$Dir\\identity.p12\" -CertStoreLocation Cert:\\LocalMachine\\My -Password $Password | Out-Null\n")
+	buf.WriteString("} finally {\n")
+	buf.WriteString("    Remove-Item -Recurse -Force $Dir\n")
+	buf.WriteString("}\n\n")
+
+	buf.WriteString("Get-VpnConnection -Name $Name -AllUserConnection -ErrorAction SilentlyContinue | Remove-VpnConnection -AllUserConnection -Force\n")
+	fmt.Fprintf(&buf, "Add-VpnConnection -Name $Name -ServerAddress %s -TunnelType Ikev2 -AuthenticationMethod MachineCertificate -EncryptionLevel Required -SplitTunneling -AllUserConnection\n",
+		powerShellQuote(c.Server))
+	fmt.Fprintf(&buf, "Set-VpnConnectionIPsecConfiguration -ConnectionName $Name -AuthenticationTransformConstants GCMAES256 -CipherTransformConstants GCMAES256 -EncryptionMethod GCMAES256 -IntegrityCheckMethod %s -DHGroup %s -PfsGroup %s -AllUserConnection -Force\n",
+		integrity, group[0], pfs)
+	fmt.Fprintf(&buf, "Add-VpnConnectionRoute -ConnectionName $Name -DestinationPrefix %s -AllUserConnection\n", powerShellQuote(c.Tunnel.LocalSubnet))
+	return buf.Bytes(), nil
+}
+
+// strongSwanGroup names a DH group the way strongSwan does
+func strongSwanGroup(group int) string {
+	for _, name := range slices.Sorted(maps.Keys(dhGroups)) {
+		if dhGroups[name] == group {
+			return name
+		}
+	}
+	return ""
+}
+
+// sswanProfile is a profile of the strongSwan VPN Client for Android
+type sswanProfile struct {
+	UUID           string      `json:"uuid"`
+	Name           string      `json:"name"`
+	Type           string      `json:"type"`
+	Remote         sswanRemote `json:"remote"`
+	Local          sswanLocal  `json:"local"`
+	IKEProposal    string      `json:"ike-proposal"`
+	ESPProposal    string      `json:"esp-proposal"`
+	SplitTunneling sswanSplit  `json:"split-tunneling"`
+}
+
+type sswanRemote struct {
+	Addr string `json:"addr"`
+	ID   string `json:"id"`
+	Cert string `json:"cert"` // CA certificate, base64 DER
+}
+
+type sswanLocal struct {
+	ID  string `json:"id"`
+	P12 string `json:"p12"` // PKCS #12 identity, base64
+}
+
+type sswanSplit struct {
+	Subnets string `json:"subnets"` // Routed through the tunnel, separated by spaces
+}
+
+// strongSwanAndroid writes a profile of the strongSwan VPN Client for Android
+func (c *clientProfile) strongSwanAndroid() ([]byte, error) {
+	s := c.Settings
+	ike := []string{strongSwanCipher(s.IKE.Cipher), "prf" + s.IKE.Hash, strongSwanGroup(s.IKE.Group)}
+	esp := []string{strongSwanCipher(s.ESP.Cipher)}
+	if s.PFSGroup != 0 {
+		esp = append(esp, strongSwanGroup(s.PFSGroup))
+	}
+	data, err := json.MarshalIndent(sswanProfile{
+		UUID: strings.ToLower(newUUID()),
+		Name: c.displayName(),
+		Type: "ikev2-cert",
+		Remote: sswanRemote{
+			Addr: c.Server,
+			ID:   c.ServerID,
+			Cert: base64.StdEncoding.EncodeToString(c.Authority.Certificate.Raw),
+		},
+		Local:          sswanLocal{ID: c.User, P12: base64.StdEncoding.EncodeToString(c.Identity)},
+		IKEProposal:    strings.Join(ike, "-"),
+		ESPProposal:    strings.Join(esp, "-"),
+		SplitTunneling: sswanSplit{Subnets: c.Tunnel.LocalSubnet},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,24 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/secret"
+)
+
+// resolvePSK reads the pre-shared key the reference of a tunnel points to, nil
+// without one. The key is only held for as long as it is needed and never
+// stored with the tunnel; the caller zeroizes it.
+func resolvePSK(t *Tunnel) ([]byte, error) {
+	if t.PSKRef == "" {
+		return nil, nil
+	}
+	psk, err := secret.ResolvePSK(context.Background(), t.PSKRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the pre-shared key %s: %w", t.PSKRef, err)
+	}
+	tunnelLog.Debug("Resolved pre-shared key", "tunnel", t.Name, "ref", t.PSKRef, "fingerprint", keys.Fingerprint(psk))
+	return psk, nil
+}
@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// SetRateLimit limits the bandwidth of a tunnel's peer, in bits per second in
+// each direction, or removes the limit if it is 0
+func SetRateLimit(name string, bitsPerSecond uint64) error {
+	if err := RequireSelfTest(); err != nil {
+		return err
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+
+	previous := tunnel.RateLimit
+	tunnel.RateLimit = bitsPerSecond
+	if err := applyRateLimit(tunnel, previous); err != nil {
+		return err
+	}
+
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// applyRateLimit installs the rate limit of a tunnel on its interface, or removes
+// a previous limit that has been turned off
+func applyRateLimit(tunnel *Tunnel, previous uint64) error {
+	if tunnel.RateLimit == 0 && previous == 0 {
+		return nil
+	}
+
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	iface := tunnel.Interface()
+	if tunnel.RateLimit == 0 {
+		tunnelLog.Debug("Removing rate limit of tunnel", "tunnel", tunnel.Name)
+		return network.ClearRateLimit(handle, iface)
+	}
+	tunnelLog.Debug("Limiting tunnel", "tunnel", tunnel.Name, "rate", network.FormatRate(tunnel.RateLimit))
+	return network.SetRateLimit(handle, iface, tunnel.RateLimit)
+}
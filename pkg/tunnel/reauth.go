@@ -0,0 +1,258 @@
+package tunnel
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+)
+
+// What the IKE daemon reports of a reauthentication
+const (
+	ReauthSuccess = "success"
+	ReauthFailure = "failure"
+)
+
+// ReauthResults lists what the IKE daemon may report of a reauthentication
+var ReauthResults = []string{ReauthSuccess, ReauthFailure}
+
+// ReauthPolicy sets how often the IKE SA of a tunnel is reauthenticated. A
+// rekey only derives new keys, while a reauthentication negotiates a new IKE
+// SA from scratch, checking the peer's credentials again, as some security
+// policies require every so many hours. The SAs outlive a reauthentication
+// that is due by the grace, so that the new ones are up before the old ones
+// go; a tunnel whose reauthentication has not succeeded by then is overdue.
+type ReauthPolicy struct {
+	Interval time.Duration `json:"interval"` // 0 to only rekey
+	Grace    time.Duration `json:"grace,omitempty"`
+}
+
+// Validate checks that a reauthentication is at least a minute apart from the
+// next and its grace shorter than that
+func (p ReauthPolicy) Validate() error {
+	if p.Interval < 0 || p.Grace < 0 {
+		return errors.New("reauthentication interval and grace must not be negative")
+	}
+	if p.Interval > 0 && p.Interval < time.Minute {
+		return fmt.Errorf("reauthentication interval must be at least 1m, got %s", p.Interval)
+	}
+	if p.Interval > 0 && p.Grace >= p.Interval {
+		return fmt.Errorf("reauthentication grace (%s) must be shorter than the interval (%s)", p.Grace, p.Interval)
+	}
+	return nil
+}
+
+// String describes the policy
+func (p ReauthPolicy) String() string {
+	if p.Interval == 0 {
+		return "rekey only"
+	}
+	return fmt.Sprintf("every %s, grace %s", p.Interval, p.Grace)
+}
+
+// ReauthCounts counts the reauthentications the IKE daemon reported for a tunnel
+type ReauthCounts struct {
+	Successes   uint64    `json:"successes"`
+	Failures    uint64    `json:"failures"`
+	LastAttempt time.Time `json:"last_attempt,omitzero"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	LastResult  string    `json:"last_result,omitempty"`
+	LastReason  string    `json:"last_reason,omitempty"`
+}
+
+// ReauthDue returns when the IKE SA of a tunnel is next to be reauthenticated:
+// the interval after it last authenticated, by a reauthentication or by coming
+// up. It is zero for a tunnel that is not up or only rekeys.
+func ReauthDue(t *Tunnel, p ReauthPolicy, c *ReauthCounts) time.Time {
+	if p.Interval == 0 || t.Status != StatusUp {
+		return time.Time{}
+	}
+	last := t.LastTransition
+	if c != nil && c.LastSuccess.After(last) {
+		last = c.LastSuccess
+	}
+	if last.IsZero() {
+		last = t.CreatedAt
+	}
+	return last.Add(p.Interval)
+}
+
+// ReauthOverdue reports whether the grace of a due reauthentication ran out
+// without one succeeding
+func ReauthOverdue(t *Tunnel, p ReauthPolicy, c *ReauthCounts, now time.Time) bool {
+	due := ReauthDue(t, p, c)
+	return !due.IsZero() && now.After(due.Add(p.Grace))
+}
+
+// EffectiveReauth returns the reauthentication policy of a tunnel and where it
+// comes from: the tunnel's own, its peer group's, or the configuration file's
+// advanced.reauth_interval and advanced.reauth_grace
+func EffectiveReauth(t *Tunnel) (ReauthPolicy, string) {
+	return std.EffectiveReauth(t)
+}
+
+// EffectiveReauth returns the reauthentication policy of a tunnel and where it comes from
+func (m *Manager) EffectiveReauth(t *Tunnel) (ReauthPolicy, string) {
+	if t.Reauth != nil {
+		return *t.Reauth, "tunnel"
+	}
+	s := m.IKESettingsOf(t)
+	p := ReauthPolicy{
+		Interval: time.Duration(s.ReauthInterval) * time.Second,
+		Grace:    time.Duration(s.ReauthGrace) * time.Second,
+	}
+	if s.Group != "" {
+		if g, err := m.PeerGroup(s.Group); err == nil && (g.ReauthInterval > 0 || g.ReauthGrace > 0) {
+			return p, "peer group " + s.Group
+		}
+	}
+	if m.settings != nil {
+		return p, "manager settings"
+	}
+	return p, "configuration file"
+}
+
+// SetReauth sets the reauthentication policy of a tunnel, or makes it use that
+// of its peer group or the configuration file again if p is nil. The IKE
+// daemon applies it from the next IKE SA it negotiates.
+func SetReauth(name string, p *ReauthPolicy) error {
+	return std.SetReauth(name, p)
+}
+
+// SetReauth sets the reauthentication policy of a tunnel
+func (m *Manager) SetReauth(name string, p *ReauthPolicy) error {
+	t, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+	if t.Mode == ModeWireGuard {
+		return fmt.Errorf("tunnel '%s' is a WireGuard tunnel, which has no IKE SA to reauthenticate", name)
+	}
+	if p != nil {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	t.Reauth = p
+	t.UpdatedAt = time.Now()
+	if err := m.save(t); err != nil {
+		return err
+	}
+	policy, source := m.EffectiveReauth(t)
+	m.logger().Info("Set reauthentication policy of tunnel", "tunnel", name, "policy", policy, "source", source)
+	return nil
+}
+
+// Reauths returns the reauthentication counts of a tunnel, zero if none were
+// reported
+func Reauths(name string) (*ReauthCounts, error) {
+	return std.Reauths(name)
+}
+
+// Reauths returns the reauthentication counts of a tunnel
+func (m *Manager) Reauths(name string) (*ReauthCounts, error) {
+	path, err := m.reauthPath(name)
+	if err != nil {
+		return nil, err
+	}
+	counts := &ReauthCounts{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return counts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, counts); err != nil {
+		return nil, fmt.Errorf("failed to read reauthentication counts of tunnel '%s': %v", name, err)
+	}
+	return counts, nil
+}
+
+// RecordReauth counts a reauthentication of the IKE SA of a tunnel that the
+// IKE daemon reports, logs it and publishes it as a tunnel.reauth.succeeded or
+// tunnel.reauth.failed event
+func RecordReauth(name, result, reason string) (*ReauthCounts, error) {
+	return std.RecordReauth(name, result, reason)
+}
+
+// RecordReauth counts a reauthentication of the IKE SA of a tunnel
+func (m *Manager) RecordReauth(name, result, reason string) (*ReauthCounts, error) {
+	if !slices.Contains(ReauthResults, result) {
+		return nil, fmt.Errorf("invalid result %q, expected %s", result, strings.Join(ReauthResults, ", "))
+	}
+	t, err := m.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if t.Mode == ModeWireGuard {
+		return nil, fmt.Errorf("tunnel '%s' is a WireGuard tunnel, which has no IKE SA to reauthenticate", name)
+	}
+	counts, err := m.Reauths(name)
+	if err != nil {
+		return nil, err
+	}
+	policy, _ := m.EffectiveReauth(t)
+	now := time.Now()
+	// The grace of a failure runs from when the reauthentication was due
+	due := ReauthDue(t, policy, counts)
+
+	counts.LastAttempt, counts.LastResult, counts.LastReason = now, result, reason
+	e := events.New(events.TypeReauthSucceeded, name)
+	e.Status = string(t.Status)
+	if result == ReauthSuccess {
+		counts.Successes++
+		counts.LastSuccess = now
+		e.Reason = "IKE SA reauthenticated"
+		m.logger().Info("Reauthenticated IKE SA", "tunnel", name)
+	} else {
+		counts.Failures++
+		e.Type = events.TypeReauthFailed
+		e.Reason = cmp.Or(reason, "reauthentication failed")
+		if !due.IsZero() {
+			e.Reason += fmt.Sprintf(", the SAs are kept until %s", due.Add(policy.Grace).Format(time.RFC3339))
+		}
+		m.logger().Error("Failed to reauthenticate IKE SA", "tunnel", name, "reason", e.Reason)
+	}
+	if err := m.saveReauths(name, counts); err != nil {
+		return nil, err
+	}
+	m.send(e)
+	return counts, nil
+}
+
+// saveReauths writes the reauthentication counts of a tunnel
+func (m *Manager) saveReauths(name string, counts *ReauthCounts) error {
+	path, err := m.reauthPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// reauthPath returns the file the reauthentication counts of a tunnel are kept in
+func (m *Manager) reauthPath(name string) (string, error) {
+	dir, err := m.dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "reauth", name+".json"), nil
+}
@@ -0,0 +1,345 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/dzakwan/ipsec-vpn/pkg/retry"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultReconcileInterval is how often the reconciler compares the tunnels with
+// the kernel, unless reconcile.interval says otherwise
+const DefaultReconcileInterval = 30 * time.Second
+
+// ReconcileInterval returns how often the reconciler runs
+func ReconcileInterval() time.Duration {
+	return ConfiguredSettings().reconcileInterval()
+}
+
+// Default bounds of the delay before the reconciler repairs a tunnel that keeps
+// drifting, such as one whose peer flaps, again, unless reconcile.backoff_initial
+// and reconcile.backoff_max say otherwise
+const (
+	DefaultBackoffInitial = 30 * time.Second
+	DefaultBackoffMax     = 15 * time.Minute
+)
+
+// Drift is a difference between the configuration of a tunnel and the kernel
+type Drift struct {
+	Tunnel   string
+	Problem  string
+	Repaired bool
+	Err      error // Why the repair failed
+	repair   func() error
+}
+
+// SyncState records whether a tunnel matched the kernel when last reconciled,
+// and how the repairs of a tunnel that keeps drifting are held back
+type SyncState struct {
+	InSync     bool      `json:"in_sync"`
+	Drift      []string  `json:"drift,omitempty"`    // Drift that remains
+	Repaired   []string  `json:"repaired,omitempty"` // Drift that was repaired
+	Checked    time.Time `json:"checked"`
+	Repairs    int       `json:"repairs,omitempty"`    // Passes that repaired the tunnel since it was last stable
+	LastRepair time.Time `json:"last_repair,omitzero"` // When a repair was last attempted
+	NextRetry  time.Time `json:"next_retry,omitzero"`  // Drift is not repaired before then
+}
+
+// BackingOff reports whether the reconciler holds back repairs of the tunnel
+// at a time
+func (s *SyncState) BackingOff(now time.Time) bool {
+	return s != nil && now.Before(s.NextRetry)
+}
+
+func (s *SyncState) String() string {
+	if s.InSync {
+		return "in sync"
+	}
+	return "drifted"
+}
+
+// kernelReader reads what the reconciler compares the tunnels with
+type kernelReader interface {
+	link(tunnel *Tunnel) (exists, up bool, err error)
+	blockRoute(subnet string) (bool, error)
+	policy(p *netlink.XfrmPolicy) (bool, error)
+}
+
+// kernelState is a variable so tests can do without links, routes and XFRM policies
+var kernelState kernelReader = netlinkState{}
+
+// netlinkState reads the kernel through netlink
+type netlinkState struct{}
+
+func (netlinkState) link(tunnel *Tunnel) (bool, bool, error) {
+	if tunnel.Namespace == "" {
+		if exists, up, ok := links.lookup(tunnel.Interface()); ok {
+			return exists, up, nil
+		}
+	}
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return false, false, err
+	}
+	defer handle.Close()
+	link, err := handle.LinkByName(tunnel.Interface())
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	return true, link.Attrs().Flags&unix.IFF_UP != 0, nil
+}
+
+func (netlinkState) blockRoute(subnet string) (bool, error) {
+	return network.HasBlockRoute(subnet)
+}
+
+func (netlinkState) policy(p *netlink.XfrmPolicy) (bool, error) {
+	if _, err := network.Handle().XfrmPolicyGet(p); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// CheckDrift compares a tunnel with the kernel: its interface must exist and,
+// while the tunnel is up, be up; its kill-switch block route and the XFRM
+// policies of its traffic policy must be installed. The default route, which
+// GuardDefaultRoute keeps in step, is left out.
+func CheckDrift(tunnel *Tunnel) ([]*Drift, error) {
+	if tunnel.Responder() {
+		return nil, nil // Only its instances are in the kernel
+	}
+	var drift []*Drift
+	add := func(problem string, repair func() error) {
+		drift = append(drift, &Drift{Tunnel: tunnel.Name, Problem: problem, repair: repair})
+	}
+
+	exists, up, err := kernelState.link(tunnel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read interface %s: %v", tunnel.Interface(), err)
+	}
+	switch {
+	case !exists:
+		add(fmt.Sprintf("interface %s is missing", tunnel.Interface()), func() error {
+			if err := createLink(tunnel); err != nil {
+				return err
+			}
+			if tunnel.Namespace != "" {
+				if err := moveToNamespace(tunnel); err != nil {
+					return err
+				}
+			}
+			if tunnel.Status == StatusUp {
+				return startTunnel(tunnel)
+			}
+			return nil
+		})
+	case tunnel.Status == StatusUp && !up:
+		add(fmt.Sprintf("interface %s is down", tunnel.Interface()), func() error {
+			return setLinkUp(tunnel)
+		})
+	}
+
+	if tunnel.KillSwitchEnabled() && tunnel.RemoteSubnet != "" {
+		installed, err := kernelState.blockRoute(tunnel.RemoteSubnet)
+		if err != nil {
+			return nil, err
+		}
+		if !installed {
+			add(fmt.Sprintf("kill-switch block route for %s is missing", tunnel.RemoteSubnet), func() error {
+				return installKillSwitch(tunnel)
+			})
+		}
+	}
+
+	policies, err := trafficSelectors(tunnel)
+	if err != nil {
+		return nil, err
+	}
+	missing := 0
+	for i := range policies {
+		installed, err := kernelState.policy(&policies[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read XFRM policy: %v", err)
+		}
+		if !installed {
+			missing++
+		}
+	}
+	if missing > 0 {
+		add(fmt.Sprintf("%d of %d traffic policy XFRM policies are missing", missing, len(policies)), func() error {
+			return installTrafficPolicy(tunnel)
+		})
+	}
+	return drift, nil
+}
+
+// Reconcile compares every tunnel with the kernel and, unless dryRun, repairs
+// the drift it finds. Whether each tunnel is in sync afterwards is recorded for
+// show. A tunnel that cannot be checked is reported as drifted.
+//
+// A tunnel repaired on consecutive passes, as when its peer flaps, is not
+// repaired again before a delay that doubles with each repair up to
+// reconcile.backoff_max, unless force; its drift is then reported with
+// ErrBackingOff. Once it has stayed in sync for that long, it is repaired at
+// once again.
+func Reconcile(dryRun, force bool) ([]*Drift, error) {
+	tunnels, err := ListAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var all []*Drift
+	backoff := ConfiguredSettings().renegotiationBackoff()
+	for _, t := range tunnels {
+		drift, err := CheckDrift(t)
+		if err != nil {
+			drift = []*Drift{{Tunnel: t.Name, Problem: "cannot be checked", Err: err}}
+		}
+		prev, err := Sync(t.Name)
+		if err != nil {
+			tunnelLog.Error("Failed to read the sync state of tunnel", "tunnel", t.Name, "err", err)
+		}
+		now := time.Now()
+		state := &SyncState{Checked: now}
+		if prev != nil {
+			state.Repairs, state.LastRepair, state.NextRetry = prev.Repairs, prev.LastRepair, prev.NextRetry
+		}
+		repair := !dryRun && slices.ContainsFunc(drift, func(d *Drift) bool { return d.repair != nil })
+		switch {
+		case repair && !force && state.BackingOff(now):
+			// A tunnel whose peer flaps is not renegotiated on every pass
+			tunnelLog.Debug("Holding back repair of tunnel", "tunnel", t.Name, "next_retry", state.NextRetry, "repairs", state.Repairs)
+			for _, d := range drift {
+				if d.repair != nil {
+					d.Err = fmt.Errorf("%w until %s", ErrBackingOff, state.NextRetry.Format(time.DateTime))
+				}
+			}
+			repair = false
+		case repair:
+			state.recordRepair(now, backoff)
+		case len(drift) == 0:
+			state.settle(now, backoff)
+		}
+		for _, d := range drift {
+			if repair && d.repair != nil {
+				if d.Err = d.repair(); d.Err == nil {
+					d.Repaired = true
+					tunnelLog.Info("Repaired drift of tunnel", "tunnel", t.Name, "problem", d.Problem)
+					state.Repaired = append(state.Repaired, d.Problem)
+					continue
+				}
+				tunnelLog.Error("Failed to repair drift of tunnel", "tunnel", t.Name, "problem", d.Problem, "err", d.Err)
+			}
+			state.Drift = append(state.Drift, d.Problem)
+		}
+		state.InSync = len(state.Drift) == 0
+		if err := saveSyncState(t.Name, state); err != nil {
+			tunnelLog.Error("Failed to record the sync state of tunnel", "tunnel", t.Name, "err", err)
+		}
+		all = append(all, drift...)
+	}
+	return all, nil
+}
+
+// recordRepair counts a repair of a tunnel at a time and, if it was repaired
+// on the pass before too, holds the next one back
+func (s *SyncState) recordRepair(now time.Time, backoff retry.Policy) {
+	s.Repairs++
+	s.LastRepair = now
+	s.NextRetry = time.Time{}
+	if s.Repairs > 1 {
+		s.NextRetry = now.Add(backoff.Backoff(s.Repairs - 2))
+	}
+}
+
+// settle forgets the repairs of a tunnel in sync at a time once it has stayed
+// so for the longest delay, so that it is repaired at once again
+func (s *SyncState) settle(now time.Time, backoff retry.Policy) {
+	if s.Repairs > 0 && now.Sub(s.LastRepair) >= backoff.Max {
+		s.Repairs, s.LastRepair, s.NextRetry = 0, time.Time{}, time.Time{}
+	}
+}
+
+// ErrBackingOff is the error of drift left alone because the tunnel was
+// repaired too often lately
+var ErrBackingOff = errors.New("backing off")
+
+// Sync returns the state of a tunnel when last reconciled, or nil if it never was
+func Sync(name string) (*SyncState, error) {
+	path, err := syncStatePath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state SyncState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to read sync state of tunnel '%s': %v", name, err)
+	}
+	return &state, nil
+}
+
+// saveSyncState records the state of a tunnel when last reconciled
+func saveSyncState(name string, state *SyncState) error {
+	path, err := syncStatePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// syncStatePath returns the file the sync state of a tunnel is kept in
+func syncStatePath(name string) (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "sync", name+".json"), nil
+}
+
+// setLinkUp brings the interface of a tunnel up
+func setLinkUp(tunnel *Tunnel) error {
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	link, err := handle.LinkByName(tunnel.Interface())
+	if err != nil {
+		return err
+	}
+	if err := handle.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring %s up: %v", tunnel.Interface(), err)
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package tunnel
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/ca"
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+)
+
+// AnyPeer is the remote IP of a responder, a tunnel that accepts initiators
+// from any address, such as the spokes of a hub whose addresses are not known
+const AnyPeer = "%any"
+
+// HubCA is the peer CA of a responder accepting certificates issued by the
+// certificate authority of this hub, see 'ipsec-vpn ca init'
+const HubCA = "hub"
+
+// ErrPeerRejected is returned when an initiator does not match a responder
+var ErrPeerRejected = errors.New("peer rejected")
+
+// Initiator is a peer that authenticated to a responder: its IKE identity,
+// address and the subnet it proposed as traffic selector
+type Initiator struct {
+	ID      string              // IKE identity, such as spoke1.branches.example.com
+	Address string              // Outer address the peer connected from
+	Subnet  string              // Subnet behind the peer
+	Chain   []*x509.Certificate // Certificate chain the peer authenticated with, leaf first
+}
+
+// Responder reports whether a tunnel accepts initiators from any address
+// instead of connecting to a peer. A responder has no interface of its own:
+// each initiator it accepts gets an instance, a tunnel of its own.
+func (t *Tunnel) Responder() bool {
+	return t.RemoteIP == AnyPeer
+}
+
+// validateResponder checks the options of a responder, or that a tunnel with a
+// peer address has none of them
+func validateResponder(config Config) error {
+	if config.RemoteIP != AnyPeer {
+		if config.PeerID != "" || config.PeerCA != "" {
+			return fmt.Errorf("a peer ID pattern or CA needs remote IP %s", AnyPeer)
+		}
+		return nil
+	}
+	if config.Mode == ModeWireGuard {
+		return fmt.Errorf("wireguard mode does not support remote IP %s", AnyPeer)
+	}
+	if config.PeerID == "" && config.PeerCA == "" {
+		return fmt.Errorf("remote IP %s needs a peer ID pattern or CA to accept initiators by", AnyPeer)
+	}
+	if config.PeerPin != "" || config.PinTOFU {
+		return fmt.Errorf("remote IP %s accepts many peers and cannot pin one key", AnyPeer)
+	}
+	if _, err := path.Match(config.PeerID, ""); err != nil {
+		return fmt.Errorf("invalid peer ID pattern %q: %v", config.PeerID, err)
+	}
+	return nil
+}
+
+// peerCA returns the certificate authority a responder accepts certificates
+// issued by, nil if it has none
+func peerCA(t *Tunnel) (*x509.CertPool, error) {
+	if t.PeerCA == "" {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if t.PeerCA == HubCA {
+		authority, err := ca.Load()
+		if err != nil {
+			return nil, err
+		}
+		pool.AddCert(authority.Certificate)
+		return pool, nil
+	}
+	data, err := os.ReadFile(t.PeerCA)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		block, _ := pem.Decode(data)
+		if block != nil {
+			return nil, fmt.Errorf("no certificate in %s, found %s", t.PeerCA, block.Type)
+		}
+		return nil, fmt.Errorf("no certificate in %s", t.PeerCA)
+	}
+	return pool, nil
+}
+
+// certificateIDs returns the identities a certificate vouches for: its DNS,
+// email and URI subject alternative names and its common name
+func certificateIDs(cert *x509.Certificate) []string {
+	ids := slices.Concat(cert.DNSNames, cert.EmailAddresses)
+	for _, uri := range cert.URIs {
+		ids = append(ids, uri.String())
+	}
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return ids
+}
+
+// authorize checks an initiator against the peer ID pattern and CA of a
+// responder, and returns the identity it is accepted as. An initiator that
+// authenticated with a certificate without giving an identity is identified by
+// the certificate's common name.
+func authorize(t *Tunnel, peer Initiator) (string, error) {
+	id := peer.ID
+	pool, err := peerCA(t)
+	if err != nil {
+		return "", fmt.Errorf("failed to read peer CA %s: %w", t.PeerCA, err)
+	}
+	if pool != nil {
+		if len(peer.Chain) == 0 {
+			return "", fmt.Errorf("%w: no certificate from a peer issued by %s", ErrPeerRejected, t.PeerCA)
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range peer.Chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		leaf := peer.Chain[0]
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return "", fmt.Errorf("%w: certificate %q: %v", ErrPeerRejected, leaf.Subject.CommonName, err)
+		}
+		ids := certificateIDs(leaf)
+		if id == "" && len(ids) > 0 {
+			id = ids[len(ids)-1]
+		}
+		if !slices.Contains(ids, id) {
+			return "", fmt.Errorf("%w: identity %q is not in the peer's certificate", ErrPeerRejected, id)
+		}
+	}
+	if id == "" {
+		return "", fmt.Errorf("%w: the peer gave no identity", ErrPeerRejected)
+	}
+	if t.PeerID != "" {
+		if ok, _ := path.Match(t.PeerID, id); !ok {
+			return "", fmt.Errorf("%w: identity %q does not match %s", ErrPeerRejected, id, t.PeerID)
+		}
+	}
+	return id, nil
+}
+
+// AcceptPeer accepts an initiator that authenticated to a responder and brings
+// up its instance, a tunnel named after the responder with the initiator's
+// address and subnet and the responder's other options. An initiator already
+// connected, such as one reconnecting from a new address, keeps its instance.
+// The initiator's identity must match the responder's peer ID pattern, its
+// certificate be issued by the responder's CA, its subnet lie within the
+// responder's remote subnet, and the login policies of its identity allow it.
+func AcceptPeer(responder string, peer Initiator) (*Tunnel, error) {
+	return std.AcceptPeer(responder, peer)
+}
+
+// AcceptPeer accepts an initiator that authenticated to a responder
+func (m *Manager) AcceptPeer(responder string, peer Initiator) (*Tunnel, error) {
+	t, err := m.Get(responder)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Responder() {
+		return nil, fmt.Errorf("tunnel '%s' is not a responder, its remote IP is %s", responder, t.RemoteIP)
+	}
+	if t.Status != StatusUp {
+		return nil, fmt.Errorf("responder '%s' is %s and accepts no peers", responder, t.Status)
+	}
+	id, err := authorize(t, peer)
+	if err != nil {
+		m.logger().Error("Rejected initiator", "tunnel", responder, "id", peer.ID, "address", peer.Address, "err", err)
+		return nil, err
+	}
+	if net.ParseIP(peer.Address) == nil {
+		return nil, fmt.Errorf("invalid address of peer %s: %q", id, peer.Address)
+	}
+	if err := m.checkLogin(t, id, peer.Address, time.Now()); err != nil {
+		return nil, err
+	}
+	virtualIP, err := m.assignVirtualIP(t, id)
+	if err != nil {
+		m.logger().Error("Rejected initiator", "tunnel", responder, "id", id, "address", peer.Address, "err", err)
+		return nil, err
+	}
+	// An initiator that proposes no subnet of its own is reached at its virtual IP
+	if peer.Subnet == "" && virtualIP != "" {
+		peer.Subnet = virtualIP
+	} else if err := withinSubnet(peer.Subnet, t.RemoteSubnet); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrPeerRejected, id, err)
+	}
+
+	instances, err := m.Instances(responder)
+	if err != nil {
+		return nil, err
+	}
+	name := ""
+	for _, instance := range instances {
+		if instance.PeerIdentity != id {
+			continue
+		}
+		if instance.RemoteIP == peer.Address && instance.RemoteSubnet == peer.Subnet && instance.VirtualIP == virtualIP &&
+			instance.Status == StatusUp {
+			m.logger().Info("Initiator is already connected", "tunnel", instance.Name, "id", id)
+			return instance, nil
+		}
+		// The interface is bound to the peer's address, so one that moved gets a new one
+		m.logger().Info("Initiator reconnected", "tunnel", instance.Name, "id", id, "address", peer.Address)
+		if err := m.deleteTunnel(instance.Name, true, "reconnected"); err != nil {
+			return nil, err
+		}
+		name = instance.Name
+	}
+	if name == "" {
+		if name, err = m.instanceName(responder); err != nil {
+			return nil, err
+		}
+	}
+
+	namespace := t.Namespace
+	if t.OwnsNamespace() {
+		namespace = DedicatedNamespace
+	}
+	instance, err := m.Create(Config{
+		Name:         name,
+		LocalIP:      t.LocalIP,
+		RemoteIP:     peer.Address,
+		LocalSubnet:  t.LocalSubnet,
+		RemoteSubnet: peer.Subnet,
+		Encryption:   t.Encryption,
+		PostQuantum:  t.PostQuantum,
+		Namespace:    namespace,
+		KillSwitch:   t.KillSwitch,
+		RateLimit:    t.RateLimit,
+		Mode:         t.Mode,
+		PSKRef:       t.PSKRef,
+		PeerGroup:    t.PeerGroup,
+		Template:     responder,
+		PeerIdentity: id,
+		VirtualIP:    virtualIP,
+	})
+	if err != nil {
+		return nil, err
+	}
+	instance.Labels = t.Labels
+	instance.UpdatedAt = time.Now()
+	if err := m.save(instance); err != nil {
+		return nil, err
+	}
+	m.startSession(instance)
+	m.logger().Info("Accepted initiator", "tunnel", name, "responder", responder, "id", id, "address", peer.Address, "virtual_ip", virtualIP)
+	return instance, nil
+}
+
+// withinSubnet checks that a subnet lies within another
+func withinSubnet(subnet, within string) error {
+	_, inner, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q", subnet)
+	}
+	_, outer, err := net.ParseCIDR(within)
+	if err != nil {
+		return err
+	}
+	innerOnes, _ := inner.Mask.Size()
+	outerOnes, _ := outer.Mask.Size()
+	if !outer.Contains(inner.IP) || innerOnes < outerOnes {
+		return fmt.Errorf("subnet %s is not within %s", inner, outer)
+	}
+	return nil
+}
+
+// instanceName returns the first free name for an instance of a responder,
+// the responder's name followed by a number
+func (m *Manager) instanceName(responder string) (string, error) {
+	tunnels, err := m.ListConfigured()
+	if err != nil {
+		return "", err
+	}
+	for n := 1; ; n++ {
+		name := responder + "-" + strconv.Itoa(n)
+		if !slices.ContainsFunc(tunnels, func(t *Tunnel) bool { return t.Name == name }) {
+			return name, nil
+		}
+	}
+}
+
+// ReleasePeer deletes the instance of an initiator that disconnected, or whose
+// SA was deleted or declared dead
+func ReleasePeer(name string) error {
+	return std.ReleasePeer(name)
+}
+
+// ReleasePeer deletes the instance of an initiator that disconnected
+func (m *Manager) ReleasePeer(name string) error {
+	return m.release(name, "released")
+}
+
+// release deletes the instance of an initiator, recording the end of its
+// session for a reason
+func (m *Manager) release(name, reason string) error {
+	t, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+	if t.Template == "" {
+		return fmt.Errorf("tunnel '%s' is not an instance of a responder", name)
+	}
+	if err := m.deleteTunnel(name, true, reason); err != nil {
+		return err
+	}
+	m.logger().Info("Released initiator", "tunnel", name, "responder", t.Template, "id", t.PeerIdentity)
+	return nil
+}
+
+// Instances returns the instances of a responder, one for each initiator it
+// accepted
+func Instances(responder string) ([]*Tunnel, error) {
+	return std.Instances(responder)
+}
+
+// Instances returns the instances of a responder
+func (m *Manager) Instances(responder string) ([]*Tunnel, error) {
+	tunnels, err := m.ListConfigured()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(tunnels, func(t *Tunnel) bool { return t.Template != responder }), nil
+}
+
+// setResponderStatus starts or stops accepting initiators. A responder that
+// stops releases the initiators it accepted.
+func (m *Manager) setResponderStatus(t *Tunnel, status Status) error {
+	if t.Status == status {
+		return nil
+	}
+	if status != StatusUp {
+		if err := m.releaseAll(t.Name, "responder stopped"); err != nil {
+			return err
+		}
+	}
+	t.setStatus(status, "")
+	if err := m.save(t); err != nil {
+		return err
+	}
+	m.logger().Info("Responder changed status", "tunnel", t.Name, "status", status)
+	m.publish(t, statusEvents[status])
+	return nil
+}
+
+// releaseAll releases every instance of a responder for a reason
+func (m *Manager) releaseAll(responder, reason string) error {
+	instances, err := m.Instances(responder)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, instance := range instances {
+		if err := m.release(instance.Name, reason); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel '%s': %w", instance.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteResponder deletes a responder and, with force or once it is stopped,
+// its instances
+func (m *Manager) deleteResponder(t *Tunnel, force bool) error {
+	if t.Status == StatusUp && !force {
+		return errors.New("responder is accepting peers, stop it first or use --force")
+	}
+	if err := m.releaseAll(t.Name, "responder deleted"); err != nil && !force {
+		return err
+	}
+	if err := m.deleteConfig(t.Name); err != nil {
+		return err
+	}
+	if path, err := m.leasesPath(t.Name); err == nil {
+		_ = os.Remove(path)
+	}
+	m.publish(&Tunnel{Name: t.Name}, events.TypeDeleted)
+	return nil
+}
+
+// Accepts says which initiators a responder accepts
+func (t *Tunnel) Accepts() string {
+	var by []string
+	if t.PeerID != "" {
+		by = append(by, "identity matching "+t.PeerID)
+	}
+	if t.PeerCA == HubCA {
+		by = append(by, "a certificate issued by this hub's CA")
+	} else if t.PeerCA != "" {
+		by = append(by, "a certificate issued by "+t.PeerCA)
+	}
+	return "any peer with " + strings.Join(by, " and ")
+}
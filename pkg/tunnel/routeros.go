@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// routerOSGroups names the DH groups RouterOS supports
+var routerOSGroups = map[int]string{
+	14: "modp2048",
+	15: "modp3072",
+	16: "modp4096",
+	19: "ecp256",
+	20: "ecp384",
+	21: "ecp521",
+}
+
+// exportRouterOS writes the /ip ipsec commands that make a RouterOS 7 device the
+// peer of a tunnel, as a script to paste into a terminal or run with /import
+func exportRouterOS(tunnel *Tunnel, s *peerSettings) []byte {
+	name := "ipsec-vpn-" + tunnel.Name
+	notes := s.Notes
+
+	// IKE profiles have no AEAD ciphers, so IKE integrity comes from the hash
+	notes = append(notes, fmt.Sprintf("RouterOS profiles have no AEAD ciphers, so IKE uses aes-256 with %s integrity, which this gateway must accept", s.IKE.Hash))
+	group, ok := routerOSGroups[s.IKE.Group]
+	if !ok {
+		group = "ecp384"
+		notes = append(notes, fmt.Sprintf("RouterOS does not support DH group %d, using ecp384 instead", s.IKE.Group))
+	}
+	pfs := "none"
+	if s.PFSGroup != 0 {
+		if pfs, ok = routerOSGroups[s.PFSGroup]; !ok {
+			pfs = group
+		}
+	}
+
+	dpd := "dpd-interval=disable-dpd"
+	if s.DPDDelay > 0 {
+		dpd = fmt.Sprintf("dpd-interval=%s dpd-maximum-failures=%d", routerOSDuration(s.DPDDelay), s.DPDMaxFail)
+	}
+	exchange := "ike2"
+	if s.IKEv1 {
+		exchange = "main"
+	}
+	cipher := "aes-256-gcm"
+	if s.ESP.Cipher == "chacha20poly1305" {
+		cipher = s.ESP.Cipher
+	}
+	auth := `auth-method=pre-shared-key secret=""`
+	if s.Certificates {
+		auth = `auth-method=digital-signature certificate=""`
+	}
+	address := tunnel.LocalIP + "/32"
+	if ip := net.ParseIP(tunnel.LocalIP); ip != nil && ip.To4() == nil {
+		address = tunnel.LocalIP + "/128"
+	}
+	hash := s.IKE.Hash
+	if hash == "" {
+		hash = "sha256"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# ipsec-vpn tunnel '%s' for RouterOS 7: paste into a terminal or run with /import\n", tunnel.Name)
+	for _, note := range notes {
+		fmt.Fprintf(&buf, "# %s\n", note)
+	}
+	fmt.Fprintf(&buf, "/ip ipsec profile\nadd name=%s hash-algorithm=%s enc-algorithm=aes-256 dh-group=%s lifetime=%s nat-traversal=yes %s\n",
+		name, hash, group, routerOSDuration(s.Lifetime), dpd)
+	fmt.Fprintf(&buf, "/ip ipsec peer\nadd name=%s address=%s exchange-mode=%s profile=%s\n", name, address, exchange, name)
+	fmt.Fprintf(&buf, "/ip ipsec proposal\nadd name=%s auth-algorithms=null enc-algorithms=%s pfs-group=%s lifetime=%s\n",
+		name, cipher, pfs, routerOSDuration(s.Lifetime))
+	fmt.Fprintf(&buf, "/ip ipsec identity\nadd peer=%s %s\n", name, auth)
+	fmt.Fprintf(&buf, "/ip ipsec policy\nadd peer=%s tunnel=yes src-address=%s dst-address=%s proposal=%s action=encrypt level=require\n",
+		name, s.Local, s.Remote, name)
+	return buf.Bytes()
+}
+
+// routerOSDuration formats seconds the way RouterOS writes times, e.g. 1d or 1h30m
+func routerOSDuration(seconds int) string {
+	var b strings.Builder
+	for _, unit := range []struct {
+		suffix string
+		size   int
+	}{{"d", 86400}, {"h", 3600}, {"m", 60}, {"s", 1}} {
+		if n := seconds / unit.size; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, unit.suffix)
+			seconds %= unit.size
+		}
+	}
+	if b.Len() == 0 {
+		return "0s"
+	}
+	return b.String()
+}
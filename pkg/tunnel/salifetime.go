@@ -0,0 +1,366 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// What made an SA reach a lifetime limit
+const (
+	ExpiryTime    = "time"
+	ExpiryBytes   = "bytes"
+	ExpiryPackets = "packets"
+)
+
+// defaultSALifetime is the hard time limit of SAs without key_rotation_interval,
+// and defaultSoftShare the share of the hard limit after which they are rekeyed
+const (
+	defaultSALifetime = 24 * time.Hour
+	defaultSoftShare  = 0.9
+)
+
+// SALifetime sets when the SAs of a tunnel are rekeyed and when they expire. A
+// soft limit starts a rekey and a hard limit deletes the SA, whether the
+// replacement is ready or not, so soft limits must come first. Zero is no limit.
+type SALifetime struct {
+	SoftTime    time.Duration `json:"soft_time,omitempty"`
+	HardTime    time.Duration `json:"hard_time,omitempty"`
+	SoftBytes   uint64        `json:"soft_bytes,omitempty"`
+	HardBytes   uint64        `json:"hard_bytes,omitempty"`
+	SoftPackets uint64        `json:"soft_packets,omitempty"`
+	HardPackets uint64        `json:"hard_packets,omitempty"`
+}
+
+// DefaultSALifetime returns the lifetime of SAs of tunnels without one of their
+// own: the limits under tunnel_defaults.sa_lifetime, with the hard time limit
+// falling back to tunnel_defaults.key_rotation_interval and the soft one to 90%
+// of the hard one
+func DefaultSALifetime() SALifetime {
+	return ConfiguredSettings().saLifetime()
+}
+
+// EffectiveSALifetime returns the SA lifetime of a tunnel, its own or the
+// default of its Manager
+func (t *Tunnel) EffectiveSALifetime() SALifetime {
+	if t.SALifetime != nil {
+		return *t.SALifetime
+	}
+	return t.config().saLifetime()
+}
+
+// Validate checks that every soft limit comes before its hard limit
+func (l SALifetime) Validate() error {
+	if l.SoftTime < 0 || l.HardTime < 0 {
+		return errors.New("time limits must not be negative")
+	}
+	if l.HardTime > 0 && l.HardTime < time.Minute {
+		return fmt.Errorf("hard time limit must be at least 1m, got %s", l.HardTime)
+	}
+	for _, pair := range []struct {
+		what       string
+		soft, hard uint64
+	}{
+		{"time", uint64(l.SoftTime), uint64(l.HardTime)},
+		{"byte", l.SoftBytes, l.HardBytes},
+		{"packet", l.SoftPackets, l.HardPackets},
+	} {
+		if pair.hard > 0 && (pair.soft == 0 || pair.soft >= pair.hard) {
+			return fmt.Errorf("soft %s limit must be set and below the hard one, so SAs are rekeyed before they expire", pair.what)
+		}
+		if pair.soft > 0 && pair.hard == 0 {
+			return fmt.Errorf("soft %s limit needs a hard one", pair.what)
+		}
+	}
+	return nil
+}
+
+// Limits returns the lifetime as the limits of an XFRM state
+func (l SALifetime) Limits() netlink.XfrmStateLimits {
+	return netlink.XfrmStateLimits{
+		ByteSoft:   l.SoftBytes,
+		ByteHard:   l.HardBytes,
+		PacketSoft: l.SoftPackets,
+		PacketHard: l.HardPackets,
+		TimeSoft:   uint64(l.SoftTime / time.Second),
+		TimeHard:   uint64(l.HardTime / time.Second),
+	}
+}
+
+// SetSALifetime sets the SA lifetime of a tunnel, or makes it use the default
+// again if lifetime is nil. The SAs the tunnel has now get the new limits.
+func SetSALifetime(name string, lifetime *SALifetime) error {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+	if lifetime != nil {
+		if err := lifetime.Validate(); err != nil {
+			return err
+		}
+	}
+
+	tunnel.SALifetime = lifetime
+	tunnel.UpdatedAt = time.Now()
+	if err := saveTunnel(tunnel); err != nil {
+		return err
+	}
+	if tunnel.Status == StatusUp && tunnel.Mode != ModeWireGuard {
+		return applySALifetime(tunnel)
+	}
+	return nil
+}
+
+// tunnelStates returns the XFRM states carrying a tunnel, in either direction
+func tunnelStates(tunnel *Tunnel) ([]netlink.XfrmState, error) {
+	states, err := network.Handle().XfrmStateList(netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list XFRM states: %v", err)
+	}
+	var matching []netlink.XfrmState
+	for _, s := range states {
+		if stateOf(tunnel, &s) {
+			matching = append(matching, s)
+		}
+	}
+	return matching, nil
+}
+
+// stateOf reports whether an XFRM state carries a tunnel
+func stateOf(tunnel *Tunnel, s *netlink.XfrmState) bool {
+	local, remote := net.ParseIP(tunnel.LocalIP), net.ParseIP(tunnel.RemoteIP)
+	return s.Src.Equal(local) && s.Dst.Equal(remote) || s.Src.Equal(remote) && s.Dst.Equal(local)
+}
+
+// applySALifetime sets the lifetime limits on the XFRM states of a tunnel
+func applySALifetime(tunnel *Tunnel) error {
+	states, err := tunnelStates(tunnel)
+	if err != nil {
+		return err
+	}
+	limits := tunnel.EffectiveSALifetime().Limits()
+	for _, s := range states {
+		s.Limits = limits
+		if err := network.Handle().XfrmStateUpdate(&s); err != nil {
+			return fmt.Errorf("failed to set the lifetime of SA 0x%08x: %v", uint32(s.Spi), err)
+		}
+	}
+	if len(states) > 0 {
+		xfrmLog.Debug("Set the lifetime of the SAs of tunnel", "tunnel", tunnel.Name, "sas", len(states))
+	}
+	return nil
+}
+
+// SAExpiry is an SA of a tunnel reaching a soft limit, which starts a rekey, or
+// a hard one, which deletes it
+type SAExpiry struct {
+	Tunnel  string
+	SPI     uint32
+	Src     net.IP
+	Dst     net.IP
+	Hard    bool
+	Cause   string // ExpiryTime, ExpiryBytes or ExpiryPackets
+	Bytes   uint64
+	Packets uint64
+	Age     time.Duration
+}
+
+// String describes the expiry for logs and events
+func (e SAExpiry) String() string {
+	limit := "soft"
+	if e.Hard {
+		limit = "hard"
+	}
+	return fmt.Sprintf("SA 0x%08x %s->%s reached its %s %s limit after %s, %d bytes and %d packets",
+		e.SPI, e.Src, e.Dst, limit, e.Cause, e.Age.Round(time.Second), e.Bytes, e.Packets)
+}
+
+// expiryCause returns which limit of an XFRM state expired. The kernel does not
+// say, but a volume limit that was reached is the cause; otherwise time is.
+func expiryCause(s *netlink.XfrmState, hard bool) string {
+	bytes, packets := s.Limits.ByteSoft, s.Limits.PacketSoft
+	if hard {
+		bytes, packets = s.Limits.ByteHard, s.Limits.PacketHard
+	}
+	switch {
+	case bytes != 0 && bytes != nl.XFRM_INF && s.Statistics.Bytes >= bytes:
+		return ExpiryBytes
+	case packets != 0 && packets != nl.XFRM_INF && s.Statistics.Packets >= packets:
+		return ExpiryPackets
+	}
+	return ExpiryTime
+}
+
+// RekeyCounts counts the SA lifetime limits a tunnel reached, by cause
+type RekeyCounts struct {
+	Time         uint64    `json:"time"`
+	Bytes        uint64    `json:"bytes"`
+	Packets      uint64    `json:"packets"`
+	HardExpiries uint64    `json:"hard_expiries"` // SAs deleted by a hard limit, which rekeying should prevent
+	Last         time.Time `json:"last,omitempty"`
+	LastCause    string    `json:"last_cause,omitempty"`
+}
+
+// WatchSAExpiry follows the kernel's SA expiry notifications until stop is
+// closed. Each expiry of a tunnel's SA is counted, logged, published as a
+// tunnel.sa.rekey event for a soft limit or tunnel.sa.expired for a hard one,
+// and passed to handle.
+func WatchSAExpiry(stop <-chan struct{}, handle func(SAExpiry)) error {
+	msgs := make(chan netlink.XfrmMsg)
+	errs := make(chan error, 1)
+	if err := netlink.XfrmMonitor(msgs, stop, errs, nl.XFRM_MSG_EXPIRE); err != nil {
+		return fmt.Errorf("failed to subscribe to SA expiry: %v", err)
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case err := <-errs:
+			select {
+			case <-stop:
+				return nil
+			default:
+				return fmt.Errorf("SA expiry notifications failed: %v", err)
+			}
+		case msg, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			expire, ok := msg.(*netlink.XfrmMsgExpire)
+			if !ok || expire.XfrmState == nil {
+				continue
+			}
+			if e, ok := recordExpiry(expire.XfrmState, expire.Hard); ok && handle != nil {
+				handle(e)
+			}
+		}
+	}
+}
+
+// recordExpiry counts, logs and publishes the expiry of an XFRM state, if it
+// carries a tunnel
+func recordExpiry(s *netlink.XfrmState, hard bool) (SAExpiry, bool) {
+	tunnels, err := ListAll()
+	if err != nil {
+		xfrmLog.Error("Failed to list tunnels", "err", err)
+		return SAExpiry{}, false
+	}
+	var tunnel *Tunnel
+	for _, t := range tunnels {
+		if stateOf(t, s) {
+			tunnel = t
+			break
+		}
+	}
+	if tunnel == nil {
+		return SAExpiry{}, false
+	}
+
+	e := SAExpiry{
+		Tunnel:  tunnel.Name,
+		SPI:     uint32(s.Spi),
+		Src:     s.Src,
+		Dst:     s.Dst,
+		Hard:    hard,
+		Cause:   expiryCause(s, hard),
+		Bytes:   s.Statistics.Bytes,
+		Packets: s.Statistics.Packets,
+	}
+	if s.Statistics.AddTime > 0 {
+		e.Age = time.Since(time.Unix(int64(s.Statistics.AddTime), 0))
+	}
+
+	typ := events.TypeSARekey
+	if hard {
+		typ = events.TypeSAExpired
+		xfrmLog.Error("SA reached its hard limit", "tunnel", tunnel.Name, "expiry", e)
+	} else {
+		xfrmLog.Info("SA reached its soft limit, rekeying", "tunnel", tunnel.Name, "expiry", e)
+	}
+	event := events.New(typ, tunnel.Name)
+	event.Status = string(tunnel.Status)
+	event.Reason = e.String()
+	events.Publish(event)
+
+	if err := countExpiry(tunnel.Name, e); err != nil {
+		xfrmLog.Error("Failed to count the SA expiry of tunnel", "tunnel", tunnel.Name, "err", err)
+	}
+	return e, true
+}
+
+// countExpiry adds an expiry to the rekey counts of a tunnel
+func countExpiry(name string, e SAExpiry) error {
+	counts, err := Rekeys(name)
+	if err != nil {
+		return err
+	}
+	if e.Hard {
+		counts.HardExpiries++
+	} else {
+		switch e.Cause {
+		case ExpiryBytes:
+			counts.Bytes++
+		case ExpiryPackets:
+			counts.Packets++
+		default:
+			counts.Time++
+		}
+	}
+	counts.Last, counts.LastCause = time.Now(), e.Cause
+
+	path, err := rekeyCountsPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// rekeyCountsPath returns the file the rekey counts of a tunnel are kept in
+func rekeyCountsPath(name string) (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "rekeys", name+".json"), nil
+}
+
+// Rekeys returns the rekey counts of a tunnel, zero if none were recorded
+func Rekeys(name string) (*RekeyCounts, error) {
+	path, err := rekeyCountsPath(name)
+	if err != nil {
+		return nil, err
+	}
+	counts := &RekeyCounts{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return counts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, counts); err != nil {
+		return nil, fmt.Errorf("failed to read rekey counts of tunnel '%s': %v", name, err)
+	}
+	return counts, nil
+}
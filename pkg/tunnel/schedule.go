@@ -0,0 +1,513 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// DefaultScheduleMetric is the metric of scheduled routes
+const DefaultScheduleMetric = 100
+
+// scheduleLogSize is the number of activations kept per schedule
+const scheduleLogSize = 1000
+
+// ScheduleDays are the days a schedule can be limited to, as they are written
+var ScheduleDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ErrScheduleNotFound is returned for schedules that do not exist
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// Schedule routes a prefix through a tunnel during a window of the day, such
+// as replicating traffic over an expensive LTE tunnel only at night, and
+// withdraws the route outside it. The window is in local time; one ending at
+// or before its start runs past midnight, into the day after. It opens on the
+// days listed, or every day without any.
+type Schedule struct {
+	Name      string    `json:"name"`
+	Tunnel    string    `json:"tunnel"`
+	Prefix    string    `json:"prefix"`
+	Metric    int       `json:"metric"`
+	Advertise bool      `json:"advertise,omitempty"` // Advertise the route with those of 'network advertise'
+	Days      []string  `json:"days,omitempty"`
+	Start     string    `json:"start"` // HH:MM
+	End       string    `json:"end"`
+	Active    bool      `json:"active"`
+	Error     string    `json:"error,omitempty"` // Why the last activation failed
+	ChangedAt time.Time `json:"changed_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// What a round of a schedule did
+const (
+	ScheduleActivated   = "activated"
+	ScheduleDeactivated = "deactivated"
+	ScheduleFailed      = "failed" // The route could not be put in place
+)
+
+// ScheduleActivation records a schedule routing its prefix through its tunnel,
+// withdrawing the route, or failing to put it in place
+type ScheduleActivation struct {
+	Time     time.Time `json:"time"`
+	Schedule string    `json:"schedule"`
+	Action   string    `json:"action"`
+	Reason   string    `json:"reason"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// parseClock parses a time of day such as 22:00 into minutes past midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Window formats the days and hours of a schedule
+func (s *Schedule) Window() string {
+	days := "daily"
+	if len(s.Days) > 0 {
+		days = strings.Join(s.Days, ",")
+	}
+	return fmt.Sprintf("%s-%s %s", s.Start, s.End, days)
+}
+
+// Validate checks the settings of a schedule, filling in defaults
+func (s *Schedule) Validate() error {
+	if !keys.ValidName(s.Name) {
+		return fmt.Errorf("invalid schedule name: %s", s.Name)
+	}
+	if s.Tunnel == "" {
+		return errors.New("a tunnel is required")
+	}
+	_, prefix, err := net.ParseCIDR(s.Prefix)
+	if err != nil {
+		return fmt.Errorf("invalid prefix %q", s.Prefix)
+	}
+	s.Prefix = prefix.String()
+	if s.Metric == 0 {
+		s.Metric = DefaultScheduleMetric
+	}
+	if s.Metric < 0 {
+		return fmt.Errorf("invalid metric %d", s.Metric)
+	}
+	for i, day := range s.Days {
+		s.Days[i] = strings.ToLower(day)
+		if !slices.Contains(ScheduleDays, s.Days[i]) {
+			return fmt.Errorf("invalid day %q, expected one of %s", day, strings.Join(ScheduleDays, ", "))
+		}
+	}
+	if _, err := parseClock(s.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(s.End); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ActiveAt reports whether the window of a schedule is open at a time: on a
+// day it lists, between its start and end, or past midnight after a day it
+// lists when it ends at or before its start
+func (s *Schedule) ActiveAt(now time.Time) bool {
+	return windowOpen(s.Days, s.Start, s.End, now)
+}
+
+// windowOpen reports whether a window of the day is open at a time, on the
+// days listed or every day without any
+func windowOpen(days []string, from, to string, now time.Time) bool {
+	start, err := parseClock(from)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return false
+	}
+	on := func(day time.Weekday) bool {
+		return len(days) == 0 || slices.Contains(days, ScheduleDays[day])
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	switch {
+	case start < end:
+		return on(today) && minute >= start && minute < end
+	case minute >= start:
+		return on(today)
+	case minute < end:
+		return on((today + 6) % 7)
+	default:
+		return false
+	}
+}
+
+// GetSchedule returns a schedule
+func GetSchedule(name string) (*Schedule, error) {
+	return std.Schedule(name)
+}
+
+// Schedule returns a schedule
+func (m *Manager) Schedule(name string) (*Schedule, error) {
+	path, err := m.schedulePath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrScheduleNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s Schedule
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid schedule %s: %v", name, err)
+	}
+	return &s, nil
+}
+
+// Schedules returns the schedules sorted by name
+func Schedules() ([]*Schedule, error) {
+	return std.Schedules()
+}
+
+// Schedules returns the schedules sorted by name
+func (m *Manager) Schedules() ([]*Schedule, error) {
+	dir, err := m.schedulesDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var schedules []*Schedule
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		if strings.HasSuffix(name, ".log") {
+			continue
+		}
+		s, err := m.Schedule(name)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+// SaveSchedule creates or changes a schedule. Its tunnel must exist and reach
+// the whole prefix. The route of a schedule that is active is withdrawn, to be
+// put in place as changed at the next round.
+func SaveSchedule(s *Schedule) error {
+	return std.SaveSchedule(s)
+}
+
+// SaveSchedule creates or changes a schedule
+func (m *Manager) SaveSchedule(s *Schedule) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	t, err := m.load(s.Tunnel)
+	if err != nil {
+		return err
+	}
+	if t.Responder() {
+		return fmt.Errorf("tunnel '%s' is a responder, schedule routes through its instances", s.Tunnel)
+	}
+	if err := withinSubnet(s.Prefix, t.RemoteSubnet); err != nil {
+		return fmt.Errorf("tunnel '%s' does not reach all of %s: %v", s.Tunnel, s.Prefix, err)
+	}
+
+	if old, err := m.Schedule(s.Name); err == nil && old.Active {
+		m.deactivate(old, time.Now(), "schedule changed")
+	}
+	s.Active, s.Error = false, ""
+	if err := m.writeSchedule(s); err != nil {
+		return err
+	}
+	m.logger().Info("Saved schedule", "schedule", s.Name, "tunnel", s.Tunnel, "prefix", s.Prefix, "window", s.Window())
+	return nil
+}
+
+// DeleteSchedule deletes a schedule and its activation log, withdrawing its
+// route if it is active
+func DeleteSchedule(name string) error {
+	return std.DeleteSchedule(name)
+}
+
+// DeleteSchedule deletes a schedule
+func (m *Manager) DeleteSchedule(name string) error {
+	s, err := m.Schedule(name)
+	if err != nil {
+		return err
+	}
+	if s.Active {
+		m.deactivate(s, time.Now(), "schedule deleted")
+	}
+	path, _ := m.schedulePath(name)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if log, err := m.scheduleLogPath(name); err == nil {
+		_ = os.Remove(log)
+	}
+	m.logger().Info("Deleted schedule", "schedule", name)
+	return nil
+}
+
+// RunSchedules runs a round of every schedule at a time, see RunSchedule. It
+// returns the activations the round made.
+func RunSchedules(now time.Time) ([]ScheduleActivation, error) {
+	return std.RunSchedules(now)
+}
+
+// RunSchedules runs a round of every schedule at a time
+func (m *Manager) RunSchedules(now time.Time) ([]ScheduleActivation, error) {
+	schedules, err := m.Schedules()
+	if err != nil {
+		return nil, err
+	}
+	var activations []ScheduleActivation
+	for _, s := range schedules {
+		a, err := m.runSchedule(s, now)
+		if err != nil {
+			return activations, err
+		}
+		if a != nil {
+			activations = append(activations, *a)
+		}
+	}
+	return activations, nil
+}
+
+// RunSchedule puts the route of a schedule in place while its window is open,
+// again each round in case its tunnel was restarted, and withdraws it once the
+// window closes. Activating, deactivating and the first failure to activate
+// are logged, recorded in the schedule's activation log and published as
+// tunnel.schedule.activated and tunnel.schedule.deactivated events. It returns
+// the activation the round made, if any.
+func RunSchedule(name string, now time.Time) (*ScheduleActivation, error) {
+	return std.RunSchedule(name, now)
+}
+
+// RunSchedule runs a round of a schedule at a time
+func (m *Manager) RunSchedule(name string, now time.Time) (*ScheduleActivation, error) {
+	s, err := m.Schedule(name)
+	if err != nil {
+		return nil, err
+	}
+	return m.runSchedule(s, now)
+}
+
+// runSchedule runs a round of a schedule
+func (m *Manager) runSchedule(s *Schedule, now time.Time) (*ScheduleActivation, error) {
+	if !s.ActiveAt(now) {
+		if !s.Active {
+			return nil, nil
+		}
+		a := m.deactivate(s, now, fmt.Sprintf("window %s closed", s.Window()))
+		return a, m.writeSchedule(s)
+	}
+
+	t, err := m.Get(s.Tunnel)
+	if err == nil && t.Status != StatusUp {
+		err = fmt.Errorf("tunnel '%s' is %s", s.Tunnel, t.Status)
+	}
+	if err == nil {
+		err = scheduledRoute(t, s, true)
+	}
+	if err != nil {
+		// Only the first failure is logged, not every round until it clears
+		if s.Error == err.Error() && !s.Active {
+			return nil, nil
+		}
+		// A route that was in place went with its tunnel
+		if s.Active {
+			s.ChangedAt = now
+		}
+		s.Active, s.Error = false, err.Error()
+		a := m.logActivation(s, now, ScheduleFailed, fmt.Sprintf("window %s open", s.Window()), err)
+		return a, m.writeSchedule(s)
+	}
+	if s.Active {
+		return nil, nil
+	}
+	s.Active, s.Error, s.ChangedAt = true, "", now
+	a := m.logActivation(s, now, ScheduleActivated, fmt.Sprintf("window %s opened", s.Window()), nil)
+	return a, m.writeSchedule(s)
+}
+
+// deactivate withdraws the route of an active schedule and logs it. A route
+// that cannot be withdrawn is logged as an error, but the schedule is no
+// longer active.
+func (m *Manager) deactivate(s *Schedule, now time.Time, reason string) *ScheduleActivation {
+	var err error
+	if t, loadErr := m.load(s.Tunnel); loadErr == nil {
+		err = scheduledRoute(t, s, false)
+	}
+	s.Active, s.Error, s.ChangedAt = false, "", now
+	return m.logActivation(s, now, ScheduleDeactivated, reason, err)
+}
+
+// logActivation records an activation of a schedule in its log, logs it and
+// publishes it as an event, recorded in the journal. A failed activation of a
+// schedule that was not active changes nothing, so it is no event.
+func (m *Manager) logActivation(s *Schedule, now time.Time, action, reason string, err error) *ScheduleActivation {
+	a := &ScheduleActivation{Time: now, Schedule: s.Name, Action: action, Reason: reason}
+	if err != nil {
+		a.Error = err.Error()
+		m.logger().Error("Schedule "+action, "schedule", s.Name, "tunnel", s.Tunnel, "prefix", s.Prefix, "reason", reason, "err", err)
+	} else {
+		m.logger().Info("Schedule "+action, "schedule", s.Name, "tunnel", s.Tunnel, "prefix", s.Prefix, "reason", reason)
+	}
+	if logErr := m.appendScheduleLog(a); logErr != nil {
+		m.logger().Error("Failed to record schedule activation", "schedule", s.Name, "err", logErr)
+	}
+
+	typ := events.TypeScheduleDeactivated
+	switch {
+	case action == ScheduleActivated:
+		typ = events.TypeScheduleActivated
+	case action == ScheduleFailed && !s.ChangedAt.Equal(now):
+		return a
+	}
+	e := events.New(typ, s.Tunnel)
+	e.Reason = fmt.Sprintf("%s: %s through %s, %s", s.Name, s.Prefix, s.Tunnel, reason)
+	if a.Error != "" {
+		e.Reason += ": " + a.Error
+	}
+	if err := m.record(e); err != nil {
+		m.logger().Error("Failed to record event in the journal", "tunnel", s.Tunnel, "type", e.Type, "err", err)
+	}
+	m.send(e)
+	return a
+}
+
+// scheduledRoute puts in place or withdraws the route of a schedule
+func scheduledRoute(t *Tunnel, s *Schedule, up bool) error {
+	handle, err := linkHandle(t)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if up {
+		return network.SetScheduledRoute(handle, t.Interface(), s.Prefix, s.Metric, s.Advertise)
+	}
+	return network.DeleteScheduledRoute(handle, t.Interface(), s.Prefix, s.Metric, s.Advertise)
+}
+
+// ScheduleLog returns the activations recorded for a schedule, oldest first
+func ScheduleLog(name string) ([]ScheduleActivation, error) {
+	return std.ScheduleLog(name)
+}
+
+// ScheduleLog returns the activations recorded for a schedule
+func (m *Manager) ScheduleLog(name string) ([]ScheduleActivation, error) {
+	path, err := m.scheduleLogPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var log []ScheduleActivation
+	if err := json.Unmarshal(data, &log); err != nil {
+		return nil, fmt.Errorf("failed to read activation log of %s: %v", name, err)
+	}
+	return log, nil
+}
+
+// appendScheduleLog appends an activation to the log of its schedule, keeping
+// the last scheduleLogSize
+func (m *Manager) appendScheduleLog(a *ScheduleActivation) error {
+	log, err := m.ScheduleLog(a.Schedule)
+	if err != nil {
+		return err
+	}
+	log = append(log, *a)
+	if len(log) > scheduleLogSize {
+		log = log[len(log)-scheduleLogSize:]
+	}
+	path, err := m.scheduleLogPath(a.Schedule)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(log)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeSchedule stores a schedule
+func (m *Manager) writeSchedule(s *Schedule) error {
+	dir, err := m.schedulesDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	s.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, s.Name+".json"), append(data, '\n'), 0644)
+}
+
+// schedulesDir returns the directory of the schedules
+func (m *Manager) schedulesDir() (string, error) {
+	dir, err := m.dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "schedules"), nil
+}
+
+// schedulePath returns the file of a schedule
+func (m *Manager) schedulePath(name string) (string, error) {
+	if !keys.ValidName(name) {
+		return "", fmt.Errorf("invalid schedule name: %s", name)
+	}
+	dir, err := m.schedulesDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// scheduleLogPath returns the file the activations of a schedule are kept in
+func (m *Manager) scheduleLogPath(name string) (string, error) {
+	path, err := m.schedulePath(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(path, ".json") + ".log.json", nil
+}
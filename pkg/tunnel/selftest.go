@@ -0,0 +1,142 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/vishvananda/netlink"
+)
+
+// ErrSelfTestFailed is returned by tunnel operations once the self-test has
+// failed with self_test.fail_closed set
+var ErrSelfTestFailed = errors.New("self-test failed, refusing to manage tunnels")
+
+// Self-test checks
+const (
+	CheckCrypto  = "crypto"  // Random number generator health and known-answer tests
+	CheckNetlink = "netlink" // Links and XFRM policies can be listed over netlink
+	CheckStore   = "store"   // Every tunnel and key file can be read and is consistent
+)
+
+// SelfTestResult is the outcome of one self-test check
+type SelfTestResult struct {
+	Check string
+	Err   error
+}
+
+var (
+	selfTestOnce sync.Once
+	selfTestErr  error
+)
+
+// SelfTest runs every self-test check. All of them are critical: a tunnel
+// managed with any of them failing could be left unprotected or half configured.
+func SelfTest() []SelfTestResult {
+	return std.selfTest()
+}
+
+// selfTest runs every self-test check on the tunnels of the Manager
+func (m *Manager) selfTest() []SelfTestResult {
+	return []SelfTestResult{
+		{CheckCrypto, checkCrypto()},
+		{CheckNetlink, checkNetlink()},
+		{CheckStore, m.checkStore()},
+	}
+}
+
+// SelfTestError returns an error naming every failed check, or nil
+func SelfTestError(results []SelfTestResult) error {
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.Check, r.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RequireSelfTest runs the self-test the first time a tunnel is managed, if
+// self_test.enabled is set, logging each failed check. With
+// self_test.fail_closed set, a failure stops tunnels being managed for the
+// rest of the process. Servers call it on startup to report a failure early.
+func RequireSelfTest() error {
+	selfTestOnce.Do(func() {
+		settings := ConfiguredSettings()
+		if !settings.SelfTest {
+			return
+		}
+		selfTestErr = runSelfTest(tunnelLog, SelfTest(), settings.SelfTestFailClosed)
+	})
+	return selfTestErr
+}
+
+// runSelfTest logs each failed check of a self-test, returning
+// ErrSelfTestFailed if any did and failClosed is set
+func runSelfTest(log Logger, results []SelfTestResult, failClosed bool) error {
+	for _, r := range results {
+		if r.Err != nil {
+			log.Error("Self-test check failed", "check", r.Check, "err", r.Err)
+		}
+	}
+	err := SelfTestError(results)
+	if err == nil {
+		log.Debug("Self-test passed")
+		return nil
+	}
+	if failClosed {
+		log.Error("Refusing to manage tunnels until the self-test passes (self_test.fail_closed is set)")
+		return fmt.Errorf("%w: %v", ErrSelfTestFailed, err)
+	}
+	return nil
+}
+
+func checkCrypto() error {
+	if err := crypto.RNGStatus(); err != nil {
+		return err
+	}
+	return crypto.SelfTest()
+}
+
+func checkNetlink() error {
+	if _, err := netlink.LinkList(); err != nil {
+		return fmt.Errorf("cannot list links: %v", err)
+	}
+	if _, err := netlink.XfrmPolicyList(netlink.FAMILY_ALL); err != nil {
+		return fmt.Errorf("cannot list XFRM policies: %v", err)
+	}
+	return nil
+}
+
+// checkStore reads every tunnel file, making sure it holds the tunnel it is
+// named after, then checks the key store of the ipsec-vpn configuration
+// unless the Manager has settings of its own
+func (m *Manager) checkStore() error {
+	dir, err := m.dir()
+	if err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "tunnels", "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		name = name[:len(name)-5] // Remove .json extension
+
+		tunnel, err := m.load(name)
+		if err != nil {
+			return fmt.Errorf("tunnel file %s: %v", file, err)
+		}
+		if tunnel.Name != name {
+			return fmt.Errorf("tunnel file %s holds tunnel '%s'", file, tunnel.Name)
+		}
+	}
+	if m.settings != nil {
+		return nil
+	}
+	return keys.CheckStore()
+}
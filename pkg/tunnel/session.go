@@ -0,0 +1,111 @@
+package tunnel
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+)
+
+// Session is the connection of an initiator, such as a road warrior, to a
+// responder. The IKE daemon reports sessions as they start and end with
+// 'tunnel accept' and 'tunnel release', and each is the instance the
+// responder brought up for the initiator, whose name identifies the session.
+type Session struct {
+	ID        string    `json:"id"`
+	Responder string    `json:"responder"`
+	Identity  string    `json:"identity"`
+	VirtualIP string    `json:"virtual_ip,omitempty"`
+	Address   string    `json:"address"` // Public address the initiator connects from
+	Status    Status    `json:"status"`
+	Connected time.Time `json:"connected"`
+	RxBytes   uint64    `json:"rx_bytes"`
+	TxBytes   uint64    `json:"tx_bytes"`
+}
+
+// Duration returns how long a session has been connected
+func (s *Session) Duration() time.Duration {
+	return time.Since(s.Connected).Truncate(time.Second)
+}
+
+// Sessions returns the sessions of the initiators connected to a responder,
+// or to any responder if it is empty, oldest first. Traffic counters that
+// cannot be read, such as those of a session whose interface is gone, are 0.
+func Sessions(responder string) ([]Session, error) {
+	return std.Sessions(responder)
+}
+
+// Sessions returns the sessions of the initiators connected to a responder
+func (m *Manager) Sessions(responder string) ([]Session, error) {
+	if responder != "" {
+		if _, err := m.responder(responder); err != nil {
+			return nil, err
+		}
+	}
+	tunnels, err := m.ListConfigured()
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	for _, t := range tunnels {
+		if t.Template == "" || responder != "" && t.Template != responder {
+			continue
+		}
+		sessions = append(sessions, session(t))
+	}
+	slices.SortFunc(sessions, func(a, b Session) int { return a.Connected.Compare(b.Connected) })
+	return sessions, nil
+}
+
+// Disconnect terminates a session: it releases the initiator's instance, so
+// that no traffic flows, and publishes a tunnel.session.disconnected event for
+// the IKE daemon to delete the initiator's IKE SA. The initiator may connect
+// again unless it is refused, such as by revoking its certificate.
+func Disconnect(id string) (*Session, error) {
+	return std.Disconnect(id)
+}
+
+// Disconnect terminates a session
+func (m *Manager) Disconnect(id string) (*Session, error) {
+	t, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if t.Template == "" {
+		return nil, fmt.Errorf("tunnel '%s' is not the session of an initiator", id)
+	}
+	s := session(t)
+	if err := m.release(id, "disconnected"); err != nil {
+		return nil, err
+	}
+
+	e := events.New(events.TypeSessionDisconnected, id)
+	e.Reason = fmt.Sprintf("session of %s disconnected from responder %s", s.Identity, s.Responder)
+	e.PeerID = s.Identity
+	e.PeerAddress = s.Address
+	e.RxBytes, e.TxBytes = &s.RxBytes, &s.TxBytes
+	if err := m.record(e); err != nil {
+		m.logger().Error("Failed to record event in the journal", "tunnel", id, "type", e.Type, "err", err)
+	}
+	m.send(e)
+	m.logger().Info("Disconnected initiator", "tunnel", id, "responder", s.Responder, "id", s.Identity, "address", s.Address)
+	return &s, nil
+}
+
+// session returns the session of an instance, with its traffic counters
+func session(t *Tunnel) Session {
+	s := Session{
+		ID:        t.Name,
+		Responder: t.Template,
+		Identity:  t.PeerIdentity,
+		VirtualIP: t.VirtualIP,
+		Address:   t.RemoteIP,
+		Status:    t.Status,
+		Connected: t.CreatedAt,
+	}
+	if stats, err := tunnelStats(t); err == nil {
+		s.RxBytes, s.TxBytes = stats.RxBytes, stats.TxBytes
+	}
+	return s
+}
@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultAccountingRetention is how many days of session records are kept
+// unless client.accounting_retention says otherwise
+const DefaultAccountingRetention = 365
+
+// accountingDay is the layout of the name of each day's file of session records
+const accountingDay = "2006-01-02"
+
+// SessionRecord is the accounting record of a session: who connected to which
+// responder, from where, with which virtual IP, when, for how long and how
+// much traffic it carried. A record without a stop time is that of a session
+// still connected, or one whose end was not seen, such as when the hub
+// crashed.
+type SessionRecord struct {
+	Session   string    `json:"session"` // Name of the instance, reused by later sessions of the responder
+	Responder string    `json:"responder"`
+	Identity  string    `json:"identity"`
+	Address   string    `json:"address"`
+	VirtualIP string    `json:"virtual_ip,omitempty"`
+	Start     time.Time `json:"start"`
+	Stop      time.Time `json:"stop,omitzero"`
+	RxBytes   uint64    `json:"rx_bytes"`
+	TxBytes   uint64    `json:"tx_bytes"`
+	Reason    string    `json:"reason,omitempty"` // Why the session ended: released, disconnected, reconnected...
+}
+
+// Duration returns how long the session lasted, until now if it has not ended
+func (r *SessionRecord) Duration() time.Duration {
+	stop := r.Stop
+	if stop.IsZero() {
+		stop = time.Now()
+	}
+	return stop.Sub(r.Start).Truncate(time.Second)
+}
+
+// startSession records the start of the session of an instance
+func (m *Manager) startSession(t *Tunnel) {
+	m.account(SessionRecord{
+		Session:   t.Name,
+		Responder: t.Template,
+		Identity:  t.PeerIdentity,
+		Address:   t.RemoteIP,
+		VirtualIP: t.VirtualIP,
+		Start:     t.CreatedAt,
+	}, t.CreatedAt)
+}
+
+// stopSession records the end of a session, with the traffic it carried
+func (m *Manager) stopSession(s Session, reason string) {
+	now := time.Now()
+	m.account(SessionRecord{
+		Session:   s.ID,
+		Responder: s.Responder,
+		Identity:  s.Identity,
+		Address:   s.Address,
+		VirtualIP: s.VirtualIP,
+		Start:     s.Connected,
+		Stop:      now,
+		RxBytes:   s.RxBytes,
+		TxBytes:   s.TxBytes,
+		Reason:    reason,
+	}, now)
+}
+
+// account appends a session record to the file of the day it happened,
+// <state dir>/sessions/2026-10-16.jsonl, and removes the days past retention
+// when it starts a new one. Failures are logged, they do not keep initiators
+// from connecting or being released.
+func (m *Manager) account(r SessionRecord, now time.Time) {
+	if err := m.appendRecord(r, now); err != nil {
+		m.logger().Error("Failed to record session", "tunnel", r.Session, "id", r.Identity, "err", err)
+	}
+}
+
+// appendRecord appends a session record to the file of a day
+func (m *Manager) appendRecord(r SessionRecord, now time.Time) error {
+	dir, err := m.accountingDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, now.UTC().Format(accountingDay)+".jsonl")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		pruneAccounting(dir, now, m.config().accountingRetention())
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// oldestAccountingDay returns the first day of session records kept for a
+// number of days at a time
+func oldestAccountingDay(now time.Time, retention int) string {
+	return now.UTC().AddDate(0, 0, -retention+1).Format(accountingDay)
+}
+
+// pruneAccounting removes the days of session records past retention at a time
+func pruneAccounting(dir string, now time.Time, retention int) {
+	oldest := oldestAccountingDay(now, retention)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	for _, file := range files {
+		if day := strings.TrimSuffix(filepath.Base(file), ".jsonl"); day < oldest {
+			_ = os.Remove(file)
+		}
+	}
+}
+
+// SessionHistory returns the records of the sessions that were connected at
+// some point between two times, oldest first, of the identities matching a
+// pattern, or of all if it is empty. Records past client.accounting_retention
+// are left out even if they were not pruned yet.
+func SessionHistory(from, to time.Time, identity string) ([]SessionRecord, error) {
+	return std.SessionHistory(from, to, identity)
+}
+
+// SessionHistory returns the records of the sessions connected between two times
+func (m *Manager) SessionHistory(from, to time.Time, identity string) ([]SessionRecord, error) {
+	if _, err := path.Match(identity, ""); err != nil {
+		return nil, err
+	}
+	dir, err := m.accountingDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	oldest := oldestAccountingDay(time.Now(), m.config().accountingRetention())
+
+	// The start and the stop of a session are separate lines, possibly on
+	// different days, so days after the range are read too; the stop holds
+	// everything the start does
+	type key struct {
+		session string
+		start   time.Time
+	}
+	sessions := map[key]SessionRecord{}
+	for _, file := range files {
+		if strings.TrimSuffix(filepath.Base(file), ".jsonl") < oldest {
+			continue
+		}
+		records, err := readAccounting(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			k := key{r.Session, r.Start.UTC()}
+			if prev, ok := sessions[k]; ok && !prev.Stop.IsZero() {
+				continue
+			}
+			sessions[k] = r
+		}
+	}
+
+	var history []SessionRecord
+	for _, r := range sessions {
+		if r.Start.After(to) || !r.Stop.IsZero() && r.Stop.Before(from) {
+			continue
+		}
+		if identity != "" {
+			if ok, _ := path.Match(identity, r.Identity); !ok {
+				continue
+			}
+		}
+		history = append(history, r)
+	}
+	slices.SortFunc(history, func(a, b SessionRecord) int {
+		if c := a.Start.Compare(b.Start); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Session, b.Session)
+	})
+	return history, nil
+}
+
+// readAccounting reads the session records of a day. A line cut short, as by
+// a crash while it was written, is skipped.
+func readAccounting(path string) ([]SessionRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []SessionRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r SessionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.Session == "" {
+			continue
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, bufio.ErrTooLong) {
+		return nil, err
+	}
+	return records, nil
+}
+
+// accountingDir returns the directory of the session records
+func (m *Manager) accountingDir() (string, error) {
+	dir, err := m.dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sessions"), nil
+}
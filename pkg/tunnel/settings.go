@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/retry"
+	"github.com/spf13/viper"
+)
+
+// Settings are the settings of the ipsec-vpn configuration a Manager applies to
+// its tunnels. The zero value of each field selects the built-in default. A
+// Manager from NewManager only uses those in its Options; the package-level
+// functions read them from the configuration with ConfiguredSettings each time
+// they are used.
+type Settings struct {
+	// KillSwitch turns on the kill-switch of every tunnel, as security.kill_switch
+	KillSwitch bool
+	// SALifetime is the lifetime of the SAs of tunnels without one of their
+	// own, as tunnel_defaults.sa_lifetime. The hard time limit defaults to
+	// 24h and the soft one to 90% of it.
+	SALifetime SALifetime
+	// ReconcileInterval is how often the reconciler runs, as reconcile.interval
+	ReconcileInterval time.Duration
+	// BackoffInitial and BackoffMax bound the delay before a tunnel that
+	// keeps drifting is repaired again, as reconcile.backoff_initial and
+	// reconcile.backoff_max
+	BackoffInitial time.Duration
+	BackoffMax     time.Duration
+	// SelfTest runs the self-test before the first change to a tunnel, as
+	// self_test.enabled, and SelfTestFailClosed refuses changes if it
+	// failed, as self_test.fail_closed
+	SelfTest           bool
+	SelfTestFailClosed bool
+	// AccountingRetention is how many days of session records are kept, as
+	// client.accounting_retention
+	AccountingRetention int
+	// IKE holds what tunnels negotiate their peers with unless their peer
+	// group sets it, as security.authentication_method and the
+	// advanced.ike_proposals, esp_proposals, dpd_delay, dpd_timeout,
+	// reauth_interval and reauth_grace settings. Its Group is not used.
+	IKE IKESettings
+}
+
+// ConfiguredSettings returns the settings of the ipsec-vpn configuration
+func ConfiguredSettings() Settings {
+	s := Settings{
+		KillSwitch: viper.GetBool("security.kill_switch"),
+		SALifetime: SALifetime{
+			SoftTime:    time.Duration(viper.GetInt("tunnel_defaults.sa_lifetime.soft_time")) * time.Second,
+			HardTime:    time.Duration(viper.GetInt("tunnel_defaults.sa_lifetime.hard_time")) * time.Second,
+			SoftBytes:   viper.GetUint64("tunnel_defaults.sa_lifetime.soft_bytes"),
+			HardBytes:   viper.GetUint64("tunnel_defaults.sa_lifetime.hard_bytes"),
+			SoftPackets: viper.GetUint64("tunnel_defaults.sa_lifetime.soft_packets"),
+			HardPackets: viper.GetUint64("tunnel_defaults.sa_lifetime.hard_packets"),
+		},
+		ReconcileInterval:   time.Duration(viper.GetInt("reconcile.interval")) * time.Second,
+		BackoffInitial:      time.Duration(viper.GetInt("reconcile.backoff_initial")) * time.Second,
+		BackoffMax:          time.Duration(viper.GetInt("reconcile.backoff_max")) * time.Second,
+		SelfTest:            viper.GetBool("self_test.enabled"),
+		SelfTestFailClosed:  viper.GetBool("self_test.fail_closed"),
+		AccountingRetention: viper.GetInt("client.accounting_retention"),
+		IKE: IKESettings{
+			AuthMethod:     viper.GetString("security.authentication_method"),
+			IKEProposals:   viper.GetStringSlice("advanced.ike_proposals"),
+			ESPProposals:   viper.GetStringSlice("advanced.esp_proposals"),
+			DPDDelay:       viper.GetInt("advanced.dpd_delay"),
+			DPDTimeout:     viper.GetInt("advanced.dpd_timeout"),
+			ReauthInterval: viper.GetInt("advanced.reauth_interval"),
+			ReauthGrace:    viper.GetInt("advanced.reauth_grace"),
+		},
+	}
+	// The hard time limit falls back to the key rotation interval
+	if s.SALifetime.HardTime == 0 {
+		s.SALifetime.HardTime = time.Duration(viper.GetInt("tunnel_defaults.key_rotation_interval")) * time.Second
+	}
+	return s
+}
+
+// saLifetime returns the lifetime of SAs of tunnels without one of their own,
+// with the default time limits filled in
+func (s Settings) saLifetime() SALifetime {
+	l := s.SALifetime
+	if l.HardTime <= 0 {
+		l.HardTime = defaultSALifetime
+	}
+	if l.SoftTime == 0 {
+		l.SoftTime = time.Duration(float64(l.HardTime) * defaultSoftShare).Round(time.Second)
+	}
+	return l
+}
+
+// reconcileInterval returns how often the reconciler runs
+func (s Settings) reconcileInterval() time.Duration {
+	if s.ReconcileInterval > 0 {
+		return s.ReconcileInterval
+	}
+	return DefaultReconcileInterval
+}
+
+// renegotiationBackoff returns how the repairs of a tunnel that keeps drifting
+// are spaced out
+func (s Settings) renegotiationBackoff() retry.Policy {
+	p := retry.Backoff(DefaultBackoffInitial, DefaultBackoffMax)
+	if s.BackoffInitial > 0 {
+		p.Initial = s.BackoffInitial
+	}
+	if s.BackoffMax > 0 {
+		p.Max = s.BackoffMax
+	}
+	return p
+}
+
+// accountingRetention returns how many days of session records are kept
+func (s Settings) accountingRetention() int {
+	if s.AccountingRetention > 0 {
+		return s.AccountingRetention
+	}
+	return DefaultAccountingRetention
+}
@@ -0,0 +1,362 @@
+package tunnel
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultShortcutMinBytes is the traffic between two spokes through their hub
+// past which the hub offers them a shortcut
+const DefaultShortcutMinBytes = 1 << 20
+
+// ShortcutPeer is an end of a shortcut: a spoke, by the instance the hub
+// accepted it as, its identity, address and subnet
+type ShortcutPeer struct {
+	Tunnel  string `json:"tunnel,omitempty"` // Instance of the spoke on the hub
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Subnet  string `json:"subnet"`
+}
+
+// Shortcut is a direct tunnel a hub brokers between two of its spokes that
+// exchange traffic through it, in the manner of DMVPN and ADVPN, so that the
+// hub leaves the data path between them
+type Shortcut struct {
+	Responder string          `json:"responder"`
+	Peers     [2]ShortcutPeer `json:"peers"`
+	Bytes     uint64          `json:"bytes"` // Traffic between the spokes through the hub
+	Flows     int             `json:"flows"`
+}
+
+// validateShortcuts checks that only responders broker shortcuts
+func validateShortcuts(config Config) error {
+	if config.Shortcuts && config.RemoteIP != AnyPeer {
+		return fmt.Errorf("shortcuts need remote IP %s, a hub accepting spokes", AnyPeer)
+	}
+	if config.Via != "" && config.RemoteIP == AnyPeer {
+		return errors.New("a shortcut connects to a spoke's address, not any")
+	}
+	return nil
+}
+
+// SetShortcuts makes a responder broker shortcuts between its spokes, or stop
+func SetShortcuts(responder string, enabled bool) error {
+	return std.SetShortcuts(responder, enabled)
+}
+
+// SetShortcuts makes a responder broker shortcuts between its spokes
+func (m *Manager) SetShortcuts(responder string, enabled bool) error {
+	t, err := m.responder(responder)
+	if err != nil {
+		return err
+	}
+	t.Shortcuts = enabled
+	t.UpdatedAt = time.Now()
+	if err := m.save(t); err != nil {
+		return err
+	}
+	m.logger().Info("Set shortcuts", "tunnel", responder, "enabled", enabled)
+	return nil
+}
+
+// FindShortcuts returns the shortcuts a responder would broker: the pairs of
+// its spokes that conntrack on the hub has seen exchange at least minBytes,
+// busiest first. With offer, the hub offers each spoke of a pair a shortcut to
+// the other in a tunnel.shortcut.offered event, which the IKE daemon delivers
+// to it; the spoke connects with 'tunnel shortcut add'. Offers are repeated as
+// long as the traffic is seen, and spokes ignore the ones they have taken.
+func FindShortcuts(responder string, minBytes uint64, offer bool) ([]Shortcut, error) {
+	return std.FindShortcuts(responder, minBytes, offer)
+}
+
+// FindShortcuts returns the shortcuts a responder would broker
+func (m *Manager) FindShortcuts(responder string, minBytes uint64, offer bool) ([]Shortcut, error) {
+	t, err := m.responder(responder)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Shortcuts {
+		return nil, fmt.Errorf("responder '%s' brokers no shortcuts, enable them with 'tunnel shortcut enable'", responder)
+	}
+	instances, err := m.Instances(responder)
+	if err != nil {
+		return nil, err
+	}
+	instances = slices.DeleteFunc(instances, func(i *Tunnel) bool { return i.Status != StatusUp })
+	if len(instances) < 2 {
+		return nil, nil
+	}
+
+	// The instances of a responder share its network namespace
+	handle, err := linkHandle(instances[0])
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	var conntrack []*netlink.ConntrackFlow
+	for _, family := range []netlink.InetFamily{unix.AF_INET, unix.AF_INET6} {
+		flows, err := handle.ConntrackTableList(netlink.ConntrackTable, family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list conntrack flows: %v", err)
+		}
+		conntrack = append(conntrack, flows...)
+	}
+
+	shortcuts := spokeShortcuts(responder, instances, conntrack, minBytes)
+	if offer {
+		for _, s := range shortcuts {
+			m.offerShortcut(s.Peers[0], s.Peers[1])
+			m.offerShortcut(s.Peers[1], s.Peers[0])
+		}
+	}
+	return shortcuts, nil
+}
+
+// spokeShortcuts adds up the flows between the subnets of each pair of
+// instances, and returns the pairs past minBytes, busiest first
+func spokeShortcuts(responder string, instances []*Tunnel, conntrack []*netlink.ConntrackFlow, minBytes uint64) []Shortcut {
+	subnets := make([]*net.IPNet, len(instances))
+	for i, instance := range instances {
+		_, subnets[i], _ = net.ParseCIDR(instance.RemoteSubnet)
+	}
+	spokeOf := func(ip net.IP) int {
+		return slices.IndexFunc(subnets, func(subnet *net.IPNet) bool { return subnet != nil && subnet.Contains(ip) })
+	}
+
+	byPair := make(map[[2]int]*Shortcut)
+	for _, c := range conntrack {
+		a, b := spokeOf(c.Forward.SrcIP), spokeOf(c.Forward.DstIP)
+		if a < 0 || b < 0 || a == b {
+			continue
+		}
+		pair := [2]int{min(a, b), max(a, b)}
+		s, ok := byPair[pair]
+		if !ok {
+			s = &Shortcut{Responder: responder}
+			for i, n := range pair {
+				s.Peers[i] = ShortcutPeer{Tunnel: instances[n].Name, ID: instances[n].PeerIdentity,
+					Address: instances[n].RemoteIP, Subnet: instances[n].RemoteSubnet}
+			}
+			byPair[pair] = s
+		}
+		s.Bytes += c.Forward.Bytes + c.Reverse.Bytes
+		s.Flows++
+	}
+
+	var shortcuts []Shortcut
+	for _, s := range byPair {
+		if s.Bytes >= minBytes {
+			shortcuts = append(shortcuts, *s)
+		}
+	}
+	slices.SortFunc(shortcuts, func(a, b Shortcut) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.Peers[0].Tunnel, b.Peers[0].Tunnel))
+	})
+	return shortcuts
+}
+
+// offerShortcut publishes the offer to a spoke of a shortcut to another
+func (m *Manager) offerShortcut(to, peer ShortcutPeer) {
+	e := events.New(events.TypeShortcutOffered, to.Tunnel)
+	e.Reason = fmt.Sprintf("shortcut from %s to %s", to.ID, peer.ID)
+	e.PeerID = peer.ID
+	e.PeerAddress = peer.Address
+	e.PeerSubnet = peer.Subnet
+	if err := m.record(e); err != nil {
+		m.logger().Error("Failed to record event in the journal", "tunnel", to.Tunnel, "type", e.Type, "err", err)
+	}
+	m.send(e)
+	m.logger().Info("Offered shortcut", "tunnel", to.Tunnel, "id", to.ID, "peer", peer.ID, "address", peer.Address)
+}
+
+// AddShortcut connects a spoke directly to another spoke of the hub it reaches
+// through a tunnel, via, as the hub offered. The shortcut is a tunnel named
+// after via with the other spoke's address and subnet and via's other options.
+// The other spoke's subnet is within via's remote subnet and more specific, so
+// traffic to it takes the shortcut rather than the hub. A shortcut already
+// taken to the same spoke is kept, or replaced if the spoke moved.
+func AddShortcut(via string, peer ShortcutPeer) (*Tunnel, error) {
+	return std.AddShortcut(via, peer)
+}
+
+// AddShortcut connects a spoke directly to another spoke of its hub
+func (m *Manager) AddShortcut(via string, peer ShortcutPeer) (*Tunnel, error) {
+	t, err := m.Get(via)
+	if err != nil {
+		return nil, err
+	}
+	if t.Responder() || t.Template != "" || t.Via != "" {
+		return nil, fmt.Errorf("tunnel '%s' is not a spoke's tunnel to its hub", via)
+	}
+	if peer.ID == "" {
+		return nil, errors.New("the peer of a shortcut needs an identity")
+	}
+	if net.ParseIP(peer.Address) == nil {
+		return nil, fmt.Errorf("invalid address of peer %s: %q", peer.ID, peer.Address)
+	}
+	if err := withinSubnet(peer.Subnet, t.RemoteSubnet); err != nil {
+		return nil, fmt.Errorf("%s: %v", peer.ID, err)
+	}
+	if _, subnet, _ := net.ParseCIDR(peer.Subnet); subnet.String() == t.RemoteSubnet {
+		return nil, fmt.Errorf("%s: subnet %s is all of %s's, a shortcut to it would bypass the hub's other spokes", peer.ID, peer.Subnet, via)
+	}
+
+	shortcuts, err := m.ShortcutsVia(via)
+	if err != nil {
+		return nil, err
+	}
+	name := ""
+	for _, s := range shortcuts {
+		if s.PeerIdentity != peer.ID {
+			continue
+		}
+		if s.RemoteIP == peer.Address && s.RemoteSubnet == peer.Subnet && s.Status == StatusUp {
+			m.logger().Info("Shortcut is already up", "tunnel", s.Name, "peer", peer.ID)
+			return s, nil
+		}
+		m.logger().Info("Shortcut peer moved", "tunnel", s.Name, "peer", peer.ID, "address", peer.Address)
+		if err := m.Delete(s.Name, true); err != nil {
+			return nil, err
+		}
+		name = s.Name
+	}
+	if name == "" {
+		if name, err = m.shortcutName(via); err != nil {
+			return nil, err
+		}
+	}
+
+	namespace := t.Namespace
+	if t.OwnsNamespace() {
+		namespace = DedicatedNamespace
+	}
+	shortcut, err := m.Create(Config{
+		Name:         name,
+		LocalIP:      t.LocalIP,
+		RemoteIP:     peer.Address,
+		LocalSubnet:  t.LocalSubnet,
+		RemoteSubnet: peer.Subnet,
+		Encryption:   t.Encryption,
+		PostQuantum:  t.PostQuantum,
+		Namespace:    namespace,
+		KillSwitch:   t.KillSwitch,
+		RateLimit:    t.RateLimit,
+		Mode:         t.Mode,
+		PSKRef:       t.PSKRef,
+		PeerGroup:    t.PeerGroup,
+		PeerIdentity: peer.ID,
+		Via:          via,
+	})
+	if err != nil {
+		return nil, err
+	}
+	shortcut.Labels = t.Labels
+	shortcut.UpdatedAt = time.Now()
+	if err := m.save(shortcut); err != nil {
+		return nil, err
+	}
+	m.logger().Info("Took shortcut", "tunnel", name, "via", via, "peer", peer.ID, "address", peer.Address, "subnet", peer.Subnet)
+	return shortcut, nil
+}
+
+// shortcutName returns the first free name for a shortcut bypassing a tunnel,
+// the tunnel's name followed by -sc and a number
+func (m *Manager) shortcutName(via string) (string, error) {
+	tunnels, err := m.ListConfigured()
+	if err != nil {
+		return "", err
+	}
+	for n := 1; ; n++ {
+		name := via + "-sc" + strconv.Itoa(n)
+		if !slices.ContainsFunc(tunnels, func(t *Tunnel) bool { return t.Name == name }) {
+			return name, nil
+		}
+	}
+}
+
+// ShortcutsVia returns the shortcuts taken that bypass the hub of a tunnel
+func ShortcutsVia(via string) ([]*Tunnel, error) {
+	return std.ShortcutsVia(via)
+}
+
+// ShortcutsVia returns the shortcuts taken that bypass the hub of a tunnel
+func (m *Manager) ShortcutsVia(via string) ([]*Tunnel, error) {
+	tunnels, err := m.ListConfigured()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(tunnels, func(t *Tunnel) bool { return t.Via != via }), nil
+}
+
+// RemoveShortcut deletes a shortcut, so that traffic to its spoke goes through
+// the hub again
+func RemoveShortcut(name string) error {
+	return std.RemoveShortcut(name)
+}
+
+// RemoveShortcut deletes a shortcut
+func (m *Manager) RemoveShortcut(name string) error {
+	t, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+	if t.Via == "" {
+		return fmt.Errorf("tunnel '%s' is not a shortcut", name)
+	}
+	if err := m.Delete(name, true); err != nil {
+		return err
+	}
+	m.logger().Info("Removed shortcut", "tunnel", name, "via", t.Via, "peer", t.PeerIdentity)
+	return nil
+}
+
+// PruneShortcuts removes the shortcuts bypassing a tunnel that carry no
+// traffic, as conntrack sees it, and returns their names
+func PruneShortcuts(via string) ([]string, error) {
+	shortcuts, err := ShortcutsVia(via)
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	var errs []error
+	for _, s := range shortcuts {
+		flows, err := Flows(s.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tunnel '%s': %w", s.Name, err))
+			continue
+		}
+		if len(flows) > 0 {
+			continue
+		}
+		if err := RemoveShortcut(s.Name); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel '%s': %w", s.Name, err))
+			continue
+		}
+		pruned = append(pruned, s.Name)
+	}
+	return pruned, errors.Join(errs...)
+}
+
+// removeShortcuts deletes the shortcuts bypassing a tunnel being deleted
+func (m *Manager) removeShortcuts(via string) error {
+	shortcuts, err := m.ShortcutsVia(via)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, s := range shortcuts {
+		if err := m.RemoveShortcut(s.Name); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel '%s': %w", s.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
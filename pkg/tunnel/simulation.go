@@ -0,0 +1,57 @@
+package tunnel
+
+// simulating is set once the package-level functions use SimulationBackend,
+// so that hook scripts, which act on the host, are not run either
+var simulating bool
+
+// SimulationBackend stands in for the kernel when recorded operations are
+// replayed with 'ipsec-vpn history replay': it changes nothing and reports
+// the status each tunnel was last given, so that the state directory ends up
+// as the operations left it on the host they were recorded on.
+type SimulationBackend struct{}
+
+// Create simulates creating the interface of a tunnel
+func (SimulationBackend) Create(t *Tunnel) error {
+	tunnelLog.Debug("Simulated creating tunnel", "tunnel", t.Name)
+	return nil
+}
+
+// Guard simulates installing the kill-switch of a tunnel
+func (SimulationBackend) Guard(t *Tunnel) error {
+	return nil
+}
+
+// Start simulates bringing a tunnel up
+func (SimulationBackend) Start(t *Tunnel) error {
+	tunnelLog.Debug("Simulated starting tunnel", "tunnel", t.Name)
+	return nil
+}
+
+// Stop simulates taking a tunnel down
+func (SimulationBackend) Stop(t *Tunnel) error {
+	tunnelLog.Debug("Simulated stopping tunnel", "tunnel", t.Name)
+	return nil
+}
+
+// Route simulates installing or removing the default route of a tunnel
+func (SimulationBackend) Route(t *Tunnel, up bool) error {
+	return nil
+}
+
+// Status returns the status a tunnel was last given
+func (SimulationBackend) Status(t *Tunnel) (Status, error) {
+	return t.Status, nil
+}
+
+// Delete simulates removing everything set up for a tunnel
+func (SimulationBackend) Delete(t *Tunnel, force bool) error {
+	tunnelLog.Debug("Simulated deleting tunnel", "tunnel", t.Name)
+	return nil
+}
+
+// Simulate makes the package-level functions use SimulationBackend and skip
+// hook scripts, for the rest of the process
+func Simulate() {
+	std.backend = SimulationBackend{}
+	simulating = true
+}
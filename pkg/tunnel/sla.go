@@ -0,0 +1,294 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+)
+
+// SLA probe types
+const (
+	ProbeICMP = "icmp" // ICMP echo, answered by any host
+	ProbeUDP  = "udp"  // UDP echo, answered by 'tunnel sla responder' or an RFC 862 echo service
+)
+
+// SLA defaults
+const (
+	DefaultSLAInterval = time.Minute
+	DefaultSLACount    = 10
+	DefaultSLAPort     = 7 // The echo service
+)
+
+// slaSpacing is the time between the probes of one operation, and slaTimeout how
+// long a reply to the last probe is waited for
+const (
+	slaSpacing = 20 * time.Millisecond
+	slaTimeout = 2 * time.Second
+)
+
+// slaHistorySize is the number of results kept per tunnel, a day at the default interval
+const slaHistorySize = 1440
+
+// SLA configures the probes sent through a tunnel and the thresholds they must
+// meet. A zero threshold is not checked, but an operation without any reply
+// always violates the SLA.
+type SLA struct {
+	Type       string        `json:"type"`
+	Target     string        `json:"target"` // Address in the remote subnet, with a port for udp probes
+	Interval   time.Duration `json:"interval"`
+	Count      int           `json:"count"` // Probes per operation
+	MaxLatency time.Duration `json:"max_latency,omitempty"`
+	MaxJitter  time.Duration `json:"max_jitter,omitempty"`
+	MaxLoss    float64       `json:"max_loss,omitempty"` // Percent
+}
+
+// SLAResult is the outcome of one probe operation
+type SLAResult struct {
+	Time       time.Time `json:"time"`
+	Sent       int       `json:"sent"`
+	Received   int       `json:"received"`
+	Latency    float64   `json:"latency_ms"` // Mean round-trip time
+	Jitter     float64   `json:"jitter_ms"`  // Mean difference between consecutive round-trip times
+	Loss       float64   `json:"loss"`       // Percent
+	Met        bool      `json:"met"`
+	Violations []string  `json:"violations,omitempty"`
+}
+
+// SetSLA sets the SLA probes of a tunnel, or removes them and their history if sla is nil
+func SetSLA(name string, sla *SLA) error {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+
+	if sla != nil {
+		if err := sla.validate(tunnel); err != nil {
+			return err
+		}
+	} else if path, err := slaHistoryPath(name); err == nil {
+		_ = os.Remove(path)
+	}
+
+	tunnel.SLA = sla
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// validate checks an SLA, filling in defaults
+func (s *SLA) validate(tunnel *Tunnel) error {
+	if s.Type == "" {
+		s.Type = ProbeICMP
+	}
+	if s.Interval == 0 {
+		s.Interval = DefaultSLAInterval
+	}
+	if s.Count == 0 {
+		s.Count = DefaultSLACount
+	}
+	if s.Interval < time.Second {
+		return fmt.Errorf("interval must be at least 1s, got %s", s.Interval)
+	}
+	if s.Count < 1 || s.Count > 1000 {
+		return fmt.Errorf("count must be between 1 and 1000, got %d", s.Count)
+	}
+	if s.MaxLatency < 0 || s.MaxJitter < 0 || s.MaxLoss < 0 || s.MaxLoss > 100 {
+		return errors.New("thresholds must not be negative, and the loss at most 100%")
+	}
+
+	host := s.Target
+	switch s.Type {
+	case ProbeICMP:
+	case ProbeUDP:
+		if h, _, err := net.SplitHostPort(s.Target); err == nil {
+			host = h
+		} else {
+			s.Target = net.JoinHostPort(s.Target, fmt.Sprint(DefaultSLAPort))
+		}
+	default:
+		return fmt.Errorf("unknown probe type '%s', use %s or %s", s.Type, ProbeICMP, ProbeUDP)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid target address '%s'", host)
+	}
+	// Probes must travel through the tunnel to measure it
+	if _, subnet, err := net.ParseCIDR(tunnel.RemoteSubnet); err == nil && !subnet.Contains(ip) {
+		return fmt.Errorf("target %s is not in the remote subnet %s", ip, tunnel.RemoteSubnet)
+	}
+	return nil
+}
+
+// ProbeSLA runs one probe operation through a tunnel, records the result in its
+// history and publishes an event when the SLA becomes violated or is met again
+func ProbeSLA(name string) (*SLAResult, error) {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return nil, err
+	}
+	if tunnel.SLA == nil {
+		return nil, fmt.Errorf("tunnel '%s' has no SLA probes configured", name)
+	}
+	sla := tunnel.SLA
+
+	var rtts []time.Duration
+	err = inNamespace(tunnel, func() error {
+		var err error
+		if sla.Type == ProbeUDP {
+			rtts, err = probeUDP(sla.Target, sla.Count)
+		} else {
+			rtts, err = probeICMP(net.ParseIP(sla.Target), sla.Count)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := sla.evaluate(rtts)
+
+	history, err := SLAHistory(name)
+	if err != nil {
+		return nil, err
+	}
+	// A tunnel without history is taken to have met its SLA
+	previouslyMet := len(history) == 0 || history[len(history)-1].Met
+	if result.Met != previouslyMet {
+		typ := events.TypeSLARestored
+		if !result.Met {
+			typ = events.TypeSLAViolated
+			tunnelLog.Error("Tunnel violates its SLA", "tunnel", name, "violations", strings.Join(result.Violations, ", "))
+		} else {
+			tunnelLog.Info("Tunnel meets its SLA again", "tunnel", name)
+		}
+		e := events.New(typ, name)
+		e.Status = string(tunnel.Status)
+		e.Reason = strings.Join(result.Violations, ", ")
+		events.Publish(e)
+	}
+
+	history = append(history, *result)
+	if len(history) > slaHistorySize {
+		history = history[len(history)-slaHistorySize:]
+	}
+	return result, saveSLAHistory(name, history)
+}
+
+// evaluate summarizes the round-trip times of an operation, in the order the
+// probes were sent with -1 for those lost, and checks them against the thresholds
+func (s *SLA) evaluate(rtts []time.Duration) *SLAResult {
+	result := &SLAResult{Time: time.Now(), Sent: len(rtts)}
+	var total, diffs time.Duration
+	var previous time.Duration = -1
+	var pairs int
+	for _, rtt := range rtts {
+		if rtt < 0 {
+			continue
+		}
+		result.Received++
+		total += rtt
+		if previous >= 0 {
+			diffs += (rtt - previous).Abs()
+			pairs++
+		}
+		previous = rtt
+	}
+	if result.Sent > 0 {
+		result.Loss = float64(result.Sent-result.Received) * 100 / float64(result.Sent)
+	}
+	if result.Received > 0 {
+		result.Latency = ms(total / time.Duration(result.Received))
+	}
+	if pairs > 0 {
+		result.Jitter = ms(diffs / time.Duration(pairs))
+	}
+
+	if result.Received == 0 {
+		result.Violations = append(result.Violations, "no replies")
+	} else {
+		if s.MaxLatency > 0 && result.Latency > ms(s.MaxLatency) {
+			result.Violations = append(result.Violations, fmt.Sprintf("latency %.1fms over %s", result.Latency, s.MaxLatency))
+		}
+		if s.MaxJitter > 0 && result.Jitter > ms(s.MaxJitter) {
+			result.Violations = append(result.Violations, fmt.Sprintf("jitter %.1fms over %s", result.Jitter, s.MaxJitter))
+		}
+		if s.MaxLoss > 0 && result.Loss > s.MaxLoss {
+			result.Violations = append(result.Violations, fmt.Sprintf("loss %.0f%% over %g%%", result.Loss, s.MaxLoss))
+		}
+	}
+	result.Met = len(result.Violations) == 0
+	return result
+}
+
+// ms converts a duration to milliseconds
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Compliance returns the percentage of results that met the SLA
+func Compliance(history []SLAResult) float64 {
+	if len(history) == 0 {
+		return 0
+	}
+	met := 0
+	for _, r := range history {
+		if r.Met {
+			met++
+		}
+	}
+	return float64(met) * 100 / float64(len(history))
+}
+
+// slaHistoryPath returns the file the SLA results of a tunnel are kept in
+func slaHistoryPath(name string) (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "sla", name+".json"), nil
+}
+
+// SLAHistory returns the recorded SLA results of a tunnel, oldest first
+func SLAHistory(name string) ([]SLAResult, error) {
+	path, err := slaHistoryPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var history []SLAResult
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("failed to read SLA history of tunnel '%s': %v", name, err)
+	}
+	return history, nil
+}
+
+// saveSLAHistory replaces the SLA results of a tunnel
+func saveSLAHistory(name string, history []SLAResult) error {
+	path, err := slaHistoryPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
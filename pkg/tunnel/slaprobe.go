@@ -0,0 +1,189 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ICMP echo message types
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// echoID tells apart the ICMP echoes of concurrent probe operations, as every
+// raw socket receives all replies
+var echoID atomic.Uint32
+
+func init() {
+	echoID.Store(uint32(os.Getpid()))
+}
+
+// probeICMP sends count ICMP echo requests to target and returns the round-trip
+// time of each, or -1 for those not answered in time. It needs a raw socket.
+func probeICMP(target net.IP, count int) ([]time.Duration, error) {
+	network, request, reply := "ip4:icmp", byte(icmpv4EchoRequest), byte(icmpv4EchoReply)
+	if target.To4() == nil {
+		network, request, reply = "ip6:ipv6-icmp", icmpv6EchoRequest, icmpv6EchoReply
+	}
+	conn, err := net.ListenPacket(network, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMP socket: %v", err)
+	}
+	defer conn.Close()
+
+	id := uint16(echoID.Add(1))
+	rtts := probe(count, func(seq int) error {
+		msg := make([]byte, 16)
+		msg[0] = request
+		binary.BigEndian.PutUint16(msg[4:], id)
+		binary.BigEndian.PutUint16(msg[6:], uint16(seq))
+		copy(msg[8:], "ipsecvpn")
+		// The kernel computes ICMPv6 checksums, but not ICMPv4 ones
+		if network == "ip4:icmp" {
+			binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+		}
+		_, err := conn.WriteTo(msg, &net.IPAddr{IP: target})
+		return err
+	}, func(deadline time.Time) (int, error) {
+		buf := make([]byte, 1500)
+		for {
+			conn.SetReadDeadline(deadline)
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return 0, err
+			}
+			ip, ok := from.(*net.IPAddr)
+			if n < 8 || !ok || !ip.IP.Equal(target) || buf[0] != reply || binary.BigEndian.Uint16(buf[4:]) != id {
+				continue
+			}
+			return int(binary.BigEndian.Uint16(buf[6:])), nil
+		}
+	})
+	return rtts, nil
+}
+
+// probeUDP sends count UDP probes to an echo service at target (host:port) and
+// returns the round-trip time of each, or -1 for those not echoed in time
+func probeUDP(target string, count int) ([]time.Duration, error) {
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// A random token keeps stray or delayed echoes of other operations out
+	var token [8]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return nil, err
+	}
+	rtts := probe(count, func(seq int) error {
+		msg := binary.BigEndian.AppendUint32(token[:len(token):len(token)], uint32(seq))
+		_, err := conn.Write(msg)
+		return err
+	}, func(deadline time.Time) (int, error) {
+		buf := make([]byte, 64)
+		for {
+			conn.SetReadDeadline(deadline)
+			n, err := conn.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, err
+			}
+			// An ICMP port unreachable is reported on the next read; the probe is lost
+			if err != nil || n != len(token)+4 || string(buf[:len(token)]) != string(token[:]) {
+				continue
+			}
+			return int(binary.BigEndian.Uint32(buf[len(token):])), nil
+		}
+	})
+	return rtts, nil
+}
+
+// probe sends count probes slaSpacing apart while receiving their replies, and
+// returns the round-trip time of each or -1 if it was lost. send failures, such
+// as no route to the target while the tunnel is down, count as lost probes.
+// receive returns the sequence number of the next reply, or an error once the
+// deadline passes.
+func probe(count int, send func(seq int) error, receive func(deadline time.Time) (int, error)) []time.Duration {
+	var mu sync.Mutex
+	rtts := make([]time.Duration, count)
+	sent := make([]time.Time, count)
+	for i := range rtts {
+		rtts[i] = -1
+	}
+
+	deadline := time.Now().Add(time.Duration(count-1)*slaSpacing + slaTimeout)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for answered := 0; answered < count; {
+			seq, err := receive(deadline)
+			now := time.Now()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			if seq < count && !sent[seq].IsZero() && rtts[seq] < 0 {
+				rtts[seq] = now.Sub(sent[seq])
+				answered++
+			}
+			mu.Unlock()
+		}
+	}()
+
+	for seq := 0; seq < count; seq++ {
+		if seq > 0 {
+			time.Sleep(slaSpacing)
+		}
+		mu.Lock()
+		sent[seq] = time.Now()
+		mu.Unlock()
+		if err := send(seq); err != nil {
+			mu.Lock()
+			sent[seq] = time.Time{}
+			mu.Unlock()
+		}
+	}
+	<-done
+	return rtts
+}
+
+// checksum computes the Internet checksum of an ICMPv4 message
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// ServeSLAResponder echoes UDP probes back to their sender until conn is closed
+func ServeSLAResponder(conn net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		_, _ = conn.WriteTo(buf[:n], from)
+	}
+}
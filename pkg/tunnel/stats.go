@@ -0,0 +1,88 @@
+package tunnel
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/fault"
+)
+
+// Stats counts the traffic a tunnel has carried since its interface was created
+type Stats struct {
+	RxBytes       uint64
+	TxBytes       uint64
+	LastHandshake time.Time // Zero if the tunnel mode does not report handshakes or none happened yet
+}
+
+// GetStats returns the traffic counters of a tunnel. IPsec tunnels report the
+// counters of their GRE interface, WireGuard tunnels those of their peer.
+func GetStats(name string) (*Stats, error) {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return nil, err
+	}
+	return tunnelStats(tunnel)
+}
+
+// tunnelStats returns the traffic counters of a loaded tunnel, delayed and
+// corrupted as fault injection says
+func tunnelStats(tunnel *Tunnel) (*Stats, error) {
+	fault.DelayNetlink()
+	stats, err := readStats(tunnel)
+	if err != nil {
+		return nil, err
+	}
+	stats.RxBytes, stats.TxBytes = fault.CorruptCounter(stats.RxBytes), fault.CorruptCounter(stats.TxBytes)
+	return stats, nil
+}
+
+// readStats reads the traffic counters of a loaded tunnel from the kernel
+func readStats(tunnel *Tunnel) (*Stats, error) {
+	if tunnel.Mode == ModeWireGuard {
+		return wireGuardStats(tunnel)
+	}
+
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	link, err := handle.LinkByName(tunnel.Interface())
+	if err != nil {
+		return nil, fmt.Errorf("interface %s not found: %v", tunnel.Interface(), err)
+	}
+	stats := &Stats{}
+	if s := link.Attrs().Statistics; s != nil {
+		stats.RxBytes = s.RxBytes
+		stats.TxBytes = s.TxBytes
+	}
+	return stats, nil
+}
+
+// PublishStats publishes the traffic counters of each tunnel that is up as a
+// stats event. Tunnels whose counters cannot be read are skipped.
+func PublishStats() error {
+	tunnels, err := ListAll()
+	if err != nil {
+		return err
+	}
+	for _, t := range tunnels {
+		if t.Status != StatusUp {
+			continue
+		}
+		stats, err := GetStats(t.Name)
+		if err != nil {
+			continue
+		}
+		e := events.New(events.TypeStats, t.Name)
+		e.Status = string(t.Status)
+		e.RxBytes, e.TxBytes = &stats.RxBytes, &stats.TxBytes
+		if !stats.LastHandshake.IsZero() {
+			e.LastHandshake = &stats.LastHandshake
+		}
+		events.Publish(e)
+	}
+	return nil
+}
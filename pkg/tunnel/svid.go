@@ -0,0 +1,32 @@
+package tunnel
+
+import (
+	"crypto/x509"
+	"fmt"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/spiffe"
+)
+
+// VerifyPeerSVID checks the X.509-SVID chain a peer authenticated with against the
+// trust bundles from the Workload API and the SPIFFE ID the tunnel accepts
+func VerifyPeerSVID(name string, chain []*x509.Certificate, bundles map[string][]*x509.Certificate) (spiffe.ID, error) {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return spiffe.ID{}, err
+	}
+	if tunnel.PeerSpiffeID == "" {
+		return spiffe.ID{}, fmt.Errorf("tunnel '%s' has no peer SPIFFE ID to authenticate against", name)
+	}
+	allowed, err := spiffe.ParseID(tunnel.PeerSpiffeID)
+	if err != nil {
+		return spiffe.ID{}, err
+	}
+
+	id, err := spiffe.VerifyPeer(chain, bundles, allowed)
+	if err != nil {
+		tunnelLog.Error("Rejected peer SVID", "tunnel", name, "err", err)
+		return id, err
+	}
+	tunnelLog.Debug("Authenticated peer", "tunnel", name, "spiffe_id", id)
+	return id, nil
+}
@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Payload is an IKE payload as recorded in a transcript. Only the type and length
+// are kept, so nonces, key exchange data, identities and AUTH never reach the file.
+type Payload struct {
+	Type   string `json:"type"`
+	Length int    `json:"length"`
+}
+
+// TranscriptEvent is one IKE message in a negotiation transcript
+type TranscriptEvent struct {
+	Time      time.Time `json:"time"`
+	Elapsed   float64   `json:"elapsed_ms"` // Since the negotiation started
+	Direction string    `json:"direction"`  // "in" or "out"
+	Exchange  string    `json:"exchange"`   // e.g. IKE_SA_INIT, IKE_AUTH, CREATE_CHILD_SA
+	MessageID uint32    `json:"message_id"`
+	Payloads  []Payload `json:"payloads,omitempty"`
+	Notify    []string  `json:"notify,omitempty"`   // Notify message types
+	Proposal  string    `json:"proposal,omitempty"` // The selected proposal, if any
+}
+
+// Transcript records an IKE negotiation for interop debugging. A nil Transcript
+// records nothing, so callers need not check whether debugging is enabled.
+type Transcript struct {
+	mu      sync.Mutex
+	file    *os.File
+	started time.Time
+}
+
+// SetDebug turns negotiation transcripts on or off for a tunnel. The setting is
+// read at the start of each negotiation, so it takes effect without a restart.
+func SetDebug(name string, enabled bool) error {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+
+	tunnel.Debug = enabled
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// TranscriptPath returns the file a tunnel's negotiation transcript is written to
+func TranscriptPath(name string) (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "debug", name+".log"), nil
+}
+
+// OpenTranscript starts a transcript for a new negotiation of a tunnel. It returns
+// nil if debugging is not enabled for the tunnel.
+func OpenTranscript(name string) (*Transcript, error) {
+	tunnel, err := loadTunnel(name)
+	if err != nil || !tunnel.Debug {
+		return nil, err
+	}
+
+	path, err := TranscriptPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transcript{file: file, started: time.Now()}, nil
+}
+
+// Record appends a message to the transcript
+func (t *Transcript) Record(event TranscriptEvent) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Elapsed = float64(event.Time.Sub(t.started).Microseconds()) / 1000
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = t.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close ends the transcript
+func (t *Transcript) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.file.Close()
+}
+
+// ReadTranscript returns the recorded negotiation messages of a tunnel
+func ReadTranscript(name string) ([]TranscriptEvent, error) {
+	path, err := TranscriptPath(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []TranscriptEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event TranscriptEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue // Skip lines cut short by a crash
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
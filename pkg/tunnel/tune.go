@@ -0,0 +1,304 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// AutoMTU sizes the MTU of a tunnel interface to fit the MTU of its underlay
+const AutoMTU = -1
+
+// Bounds of the MTUs a tuning sets. Jumbo frames top out at 9216 bytes on most
+// switches.
+const (
+	minMTU = 576
+	maxMTU = 9216
+)
+
+// Tuning holds the settings that get more throughput out of a tunnel than the
+// defaults do, on fast links in particular: offload features of the tunnel
+// interface and of the underlay interface carrying its traffic to the peer, and
+// their MTUs. A jumbo-frame underlay, with an MTU of 9000, carries tunnel
+// packets several times larger than the default 1400 byte ones.
+type Tuning struct {
+	MTU              int             `json:"mtu,omitempty"`          // Of the tunnel interface, AutoMTU to fit the underlay
+	UnderlayMTU      int             `json:"underlay_mtu,omitempty"` // Of the underlay interface
+	Offloads         map[string]bool `json:"offloads,omitempty"`     // Of the tunnel interface, by ethtool name, such as gro
+	UnderlayOffloads map[string]bool `json:"underlay_offloads,omitempty"`
+}
+
+// Validate checks the MTUs and offload names of a tuning
+func (t *Tuning) Validate() error {
+	if t.MTU != 0 && t.MTU != AutoMTU && (t.MTU < minMTU || t.MTU > maxMTU) {
+		return fmt.Errorf("invalid MTU %d, must be between %d and %d", t.MTU, minMTU, maxMTU)
+	}
+	if t.UnderlayMTU != 0 && (t.UnderlayMTU < minMTU || t.UnderlayMTU > maxMTU) {
+		return fmt.Errorf("invalid underlay MTU %d, must be between %d and %d", t.UnderlayMTU, minMTU, maxMTU)
+	}
+	for _, offloads := range []map[string]bool{t.Offloads, t.UnderlayOffloads} {
+		for name := range offloads {
+			if _, ok := network.OffloadFeatures[name]; !ok {
+				return fmt.Errorf("unknown offload %s, expected one of %s", name, strings.Join(slices.Sorted(maps.Keys(network.OffloadFeatures)), ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// String summarizes a tuning on one line
+func (t *Tuning) String() string {
+	var parts []string
+	switch t.MTU {
+	case 0:
+	case AutoMTU:
+		parts = append(parts, "mtu auto")
+	default:
+		parts = append(parts, fmt.Sprintf("mtu %d", t.MTU))
+	}
+	parts = append(parts, formatOffloads(t.Offloads)...)
+	if t.UnderlayMTU != 0 {
+		parts = append(parts, fmt.Sprintf("underlay mtu %d", t.UnderlayMTU))
+	}
+	for _, o := range formatOffloads(t.UnderlayOffloads) {
+		parts = append(parts, "underlay "+o)
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// FormatOffload formats the setting of an offload feature as name=on or name=off
+func FormatOffload(name string, on bool) string {
+	if on {
+		return name + "=on"
+	}
+	return name + "=off"
+}
+
+// ParseOffload parses the setting of an offload feature, such as gro=on
+func ParseOffload(s string) (string, bool, error) {
+	name, state, _ := strings.Cut(s, "=")
+	if _, ok := network.OffloadFeatures[name]; !ok {
+		return "", false, fmt.Errorf("unknown offload %q, expected one of %s", name, strings.Join(slices.Sorted(maps.Keys(network.OffloadFeatures)), ", "))
+	}
+	switch state {
+	case "on":
+		return name, true, nil
+	case "off":
+		return name, false, nil
+	}
+	return "", false, fmt.Errorf("invalid offload setting %q, expected %s=on or %s=off", s, name, name)
+}
+
+// formatOffloads formats offload settings in the order of their names
+func formatOffloads(offloads map[string]bool) []string {
+	var settings []string
+	for _, name := range slices.Sorted(maps.Keys(offloads)) {
+		settings = append(settings, FormatOffload(name, offloads[name]))
+	}
+	return settings
+}
+
+// parseOffloads parses the offload settings formatOffloads formatted, skipping
+// any that are invalid
+func parseOffloads(settings []string) map[string]bool {
+	var offloads map[string]bool
+	for _, s := range settings {
+		if name, on, err := ParseOffload(s); err == nil {
+			if offloads == nil {
+				offloads = make(map[string]bool)
+			}
+			offloads[name] = on
+		}
+	}
+	return offloads
+}
+
+// Overhead returns the bytes a tunnel adds to each packet it carries, at most:
+// the outer IP header, and for WireGuard its UDP header and own header and tag;
+// for IPsec, the GRE header, UDP encapsulation for NAT traversal, and the ESP
+// header, the largest IV, padding and ICV of the algorithms it negotiates
+func Overhead(tunnel *Tunnel) int {
+	outer := 20
+	if ip := net.ParseIP(tunnel.RemoteIP); ip != nil && ip.To4() == nil {
+		outer = 40
+	}
+	if tunnel.Mode == ModeWireGuard {
+		return outer + 8 + 32
+	}
+	const gre, natt, esp = 4, 8, 8 + 16 + 15 + 2 + 16
+	return outer + gre + natt + esp
+}
+
+// TuningState is the MTU and offload features of the tunnel interface and the
+// underlay interface of a tunnel, and the MTU the tunnel interface can have for
+// its packets to fit the underlay unfragmented
+type TuningState struct {
+	Interface        string                     `json:"interface"`
+	MTU              int                        `json:"mtu"`
+	Offloads         map[string]network.Offload `json:"offloads"`
+	Underlay         string                     `json:"underlay"`
+	UnderlayMTU      int                        `json:"underlay_mtu"`
+	UnderlayOffloads map[string]network.Offload `json:"underlay_offloads"`
+	FitMTU           int                        `json:"fit_mtu"`
+}
+
+// underlayOf returns the interface the traffic of a tunnel to its peer leaves through
+func underlayOf(tunnel *Tunnel) (string, error) {
+	if tunnel.Responder() {
+		return "", errors.New("a responder has no interface of its own, tune the tunnels to its initiators")
+	}
+	_, iface, err := network.PeerPath(tunnel.RemoteIP)
+	return iface, err
+}
+
+// Underlays returns the interfaces the traffic of the tunnels to their peers
+// leaves through, in the order of the tunnels. Responders, whose peers may be
+// anywhere, are left out.
+func Underlays() ([]string, error) {
+	tunnels, err := ListAll()
+	if err != nil {
+		return nil, err
+	}
+	var underlays []string
+	for _, t := range tunnels {
+		if t.Responder() {
+			continue
+		}
+		iface, err := underlayOf(t)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel '%s': %v", t.Name, err)
+		}
+		if !slices.Contains(underlays, iface) {
+			underlays = append(underlays, iface)
+		}
+	}
+	return underlays, nil
+}
+
+// GetTuningState returns the current MTUs and offload features of a tunnel,
+// which must have its interface
+func GetTuningState(name string) (*TuningState, error) {
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return nil, err
+	}
+	underlay, err := underlayOf(tunnel)
+	if err != nil {
+		return nil, err
+	}
+	state := &TuningState{Interface: tunnel.Interface(), Underlay: underlay}
+
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	err = inNamespace(tunnel, func() error {
+		link, err := handle.LinkByName(state.Interface)
+		if err != nil {
+			return fmt.Errorf("failed to find interface %s: %v", state.Interface, err)
+		}
+		state.MTU = link.Attrs().MTU
+		state.Offloads, err = network.Offloads(state.Interface)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The underlay stays in the namespace the tunnel interface was created in
+	link, err := network.Handle().LinkByName(underlay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %v", underlay, err)
+	}
+	state.UnderlayMTU = link.Attrs().MTU
+	state.FitMTU = state.UnderlayMTU - Overhead(tunnel)
+	if state.UnderlayOffloads, err = network.Offloads(underlay); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// SetTuning replaces the tuning of a tunnel, or removes it if nil. A tunnel
+// that is up is tuned straight away; otherwise it is when it starts. Removing a
+// tuning leaves the interfaces as they are.
+func SetTuning(name string, tuning *Tuning) error {
+	if err := RequireSelfTest(); err != nil {
+		return err
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+	if tuning != nil {
+		if err := tuning.Validate(); err != nil {
+			return err
+		}
+		if tunnel.Responder() {
+			return errors.New("a responder has no interface of its own, tune the tunnels to its initiators")
+		}
+	}
+
+	tunnel.Tuning = tuning
+	if tunnel.Status == StatusUp {
+		if err := applyTuning(tunnel); err != nil {
+			return err
+		}
+	}
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
+
+// applyTuning sets the MTUs and offload features of a tuning, the underlay's
+// first so that an MTU sized to fit it sees the new one
+func applyTuning(tunnel *Tunnel) error {
+	t := tunnel.Tuning
+	if t == nil {
+		return nil
+	}
+	underlay, err := underlayOf(tunnel)
+	if err != nil {
+		return err
+	}
+	if t.UnderlayMTU != 0 {
+		if err := network.SetMTU(network.Handle(), underlay, t.UnderlayMTU); err != nil {
+			return err
+		}
+	}
+	if err := network.SetOffloads(underlay, t.UnderlayOffloads); err != nil {
+		return err
+	}
+
+	mtu := t.MTU
+	if mtu == AutoMTU {
+		link, err := network.Handle().LinkByName(underlay)
+		if err != nil {
+			return fmt.Errorf("failed to find interface %s: %v", underlay, err)
+		}
+		mtu = link.Attrs().MTU - Overhead(tunnel)
+	}
+
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	tunnelLog.Debug("Tuning tunnel", "tunnel", tunnel.Name, "tuning", t.String(), "underlay", underlay)
+	return inNamespace(tunnel, func() error {
+		if mtu != 0 {
+			if err := network.SetMTU(handle, tunnel.Interface(), mtu); err != nil {
+				return err
+			}
+		}
+		return network.SetOffloads(tunnel.Interface(), t.Offloads)
+	})
+}
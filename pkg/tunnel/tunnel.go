@@ -1,19 +1,34 @@
 package tunnel
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"os"
-	"os/user"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
+
 	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
-	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/dzakwan/ipsec-vpn/pkg/paths"
+	"github.com/dzakwan/ipsec-vpn/pkg/secret"
+	"github.com/dzakwan/ipsec-vpn/pkg/spiffe"
 	"github.com/spf13/viper"
 	"github.com/vishvananda/netlink"
 )
 
+var (
+	// ErrNotFound is returned when a tunnel has no configuration
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidConfig is returned by Create for a configuration that does not validate
+	ErrInvalidConfig = errors.New("invalid tunnel configuration")
+)
+
 // Status represents the current state of a tunnel
 type Status string
 
@@ -33,107 +48,275 @@ LocalSubnet  string
 RemoteSubnet string
 Encryption   string
 PostQuantum  bool
+Namespace    string // Network namespace for the tunnel interface, or DedicatedNamespace
+KillSwitch   bool   // Drop traffic to the remote subnet while the tunnel is down
+RateLimit    uint64 // Bandwidth limit in bits per second in each direction, 0 for none
+PeerPin      string // Fingerprint of the key the peer must present
+PinTOFU      bool   // Pin the peer's key on first use
+PeerSpiffeID string // SPIFFE ID, or trust domain, the peer's SVID must carry
+Mode         string // ModeIPsec, the default, or ModeWireGuard
+WireGuardPeerKey string // Peer's WireGuard public key, in ModeWireGuard
+ListenPort   int    // WireGuard UDP port, DefaultWireGuardPort if 0
+PSKRef       string // Where the pre-shared key is kept, such as vault://branches/paris
+PeerGroup    string // Peer group whose authentication, proposals and DPD settings the tunnel shares
+PeerID       string // Identity pattern initiators must match, with RemoteIP AnyPeer
+PeerCA       string // CA certificate file, or HubCA, initiators' certificates must chain to, with RemoteIP AnyPeer
+VirtualIPPool string            // Subnet initiators are leased virtual IPs from, with RemoteIP AnyPeer
+VirtualIPs    map[string]string // Virtual IPs of initiators by identity, with RemoteIP AnyPeer
+Template      string            // Responder whose initiator the tunnel is an instance for
+PeerIdentity  string            // Identity of that initiator, or of the spoke a shortcut connects to
+VirtualIP     string            // Virtual IP, or subnet, the responder assigned that initiator
+Shortcuts     bool              // Broker shortcuts between the initiators, with RemoteIP AnyPeer
+Via           string            // Tunnel to the hub a shortcut bypasses
 }
 
-// Tunnel represents an IPsec tunnel
+// Tunnel represents an IPsec tunnel. Reason explains the current status, such as
+// the error that put the tunnel in the ERROR state, and LastTransition is when the
+// status last changed. Failures holds the times of the failures reported in the
+// last failureRetention, such as failed negotiations and rekeys.
 type Tunnel struct {
-Name         string    `json:"name"`
-LocalIP      string    `json:"local_ip"`
-RemoteIP     string    `json:"remote_ip"`
-LocalSubnet  string    `json:"local_subnet"`
-RemoteSubnet string    `json:"remote_subnet"`
-Encryption   string    `json:"encryption"`
-PostQuantum  bool      `json:"post_quantum"`
-Status       Status    `json:"status"`
-CreatedAt    time.Time `json:"created_at"`
-UpdatedAt    time.Time `json:"updated_at"`
+Name           string    `json:"name"`
+LocalIP        string    `json:"local_ip"`
+RemoteIP       string    `json:"remote_ip"`
+LocalSubnet    string    `json:"local_subnet"`
+RemoteSubnet   string    `json:"remote_subnet"`
+Encryption     string    `json:"encryption"`
+PostQuantum    bool      `json:"post_quantum"`
+Status         Status    `json:"status"`
+Reason         string    `json:"reason,omitempty"`
+LastTransition time.Time `json:"last_transition"`
+Peer           *Peer     `json:"peer,omitempty"`
+Debug          bool      `json:"debug"`
+Namespace      string    `json:"namespace,omitempty"`
+KillSwitch     bool      `json:"kill_switch"`
+Policy         []TrafficRule `json:"policy,omitempty"`
+AppRoutes      []AppRoute `json:"app_routes,omitempty"`
+MulticastRoutes []MulticastRoute `json:"multicast_routes,omitempty"`
+RateLimit      uint64    `json:"rate_limit,omitempty"`
+PacketAccounting bool    `json:"packet_accounting,omitempty"`
+PeerPin        string    `json:"peer_pin,omitempty"`
+PinTOFU        bool      `json:"pin_tofu"`
+PinnedAt       time.Time `json:"pinned_at,omitempty"`
+PeerSpiffeID   string    `json:"peer_spiffe_id,omitempty"`
+Mode           string    `json:"mode"`
+WireGuardPeerKey string  `json:"wireguard_peer_key,omitempty"`
+ListenPort     int       `json:"listen_port,omitempty"`
+PSKRef         string    `json:"psk_ref,omitempty"`
+PeerGroup      string    `json:"peer_group,omitempty"`
+PeerID         string    `json:"peer_id,omitempty"`
+PeerCA         string    `json:"peer_ca,omitempty"`
+Template       string    `json:"template,omitempty"`      // Responder this tunnel is an instance of
+PeerIdentity   string    `json:"peer_identity,omitempty"` // Identity the initiator of an instance was accepted as
+VirtualIPPool  string    `json:"virtual_ip_pool,omitempty"`
+VirtualIPs     map[string]string `json:"virtual_ips,omitempty"`
+VirtualIP      string    `json:"virtual_ip,omitempty"` // Assigned to the initiator of an instance
+Shortcuts      bool      `json:"shortcuts,omitempty"`
+Via            string    `json:"via,omitempty"` // Tunnel to the hub this shortcut bypasses
+SLA            *SLA      `json:"sla,omitempty"`
+Hooks          *Hooks    `json:"hooks,omitempty"`
+Inspection     *Inspection `json:"inspection,omitempty"`
+Uplink         string    `json:"uplink,omitempty"`
+Labels         map[string]string `json:"labels,omitempty"`
+DefaultRoute   bool      `json:"default_route"`
+DNS            []string  `json:"dns,omitempty"`
+Keepalive      time.Duration `json:"keepalive,omitempty"`
+SALifetime     *SALifetime `json:"sa_lifetime,omitempty"`
+Reauth         *ReauthPolicy `json:"reauth,omitempty"`
+Tuning         *Tuning   `json:"tuning,omitempty"`
+Failures       []time.Time `json:"failures,omitempty"`
+CreatedAt      time.Time `json:"created_at"`
+UpdatedAt      time.Time `json:"updated_at"`
+settings       *Settings // Of the Manager the tunnel belongs to, nil for the configuration
 }
 
 // Create creates a new IPsec tunnel with the given configuration
 func Create(config Config) (*Tunnel, error) {
+	return std.Create(config)
+}
+
+// Create creates a new IPsec tunnel with the given configuration
+func (m *Manager) Create(config Config) (*Tunnel, error) {
+	if err := m.requireSelfTest(); err != nil {
+		return nil, err
+	}
+	// Pick a concrete cipher for this host if requested. WireGuard has only one.
+	config.Mode = cmp.Or(config.Mode, ModeIPsec)
+	if config.Mode == ModeWireGuard {
+		config.Encryption = cmp.Or(config.Encryption, WireGuardEncryption)
+		config.ListenPort = cmp.Or(config.ListenPort, DefaultWireGuardPort)
+	}
+	config.Encryption = m.resolveAlgorithm(config.Encryption)
+
 	// Validate configuration
 	if err := validateConfig(config); err != nil {
-		logger.Error("Failed to validate tunnel configuration: %v", err)
-		return nil, err
+		m.logger().Error("Failed to validate tunnel configuration", "tunnel", config.Name, "err", err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
 	}
 
 	// Check if tunnel already exists
-	if _, err := Get(config.Name); err == nil {
-		logger.Error("Tunnel with name '%s' already exists", config.Name)
+	if _, err := m.Get(config.Name); err == nil {
+		m.logger().Error("Tunnel already exists", "tunnel", config.Name)
 		return nil, fmt.Errorf("tunnel with name '%s' already exists", config.Name)
 	}
 
-	logger.Info("Creating new tunnel '%s' from %s to %s", config.Name, config.LocalIP, config.RemoteIP)
-	logger.Debug("Tunnel details: local subnet %s, remote subnet %s, encryption %s, post-quantum %v", 
-		config.LocalSubnet, config.RemoteSubnet, config.Encryption, config.PostQuantum)
+	if config.PeerGroup != "" {
+		if _, err := m.PeerGroup(config.PeerGroup); err != nil {
+			return nil, err
+		}
+	}
+
+	// A reference to a pre-shared key that cannot be resolved fails before anything is created
+	if config.PSKRef != "" {
+		psk, err := resolvePSK(&Tunnel{Name: config.Name, PSKRef: config.PSKRef})
+		if err != nil {
+			return nil, err
+		}
+		crypto.Zeroize(psk)
+	}
+
+	// So does a peer CA that cannot be read
+	if config.PeerCA != "" {
+		if _, err := peerCA(&Tunnel{PeerCA: config.PeerCA}); err != nil {
+			return nil, fmt.Errorf("failed to read peer CA %s: %w", config.PeerCA, err)
+		}
+	}
+
+	m.logger().Info("Creating new tunnel", "tunnel", config.Name, "local", config.LocalIP, "remote", config.RemoteIP)
+	m.logger().Debug("Tunnel details", "tunnel", config.Name, "local_subnet", config.LocalSubnet,
+		"remote_subnet", config.RemoteSubnet, "encryption", config.Encryption, "post_quantum", config.PostQuantum)
 
 	// Create tunnel object
 	tunnel := &Tunnel{
-		Name:         config.Name,
-		LocalIP:      config.LocalIP,
-		RemoteIP:     config.RemoteIP,
-		LocalSubnet:  config.LocalSubnet,
-		RemoteSubnet: config.RemoteSubnet,
-		Encryption:   config.Encryption,
-		PostQuantum:  config.PostQuantum,
-		Status:       StatusDown,
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+		settings:         m.settings,
+		Name:             config.Name,
+		LocalIP:          config.LocalIP,
+		RemoteIP:         config.RemoteIP,
+		LocalSubnet:      config.LocalSubnet,
+		RemoteSubnet:     config.RemoteSubnet,
+		Encryption:       config.Encryption,
+		PostQuantum:      config.PostQuantum,
+		Namespace:        namespaceFor(config.Name, config.Namespace),
+		KillSwitch:       config.KillSwitch,
+		RateLimit:        config.RateLimit,
+		PeerPin:          config.PeerPin,
+		PinTOFU:          config.PinTOFU,
+		PeerSpiffeID:     config.PeerSpiffeID,
+		Mode:             config.Mode,
+		WireGuardPeerKey: config.WireGuardPeerKey,
+		ListenPort:       config.ListenPort,
+		PSKRef:           config.PSKRef,
+		PeerGroup:        config.PeerGroup,
+		PeerID:           config.PeerID,
+		PeerCA:           config.PeerCA,
+		VirtualIPPool:    config.VirtualIPPool,
+		VirtualIPs:       config.VirtualIPs,
+		Template:         config.Template,
+		PeerIdentity:     config.PeerIdentity,
+		VirtualIP:        config.VirtualIP,
+		Shortcuts:        config.Shortcuts,
+		Via:              config.Via,
+		Status:           StatusDown,
+		LastTransition:   time.Now(),
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
 	}
 
 	// Save tunnel configuration
-	if err := saveTunnel(tunnel); err != nil {
-		logger.Error("Failed to save tunnel configuration: %v", err)
+	if err := m.save(tunnel); err != nil {
+		m.logger().Error("Failed to save tunnel configuration", "tunnel", config.Name, "err", err)
 		return nil, err
 	}
 
-	// Create GRE tunnel interface
-	logger.Debug("Creating GRE tunnel interface for '%s'", config.Name)
-	if err := createGRETunnelInterface(tunnel); err != nil {
-		logger.Error("Failed to create GRE tunnel interface: %v", err)
-		_ = deleteTunnelConfig(config.Name)
-		return nil, err
+	// Create the interface and everything around it. A responder has none, only
+	// the instances of the initiators it accepts.
+	if !tunnel.Responder() {
+		m.logger().Debug("Creating interface", "tunnel", config.Name, "mode", tunnel.Mode, "interface", tunnel.Interface())
+		if err := m.backend.Create(tunnel); err != nil {
+			m.logger().Error("Failed to create tunnel", "tunnel", config.Name, "err", err)
+			_ = m.deleteConfig(config.Name)
+			return nil, err
+		}
 	}
 
 	// Update status
-	tunnel.Status = StatusUp
-	if err := saveTunnel(tunnel); err != nil {
+	tunnel.setStatus(StatusUp, "")
+	if tunnel.PeerPin != "" {
+		tunnel.PinnedAt = tunnel.CreatedAt
+	}
+	if err := m.save(tunnel); err != nil {
 		return nil, err
 	}
+	m.publish(tunnel, events.TypeCreated)
 
 	return tunnel, nil
 }
 
 // Get retrieves a tunnel by name
 func Get(name string) (*Tunnel, error) {
+	return std.Get(name)
+}
+
+// Get retrieves a tunnel by name
+func (m *Manager) Get(name string) (*Tunnel, error) {
 	// Load tunnel configuration
-	tunnel, err := loadTunnel(name)
+	tunnel, err := m.load(name)
 	if err != nil {
 		return nil, err
 	}
 
-	// Update status
-	status, err := getTunnelStatus(tunnel)
+	m.refreshStatus(tunnel)
+	return tunnel, nil
+}
+
+// RefreshStatus looks up the current status of a tunnel
+func (t *Tunnel) RefreshStatus() {
+	std.refreshStatus(t)
+}
+
+// refreshStatus looks up the current status of a tunnel in the backend
+func (m *Manager) refreshStatus(t *Tunnel) {
+	status, err := m.backend.Status(t)
 	if err != nil {
-		tunnel.Status = StatusUnknown
+		t.Status = StatusUnknown
 	} else {
-		tunnel.Status = status
+		t.Status = status
 	}
-
-	return tunnel, nil
 }
 
 // ListAll returns all configured tunnels
 func ListAll() ([]*Tunnel, error) {
-	// Get config directory
-	configDir, err := getConfigDir()
+	return std.List()
+}
+
+// List returns all configured tunnels
+func (m *Manager) List() ([]*Tunnel, error) {
+	tunnels, err := m.ListConfigured()
+	if err != nil {
+		return nil, err
+	}
+	for _, tunnel := range tunnels {
+		m.refreshStatus(tunnel)
+	}
+	return tunnels, nil
+}
+
+// ListConfigured returns all configured tunnels as stored, without looking up
+// their status, for callers that only need it for some of them
+func ListConfigured() ([]*Tunnel, error) {
+	return std.ListConfigured()
+}
+
+// ListConfigured returns all configured tunnels as stored, without looking up
+// their status
+func (m *Manager) ListConfigured() ([]*Tunnel, error) {
+	// Get the directory of the tunnels
+	tunnelsDir, err := m.tunnelsDir()
 	if err != nil {
 		return nil, err
 	}
 
 	// List all tunnel config files
-	pattern := filepath.Join(configDir, "tunnels", "*.json")
-	files, err := filepath.Glob(pattern)
+	files, err := filepath.Glob(filepath.Join(tunnelsDir, "*.json"))
 	if err != nil {
 		return nil, err
 	}
@@ -144,7 +327,7 @@ func ListAll() ([]*Tunnel, error) {
 		name := filepath.Base(file)
 		name = name[:len(name)-5] // Remove .json extension
 
-		tunnel, err := Get(name)
+		tunnel, err := m.load(name)
 		if err != nil {
 			// Skip tunnels with errors
 			continue
@@ -158,8 +341,16 @@ func ListAll() ([]*Tunnel, error) {
 
 // Start starts an existing tunnel
 func Start(name string) error {
+	return std.Start(name)
+}
+
+// Start starts an existing tunnel
+func (m *Manager) Start(name string) error {
+	if err := m.requireSelfTest(); err != nil {
+		return err
+	}
 	// Get tunnel
-	tunnel, err := Get(name)
+	tunnel, err := m.Get(name)
 	if err != nil {
 		return err
 	}
@@ -168,83 +359,277 @@ func Start(name string) error {
 	if tunnel.Status == StatusUp {
 		return nil
 	}
+	if tunnel.Responder() {
+		return m.setResponderStatus(tunnel, StatusUp)
+	}
+
+	// The block route does not survive a reboot, so make sure it is there
+	if err := m.backend.Guard(tunnel); err != nil {
+		return err
+	}
+
+	if err := runHook(tunnel, HookPreUp); err != nil {
+		m.logger().Error("Not starting tunnel", "tunnel", name, "err", err)
+		return err
+	}
 
-	// Start the tunnel
-	if err := startTunnel(tunnel); err != nil {
+	// Start the tunnel, recording why it failed
+	if err := m.backend.Start(tunnel); err != nil {
+		tunnel.setStatus(StatusError, fmt.Sprintf("start failed: %v", err))
+		_ = m.save(tunnel)
+		m.publish(tunnel, events.TypeError)
 		return err
 	}
 
 	// Update status
-	tunnel.Status = StatusUp
-	tunnel.UpdatedAt = time.Now()
-	if err := saveTunnel(tunnel); err != nil {
+	tunnel.setStatus(StatusUp, "")
+	if err := m.save(tunnel); err != nil {
 		return err
 	}
+	m.publish(tunnel, events.TypeUp)
 
+	if err := m.backend.Route(tunnel, true); err != nil {
+		m.logger().Error("Tunnel is up but does not carry all traffic", "tunnel", name, "err", err)
+		return err
+	}
+
+	if err := runHook(tunnel, HookPostUp); err != nil {
+		m.logger().Error("Hook failed", "tunnel", name, "err", err)
+	}
 	return nil
 }
 
 // Stop stops an active tunnel
 func Stop(name string) error {
+	return std.Stop(name)
+}
+
+// Stop stops an active tunnel
+func (m *Manager) Stop(name string) error {
+	if err := m.requireSelfTest(); err != nil {
+		return err
+	}
 	// Get tunnel
-	logger.Debug("Attempting to stop tunnel '%s'", name)
-	tunnel, err := Get(name)
+	m.logger().Debug("Attempting to stop tunnel", "tunnel", name)
+	tunnel, err := m.Get(name)
 	if err != nil {
-		logger.Error("Failed to get tunnel '%s': %v", name, err)
+		m.logger().Error("Failed to get tunnel", "tunnel", name, "err", err)
+		return err
+	}
+	if tunnel.Responder() {
+		return m.setResponderStatus(tunnel, StatusDown)
+	}
+
+	// Make sure traffic is dropped once the tunnel is down
+	if err := m.backend.Guard(tunnel); err != nil {
+		m.logger().Error("Failed to install kill-switch for tunnel", "tunnel", name, "err", err)
 		return err
 	}
 
 	// Check if tunnel is already down
 	if tunnel.Status == StatusDown {
-		logger.Info("Tunnel '%s' is already down, no action needed", name)
+		m.logger().Info("Tunnel is already down, no action needed", "tunnel", name)
 		return nil
 	}
 
+	if err := runHook(tunnel, HookPreDown); err != nil {
+		m.logger().Error("Not stopping tunnel", "tunnel", name, "err", err)
+		return err
+	}
+
+	// Hand traffic back to the default route before the tunnel goes away
+	if err := m.backend.Route(tunnel, false); err != nil {
+		m.logger().Error("Failed to roll back the default route of tunnel", "tunnel", name, "err", err)
+	}
+
 	// Stop the tunnel
-	logger.Info("Stopping tunnel '%s'", name)
-	if err := stopTunnel(tunnel); err != nil {
-		logger.Error("Failed to stop tunnel '%s': %v", name, err)
+	m.logger().Info("Stopping tunnel", "tunnel", name)
+	if err := m.backend.Stop(tunnel); err != nil {
+		m.logger().Error("Failed to stop tunnel", "tunnel", name, "err", err)
+		tunnel.setStatus(StatusError, fmt.Sprintf("stop failed: %v", err))
+		_ = m.save(tunnel)
+		m.publish(tunnel, events.TypeError)
 		return err
 	}
 
 	// Update status
-	tunnel.Status = StatusDown
-	tunnel.UpdatedAt = time.Now()
-	if err := saveTunnel(tunnel); err != nil {
-		logger.Error("Failed to update tunnel status: %v", err)
+	tunnel.setStatus(StatusDown, "")
+	if err := m.save(tunnel); err != nil {
+		m.logger().Error("Failed to update tunnel status", "tunnel", name, "err", err)
+		return err
+	}
+	m.publish(tunnel, events.TypeDown)
+
+	if err := runHook(tunnel, HookPostDown); err != nil {
+		m.logger().Error("Hook failed", "tunnel", name, "err", err)
+	}
+	m.logger().Info("Tunnel stopped successfully", "tunnel", name)
+	return nil
+}
+
+// SetStatus records a status change for a tunnel, such as a failure detected while
+// the tunnel is running, along with the reason for it
+func SetStatus(name string, status Status, reason string) error {
+	return std.SetStatus(name, status, reason)
+}
+
+// SetStatus records a status change for a tunnel along with the reason for it
+func (m *Manager) SetStatus(name string, status Status, reason string) error {
+	tunnel, err := m.load(name)
+	if err != nil {
 		return err
 	}
 
-	logger.Info("Tunnel '%s' stopped successfully", name)
+	if status == StatusError {
+		m.logger().Error("Tunnel failed", "tunnel", name, "reason", reason)
+	}
+	changed := tunnel.Status != status
+	tunnel.setStatus(status, reason)
+	if err := m.save(tunnel); err != nil {
+		return err
+	}
+	// A tunnel that dropped must not keep all traffic
+	if changed && status != StatusUp {
+		if err := m.backend.Route(tunnel, false); err != nil {
+			m.logger().Error("Failed to roll back the default route of tunnel", "tunnel", name, "err", err)
+		}
+	}
+	if typ, ok := statusEvents[status]; ok && changed {
+		m.publish(tunnel, typ)
+	}
 	return nil
 }
 
+// failureRetention is how long the times of tunnel failures are kept
+const failureRetention = 24 * time.Hour
+
+// setStatus updates the status and reason, noting the time of any transition
+// and of each failure
+func (t *Tunnel) setStatus(status Status, reason string) {
+	now := time.Now()
+	if t.Status != status {
+		t.LastTransition = now
+	}
+	if status == StatusError {
+		t.Failures = append(slices.DeleteFunc(t.Failures, func(f time.Time) bool {
+			return now.Sub(f) > failureRetention
+		}), now)
+	}
+	t.Status = status
+	t.Reason = reason
+	t.UpdatedAt = now
+}
+
+// FailuresSince returns the number of failures reported since a time
+func (t *Tunnel) FailuresSince(since time.Time) int {
+	count := 0
+	for _, f := range t.Failures {
+		if f.After(since) {
+			count++
+		}
+	}
+	return count
+}
+
+// statusEvents maps the statuses a tunnel can change to onto their events
+var statusEvents = map[Status]string{
+	StatusUp:    events.TypeUp,
+	StatusDown:  events.TypeDown,
+	StatusError: events.TypeError,
+}
+
 // Delete removes a tunnel
 func Delete(name string, force bool) error {
+	return std.Delete(name, force)
+}
+
+// tunnelStateDirs hold a file of state for each tunnel, such as its SLA
+// history, under the state directory
+var tunnelStateDirs = []string{"sla", "keepalive", "rekeys", "reauth", "sync"}
+
+// Delete removes a tunnel. With force, the configuration of a tunnel that is
+// still up or cannot be fully taken apart is removed anyway.
+func (m *Manager) Delete(name string, force bool) error {
+	return m.deleteTunnel(name, force, "deleted")
+}
+
+// deleteTunnel removes a tunnel, and for the instance of an initiator records
+// the end of its session for a reason
+func (m *Manager) deleteTunnel(name string, force bool, reason string) error {
+	if err := m.requireSelfTest(); err != nil {
+		return err
+	}
 	// Get tunnel
-	tunnel, err := Get(name)
+	tunnel, err := m.Get(name)
 	if err != nil {
 		if force {
 			// If forced, try to delete config even if tunnel doesn't exist
-			return deleteTunnelConfig(name)
+			return m.deleteConfig(name)
 		}
 		return err
 	}
+	if tunnel.Responder() {
+		return m.deleteResponder(tunnel, force)
+	}
+	// Read the traffic of a session before its interface goes
+	var s Session
+	if tunnel.Template != "" {
+		s = session(tunnel)
+	}
 
 	// Stop the tunnel if it's running
 	if tunnel.Status == StatusUp && !force {
 		return errors.New("tunnel is active, stop it first or use --force")
 	} else if tunnel.Status == StatusUp {
-		_ = stopTunnel(tunnel)
+		_ = runHook(tunnel, HookPreDown)
+		_ = m.backend.Route(tunnel, false)
+		_ = m.backend.Stop(tunnel)
+		_ = runHook(tunnel, HookPostDown)
+	}
+	if err := m.removeShortcuts(name); err != nil && !force {
+		return err
 	}
 
-	// Delete GRE tunnel interface
-	if err := deleteGRETunnelInterface(tunnel); err != nil && !force {
+	// Delete the tunnel interface and everything around it
+	if err := m.backend.Delete(tunnel, force); err != nil && !force {
 		return err
 	}
 
 	// Delete tunnel configuration
-	return deleteTunnelConfig(name)
+	if err := m.deleteConfig(name); err != nil {
+		return err
+	}
+	if dir, err := m.dir(); err == nil {
+		for _, sub := range tunnelStateDirs {
+			_ = os.Remove(filepath.Join(dir, sub, name+".json"))
+		}
+	}
+	if tunnel.Template != "" {
+		m.stopSession(s, reason)
+	}
+	m.publish(&Tunnel{Name: name}, events.TypeDeleted)
+	return nil
+}
+
+// InterfaceName returns the name of the GRE interface carrying an IPsec tunnel
+func InterfaceName(name string) string {
+	return fmt.Sprintf("gre-%s", name)
+}
+
+// createLink creates the interface carrying a tunnel in its mode
+func createLink(tunnel *Tunnel) error {
+	if tunnel.Mode == ModeWireGuard {
+		return createWireGuardInterface(tunnel)
+	}
+	return createGRETunnelInterface(tunnel)
+}
+
+// deleteLink deletes the interface carrying a tunnel in its mode
+func deleteLink(tunnel *Tunnel) error {
+	if tunnel.Mode == ModeWireGuard {
+		return deleteWireGuardInterface(tunnel)
+	}
+	return deleteGRETunnelInterface(tunnel)
 }
 
 // createGRETunnelInterface creates a GRE tunnel interface
@@ -261,7 +646,7 @@ func createGRETunnelInterface(tunnel *Tunnel) error {
 	}
 
 	attrs := netlink.NewLinkAttrs()
-	attrs.Name = fmt.Sprintf("gre-%s", tunnel.Name)
+	attrs.Name = InterfaceName(tunnel.Name)
 
 	gre := &netlink.Gretun{
 		LinkAttrs: attrs,
@@ -271,12 +656,12 @@ func createGRETunnelInterface(tunnel *Tunnel) error {
 		OKey:      0,
 	}
 
-	if err := netlink.LinkAdd(gre); err != nil {
+	if err := network.Busy(func() error { return netlink.LinkAdd(gre) }); err != nil {
 		return fmt.Errorf("failed to create GRE tunnel interface: %v", err)
 	}
 
 	// Bring the interface up
-	if err := netlink.LinkSetUp(gre); err != nil {
+	if err := network.Busy(func() error { return netlink.LinkSetUp(gre) }); err != nil {
 		return fmt.Errorf("failed to bring GRE tunnel interface up: %v", err)
 	}
 
@@ -288,11 +673,17 @@ func deleteGRETunnelInterface(tunnel *Tunnel) error {
 	if os.Geteuid() != 0 {
 		return fmt.Errorf("must run as root to delete GRE tunnel interfaces")
 	}
-	link, err := netlink.LinkByName(fmt.Sprintf("gre-%s", tunnel.Name))
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	link, err := handle.LinkByName(InterfaceName(tunnel.Name))
 	if err != nil {
 		return nil // Interface doesn't exist, nothing to delete
 	}
-	if err := netlink.LinkDel(link); err != nil {
+	if err := handle.LinkDel(link); err != nil {
 		return fmt.Errorf("failed to delete GRE tunnel interface: %v", err)
 	}
 	return nil
@@ -348,35 +739,62 @@ func validateConfig(config Config) error {
 		}
 	}
 
-	return nil
-}
+	if config.PeerSpiffeID != "" {
+		if _, err := spiffe.ParseID(config.PeerSpiffeID); err != nil {
+			return err
+		}
+	}
 
-// getConfigDir returns the configuration directory
-func getConfigDir() (string, error) {
-	// Check if config directory is set in viper
-	configDir := viper.GetString("config_dir")
-	if configDir != "" {
-		return configDir, nil
+	if config.PSKRef != "" {
+		if _, _, err := secret.Parse(config.PSKRef); err != nil {
+			return err
+		}
 	}
 
-	// Use default config directory
-	home := ""
-	// Check if running with sudo
-	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
-		u, err := user.Lookup(sudoUser)
-		if err != nil {
-			return "", err
+	if err := validateResponder(config); err != nil {
+		return err
+	}
+	if err := validateVirtualIPs(config); err != nil {
+		return err
+	}
+	if err := validateShortcuts(config); err != nil {
+		return err
+	}
+
+	switch config.Mode {
+	case "", ModeIPsec:
+		if config.WireGuardPeerKey != "" {
+			return errors.New("a WireGuard peer key needs wireguard mode")
 		}
-		home = u.HomeDir
-	} else {
-		var err error
-		home, err = os.UserHomeDir()
-		if err != nil {
-			return "", err
+	case ModeWireGuard:
+		if config.WireGuardPeerKey == "" {
+			return errors.New("wireguard mode needs the peer's WireGuard public key")
+		}
+		if _, err := ParseWireGuardKey(config.WireGuardPeerKey); err != nil {
+			return err
 		}
+		if config.Encryption != WireGuardEncryption {
+			return fmt.Errorf("wireguard mode always uses %s, not %s", WireGuardEncryption, config.Encryption)
+		}
+		if config.PostQuantum {
+			return errors.New("wireguard mode does not support post-quantum key exchange")
+		}
+		if config.ListenPort < 1 || config.ListenPort > 65535 {
+			return fmt.Errorf("invalid WireGuard port: %d", config.ListenPort)
+		}
+	default:
+		return fmt.Errorf("invalid tunnel mode: %s", config.Mode)
 	}
 
-	configDir = filepath.Join(home, ".ipsec-vpn")
+	return nil
+}
+
+// getConfigDir returns the configuration directory, creating it if needed
+func getConfigDir() (string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return "", err
+	}
 
 	// Create config directory if it doesn't exist
 	if err := os.MkdirAll(filepath.Join(configDir, "tunnels"), 0755); err != nil {
@@ -388,15 +806,14 @@ func getConfigDir() (string, error) {
 
 // saveTunnel saves the tunnel configuration to disk
 func saveTunnel(tunnel *Tunnel) error {
-	// Get config directory
-	configDir, err := getConfigDir()
-	if err != nil {
-		return err
-	}
+	return std.save(tunnel)
+}
 
-	// Create tunnels directory if it doesn't exist
-	tunnelsDir := filepath.Join(configDir, "tunnels")
-	if err := os.MkdirAll(tunnelsDir, 0755); err != nil {
+// save saves the tunnel configuration to the state directory
+func (m *Manager) save(tunnel *Tunnel) error {
+	// Get the directory of the tunnels, creating it if needed
+	tunnelsDir, err := m.tunnelsDir()
+	if err != nil {
 		return err
 	}
 
@@ -413,6 +830,109 @@ func saveTunnel(tunnel *Tunnel) error {
 	v.Set("encryption", tunnel.Encryption)
 	v.Set("post_quantum", tunnel.PostQuantum)
 	v.Set("status", string(tunnel.Status))
+	v.Set("reason", tunnel.Reason)
+	v.Set("last_transition", tunnel.LastTransition)
+	v.Set("debug", tunnel.Debug)
+	v.Set("namespace", tunnel.Namespace)
+	v.Set("kill_switch", tunnel.KillSwitch)
+	v.Set("rate_limit", tunnel.RateLimit)
+	v.Set("packet_accounting", tunnel.PacketAccounting)
+	v.Set("peer_pin", tunnel.PeerPin)
+	v.Set("pin_tofu", tunnel.PinTOFU)
+	v.Set("pinned_at", tunnel.PinnedAt)
+	v.Set("peer_spiffe_id", tunnel.PeerSpiffeID)
+	v.Set("mode", tunnel.Mode)
+	v.Set("wireguard_peer_key", tunnel.WireGuardPeerKey)
+	v.Set("listen_port", tunnel.ListenPort)
+	v.Set("psk_ref", tunnel.PSKRef)
+	v.Set("peer_group", tunnel.PeerGroup)
+	v.Set("peer_id", tunnel.PeerID)
+	v.Set("peer_ca", tunnel.PeerCA)
+	v.Set("template", tunnel.Template)
+	v.Set("peer_identity", tunnel.PeerIdentity)
+	v.Set("virtual_ip_pool", tunnel.VirtualIPPool)
+	v.Set("virtual_ips", formatVirtualIPs(tunnel.VirtualIPs))
+	v.Set("virtual_ip", tunnel.VirtualIP)
+	v.Set("shortcuts", tunnel.Shortcuts)
+	v.Set("via", tunnel.Via)
+	v.Set("uplink", tunnel.Uplink)
+	v.Set("default_route", tunnel.DefaultRoute)
+	v.Set("dns", tunnel.DNS)
+	if tunnel.Keepalive > 0 {
+		v.Set("keepalive", tunnel.Keepalive.String())
+	}
+	if l := tunnel.SALifetime; l != nil {
+		v.Set("sa_soft_time", l.SoftTime.String())
+		v.Set("sa_hard_time", l.HardTime.String())
+		v.Set("sa_soft_bytes", l.SoftBytes)
+		v.Set("sa_hard_bytes", l.HardBytes)
+		v.Set("sa_soft_packets", l.SoftPackets)
+		v.Set("sa_hard_packets", l.HardPackets)
+	}
+	if r := tunnel.Reauth; r != nil {
+		v.Set("reauth_interval", r.Interval.String())
+		v.Set("reauth_grace", r.Grace.String())
+	}
+	policy := make([]string, len(tunnel.Policy))
+	for i, rule := range tunnel.Policy {
+		policy[i] = rule.String()
+	}
+	v.Set("policy", policy)
+	appRoutes := make([]string, len(tunnel.AppRoutes))
+	for i, r := range tunnel.AppRoutes {
+		appRoutes[i] = r.String()
+	}
+	v.Set("app_routes", appRoutes)
+	multicastRoutes := make([]string, len(tunnel.MulticastRoutes))
+	for i, r := range tunnel.MulticastRoutes {
+		multicastRoutes[i] = r.String()
+	}
+	v.Set("multicast_routes", multicastRoutes)
+	// Viper would fold the case of label keys and split them at dots
+	labels := make([]string, 0, len(tunnel.Labels))
+	for _, key := range slices.Sorted(maps.Keys(tunnel.Labels)) {
+		labels = append(labels, key+"="+tunnel.Labels[key])
+	}
+	v.Set("labels", labels)
+	failures := make([]string, len(tunnel.Failures))
+	for i, f := range tunnel.Failures {
+		failures[i] = f.Format(time.RFC3339Nano)
+	}
+	v.Set("failures", failures)
+	if tunnel.SLA != nil {
+		v.Set("sla_type", tunnel.SLA.Type)
+		v.Set("sla_target", tunnel.SLA.Target)
+		v.Set("sla_interval", tunnel.SLA.Interval.String())
+		v.Set("sla_count", tunnel.SLA.Count)
+		v.Set("sla_max_latency", tunnel.SLA.MaxLatency.String())
+		v.Set("sla_max_jitter", tunnel.SLA.MaxJitter.String())
+		v.Set("sla_max_loss", tunnel.SLA.MaxLoss)
+	}
+	if tunnel.Hooks != nil {
+		v.Set("hook_pre_up", tunnel.Hooks.PreUp)
+		v.Set("hook_post_up", tunnel.Hooks.PostUp)
+		v.Set("hook_pre_down", tunnel.Hooks.PreDown)
+		v.Set("hook_post_down", tunnel.Hooks.PostDown)
+	}
+	if tunnel.Tuning != nil {
+		v.Set("tune_mtu", tunnel.Tuning.MTU)
+		v.Set("tune_underlay_mtu", tunnel.Tuning.UnderlayMTU)
+		v.Set("tune_offloads", formatOffloads(tunnel.Tuning.Offloads))
+		v.Set("tune_underlay_offloads", formatOffloads(tunnel.Tuning.UnderlayOffloads))
+	}
+	if tunnel.Inspection != nil {
+		v.Set("inspect_type", tunnel.Inspection.Type)
+		v.Set("inspect_interface", tunnel.Inspection.Interface)
+		v.Set("inspect_gateway", tunnel.Inspection.Gateway)
+		v.Set("inspect_queue", tunnel.Inspection.Queue)
+		v.Set("inspect_bypass", tunnel.Inspection.Bypass)
+	}
+	if tunnel.Peer != nil {
+		v.Set("peer_software", tunnel.Peer.Software)
+		v.Set("peer_vendor_ids", tunnel.Peer.VendorIDs)
+		v.Set("peer_features", tunnel.Peer.Features)
+		v.Set("peer_post_quantum", tunnel.Peer.PostQuantum)
+	}
 	v.Set("created_at", tunnel.CreatedAt)
 	v.Set("updated_at", tunnel.UpdatedAt)
 
@@ -423,16 +943,20 @@ func saveTunnel(tunnel *Tunnel) error {
 
 // loadTunnel loads a tunnel configuration from disk
 func loadTunnel(name string) (*Tunnel, error) {
-	// Get config directory
-	configDir, err := getConfigDir()
+	return std.load(name)
+}
+
+// load loads a tunnel configuration from the state directory
+func (m *Manager) load(name string) (*Tunnel, error) {
+	tunnelsDir, err := m.tunnelsDir()
 	if err != nil {
 		return nil, err
 	}
 
 	// Check if tunnel config exists
-	configFile := filepath.Join(configDir, "tunnels", name+".json")
+	configFile := filepath.Join(tunnelsDir, name+".json")
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
-		return nil, fmt.Errorf("tunnel '%s' not found", name)
+		return nil, fmt.Errorf("tunnel '%s' %w", name, ErrNotFound)
 	}
 
 	// Create a new viper instance for this tunnel
@@ -447,6 +971,7 @@ func loadTunnel(name string) (*Tunnel, error) {
 
 	// Create tunnel object
 	tunnel := &Tunnel{
+		settings:     m.settings,
 		Name:         v.GetString("name"),
 		LocalIP:      v.GetString("local_ip"),
 		RemoteIP:     v.GetString("remote_ip"),
@@ -455,6 +980,126 @@ func loadTunnel(name string) (*Tunnel, error) {
 		Encryption:   v.GetString("encryption"),
 		PostQuantum:  v.GetBool("post_quantum"),
 		Status:       Status(v.GetString("status")),
+		Reason:       v.GetString("reason"),
+		Debug:        v.GetBool("debug"),
+		Namespace:    v.GetString("namespace"),
+		KillSwitch:   v.GetBool("kill_switch"),
+		RateLimit:    v.GetUint64("rate_limit"),
+		PacketAccounting: v.GetBool("packet_accounting"),
+		PeerPin:      v.GetString("peer_pin"),
+		PinTOFU:      v.GetBool("pin_tofu"),
+		PinnedAt:     v.GetTime("pinned_at"),
+		PeerSpiffeID: v.GetString("peer_spiffe_id"),
+		Mode:         cmp.Or(v.GetString("mode"), ModeIPsec),
+		WireGuardPeerKey: v.GetString("wireguard_peer_key"),
+		ListenPort:   v.GetInt("listen_port"),
+		PSKRef:       v.GetString("psk_ref"),
+		PeerGroup:    v.GetString("peer_group"),
+		PeerID:       v.GetString("peer_id"),
+		PeerCA:       v.GetString("peer_ca"),
+		Template:     v.GetString("template"),
+		PeerIdentity: v.GetString("peer_identity"),
+		VirtualIPPool: v.GetString("virtual_ip_pool"),
+		VirtualIP:    v.GetString("virtual_ip"),
+		Shortcuts:    v.GetBool("shortcuts"),
+		Via:          v.GetString("via"),
+		Uplink:       v.GetString("uplink"),
+		DefaultRoute: v.GetBool("default_route"),
+		DNS:          v.GetStringSlice("dns"),
+		Keepalive:    v.GetDuration("keepalive"),
+	}
+
+	// Rules were validated when they were added
+	for _, s := range v.GetStringSlice("policy") {
+		if rule, err := ParseTrafficRule(s); err == nil {
+			tunnel.Policy = append(tunnel.Policy, rule)
+		}
+	}
+	for _, s := range v.GetStringSlice("app_routes") {
+		if r, err := ParseAppRoute(s); err == nil {
+			tunnel.AppRoutes = append(tunnel.AppRoutes, r)
+		}
+	}
+	for _, s := range v.GetStringSlice("multicast_routes") {
+		if r, err := ParseMulticastRoute(s); err == nil {
+			tunnel.MulticastRoutes = append(tunnel.MulticastRoutes, r)
+		}
+	}
+
+	for _, s := range v.GetStringSlice("labels") {
+		if key, value, ok := strings.Cut(s, "="); ok {
+			if tunnel.Labels == nil {
+				tunnel.Labels = make(map[string]string)
+			}
+			tunnel.Labels[key] = value
+		}
+	}
+
+	// Mappings were validated when they were added
+	tunnel.VirtualIPs, _ = ParseVirtualIPs(v.GetStringSlice("virtual_ips"))
+
+	for _, s := range v.GetStringSlice("failures") {
+		if f, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			tunnel.Failures = append(tunnel.Failures, f)
+		}
+	}
+
+	if v.IsSet("sla_target") {
+		tunnel.SLA = &SLA{
+			Type:       v.GetString("sla_type"),
+			Target:     v.GetString("sla_target"),
+			Interval:   v.GetDuration("sla_interval"),
+			Count:      v.GetInt("sla_count"),
+			MaxLatency: v.GetDuration("sla_max_latency"),
+			MaxJitter:  v.GetDuration("sla_max_jitter"),
+			MaxLoss:    v.GetFloat64("sla_max_loss"),
+		}
+	}
+
+	hooks := Hooks{
+		PreUp:    v.GetString("hook_pre_up"),
+		PostUp:   v.GetString("hook_post_up"),
+		PreDown:  v.GetString("hook_pre_down"),
+		PostDown: v.GetString("hook_post_down"),
+	}
+	if hooks != (Hooks{}) {
+		tunnel.Hooks = &hooks
+	}
+
+	if v.IsSet("sa_hard_time") {
+		tunnel.SALifetime = &SALifetime{
+			SoftTime:    v.GetDuration("sa_soft_time"),
+			HardTime:    v.GetDuration("sa_hard_time"),
+			SoftBytes:   v.GetUint64("sa_soft_bytes"),
+			HardBytes:   v.GetUint64("sa_hard_bytes"),
+			SoftPackets: v.GetUint64("sa_soft_packets"),
+			HardPackets: v.GetUint64("sa_hard_packets"),
+		}
+	}
+	if v.IsSet("reauth_interval") {
+		tunnel.Reauth = &ReauthPolicy{
+			Interval: v.GetDuration("reauth_interval"),
+			Grace:    v.GetDuration("reauth_grace"),
+		}
+	}
+
+	if v.IsSet("inspect_type") {
+		tunnel.Inspection = &Inspection{
+			Type:      v.GetString("inspect_type"),
+			Interface: v.GetString("inspect_interface"),
+			Gateway:   v.GetString("inspect_gateway"),
+			Queue:     v.GetUint16("inspect_queue"),
+			Bypass:    v.GetBool("inspect_bypass"),
+		}
+	}
+
+	if v.IsSet("tune_mtu") {
+		tunnel.Tuning = &Tuning{
+			MTU:              v.GetInt("tune_mtu"),
+			UnderlayMTU:      v.GetInt("tune_underlay_mtu"),
+			Offloads:         parseOffloads(v.GetStringSlice("tune_offloads")),
+			UnderlayOffloads: parseOffloads(v.GetStringSlice("tune_underlay_offloads")),
+		}
 	}
 
 	// Parse timestamps
@@ -470,19 +1115,40 @@ func loadTunnel(name string) (*Tunnel, error) {
 		tunnel.UpdatedAt = time.Now()
 	}
 
+	// The peer is only known once IKE has run
+	if v.IsSet("peer_post_quantum") {
+		tunnel.Peer = &Peer{
+			Software:    v.GetString("peer_software"),
+			VendorIDs:   v.GetStringSlice("peer_vendor_ids"),
+			Features:    v.GetStringSlice("peer_features"),
+			PostQuantum: v.GetBool("peer_post_quantum"),
+		}
+	}
+
+	// Tunnels saved before transitions were recorded last changed when they were updated
+	if v.IsSet("last_transition") {
+		tunnel.LastTransition = v.GetTime("last_transition")
+	} else {
+		tunnel.LastTransition = tunnel.UpdatedAt
+	}
+
 	return tunnel, nil
 }
 
 // deleteTunnelConfig deletes the tunnel configuration from disk
 func deleteTunnelConfig(name string) error {
-	// Get config directory
-	configDir, err := getConfigDir()
+	return std.deleteConfig(name)
+}
+
+// deleteConfig deletes the tunnel configuration from the state directory
+func (m *Manager) deleteConfig(name string) error {
+	tunnelsDir, err := m.tunnelsDir()
 	if err != nil {
 		return err
 	}
 
 	// Delete tunnel config file
-	configFile := filepath.Join(configDir, "tunnels", name+".json")
+	configFile := filepath.Join(tunnelsDir, name+".json")
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
 		return nil // File doesn't exist, nothing to delete
 	}
@@ -504,24 +1170,51 @@ func deleteTunnelInterface(tunnel *Tunnel) error {
 
 // startTunnel starts the tunnel
 func startTunnel(tunnel *Tunnel) error {
+	if tunnel.Mode == ModeWireGuard {
+		// Reapply the configuration in case the peer's key or address changed
+		err := inNamespace(tunnel, func() error { return configureWireGuard(tunnel) })
+		if err != nil {
+			return err
+		}
+		tunnelLog.Info("Configured WireGuard peer for tunnel", "tunnel", tunnel.Name)
+		return setWireGuardLink(tunnel, true)
+	}
+
+	psk, err := resolvePSK(tunnel)
+	if err != nil {
+		return err
+	}
+	defer crypto.Zeroize(psk)
+
 	// Here you should configure XFRM policies and states for IPsec
 	// Example: use netlink.XfrmPolicyAdd and netlink.XfrmStateAdd
 	// For now, just simulate success
-	logger.Info("Configured XFRM policies and states for tunnel '%s'", tunnel.Name)
+	xfrmLog.Info("Configured XFRM policies and states for tunnel", "tunnel", tunnel.Name)
 	return nil
 }
 
 // stopTunnel stops the tunnel
 func stopTunnel(tunnel *Tunnel) error {
+	if tunnel.Mode == ModeWireGuard {
+		tunnelLog.Info("Taking down WireGuard interface of tunnel", "tunnel", tunnel.Name)
+		return setWireGuardLink(tunnel, false)
+	}
+
 	// Here you should remove XFRM policies and states for IPsec
 	// Example: use netlink.XfrmPolicyDel and netlink.XfrmStateDel
 	// For now, just simulate success
-	logger.Info("Removed XFRM policies and states for tunnel '%s'", tunnel.Name)
+	xfrmLog.Info("Removed XFRM policies and states for tunnel", "tunnel", tunnel.Name)
 	return nil
 }
 
 // getTunnelStatus returns the current status of the tunnel
 func getTunnelStatus(tunnel *Tunnel) (Status, error) {
-	// For standard IPsec/XFRM, status is based on config only
+	// For standard IPsec/XFRM, status is based on config only, except that
+	// while WatchLinks runs a tunnel whose interface has gone or is down is down
+	if tunnel.Status == StatusUp && tunnel.Namespace == "" {
+		if _, up, ok := links.lookup(tunnel.Interface()); ok && !up {
+			return StatusDown, nil
+		}
+	}
 	return tunnel.Status, nil
 }
\ No newline at end of file
@@ -0,0 +1,2567 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/ca"
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/geoip"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/dzakwan/ipsec-vpn/pkg/retry"
+	"github.com/spf13/viper"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetStatus(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	created := time.Now().Add(-time.Hour)
+	tun := &Tunnel{
+		Name:           "office",
+		LocalIP:        "192.0.2.1",
+		RemoteIP:       "198.51.100.1",
+		Status:         StatusUp,
+		LastTransition: created,
+		CreatedAt:      created,
+		UpdatedAt:      created,
+	}
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+
+	reason := "peer authentication failed: no matching PSK"
+	if err := SetStatus("office", StatusError, reason); err != nil {
+		t.Fatalf("SetStatus failed: %v", err)
+	}
+	got, err := Get("office")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if got.Status != StatusError || got.Reason != reason {
+		t.Errorf("Expected ERROR with reason %q, got %s with %q", reason, got.Status, got.Reason)
+	}
+	if !got.LastTransition.After(created) {
+		t.Errorf("Expected the transition time to be updated, got %v", got.LastTransition)
+	}
+
+	// Staying in the same state keeps the transition time
+	transition := got.LastTransition
+	if err := SetStatus("office", StatusError, "retrying"); err != nil {
+		t.Fatalf("SetStatus failed: %v", err)
+	}
+	got, _ = Get("office")
+	if !got.LastTransition.Equal(transition) || got.Reason != "retrying" {
+		t.Errorf("Expected transition %v and updated reason, got %v and %q", transition, got.LastTransition, got.Reason)
+	}
+	if n := got.FailuresSince(created); n != 2 {
+		t.Errorf("Expected both failures to be recorded, got %d", n)
+	}
+
+	if err := SetStatus("missing", StatusError, reason); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing tunnel, got %v", err)
+	}
+}
+
+func TestRecordPeer(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	tun := &Tunnel{Name: "office", Encryption: "chacha20poly1305", PostQuantum: true, Status: StatusUp}
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+
+	strongSwan, _ := hex.DecodeString("882fe56d6fd20dbc2251613b2ebe5beb")
+	dpd, _ := hex.DecodeString("afcad71368a1f1c96b8696fc77570100")
+	if _, err := RecordPeer("office", [][]byte{strongSwan, dpd, []byte("private")}, true); err != nil {
+		t.Fatalf("RecordPeer failed: %v", err)
+	}
+
+	got, err := Get("office")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if got.Peer == nil || got.Peer.Name() != "strongSwan" {
+		t.Fatalf("Expected a strongSwan peer, got %+v", got.Peer)
+	}
+	if len(got.Peer.VendorIDs) != 3 || len(got.Peer.Features) != 1 || got.Peer.Features[0] != "DPD" {
+		t.Errorf("Expected 3 vendor IDs and the DPD feature, got %+v", got.Peer)
+	}
+	if warnings := got.InteropWarnings(); len(warnings) != 0 {
+		t.Errorf("Expected no interop warnings, got %v", warnings)
+	}
+
+	windows, _ := hex.DecodeString("1e2b516905991c7d7c96fcbfb587e46100000009")
+	peer, err := RecordPeer("office", [][]byte{windows}, false)
+	if err != nil {
+		t.Fatalf("RecordPeer failed: %v", err)
+	}
+	if peer.Name() != "Microsoft Windows" {
+		t.Errorf("Expected a Windows peer, got %s", peer.Name())
+	}
+	got, _ = Get("office")
+	if warnings := got.InteropWarnings(); len(warnings) != 2 {
+		t.Errorf("Expected post-quantum and cipher warnings, got %v", warnings)
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	if err := saveTunnel(&Tunnel{Name: "office", Status: StatusUp}); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+
+	// Nothing is recorded until debugging is enabled
+	transcript, err := OpenTranscript("office")
+	if err != nil || transcript != nil {
+		t.Fatalf("Expected no transcript while disabled, got %v, %v", transcript, err)
+	}
+	if err := transcript.Record(TranscriptEvent{Exchange: "IKE_SA_INIT"}); err != nil {
+		t.Errorf("Expected recording to a nil transcript to do nothing, got %v", err)
+	}
+
+	if err := SetDebug("office", true); err != nil {
+		t.Fatalf("SetDebug failed: %v", err)
+	}
+	transcript, err = OpenTranscript("office")
+	if err != nil || transcript == nil {
+		t.Fatalf("OpenTranscript failed: %v", err)
+	}
+	transcript.Record(TranscriptEvent{
+		Direction: "out",
+		Exchange:  "IKE_SA_INIT",
+		Payloads:  []Payload{{Type: "SA", Length: 48}, {Type: "KE", Length: 1192}},
+		Notify:    []string{"NAT_DETECTION_SOURCE_IP"},
+	})
+	transcript.Record(TranscriptEvent{Direction: "in", Exchange: "IKE_SA_INIT", Proposal: "AES_GCM_16_256/MLKEM768"})
+	transcript.Close()
+
+	events, err := ReadTranscript("office")
+	if err != nil {
+		t.Fatalf("ReadTranscript failed: %v", err)
+	}
+	if len(events) != 2 || events[0].Payloads[1].Length != 1192 || events[1].Proposal != "AES_GCM_16_256/MLKEM768" {
+		t.Errorf("Unexpected transcript: %+v", events)
+	}
+	if events[1].Elapsed < events[0].Elapsed {
+		t.Errorf("Expected elapsed time to increase, got %v then %v", events[0].Elapsed, events[1].Elapsed)
+	}
+}
+
+func TestKillSwitchGlobal(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	viper.Set("security.kill_switch", true)
+	defer viper.Set("config_dir", "")
+	defer viper.Set("security.kill_switch", false)
+
+	tun := &Tunnel{Name: "office", RemoteSubnet: "10.0.0.0/24", Status: StatusDown}
+	if !tun.KillSwitchEnabled() {
+		t.Error("Expected security.kill_switch to turn on the kill-switch of every tunnel")
+	}
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+	if err := SetKillSwitch("office", false); err == nil {
+		t.Error("Expected turning off a tunnel's kill-switch to fail while it is on for all tunnels")
+	}
+}
+
+func TestParseTrafficRule(t *testing.T) {
+	for _, s := range []string{"tcp/443", "udp/53", "tcp/8000-8010", "icmp"} {
+		rule, err := ParseTrafficRule(s)
+		if err != nil {
+			t.Errorf("ParseTrafficRule(%q) failed: %v", s, err)
+			continue
+		}
+		if rule.String() != s {
+			t.Errorf("Expected %q to format back to itself, got %q", s, rule.String())
+		}
+	}
+
+	for _, s := range []string{"gre", "tcp/0", "udp/70000", "tcp/443-80", "icmp/8", "tcp/1-1000", "tcp/https"} {
+		if _, err := ParseTrafficRule(s); err == nil {
+			t.Errorf("Expected ParseTrafficRule(%q) to fail", s)
+		}
+	}
+}
+
+func TestParseAppRoute(t *testing.T) {
+	for _, s := range []string{"uid:1001", "uid:0", "cgroup:system.slice/restic.service"} {
+		route, err := ParseAppRoute(s)
+		if err != nil {
+			t.Errorf("ParseAppRoute(%q) failed: %v", s, err)
+			continue
+		}
+		if route.String() != s {
+			t.Errorf("Expected %q to format back to itself, got %q", s, route.String())
+		}
+	}
+	if route, err := ParseAppRoute("uid:root"); err != nil || route != (AppRoute{UID: 0}) {
+		t.Errorf("Expected uid:root to be looked up as uid:0, got %v: %v", route, err)
+	}
+	if route, _ := ParseAppRoute("cgroup:/sys/fs/cgroup/system.slice/restic.service/"); route.Cgroup != "system.slice/restic.service" {
+		t.Errorf("Expected the cgroup mount to be trimmed, got %q", route.Cgroup)
+	}
+
+	for _, s := range []string{"gid:100", "uid:-1", "uid:no-such-user", "cgroup:", "cgroup:../user.slice", "cgroup:a//b", "cgroup:a\"b"} {
+		if _, err := ParseAppRoute(s); err == nil {
+			t.Errorf("Expected ParseAppRoute(%q) to fail", s)
+		}
+	}
+}
+
+func TestParseMulticastRoute(t *testing.T) {
+	for _, s := range []string{"out:eth1:239.1.1.1", "in:eth1:10.1.0.5,239.1.1.1", "in:br0:ff15::1"} {
+		route, err := ParseMulticastRoute(s)
+		if err != nil {
+			t.Errorf("ParseMulticastRoute(%q) failed: %v", s, err)
+			continue
+		}
+		if route.String() != s {
+			t.Errorf("Expected %q to format back to itself, got %q", s, route.String())
+		}
+	}
+	want := MulticastRoute{Inbound: true, Interface: "eth1", Source: "10.1.0.5", Group: "239.1.1.1"}
+	if route, _ := ParseMulticastRoute("in:eth1:10.1.0.5,239.1.1.1"); route != want {
+		t.Errorf("Expected %+v, got %+v", want, route)
+	}
+
+	for _, s := range []string{"both:eth1:239.1.1.1", "out::239.1.1.1", "out:eth1", "out:eth1:10.1.0.5", "out:eth1:239.1.1.1,239.1.1.2", "out:eth1:10.1.0.5,ff15::1", "out:a/b:239.1.1.1"} {
+		if _, err := ParseMulticastRoute(s); err == nil {
+			t.Errorf("Expected ParseMulticastRoute(%q) to fail", s)
+		}
+	}
+}
+
+func TestTuning(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	for _, tuning := range []Tuning{
+		{MTU: 100},
+		{MTU: 9300},
+		{UnderlayMTU: -1},
+		{Offloads: map[string]bool{"sg": true}},
+		{UnderlayOffloads: map[string]bool{"gro ": true}},
+	} {
+		if err := tuning.Validate(); err == nil {
+			t.Errorf("Expected %+v to be refused", tuning)
+		}
+	}
+	for _, s := range []string{"gro", "gro=yes", "sg=on", "=on"} {
+		if _, _, err := ParseOffload(s); err == nil {
+			t.Errorf("Expected ParseOffload(%q) to fail", s)
+		}
+	}
+
+	// A 9000 byte underlay carries 8911 byte IPv4 tunnel packets, a 1500 byte one 1411
+	tun := &Tunnel{Name: "dc2", LocalIP: "192.0.2.10", RemoteIP: "198.51.100.1", RemoteSubnet: "10.2.0.0/24", Mode: ModeIPsec,
+		Tuning: &Tuning{MTU: AutoMTU, UnderlayMTU: 9000, Offloads: map[string]bool{"gso": true, "gro": true}, UnderlayOffloads: map[string]bool{"lro": false}}}
+	if overhead := Overhead(tun); overhead != 89 {
+		t.Errorf("Expected 89 bytes of overhead over IPv4, got %d", overhead)
+	}
+	if overhead := Overhead(&Tunnel{RemoteIP: "2001:db8::1", Mode: ModeWireGuard}); overhead != 80 {
+		t.Errorf("Expected 80 bytes of WireGuard overhead over IPv6, got %d", overhead)
+	}
+	if want := "mtu auto, gro=on, gso=on, underlay mtu 9000, underlay lro=off"; tun.Tuning.String() != want {
+		t.Errorf("Expected %q, got %q", want, tun.Tuning.String())
+	}
+
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+	loaded, err := loadTunnel("dc2")
+	if err != nil || loaded.Tuning == nil {
+		t.Fatalf("Expected the tuning to be stored, got %v", err)
+	}
+	if loaded.Tuning.String() != tun.Tuning.String() {
+		t.Errorf("Expected the tuning %s to be loaded, got %s", tun.Tuning, loaded.Tuning)
+	}
+}
+
+func TestTrafficSelectors(t *testing.T) {
+	tun := &Tunnel{Name: "office", LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24"}
+	if policies, _ := trafficSelectors(tun); len(policies) != 0 {
+		t.Fatalf("Expected no XFRM policies without rules, got %d", len(policies))
+	}
+
+	for _, s := range []string{"tcp/443", "udp/53-54", "icmp"} {
+		rule, _ := ParseTrafficRule(s)
+		tun.Policy = append(tun.Policy, rule)
+	}
+	policies, err := trafficSelectors(tun)
+	if err != nil {
+		t.Fatalf("trafficSelectors failed: %v", err)
+	}
+
+	// Per direction: 2 for tcp/443, 4 for udp/53-54, 1 for icmp and the block
+	if len(policies) != 3*8 {
+		t.Fatalf("Expected 24 XFRM policies, got %d", len(policies))
+	}
+	out := policies[:8]
+	if out[0].Src.String() != "10.1.0.0/24" || out[0].Dst.String() != "10.2.0.0/24" || out[0].DstPort != 443 || out[1].SrcPort != 443 {
+		t.Errorf("Unexpected selector for tcp/443: %+v", out[0])
+	}
+	if block := out[7]; block.Action != netlink.XFRM_POLICY_BLOCK || block.Proto != 0 || block.Priority <= out[0].Priority {
+		t.Errorf("Expected a lower-priority block on all other traffic, got %+v", block)
+	}
+	if in := policies[8]; in.Dir != netlink.XFRM_DIR_IN || in.Src.String() != "10.2.0.0/24" {
+		t.Errorf("Expected inbound selectors from the remote subnet, got %+v", in)
+	}
+}
+
+func TestVerifyPeerKey(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	if err := saveTunnel(&Tunnel{Name: "office", Status: StatusUp, PinTOFU: true}); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+
+	first := KeyFingerprint([]byte("first key"))
+	if err := VerifyPeerKey("office", first); err != nil {
+		t.Fatalf("Expected the first key to be trusted, got %v", err)
+	}
+	got, _ := Get("office")
+	if got.PeerPin != first || got.PinnedAt.IsZero() {
+		t.Fatalf("Expected %s to be pinned, got %q at %v", first, got.PeerPin, got.PinnedAt)
+	}
+	if err := VerifyPeerKey("office", first); err != nil {
+		t.Errorf("Expected the pinned key to be accepted, got %v", err)
+	}
+
+	if err := VerifyPeerKey("office", KeyFingerprint([]byte("other key"))); !errors.Is(err, ErrPinMismatch) {
+		t.Fatalf("Expected ErrPinMismatch, got %v", err)
+	}
+	got, _ = Get("office")
+	if got.Status != StatusError || got.PeerPin != first {
+		t.Errorf("Expected ERROR with the pin kept, got %s with pin %q", got.Status, got.PeerPin)
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	want := KeyFingerprint([]byte("key"))
+	digest := want[len("SHA256:"):]
+	colons := ""
+	for i := 0; i < len(digest); i += 2 {
+		if i > 0 {
+			colons += ":"
+		}
+		colons += digest[i : i+2]
+	}
+
+	for _, s := range []string{want, digest, "sha256:" + colons} {
+		if got, err := ParseFingerprint(s); err != nil || got != want {
+			t.Errorf("ParseFingerprint(%q) = %q, %v, expected %s", s, got, err, want)
+		}
+	}
+	if _, err := ParseFingerprint("SHA256:abcd"); err == nil {
+		t.Error("Expected a short fingerprint to be rejected")
+	}
+}
+
+func TestWireGuardDeviceAttrs(t *testing.T) {
+	tun := &Tunnel{
+		Name:         "branch",
+		RemoteIP:     "198.51.100.1",
+		RemoteSubnet: "10.1.0.0/16",
+		Mode:         ModeWireGuard,
+		ListenPort:   51821,
+	}
+	private := bytes.Repeat([]byte{1}, 32)
+	peer := bytes.Repeat([]byte{2}, 32)
+	psk := bytes.Repeat([]byte{3}, 32)
+	attrs, err := wireGuardDeviceAttrs(tun, private, peer, psk)
+	if err != nil {
+		t.Fatalf("wireGuardDeviceAttrs failed: %v", err)
+	}
+
+	var data []byte
+	for _, attr := range attrs {
+		data = append(data, attr.Serialize()...)
+	}
+	found := map[uint16][]byte{}
+	for attr := range nl.ParseAttributes(data) {
+		found[attr.Type&nl.NLA_TYPE_MASK] = attr.Value
+	}
+	if string(found[wgDeviceIfname]) != "wg-branch\x00" {
+		t.Errorf("Expected interface wg-branch, got %q", found[wgDeviceIfname])
+	}
+	if !bytes.Equal(found[wgDevicePrivateKey], private) {
+		t.Error("Private key not set")
+	}
+
+	peerAttrs := map[uint16][]byte{}
+	for p := range nl.ParseAttributes(found[wgDevicePeers]) {
+		for a := range nl.ParseAttributes(p.Value) {
+			peerAttrs[a.Type&nl.NLA_TYPE_MASK] = a.Value
+		}
+	}
+	if !bytes.Equal(peerAttrs[wgPeerPublicKey], peer) {
+		t.Error("Peer public key not set")
+	}
+	if !bytes.Equal(peerAttrs[wgPeerPresharedKey], psk) {
+		t.Error("Pre-shared key not set")
+	}
+	endpoint := peerAttrs[wgPeerEndpoint]
+	if len(endpoint) != 16 || endpoint[2] != 0xca || endpoint[3] != 0x6d || !net.IP(endpoint[4:8]).Equal(net.ParseIP("198.51.100.1")) {
+		t.Errorf("Unexpected endpoint %v", endpoint)
+	}
+
+	var mask uint8
+	for ip := range nl.ParseAttributes(peerAttrs[wgPeerAllowedIPs]) {
+		for a := range nl.ParseAttributes(ip.Value) {
+			if a.Type&nl.NLA_TYPE_MASK == wgAllowedIPMask {
+				mask = a.Value[0]
+			}
+		}
+	}
+	if mask != 16 {
+		t.Errorf("Expected the remote subnet /16 as allowed IPs, got /%d", mask)
+	}
+}
+
+func TestParseWireGuardDevice(t *testing.T) {
+	handshake := time.Unix(1700000000, 0)
+	ts := make([]byte, 16)
+	nl.NativeEndian().PutUint64(ts, uint64(handshake.Unix()))
+
+	peers := nl.NewRtAttr(wgDevicePeers|int(nl.NLA_F_NESTED), nil)
+	p := peers.AddRtAttr(0|int(nl.NLA_F_NESTED), nil)
+	p.AddRtAttr(wgPeerRxBytes, nl.Uint64Attr(1500))
+	p.AddRtAttr(wgPeerTxBytes, nl.Uint64Attr(3000))
+	p.AddRtAttr(wgPeerLastHandshake, ts)
+
+	stats := &Stats{}
+	parseWireGuardDevice(peers.Serialize(), stats)
+	if stats.RxBytes != 1500 || stats.TxBytes != 3000 || !stats.LastHandshake.Equal(handshake) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestValidateWireGuardConfig(t *testing.T) {
+	config := Config{
+		Name:             "branch",
+		LocalIP:          "192.0.2.1",
+		RemoteIP:         "198.51.100.1",
+		LocalSubnet:      "10.0.0.0/16",
+		RemoteSubnet:     "10.1.0.0/16",
+		Encryption:       WireGuardEncryption,
+		Mode:             ModeWireGuard,
+		WireGuardPeerKey: base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		ListenPort:       DefaultWireGuardPort,
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected a valid WireGuard tunnel, got %v", err)
+	}
+
+	bad := config
+	bad.WireGuardPeerKey = "not-a-key"
+	if err := validateConfig(bad); err == nil {
+		t.Error("Expected an invalid peer key to be rejected")
+	}
+	bad = config
+	bad.Encryption = "aes256gcm"
+	if err := validateConfig(bad); err == nil {
+		t.Error("Expected another cipher to be rejected in wireguard mode")
+	}
+	bad = config
+	bad.Mode = "openvpn"
+	if err := validateConfig(bad); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+}
+
+func TestExportPeer(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+	viper.Set("advanced.ike_proposals", []string{"aes256gcm-sha384-ecp384", "chacha20poly1305-sha256-x25519"})
+	defer viper.Set("advanced.ike_proposals", nil)
+
+	tun := &Tunnel{
+		Name:         "branch",
+		LocalIP:      "192.0.2.1",
+		RemoteIP:     "198.51.100.1",
+		LocalSubnet:  "10.0.0.0/16",
+		RemoteSubnet: "10.1.2.0/24",
+		Encryption:   "chacha20poly1305",
+		Mode:         ModeIPsec,
+	}
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+
+	for _, format := range []string{FormatOPNsense, FormatPfSense} {
+		data, err := ExportPeer("branch", format, 7)
+		if err != nil {
+			t.Fatalf("ExportPeer(%s) failed: %v", format, err)
+		}
+		var got struct {
+			Phase1 phase1
+			Phase2 phase2
+		}
+		if err := xml.Unmarshal(data, &got); err != nil {
+			t.Fatalf("Export for %s is not valid XML: %v", format, err)
+		}
+		if got.Phase1.RemoteGateway != "192.0.2.1" || got.Phase1.IKEID != 7 || got.Phase2.IKEID != 7 {
+			t.Errorf("%s: expected phase 1 7 towards 192.0.2.1, got %+v", format, got.Phase1)
+		}
+		if got.Phase2.LocalID.Address != "10.1.2.0" || got.Phase2.LocalID.Netbits != 24 || got.Phase2.RemoteID.Address != "10.0.0.0" {
+			t.Errorf("%s: expected the subnets swapped, got %+v and %+v", format, got.Phase2.LocalID, got.Phase2.RemoteID)
+		}
+		if len(got.Phase2.Algorithms) != 1 || got.Phase2.Algorithms[0].Name != "chacha20poly1305" {
+			t.Errorf("%s: expected chacha20poly1305 for phase 2, got %+v", format, got.Phase2.Algorithms)
+		}
+		if !bytes.Contains(data, []byte("<dhgroup>31</dhgroup>")) {
+			t.Errorf("%s: expected the x25519 group of the matching IKE proposal:\n%s", format, data)
+		}
+	}
+
+	data, err := ExportPeer("branch", FormatRouterOS, 1)
+	if err != nil {
+		t.Fatalf("ExportPeer(routeros) failed: %v", err)
+	}
+	for _, want := range []string{
+		"add name=ipsec-vpn-branch address=192.0.2.1/32 exchange-mode=ike2",
+		"enc-algorithms=chacha20poly1305",
+		"src-address=10.1.2.0/24 dst-address=10.0.0.0/16",
+		"RouterOS does not support DH group 31",
+	} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("Expected %q in the RouterOS export:\n%s", want, data)
+		}
+	}
+	if d := routerOSDuration(5400); d != "1h30m" {
+		t.Errorf("Expected 1h30m, got %s", d)
+	}
+
+	data, err = ExportPeer("branch", FormatCiscoIOS, 20)
+	if err != nil {
+		t.Fatalf("ExportPeer(cisco-ios) failed: %v", err)
+	}
+	for _, want := range []string{
+		"permit ip 10.1.2.0 0.0.0.255 10.0.0.0 0.0.255.255",
+		"crypto map IPSEC-VPN 20 ipsec-isakmp\n set peer 192.0.2.1",
+		"Cisco IOS has no ChaCha20-Poly1305",
+		"Cisco IOS does not support DH group 31, group 20 is used instead",
+	} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("Expected %q in the Cisco IOS export:\n%s", want, data)
+		}
+	}
+	data, err = ExportPeer("branch", FormatCiscoASA, 20)
+	if err != nil {
+		t.Fatalf("ExportPeer(cisco-asa) failed: %v", err)
+	}
+	for _, want := range []string{
+		"network-object 10.1.2.0 255.255.255.0",
+		"crypto map outside_map 20 set peer 192.0.2.1",
+		"tunnel-group 192.0.2.1 type ipsec-l2l",
+	} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("Expected %q in the Cisco ASA export:\n%s", want, data)
+		}
+	}
+
+	if _, err := ExportPeer("branch", "juniper", 1); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+}
+
+func TestSLAEvaluate(t *testing.T) {
+	sla := &SLA{MaxLatency: 50 * time.Millisecond, MaxJitter: 10 * time.Millisecond, MaxLoss: 10}
+
+	result := sla.evaluate([]time.Duration{20 * time.Millisecond, 30 * time.Millisecond, -1, 40 * time.Millisecond})
+	if result.Sent != 4 || result.Received != 3 || result.Loss != 25 {
+		t.Errorf("Expected 3 of 4 received and 25%% loss, got %+v", result)
+	}
+	if result.Latency != 30 || result.Jitter != 10 {
+		t.Errorf("Expected 30ms latency and 10ms jitter, got %.1fms and %.1fms", result.Latency, result.Jitter)
+	}
+	if result.Met || len(result.Violations) != 1 || result.Violations[0] != "loss 25% over 10%" {
+		t.Errorf("Expected only the loss to violate the SLA, got %v", result.Violations)
+	}
+
+	result = sla.evaluate([]time.Duration{10 * time.Millisecond, 10 * time.Millisecond})
+	if !result.Met || result.Jitter != 0 {
+		t.Errorf("Expected the SLA to be met, got %+v", result)
+	}
+
+	// Without replies the SLA is violated even without thresholds
+	result = (&SLA{}).evaluate([]time.Duration{-1, -1})
+	if result.Met || result.Loss != 100 {
+		t.Errorf("Expected a violation without replies, got %+v", result)
+	}
+}
+
+func TestProbeSLA(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go ServeSLAResponder(conn)
+
+	tun := &Tunnel{Name: "office", LocalIP: "192.0.2.1", RemoteIP: "198.51.100.1", RemoteSubnet: "127.0.0.0/8"}
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+
+	if err := SetSLA("office", &SLA{Type: ProbeUDP, Target: "10.1.0.1"}); err == nil {
+		t.Error("Expected a target outside the remote subnet to be rejected")
+	}
+	if err := SetSLA("office", &SLA{Type: "tcp", Target: "127.0.0.1"}); err == nil {
+		t.Error("Expected an unknown probe type to be rejected")
+	}
+	sla := &SLA{Type: ProbeUDP, Target: conn.LocalAddr().String(), Count: 5, MaxLoss: 10}
+	if err := SetSLA("office", sla); err != nil {
+		t.Fatalf("SetSLA failed: %v", err)
+	}
+	got, err := Get("office")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if got.SLA == nil || *got.SLA != *sla || got.SLA.Interval != DefaultSLAInterval {
+		t.Fatalf("Expected SLA %+v with the default interval to be stored, got %+v", sla, got.SLA)
+	}
+
+	result, err := ProbeSLA("office")
+	if err != nil {
+		t.Fatalf("ProbeSLA failed: %v", err)
+	}
+	if result.Received != 5 || !result.Met {
+		t.Errorf("Expected all probes to be echoed, got %+v", result)
+	}
+	history, err := SLAHistory("office")
+	if err != nil || len(history) != 1 {
+		t.Fatalf("Expected 1 result in the history, got %d: %v", len(history), err)
+	}
+
+	if err := SetSLA("office", nil); err != nil {
+		t.Fatalf("SetSLA(nil) failed: %v", err)
+	}
+	got, _ = Get("office")
+	history, _ = SLAHistory("office")
+	if got.SLA != nil || len(history) != 0 {
+		t.Errorf("Expected the SLA and its history to be removed, got %+v and %d results", got.SLA, len(history))
+	}
+}
+
+func TestProbeICMP(t *testing.T) {
+	rtts, err := probeICMP(net.ParseIP("127.0.0.1"), 3)
+	if err != nil {
+		t.Skipf("Raw sockets are not available: %v", err)
+	}
+	for i, rtt := range rtts {
+		if rtt < 0 {
+			t.Errorf("Expected echo %d to be answered", i)
+		}
+	}
+}
+
+func TestSelfTestFailClosed(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	viper.Set("self_test.enabled", true)
+	viper.Set("self_test.fail_closed", true)
+	selfTestOnce = sync.Once{}
+	defer func() {
+		viper.Set("config_dir", "")
+		viper.Set("self_test.enabled", false)
+		viper.Set("self_test.fail_closed", false)
+		selfTestOnce, selfTestErr = sync.Once{}, nil
+	}()
+
+	if err := saveTunnel(&Tunnel{Name: "office", Status: StatusDown}); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+	// A tunnel file copied by hand under another name
+	data, _ := os.ReadFile(filepath.Join(dir, "tunnels", "office.json"))
+	os.WriteFile(filepath.Join(dir, "tunnels", "branch.json"), data, 0600)
+
+	for _, r := range SelfTest() {
+		if r.Check == CheckStore && (r.Err == nil || !strings.Contains(r.Err.Error(), "holds tunnel 'office'")) {
+			t.Errorf("Expected the store check to fail, got %v", r.Err)
+		}
+	}
+	if err := Start("office"); !errors.Is(err, ErrSelfTestFailed) {
+		t.Errorf("Expected Start to be refused, got %v", err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	defer viper.Set("config_dir", "")
+
+	for _, name := range []string{"office", "branch"} {
+		tun := &Tunnel{Name: name, LocalIP: "192.0.2.1", RemoteIP: "198.51.100.1", LocalSubnet: "10.0.0.0/24",
+			RemoteSubnet: "10.1.0.0/24", Encryption: "aes256gcm", Mode: ModeIPsec, Status: StatusDown}
+		if err := saveTunnel(tun); err != nil {
+			t.Fatalf("saveTunnel failed: %v", err)
+		}
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "tunnels", "office.json"))
+	os.WriteFile(filepath.Join(dir, "tunnels", "lab.json"), data, 0600)
+	os.WriteFile(filepath.Join(dir, "tunnels", "broken.json"), []byte(`{"name": "bro`), 0600)
+	os.MkdirAll(filepath.Join(dir, "sla"), 0755)
+	os.WriteFile(filepath.Join(dir, "sla", "gone.json"), []byte("[]"), 0600)
+
+	problems, err := Fsck()
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	found := make(map[string]*FsckProblem)
+	for _, p := range problems {
+		if p.Kind != FsckOrphan || strings.HasPrefix(p.Subject, dir) {
+			found[p.Kind+" "+filepath.Base(p.Subject)] = p
+		}
+	}
+	for _, want := range []string{"invalid lab", "invalid broken.json", "orphan gone.json", "duplicate branch, lab, office"} {
+		if found[want] == nil {
+			t.Errorf("Expected a %s problem, got %v", want, found)
+		}
+	}
+	if len(found) != 4 {
+		t.Errorf("Expected 4 problems, got %v", found)
+	}
+	if err := found["duplicate branch, lab, office"].Fix(); err == nil {
+		t.Error("Expected duplicate selectors to need fixing by hand")
+	}
+
+	for _, key := range []string{"invalid lab", "invalid broken.json", "orphan gone.json"} {
+		if err := found[key].Fix(); err != nil {
+			t.Errorf("Fixing %s failed: %v", key, err)
+		}
+	}
+	if lab, err := loadTunnel("lab"); err != nil || lab.Name != "lab" {
+		t.Errorf("Expected lab to be renamed, got %v: %v", lab, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tunnels", "broken.json.corrupt")); err != nil {
+		t.Errorf("Expected the damaged file to be moved aside: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sla", "gone.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected the orphaned SLA history to be deleted: %v", err)
+	}
+}
+
+func TestLeftovers(t *testing.T) {
+	rule, _ := ParseTrafficRule("tcp/443")
+	office := &Tunnel{Name: "office", LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24", Policy: []TrafficRule{rule}}
+	gone := &Tunnel{Name: "gone", LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.3.0.0/24", Policy: []TrafficRule{rule}}
+	kept, _ := trafficSelectors(office)
+	stale, _ := trafficSelectors(gone)
+	foreign := netlink.XfrmPolicy{Src: stale[0].Src, Dst: stale[0].Dst, Dir: netlink.XFRM_DIR_OUT, Priority: 50}
+
+	leftovers := leftoverPolicies([]*Tunnel{office}, append(append(kept, stale...), foreign))
+	if len(leftovers) != len(stale) {
+		t.Fatalf("Expected the %d policies of the deleted tunnel, got %d", len(stale), len(leftovers))
+	}
+	for _, l := range leftovers {
+		if l.Kind != LeftoverPolicy || !strings.Contains(l.Name, "10.3.0.0/24") {
+			t.Errorf("Unexpected leftover %+v", l)
+		}
+	}
+
+	_, remote, _ := net.ParseCIDR("10.2.0.0/24")
+	_, other, _ := net.ParseCIDR("10.3.0.0/24")
+	routes := []netlink.Route{
+		{Dst: remote, Type: unix.RTN_BLACKHOLE, Priority: network.BlockMetric},
+		{Dst: other, Type: unix.RTN_BLACKHOLE, Priority: network.BlockMetric},
+		{Dst: other, Type: unix.RTN_BLACKHOLE, Priority: 100},
+	}
+	leftovers = leftoverRoutes([]*Tunnel{office}, routes)
+	if len(leftovers) != 1 || leftovers[0].Name != "blackhole 10.3.0.0/24" {
+		t.Errorf("Expected only the block route to 10.3.0.0/24, got %+v", leftovers)
+	}
+}
+
+func TestWaitQuiet(t *testing.T) {
+	counters := []uint64{100, 200, 300, 300}
+	calls := 0
+	sample := func() (*Stats, error) {
+		stats := &Stats{RxBytes: counters[min(calls, len(counters)-1)]}
+		calls++
+		return stats, nil
+	}
+	if !waitQuiet(sample, time.Millisecond, time.Second) || calls != 4 {
+		t.Errorf("Expected the counters to settle after 4 samples, got %d", calls)
+	}
+
+	calls = 0
+	busy := func() (*Stats, error) {
+		calls++
+		return &Stats{TxBytes: uint64(calls)}, nil
+	}
+	if waitQuiet(busy, time.Millisecond, 20*time.Millisecond) {
+		t.Error("Expected moving counters to time out")
+	}
+
+	failing := func() (*Stats, error) { return nil, errors.New("interface gone") }
+	if !waitQuiet(failing, time.Millisecond, time.Second) {
+		t.Error("Expected unreadable counters to count as quiet")
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hook.out")
+	tun := &Tunnel{Name: "office", Mode: ModeIPsec, RemoteSubnet: "10.2.0.0/24", Hooks: &Hooks{
+		PreUp:   `echo "$IPSEC_VPN_VERB $IPSEC_VPN_TUNNEL $IPSEC_VPN_INTERFACE $IPSEC_VPN_REMOTE_SUBNET" > ` + out,
+		PreDown: "echo refusing; exit 3",
+	}}
+
+	if err := runHook(tun, HookPreUp); err != nil {
+		t.Fatalf("runHook failed: %v", err)
+	}
+	if data, _ := os.ReadFile(out); string(data) != "pre-up office gre-office 10.2.0.0/24\n" {
+		t.Errorf("Unexpected hook environment %q", data)
+	}
+	if err := runHook(tun, HookPreDown); err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Errorf("Expected the failing hook's output in the error, got %v", err)
+	}
+	if err := runHook(tun, HookPostUp); err != nil {
+		t.Errorf("Expected no error without a hook, got %v", err)
+	}
+	if err := runHook(&Tunnel{Name: "bare"}, HookPreUp); err != nil {
+		t.Errorf("Expected no error without hooks, got %v", err)
+	}
+}
+
+func TestInspection(t *testing.T) {
+	for _, tc := range []struct {
+		inspection Inspection
+		valid      bool
+	}{
+		{Inspection{Type: InspectInterface, Interface: "eth2"}, true},
+		{Inspection{Type: InspectInterface, Interface: "eth2", Gateway: "10.9.0.1"}, true},
+		{Inspection{Type: InspectInterface}, false},
+		{Inspection{Type: InspectInterface, Interface: "eth2", Gateway: "ids"}, false},
+		{Inspection{Type: InspectInterface, Interface: "eth2", Bypass: true}, false},
+		{Inspection{Type: InspectQueue, Queue: 3, Bypass: true}, true},
+		{Inspection{Type: InspectQueue, Interface: "eth2"}, false},
+		{Inspection{Type: "mirror"}, false},
+	} {
+		if err := tc.inspection.validate(); (err == nil) != tc.valid {
+			t.Errorf("validate(%+v) = %v, expected valid %v", tc.inspection, err, tc.valid)
+		}
+	}
+
+	dir := t.TempDir()
+	viper.Set("config_dir", dir)
+	defer viper.Set("config_dir", "")
+	tun := &Tunnel{Name: "office", LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24", Status: StatusDown,
+		Inspection: &Inspection{Type: InspectQueue, Queue: 3, Bypass: true}}
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+	loaded, err := loadTunnel("office")
+	if err != nil {
+		t.Fatalf("loadTunnel failed: %v", err)
+	}
+	if loaded.Inspection == nil || *loaded.Inspection != *tun.Inspection {
+		t.Errorf("Expected inspection %+v, got %+v", tun.Inspection, loaded.Inspection)
+	}
+	if s := loaded.Inspection.String(); s != "NFQUEUE 3 (bypassed while nothing listens)" {
+		t.Errorf("Unexpected description %q", s)
+	}
+}
+
+func TestTunnelFlows(t *testing.T) {
+	tun := &Tunnel{Name: "office", LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24"}
+	flow := func(proto uint8, src, dst string, sport, dport uint16, sent, recv uint64) *netlink.ConntrackFlow {
+		return &netlink.ConntrackFlow{
+			Forward: netlink.IPTuple{Protocol: proto, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst), SrcPort: sport, DstPort: dport, Bytes: sent},
+			Reverse: netlink.IPTuple{Protocol: proto, SrcIP: net.ParseIP(dst), DstIP: net.ParseIP(src), SrcPort: dport, DstPort: sport, Bytes: recv},
+		}
+	}
+	flows := tunnelFlows(tun, []*netlink.ConntrackFlow{
+		flow(unix.IPPROTO_TCP, "10.1.0.5", "10.2.0.9", 40000, 443, 100, 5000),
+		flow(unix.IPPROTO_ICMP, "10.2.0.9", "10.1.0.5", 0, 0, 84, 84),
+		flow(unix.IPPROTO_UDP, "10.1.0.5", "192.0.2.1", 5353, 53, 60, 120),
+	})
+
+	if len(flows) != 2 {
+		t.Fatalf("Expected the 2 flows between the subnets, got %+v", flows)
+	}
+	if f := flows[0]; f.Protocol() != "tcp" || f.Source() != "10.1.0.5:40000" || f.Destination() != "10.2.0.9:443" || !f.Outbound || f.Bytes() != 5100 {
+		t.Errorf("Unexpected busiest flow %+v", f)
+	}
+	if f := flows[1]; f.Protocol() != "icmp" || f.Source() != "10.2.0.9" || f.Outbound {
+		t.Errorf("Expected an inbound icmp flow, got %+v", f)
+	}
+}
+
+func TestPlanUplinks(t *testing.T) {
+	fiber := &Uplink{Name: "fiber", Capacity: 100_000_000, Up: true, Addresses: []net.IP{net.ParseIP("203.0.113.10")}}
+	cable := &Uplink{Name: "cable", Capacity: 50_000_000, Up: true, Addresses: []net.IP{net.ParseIP("198.51.100.10")}}
+	lte := &Uplink{Name: "lte", Capacity: 20_000_000, Up: true, Addresses: []net.IP{net.ParseIP("192.0.2.10")}}
+	uplinks := []*Uplink{fiber, cable, lte}
+
+	office := &Tunnel{Name: "office", LocalIP: "203.0.113.10", RemoteIP: "10.0.0.1", Uplink: "fiber", RateLimit: 40_000_000}
+	branch := &Tunnel{Name: "branch", LocalIP: "203.0.113.10", RemoteIP: "10.0.0.2", Uplink: UplinkAuto, RateLimit: 30_000_000}
+	lab := &Tunnel{Name: "lab", LocalIP: "198.51.100.10", RemoteIP: "10.0.0.3", Uplink: UplinkAuto}
+	manual := &Tunnel{Name: "manual", LocalIP: "203.0.113.10", RemoteIP: "10.0.0.4"}
+	tunnels := []*Tunnel{office, branch, lab, manual}
+
+	if moves := planUplinks(tunnels, uplinks); len(moves) != 0 {
+		t.Errorf("Expected no moves while every uplink is up, got %v", moves)
+	}
+
+	// The fiber goes down: the cable has 50mbit spare after lab, the LTE 20mbit
+	fiber.Up = false
+	moves := planUplinks(tunnels, uplinks)
+	if len(moves) != 2 || moves[branch] != cable || moves[office] == nil {
+		t.Fatalf("Expected branch and office to leave the fiber, got %v", moves)
+	}
+	if moves[office] != lte {
+		t.Errorf("Expected office to take the LTE once branch booked the cable, got %s", moves[office].Name)
+	}
+
+	// Once the fiber is back, only the tunnel bound to it returns
+	fiber.Up = true
+	office.LocalIP, branch.LocalIP = "192.0.2.10", "198.51.100.10"
+	moves = planUplinks(tunnels, uplinks)
+	if len(moves) != 1 || moves[office] != fiber {
+		t.Errorf("Expected office to return to the fiber, got %v", moves)
+	}
+
+	// With no uplink up, tunnels stay where they are
+	lte.Up, fiber.Up, cable.Up = false, false, false
+	if moves := planUplinks(tunnels, uplinks); len(moves) != 0 {
+		t.Errorf("Expected tunnels to stay put with no uplink up, got %v", moves)
+	}
+}
+
+func TestGuardDefaultRoute(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	tun := &Tunnel{Name: "office", RemoteIP: "192.0.2.1", LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24",
+		Status: StatusUp, DefaultRoute: true, DNS: []string{"10.2.0.53"}}
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+	loaded, err := loadTunnel("office")
+	if err != nil {
+		t.Fatalf("loadTunnel failed: %v", err)
+	}
+	if !loaded.DefaultRoute || len(loaded.DNS) != 1 || loaded.DNS[0] != "10.2.0.53" {
+		t.Errorf("Expected the default route with DNS to be stored, got %v %v", loaded.DefaultRoute, loaded.DNS)
+	}
+
+	// The tunnel has no interface, so there is nothing to install and the guard
+	// only has to roll back on the way out
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- GuardDefaultRoute("office", 10*time.Millisecond, stop) }()
+	time.Sleep(30 * time.Millisecond)
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the guard to roll back cleanly, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Guard did not stop")
+	}
+
+	tun.DefaultRoute = false
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+	if err := GuardDefaultRoute("office", time.Second, nil); err == nil {
+		t.Error("Expected the guard to refuse a tunnel without the default route")
+	}
+}
+
+func TestPeerCheck(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		check    PeerCheck
+		err      string
+		warnings []string
+	}{
+		{"no route", PeerCheck{Peer: "203.0.113.9", RouteErr: errors.New("no route to peer 203.0.113.9")}, "no route", nil},
+		{"port closed", PeerCheck{Peer: "203.0.113.9", Sent: 3, Received: 3, Port: 500, PortState: PortClosed}, "refused UDP port 500", nil},
+		{"no answer", PeerCheck{Peer: "203.0.113.9", Interface: "eth0", Sent: 3, Port: 500, PortState: PortSilent}, "answered neither", nil},
+		{"ike answered", PeerCheck{Peer: "203.0.113.9", Sent: 3, Port: 500, PortState: PortAnswered}, "", []string{"3 of 3 ICMP echoes to 203.0.113.9 lost"}},
+		{"ike filtered", PeerCheck{Peer: "203.0.113.9", Sent: 3, Received: 3, Latency: 450, Port: 500, PortState: PortSilent}, "",
+			[]string{"round-trip time to 203.0.113.9 is 450ms", "no answer from UDP port 500, a firewall may drop IKE"}},
+		{"wireguard", PeerCheck{Peer: "203.0.113.9", Sent: 3, Received: 3, Latency: 12, Port: 51820, PortState: PortSilent, wireGuard: true}, "", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.check.Err()
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("Expected error %q, got %v", tt.err, err)
+			}
+			if warnings := tt.check.Warnings(); !slices.Equal(warnings, tt.warnings) {
+				t.Errorf("Expected warnings %q, got %q", tt.warnings, warnings)
+			}
+		})
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	for subnet, want := range map[string]string{
+		"10.2.0.0/24":   "10.2.0.1:9",
+		"10.2.0.7/32":   "10.2.0.7:9",
+		"2001:db8::/64": "[2001:db8::1]:9",
+	} {
+		if target, err := keepaliveTarget(&Tunnel{RemoteSubnet: subnet}); err != nil || target != want {
+			t.Errorf("Expected keepalives for %s to go to %s, got %s, %v", subnet, want, target, err)
+		}
+	}
+
+	tun := &Tunnel{Name: "office", RemoteIP: "192.0.2.1", LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24", Status: StatusUp}
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+	if err := SetKeepalive("office", 100*time.Millisecond); err == nil {
+		t.Error("Expected an interval under a second to be refused")
+	}
+	if err := SetKeepalive("office", 20*time.Second); err != nil {
+		t.Fatalf("SetKeepalive failed: %v", err)
+	}
+	if loaded, err := loadTunnel("office"); err != nil || loaded.Keepalive != 20*time.Second {
+		t.Fatalf("Expected the keepalive interval to be stored, got %v", err)
+	}
+
+	// The tunnel has no interface to send through, so the keepalive fails and is counted
+	stats, err := SendKeepalive("office")
+	if err == nil || stats == nil || stats.Failed != 1 || stats.Sent != 0 || stats.LastError == "" {
+		t.Errorf("Expected a failed keepalive to be counted, got %+v, %v", stats, err)
+	}
+	if err := SetKeepalive("office", 0); err != nil {
+		t.Fatalf("SetKeepalive failed: %v", err)
+	}
+	if stats, err := KeepaliveCounters("office"); err != nil || stats.Failed != 0 {
+		t.Errorf("Expected the counters to be dropped with the keepalive, got %+v, %v", stats, err)
+	}
+}
+
+func TestSALifetime(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	viper.Set("tunnel_defaults.key_rotation_interval", 3600)
+	defer viper.Set("config_dir", "")
+	defer viper.Set("tunnel_defaults.key_rotation_interval", nil)
+
+	if l := DefaultSALifetime(); l.HardTime != time.Hour || l.SoftTime != 54*time.Minute {
+		t.Errorf("Expected the default lifetime to rekey at 90%% of the key rotation interval, got %+v", l)
+	}
+	for _, l := range []SALifetime{
+		{SoftTime: time.Hour, HardTime: time.Hour},
+		{SoftTime: time.Minute, HardTime: time.Hour, HardBytes: 1 << 30},
+		{SoftTime: time.Minute, HardTime: time.Hour, SoftPackets: 1000},
+		{SoftTime: time.Second, HardTime: 10 * time.Second},
+	} {
+		if err := l.Validate(); err == nil {
+			t.Errorf("Expected %+v to be refused", l)
+		}
+	}
+
+	// A byte limit that was reached is the cause, otherwise time is
+	state := &netlink.XfrmState{
+		Src: net.ParseIP("192.0.2.10"), Dst: net.ParseIP("198.51.100.1"), Spi: 0x1234,
+		Limits:     netlink.XfrmStateLimits{ByteSoft: 1000, ByteHard: 2000, PacketSoft: nl.XFRM_INF, PacketHard: nl.XFRM_INF},
+		Statistics: netlink.XfrmStateStats{Bytes: 1500, Packets: 10},
+	}
+	if cause := expiryCause(state, false); cause != ExpiryBytes {
+		t.Errorf("Expected the soft expiry to be caused by bytes, got %s", cause)
+	}
+	if cause := expiryCause(state, true); cause != ExpiryTime {
+		t.Errorf("Expected the hard expiry to be caused by time, got %s", cause)
+	}
+
+	tun := &Tunnel{Name: "office", LocalIP: "192.0.2.10", RemoteIP: "198.51.100.1", RemoteSubnet: "10.2.0.0/24", Status: StatusUp,
+		SALifetime: &SALifetime{SoftTime: 50 * time.Minute, HardTime: time.Hour, SoftBytes: 1000, HardBytes: 2000}}
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+	if loaded, err := loadTunnel("office"); err != nil || loaded.SALifetime == nil || *loaded.SALifetime != *tun.SALifetime {
+		t.Fatalf("Expected the SA lifetime to be stored, got %v", err)
+	}
+
+	// The inbound SA of the tunnel is matched too
+	state.Src, state.Dst = state.Dst, state.Src
+	if e, ok := recordExpiry(state, false); !ok || e.Tunnel != "office" || e.Cause != ExpiryBytes {
+		t.Errorf("Expected a rekey of tunnel 'office' by bytes, got %+v", e)
+	}
+	if _, ok := recordExpiry(state, true); !ok {
+		t.Error("Expected the hard expiry to be recorded")
+	}
+	state.Src = net.ParseIP("203.0.113.7")
+	if _, ok := recordExpiry(state, false); ok {
+		t.Error("Expected the SA of another peer to be ignored")
+	}
+	if counts, err := Rekeys("office"); err != nil || counts.Bytes != 1 || counts.Time != 0 || counts.HardExpiries != 1 {
+		t.Errorf("Expected one rekey by bytes and one hard expiry, got %+v, %v", counts, err)
+	}
+}
+
+// fakeKernel is the kernel as seen by the reconciler in tests
+type fakeKernel struct {
+	exists, up bool
+	blocked    bool
+	policies   int // Number of policies installed, in order
+}
+
+func (k *fakeKernel) link(*Tunnel) (bool, bool, error) { return k.exists, k.up, nil }
+func (k *fakeKernel) blockRoute(string) (bool, error)  { return k.blocked, nil }
+func (k *fakeKernel) policy(*netlink.XfrmPolicy) (bool, error) {
+	k.policies--
+	return k.policies >= 0, nil
+}
+
+func TestReconcile(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+	defer func(saved kernelReader) { kernelState = saved }(kernelState)
+
+	rule, _ := ParseTrafficRule("tcp/443")
+	tun := &Tunnel{Name: "office", LocalIP: "192.0.2.1", RemoteIP: "198.51.100.1", LocalSubnet: "10.1.0.0/24",
+		RemoteSubnet: "10.2.0.0/24", Status: StatusUp, KillSwitch: true, Policy: []TrafficRule{rule}}
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+	if state, err := Sync("office"); err != nil || state != nil {
+		t.Fatalf("Expected no sync state before reconciling, got %+v: %v", state, err)
+	}
+
+	kernelState = &fakeKernel{exists: true, blocked: true, policies: 1}
+	drift, err := Reconcile(true, false)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	var problems []string
+	for _, d := range drift {
+		if d.Repaired || d.Err != nil {
+			t.Errorf("Expected nothing to be repaired in a dry run, got %+v", d)
+		}
+		problems = append(problems, d.Problem)
+	}
+	want := []string{"interface gre-office is down", "8 of 9 traffic policy XFRM policies are missing"}
+	if !slices.Equal(problems, want) {
+		t.Fatalf("Expected drift %q, got %q", want, problems)
+	}
+	state, err := Sync("office")
+	if err != nil || state == nil || state.InSync || !slices.Equal(state.Drift, want) {
+		t.Fatalf("Expected the tunnel to be recorded as drifted, got %+v: %v", state, err)
+	}
+
+	// A tunnel that is down may have its interface down, but not its block route missing
+	tun.Status = StatusDown
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+	kernelState = &fakeKernel{exists: true, policies: 9}
+	drift, _ = Reconcile(true, false)
+	if len(drift) != 1 || !strings.Contains(drift[0].Problem, "block route") {
+		t.Errorf("Expected only the block route to be missing, got %+v", drift)
+	}
+
+	kernelState = &fakeKernel{exists: true, blocked: true, policies: 9}
+	if drift, _ = Reconcile(true, false); len(drift) != 0 {
+		t.Errorf("Expected no drift, got %+v", drift)
+	}
+	if state, _ = Sync("office"); state == nil || !state.InSync || len(state.Drift) != 0 {
+		t.Errorf("Expected the tunnel to be recorded as in sync, got %+v", state)
+	}
+}
+
+func TestRepairBackoff(t *testing.T) {
+	backoff := retry.Policy{Initial: 30 * time.Second, Max: 2 * time.Minute}
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	state := &SyncState{}
+
+	// The first repair is not held back, the next ones are for longer each time
+	state.recordRepair(now, backoff)
+	if state.BackingOff(now) {
+		t.Errorf("Expected no backoff after one repair, got next retry %v", state.NextRetry)
+	}
+	for _, want := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 2 * time.Minute} {
+		state.recordRepair(now, backoff)
+		if got := state.NextRetry.Sub(now); got != want {
+			t.Errorf("Expected a delay of %v after %d repairs, got %v", want, state.Repairs, got)
+		}
+		if !state.BackingOff(now) || state.BackingOff(state.NextRetry) {
+			t.Errorf("Expected to back off until %v", state.NextRetry)
+		}
+	}
+
+	// A tunnel in sync for less than the longest delay may still flap
+	state.settle(now.Add(time.Minute), backoff)
+	if state.Repairs != 5 {
+		t.Errorf("Expected the repairs to be kept, got %d", state.Repairs)
+	}
+	state.settle(now.Add(2*time.Minute), backoff)
+	if state.Repairs != 0 || !state.NextRetry.IsZero() {
+		t.Errorf("Expected the repairs to be forgotten, got %+v", state)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+
+	// A month past retention is removed when the journal starts a new one
+	old := events.New(events.TypeUp, "office")
+	old.Time = time.Now().AddDate(-2, 0, 0)
+	if err := std.record(old); err != nil {
+		t.Fatalf("record failed: %v", err)
+	}
+
+	tun := &Tunnel{Name: "office", LocalIP: "192.0.2.1", RemoteIP: "198.51.100.1", Status: StatusUp}
+	if err := saveTunnel(tun); err != nil {
+		t.Fatalf("saveTunnel failed: %v", err)
+	}
+	if err := SetStatus("office", StatusError, "peer unreachable"); err != nil {
+		t.Fatalf("SetStatus failed: %v", err)
+	}
+	if err := SetStatus("office", StatusUp, ""); err != nil {
+		t.Fatalf("SetStatus failed: %v", err)
+	}
+
+	journal, err := Journal(time.Now())
+	if err != nil {
+		t.Fatalf("Journal failed: %v", err)
+	}
+	var types []string
+	for _, e := range journal {
+		types = append(types, e.Type)
+	}
+	if want := []string{events.TypeError, events.TypeUp}; !slices.Equal(types, want) {
+		t.Fatalf("Expected events %q, got %q", want, types)
+	}
+	if journal[0].Reason != "peer unreachable" || journal[0].Status != string(StatusError) {
+		t.Errorf("Expected the status and reason to be recorded, got %+v", journal[0])
+	}
+
+	// Events after the end of a report are left out
+	if journal, _ = Journal(journal[0].Time.Add(-time.Second)); len(journal) != 0 {
+		t.Errorf("Expected no events before the first, got %+v", journal)
+	}
+}
+
+func TestRenderSpecs(t *testing.T) {
+	viper.Set("tunnel_defaults.encryption", "aes256gcm")
+	defer viper.Set("tunnel_defaults.encryption", nil)
+
+	text := []byte(`tunnels:
+{{- range .Sites }}
+  - name: branch-{{ .ID }}
+    local_ip: {{ $.HubIP }}
+    remote_ip: {{ .IP }}
+    local_subnet: 10.0.0.0/16
+    remote_subnet: 10.{{ .ID }}.0.0/24
+    rate_limit: 10mbit
+    labels:
+      region: {{ $.Region | lower }}
+{{- end }}
+`)
+	values := Values{"HubIP": "192.0.2.1", "Region": "EU"}.Merge(Values{"Sites": []any{
+		map[string]any{"ID": 11, "IP": "198.51.100.11"},
+		map[string]any{"ID": 12, "IP": "198.51.100.12"},
+	}})
+	data, err := Render("sites.yaml", text, values)
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	specs, err := ParseSpecs(data)
+	if err != nil {
+		t.Fatalf("ParseSpecs failed: %v\n%s", err, data)
+	}
+	if len(specs) != 2 || specs[1].Name != "branch-12" || specs[1].RemoteSubnet != "10.12.0.0/24" || specs[1].Labels["region"] != "eu" {
+		t.Fatalf("Expected two branch tunnels, got %+v", specs)
+	}
+
+	config, err := specs[0].Config()
+	if err != nil {
+		t.Fatalf("Config failed: %v", err)
+	}
+	if config.Encryption != "aes256gcm" || config.Mode != ModeIPsec || config.RateLimit != 10_000_000 {
+		t.Errorf("Expected the defaults and the rate to be filled in, got %+v", config)
+	}
+	existing := &Tunnel{Name: "branch-11", Mode: ModeIPsec, LocalIP: "192.0.2.1", RemoteIP: "198.51.100.11",
+		LocalSubnet: "10.0.0.0/16", RemoteSubnet: "10.11.0.0/24", Encryption: "aes256gcm", RateLimit: 10_000_000}
+	if diffs, _ := specs[0].Differences(existing); len(diffs) != 0 {
+		t.Errorf("Expected no differences, got %q", diffs)
+	}
+	existing.RemoteIP = "198.51.100.99"
+	if diffs, _ := specs[0].Differences(existing); !slices.Equal(diffs, []string{"remote_ip: 198.51.100.99 -> 198.51.100.11"}) {
+		t.Errorf("Expected the remote IP to differ, got %q", diffs)
+	}
+
+	// A placeholder without a value is an error rather than an empty string
+	if _, err := Render("sites.yaml", text, Values{"Sites": []any{map[string]any{"ID": 1}}}); err == nil {
+		t.Error("Expected a missing value to be an error")
+	}
+	if _, err := ParseSpecs([]byte("tunnels:\n  - name: a\n    remote_ipp: 198.51.100.1\n")); err == nil {
+		t.Error("Expected an unknown option to be an error")
+	}
+	if _, err := ParseSpecs([]byte("tunnels:\n  - name: a\n  - name: a\n")); err == nil {
+		t.Error("Expected a tunnel declared twice to be an error")
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	labels := map[string]string{"site": "fra", "env": "prod", "app.example.com/tier": "edge"}
+	for s, want := range map[string]bool{
+		"":                               true,
+		"site=fra":                       true,
+		"site==fra, env":                 true,
+		"site!=ams,app.example.com/tier": true,
+		"site=ams":                       false,
+		"!env":                           false,
+		"!owner,site":                    true,
+		"owner":                          false,
+		"env!=prod":                      false,
+	} {
+		selector, err := ParseSelector(s)
+		if err != nil {
+			t.Errorf("ParseSelector(%q) failed: %v", s, err)
+			continue
+		}
+		if got := selector.Matches(labels); got != want {
+			t.Errorf("Expected %q to match %v, got %v", s, want, got)
+		}
+	}
+	for _, s := range []string{"=fra", "site=a b", "-site", "site=fra,env=x=y"} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+	if err := ValidateLabels(map[string]string{"site": strings.Repeat("x", 64)}); err == nil {
+		t.Error("Expected a value over 63 characters to be rejected")
+	}
+}
+
+// fakeBackend records the changes a Manager asks for instead of making them
+type fakeBackend struct {
+	calls []string
+}
+
+func (b *fakeBackend) record(call string, t *Tunnel) error {
+	b.calls = append(b.calls, call+" "+t.Name)
+	return nil
+}
+
+func (b *fakeBackend) Create(t *Tunnel) error { return b.record("create", t) }
+func (b *fakeBackend) Guard(t *Tunnel) error  { return b.record("guard", t) }
+func (b *fakeBackend) Start(t *Tunnel) error  { return b.record("start", t) }
+func (b *fakeBackend) Stop(t *Tunnel) error   { return b.record("stop", t) }
+func (b *fakeBackend) Route(t *Tunnel, up bool) error {
+	if up {
+		return b.record("route", t)
+	}
+	return b.record("unroute", t)
+}
+func (b *fakeBackend) Status(t *Tunnel) (Status, error)   { return t.Status, nil }
+func (b *fakeBackend) Delete(t *Tunnel, force bool) error { return b.record("delete", t) }
+
+func TestManager(t *testing.T) {
+	// The configuration directory of ipsec-vpn is not used
+	configDir := t.TempDir()
+	viper.Set("config_dir", configDir)
+	defer viper.Set("config_dir", "")
+
+	dir := t.TempDir()
+	backend := &fakeBackend{}
+	var log bytes.Buffer
+	m := NewManager(Options{StateDir: dir, Backend: backend, Logger: slog.New(slog.NewTextHandler(&log, nil))})
+
+	tun, err := m.Create(Config{Name: "office", LocalIP: "192.0.2.1", RemoteIP: "198.51.100.1",
+		LocalSubnet: "10.0.0.0/16", RemoteSubnet: "10.1.0.0/16", Encryption: "aes256gcm"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if tun.Status != StatusUp {
+		t.Errorf("Expected the tunnel to be up, got %s", tun.Status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tunnels", "office.json")); err != nil {
+		t.Errorf("Expected the tunnel to be stored in the state directory: %v", err)
+	}
+	if err := m.Delete("office", false); err == nil {
+		t.Error("Expected an active tunnel not to be deleted")
+	}
+	if err := m.Stop("office"); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if err := m.Start("office"); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if tunnels, err := m.List(); err != nil || len(tunnels) != 1 || tunnels[0].Status != StatusUp {
+		t.Errorf("Expected one tunnel that is up, got %v: %v", tunnels, err)
+	}
+	if err := m.Stop("office"); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if err := m.Delete("office", false); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := m.Get("office"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the tunnel to be gone, got %v", err)
+	}
+
+	want := []string{
+		"create office",
+		"guard office", "unroute office", "stop office",
+		"guard office", "start office", "route office",
+		"guard office", "unroute office", "stop office",
+		"delete office",
+	}
+	if !slices.Equal(backend.calls, want) {
+		t.Errorf("Expected backend calls %q, got %q", want, backend.calls)
+	}
+	if !strings.Contains(log.String(), `msg="Creating new tunnel" tunnel=office`) {
+		t.Errorf("Expected the messages to go to the logger, got %q", log.String())
+	}
+	if entries, _ := os.ReadDir(configDir); len(entries) != 0 {
+		t.Errorf("Expected nothing in the configuration directory, got %v", entries)
+	}
+}
+
+func TestManagerSettings(t *testing.T) {
+	// A Manager from NewManager neither reads the configuration nor writes
+	// outside its state directory, even where ~/.ipsec-vpn would be used
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SUDO_USER", "")
+	viper.Set("security.kill_switch", false)
+	viper.Set("tunnel_defaults.sa_lifetime.hard_time", 600)
+
+	var published []events.Event
+	m := NewManager(Options{
+		StateDir: t.TempDir(),
+		Backend:  &fakeBackend{},
+		Publish:  func(e events.Event) { published = append(published, e) },
+		Settings: Settings{KillSwitch: true, SALifetime: SALifetime{HardTime: time.Hour}},
+	})
+	tun, err := m.Create(Config{Name: "office", LocalIP: "192.0.2.1", RemoteIP: "198.51.100.1",
+		LocalSubnet: "10.0.0.0/16", RemoteSubnet: "10.1.0.0/16", Encryption: "auto"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if tun.Encryption == "auto" {
+		t.Error("Expected the encryption to be resolved")
+	}
+	if !tun.KillSwitchEnabled() {
+		t.Error("Expected the kill-switch of the settings")
+	}
+	if got := tun.EffectiveSALifetime(); got.HardTime != time.Hour || got.SoftTime != 54*time.Minute {
+		t.Errorf("Expected the SA lifetime of the settings, got %+v", got)
+	}
+	if err := m.Stop("office"); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if err := m.Start("office"); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	loaded, err := m.Get("office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.KillSwitchEnabled() {
+		t.Error("Expected a loaded tunnel to use the settings")
+	}
+	if err := m.Stop("office"); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if err := m.Delete("office", false); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	var types []string
+	for _, e := range published {
+		types = append(types, e.Type)
+	}
+	if len(types) == 0 || types[0] != events.TypeCreated {
+		t.Errorf("Expected the events published to Options.Publish, got %q", types)
+	}
+	if entries, _ := os.ReadDir(home); len(entries) != 0 {
+		t.Errorf("Expected nothing written outside the state directory, got %v", entries)
+	}
+}
+
+func TestLinkCache(t *testing.T) {
+	tun := &Tunnel{Name: "office", Status: StatusUp}
+	if status, _ := getTunnelStatus(tun); status != StatusUp {
+		t.Errorf("Expected the stored status without the cache, got %s", status)
+	}
+
+	links.reset([]netlink.Link{&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: tun.Interface(), Index: 7, Flags: net.FlagUp}}})
+	defer links.reset(nil)
+	if status, _ := getTunnelStatus(tun); status != StatusUp {
+		t.Errorf("Expected a tunnel with its interface up to be up, got %s", status)
+	}
+
+	// Renamed away, the interface is no longer the tunnel's
+	links.update(false, &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "old-office", Index: 7, Flags: net.FlagUp}})
+	if exists, _, _ := links.lookup(tun.Interface()); exists {
+		t.Error("Expected a renamed interface to be looked up by its new name")
+	}
+	if status, _ := getTunnelStatus(tun); status != StatusDown {
+		t.Errorf("Expected a tunnel without its interface to be down, got %s", status)
+	}
+
+	links.update(false, &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: tun.Interface(), Index: 8}})
+	if exists, up, _ := (netlinkState{}).link(tun); !exists || up {
+		t.Errorf("Expected the reconciler to see the interface down, got exists=%v up=%v", exists, up)
+	}
+	links.update(true, &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: tun.Interface(), Index: 8}})
+	if exists, _, ok := links.lookup(tun.Interface()); exists || !ok {
+		t.Error("Expected a deleted interface to be gone")
+	}
+}
+
+func TestPSKRef(t *testing.T) {
+	backend := &fakeBackend{}
+	m := NewManager(Options{StateDir: t.TempDir(), Backend: backend})
+	t.Setenv("OFFICE_PSK", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+
+	config := Config{Name: "office", LocalIP: "192.0.2.1", RemoteIP: "198.51.100.1",
+		LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24", Encryption: "aes256gcm", PSKRef: "env://OFFICE_PSK"}
+	if _, err := m.Create(config); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	tun, err := m.Get("office")
+	if err != nil || tun.PSKRef != "env://OFFICE_PSK" {
+		t.Fatalf("Expected the reference to be stored, got %+v: %v", tun, err)
+	}
+
+	// A reference that cannot be resolved fails before anything is created
+	config.Name, config.PSKRef = "branch", "env://BRANCH_PSK"
+	if _, err := m.Create(config); err == nil || !strings.Contains(err.Error(), "BRANCH_PSK") {
+		t.Errorf("Expected an unresolved reference to fail, got %v", err)
+	}
+	config.PSKRef = "s3cr3t"
+	if _, err := m.Create(config); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected a literal key to be rejected, got %v", err)
+	}
+	if !slices.Equal(backend.calls, []string{"create office"}) {
+		t.Errorf("Expected only office to be created, got %q", backend.calls)
+	}
+}
+
+func TestPeerGroup(t *testing.T) {
+	// The configuration file is not what a Manager from NewManager uses
+	viper.Set("advanced.ike_proposals", []string{"chacha20poly1305-sha256-x25519"})
+	viper.Set("advanced.dpd_delay", 10)
+	defer viper.Set("advanced.ike_proposals", nil)
+	defer viper.Set("advanced.dpd_delay", nil)
+
+	backend := &fakeBackend{}
+	m := NewManager(Options{StateDir: t.TempDir(), Backend: backend, Settings: Settings{
+		IKE: IKESettings{AuthMethod: "psk", IKEProposals: []string{"aes256gcm-sha384-ecp384"}, DPDDelay: 30},
+	}})
+
+	config := Config{Name: "paris", LocalIP: "192.0.2.1", RemoteIP: "198.51.100.1",
+		LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24", Encryption: "aes256gcm", PeerGroup: "branches"}
+	if _, err := m.Create(config); !errors.Is(err, ErrPeerGroupNotFound) {
+		t.Errorf("Expected a missing peer group to fail, got %v", err)
+	}
+	for _, g := range []PeerGroup{
+		{Name: "branches", AuthMethod: "password"},
+		{Name: "branches", DPDDelay: 30, DPDTimeout: 10},
+		{Name: "branches", IKEProposals: []string{"rot13"}},
+	} {
+		if _, err := m.SavePeerGroup(&g); err == nil {
+			t.Errorf("Expected %+v to be rejected", g)
+		}
+	}
+	if _, err := m.SavePeerGroup(&PeerGroup{Name: "branches", AuthMethod: "pubkey", DPDTimeout: 120}); err != nil {
+		t.Fatalf("SavePeerGroup failed: %v", err)
+	}
+	if _, err := m.Create(config); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	tun, err := m.Get("paris")
+	if err != nil || tun.PeerGroup != "branches" {
+		t.Fatalf("Expected the peer group to be stored, got %+v: %v", tun, err)
+	}
+	s := m.IKESettingsOf(tun)
+	if s.AuthMethod != "pubkey" || s.DPDTimeout != 120 || s.DPDDelay != 30 || !slices.Equal(s.IKEProposals, []string{"aes256gcm-sha384-ecp384"}) {
+		t.Errorf("Expected the group's settings over the Manager's, got %+v", s)
+	}
+	if s := m.IKESettingsOf(&Tunnel{Name: "lyon"}); s.Group != "" || s.AuthMethod != "psk" || s.DPDDelay != 30 {
+		t.Errorf("Expected the Manager's settings without a peer group, got %+v", s)
+	}
+
+	// Changing the group rekeys its members that are up
+	backend.calls = nil
+	rekeyed, err := m.SavePeerGroup(&PeerGroup{Name: "branches", AuthMethod: "psk"})
+	if err != nil || !slices.Equal(rekeyed, []string{"paris"}) {
+		t.Errorf("Expected paris to be rekeyed, got %q: %v", rekeyed, err)
+	}
+	want := []string{"guard paris", "unroute paris", "stop paris", "guard paris", "start paris", "route paris"}
+	if !slices.Equal(backend.calls, want) {
+		t.Errorf("Expected backend calls %q, got %q", want, backend.calls)
+	}
+
+	if err := m.DeletePeerGroup("branches", false); err == nil {
+		t.Error("Expected a peer group with members not to be deleted")
+	}
+	if err := m.DeletePeerGroup("branches", true); err != nil {
+		t.Fatalf("DeletePeerGroup failed: %v", err)
+	}
+	if tun, err := m.Get("paris"); err != nil || tun.PeerGroup != "" {
+		t.Errorf("Expected paris to be taken out of the group, got %+v: %v", tun, err)
+	}
+	if groups, err := m.PeerGroups(); err != nil || len(groups) != 0 {
+		t.Errorf("Expected no peer groups, got %v: %v", groups, err)
+	}
+}
+
+// testCertificate creates a certificate for a common name, self-signed
+// without a parent
+func testCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestReauth(t *testing.T) {
+	m := NewManager(Options{StateDir: t.TempDir(), Backend: &fakeBackend{}, Settings: Settings{IKE: IKESettings{ReauthGrace: 300}}})
+
+	if _, err := m.SavePeerGroup(&PeerGroup{Name: "strict", ReauthInterval: 240}); err == nil {
+		t.Error("Expected a default grace longer than the interval to be rejected")
+	}
+	viper.Set("advanced.reauth_grace", 300)
+	if err := (&PeerGroup{Name: "strict", ReauthInterval: 240}).Validate(); err == nil {
+		t.Error("Expected a grace from the configuration file longer than the interval to be rejected")
+	}
+	viper.Set("advanced.reauth_grace", nil)
+	if _, err := m.SavePeerGroup(&PeerGroup{Name: "strict", ReauthInterval: 4 * 3600}); err != nil {
+		t.Fatalf("SavePeerGroup failed: %v", err)
+	}
+	config := Config{Name: "paris", LocalIP: "192.0.2.1", RemoteIP: "198.51.100.1",
+		LocalSubnet: "10.1.0.0/24", RemoteSubnet: "10.2.0.0/24", Encryption: "aes256gcm"}
+	if _, err := m.Create(config); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	tun, _ := m.Get("paris")
+	if p, source := m.EffectiveReauth(tun); p.Interval != 0 || source != "manager settings" {
+		t.Errorf("Expected tunnels to only rekey by default, got %s from %s", p, source)
+	}
+	tun.PeerGroup = "strict"
+	if p, source := m.EffectiveReauth(tun); p.Interval != 4*time.Hour || p.Grace != 5*time.Minute || source != "peer group strict" {
+		t.Errorf("Expected the group's interval with the default grace, got %s from %s", p, source)
+	}
+
+	for _, p := range []ReauthPolicy{{Interval: time.Second}, {Interval: time.Hour, Grace: time.Hour}, {Interval: -time.Hour}} {
+		if err := m.SetReauth("paris", &p); err == nil {
+			t.Errorf("Expected %+v to be rejected", p)
+		}
+	}
+	if err := m.SetReauth("paris", &ReauthPolicy{Interval: 8 * time.Hour, Grace: 10 * time.Minute}); err != nil {
+		t.Fatalf("SetReauth failed: %v", err)
+	}
+	if err := m.Start("paris"); err != nil {
+		t.Fatal(err)
+	}
+	tun, _ = m.Get("paris")
+	p, source := m.EffectiveReauth(tun)
+	if p.Interval != 8*time.Hour || source != "tunnel" {
+		t.Fatalf("Expected the tunnel's own policy to be stored, got %s from %s", p, source)
+	}
+	counts, err := m.Reauths("paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	due := ReauthDue(tun, p, counts)
+	if want := tun.LastTransition.Add(8 * time.Hour); !due.Equal(want) {
+		t.Errorf("Expected a reauthentication due 8h after the tunnel came up at %s, got %s", want, due)
+	}
+	if ReauthOverdue(tun, p, counts, due.Add(5*time.Minute)) || !ReauthOverdue(tun, p, counts, due.Add(11*time.Minute)) {
+		t.Error("Expected the reauthentication to be overdue once the grace ran out")
+	}
+
+	if _, err := m.RecordReauth("paris", "maybe", ""); err == nil {
+		t.Error("Expected an unknown result to be rejected")
+	}
+	if _, err := m.RecordReauth("paris", ReauthFailure, "peer certificate revoked"); err != nil {
+		t.Fatalf("RecordReauth failed: %v", err)
+	}
+	counts, err = m.RecordReauth("paris", ReauthSuccess, "")
+	if err != nil {
+		t.Fatalf("RecordReauth failed: %v", err)
+	}
+	if counts.Successes != 1 || counts.Failures != 1 || counts.LastResult != ReauthSuccess || counts.LastSuccess.IsZero() {
+		t.Errorf("Expected one success and one failure, got %+v", counts)
+	}
+	if next := ReauthDue(tun, p, counts); !next.Equal(counts.LastSuccess.Add(8 * time.Hour)) {
+		t.Errorf("Expected the next reauthentication due 8h after the last, got %s", next)
+	}
+
+	if err := m.SetReauth("paris", nil); err != nil {
+		t.Fatalf("SetReauth failed: %v", err)
+	}
+	if tun, _ = m.Get("paris"); tun.Reauth != nil {
+		t.Errorf("Expected the tunnel's policy to be cleared, got %+v", tun.Reauth)
+	}
+}
+
+func TestResponder(t *testing.T) {
+	backend := &fakeBackend{}
+	m := NewManager(Options{StateDir: t.TempDir(), Backend: backend})
+
+	authority, caKey := testCertificate(t, "Branches CA", nil, nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: authority.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spoke, _ := testCertificate(t, "paris.branches.example.com", authority, caKey)
+	stranger, _ := testCertificate(t, "paris.branches.example.com", nil, nil)
+
+	config := Config{Name: "hub", LocalIP: "192.0.2.1", RemoteIP: AnyPeer,
+		LocalSubnet: "10.0.0.0/16", RemoteSubnet: "10.128.0.0/9", Encryption: "aes256gcm"}
+	if _, err := m.Create(config); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected a responder without a peer ID or CA to be rejected, got %v", err)
+	}
+	config.PeerID, config.PeerCA = "*.branches.example.com", caFile
+	hub, err := m.Create(config)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if hub.Status != StatusUp || len(backend.calls) != 0 {
+		t.Errorf("Expected a responder accepting peers without an interface, got %s and %q", hub.Status, backend.calls)
+	}
+
+	for _, tt := range []struct {
+		desc string
+		peer Initiator
+	}{
+		{"a certificate from another CA", Initiator{Address: "203.0.113.1", Subnet: "10.130.0.0/24", Chain: []*x509.Certificate{stranger}}},
+		{"no certificate", Initiator{ID: "paris.branches.example.com", Address: "203.0.113.1", Subnet: "10.130.0.0/24"}},
+		{"an identity not in its certificate", Initiator{ID: "rome.branches.example.com", Address: "203.0.113.1", Subnet: "10.130.0.0/24", Chain: []*x509.Certificate{spoke}}},
+		{"a subnet outside the remote subnet", Initiator{Address: "203.0.113.1", Subnet: "10.0.1.0/24", Chain: []*x509.Certificate{spoke}}},
+	} {
+		if _, err := m.AcceptPeer("hub", tt.peer); !errors.Is(err, ErrPeerRejected) {
+			t.Errorf("Expected a peer with %s to be rejected, got %v", tt.desc, err)
+		}
+	}
+
+	paris := Initiator{Address: "203.0.113.1", Subnet: "10.130.0.0/24", Chain: []*x509.Certificate{spoke}}
+	instance, err := m.AcceptPeer("hub", paris)
+	if err != nil {
+		t.Fatalf("AcceptPeer failed: %v", err)
+	}
+	if instance.Name != "hub-1" || instance.Template != "hub" || instance.PeerIdentity != "paris.branches.example.com" ||
+		instance.RemoteIP != "203.0.113.1" || instance.RemoteSubnet != "10.130.0.0/24" || instance.LocalSubnet != "10.0.0.0/16" {
+		t.Errorf("Expected instance hub-1 of hub for paris, got %+v", instance)
+	}
+
+	// The same initiator keeps its instance, and one from a new address gets it back
+	if again, err := m.AcceptPeer("hub", paris); err != nil || again.Name != "hub-1" {
+		t.Errorf("Expected paris to keep hub-1, got %v: %v", again, err)
+	}
+	paris.Address = "203.0.113.9"
+	if moved, err := m.AcceptPeer("hub", paris); err != nil || moved.Name != "hub-1" || moved.RemoteIP != "203.0.113.9" {
+		t.Errorf("Expected paris to move hub-1 to its new address, got %v: %v", moved, err)
+	}
+	want := []string{"create hub-1", "unroute hub-1", "stop hub-1", "delete hub-1", "create hub-1"}
+	if !slices.Equal(backend.calls, want) {
+		t.Errorf("Expected backend calls %q, got %q", want, backend.calls)
+	}
+
+	// Stopping the responder releases its instances
+	if err := m.Delete("hub", false); err == nil {
+		t.Error("Expected a responder accepting peers not to be deleted")
+	}
+	if err := m.Stop("hub"); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if instances, err := m.Instances("hub"); err != nil || len(instances) != 0 {
+		t.Errorf("Expected no instances, got %v: %v", instances, err)
+	}
+	if _, err := m.AcceptPeer("hub", paris); err == nil {
+		t.Error("Expected a stopped responder to accept no peers")
+	}
+	if err := m.Delete("hub", false); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+}
+
+func TestVirtualIP(t *testing.T) {
+	m := NewManager(Options{StateDir: t.TempDir(), Backend: &fakeBackend{}})
+
+	authority, caKey := testCertificate(t, "Branches CA", nil, nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: authority.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spoke := func(name, address string) Initiator {
+		cert, _ := testCertificate(t, name+".branches.example.com", authority, caKey)
+		return Initiator{Address: address, Chain: []*x509.Certificate{cert}}
+	}
+
+	config := Config{Name: "hub", LocalIP: "192.0.2.1", RemoteIP: AnyPeer, LocalSubnet: "10.0.0.0/16",
+		RemoteSubnet: "10.128.0.0/9", Encryption: "aes256gcm", PeerID: "*.branches.example.com", PeerCA: caFile,
+		VirtualIPPool: "10.200.0.0/30", VirtualIPs: map[string]string{"rome.branches.example.com": "10.201.0.0/24"}}
+	if _, err := m.Create(config); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// The pool's network address is skipped, and a lease survives a reconnect
+	paris, err := m.AcceptPeer("hub", spoke("paris", "203.0.113.1"))
+	if err != nil {
+		t.Fatalf("AcceptPeer failed: %v", err)
+	}
+	if paris.VirtualIP != "10.200.0.1/32" || paris.RemoteSubnet != "10.200.0.1/32" {
+		t.Errorf("Expected paris to be leased 10.200.0.1/32 as its subnet, got %s and %s", paris.VirtualIP, paris.RemoteSubnet)
+	}
+	if err := m.ReleasePeer(paris.Name); err != nil {
+		t.Fatalf("ReleasePeer failed: %v", err)
+	}
+	if paris, err = m.AcceptPeer("hub", spoke("paris", "203.0.113.9")); err != nil || paris.VirtualIP != "10.200.0.1/32" {
+		t.Errorf("Expected paris to keep 10.200.0.1/32 when it reconnects, got %v: %v", paris, err)
+	}
+
+	// A static mapping takes precedence over the pool
+	if rome, err := m.AcceptPeer("hub", spoke("rome", "203.0.113.2")); err != nil || rome.VirtualIP != "10.201.0.0/24" {
+		t.Errorf("Expected rome to be assigned 10.201.0.0/24, got %v: %v", rome, err)
+	}
+
+	// The broadcast address is skipped too, which leaves a single address after paris's
+	if _, err := m.AcceptPeer("hub", spoke("oslo", "203.0.113.3")); err != nil {
+		t.Fatalf("AcceptPeer failed: %v", err)
+	}
+	if _, err := m.AcceptPeer("hub", spoke("lima", "203.0.113.4")); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("Expected an exhausted pool, got %v", err)
+	}
+
+	// A mapping to an address leased to another identity is refused until it is cleared
+	if err := m.SetVirtualIP("hub", "lima.branches.example.com", "10.200.0.2"); err == nil {
+		t.Error("Expected a virtual IP leased to oslo not to be mapped to lima")
+	}
+	if err := m.ClearVirtualIP("hub", "oslo.branches.example.com"); err != nil {
+		t.Fatalf("ClearVirtualIP failed: %v", err)
+	}
+	if err := m.SetVirtualIP("hub", "lima.branches.example.com", "10.200.0.2"); err != nil {
+		t.Fatalf("SetVirtualIP failed: %v", err)
+	}
+	ips, err := m.VirtualIPs("hub")
+	if err != nil {
+		t.Fatalf("VirtualIPs failed: %v", err)
+	}
+	var got []string
+	for _, ip := range ips {
+		assigned := "leased"
+		if ip.Static {
+			assigned = "static"
+		}
+		got = append(got, ip.Identity+"="+ip.Address+" "+assigned)
+	}
+	want := []string{"lima.branches.example.com=10.200.0.2/32 static", "paris.branches.example.com=10.200.0.1/32 leased",
+		"rome.branches.example.com=10.201.0.0/24 static"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected virtual IPs %q, got %q", want, got)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	m := NewManager(Options{StateDir: t.TempDir(), Backend: &fakeBackend{}})
+
+	authority, caKey := testCertificate(t, "Users CA", nil, nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: authority.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	user := func(name, address string) Initiator {
+		cert, _ := testCertificate(t, name, authority, caKey)
+		return Initiator{Address: address, Chain: []*x509.Certificate{cert}}
+	}
+	for _, name := range []string{"roaming", "office"} {
+		config := Config{Name: name, LocalIP: "192.0.2.1", RemoteIP: AnyPeer, LocalSubnet: "10.0.0.0/16",
+			RemoteSubnet: "10.128.0.0/9", Encryption: "aes256gcm", PeerCA: caFile, VirtualIPPool: "10.200.0.0/24"}
+		if _, err := m.Create(config); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+	for _, peer := range []struct{ responder, name, address string }{
+		{"roaming", "alice", "198.51.100.7"}, {"roaming", "bob", "203.0.113.4"}, {"office", "carol", "203.0.113.5"},
+	} {
+		if _, err := m.AcceptPeer(peer.responder, user(peer.name, peer.address)); err != nil {
+			t.Fatalf("AcceptPeer failed: %v", err)
+		}
+	}
+
+	if _, err := m.Sessions("missing"); err == nil {
+		t.Error("Expected the sessions of an unknown responder to be refused")
+	}
+	if all, err := m.Sessions(""); err != nil || len(all) != 3 {
+		t.Errorf("Expected the sessions of both responders, got %v: %v", all, err)
+	}
+	sessions, err := m.Sessions("roaming")
+	if err != nil {
+		t.Fatalf("Sessions failed: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions of roaming, got %+v", sessions)
+	}
+	alice := sessions[0]
+	if alice.ID != "roaming-1" || alice.Identity != "alice" || alice.Address != "198.51.100.7" ||
+		alice.VirtualIP != "10.200.0.1/32" || alice.Status != StatusUp || alice.Connected.IsZero() {
+		t.Errorf("Expected the session of alice first, got %+v", alice)
+	}
+
+	if _, err := m.Disconnect("roaming"); err == nil {
+		t.Error("Expected a responder not to be disconnected as a session")
+	}
+	if _, err := m.Disconnect(alice.ID); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+	if sessions, err := m.Sessions("roaming"); err != nil || len(sessions) != 1 || sessions[0].Identity != "bob" {
+		t.Errorf("Expected only bob connected, got %+v: %v", sessions, err)
+	}
+	journal, err := m.Journal(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(journal, func(e events.Event) bool {
+		return e.Type == events.TypeSessionDisconnected && e.Tunnel == alice.ID && e.PeerID == "alice" && e.PeerAddress == "198.51.100.7"
+	}) {
+		t.Errorf("Expected a disconnect event for the IKE daemon, got %+v", journal)
+	}
+}
+
+func TestSessionAccounting(t *testing.T) {
+	state := t.TempDir()
+	m := NewManager(Options{StateDir: state, Backend: &fakeBackend{}})
+
+	// Records past retention go when the first record of a day is written
+	stale := filepath.Join(state, "sessions", "2020-01-01.jsonl")
+	if err := os.MkdirAll(filepath.Dir(stale), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte(`{"session":"roaming-9","identity":"mallory","start":"2020-01-01T00:00:00Z"}`+"\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	authority, caKey := testCertificate(t, "Users CA", nil, nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: authority.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	user := func(name, address string) Initiator {
+		cert, _ := testCertificate(t, name, authority, caKey)
+		return Initiator{Address: address, Chain: []*x509.Certificate{cert}}
+	}
+	config := Config{Name: "roaming", LocalIP: "192.0.2.1", RemoteIP: AnyPeer, LocalSubnet: "10.0.0.0/16",
+		RemoteSubnet: "10.128.0.0/9", Encryption: "aes256gcm", PeerCA: caFile, VirtualIPPool: "10.200.0.0/24"}
+	if _, err := m.Create(config); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	start := time.Now()
+	for _, peer := range []struct{ name, address string }{
+		{"alice", "198.51.100.7"}, {"bob", "203.0.113.4"}, {"alice", "198.51.100.8"},
+	} {
+		if _, err := m.AcceptPeer("roaming", user(peer.name, peer.address)); err != nil {
+			t.Fatalf("AcceptPeer failed: %v", err)
+		}
+	}
+	if _, err := m.Disconnect("roaming-2"); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+
+	history, err := m.SessionHistory(time.Time{}, time.Now(), "")
+	if err != nil {
+		t.Fatalf("SessionHistory failed: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected the records past retention to be removed, got %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 sessions, got %+v", history)
+	}
+	for i, want := range []SessionRecord{
+		{Session: "roaming-1", Identity: "alice", Address: "198.51.100.7", VirtualIP: "10.200.0.1/32", Reason: "reconnected"},
+		{Session: "roaming-2", Identity: "bob", Address: "203.0.113.4", VirtualIP: "10.200.0.2/32", Reason: "disconnected"},
+		{Session: "roaming-1", Identity: "alice", Address: "198.51.100.8", VirtualIP: "10.200.0.1/32"},
+	} {
+		r := history[i]
+		if r.Session != want.Session || r.Responder != "roaming" || r.Identity != want.Identity || r.Address != want.Address ||
+			r.VirtualIP != want.VirtualIP || r.Reason != want.Reason || r.Start.Before(start.Add(-time.Second)) {
+			t.Errorf("Expected session %d to be %+v, got %+v", i, want, r)
+		}
+		if stopped := want.Reason != ""; stopped == r.Stop.IsZero() {
+			t.Errorf("Expected session %d to have ended: %v, got stop %v", i, stopped, r.Stop)
+		}
+	}
+
+	if err := m.Stop("roaming"); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if history, err := m.SessionHistory(time.Time{}, time.Now(), "alice"); err != nil || len(history) != 2 || history[1].Reason != "responder stopped" {
+		t.Errorf("Expected the sessions of alice, the last ended by stopping the responder, got %+v: %v", history, err)
+	}
+	if history, err := m.SessionHistory(time.Now().Add(time.Hour), time.Now().Add(2*time.Hour), ""); err != nil || len(history) != 0 {
+		t.Errorf("Expected no sessions connected in the next hour, got %+v: %v", history, err)
+	}
+	if _, err := m.SessionHistory(time.Time{}, time.Now(), "["); err == nil {
+		t.Error("Expected an invalid identity pattern to be refused")
+	}
+}
+
+func TestLoginPolicy(t *testing.T) {
+	m := NewManager(Options{StateDir: t.TempDir(), Backend: &fakeBackend{}})
+	locate := locateSource
+	defer func() { locateSource = locate }()
+	locateSource = func(ip net.IP) (geoip.Location, error) {
+		if ip.Equal(net.ParseIP("198.51.100.7")) {
+			return geoip.Location{Country: "DE"}, nil
+		}
+		return geoip.Location{Country: "US"}, nil
+	}
+
+	for _, p := range []LoginPolicy{
+		{Name: "empty", Identity: "*"},
+		{Name: "bad-day", Identity: "*", Days: []string{"someday"}},
+		{Name: "half-hours", Identity: "*", Start: "08:00"},
+		{Name: "bad-country", Identity: "*", Countries: []string{"Germany"}},
+		{Name: "bad-network", Identity: "*", Networks: []string{"198.51.100.0"}},
+		{Name: "bad-pattern", Identity: "[", MaxSessions: 1},
+	} {
+		if err := m.SaveLoginPolicy(&p); err == nil {
+			t.Errorf("Expected login policy %s to be rejected", p.Name)
+		}
+	}
+
+	office := LoginPolicy{Name: "office-hours", Identity: "*@contractors.example.com", Days: []string{"Mon", "Tue", "Wed", "Thu", "Fri"},
+		Start: "08:00", End: "18:00"}
+	if err := office.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	monday := time.Date(2026, 10, 12, 9, 0, 0, 0, time.Local)
+	for _, tt := range []struct {
+		at   time.Time
+		open bool
+	}{
+		{monday, true}, {monday.Add(9 * time.Hour), false}, {monday.AddDate(0, 0, 5), false},
+	} {
+		if open := office.OpenAt(tt.at); open != tt.open {
+			t.Errorf("Expected %s open %v at %s, got %v", office.Hours(), tt.open, tt.at, open)
+		}
+	}
+
+	authority, caKey := testCertificate(t, "Users CA", nil, nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: authority.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	user := func(name, address string) Initiator {
+		cert, _ := testCertificate(t, name, authority, caKey)
+		return Initiator{Address: address, Chain: []*x509.Certificate{cert}}
+	}
+	for _, name := range []string{"roaming", "office"} {
+		config := Config{Name: name, LocalIP: "192.0.2.1", RemoteIP: AnyPeer, LocalSubnet: "10.0.0.0/16",
+			RemoteSubnet: "10.128.0.0/9", Encryption: "aes256gcm", PeerCA: caFile, VirtualIPPool: "10.200.0.0/24"}
+		if _, err := m.Create(config); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+	if err := m.SaveLoginPolicy(&LoginPolicy{Name: "single", Identity: "*@example.com", MaxSessions: 1,
+		Countries: []string{"de"}, Networks: []string{"203.0.113.0/24"}}); err != nil {
+		t.Fatalf("SaveLoginPolicy failed: %v", err)
+	}
+	if p, err := m.LoginPolicy("single"); err != nil || p.Countries[0] != "DE" || p.Sources() != "DE,203.0.113.0/24" {
+		t.Errorf("Expected the countries normalized, got %+v: %v", p, err)
+	}
+
+	// Allowed from a country or network of the policy, once at a time
+	if _, err := m.AcceptPeer("roaming", user("alice@example.com", "198.51.100.7")); err != nil {
+		t.Fatalf("Expected alice to connect from DE, got %v", err)
+	}
+	if _, err := m.AcceptPeer("roaming", user("alice@example.com", "203.0.113.9")); err != nil {
+		t.Errorf("Expected alice to move her session to an allowed network, got %v", err)
+	}
+	if _, err := m.AcceptPeer("office", user("alice@example.com", "203.0.113.9")); !errors.Is(err, ErrPeerRejected) ||
+		!strings.Contains(err.Error(), "allows 1 connected at once") {
+		t.Errorf("Expected a second session of alice to be rejected, got %v", err)
+	}
+	if _, err := m.AcceptPeer("office", user("bob@example.com", "192.0.2.99")); !errors.Is(err, ErrPeerRejected) ||
+		!strings.Contains(err.Error(), "country US") {
+		t.Errorf("Expected bob to be rejected from US, got %v", err)
+	}
+	if _, err := m.AcceptPeer("office", user("carol@example.org", "192.0.2.99")); err != nil {
+		t.Errorf("Expected an identity without policy to connect, got %v", err)
+	}
+
+	journal, err := m.Journal(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := 0
+	for _, e := range journal {
+		if e.Type == events.TypeSessionRejected && e.Reason != "" && e.Source != "" {
+			rejected++
+		}
+	}
+	if rejected != 2 {
+		t.Errorf("Expected 2 rejections in the journal, got %d", rejected)
+	}
+
+	if err := m.DeleteLoginPolicy("single"); err != nil {
+		t.Fatalf("DeleteLoginPolicy failed: %v", err)
+	}
+	if err := m.DeleteLoginPolicy("single"); !errors.Is(err, ErrLoginPolicyNotFound) {
+		t.Errorf("Expected ErrLoginPolicyNotFound, got %v", err)
+	}
+}
+
+func TestShortcuts(t *testing.T) {
+	instances := []*Tunnel{
+		{Name: "hub-1", PeerIdentity: "paris.branches.example.com", RemoteIP: "203.0.113.1", RemoteSubnet: "10.130.1.0/24"},
+		{Name: "hub-2", PeerIdentity: "rome.branches.example.com", RemoteIP: "203.0.113.2", RemoteSubnet: "10.130.2.0/24"},
+		{Name: "hub-3", PeerIdentity: "oslo.branches.example.com", RemoteIP: "203.0.113.3", RemoteSubnet: "10.130.3.0/24"},
+	}
+	flow := func(src, dst string, sent, recv uint64) *netlink.ConntrackFlow {
+		f := &netlink.ConntrackFlow{}
+		f.Forward.SrcIP, f.Forward.DstIP, f.Forward.Bytes = net.ParseIP(src), net.ParseIP(dst), sent
+		f.Reverse.Bytes = recv
+		return f
+	}
+	shortcuts := spokeShortcuts("hub", instances, []*netlink.ConntrackFlow{
+		flow("10.130.2.5", "10.130.1.9", 600, 600), // Either direction counts for the pair
+		flow("10.130.1.9", "10.130.2.7", 300, 100),
+		flow("10.130.1.9", "10.130.3.7", 900, 0),  // Below the threshold
+		flow("10.130.1.9", "10.0.0.1", 5000, 0),   // To the hub's own subnet
+		flow("10.130.3.1", "10.130.3.2", 5000, 0), // Within a spoke
+	}, 1000)
+	if len(shortcuts) != 1 {
+		t.Fatalf("Expected a shortcut between paris and rome, got %+v", shortcuts)
+	}
+	if s := shortcuts[0]; s.Peers[0].Tunnel != "hub-1" || s.Peers[1].ID != "rome.branches.example.com" ||
+		s.Peers[1].Address != "203.0.113.2" || s.Bytes != 1600 || s.Flows != 2 {
+		t.Errorf("Expected 1600 bytes in 2 flows between hub-1 and hub-2, got %+v", s)
+	}
+
+	// The spoke takes the shortcut the hub offers
+	m := NewManager(Options{StateDir: t.TempDir(), Backend: &fakeBackend{}})
+	if _, err := m.Create(Config{Name: "hq", LocalIP: "203.0.113.1", RemoteIP: "192.0.2.1", LocalSubnet: "10.130.1.0/24",
+		RemoteSubnet: "10.128.0.0/9", Encryption: "aes256gcm"}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	rome := ShortcutPeer{ID: "rome.branches.example.com", Address: "203.0.113.2", Subnet: "10.130.2.0/24"}
+	shortcut, err := m.AddShortcut("hq", rome)
+	if err != nil {
+		t.Fatalf("AddShortcut failed: %v", err)
+	}
+	if shortcut.Name != "hq-sc1" || shortcut.Via != "hq" || shortcut.RemoteIP != rome.Address ||
+		shortcut.RemoteSubnet != rome.Subnet || shortcut.LocalSubnet != "10.130.1.0/24" || shortcut.PeerIdentity != rome.ID {
+		t.Errorf("Expected shortcut hq-sc1 to rome via hq, got %+v", shortcut)
+	}
+	if again, err := m.AddShortcut("hq", rome); err != nil || again.Name != "hq-sc1" {
+		t.Errorf("Expected the offer taken again to keep hq-sc1, got %v: %v", again, err)
+	}
+	for _, peer := range []ShortcutPeer{
+		{ID: "lima.branches.example.com", Address: "203.0.113.4", Subnet: "172.16.0.0/24"},
+		{ID: "all.branches.example.com", Address: "203.0.113.5", Subnet: "10.128.0.0/9"},
+	} {
+		if _, err := m.AddShortcut("hq", peer); err == nil {
+			t.Errorf("Expected a shortcut to %s outside or as wide as the hub's subnet to fail", peer.Subnet)
+		}
+	}
+
+	// Shortcuts go with the tunnel to the hub
+	if err := m.Delete("hq", true); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := m.Get("hq-sc1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected hq-sc1 to be deleted with hq, got %v", err)
+	}
+}
+
+func TestPathSelection(t *testing.T) {
+	p := &PathSet{Name: "dc", Prefix: "10.50.0.0/16", Tunnels: []string{"isp-a", "isp-b"}, Hysteresis: 20, Hold: 2}
+	result := func(latency, loss float64) *SLAResult {
+		return &SLAResult{Sent: 10, Received: 10 - int(loss/10), Latency: latency, Loss: loss}
+	}
+
+	// Without an active tunnel, the best one is taken at once
+	d := choosePath(p, map[string]*SLAResult{"isp-a": result(30, 0), "isp-b": result(20, 0)}, nil)
+	if !d.Changed || d.To != "isp-b" || p.Active != "isp-b" {
+		t.Fatalf("Expected isp-b to be taken first, got %+v", d)
+	}
+
+	// Within the hysteresis, the active tunnel is kept
+	if d := choosePath(p, map[string]*SLAResult{"isp-a": result(17, 0), "isp-b": result(20, 0)}, nil); d.Changed || p.Challenger != "" {
+		t.Errorf("Expected isp-b to be kept within the hysteresis, got %+v", d)
+	}
+
+	// A better tunnel must stay better for the hold, loss counting against isp-b
+	better := map[string]*SLAResult{"isp-a": result(10, 0), "isp-b": result(12, 10)}
+	if d := choosePath(p, better, nil); d.Changed || p.Challenger != "isp-a" || p.Streak != 1 {
+		t.Errorf("Expected isp-a to challenge for a round, got %+v and %+v", d, p)
+	}
+	choosePath(p, map[string]*SLAResult{"isp-a": result(20, 0), "isp-b": result(20, 0)}, nil)
+	if p.Streak != 0 {
+		t.Errorf("Expected a round alike to reset the streak, got %d", p.Streak)
+	}
+	choosePath(p, better, nil)
+	if d := choosePath(p, better, nil); !d.Changed || d.From != "isp-b" || d.To != "isp-a" || p.Streak != 0 {
+		t.Errorf("Expected isp-a to be taken after 2 rounds, got %+v", d)
+	}
+
+	// A failing active tunnel is left at once; with none answering, the route stays
+	failing := map[string]*SLAResult{"isp-a": {Sent: 10}, "isp-b": result(50, 0)}
+	if d := choosePath(p, failing, nil); !d.Changed || d.To != "isp-b" {
+		t.Errorf("Expected isp-b to take over from the failing isp-a, got %+v", d)
+	}
+	d = choosePath(p, nil, map[string]error{"isp-b": errors.New("tunnel is down")})
+	if d.Changed || d.To != "isp-b" || d.Scores[1].Usable || d.Scores[1].Error != "tunnel is down" {
+		t.Errorf("Expected isp-b to be kept with no tunnel answering, got %+v", d)
+	}
+
+	// Path sets are stored, their tunnels checked
+	m := NewManager(Options{StateDir: t.TempDir(), Backend: &fakeBackend{}})
+	for _, c := range []Config{
+		{Name: "isp-a", LocalIP: "198.51.100.1", RemoteIP: "203.0.113.1", RemoteSubnet: "10.50.0.0/16"},
+		{Name: "isp-b", LocalIP: "198.51.100.2", RemoteIP: "203.0.113.2", RemoteSubnet: "10.50.0.0/16"},
+		{Name: "other", LocalIP: "198.51.100.3", RemoteIP: "203.0.113.3", RemoteSubnet: "10.60.0.0/16"},
+	} {
+		c.LocalSubnet, c.Encryption = "10.1.0.0/24", "aes256gcm"
+		if _, err := m.Create(c); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+	set := &PathSet{Name: "dc", Prefix: "10.50.1.0/24", Tunnels: []string{"isp-a", "isp-b"}}
+	if err := m.SavePathSet(set); err == nil {
+		t.Error("Expected a path set of tunnels without SLA probes to fail")
+	}
+	for _, name := range []string{"isp-a", "isp-b", "other"} {
+		tunnel, _ := m.load(name)
+		tunnel.SLA = &SLA{Type: "icmp", Target: "10.50.0.1", Interval: time.Minute, Count: 10}
+		if err := m.save(tunnel); err != nil {
+			t.Fatalf("save failed: %v", err)
+		}
+	}
+	if err := m.SavePathSet(&PathSet{Name: "dc", Prefix: "10.50.1.0/24", Tunnels: []string{"isp-a", "other"}}); err == nil {
+		t.Error("Expected a path set with a tunnel not reaching its prefix to fail")
+	}
+	if err := m.SavePathSet(set); err != nil {
+		t.Fatalf("SavePathSet failed: %v", err)
+	}
+	if got, err := m.PathSet("dc"); err != nil || got.Hold != DefaultPathHold || got.Hysteresis != 0 || len(got.Tunnels) != 2 {
+		t.Errorf("Expected dc with a hold of %d, got %+v: %v", DefaultPathHold, got, err)
+	}
+
+	// Rounds are recorded in the history, even without a tunnel to route through
+	decision, err := m.SelectPath("dc", func(name string) (*SLAResult, error) { return nil, errors.New("no route to host") })
+	if err != nil {
+		t.Fatalf("SelectPath failed: %v", err)
+	}
+	if decision.To != "" || decision.Scores[0].Error != "no route to host" {
+		t.Errorf("Expected no tunnel to be routed through, got %+v", decision)
+	}
+	if history, err := m.PathHistory("dc"); err != nil || len(history) != 1 || history[0].Reason != decision.Reason {
+		t.Errorf("Expected the round in the history, got %+v: %v", history, err)
+	}
+	if sets, err := m.PathSets(); err != nil || len(sets) != 1 {
+		t.Errorf("Expected one path set besides its history, got %+v: %v", sets, err)
+	}
+	if err := m.DeletePathSet("dc"); err != nil {
+		t.Fatalf("DeletePathSet failed: %v", err)
+	}
+	if _, err := m.PathSet("dc"); !errors.Is(err, ErrPathSetNotFound) {
+		t.Errorf("Expected dc to be deleted, got %v", err)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	at := func(day time.Weekday, clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		// 2026-10-04 is a Sunday
+		return time.Date(2026, 10, 4+int(day), c.Hour(), c.Minute(), 0, 0, time.Local)
+	}
+	night := &Schedule{Start: "22:00", End: "06:00", Days: []string{"mon", "tue"}}
+	office := &Schedule{Start: "08:30", End: "18:00"}
+	for _, tt := range []struct {
+		s      *Schedule
+		now    time.Time
+		active bool
+	}{
+		{night, at(time.Monday, "22:00"), true},
+		{night, at(time.Monday, "21:59"), false},
+		{night, at(time.Wednesday, "05:59"), true}, // Opened on Tuesday
+		{night, at(time.Monday, "05:00"), false},   // Opened on Sunday, not listed
+		{night, at(time.Tuesday, "06:00"), false},
+		{office, at(time.Saturday, "08:30"), true},
+		{office, at(time.Saturday, "18:00"), false},
+		{&Schedule{Start: "00:00", End: "00:00"}, at(time.Friday, "13:00"), true},
+	} {
+		if got := tt.s.ActiveAt(tt.now); got != tt.active {
+			t.Errorf("Expected %s at %s to be active: %v, got %v", tt.s.Window(), tt.now.Format("Mon 15:04"), tt.active, got)
+		}
+	}
+
+	m := NewManager(Options{StateDir: t.TempDir(), Backend: &fakeBackend{}})
+	if _, err := m.Create(Config{Name: "lte", LocalIP: "198.51.100.1", RemoteIP: "203.0.113.1", LocalSubnet: "10.1.0.0/24",
+		RemoteSubnet: "10.50.0.0/16", Encryption: "aes256gcm"}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	for _, s := range []*Schedule{
+		{Name: "bad-day", Tunnel: "lte", Prefix: "10.50.1.0/24", Start: "22:00", End: "06:00", Days: []string{"someday"}},
+		{Name: "bad-time", Tunnel: "lte", Prefix: "10.50.1.0/24", Start: "25:00", End: "06:00"},
+		{Name: "outside", Tunnel: "lte", Prefix: "10.60.0.0/24", Start: "22:00", End: "06:00"},
+	} {
+		if err := m.SaveSchedule(s); err == nil {
+			t.Errorf("Expected schedule %s to fail", s.Name)
+		}
+	}
+	replicate := &Schedule{Name: "replicate", Tunnel: "lte", Prefix: "10.50.1.5/24", Start: "22:00", End: "06:00", Days: []string{"Mon"}}
+	if err := m.SaveSchedule(replicate); err != nil {
+		t.Fatalf("SaveSchedule failed: %v", err)
+	}
+	if s, err := m.Schedule("replicate"); err != nil || s.Prefix != "10.50.1.0/24" || s.Metric != DefaultScheduleMetric || s.Days[0] != "mon" {
+		t.Errorf("Expected replicate on 10.50.1.0/24 with the default metric on mon, got %+v: %v", s, err)
+	}
+
+	// Outside the window nothing happens; inside, a missing interface fails
+	// the activation, logged once
+	if a, err := m.RunSchedule("replicate", at(time.Monday, "12:00")); err != nil || a != nil {
+		t.Errorf("Expected no activation outside the window, got %+v: %v", a, err)
+	}
+	a, err := m.RunSchedule("replicate", at(time.Monday, "23:00"))
+	if err != nil || a == nil || a.Action != ScheduleFailed || a.Error == "" {
+		t.Errorf("Expected the activation to fail without an interface, got %+v: %v", a, err)
+	}
+	if again, err := m.RunSchedules(at(time.Monday, "23:01")); err != nil || len(again) != 0 {
+		t.Errorf("Expected the same failure not to be logged again, got %+v: %v", again, err)
+	}
+	if log, err := m.ScheduleLog("replicate"); err != nil || len(log) != 1 || log[0].Error == "" {
+		t.Errorf("Expected the failure in the activation log, got %+v: %v", log, err)
+	}
+
+	if err := m.DeleteSchedule("replicate"); err != nil {
+		t.Fatalf("DeleteSchedule failed: %v", err)
+	}
+	if _, err := m.Schedule("replicate"); !errors.Is(err, ErrScheduleNotFound) {
+		t.Errorf("Expected replicate to be deleted, got %v", err)
+	}
+}
+
+func TestClientProfile(t *testing.T) {
+	viper.Set("config_dir", t.TempDir())
+	defer viper.Set("config_dir", "")
+	viper.Set("advanced.ike_proposals", []string{"chacha20poly1305-sha256-x25519", "aes256gcm-sha384-ecp384"})
+	defer viper.Set("advanced.ike_proposals", nil)
+	viper.Set("security.perfect_forward_secrecy", true)
+	defer viper.Set("security.perfect_forward_secrecy", nil)
+
+	if _, err := ca.Init("hub CA"); err != nil {
+		t.Fatal(err)
+	}
+	hub := &Tunnel{Name: "hub", LocalIP: "192.0.2.1", RemoteIP: AnyPeer, LocalSubnet: "10.0.0.0/16",
+		RemoteSubnet: "10.128.0.0/9", Encryption: "chacha20poly1305", Mode: ModeIPsec,
+		PeerID: "*@example.com", PeerCA: HubCA, VirtualIPPool: "10.200.0.0/24"}
+	if err := saveTunnel(hub); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ClientProfile("alice@example.com", ProfileOptions{Format: "openvpn"}); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+	if _, err := ClientProfile("bob@example.org", ProfileOptions{Format: ProfileMobileconfig}); err == nil {
+		t.Error("Expected an identity outside the peer ID pattern to be rejected")
+	}
+
+	profile, err := ClientProfile("alice@example.com", ProfileOptions{Format: ProfileMobileconfig, ServerID: "vpn.example.com"})
+	if err != nil {
+		t.Fatalf("ClientProfile(mobileconfig) failed: %v", err)
+	}
+	if profile.Responder != "hub" || profile.Password != "" {
+		t.Errorf("Expected a profile for hub with its password inside, got %+v", profile)
+	}
+	for dec := xml.NewDecoder(bytes.NewReader(profile.Data)); ; {
+		if _, err := dec.Token(); err != nil {
+			if err != io.EOF {
+				t.Errorf("mobileconfig is not valid XML: %v", err)
+			}
+			break
+		}
+	}
+	for _, want := range []string{
+		"<key>RemoteAddress</key>\n\t\t\t\t<string>192.0.2.1</string>",
+		"<key>RemoteIdentifier</key>\n\t\t\t\t<string>vpn.example.com</string>",
+		"<key>LocalIdentifier</key>\n\t\t\t\t<string>alice@example.com</string>",
+		"<string>ChaCha20Poly1305</string>",
+		"<key>DiffieHellmanGroup</key>\n\t\t\t\t\t<integer>31</integer>",
+		"<key>EnablePFS</key>\n\t\t\t\t<integer>1</integer>",
+	} {
+		if !bytes.Contains(profile.Data, []byte(want)) {
+			t.Errorf("Expected %q in the mobileconfig:\n%s", want, profile.Data)
+		}
+	}
+
+	// Windows takes the AES-GCM proposal
+	profile, err = ClientProfile("alice@example.com", ProfileOptions{Format: ProfilePowerShell, Server: "vpn.example.com"})
+	if err != nil {
+		t.Fatalf("ClientProfile(powershell) failed: %v", err)
+	}
+	for _, want := range []string{
+		"-ServerAddress 'vpn.example.com' -TunnelType Ikev2 -AuthenticationMethod MachineCertificate",
+		"-IntegrityCheckMethod SHA384 -DHGroup ECP384 -PfsGroup ECP384",
+		"-DestinationPrefix '10.0.0.0/16'",
+	} {
+		if !bytes.Contains(profile.Data, []byte(want)) {
+			t.Errorf("Expected %q in the PowerShell script:\n%s", want, profile.Data)
+		}
+	}
+
+	profile, err = ClientProfile("alice@example.com", ProfileOptions{Format: ProfileStrongSwanAndroid, Validity: time.Hour})
+	if err != nil {
+		t.Fatalf("ClientProfile(strongswan-android) failed: %v", err)
+	}
+	var sswan sswanProfile
+	if err := json.Unmarshal(profile.Data, &sswan); err != nil {
+		t.Fatalf("strongSwan profile is not valid JSON: %v", err)
+	}
+	if sswan.Type != "ikev2-cert" || sswan.Remote.ID != "192.0.2.1" || sswan.Local.ID != "alice@example.com" ||
+		sswan.IKEProposal != "chacha20poly1305-prfsha256-curve25519" || sswan.ESPProposal != "chacha20poly1305-curve25519" {
+		t.Errorf("Unexpected strongSwan profile %+v", sswan)
+	}
+	if p12, err := base64.StdEncoding.DecodeString(sswan.Local.P12); err != nil || len(p12) == 0 || profile.Password == "" {
+		t.Errorf("Expected the identity in the profile and its password apart, got %v", err)
+	}
+	if lifetime := time.Until(profile.NotAfter); lifetime > time.Hour {
+		t.Errorf("Expected the certificate to expire within an hour, got %v", lifetime)
+	}
+
+	office := &Tunnel{Name: "office", LocalIP: "192.0.2.2", RemoteIP: AnyPeer, LocalSubnet: "10.1.0.0/16",
+		RemoteSubnet: "10.128.0.0/9", Encryption: "aes256gcm", Mode: ModeIPsec, PeerCA: HubCA,
+		VirtualIPs: map[string]string{"carol@example.com": "10.201.0.1"}}
+	if err := saveTunnel(office); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientProfile("alice@example.com", ProfileOptions{Format: ProfileMobileconfig}); err == nil {
+		t.Error("Expected the responder to be asked for with two of them")
+	}
+	if _, err := ClientProfile("alice@example.com", ProfileOptions{Format: ProfileMobileconfig, Responder: "office"}); err == nil {
+		t.Error("Expected an identity without a virtual IP to be rejected")
+	}
+	if _, err := ClientProfile("carol@example.com", ProfileOptions{Format: ProfileMobileconfig, Responder: "office"}); err != nil {
+		t.Errorf("ClientProfile failed for a mapped identity: %v", err)
+	}
+}
+
+// FuzzParseProposal checks that proposals, which peer groups and the
+// configuration file take from users, parse without panicking and that those
+// accepted parse the same again
+func FuzzParseProposal(f *testing.F) {
+	for _, s := range []string{defaultIKEProposal, "aes256gcm-sha384-ecp384", "chacha20poly1305-x25519", "AES256-SHA256-MODP2048", "-", ""} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		p, err := parseProposal(s)
+		if err != nil {
+			return
+		}
+		again, err := parseProposal(strings.ToLower(s))
+		if err != nil || again != p {
+			t.Errorf("Expected %q to parse as %+v again, got %+v, %v", s, p, again, err)
+		}
+		if _, err := selectProposal([]string{s}, p.Cipher, proposal{}); err != nil {
+			t.Errorf("Expected %q to be selectable, got %v", s, err)
+		}
+	})
+}
+
+// FuzzParseSpecs checks that any apply file parses without panicking and that
+// the tunnels it accepts are named and unique
+func FuzzParseSpecs(f *testing.F) {
+	f.Add([]byte("tunnels:\n  - name: a\n    remote_ip: 198.51.100.1\n    rate_limit: 10mbit\n    labels:\n      region: eu\n"))
+	f.Add([]byte("tunnels:\n  - name: a\n  - name: a\n"))
+	f.Add([]byte("tunnels: [{name: &x a}, {name: *x}]\n"))
+	f.Add([]byte(""))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		specs, err := ParseSpecs(data)
+		if err != nil {
+			return
+		}
+		seen := make(map[string]bool)
+		for _, s := range specs {
+			if s.Name == "" || seen[s.Name] {
+				t.Fatalf("Expected named, unique tunnels, got %+v", specs)
+			}
+			seen[s.Name] = true
+			s.Config()
+		}
+	})
+}
+
+// FuzzLoadTunnel checks that a stored tunnel, such as one cut short by a full
+// disk or edited by hand, loads or fails without panicking
+func FuzzLoadTunnel(f *testing.F) {
+	f.Add([]byte(`{"name":"fuzz","local_ip":"192.0.2.1","remote_ip":"198.51.100.1","local_subnet":"10.0.0.0/24",` +
+		`"remote_subnet":"10.1.0.0/24","encryption":"aes256gcm","status":"up","sa_soft_time":3600,"reauth_interval":86400}`))
+	f.Add([]byte(`{"name":"fuzz","labels":{"a":1},"virtual_ip_pool":"10.9.0.0/24","schedule":[1,2]}`))
+	f.Add([]byte(`{"name":`))
+	m := NewManager(Options{StateDir: f.TempDir(), Backend: &fakeBackend{}})
+	dir, err := m.tunnelsDir()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := os.WriteFile(filepath.Join(dir, "fuzz.json"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		m.Get("fuzz")
+	})
+}
@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/spf13/viper"
+	"github.com/vishvananda/netlink"
+)
+
+// UplinkAuto lets ipsec-vpn pick the uplink that carries a tunnel
+const UplinkAuto = "auto"
+
+// Uplink is a WAN interface, from the uplinks configuration, that tunnels can be
+// carried over. Up is whether the interface is up with an address tunnels can use.
+type Uplink struct {
+	Name      string   `json:"name"`
+	Interface string   `json:"interface"`
+	Gateway   string   `json:"gateway,omitempty"`
+	Capacity  uint64   `json:"capacity,omitempty"` // Bits per second, 0 if unknown
+	Up        bool     `json:"up"`
+	Addresses []net.IP `json:"addresses,omitempty"`
+}
+
+// UplinkMove is a tunnel re-homed from one uplink to another. From is empty if
+// the tunnel was not on any configured uplink.
+type UplinkMove struct {
+	Tunnel string
+	From   string
+	To     string
+	Err    error
+}
+
+// Uplinks returns the configured uplinks with their current state
+func Uplinks() ([]*Uplink, error) {
+	var configs []struct {
+		Name      string
+		Interface string
+		Gateway   string
+		Capacity  string
+	}
+	if err := viper.UnmarshalKey("uplinks", &configs); err != nil {
+		return nil, fmt.Errorf("invalid uplinks configuration: %v", err)
+	}
+
+	uplinks := make([]*Uplink, 0, len(configs))
+	for _, c := range configs {
+		u := &Uplink{Name: c.Name, Interface: c.Interface, Gateway: c.Gateway}
+		if c.Capacity != "" {
+			capacity, err := network.ParseRate(c.Capacity)
+			if err != nil {
+				return nil, fmt.Errorf("invalid capacity of uplink '%s': %v", c.Name, err)
+			}
+			u.Capacity = capacity
+		}
+		up, addrs, err := network.UplinkAddresses(c.Interface)
+		if err != nil {
+			networkLog.Debug("Uplink is unavailable", "uplink", c.Name, "err", err)
+		}
+		u.Up, u.Addresses = up && len(addrs) > 0, addrs
+		uplinks = append(uplinks, u)
+	}
+	return uplinks, nil
+}
+
+// address returns the first address of an uplink in the family of ip, or nil
+func (u *Uplink) address(ip net.IP) net.IP {
+	for _, a := range u.Addresses {
+		if (a.To4() == nil) == (ip.To4() == nil) {
+			return a
+		}
+	}
+	return nil
+}
+
+// usable reports whether an uplink can carry a tunnel
+func (u *Uplink) usable(t *Tunnel) bool {
+	return u.Up && u.address(net.ParseIP(t.RemoteIP)) != nil
+}
+
+// carries reports whether a tunnel's local address is one of the uplink's
+func (u *Uplink) carries(t *Tunnel) bool {
+	local := net.ParseIP(t.LocalIP)
+	return slices.ContainsFunc(u.Addresses, local.Equal)
+}
+
+// UplinkOf returns the uplink currently carrying a tunnel, or nil
+func UplinkOf(t *Tunnel, uplinks []*Uplink) *Uplink {
+	for _, u := range uplinks {
+		if u.carries(t) {
+			return u
+		}
+	}
+	return nil
+}
+
+// SetUplink binds a tunnel to an uplink, lets ipsec-vpn place it with UplinkAuto,
+// or leaves its local address alone again with an empty uplink. A tunnel that is
+// not on the uplink it should be on is moved straight away.
+func SetUplink(name, uplink string) error {
+	if err := RequireSelfTest(); err != nil {
+		return err
+	}
+	tunnel, err := loadTunnel(name)
+	if err != nil {
+		return err
+	}
+	uplinks, err := Uplinks()
+	if err != nil {
+		return err
+	}
+	if uplink != "" && uplink != UplinkAuto && !slices.ContainsFunc(uplinks, func(u *Uplink) bool { return u.Name == uplink }) {
+		return fmt.Errorf("uplink '%s' is not configured", uplink)
+	}
+
+	tunnel.Uplink = uplink
+	tunnel.UpdatedAt = time.Now()
+	if err := saveTunnel(tunnel); err != nil {
+		return err
+	}
+	if uplink == "" {
+		return nil
+	}
+
+	tunnels, err := ListAll()
+	if err != nil {
+		return err
+	}
+	for t, u := range planUplinks(tunnels, uplinks) {
+		if t.Name == name {
+			return rehome(t, u)
+		}
+	}
+	return nil
+}
+
+// RebalanceUplinks moves the tunnels with an uplink off uplinks that are down,
+// and tunnels bound to an uplink back onto it once it is up again
+func RebalanceUplinks() ([]UplinkMove, error) {
+	if err := RequireSelfTest(); err != nil {
+		return nil, err
+	}
+	uplinks, err := Uplinks()
+	if err != nil {
+		return nil, err
+	}
+	tunnels, err := ListAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var moves []UplinkMove
+	for t, u := range planUplinks(tunnels, uplinks) {
+		move := UplinkMove{Tunnel: t.Name, To: u.Name}
+		if from := UplinkOf(t, uplinks); from != nil {
+			move.From = from.Name
+		}
+		move.Err = rehome(t, u)
+		moves = append(moves, move)
+	}
+	slices.SortFunc(moves, func(a, b UplinkMove) int { return cmp.Compare(a.Tunnel, b.Tunnel) })
+	return moves, nil
+}
+
+// planUplinks returns the tunnels with an uplink that should move, and where to.
+// A tunnel bound to an uplink goes back to it whenever it is usable. Otherwise a
+// tunnel stays where it is while its uplink is usable, and leaves for the usable
+// uplink with the most capacity left after the rate limits of the tunnels
+// already on it, then the one carrying the fewest tunnels, then the first
+// configured. Tunnels with no usable uplink stay put.
+func planUplinks(tunnels []*Tunnel, uplinks []*Uplink) map[*Tunnel]*Uplink {
+	booked := make(map[*Uplink]uint64)
+	count := make(map[*Uplink]int)
+	current := make(map[*Tunnel]*Uplink)
+	for _, t := range tunnels {
+		if u := UplinkOf(t, uplinks); u != nil {
+			current[t] = u
+			booked[u] += t.RateLimit
+			count[u]++
+		}
+	}
+
+	spare := func(u *Uplink) int64 { return int64(u.Capacity) - int64(booked[u]) }
+	best := func(t *Tunnel) *Uplink {
+		var pick *Uplink
+		for _, u := range uplinks {
+			if !u.usable(t) {
+				continue
+			}
+			if pick == nil || spare(u) > spare(pick) || spare(u) == spare(pick) && count[u] < count[pick] {
+				pick = u
+			}
+		}
+		return pick
+	}
+
+	sorted := slices.Clone(tunnels)
+	slices.SortFunc(sorted, func(a, b *Tunnel) int { return cmp.Compare(a.Name, b.Name) })
+	moves := make(map[*Tunnel]*Uplink)
+	for _, t := range sorted {
+		if t.Uplink == "" {
+			continue
+		}
+		from := current[t]
+		var to *Uplink
+		if i := slices.IndexFunc(uplinks, func(u *Uplink) bool { return u.Name == t.Uplink }); i >= 0 && uplinks[i].usable(t) {
+			to = uplinks[i]
+		} else if from != nil && from.usable(t) {
+			to = from
+		} else {
+			to = best(t)
+		}
+		if to == nil || to == from {
+			continue
+		}
+
+		moves[t] = to
+		if from != nil {
+			booked[from] -= t.RateLimit
+			count[from]--
+		}
+		booked[to] += t.RateLimit
+		count[to]++
+	}
+	return moves
+}
+
+// rehome moves a tunnel onto an uplink: its local address becomes the uplink's,
+// on the GRE interface if it has one, and the route to its peer goes out of the
+// uplink's interface from that address
+func rehome(tunnel *Tunnel, uplink *Uplink) error {
+	local := uplink.address(net.ParseIP(tunnel.RemoteIP))
+	if local == nil {
+		return fmt.Errorf("uplink '%s' has no address to reach %s from", uplink.Name, tunnel.RemoteIP)
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("must run as root to move tunnels between uplinks")
+	}
+
+	if tunnel.Mode != ModeWireGuard {
+		handle, err := linkHandle(tunnel)
+		if err != nil {
+			return err
+		}
+		defer handle.Close()
+		if link, err := handle.LinkByName(tunnel.Interface()); err == nil {
+			if gre, ok := link.(*netlink.Gretun); ok {
+				gre.Local = local
+				if err := handle.LinkModify(gre); err != nil {
+					return fmt.Errorf("failed to change the local address of %s: %v", tunnel.Interface(), err)
+				}
+			}
+		}
+	}
+	if err := network.SetPeerRoute(tunnel.RemoteIP, uplink.Interface, uplink.Gateway, local.String()); err != nil {
+		return err
+	}
+
+	tunnelLog.Info("Moved tunnel onto uplink", "tunnel", tunnel.Name, "uplink", uplink.Name, "local", local, "previous", tunnel.LocalIP)
+	tunnel.LocalIP = local.String()
+	tunnel.UpdatedAt = time.Now()
+	return saveTunnel(tunnel)
+}
@@ -0,0 +1,413 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+)
+
+// ErrPoolExhausted is returned when a responder has no virtual IP left to
+// assign an initiator
+var ErrPoolExhausted = errors.New("virtual IP pool exhausted")
+
+// VirtualIP is the virtual IP, or subnet, of an identity accepted by a
+// responder: mapped to it statically, or leased to it from the pool
+type VirtualIP struct {
+	Identity string `json:"identity"`
+	Address  string `json:"address"` // A subnet, a single address as a host route such as 10.200.0.5/32
+	Static   bool   `json:"static"`
+	Instance string `json:"instance,omitempty"` // The instance of the identity, while it is connected
+}
+
+// parseVirtualIP reads a virtual IP given as an address or a subnet, and
+// returns it as a subnet
+func parseVirtualIP(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		} else {
+			ip = ip.To4()
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid virtual IP %q, expected an address or a subnet", s)
+	}
+	return subnet, nil
+}
+
+// validateVirtualIPs checks the virtual IP pool and static map of a responder
+func validateVirtualIPs(config Config) error {
+	if config.VirtualIPPool == "" && len(config.VirtualIPs) == 0 {
+		return nil
+	}
+	if config.RemoteIP != AnyPeer {
+		return fmt.Errorf("virtual IPs are assigned by responders, with remote IP %s", AnyPeer)
+	}
+	if config.VirtualIPPool != "" {
+		if _, _, err := net.ParseCIDR(config.VirtualIPPool); err != nil {
+			return fmt.Errorf("invalid virtual IP pool %q", config.VirtualIPPool)
+		}
+	}
+	owners := make(map[string]string)
+	for _, id := range slices.Sorted(maps.Keys(config.VirtualIPs)) {
+		subnet, err := parseVirtualIP(config.VirtualIPs[id])
+		if err != nil {
+			return err
+		}
+		if owner, ok := owners[subnet.String()]; ok {
+			return fmt.Errorf("virtual IP %s is mapped to both %s and %s", subnet, owner, id)
+		}
+		owners[subnet.String()] = id
+	}
+	return nil
+}
+
+// formatVirtualIPs formats a static map of virtual IPs as identity=address
+// entries, sorted by identity
+func formatVirtualIPs(ips map[string]string) []string {
+	entries := make([]string, 0, len(ips))
+	for _, id := range slices.Sorted(maps.Keys(ips)) {
+		entries = append(entries, id+"="+ips[id])
+	}
+	return entries
+}
+
+// ParseVirtualIPs reads a static map of virtual IPs from identity=address
+// entries. An identity may contain '=', as in CN=paris, so the address is
+// what follows the last one.
+func ParseVirtualIPs(entries []string) (map[string]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	ips := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid virtual IP %q, expected identity=address", entry)
+		}
+		subnet, err := parseVirtualIP(entry[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		ips[entry[:i]] = subnet.String()
+	}
+	return ips, nil
+}
+
+// leasesPath returns the file holding the virtual IPs a responder leased from
+// its pool, by identity
+func (m *Manager) leasesPath(responder string) (string, error) {
+	if !keys.ValidName(responder) {
+		return "", fmt.Errorf("invalid tunnel name: %s", responder)
+	}
+	dir, err := m.dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "leases", responder+".json"), nil
+}
+
+// leases reads the virtual IPs a responder leased, by identity
+func (m *Manager) leases(responder string) (map[string]string, error) {
+	path, err := m.leasesPath(responder)
+	if err != nil {
+		return nil, err
+	}
+	leases := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return leases, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, fmt.Errorf("invalid leases of responder '%s': %v", responder, err)
+	}
+	return leases, nil
+}
+
+// saveLeases writes the virtual IPs a responder leased
+func (m *Manager) saveLeases(responder string, leases map[string]string) error {
+	path, err := m.leasesPath(responder)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// assignVirtualIP returns the virtual IP of an identity accepted by a
+// responder, empty if the responder assigns none: the one mapped to it
+// statically, else the one it leased before, else the first free address of
+// the pool. A lease is kept when the identity disconnects, so a spoke keeps its
+// address across reconnects; one outside a pool that changed is given up.
+func (m *Manager) assignVirtualIP(t *Tunnel, id string) (string, error) {
+	if address, ok := t.VirtualIPs[id]; ok {
+		return address, nil
+	}
+	if t.VirtualIPPool == "" {
+		if len(t.VirtualIPs) > 0 {
+			return "", fmt.Errorf("%w: no virtual IP for %s and no pool", ErrPeerRejected, id)
+		}
+		return "", nil
+	}
+	_, pool, err := net.ParseCIDR(t.VirtualIPPool)
+	if err != nil {
+		return "", err
+	}
+	leases, err := m.leases(t.Name)
+	if err != nil {
+		return "", err
+	}
+	if address, ok := leases[id]; ok {
+		if ip, _, err := net.ParseCIDR(address); err == nil && pool.Contains(ip) {
+			return address, nil
+		}
+	}
+
+	used := make(map[string]bool)
+	for _, address := range t.VirtualIPs {
+		used[address] = true
+	}
+	for owner, address := range leases {
+		if owner != id {
+			used[address] = true
+		}
+	}
+	ones, bits := pool.Mask.Size()
+	for ip := slices.Clone(pool.IP); pool.Contains(ip); ip = nextIP(ip) {
+		// The network and broadcast addresses of an IPv4 pool are no hosts'
+		if bits == 32 && ones < 31 && (ip.Equal(pool.IP) || !pool.Contains(nextIP(ip))) {
+			continue
+		}
+		address := (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String()
+		if used[address] {
+			continue
+		}
+		leases[id] = address
+		if err := m.saveLeases(t.Name, leases); err != nil {
+			return "", err
+		}
+		m.logger().Info("Leased virtual IP", "tunnel", t.Name, "id", id, "address", address)
+		return address, nil
+	}
+	return "", fmt.Errorf("%w: %s has no address left for %s", ErrPoolExhausted, t.VirtualIPPool, id)
+}
+
+// nextIP returns the address after ip, which wraps around past the last one
+func nextIP(ip net.IP) net.IP {
+	next := slices.Clone(ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// VirtualIPs returns the virtual IPs of the identities a responder accepts,
+// mapped statically or leased, sorted by identity
+func VirtualIPs(responder string) ([]VirtualIP, error) {
+	return std.VirtualIPs(responder)
+}
+
+// VirtualIPs returns the virtual IPs of the identities a responder accepts
+func (m *Manager) VirtualIPs(responder string) ([]VirtualIP, error) {
+	t, err := m.responder(responder)
+	if err != nil {
+		return nil, err
+	}
+	leases, err := m.leases(responder)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := m.Instances(responder)
+	if err != nil {
+		return nil, err
+	}
+	ips := make(map[string]*VirtualIP)
+	for id, address := range leases {
+		ips[id] = &VirtualIP{Identity: id, Address: address}
+	}
+	for id, address := range t.VirtualIPs {
+		ips[id] = &VirtualIP{Identity: id, Address: address, Static: true}
+	}
+	for _, instance := range instances {
+		if ip, ok := ips[instance.PeerIdentity]; ok {
+			ip.Instance = instance.Name
+		}
+	}
+	var list []VirtualIP
+	for _, id := range slices.Sorted(maps.Keys(ips)) {
+		list = append(list, *ips[id])
+	}
+	return list, nil
+}
+
+// SetVirtualIP maps an identity to a virtual IP, an address or a subnet,
+// statically. The identity's instance, if it is connected, gets it when it
+// next reconnects.
+func SetVirtualIP(responder, id, address string) error {
+	return std.SetVirtualIP(responder, id, address)
+}
+
+// SetVirtualIP maps an identity to a virtual IP statically
+func (m *Manager) SetVirtualIP(responder, id, address string) error {
+	t, err := m.responder(responder)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return errors.New("identity cannot be empty")
+	}
+	subnet, err := parseVirtualIP(address)
+	if err != nil {
+		return err
+	}
+	leases, err := m.leases(responder)
+	if err != nil {
+		return err
+	}
+	for owner, other := range t.VirtualIPs {
+		if owner != id && other == subnet.String() {
+			return fmt.Errorf("virtual IP %s is mapped to %s", subnet, owner)
+		}
+	}
+	for owner, other := range leases {
+		if owner != id && other == subnet.String() {
+			return fmt.Errorf("virtual IP %s is leased to %s, clear it first", subnet, owner)
+		}
+	}
+	if t.VirtualIPs == nil {
+		t.VirtualIPs = make(map[string]string)
+	}
+	t.VirtualIPs[id] = subnet.String()
+	t.UpdatedAt = time.Now()
+	if err := m.save(t); err != nil {
+		return err
+	}
+	m.logger().Info("Mapped virtual IP", "tunnel", responder, "id", id, "address", subnet)
+	return nil
+}
+
+// ClearVirtualIP removes the static virtual IP of an identity and gives up its
+// lease, so that it is assigned another from the pool when it next connects
+func ClearVirtualIP(responder, id string) error {
+	return std.ClearVirtualIP(responder, id)
+}
+
+// ClearVirtualIP removes the virtual IP of an identity
+func (m *Manager) ClearVirtualIP(responder, id string) error {
+	t, err := m.responder(responder)
+	if err != nil {
+		return err
+	}
+	leases, err := m.leases(responder)
+	if err != nil {
+		return err
+	}
+	_, static := t.VirtualIPs[id]
+	_, leased := leases[id]
+	if !static && !leased {
+		return fmt.Errorf("%s has no virtual IP", id)
+	}
+	if static {
+		delete(t.VirtualIPs, id)
+		t.UpdatedAt = time.Now()
+		if err := m.save(t); err != nil {
+			return err
+		}
+	}
+	if leased {
+		delete(leases, id)
+		if err := m.saveLeases(responder, leases); err != nil {
+			return err
+		}
+	}
+	m.logger().Info("Cleared virtual IP", "tunnel", responder, "id", id)
+	return nil
+}
+
+// SetVirtualIPPool sets the pool a responder leases virtual IPs from, or with
+// an empty pool stops leasing them. Leases outside a new pool are given up when
+// their identities next connect.
+func SetVirtualIPPool(responder, pool string) error {
+	return std.SetVirtualIPPool(responder, pool)
+}
+
+// SetVirtualIPPool sets the pool a responder leases virtual IPs from
+func (m *Manager) SetVirtualIPPool(responder, pool string) error {
+	t, err := m.responder(responder)
+	if err != nil {
+		return err
+	}
+	if pool != "" {
+		_, subnet, err := net.ParseCIDR(pool)
+		if err != nil {
+			return fmt.Errorf("invalid virtual IP pool %q", pool)
+		}
+		pool = subnet.String()
+	}
+	t.VirtualIPPool = pool
+	t.UpdatedAt = time.Now()
+	if err := m.save(t); err != nil {
+		return err
+	}
+	m.logger().Info("Set virtual IP pool", "tunnel", responder, "pool", pool)
+	return nil
+}
+
+// responder loads a tunnel that must be a responder
+func (m *Manager) responder(name string) (*Tunnel, error) {
+	t, err := m.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Responder() {
+		return nil, fmt.Errorf("tunnel '%s' is not a responder, its remote IP is %s", name, t.RemoteIP)
+	}
+	return t, nil
+}
+
+// installSpokeRoutes routes the virtual IP and subnet of an initiator through
+// the interface of its instance
+func installSpokeRoutes(t *Tunnel) error {
+	if t.Template == "" {
+		return nil
+	}
+	handle, err := linkHandle(t)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	for _, destination := range slices.Compact([]string{t.VirtualIP, t.RemoteSubnet}) {
+		if destination == "" {
+			continue
+		}
+		if err := network.SetSpokeRoute(handle, t.Interface(), destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
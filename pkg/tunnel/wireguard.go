@@ -0,0 +1,370 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/crypto"
+	"github.com/dzakwan/ipsec-vpn/pkg/keys"
+	"github.com/dzakwan/ipsec-vpn/pkg/network"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Tunnel modes. An IPsec tunnel is carried by GRE and protected by XFRM; a
+// WireGuard tunnel is a kernel WireGuard interface with the peer as its only peer.
+const (
+	ModeIPsec     = "ipsec"
+	ModeWireGuard = "wireguard"
+)
+
+// WireGuardEncryption is the only cipher WireGuard uses
+const WireGuardEncryption = "chacha20poly1305"
+
+// DefaultWireGuardPort is the UDP port WireGuard tunnels use unless configured otherwise.
+// Both ends of a tunnel listen on the same port.
+const DefaultWireGuardPort = 51820
+
+// wireGuardKeepalive keeps NAT mappings towards the peer open, in seconds
+const wireGuardKeepalive = 25
+
+// WireGuard generic netlink interface, see include/uapi/linux/wireguard.h
+const (
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+
+	wgCmdGetDevice = 0
+	wgCmdSetDevice = 1
+
+	wgDeviceIfname     = 2
+	wgDevicePrivateKey = 3
+	wgDeviceFlags      = 5
+	wgDeviceListenPort = 6
+	wgDevicePeers      = 8
+
+	wgDeviceReplacePeers = 1 << 0
+
+	wgPeerPublicKey     = 1
+	wgPeerPresharedKey  = 2
+	wgPeerFlags         = 3
+	wgPeerEndpoint      = 4
+	wgPeerKeepalive     = 5
+	wgPeerLastHandshake = 6
+	wgPeerRxBytes       = 7
+	wgPeerTxBytes       = 8
+	wgPeerAllowedIPs    = 9
+
+	wgPeerReplaceAllowedIPs = 1 << 1
+
+	wgAllowedIPFamily = 1
+	wgAllowedIPAddr   = 2
+	wgAllowedIPMask   = 3
+)
+
+// Interface returns the name of the interface carrying the tunnel
+func (t *Tunnel) Interface() string {
+	if t.Mode == ModeWireGuard {
+		return "wg-" + t.Name
+	}
+	return InterfaceName(t.Name)
+}
+
+// ParseWireGuardKey decodes a WireGuard public key in the base64 form used by wg(8)
+func ParseWireGuardKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid WireGuard key: %s", s)
+	}
+	return key, nil
+}
+
+// wireGuardKeyName is the name of the stored key pair of a WireGuard tunnel
+func wireGuardKeyName(tunnel string) string {
+	return "wg-" + tunnel
+}
+
+// wireGuardKey returns the key pair of a WireGuard tunnel, generating it the first
+// time. The key is kept when the tunnel is deleted so that a tunnel created again
+// under the same name keeps the public key its peer knows.
+func wireGuardKey(tunnel string) (*keys.Key, error) {
+	name := wireGuardKeyName(tunnel)
+	key, err := keys.Get(name)
+	if err != nil {
+		return keys.Generate(name, keys.TypeKeyPair, crypto.AlgorithmX25519, 0, 0, nil)
+	}
+	if key.Algorithm != crypto.AlgorithmX25519 {
+		return nil, fmt.Errorf("key '%s' is not an %s key pair", name, crypto.AlgorithmX25519)
+	}
+	return key, nil
+}
+
+// WireGuardPublicKey returns the public key of a WireGuard tunnel in the form the
+// peer needs for its configuration
+func WireGuardPublicKey(name string) (string, error) {
+	key, err := keys.Get(wireGuardKeyName(name))
+	if err != nil {
+		return "", err
+	}
+	public, err := key.PublicBytes()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(public), nil
+}
+
+// PrepareWireGuardKey returns the public key of the WireGuard tunnel that is
+// to be created under a name, generating its key pair if it has none yet, so
+// that the peer can be given it before the tunnel exists
+func PrepareWireGuardKey(name string) (string, error) {
+	if _, err := wireGuardKey(name); err != nil {
+		return "", err
+	}
+	return WireGuardPublicKey(name)
+}
+
+// createWireGuardInterface creates and configures the WireGuard interface of a
+// tunnel. The interface is configured before it can be moved to the tunnel's
+// namespace, so its UDP socket stays in the namespace it was created in.
+func createWireGuardInterface(tunnel *Tunnel) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("must run as root to create WireGuard interfaces")
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = tunnel.Interface()
+	link := &netlink.Wireguard{LinkAttrs: attrs}
+	if err := network.Busy(func() error { return netlink.LinkAdd(link) }); err != nil {
+		return fmt.Errorf("failed to create WireGuard interface: %v", err)
+	}
+
+	if err := configureWireGuard(tunnel); err != nil {
+		_ = netlink.LinkDel(link)
+		return err
+	}
+
+	if err := network.Busy(func() error { return netlink.LinkSetUp(link) }); err != nil {
+		_ = netlink.LinkDel(link)
+		return fmt.Errorf("failed to bring WireGuard interface up: %v", err)
+	}
+	return nil
+}
+
+// deleteWireGuardInterface deletes the WireGuard interface of a tunnel
+func deleteWireGuardInterface(tunnel *Tunnel) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("must run as root to delete WireGuard interfaces")
+	}
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	link, err := handle.LinkByName(tunnel.Interface())
+	if err != nil {
+		return nil // Interface doesn't exist, nothing to delete
+	}
+	if err := handle.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete WireGuard interface: %v", err)
+	}
+	return nil
+}
+
+// setWireGuardLink brings the WireGuard interface of a tunnel up or down
+func setWireGuardLink(tunnel *Tunnel, up bool) error {
+	handle, err := linkHandle(tunnel)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	link, err := handle.LinkByName(tunnel.Interface())
+	if err != nil {
+		return fmt.Errorf("WireGuard interface %s not found: %v", tunnel.Interface(), err)
+	}
+	if up {
+		return handle.LinkSetUp(link)
+	}
+	return handle.LinkSetDown(link)
+}
+
+// configureWireGuard sets the private key, listen port and peer of the tunnel's
+// WireGuard interface, with the pre-shared key its reference points to if it
+// has one, replacing any previous configuration
+func configureWireGuard(tunnel *Tunnel) error {
+	key, err := wireGuardKey(tunnel.Name)
+	if err != nil {
+		return err
+	}
+	private, err := key.Material(nil)
+	if err != nil {
+		return err
+	}
+	defer crypto.Zeroize(private)
+
+	peer, err := ParseWireGuardKey(tunnel.WireGuardPeerKey)
+	if err != nil {
+		return err
+	}
+
+	psk, err := resolvePSK(tunnel)
+	if err != nil {
+		return err
+	}
+	defer crypto.Zeroize(psk)
+	if psk != nil && len(psk) != 32 {
+		return fmt.Errorf("a WireGuard pre-shared key must be 32 bytes, the one %s points to is %d", tunnel.PSKRef, len(psk))
+	}
+
+	attrs, err := wireGuardDeviceAttrs(tunnel, private, peer, psk)
+	if err != nil {
+		return err
+	}
+
+	family, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return fmt.Errorf("WireGuard is not available in this kernel: %v", err)
+	}
+	req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: wgCmdSetDevice, Version: wgGenlVersion})
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	if _, err := req.Execute(unix.NETLINK_GENERIC, 0); err != nil {
+		return fmt.Errorf("failed to configure WireGuard interface: %v", err)
+	}
+
+	tunnelLog.Debug("Configured WireGuard interface", "interface", tunnel.Interface(), "peer", net.JoinHostPort(tunnel.RemoteIP, strconv.Itoa(tunnel.ListenPort)))
+	return nil
+}
+
+// wireGuardDeviceAttrs builds the attributes of a WG_CMD_SET_DEVICE message for a
+// tunnel: the remote IP as the peer's endpoint on the tunnel's port, and the
+// remote subnet as the only addresses the peer may send from, with a pre-shared
+// key unless psk is nil
+func wireGuardDeviceAttrs(tunnel *Tunnel, private, peer, psk []byte) ([]*nl.RtAttr, error) {
+	endpoint, err := sockaddr(tunnel.RemoteIP, tunnel.ListenPort)
+	if err != nil {
+		return nil, err
+	}
+	_, remote, err := net.ParseCIDR(tunnel.RemoteSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote subnet: %v", err)
+	}
+	family, addr := uint16(unix.AF_INET), remote.IP.To4()
+	if addr == nil {
+		family, addr = unix.AF_INET6, remote.IP.To16()
+	}
+	ones, _ := remote.Mask.Size()
+
+	peers := nl.NewRtAttr(wgDevicePeers|int(nl.NLA_F_NESTED), nil)
+	p := peers.AddRtAttr(0|int(nl.NLA_F_NESTED), nil)
+	p.AddRtAttr(wgPeerPublicKey, peer)
+	if psk != nil {
+		p.AddRtAttr(wgPeerPresharedKey, psk)
+	}
+	p.AddRtAttr(wgPeerFlags, nl.Uint32Attr(wgPeerReplaceAllowedIPs))
+	p.AddRtAttr(wgPeerEndpoint, endpoint)
+	p.AddRtAttr(wgPeerKeepalive, nl.Uint16Attr(wireGuardKeepalive))
+	allowed := p.AddRtAttr(wgPeerAllowedIPs|int(nl.NLA_F_NESTED), nil)
+	ip := allowed.AddRtAttr(0|int(nl.NLA_F_NESTED), nil)
+	ip.AddRtAttr(wgAllowedIPFamily, nl.Uint16Attr(family))
+	ip.AddRtAttr(wgAllowedIPAddr, addr)
+	ip.AddRtAttr(wgAllowedIPMask, nl.Uint8Attr(uint8(ones)))
+
+	return []*nl.RtAttr{
+		nl.NewRtAttr(wgDeviceIfname, nl.ZeroTerminated(tunnel.Interface())),
+		nl.NewRtAttr(wgDevicePrivateKey, private),
+		nl.NewRtAttr(wgDeviceListenPort, nl.Uint16Attr(uint16(tunnel.ListenPort))),
+		nl.NewRtAttr(wgDeviceFlags, nl.Uint32Attr(wgDeviceReplacePeers)),
+		peers,
+	}, nil
+}
+
+// sockaddr encodes an address and port as a struct sockaddr_in or sockaddr_in6
+func sockaddr(ip string, port int) ([]byte, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", ip)
+	}
+	if v4 := addr.To4(); v4 != nil {
+		b := make([]byte, 16)
+		nl.NativeEndian().PutUint16(b[0:], unix.AF_INET)
+		binary.BigEndian.PutUint16(b[2:], uint16(port))
+		copy(b[4:], v4)
+		return b, nil
+	}
+	b := make([]byte, 28)
+	nl.NativeEndian().PutUint16(b[0:], unix.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:], uint16(port))
+	copy(b[8:], addr.To16())
+	return b, nil
+}
+
+// wireGuardStats reads the traffic counters and last handshake of the peer of a
+// WireGuard tunnel from the kernel
+func wireGuardStats(tunnel *Tunnel) (*Stats, error) {
+	var msgs [][]byte
+	err := inNamespace(tunnel, func() error {
+		family, err := netlink.GenlFamilyGet(wgGenlName)
+		if err != nil {
+			return fmt.Errorf("WireGuard is not available in this kernel: %v", err)
+		}
+		req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_DUMP)
+		req.AddData(&nl.Genlmsg{Command: wgCmdGetDevice, Version: wgGenlVersion})
+		req.AddData(nl.NewRtAttr(wgDeviceIfname, nl.ZeroTerminated(tunnel.Interface())))
+		msgs, err = req.Execute(unix.NETLINK_GENERIC, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{}
+	for _, msg := range msgs {
+		if len(msg) < nl.SizeofGenlmsg {
+			return nil, errors.New("short WireGuard device message")
+		}
+		parseWireGuardDevice(msg[nl.SizeofGenlmsg:], stats)
+	}
+	return stats, nil
+}
+
+// parseWireGuardDevice adds up the counters of the peers in the attributes of a
+// WG_CMD_GET_DEVICE reply, keeping the most recent handshake
+func parseWireGuardDevice(data []byte, stats *Stats) {
+	native := nl.NativeEndian()
+	for attr := range nl.ParseAttributes(data) {
+		if attr.Type&nl.NLA_TYPE_MASK != wgDevicePeers {
+			continue
+		}
+		for peer := range nl.ParseAttributes(attr.Value) {
+			for a := range nl.ParseAttributes(peer.Value) {
+				switch a.Type & nl.NLA_TYPE_MASK {
+				case wgPeerRxBytes:
+					stats.RxBytes += native.Uint64(a.Value)
+				case wgPeerTxBytes:
+					stats.TxBytes += native.Uint64(a.Value)
+				case wgPeerLastHandshake:
+					if len(a.Value) < 16 {
+						continue
+					}
+					sec, nsec := int64(native.Uint64(a.Value[0:])), int64(native.Uint64(a.Value[8:]))
+					if sec == 0 && nsec == 0 {
+						continue
+					}
+					if t := time.Unix(sec, nsec); t.After(stats.LastHandshake) {
+						stats.LastHandshake = t
+					}
+				}
+			}
+		}
+	}
+}
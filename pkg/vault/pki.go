@@ -0,0 +1,132 @@
+package vault
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dzakwan/ipsec-vpn/pkg/events"
+	"github.com/dzakwan/ipsec-vpn/pkg/logger"
+)
+
+// Retry intervals for failed certificate renewals
+const (
+	minRetry = 5 * time.Second
+	maxRetry = 5 * time.Minute
+)
+
+// Certificate is a certificate and private key issued by the PKI secrets engine
+type Certificate struct {
+	Certificate    *x509.Certificate
+	CertificatePEM string // Leaf followed by the issuing chain
+	PrivateKeyPEM  string
+	CAChainPEM     string
+	SerialNumber   string
+}
+
+// renewAt returns when a certificate should be replaced: after two thirds of its
+// lifetime, leaving the rest to retry if Vault is unreachable
+func (c *Certificate) renewAt() time.Time {
+	notBefore, notAfter := c.Certificate.NotBefore, c.Certificate.NotAfter
+	return notBefore.Add(notAfter.Sub(notBefore) * 2 / 3)
+}
+
+// IssueCertificate issues a certificate for a common name from vault.pki_role,
+// valid for vault.certificate_ttl. The private key is generated by Vault and not
+// stored there.
+func (c *Client) IssueCertificate(ctx context.Context, commonName string) (*Certificate, error) {
+	if c.pkiRole == "" {
+		return nil, errors.New("no PKI role configured, set vault.pki_role")
+	}
+
+	request := map[string]any{"common_name": commonName}
+	if c.ttl > 0 {
+		request["ttl"] = c.ttl.String()
+	}
+	var data struct {
+		Certificate  string   `json:"certificate"`
+		PrivateKey   string   `json:"private_key"`
+		IssuingCA    string   `json:"issuing_ca"`
+		CAChain      []string `json:"ca_chain"`
+		SerialNumber string   `json:"serial_number"`
+	}
+	if err := c.do(ctx, http.MethodPost, c.pkiMount+"/issue/"+c.pkiRole, request, &data); err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(data.Certificate))
+	if block == nil {
+		return nil, errors.New("Vault returned no certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Vault returned an invalid certificate: %v", err)
+	}
+	if data.PrivateKey == "" {
+		return nil, errors.New("Vault returned no private key")
+	}
+
+	chain := data.CAChain
+	if len(chain) == 0 && data.IssuingCA != "" {
+		chain = []string{data.IssuingCA}
+	}
+	caChain := strings.Join(chain, "\n")
+	return &Certificate{
+		Certificate:    cert,
+		CertificatePEM: strings.TrimSpace(data.Certificate) + "\n" + caChain,
+		PrivateKeyPEM:  data.PrivateKey,
+		CAChainPEM:     caChain,
+		SerialNumber:   data.SerialNumber,
+	}, nil
+}
+
+// WatchCertificate issues a certificate and passes it to update, then issues a
+// new one each time two thirds of the current one's lifetime have passed, until
+// the context is cancelled. The token is renewed along with it. Failures are
+// retried with backoff, and the first failure to renew a certificate publishes
+// a certificate.expiring event.
+func (c *Client) WatchCertificate(ctx context.Context, commonName string, update func(*Certificate)) error {
+	retry := minRetry
+	next := time.Now()
+	var current *Certificate
+	warned := false
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(next)):
+		}
+
+		if err := c.RenewToken(ctx); err != nil && ctx.Err() == nil {
+			logger.Error("Failed to renew Vault token: %v", err)
+		}
+		cert, err := c.IssueCertificate(ctx, commonName)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			logger.Error("Failed to issue certificate for %s, retrying in %v: %v", commonName, retry, err)
+			if current != nil && !warned {
+				warned = true
+				e := events.New(events.TypeCertificateExpiring, "")
+				e.Expires = &current.Certificate.NotAfter
+				e.Reason = fmt.Sprintf("renewing the certificate for %s failed: %v", commonName, err)
+				events.Publish(e)
+			}
+			next = time.Now().Add(retry)
+			retry = min(2*retry, maxRetry)
+			continue
+		}
+
+		retry = minRetry
+		current, warned = cert, false
+		next = cert.renewAt()
+		logger.Info("Issued certificate %s for %s, valid until %s", cert.SerialNumber, commonName, cert.Certificate.NotAfter.Format(time.RFC3339))
+		update(cert)
+	}
+}
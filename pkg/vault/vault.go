@@ -0,0 +1,273 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Environment variables, as used by the vault CLI
+const (
+	AddressEnv   = "VAULT_ADDR"
+	TokenEnv     = "VAULT_TOKEN"
+	NamespaceEnv = "VAULT_NAMESPACE"
+)
+
+// requestTimeout bounds a single Vault request
+const requestTimeout = 30 * time.Second
+
+// MinPSKSize is the shortest pre-shared key accepted
+const MinPSKSize = 16
+
+var (
+	// ErrNotConfigured is returned when no Vault address is set
+	ErrNotConfigured = errors.New("no Vault address configured, set vault.address or " + AddressEnv)
+	// ErrNotFound is returned for secrets that do not exist
+	ErrNotFound = errors.New("not found in Vault")
+)
+
+// Client talks to the HashiCorp Vault HTTP API
+type Client struct {
+	address   string
+	token     string
+	namespace string
+	http      *http.Client
+
+	kvMount   string
+	kvVersion int
+	pkiMount  string
+	pkiRole   string
+	ttl       time.Duration
+}
+
+// Address returns the Vault server address
+func Address() string {
+	if addr := os.Getenv(AddressEnv); addr != "" {
+		return addr
+	}
+	return viper.GetString("vault.address")
+}
+
+// FromConfig creates a client from the vault settings, with the address, token
+// and namespace overridable through the environment like the vault CLI
+func FromConfig() (*Client, error) {
+	address := Address()
+	if address == "" {
+		return nil, ErrNotConfigured
+	}
+	if _, err := url.ParseRequestURI(address); err != nil {
+		return nil, fmt.Errorf("invalid Vault address %q: %v", address, err)
+	}
+
+	token, err := loadToken()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if path := viper.GetString("vault.ca_cert"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", path)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	namespace := os.Getenv(NamespaceEnv)
+	if namespace == "" {
+		namespace = viper.GetString("vault.namespace")
+	}
+
+	return &Client{
+		address:   strings.TrimRight(address, "/"),
+		token:     token,
+		namespace: namespace,
+		http:      &http.Client{Transport: transport, Timeout: requestTimeout},
+		kvMount:   viper.GetString("vault.kv_mount"),
+		kvVersion: viper.GetInt("vault.kv_version"),
+		pkiMount:  viper.GetString("vault.pki_mount"),
+		pkiRole:   viper.GetString("vault.pki_role"),
+		ttl:       time.Duration(viper.GetInt("vault.certificate_ttl")) * time.Second,
+	}, nil
+}
+
+// loadToken returns the Vault token from the environment, vault.token_file, or
+// the token helper file the vault CLI writes on login
+func loadToken() (string, error) {
+	if token := os.Getenv(TokenEnv); token != "" {
+		return token, nil
+	}
+	path := viper.GetString("vault.token_file")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", errors.New("no Vault token, set " + TokenEnv + " or vault.token_file")
+		}
+		path = filepath.Join(home, ".vault-token")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("no Vault token, set %s or vault.token_file: %v", TokenEnv, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// do sends a request to the Vault API and decodes the response's data field
+func (c *Client) do(ctx context.Context, method, path string, body, data any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.address+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+	req.Header.Set("X-Vault-Request", "true")
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid response from Vault (HTTP %d): %v", resp.StatusCode, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && len(result.Errors) == 0:
+		return fmt.Errorf("%s: %w", path, ErrNotFound)
+	case resp.StatusCode >= 300:
+		if len(result.Errors) == 0 {
+			return fmt.Errorf("Vault returned HTTP %d for %s", resp.StatusCode, path)
+		}
+		return fmt.Errorf("Vault returned HTTP %d for %s: %s", resp.StatusCode, path, strings.Join(result.Errors, "; "))
+	}
+	if data != nil && len(result.Data) > 0 {
+		return json.Unmarshal(result.Data, data)
+	}
+	return nil
+}
+
+// ReadPSK reads a pre-shared key from the KV secrets engine. The reference is a
+// path within vault.kv_mount, optionally followed by #field; the field defaults
+// to psk and holds the key encoded in base64.
+func (c *Client) ReadPSK(ctx context.Context, ref string) ([]byte, error) {
+	path, field, _ := strings.Cut(ref, "#")
+	if field == "" {
+		field = "psk"
+	}
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, fmt.Errorf("invalid secret reference %q", ref)
+	}
+
+	var values map[string]any
+	if c.kvVersion == 1 {
+		if err := c.do(ctx, http.MethodGet, c.kvMount+"/"+path, nil, &values); err != nil {
+			return nil, err
+		}
+	} else {
+		var secret struct {
+			Data map[string]any `json:"data"`
+		}
+		if err := c.do(ctx, http.MethodGet, c.kvMount+"/data/"+path, nil, &secret); err != nil {
+			return nil, err
+		}
+		// A deleted latest version reads as null data
+		if secret.Data == nil {
+			return nil, fmt.Errorf("%s: %w", path, ErrNotFound)
+		}
+		values = secret.Data
+	}
+
+	encoded, ok := values[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no field %q", path, field)
+	}
+	psk, err := DecodeKey(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("field %q of secret %s: %v", field, path, err)
+	}
+	if len(psk) < MinPSKSize {
+		return nil, fmt.Errorf("pre-shared key in %s is %d bytes, expected at least %d", path, len(psk), MinPSKSize)
+	}
+	return psk, nil
+}
+
+// DecodeKey decodes standard or URL-safe base64, padded or not
+func DecodeKey(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// TokenInfo describes the token the client authenticates with
+type TokenInfo struct {
+	DisplayName string        `json:"display_name"`
+	Policies    []string      `json:"policies"`
+	Renewable   bool          `json:"renewable"`
+	TTL         time.Duration `json:"-"`
+}
+
+// LookupToken returns information about the client's token
+func (c *Client) LookupToken(ctx context.Context) (*TokenInfo, error) {
+	var data struct {
+		TokenInfo
+		TTL int64 `json:"ttl"`
+	}
+	if err := c.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, &data); err != nil {
+		return nil, err
+	}
+	info := data.TokenInfo
+	info.TTL = time.Duration(data.TTL) * time.Second
+	return &info, nil
+}
+
+// RenewToken extends the lease of the client's token if it is renewable and
+// expires. Tokens without a TTL, such as root tokens, are left alone.
+func (c *Client) RenewToken(ctx context.Context) error {
+	info, err := c.LookupToken(ctx)
+	if err != nil {
+		return err
+	}
+	if !info.Renewable || info.TTL == 0 {
+		return nil
+	}
+	return c.do(ctx, http.MethodPost, "auth/token/renew-self", struct{}{}, nil)
+}